@@ -21,6 +21,7 @@ import (
 	"github.com/tiglabs/containerfs/fuse"
 
 	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/sdk/data/stream"
 )
 
 const (
@@ -48,13 +49,32 @@ const (
 )
 
 const (
-	DentryValidDuration = 5 * time.Second
+	DentryValidDuration       = 5 * time.Second
+	LeasedDentryValidDuration = 120 * time.Second //the changes of the other clients are notified by the leases
+)
+
+// Cache durations of an immutable vol, whose metadata and data never change.
+const (
+	ImmutableValidDuration = 365 * 24 * time.Hour
 )
 
 const (
 	DeleteExtentsTimeout = 600 * time.Second
 )
 
+// The xattr of a file taking the posix_fadvise hints.
+const (
+	FadviseXattr = "user.cfs.fadvise"
+)
+
+var fadviseNames = map[string]int{
+	"normal":     stream.AdviceNormal,
+	"sequential": stream.AdviceSequential,
+	"random":     stream.AdviceRandom,
+	"willneed":   stream.AdviceWillNeed,
+	"dontneed":   stream.AdviceDontNeed,
+}
+
 func ParseError(err error) fuse.Errno {
 	switch v := err.(type) {
 	case syscall.Errno:
@@ -15,53 +15,206 @@
 package fs
 
 import (
+	"container/list"
 	"sync"
 	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+const (
+	DefaultMaxDentryCache = 1000000
 )
 
+type dentryKey struct {
+	parent uint64
+	name   string
+}
+
+// a looked up dentry, ino 0 if the name does not exist
+type dentryEntry struct {
+	key        dentryKey
+	ino        uint64
+	expiration time.Time
+}
+
+// the children of a dir read by a readdir
+type dirEntry struct {
+	parent     uint64
+	children   []proto.Dentry
+	index      map[string]int
+	expiration time.Time
+}
+
+// DentryCache keeps the lookups and the readdirs of all the dirs for valid,
+// the names changed by the other clients are seen at most valid later, or at
+// the next renew of the leases when the client has them. The changes through
+// this client invalidate the entries of their dirs. A readdir counts as many
+// elements as its children, the least recently used entries are evicted
+// beyond maxElements.
 type DentryCache struct {
 	sync.Mutex
-	cache      map[string]uint64
-	expiration time.Time
+	valid       time.Duration
+	maxElements int
+	elements    int
+	lruList     *list.List
+	dentries    map[dentryKey]*list.Element
+	dirs        map[uint64]*list.Element
+	names       map[uint64]map[string]bool // the looked up names by dir
 }
 
-func NewDentryCache() *DentryCache {
+func NewDentryCache(valid time.Duration, maxElements int) *DentryCache {
 	return &DentryCache{
-		cache:      make(map[string]uint64),
-		expiration: time.Now().Add(DentryValidDuration),
+		valid:       valid,
+		maxElements: maxElements,
+		lruList:     list.New(),
+		dentries:    make(map[dentryKey]*list.Element),
+		dirs:        make(map[uint64]*list.Element),
+		names:       make(map[uint64]map[string]bool),
 	}
 }
 
-func (dc *DentryCache) Put(name string, ino uint64) {
-	if dc == nil {
+// Put caches the lookup of name in parent, ino 0 caches that it does not exist.
+func (dc *DentryCache) Put(parent uint64, name string, ino uint64) {
+	if dc == nil || dc.valid <= 0 {
 		return
 	}
 	dc.Lock()
 	defer dc.Unlock()
-	dc.cache[name] = ino
-	dc.expiration = time.Now().Add(DentryValidDuration)
+	key := dentryKey{parent: parent, name: name}
+	if old, ok := dc.dentries[key]; ok {
+		dc.remove(old)
+	}
+	dc.dentries[key] = dc.lruList.PushFront(&dentryEntry{key: key, ino: ino, expiration: time.Now().Add(dc.valid)})
+	if dc.names[parent] == nil {
+		dc.names[parent] = make(map[string]bool)
+	}
+	dc.names[parent][name] = true
+	dc.elements++
+	dc.evict()
 }
 
-func (dc *DentryCache) Get(name string) (uint64, bool) {
+// Get returns the cached lookup of name in parent, from the readdir of parent
+// if the name was not looked up. ok is false if neither is cached.
+func (dc *DentryCache) Get(parent uint64, name string) (ino uint64, ok bool) {
 	if dc == nil {
 		return 0, false
 	}
+	dc.Lock()
+	defer dc.Unlock()
+	now := time.Now()
+	if element, found := dc.dentries[dentryKey{parent: parent, name: name}]; found {
+		entry := element.Value.(*dentryEntry)
+		if entry.expiration.After(now) {
+			dc.lruList.MoveToFront(element)
+			return entry.ino, true
+		}
+		dc.remove(element)
+	}
+	if element, found := dc.dirs[parent]; found {
+		dir := element.Value.(*dirEntry)
+		if dir.expiration.After(now) {
+			dc.lruList.MoveToFront(element)
+			if i, exist := dir.index[name]; exist {
+				return dir.children[i].Inode, true
+			}
+			return 0, true
+		}
+		dc.remove(element)
+	}
+	return 0, false
+}
 
+// PutDir caches the children of parent read by a readdir.
+func (dc *DentryCache) PutDir(parent uint64, children []proto.Dentry) {
+	if dc == nil || dc.valid <= 0 || len(children) > dc.maxElements {
+		return
+	}
 	dc.Lock()
 	defer dc.Unlock()
-	if dc.expiration.Before(time.Now()) {
-		dc.cache = make(map[string]uint64)
-		return 0, false
+	if old, ok := dc.dirs[parent]; ok {
+		dc.remove(old)
+	}
+	dir := &dirEntry{parent: parent, children: children, index: make(map[string]int, len(children)),
+		expiration: time.Now().Add(dc.valid)}
+	for i, child := range children {
+		dir.index[child.Name] = i
 	}
-	ino, ok := dc.cache[name]
-	return ino, ok
+	dc.dirs[parent] = dc.lruList.PushFront(dir)
+	dc.elements += len(children)
+	dc.evict()
 }
 
-func (dc *DentryCache) Delete(name string) {
+// GetDir returns the cached readdir of parent.
+func (dc *DentryCache) GetDir(parent uint64) (children []proto.Dentry, ok bool) {
+	if dc == nil {
+		return nil, false
+	}
+	dc.Lock()
+	defer dc.Unlock()
+	element, found := dc.dirs[parent]
+	if !found {
+		return nil, false
+	}
+	dir := element.Value.(*dirEntry)
+	if !dir.expiration.After(time.Now()) {
+		dc.remove(element)
+		return nil, false
+	}
+	dc.lruList.MoveToFront(element)
+	return dir.children, true
+}
+
+// Invalidate drops the lookup of name and the readdir of parent, it is called
+// once parent is changed by this client or the change of another is notified.
+func (dc *DentryCache) Invalidate(parent uint64, name string) {
+	if dc == nil {
+		return
+	}
+	dc.Lock()
+	defer dc.Unlock()
+	if element, ok := dc.dentries[dentryKey{parent: parent, name: name}]; ok {
+		dc.remove(element)
+	}
+	if element, ok := dc.dirs[parent]; ok {
+		dc.remove(element)
+	}
+}
+
+// InvalidateDir drops the lookups and the readdir of parent, it is called
+// once the change of parent by another client is notified.
+func (dc *DentryCache) InvalidateDir(parent uint64) {
 	if dc == nil {
 		return
 	}
 	dc.Lock()
 	defer dc.Unlock()
-	delete(dc.cache, name)
+	for name := range dc.names[parent] {
+		dc.remove(dc.dentries[dentryKey{parent: parent, name: name}])
+	}
+	if element, ok := dc.dirs[parent]; ok {
+		dc.remove(element)
+	}
+}
+
+/*the caller must hold the lock of dc*/
+func (dc *DentryCache) remove(element *list.Element) {
+	switch entry := dc.lruList.Remove(element).(type) {
+	case *dentryEntry:
+		delete(dc.dentries, entry.key)
+		if delete(dc.names[entry.key.parent], entry.key.name); len(dc.names[entry.key.parent]) == 0 {
+			delete(dc.names, entry.key.parent)
+		}
+		dc.elements--
+	case *dirEntry:
+		delete(dc.dirs, entry.parent)
+		dc.elements -= len(entry.children)
+	}
+}
+
+/*the caller must hold the lock of dc*/
+func (dc *DentryCache) evict() {
+	for dc.elements > dc.maxElements {
+		dc.remove(dc.lruList.Back())
+	}
 }
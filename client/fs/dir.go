@@ -16,6 +16,7 @@ package fs
 
 import (
 	"os"
+	"path"
 	"syscall"
 	"time"
 
@@ -24,13 +25,18 @@ import (
 	"golang.org/x/net/context"
 
 	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/sdk/meta"
+	"github.com/tiglabs/containerfs/util/audit"
 	"github.com/tiglabs/containerfs/util/log"
+	"github.com/tiglabs/containerfs/util/trace"
 )
 
 type Dir struct {
-	super  *Super
-	inode  *Inode
-	dcache *DentryCache
+	super *Super
+	inode *Inode
+	// the path of the dir in the vol it was looked up by, stale once the dir
+	// or one of its parents is renamed
+	path string
 }
 
 //functions that Dir needs to implement
@@ -42,7 +48,7 @@ var (
 	_ fs.NodeRemover         = (*Dir)(nil)
 	_ fs.NodeFsyncer         = (*Dir)(nil)
 	_ fs.NodeRequestLookuper = (*Dir)(nil)
-	_ fs.HandleReadDirAller  = (*Dir)(nil)
+	_ fs.HandleReadDirPager  = (*Dir)(nil)
 	_ fs.NodeRenamer         = (*Dir)(nil)
 	_ fs.NodeSetattrer       = (*Dir)(nil)
 	_ fs.NodeSymlinker       = (*Dir)(nil)
@@ -50,15 +56,24 @@ var (
 	_ fs.NodeListxattrer     = (*Dir)(nil)
 	_ fs.NodeSetxattrer      = (*Dir)(nil)
 	_ fs.NodeRemovexattrer   = (*Dir)(nil)
+	_ fs.HandleLocker        = (*Dir)(nil)
+	_ fs.HandleReleaser      = (*Dir)(nil)
 )
 
-func NewDir(s *Super, i *Inode) *Dir {
+func NewDir(s *Super, i *Inode, path string) *Dir {
 	return &Dir{
 		super: s,
 		inode: i,
+		path:  path,
 	}
 }
 
+// pathContext returns ctx carrying the path of the dir, the meta nodes audit
+// the dentry ops of the dir with the paths of the dentries.
+func (d *Dir) pathContext(ctx context.Context) context.Context {
+	return meta.NewDirPathContext(ctx, d.inode.ino, d.path)
+}
+
 func (d *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
 	ino := d.inode.ino
 	inode, err := d.super.InodeGet(ino)
@@ -67,14 +82,21 @@ func (d *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
 		return ParseError(err)
 	}
 	inode.fillAttr(a)
+	a.Valid = d.super.attrValid()
 	log.LogDebugf("TRACE Attr: inode(%v)", inode)
 	return nil
 }
 
 func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
 	start := time.Now()
-	info, err := d.super.mw.Create_ll(d.inode.ino, req.Name, proto.Mode(req.Mode.Perm()), nil)
+	span := d.super.startSpan("fs.create", d.inode.ino, req.Name)
+	defer span.End()
+	uid, gid, mode := d.super.newOwner(d.inode.ino, req.Header, req.Mode.Perm())
+	ctx = d.super.callerContext(d.pathContext(trace.NewContext(ctx, span)), req.Header)
+	info, err := d.super.mw.CreateContext_ll(ctx, d.inode.ino, req.Name, proto.Mode(mode), uid, gid, nil)
+	d.super.dc.Invalidate(d.inode.ino, req.Name)
 	if err != nil {
+		span.SetError(err)
 		log.LogErrorf("Create: parent(%v) req(%v) err(%v)", d.inode.ino, req, err)
 		return nil, nil, ParseError(err)
 	}
@@ -84,6 +106,9 @@ func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.Cr
 	child := NewFile(d.super, inode)
 	d.super.ec.OpenForWrite(inode.ino, 0)
 
+	if d.super.auditor != nil {
+		d.super.auditor.Log(start, &audit.Entry{Op: audit.OpCreate, Ino: d.inode.ino, Name: req.Name, NewIno: inode.ino})
+	}
 	elapsed := time.Since(start)
 	log.LogDebugf("TRACE Create: parent(%v) req(%v) resp(%v) ino(%v) (%v)ns", d.inode.ino, req, resp, inode.ino, elapsed.Nanoseconds())
 	return child, child, nil
@@ -94,16 +119,25 @@ func (d *Dir) Forget() {
 
 func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
 	start := time.Now()
-	info, err := d.super.mw.Create_ll(d.inode.ino, req.Name, proto.Mode(os.ModeDir|req.Mode.Perm()), nil)
+	span := d.super.startSpan("fs.mkdir", d.inode.ino, req.Name)
+	defer span.End()
+	uid, gid, mode := d.super.newOwner(d.inode.ino, req.Header, os.ModeDir|req.Mode.Perm())
+	ctx = d.super.callerContext(d.pathContext(trace.NewContext(ctx, span)), req.Header)
+	info, err := d.super.mw.CreateContext_ll(ctx, d.inode.ino, req.Name, proto.Mode(mode), uid, gid, nil)
+	d.super.dc.Invalidate(d.inode.ino, req.Name)
 	if err != nil {
+		span.SetError(err)
 		log.LogErrorf("Mkdir: parent(%v) req(%v) err(%v)", d.inode.ino, req, err)
 		return nil, ParseError(err)
 	}
 
 	inode := NewInode(info)
 	d.super.ic.Put(inode)
-	child := NewDir(d.super, inode)
+	child := NewDir(d.super, inode, path.Join(d.path, req.Name))
 
+	if d.super.auditor != nil {
+		d.super.auditor.Log(start, &audit.Entry{Op: audit.OpMkdir, Ino: d.inode.ino, Name: req.Name, NewIno: inode.ino})
+	}
 	elapsed := time.Since(start)
 	log.LogDebugf("TRACE Mkdir: parent(%v) req(%v) ino(%v) (%v)ns", d.inode.ino, req, inode.ino, elapsed.Nanoseconds())
 	return child, nil
@@ -111,8 +145,8 @@ func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error
 
 func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 	start := time.Now()
-	d.dcache.Delete(req.Name)
-	info, err := d.super.mw.Delete_ll(d.inode.ino, req.Name)
+	info, err := d.super.mw.DeleteContext_ll(d.super.callerContext(d.pathContext(ctx), req.Header), d.inode.ino, req.Name)
+	d.super.dc.Invalidate(d.inode.ino, req.Name)
 	if err != nil {
 		log.LogErrorf("Remove: parent(%v) name(%v) err(%v)", d.inode.ino, req.Name, err)
 		return ParseError(err)
@@ -122,7 +156,14 @@ func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 		d.super.orphan.Put(info.Inode)
 		log.LogDebugf("Remove: add to orphan inode list, ino(%v)", info.Inode)
 	}
+	if info != nil {
+		// the other links of the inode see its new nlink
+		d.super.ic.Delete(info.Inode)
+	}
 
+	if d.super.auditor != nil {
+		d.super.auditor.Log(start, &audit.Entry{Op: audit.OpRemove, Ino: d.inode.ino, Name: req.Name})
+	}
 	elapsed := time.Since(start)
 	log.LogDebugf("TRACE Remove: parent(%v) req(%v) (%v)ns", d.inode.ino, req, elapsed.Nanoseconds())
 	return nil
@@ -139,20 +180,34 @@ func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.Lo
 	)
 
 	log.LogDebugf("TRACE Lookup: parent(%v) req(%v)", d.inode.ino, req)
+	start := time.Now()
 
-	ino, ok := d.dcache.Get(req.Name)
+	span := d.super.startSpan("fs.lookup", d.inode.ino, req.Name)
+	defer span.End()
+	ino, ok := d.super.dc.Get(d.inode.ino, req.Name)
+	span.SetAttribute("cached", ok)
+	if ok && ino == 0 {
+		return nil, fuse.ENOENT
+	}
 	if !ok {
-		ino, _, err = d.super.mw.Lookup_ll(d.inode.ino, req.Name)
+		ino, _, err = d.super.mw.LookupContext_ll(d.super.callerContext(trace.NewContext(ctx, span), req.Header), d.inode.ino, req.Name)
+		if err == syscall.ENOENT {
+			d.super.dc.Put(d.inode.ino, req.Name, 0)
+		}
 		if err != nil {
 			if err != syscall.ENOENT {
+				span.SetError(err)
 				log.LogErrorf("Lookup: parent(%v) name(%v) err(%v)", d.inode.ino, req.Name, err)
 			}
 			return nil, ParseError(err)
 		}
+		d.super.dc.Put(d.inode.ino, req.Name, ino)
 	}
 
 	inode, err := d.super.InodeGet(ino)
 	if err != nil {
+		// the cached dentry may be removed by another client
+		d.super.dc.Invalidate(d.inode.ino, req.Name)
 		log.LogErrorf("Lookup: parent(%v) name(%v) ino(%v) err(%v)", d.inode.ino, req.Name, ino, err)
 		return nil, ParseError(err)
 	}
@@ -160,26 +215,43 @@ func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.Lo
 
 	var child fs.Node
 	if mode.IsDir() {
-		child = NewDir(d.super, inode)
+		child = NewDir(d.super, inode, path.Join(d.path, req.Name))
 	} else {
 		child = NewFile(d.super, inode)
 	}
 
-	resp.EntryValid = LookupValidDuration
+	resp.EntryValid = d.super.entryValid()
+	if d.super.auditor != nil {
+		d.super.auditor.Log(start, &audit.Entry{Op: audit.OpLookup, Ino: d.inode.ino, Name: req.Name, NewIno: ino})
+	}
 	return child, nil
 }
 
-func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+// ReadDirPage reads the dir one page of dentries at a time as the kernel
+// reads it, a dir of one page is cached whole by the dentry cache.
+func (d *Dir) ReadDirPage(ctx context.Context, marker string) ([]fuse.Dirent, string, error) {
 	start := time.Now()
-	children, err := d.super.mw.ReadDir_ll(d.inode.ino)
-	if err != nil {
-		log.LogErrorf("Readdir: ino(%v) err(%v)", d.inode.ino, err)
-		return make([]fuse.Dirent, 0), ParseError(err)
+	var (
+		children []proto.Dentry
+		next     string
+		cached   bool
+	)
+	if marker == "" {
+		children, cached = d.super.dc.GetDir(d.inode.ino)
+	}
+	if !cached {
+		var err error
+		if children, next, err = d.super.mw.ReadDirLimit_ll(d.inode.ino, marker, meta.ReadDirLimit); err != nil {
+			log.LogErrorf("Readdir: ino(%v) marker(%v) err(%v)", d.inode.ino, marker, err)
+			return make([]fuse.Dirent, 0), "", ParseError(err)
+		}
+		if marker == "" && next == "" {
+			d.super.dc.PutDir(d.inode.ino, children)
+		}
 	}
 
 	inodes := make([]uint64, 0, len(children))
 	dirents := make([]fuse.Dirent, 0, len(children))
-	dcache := NewDentryCache()
 
 	for _, child := range children {
 		dentry := fuse.Dirent{
@@ -189,18 +261,23 @@ func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 		}
 		inodes = append(inodes, child.Inode)
 		dirents = append(dirents, dentry)
-		dcache.Put(child.Name, child.Inode)
 	}
 
-	infos := d.super.mw.BatchInodeGet(inodes)
-	for _, info := range infos {
-		d.super.ic.Put(NewInode(info))
+	// the inodes of a cached readdir are got by the lookups as they expire
+	if !cached {
+		infos := d.super.mw.BatchInodeGet(inodes)
+		for _, info := range infos {
+			d.super.ic.Put(NewInode(info))
+		}
 	}
-	d.dcache = dcache
 
+	// a readdir is recorded once, with the dentries of its first page
+	if marker == "" && d.super.auditor != nil {
+		d.super.auditor.Log(start, &audit.Entry{Op: audit.OpReadDir, Ino: d.inode.ino, Size: len(dirents)})
+	}
 	elapsed := time.Since(start)
-	log.LogDebugf("TRACE ReadDir: ino(%v) (%v)ns", d.inode.ino, elapsed.Nanoseconds())
-	return dirents, nil
+	log.LogDebugf("TRACE ReadDir: ino(%v) marker(%v) next(%v) cached(%v) (%v)ns", d.inode.ino, marker, next, cached, elapsed.Nanoseconds())
+	return dirents, next, nil
 }
 
 func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
@@ -210,13 +287,19 @@ func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Nod
 		return fuse.ENOTSUP
 	}
 	start := time.Now()
-	d.dcache.Delete(req.OldName)
-	err := d.super.mw.Rename_ll(d.inode.ino, req.OldName, dstDir.inode.ino, req.NewName)
+	ctx = dstDir.pathContext(d.pathContext(ctx))
+	err := d.super.mw.RenameContext_ll(d.super.callerContext(ctx, req.Header), d.inode.ino, req.OldName, dstDir.inode.ino, req.NewName)
+	d.super.dc.Invalidate(d.inode.ino, req.OldName)
+	d.super.dc.Invalidate(dstDir.inode.ino, req.NewName)
 	if err != nil {
 		log.LogErrorf("Rename: parent(%v) req(%v) err(%v)", d.inode.ino, req, err)
 		return ParseError(err)
 	}
 
+	if d.super.auditor != nil {
+		d.super.auditor.Log(start, &audit.Entry{Op: audit.OpRename, Ino: d.inode.ino, Name: req.OldName,
+			NewIno: dstDir.inode.ino, NewName: req.NewName})
+	}
 	elapsed := time.Since(start)
 	log.LogDebugf("TRACE Rename: SrcParent(%v) OldName(%v) DstParent(%v) NewName(%v) (%v)ns", d.inode.ino, req.OldName, dstDir.inode.ino, req.NewName, elapsed.Nanoseconds())
 	return nil
@@ -232,7 +315,7 @@ func (d *Dir) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.
 	}
 
 	if valid := inode.setattr(req); valid != 0 {
-		err = d.super.mw.Setattr(ino, valid, proto.Mode(inode.mode), inode.uid, inode.gid)
+		err = d.super.mw.SetattrContext(d.super.callerContext(ctx, req.Header), ino, valid, proto.Mode(inode.mode), inode.uid, inode.gid)
 		if err != nil {
 			d.super.ic.Delete(ino)
 			return ParseError(err)
@@ -249,7 +332,10 @@ func (d *Dir) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.
 func (d *Dir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, error) {
 	parentIno := d.inode.ino
 	start := time.Now()
-	info, err := d.super.mw.Create_ll(parentIno, req.NewName, proto.Mode(os.ModeSymlink|os.ModePerm), []byte(req.Target))
+	uid, gid, _ := d.super.newOwner(parentIno, req.Header, os.ModeSymlink|os.ModePerm)
+	info, err := d.super.mw.CreateContext_ll(d.super.callerContext(d.pathContext(ctx), req.Header), parentIno, req.NewName,
+		proto.Mode(os.ModeSymlink|os.ModePerm), uid, gid, []byte(req.Target))
+	d.super.dc.Invalidate(parentIno, req.NewName)
 	if err != nil {
 		log.LogErrorf("Symlink: parent(%v) NewName(%v) err(%v)", parentIno, req.NewName, err)
 		return nil, ParseError(err)
@@ -280,7 +366,8 @@ func (d *Dir) Link(ctx context.Context, req *fuse.LinkRequest, old fs.Node) (fs.
 
 	start := time.Now()
 
-	info, err := d.super.mw.Link(d.inode.ino, req.NewName, oldInode.ino)
+	info, err := d.super.mw.LinkContext(d.super.callerContext(d.pathContext(ctx), req.Header), d.inode.ino, req.NewName, oldInode.ino)
+	d.super.dc.Invalidate(d.inode.ino, req.NewName)
 	if err != nil {
 		log.LogErrorf("Link: parent(%v) name(%v) ino(%v) err(%v)", d.inode.ino, req.NewName, oldInode.ino, err)
 		return nil, ParseError(err)
@@ -290,23 +377,26 @@ func (d *Dir) Link(ctx context.Context, req *fuse.LinkRequest, old fs.Node) (fs.
 	d.super.ic.Put(newInode)
 	newFile := NewFile(d.super, newInode)
 
+	if d.super.auditor != nil {
+		d.super.auditor.Log(start, &audit.Entry{Op: audit.OpLink, Ino: d.inode.ino, Name: req.NewName, NewIno: newInode.ino})
+	}
 	elapsed := time.Since(start)
 	log.LogDebugf("TRACE Link: parent(%v) name(%v) ino(%v) (%v)ns", d.inode.ino, req.NewName, newInode.ino, elapsed.Nanoseconds())
 	return newFile, nil
 }
 
 func (d *Dir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
-	return fuse.ENOSYS
+	return d.super.getxattr(ctx, d.inode.ino, req, resp)
 }
 
 func (d *Dir) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
-	return fuse.ENOSYS
+	return d.super.listxattr(d.inode.ino, req, resp)
 }
 
 func (d *Dir) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
-	return fuse.ENOSYS
+	return d.super.setxattr(ctx, d.inode.ino, req)
 }
 
 func (d *Dir) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
-	return fuse.ENOSYS
+	return d.super.removexattr(ctx, d.inode.ino, req)
 }
@@ -16,6 +16,10 @@ package fs
 
 import (
 	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/tiglabs/containerfs/fuse"
@@ -24,7 +28,9 @@ import (
 
 	"github.com/tiglabs/containerfs/proto"
 	"github.com/tiglabs/containerfs/sdk/data/stream"
+	"github.com/tiglabs/containerfs/util/audit"
 	"github.com/tiglabs/containerfs/util/log"
+	"github.com/tiglabs/containerfs/util/trace"
 	"sync"
 )
 
@@ -32,6 +38,12 @@ type File struct {
 	super  *Super
 	inode  *Inode
 	stream *stream.StreamReader
+
+	// the size and mtime of the file when the kernel cached its pages,
+	// the pages are dropped once the inode is changed by another client
+	pageSize  uint64
+	pageMtime time.Time
+	pageValid bool
 	sync.RWMutex
 }
 
@@ -52,6 +64,8 @@ var (
 	_ fs.NodeListxattrer   = (*File)(nil)
 	_ fs.NodeSetxattrer    = (*File)(nil)
 	_ fs.NodeRemovexattrer = (*File)(nil)
+	_ fs.HandleLocker      = (*File)(nil)
+	_ fs.HandleFallocater  = (*File)(nil)
 )
 
 func (f *File) getReadStream() (r *stream.StreamReader) {
@@ -79,9 +93,11 @@ func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
 	}
 
 	inode.fillAttr(a)
+	a.Valid = f.super.attrValid()
 	if writeSize := f.super.ec.GetWriteSize(ino); writeSize > a.Size {
 		a.Size = writeSize
 	}
+	f.checkPages(inode, true)
 
 	log.LogDebugf("TRACE Attr: inode(%v) attr(%v)", inode, a)
 	return nil
@@ -102,31 +118,102 @@ func (f *File) Forget() {
 func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (handle fs.Handle, err error) {
 	ino := f.inode.ino
 	start := time.Now()
-	err = f.super.mw.Open_ll(ino)
+	direct := req.Flags&fuse.OpenDirect != 0
+	if direct {
+		// the reads and writes of the handle bypass the page cache of the
+		// kernel and the caches of the client
+		resp.Flags |= fuse.OpenDirectIO
+	}
+	if f.super.immutable {
+		// Nothing changes, no need to touch the meta node and the kernel
+		// keeps the cached pages of the file.
+		if !direct {
+			resp.Flags |= fuse.OpenKeepCache
+		}
+		log.LogDebugf("TRACE Open: ino(%v) flags(%v) immutable", ino, req.Flags)
+		return f, nil
+	}
+	err = f.super.mw.OpenContext_ll(f.super.callerContext(ctx, req.Header), ino, uint32(req.Flags))
 	if err != nil {
 		f.super.ic.Delete(ino)
 		log.LogErrorf("Open: ino(%v) req(%v) err(%v)", ino, req, ParseError(err))
 		return nil, ParseError(err)
 	}
+	f.super.leased.open(f)
 
 	//FIXME: let open return inode info
 	inode, err := f.super.InodeGet(ino)
 	if err != nil {
+		f.super.mw.Release_ll(ino)
+		f.super.leased.release(ino)
 		f.super.ic.Delete(ino)
 		log.LogErrorf("Open: ino(%v) req(%v) err(%v)", ino, req, ParseError(err))
 		return nil, ParseError(err)
 	}
 
 	f.super.ec.OpenForWrite(ino, inode.size)
+	// the kernel drops the cached pages at the open unless kept, the pages of
+	// a file not changed since they were cached are still valid
+	if f.checkPages(inode, false) && !direct {
+		resp.Flags |= fuse.OpenKeepCache
+	}
 
+	if f.super.auditor != nil {
+		f.super.auditor.Log(start, &audit.Entry{Op: audit.OpOpen, Ino: ino})
+	}
 	elapsed := time.Since(start)
 	log.LogDebugf("TRACE Open: ino(%v) flags(%v) (%v)ns", ino, req.Flags, elapsed.Nanoseconds())
 	return f, nil
 }
 
+// checkPages records the version of the inode the cached pages of the file
+// are of, it returns true if they were of it already. The pages changed by
+// another client are dropped if notify, from the last page cached only if the
+// file was appended.
+func (f *File) checkPages(inode *Inode, notify bool) (valid bool) {
+	ino := f.inode.ino
+	f.Lock()
+	defer f.Unlock()
+	if f.pageValid && inode.size == f.pageSize && inode.mtime.Equal(f.pageMtime) {
+		return true
+	}
+	oldSize, cached := f.pageSize, f.pageValid
+	f.pageSize, f.pageMtime, f.pageValid = inode.size, inode.mtime, true
+	if !cached || !notify {
+		return false
+	}
+	// the size grown by the writes of the client is in the pages already
+	if writeSize := f.super.ec.GetWriteSize(ino); inode.size > oldSize && inode.size <= writeSize {
+		return false
+	}
+	var off int64
+	if inode.size > oldSize {
+		off = int64(oldSize) &^ int64(os.Getpagesize()-1)
+	}
+	f.super.invalidatePages(f, ino, off)
+	return false
+}
+
+/*the cached pages are of no version of the inode, they are dropped by the next open*/
+func (f *File) dropPages() {
+	f.Lock()
+	defer f.Unlock()
+	f.pageValid = false
+}
+
 func (f *File) Release(ctx context.Context, req *fuse.ReleaseRequest) (err error) {
 	ino := f.inode.ino
 	start := time.Now()
+	f.super.releaseFlock(ino, req)
+	if f.super.immutable {
+		return nil
+	}
+
+	// The handle is released on the meta node whatever the flush result.
+	if err = f.super.mw.Release_ll(ino); err != nil {
+		log.LogWarnf("Release: release handle failed, ino(%v) err(%v)", ino, err)
+	}
+	f.super.leased.release(ino)
 
 	err = f.super.ec.Flush(f.inode.ino)
 	if err != nil {
@@ -156,7 +243,12 @@ func (f *File) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadR
 		f.setReadStream(stream)
 	}
 	start := time.Now()
-	size, err := f.super.ec.Read(f.getReadStream(), f.inode.ino, resp.Data[fuse.OutHeaderSize:], int(req.Offset), req.Size)
+	var size int
+	if req.FileFlags&fuse.OpenDirect != 0 {
+		size, err = f.super.ec.ReadDirect(f.getReadStream(), f.inode.ino, resp.Data[fuse.OutHeaderSize:], int(req.Offset), req.Size)
+	} else {
+		size, err = f.super.ec.Read(f.getReadStream(), f.inode.ino, resp.Data[fuse.OutHeaderSize:], int(req.Offset), req.Size)
+	}
 	if err != nil && err != io.EOF {
 		log.LogErrorf("Read: ino(%v) req(%v) err(%v) size(%v)", f.inode.ino, req, err, size)
 		return fuse.EIO
@@ -169,6 +261,9 @@ func (f *File) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadR
 		resp.Data = resp.Data[:size+fuse.OutHeaderSize]
 	}
 
+	if f.super.auditor != nil {
+		f.super.auditor.Log(start, &audit.Entry{Op: audit.OpRead, Ino: f.inode.ino, Offset: req.Offset, Size: req.Size})
+	}
 	elapsed := time.Since(start)
 	log.LogDebugf("TRACE Read: ino(%v) req(%v) size(%v) (%v)ns", f.inode.ino, req, size, elapsed.Nanoseconds())
 	return nil
@@ -182,13 +277,33 @@ func (f *File) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.Wri
 		return nil
 	}
 
+	if f.super.ReadOnly() {
+		log.LogErrorf("Write: vol is read only, ino(%v) offset(%v) len(%v)", f.inode.ino, req.Offset, reqlen)
+		return fuse.Errno(syscall.EROFS)
+	}
+
+	if maxFileSize := f.super.mw.MaxFileSize(); maxFileSize != 0 && uint64(req.Offset)+uint64(reqlen) > maxFileSize {
+		log.LogErrorf("Write: file too large, ino(%v) offset(%v) len(%v) maxFileSize(%v)", f.inode.ino, req.Offset, reqlen, maxFileSize)
+		return fuse.Errno(syscall.EFBIG)
+	}
+
 	defer func() {
 		f.super.ic.Delete(f.inode.ino)
 	}()
 
 	start := time.Now()
-	size, err := f.super.ec.Write(f.inode.ino, int(req.Offset), req.Data)
+	span := f.super.startSpan("fs.write", f.inode.ino, "")
+	defer span.End()
+	span.SetAttribute("offset", req.Offset)
+	span.SetAttribute("size", reqlen)
+	var size int
+	if req.FileFlags&fuse.OpenDirect != 0 {
+		size, err = f.super.ec.WriteDirectContext(trace.NewContext(ctx, span), f.inode.ino, int(req.Offset), req.Data)
+	} else {
+		size, err = f.super.ec.WriteContext(trace.NewContext(ctx, span), f.inode.ino, int(req.Offset), req.Data)
+	}
 	if err != nil {
+		span.SetError(err)
 		log.LogErrorf("Write: ino(%v) offset(%v) len(%v) err(%v)", f.inode.ino, req.Offset, reqlen, err)
 		return fuse.EIO
 	}
@@ -197,6 +312,9 @@ func (f *File) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.Wri
 		log.LogErrorf("Write: ino(%v) offset(%v) len(%v) size(%v)", f.inode.ino, req.Offset, reqlen, size)
 	}
 
+	if f.super.auditor != nil {
+		f.super.auditor.Log(start, &audit.Entry{Op: audit.OpWrite, Ino: f.inode.ino, Offset: req.Offset, Size: reqlen})
+	}
 	elapsed := time.Since(start)
 	log.LogDebugf("TRACE Write: ino(%v) offset(%v) len(%v) flags(%v) fileflags(%v) (%v)ns ",
 		f.inode.ino, req.Offset, reqlen, req.Flags, req.FileFlags, elapsed.Nanoseconds())
@@ -204,33 +322,123 @@ func (f *File) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.Wri
 }
 
 func (f *File) Flush(ctx context.Context, req *fuse.FlushRequest) (err error) {
-	return fuse.ENOSYS
+	if f.super.immutable || !f.super.syncOnClose {
+		return fuse.ENOSYS
+	}
+	start := time.Now()
+	span := f.super.startSpan("fs.flush", f.inode.ino, "")
+	defer span.End()
+	err = f.super.ec.Sync(f.inode.ino)
+	if err != nil {
+		span.SetError(err)
+		log.LogErrorf("Flush: ino(%v) err(%v)", f.inode.ino, err)
+		return fuse.EIO
+	}
+	f.super.ic.Delete(f.inode.ino)
+	elapsed := time.Since(start)
+	log.LogDebugf("TRACE Flush: ino(%v) (%v)ns", f.inode.ino, elapsed.Nanoseconds())
+	return nil
 }
 
 func (f *File) Fsync(ctx context.Context, req *fuse.FsyncRequest) (err error) {
 	start := time.Now()
-	err = f.super.ec.Flush(f.inode.ino)
+	span := f.super.startSpan("fs.fsync", f.inode.ino, "")
+	defer span.End()
+	err = f.super.ec.Sync(f.inode.ino)
 	if err != nil {
+		span.SetError(err)
 		log.LogErrorf("Fsync: ino(%v) err(%v)", f.inode.ino, err)
 		return fuse.EIO
 	}
 	f.super.ic.Delete(f.inode.ino)
+	if f.super.auditor != nil {
+		f.super.auditor.Log(start, &audit.Entry{Op: audit.OpFsync, Ino: f.inode.ino})
+	}
 	elapsed := time.Since(start)
 	log.LogDebugf("TRACE Fsync: ino(%v) (%v)ns", f.inode.ino, elapsed.Nanoseconds())
 	return nil
 }
 
+// Fallocate punches holes in the file or preallocates the space of the range.
+// The files are append only, so the size is not changed by either of them.
+func (f *File) Fallocate(ctx context.Context, req *fuse.FallocateRequest) (err error) {
+	ino := f.inode.ino
+	start := time.Now()
+	if req.Mode&^(fuse.FallocateKeepSize|fuse.FallocatePunchHole) != 0 {
+		return fuse.ENOTSUP
+	}
+	size := f.super.ec.GetWriteSize(ino)
+	if size < f.inode.size {
+		size = f.inode.size
+	}
+	end := req.Offset + req.Length
+	if req.Mode&fuse.FallocatePunchHole != 0 {
+		if req.Mode&fuse.FallocateKeepSize == 0 {
+			return fuse.ENOTSUP
+		}
+		if req.Offset >= size {
+			return nil
+		}
+		if end > size {
+			end = size
+		}
+		// the data written goes to the extents before their ranges are punched
+		if err = f.super.ec.Flush(ino); err != nil {
+			log.LogErrorf("Fallocate: flush ino(%v) err(%v)", ino, err)
+			return fuse.EIO
+		}
+		if err = f.super.ec.PunchHole(ino, int(req.Offset), int(end-req.Offset)); err == syscall.EOPNOTSUPP {
+			f.super.ic.Delete(ino)
+			return fuse.ENOTSUP
+		} else if err != nil {
+			log.LogErrorf("Fallocate: punch hole ino(%v) offset(%v) len(%v) err(%v)", ino, req.Offset, req.Length, err)
+			return fuse.EIO
+		}
+		f.super.ec.Advise(ino, stream.AdviceDontNeed, int(req.Offset), int(end-req.Offset))
+		f.super.ic.Delete(ino)
+	} else {
+		if end > size && req.Mode&fuse.FallocateKeepSize == 0 {
+			// the size is extended by the writes only
+			return fuse.ENOTSUP
+		}
+		if end > size {
+			if total, used := f.super.mw.Statfs(); used+(end-size) > total {
+				return fuse.Errno(syscall.ENOSPC)
+			}
+			if err = f.super.ec.Preallocate(ino, end); err != nil {
+				// no extent is created for the handle
+				return fuse.ENOTSUP
+			}
+		}
+	}
+	if f.super.auditor != nil {
+		f.super.auditor.Log(start, &audit.Entry{Op: audit.OpFallocate, Ino: ino, Offset: int64(req.Offset), Size: int(req.Length)})
+	}
+	elapsed := time.Since(start)
+	log.LogDebugf("TRACE Fallocate: ino(%v) req(%v) (%v)ns", ino, req, elapsed.Nanoseconds())
+	return nil
+}
+
 func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
 	ino := f.inode.ino
 	start := time.Now()
 	if req.Valid.Size() && req.Size == 0 {
-		err := f.super.mw.Truncate(ino)
+		// the dirty data of the write back cache goes before the truncate
+		if err := f.super.ec.Flush(ino); err != nil {
+			log.LogErrorf("Setattr: flush ino(%v) err(%v)", ino, err)
+			return fuse.EIO
+		}
+		err := f.super.mw.TruncateContext(f.super.callerContext(ctx, req.Header), ino)
 		if err != nil {
 			log.LogErrorf("Setattr: truncate ino(%v) err(%v)", ino, err)
 			return ParseError(err)
 		}
 		f.super.ic.Delete(ino)
 		f.super.ec.SetWriteSize(ino, 0)
+		f.super.ec.Advise(ino, stream.AdviceDontNeed, 0, 0)
+		if f.super.auditor != nil {
+			f.super.auditor.Log(start, &audit.Entry{Op: audit.OpTruncate, Ino: ino})
+		}
 	}
 
 	inode, err := f.super.InodeGet(ino)
@@ -246,7 +454,7 @@ func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse
 	}
 
 	if valid := inode.setattr(req); valid != 0 {
-		err = f.super.mw.Setattr(ino, valid, proto.Mode(inode.mode), inode.uid, inode.gid)
+		err = f.super.mw.SetattrContext(f.super.callerContext(ctx, req.Header), ino, valid, proto.Mode(inode.mode), inode.uid, inode.gid)
 		if err != nil {
 			f.super.ic.Delete(ino)
 			return ParseError(err)
@@ -272,17 +480,56 @@ func (f *File) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string,
 }
 
 func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
-	return fuse.ENOSYS
+	return f.super.getxattr(ctx, f.inode.ino, req, resp)
 }
 
 func (f *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
-	return fuse.ENOSYS
+	return f.super.listxattr(f.inode.ino, req, resp)
 }
 
+// Setxattr of FadviseXattr passes a posix_fadvise hint of the application
+// to the read ahead cache, the kernel does not forward posix_fadvise itself.
+// The hint is not kept, the other names are set on the inode.
 func (f *File) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
-	return fuse.ENOSYS
+	ino := f.inode.ino
+	if req.Name != FadviseXattr {
+		return f.super.setxattr(ctx, ino, req)
+	}
+	advice, offset, size, err := parseFadvise(string(req.Xattr))
+	if err != nil {
+		log.LogWarnf("Setxattr: ino(%v) fadvise(%v) err(%v)", ino, string(req.Xattr), err)
+		return fuse.Errno(syscall.EINVAL)
+	}
+	if err = f.super.ec.Advise(ino, advice, offset, size); err != nil {
+		log.LogErrorf("Setxattr: ino(%v) fadvise(%v) err(%v)", ino, string(req.Xattr), err)
+		return ParseError(err)
+	}
+	log.LogDebugf("TRACE Setxattr: ino(%v) fadvise(%v)", ino, string(req.Xattr))
+	return nil
+}
+
+// parseFadvise parses "ADVICE [OFFSET LENGTH]", a zero or missing length
+// means up to the end of file like posix_fadvise.
+func parseFadvise(value string) (advice, offset, size int, err error) {
+	fields := strings.Fields(value)
+	if len(fields) != 1 && len(fields) != 3 {
+		return 0, 0, 0, syscall.EINVAL
+	}
+	var ok bool
+	if advice, ok = fadviseNames[strings.ToLower(fields[0])]; !ok {
+		return 0, 0, 0, syscall.EINVAL
+	}
+	if len(fields) == 3 {
+		if offset, err = strconv.Atoi(fields[1]); err != nil || offset < 0 {
+			return 0, 0, 0, syscall.EINVAL
+		}
+		if size, err = strconv.Atoi(fields[2]); err != nil || size < 0 {
+			return 0, 0, 0, syscall.EINVAL
+		}
+	}
+	return
 }
 
 func (f *File) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
-	return fuse.ENOSYS
+	return f.super.removexattr(ctx, f.inode.ino, req)
 }
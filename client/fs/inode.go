@@ -105,6 +105,10 @@ func (inode *Inode) fill(info *proto.InodeInfo) {
 	inode.mtime = info.ModifyTime
 	inode.target = info.Target
 	inode.mode = proto.OsMode(info.Mode)
+	if proto.IsSymlink(info.Mode) {
+		// the size of a symlink is the length of its target, as lstat of a local fs
+		inode.size = uint64(len(info.Target))
+	}
 }
 
 func (inode *Inode) fillAttr(attr *fuse.Attr) {
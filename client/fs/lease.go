@@ -0,0 +1,106 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package fs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+// leasedFiles is the files opened with a cache lease by inode, the kernel
+// cache of a file changed by another client is invalidated through its node.
+type leasedFiles struct {
+	files   map[uint64]*File
+	handles map[uint64]int
+	sync.Mutex
+}
+
+func newLeasedFiles() *leasedFiles {
+	return &leasedFiles{
+		files:   make(map[uint64]*File),
+		handles: make(map[uint64]int),
+	}
+}
+
+func (l *leasedFiles) open(f *File) {
+	if l == nil {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.files[f.inode.ino] = f
+	l.handles[f.inode.ino]++
+}
+
+func (l *leasedFiles) release(ino uint64) {
+	if l == nil {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	if l.handles[ino]--; l.handles[ino] > 0 {
+		return
+	}
+	delete(l.handles, ino)
+	delete(l.files, ino)
+}
+
+func (l *leasedFiles) get(ino uint64) *File {
+	l.Lock()
+	defer l.Unlock()
+	return l.files[ino]
+}
+
+// EnableLeases keeps the caches of the opened files, the cached inodes and
+// the cached dentries coherent with the changes of the other clients, the
+// meta nodes notify the changes of the inodes the client leases at the renews
+// of the leases. The inodes and the dentries are leased for as long as they
+// are cached, at most MaxCacheLeaseSeconds. It is called before the mount.
+func (s *Super) EnableLeases() {
+	if s.immutable {
+		return
+	}
+	maxValid := proto.MaxCacheLeaseSeconds * time.Second
+	if s.ic.expiration > maxValid {
+		s.ic.expiration = maxValid
+	}
+	if s.dc.valid > maxValid {
+		s.dc.valid = maxValid
+	}
+	ttl := s.ic.expiration
+	if s.dc.valid > ttl {
+		ttl = s.dc.valid
+	}
+	s.leased = newLeasedFiles()
+	s.mw.EnableLeases(ttl, s.invalidateInodes)
+}
+
+/*drop the cached inodes, the cached dentries of the dirs and the kernel cache of the files changed by the other clients*/
+func (s *Super) invalidateInodes(inodes []uint64) {
+	for _, ino := range inodes {
+		s.ic.Delete(ino)
+		s.dc.InvalidateDir(ino)
+		f := s.leased.get(ino)
+		if f == nil {
+			continue
+		}
+		f.dropPages()
+		s.invalidatePages(f, ino, 0)
+		log.LogDebugf("invalidateInodes: ino(%v) changed by another client", ino)
+	}
+}
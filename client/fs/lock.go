@@ -0,0 +1,130 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package fs
+
+import (
+	"math"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/tiglabs/containerfs/fuse"
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+// The wait of a blocking lock polls the meta node from the min to the max
+// interval, the meta node does not notify the release of a lock.
+const (
+	LockWaitMinInterval = 10 * time.Millisecond
+	LockWaitMaxInterval = time.Second
+)
+
+func toFileLock(owner uint64, lk fuse.FileLock, flags fuse.LockFlags) (lock proto.FileLock) {
+	lock = proto.FileLock{Owner: owner, Pid: lk.PID, Start: lk.Start, End: lk.End}
+	switch lk.Type {
+	case fuse.LockRead:
+		lock.Type = proto.LockRead
+	case fuse.LockWrite:
+		lock.Type = proto.LockWrite
+	default:
+		lock.Type = proto.LockUnlock
+	}
+	if flags&fuse.LockFlock != 0 {
+		lock.Flock = true
+		lock.Start, lock.End = 0, math.MaxUint64
+	}
+	return
+}
+
+func fromFileLock(lock proto.FileLock) (lk fuse.FileLock) {
+	lk = fuse.FileLock{Start: lock.Start, End: lock.End, PID: lock.Pid, Type: fuse.LockUnlock}
+	switch lock.Type {
+	case proto.LockRead:
+		lk.Type = fuse.LockRead
+	case proto.LockWrite:
+		lk.Type = fuse.LockWrite
+	}
+	return
+}
+
+func (s *Super) lock(ctx context.Context, ino uint64, req *fuse.LockRequest) error {
+	lock := toFileLock(req.LockOwner, req.Lock, req.LockFlags)
+	interval := LockWaitMinInterval
+	for {
+		err := s.mw.SetLock(ino, lock)
+		if err == nil {
+			log.LogDebugf("TRACE Lock: ino(%v) req(%v)", ino, req)
+			return nil
+		}
+		if err != syscall.EAGAIN || !req.Wait {
+			log.LogDebugf("Lock: ino(%v) req(%v) err(%v)", ino, req, err)
+			return ParseError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return fuse.EINTR
+		case <-time.After(interval):
+		}
+		if interval *= 2; interval > LockWaitMaxInterval {
+			interval = LockWaitMaxInterval
+		}
+	}
+}
+
+func (s *Super) queryLock(ino uint64, req *fuse.QueryLockRequest, resp *fuse.QueryLockResponse) error {
+	conflict, err := s.mw.GetLock(ino, toFileLock(req.LockOwner, req.Lock, req.LockFlags))
+	if err != nil {
+		log.LogErrorf("QueryLock: ino(%v) req(%v) err(%v)", ino, req, err)
+		return ParseError(err)
+	}
+	resp.Lock = fromFileLock(conflict)
+	log.LogDebugf("TRACE QueryLock: ino(%v) req(%v) resp(%v)", ino, req, resp)
+	return nil
+}
+
+// releaseFlock releases the flock lock of the owner of the handle, the
+// kernel asks it in the release of the last descriptor of the handle.
+func (s *Super) releaseFlock(ino uint64, req *fuse.ReleaseRequest) {
+	if req.ReleaseFlags&fuse.ReleaseFlockUnlock == 0 {
+		return
+	}
+	lock := proto.FileLock{Owner: req.LockOwner, Start: 0, End: math.MaxUint64, Type: proto.LockUnlock, Flock: true}
+	if err := s.mw.SetLock(ino, lock); err != nil {
+		log.LogWarnf("Release: unlock flock failed, ino(%v) owner(%v) err(%v)", ino, req.LockOwner, err)
+	}
+}
+
+func (f *File) SetLock(ctx context.Context, req *fuse.LockRequest) error {
+	return f.super.lock(ctx, f.inode.ino, req)
+}
+
+func (f *File) QueryLock(ctx context.Context, req *fuse.QueryLockRequest, resp *fuse.QueryLockResponse) error {
+	return f.super.queryLock(f.inode.ino, req, resp)
+}
+
+func (d *Dir) SetLock(ctx context.Context, req *fuse.LockRequest) error {
+	return d.super.lock(ctx, d.inode.ino, req)
+}
+
+func (d *Dir) QueryLock(ctx context.Context, req *fuse.QueryLockRequest, resp *fuse.QueryLockResponse) error {
+	return d.super.queryLock(d.inode.ino, req, resp)
+}
+
+func (d *Dir) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	d.super.releaseFlock(d.inode.ino, req)
+	return nil
+}
@@ -0,0 +1,305 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/sdk/data/stream"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+// The migration of the files off the data partitions released by the shrink of
+// the vol: each extent of a file on a releasing partition is copied to a temp
+// file under the root, and the keys of the copy replace the key of the extent
+// in the inode of the file, if the keys of the file did not change since.
+const (
+	MigrateInterval   = 5 * time.Minute
+	MigrateIdleTime   = 10 * time.Minute //a file modified since may be open for write, it is left to the next pass
+	MigrateBufferSize = 1 << 20
+	MigrateTempPrefix = ".cfs_migrate_"
+)
+
+// StartMigrator starts the passes migrating the files of the vol off the
+// releasing partitions, one client of the vol is enough to run it.
+func (s *Super) StartMigrator() {
+	go func() {
+		for {
+			time.Sleep(MigrateInterval)
+			s.migratePass()
+		}
+	}()
+}
+
+/*a pass over the tree of the vol and the orphan inodes, it is reported to the master once no file is left on the releasing partitions*/
+func (s *Super) migratePass() {
+	releasing := s.ec.ReleasingPartitions()
+	if len(releasing) == 0 {
+		return
+	}
+	start := time.Now()
+	pending := s.migrateDir(RootInode, releasing)
+	pending += s.migrateOrphans(releasing)
+	if pending != 0 {
+		log.LogWarnf("migratePass: %v files left on releasing partitions(%v)", pending, len(releasing))
+		return
+	}
+	s.ec.ReportMigrated(start.Unix())
+	log.LogInfof("migratePass: releasing partitions(%v) migrated (%v)", len(releasing), time.Since(start))
+}
+
+/*migrate the files under the dir, return the files still on the releasing partitions*/
+func (s *Super) migrateDir(ino uint64, releasing map[uint32]bool) (pending int) {
+	children, err := s.mw.ReadDir_ll(ino)
+	if err != nil {
+		log.LogWarnf("migrateDir: ino(%v) err(%v)", ino, err)
+		return 1
+	}
+	for _, child := range children {
+		switch {
+		case proto.IsDir(child.Type):
+			pending += s.migrateDir(child.Inode, releasing)
+		case !proto.IsRegular(child.Type):
+		case strings.HasPrefix(child.Name, MigrateTempPrefix):
+			s.removeMigrateTemp(ino, child)
+		default:
+			if err = s.migrateFile(child.Inode, releasing); err != nil {
+				log.LogWarnf("migrateFile: parent(%v) name(%v) ino(%v) err(%v)", ino, child.Name, child.Inode, err)
+				pending++
+			}
+		}
+	}
+	return
+}
+
+/*migrate the inodes unlinked and still open, their data is read until they are closed*/
+func (s *Super) migrateOrphans(releasing map[uint32]bool) (pending int) {
+	inodes, err := s.mw.ListOrphans()
+	if err != nil {
+		log.LogWarnf("migrateOrphans: err(%v)", err)
+		return 1
+	}
+	for _, ino := range inodes {
+		if err = s.migrateFile(ino, releasing); err != nil {
+			log.LogWarnf("migrateFile: orphan ino(%v) err(%v)", ino, err)
+			pending++
+		}
+	}
+	return
+}
+
+// migrateFile moves the extents of the inode off the releasing partitions in
+// place, the inode keeps its number, links, xattrs and open handles.
+func (s *Super) migrateFile(ino uint64, releasing map[uint32]bool) (err error) {
+	var (
+		eks  []proto.ExtentKey
+		info *proto.InodeInfo
+	)
+	if eks, err = s.mw.GetExtents(ino); err != nil {
+		return
+	}
+	if !onReleasing(eks, releasing) {
+		return
+	}
+	// an orphan inode is not got, its extents are
+	if info, err = s.mw.InodeGet_ll(ino); err == nil && time.Since(info.ModifyTime) < MigrateIdleTime {
+		return fmt.Errorf("modified at %v", info.ModifyTime)
+	}
+
+	var (
+		temps    []*proto.InodeInfo
+		tmpNames []string
+		newEks   []proto.ExtentKey
+		offset   uint64
+	)
+	for i, ek := range eks {
+		if !releasing[ek.PartitionId] {
+			newEks = append(newEks, ek)
+			offset += uint64(ek.Size)
+			continue
+		}
+		var (
+			tmp     *proto.InodeInfo
+			tempEks []proto.ExtentKey
+		)
+		tmpName := migrateTempName(ino, i)
+		if tmp, err = s.mw.Create_ll(RootInode, tmpName, proto.Mode(0600), nil); err != nil {
+			break
+		}
+		s.dc.Invalidate(RootInode, tmpName)
+		temps = append(temps, tmp)
+		tmpNames = append(tmpNames, tmpName)
+		if err = s.copyRange(ino, tmp.Inode, offset, uint64(ek.Size)); err != nil {
+			break
+		}
+		if tempEks, err = s.mw.GetExtents(tmp.Inode); err != nil {
+			break
+		}
+		newEks = append(newEks, tempEks...)
+		offset += uint64(ek.Size)
+	}
+	if err == nil {
+		// the file is left as is if its keys changed during the copy
+		err = s.mw.ReplaceExtentKeys(ino, eks, newEks)
+	}
+	for i, tmp := range temps {
+		s.removeMigrated(tmpNames[i], tmp.Inode, err == nil)
+	}
+	if err != nil {
+		return
+	}
+	s.ic.Delete(ino)
+	log.LogInfof("migrateFile: ino(%v) extents(%v) migrated to extents(%v)", ino, len(eks), len(newEks))
+	return
+}
+
+func migrateTempName(ino uint64, index int) string {
+	return MigrateTempPrefix + strconv.FormatUint(ino, 10) + "_" + strconv.Itoa(index)
+}
+
+/*the inode of the file a temp file is migrated to, 0 if the name is not of a temp file*/
+func migrateTempTarget(name string) (ino uint64) {
+	name = strings.TrimPrefix(name, MigrateTempPrefix)
+	if i := strings.Index(name, "_"); i >= 0 {
+		name = name[:i]
+	}
+	ino, _ = strconv.ParseUint(name, 10, 64)
+	return
+}
+
+func onReleasing(eks []proto.ExtentKey, releasing map[uint32]bool) bool {
+	for _, ek := range eks {
+		if releasing[ek.PartitionId] {
+			return true
+		}
+	}
+	return false
+}
+
+/*copy size bytes of src from offset to dst, the new extents go to the writable partitions*/
+func (s *Super) copyRange(src, dst, offset, size uint64) (err error) {
+	var (
+		reader *stream.StreamReader
+		read   int
+	)
+	if reader, err = s.ec.OpenForRead(src); err != nil {
+		return
+	}
+	s.ec.OpenForWrite(dst, 0)
+	buf := make([]byte, MigrateBufferSize)
+	for copied := uint64(0); copied < size; copied += uint64(read) {
+		n := len(buf)
+		if remain := size - copied; uint64(n) > remain {
+			n = int(remain)
+		}
+		read, err = s.ec.Read(reader, src, buf[:n], int(offset+copied), n)
+		if err == io.EOF {
+			err = nil
+		}
+		if err == nil && read == 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			break
+		}
+		if _, err = s.ec.Write(dst, int(copied), buf[:read]); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = s.ec.Sync(dst)
+	}
+	if closeErr := s.ec.CloseForWrite(dst); err == nil {
+		err = closeErr
+	}
+	return
+}
+
+// removeMigrated removes a temp file of a migration, the keys of a temp file
+// moved to the file are dropped from the temp file first so that its deletion
+// does not delete their extents.
+func (s *Super) removeMigrated(tmpName string, tmp uint64, moved bool) {
+	if moved {
+		eks, err := s.mw.GetExtents(tmp)
+		if err == nil && len(eks) != 0 {
+			err = s.mw.ReplaceExtentKeys(tmp, eks, nil)
+		}
+		if err != nil {
+			// left to removeMigrateTemp
+			log.LogWarnf("removeMigrated: tmp(%v) ino(%v) err(%v)", tmpName, tmp, err)
+			return
+		}
+	}
+	s.deleteFile(RootInode, tmpName)
+}
+
+/*remove the temp file of a migration interrupted, a temp file of a pass in progress is recent*/
+func (s *Super) removeMigrateTemp(parent uint64, dentry proto.Dentry) {
+	info, err := s.mw.InodeGet_ll(dentry.Inode)
+	if err != nil || time.Since(info.ModifyTime) < MigrateIdleTime {
+		return
+	}
+	eks, err := s.mw.GetExtents(dentry.Inode)
+	if err != nil {
+		return
+	}
+	// the keys of the temp file replaced those of the file if they share an extent
+	moved := false
+	if target := migrateTempTarget(dentry.Name); target != 0 {
+		targetEks, err := s.mw.GetExtents(target)
+		if err != nil && err != syscall.ENOENT {
+			return
+		}
+		moved = sharesExtent(eks, targetEks)
+	}
+	if moved {
+		if err = s.mw.ReplaceExtentKeys(dentry.Inode, eks, nil); err != nil {
+			log.LogWarnf("removeMigrateTemp: parent(%v) name(%v) err(%v)", parent, dentry.Name, err)
+			return
+		}
+	}
+	s.deleteFile(parent, dentry.Name)
+}
+
+func sharesExtent(eks, others []proto.ExtentKey) bool {
+	for _, ek := range eks {
+		for _, other := range others {
+			if ek.Equal(other) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Super) deleteFile(parent uint64, name string) {
+	info, err := s.mw.Delete_ll(parent, name)
+	s.dc.Invalidate(parent, name)
+	if err != nil {
+		log.LogWarnf("deleteFile: parent(%v) name(%v) err(%v)", parent, name, err)
+		return
+	}
+	if info != nil && info.Nlink == 0 {
+		if err = s.mw.Evict(info.Inode); err != nil {
+			log.LogWarnf("deleteFile: parent(%v) name(%v) evict ino(%v) err(%v)", parent, name, info.Inode, err)
+		}
+	}
+}
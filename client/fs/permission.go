@@ -0,0 +1,50 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package fs
+
+import (
+	"os"
+
+	"github.com/tiglabs/containerfs/fuse"
+	"golang.org/x/net/context"
+
+	"github.com/tiglabs/containerfs/sdk/meta"
+)
+
+// callerContext returns ctx carrying the user of the fuse request, the meta
+// nodes of a vol with the permission checks check the ops for it. The kernel
+// checks the opens itself on the attrs of the inodes.
+func (s *Super) callerContext(ctx context.Context, h fuse.Header) context.Context {
+	if !s.mw.Permission() {
+		return ctx
+	}
+	return meta.NewCallerContext(ctx, h.Uid, h.Gid)
+}
+
+// newOwner returns the owner and the mode of an inode the user of the request
+// creates in the dir. The inode of a setgid dir takes the group of the dir,
+// and a dir created in it is setgid too.
+func (s *Super) newOwner(parent uint64, h fuse.Header, mode os.FileMode) (uid, gid uint32, m os.FileMode) {
+	uid, gid, m = h.Uid, h.Gid, mode
+	dir, err := s.InodeGet(parent)
+	if err != nil || dir.mode&os.ModeSetgid == 0 {
+		return
+	}
+	gid = dir.gid
+	if mode.IsDir() {
+		m |= os.ModeSetgid
+	}
+	return
+}
@@ -15,25 +15,58 @@
 package fs
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
 	"time"
 
 	"github.com/tiglabs/containerfs/fuse"
 	"github.com/tiglabs/containerfs/fuse/fs"
 	"golang.org/x/net/context"
 
+	"github.com/tiglabs/containerfs/proto"
 	"github.com/tiglabs/containerfs/sdk/data/stream"
 	"github.com/tiglabs/containerfs/sdk/meta"
+	"github.com/tiglabs/containerfs/util/audit"
+	"github.com/tiglabs/containerfs/util/buf"
 	"github.com/tiglabs/containerfs/util/log"
+	"github.com/tiglabs/containerfs/util/pool"
+	"github.com/tiglabs/containerfs/util/trace"
 )
 
 type Super struct {
 	cluster string
 	volname string
 	ic      *InodeCache
+	dc      *DentryCache
 	mw      *meta.MetaWrapper
 	ec      *stream.ExtentClient
 	orphan  *OrphanInodeList
+
+	// Immutable vol is mounted read only and cached indefinitely.
+	immutable bool
+
+	// Close of a file durably flushes its written data if set, otherwise
+	// the data is flushed lazily and synchronized only by fsync.
+	syncOnClose  bool
+	followerRead bool
+
+	// the ops are recorded for cfs-replay if set
+	auditor *audit.Logger
+
+	// the server of the mount, the cached pages of the files changed by the
+	// other clients are invalidated through it
+	srv *fs.Server
+
+	// the files opened with a cache lease, nil without the leases
+	leased *leasedFiles
+
+	// the dir of the vol mounted as the root, RootInode but for a subdir mount
+	rootIno  uint64
+	rootPath string
 }
 
 //functions that Super needs to implement
@@ -42,38 +75,54 @@ var (
 	_ fs.FSStatfser = (*Super)(nil)
 )
 
-func NewSuper(volname, master string, icacheTimeout int64) (s *Super, err error) {
+// NewSuper connects to the meta nodes and the data nodes of the vol through
+// conns presenting session, the mounts of the vols of a process may share it.
+func NewSuper(volname, master, session string, icacheTimeout int64, conns *pool.ConnectPool) (s *Super, err error) {
 	s = new(Super)
-	s.mw, err = meta.NewMetaWrapper(volname, master)
+	s.mw, err = meta.NewMetaWrapperWithConns(volname, master, session, conns)
 	if err != nil {
 		log.LogErrorf("NewMetaWrapper failed! %v", err.Error())
 		return nil, err
 	}
+	// the requests of the client itself, the flushes of the extents and the
+	// migration, are made for the user running it
+	s.mw.SetCaller(uint32(os.Getuid()), uint32(os.Getgid()))
 
-	s.ec, err = stream.NewExtentClient(volname, master, s.mw.AppendExtentKey, s.mw.GetExtents)
+	s.ec, err = stream.NewExtentClientWithConns(volname, master, conns, s.mw.AppendExtentKey, s.mw.GetExtents)
 	if err != nil {
 		log.LogErrorf("NewExtentClient failed! %v", err.Error())
 		return nil, err
 	}
 
 	s.volname = volname
+	s.rootIno = RootInode
+	s.rootPath = "/"
 	s.cluster = s.mw.Cluster()
+	s.immutable = s.mw.Immutable()
+	s.syncOnClose = s.mw.SyncOnClose()
+	s.followerRead = s.mw.FollowerRead()
+	s.ec.SetFollowerRead(s.followerRead)
 	inodeExpiration := DefaultInodeExpiration
 	if icacheTimeout > 0 {
 		inodeExpiration = time.Duration(icacheTimeout) * time.Second
 	}
+	if s.immutable {
+		inodeExpiration = ImmutableValidDuration
+	}
 	s.ic = NewInodeCache(inodeExpiration, MaxInodeCache)
+	s.dc = NewDentryCache(s.dentryValid(), DefaultMaxDentryCache)
 	s.orphan = NewOrphanInodeList()
-	log.LogInfof("NewSuper: cluster(%v) volname(%v)", s.cluster, s.volname)
+	log.LogInfof("NewSuper: cluster(%v) volname(%v) immutable(%v) syncOnClose(%v) followerRead(%v)",
+		s.cluster, s.volname, s.immutable, s.syncOnClose, s.followerRead)
 	return s, nil
 }
 
 func (s *Super) Root() (fs.Node, error) {
-	inode, err := s.InodeGet(RootInode)
+	inode, err := s.InodeGet(s.rootIno)
 	if err != nil {
 		return nil, err
 	}
-	root := NewDir(s, inode)
+	root := NewDir(s, inode, s.rootPath)
 	return root, nil
 }
 
@@ -88,6 +137,183 @@ func (s *Super) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.
 	return nil
 }
 
+// SetSubdir mounts the dir of the vol at subdir instead of its root, the
+// dentries out of it are not reached through the mount. It is called before
+// the mount. It is not an isolation of the tenants, the meta nodes serve the
+// whole vol to the token of the vol.
+func (s *Super) SetSubdir(subdir string) (err error) {
+	ino := uint64(RootInode)
+	for _, name := range strings.Split(path.Clean("/"+subdir), "/") {
+		if name == "" {
+			continue
+		}
+		var mode uint32
+		if ino, mode, err = s.mw.Lookup_ll(ino, name); err != nil {
+			return fmt.Errorf("subdir(%v) lookup(%v): %v", subdir, name, err)
+		}
+		if !proto.IsDir(mode) {
+			return fmt.Errorf("subdir(%v): %v is not a dir", subdir, name)
+		}
+	}
+	s.rootIno = ino
+	s.rootPath = path.Clean("/" + subdir)
+	log.LogInfof("SetSubdir: volname(%v) subdir(%v) ino(%v)", s.volname, subdir, ino)
+	return
+}
+
+// IsSubdir returns if a dir of the vol is mounted instead of its root.
+func (s *Super) IsSubdir() bool {
+	return s.rootIno != RootInode
+}
+
+// Immutable returns if the vol is mounted as an immutable dataset.
+func (s *Super) Immutable() bool {
+	return s.immutable
+}
+
+// ReadOnly returns if the vol is set read only by the master, it may change
+// while mounted.
+func (s *Super) ReadOnly() bool {
+	return s.mw.ReadOnly()
+}
+
+// Permission returns if the meta nodes check the ops of the vol for the users
+// of the requests.
+func (s *Super) Permission() bool {
+	return s.mw.Permission()
+}
+
+// SetReadAheadCache sets the memory of the read ahead cache of the data
+// prefetched by the hints of the applications, zero disables it.
+func (s *Super) SetReadAheadCache(size int) {
+	s.ec.SetReadAheadCache(size / stream.ReadAheadBlockSize)
+}
+
+// SetServer sets the server of the mount to invalidate the kernel cache of the
+// files through.
+func (s *Super) SetServer(srv *fs.Server) {
+	s.srv = srv
+}
+
+/*drop the pages of the file the kernel caches from off to the end*/
+func (s *Super) invalidatePages(node fs.Node, ino uint64, off int64) {
+	if s.srv == nil {
+		return
+	}
+	// not from the handler of a request, the kernel may hold the pages
+	go func() {
+		if err := s.srv.InvalidateNodeDataRange(node, off, -1); err != nil && err != fuse.ErrNotCached {
+			log.LogWarnf("invalidatePages: ino(%v) off(%v) err(%v)", ino, off, err)
+		}
+	}()
+}
+
+// SetZeroCopyRead asks the data nodes to send the blocks read without copy.
+func (s *Super) SetZeroCopyRead(enable bool) {
+	s.ec.SetZeroCopyRead(enable)
+}
+
+// SetZone sets the zone of the client to read from the replicas in it.
+func (s *Super) SetZone(zone string) {
+	s.ec.SetZone(zone)
+}
+
+// SetAuditLog records the ops taking at least slow to file, zero records all
+// of them.
+func (s *Super) SetAuditLog(file string, slow time.Duration) (err error) {
+	s.auditor, err = audit.NewLogger(file, slow, audit.DefaultMaxSize)
+	return
+}
+
+// CloseAuditLog flushes the recorded ops.
+func (s *Super) CloseAuditLog() {
+	if s.auditor != nil {
+		log.LogInfof("CloseAuditLog: dropped(%v)", s.auditor.Dropped())
+		s.auditor.Close()
+	}
+}
+
+// SetWriteBack sets the dirty data kept by the write back cache of the writes
+// and the number of its flushers, zero disables it.
+func (s *Super) SetWriteBack(size, flushers int) {
+	s.ec.SetWriteBack(size, flushers)
+}
+
+// SetDentryCache sets how long the lookups and the readdirs are cached and the
+// max dentries cached, zero valid disables the cache.
+func (s *Super) SetDentryCache(valid time.Duration, maxElements int) {
+	if s.immutable {
+		valid = ImmutableValidDuration
+	}
+	if maxElements <= 0 {
+		maxElements = DefaultMaxDentryCache
+	}
+	s.dc = NewDentryCache(valid, maxElements)
+}
+
+func (s *Super) attrValid() time.Duration {
+	if s.immutable {
+		return ImmutableValidDuration
+	}
+	return AttrValidDuration
+}
+
+func (s *Super) entryValid() time.Duration {
+	if s.immutable {
+		return ImmutableValidDuration
+	}
+	return LookupValidDuration
+}
+
+func (s *Super) dentryValid() time.Duration {
+	if s.immutable {
+		return ImmutableValidDuration
+	}
+	return DentryValidDuration
+}
+
+// Evicted is closed once the client is evicted by master.
+func (s *Super) Evicted() <-chan struct{} {
+	return s.mw.Evicted()
+}
+
+// OpenFilesHandle reports the handles this mount holds on the meta nodes.
+func (s *Super) OpenFilesHandle(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(map[string]interface{}{
+		"vol":       s.volname,
+		"sessionID": s.mw.SessionID(),
+		"openFiles": s.mw.OpenFiles(),
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write(data)
+}
+
+// BufferPoolHandle reports the use of the packet buffers pooled by the client.
+func (s *Super) BufferPoolHandle(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(buf.Buffers.Stats())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write(data)
+}
+
+/*the root span of a fuse request on the inode, name is the entry under the inode if not empty*/
+func (s *Super) startSpan(op string, ino uint64, name string) (span *trace.Span) {
+	span = trace.StartRoot(op, trace.SpanKindInternal)
+	span.SetAttribute("vol", s.volname)
+	span.SetAttribute("ino", ino)
+	if name != "" {
+		span.SetAttribute("name", name)
+	}
+	return
+}
+
 func (s *Super) umpKey(act string) string {
 	return fmt.Sprintf("%s_fuseclient_%s", s.cluster, act)
 }
@@ -0,0 +1,97 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package fs
+
+import (
+	"syscall"
+
+	"github.com/tiglabs/containerfs/fuse"
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/log"
+	"golang.org/x/net/context"
+)
+
+// The flags of setxattr of linux.
+const (
+	xattrCreate  = 0x1
+	xattrReplace = 0x2
+)
+
+// The xattrs of the files and the dirs are kept by the meta nodes, they are
+// not cached and each request goes to the meta partition of the inode.
+
+func (s *Super) getxattr(ctx context.Context, ino uint64, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	value, err := s.mw.GetXAttrContext(s.callerContext(ctx, req.Header), ino, req.Name)
+	if err != nil {
+		if err == syscall.ENODATA {
+			return fuse.ErrNoXattr
+		}
+		log.LogErrorf("Getxattr: ino(%v) name(%v) err(%v)", ino, req.Name, err)
+		return ParseError(err)
+	}
+	// a size of 0 asks for the length only, fuse replies it
+	if req.Size != 0 && int(req.Size) < len(value) {
+		return fuse.Errno(syscall.ERANGE)
+	}
+	resp.Xattr = value
+	log.LogDebugf("TRACE Getxattr: ino(%v) name(%v) size(%v)", ino, req.Name, len(value))
+	return nil
+}
+
+func (s *Super) listxattr(ino uint64, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	names, err := s.mw.ListXAttr(ino)
+	if err != nil {
+		log.LogErrorf("Listxattr: ino(%v) err(%v)", ino, err)
+		return ParseError(err)
+	}
+	resp.Append(names...)
+	if req.Size != 0 && int(req.Size) < len(resp.Xattr) {
+		resp.Xattr = nil
+		return fuse.Errno(syscall.ERANGE)
+	}
+	log.LogDebugf("TRACE Listxattr: ino(%v) names(%v)", ino, len(names))
+	return nil
+}
+
+func (s *Super) setxattr(ctx context.Context, ino uint64, req *fuse.SetxattrRequest) error {
+	var flags uint32
+	if req.Flags&xattrCreate != 0 {
+		flags |= proto.XAttrCreate
+	}
+	if req.Flags&xattrReplace != 0 {
+		flags |= proto.XAttrReplace
+	}
+	if err := s.mw.SetXAttrContext(s.callerContext(ctx, req.Header), ino, req.Name, req.Xattr, flags); err != nil {
+		if err == syscall.ENODATA {
+			return fuse.ErrNoXattr
+		}
+		log.LogErrorf("Setxattr: ino(%v) name(%v) flags(%v) err(%v)", ino, req.Name, req.Flags, err)
+		return ParseError(err)
+	}
+	log.LogDebugf("TRACE Setxattr: ino(%v) name(%v) size(%v)", ino, req.Name, len(req.Xattr))
+	return nil
+}
+
+func (s *Super) removexattr(ctx context.Context, ino uint64, req *fuse.RemovexattrRequest) error {
+	if err := s.mw.RemoveXAttrContext(s.callerContext(ctx, req.Header), ino, req.Name); err != nil {
+		if err == syscall.ENODATA {
+			return fuse.ErrNoXattr
+		}
+		log.LogErrorf("Removexattr: ino(%v) name(%v) err(%v)", ino, req.Name, err)
+		return ParseError(err)
+	}
+	log.LogDebugf("TRACE Removexattr: ino(%v) name(%v)", ino, req.Name)
+	return nil
+}
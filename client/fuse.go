@@ -30,14 +30,20 @@ import (
 	"path"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/tiglabs/containerfs/fuse"
 	"github.com/tiglabs/containerfs/fuse/fs"
 
 	bdfs "github.com/tiglabs/containerfs/client/fs"
+	"github.com/tiglabs/containerfs/sdk/meta"
 	"github.com/tiglabs/containerfs/util"
+	"github.com/tiglabs/containerfs/util/auth"
+	"github.com/tiglabs/containerfs/util/buf"
 	"github.com/tiglabs/containerfs/util/config"
 	"github.com/tiglabs/containerfs/util/log"
+	"github.com/tiglabs/containerfs/util/pool"
+	"github.com/tiglabs/containerfs/util/trace"
 	"github.com/tiglabs/containerfs/util/ump"
 	"strconv"
 )
@@ -72,11 +78,11 @@ func main() {
 }
 
 func Mount(cfg *config.Config) error {
-	mnt := cfg.GetString("mountpoint")
-	volname := cfg.GetString("volname")
 	master := cfg.GetString("master")
 	logpath := cfg.GetString("logpath")
 	loglvl := cfg.GetString("loglvl")
+	logFormat := cfg.GetString("logFormat")
+	logSampleLines := cfg.GetInt("logSampleLines")
 	profport := cfg.GetString("profport")
 
 	bufferSizeStr := cfg.GetString("bufferSize")
@@ -95,37 +101,306 @@ func Mount(cfg *config.Config) error {
 	icacheTimeout := cfg.GetInt("icacheTimeout")
 	fmt.Println(fmt.Sprintf("icacheTimeout [%v]", icacheTimeout))
 
-	c, err := fuse.Mount(
-		mnt,
-		fuse.AllowOther(),
-		fuse.MaxReadahead(MaxReadAhead),
-		fuse.AsyncRead(),
-		fuse.FSName("cfs-"+volname),
-		fuse.LocalVolume(),
-		fuse.VolumeName("cfs-"+volname))
+	readAheadCacheStr := cfg.GetString("readAheadCacheMB")
+	writeBackStr := cfg.GetString("writeBackMB")
+	writeBackFlushers := cfg.GetInt("writeBackFlushers")
+	dentryCacheStr := cfg.GetString("dentryCacheSeconds")
+	dentryCacheSize := cfg.GetInt("dentryCacheSize")
+	migrateReleasing := cfg.GetBool("migrateReleasing")
+	localLocks := cfg.GetBool("localLocks")
+	kernelWritebackCache := cfg.GetBool("kernelWritebackCache")
+	cacheLeases := cfg.GetBool("cacheLeases")
+	zone := cfg.GetString("zone")
+	auditLog := cfg.GetString("auditLog")
+	auditSlowMs := cfg.GetInt("auditSlowMs")
+	bufferPoolMaxKB := cfg.GetInt("bufferPoolMaxKB")
+	zeroCopyRead := cfg.GetBool("zeroCopyRead")
+	traceEndpoint := cfg.GetString("traceEndpoint")
+	traceSampleRatio := cfg.GetFloat("traceSampleRatio")
 
+	level := ParseLogLevel(loglvl)
+	_, err := log.InitLog(path.Join(logpath, LoggerDir), LoggerPrefix, level)
 	if err != nil {
 		return err
 	}
-	defer c.Close()
+	defer log.LogFlush()
+	log.SetJSON(strings.ToLower(logFormat) == "json")
+	if logSampleLines != 0 {
+		log.SetSampleLines(logSampleLines)
+	}
+	trace.Init("client", traceEndpoint, traceSampleRatio)
+	defer trace.Close()
 
-	level := ParseLogLevel(loglvl)
-	_, err = log.InitLog(path.Join(logpath, LoggerDir), LoggerPrefix, level)
+	// the connections to the masters, the metanodes and the datanodes use TLS if certFile or caFile is set
+	tlsConfig, err := cfg.ClientTLSConfig()
 	if err != nil {
 		return err
 	}
-	defer log.LogFlush()
+	pool.SetTLSConfig(tlsConfig)
+	util.SetMasterTLSConfig(tlsConfig)
+
+	if bufferPoolMaxKB > 0 {
+		if err = buf.Buffers.SetMaxPooledSize(int(bufferPoolMaxKB) * util.KB); err != nil {
+			return fmt.Errorf("bufferPoolMaxKB(%v) is invalid: %v", bufferPoolMaxKB, err)
+		}
+	}
+
+	// the mounts share the connections, they are of the same session so that
+	// the eviction of the session fences all of them
+	session := meta.NewSessionID()
+	// the settings of the caches and the data path are the same for all the mounts
+	newSuper := func(m *mountConfig, auditFile string) (super *bdfs.Super, err error) {
+		if super, err = bdfs.NewSuper(m.volname, master, session, icacheTimeout, connPool(m, session)); err != nil {
+			return
+		}
+		if m.subdir != "" {
+			if err = super.SetSubdir(m.subdir); err != nil {
+				return nil, err
+			}
+		}
+		// the nodes refuse the writes of a read only vol anyway
+		if super.ReadOnly() {
+			m.readonly = true
+		}
+		if readAheadCacheStr != "" {
+			readAheadCacheMB, err := strconv.Atoi(readAheadCacheStr)
+			if err != nil {
+				return nil, fmt.Errorf("readAheadCacheMB(%v) is invalid: %v", readAheadCacheStr, err)
+			}
+			super.SetReadAheadCache(readAheadCacheMB * util.MB)
+		}
+		if writeBackStr != "" {
+			writeBackMB, err := strconv.Atoi(writeBackStr)
+			if err != nil {
+				return nil, fmt.Errorf("writeBackMB(%v) is invalid: %v", writeBackStr, err)
+			}
+			super.SetWriteBack(writeBackMB*util.MB, int(writeBackFlushers))
+		}
+		// the kernel keeps the written pages until they are flushed, the caches
+		// of the files changed by the other clients are dropped by the leases
+		m.writeback = kernelWritebackCache && !super.Immutable() && !m.readonly
+		leases := cacheLeases || m.writeback
+		if dentryCacheStr != "" || dentryCacheSize != 0 || leases {
+			dentryCacheSeconds := int(bdfs.DentryValidDuration / time.Second)
+			if leases {
+				dentryCacheSeconds = int(bdfs.LeasedDentryValidDuration / time.Second)
+			}
+			if dentryCacheStr != "" {
+				if dentryCacheSeconds, err = strconv.Atoi(dentryCacheStr); err != nil {
+					return nil, fmt.Errorf("dentryCacheSeconds(%v) is invalid: %v", dentryCacheStr, err)
+				}
+			}
+			super.SetDentryCache(time.Duration(dentryCacheSeconds)*time.Second, int(dentryCacheSize))
+		}
+
+		if zone != "" {
+			super.SetZone(zone)
+		}
+		if zeroCopyRead {
+			super.SetZeroCopyRead(true)
+		}
+		if leases {
+			super.EnableLeases()
+		}
+		if auditFile != "" {
+			if err = super.SetAuditLog(auditFile, time.Duration(auditSlowMs)*time.Millisecond); err != nil {
+				return nil, fmt.Errorf("auditLog(%v) open failed: %v", auditFile, err)
+			}
+		}
+		return
+	}
 
-	super, err := bdfs.NewSuper(volname, master, icacheTimeout)
+	mounts, err := parseMounts(cfg)
 	if err != nil {
 		return err
 	}
+	supers := make([]*bdfs.Super, 0, len(mounts))
+	defer func() {
+		for _, super := range supers {
+			// flushes the write back cache and stops its flushers
+			super.SetWriteBack(0, 0)
+			super.CloseAuditLog()
+		}
+	}()
+	for i, m := range mounts {
+		auditFile := auditLog
+		if auditFile != "" && len(mounts) > 1 {
+			auditFile = fmt.Sprintf("%v.%v", auditLog, i)
+		}
+		super, err := newSuper(m, auditFile)
+		if err != nil {
+			return fmt.Errorf("mount(%v) of vol(%v): %v", m.mountpoint, m.volname, err)
+		}
+		supers = append(supers, super)
+	}
 
+	http.HandleFunc("/openFiles", openFilesHandle(mounts, supers))
+	http.HandleFunc("/bufferPool", supers[0].BufferPoolHandle)
+	http.HandleFunc(log.LevelPath, log.LevelHandle)
 	go func() {
 		fmt.Println(http.ListenAndServe(":"+profport, nil))
 	}()
 
-	if err = fs.Serve(c, super); err != nil {
+	// the mounts are served until they are all unmounted, the first error is returned
+	errC := make(chan error, len(mounts))
+	for i, m := range mounts {
+		go func(m *mountConfig, super *bdfs.Super) {
+			errC <- serve(m, super, localLocks, migrateReleasing)
+		}(m, supers[i])
+	}
+	for range mounts {
+		if e := <-errC; e != nil {
+			log.LogErrorf("Mount: %v", e)
+			if err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+// a vol mounted by the client, the client mounts the ones of "mounts" or the
+// one of "volname" and "mountpoint"
+type mountConfig struct {
+	mountpoint string
+	volname    string
+	subdir     string
+	token      string
+	readonly   bool
+	writeback  bool // mounted with the writeback cache of the kernel
+}
+
+/*the mounts of the config, the keys of an entry of "mounts" override the ones of the top level*/
+func parseMounts(cfg *config.Config) (mounts []*mountConfig, err error) {
+	top := &mountConfig{
+		mountpoint: cfg.GetString("mountpoint"),
+		volname:    cfg.GetString("volname"),
+		subdir:     cfg.GetString("subdir"),
+		token:      cfg.GetString(auth.Token),
+		readonly:   cfg.GetBool("readonly"),
+	}
+	entries := cfg.GetArray("mounts")
+	if len(entries) == 0 {
+		mounts = append(mounts, top)
+	}
+	for i, e := range entries {
+		entry, ok := e.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("mounts[%v] is not an object", i)
+		}
+		m := *top
+		m.mountpoint = ""
+		for key, value := range entry {
+			switch v := value.(type) {
+			case string:
+				switch key {
+				case "mountpoint":
+					m.mountpoint = v
+				case "volname":
+					m.volname = v
+				case "subdir":
+					m.subdir = v
+				case auth.Token:
+					m.token = v
+				default:
+					return nil, fmt.Errorf("mounts[%v] key(%v) is unknown", i, key)
+				}
+			case bool:
+				if key != "readonly" {
+					return nil, fmt.Errorf("mounts[%v] key(%v) is unknown", i, key)
+				}
+				m.readonly = v
+			default:
+				return nil, fmt.Errorf("mounts[%v] key(%v) is invalid", i, key)
+			}
+		}
+		mounts = append(mounts, &m)
+	}
+	mountpoints := make(map[string]bool, len(mounts))
+	for _, m := range mounts {
+		if m.mountpoint == "" || m.volname == "" {
+			return nil, fmt.Errorf("mount(%v) of vol(%v): mountpoint and volname are required", m.mountpoint, m.volname)
+		}
+		if mountpoints[path.Clean(m.mountpoint)] {
+			return nil, fmt.Errorf("mountpoint(%v) is mounted twice", m.mountpoint)
+		}
+		mountpoints[path.Clean(m.mountpoint)] = true
+	}
+	return
+}
+
+/*the token is required by the metanodes and the datanodes once the vol has tokens, the connections authenticated with it are shared by the mounts of the vol only, the others by all the mounts. All present the session of the process*/
+func connPool(m *mountConfig, session string) *pool.ConnectPool {
+	if m.token == "" {
+		return pool.SharedConnPool("", auth.ConnectHook("", "", session))
+	}
+	return pool.SharedConnPool(m.volname+"/"+m.token, auth.ConnectHook(m.volname, m.token, session))
+}
+
+/*the open files of the mount of the mountpoint in the query, of the first mount without it*/
+func openFilesHandle(mounts []*mountConfig, supers []*bdfs.Super) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mountpoint := r.FormValue("mountpoint")
+		for i, m := range mounts {
+			if mountpoint == "" || path.Clean(mountpoint) == path.Clean(m.mountpoint) {
+				supers[i].OpenFilesHandle(w, r)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf("mountpoint(%v) not found", mountpoint)))
+	}
+}
+
+func serve(m *mountConfig, super *bdfs.Super, localLocks, migrateReleasing bool) (err error) {
+	options := []fuse.MountOption{
+		fuse.AllowOther(),
+		fuse.MaxReadahead(MaxReadAhead),
+		fuse.AsyncRead(),
+		fuse.FSName("cfs-" + m.volname),
+		fuse.LocalVolume(),
+		fuse.VolumeName("cfs-" + m.volname),
+	}
+	if super.Immutable() || m.readonly {
+		options = append(options, fuse.ReadOnly())
+	}
+	// the kernel checks the opens and the accesses of the users with the checks
+	// of the meta nodes, a vol changed while mounted is checked so after a remount
+	if super.Permission() {
+		options = append(options, fuse.DefaultPermissions())
+	}
+	// the flock and fcntl locks are kept by the meta nodes for all the clients,
+	// the kernel keeps them for the mount only with localLocks
+	if !localLocks {
+		options = append(options, fuse.LockingFlock(), fuse.LockingPOSIX())
+	}
+	if m.writeback {
+		options = append(options, fuse.WritebackCache())
+	}
+	c, err := fuse.Mount(m.mountpoint, options...)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// the files are moved off the partitions released by the shrink of the vol,
+	// the migrator walks the whole vol so a subdir mount does not run it
+	if migrateReleasing && !super.Immutable() && !m.readonly && !super.IsSubdir() {
+		super.StartMigrator()
+	}
+
+	go func() {
+		// Forced unmount once master evicted this client.
+		<-super.Evicted()
+		log.LogErrorf("client evicted by master, unmount(%v)", m.mountpoint)
+		if err := fuse.Unmount(m.mountpoint); err != nil {
+			log.LogErrorf("unmount(%v) failed: %v", m.mountpoint, err)
+		}
+	}()
+
+	srv := fs.New(c, nil)
+	super.SetServer(srv)
+	if err = srv.Serve(super); err != nil {
 		return err
 	}
 
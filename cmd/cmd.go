@@ -18,7 +18,12 @@ import (
 	"github.com/tiglabs/containerfs/datanode"
 	"github.com/tiglabs/containerfs/master"
 	"github.com/tiglabs/containerfs/metanode"
+	"github.com/tiglabs/containerfs/objectnode"
+	"github.com/tiglabs/containerfs/util"
+	"github.com/tiglabs/containerfs/util/auth"
 	"github.com/tiglabs/containerfs/util/log"
+	"github.com/tiglabs/containerfs/util/pool"
+	"github.com/tiglabs/containerfs/util/trace"
 	"strings"
 
 	"flag"
@@ -40,22 +45,27 @@ const (
 )
 
 const (
-	ConfigKeyRole     = "role"
-	ConfigKeyLogDir   = "logDir"
-	ConfigKeyLogLevel = "logLevel"
-	ConfigKeyProfPort = "prof"
+	ConfigKeyRole           = "role"
+	ConfigKeyLogDir         = "logDir"
+	ConfigKeyLogLevel       = "logLevel"
+	ConfigKeyLogFormat      = "logFormat"
+	ConfigKeyLogSampleLines = "logSampleLines"
+	ConfigKeyTraceEndpoint  = "traceEndpoint"
+	ConfigKeyProfPort       = "prof"
 )
 
 const (
 	RoleMaster = "master"
 	RoleMeta   = "metanode"
 	RoleData   = "datanode"
+	RoleObject = "objectnode"
 )
 
 const (
 	ModuleMaster = "master"
 	ModuleMeta   = "metaNode"
 	ModuleData   = "dataNode"
+	ModuleObject = "objectNode"
 )
 
 var (
@@ -123,6 +133,9 @@ func main() {
 	case RoleData:
 		server = datanode.NewServer()
 		module = ModuleData
+	case RoleObject:
+		server = objectnode.NewServer()
+		module = ModuleObject
 	default:
 		log.LogInfo("Fatal: role mismatch: ", role)
 		os.Exit(1)
@@ -146,6 +159,8 @@ func main() {
 		level = log.ErrorLevel
 	}
 
+	// the levels are changed at runtime by the prof port
+	http.HandleFunc(log.LevelPath, log.LevelHandle)
 	if profPort != "" {
 		go func() {
 			http.ListenAndServe(fmt.Sprintf(":%v", profPort), nil)
@@ -157,9 +172,30 @@ func main() {
 		os.Exit(1)
 		return
 	}
+	log.SetJSON(strings.ToLower(cfg.GetString(ConfigKeyLogFormat)) == "json")
+	if lines := cfg.GetInt(ConfigKeyLogSampleLines); lines != 0 {
+		log.SetSampleLines(lines)
+	}
+	// the nodes start no trace, they only continue the traces sampled by the clients
+	trace.Init(module, cfg.GetString(ConfigKeyTraceEndpoint), 0)
+
+	// the connections to the other nodes and the masters use TLS if certFile or caFile is set
+	tlsConfig, err := cfg.ClientTLSConfig()
+	if err != nil {
+		log.LogFatal("Fatal: failed to load the tls config - ", err)
+		log.LogFlush()
+		os.Exit(1)
+		return
+	}
+	pool.SetTLSConfig(tlsConfig)
+	util.SetMasterTLSConfig(tlsConfig)
+	// the nodes of the cluster present the auth key on the connections to each other
+	if key := cfg.GetString(auth.AuthKey); key != "" {
+		pool.SetDialHook(auth.ConnectHook("", key, ""))
+	}
 
 	interceptSignal(server)
-	err := server.Start(cfg)
+	err = server.Start(cfg)
 	if err != nil {
 		log.LogFatal("Fatal: failed to start the baud storage daemon - ", err)
 		log.LogFlush()
@@ -168,6 +204,7 @@ func main() {
 	}
 	// Block main goroutine until server shutdown.
 	server.Sync()
+	trace.Close()
 	log.LogFlush()
 	os.Exit(0)
 }
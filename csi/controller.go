@@ -0,0 +1,169 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"strconv"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/tiglabs/containerfs/proto"
+	cfsmaster "github.com/tiglabs/containerfs/sdk/master"
+	"github.com/tiglabs/containerfs/util"
+	"github.com/tiglabs/containerfs/util/log"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// parameters of the storage class
+const (
+	ParamReplicas = "replicas"
+	ParamVolType  = "type"
+)
+
+const (
+	DefaultReplicas = 3
+)
+
+func (d *driver) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
+	return &csi.ControllerGetCapabilitiesResponse{
+		Capabilities: []*csi.ControllerServiceCapability{
+			{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{Type: csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME},
+				},
+			},
+		},
+	}, nil
+}
+
+/*create the vol named after the PV, a vol already created by a retry of the request is returned as it is*/
+func (d *driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (resp *csi.CreateVolumeResponse, err error) {
+	name := req.GetName()
+	if name == "" {
+		return nil, status.Error(codes.InvalidArgument, "name missing")
+	}
+	if err = checkVolumeCapabilities(req.GetVolumeCapabilities()); err != nil {
+		return
+	}
+	replicas := DefaultReplicas
+	if value, ok := req.GetParameters()[ParamReplicas]; ok {
+		if replicas, err = strconv.Atoi(value); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%v[%v] invalid", ParamReplicas, value)
+		}
+	}
+	volType := proto.ExtentPartition
+	if value, ok := req.GetParameters()[ParamVolType]; ok {
+		volType = value
+	}
+	// the quota of master is in GB
+	var quota uint64
+	if bytes := req.GetCapacityRange().GetRequiredBytes(); bytes > 0 {
+		quota = (uint64(bytes) + util.GB - 1) / util.GB
+	}
+
+	_, err = d.master.GetVolStat(ctx, name)
+	if err != nil && !cfsmaster.IsNotFound(err) {
+		return nil, status.Errorf(codes.Unavailable, "get vol[%v]: %v", name, err)
+	}
+	if err != nil {
+		if err = d.master.CreateVol(ctx, name, volType, replicas, ""); err != nil {
+			return nil, status.Errorf(codes.Internal, "create vol[%v]: %v", name, err)
+		}
+		log.LogWarnf("action[CreateVolume] vol[%v] type[%v] replicas[%v] created", name, volType, replicas)
+	}
+	if quota > 0 {
+		if err = d.master.SetVolQuota(ctx, name, quota); err != nil {
+			return nil, status.Errorf(codes.Internal, "set vol[%v] quota: %v", name, err)
+		}
+	}
+	resp = &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      name,
+			CapacityBytes: int64(quota * util.GB),
+		},
+	}
+	return
+}
+
+func (d *driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (resp *csi.DeleteVolumeResponse, err error) {
+	name := req.GetVolumeId()
+	if name == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id missing")
+	}
+	if _, err = d.master.GetVolStat(ctx, name); err != nil {
+		if cfsmaster.IsNotFound(err) {
+			return &csi.DeleteVolumeResponse{}, nil
+		}
+		return nil, status.Errorf(codes.Unavailable, "get vol[%v]: %v", name, err)
+	}
+	if err = d.master.DeleteVol(ctx, name); err != nil {
+		return nil, status.Errorf(codes.Internal, "delete vol[%v]: %v", name, err)
+	}
+	log.LogWarnf("action[DeleteVolume] vol[%v] deleted", name)
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+func (d *driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (resp *csi.ValidateVolumeCapabilitiesResponse, err error) {
+	name := req.GetVolumeId()
+	if name == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id missing")
+	}
+	if _, err = d.master.GetVolStat(ctx, name); err != nil {
+		if cfsmaster.IsNotFound(err) {
+			return nil, status.Errorf(codes.NotFound, "vol[%v] not found", name)
+		}
+		return nil, status.Errorf(codes.Unavailable, "get vol[%v]: %v", name, err)
+	}
+	resp = &csi.ValidateVolumeCapabilitiesResponse{}
+	if checkVolumeCapabilities(req.GetVolumeCapabilities()) != nil {
+		resp.Message = "only mount access type is supported"
+		return
+	}
+	resp.Confirmed = &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+		VolumeContext:      req.GetVolumeContext(),
+		VolumeCapabilities: req.GetVolumeCapabilities(),
+		Parameters:         req.GetParameters(),
+	}
+	return
+}
+
+func (d *driver) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (d *driver) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (d *driver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (d *driver) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (d *driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (d *driver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (d *driver) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
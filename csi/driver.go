@@ -0,0 +1,103 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	cfsmaster "github.com/tiglabs/containerfs/sdk/master"
+	"github.com/tiglabs/containerfs/util/log"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	DriverName    = "csi.containerfs.io"
+	DriverVersion = "1.0"
+)
+
+// driver implements the identity, controller and node services of CSI, a
+// volume of containerfs is a PV and its name is the volume id.
+type driver struct {
+	nodeID     string
+	master     *cfsmaster.Client
+	masterAddr string
+	clientPath string
+	stateDir   string
+	logDir     string
+	logLevel   string
+	mountLock  sync.Mutex
+}
+
+func newDriver(nodeID, masterAddr, clientPath, stateDir, logDir, logLevel string) *driver {
+	return &driver{
+		nodeID:     nodeID,
+		master:     cfsmaster.NewClient(strings.Split(masterAddr, ",")),
+		masterAddr: masterAddr,
+		clientPath: clientPath,
+		stateDir:   stateDir,
+		logDir:     logDir,
+		logLevel:   logLevel,
+	}
+}
+
+func logInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (resp interface{}, err error) {
+	log.LogDebugf("action[%v] request: %v", info.FullMethod, req)
+	if resp, err = handler(ctx, req); err != nil {
+		log.LogErrorf("action[%v] request(%v) err(%v)", info.FullMethod, req, err)
+	}
+	return
+}
+
+func (d *driver) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
+	return &csi.GetPluginInfoResponse{Name: DriverName, VendorVersion: DriverVersion}, nil
+}
+
+func (d *driver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	return &csi.GetPluginCapabilitiesResponse{
+		Capabilities: []*csi.PluginCapability{
+			{
+				Type: &csi.PluginCapability_Service_{
+					Service: &csi.PluginCapability_Service{Type: csi.PluginCapability_Service_CONTROLLER_SERVICE},
+				},
+			},
+		},
+	}, nil
+}
+
+func (d *driver) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	return &csi.ProbeResponse{}, nil
+}
+
+/*all the access modes are supported by the shared file system, raw block is not*/
+func checkVolumeCapabilities(caps []*csi.VolumeCapability) error {
+	if len(caps) == 0 {
+		return status.Error(codes.InvalidArgument, "volume capabilities missing")
+	}
+	for _, c := range caps {
+		if c.GetBlock() != nil {
+			return status.Error(codes.InvalidArgument, "block access type not supported")
+		}
+		if c.GetAccessMode() == nil {
+			return status.Error(codes.InvalidArgument, "access mode missing")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+//
+// Usage: ./csi -endpoint unix:///csi/csi.sock -nodeid $NODE_NAME -master 10.196.31.173:80,10.196.31.141:80
+//
+// The same binary serves the controller service, run with the external
+// provisioner, and the node service, run on every node with the client binary.
+//
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/tiglabs/containerfs/util/log"
+	"google.golang.org/grpc"
+)
+
+const (
+	LoggerDir    = "csi"
+	LoggerPrefix = "csi"
+)
+
+var (
+	endpoint   = flag.String("endpoint", "unix:///csi/csi.sock", "CSI endpoint")
+	nodeID     = flag.String("nodeid", "", "identity of the node")
+	masterAddr = flag.String("master", "", "addresses of master server, separated by comma")
+	clientPath = flag.String("client", "cfs-client", "path of the FUSE client binary")
+	stateDir   = flag.String("statedir", "/var/lib/containerfs/csi", "dir of the client configs of the mounts")
+	logDir     = flag.String("logdir", "/var/log/containerfs", "path for log file storage")
+	logLevel   = flag.String("loglvl", "info", "level of logging")
+)
+
+func main() {
+	flag.Parse()
+	if *nodeID == "" || *masterAddr == "" {
+		fmt.Println("nodeid and master are required")
+		os.Exit(1)
+	}
+	if _, err := log.InitLog(path.Join(*logDir, LoggerDir), LoggerPrefix, parseLogLevel(*logLevel)); err != nil {
+		fmt.Println("init log failed: ", err)
+		os.Exit(1)
+	}
+	defer log.LogFlush()
+	d := newDriver(*nodeID, *masterAddr, *clientPath, *stateDir, *logDir, *logLevel)
+	if err := serve(*endpoint, d); err != nil {
+		log.LogErrorf("action[main] serve %v: %v", *endpoint, err)
+		fmt.Println("serve failed: ", err)
+		os.Exit(1)
+	}
+}
+
+func serve(endpoint string, d *driver) (err error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return
+	}
+	addr := u.Host
+	if u.Scheme == "unix" {
+		addr = u.Path
+		os.MkdirAll(path.Dir(addr), 0755)
+		if err = os.Remove(addr); err != nil && !os.IsNotExist(err) {
+			return
+		}
+	}
+	listener, err := net.Listen(u.Scheme, addr)
+	if err != nil {
+		return
+	}
+	server := grpc.NewServer(grpc.UnaryInterceptor(logInterceptor))
+	csi.RegisterIdentityServer(server, d)
+	csi.RegisterControllerServer(server, d)
+	csi.RegisterNodeServer(server, d)
+	log.LogInfof("action[serve] driver[%v] node[%v] listen on %v", DriverName, d.nodeID, endpoint)
+	return server.Serve(listener)
+}
+
+func parseLogLevel(loglvl string) log.Level {
+	switch loglvl {
+	case "debug":
+		return log.DebugLevel
+	case "info":
+		return log.InfoLevel
+	case "warn":
+		return log.WarnLevel
+	default:
+		return log.ErrorLevel
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/juju/errors"
+	"github.com/tiglabs/containerfs/fuse"
+	"github.com/tiglabs/containerfs/util/log"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	MountTimeout       = 10 * time.Second
+	MountCheckInterval = 100 * time.Millisecond
+)
+
+// the config of the FUSE client started for a mount, see client/fuse.json
+type clientConfig struct {
+	MountPoint string `json:"mountpoint"`
+	VolName    string `json:"volname"`
+	Master     string `json:"master"`
+	LogPath    string `json:"logpath"`
+	LogLevel   string `json:"loglvl"`
+	ReadOnly   bool   `json:"readonly"`
+}
+
+func (d *driver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	return &csi.NodeGetInfoResponse{NodeId: d.nodeID}, nil
+}
+
+func (d *driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	return &csi.NodeGetCapabilitiesResponse{
+		Capabilities: []*csi.NodeServiceCapability{
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS},
+				},
+			},
+		},
+	}, nil
+}
+
+func (d *driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (d *driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+/*mount the vol on the target path by a FUSE client of its own*/
+func (d *driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (resp *csi.NodePublishVolumeResponse, err error) {
+	name, target := req.GetVolumeId(), req.GetTargetPath()
+	if name == "" || target == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id or target path missing")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume capability missing")
+	}
+	if err = checkVolumeCapabilities([]*csi.VolumeCapability{req.GetVolumeCapability()}); err != nil {
+		return
+	}
+	d.mountLock.Lock()
+	defer d.mountLock.Unlock()
+	mounted, err := isMountPoint(target)
+	switch {
+	case os.IsNotExist(err):
+		if err = os.MkdirAll(target, 0750); err != nil {
+			return nil, status.Errorf(codes.Internal, "create target[%v]: %v", target, err)
+		}
+	case err != nil:
+		// the client of the mount exited
+		log.LogWarnf("action[NodePublishVolume] vol[%v] target[%v] stale mount: %v", name, target, err)
+		fuse.Unmount(target)
+	case mounted:
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+	if err = d.mount(name, target, req.GetReadonly()); err != nil {
+		return nil, status.Errorf(codes.Internal, "mount vol[%v] on %v: %v", name, target, err)
+	}
+	log.LogWarnf("action[NodePublishVolume] vol[%v] mounted on %v readonly[%v]", name, target, req.GetReadonly())
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+func (d *driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (resp *csi.NodeUnpublishVolumeResponse, err error) {
+	name, target := req.GetVolumeId(), req.GetTargetPath()
+	if name == "" || target == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id or target path missing")
+	}
+	d.mountLock.Lock()
+	defer d.mountLock.Unlock()
+	mounted, err := isMountPoint(target)
+	if os.IsNotExist(err) {
+		os.Remove(d.configFile(target))
+		return &csi.NodeUnpublishVolumeResponse{}, nil
+	}
+	if mounted || err != nil {
+		// the client exits once unmounted
+		if err = fuse.Unmount(target); err != nil {
+			return nil, status.Errorf(codes.Internal, "unmount %v: %v", target, err)
+		}
+	}
+	os.Remove(d.configFile(target))
+	if err = os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return nil, status.Errorf(codes.Internal, "remove target[%v]: %v", target, err)
+	}
+	log.LogWarnf("action[NodeUnpublishVolume] vol[%v] unmounted from %v", name, target)
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+func (d *driver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	volumePath := req.GetVolumePath()
+	if req.GetVolumeId() == "" || volumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id or volume path missing")
+	}
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(volumePath, &fs); err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume path[%v] not found", volumePath)
+		}
+		return nil, status.Errorf(codes.Internal, "statfs %v: %v", volumePath, err)
+	}
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Unit:      csi.VolumeUsage_BYTES,
+				Total:     int64(fs.Blocks) * int64(fs.Bsize),
+				Available: int64(fs.Bavail) * int64(fs.Bsize),
+				Used:      int64(fs.Blocks-fs.Bfree) * int64(fs.Bsize),
+			},
+			{
+				Unit:      csi.VolumeUsage_INODES,
+				Total:     int64(fs.Files),
+				Available: int64(fs.Ffree),
+				Used:      int64(fs.Files - fs.Ffree),
+			},
+		},
+	}, nil
+}
+
+func (d *driver) configFile(target string) string {
+	return path.Join(d.stateDir, fmt.Sprintf("%x.json", md5.Sum([]byte(target))))
+}
+
+/*start a client for the target and wait until it is mounted*/
+func (d *driver) mount(name, target string, readOnly bool) (err error) {
+	filename := d.configFile(target)
+	conf := &clientConfig{
+		MountPoint: target,
+		VolName:    name,
+		Master:     d.masterAddr,
+		LogPath:    path.Join(d.logDir, path.Base(filename[:len(filename)-len(".json")])),
+		LogLevel:   d.logLevel,
+		ReadOnly:   readOnly,
+	}
+	data, err := json.Marshal(conf)
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(d.stateDir, 0755); err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(filename, data, 0644); err != nil {
+		return
+	}
+	if err = os.MkdirAll(conf.LogPath, 0755); err != nil {
+		return
+	}
+	output, err := os.OpenFile(path.Join(conf.LogPath, "output.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	defer output.Close()
+	cmd := exec.Command(d.clientPath, "-c", filename)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err = cmd.Start(); err != nil {
+		return
+	}
+	exitC := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		log.LogWarnf("action[mount] client of vol[%v] on %v exited: %v", name, target, err)
+		exitC <- err
+	}()
+	timeout := time.After(MountTimeout)
+	for {
+		select {
+		case err = <-exitC:
+			return errors.Errorf("client exited: %v, see %v", err, output.Name())
+		case <-timeout:
+			cmd.Process.Kill()
+			return errors.Errorf("not mounted in %v, see %v", MountTimeout, output.Name())
+		case <-time.After(MountCheckInterval):
+			if mounted, _ := isMountPoint(target); mounted {
+				return nil
+			}
+		}
+	}
+}
+
+/*a mount point is on another device than its parent*/
+func isMountPoint(p string) (mounted bool, err error) {
+	info, err := os.Stat(p)
+	if err != nil {
+		return
+	}
+	parent, err := os.Stat(path.Dir(p))
+	if err != nil {
+		return
+	}
+	return info.Sys().(*syscall.Stat_t).Dev != parent.Sys().(*syscall.Stat_t).Dev, nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tiglabs/containerfs/master"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	replicaAddrTTL      = 5 * time.Minute
+	replicaAddrRetryTTL = 30 * time.Second //a node the master could not tell is asked again sooner
+)
+
+// replicaAddrs caches the replication address advertised to the master by
+// every peer data node, keyed by any address the peer is known by.
+var replicaAddrs sync.Map
+
+type replicaAddrEntry struct {
+	addr       atomic.Value //string
+	expires    int64        //unix nano
+	refreshing int32
+}
+
+func newReplicaAddrEntry(addr string, expires int64) (entry *replicaAddrEntry) {
+	entry = &replicaAddrEntry{expires: expires}
+	entry.addr.Store(addr)
+	return
+}
+
+type advertisedAddrs struct {
+	Addr        string
+	ClientAddr  string
+	ReplicaAddr string
+}
+
+// isLocalHost tells if the control addr of a replica is the one of this node.
+func isLocalHost(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	return err == nil && host == LocalIP
+}
+
+// replicaAddr translate the addr of a peer data node to the address its
+// replication traffic should be sent to. If the master does not know
+// the node or the node not advertise a replica address, addr is returned.
+// The master is never asked on the data path: a node not cached yet gets addr
+// until the lookup started in the background is done, and an expired entry is
+// used while it is refreshed.
+func replicaAddr(addr string) string {
+	v, ok := replicaAddrs.Load(addr)
+	if !ok {
+		v, _ = replicaAddrs.LoadOrStore(addr, newReplicaAddrEntry(addr, 0))
+	}
+	entry := v.(*replicaAddrEntry)
+	if atomic.LoadInt64(&entry.expires) < time.Now().UnixNano() && atomic.CompareAndSwapInt32(&entry.refreshing, 0, 1) {
+		go refreshReplicaAddr(addr, entry)
+	}
+	return entry.addr.Load().(string)
+}
+
+func refreshReplicaAddr(addr string, entry *replicaAddrEntry) {
+	defer atomic.StoreInt32(&entry.refreshing, 0)
+	params := make(map[string]string)
+	params["addr"] = addr
+	data, err := MasterHelper.Request(http.MethodGet, master.GetDataNode, params, nil)
+	if err != nil {
+		log.LogWarnf("action[refreshReplicaAddr] cannot get dataNode(%v) from master err(%v).", addr, err)
+		atomic.StoreInt64(&entry.expires, time.Now().Add(replicaAddrRetryTTL).UnixNano())
+		return
+	}
+	expires := time.Now().Add(replicaAddrTTL).UnixNano()
+	node := new(advertisedAddrs)
+	if err = json.Unmarshal(data, node); err != nil || node.ReplicaAddr == "" {
+		entry.addr.Store(addr)
+		atomic.StoreInt64(&entry.expires, expires)
+		return
+	}
+	entry.addr.Store(node.ReplicaAddr)
+	atomic.StoreInt64(&entry.expires, expires)
+	for _, a := range []string{node.Addr, node.ClientAddr, node.ReplicaAddr} {
+		if a != "" && a != addr {
+			replicaAddrs.Store(a, newReplicaAddrEntry(node.ReplicaAddr, expires))
+		}
+	}
+}
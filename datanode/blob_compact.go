@@ -11,14 +11,15 @@ import (
 )
 
 var (
-	GcanCompact int
+	GcanCompact      int
+	compactThreshold = storage.CompactThreshold //percent of the dead bytes of a blob file to compact it
 )
 
 func (dp *dataPartition) lauchCompact() {
 	if GcanCompact != CanCompact {
 		return
 	}
-	if !dp.isLeader {
+	if !dp.IsLeader() {
 		return
 	}
 	blobFile, err := dp.getCompactBlobFiles()
@@ -32,7 +33,7 @@ func (dp *dataPartition) lauchCompact() {
 		dp.leaderPutBlobToAvaliCh(blobFile)
 		return
 	}
-	task := &CompactTask{partitionId: dp.partitionId, blobfileId: blobFile, isLeader: dp.isLeader}
+	task := &CompactTask{partitionId: dp.partitionId, blobfileId: blobFile, isLeader: dp.IsLeader()}
 	if dp.disk.hasExsitCompactTask(task.toString()) {
 		return
 	}
@@ -50,7 +51,7 @@ func (dp *dataPartition) leaderPutBlobToAvaliCh(blobFile int) {
 }
 
 func (dp *dataPartition) getCompactKey(blobFile int) string {
-	return fmt.Sprintf("CompactID(%v_%v_%v)", dp.partitionId, blobFile, dp.isLeader)
+	return fmt.Sprintf("CompactID(%v_%v_%v)", dp.partitionId, blobFile, dp.IsLeader())
 }
 
 func (dp *dataPartition) getCompactBlobFiles() (blobFile int, err error) {
@@ -60,7 +61,7 @@ func (dp *dataPartition) getCompactBlobFiles() (blobFile int, err error) {
 	if err != nil {
 		return -1, errors.Annotatef(err, "%v cannot get avalibBlobFile", dp.getCompactKey(-1))
 	}
-	thresh := -1
+	thresh := compactThreshold
 	if dp.Status() == proto.ReadOnly {
 		rand.Seed(time.Now().UnixNano())
 		thresh = rand.Intn(10) + 10
@@ -78,7 +79,7 @@ func (dp *dataPartition) notifyCompactBlobFile(blobFile int) (err error) {
 	for i := 1; i < len(dp.replicaHosts); i++ {
 		target := dp.replicaHosts[i]
 		pkg := NewNotifyCompactPkg(uint32(blobFile), dp.partitionId)
-		conn, err := gConnPool.Get(target)
+		conn, err := gConnPool.Get(replicaAddr(target))
 		if err != nil {
 			gConnPool.Put(conn, true)
 			return fmt.Errorf("%v notify compact package get connect for (%v) failed (%v)",
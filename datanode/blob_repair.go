@@ -56,7 +56,7 @@ func (dp *dataPartition) blobRepair() {
 	if dp.updateReplicaHosts() != nil {
 		return
 	}
-	if !dp.isLeader {
+	if !dp.IsLeader() {
 		return
 	}
 	defer func() {
@@ -155,9 +155,9 @@ func (dp *dataPartition) getLocalBlobFileMetas(filterBlobFileids []int) (fileMet
 
 func (dp *dataPartition) getRemoteBlobFileMetas(remote string, filterBlobFileids []int, index int) (fileMetas *MembersFileMetas, err error) {
 	var (
-		conn *net.TCPConn
+		conn net.Conn
 	)
-	if conn, err = gConnPool.Get(remote); err != nil {
+	if conn, err = gConnPool.Get(replicaAddr(remote)); err != nil {
 		err = errors.Annotatef(err, "getRemoteBlobMetas partition(%v) get connection", dp.partitionId)
 		return
 	}
@@ -328,9 +328,11 @@ func (dp *dataPartition) NotifyBlobRepair(members []*MembersFileMetas) (err erro
 		go func(index int) {
 			defer wg.Done()
 			p := NewNotifyBlobRepair(dp.partitionId) //notify all follower to repairt task,send opnotifyRepair command
-			var conn *net.TCPConn
+			p.Arg = proto.ArgWithEpoch("", dp.Epoch())
+			p.Arglen = uint32(len(p.Arg))
+			var conn net.Conn
 			target := dp.replicaHosts[index]
-			conn, err = gConnPool.Get(target)
+			conn, err = gConnPool.Get(replicaAddr(target))
 			if err != nil {
 				errList = append(errList, err)
 				return
@@ -359,6 +361,11 @@ func (dp *dataPartition) NotifyBlobRepair(members []*MembersFileMetas) (err erro
 //do stream repair blobfilefile,it do on follower host
 func (dp *dataPartition) doStreamBlobFixRepair(wg *sync.WaitGroup, remoteBlobFileInfo *storage.FileInfo) {
 	defer wg.Done()
+	defer dp.runtimeMetrics.EndRepair()
+	if !gRepairScheduler.acquire(dp.disk.Path, dp.stopC) {
+		return
+	}
+	defer gRepairScheduler.release(dp.disk.Path)
 	err := dp.streamRepairBlobObjects(remoteBlobFileInfo)
 	if err != nil {
 		log.LogErrorf(err.Error())
@@ -405,9 +412,9 @@ func (dp *dataPartition) streamRepairBlobObjects(remoteBlobFileInfo *storage.Fil
 	request := NewStreamBlobFileRepairReadPacket(dp.ID(), remoteBlobFileInfo.FileId)
 	request.Data, _ = json.Marshal(task)
 	request.Size = uint32(len(request.Data))
-	var conn *net.TCPConn
+	var conn net.Conn
 	//4.get a connection to leader host
-	conn, err = gConnPool.Get(remoteBlobFileInfo.Source)
+	conn, err = gConnPool.Get(replicaAddr(remoteBlobFileInfo.Source))
 	if err != nil {
 		err = errors.Annotatef(err, "Request(%v) %v streamRepairBlobObjects get conn from host(%v) error",
 			request.GetUniqueLogId(),dp.getBlobRepairLogKey(remoteBlobFileInfo.FileId), remoteBlobFileInfo.Source)
@@ -443,6 +450,7 @@ func (dp *dataPartition) streamRepairBlobObjects(remoteBlobFileInfo *storage.Fil
 				request.GetUniqueLogId(),dp.getBlobRepairLogKey(remoteBlobFileInfo.FileId))
 			return
 		}
+		gRepairScheduler.wait(dp.disk.Path, int(request.Size))
 		// get this repairPacket end oid,if oid has large,then break
 		newLastOid := uint64(request.Offset)
 		log.LogWritef("Request(%v) %v recive repair,localOid(%v) remoteOid(%v)",
@@ -506,8 +514,13 @@ func (dp *dataPartition) applyRepairBlobObjects(blobfileId int, data []byte, end
 		//get this object body
 		ndata := data[dataPos : dataPos+int(o.Size)]
 		dataPos += int(o.Size)
-		//generator crc
-		ncrc := crc32.ChecksumIEEE(ndata)
+		//generator crc of the raw data
+		var rawData []byte
+		if rawData, err = store.DecodeObject(uint32(blobfileId), o.Oid, o.Codec, ndata); err != nil {
+			return errors.Annotatef(err, "%v applyRepairBlobObjects  oid(%v) codec(%v) decode failed",
+				dp.getBlobRepairLogKey(blobfileId), o.Oid, o.Codec)
+		}
+		ncrc := crc32.ChecksumIEEE(rawData)
 		//check crc
 		log.LogWritef("%v applyRepairBlobObjects start Fix oid(%v) end(%v)", dp.getBlobRepairLogKey(blobfileId), startObjectId, endObjectId)
 		if ncrc != o.Crc {
@@ -516,7 +529,7 @@ func (dp *dataPartition) applyRepairBlobObjects(blobfileId int, data []byte, end
 		}
 		//write local storage engine
 		log.LogWritef("%v applyRepairBlobObjects oid(%v) size(%v) crc(%v)", dp.getBlobRepairLogKey(blobfileId), o.Oid, ncrc)
-		err = store.Write(uint32(blobfileId), uint64(o.Oid), int64(o.Size), ndata, o.Crc)
+		err = store.WriteStored(uint32(blobfileId), uint64(o.Oid), int64(o.Size), ndata, o.Codec, o.Crc)
 		if err != nil {
 			return errors.Annotatef(err, "%v applyRepairBlobObjects oid(%v) write failed(%v)", dp.getBlobRepairLogKey(blobfileId), o.Oid, err)
 		}
@@ -530,12 +543,12 @@ func (dp *dataPartition) applyRepairBlobObjects(blobfileId int, data []byte, end
 	return nil
 }
 
-func (dp *dataPartition) postRepairData(pkg *Packet, startOid, lastOid uint64, data []byte, blobFileId, size int, conn *net.TCPConn) (err error) {
+func (dp *dataPartition) postRepairData(pkg *Packet, startOid, lastOid uint64, data []byte, blobFileId, size int, conn net.Conn) (err error) {
 	pkg.Offset = int64(lastOid)
 	pkg.ResultCode = proto.OpOk
 	pkg.Size = uint32(size)
 	pkg.Data = data
-	pkg.Crc = crc32.ChecksumIEEE(pkg.Data)
+	pkg.Crc = crc32.ChecksumIEEE(pkg.Data[:size])
 	err = pkg.WriteToNoDeadLineConn(conn)
 	log.LogWarnf("%v syncData postRepairData startOid(%v) endOid(%v) size(%v) err(%v)",
 		dp.getBlobRepairLogKey(int(blobFileId)), startOid, lastOid, pkg.Size, err)
@@ -548,7 +561,7 @@ const (
 	PkgRepairCReadRespLimitSize = 10 * util.MB
 )
 
-func (dp *dataPartition) syncData(blobfileID uint32, startOid, endOid uint64, pkg *Packet, conn *net.TCPConn) error {
+func (dp *dataPartition) syncData(blobfileID uint32, startOid, endOid uint64, pkg *Packet, conn net.Conn) error {
 	var (
 		err     error
 		objects []*storage.Object
@@ -556,7 +569,9 @@ func (dp *dataPartition) syncData(blobfileID uint32, startOid, endOid uint64, pk
 	dataPartition := pkg.DataPartition
 	objects = dataPartition.GetObjects(blobfileID, startOid, endOid)
 	log.LogWarnf("%v syncData startOid(%v) endOid(%v)", dp.getBlobRepairLogKey(int(blobfileID)), startOid, endOid)
-	databuf := make([]byte, PkgRepairCReadRespMaxSize)
+	// the data of a batch is written before the next one is packed, so the buffer is reused
+	databuf := proto.Buffers.Alloc(PkgRepairCReadRespMaxSize)
+	defer proto.Buffers.Free(databuf)
 	pos := 0
 	for i := 0; i < len(objects); i++ {
 		var realSize uint32
@@ -568,7 +583,6 @@ func (dp *dataPartition) syncData(blobfileID uint32, startOid, endOid uint64, pk
 			if err = dp.postRepairData(pkg, startOid, objects[i-1].Oid, databuf, int(blobfileID), pos, conn); err != nil {
 				return err
 			}
-			databuf = make([]byte, PkgRepairCReadRespMaxSize)
 			pos = 0
 		}
 		if err = dataPartition.PackObject(databuf[pos:], objects[i], blobfileID); err != nil {
@@ -14,6 +14,8 @@
 
 package datanode
 
+import "time"
+
 const (
 	Standby uint32 = iota
 	Start
@@ -34,6 +36,9 @@ const (
 	ActionWriteToCli                                 = "ActionWriteToCli"
 	ActionGetDataPartitionMetrics                    = "ActionGetDataPartitionMetrics"
 	ActionCheckAndAddInfos                           = "ActionCheckAndAddInfos"
+	ActionCheckAuth                                  = "ActionCheckAuth"
+	ActionNegotiate                                  = "ActionNegotiate"
+	ActionCheckQos                                   = "ActionCheckQos"
 	ActionCheckBlobFileInfo                          = "ActionCheckBlobFileInfo"
 	ActionPostToMaster                               = "ActionPostToMaster"
 	ActionFollowerRequireBlobFileRepairCmd           = "ActionFollowerRequireBlobFileRepairCmd"
@@ -93,8 +98,13 @@ const (
 	LogDelPartition      = "DELV:"
 	LogDelFile           = "DELF:"
 	LogMarkDel           = "MDEL:"
+	LogSync              = "SYNC:"
+	LogAddExtentRef      = "AREF:"
+	LogPunchHole         = "PHOL:"
+	LogExtentGC          = "ExtentGC:"
 	LogPartitionSnapshot = "Snapshot:"
 	LogGetWm             = "WM:"
+	LogGetBlockCrcs      = "BCRC:"
 	LogGetAllWm          = "AllWM:"
 	LogCompactBlobFile   = "CompactBlobFile:"
 	LogWrite             = "WR:"
@@ -107,3 +117,11 @@ const (
 	LogTask              = "Master Task:"
 	LogGetFlow           = "GetFlowInfo:"
 )
+
+const (
+	DefaultFullReportInterval = 5 * time.Minute //interval to send a full partition report in heartbeat
+)
+
+const (
+	MasterHeartbeatTimeout = 3 * 60 //seconds without heartbeat the master counts the node down after
+)
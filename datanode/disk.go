@@ -16,7 +16,6 @@ package datanode
 
 import (
 	"fmt"
-	"io/ioutil"
 	"path"
 	"regexp"
 	"strconv"
@@ -28,6 +27,7 @@ import (
 
 	"github.com/juju/errors"
 	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/storage"
 	"github.com/tiglabs/containerfs/util"
 	"github.com/tiglabs/containerfs/util/log"
 )
@@ -50,6 +50,11 @@ var (
 	ErrDiskCompactChanFull = errors.New("disk compact chan is full")
 )
 
+var (
+	ioBackend      = storage.IOBackendSync
+	ioUringEntries = storage.DefaultIOUringEntries
+)
+
 var (
 	// Regexp pattern for data partition dir name validate.
 	RegexpDataPartitionDir, _ = regexp.Compile("^datapartition_(\\d)+_(\\d)+$")
@@ -66,6 +71,7 @@ type DiskUsage struct {
 type Disk struct {
 	sync.RWMutex
 	Path            string
+	Layout          string
 	ReadErrs        uint64
 	WriteErrs       uint64
 	Total           uint64
@@ -81,13 +87,17 @@ type Disk struct {
 	space           *spaceManager
 	compactTasks    map[string]*CompactTask
 	compactTaskLock sync.RWMutex
+	health          diskHealth
+	io              storage.ExtentIO //of the extents of the partitions on the disk
 }
 
 type PartitionVisitor func(dp DataPartition)
 
-func NewDisk(path string, restSize uint64, maxErrs int, space *spaceManager) (d *Disk) {
+func NewDisk(path string, restSize uint64, maxErrs int, layout string, extentIO storage.ExtentIO, space *spaceManager) (d *Disk) {
 	d = new(Disk)
 	d.Path = path
+	d.io = extentIO
+	d.Layout = layout
 	d.RestSize = restSize
 	d.MaxErrs = maxErrs
 	d.space = space
@@ -102,9 +112,20 @@ func NewDisk(path string, restSize uint64, maxErrs int, space *spaceManager) (d
 	d.computeUsage()
 
 	d.startScheduleTasks()
+	go d.watchHealth()
 	return
 }
 
+// Stop closes the extent io of the disk, the IO in flight is finished before.
+func (d *Disk) Stop() {
+	if d.io == nil {
+		return
+	}
+	if err := d.io.Close(); err != nil {
+		log.LogErrorf("action[Disk.Stop] disk(%v) close extent io: %v", d.Path, err)
+	}
+}
+
 func (d *Disk) PartitionCount() int {
 	return len(d.partitionMap)
 }
@@ -213,7 +234,7 @@ func (d *Disk) updateSpaceInfo() (err error) {
 		d.addReadErr()
 	}
 	currErrs := d.ReadErrs + d.WriteErrs
-	if currErrs >= uint64(d.MaxErrs) {
+	if d.isFailed() || currErrs >= uint64(d.MaxErrs) {
 		d.Status = proto.Unavaliable
 	} else if d.Available <= 0 {
 		d.Status = proto.ReadOnly
@@ -305,33 +326,31 @@ func (d *Disk) RestorePartition(visitor PartitionVisitor) {
 		partitionId   uint32
 		partitionSize int
 	)
-	fileInfoList, err := ioutil.ReadDir(d.Path)
+	dirs, err := d.listPartitionDirs()
 	if err != nil {
 		log.LogErrorf("action[RestorePartition] read dir(%v) err(%v).", d.Path, err)
 		return
 	}
 	var wg sync.WaitGroup
-	for _, fileInfo := range fileInfoList {
-		filename := fileInfo.Name()
-		if !d.isPartitionDir(filename) {
-			continue
-		}
-
+	for _, dir := range dirs {
+		filename := path.Base(dir)
 		if partitionId, partitionSize, err = unmarshalPartitionName(filename); err != nil {
 			log.LogErrorf("action[RestorePartition] unmarshal partitionName(%v) from disk(%v) err(%v) ",
 				filename, d.Path, err.Error())
 			continue
 		}
 		log.LogDebugf("acton[RestorePartition] disk(%v) path(%v) partitionId(%v) partitionSize(%v).",
-			d.Path, fileInfo.Name(), partitionId, partitionSize)
+			d.Path, dir, partitionId, partitionSize)
+		d.space.stats.AddPartitionToLoad()
 		wg.Add(1)
-		go func(partitionId uint32, filename string) {
+		go func(partitionId uint32, dir string) {
 			var (
 				dp  DataPartition
 				err error
 			)
 			defer wg.Done()
-			if dp, err = LoadDataPartition(path.Join(d.Path, filename), d); err != nil {
+			defer d.space.stats.AddPartitionLoaded()
+			if dp, err = LoadDataPartition(dir, d); err != nil {
 				log.LogError(fmt.Sprintf("action[RestorePartition] new partition(%v) err(%v) ",
 					partitionId, err.Error()))
 				return
@@ -340,7 +359,8 @@ func (d *Disk) RestorePartition(visitor PartitionVisitor) {
 				visitor(dp)
 			}
 
-		}(partitionId, filename)
+		}(partitionId, dir)
 	}
 	wg.Wait()
+	go d.scrub()
 }
@@ -0,0 +1,160 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	DefaultDiskErrorThreshold = 100 // IO errors in a check interval
+	DefaultDiskLatencySLO     = 2 * time.Second
+	DiskHealthCheckInterval   = 10 * time.Second
+	DiskSlowChecks            = 3 // consecutive slow or failed probes
+	DiskProbeFileName         = ".disk_probe"
+	DiskProbeSize             = 4096
+)
+
+// set by the config before the disks are loaded
+var (
+	diskErrorThreshold = uint64(DefaultDiskErrorThreshold)
+	diskLatencySLO     = DefaultDiskLatencySLO
+)
+
+// the health of a disk, a disk failed is unavailable until the restart of the
+// node, so its partitions are rebuilt on the other nodes and not set back to
+// writable by a lull of the errors
+type diskHealth struct {
+	lastErrs   uint64
+	slowChecks int
+	failed     bool
+	reason     string
+	failTime   int64
+}
+
+// watchHealth fails the disk if its IO errors during a check exceed the threshold,
+// or if DiskSlowChecks probes in a row fail or take longer than the latency SLO.
+func (d *Disk) watchHealth() {
+	ticker := time.NewTicker(DiskHealthCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if d.isFailed() {
+			return
+		}
+		d.checkHealth()
+	}
+}
+
+func (d *Disk) checkHealth() {
+	errs := atomic.LoadUint64(&d.ReadErrs) + atomic.LoadUint64(&d.WriteErrs)
+	delta := errs - d.health.lastErrs
+	d.health.lastErrs = errs
+	if diskErrorThreshold > 0 && delta >= diskErrorThreshold {
+		d.fail(fmt.Sprintf("%v IO errors in %v", delta, DiskHealthCheckInterval))
+		return
+	}
+	if diskLatencySLO <= 0 {
+		return
+	}
+	elapsed, err := d.probe()
+	if err == syscall.ENOSPC {
+		// a full disk is read only, not failed
+		return
+	}
+	if err == nil && elapsed <= diskLatencySLO {
+		d.health.slowChecks = 0
+		return
+	}
+	if err != nil {
+		d.addWriteErr()
+	}
+	d.health.slowChecks++
+	log.LogWarnf("action[checkHealth] disk(%v) probe cost(%v) err(%v) slowChecks(%v).",
+		d.Path, elapsed, err, d.health.slowChecks)
+	if d.health.slowChecks >= DiskSlowChecks {
+		d.fail(fmt.Sprintf("%v probes in a row failed or slower than %v, last cost(%v) err(%v)",
+			d.health.slowChecks, diskLatencySLO, elapsed, err))
+	}
+}
+
+/*write, sync and read back a small file on the disk*/
+func (d *Disk) probe() (elapsed time.Duration, err error) {
+	name := path.Join(d.Path, DiskProbeFileName)
+	data := make([]byte, DiskProbeSize)
+	start := time.Now()
+	defer func() {
+		elapsed = time.Since(start)
+		if pe, ok := err.(*os.PathError); ok {
+			err = pe.Err
+		}
+	}()
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if _, err = f.WriteAt(data, 0); err != nil {
+		return
+	}
+	if err = f.Sync(); err != nil {
+		return
+	}
+	_, err = f.ReadAt(data, 0)
+	return
+}
+
+// fail marks the disk unavailable with the partitions on it, the master is told
+// by the next heartbeat and offlines their replicas on this node, so they are
+// rebuilt on the other nodes. The other disks keep serving.
+func (d *Disk) fail(reason string) {
+	d.Lock()
+	if d.health.failed {
+		d.Unlock()
+		return
+	}
+	d.health.failed = true
+	d.health.reason = reason
+	d.health.failTime = time.Now().Unix()
+	d.Status = proto.Unavaliable
+	partitions := make([]DataPartition, 0, len(d.partitionMap))
+	for _, dp := range d.partitionMap {
+		partitions = append(partitions, dp)
+	}
+	d.Unlock()
+	for _, dp := range partitions {
+		dp.ChangeStatus(proto.Unavaliable)
+	}
+	log.LogErrorf("action[fail] disk(%v) unavailable, partitions(%v): %v", d.Path, len(partitions), reason)
+}
+
+func (d *Disk) isFailed() bool {
+	d.RLock()
+	defer d.RUnlock()
+	return d.health.failed
+}
+
+func (d *Disk) failReason() string {
+	d.RLock()
+	defer d.RUnlock()
+	return d.health.reason
+}
@@ -0,0 +1,127 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+// The layouts of the partition dirs of a disk.
+const (
+	DiskLayoutFlat   = "flat"   //datapartition_<id>_<size> in the disk root
+	DiskLayoutHashed = "hashed" //<xx>/<yy>/datapartition_<id>_<size>, xx and yy from the crc of the name
+)
+
+var (
+	// Regexp pattern for the dir names of the hashed layout.
+	RegexpHashedLayoutDir, _ = regexp.Compile("^[0-9a-f]{2}$")
+)
+
+func isDiskLayout(layout string) bool {
+	return layout == DiskLayoutFlat || layout == DiskLayoutHashed
+}
+
+func hashedPartitionParent(name string) string {
+	h := crc32.ChecksumIEEE([]byte(name))
+	return path.Join(fmt.Sprintf("%02x", h>>24), fmt.Sprintf("%02x", (h>>16)&0xff))
+}
+
+// The layout of a disk only places the new partitions, a partition is found
+// and kept in its dir of either layout, so the layout of a disk can be changed
+// without moving the partitions already on it.
+
+/*the dir of the partition named name, the existing one or the one of the disk layout*/
+func (d *Disk) partitionDir(name string) string {
+	flat := path.Join(d.Path, name)
+	hashed := path.Join(d.Path, hashedPartitionParent(name), name)
+	dir, other := flat, hashed
+	if d.Layout == DiskLayoutHashed {
+		dir, other = hashed, flat
+	}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if _, err = os.Stat(other); err == nil {
+			return other
+		}
+	}
+	return dir
+}
+
+/*the dirs of the partitions in both layouts*/
+func (d *Disk) listPartitionDirs() (dirs []string, err error) {
+	var fileInfoList []os.FileInfo
+	if fileInfoList, err = ioutil.ReadDir(d.Path); err != nil {
+		return
+	}
+	dirs = make([]string, 0, len(fileInfoList))
+	for _, fileInfo := range fileInfoList {
+		switch {
+		case d.isPartitionDir(fileInfo.Name()):
+			dirs = append(dirs, path.Join(d.Path, fileInfo.Name()))
+		case fileInfo.IsDir() && RegexpHashedLayoutDir.MatchString(fileInfo.Name()):
+			dirs = append(dirs, d.listHashedPartitionDirs(path.Join(d.Path, fileInfo.Name()))...)
+		}
+	}
+	return
+}
+
+func (d *Disk) listHashedPartitionDirs(parent string) (dirs []string) {
+	fileInfoList, err := ioutil.ReadDir(parent)
+	if err != nil {
+		log.LogErrorf("action[listHashedPartitionDirs] read dir(%v) err(%v).", parent, err)
+		return
+	}
+	for _, fileInfo := range fileInfoList {
+		if !fileInfo.IsDir() || !RegexpHashedLayoutDir.MatchString(fileInfo.Name()) {
+			continue
+		}
+		sub := path.Join(parent, fileInfo.Name())
+		subInfoList, err := ioutil.ReadDir(sub)
+		if err != nil {
+			log.LogErrorf("action[listHashedPartitionDirs] read dir(%v) err(%v).", sub, err)
+			continue
+		}
+		for _, subInfo := range subInfoList {
+			if d.isPartitionDir(subInfo.Name()) {
+				dirs = append(dirs, path.Join(sub, subInfo.Name()))
+			}
+		}
+	}
+	return
+}
+
+/*remove the dir of a partition and the dirs of the hashed layout left empty*/
+func (d *Disk) removePartitionDir(dir string) (err error) {
+	if err = os.RemoveAll(dir); err != nil {
+		return
+	}
+	d.removeEmptyParents(dir)
+	return
+}
+
+/*remove the dirs of the hashed layout left empty after the partition dir was moved or removed*/
+func (d *Disk) removeEmptyParents(dir string) {
+	for parent := path.Dir(dir); len(parent) > len(d.Path); parent = path.Dir(parent) {
+		if os.Remove(parent) != nil {
+			return
+		}
+	}
+}
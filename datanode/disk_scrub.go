@@ -0,0 +1,137 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"strings"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/storage"
+	"github.com/tiglabs/containerfs/util"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	DefaultScrubInterval  = 24 * time.Hour
+	DefaultScrubBandwidth = 20 * util.MB // bytes per second of each disk
+)
+
+// set by the config before the disks are loaded
+var (
+	scrubInterval  = DefaultScrubInterval
+	scrubBandwidth = int64(DefaultScrubBandwidth)
+)
+
+// scrubLimiter paces the reads of a scrub pass to the bandwidth, it is used by
+// the scrubber of one disk only.
+type scrubLimiter struct {
+	bytesPerSec int64
+	start       time.Time
+	bytes       int64
+}
+
+func newScrubLimiter(bytesPerSec int64) *scrubLimiter {
+	return &scrubLimiter{bytesPerSec: bytesPerSec, start: time.Now()}
+}
+
+func (l *scrubLimiter) wait(n int) {
+	l.bytes += int64(n)
+	expect := time.Duration(l.bytes * int64(time.Second) / l.bytesPerSec)
+	if elapsed := time.Since(l.start); elapsed < expect {
+		time.Sleep(expect - elapsed)
+	}
+}
+
+// scrub walks all the partitions of the disk once every interval, so silent
+// corruption is found and repaired before clients read it. The load of the
+// partitions only verifies the tails of the extents, the first pass starts once
+// they are loaded so the blocks torn by a crash before the tails are found too.
+func (d *Disk) scrub() {
+	if scrubInterval <= 0 {
+		return
+	}
+	for {
+		start := time.Now()
+		limiter := newScrubLimiter(scrubBandwidth)
+		ids := d.DataPartitionList()
+		for _, id := range ids {
+			if dp, ok := d.space.GetPartition(id).(*dataPartition); ok {
+				dp.scrub(limiter.wait)
+			}
+		}
+		log.LogInfof("action[scrub] disk(%v) partitions(%v) scrubbed bytes(%v) cost(%v).",
+			d.Path, len(ids), limiter.bytes, time.Since(start))
+		time.Sleep(scrubInterval)
+	}
+}
+
+// scrub reads all the extents and blob objects of the partition. A corrupt
+// extent tail is quarantined and repaired from the other replicas, the leader
+// launches the repair at once and a follower reports it to master by the next
+// heartbeat. The corrupt blob objects are reported until the next pass.
+func (dp *dataPartition) scrub(wait func(n int)) {
+	var corrupted bool
+	// the headers of a sealed partition are checked against the seal first, without reading the data
+	if dp.IsSealed() {
+		if extents := dp.extentStore.VerifySeal(); len(extents) != 0 {
+			corrupted = true
+			log.LogErrorf("action[scrub] partition(%v) extents(%v) changed since sealed.", dp.partitionId, extents)
+		}
+	}
+	extents, err := dp.extentStore.GetAllWatermark(nil)
+	if err != nil {
+		log.LogErrorf("action[scrub] partition(%v) get extents err(%v).", dp.partitionId, err)
+		return
+	}
+	for _, extentInfo := range extents {
+		select {
+		case <-dp.stopC:
+			return
+		default:
+		}
+		if extentInfo.Deleted || extentInfo.Size == 0 {
+			continue
+		}
+		if err = dp.extentStore.ScrubExtent(uint64(extentInfo.FileId), wait); err == nil {
+			continue
+		}
+		if strings.Contains(err.Error(), storage.ErrorBlockCrcMismatch.Error()) {
+			corrupted = true
+			log.LogErrorf("action[scrub] partition(%v) extent(%v) err(%v).", dp.partitionId, extentInfo.FileId, err)
+		} else {
+			log.LogDebugf("action[scrub] partition(%v) extent(%v) err(%v).", dp.partitionId, extentInfo.FileId, err)
+		}
+	}
+	objects := make([]*proto.QuarantinedRange, 0)
+	for blobfileId := 1; blobfileId <= storage.BlobFileFileCount; blobfileId++ {
+		ranges, err := dp.blobStore.ScrubBlobFile(blobfileId, wait)
+		if err != nil {
+			log.LogErrorf("action[scrub] partition(%v) blobfile(%v) err(%v).", dp.partitionId, blobfileId, err)
+			continue
+		}
+		for _, qr := range ranges {
+			log.LogErrorf("action[scrub] partition(%v) blobfile(%v) object(%v) reason(%v).",
+				dp.partitionId, blobfileId, qr.Start, qr.Reason)
+		}
+		objects = append(objects, ranges...)
+	}
+	dp.scrubLock.Lock()
+	dp.corruptObjects = objects
+	dp.scrubLock.Unlock()
+	if corrupted {
+		dp.LaunchRepair()
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/containerfs/master"
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/storage"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	DefaultExtentGCWindow = 24 * time.Hour
+	ExtentGCCheckInterval = 10 * time.Minute
+)
+
+// set by the config before the gc starts
+var (
+	extentGCWindow = DefaultExtentGCWindow
+)
+
+type extentReport struct {
+	time    time.Time //when the references were collected by the meta partition
+	extents map[uint64]bool
+}
+
+// extentReferences keeps the last report of each meta partition of the vol and
+// the extents found referenced by none of them with the time first found. An
+// extent is collected only if it stays unreferenced for the window and every
+// meta partition reported after it was found, so an extent written but not yet
+// added to its inode, or a report of a deposed meta partition leader, never
+// gets an extent deleted.
+type extentReferences struct {
+	reports    map[uint64]*extentReport
+	candidates map[uint64]time.Time
+	sync.Mutex
+}
+
+func newExtentReferences() *extentReferences {
+	return &extentReferences{
+		reports:    make(map[uint64]*extentReport),
+		candidates: make(map[uint64]time.Time),
+	}
+}
+
+func (r *extentReferences) update(report *proto.ExtentReferences) {
+	extents := make(map[uint64]bool, len(report.Extents))
+	for _, extentId := range report.Extents {
+		extents[extentId] = true
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.reports[report.MetaPartitionID] = &extentReport{
+		time:    time.Now().Add(-time.Duration(report.AgeMs) * time.Millisecond),
+		extents: extents,
+	}
+}
+
+/*the extents referenced by the meta partitions and the oldest report time, ok is false if one has not reported in the window*/
+func (r *extentReferences) referenced(metaPartitions []uint64) (referenced map[uint64]bool, oldest time.Time, ok bool) {
+	r.Lock()
+	defer r.Unlock()
+	referenced = make(map[uint64]bool)
+	for _, id := range metaPartitions {
+		report, has := r.reports[id]
+		if !has || time.Since(report.time) > extentGCWindow {
+			return nil, oldest, false
+		}
+		if oldest.IsZero() || report.time.Before(oldest) {
+			oldest = report.time
+		}
+		for extentId := range report.extents {
+			referenced[extentId] = true
+		}
+	}
+	// the reports of the meta partitions removed from the vol are dropped
+	for id := range r.reports {
+		if !containsID(metaPartitions, id) {
+			delete(r.reports, id)
+		}
+	}
+	return referenced, oldest, true
+}
+
+/*track the unreferenced extents, return the ones to be collected*/
+func (r *extentReferences) collect(extents []*storage.FileInfo, referenced map[uint64]bool, oldest time.Time) (garbage []uint64) {
+	now := time.Now()
+	r.Lock()
+	defer r.Unlock()
+	exists := make(map[uint64]bool, len(extents))
+	for _, extentInfo := range extents {
+		extentId := uint64(extentInfo.FileId)
+		if extentInfo.Deleted {
+			continue
+		}
+		exists[extentId] = true
+		if referenced[extentId] || now.Sub(extentInfo.ModTime) < extentGCWindow {
+			delete(r.candidates, extentId)
+			continue
+		}
+		first, ok := r.candidates[extentId]
+		if !ok {
+			r.candidates[extentId] = now
+			continue
+		}
+		if oldest.After(first) && now.Sub(first) >= extentGCWindow {
+			garbage = append(garbage, extentId)
+		}
+	}
+	for extentId := range r.candidates {
+		if !exists[extentId] {
+			delete(r.candidates, extentId)
+		}
+	}
+	return
+}
+
+func containsID(ids []uint64, id uint64) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *DataNode) startExtentGC() {
+	if extentGCWindow <= 0 {
+		return
+	}
+	ticker := time.NewTicker(ExtentGCCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopC:
+			return
+		case <-ticker.C:
+			s.checkExtentGC()
+		}
+	}
+}
+
+/*collect the unreferenced extents of the extent partitions led by the node*/
+func (s *DataNode) checkExtentGC() {
+	metaPartitions := make(map[string][]uint64)
+	s.space.RangePartitions(func(partition DataPartition) bool {
+		dp, ok := partition.(*dataPartition)
+		if !ok || !dp.IsLeader() || dp.meta == nil || dp.meta.PartitionType != proto.ExtentPartition {
+			return true
+		}
+		ids, ok := metaPartitions[dp.volumeId]
+		if !ok {
+			var err error
+			if ids, err = getVolMetaPartitions(dp.volumeId); err != nil {
+				log.LogWarnf("action[checkExtentGC] vol(%v) get meta partitions err(%v).", dp.volumeId, err)
+			}
+			metaPartitions[dp.volumeId] = ids
+		}
+		// unknown meta partitions reference everything
+		if len(ids) != 0 {
+			s.collectExtents(dp, ids)
+		}
+		return true
+	})
+}
+
+func getVolMetaPartitions(volName string) (ids []uint64, err error) {
+	var data []byte
+	params := make(map[string]string)
+	params["name"] = volName
+	if data, err = MasterHelper.Request(http.MethodGet, master.ClientVol, params, nil); err != nil {
+		return
+	}
+	view := &master.VolView{}
+	if err = json.Unmarshal(data, view); err != nil {
+		return
+	}
+	ids = make([]uint64, 0, len(view.MetaPartitions))
+	for _, mp := range view.MetaPartitions {
+		ids = append(ids, mp.PartitionID)
+	}
+	return
+}
+
+func (s *DataNode) collectExtents(dp *dataPartition, metaPartitions []uint64) {
+	referenced, oldest, ok := dp.extentRefs.referenced(metaPartitions)
+	if !ok {
+		return
+	}
+	extents, err := dp.extentStore.GetAllWatermark(nil)
+	if err != nil {
+		log.LogErrorf("action[collectExtents] partition(%v) get extents err(%v).", dp.partitionId, err)
+		return
+	}
+	for _, extentId := range dp.extentRefs.collect(extents, referenced, oldest) {
+		if err = s.deleteUnreferencedExtent(dp, extentId); err != nil {
+			log.LogWarnf("action[collectExtents] partition(%v) extent(%v) err(%v).", dp.partitionId, extentId, err)
+			continue
+		}
+		log.LogWarnf("action[collectExtents] partition(%v) extent(%v) referenced by no meta partition, deleted.",
+			dp.partitionId, extentId)
+	}
+}
+
+/*delete the extent on all the replicas by a mark delete through the replication chain like a meta node does*/
+func (s *DataNode) deleteUnreferencedExtent(dp *dataPartition, extentId uint64) (err error) {
+	hosts := dp.ReplicaHosts()
+	if len(hosts) == 0 {
+		return errors.Errorf("partition(%v) has no replica hosts", dp.partitionId)
+	}
+	p := NewPacket()
+	p.Opcode = proto.OpMarkDelete
+	p.StoreMode = proto.ExtentStoreMode
+	p.PartitionID = dp.partitionId
+	p.FileID = extentId
+	p.ReqID = proto.GetReqID()
+	p.Nodes = uint8(len(hosts) - 1)
+	p.Arg = proto.ArgWithEpoch(strings.Join(hosts[1:], proto.AddrSplit)+proto.AddrSplit, dp.Epoch())
+	p.Arglen = uint32(len(p.Arg))
+	var conn net.Conn
+	if conn, err = gConnPool.Get(hosts[0]); err != nil {
+		return
+	}
+	if err = p.WriteToConn(conn); err != nil {
+		gConnPool.Put(conn, true)
+		return
+	}
+	if err = p.ReadFromConn(conn, proto.ReadDeadlineTime); err != nil {
+		gConnPool.Put(conn, true)
+		return
+	}
+	gConnPool.Put(conn, false)
+	if p.ResultCode != proto.OpOk {
+		err = errors.Errorf("%v: %v", p.GetUniqueLogId(), string(p.Data[:p.Size]))
+	}
+	return
+}
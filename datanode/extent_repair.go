@@ -15,6 +15,7 @@
 package datanode
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"net"
 	"sync"
@@ -24,6 +25,7 @@ import (
 	"github.com/juju/errors"
 	"github.com/tiglabs/containerfs/proto"
 	"github.com/tiglabs/containerfs/storage"
+	"github.com/tiglabs/containerfs/util"
 	"github.com/tiglabs/containerfs/util/log"
 	"hash/crc32"
 )
@@ -34,6 +36,7 @@ type MembersFileMetas struct {
 	NeedDeleteExtentsTasks   []*storage.FileInfo       //generator delete extent file task
 	NeedAddExtentsTasks      []*storage.FileInfo       //generator add extent file task
 	NeedFixExtentSizeTasks   []*storage.FileInfo       //generator fixSize file task
+	NeedFixExtentRefsTasks   []*storage.FileInfo       //generator fix references of extent task
 	NeedDeleteObjectsTasks   map[int][]byte            //generator deleteObject on blob file task
 	NeedFixBlobFileSizeTasks []*storage.FileInfo
 }
@@ -44,6 +47,7 @@ func NewMemberFileMetas() (mf *MembersFileMetas) {
 		NeedDeleteExtentsTasks:   make([]*storage.FileInfo, 0),
 		NeedAddExtentsTasks:      make([]*storage.FileInfo, 0),
 		NeedFixExtentSizeTasks:   make([]*storage.FileInfo, 0),
+		NeedFixExtentRefsTasks:   make([]*storage.FileInfo, 0),
 		NeedFixBlobFileSizeTasks: make([]*storage.FileInfo, 0),
 		NeedDeleteObjectsTasks:   make(map[int][]byte),
 	}
@@ -56,32 +60,50 @@ func (dp *dataPartition) extentFileRepair() {
 	log.LogInfof("action[extentFileRepair] partition(%v) start.",
 		dp.partitionId)
 
+	replicaHosts := dp.replicaHosts
+	dp.repairMembersExtents(replicaHosts, true)
+
+	// warm replicas do not vote, they catch up with the leader one by one and
+	// never fix the leader
+	for _, warmHost := range dp.warmHosts {
+		dp.repairMembersExtents([]string{replicaHosts[0], warmHost}, false)
+	}
+	finishTime := time.Now().UnixNano()
+	log.LogInfof("action[extentFileRepair] partition(%v) finish cost[%vms].",
+		dp.partitionId, (finishTime-startTime)/int64(time.Millisecond))
+}
+
+//repair the extents of hosts, hosts[0] is the leader
+func (dp *dataPartition) repairMembersExtents(hosts []string, fixLeader bool) {
 	// Get all data partition group member about file metas
-	allMembers, err := dp.getAllMemberExtentMetas()
+	allMembers, err := dp.getAllMemberExtentMetas(hosts)
 	if err != nil {
-		log.LogErrorf("action[extentFileRepair] partition(%v) err(%v).",
-			dp.partitionId, err)
+		log.LogErrorf("action[extentFileRepair] partition(%v) hosts(%v) err(%v).",
+			dp.partitionId, hosts, err)
 		log.LogErrorf(errors.ErrorStack(err))
 		return
 	}
-	dp.generatorExtentRepairTasks(allMembers) //generator file repair task
-	err = dp.NotifyExtentRepair(allMembers)   //notify host to fix it
+	dp.generatorExtentRepairTasks(allMembers, hosts) //generator file repair task
+	err = dp.NotifyExtentRepair(allMembers, hosts)   //notify host to fix it
 	if err != nil {
-		log.LogErrorf("action[extentFileRepair] partition(%v) err(%v).",
-			dp.partitionId, err)
+		log.LogErrorf("action[extentFileRepair] partition(%v) hosts(%v) err(%v).",
+			dp.partitionId, hosts, err)
 		log.LogError(errors.ErrorStack(err))
 	}
+	if !fixLeader {
+		return
+	}
 	for _, fixExtentFile := range allMembers[0].NeedFixExtentSizeTasks {
 		dp.streamRepairExtent(fixExtentFile) //fix leader filesize
 	}
-	finishTime := time.Now().UnixNano()
-	log.LogInfof("action[extentFileRepair] partition(%v) finish cost[%vms].",
-		dp.partitionId, (finishTime-startTime)/int64(time.Millisecond))
+	if len(allMembers[0].NeedFixExtentSizeTasks) != 0 {
+		dp.resealAfterRepair()
+	}
 }
 
 // Get all data partition group ,about all files meta
-func (dp *dataPartition) getAllMemberExtentMetas() (allMemberFileMetas []*MembersFileMetas, err error) {
-	allMemberFileMetas = make([]*MembersFileMetas, len(dp.replicaHosts))
+func (dp *dataPartition) getAllMemberExtentMetas(hosts []string) (allMemberFileMetas []*MembersFileMetas, err error) {
+	allMemberFileMetas = make([]*MembersFileMetas, len(hosts))
 	var (
 		extentFiles []*storage.FileInfo
 	)
@@ -107,10 +129,10 @@ func (dp *dataPartition) getAllMemberExtentMetas() (allMemberFileMetas []*Member
 
 	// get remote files meta by opGetAllWaterMarker cmd
 	p := NewExtentStoreGetAllWaterMarker(dp.partitionId)
-	for i := 1; i < len(dp.replicaHosts); i++ {
-		var conn *net.TCPConn
-		target := dp.replicaHosts[i]
-		conn, err = gConnPool.Get(target) //get remote connect
+	for i := 1; i < len(hosts); i++ {
+		var conn net.Conn
+		target := hosts[i]
+		conn, err = gConnPool.Get(replicaAddr(target)) //get remote connect
 		if err != nil {
 			err = errors.Annotatef(err, "getAllMemberExtentMetas  dataPartition(%v) get host(%v) connect", dp.partitionId, target)
 			return
@@ -145,10 +167,11 @@ func (dp *dataPartition) getAllMemberExtentMetas() (allMemberFileMetas []*Member
 }
 
 //generator file task
-func (dp *dataPartition) generatorExtentRepairTasks(allMembers []*MembersFileMetas) {
-	dp.generatorAddExtentsTasks(allMembers) //add extentTask
-	dp.generatorFixExtentSizeTasks(allMembers)
-	dp.generatorDeleteExtentsTasks(allMembers)
+func (dp *dataPartition) generatorExtentRepairTasks(allMembers []*MembersFileMetas, hosts []string) {
+	dp.generatorAddExtentsTasks(allMembers, hosts) //add extentTask
+	dp.generatorFixExtentSizeTasks(allMembers, hosts)
+	dp.generatorFixExtentRefsTasks(allMembers, hosts)
+	dp.generatorDeleteExtentsTasks(allMembers, hosts)
 
 }
 
@@ -176,9 +199,9 @@ func (dp *dataPartition) mapMaxSizeExtentToIndex(allMembers []*MembersFileMetas)
 }
 
 /*generator add extent if follower not have this extent*/
-func (dp *dataPartition) generatorAddExtentsTasks(allMembers []*MembersFileMetas) {
+func (dp *dataPartition) generatorAddExtentsTasks(allMembers []*MembersFileMetas, hosts []string) {
 	leader := allMembers[0]
-	leaderAddr := dp.replicaHosts[0]
+	leaderAddr := hosts[0]
 	for fileId, leaderFile := range leader.files {
 		if fileId <= storage.BlobFileFileCount {
 			continue
@@ -186,7 +209,8 @@ func (dp *dataPartition) generatorAddExtentsTasks(allMembers []*MembersFileMetas
 		for index := 1; index < len(allMembers); index++ {
 			follower := allMembers[index]
 			if _, ok := follower.files[fileId]; !ok {
-				addFile := &storage.FileInfo{Source: leaderAddr, FileId: fileId, Size: leaderFile.Size, Inode: leaderFile.Inode}
+				addFile := &storage.FileInfo{Source: leaderAddr, FileId: fileId, Size: leaderFile.Size, Inode: leaderFile.Inode,
+					Refs: leaderFile.Refs}
 				follower.NeedAddExtentsTasks = append(follower.NeedAddExtentsTasks, addFile)
 				log.LogInfof("action[generatorAddExtentsTasks] partition(%v) addFile(%v).", dp.partitionId, addFile)
 			}
@@ -195,7 +219,7 @@ func (dp *dataPartition) generatorAddExtentsTasks(allMembers []*MembersFileMetas
 }
 
 /*generator fix extent Size ,if all members  Not the same length*/
-func (dp *dataPartition) generatorFixExtentSizeTasks(allMembers []*MembersFileMetas) {
+func (dp *dataPartition) generatorFixExtentSizeTasks(allMembers []*MembersFileMetas, hosts []string) {
 	leader := allMembers[0]
 	maxSizeExtentMap := dp.mapMaxSizeExtentToIndex(allMembers) //map maxSize extentId to allMembers index
 	for fileId, leaderFile := range leader.files {
@@ -204,7 +228,7 @@ func (dp *dataPartition) generatorFixExtentSizeTasks(allMembers []*MembersFileMe
 		}
 		maxSizeExtentIdIndex := maxSizeExtentMap[fileId]
 		maxSize := allMembers[maxSizeExtentIdIndex].files[fileId].Size
-		sourceAddr := dp.replicaHosts[maxSizeExtentIdIndex]
+		sourceAddr := hosts[maxSizeExtentIdIndex]
 		inode := leaderFile.Inode
 		for index := 0; index < len(allMembers); index++ {
 			if index == maxSizeExtentIdIndex {
@@ -223,11 +247,32 @@ func (dp *dataPartition) generatorFixExtentSizeTasks(allMembers []*MembersFileMe
 	}
 }
 
+/*generator fix references of extent, if a follower missed a reference added or dropped on the leader*/
+func (dp *dataPartition) generatorFixExtentRefsTasks(allMembers []*MembersFileMetas, hosts []string) {
+	leader := allMembers[0]
+	leaderAddr := hosts[0]
+	for fileId, leaderFile := range leader.files {
+		if fileId <= storage.BlobFileFileCount || leaderFile.Refs == 0 {
+			continue
+		}
+		for index := 1; index < len(allMembers); index++ {
+			extentInfo, ok := allMembers[index].files[fileId]
+			if !ok || extentInfo.Refs == leaderFile.Refs {
+				continue
+			}
+			fixRefs := &storage.FileInfo{Source: leaderAddr, FileId: fileId, Refs: leaderFile.Refs}
+			allMembers[index].NeedFixExtentRefsTasks = append(allMembers[index].NeedFixExtentRefsTasks, fixRefs)
+			log.LogInfof("action[generatorFixExtentRefsTasks] partition(%v) fixRefs(%v) from(%v).",
+				dp.partitionId, fixRefs, extentInfo.Refs)
+		}
+	}
+}
+
 /*generator fix extent Size ,if all members  Not the same length*/
-func (dp *dataPartition) generatorDeleteExtentsTasks(allMembers []*MembersFileMetas) {
+func (dp *dataPartition) generatorDeleteExtentsTasks(allMembers []*MembersFileMetas, hosts []string) {
 	store := dp.extentStore
 	deletes := store.GetDelObjects()
-	leaderAddr := dp.replicaHosts[0]
+	leaderAddr := hosts[0]
 	for _, deleteFileId := range deletes {
 		for index := 1; index < len(allMembers); index++ {
 			follower := allMembers[index]
@@ -241,7 +286,7 @@ func (dp *dataPartition) generatorDeleteExtentsTasks(allMembers []*MembersFileMe
 }
 
 /*notify follower to repair dataPartition extentStore*/
-func (dp *dataPartition) NotifyExtentRepair(members []*MembersFileMetas) (err error) {
+func (dp *dataPartition) NotifyExtentRepair(members []*MembersFileMetas, hosts []string) (err error) {
 	var (
 		errList []error
 	)
@@ -252,9 +297,11 @@ func (dp *dataPartition) NotifyExtentRepair(members []*MembersFileMetas) (err er
 		go func(index int) {
 			defer wg.Done()
 			p := NewNotifyExtentRepair(dp.partitionId) //notify all follower to repairt task,send opnotifyRepair command
-			var conn *net.TCPConn
-			target := dp.replicaHosts[index]
-			conn, err = gConnPool.Get(target)
+			p.Arg = proto.ArgWithEpoch("", dp.Epoch())
+			p.Arglen = uint32(len(p.Arg))
+			var conn net.Conn
+			target := hosts[index]
+			conn, err = gConnPool.Get(replicaAddr(target))
 			if err != nil {
 				errList = append(errList, err)
 				return
@@ -284,6 +331,11 @@ func (dp *dataPartition) NotifyExtentRepair(members []*MembersFileMetas) (err er
 // It receive from leader notifyRepair command extent file repair.
 func (dp *dataPartition) doStreamExtentFixRepair(wg *sync.WaitGroup, remoteExtentInfo *storage.FileInfo) {
 	defer wg.Done()
+	defer dp.runtimeMetrics.EndRepair()
+	if !gRepairScheduler.acquire(dp.disk.Path, dp.stopC) {
+		return
+	}
+	defer gRepairScheduler.release(dp.disk.Path)
 	err := dp.streamRepairExtent(remoteExtentInfo)
 	if err != nil {
 		localExtentInfo, opErr := dp.GetExtentStore().GetWatermark(uint64(remoteExtentInfo.FileId), false)
@@ -302,22 +354,177 @@ func (dp *dataPartition) streamRepairExtent(remoteExtentInfo *storage.FileInfo)
 	if !store.IsExistExtent(uint64(remoteExtentInfo.FileId)) {
 		return
 	}
+	if err = dp.deltaRepairExtent(remoteExtentInfo); err != nil {
+		return
+	}
+	return dp.streamRepairExtentTo(remoteExtentInfo, remoteExtentInfo.Size)
+}
+
+// deltaRepairExtent takes the blocks of the tail quarantined at the local size
+// from the local disk if their crc matches the block crc of the remote extent,
+// only the blocks between them are fetched from the remote. A replica shrunk by
+// the verify keeps most of its tail, so it transfers only the blocks differing.
+func (dp *dataPartition) deltaRepairExtent(remoteExtentInfo *storage.FileInfo) (err error) {
+	store := dp.GetExtentStore()
+	extentId := uint64(remoteExtentInfo.FileId)
+	localExtentInfo, err := store.GetWatermark(extentId, false)
+	if err != nil {
+		return errors.Annotatef(err, "deltaRepairExtent GetWatermark error")
+	}
+	validSize := int64(localExtentInfo.Size)
+	if validSize%util.BlockSize != 0 || uint64(validSize) >= remoteExtentInfo.Size {
+		return
+	}
+	data := make([]byte, util.BlockSize)
+	if _, err = store.ReadQuarantined(extentId, validSize, validSize, data[:1]); err != nil {
+		// no tail quarantined at the local size, the whole tail is fetched
+		return nil
+	}
+	var crcs []uint32
+	if crcs, err = dp.getRemoteBlockCrcs(remoteExtentInfo, validSize); err != nil {
+		log.LogWarnf("action[deltaRepairExtent] partition(%v) extent(%v) get block crcs from (%v) err(%v), fetch the whole tail.",
+			dp.ID(), extentId, remoteExtentInfo.Source, err)
+		return nil
+	}
+	var reused int64
+	for i, crc := range crcs {
+		offset := validSize + int64(i)*util.BlockSize
+		if uint64(offset) >= remoteExtentInfo.Size {
+			break
+		}
+		size := int64(util.BlockSize)
+		if uint64(offset+size) > remoteExtentInfo.Size {
+			size = int64(remoteExtentInfo.Size) - offset
+		}
+		n, readErr := store.ReadQuarantined(extentId, validSize, offset, data[:size])
+		if readErr != nil || int64(n) < size || crc32.ChecksumIEEE(data[:size]) != crc {
+			continue
+		}
+		// Fetch the blocks differing before this one
+		if err = dp.streamRepairExtentTo(remoteExtentInfo, uint64(offset)); err != nil {
+			return
+		}
+		if localExtentInfo, err = store.GetWatermark(extentId, false); err != nil {
+			return errors.Annotatef(err, "deltaRepairExtent GetWatermark error")
+		}
+		if int64(localExtentInfo.Size) != offset {
+			// the partition is stopped
+			return
+		}
+		if err = store.Write(extentId, offset, size, data, crc); err != nil {
+			return errors.Annotatef(err, "deltaRepairExtent repair data error")
+		}
+		reused += size
+	}
+	log.LogInfof("action[deltaRepairExtent] partition(%v) extent(%v) reused(%v) bytes of quarantined tail,"+
+		" fix from (%v) remoteSize(%v) localSize(%v).", dp.ID(), extentId, reused,
+		remoteExtentInfo.Source, remoteExtentInfo.Size, validSize)
+	return
+}
+
+// repairCorruptBlocks fetches the blocks of the local extents mismatching their
+// crc from another replica and writes them in place, the extents keep their size
+// so the data after the blocks stays as it is. A block is taken from the first
+// replica whose copy matches the crc it sends.
+func (dp *dataPartition) repairCorruptBlocks() {
+	store := dp.GetExtentStore()
+	for _, qr := range store.GetCorruptBlocks() {
+		var err error
+		for _, host := range dp.replicaHosts {
+			if isLocalHost(host) {
+				continue
+			}
+			if err = dp.repairBlockFrom(host, qr); err == nil {
+				log.LogInfof("action[repairCorruptBlocks] partition(%v) extent(%v) range(%v-%v) repaired from (%v).",
+					dp.partitionId, qr.FileId, qr.Start, qr.End, host)
+				break
+			}
+		}
+		if err != nil {
+			log.LogErrorf("action[repairCorruptBlocks] partition(%v) extent(%v) range(%v-%v) err(%v).",
+				dp.partitionId, qr.FileId, qr.Start, qr.End, err)
+		}
+	}
+}
+
+func (dp *dataPartition) repairBlockFrom(host string, qr *proto.QuarantinedRange) (err error) {
+	size := int(qr.End - qr.Start)
+	request := NewStreamReadPacket(dp.ID(), int(qr.FileId), int(qr.Start), size)
+	var conn net.Conn
+	if conn, err = gConnPool.Get(replicaAddr(host)); err != nil {
+		return
+	}
+	if err = request.WriteToConn(conn); err != nil {
+		gConnPool.Put(conn, true)
+		return
+	}
+	if err = request.ReadFromConn(conn, proto.ReadDeadlineTime); err != nil {
+		gConnPool.Put(conn, true)
+		return
+	}
+	gConnPool.Put(conn, true)
+	if request.IsErrPack() {
+		return errors.New(request.getErr())
+	}
+	if int(request.Size) != size {
+		return fmt.Errorf("read size(%v) of block size(%v)", request.Size, size)
+	}
+	gRepairScheduler.wait(dp.disk.Path, size)
+	return dp.GetExtentStore().RepairBlock(qr.FileId, int64(qr.Start), request.Data[:size], request.Crc)
+}
+
+/*the block crcs of the remote extent from the block of offset*/
+func (dp *dataPartition) getRemoteBlockCrcs(remoteExtentInfo *storage.FileInfo, offset int64) (crcs []uint32, err error) {
+	p := NewGetBlockCrcsPacket(dp.ID(), remoteExtentInfo.FileId, offset)
+	var conn net.Conn
+	if conn, err = gConnPool.Get(replicaAddr(remoteExtentInfo.Source)); err != nil {
+		return
+	}
+	if !proto.PeerSupports(conn.RemoteAddr().String(), proto.ConnCapBlockCrcs) {
+		gConnPool.Put(conn, false)
+		return nil, fmt.Errorf("%v did not negotiate the block crcs", remoteExtentInfo.Source)
+	}
+	if err = p.WriteToConn(conn); err != nil {
+		gConnPool.Put(conn, true)
+		return
+	}
+	if err = p.ReadFromConn(conn, proto.ReadDeadlineTime); err != nil {
+		gConnPool.Put(conn, true)
+		return
+	}
+	gConnPool.Put(conn, false)
+	if p.IsErrPack() {
+		return nil, errors.New(p.getErr())
+	}
+	crcs = make([]uint32, p.Size/util.PerBlockCrcSize)
+	for i := range crcs {
+		crcs[i] = binary.BigEndian.Uint32(p.Data[i*util.PerBlockCrcSize:])
+	}
+	return
+}
+
+// streamRepairExtentTo fetches the data of the remote extent from the local size to end.
+func (dp *dataPartition) streamRepairExtentTo(remoteExtentInfo *storage.FileInfo, end uint64) (err error) {
+	store := dp.GetExtentStore()
 
 	// Get local extent file info
 	localExtentInfo, err := store.GetWatermark(uint64(remoteExtentInfo.FileId), false)
 	if err != nil {
 		return errors.Annotatef(err, "streamRepairExtent GetWatermark error")
 	}
+	if localExtentInfo.Size >= end {
+		return
+	}
 
 	// Get need fix size for this extent file
-	needFixSize := remoteExtentInfo.Size - localExtentInfo.Size
+	needFixSize := end - localExtentInfo.Size
 
 	// Create streamRead packet, it offset is local extentInfoSize, size is needFixSize
 	request := NewStreamReadPacket(dp.ID(), remoteExtentInfo.FileId, int(localExtentInfo.Size), int(needFixSize))
-	var conn *net.TCPConn
+	var conn net.Conn
 
 	// Get a connection to leader host
-	conn, err = gConnPool.Get(remoteExtentInfo.Source)
+	conn, err = gConnPool.Get(replicaAddr(remoteExtentInfo.Source))
 	if err != nil {
 		return errors.Annotatef(err, "streamRepairExtent get conn from host(%v) error", remoteExtentInfo.Source)
 	}
@@ -344,8 +551,8 @@ func (dp *dataPartition) streamRepairExtent(remoteExtentInfo *storage.FileInfo)
 			log.LogErrorf("action[streamRepairExtent] err(%v).", err)
 			return
 		}
-		// If local extent size has great remoteExtent file size ,then break
-		if localExtentInfo.Size >= remoteExtentInfo.Size {
+		// If local extent size has reached end ,then break
+		if localExtentInfo.Size >= end {
 			break
 		}
 
@@ -355,6 +562,7 @@ func (dp *dataPartition) streamRepairExtent(remoteExtentInfo *storage.FileInfo)
 			log.LogError("action[streamRepairExtent] err(%v).", err)
 			return
 		}
+		gRepairScheduler.wait(dp.disk.Path, int(request.Size))
 		log.LogInfof("action[streamRepairExtent] partition(%v) extent(%v) start fix from (%v)"+
 			" remoteSize(%v) localSize(%v).", dp.ID(), remoteExtentInfo.FileId,
 			remoteExtentInfo.Source, remoteExtentInfo.Size, localExtentInfo.Size)
@@ -0,0 +1,97 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/health"
+)
+
+func (s *DataNode) registerHealth() {
+	health.Register("datanode", s.checkHealth, s.checkReady)
+}
+
+/*the node is alive from the start until it shuts down, and while a disk is usable*/
+func (s *DataNode) checkHealth() (checks []*health.Check) {
+	state := atomic.LoadUint32(&s.state)
+	checks = append(checks, health.NewCheck("state", state == Start || state == Running, "%v", stateName(state)))
+	if state == Running {
+		checks = append(checks, s.checkDisks())
+	}
+	return
+}
+
+/*the node is ready once it loaded its partitions and registered to master*/
+func (s *DataNode) checkReady() (checks []*health.Check) {
+	checks = s.checkHealth()
+	state := atomic.LoadUint32(&s.state)
+	if state != Start && state != Running {
+		return
+	}
+	var toLoad, loaded int64
+	if s.space != nil {
+		toLoad, loaded = s.space.Stats().GetLoadProgress()
+	}
+	checks = append(checks, health.NewCheck("partitions", state == Running && loaded == toLoad,
+		"%v of %v loaded", loaded, toLoad))
+	registered := atomic.LoadInt32(&s.registered) == 1
+	checks = append(checks, health.NewCheck("register", registered, "addr[%v] master[%v]", s.localServeAddr, MasterHelper.Leader()))
+	if registered && s.raftDir != "" && s.nodeId != 0 {
+		checks = append(checks, health.NewCheck("raft", s.raftStore != nil, "nodeID[%v] dir[%v]", s.nodeId, s.raftDir))
+	}
+	checks = append(checks, checkMasterHeartbeat(atomic.LoadInt64(&s.lastHeartbeat)))
+	return
+}
+
+func (s *DataNode) checkDisks() *health.Check {
+	var good int
+	disks := s.space.GetDisks()
+	for _, d := range disks {
+		d.RLock()
+		if d.Status != proto.Unavaliable {
+			good++
+		}
+		d.RUnlock()
+	}
+	return health.NewCheck("disks", good != 0, "%v of %v disks available", good, len(disks))
+}
+
+/*the master counts the node down if it misses the heartbeats*/
+func checkMasterHeartbeat(last int64) *health.Check {
+	if last == 0 {
+		return health.NewWarnCheck("masterHeartbeat", false, "no heartbeat")
+	}
+	elapsed := time.Now().Unix() - last
+	return health.NewWarnCheck("masterHeartbeat", elapsed < MasterHeartbeatTimeout, "last heartbeat %vs ago", elapsed)
+}
+
+func stateName(state uint32) string {
+	switch state {
+	case Standby:
+		return "standby"
+	case Start:
+		return "starting"
+	case Running:
+		return "running"
+	case Shutdown:
+		return "shutting down"
+	case Stopped:
+		return "stopped"
+	}
+	return "unknown"
+}
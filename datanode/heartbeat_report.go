@@ -0,0 +1,109 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+// PartitionReporter keeps the partition reports last acked by the master,
+// so a heartbeat only need to carry the partitions changed since then. A
+// report sent is pending until the next heartbeat request of the master acks
+// its seq, a report lost on the way is never the base of a delta.
+type PartitionReporter struct {
+	epoch      uint64
+	seq        uint64
+	lastFull   time.Time
+	reports    map[uint64]*proto.PartitionReport //reports acked by the master, nil if none of epoch
+	reportSeq  uint64
+	pending    map[uint64]*proto.PartitionReport //reports sent, waiting for the ack of the master
+	pendingSeq uint64
+	sync.Mutex
+}
+
+func NewPartitionReporter() *PartitionReporter {
+	return &PartitionReporter{}
+}
+
+// MakeReport turn the full partition reports in response into a delta one if
+// the master supports it and acked the reports this node holds as its base.
+// The reports of response are returned, and should be passed to Accept once
+// the heartbeat is sent.
+func (r *PartitionReporter) MakeReport(request *proto.HeartBeatRequest,
+	response *proto.DataNodeHeartBeatResponse) (epoch uint64, reports map[uint64]*proto.PartitionReport) {
+	if r.pending != nil && request.ReportEpoch == r.epoch && request.ReportSeq == r.pendingSeq {
+		r.reports, r.reportSeq = r.pending, r.pendingSeq
+	}
+	r.pending = nil
+	reports = make(map[uint64]*proto.PartitionReport)
+	for _, vr := range response.PartitionInfo {
+		reports[vr.PartitionID] = vr
+	}
+	r.seq++
+	response.ReportSeq = r.seq
+	response.Capabilities = proto.CapDeltaHeartbeat
+	if request.Capabilities&proto.CapDeltaHeartbeat == 0 || request.ReportEpoch == 0 ||
+		request.ReportEpoch != r.epoch || r.reports == nil || request.ReportSeq != r.reportSeq ||
+		time.Since(r.lastFull) > DefaultFullReportInterval {
+		epoch = uint64(time.Now().UnixNano())
+		response.ReportEpoch = epoch
+		return
+	}
+	epoch = r.epoch
+	changed := make([]*proto.PartitionReport, 0)
+	for id, vr := range reports {
+		if last, ok := r.reports[id]; !ok || !isSameReport(last, vr) {
+			changed = append(changed, vr)
+		}
+	}
+	for id := range r.reports {
+		if _, ok := reports[id]; !ok {
+			response.RemovedPartitions = append(response.RemovedPartitions, id)
+		}
+	}
+	response.IsDelta = true
+	response.ReportEpoch = epoch
+	response.PartitionInfo = changed
+	return
+}
+
+// Accept record the reports sent to the master, they are the base of the
+// next delta once the master acks seq.
+func (r *PartitionReporter) Accept(epoch, seq uint64, reports map[uint64]*proto.PartitionReport) {
+	if epoch != r.epoch {
+		r.lastFull = time.Now()
+		r.reports = nil
+	}
+	r.epoch = epoch
+	r.pending, r.pendingSeq = reports, seq
+}
+
+func isSameReport(a, b *proto.PartitionReport) bool {
+	if a.PartitionStatus != b.PartitionStatus || a.Total != b.Total || a.Used != b.Used ||
+		a.Reclaimable != b.Reclaimable || len(a.Quarantined) != len(b.Quarantined) ||
+		a.Sealed != b.Sealed || a.SealCrc != b.SealCrc || a.RaftLeader != b.RaftLeader || a.WriteLatencyMs != b.WriteLatencyMs ||
+		a.Epoch != b.Epoch {
+		return false
+	}
+	for i := range a.Quarantined {
+		if *a.Quarantined[i] != *b.Quarantined[i] {
+			return false
+		}
+	}
+	return true
+}
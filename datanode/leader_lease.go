@@ -0,0 +1,108 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/tiglabs/containerfs/master"
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	LeaderLeaseRenewInterval = 5 * time.Second
+	LeaderLeaseRetryInterval = time.Second //the renew is retried at it until it succeeds
+)
+
+// startLeaderLease renews the leader leases of the partitions of the node. A
+// partition not raft replicated is led by the node only while it holds the
+// lease granted by the master at the current epoch of the partition, so a
+// leader replaced by the master refuses the writes once its lease expired.
+// The first renew is made once the node is registered and a failed renew is
+// retried every second, the leases held are alarmed once they expired without
+// a master answering.
+func (s *DataNode) startLeaderLease() {
+	timer := time.NewTimer(LeaderLeaseRetryInterval)
+	defer timer.Stop()
+	renewed := time.Now()
+	alarmed := false
+	for {
+		select {
+		case <-s.stopC:
+			return
+		case <-timer.C:
+		}
+		if ok, err := s.renewLeaderLeases(); ok {
+			renewed = time.Now()
+			alarmed = false
+			timer.Reset(LeaderLeaseRenewInterval)
+			continue
+		} else if err != nil && !alarmed && time.Since(renewed) > time.Second*master.DefaultLeaderLeaseSeconds {
+			alarmed = true
+			msg := fmt.Sprintf("node[%v] got no leader lease from the master for %v, the writes of its partitions are refused: %v",
+				s.localServeAddr, time.Since(renewed), err)
+			master.WarnBySpecialUmpKey(fmt.Sprintf("%s_%s", s.clusterId, UmpModuleName), msg)
+		}
+		timer.Reset(LeaderLeaseRetryInterval)
+	}
+}
+
+/*ok once the master answered or the node leads no partition, err is the failure of the master*/
+func (s *DataNode) renewLeaderLeases() (ok bool, err error) {
+	if LocalIP == "" {
+		return
+	}
+	partitions := make(map[uint64]*dataPartition)
+	request := &proto.LeaderLeaseRequest{Addr: util.JoinHostPort(LocalIP, s.port), PartitionIDs: make([]uint64, 0)}
+	s.space.RangePartitions(func(partition DataPartition) bool {
+		if dp, ok := partition.(*dataPartition); ok && !dp.isRaftReplicated() {
+			partitions[uint64(dp.ID())] = dp
+			request.PartitionIDs = append(request.PartitionIDs, uint64(dp.ID()))
+		}
+		return true
+	})
+	if len(partitions) == 0 {
+		return true, nil
+	}
+	data, err := json.Marshal(request)
+	if err != nil {
+		log.LogErrorf("action[renewLeaderLeases] err(%v).", err)
+		return
+	}
+	// the lease is counted from the time it was asked, it expires on the node
+	// before it expires on the master
+	asked := time.Now()
+	body, err := MasterHelper.Request("POST", master.DataNodeLease, nil, data)
+	if err != nil {
+		log.LogWarnf("action[renewLeaderLeases] partitions(%v) err(%v).", len(partitions), err)
+		return
+	}
+	response := &proto.LeaderLeaseResponse{}
+	if err = json.Unmarshal(body, response); err != nil {
+		log.LogErrorf("action[renewLeaderLeases] unmarshal(%v) err(%v).", string(body), err)
+		return
+	}
+	for _, lease := range response.Leases {
+		if dp, ok := partitions[lease.PartitionID]; ok {
+			dp.renewLeaderLease(lease.Epoch, asked.Add(time.Second*time.Duration(lease.Seconds)))
+		}
+	}
+	log.LogDebugf("action[renewLeaderLeases] partitions(%v) leases(%v).", len(partitions), len(response.Leases))
+	return true, nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+/*the head node of a mark delete of the partition at epoch*/
+func newLeaseTestPacket(epoch uint64) *Packet {
+	pkg := &Packet{epoch: epoch, epochRequired: true}
+	pkg.Opcode = proto.OpMarkDelete
+	pkg.PartitionID = 7
+	return pkg
+}
+
+func TestDataPartition_LeaderLease(t *testing.T) {
+	dir := testPartitionDir(t)
+	defer os.RemoveAll(path.Dir(dir))
+	dp := &dataPartition{partitionId: 7, path: dir, meta: testPartitionMeta(1), replicaHosts: make([]string, 0)}
+	s := &DataNode{space: &spaceManager{partitions: map[uint32]DataPartition{7: dp}}}
+	checkLeader := func(name string, leader bool) {
+		err := s.checkAction(newLeaseTestPacket(dp.Epoch()))
+		if dp.IsLeader() != leader || (err == nil) != leader || err != nil && errCodeOf(err.Error()) != proto.ErrCodeNotLeader {
+			t.Fatalf("%v: leader(%v) write err(%v)", name, dp.IsLeader(), err)
+		}
+	}
+	checkLeader("no lease", false)
+	dp.renewLeaderLease(3, time.Now().Add(time.Second))
+	checkLeader("lease", true)
+	dp.renewLeaderLease(3, time.Now())
+	checkLeader("lease expired", false)
+
+	// the epoch bumped by the master, the lease of the old epoch is no more held
+	dp.renewLeaderLease(3, time.Now().Add(time.Second))
+	dp.UpdateEpoch(4)
+	checkLeader("lease of the old epoch", false)
+	dp.renewLeaderLease(3, time.Now().Add(time.Second))
+	checkLeader("lease renewed at the old epoch", false)
+	dp.renewLeaderLease(4, time.Now().Add(time.Second))
+	checkLeader("lease renewed at the new epoch", true)
+	// a lease granted at a newer epoch catches the partition up with it
+	dp.renewLeaderLease(5, time.Now().Add(time.Second))
+	if dp.Epoch() != 5 {
+		t.Fatalf("epoch(%v) after a lease of epoch 5", dp.Epoch())
+	}
+	checkLeader("lease of a newer epoch", true)
+	if meta, _, err := loadDataPartitionMeta(dir); err != nil || meta.Epoch != 5 {
+		t.Fatalf("stored epoch: meta(%+v) err(%v)", meta, err)
+	}
+
+	// the writes of the old epoch are refused even by the leader
+	if err := s.checkAction(newLeaseTestPacket(4)); err == nil || errCodeOf(err.Error()) != proto.ErrCodeStaleEpoch {
+		t.Fatalf("write of a stale epoch: err(%v)", err)
+	}
+	pkg := newLeaseTestPacket(5)
+	pkg.goals = 1
+	if err := s.checkAction(pkg); err != nil {
+		t.Fatalf("write down the chain: %v", err)
+	}
+}
@@ -31,16 +31,17 @@ type MessageHandler struct {
 	handleCh    chan struct{}
 	requestCh   chan *Packet
 	replyCh     chan *Packet
-	inConn      *net.TCPConn
+	inConn      net.Conn
+	connCaps    uint32 //capabilities negotiated by the first packet of inConn
 	isClean     bool
 	exitC       chan bool
 	exited      bool
 	exitedMu    sync.RWMutex
-	connectMap  map[string]*net.TCPConn
+	connectMap  map[string]net.Conn
 	connectLock sync.RWMutex
 }
 
-func NewMsgHandler(inConn *net.TCPConn) *MessageHandler {
+func NewMsgHandler(inConn net.Conn) *MessageHandler {
 	m := new(MessageHandler)
 	m.sentList = list.New()
 	m.handleCh = make(chan struct{}, RequestChanSize)
@@ -48,7 +49,7 @@ func NewMsgHandler(inConn *net.TCPConn) *MessageHandler {
 	m.replyCh = make(chan *Packet, RequestChanSize)
 	m.exitC = make(chan bool, 100)
 	m.inConn = inConn
-	m.connectMap = make(map[string]*net.TCPConn)
+	m.connectMap = make(map[string]net.Conn)
 
 	return m
 }
@@ -83,14 +84,14 @@ func (msgH *MessageHandler) ExitSign() {
 }
 
 func (msgH *MessageHandler) AllocateNextConn(pkg *Packet) (err error) {
-	var conn *net.TCPConn
+	var conn net.Conn
 	if pkg.StoreMode == proto.ExtentStoreMode && pkg.IsWriteOperation() {
 		key := fmt.Sprintf("%v_%v", pkg.PartitionID, pkg.FileID)
 		msgH.connectLock.RLock()
 		conn := msgH.connectMap[key]
 		msgH.connectLock.RUnlock()
 		if conn == nil {
-			conn, err = gConnPool.Get(pkg.NextAddr)
+			conn, err = gConnPool.Get(replicaAddr(pkg.NextAddr))
 			if err != nil {
 				return
 			}
@@ -101,7 +102,7 @@ func (msgH *MessageHandler) AllocateNextConn(pkg *Packet) (err error) {
 		pkg.useConnectMap = true
 		pkg.NextConn = conn
 	} else {
-		conn, err = gConnPool.Get(pkg.NextAddr)
+		conn, err = gConnPool.Get(replicaAddr(pkg.NextAddr))
 		if err != nil {
 			return
 		}
@@ -172,7 +173,7 @@ func (msgH *MessageHandler) ClearReplys() {
 	}
 }
 
-func (msgH *MessageHandler) isUsedCloseFiles(conn *net.TCPConn, target string, err error) {
+func (msgH *MessageHandler) isUsedCloseFiles(conn net.Conn, target string, err error) {
 	gConnPool.CheckErrorForPutConnect(conn, target, err)
 }
 
@@ -26,6 +26,9 @@ import (
 	"github.com/tiglabs/containerfs/proto"
 	"github.com/tiglabs/containerfs/storage"
 	"github.com/tiglabs/containerfs/util"
+	"github.com/tiglabs/containerfs/util/auth"
+	"github.com/tiglabs/containerfs/util/qos"
+	"github.com/tiglabs/containerfs/util/trace"
 	"github.com/tiglabs/containerfs/util/ump"
 )
 
@@ -37,14 +40,17 @@ var (
 
 type Packet struct {
 	proto.Packet
-	NextConn      *net.TCPConn
+	NextConn      net.Conn
 	NextAddr      string
 	IsReturn      bool
 	DataPartition DataPartition
 	goals         uint8
 	addrs         []string
+	epoch         uint64
+	epochRequired bool //the sender negotiated ConnCapEpoch, a packet without epoch is at epoch 0
 	tpObject      *ump.TpObject
 	useConnectMap bool
+	span          *trace.Span
 }
 
 func (p *Packet) afterTp() (ok bool) {
@@ -63,11 +69,46 @@ func (p *Packet) beforeTp(clusterId string) (ok bool) {
 	return
 }
 
+/*start the span of a traced packet, the packet goes on to the next node as its child*/
+func (p *Packet) startSpan() {
+	if p.span = trace.StartChild(p.Trace, "datanode."+p.GetOpMsg(), trace.SpanKindServer); p.span == nil {
+		return
+	}
+	p.SetTrace(p.span.Context())
+	p.span.SetAttribute("partition", p.PartitionID)
+	p.span.SetAttribute("extent", p.FileID)
+	p.span.SetAttribute("offset", p.Offset)
+	p.span.SetAttribute("size", p.Size)
+}
+
+func (p *Packet) endSpan() {
+	if p.span == nil {
+		return
+	}
+	if p.IsErrPack() {
+		p.span.SetError(errors.New(p.getErr()))
+	}
+	p.span.End()
+}
+
+/*the context of a slow op, with the next nodes of a transit packet and the error of a failed one*/
+func (p *Packet) slowOpContext(c net.Conn) string {
+	msg := fmt.Sprintf("id[%v] remote[%v] nodes[%v] next[%v]", p.GetUniqueLogId(), c.RemoteAddr(), p.Nodes, p.NextAddr)
+	if p.IsErrPack() {
+		msg += fmt.Sprintf(" err[%v]", string(p.Data[:p.Size]))
+	}
+	if p.IsTraced() {
+		msg += fmt.Sprintf(" trace[%v]", p.Trace)
+	}
+	return msg
+}
+
 func (p *Packet) UnmarshalAddrs() (addrs []string, err error) {
 	if len(p.Arg) < int(p.Arglen) {
 		return nil, ErrArgLenMismatch
 	}
 	str := string(p.Arg[:int(p.Arglen)])
+	str, p.epoch = proto.SplitEpochArg(str)
 	goalAddrs := strings.SplitN(str, proto.AddrSplit, -1)
 	p.goals = uint8(len(goalAddrs) - 1)
 	if p.goals > 0 {
@@ -82,6 +123,11 @@ func (p *Packet) UnmarshalAddrs() (addrs []string, err error) {
 	return
 }
 
+/*the stream read asks the full blocks to be sent from the file without copy*/
+func (p *Packet) isZeroCopyRead() bool {
+	return p.Opcode == proto.OpStreamRead && int(p.Arglen) <= len(p.Arg) && string(p.Arg[:p.Arglen]) == proto.ArgZeroCopy
+}
+
 func NewPacket() (p *Packet) {
 	p = new(Packet)
 	p.Magic = proto.ProtoMagic
@@ -89,13 +135,42 @@ func NewPacket() (p *Packet) {
 	return
 }
 
+/*the access of the packet to the vol of its partition, the ops not sent by the clients are internal*/
+func (p *Packet) access() auth.Access {
+	switch p.Opcode {
+	case proto.OpRead, proto.OpStreamRead, proto.OpGetWatermark, proto.OpGetDataPartitionMetrics:
+		return auth.AccessRead
+	case proto.OpWrite, proto.OpCreateFile, proto.OpMarkDelete, proto.OpSyncExtent, proto.OpAddExtentRef,
+		proto.OpPunchHole:
+		return auth.AccessWrite
+	}
+	return auth.AccessInternal
+}
+
+/*the reads and the writes of the clients are limited by the qos, not the ones forwarded by the replication chain*/
+func (p *Packet) isQosLimited() bool {
+	switch p.Opcode {
+	case proto.OpRead, proto.OpStreamRead, proto.OpWrite:
+		return p.goals == p.Nodes
+	}
+	return false
+}
+
 func (p *Packet) IsMasterCommand() bool {
 	switch p.Opcode {
 	case
 		proto.OpDataNodeHeartbeat,
 		proto.OpLoadDataPartition,
 		proto.OpCreateDataPartition,
-		proto.OpDeleteDataPartition:
+		proto.OpDeleteDataPartition,
+		proto.OpArchiveDataPartition,
+		proto.OpRehydrateDataPartition,
+		proto.OpMoveDataPartition,
+		proto.OpOfflineDataPartition,
+		proto.OpRepairDataPartition,
+		proto.OpVerifyDataPartition,
+		proto.OpTierExtents,
+		proto.OpEncodeDataPartition:
 		return true
 	}
 	return false
@@ -167,6 +242,19 @@ func NewStreamReadPacket(partitionId uint32, extentId, offset, size int) (p *Pac
 	return
 }
 
+func NewGetBlockCrcsPacket(partitionId uint32, extentId int, offset int64) (p *Packet) {
+	p = new(Packet)
+	p.FileID = uint64(extentId)
+	p.PartitionID = partitionId
+	p.Magic = proto.ProtoMagic
+	p.Offset = offset
+	p.Opcode = proto.OpGetBlockCrcs
+	p.StoreMode = proto.ExtentStoreMode
+	p.ReqID = proto.GetReqID()
+
+	return
+}
+
 func NewStreamBlobFileRepairReadPacket(partitionId uint32, blobfileId int) (p *Packet) {
 	p = new(Packet)
 	p.FileID = uint64(blobfileId)
@@ -236,6 +324,17 @@ func (p *Packet) IsExtentWritePacket() bool {
 	return p.StoreMode == proto.ExtentStoreMode && p.IsWriteOperation()
 }
 
+// IsEpochProtected return true if the packet must carry the latest membership
+// epoch of the partition, packets of stale client or old leader are rejected.
+func (p *Packet) IsEpochProtected() bool {
+	switch p.Opcode {
+	case proto.OpWrite, proto.OpCreateFile, proto.OpMarkDelete, proto.OpAddExtentRef, proto.OpPunchHole,
+		proto.OpNotifyExtentRepair, proto.OpNotifyBlobRepair:
+		return true
+	}
+	return false
+}
+
 func (p *Packet) IsReadOperation() bool {
 	return p.Opcode == proto.OpStreamRead || p.Opcode == proto.OpRead
 }
@@ -245,7 +344,8 @@ func (p *Packet) IsMarkDeleteReq() bool {
 }
 
 func (p *Packet) isHeadNode() (ok bool) {
-	if p.goals == p.Nodes && (p.IsWriteOperation() || p.IsCreateFileOperation() || p.IsMarkDeleteOperation()) {
+	if p.goals == p.Nodes && (p.IsWriteOperation() || p.IsCreateFileOperation() || p.IsMarkDeleteOperation() ||
+		p.Opcode == proto.OpPunchHole) {
 		ok = true
 	}
 
@@ -267,47 +367,70 @@ func (p *Packet) getErr() (m string) {
 	return fmt.Sprintf("req(%v) err(%v)", p.GetUniqueLogId(), string(p.Data[:p.Size]))
 }
 
-func (p *Packet) ClassifyErrorOp(errLog string, errMsg string) {
+// the codes of the errors of the data node, the first error found in the
+// message gives the code since the errors are annotated along the chain
+var errCodes = []struct {
+	err  error
+	code proto.ErrCode
+}{
+	{storage.ErrorParamMismatch, proto.ErrCodeArgMismatch},
+	{ErrorUnknownOp, proto.ErrCodeUnknownOp},
+	{ErrStoreTypeMismatch, proto.ErrCodeArgMismatch},
+	{storage.ErrorObjNotFound, proto.ErrCodeNotExist},
+	{storage.ErrorHasDelete, proto.ErrCodeNotExist},
+	{auth.ErrNotPermitted, proto.ErrCodeNotPerm},
+	{ErrClientFenced, proto.ErrCodeClientFenced},
+	{ErrVolReadOnly, proto.ErrCodeReadOnly},
+	{qos.ErrThrottled, proto.ErrCodeThrottled},
+	{ErrPartitionNotExist, proto.ErrCodePartitionNotExist},
+	{ErrStaleEpoch, proto.ErrCodeStaleEpoch},
+	{ErrNotLeader, proto.ErrCodeNotLeader},
+	{ErrNodeDraining, proto.ErrCodeNodeDraining},
+	{storage.ErrSyscallNoSpace, proto.ErrCodeDiskNoSpace},
+	{storage.ErrorAgain, proto.ErrCodeIntraGroupNet},
+	{storage.ErrorFileNotFound, proto.ErrCodeNotExist},
+	{storage.ErrorExtentShared, proto.ErrCodeExtentShared},
+}
+
+/*the code of the error message, ErrCodeIntraGroupNet if it is none of the known errors*/
+func errCodeOf(errMsg string) proto.ErrCode {
+	for _, e := range errCodes {
+		if strings.Contains(errMsg, e.err.Error()) {
+			return e.code
+		}
+	}
+	return proto.ErrCodeIntraGroupNet
+}
+
+func (p *Packet) ClassifyErrorOp(errLog string, errMsg string) (code proto.ErrCode) {
 	if strings.Contains(errLog, ActionReceiveFromNext) || strings.Contains(errLog, ActionSendToNext) ||
 		strings.Contains(errLog, ConnIsNullErr) || strings.Contains(errLog, ActionCheckAndAddInfos) {
-		p.ResultCode = proto.OpIntraGroupNetErr
-		return
+		code = proto.ErrCodeIntraGroupNet
+	} else if code = errCodeOf(errMsg); code == proto.ErrCodeNotExist && p.Opcode == proto.OpWrite &&
+		strings.Contains(errMsg, storage.ErrorFileNotFound.Error()) {
+		// the extent of a write may be created on the replica later, the write goes to another partition
+		code = proto.ErrCodeIntraGroupNet
 	}
-
-	if strings.Contains(errMsg, storage.ErrorParamMismatch.Error()) ||
-		strings.Contains(errMsg, ErrorUnknownOp.Error()) {
-		p.ResultCode = proto.OpArgMismatchErr
-	} else if strings.Contains(errMsg, storage.ErrorObjNotFound.Error()) ||
-		strings.Contains(errMsg, storage.ErrorHasDelete.Error()) {
-		p.ResultCode = proto.OpNotExistErr
-	} else if strings.Contains(errMsg, storage.ErrSyscallNoSpace.Error()) {
-		p.ResultCode = proto.OpDiskNoSpaceErr
-	} else if strings.Contains(errMsg, storage.ErrorAgain.Error()) {
-		p.ResultCode = proto.OpIntraGroupNetErr
-	} else if strings.Contains(errMsg, storage.ErrorFileNotFound.Error()) {
-		if p.Opcode != proto.OpWrite {
-			p.ResultCode = proto.OpNotExistErr
-		} else {
-			p.ResultCode = proto.OpIntraGroupNetErr
-		}
-	} else {
+	p.ResultCode = code.ResultCode()
+	if code == proto.ErrCodeClientFenced || code == proto.ErrCodePartitionNotExist {
+		// these failed with OpIntraGroupNetErr before the codes, the older clients rely on it
 		p.ResultCode = proto.OpIntraGroupNetErr
 	}
+	return
 }
 
 func (p *Packet) PackErrorBody(action, msg string) {
-	p.ClassifyErrorOp(action, msg)
+	code := p.ClassifyErrorOp(action, msg)
 	if p.ResultCode == proto.OpDiskNoSpaceErr || p.ResultCode == proto.OpDiskErr {
 		p.ResultCode = proto.OpIntraGroupNetErr
 	}
-	p.Size = uint32(len([]byte(action + "_" + msg)))
-	p.Data = make([]byte, p.Size)
-	copy(p.Data[:int(p.Size)], []byte(action+"_"+msg))
+	p.Data = proto.ErrBody(code, action+"_"+msg)
+	p.Size = uint32(len(p.Data))
 }
 
 func (p *Packet) ReadFull(c net.Conn, readSize int) (err error) {
-	if p.Opcode == proto.OpWrite && readSize == util.BlockSize {
-		p.Data, _ = proto.Buffers.Get(util.BlockSize)
+	if p.Opcode == proto.OpWrite {
+		p.Data = proto.Buffers.Alloc(readSize)
 	} else {
 		p.Data = make([]byte, readSize)
 	}
@@ -330,6 +453,9 @@ func (p *Packet) ReadFromConnFromCli(c net.Conn, deadlineTime time.Duration) (er
 	if err = p.UnmarshalHeader(header); err != nil {
 		return
 	}
+	if err = p.ReadTraceFromConn(c); err != nil {
+		return
+	}
 
 	if p.Arglen > 0 {
 		if err = proto.ReadFull(c, &p.Arg, int(p.Arglen)); err != nil {
@@ -18,13 +18,17 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"io/ioutil"
 	"math"
+	"math/rand"
 	"os"
 	"path"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/juju/errors"
@@ -37,6 +41,7 @@ import (
 const (
 	DataPartitionPrefix       = "datapartition"
 	DataPartitionMetaFileName = "META"
+	DataPartitionMetaBakName  = "META.bak" //the meta before the last store
 	TimeLayout                = "2006-01-02 15:04:05"
 )
 
@@ -46,6 +51,7 @@ var (
 
 type DataPartition interface {
 	ID() uint32
+	Volume() string
 	Path() string
 	IsLeader() bool
 	ReplicaHosts() []string
@@ -54,6 +60,7 @@ type DataPartition interface {
 	Size() int
 	Used() int
 	Available() int
+	Reclaimable() int
 
 	Status() int
 	ChangeStatus(status int)
@@ -73,16 +80,37 @@ type DataPartition interface {
 	AddWriteMetrics(latency uint64)
 	AddReadMetrics(latency uint64)
 
+	Quarantined() []*proto.QuarantinedRange
+	IsSealed() bool
+	Manifest() (*proto.PartitionManifest, error)
+
+	Epoch() uint64
+	UpdateEpoch(epoch uint64)
+	CheckEpoch(epoch uint64) error
+
 	Stop()
 }
 
 type dataPartitionMeta struct {
-	VolumeId      string
-	PartitionType string
-	PartitionId   uint32
-	PartitionSize int
-	CreateTime    string
-}
+	VolumeId        string
+	PartitionType   string
+	PartitionId     uint32
+	PartitionSize   int
+	CreateTime      string
+	Epoch           uint64
+	Sealed          bool         `json:",omitempty"`
+	ReplicationMode string       `json:",omitempty"`
+	Peers           []proto.Peer `json:",omitempty"` //members of the raft group of a raft replicated partition
+	Hosts           []string     `json:",omitempty"` //the replica hosts got from the master at the time of the store
+	WarmHosts       []string     `json:",omitempty"`
+	ShardHosts      []string     `json:",omitempty"` //the hosts of the shards of an erasure coded partition by the shard index
+	Status          int          `json:",omitempty"`
+	Version         uint64       `json:",omitempty"` //incremented by every store, the load takes the valid meta of the highest
+	Crc             uint32       `json:",omitempty"` //of the json before it, the meta stored before it has none
+}
+
+// the crc trails the json of the meta, so it is checked on the bytes read
+var metaCrcTrailer = regexp.MustCompile(`,"Crc":([0-9]+)}\s*$`)
 
 func (meta *dataPartitionMeta) Validate() (err error) {
 	meta.VolumeId = strings.TrimSpace(meta.VolumeId)
@@ -95,89 +123,263 @@ func (meta *dataPartitionMeta) Validate() (err error) {
 	return
 }
 
+func (meta *dataPartitionMeta) marshal() (data []byte, err error) {
+	meta.Crc = 0
+	if data, err = json.Marshal(meta); err != nil {
+		return
+	}
+	meta.Crc = crc32.ChecksumIEEE(data)
+	data = append(data[:len(data)-1], fmt.Sprintf(`,"Crc":%v}`, meta.Crc)...)
+	return
+}
+
+// checkCrc checks the crc on the bytes of the json before it, not on a marshal
+// of the meta decoded, so a meta stored by a release with fields unknown to
+// this one still loads.
+func (meta *dataPartitionMeta) checkCrc(data []byte) (err error) {
+	if meta.Crc == 0 {
+		return
+	}
+	loc := metaCrcTrailer.FindIndex(data)
+	if loc == nil {
+		return fmt.Errorf("data partition meta crc(%v) not trailing", meta.Crc)
+	}
+	body := append(append(make([]byte, 0, loc[0]+1), data[:loc[0]]...), '}')
+	if actual := crc32.ChecksumIEEE(body); actual != meta.Crc {
+		err = fmt.Errorf("data partition meta crc(%v) expect(%v)", actual, meta.Crc)
+	}
+	return
+}
+
+func readDataPartitionMeta(filename string) (meta *dataPartitionMeta, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(filename); err != nil {
+		return
+	}
+	meta = &dataPartitionMeta{}
+	if err = json.Unmarshal(data, meta); err != nil {
+		return
+	}
+	if err = meta.checkCrc(data); err != nil {
+		return
+	}
+	err = meta.Validate()
+	return
+}
+
+// loadDataPartitionMeta returns the valid meta of the highest version among the
+// META and the META.bak of the partition, and whether it is not the META, a
+// META broken by a crash of an older release before the meta had a backup is
+// not recovered. The meta has to match the name of the partition dir.
+func loadDataPartitionMeta(partitionDir string) (meta *dataPartitionMeta, recovered bool, err error) {
+	var id uint32
+	var size int
+	if id, size, err = unmarshalPartitionName(path.Base(partitionDir)); err != nil {
+		return
+	}
+	var metaErr error
+	for _, name := range []string{DataPartitionMetaFileName, DataPartitionMetaBakName} {
+		m, err := readDataPartitionMeta(path.Join(partitionDir, name))
+		if err == nil && (m.PartitionId != id || m.PartitionSize != size) {
+			err = fmt.Errorf("data partition meta of partition(%v) size(%v)", m.PartitionId, m.PartitionSize)
+		}
+		if err != nil {
+			if name == DataPartitionMetaFileName {
+				metaErr = err
+			}
+			if !os.IsNotExist(err) {
+				log.LogWarnf("action[loadDataPartitionMeta] %v of %v err(%v).", name, partitionDir, err)
+			}
+			continue
+		}
+		if meta == nil || m.Version > meta.Version {
+			meta = m
+			recovered = name != DataPartitionMetaFileName
+		}
+	}
+	if meta == nil {
+		err = metaErr
+	}
+	return
+}
+
 type dataPartition struct {
 	volumeId        string
 	partitionId     uint32
 	partitionStatus int
 	partitionSize   int
 	replicaHosts    []string
+	warmHosts       []string //non-voting replicas, caught up by the leader asynchronously
+	hostsRefreshed  int64    //unix nanoseconds the hosts were got by the batched refresh of the node
 	disk            *Disk
-	isLeader        bool
 	path            string
 	used            int
+	reclaimable     int
+	usageReconciled time.Time
 	extentStore     *storage.ExtentStore
 	blobStore       *storage.BlobStore
+	ecStore         *storage.ECStore //the shards kept by the node, nil unless the partition is erasure coded or being encoded
+	ecLock          sync.RWMutex
 	stopC           chan bool
 	isFirstRestart  bool
+	meta            *dataPartitionMeta
+	epochLock       sync.Mutex
+	leaseEpoch      uint64    //the epoch of the leader lease granted by the master
+	leaseExpire     time.Time //counted from the time the lease was asked
+	isRepairing     int32
+	isSealed        int32                     //set by the archive or the seal, the partition refuses the writes
+	isSealing       int32                     //a seal or unseal asked by the master in progress
+	sealInSync      int32                     //the master found the replicas of the sealed partition the same
+	corruptObjects  []*proto.QuarantinedRange //blob objects failed the last scrub
+	scrubLock       sync.Mutex
+	extentRefs      *extentReferences //extents referenced by the meta partitions of the vol
+	raft            *partitionRaft    //nil unless the partition is raft replicated and the raft is started
+	coldTierDays    int32             //days an extent is not read before it is tiered, 0 keeps the extents local
+	volReadOnly     int32             //set by master heartbeat while the vol refuses the writes of the clients
 
 	runtimeMetrics *DataPartitionMetrics
 }
 
-func CreateDataPartition(volId string, partitionId uint32, disk *Disk, size int, partitionType string) (dp DataPartition, err error) {
+func CreateDataPartition(volId string, partitionId uint32, disk *Disk, size int, partitionType, encryptKeyId string) (dp DataPartition, err error) {
 
-	if dp, err = newDataPartition(volId, partitionId, disk, size); err != nil {
+	if dp, err = newDataPartition(volId, partitionId, disk, size, false); err != nil {
 		return
 	}
-	// Store meta information into meta file.
-	var (
-		metaFile *os.File
-		metaData []byte
-	)
-	metaFilePath := path.Join(dp.Path(), DataPartitionMetaFileName)
-	if metaFile, err = os.OpenFile(metaFilePath, os.O_CREATE|os.O_RDWR, 0666); err != nil {
-		return
+	partition := dp.(*dataPartition)
+	// the stores keep the key id, the key is delivered by the heartbeats
+	if encryptKeyId != "" {
+		if err = partition.extentStore.EnableEncryption(encryptKeyId); err != nil {
+			return
+		}
+		if err = partition.blobStore.EnableEncryption(encryptKeyId); err != nil {
+			return
+		}
 	}
-	defer metaFile.Close()
-	meta := &dataPartitionMeta{
+	// Store meta information into meta file.
+	partition.meta = &dataPartitionMeta{
 		VolumeId:      volId,
 		PartitionId:   partitionId,
 		PartitionType: partitionType,
 		PartitionSize: size,
 		CreateTime:    time.Now().Format(TimeLayout),
 	}
-	if metaData, err = json.Marshal(meta); err != nil {
+	err = partition.storeMeta()
+	return
+}
+
+// storeMeta write the meta information into meta file, the file is replaced
+// atomically as the epoch in it may be updated. The new meta is synced before it
+// replaces the META, which is kept as META.bak, so a crash at any point leaves
+// the new or the previous meta whole. The caller must hold the epochLock of the
+// partition once it is created.
+func (dp *dataPartition) storeMeta() (err error) {
+	meta := *dp.meta
+	meta.Version++
+	meta.Hosts = dp.replicaHosts
+	meta.WarmHosts = dp.warmHosts
+	meta.Status = dp.partitionStatus
+	var metaData []byte
+	if metaData, err = meta.marshal(); err != nil {
+		return
+	}
+	tmpFilePath := path.Join(dp.Path(), "."+DataPartitionMetaFileName)
+	if err = writeFileSync(tmpFilePath, metaData); err != nil {
+		return
+	}
+	filePath := path.Join(dp.Path(), DataPartitionMetaFileName)
+	bakFilePath := path.Join(dp.Path(), DataPartitionMetaBakName)
+	if err = os.Remove(bakFilePath); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	if err = os.Link(filePath, bakFilePath); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	if err = os.Rename(tmpFilePath, filePath); err != nil {
 		return
 	}
-	if _, err = metaFile.Write(metaData); err != nil {
+	if err = syncDir(dp.Path()); err != nil {
 		return
 	}
+	*dp.meta = meta
 	return
 }
 
+func writeFileSync(filename string, data []byte) (err error) {
+	var f *os.File
+	if f, err = os.OpenFile(filename, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666); err != nil {
+		return
+	}
+	defer f.Close()
+	if _, err = f.Write(data); err != nil {
+		return
+	}
+	return f.Sync()
+}
+
+func syncDir(dir string) (err error) {
+	var f *os.File
+	if f, err = os.Open(dir); err != nil {
+		return
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
 // LoadDataPartition load and returns partition instance from specified directory.
 // This method will read the partition meta file stored under the specified directory
 // and create partition instance.
 func LoadDataPartition(partitionDir string, disk *Disk) (dp DataPartition, err error) {
 	var (
-		metaFileData []byte
+		meta      *dataPartitionMeta
+		recovered bool
 	)
-	if metaFileData, err = ioutil.ReadFile(path.Join(partitionDir, DataPartitionMetaFileName)); err != nil {
+	if meta, recovered, err = loadDataPartitionMeta(partitionDir); err != nil {
 		return
 	}
-	meta := &dataPartitionMeta{}
-	if err = json.Unmarshal(metaFileData, meta); err != nil {
+	if dp, err = newDataPartition(meta.VolumeId, meta.PartitionId, disk, meta.PartitionSize, true); err != nil {
 		return
 	}
-	if err = meta.Validate(); err != nil {
+	partition := dp.(*dataPartition)
+	partition.meta = meta
+	if meta.Sealed {
+		atomic.StoreInt32(&partition.isSealed, 1)
+	}
+	// the hosts until the master is reached, the status until it is computed again
+	if len(meta.Hosts) != 0 {
+		partition.replicaHosts = meta.Hosts
+		partition.warmHosts = meta.WarmHosts
+	}
+	partition.ChangeStatus(meta.Status)
+	if err = partition.loadECStore(); err != nil {
 		return
 	}
-	dp, err = newDataPartition(meta.VolumeId, meta.PartitionId, disk, meta.PartitionSize)
+	if recovered {
+		log.LogWarnf("action[LoadDataPartition] partition(%v) meta recovered from %v version(%v).",
+			meta.PartitionId, DataPartitionMetaBakName, meta.Version)
+		partition.epochLock.Lock()
+		err = partition.storeMeta()
+		partition.epochLock.Unlock()
+	}
 	return
 }
 
-func newDataPartition(volumeId string, partitionId uint32, disk *Disk, size int) (dp DataPartition, err error) {
+func newDataPartition(volumeId string, partitionId uint32, disk *Disk, size int, isLoad bool) (dp DataPartition, err error) {
 	partition := &dataPartition{
 		volumeId:        volumeId,
 		partitionId:     partitionId,
 		disk:            disk,
-		path:            path.Join(disk.Path, fmt.Sprintf(DataPartitionPrefix+"_%v_%v", partitionId, size)),
+		path:            disk.partitionDir(fmt.Sprintf(DataPartitionPrefix+"_%v_%v", partitionId, size)),
 		partitionSize:   size,
 		replicaHosts:    make([]string, 0),
 		stopC:           make(chan bool, 0),
 		partitionStatus: proto.ReadWrite,
 		runtimeMetrics:  NewDataPartitionMetrics(),
+		extentRefs:      newExtentReferences(),
+		// the stores count their files at the load, the first reconciles of
+		// the partitions are spread over the interval
+		usageReconciled: time.Now().Add(-time.Duration(rand.Int63n(int64(gStatusIntervals.Intervals().UsageReconcile)))),
 	}
-	partition.extentStore, err = storage.NewExtentStore(partition.path, size)
+	partition.extentStore, err = storage.NewExtentStoreWithIO(partition.path, size, disk.io)
 	if err != nil {
 		return
 	}
@@ -185,10 +387,21 @@ func newDataPartition(volumeId string, partitionId uint32, disk *Disk, size int)
 	if err != nil {
 		return
 	}
+	if coldTierTarget != "" {
+		partition.extentStore.SetColdTier(newHTTPColdTier(coldTierTarget, coldTierCluster, partition), coldTierRecall)
+	}
+	if isLoad {
+		if err = partition.checkConsistency(); err != nil {
+			return
+		}
+	}
 	disk.AttachDataPartition(partition)
 	dp = partition
 	go partition.statusUpdateScheduler()
 	go partition.lauchBlobRepair()
+	if coldTierTarget != "" {
+		go partition.coldTierScheduler()
+	}
 	return
 }
 
@@ -196,12 +409,19 @@ func (dp *dataPartition) ID() uint32 {
 	return dp.partitionId
 }
 
+func (dp *dataPartition) Volume() string {
+	return dp.volumeId
+}
+
 func (dp *dataPartition) Path() string {
 	return dp.path
 }
 
 func (dp *dataPartition) IsLeader() bool {
-	return dp.isLeader
+	if dp.isRaftReplicated() {
+		return dp.isRaftLeader()
+	}
+	return dp.hasLeaderLease()
 }
 
 func (dp *dataPartition) ReplicaHosts() []string {
@@ -212,14 +432,21 @@ func (dp *dataPartition) Stop() {
 	if dp.stopC != nil {
 		close(dp.stopC)
 	}
+	dp.stopRaft()
 	// Close all store and backup partition data file.
 	dp.extentStore.Close()
 	dp.blobStore.CloseAll()
+	dp.closeECStore()
 
 }
 
 func (dp *dataPartition) FlushDelete() (err error) {
-	err = dp.extentStore.FlushDelete()
+	if err = dp.extentStore.FlushDelete(); err != nil {
+		return
+	}
+	if store := dp.getECStore(); store != nil {
+		err = store.FlushDelete()
+	}
 	return
 }
 
@@ -243,6 +470,12 @@ func (dp *dataPartition) Available() int {
 	return dp.partitionSize - dp.used
 }
 
+// Reclaimable returns the bytes which are expected to be released by delete flush,
+// blob compaction and hole punching.
+func (dp *dataPartition) Reclaimable() int {
+	return dp.reclaimable
+}
+
 func (dp *dataPartition) ChangeStatus(status int) {
 	switch status {
 	case proto.ReadOnly, proto.ReadWrite, proto.Unavaliable:
@@ -251,17 +484,21 @@ func (dp *dataPartition) ChangeStatus(status int) {
 }
 
 func (dp *dataPartition) statusUpdateScheduler() {
-	ticker := time.NewTicker(10 * time.Second)
-	metricTicker := time.NewTicker(2 * time.Second)
+	intervals := gStatusIntervals.Intervals()
+	timer := time.NewTimer(intervals.StatusUpdate)
+	metricTimer := time.NewTimer(intervals.MetricsUpdate)
 	for {
 		select {
-		case <-ticker.C:
+		case <-timer.C:
 			dp.statusUpdate()
+			timer.Reset(gStatusIntervals.Intervals().StatusUpdate)
 		case <-dp.stopC:
-			ticker.Stop()
+			timer.Stop()
+			metricTimer.Stop()
 			return
-		case <-metricTicker.C:
+		case <-metricTimer.C:
 			dp.runtimeMetrics.recomputLatency()
+			metricTimer.Reset(gStatusIntervals.Intervals().MetricsUpdate)
 		}
 	}
 }
@@ -269,28 +506,133 @@ func (dp *dataPartition) statusUpdateScheduler() {
 func (dp *dataPartition) statusUpdate() {
 	status := proto.ReadWrite
 	dp.computeUsage()
-	if dp.used >= dp.partitionSize {
+	if dp.used >= dp.partitionSize || atomic.LoadInt32(&dp.isSealed) == 1 {
 		status = proto.ReadOnly
 	}
-	if dp.isLeader {
+	if dp.isRaftApplyFailed() {
+		status = proto.Unavaliable
+	}
+	if dp.IsLeader() {
 		dp.blobStore.MoveBlobFileToUnavailChan()
 	}
 	dp.partitionStatus = int(math.Min(float64(status), float64(dp.disk.Status)))
 }
 
+// computeUsage takes the used size kept by the stores on the writes and the
+// deletes, the holes punched in the extents don't consume disk space.
 func (dp *dataPartition) computeUsage() {
+	if time.Since(dp.usageReconciled) >= gStatusIntervals.Intervals().UsageReconcile {
+		dp.reconcileUsage()
+	}
+	dp.used = int(dp.extentStore.UsedSize() + dp.blobStore.UseSize())
+	dp.reclaimable = int(dp.extentStore.ReclaimableSize() + dp.blobStore.ReclaimableSize())
+	if store := dp.getECStore(); store != nil {
+		dp.used += int(store.UsedSize())
+		dp.reclaimable += int(store.ReclaimableSize())
+	}
+}
+
+func (dp *dataPartition) reconcileUsage() {
+	extentDrift, err := dp.extentStore.ReconcileUsedSize()
+	if err != nil {
+		log.LogWarnf("action[reconcileUsage] partition(%v) scan extents: %v", dp.partitionId, err)
+		return
+	}
+	blobDrift := dp.blobStore.ReconcileUsedSize()
+	dp.usageReconciled = time.Now()
+	if extentDrift != 0 || blobDrift != 0 {
+		log.LogInfof("action[reconcileUsage] partition(%v) used size drift extent(%v) blob(%v).",
+			dp.partitionId, extentDrift, blobDrift)
+	}
+}
+
+// checkConsistency verifies extents and blob files after restart. Ranges which
+// fail the check are quarantined and reported to master until they are repaired.
+func (dp *dataPartition) checkConsistency() (err error) {
 	var (
-		used  int64
-		files []os.FileInfo
-		err   error
+		extentRanges []*proto.QuarantinedRange
+		blobRanges   []*proto.QuarantinedRange
 	)
-	if files, err = ioutil.ReadDir(dp.path); err != nil {
+	if extentRanges, err = dp.extentStore.VerifyExtents(); err != nil {
+		err = errors.Annotatef(err, "checkConsistency partition(%v) verify extents", dp.partitionId)
+		return
+	}
+	if blobRanges, err = dp.blobStore.VerifyBlobFiles(); err != nil {
+		err = errors.Annotatef(err, "checkConsistency partition(%v) verify blob files", dp.partitionId)
+		return
+	}
+	for _, qr := range append(extentRanges, blobRanges...) {
+		log.LogWarnf("action[checkConsistency] partition(%v) quarantine file(%v) range(%v-%v) reason(%v).",
+			dp.partitionId, qr.FileId, qr.Start, qr.End, qr.Reason)
+	}
+	return
+}
+
+// Quarantined returns all ranges of this partition which are waiting for repair.
+func (dp *dataPartition) Quarantined() (ranges []*proto.QuarantinedRange) {
+	ranges = dp.extentStore.GetQuarantined()
+	ranges = append(ranges, dp.blobStore.GetQuarantined()...)
+	dp.scrubLock.Lock()
+	ranges = append(ranges, dp.corruptObjects...)
+	dp.scrubLock.Unlock()
+	return
+}
+
+func (dp *dataPartition) Epoch() uint64 {
+	dp.epochLock.Lock()
+	defer dp.epochLock.Unlock()
+	return dp.meta.Epoch
+}
+
+// UpdateEpoch advance the membership epoch of partition, older epoch is ignored.
+func (dp *dataPartition) UpdateEpoch(epoch uint64) {
+	dp.epochLock.Lock()
+	defer dp.epochLock.Unlock()
+	if epoch <= dp.meta.Epoch {
+		return
+	}
+	log.LogInfof("action[UpdateEpoch] partition(%v) epoch from(%v) to(%v).", dp.partitionId, dp.meta.Epoch, epoch)
+	dp.meta.Epoch = epoch
+	if err := dp.storeMeta(); err != nil {
+		log.LogErrorf("action[UpdateEpoch] partition(%v) store meta err(%v).", dp.partitionId, err)
+	}
+}
+
+// renewLeaderLease lets the node lead the partition at epoch until expire,
+// the lease of an epoch older than the partition is ignored.
+func (dp *dataPartition) renewLeaderLease(epoch uint64, expire time.Time) {
+	dp.UpdateEpoch(epoch)
+	dp.epochLock.Lock()
+	defer dp.epochLock.Unlock()
+	if epoch != dp.meta.Epoch {
 		return
 	}
-	for _, file := range files {
-		used += file.Size()
+	dp.leaseEpoch = epoch
+	dp.leaseExpire = expire
+}
+
+/*the epoch and the expire time of the last leader lease of the partition*/
+func (dp *dataPartition) leaderLease() (epoch uint64, expire time.Time) {
+	dp.epochLock.Lock()
+	defer dp.epochLock.Unlock()
+	return dp.leaseEpoch, dp.leaseExpire
+}
+
+/*true if the node holds the leader lease of the partition at its current epoch*/
+func (dp *dataPartition) hasLeaderLease() bool {
+	dp.epochLock.Lock()
+	defer dp.epochLock.Unlock()
+	return dp.leaseEpoch == dp.meta.Epoch && time.Now().Before(dp.leaseExpire)
+}
+
+// CheckEpoch reject the request carrying an epoch older than the partition,
+// a newer epoch means the membership changed, the partition catch up with it.
+func (dp *dataPartition) CheckEpoch(epoch uint64) (err error) {
+	if current := dp.Epoch(); epoch < current {
+		return errors.Annotatef(ErrStaleEpoch, "partition(%v) epoch(%v) request epoch(%v)", dp.partitionId, current, epoch)
 	}
-	dp.used = int(used)
+	dp.UpdateEpoch(epoch)
+	return
 }
 
 func (dp *dataPartition) GetExtentStore() *storage.ExtentStore {
@@ -318,25 +660,85 @@ func (dp *dataPartition) LaunchRepair() {
 		log.LogErrorf("action[LaunchRepair] err(%v).", err)
 		return
 	}
-	if !dp.isLeader {
+	// every replica fetches its own corrupt blocks, the leader included
+	dp.repairCorruptBlocks()
+	if !dp.IsLeader() {
+		return
+	}
+	// the replicas of a raft replicated partition apply the same log, a replica
+	// behind is caught up by the log or a snapshot of the leader
+	if dp.isRaftReplicated() {
+		return
+	}
+	// a repair is also launched at once by a corrupt read, never run two at a time
+	if !atomic.CompareAndSwapInt32(&dp.isRepairing, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&dp.isRepairing, 0)
+	// every host keeps a different shard of an erasure coded partition, a lost
+	// shard is rebuilt by decoding the others instead of copying the leader
+	if dp.isErasureCode() {
+		dp.repairECShards()
 		return
 	}
 	dp.extentFileRepair()
 }
 
+// updateReplicaHosts gets the hosts from the master unless the batched refresh
+// of the node got them during the last interval. While the master can't be
+// reached the hosts got last, or stored in the meta before a restart, stay in
+// use, they are at the epoch of the partition so the followers still refuse
+// the packets of an older membership.
 func (dp *dataPartition) updateReplicaHosts() (err error) {
-	dp.isLeader = false
-	isLeader, replicas, err := dp.fetchReplicaHosts()
+	if time.Now().UnixNano()-atomic.LoadInt64(&dp.hostsRefreshed) < int64(ReplicaHostsRefreshInterval) {
+		return
+	}
+	if err = dp.loadReplicaHosts(); err != nil && len(dp.replicaHosts) != 0 {
+		log.LogWarnf("action[updateReplicaHosts] partition(%v) keeps hosts(%v) epoch(%v), err(%v).",
+			dp.partitionId, dp.replicaHosts, dp.Epoch(), err)
+		return nil
+	}
+	return
+}
+
+func (dp *dataPartition) loadReplicaHosts() (err error) {
+	replicas, warmHosts, epoch, err := dp.fetchReplicaHosts()
 	if err != nil {
 		return
 	}
+	dp.applyReplicaHosts(replicas, warmHosts, epoch, "")
+	return
+}
+
+// applyReplicaHosts takes the hosts of the master at epoch, the leader at the
+// head of the chain, in the order of the master if it named none.
+func (dp *dataPartition) applyReplicaHosts(replicas, warmHosts []string, epoch uint64, leader string) (applied bool) {
+	// a master serving the query as a follower may be behind the epoch got by a packet
+	if epoch < dp.Epoch() {
+		log.LogInfof("action[updateReplicaHosts] partition(%v) stale epoch(%v) ignored.", dp.partitionId, epoch)
+		return false
+	}
+	dp.UpdateEpoch(epoch)
+	replicas = dp.leaderFirst(replicas, leader)
 	if !dp.compareReplicaHosts(dp.replicaHosts, replicas) {
 		log.LogInfof("action[updateReplicaHosts] partition(%v) replicaHosts changed from (%v) to (%v).",
 			dp.partitionId, dp.replicaHosts, replicas)
 	}
-	dp.isLeader = isLeader
+	if !dp.compareReplicaHosts(dp.warmHosts, warmHosts) {
+		log.LogInfof("action[updateReplicaHosts] partition(%v) warmHosts changed from (%v) to (%v).",
+			dp.partitionId, dp.warmHosts, warmHosts)
+	}
+	changed := !dp.compareReplicaHosts(dp.replicaHosts, replicas) || !dp.compareReplicaHosts(dp.warmHosts, warmHosts)
 	dp.replicaHosts = replicas
-	return
+	dp.warmHosts = warmHosts
+	if changed {
+		dp.epochLock.Lock()
+		if err := dp.storeMeta(); err != nil {
+			log.LogErrorf("action[updateReplicaHosts] partition(%v) store meta err(%v).", dp.partitionId, err)
+		}
+		dp.epochLock.Unlock()
+	}
+	return true
 }
 
 func (dp *dataPartition) compareReplicaHosts(v1, v2 []string) (equals bool) {
@@ -356,33 +758,29 @@ func (dp *dataPartition) compareReplicaHosts(v1, v2 []string) (equals bool) {
 	return
 }
 
-func (dp *dataPartition) fetchReplicaHosts() (isLeader bool, replicaHosts []string, err error) {
+func (dp *dataPartition) fetchReplicaHosts() (replicaHosts, warmHosts []string, epoch uint64, err error) {
 	var (
 		HostsBuf []byte
 	)
 	params := make(map[string]string)
 	params["id"] = strconv.Itoa(int(dp.partitionId))
-	if HostsBuf, err = MasterHelper.Request("GET", AdminGetDataPartition, params, nil); err != nil {
-		isLeader = false
+	if HostsBuf, err = MasterHelper.ReadRequest("GET", AdminGetDataPartition, params, nil); err != nil {
 		return
 	}
 	response := &master.DataPartition{}
 	replicaHosts = make([]string, 0)
 	if err = json.Unmarshal(HostsBuf, &response); err != nil {
-		isLeader = false
 		replicaHosts = nil
 		return
 	}
 	for _, host := range response.PersistenceHosts {
 		replicaHosts = append(replicaHosts, host)
 	}
-	if response.PersistenceHosts != nil && len(response.PersistenceHosts) >= 1 {
-		leaderAddr := response.PersistenceHosts[0]
-		leaderAddrParts := strings.Split(leaderAddr, ":")
-		if len(leaderAddrParts) == 2 && strings.TrimSpace(leaderAddrParts[0]) == LocalIP {
-			isLeader = true
-		}
+	warmHosts = make([]string, 0, len(response.WarmHosts))
+	for _, host := range response.WarmHosts {
+		warmHosts = append(warmHosts, host)
 	}
+	epoch = response.Epoch
 	return
 }
 
@@ -396,12 +794,14 @@ func (dp *dataPartition) Load() (response *proto.LoadDataPartitionResponse) {
 	if err != nil {
 		response.Status = proto.TaskFail
 		response.Result = err.Error()
+		response.ErrCode = errCodeOf(response.Result)
 		return
 	}
 	blobSnapshot, err := dp.blobStore.Snapshot()
 	if err != nil {
 		response.Status = proto.TaskFail
 		response.Result = err.Error()
+		response.ErrCode = errCodeOf(response.Result)
 		return
 	}
 	response.PartitionSnapshot = append(response.PartitionSnapshot, blobSnapshot...)
@@ -435,7 +835,8 @@ func (dp *dataPartition) PackObject(dataBuf []byte, o *storage.Object, blobfileI
 	if o.Size == storage.MarkDeleteObject && o.Oid != 0 {
 		return
 	}
-	_, err = dp.blobStore.Read(blobfileID, int64(o.Oid), int64(o.Size), dataBuf[storage.ObjectHeaderSize:])
+	// the object is sent as stored, compressed by the codec in its header
+	_, err = dp.blobStore.ReadStored(blobfileID, int64(o.Oid), int64(o.Size), dataBuf[storage.ObjectHeaderSize:])
 	return
 }
 
@@ -464,7 +865,8 @@ func (dp *dataPartition) MergeExtentStoreRepair(metas *MembersFileMetas) {
 		if deleteExtentId.FileId <= storage.BlobFileFileCount {
 			continue
 		}
-		extentStore.MarkDelete(uint64(deleteExtentId.FileId))
+		// the leader deleted the extent with its last reference
+		extentStore.ForceMarkDelete(uint64(deleteExtentId.FileId))
 	}
 	for _, addExtent := range metas.NeedAddExtentsTasks {
 		if addExtent.FileId <= storage.BlobFileFileCount {
@@ -477,10 +879,17 @@ func (dp *dataPartition) MergeExtentStoreRepair(metas *MembersFileMetas) {
 		if err != nil {
 			continue
 		}
+		extentStore.SetRefs(uint64(addExtent.FileId), addExtent.Refs)
 		fixFileSizeTask := &storage.FileInfo{Source: addExtent.Source, FileId: addExtent.FileId, Size: addExtent.Size}
 		metas.NeedFixExtentSizeTasks = append(metas.NeedFixExtentSizeTasks, fixFileSizeTask)
 	}
 
+	for _, fixRefs := range metas.NeedFixExtentRefsTasks {
+		if err := extentStore.SetRefs(uint64(fixRefs.FileId), fixRefs.Refs); err != nil {
+			log.LogWarnf("action[MergeExtentStoreRepair] partition(%v) fixRefs(%v) err(%v).", dp.partitionId, fixRefs, err)
+		}
+	}
+
 	var wg sync.WaitGroup
 	for _, fixExtent := range metas.NeedFixExtentSizeTasks {
 		if fixExtent.FileId <= storage.BlobFileFileCount {
@@ -490,9 +899,13 @@ func (dp *dataPartition) MergeExtentStoreRepair(metas *MembersFileMetas) {
 			continue
 		}
 		wg.Add(1)
+		dp.runtimeMetrics.BeginRepair()
 		go dp.doStreamExtentFixRepair(&wg, fixExtent)
 	}
 	wg.Wait()
+	if len(metas.NeedAddExtentsTasks) != 0 || len(metas.NeedFixExtentSizeTasks) != 0 {
+		dp.resealAfterRepair()
+	}
 }
 
 func (dp *dataPartition) MergeBlobStoreRepair(metas *MembersFileMetas) {
@@ -504,6 +917,7 @@ func (dp *dataPartition) MergeBlobStoreRepair(metas *MembersFileMetas) {
 		wg.Add(1)
 		log.LogWarnf("%v recive repair task(%v)",
 			dp.getBlobRepairLogKey(fixBlobFiles.FileId), fixBlobFiles.String())
+		dp.runtimeMetrics.BeginRepair()
 		go dp.doStreamBlobFixRepair(&wg, fixBlobFiles)
 	}
 
@@ -0,0 +1,407 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	ArchivedPartitionPrefix  = "archived_"
+	RehydratePartitionPrefix = ".rehydrate_"
+	ArchiveManifestName      = "MANIFEST"
+	ArchiveRequestTimeout    = 30 * time.Minute
+	SealWaitWritesSeconds    = 30
+)
+
+// the files of a partition exported to the archive target, the manifest is put
+// after all the files so a partition with a manifest is exported completely
+type archiveManifest struct {
+	VolumeId      string
+	PartitionId   uint32
+	PartitionSize int
+	Files         []*archiveFile
+}
+
+type archiveFile struct {
+	Name string
+	Size int64
+}
+
+var (
+	archiveClient       = &http.Client{Timeout: ArchiveRequestTimeout}
+	archivingPartitions sync.Map //partitions with an archive or rehydrate in progress
+)
+
+// Handle OpArchiveDataPartition packet.
+func (s *DataNode) handleArchiveDataPartition(pkg *Packet) {
+	task := &proto.AdminTask{}
+	json.Unmarshal(pkg.Data, task)
+	pkg.PackOkReply()
+	s.taskEngine.Submit(task, s.archiveDataPartition)
+}
+
+func (s *DataNode) archiveDataPartition(task *proto.AdminTask) (resp interface{}, status int8) {
+	var err error
+	request := &proto.ArchiveDataPartitionRequest{}
+	response := &proto.ArchiveDataPartitionResponse{}
+	if task.OpCode == proto.OpArchiveDataPartition {
+		data, _ := json.Marshal(task.Request)
+		if err = json.Unmarshal(data, request); err == nil {
+			err = s.archivePartition(request)
+		}
+	} else {
+		err = ErrorUnknownOp
+	}
+	response.PartitionId = request.PartitionId
+	if err != nil {
+		response.Status = proto.TaskFail
+		response.Result = err.Error()
+		response.ErrCode = errCodeOf(response.Result)
+		log.LogErrorf("action[archiveDataPartition] from master Task(%v) failed, err(%v)", task.ToString(), err)
+	} else {
+		response.Status = proto.TaskSuccess
+	}
+	return response, int8(response.Status)
+}
+
+/*seal and flush the partition, export it if asked, then detach it from the node*/
+func (s *DataNode) archivePartition(request *proto.ArchiveDataPartitionRequest) (err error) {
+	partitionId := uint32(request.PartitionId)
+	if _, ok := archivingPartitions.LoadOrStore(partitionId, true); ok {
+		return fmt.Errorf("dataPartition(%v) archive or rehydrate in progress", partitionId)
+	}
+	defer archivingPartitions.Delete(partitionId)
+	dp := s.space.GetPartition(partitionId)
+	if dp == nil {
+		// detached by an archive before, the export is done if its manifest is on the target
+		if request.Export {
+			_, err = getArchiveManifest(request.Target, partitionId)
+		}
+		return
+	}
+	partition := dp.(*dataPartition)
+	if err = partition.seal(); err != nil {
+		return
+	}
+	// the archive holds the data of the extents, not the objects in the cold tier
+	if err = partition.extentStore.RecallExtents(); err != nil {
+		return errors.Annotatef(err, "dataPartition(%v) recall tiered extents", partitionId)
+	}
+	// the files are exported once the stores are closed, nothing changes them after
+	s.space.DetachPartition(partitionId)
+	if request.Export {
+		if err = exportPartition(partition.Path(), request.Target, partition.meta); err != nil {
+			s.reattachPartition(partition.Path(), partition.Disk())
+			return
+		}
+	}
+	if request.Target != "" {
+		err = partition.Disk().removePartitionDir(partition.Path())
+	} else if err = os.Rename(partition.Path(), path.Join(partition.Disk().Path, ArchivedPartitionPrefix+path.Base(partition.Path()))); err == nil {
+		partition.Disk().removeEmptyParents(partition.Path())
+	}
+	log.LogWarnf("action[archivePartition] dataPartition(%v) archived, target(%v) export(%v) err(%v)",
+		partitionId, request.Target, request.Export, err)
+	return
+}
+
+func (s *DataNode) reattachPartition(partitionDir string, disk *Disk) (dp DataPartition, err error) {
+	if dp, err = LoadDataPartition(partitionDir, disk); err != nil {
+		log.LogErrorf("action[reattachPartition] load partition(%v) err(%v)", partitionDir, err)
+		return
+	}
+	s.space.AttachPartition(dp)
+	s.startPartitionRaft(dp)
+	return
+}
+
+// seal refuses the writes to the partition and flushes its written data to disk.
+func (dp *dataPartition) seal() (err error) {
+	atomic.StoreInt32(&dp.isSealed, 1)
+	dp.ChangeStatus(proto.ReadOnly)
+	for i := 0; i < SealWaitWritesSeconds && atomic.LoadInt64(&dp.runtimeMetrics.inflightWrites) > 0; i++ {
+		time.Sleep(time.Second)
+	}
+	if inflight := atomic.LoadInt64(&dp.runtimeMetrics.inflightWrites); inflight > 0 {
+		return fmt.Errorf("dataPartition(%v) %v writes in progress after sealed", dp.partitionId, inflight)
+	}
+	extents, err := dp.extentStore.GetAllWatermark(nil)
+	if err != nil {
+		return
+	}
+	for _, extent := range extents {
+		if extent.Deleted {
+			continue
+		}
+		if err = dp.extentStore.Sync(uint64(extent.FileId)); err != nil {
+			return errors.Annotatef(err, "dataPartition(%v) sync extent(%v)", dp.partitionId, extent.FileId)
+		}
+	}
+	dp.blobStore.SyncAll()
+	return
+}
+
+func (dp *dataPartition) unseal() {
+	// a partition sealed by the master stays sealed after an archive is aborted
+	if !dp.IsSealed() {
+		atomic.StoreInt32(&dp.isSealed, 0)
+	}
+}
+
+// Handle OpRehydrateDataPartition packet.
+func (s *DataNode) handleRehydrateDataPartition(pkg *Packet) {
+	task := &proto.AdminTask{}
+	json.Unmarshal(pkg.Data, task)
+	pkg.PackOkReply()
+	s.taskEngine.Submit(task, s.rehydrateDataPartition)
+}
+
+func (s *DataNode) rehydrateDataPartition(task *proto.AdminTask) (resp interface{}, status int8) {
+	var err error
+	request := &proto.RehydrateDataPartitionRequest{}
+	response := &proto.RehydrateDataPartitionResponse{}
+	if task.OpCode == proto.OpRehydrateDataPartition {
+		data, _ := json.Marshal(task.Request)
+		if err = json.Unmarshal(data, request); err == nil {
+			err = s.rehydratePartition(request)
+		}
+	} else {
+		err = ErrorUnknownOp
+	}
+	response.PartitionId = request.PartitionId
+	if err != nil {
+		response.Status = proto.TaskFail
+		response.Result = err.Error()
+		response.ErrCode = errCodeOf(response.Result)
+		log.LogErrorf("action[rehydrateDataPartition] from master Task(%v) failed, err(%v)", task.ToString(), err)
+	} else {
+		response.Status = proto.TaskSuccess
+	}
+	return response, int8(response.Status)
+}
+
+/*attach the archived partition from the files kept on the node or imported from the target*/
+func (s *DataNode) rehydratePartition(request *proto.RehydrateDataPartitionRequest) (err error) {
+	partitionId := uint32(request.PartitionId)
+	if _, ok := archivingPartitions.LoadOrStore(partitionId, true); ok {
+		return fmt.Errorf("dataPartition(%v) archive or rehydrate in progress", partitionId)
+	}
+	defer archivingPartitions.Delete(partitionId)
+	// a partition not detached yet is kept, the archive in progress is aborted
+	if dp := s.space.GetPartition(partitionId); dp != nil {
+		dp.(*dataPartition).unseal()
+		dp.UpdateEpoch(request.Epoch)
+		return
+	}
+	disk, archivedDir := s.findArchivedPartition(partitionId)
+	if archivedDir == "" {
+		if request.Target == "" {
+			return fmt.Errorf("dataPartition(%v) archive not found", partitionId)
+		}
+		if disk, archivedDir, err = s.importPartition(request.Target, partitionId); err != nil {
+			return
+		}
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(path.Base(archivedDir), ArchivedPartitionPrefix), RehydratePartitionPrefix)
+	partitionDir := disk.partitionDir(name)
+	if err = os.MkdirAll(path.Dir(partitionDir), 0755); err != nil {
+		return
+	}
+	if err = os.Rename(archivedDir, partitionDir); err != nil {
+		return
+	}
+	var dp DataPartition
+	if dp, err = s.reattachPartition(partitionDir, disk); err != nil {
+		return
+	}
+	dp.UpdateEpoch(request.Epoch)
+	log.LogWarnf("action[rehydratePartition] dataPartition(%v) rehydrated from(%v)", partitionId, archivedDir)
+	return
+}
+
+/*the dir of the partition archived with its files kept on the node*/
+func (s *DataNode) findArchivedPartition(partitionId uint32) (disk *Disk, dir string) {
+	prefix := fmt.Sprintf(ArchivedPartitionPrefix+DataPartitionPrefix+"_%v_", partitionId)
+	for _, d := range s.space.GetDisks() {
+		fileInfoList, err := ioutil.ReadDir(d.Path)
+		if err != nil {
+			continue
+		}
+		for _, fileInfo := range fileInfoList {
+			if fileInfo.IsDir() && strings.HasPrefix(fileInfo.Name(), prefix) {
+				return d, path.Join(d.Path, fileInfo.Name())
+			}
+		}
+	}
+	return
+}
+
+/*the disk with the fewest partitions and room for the partition*/
+func (s *DataNode) getImportDisk(size uint64) (disk *Disk) {
+	for _, d := range s.space.GetDisks() {
+		d.RLock()
+		ok := d.Status != proto.Unavaliable && d.Available >= size
+		d.RUnlock()
+		if ok && (disk == nil || d.PartitionCount() < disk.PartitionCount()) {
+			disk = d
+		}
+	}
+	return
+}
+
+/*download the files of the partition from the target to a temp dir of a disk*/
+func (s *DataNode) importPartition(target string, partitionId uint32) (disk *Disk, dir string, err error) {
+	var manifest *archiveManifest
+	if manifest, err = getArchiveManifest(target, partitionId); err != nil {
+		return
+	}
+	var total uint64
+	for _, f := range manifest.Files {
+		total += uint64(f.Size)
+	}
+	if disk = s.getImportDisk(total); disk == nil {
+		err = ErrNoDiskForCreatePartition
+		return
+	}
+	dir = path.Join(disk.Path, fmt.Sprintf(RehydratePartitionPrefix+DataPartitionPrefix+"_%v_%v", partitionId, manifest.PartitionSize))
+	os.RemoveAll(dir)
+	for _, f := range manifest.Files {
+		if err = getArchiveFile(archiveObjectURL(target, partitionId, f.Name), path.Join(dir, filepath.ToSlash(f.Name)), f.Size); err != nil {
+			os.RemoveAll(dir)
+			return
+		}
+	}
+	return
+}
+
+func archiveObjectURL(target string, partitionId uint32, name string) string {
+	return strings.TrimSuffix(target, "/") + "/" + strconv.FormatUint(uint64(partitionId), 10) + "/" + filepath.ToSlash(name)
+}
+
+/*put the files of the partition dir and then its manifest to the target*/
+func exportPartition(partitionDir, target string, meta *dataPartitionMeta) (err error) {
+	manifest := &archiveManifest{VolumeId: meta.VolumeId, PartitionId: meta.PartitionId, PartitionSize: meta.PartitionSize,
+		Files: make([]*archiveFile, 0)}
+	err = filepath.Walk(partitionDir, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(partitionDir, name)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err = putArchiveObject(archiveObjectURL(target, meta.PartitionId, rel), f, info.Size()); err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, &archiveFile{Name: rel, Size: info.Size()})
+		return nil
+	})
+	if err != nil {
+		return errors.Annotatef(err, "export dataPartition(%v) to %v", meta.PartitionId, target)
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return
+	}
+	return putArchiveObject(archiveObjectURL(target, meta.PartitionId, ArchiveManifestName), bytes.NewReader(data), int64(len(data)))
+}
+
+func getArchiveManifest(target string, partitionId uint32) (manifest *archiveManifest, err error) {
+	var resp *http.Response
+	if resp, err = archiveClient.Get(archiveObjectURL(target, partitionId, ArchiveManifestName)); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get manifest of dataPartition(%v) from %v status(%v)", partitionId, target, resp.Status)
+	}
+	manifest = new(archiveManifest)
+	if err = json.NewDecoder(resp.Body).Decode(manifest); err != nil {
+		return nil, errors.Annotatef(err, "decode manifest of dataPartition(%v)", partitionId)
+	}
+	return
+}
+
+func putArchiveObject(url string, body io.Reader, size int64) (err error) {
+	var (
+		req  *http.Request
+		resp *http.Response
+	)
+	if req, err = http.NewRequest(http.MethodPut, url, body); err != nil {
+		return
+	}
+	req.ContentLength = size
+	if resp, err = archiveClient.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("put %v status(%v)", url, resp.Status)
+	}
+	return
+}
+
+func getArchiveFile(url, name string, size int64) (err error) {
+	var (
+		resp *http.Response
+		f    *os.File
+		n    int64
+	)
+	if err = os.MkdirAll(path.Dir(name), 0755); err != nil {
+		return
+	}
+	if resp, err = archiveClient.Get(url); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("get %v status(%v)", url, resp.Status)
+	}
+	if f, err = os.Create(name); err != nil {
+		return
+	}
+	defer f.Close()
+	if n, err = io.Copy(f, resp.Body); err != nil {
+		return
+	}
+	if n != size {
+		return fmt.Errorf("get %v size(%v) expect(%v)", url, n, size)
+	}
+	return f.Sync()
+}
@@ -0,0 +1,131 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"encoding/json"
+	"sync/atomic"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+var (
+	ErrRepairNotLeader    = errors.New("not the leader of dataPartition")
+	ErrRepairInProgress   = errors.New("repair of dataPartition in progress")
+	ErrRepairNotSupported = errors.New("dataPartition not repaired from the leader")
+)
+
+// The master asks for a repair or a verify of a partition at once, instead of
+// waiting for the periodic repair or the scrub. Both run in the task engine and
+// are answered to the master when they finished, the repair by the leader and
+// the verify by every replica.
+
+// Handle OpRepairDataPartition packet.
+func (s *DataNode) handleRepairDataPartition(pkg *Packet) {
+	task := &proto.AdminTask{}
+	json.Unmarshal(pkg.Data, task)
+	pkg.PackOkReply()
+	s.taskEngine.Submit(task, s.repairDataPartition)
+}
+
+func (s *DataNode) repairDataPartition(task *proto.AdminTask) (resp interface{}, status int8) {
+	var err error
+	request := &proto.RepairDataPartitionRequest{}
+	response := &proto.RepairDataPartitionResponse{}
+	if task.OpCode == proto.OpRepairDataPartition {
+		data, _ := json.Marshal(task.Request)
+		if err = json.Unmarshal(data, request); err == nil {
+			if dp, ok := s.space.GetPartition(uint32(request.PartitionId)).(*dataPartition); ok {
+				err = dp.repairNow()
+			} else {
+				err = ErrPartitionNotExist
+			}
+		}
+	} else {
+		err = ErrorUnknownOp
+	}
+	response.PartitionId = request.PartitionId
+	if err != nil {
+		response.Status = proto.TaskFail
+		response.Result = err.Error()
+		response.ErrCode = errCodeOf(response.Result)
+		log.LogErrorf("action[repairDataPartition] from master Task(%v) failed, err(%v)", task.ToString(), err)
+	} else {
+		response.Status = proto.TaskSuccess
+	}
+	return response, int8(response.Status)
+}
+
+// repairNow runs the extent repair of LaunchRepair at once, the error tells why
+// the replica didn't repair the partition. The blob files are repaired by the
+// leader every 20 seconds anyway.
+func (dp *dataPartition) repairNow() (err error) {
+	if dp.isRaftReplicated() || dp.isErasureCode() {
+		return ErrRepairNotSupported
+	}
+	// the master asked for the repair, the hosts may have changed since the last refresh
+	if err = dp.loadReplicaHosts(); err != nil {
+		return
+	}
+	if !dp.IsLeader() {
+		return ErrRepairNotLeader
+	}
+	if !atomic.CompareAndSwapInt32(&dp.isRepairing, 0, 1) {
+		return ErrRepairInProgress
+	}
+	defer atomic.StoreInt32(&dp.isRepairing, 0)
+	dp.extentFileRepair()
+	return
+}
+
+// Handle OpVerifyDataPartition packet.
+func (s *DataNode) handleVerifyDataPartition(pkg *Packet) {
+	task := &proto.AdminTask{}
+	json.Unmarshal(pkg.Data, task)
+	pkg.PackOkReply()
+	s.taskEngine.Submit(task, s.verifyDataPartition)
+}
+
+func (s *DataNode) verifyDataPartition(task *proto.AdminTask) (resp interface{}, status int8) {
+	var err error
+	request := &proto.VerifyDataPartitionRequest{}
+	response := &proto.VerifyDataPartitionResponse{}
+	if task.OpCode == proto.OpVerifyDataPartition {
+		data, _ := json.Marshal(task.Request)
+		if err = json.Unmarshal(data, request); err == nil {
+			if dp, ok := s.space.GetPartition(uint32(request.PartitionId)).(*dataPartition); ok {
+				// paced like the scrub, the corrupt ranges are repaired as found by a scrub
+				dp.scrub(newScrubLimiter(scrubBandwidth).wait)
+				response.Quarantined = dp.Quarantined()
+			} else {
+				err = ErrPartitionNotExist
+			}
+		}
+	} else {
+		err = ErrorUnknownOp
+	}
+	response.PartitionId = request.PartitionId
+	if err != nil {
+		response.Status = proto.TaskFail
+		response.Result = err.Error()
+		response.ErrCode = errCodeOf(response.Result)
+		log.LogErrorf("action[verifyDataPartition] from master Task(%v) failed, err(%v)", task.ToString(), err)
+	} else {
+		response.Status = proto.TaskSuccess
+	}
+	return response, int8(response.Status)
+}
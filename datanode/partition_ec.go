@@ -0,0 +1,634 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/tiglabs/containerfs/master"
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/storage"
+	"github.com/tiglabs/containerfs/util"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+// A sealed extent partition of an erasure coded vol is encoded by the master in
+// steps: the shard hosts open the store of the shards, creating the partition if
+// they have no replica of it, the leader encodes every extent into the shards on
+// the shard hosts, and at the commit the shard hosts serve the extents from the
+// shards and drop the whole extents. The hosts keep serving the extents they
+// have whole until the commit, the shards are read if the extent is not.
+
+const (
+	ECShardHeaderSize = 20 //the size of the data, the inode and the refs of the extent, in the first write of a shard
+)
+
+var (
+	ErrECNotPrepared  = errors.New("erasure code shards not prepared")
+	ErrECShardHosts   = errors.New("erasure code shard hosts mismatch")
+	ErrECNotSealed    = errors.New("partition not sealed for the erasure code")
+	ErrECShardCorrupt = errors.New("erasure code shard crc mismatch")
+)
+
+func (dp *dataPartition) isErasureCode() bool {
+	dp.epochLock.Lock()
+	defer dp.epochLock.Unlock()
+	return dp.meta != nil && dp.meta.PartitionType == proto.ErasureCodePartition
+}
+
+/*the hosts of the shards by the shard index, nil unless the partition is encoded or being encoded*/
+func (dp *dataPartition) getShardHosts() (hosts []string) {
+	dp.epochLock.Lock()
+	defer dp.epochLock.Unlock()
+	if dp.meta == nil {
+		return nil
+	}
+	return append([]string{}, dp.meta.ShardHosts...)
+}
+
+func (dp *dataPartition) getECStore() *storage.ECStore {
+	dp.ecLock.RLock()
+	defer dp.ecLock.RUnlock()
+	return dp.ecStore
+}
+
+/*open the store of the shards kept by the node, an ec partition or one being encoded has one*/
+func (dp *dataPartition) openECStore() (store *storage.ECStore, err error) {
+	dp.ecLock.Lock()
+	defer dp.ecLock.Unlock()
+	if dp.ecStore == nil {
+		dp.ecStore, err = storage.NewECStore(path.Join(dp.path, storage.ECStoreDirName), dp.partitionSize, dp.disk.io)
+	}
+	return dp.ecStore, err
+}
+
+/*open the store of the shards at the load if the partition is encoded or was being encoded*/
+func (dp *dataPartition) loadECStore() (err error) {
+	if _, err = os.Stat(path.Join(dp.path, storage.ECStoreDirName)); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	if os.IsNotExist(err) && !dp.isErasureCode() {
+		return nil
+	}
+	_, err = dp.openECStore()
+	return
+}
+
+func (dp *dataPartition) closeECStore() {
+	dp.ecLock.Lock()
+	defer dp.ecLock.Unlock()
+	if dp.ecStore != nil {
+		dp.ecStore.Close()
+	}
+}
+
+/*the extent served from the shards, nil if the node has it whole or it is not encoded*/
+func (dp *dataPartition) ecExtentOf(extentId uint64) *proto.ECExtent {
+	store := dp.getECStore()
+	if store == nil {
+		return nil
+	}
+	if info, err := dp.extentStore.GetWatermark(extentId, false); err == nil && !info.Deleted {
+		return nil
+	}
+	return store.ECExtent(extentId)
+}
+
+/*the partition of the packet and the extent it asks if served from the shards*/
+func (p *Packet) ecExtent() (dp *dataPartition, extent *proto.ECExtent) {
+	if dp, _ = p.DataPartition.(*dataPartition); dp != nil {
+		extent = dp.ecExtentOf(p.FileID)
+	}
+	return
+}
+
+/*the store of the shards of the partition of the packet*/
+func (p *Packet) ecStore() *storage.ECStore {
+	if dp, ok := p.DataPartition.(*dataPartition); ok {
+		return dp.getECStore()
+	}
+	return nil
+}
+
+/*record the shard hosts and open the store of the shards, the extents are kept as they are*/
+func (dp *dataPartition) prepareShards(shardHosts []string) (err error) {
+	if len(shardHosts) != proto.ECDataShards+proto.ECParityShards {
+		return fmt.Errorf("%v: %v", ErrECShardHosts, shardHosts)
+	}
+	if !dp.IsSealed() {
+		if err = dp.sealPartition(); err != nil {
+			return
+		}
+	}
+	if err = dp.setShardHosts(shardHosts, ""); err != nil {
+		return
+	}
+	_, err = dp.openECStore()
+	return
+}
+
+/*the ec partition created on a new shard host keeps the shard hosts, its shards are rebuilt by the repair of the leader*/
+func (s *DataNode) createPartitionShards(dp DataPartition, request *proto.CreateDataPartitionRequest) (err error) {
+	partition, ok := dp.(*dataPartition)
+	if !ok || request.PartitionType != proto.ErasureCodePartition {
+		return
+	}
+	if err = partition.prepareShards(request.ShardHosts); err != nil {
+		return
+	}
+	return partition.setShardHosts(request.ShardHosts, proto.ErasureCodePartition)
+}
+
+/*store the shard hosts in the meta, the partition type too unless it is empty*/
+func (dp *dataPartition) setShardHosts(shardHosts []string, partitionType string) (err error) {
+	dp.epochLock.Lock()
+	defer dp.epochLock.Unlock()
+	orgHosts, orgType := dp.meta.ShardHosts, dp.meta.PartitionType
+	dp.meta.ShardHosts = shardHosts
+	if partitionType != "" {
+		dp.meta.PartitionType = partitionType
+	}
+	if err = dp.storeMeta(); err != nil {
+		dp.meta.ShardHosts, dp.meta.PartitionType = orgHosts, orgType
+	}
+	return
+}
+
+// encodeExtents encodes the extents of the sealed partition into the shards on
+// the shard hosts, the extents whose shards are whole on every host are skipped
+// so an encode failed is resumed.
+func (dp *dataPartition) encodeExtents(shardHosts []string) (err error) {
+	if !dp.IsSealed() {
+		return ErrECNotSealed
+	}
+	var (
+		ec      *storage.ErasureCode
+		extents []*storage.FileInfo
+	)
+	if ec, err = storage.NewErasureCode(proto.ECDataShards, proto.ECParityShards); err != nil {
+		return
+	}
+	if len(shardHosts) != ec.TotalShards() {
+		return fmt.Errorf("%v: %v", ErrECShardHosts, shardHosts)
+	}
+	encoded := dp.getShardExtents(shardHosts)
+	if extents, err = dp.extentStore.GetAllWatermark(nil); err != nil {
+		return
+	}
+	for _, info := range extents {
+		if info.Deleted || encoded[uint64(info.FileId)] == len(shardHosts) {
+			continue
+		}
+		extent := &proto.ECExtent{ExtentId: uint64(info.FileId), Inode: info.Inode, Size: int64(info.Size), Refs: info.Refs}
+		err = ec.EncodeExtent(extent.Size, func(offset int64, data []byte) error {
+			return dp.readWholeExtent(extent.ExtentId, offset, data)
+		}, func(shard int, offset int64, data []byte) error {
+			return dp.writeShard(shardHosts[shard], extent, offset, data)
+		})
+		if err != nil {
+			return fmt.Errorf("encode extent(%v) size(%v) err(%v)", extent.ExtentId, extent.Size, err)
+		}
+		if extent.Size == 0 {
+			// no stripe to write, the shards are created empty
+			for _, host := range shardHosts {
+				if err = dp.writeShard(host, extent, 0, nil); err != nil {
+					return
+				}
+			}
+		}
+	}
+	log.LogWarnf("action[encodeExtents] partition(%v) %v extents encoded to %v.", dp.partitionId, len(extents), shardHosts)
+	return
+}
+
+/*the number of the shard hosts holding the shard of each extent whole*/
+func (dp *dataPartition) getShardExtents(shardHosts []string) (counts map[uint64]int) {
+	counts = make(map[uint64]int)
+	for _, host := range shardHosts {
+		extents, err := dp.getHostECExtents(host)
+		if err != nil {
+			log.LogWarnf("action[getShardExtents] partition(%v) host(%v) err(%v).", dp.partitionId, host, err)
+			continue
+		}
+		for _, extent := range extents {
+			counts[extent.ExtentId]++
+		}
+	}
+	return
+}
+
+/*read data of the whole extent at offset, by the blocks the store reads at a time*/
+func (dp *dataPartition) readWholeExtent(extentId uint64, offset int64, data []byte) (err error) {
+	for done := 0; done < len(data); {
+		n := util.Min(len(data)-done, util.BlockSize)
+		if _, err = dp.extentStore.Read(extentId, offset+int64(done), int64(n), data[done:done+n]); err != nil {
+			return
+		}
+		done += n
+	}
+	return
+}
+
+// commitShards serves the partition from the shards: the partition turns into
+// an ec one and the extents encoded are dropped from the extent store.
+func (dp *dataPartition) commitShards(shardHosts []string) (err error) {
+	store := dp.getECStore()
+	if store == nil {
+		return ErrECNotPrepared
+	}
+	if err = dp.setShardHosts(shardHosts, proto.ErasureCodePartition); err != nil {
+		return
+	}
+	var extents []*storage.FileInfo
+	if extents, err = dp.extentStore.GetAllWatermark(nil); err != nil {
+		return
+	}
+	for _, info := range extents {
+		if store.ECExtent(uint64(info.FileId)) == nil {
+			continue
+		}
+		if err = dp.extentStore.ForceMarkDelete(uint64(info.FileId)); err != nil {
+			return
+		}
+	}
+	if err = dp.extentStore.FlushDelete(); err != nil {
+		return
+	}
+	dp.resealAfterRepair()
+	log.LogWarnf("action[commitShards] partition(%v) served from the shards on %v.", dp.partitionId, shardHosts)
+	return
+}
+
+// ecRead reads data at offset of the extent from the shards, the stripes on the
+// shard hosts failing to read are decoded from the other shards.
+func (dp *dataPartition) ecRead(extent *proto.ECExtent, offset int64, data []byte) (err error) {
+	var ec *storage.ErasureCode
+	if ec, err = storage.NewErasureCode(proto.ECDataShards, proto.ECParityShards); err != nil {
+		return
+	}
+	shardHosts := dp.getShardHosts()
+	if len(shardHosts) != ec.TotalShards() {
+		return fmt.Errorf("%v: %v", ErrECShardHosts, shardHosts)
+	}
+	return ec.ReadExtent(extent.Size, offset, data, func(shard int, offset int64, data []byte) error {
+		return dp.readShard(shardHosts[shard], extent.ExtentId, offset, data)
+	})
+}
+
+/*read data of the shard of the extent on host at offset*/
+func (dp *dataPartition) readShard(host string, extentId uint64, offset int64, data []byte) (err error) {
+	if isLocalHost(host) {
+		store := dp.getECStore()
+		if store == nil {
+			return ErrECNotPrepared
+		}
+		_, err = store.Read(extentId, offset, int64(len(data)), data)
+		return
+	}
+	p := NewReadECShardPacket(dp.ID(), extentId, offset, len(data))
+	if err = dp.sendShardPacket(host, p); err != nil {
+		return
+	}
+	if int(p.Size) != len(data) || crc32.ChecksumIEEE(p.Data[:p.Size]) != p.Crc {
+		return fmt.Errorf("%v: host(%v) extent(%v) offset(%v) size(%v)", ErrECShardCorrupt, host, extentId, offset, p.Size)
+	}
+	copy(data, p.Data[:p.Size])
+	return
+}
+
+/*write data of the shard of the extent to host at offset, the shard is created by the write at offset 0*/
+func (dp *dataPartition) writeShard(host string, extent *proto.ECExtent, offset int64, data []byte) (err error) {
+	if isLocalHost(host) {
+		store := dp.getECStore()
+		if store == nil {
+			return ErrECNotPrepared
+		}
+		return writeECShard(store, extent, offset, data, crc32.ChecksumIEEE(data))
+	}
+	return dp.sendShardPacket(host, NewWriteECShardPacket(dp.ID(), extent, offset, data))
+}
+
+func writeECShard(store *storage.ECStore, extent *proto.ECExtent, offset int64, data []byte, crc uint32) (err error) {
+	if offset == 0 {
+		if err = store.CreateShard(extent.ExtentId, extent.Inode, extent.Size); err != nil {
+			return
+		}
+		if extent.Refs > 1 {
+			if err = store.SetRefs(extent.ExtentId, extent.Refs); err != nil {
+				return
+			}
+		}
+	}
+	if len(data) == 0 {
+		return
+	}
+	return store.Write(extent.ExtentId, offset, int64(len(data)), data, crc)
+}
+
+/*the extents whose shards host holds whole*/
+func (dp *dataPartition) getHostECExtents(host string) (extents []*proto.ECExtent, err error) {
+	if isLocalHost(host) {
+		store := dp.getECStore()
+		if store == nil {
+			return nil, ErrECNotPrepared
+		}
+		return store.ECExtents(), nil
+	}
+	p := NewGetECExtentsPacket(dp.ID())
+	if err = dp.sendShardPacket(host, p); err != nil {
+		return
+	}
+	extents = make([]*proto.ECExtent, 0)
+	err = json.Unmarshal(p.Data[:p.Size], &extents)
+	return
+}
+
+func (dp *dataPartition) sendShardPacket(host string, p *Packet) (err error) {
+	var conn net.Conn
+	if conn, err = gConnPool.Get(replicaAddr(host)); err != nil {
+		return
+	}
+	if err = p.WriteToConn(conn); err != nil {
+		gConnPool.Put(conn, true)
+		return
+	}
+	if err = p.ReadFromConn(conn, proto.ReadDeadlineTime); err != nil {
+		gConnPool.Put(conn, true)
+		return
+	}
+	gConnPool.Put(conn, false)
+	if p.IsErrPack() {
+		return fmt.Errorf("host(%v) %v", host, p.getErr())
+	}
+	return
+}
+
+// repairECShards rebuilds the shards the shard hosts lack by decoding the
+// others, an extent is rebuilt only while enough shards of it are left.
+func (dp *dataPartition) repairECShards() {
+	shardHosts := dp.getShardHosts()
+	if hosts, err := dp.fetchShardHosts(); err == nil && len(hosts) == len(shardHosts) {
+		shardHosts = hosts
+	}
+	ec, err := storage.NewErasureCode(proto.ECDataShards, proto.ECParityShards)
+	if err != nil || len(shardHosts) != ec.TotalShards() {
+		log.LogErrorf("action[repairECShards] partition(%v) shard hosts(%v) err(%v).", dp.partitionId, shardHosts, err)
+		return
+	}
+	all := make(map[uint64]*proto.ECExtent)
+	held := make([]map[uint64]bool, len(shardHosts))
+	for i, host := range shardHosts {
+		extents, err := dp.getHostECExtents(host)
+		if err != nil {
+			log.LogWarnf("action[repairECShards] partition(%v) host(%v) err(%v).", dp.partitionId, host, err)
+			continue
+		}
+		held[i] = make(map[uint64]bool)
+		for _, extent := range extents {
+			held[i][extent.ExtentId] = true
+			all[extent.ExtentId] = extent
+		}
+	}
+	for i, host := range shardHosts {
+		if held[i] == nil {
+			continue
+		}
+		for id, extent := range all {
+			if held[i][id] {
+				continue
+			}
+			read := func(shard int, offset int64, data []byte) error {
+				if held[shard] == nil || !held[shard][id] {
+					return ErrECNotPrepared
+				}
+				return dp.readShard(shardHosts[shard], id, offset, data)
+			}
+			err = ec.RebuildShard(extent.Size, i, read, func(offset int64, data []byte) error {
+				gRepairScheduler.wait(dp.disk.Path, len(data))
+				return dp.writeShard(host, extent, offset, data)
+			})
+			if err == nil && extent.Size == 0 {
+				err = dp.writeShard(host, extent, 0, nil)
+			}
+			if err != nil {
+				log.LogErrorf("action[repairECShards] partition(%v) extent(%v) shard(%v) on host(%v) err(%v).",
+					dp.partitionId, id, i, host, err)
+				continue
+			}
+			log.LogWarnf("action[repairECShards] partition(%v) extent(%v) shard(%v) rebuilt on host(%v).",
+				dp.partitionId, id, i, host)
+		}
+	}
+}
+
+/*the shard hosts of the master, the host taking the shard of an offline one is in its place*/
+func (dp *dataPartition) fetchShardHosts() (hosts []string, err error) {
+	var data []byte
+	params := map[string]string{"id": strconv.Itoa(int(dp.partitionId))}
+	if data, err = MasterHelper.ReadRequest("GET", AdminGetDataPartition, params, nil); err != nil {
+		return
+	}
+	response := &master.DataPartition{}
+	if err = json.Unmarshal(data, response); err != nil {
+		return
+	}
+	if response.Epoch < dp.Epoch() || len(response.ShardHosts) == 0 {
+		return dp.getShardHosts(), nil
+	}
+	hosts = response.ShardHosts
+	if fmt.Sprint(hosts) != fmt.Sprint(dp.getShardHosts()) {
+		err = dp.setShardHosts(hosts, "")
+	}
+	return
+}
+
+func NewWriteECShardPacket(partitionId uint32, extent *proto.ECExtent, offset int64, data []byte) (p *Packet) {
+	p = NewPacket()
+	p.Opcode = proto.OpWriteECShard
+	p.PartitionID = partitionId
+	p.FileID = extent.ExtentId
+	p.Offset = offset
+	p.StoreMode = proto.ExtentStoreMode
+	p.ReqID = proto.GetReqID()
+	p.Data = make([]byte, ECShardHeaderSize+len(data))
+	binary.BigEndian.PutUint64(p.Data[0:8], uint64(extent.Size))
+	binary.BigEndian.PutUint64(p.Data[8:16], extent.Inode)
+	binary.BigEndian.PutUint32(p.Data[16:ECShardHeaderSize], extent.Refs)
+	copy(p.Data[ECShardHeaderSize:], data)
+	p.Size = uint32(len(p.Data))
+	p.Crc = crc32.ChecksumIEEE(data)
+	return
+}
+
+func NewReadECShardPacket(partitionId uint32, extentId uint64, offset int64, size int) (p *Packet) {
+	p = NewPacket()
+	p.Opcode = proto.OpReadECShard
+	p.PartitionID = partitionId
+	p.FileID = extentId
+	p.Offset = offset
+	p.Size = uint32(size)
+	p.StoreMode = proto.ExtentStoreMode
+	p.ReqID = proto.GetReqID()
+	return
+}
+
+func NewGetECExtentsPacket(partitionId uint32) (p *Packet) {
+	p = NewPacket()
+	p.Opcode = proto.OpGetECExtents
+	p.PartitionID = partitionId
+	p.StoreMode = proto.ExtentStoreMode
+	p.ReqID = proto.GetReqID()
+	return
+}
+
+// Handle OpWriteECShard packet.
+func (s *DataNode) handleWriteECShard(pkg *Packet) {
+	var err error
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("Request(%v) WriteECShard Error: %v", pkg.GetUniqueLogId(), err)
+			pkg.PackErrorBody(LogWrite, err.Error())
+		} else {
+			pkg.PackOkReply()
+		}
+	}()
+	store := pkg.ecStore()
+	if store == nil {
+		err = ErrECNotPrepared
+		return
+	}
+	if pkg.Size < ECShardHeaderSize || len(pkg.Data) < int(pkg.Size) {
+		err = storage.NewParamMismatchErr(fmt.Sprintf("shard data size=%v", pkg.Size))
+		return
+	}
+	extent := &proto.ECExtent{
+		ExtentId: pkg.FileID,
+		Size:     int64(binary.BigEndian.Uint64(pkg.Data[0:8])),
+		Inode:    binary.BigEndian.Uint64(pkg.Data[8:16]),
+		Refs:     binary.BigEndian.Uint32(pkg.Data[16:ECShardHeaderSize]),
+	}
+	data := pkg.Data[ECShardHeaderSize:pkg.Size]
+	if crc32.ChecksumIEEE(data) != pkg.Crc {
+		err = storage.ErrPkgCrcMismatch
+		return
+	}
+	err = writeECShard(store, extent, pkg.Offset, data, pkg.Crc)
+	return
+}
+
+// Handle OpReadECShard packet.
+func (s *DataNode) handleReadECShard(pkg *Packet) {
+	var err error
+	store := pkg.ecStore()
+	if store == nil {
+		err = ErrECNotPrepared
+	} else {
+		pkg.Data = make([]byte, pkg.Size)
+		pkg.Crc, err = store.Read(pkg.FileID, pkg.Offset, int64(pkg.Size), pkg.Data)
+		s.addDiskErrs(pkg.PartitionID, err, ReadFlag)
+	}
+	if err == nil {
+		pkg.PackOkReadReply()
+	} else {
+		pkg.PackErrorBody(LogRead, err.Error())
+	}
+}
+
+// Handle OpGetECExtents packet.
+func (s *DataNode) handleGetECExtents(pkg *Packet) {
+	store := pkg.ecStore()
+	if store == nil {
+		pkg.PackErrorBody(LogGetWm, ErrECNotPrepared.Error())
+		return
+	}
+	data, err := json.Marshal(store.ECExtents())
+	if err != nil {
+		pkg.PackErrorBody(LogGetWm, err.Error())
+		return
+	}
+	pkg.PackOkWithBody(data)
+}
+
+// Handle OpEncodeDataPartition packet.
+func (s *DataNode) handleEncodeDataPartition(pkg *Packet) {
+	task := &proto.AdminTask{}
+	json.Unmarshal(pkg.Data, task)
+	pkg.PackOkReply()
+	s.taskEngine.Submit(task, s.encodeDataPartition)
+}
+
+func (s *DataNode) encodeDataPartition(task *proto.AdminTask) (resp interface{}, status int8) {
+	var err error
+	request := &proto.EncodeDataPartitionRequest{}
+	response := &proto.EncodeDataPartitionResponse{}
+	if task.OpCode == proto.OpEncodeDataPartition {
+		bytes, _ := json.Marshal(task.Request)
+		if err = json.Unmarshal(bytes, request); err == nil {
+			err = s.encodePartition(request)
+		}
+	} else {
+		err = fmt.Errorf("illegal opcode")
+	}
+	response.PartitionId = request.PartitionId
+	response.Step = request.Step
+	if err != nil {
+		response.Status = proto.TaskFail
+		response.Result = err.Error()
+		response.ErrCode = errCodeOf(response.Result)
+		log.LogErrorf("action[encodeDataPartition] from master Task(%v) failed, err(%v)", task.ToString(), err)
+	} else {
+		response.Status = proto.TaskSuccess
+	}
+	return response, int8(response.Status)
+}
+
+func (s *DataNode) encodePartition(request *proto.EncodeDataPartitionRequest) (err error) {
+	partitionId := uint32(request.PartitionId)
+	dp, _ := s.space.GetPartition(partitionId).(*dataPartition)
+	if dp == nil && request.Step == proto.EncodeStepPrepare {
+		// a shard host without a replica keeps only the shards of the partition
+		var created DataPartition
+		if created, err = s.space.CreatePartition(request.VolumeId, partitionId, request.PartitionSize,
+			proto.ExtentPartition, ""); err != nil {
+			return
+		}
+		if created == nil {
+			created = s.space.GetPartition(partitionId)
+		}
+		dp, _ = created.(*dataPartition)
+	}
+	if dp == nil {
+		return fmt.Errorf("dataPartition(%v) not exist", partitionId)
+	}
+	switch request.Step {
+	case proto.EncodeStepPrepare:
+		err = dp.prepareShards(request.ShardHosts)
+	case proto.EncodeStepEncode:
+		err = dp.encodeExtents(request.ShardHosts)
+	case proto.EncodeStepCommit:
+		err = dp.commitShards(request.ShardHosts)
+	default:
+		err = fmt.Errorf("unknown encode step %v", request.Step)
+	}
+	return
+}
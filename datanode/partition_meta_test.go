@@ -0,0 +1,119 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+func testPartitionDir(t *testing.T) string {
+	root, err := ioutil.TempDir("", "datanode")
+	if err != nil {
+		t.Fatalf("temp dir: %v", err)
+	}
+	dir := path.Join(root, fmt.Sprintf(DataPartitionPrefix+"_%v_%v", 7, 1024))
+	if err = os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	return dir
+}
+
+func testPartitionMeta(version uint64) *dataPartitionMeta {
+	return &dataPartitionMeta{VolumeId: "ltptest", PartitionType: proto.ExtentPartition, PartitionId: 7,
+		PartitionSize: 1024, Epoch: 3, Hosts: []string{"10.0.0.1:17310", "10.0.0.2:17310"}, Version: version}
+}
+
+func storeTestMeta(t *testing.T, dir, name string, meta *dataPartitionMeta) []byte {
+	data, err := meta.marshal()
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if err = writeFileSync(path.Join(dir, name), data); err != nil {
+		t.Fatalf("write %v: %v", name, err)
+	}
+	return data
+}
+
+func TestLoadDataPartitionMeta(t *testing.T) {
+	dir := testPartitionDir(t)
+	defer os.RemoveAll(path.Dir(dir))
+	if _, _, err := loadDataPartitionMeta(dir); !os.IsNotExist(err) {
+		t.Fatalf("load without meta: %v", err)
+	}
+	storeTestMeta(t, dir, DataPartitionMetaBakName, testPartitionMeta(1))
+	data := storeTestMeta(t, dir, DataPartitionMetaFileName, testPartitionMeta(2))
+	meta, recovered, err := loadDataPartitionMeta(dir)
+	if err != nil || recovered || meta.Version != 2 || meta.Epoch != 3 || len(meta.Hosts) != 2 {
+		t.Fatalf("load: meta %+v recovered(%v) err(%v)", meta, recovered, err)
+	}
+
+	// a META broken by a crash, the META.bak is taken
+	broken := bytes.Replace(data, []byte("ltptest"), []byte("ltptesu"), 1)
+	if err = writeFileSync(path.Join(dir, DataPartitionMetaFileName), broken); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if meta, recovered, err = loadDataPartitionMeta(dir); err != nil || !recovered || meta.Version != 1 {
+		t.Fatalf("load of a broken meta: meta %+v recovered(%v) err(%v)", meta, recovered, err)
+	}
+
+	// the meta of another partition
+	other := testPartitionMeta(3)
+	other.PartitionId = 8
+	storeTestMeta(t, dir, DataPartitionMetaFileName, other)
+	if meta, recovered, err = loadDataPartitionMeta(dir); err != nil || !recovered || meta.PartitionId != 7 {
+		t.Fatalf("load of the meta of another partition: meta %+v recovered(%v) err(%v)", meta, recovered, err)
+	}
+}
+
+func TestLoadDataPartitionMeta_Compat(t *testing.T) {
+	dir := testPartitionDir(t)
+	defer os.RemoveAll(path.Dir(dir))
+	meta := testPartitionMeta(4)
+
+	// stored by a release with a field unknown to this one, the crc is of its bytes
+	data, err := json.Marshal(meta)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	data = append([]byte(`{"Future":{"a":[1,2]},`), data[1:]...)
+	data = append(data[:len(data)-1], fmt.Sprintf(`,"Crc":%v}`, crc32.ChecksumIEEE(data))...)
+	if err = writeFileSync(path.Join(dir, DataPartitionMetaFileName), data); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	loaded, recovered, err := loadDataPartitionMeta(dir)
+	if err != nil || recovered || loaded.Version != 4 {
+		t.Fatalf("load of a newer meta: meta %+v recovered(%v) err(%v)", loaded, recovered, err)
+	}
+
+	// stored by a release before the crc
+	if data, err = json.Marshal(meta); err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if err = writeFileSync(path.Join(dir, DataPartitionMetaFileName), data); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if loaded, recovered, err = loadDataPartitionMeta(dir); err != nil || recovered || loaded.Version != 4 {
+		t.Fatalf("load of a meta without crc: meta %+v recovered(%v) err(%v)", loaded, recovered, err)
+	}
+}
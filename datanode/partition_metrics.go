@@ -1,6 +1,27 @@
 package datanode
 
-import "sync/atomic"
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tiglabs/containerfs/util/metrics"
+)
+
+const (
+	SlowWriteLatency = 100 * time.Millisecond
+	MaxSlowWriteOps  = 32
+)
+
+// SlowWriteOp is a write which took at least SlowWriteLatency.
+type SlowWriteOp struct {
+	Opcode     uint8
+	ResultCode uint8
+	FileID     uint64
+	Offset     int64
+	Latency    time.Duration
+	Time       time.Time
+}
 
 type DataPartitionMetrics struct {
 	WriteCnt         uint64
@@ -9,30 +30,52 @@ type DataPartitionMetrics struct {
 	SumReadLatency   uint64
 	WriteLatency     float64
 	ReadLatency      float64
+	WriteQueueDepth  int64 // max number of writes in the store during last period
 	lastWriteLatency float64
 	lastReadLatency  float64
+
+	inflightWrites    int64
+	maxInflightWrites int64
+	slowWrites        []*SlowWriteOp
+	slowWriteIndex    int
+	slowWriteLock     sync.Mutex
+
+	// never reset, exported to the metrics endpoint
+	TotalWrites         uint64
+	TotalReads          uint64
+	RepairTasks         int64 // extent and blob repairs in progress
+	writeLatencySeconds *metrics.Histogram
+	readLatencySeconds  *metrics.Histogram
 }
 
 func NewDataPartitionMetrics() *DataPartitionMetrics {
 	metrics := new(DataPartitionMetrics)
 	metrics.WriteCnt = 1
 	metrics.ReadCnt = 1
+	metrics.slowWrites = make([]*SlowWriteOp, 0, MaxSlowWriteOps)
+	metrics.writeLatencySeconds = metricsHistogram()
+	metrics.readLatencySeconds = metricsHistogram()
 	return metrics
 }
 
 func (metrics *DataPartitionMetrics) AddReadMetrics(latency uint64) {
 	atomic.AddUint64(&metrics.ReadCnt, 1)
 	atomic.AddUint64(&metrics.SumReadLatency, latency)
+	atomic.AddUint64(&metrics.TotalReads, 1)
+	metrics.readLatencySeconds.Observe(time.Duration(latency).Seconds())
 }
 
 func (metrics *DataPartitionMetrics) AddWriteMetrics(latency uint64) {
 	atomic.AddUint64(&metrics.WriteCnt, 1)
 	atomic.AddUint64(&metrics.SumWriteLatency, latency)
+	atomic.AddUint64(&metrics.TotalWrites, 1)
+	metrics.writeLatencySeconds.Observe(time.Duration(latency).Seconds())
 }
 
 func (metrics *DataPartitionMetrics) recomputLatency() {
 	metrics.ReadLatency = float64((atomic.LoadUint64(&metrics.SumReadLatency)) / (atomic.LoadUint64(&metrics.ReadCnt)))
 	metrics.WriteLatency = float64((atomic.LoadUint64(&metrics.SumWriteLatency)) / (atomic.LoadUint64(&metrics.WriteCnt)))
+	atomic.StoreInt64(&metrics.WriteQueueDepth, atomic.SwapInt64(&metrics.maxInflightWrites, atomic.LoadInt64(&metrics.inflightWrites)))
 	atomic.StoreUint64(&metrics.SumReadLatency, 0)
 	atomic.StoreUint64(&metrics.SumWriteLatency, 0)
 	atomic.StoreUint64(&metrics.WriteCnt, 1)
@@ -46,3 +89,51 @@ func (metrics *DataPartitionMetrics) GetWriteLatency() float64 {
 func (metrics *DataPartitionMetrics) GetReadLatency() float64 {
 	return metrics.ReadLatency
 }
+
+func (metrics *DataPartitionMetrics) GetWriteQueueDepth() int64 {
+	return atomic.LoadInt64(&metrics.WriteQueueDepth)
+}
+
+func (metrics *DataPartitionMetrics) BeginWrite() {
+	inflight := atomic.AddInt64(&metrics.inflightWrites, 1)
+	for {
+		max := atomic.LoadInt64(&metrics.maxInflightWrites)
+		if inflight <= max || atomic.CompareAndSwapInt64(&metrics.maxInflightWrites, max, inflight) {
+			return
+		}
+	}
+}
+
+func (metrics *DataPartitionMetrics) EndWrite() {
+	atomic.AddInt64(&metrics.inflightWrites, -1)
+}
+
+// AddSlowWrite keeps the last MaxSlowWriteOps slow writes.
+func (metrics *DataPartitionMetrics) AddSlowWrite(op *SlowWriteOp) {
+	metrics.slowWriteLock.Lock()
+	defer metrics.slowWriteLock.Unlock()
+	if len(metrics.slowWrites) < MaxSlowWriteOps {
+		metrics.slowWrites = append(metrics.slowWrites, op)
+		return
+	}
+	metrics.slowWrites[metrics.slowWriteIndex] = op
+	metrics.slowWriteIndex = (metrics.slowWriteIndex + 1) % MaxSlowWriteOps
+}
+
+// SlowWrites return the recent slow writes, the oldest first.
+func (metrics *DataPartitionMetrics) SlowWrites() (ops []*SlowWriteOp) {
+	metrics.slowWriteLock.Lock()
+	defer metrics.slowWriteLock.Unlock()
+	ops = make([]*SlowWriteOp, 0, len(metrics.slowWrites))
+	ops = append(ops, metrics.slowWrites[metrics.slowWriteIndex:]...)
+	ops = append(ops, metrics.slowWrites[:metrics.slowWriteIndex]...)
+	return
+}
+
+func (metrics *DataPartitionMetrics) BeginRepair() {
+	atomic.AddInt64(&metrics.RepairTasks, 1)
+}
+
+func (metrics *DataPartitionMetrics) EndRepair() {
+	atomic.AddInt64(&metrics.RepairTasks, -1)
+}
@@ -0,0 +1,416 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	MovingPartitionPrefix    = ".moving_" //the copy of a partition on the target disk
+	MovedPartitionPrefix     = ".moved_"  //the partition on the source disk once copied, removed after the switch
+	DefaultDiskMoveThreshold = 90
+	DiskMoveCheckInterval    = 10 * time.Minute
+)
+
+var (
+	diskMoveThreshold = DefaultDiskMoveThreshold
+)
+
+// A partition is moved to another disk of the node in two passes. The files are
+// copied while the partition serves, then the partition is sealed and detached,
+// the files changed since are copied again and the copy is renamed to the
+// partition dir on the target disk and attached. Each file copied is read back
+// and checked against the crc of the source. The partition is offline during the
+// second pass only, the clients retry on the other partitions meanwhile.
+
+type movedFile struct {
+	size    int64
+	modTime time.Time
+}
+
+// Handle OpMoveDataPartition packet.
+func (s *DataNode) handleMoveDataPartition(pkg *Packet) {
+	task := &proto.AdminTask{}
+	json.Unmarshal(pkg.Data, task)
+	pkg.PackOkReply()
+	s.taskEngine.Submit(task, s.moveDataPartition)
+}
+
+func (s *DataNode) moveDataPartition(task *proto.AdminTask) (resp interface{}, status int8) {
+	var err error
+	request := &proto.MoveDataPartitionRequest{}
+	response := &proto.MoveDataPartitionResponse{}
+	if task.OpCode == proto.OpMoveDataPartition {
+		data, _ := json.Marshal(task.Request)
+		if err = json.Unmarshal(data, request); err == nil {
+			response.Disk, err = s.movePartition(uint32(request.PartitionId), request.Disk)
+		}
+	} else {
+		err = ErrorUnknownOp
+	}
+	response.PartitionId = request.PartitionId
+	if err != nil {
+		response.Status = proto.TaskFail
+		response.Result = err.Error()
+		response.ErrCode = errCodeOf(response.Result)
+		log.LogErrorf("action[moveDataPartition] from master Task(%v) failed, err(%v)", task.ToString(), err)
+	} else {
+		response.Status = proto.TaskSuccess
+	}
+	return response, int8(response.Status)
+}
+
+/*move the partition to the disk of targetPath, or the disk with the most available space if empty*/
+func (s *DataNode) movePartition(partitionId uint32, targetPath string) (diskPath string, err error) {
+	if _, ok := archivingPartitions.LoadOrStore(partitionId, true); ok {
+		return "", fmt.Errorf("dataPartition(%v) archive, rehydrate or move in progress", partitionId)
+	}
+	defer archivingPartitions.Delete(partitionId)
+	dp := s.space.GetPartition(partitionId)
+	if dp == nil {
+		return "", ErrPartitionNotExist
+	}
+	partition := dp.(*dataPartition)
+	source := partition.Disk()
+	var target *Disk
+	if target, err = s.getMoveDisk(source, targetPath, uint64(partition.Used())); err != nil {
+		return
+	}
+	if target == source {
+		return source.Path, nil
+	}
+	name := path.Base(partition.Path())
+	sourceDir := partition.Path()
+	tmpDir := path.Join(target.Path, MovingPartitionPrefix+name)
+	os.RemoveAll(tmpDir)
+	var copied map[string]*movedFile
+	if copied, err = copyPartitionFiles(sourceDir, tmpDir, nil); err != nil {
+		os.RemoveAll(tmpDir)
+		return
+	}
+	if err = partition.seal(); err != nil {
+		partition.unseal()
+		os.RemoveAll(tmpDir)
+		return
+	}
+	// nothing changes the files once the stores are closed
+	s.space.DetachPartition(partitionId)
+	movedDir := path.Join(source.Path, MovedPartitionPrefix+name)
+	targetDir := target.partitionDir(name)
+	if _, err = copyPartitionFiles(sourceDir, tmpDir, copied); err == nil {
+		err = os.MkdirAll(path.Dir(targetDir), 0755)
+	}
+	// the source is renamed on the disk before the copy is switched, a move
+	// found with both at the restart is then rolled back or finished in order
+	if err == nil {
+		if err = os.Rename(sourceDir, movedDir); err == nil {
+			err = syncMoveDirs(sourceDir, movedDir)
+		}
+	}
+	if err == nil {
+		if err = os.Rename(tmpDir, targetDir); err == nil {
+			err = syncMoveDirs(tmpDir, targetDir)
+		}
+		if err != nil {
+			os.Rename(targetDir, tmpDir)
+			os.Rename(movedDir, sourceDir)
+			syncMoveDirs(movedDir, sourceDir)
+		}
+	}
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		target.removeEmptyParents(targetDir)
+		s.reattachPartition(sourceDir, source)
+		return
+	}
+	source.removeEmptyParents(sourceDir)
+	os.RemoveAll(movedDir)
+	if _, err = s.reattachPartition(targetDir, target); err != nil {
+		return
+	}
+	log.LogWarnf("action[movePartition] dataPartition(%v) moved from disk(%v) to disk(%v)", partitionId, source.Path, target.Path)
+	return target.Path, nil
+}
+
+/*sync the parent dirs of a rename from oldDir to newDir*/
+func syncMoveDirs(oldDir, newDir string) (err error) {
+	if err = syncDir(path.Dir(newDir)); err != nil {
+		return
+	}
+	if path.Dir(oldDir) != path.Dir(newDir) {
+		err = syncDir(path.Dir(oldDir))
+	}
+	return
+}
+
+/*the disk of targetPath, or the healthy disk other than source with the most available space*/
+func (s *DataNode) getMoveDisk(source *Disk, targetPath string, size uint64) (disk *Disk, err error) {
+	if targetPath != "" {
+		if disk, err = s.space.GetDisk(targetPath); err != nil || disk == source {
+			return
+		}
+		disk.RLock()
+		defer disk.RUnlock()
+		if disk.Status != proto.ReadWrite || disk.Available < size {
+			return nil, fmt.Errorf("disk(%v) status(%v) available(%v) has no room for %v bytes",
+				disk.Path, disk.Status, disk.Available, size)
+		}
+		return
+	}
+	var maxAvail uint64
+	for _, d := range s.space.GetDisks() {
+		if d == source || d.isFailing() {
+			continue
+		}
+		d.RLock()
+		if d.Status == proto.ReadWrite && d.Available >= size && d.Available > maxAvail {
+			disk, maxAvail = d, d.Available
+		}
+		d.RUnlock()
+	}
+	if disk == nil {
+		err = ErrNoDiskForCreatePartition
+	}
+	return
+}
+
+/*copy the files of src to dst, the ones kept in prev with the same size and modify time are not copied again*/
+func copyPartitionFiles(src, dst string, prev map[string]*movedFile) (copied map[string]*movedFile, err error) {
+	copied = make(map[string]*movedFile)
+	err = filepath.Walk(src, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, name)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.MkdirAll(path.Join(dst, rel), 0755)
+		}
+		f := &movedFile{size: info.Size(), modTime: info.ModTime()}
+		copied[rel] = f
+		if p, ok := prev[rel]; ok && p.size == f.size && p.modTime.Equal(f.modTime) {
+			return nil
+		}
+		return copyFileVerified(name, path.Join(dst, rel))
+	})
+	if err != nil {
+		return
+	}
+	// the files removed during the first pass
+	for rel := range prev {
+		if _, ok := copied[rel]; !ok {
+			os.Remove(path.Join(dst, rel))
+		}
+	}
+	// the entries of the copied files are on the disk before the copy is switched
+	err = filepath.Walk(dst, func(name string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		return syncDir(name)
+	})
+	return
+}
+
+/*copy the file to dst and check the data synchronized to dst against the crc of the source*/
+func copyFileVerified(src, dst string) (err error) {
+	var (
+		in  *os.File
+		out *os.File
+	)
+	if in, err = os.Open(src); err != nil {
+		return
+	}
+	defer in.Close()
+	if out, err = os.OpenFile(dst, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666); err != nil {
+		return
+	}
+	defer out.Close()
+	hash := crc32.NewIEEE()
+	if _, err = io.Copy(io.MultiWriter(out, hash), in); err != nil {
+		return
+	}
+	if err = out.Sync(); err != nil {
+		return
+	}
+	if _, err = out.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	check := crc32.NewIEEE()
+	if _, err = io.Copy(check, out); err != nil {
+		return
+	}
+	if check.Sum32() != hash.Sum32() {
+		return fmt.Errorf("crc of %v copied to %v mismatch: %v != %v", src, dst, check.Sum32(), hash.Sum32())
+	}
+	return
+}
+
+/*finish or roll back the moves interrupted by a restart, before the partitions are loaded*/
+func recoverPartitionMoves(diskPaths []string) {
+	for _, diskPath := range diskPaths {
+		fileInfoList, err := ioutil.ReadDir(diskPath)
+		if err != nil {
+			continue
+		}
+		for _, fileInfo := range fileInfoList {
+			if !fileInfo.IsDir() || !strings.HasPrefix(fileInfo.Name(), MovedPartitionPrefix) {
+				continue
+			}
+			name := strings.TrimPrefix(fileInfo.Name(), MovedPartitionPrefix)
+			movedDir := path.Join(diskPath, fileInfo.Name())
+			// the copy was switched if the partition dir is on another disk
+			if switched := findPartitionDir(diskPaths, name); switched != "" {
+				err = os.RemoveAll(movedDir)
+			} else {
+				if err = os.Rename(movedDir, path.Join(diskPath, name)); err == nil {
+					err = syncDir(diskPath)
+				}
+			}
+			log.LogWarnf("action[recoverPartitionMoves] partition(%v) on disk(%v) recovered, err(%v)", name, diskPath, err)
+		}
+	}
+	for _, diskPath := range diskPaths {
+		fileInfoList, err := ioutil.ReadDir(diskPath)
+		if err != nil {
+			continue
+		}
+		for _, fileInfo := range fileInfoList {
+			if fileInfo.IsDir() && strings.HasPrefix(fileInfo.Name(), MovingPartitionPrefix) {
+				os.RemoveAll(path.Join(diskPath, fileInfo.Name()))
+			}
+		}
+	}
+}
+
+/*the partition dir of name in either layout of the disks, empty if none*/
+func findPartitionDir(diskPaths []string, name string) string {
+	for _, diskPath := range diskPaths {
+		for _, dir := range []string{path.Join(diskPath, name), path.Join(diskPath, hashedPartitionParent(name), name)} {
+			if _, err := os.Stat(dir); err == nil {
+				return dir
+			}
+		}
+	}
+	return ""
+}
+
+// a disk with half of its max errors is failing, its partitions are moved off
+func (d *Disk) isFailing() bool {
+	d.RLock()
+	defer d.RUnlock()
+	return d.Status == proto.Unavaliable || d.ReadErrs+d.WriteErrs >= uint64(d.MaxErrs/2)
+}
+
+func (d *Disk) usage() float64 {
+	d.RLock()
+	defer d.RUnlock()
+	if d.Total == 0 {
+		return 0
+	}
+	return float64(d.Used) / float64(d.Total)
+}
+
+func (s *DataNode) startDiskMoves() {
+	if diskMoveThreshold <= 0 {
+		return
+	}
+	ticker := time.NewTicker(DiskMoveCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopC:
+			return
+		case <-ticker.C:
+			s.checkDiskMoves()
+		}
+	}
+}
+
+/*move a partition off each failing disk and each disk used over the threshold*/
+func (s *DataNode) checkDiskMoves() {
+	disks := s.space.GetDisks()
+	if len(disks) < 2 {
+		return
+	}
+	for _, d := range disks {
+		// the replicas of a failed disk are rebuilt on the other nodes by the master
+		if d.isFailed() {
+			continue
+		}
+		failing := d.isFailing()
+		if !failing && d.usage()*100 < float64(diskMoveThreshold) {
+			continue
+		}
+		dp := s.getDiskMovePartition(d, failing)
+		if dp == nil {
+			continue
+		}
+		target, err := s.movePartition(dp.ID(), "")
+		log.LogWarnf("action[checkDiskMoves] disk(%v) failing(%v) usage(%v) move dataPartition(%v) to disk(%v) err(%v)",
+			d.Path, failing, d.usage(), dp.ID(), target, err)
+	}
+}
+
+/*the most used partition of the disk a healthy disk under the threshold can take*/
+func (s *DataNode) getDiskMovePartition(source *Disk, failing bool) (dp DataPartition) {
+	var room uint64
+	for _, d := range s.space.GetDisks() {
+		if d == source || d.isFailing() {
+			continue
+		}
+		d.RLock()
+		avail := d.Available
+		if !failing && d.Total != 0 {
+			// the move must not push the target over the threshold
+			limit := d.Total * uint64(diskMoveThreshold) / 100
+			if d.Used >= limit {
+				avail = 0
+			} else if limit-d.Used < avail {
+				avail = limit - d.Used
+			}
+		}
+		if d.Status == proto.ReadWrite && avail > room {
+			room = avail
+		}
+		d.RUnlock()
+	}
+	var used uint64
+	for _, id := range source.DataPartitionList() {
+		partition := s.space.GetPartition(id)
+		if partition == nil {
+			continue
+		}
+		if size := uint64(partition.Used()); size <= room && (dp == nil || size > used) {
+			dp, used = partition, size
+		}
+	}
+	return
+}
@@ -0,0 +1,873 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/containerfs/master"
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/raftstore"
+	"github.com/tiglabs/containerfs/storage"
+	"github.com/tiglabs/containerfs/util"
+	"github.com/tiglabs/containerfs/util/log"
+	"github.com/tiglabs/raft"
+	raftproto "github.com/tiglabs/raft/proto"
+)
+
+const (
+	DefaultRaftHeartbeatPort = 5903
+	DefaultRaftReplicatePort = 5904
+	RaftApplyFileName        = "APPLY"
+	RaftPersistInterval      = 10 * time.Second
+)
+
+// ops of the commands submitted to the raft group of a partition
+const (
+	opRaftCreate uint8 = iota + 1
+	opRaftWrite
+	opRaftMarkDelete
+	opRaftAddRef
+	opRaftPunchHole
+)
+
+// op(1) extentId(8) offset(8) ino(8) crc(4) refs(4) size(4)
+const raftCommandHeaderSize = 37
+
+var (
+	ErrRaftNotStarted   = errors.New("raft of dataPartition not started")
+	ErrRaftNotLeader    = errors.New("not the raft leader of dataPartition")
+	ErrRaftCommandSize  = errors.New("raft command size mismatch")
+	ErrRaftApplyPending = errors.New("raft leader applying the committed log")
+	ErrRaftApplyFailed  = errors.New("raft log of dataPartition not applied by the replica")
+	ErrRaftUnknownOp    = errors.New("unknown raft command op")
+	ErrRaftNoExtent     = errors.New("extent of raft command not exist")
+)
+
+// The replicas of a raft replicated partition are the members of a raft group in
+// the raft store of the node instead of a replication chain. The leader submits
+// the creates, writes and deletes of the extents to the group and replies once a
+// majority has them in its WAL, every member applies them to its extent store in
+// the log order, so an acknowledged write survives the crash of the leader. The
+// applied index is kept in the APPLY file of the partition after the extents
+// written are synced, the log is truncated up to it and replayed from it after a
+// restart. A member behind the retained log is caught up by a snapshot streaming
+// the extents of the leader. The members are changed by the master with
+// OpOfflineDataPartition.
+//
+// A command refused by the store the same way on every member, e.g. a write to
+// an extent deleted, is replied to the client with its error. Any other error
+// of a command is a failure of the local replica, it stops applying the log
+// and becomes unavailable, so it doesn't diverge from the others: the log is
+// kept from the failed command and replayed once the partition is restarted,
+// or the replica is replaced by the master.
+
+type partitionRaft struct {
+	store         raftstore.RaftStore
+	partition     raftstore.Partition
+	nodeId        uint64
+	heartbeatPort int
+	replicatePort int
+	umpKey        string
+	appliedID     uint64
+	failedID      uint64          //index of the command the replica failed to apply, 0 if none
+	dirtyExtents  map[uint64]bool //extents written since the applied index was persisted
+	refLock       sync.Mutex      //serializes the reference changes submitted by the leader
+	sync.Mutex
+}
+
+type raftCommand struct {
+	op       uint8
+	extentId uint64
+	offset   int64
+	ino      uint64
+	crc      uint32
+	refs     uint32
+	data     []byte
+}
+
+func (cmd *raftCommand) marshal() (buf []byte) {
+	buf = make([]byte, raftCommandHeaderSize+len(cmd.data))
+	buf[0] = cmd.op
+	binary.BigEndian.PutUint64(buf[1:9], cmd.extentId)
+	binary.BigEndian.PutUint64(buf[9:17], uint64(cmd.offset))
+	binary.BigEndian.PutUint64(buf[17:25], cmd.ino)
+	binary.BigEndian.PutUint32(buf[25:29], cmd.crc)
+	binary.BigEndian.PutUint32(buf[29:33], cmd.refs)
+	binary.BigEndian.PutUint32(buf[33:37], uint32(len(cmd.data)))
+	copy(buf[raftCommandHeaderSize:], cmd.data)
+	return
+}
+
+func (cmd *raftCommand) unmarshal(buf []byte) (err error) {
+	if len(buf) < raftCommandHeaderSize {
+		return ErrRaftCommandSize
+	}
+	size := int(binary.BigEndian.Uint32(buf[33:37]))
+	if len(buf) != raftCommandHeaderSize+size {
+		return ErrRaftCommandSize
+	}
+	cmd.op = buf[0]
+	cmd.extentId = binary.BigEndian.Uint64(buf[1:9])
+	cmd.offset = int64(binary.BigEndian.Uint64(buf[9:17]))
+	cmd.ino = binary.BigEndian.Uint64(buf[17:25])
+	cmd.crc = binary.BigEndian.Uint32(buf[25:29])
+	cmd.refs = binary.BigEndian.Uint32(buf[29:33])
+	cmd.data = buf[raftCommandHeaderSize:]
+	return
+}
+
+func (s *DataNode) startRaftServer() (err error) {
+	if s.raftDir == "" {
+		return
+	}
+	if err = os.MkdirAll(s.raftDir, 0755); err != nil {
+		return errors.Annotatef(err, "create raft dir(%v)", s.raftDir)
+	}
+	raftConf := &raftstore.Config{
+		NodeID:        s.nodeId,
+		WalPath:       s.raftDir,
+		IpAddr:        LocalIP,
+		HeartbeatPort: s.raftHeartbeat,
+		ReplicatePort: s.raftReplicate,
+	}
+	if s.raftStore, err = raftstore.NewRaftStore(raftConf); err != nil {
+		return errors.Annotatef(err, "new raft store")
+	}
+	s.space.RangePartitions(func(partition DataPartition) bool {
+		s.startPartitionRaft(partition)
+		return true
+	})
+	log.LogInfof("action[startRaftServer] nodeId(%v) raftDir(%v) started.", s.nodeId, s.raftDir)
+	return
+}
+
+func (s *DataNode) stopRaftServer() {
+	if s.raftStore != nil {
+		s.raftStore.Stop()
+	}
+}
+
+/*start the raft group of a raft replicated partition, the others are skipped*/
+func (s *DataNode) startPartitionRaft(partition DataPartition) (err error) {
+	dp, ok := partition.(*dataPartition)
+	if !ok || !dp.isRaftReplicated() {
+		return
+	}
+	if s.raftStore == nil {
+		return ErrRaftNotStarted
+	}
+	umpKey := fmt.Sprintf("%s_%s", s.clusterId, UmpModuleName)
+	if err = dp.startRaft(s.raftStore, s.nodeId, s.raftHeartbeat, s.raftReplicate, umpKey); err != nil {
+		log.LogErrorf("action[startPartitionRaft] partition(%v) start raft err(%v).", dp.partitionId, err)
+	}
+	return
+}
+
+/*switch the partition created by the master to the raft replication and start its raft group*/
+func (s *DataNode) createPartitionRaft(partition DataPartition, request *proto.CreateDataPartitionRequest) (err error) {
+	if request.ReplicationMode != proto.ReplicationRaft {
+		return
+	}
+	dp, ok := partition.(*dataPartition)
+	if !ok || s.raftStore == nil {
+		return ErrRaftNotStarted
+	}
+	if err = dp.enableRaft(request.Peers); err != nil {
+		return
+	}
+	return s.startPartitionRaft(dp)
+}
+
+func (dp *dataPartition) isRaftReplicated() bool {
+	dp.epochLock.Lock()
+	defer dp.epochLock.Unlock()
+	return dp.meta != nil && dp.meta.ReplicationMode == proto.ReplicationRaft
+}
+
+func (dp *dataPartition) isRaftLeader() bool {
+	r := dp.raft
+	return r != nil && r.partition != nil && r.partition.IsLeader()
+}
+
+func (dp *dataPartition) raftPeers() (peers []proto.Peer) {
+	dp.epochLock.Lock()
+	defer dp.epochLock.Unlock()
+	return append([]proto.Peer{}, dp.meta.Peers...)
+}
+
+/*switch a partition just created to the raft replication, the raft group is started by the caller*/
+func (dp *dataPartition) enableRaft(peers []proto.Peer) (err error) {
+	dp.epochLock.Lock()
+	defer dp.epochLock.Unlock()
+	if dp.meta.ReplicationMode == proto.ReplicationRaft {
+		return
+	}
+	dp.meta.ReplicationMode = proto.ReplicationRaft
+	dp.meta.Peers = peers
+	return dp.storeMeta()
+}
+
+func (dp *dataPartition) startRaft(store raftstore.RaftStore, nodeId uint64, heartbeatPort, replicatePort int, umpKey string) (err error) {
+	if dp.raft != nil {
+		return
+	}
+	r := &partitionRaft{
+		store:         store,
+		nodeId:        nodeId,
+		heartbeatPort: heartbeatPort,
+		replicatePort: replicatePort,
+		umpKey:        umpKey,
+		dirtyExtents:  make(map[uint64]bool),
+	}
+	if r.appliedID, err = dp.loadApplied(); err != nil {
+		return
+	}
+	peers := make([]raftstore.PeerAddress, 0)
+	for _, peer := range dp.raftPeers() {
+		hbPort, rpPort := r.peerPorts(peer)
+		peers = append(peers, raftstore.PeerAddress{
+			Peer:          raftproto.Peer{ID: peer.ID},
+			Address:       util.GetHost(peer.Addr),
+			HeartbeatPort: hbPort,
+			ReplicatePort: rpPort,
+		})
+	}
+	// the log after the applied index is applied as soon as the raft is created
+	dp.raft = r
+	pc := &raftstore.PartitionConfig{
+		ID:      uint64(dp.partitionId),
+		Applied: r.appliedID,
+		Peers:   peers,
+		SM:      dp,
+	}
+	if r.partition, err = store.CreatePartition(pc); err != nil {
+		dp.raft = nil
+		return
+	}
+	log.LogInfof("action[startRaft] partition(%v) applied(%v) peers(%v).", dp.partitionId, r.appliedID, peers)
+	go dp.raftPersistScheduler(r)
+	return
+}
+
+/*the raft ports of the peer, the ones of the local node if the master didn't know them*/
+func (r *partitionRaft) peerPorts(peer proto.Peer) (heartbeatPort, replicatePort int) {
+	heartbeatPort, replicatePort = peer.HeartbeatPort, peer.ReplicatePort
+	if heartbeatPort <= 0 {
+		heartbeatPort = r.heartbeatPort
+	}
+	if replicatePort <= 0 {
+		replicatePort = r.replicatePort
+	}
+	return
+}
+
+func (dp *dataPartition) stopRaft() {
+	r := dp.raft
+	if r == nil || r.partition == nil {
+		return
+	}
+	if _, err := dp.persistApplied(); err != nil {
+		log.LogErrorf("action[stopRaft] partition(%v) persist applied err(%v).", dp.partitionId, err)
+	}
+	r.partition.Stop()
+}
+
+/*remove the raft log of the partition deleted from the node, after the partition is stopped*/
+func (dp *dataPartition) deleteRaft() {
+	r := dp.raft
+	if r == nil || r.partition == nil {
+		return
+	}
+	if err := r.partition.Delete(); err != nil {
+		log.LogErrorf("action[deleteRaft] partition(%v) err(%v).", dp.partitionId, err)
+	}
+}
+
+func (dp *dataPartition) raftPersistScheduler(r *partitionRaft) {
+	ticker := time.NewTicker(RaftPersistInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-dp.stopC:
+			return
+		case <-ticker.C:
+			applied, err := dp.persistApplied()
+			if err != nil {
+				log.LogErrorf("action[raftPersistScheduler] partition(%v) persist applied err(%v).", dp.partitionId, err)
+				continue
+			}
+			// the entries applied since the persist are replayed after a restart, they are kept
+			r.partition.Truncate(applied)
+		}
+	}
+}
+
+func (dp *dataPartition) loadApplied() (applied uint64, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(path.Join(dp.Path(), RaftApplyFileName)); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// persistApplied syncs the extents written up to the applied index and records
+// the index, the log up to it is not replayed after a restart. The index recorded
+// is returned, the log may only be truncated up to it.
+func (dp *dataPartition) persistApplied() (applied uint64, err error) {
+	r := dp.raft
+	r.Lock()
+	defer r.Unlock()
+	applied = atomic.LoadUint64(&r.appliedID)
+	dirty := r.dirtyExtents
+	r.dirtyExtents = make(map[uint64]bool)
+	for extentId := range dirty {
+		if err = dp.extentStore.Sync(extentId); err != nil && dp.extentStore.IsExistExtent(extentId) {
+			for id := range dirty {
+				r.dirtyExtents[id] = true
+			}
+			return
+		}
+	}
+	tmpFilePath := path.Join(dp.Path(), "."+RaftApplyFileName)
+	if err = writeFileSync(tmpFilePath, []byte(strconv.FormatUint(applied, 10))); err != nil {
+		return
+	}
+	if err = os.Rename(tmpFilePath, path.Join(dp.Path(), RaftApplyFileName)); err != nil {
+		return
+	}
+	err = syncDir(dp.Path())
+	return
+}
+
+func (dp *dataPartition) markDirty(extentId uint64) {
+	r := dp.raft
+	r.Lock()
+	r.dirtyExtents[extentId] = true
+	r.Unlock()
+}
+
+/*submit the command to the raft group, it returns once the command is applied by the leader*/
+func (dp *dataPartition) submitRaft(cmd *raftCommand) (err error) {
+	r := dp.raft
+	if r == nil || r.partition == nil {
+		return ErrRaftNotStarted
+	}
+	if !r.partition.IsLeader() {
+		return ErrRaftNotLeader
+	}
+	if atomic.LoadUint64(&r.failedID) != 0 {
+		return ErrRaftApplyFailed
+	}
+	switch cmd.op {
+	case opRaftAddRef, opRaftMarkDelete:
+		// the commands carry the references after them, so they are applied
+		// again without harm, and are computed by one at a time
+		r.refLock.Lock()
+		defer r.refLock.Unlock()
+		fallthrough
+	case opRaftCreate:
+		// the extent ids are allocated from the creates applied, a new leader
+		// allocates them once it has applied the creates of the former one
+		if status := r.partition.Status(); status.Applied < status.Commit {
+			return ErrRaftApplyPending
+		}
+	}
+	if err = dp.setCommandRefs(cmd); err != nil {
+		return
+	}
+	_, err = r.partition.Submit(cmd.marshal())
+	return
+}
+
+/*the references of the extent after the reference change of cmd, the caller must hold the refLock of the raft*/
+func (dp *dataPartition) setCommandRefs(cmd *raftCommand) (err error) {
+	store := dp.extentStore
+	switch cmd.op {
+	case opRaftAddRef:
+		if !store.IsExistExtent(cmd.extentId) {
+			return ErrRaftNoExtent
+		}
+		cmd.refs = store.Refs(cmd.extentId) + 1
+	case opRaftMarkDelete:
+		// 0 deletes the extent, the last file referring to it is gone
+		if refs := store.Refs(cmd.extentId); refs > 1 {
+			cmd.refs = refs - 1
+		}
+	}
+	return
+}
+
+// Apply applies a command committed in the raft group to the extent store. A
+// command replayed after a restart may be applied already, the creates, writes,
+// deletes and reference changes are applied again without harm.
+func (dp *dataPartition) Apply(command []byte, index uint64) (resp interface{}, err error) {
+	r := dp.raft
+	if atomic.LoadUint64(&r.failedID) != 0 {
+		return nil, ErrRaftApplyFailed
+	}
+	cmd := new(raftCommand)
+	if err = cmd.unmarshal(command); err == nil {
+		err = dp.applyCommand(cmd)
+	}
+	if err != nil && !isRaftRejection(err) {
+		dp.stopApply(index, fmt.Sprintf("op(%v) extent(%v) err(%v)", cmd.op, cmd.extentId, err))
+		return
+	}
+	if err != nil {
+		log.LogWarnf("action[Apply] partition(%v) index(%v) op(%v) extent(%v) refused err(%v).",
+			dp.partitionId, index, cmd.op, cmd.extentId, err)
+	}
+	atomic.StoreUint64(&r.appliedID, index)
+	return
+}
+
+/*the errors of a command refused the same way by every member, the others are failures of the local replica*/
+func isRaftRejection(err error) bool {
+	switch err {
+	case storage.ErrorHasDelete, storage.ErrorExtentShared, storage.ErrPkgCrcMismatch,
+		ErrRaftCommandSize, ErrRaftUnknownOp, ErrRaftNoExtent:
+		return true
+	}
+	return strings.HasPrefix(err.Error(), storage.ErrorParamMismatch.Error())
+}
+
+/*stop applying the log at the command of index the replica failed to apply, the applied index stays before it*/
+func (dp *dataPartition) stopApply(index uint64, reason string) {
+	r := dp.raft
+	if !atomic.CompareAndSwapUint64(&r.failedID, 0, index) {
+		return
+	}
+	dp.ChangeStatus(proto.Unavaliable)
+	msg := fmt.Sprintf("dataPartition(%v) stopped applying the raft log at index(%v) applied(%v), "+
+		"the replica is unavailable until restarted or replaced: %v", dp.partitionId, index, atomic.LoadUint64(&r.appliedID), reason)
+	log.LogErrorf("action[stopApply] %v", msg)
+	master.WarnBySpecialUmpKey(r.umpKey, msg)
+}
+
+/*the replica stopped applying the log of its raft group*/
+func (dp *dataPartition) isRaftApplyFailed() bool {
+	r := dp.raft
+	return r != nil && atomic.LoadUint64(&r.failedID) != 0
+}
+
+func (dp *dataPartition) applyCommand(cmd *raftCommand) (err error) {
+	store := dp.extentStore
+	// a delete of the last reference is applied again without the extent
+	if cmd.op != opRaftCreate && (cmd.op != opRaftMarkDelete || cmd.refs > 0) && !store.IsExistExtent(cmd.extentId) {
+		return ErrRaftNoExtent
+	}
+	switch cmd.op {
+	case opRaftCreate:
+		// a create replayed, the extent may be deleted by a command after it
+		if store.IsExistExtent(cmd.extentId) || store.IsMarkDeleted(cmd.extentId) {
+			return store.UpdateBaseExtentId(cmd.extentId)
+		}
+		if err = store.Create(cmd.extentId, cmd.ino, false); err == nil && len(cmd.data) >= 8 {
+			// the preallocation is a hint, the extent is usable without it
+			store.Preallocate(cmd.extentId, int64(binary.BigEndian.Uint64(cmd.data)))
+		}
+	case opRaftWrite:
+		if err = store.Write(cmd.extentId, cmd.offset, int64(len(cmd.data)), cmd.data, cmd.crc); err == nil {
+			dp.markDirty(cmd.extentId)
+		}
+	case opRaftMarkDelete:
+		if cmd.refs > 0 {
+			err = store.SetRefs(cmd.extentId, cmd.refs)
+		} else {
+			err = store.ForceMarkDelete(cmd.extentId)
+		}
+	case opRaftAddRef:
+		err = store.SetRefs(cmd.extentId, cmd.refs)
+	case opRaftPunchHole:
+		if len(cmd.data) < 8 {
+			return ErrRaftCommandSize
+		}
+		if err = store.PunchHole(cmd.extentId, cmd.offset, int64(binary.BigEndian.Uint64(cmd.data))); err == nil {
+			dp.markDirty(cmd.extentId)
+		}
+	default:
+		err = ErrRaftUnknownOp
+	}
+	return
+}
+
+// ApplyMemberChange updates the peers kept in the meta file of the partition.
+// The replica removed is deleted by the master once the change is done.
+func (dp *dataPartition) ApplyMemberChange(confChange *raftproto.ConfChange, index uint64) (resp interface{}, err error) {
+	r := dp.raft
+	if atomic.LoadUint64(&r.failedID) != 0 {
+		return nil, ErrRaftApplyFailed
+	}
+	req := &proto.DataPartitionOfflineRequest{}
+	if err = json.Unmarshal(confChange.Context, req); err != nil {
+		// refused by every member
+		atomic.StoreUint64(&r.appliedID, index)
+		return
+	}
+	defer func() {
+		if err != nil {
+			dp.stopApply(index, fmt.Sprintf("member change(%v) err(%v)", confChange.Type, err))
+			return
+		}
+		atomic.StoreUint64(&r.appliedID, index)
+	}()
+	dp.epochLock.Lock()
+	defer dp.epochLock.Unlock()
+	peers := dp.meta.Peers
+	switch confChange.Type {
+	case raftproto.ConfAddNode:
+		for _, peer := range peers {
+			if peer.ID == req.AddPeer.ID {
+				return
+			}
+		}
+		peers = append(peers, req.AddPeer)
+		hbPort, rpPort := r.peerPorts(req.AddPeer)
+		r.store.AddNodeWithPort(req.AddPeer.ID, util.GetHost(req.AddPeer.Addr), hbPort, rpPort)
+	case raftproto.ConfRemoveNode:
+		removed := make([]proto.Peer, 0, len(peers))
+		for _, peer := range peers {
+			if peer.ID != req.RemovePeer.ID {
+				removed = append(removed, peer)
+			}
+		}
+		if len(removed) == len(peers) {
+			return
+		}
+		peers = removed
+		if req.RemovePeer.ID == r.nodeId {
+			log.LogWarnf("action[ApplyMemberChange] partition(%v) removed from the raft group.", dp.partitionId)
+		}
+	default:
+		return
+	}
+	orgPeers := dp.meta.Peers
+	dp.meta.Peers = peers
+	if err = dp.storeMeta(); err != nil {
+		dp.meta.Peers = orgPeers
+		return
+	}
+	log.LogInfof("action[ApplyMemberChange] partition(%v) index(%v) peers from(%v) to(%v).",
+		dp.partitionId, index, orgPeers, peers)
+	return
+}
+
+func (dp *dataPartition) Snapshot() (raftproto.Snapshot, error) {
+	if dp.isRaftApplyFailed() {
+		return nil, ErrRaftApplyFailed
+	}
+	applied := atomic.LoadUint64(&dp.raft.appliedID)
+	extents, err := dp.extentStore.GetAllWatermark(nil)
+	if err != nil {
+		return nil, err
+	}
+	return newExtentSnapshotIterator(dp.extentStore, applied, extents), nil
+}
+
+// ApplySnapshot replaces the extents of the partition with the ones of the
+// leader, the local extents missing in the snapshot are deleted.
+func (dp *dataPartition) ApplySnapshot(peers []raftproto.Peer, iter raftproto.SnapIterator) (err error) {
+	var (
+		data    []byte
+		applied uint64
+		index   int
+		store   = dp.extentStore
+		seen    = make(map[uint64]bool)
+	)
+	for {
+		if data, err = iter.Next(); err != nil {
+			break
+		}
+		if index == 0 {
+			if len(data) != 8 {
+				return ErrRaftCommandSize
+			}
+			applied = binary.BigEndian.Uint64(data)
+			index++
+			continue
+		}
+		index++
+		cmd := new(raftCommand)
+		if err = cmd.unmarshal(data); err != nil {
+			return
+		}
+		seen[cmd.extentId] = true
+		if err = dp.applyCommand(cmd); err != nil {
+			return
+		}
+		if cmd.op == opRaftCreate && store.Refs(cmd.extentId) != cmd.refs {
+			if err = store.SetRefs(cmd.extentId, cmd.refs); err != nil {
+				return
+			}
+		}
+	}
+	if err != io.EOF {
+		log.LogErrorf("action[ApplySnapshot] partition(%v) err(%v).", dp.partitionId, err)
+		return
+	}
+	var extents []*storage.FileInfo
+	if extents, err = store.GetAllWatermark(nil); err != nil {
+		return
+	}
+	for _, extent := range extents {
+		if !extent.Deleted && !seen[uint64(extent.FileId)] {
+			store.ForceMarkDelete(uint64(extent.FileId))
+		}
+	}
+	atomic.StoreUint64(&dp.raft.appliedID, applied)
+	if _, err = dp.persistApplied(); err != nil {
+		return
+	}
+	// the extents of the leader replace the ones the replica failed to apply to
+	if failed := atomic.SwapUint64(&dp.raft.failedID, 0); failed != 0 {
+		dp.statusUpdate()
+		log.LogWarnf("action[ApplySnapshot] partition(%v) failed at index(%v) resumes applying.", dp.partitionId, failed)
+	}
+	log.LogInfof("action[ApplySnapshot] partition(%v) applied(%v) extents(%v).", dp.partitionId, applied, len(seen))
+	return
+}
+
+func (dp *dataPartition) HandleFatalEvent(err *raft.FatalError) {
+	log.LogFatalf("action[HandleFatalEvent] partition(%v) err(%v).", dp.partitionId, err)
+}
+
+func (dp *dataPartition) HandleLeaderChange(leader uint64) {
+	log.LogInfof("action[HandleLeaderChange] partition(%v) leader(%v).", dp.partitionId, leader)
+}
+
+func (dp *dataPartition) Put(key, val interface{}) (resp interface{}, err error) {
+	return nil, nil
+}
+
+func (dp *dataPartition) Get(key interface{}) (interface{}, error) {
+	return nil, nil
+}
+
+func (dp *dataPartition) Del(key interface{}) (interface{}, error) {
+	return nil, nil
+}
+
+// extentSnapshotIterator streams the applied index, then a create and the data
+// of every extent in blocks. The extents are read while the partition applies,
+// the log after the applied index is replayed on them.
+type extentSnapshotIterator struct {
+	store   *storage.ExtentStore
+	applied uint64
+	extents []*storage.FileInfo
+	cur     int
+	offset  int64
+	created bool
+	started bool
+}
+
+func newExtentSnapshotIterator(store *storage.ExtentStore, applied uint64, extents []*storage.FileInfo) *extentSnapshotIterator {
+	return &extentSnapshotIterator{store: store, applied: applied, extents: extents}
+}
+
+func (si *extentSnapshotIterator) ApplyIndex() uint64 {
+	return si.applied
+}
+
+func (si *extentSnapshotIterator) Close() {
+	si.cur = len(si.extents)
+}
+
+func (si *extentSnapshotIterator) Next() (data []byte, err error) {
+	if !si.started {
+		si.started = true
+		data = make([]byte, 8)
+		binary.BigEndian.PutUint64(data, si.applied)
+		return
+	}
+	for si.cur < len(si.extents) {
+		extent := si.extents[si.cur]
+		extentId := uint64(extent.FileId)
+		if extent.Deleted || !si.store.IsExistExtent(extentId) {
+			si.nextExtent()
+			continue
+		}
+		if !si.created {
+			si.created = true
+			cmd := &raftCommand{op: opRaftCreate, extentId: extentId, ino: extent.Inode, refs: si.store.Refs(extentId)}
+			return cmd.marshal(), nil
+		}
+		if si.offset >= int64(extent.Size) {
+			si.nextExtent()
+			continue
+		}
+		size := util.Min(int(int64(extent.Size)-si.offset), util.BlockSize)
+		cmd := &raftCommand{op: opRaftWrite, extentId: extentId, offset: si.offset, data: make([]byte, size)}
+		if cmd.crc, err = si.store.Read(extentId, si.offset, int64(size), cmd.data); err != nil {
+			if err == storage.ErrorHasDelete {
+				// deleted since listed, the delete is replayed by the log
+				si.nextExtent()
+				continue
+			}
+			return
+		}
+		si.offset += int64(size)
+		return cmd.marshal(), nil
+	}
+	return nil, io.EOF
+}
+
+func (si *extentSnapshotIterator) nextExtent() {
+	si.cur++
+	si.offset = 0
+	si.created = false
+}
+
+/*the extent ops of the clients, replicated by the raft group of a raft replicated partition instead of the chain*/
+func (p *Packet) isRaftCommand() bool {
+	if p.StoreMode != proto.ExtentStoreMode {
+		return false
+	}
+	switch p.Opcode {
+	case proto.OpCreateFile, proto.OpWrite, proto.OpMarkDelete, proto.OpAddExtentRef, proto.OpPunchHole:
+		return true
+	}
+	return false
+}
+
+func (s *DataNode) handleRaftCommand(dp *dataPartition, pkg *Packet) {
+	var action string
+	cmd := &raftCommand{extentId: pkg.FileID, offset: pkg.Offset, crc: pkg.Crc}
+	switch pkg.Opcode {
+	case proto.OpCreateFile:
+		action = LogCreateFile
+		cmd.op = opRaftCreate
+		if len(pkg.Data) >= 8 && pkg.Size >= 8 {
+			cmd.ino = binary.BigEndian.Uint64(pkg.Data)
+		}
+		if prealloc := createPrealloc(pkg); prealloc > 0 {
+			cmd.data = pkg.Data[8:16]
+		}
+	case proto.OpWrite:
+		action = LogWrite
+		cmd.op = opRaftWrite
+		cmd.data = pkg.Data[:pkg.Size]
+		dp.runtimeMetrics.BeginWrite()
+		defer dp.runtimeMetrics.EndWrite()
+	case proto.OpMarkDelete:
+		action = LogMarkDel
+		cmd.op = opRaftMarkDelete
+	case proto.OpAddExtentRef:
+		action = LogAddExtentRef
+		cmd.op = opRaftAddRef
+	case proto.OpPunchHole:
+		action = LogPunchHole
+		cmd.op = opRaftPunchHole
+		if len(pkg.Data) >= 8 && pkg.Size >= 8 {
+			cmd.data = pkg.Data[:8]
+		}
+	}
+	var err error
+	if pkg.Opcode == proto.OpCreateFile || pkg.Opcode == proto.OpWrite {
+		if dp.Status() == proto.ReadOnly {
+			err = storage.ErrorPartitionReadOnly
+		} else if dp.Available() <= 0 {
+			err = storage.ErrSyscallNoSpace
+		}
+	}
+	if err == nil {
+		err = dp.submitRaft(cmd)
+	}
+	if pkg.Opcode == proto.OpWrite {
+		s.addDiskErrs(pkg.PartitionID, err, WriteFlag)
+	}
+	if err != nil {
+		err = errors.Annotatef(err, "Request(%v) raft %v Error", pkg.GetUniqueLogId(), pkg.GetOpMsg())
+		pkg.PackErrorBody(action, err.Error())
+		return
+	}
+	// the command holds a copy of the data
+	if pkg.Opcode == proto.OpWrite {
+		proto.Buffers.Free(pkg.Data)
+	}
+	pkg.PackOkReply()
+}
+
+// Handle OpOfflineDataPartition packet.
+func (s *DataNode) handleOfflineDataPartition(pkg *Packet) {
+	task := &proto.AdminTask{}
+	json.Unmarshal(pkg.Data, task)
+	pkg.PackOkReply()
+	s.taskEngine.Submit(task, s.offlineDataPartition)
+}
+
+func (s *DataNode) offlineDataPartition(task *proto.AdminTask) (resp interface{}, status int8) {
+	var err error
+	request := &proto.DataPartitionOfflineRequest{}
+	response := &proto.DataPartitionOfflineResponse{}
+	if task.OpCode == proto.OpOfflineDataPartition {
+		data, _ := json.Marshal(task.Request)
+		if err = json.Unmarshal(data, request); err == nil {
+			err = s.changeRaftMember(request)
+		}
+	} else {
+		err = ErrorUnknownOp
+	}
+	response.PartitionId = request.PartitionId
+	response.RemovePeer = request.RemovePeer
+	if err != nil {
+		response.Status = proto.TaskFail
+		response.Result = err.Error()
+		response.ErrCode = errCodeOf(response.Result)
+		log.LogErrorf("action[offlineDataPartition] from master Task(%v) failed, err(%v)", task.ToString(), err)
+	} else {
+		response.Status = proto.TaskSuccess
+	}
+	return response, int8(response.Status)
+}
+
+/*add the new peer to the raft group first, then remove the offline one, so the group keeps a majority*/
+func (s *DataNode) changeRaftMember(req *proto.DataPartitionOfflineRequest) (err error) {
+	dp, ok := s.space.GetPartition(uint32(req.PartitionId)).(*dataPartition)
+	if !ok {
+		return ErrPartitionNotExist
+	}
+	r := dp.raft
+	if r == nil || r.partition == nil {
+		return ErrRaftNotStarted
+	}
+	context, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+	if _, err = r.partition.ChangeMember(raftproto.ConfAddNode, raftproto.Peer{ID: req.AddPeer.ID}, context); err != nil {
+		return errors.Annotatef(err, "partition(%v) add peer(%v)", req.PartitionId, req.AddPeer)
+	}
+	if _, err = r.partition.ChangeMember(raftproto.ConfRemoveNode, raftproto.Peer{ID: req.RemovePeer.ID}, context); err != nil {
+		return errors.Annotatef(err, "partition(%v) remove peer(%v)", req.PartitionId, req.RemovePeer)
+	}
+	log.LogWarnf("action[changeRaftMember] partition(%v) peer(%v) replaced by(%v).", req.PartitionId, req.RemovePeer, req.AddPeer)
+	return
+}
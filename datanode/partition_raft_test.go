@@ -0,0 +1,305 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"bytes"
+	"encoding/json"
+	"hash/crc32"
+	"os"
+	"path"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/raftstore"
+	"github.com/tiglabs/containerfs/storage"
+	raftproto "github.com/tiglabs/raft/proto"
+)
+
+/*the raft store of the tests keeps the nodes added*/
+type testRaftStore struct {
+	raftstore.RaftStore
+	nodes map[uint64]string
+}
+
+func (s *testRaftStore) AddNodeWithPort(nodeId uint64, addr string, heartbeat int, replicate int) {
+	s.nodes[nodeId] = addr
+}
+
+/*the raft partition of the tests keeps the member changes submitted*/
+type testRaftPartition struct {
+	raftstore.Partition
+	changes []raftproto.ConfChangeType
+	peers   []uint64
+}
+
+func (p *testRaftPartition) ChangeMember(changeType raftproto.ConfChangeType, peer raftproto.Peer, context []byte) (resp interface{}, err error) {
+	p.changes = append(p.changes, changeType)
+	p.peers = append(p.peers, peer.ID)
+	return
+}
+
+/*a raft replicated partition of the tests with its extent store in a temp dir*/
+func newTestRaftPartition(t *testing.T) *dataPartition {
+	dir := testPartitionDir(t)
+	store, err := storage.NewExtentStoreWithIO(dir, 1024, storage.SyncIO)
+	if err != nil {
+		t.Fatalf("new extent store: %v", err)
+	}
+	meta := testPartitionMeta(1)
+	meta.ReplicationMode = proto.ReplicationRaft
+	meta.Peers = []proto.Peer{{ID: 1, Addr: "10.0.0.1:17310"}, {ID: 2, Addr: "10.0.0.2:17310"}}
+	return &dataPartition{
+		partitionId:  7,
+		path:         dir,
+		extentStore:  store,
+		meta:         meta,
+		replicaHosts: make([]string, 0),
+		raft: &partitionRaft{
+			store:        &testRaftStore{nodes: make(map[uint64]string)},
+			nodeId:       1,
+			dirtyExtents: make(map[uint64]bool),
+		},
+	}
+}
+
+func closeTestRaftPartition(dp *dataPartition) {
+	dp.extentStore.Close()
+	os.RemoveAll(path.Dir(dp.path))
+}
+
+func applyTestCommands(t *testing.T, dp *dataPartition, cmds []*raftCommand) {
+	for i, cmd := range cmds {
+		if _, err := dp.Apply(cmd.marshal(), uint64(i+1)); err != nil {
+			t.Fatalf("apply index(%v) op(%v): %v", i+1, cmd.op, err)
+		}
+	}
+}
+
+func readTestExtent(t *testing.T, store *storage.ExtentStore, extentId uint64, size int) []byte {
+	data := make([]byte, size)
+	if _, err := store.Read(extentId, 0, int64(size), data); err != nil {
+		t.Fatalf("read extent(%v): %v", extentId, err)
+	}
+	return data
+}
+
+func TestRaftCommand_Marshal(t *testing.T) {
+	cases := []*raftCommand{
+		{op: opRaftCreate, extentId: 1025, ino: 9, data: []byte{0, 0, 0, 0, 0, 0, 0x10, 0}},
+		{op: opRaftWrite, extentId: 1025, offset: 4096, ino: 9, crc: 0xdeadbeef, data: []byte("hello")},
+		{op: opRaftMarkDelete, extentId: 1026, refs: 3},
+		{op: opRaftAddRef, extentId: 1<<63 + 1, offset: -1, refs: 1<<32 - 1},
+	}
+	for _, c := range cases {
+		buf := c.marshal()
+		if len(buf) != raftCommandHeaderSize+len(c.data) {
+			t.Fatalf("op(%v) marshaled size(%v)", c.op, len(buf))
+		}
+		cmd := new(raftCommand)
+		if err := cmd.unmarshal(buf); err != nil {
+			t.Fatalf("op(%v) unmarshal: %v", c.op, err)
+		}
+		if len(c.data) == 0 {
+			c.data = []byte{}
+		}
+		if !reflect.DeepEqual(cmd, c) {
+			t.Fatalf("unmarshaled %+v want %+v", cmd, c)
+		}
+	}
+	buf := cases[1].marshal()
+	for _, broken := range [][]byte{buf[:raftCommandHeaderSize-1], buf[:len(buf)-1], append(buf, 0)} {
+		if err := new(raftCommand).unmarshal(broken); err != ErrRaftCommandSize {
+			t.Fatalf("unmarshal of size(%v): err(%v) want(%v)", len(broken), err, ErrRaftCommandSize)
+		}
+	}
+}
+
+func TestDataPartition_ApplyReplay(t *testing.T) {
+	dp := newTestRaftPartition(t)
+	defer closeTestRaftPartition(dp)
+	data := []byte("the data replayed")
+	cmds := []*raftCommand{
+		{op: opRaftCreate, extentId: 1025, ino: 9},
+		{op: opRaftWrite, extentId: 1025, data: data, crc: crc32.ChecksumIEEE(data)},
+		{op: opRaftAddRef, extentId: 1025, refs: 2},
+		{op: opRaftMarkDelete, extentId: 1025, refs: 1},
+		{op: opRaftCreate, extentId: 1026, ino: 10},
+		{op: opRaftMarkDelete, extentId: 1026},
+	}
+	applyTestCommands(t, dp, cmds)
+	// the log after the applied index persisted is replayed after a restart
+	applyTestCommands(t, dp, cmds)
+	if failed := atomic.LoadUint64(&dp.raft.failedID); failed != 0 {
+		t.Fatalf("replay failed at index(%v)", failed)
+	}
+	if applied := atomic.LoadUint64(&dp.raft.appliedID); applied != uint64(len(cmds)) {
+		t.Fatalf("applied(%v) want(%v)", applied, len(cmds))
+	}
+	store := dp.extentStore
+	if refs := store.Refs(1025); refs != 1 {
+		t.Fatalf("extent refs(%v) want(1)", refs)
+	}
+	if got := readTestExtent(t, store, 1025, len(data)); !bytes.Equal(got, data) {
+		t.Fatalf("extent data(%q) want(%q)", got, data)
+	}
+	if info, err := store.GetWatermark(1026, false); err == nil && !info.Deleted {
+		t.Fatalf("deleted extent replayed: %+v", info)
+	}
+	if !dp.raft.dirtyExtents[1025] {
+		t.Fatalf("written extent not dirty")
+	}
+}
+
+func TestDataPartition_PersistApplied(t *testing.T) {
+	dp := newTestRaftPartition(t)
+	defer closeTestRaftPartition(dp)
+	data := []byte("persisted")
+	applyTestCommands(t, dp, []*raftCommand{
+		{op: opRaftCreate, extentId: 1025, ino: 9},
+		{op: opRaftWrite, extentId: 1025, data: data, crc: crc32.ChecksumIEEE(data)},
+	})
+	applied, err := dp.persistApplied()
+	if err != nil || applied != 2 {
+		t.Fatalf("persist: applied(%v) err(%v)", applied, err)
+	}
+	if len(dp.raft.dirtyExtents) != 0 {
+		t.Fatalf("dirty extents after the persist: %v", dp.raft.dirtyExtents)
+	}
+	// the index applied after the persist is not the one on disk
+	atomic.StoreUint64(&dp.raft.appliedID, 5)
+	if loaded, err := dp.loadApplied(); err != nil || loaded != applied {
+		t.Fatalf("loaded applied(%v) err(%v) want(%v)", loaded, err, applied)
+	}
+	if applied, err = dp.persistApplied(); err != nil || applied != 5 {
+		t.Fatalf("persist again: applied(%v) err(%v)", applied, err)
+	}
+	if loaded, err := dp.loadApplied(); err != nil || loaded != 5 {
+		t.Fatalf("loaded applied(%v) err(%v) want(5)", loaded, err)
+	}
+}
+
+func TestDataPartition_ApplySnapshot(t *testing.T) {
+	leader := newTestRaftPartition(t)
+	defer closeTestRaftPartition(leader)
+	follower := newTestRaftPartition(t)
+	defer closeTestRaftPartition(follower)
+	data := bytes.Repeat([]byte("snapshot"), 1024)
+	applyTestCommands(t, leader, []*raftCommand{
+		{op: opRaftCreate, extentId: 1025, ino: 9},
+		{op: opRaftWrite, extentId: 1025, data: data, crc: crc32.ChecksumIEEE(data)},
+		{op: opRaftAddRef, extentId: 1025, refs: 2},
+		{op: opRaftCreate, extentId: 1027, ino: 11},
+	})
+	// the follower has an extent the leader deleted in the log it missed
+	applyTestCommands(t, follower, []*raftCommand{
+		{op: opRaftCreate, extentId: 1025, ino: 9},
+		{op: opRaftCreate, extentId: 1026, ino: 10},
+	})
+	snapshot, err := leader.Snapshot()
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	defer snapshot.Close()
+	if err = follower.ApplySnapshot(nil, snapshot); err != nil {
+		t.Fatalf("apply snapshot: %v", err)
+	}
+	store := follower.extentStore
+	if got := readTestExtent(t, store, 1025, len(data)); !bytes.Equal(got, data) {
+		t.Fatalf("extent data mismatch after the snapshot")
+	}
+	if refs := store.Refs(1025); refs != 2 {
+		t.Fatalf("extent refs(%v) want(2)", refs)
+	}
+	if !store.IsExistExtent(1027) {
+		t.Fatalf("extent of the snapshot not created")
+	}
+	if info, err := store.GetWatermark(1026, false); err == nil && !info.Deleted {
+		t.Fatalf("local extent missing from the snapshot kept: %+v", info)
+	}
+	if loaded, err := follower.loadApplied(); err != nil || loaded != 4 {
+		t.Fatalf("applied of the snapshot(%v) err(%v) want(4)", loaded, err)
+	}
+}
+
+func TestDataPartition_ApplyMemberChange(t *testing.T) {
+	dp := newTestRaftPartition(t)
+	defer closeTestRaftPartition(dp)
+	req := &proto.DataPartitionOfflineRequest{
+		PartitionId: 7,
+		AddPeer:     proto.Peer{ID: 3, Addr: "10.0.0.3:17310"},
+		RemovePeer:  proto.Peer{ID: 2, Addr: "10.0.0.2:17310"},
+	}
+	context, _ := json.Marshal(req)
+	changes := []*raftproto.ConfChange{
+		{Type: raftproto.ConfAddNode, Context: context},
+		{Type: raftproto.ConfRemoveNode, Context: context},
+	}
+	// the changes replayed keep the peers
+	for round := 0; round < 2; round++ {
+		for i, change := range changes {
+			if _, err := dp.ApplyMemberChange(change, uint64(i+1)); err != nil {
+				t.Fatalf("apply member change(%v): %v", change.Type, err)
+			}
+		}
+	}
+	want := []proto.Peer{{ID: 1, Addr: "10.0.0.1:17310"}, req.AddPeer}
+	if !reflect.DeepEqual(dp.meta.Peers, want) {
+		t.Fatalf("peers %v want %v", dp.meta.Peers, want)
+	}
+	if addr := dp.raft.store.(*testRaftStore).nodes[3]; addr != "10.0.0.3" {
+		t.Fatalf("peer added to the raft store at(%v)", addr)
+	}
+	meta, _, err := loadDataPartitionMeta(dp.path)
+	if err != nil || !reflect.DeepEqual(meta.Peers, want) {
+		t.Fatalf("stored peers %v err(%v) want %v", meta.Peers, err, want)
+	}
+	if _, err = dp.ApplyMemberChange(&raftproto.ConfChange{Type: raftproto.ConfAddNode, Context: []byte("{")}, 3); err == nil {
+		t.Fatalf("member change of a broken context applied")
+	}
+	if applied := atomic.LoadUint64(&dp.raft.appliedID); applied != 3 || dp.isRaftApplyFailed() {
+		t.Fatalf("broken member change: applied(%v) failed(%v)", applied, dp.isRaftApplyFailed())
+	}
+}
+
+func TestDataNode_ChangeRaftMember(t *testing.T) {
+	dp := newTestRaftPartition(t)
+	defer closeTestRaftPartition(dp)
+	s := &DataNode{space: &spaceManager{partitions: make(map[uint32]DataPartition)}}
+	req := &proto.DataPartitionOfflineRequest{
+		PartitionId: 7,
+		AddPeer:     proto.Peer{ID: 3, Addr: "10.0.0.3:17310"},
+		RemovePeer:  proto.Peer{ID: 2, Addr: "10.0.0.2:17310"},
+	}
+	if err := s.changeRaftMember(req); err != ErrPartitionNotExist {
+		t.Fatalf("change of a partition not on the node: err(%v)", err)
+	}
+	s.space.(*spaceManager).partitions[7] = dp
+	if err := s.changeRaftMember(req); err != ErrRaftNotStarted {
+		t.Fatalf("change without the raft started: err(%v)", err)
+	}
+	partition := &testRaftPartition{}
+	dp.raft.partition = partition
+	if err := s.changeRaftMember(req); err != nil {
+		t.Fatalf("change: %v", err)
+	}
+	// the new peer joins before the one replaced leaves
+	if !reflect.DeepEqual(partition.changes, []raftproto.ConfChangeType{raftproto.ConfAddNode, raftproto.ConfRemoveNode}) ||
+		!reflect.DeepEqual(partition.peers, []uint64{3, 2}) {
+		t.Fatalf("changes %v of peers %v", partition.changes, partition.peers)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+// The master seals the partitions of append-once workloads and lists the sealed
+// partitions of the node in the heartbeat. A sealed partition refuses the creates
+// and the writes like a full one, its extent store records the extents in
+// EXTENT_SEAL, and its periodic repair is skipped while the master finds the seal
+// crc of every replica the same. The seal is kept in the meta file of the
+// partition, so it survives restarts and archives.
+
+func (dp *dataPartition) IsSealed() bool {
+	dp.epochLock.Lock()
+	defer dp.epochLock.Unlock()
+	return dp.meta != nil && dp.meta.Sealed
+}
+
+/*the partition is sealed and the master found its replicas the same*/
+func (dp *dataPartition) isSealedInSync() bool {
+	return atomic.LoadInt32(&dp.sealInSync) == 1 && dp.IsSealed()
+}
+
+/*seal or unseal the partition as the master asks, in the background as the seal waits for the writes*/
+func (dp *dataPartition) updateSeal(sealed, inSync bool) {
+	if inSync {
+		atomic.StoreInt32(&dp.sealInSync, 1)
+	} else {
+		atomic.StoreInt32(&dp.sealInSync, 0)
+	}
+	if sealed == dp.IsSealed() || !atomic.CompareAndSwapInt32(&dp.isSealing, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&dp.isSealing, 0)
+		var err error
+		if sealed {
+			err = dp.sealPartition()
+		} else {
+			err = dp.unsealPartition()
+		}
+		if err != nil {
+			log.LogErrorf("action[updateSeal] partition(%v) sealed(%v) err(%v).", dp.partitionId, sealed, err)
+			return
+		}
+		log.LogWarnf("action[updateSeal] partition(%v) sealed(%v).", dp.partitionId, sealed)
+	}()
+}
+
+func (dp *dataPartition) sealPartition() (err error) {
+	if err = dp.seal(); err == nil {
+		err = dp.extentStore.Seal()
+	}
+	if err == nil {
+		err = dp.setMetaSealed(true)
+	}
+	if err != nil {
+		dp.extentStore.Unseal()
+		dp.unseal()
+	}
+	return
+}
+
+func (dp *dataPartition) unsealPartition() (err error) {
+	if err = dp.setMetaSealed(false); err != nil {
+		return
+	}
+	if err = dp.extentStore.Unseal(); err != nil {
+		return
+	}
+	dp.unseal()
+	return
+}
+
+func (dp *dataPartition) setMetaSealed(sealed bool) (err error) {
+	dp.epochLock.Lock()
+	defer dp.epochLock.Unlock()
+	dp.meta.Sealed = sealed
+	if err = dp.storeMeta(); err != nil {
+		dp.meta.Sealed = !sealed
+	}
+	return
+}
+
+/*the manifest comparing the extents of the partition with a copy of it, of the seal if sealed*/
+func (dp *dataPartition) Manifest() (manifest *proto.PartitionManifest, err error) {
+	if dp.meta == nil || dp.meta.PartitionType != proto.ExtentPartition {
+		return nil, fmt.Errorf("partition(%v) is not an extent partition", dp.partitionId)
+	}
+	digests, sealed, err := dp.extentStore.Manifest()
+	if err != nil {
+		return
+	}
+	return proto.NewPartitionManifest(uint64(dp.partitionId), dp.volumeId, sealed, digests), nil
+}
+
+/*record the extents repaired on a sealed partition in its seal again*/
+func (dp *dataPartition) resealAfterRepair() {
+	if !dp.IsSealed() {
+		return
+	}
+	if err := dp.extentStore.Seal(); err != nil {
+		log.LogErrorf("action[resealAfterRepair] partition(%v) err(%v).", dp.partitionId, err)
+	}
+}
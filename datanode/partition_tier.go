@@ -0,0 +1,298 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/storage"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	ColdTierCheckInterval  = time.Hour
+	ColdTierRequestTimeout = 5 * time.Minute
+)
+
+var (
+	coldTierTarget  string //prefix of the URLs of the tiered extents, empty disables the cold tier
+	coldTierCluster string //the objects are under the name of the cluster
+	coldTierRecall  bool   //recall the data of a tiered extent read to the local disk
+	coldTierClient  = &http.Client{Timeout: ColdTierRequestTimeout}
+)
+
+// the cold tier of the extents of a partition, an S3-compatible bucket reached
+// by plain HTTP like the archive target, the objects are under the cluster name
+// and the partition id. The reference of a replica to an object is an empty
+// object KEY.refs/HOST of its host.
+type httpColdTier struct {
+	prefix    string
+	partition *dataPartition
+}
+
+func newHTTPColdTier(target, cluster string, dp *dataPartition) *httpColdTier {
+	return &httpColdTier{
+		prefix:    strings.TrimSuffix(target, "/") + "/" + cluster + "/" + strconv.FormatUint(uint64(dp.partitionId), 10) + "/",
+		partition: dp,
+	}
+}
+
+func refKey(key, host string) string {
+	return key + ".refs/" + host
+}
+
+/*the replica hosts of the partition, the one of this node apart*/
+func (t *httpColdTier) hosts() (local string, others []string, err error) {
+	for _, host := range t.partition.ReplicaHosts() {
+		if local == "" && isLocalHost(host) {
+			local = host
+		} else {
+			others = append(others, host)
+		}
+	}
+	if local == "" {
+		err = fmt.Errorf("partition(%v) no replica of the local node in %v", t.partition.partitionId, t.partition.ReplicaHosts())
+	}
+	return
+}
+
+func (t *httpColdTier) do(method, key string, body io.Reader, size int64, header http.Header) (resp *http.Response, err error) {
+	var req *http.Request
+	if req, err = http.NewRequest(method, t.prefix+key, body); err != nil {
+		return
+	}
+	req.ContentLength = size
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	return coldTierClient.Do(req)
+}
+
+func (t *httpColdTier) Put(key string, data io.Reader, size int64) (err error) {
+	resp, err := t.do(http.MethodPut, key, data, size, nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("put %v%v status(%v)", t.prefix, key, resp.Status)
+	}
+	return
+}
+
+func (t *httpColdTier) Exist(key string, size int64) bool {
+	resp, err := t.do(http.MethodHead, key, nil, 0, nil)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK && resp.ContentLength == size
+}
+
+func (t *httpColdTier) ReadAt(key string, data []byte, offset int64) (n int, err error) {
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%v-%v", offset, offset+int64(len(data))-1)}}
+	resp, err := t.do(http.MethodGet, key, nil, 0, header)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("get %v%v range(%v) status(%v)", t.prefix, key, header.Get("Range"), resp.Status)
+	}
+	return io.ReadFull(resp.Body, data)
+}
+
+func (t *httpColdTier) Get(key string) (data io.ReadCloser, err error) {
+	resp, err := t.do(http.MethodGet, key, nil, 0, nil)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("get %v%v status(%v)", t.prefix, key, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (t *httpColdTier) Ref(key string) (err error) {
+	local, _, err := t.hosts()
+	if err != nil {
+		return
+	}
+	return t.Put(refKey(key, local), bytes.NewReader(nil), 0)
+}
+
+func (t *httpColdTier) Unref(key string) (err error) {
+	local, others, err := t.hosts()
+	if err != nil {
+		return
+	}
+	if err = t.Delete(refKey(key, local)); err != nil {
+		return
+	}
+	for _, host := range others {
+		// the object is kept unless the reference is known to be gone
+		resp, err := t.do(http.MethodHead, refKey(key, host), nil, 0, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			return nil
+		}
+	}
+	return t.Delete(key)
+}
+
+func (t *httpColdTier) Delete(key string) (err error) {
+	resp, err := t.do(http.MethodDelete, key, nil, 0, nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("delete %v%v status(%v)", t.prefix, key, resp.Status)
+	}
+	return
+}
+
+/*move the extents of the partition not read for the days of the vol to the cold tier*/
+func (dp *dataPartition) coldTierScheduler() {
+	ticker := time.NewTicker(ColdTierCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			dp.tierColdExtents()
+		case <-dp.stopC:
+			return
+		}
+	}
+}
+
+func (dp *dataPartition) tierColdExtents() {
+	days := atomic.LoadInt32(&dp.coldTierDays)
+	if days <= 0 || dp.extentStore.EncryptionKeyId() != "" {
+		return
+	}
+	if _, ok := archivingPartitions.Load(dp.partitionId); ok {
+		return
+	}
+	var tiered, failed int
+	for _, extentId := range dp.extentStore.ColdExtents(time.Now().Add(-time.Duration(days) * 24 * time.Hour)) {
+		select {
+		case <-dp.stopC:
+			return
+		default:
+		}
+		if err := dp.extentStore.TierExtent(extentId); err != nil {
+			if err != storage.ErrorAgain {
+				log.LogWarnf("action[tierColdExtents] partition(%v) extent(%v) err(%v).", dp.partitionId, extentId, err)
+				failed++
+			}
+			continue
+		}
+		tiered++
+	}
+	if tiered != 0 || failed != 0 {
+		log.LogInfof("action[tierColdExtents] partition(%v) vol(%v) days(%v) tiered(%v) failed(%v).",
+			dp.partitionId, dp.volumeId, days, tiered, failed)
+	}
+}
+
+/*set the days the extents are kept local to the ones of their vols, 0 keeps them local*/
+func (s *DataNode) updateColdTier(volColdTierDays map[string]int) {
+	s.space.RangePartitions(func(partition DataPartition) bool {
+		if dp, ok := partition.(*dataPartition); ok {
+			atomic.StoreInt32(&dp.coldTierDays, int32(volColdTierDays[dp.volumeId]))
+		}
+		return true
+	})
+}
+
+// Handle OpTierExtents packet.
+func (s *DataNode) handleTierExtents(pkg *Packet) {
+	task := &proto.AdminTask{}
+	json.Unmarshal(pkg.Data, task)
+	pkg.PackOkReply()
+	s.taskEngine.Submit(task, s.tierExtents)
+}
+
+/*move the extents of the lifecycle rules of the vol to the cold tier, whatever the time they were last read*/
+func (s *DataNode) tierExtents(task *proto.AdminTask) (resp interface{}, status int8) {
+	var err error
+	request := &proto.TierExtentsRequest{}
+	response := &proto.TierExtentsResponse{}
+	if task.OpCode == proto.OpTierExtents {
+		data, _ := json.Marshal(task.Request)
+		if err = json.Unmarshal(data, request); err == nil {
+			if dp, ok := s.space.GetPartition(uint32(request.PartitionId)).(*dataPartition); ok {
+				response.Tiered, err = dp.tierExtents(request.ExtentIds)
+			} else {
+				err = ErrPartitionNotExist
+			}
+		}
+	} else {
+		err = ErrorUnknownOp
+	}
+	response.PartitionId = request.PartitionId
+	if err != nil {
+		response.Status = proto.TaskFail
+		response.Result = err.Error()
+		response.ErrCode = errCodeOf(response.Result)
+		log.LogErrorf("action[tierExtents] from master Task(%v) failed, err(%v)", task.ToString(), err)
+	} else {
+		response.Status = proto.TaskSuccess
+	}
+	return response, int8(response.Status)
+}
+
+/*the extents busy are skipped, err is the last failure of the others*/
+func (dp *dataPartition) tierExtents(extentIds []uint64) (tiered int, err error) {
+	if _, ok := archivingPartitions.Load(dp.partitionId); ok {
+		return 0, storage.ErrorAgain
+	}
+	for _, extentId := range extentIds {
+		select {
+		case <-dp.stopC:
+			return tiered, ErrPartitionNotExist
+		default:
+		}
+		if e := dp.extentStore.TierExtent(extentId); e == storage.ErrorNoColdTier {
+			return tiered, e
+		} else if e != nil {
+			if e != storage.ErrorAgain {
+				log.LogWarnf("action[tierExtents] partition(%v) extent(%v) err(%v).", dp.partitionId, extentId, e)
+				err = e
+			}
+			continue
+		}
+		tiered++
+	}
+	log.LogInfof("action[tierExtents] partition(%v) vol(%v) extents(%v) tiered(%v).", dp.partitionId, dp.volumeId, len(extentIds), tiered)
+	return
+}
@@ -0,0 +1,76 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/tiglabs/containerfs/util"
+	"github.com/tiglabs/containerfs/util/config"
+	"github.com/tiglabs/containerfs/util/qos"
+)
+
+// The reads and the writes of the clients of each vol and of each client
+// session of a vol are limited by the token buckets of the qos, a request
+// waits for its tokens in the loop reading its connection, so a noisy client
+// is slowed down without delaying the others.
+
+func parseQosConfig(cfg *config.Config) (q *qos.Qos, err error) {
+	volLimit := qos.Limit{IOPS: cfg.GetInt(ConfigKeyQosVolIOPS), Bandwidth: cfg.GetInt(ConfigKeyQosVolBandwidth) * util.MB}
+	clientLimit := qos.Limit{IOPS: cfg.GetInt(ConfigKeyQosClientIOPS), Bandwidth: cfg.GetInt(ConfigKeyQosClientBandwidth) * util.MB}
+	volLimits := make(map[string]qos.Limit)
+	for _, v := range cfg.GetArray(ConfigKeyQosVols) {
+		value, ok := v.(string)
+		if !ok {
+			return nil, ErrBadConfFile
+		}
+		volName, limit, err := parseQosVolLimit(value)
+		if err != nil {
+			return nil, err
+		}
+		volLimits[volName] = limit
+	}
+	return qos.New(volLimit, clientLimit, volLimits), nil
+}
+
+// parseQosVolLimit parses "VOL:IOPS:BANDWIDTH_MB" of the config.
+func parseQosVolLimit(value string) (volName string, limit qos.Limit, err error) {
+	arr := strings.Split(value, ":")
+	if len(arr) != 3 || arr[0] == "" {
+		err = ErrBadConfFile
+		return
+	}
+	var mb int64
+	if limit.IOPS, err = strconv.ParseInt(arr[1], 10, 64); err != nil {
+		err = ErrBadConfFile
+		return
+	}
+	if mb, err = strconv.ParseInt(arr[2], 10, 64); err != nil {
+		err = ErrBadConfFile
+		return
+	}
+	limit.Bandwidth = mb * util.MB
+	return arr[0], limit, nil
+}
+
+/*the client of the connection for the qos, its session or else its address*/
+func (s *DataNode) qosClient(conn net.Conn) string {
+	if session := s.clientFences.Session(conn); session != "" {
+		return session
+	}
+	return conn.RemoteAddr().String()
+}
@@ -0,0 +1,238 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tiglabs/containerfs/util"
+	"github.com/tiglabs/containerfs/util/config"
+	"github.com/tiglabs/containerfs/util/log"
+	"github.com/tiglabs/containerfs/util/qos"
+)
+
+// RepairLimits are the limits of the repairs of each disk, 0 means no limit.
+// Between OffPeakStart and OffPeakEnd, hours of the local time, the off peak
+// limits apply instead, the window is disabled if both are the same.
+type RepairLimits struct {
+	Bandwidth          int64 //bytes per second
+	Concurrency        int   //extents or blob files repaired at a time
+	OffPeakBandwidth   int64
+	OffPeakConcurrency int
+	OffPeakStart       int
+	OffPeakEnd         int
+}
+
+func (l RepairLimits) check() (err error) {
+	if l.Bandwidth < 0 || l.Concurrency < 0 || l.OffPeakBandwidth < 0 || l.OffPeakConcurrency < 0 {
+		return fmt.Errorf("negative repair limits %+v", l)
+	}
+	if l.OffPeakStart < 0 || l.OffPeakStart > 23 || l.OffPeakEnd < 0 || l.OffPeakEnd > 23 {
+		return fmt.Errorf("off peak hours [%v,%v) not in [0,23]", l.OffPeakStart, l.OffPeakEnd)
+	}
+	return
+}
+
+func (l RepairLimits) isOffPeak(now time.Time) bool {
+	if l.OffPeakStart == l.OffPeakEnd {
+		return false
+	}
+	hour := now.Hour()
+	if l.OffPeakStart < l.OffPeakEnd {
+		return hour >= l.OffPeakStart && hour < l.OffPeakEnd
+	}
+	// the window crosses midnight
+	return hour >= l.OffPeakStart || hour < l.OffPeakEnd
+}
+
+func (l RepairLimits) current(now time.Time) (bandwidth int64, concurrency int) {
+	if l.isOffPeak(now) {
+		return l.OffPeakBandwidth, l.OffPeakConcurrency
+	}
+	return l.Bandwidth, l.Concurrency
+}
+
+// set by the config before the disks are loaded, and by /repair/setLimits
+var gRepairScheduler = newRepairScheduler(RepairLimits{})
+
+func parseRepairConfig(cfg *config.Config) (err error) {
+	limits := RepairLimits{
+		Bandwidth:          cfg.GetInt(ConfigKeyRepairBandwidth) * util.MB,
+		Concurrency:        int(cfg.GetInt(ConfigKeyRepairConcurrency)),
+		OffPeakBandwidth:   cfg.GetInt(ConfigKeyRepairOffPeakBandwidth) * util.MB,
+		OffPeakConcurrency: int(cfg.GetInt(ConfigKeyRepairOffPeakConcurrency)),
+	}
+	if hours := cfg.GetString(ConfigKeyRepairOffPeakHours); hours != "" {
+		if limits.OffPeakStart, limits.OffPeakEnd, err = parseOffPeakHours(hours); err != nil {
+			return
+		}
+	}
+	if limits.check() != nil {
+		return ErrBadConfFile
+	}
+	return gRepairScheduler.SetLimits(limits)
+}
+
+// parseOffPeakHours parses "START-END", the hours of the local time.
+func parseOffPeakHours(value string) (start, end int, err error) {
+	arr := strings.Split(value, "-")
+	if len(arr) != 2 {
+		err = ErrBadConfFile
+		return
+	}
+	if start, err = strconv.Atoi(arr[0]); err != nil {
+		err = ErrBadConfFile
+		return
+	}
+	if end, err = strconv.Atoi(arr[1]); err != nil {
+		err = ErrBadConfFile
+		return
+	}
+	return
+}
+
+type diskRepairState struct {
+	running   int
+	rate      int64
+	bandwidth *qos.TokenBucket
+}
+
+// RepairDiskView is the state of the repairs of a disk.
+type RepairDiskView struct {
+	Path    string
+	Running int
+}
+
+type RepairSchedulerView struct {
+	Limits      RepairLimits
+	OffPeak     bool
+	Bandwidth   int64
+	Concurrency int
+	Disks       []*RepairDiskView
+}
+
+// repairScheduler paces the extent and blob repairs received by the node, so
+// they don't take the disks from the clients. The repairs of a disk share its
+// bandwidth and its slots, a repair waits for a slot before it starts and for
+// the tokens of each packet it reads from the leader. The limits are changed at
+// runtime by /repair/setLimits, a change of the window is seen by the next
+// repair started or finished.
+type repairScheduler struct {
+	limits RepairLimits
+	disks  map[string]*diskRepairState
+	cond   *sync.Cond
+	sync.Mutex
+}
+
+func newRepairScheduler(limits RepairLimits) (s *repairScheduler) {
+	s = &repairScheduler{limits: limits, disks: make(map[string]*diskRepairState)}
+	s.cond = sync.NewCond(&s.Mutex)
+	return
+}
+
+func (s *repairScheduler) Limits() RepairLimits {
+	s.Lock()
+	defer s.Unlock()
+	return s.limits
+}
+
+func (s *repairScheduler) SetLimits(limits RepairLimits) (err error) {
+	if err = limits.check(); err != nil {
+		return
+	}
+	s.Lock()
+	s.limits = limits
+	s.Unlock()
+	// the waiting repairs may start with more slots
+	s.cond.Broadcast()
+	log.LogWarnf("action[SetLimits] repair limits %+v.", limits)
+	return
+}
+
+/*the caller must hold the lock of the scheduler*/
+func (s *repairScheduler) getDisk(path string) (d *diskRepairState) {
+	if d = s.disks[path]; d == nil {
+		d = &diskRepairState{}
+		s.disks[path] = d
+	}
+	return
+}
+
+/*wait for a repair slot of the disk, a stopped partition gives up when it is woken up*/
+func (s *repairScheduler) acquire(path string, stopC chan bool) bool {
+	s.Lock()
+	defer s.Unlock()
+	d := s.getDisk(path)
+	for {
+		select {
+		case <-stopC:
+			return false
+		default:
+		}
+		if _, concurrency := s.limits.current(time.Now()); concurrency == 0 || d.running < concurrency {
+			d.running++
+			return true
+		}
+		s.cond.Wait()
+	}
+}
+
+func (s *repairScheduler) release(path string) {
+	s.Lock()
+	s.getDisk(path).running--
+	s.Unlock()
+	s.cond.Broadcast()
+}
+
+/*wait until n bytes of repair data can be written to the disk*/
+func (s *repairScheduler) wait(path string, n int) {
+	now := time.Now()
+	s.Lock()
+	d := s.getDisk(path)
+	if rate, _ := s.limits.current(now); rate != d.rate {
+		d.rate = rate
+		d.bandwidth = qos.NewTokenBucket(rate, now)
+	}
+	bucket := d.bandwidth
+	s.Unlock()
+	if wait := bucket.Reserve(float64(n), now); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+func (s *repairScheduler) View() (view *RepairSchedulerView) {
+	now := time.Now()
+	s.Lock()
+	defer s.Unlock()
+	view = &RepairSchedulerView{Limits: s.limits, OffPeak: s.limits.isOffPeak(now), Disks: make([]*RepairDiskView, 0, len(s.disks))}
+	view.Bandwidth, view.Concurrency = s.limits.current(now)
+	for path, d := range s.disks {
+		view.Disks = append(view.Disks, &RepairDiskView{Path: path, Running: d.running})
+	}
+	return
+}
+
+func (s *repairScheduler) running(path string) int {
+	s.Lock()
+	defer s.Unlock()
+	if d := s.disks[path]; d != nil {
+		return d.running
+	}
+	return 0
+}
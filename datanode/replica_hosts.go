@@ -0,0 +1,107 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/tiglabs/containerfs/master"
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	ReplicaHostsRefreshInterval = time.Minute
+)
+
+// startReplicaHostsRefresh gets the hosts of all the partitions of the node from
+// the master in one request every interval, the repairs use them instead of
+// asking the master for each partition. A partition the refresh missed asks for
+// its own hosts as before.
+func (s *DataNode) startReplicaHostsRefresh() {
+	ticker := time.NewTicker(ReplicaHostsRefreshInterval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopC:
+			return
+		case <-ticker.C:
+			s.refreshReplicaHosts()
+		}
+	}
+}
+
+func (s *DataNode) refreshReplicaHosts() {
+	if LocalIP == "" {
+		return
+	}
+	partitions := make(map[uint64]*dataPartition)
+	request := &proto.ReplicaHostsRequest{Addr: util.JoinHostPort(LocalIP, s.port), PartitionIDs: make([]uint64, 0)}
+	s.space.RangePartitions(func(partition DataPartition) bool {
+		if dp, ok := partition.(*dataPartition); ok {
+			partitions[uint64(dp.ID())] = dp
+			request.PartitionIDs = append(request.PartitionIDs, uint64(dp.ID()))
+		}
+		return true
+	})
+	if len(partitions) == 0 {
+		return
+	}
+	data, err := json.Marshal(request)
+	if err != nil {
+		log.LogErrorf("action[refreshReplicaHosts] err(%v).", err)
+		return
+	}
+	body, err := MasterHelper.ReadRequest("POST", master.DataNodeHosts, nil, data)
+	if err != nil {
+		log.LogWarnf("action[refreshReplicaHosts] partitions(%v) err(%v).", len(partitions), err)
+		return
+	}
+	response := &proto.ReplicaHostsResponse{}
+	if err = json.Unmarshal(body, response); err != nil {
+		log.LogErrorf("action[refreshReplicaHosts] unmarshal(%v) err(%v).", string(body), err)
+		return
+	}
+	now := time.Now().UnixNano()
+	for _, ph := range response.Partitions {
+		if dp, ok := partitions[ph.PartitionID]; ok && dp.applyReplicaHosts(ph.Hosts, ph.WarmHosts, ph.Epoch, ph.Leader) {
+			atomic.StoreInt64(&dp.hostsRefreshed, now)
+		}
+	}
+	log.LogDebugf("action[refreshReplicaHosts] partitions(%v) refreshed(%v).", len(partitions), len(response.Partitions))
+}
+
+/*the hosts with the leader at the head of the chain and the others in their order*/
+func (dp *dataPartition) leaderFirst(hosts []string, leader string) []string {
+	if leader == "" || len(hosts) == 0 || hosts[0] == leader {
+		return hosts
+	}
+	ordered := make([]string, 0, len(hosts))
+	ordered = append(ordered, leader)
+	for _, host := range hosts {
+		if host != leader {
+			ordered = append(ordered, host)
+		}
+	}
+	if len(ordered) != len(hosts) {
+		log.LogWarnf("action[leaderFirst] partition(%v) leader(%v) not in hosts(%v), kept in order.",
+			dp.partitionId, leader, hosts)
+		return hosts
+	}
+	return ordered
+}
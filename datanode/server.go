@@ -15,12 +15,14 @@
 package datanode
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"path"
 	"regexp"
 	"runtime"
 	"strconv"
@@ -32,11 +34,17 @@ import (
 	"github.com/juju/errors"
 	"github.com/tiglabs/containerfs/master"
 	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/raftstore"
 	"github.com/tiglabs/containerfs/storage"
 	"github.com/tiglabs/containerfs/util"
+	"github.com/tiglabs/containerfs/util/auth"
 	"github.com/tiglabs/containerfs/util/config"
+	"github.com/tiglabs/containerfs/util/gctuner"
 	"github.com/tiglabs/containerfs/util/log"
 	"github.com/tiglabs/containerfs/util/pool"
+	"github.com/tiglabs/containerfs/util/qos"
+	"github.com/tiglabs/containerfs/util/rpc"
+	"github.com/tiglabs/containerfs/util/slowop"
 	"github.com/tiglabs/containerfs/util/ump"
 )
 
@@ -46,6 +54,11 @@ var (
 	ErrBlobFileOffsetMismatch   = errors.New("blobfile offset not mismatch")
 	ErrNoDiskForCreatePartition = errors.New("no disk for create dataPartition")
 	ErrBadConfFile              = errors.New("bad config file")
+	ErrStaleEpoch               = errors.New("stale partition epoch")
+	ErrClientFenced             = errors.New("client is evicted by master")
+	ErrNodeDraining             = errors.New("dataNode is draining for decommission")
+	ErrNotLeader                = errors.New("dataNode holds no leader lease of dataPartition")
+	ErrVolReadOnly              = errors.New("vol of dataPartition is read only")
 
 	LocalIP      string
 	gConnPool    = pool.NewConnPool()
@@ -66,17 +79,98 @@ const (
 	ConfigKeyClusterID  = "clusterID"  // string
 	ConfigKeyMasterAddr = "masterAddr" // array
 	ConfigKeyRack       = "rack"       // string
+	ConfigKeyZone       = "zone"       // string, the zone of the rack assigned by the master if empty
 	ConfigKeyDisks      = "disks"      // array
+	ConfigKeyControlIP  = "controlIP"  // string
+	ConfigKeyClientIP   = "clientIP"   // string
+	ConfigKeyReplicaIP  = "replicaIP"  // string
+	ConfigKeyTaskDir    = "taskDir"    // string
+
+	ConfigKeyDiagDir              = "diagDir"              // string
+	ConfigKeyWriteStallLatency    = "writeStallLatencyMs"  // int
+	ConfigKeyWriteStallQueueDepth = "writeStallQueueDepth" // int
+	ConfigKeyWriteStallSeconds    = "writeStallSeconds"    // int
+
+	ConfigKeySlowOpMs      = "slowOpMs"      // int, negative disables the slow ops without a threshold of their own
+	ConfigKeySlowOps       = "slowOps"       // array, "OP:MS" overriding the threshold of the op
+	ConfigKeySlowOpWebhook = "slowOpWebhook" // string, URL the alerts of the slow ops are posted to
+
+	ConfigKeyMemoryBudget  = "memoryBudgetMB"  // int
+	ConfigKeyMemoryBallast = "memoryBallastMB" // int
+
+	ConfigKeyScrubInterval  = "scrubIntervalHours" // int, negative disables scrubbing
+	ConfigKeyScrubBandwidth = "scrubBandwidthMB"   // int
+
+	ConfigKeyExtentGCWindow = "extentGCWindowHours" // int, negative disables the extent GC
+
+	ConfigKeyBlobCompactThreshold = "blobCompactThreshold" // int, percent of dead bytes in (0,100)
+
+	ConfigKeyDiskMoveThreshold = "diskMoveThreshold" // int, percent of used bytes in (0,100), negative disables the disk moves
+
+	ConfigKeyDiskErrorThreshold = "diskErrorThreshold" // int, IO errors in 10 seconds failing a disk, negative disables it
+	ConfigKeyDiskLatencySLO     = "diskLatencySLOMs"   // int, negative disables the probes
+
+	ConfigKeyRepairBandwidth          = "repairBandwidthMB"        // int, 0 means no limit
+	ConfigKeyRepairConcurrency        = "repairConcurrency"        // int, 0 means no limit
+	ConfigKeyRepairOffPeakBandwidth   = "repairOffPeakBandwidthMB" // int, 0 means no limit
+	ConfigKeyRepairOffPeakConcurrency = "repairOffPeakConcurrency" // int, 0 means no limit
+	ConfigKeyRepairOffPeakHours       = "repairOffPeakHours"       // string, "START-END" hours of the local time
+
+	ConfigKeyRaftDir           = "raftDir"           // string, empty disables the raft replicated partitions
+	ConfigKeyRaftHeartbeatPort = "raftHeartbeatPort" // int
+	ConfigKeyRaftReplicatePort = "raftReplicatePort" // int
+
+	ConfigKeyQosVolIOPS         = "qosVolIOPS"           // int, 0 means no limit
+	ConfigKeyQosVolBandwidth    = "qosVolBandwidthMB"    // int, 0 means no limit
+	ConfigKeyQosClientIOPS      = "qosClientIOPS"        // int, 0 means no limit
+	ConfigKeyQosClientBandwidth = "qosClientBandwidthMB" // int, 0 means no limit
+	ConfigKeyQosVols            = "qosVols"              // array, "VOL:IOPS:BANDWIDTH_MB" overriding the vol limits
+
+	ConfigKeyGrpc = "grpc" // bool, serves gRPC besides the packet protocol on the port
+
+	ConfigKeyStatusUpdateInterval   = "statusUpdateIntervalSeconds"   // int
+	ConfigKeyUsageReconcileInterval = "usageReconcileIntervalMinutes" // int
+	ConfigKeyMetricsUpdateInterval  = "metricsUpdateIntervalSeconds"  // int
+
+	ConfigKeyIOBackend      = "ioBackend"      // string, "sync" or "iouring"
+	ConfigKeyIOUringEntries = "ioUringEntries" // int, entries of the ring of each disk
+
+	ConfigKeyBufferPoolMaxKB = "bufferPoolMaxKB" // int, largest packet buffer pooled
+
+	ConfigKeyColdTierTarget = "coldTierTarget" // string, URL prefix of the tiered extents, empty disables the cold tier
+	ConfigKeyColdTierRecall = "coldTierRecall" // bool, recall the tiered extents read to the local disk
 )
 
 type DataNode struct {
 	space          SpaceManager
 	port           string
 	rackName       string
+	zoneName       string
 	clusterId      string
 	localIp        string
 	localServeAddr string
-	tcpListener    net.Listener
+	controlIp      string
+	clientIp       string
+	replicaIp      string
+	tcpListeners   []net.Listener
+	tlsConfig      *tls.Config //the peers and the clients connect over TLS if it is set
+	rpc            *rpc.Server //negotiates gRPC on the accepted connections, nil without grpc
+	reporter       *PartitionReporter
+	taskEngine     *TaskEngine
+	stallDetector  *WriteStallDetector
+	slowOps        *slowop.Detector
+	clientFences   *util.ClientFences
+	auth           *auth.Checker //checks the connections against the vol tokens, disabled without auth key
+	qos            *qos.Qos
+	gcTuner        *gctuner.Tuner
+	draining       int32 //set by master heartbeat while the node is decommissioned
+	registered     int32 //set once the node is added to master
+	lastHeartbeat  int64 //unix time of the last heartbeat of master
+	nodeId         uint64
+	raftDir        string
+	raftHeartbeat  int
+	raftReplicate  int
+	raftStore      raftstore.RaftStore //started once the node id is got from master, nil without raftDir
 	stopC          chan bool
 	state          uint32
 	wg             sync.WaitGroup
@@ -121,27 +215,60 @@ func (s *DataNode) Sync() {
 
 func (s *DataNode) onStart(cfg *config.Config) (err error) {
 	s.stopC = make(chan bool, 0)
+	s.reporter = NewPartitionReporter()
+	s.clientFences = util.NewClientFences()
 	if err = s.parseConfig(cfg); err != nil {
 		return
 	}
+	s.startGCTuner(cfg)
+	// the probes are served on the prof port while the disks load
+	s.registerHealth()
 
 	go s.registerProfHandler()
 
 	if err = s.startSpaceManager(cfg); err != nil {
 		return
 	}
+	if err = s.startTaskEngine(cfg); err != nil {
+		return
+	}
+	if err = s.startWriteStallDetector(cfg); err != nil {
+		return
+	}
+	if err = s.startSlowOpDetector(cfg); err != nil {
+		return
+	}
 	if err = s.startTcpService(); err != nil {
 		return
 	}
 
 	go s.registerToMaster()
+	go s.startExtentGC()
+	go s.startDiskMoves()
+	go s.startLeaderLease()
+	go s.startReplicaHostsRefresh()
 	ump.InitUmp(UmpModuleName)
 	return
 }
 
 func (s *DataNode) onShutdown() {
 	close(s.stopC)
+	MasterHelper.Stop()
 	s.stopTcpService()
+	if s.taskEngine != nil {
+		s.taskEngine.Stop()
+	}
+	if s.stallDetector != nil {
+		s.stallDetector.Stop()
+	}
+	s.slowOps.Close()
+	if s.gcTuner != nil {
+		s.gcTuner.Stop()
+	}
+	if s.space != nil {
+		s.space.Stop()
+	}
+	s.stopRaftServer()
 	return
 }
 
@@ -170,10 +297,103 @@ func (s *DataNode) parseConfig(cfg *config.Config) (err error) {
 	if s.rackName == "" {
 		s.rackName = DefaultRackName
 	}
+	s.zoneName = cfg.GetString(ConfigKeyZone)
+	s.controlIp = cfg.GetString(ConfigKeyControlIP)
+	s.clientIp = cfg.GetString(ConfigKeyClientIP)
+	s.replicaIp = cfg.GetString(ConfigKeyReplicaIP)
+	for _, ip := range []string{s.controlIp, s.clientIp, s.replicaIp} {
+		if ip != "" && !util.IP(ip) {
+			return ErrBadConfFile
+		}
+	}
+	if hours := cfg.GetInt(ConfigKeyScrubInterval); hours != 0 {
+		scrubInterval = time.Duration(hours) * time.Hour
+	}
+	if mb := cfg.GetInt(ConfigKeyScrubBandwidth); mb > 0 {
+		scrubBandwidth = mb * util.MB
+	}
+	if hours := cfg.GetInt(ConfigKeyExtentGCWindow); hours != 0 {
+		extentGCWindow = time.Duration(hours) * time.Hour
+	}
+	if percent := cfg.GetInt(ConfigKeyBlobCompactThreshold); percent > 0 && percent < 100 {
+		compactThreshold = int(percent)
+	}
+	if percent := cfg.GetInt(ConfigKeyDiskMoveThreshold); percent < 0 || percent > 0 && percent < 100 {
+		diskMoveThreshold = int(percent)
+	}
+	if errs := cfg.GetInt(ConfigKeyDiskErrorThreshold); errs > 0 {
+		diskErrorThreshold = uint64(errs)
+	} else if errs < 0 {
+		diskErrorThreshold = 0
+	}
+	if ms := cfg.GetInt(ConfigKeyDiskLatencySLO); ms != 0 {
+		diskLatencySLO = time.Duration(ms) * time.Millisecond
+	}
+	if err = parseRepairConfig(cfg); err != nil {
+		return
+	}
+	if err = parseStatusIntervals(cfg); err != nil {
+		return
+	}
+	if backend := cfg.GetString(ConfigKeyIOBackend); backend != "" {
+		if backend != storage.IOBackendSync && backend != storage.IOBackendIOUring {
+			return ErrBadConfFile
+		}
+		ioBackend = backend
+	}
+	if entries := cfg.GetInt(ConfigKeyIOUringEntries); entries > 0 {
+		ioUringEntries = int(entries)
+	}
+	if kb := cfg.GetInt(ConfigKeyBufferPoolMaxKB); kb > 0 {
+		if err = proto.Buffers.SetMaxPooledSize(int(kb) * util.KB); err != nil {
+			return
+		}
+	}
+	coldTierTarget = cfg.GetString(ConfigKeyColdTierTarget)
+	coldTierRecall = cfg.GetBool(ConfigKeyColdTierRecall)
+	// the objects of the clusters sharing the bucket are kept apart
+	if coldTierCluster = s.clusterId; coldTierTarget != "" && coldTierCluster == "" {
+		return fmt.Errorf("%v needs %v", ConfigKeyColdTierTarget, ConfigKeyClusterID)
+	}
+	s.raftDir = cfg.GetString(ConfigKeyRaftDir)
+	s.raftHeartbeat = DefaultRaftHeartbeatPort
+	if port := cfg.GetInt(ConfigKeyRaftHeartbeatPort); port > 0 {
+		s.raftHeartbeat = int(port)
+	}
+	s.raftReplicate = DefaultRaftReplicatePort
+	if port := cfg.GetInt(ConfigKeyRaftReplicatePort); port > 0 {
+		s.raftReplicate = int(port)
+	}
+	if s.tlsConfig, err = cfg.ServerTLSConfig(true); err != nil {
+		return
+	}
+	s.auth = auth.NewChecker(cfg.GetString(auth.AuthKey))
+	if cfg.GetBool(ConfigKeyGrpc) {
+		s.rpc = rpc.NewServer(s.serveConn, rpc.DataService, rpc.AdminService)
+	}
+	if s.qos, err = parseQosConfig(cfg); err != nil {
+		return
+	}
 	log.LogDebugf("action[parseConfig] load masterAddrs(%v).", MasterHelper.Nodes())
 	log.LogDebugf("action[parseConfig] load port(%v).", s.port)
 	log.LogDebugf("action[parseConfig] load clusterId(%v).", s.clusterId)
 	log.LogDebugf("action[parseConfig] load rackName(%v).", s.rackName)
+	log.LogDebugf("action[parseConfig] load controlIP(%v) clientIP(%v) replicaIP(%v).",
+		s.controlIp, s.clientIp, s.replicaIp)
+	log.LogDebugf("action[parseConfig] load scrubInterval(%v) scrubBandwidth(%v).", scrubInterval, scrubBandwidth)
+	log.LogDebugf("action[parseConfig] load diskErrorThreshold(%v) diskLatencySLO(%v).", diskErrorThreshold, diskLatencySLO)
+	log.LogDebugf("action[parseConfig] load extentGCWindow(%v).", extentGCWindow)
+	log.LogDebugf("action[parseConfig] load repairLimits(%+v).", gRepairScheduler.Limits())
+	log.LogDebugf("action[parseConfig] load ioBackend(%v) ioUringEntries(%v).", ioBackend, ioUringEntries)
+	log.LogDebugf("action[parseConfig] load bufferPoolMaxSize(%v).", proto.Buffers.MaxPooledSize())
+	log.LogDebugf("action[parseConfig] load coldTierTarget(%v) coldTierRecall(%v).", coldTierTarget, coldTierRecall)
+	log.LogDebugf("action[parseConfig] load raftDir(%v) raftHeartbeatPort(%v) raftReplicatePort(%v).",
+		s.raftDir, s.raftHeartbeat, s.raftReplicate)
+	log.LogDebugf("action[parseConfig] load tls(%v).", s.tlsConfig != nil)
+	log.LogDebugf("action[parseConfig] load auth(%v).", s.auth.Enabled())
+	log.LogDebugf("action[parseConfig] load grpc(%v).", s.rpc != nil)
+	log.LogDebugf("action[parseConfig] load qos vol(%v) client(%v) vols(%v).",
+		s.qos.VolLimit, s.qos.ClientLimit, s.qos.VolLimits)
 	return
 }
 
@@ -183,14 +403,24 @@ func (s *DataNode) startSpaceManager(cfg *config.Config) (err error) {
 		err = ErrBadConfFile
 		return
 	}
-	var wg sync.WaitGroup
+	var (
+		wg    sync.WaitGroup
+		paths []string
+		loads []func()
+	)
 	for _, d := range cfg.GetArray(ConfigKeyDisks) {
 		log.LogDebugf("action[startSpaceManager] load disk raw config(%v).", d)
-		// Format "PATH:RESET_SIZE:MAX_ERR
+		// Format "PATH:RESET_SIZE:MAX_ERR[:LAYOUT]"
 		arr := strings.Split(d.(string), ":")
-		if len(arr) != 3 {
+		if len(arr) != 3 && len(arr) != 4 {
 			return ErrBadConfFile
 		}
+		layout := DiskLayoutFlat
+		if len(arr) == 4 {
+			if layout = arr[3]; !isDiskLayout(layout) {
+				return ErrBadConfFile
+			}
+		}
 		path := arr[0]
 		restSize, err := strconv.ParseUint(arr[1], 10, 64)
 		if err != nil {
@@ -200,16 +430,103 @@ func (s *DataNode) startSpaceManager(cfg *config.Config) (err error) {
 		if err != nil {
 			return ErrBadConfFile
 		}
+		paths = append(paths, path)
+		loads = append(loads, func() {
+			s.space.LoadDisk(path, restSize, maxErr, layout)
+		})
+	}
+	// a partition being moved between two disks is loaded from one of them only
+	recoverPartitionMoves(paths)
+	for _, load := range loads {
 		wg.Add(1)
-		go func(wg *sync.WaitGroup, path string, restSize uint64, maxErrs int) {
+		go func(load func()) {
 			defer wg.Done()
-			s.space.LoadDisk(path, restSize, maxErrs)
-		}(&wg, path, restSize, maxErr)
+			load()
+		}(load)
 	}
 	wg.Wait()
 	return nil
 }
 
+// startTaskEngine start the engine executing master tasks, task state is
+// persisted in the config taskDir, or in the first disk if not configured.
+func (s *DataNode) startTaskEngine(cfg *config.Config) (err error) {
+	dir := cfg.GetString(ConfigKeyTaskDir)
+	if dir == "" {
+		disks := cfg.GetArray(ConfigKeyDisks)
+		if len(disks) == 0 {
+			return ErrBadConfFile
+		}
+		dir = path.Join(strings.Split(disks[0].(string), ":")[0], DefaultTaskDirName)
+	}
+	if s.taskEngine, err = NewTaskEngine(dir); err != nil {
+		err = errors.Annotatef(err, "start task engine in dir(%v)", dir)
+		return
+	}
+	log.LogDebugf("action[startTaskEngine] load taskDir(%v).", dir)
+	return
+}
+
+// startWriteStallDetector start watching the partitions for write stalls, the
+// diagnostic bundles are kept in the config diagDir, or in the first disk if
+// not configured.
+func (s *DataNode) startWriteStallDetector(cfg *config.Config) (err error) {
+	dir := cfg.GetString(ConfigKeyDiagDir)
+	if dir == "" {
+		disks := cfg.GetArray(ConfigKeyDisks)
+		if len(disks) == 0 {
+			return ErrBadConfFile
+		}
+		dir = path.Join(strings.Split(disks[0].(string), ":")[0], DefaultDiagDirName)
+	}
+	latency := DefaultWriteStallLatency
+	if ms := cfg.GetInt(ConfigKeyWriteStallLatency); ms > 0 {
+		latency = time.Duration(ms) * time.Millisecond
+	}
+	queueDepth := int64(DefaultWriteStallQueueDepth)
+	if depth := cfg.GetInt(ConfigKeyWriteStallQueueDepth); depth > 0 {
+		queueDepth = depth
+	}
+	duration := DefaultWriteStallDuration
+	if sec := cfg.GetInt(ConfigKeyWriteStallSeconds); sec > 0 {
+		duration = time.Duration(sec) * time.Second
+	}
+	umpKey := fmt.Sprintf("%s_%s", s.clusterId, UmpModuleName)
+	if s.stallDetector, err = NewWriteStallDetector(umpKey, dir, latency, queueDepth, duration, s.space); err != nil {
+		err = errors.Annotatef(err, "start write stall detector in dir(%v)", dir)
+		return
+	}
+	log.LogDebugf("action[startWriteStallDetector] load diagDir(%v) latency(%v) queueDepth(%v) duration(%v).",
+		dir, latency, queueDepth, duration)
+	return
+}
+
+// startSlowOpDetector reports the requests served slower than the threshold of
+// their op, the host of the alerts is set once the master told the local ip.
+func (s *DataNode) startSlowOpDetector(cfg *config.Config) (err error) {
+	threshold := slowop.DefaultThreshold
+	if ms := cfg.GetInt(ConfigKeySlowOpMs); ms != 0 {
+		threshold = time.Duration(ms) * time.Millisecond
+	}
+	thresholds, err := slowop.ParseThresholds(cfg.GetArray(ConfigKeySlowOps))
+	if err != nil {
+		return
+	}
+	webhook := cfg.GetString(ConfigKeySlowOpWebhook)
+	s.slowOps = slowop.NewDetector("datanode", s.localServeAddr, threshold, thresholds, webhook)
+	log.LogDebugf("action[startSlowOpDetector] load slowOpMs(%v) slowOps(%v) slowOpWebhook(%v).",
+		threshold, thresholds, webhook)
+	return
+}
+
+func (s *DataNode) startGCTuner(cfg *config.Config) {
+	budget := uint64(cfg.GetInt(ConfigKeyMemoryBudget)) * util.MB
+	ballast := uint64(cfg.GetInt(ConfigKeyMemoryBallast)) * util.MB
+	s.gcTuner = gctuner.New(budget, ballast)
+	s.gcTuner.Start()
+	log.LogDebugf("action[startGCTuner] load memoryBudget(%v) memoryBallast(%v).", budget, ballast)
+}
+
 func (s *DataNode) registerToMaster() {
 	var (
 		err  error
@@ -232,7 +549,8 @@ func (s *DataNode) registerToMaster() {
 			json.Unmarshal(data, cInfo)
 			LocalIP = string(cInfo.Ip)
 			s.clusterId = cInfo.Cluster
-			s.localServeAddr = fmt.Sprintf("%s:%v", LocalIP, s.port)
+			s.localServeAddr = util.JoinHostPort(LocalIP, s.port)
+			s.slowOps.SetHost(s.localServeAddr)
 			if !util.IP(LocalIP) {
 				log.LogErrorf("action[registerToMaster] got an invalid local ip(%v) from master(%v).",
 					LocalIP, masterAddr)
@@ -241,13 +559,24 @@ func (s *DataNode) registerToMaster() {
 			}
 			// Register this data node to master.
 			params := make(map[string]string)
-			params["addr"] = fmt.Sprintf("%s:%v", LocalIP, s.port)
+			params["addr"] = util.JoinHostPort(LocalIP, s.port)
+			params["rack"] = s.rackName
+			params["zone"] = s.zoneName
 			data, err = MasterHelper.Request(http.MethodPost, master.AddDataNode, params, nil)
 			if err != nil {
 				log.LogErrorf("action[registerToMaster] cannot register this node to master[%] err(%v).",
 					masterAddr, err)
 				continue
 			}
+			atomic.StoreInt32(&s.registered, 1)
+			// the master older than the raft replication answers a message instead of the node id
+			if s.nodeId, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err != nil || s.nodeId == 0 {
+				log.LogWarnf("action[registerToMaster] no node id from master(%v), raft replication disabled.", masterAddr)
+				return
+			}
+			if err = s.startRaftServer(); err != nil {
+				log.LogErrorf("action[registerToMaster] start raft server err(%v).", err)
+			}
 			return
 		case <-s.stopC:
 			timer.Stop()
@@ -262,51 +591,114 @@ func (s *DataNode) registerProfHandler() {
 	http.HandleFunc("/disks", s.apiGetDisk)
 	http.HandleFunc("/partitions", s.apiGetPartitions)
 	http.HandleFunc("/partition", s.apiGetPartition)
+	http.HandleFunc("/partition/blobFiles", s.apiGetPartitionBlobFiles)
+	http.HandleFunc("/partition/repair", s.apiGetPartitionRepair)
+	http.HandleFunc("/partition/metrics", s.apiGetPartitionMetrics)
+	http.HandleFunc("/partition/updateStatus", s.apiUpdatePartitionStatus)
 	http.HandleFunc("/extent", s.apiGetExtent)
 	http.HandleFunc("/blobfile", s.apiGetBlobFile)
+	http.HandleFunc("/manifest", s.apiGetManifest)
 	http.HandleFunc("/stats", s.apiGetStat)
+	http.HandleFunc("/tasks", s.apiGetTasks)
+	http.HandleFunc("/repair/limits", s.apiGetRepairLimits)
+	http.HandleFunc("/repair/setLimits", s.apiSetRepairLimits)
+	http.HandleFunc("/status/intervals", s.apiGetStatusIntervals)
+	http.HandleFunc("/status/setIntervals", s.apiSetStatusIntervals)
+	s.registerMetrics()
 }
 
 func (s *DataNode) startTcpService() (err error) {
 	log.LogInfo("Start: startTcpService")
-	addr := fmt.Sprintf(":%v", s.port)
-	l, err := net.Listen(NetType, addr)
-	log.LogDebugf("action[startTcpService] listen %v address(%v).", NetType, addr)
-	if err != nil {
-		log.LogError("failed to listen, err:", err)
-		return
-	}
-	s.tcpListener = l
-	go func(ln net.Listener) {
-		for {
-			conn, err := ln.Accept()
-			if err != nil {
-				log.LogErrorf("action[startTcpService] failed to accept, err:%s", err.Error())
-				break
+	for _, addr := range s.listenAddrs() {
+		var l net.Listener
+		l, err = net.Listen(NetType, addr)
+		log.LogDebugf("action[startTcpService] listen %v address(%v).", NetType, addr)
+		if err != nil {
+			log.LogError("failed to listen, err:", err)
+			s.stopTcpService()
+			return
+		}
+		s.tcpListeners = append(s.tcpListeners, l)
+		go func(ln net.Listener) {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					log.LogErrorf("action[startTcpService] failed to accept, err:%s", err.Error())
+					break
+				}
+				log.LogDebugf("action[startTcpService] accept connection from %s.", conn.RemoteAddr().String())
+				if s.rpc != nil {
+					go s.rpc.ServeConn(pool.ServerConn(conn, s.tlsConfig))
+				} else {
+					go s.serveConn(pool.ServerConn(conn, s.tlsConfig))
+				}
 			}
-			log.LogDebugf("action[startTcpService] accept connection from %s.", conn.RemoteAddr().String())
-			go s.serveConn(conn)
+		}(l)
+	}
+	return
+}
+
+// listenAddrs return the addresses tcp service should bind. If no control ip
+// configured, all interfaces are bound as before.
+func (s *DataNode) listenAddrs() (addrs []string) {
+	if s.controlIp == "" {
+		return []string{fmt.Sprintf(":%v", s.port)}
+	}
+	seen := make(map[string]bool)
+	for _, ip := range []string{s.controlIp, s.clientIp, s.replicaIp} {
+		if ip == "" || seen[ip] {
+			continue
 		}
-	}(l)
+		seen[ip] = true
+		addrs = append(addrs, util.JoinHostPort(ip, s.port))
+	}
 	return
 }
 
 func (s *DataNode) stopTcpService() (err error) {
-	if s.tcpListener != nil {
-		s.tcpListener.Close()
-		log.LogDebugf("action[stopTcpService] stop tcp service.")
+	for _, l := range s.tcpListeners {
+		l.Close()
 	}
+	s.tcpListeners = nil
+	if s.rpc != nil {
+		s.rpc.Stop()
+	}
+	log.LogDebugf("action[stopTcpService] stop tcp service.")
 	return
 }
 
+func (s *DataNode) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+func (s *DataNode) setDraining(draining bool) {
+	var v int32
+	if draining {
+		v = 1
+	}
+	if atomic.SwapInt32(&s.draining, v) != v {
+		log.LogWarnf("action[setDraining] dataNode draining(%v).", draining)
+	}
+}
+
+func (s *DataNode) getClientAddr() string {
+	if s.clientIp == "" {
+		return util.JoinHostPort(LocalIP, s.port)
+	}
+	return util.JoinHostPort(s.clientIp, s.port)
+}
+
+func (s *DataNode) getReplicaAddr() string {
+	if s.replicaIp == "" {
+		return util.JoinHostPort(LocalIP, s.port)
+	}
+	return util.JoinHostPort(s.replicaIp, s.port)
+}
+
 func (s *DataNode) serveConn(conn net.Conn) {
 	space := s.space
 	space.Stats().AddConnection()
-	c, _ := conn.(*net.TCPConn)
-	c.SetKeepAlive(true)
-	c.SetNoDelay(true)
-
-	msgH := NewMsgHandler(c)
+	msgH := NewMsgHandler(conn)
 	go s.handleRequest(msgH)
 	go s.writeToCli(msgH)
 
@@ -321,6 +713,8 @@ func (s *DataNode) serveConn(conn net.Conn) {
 			log.LogErrorf("action[serveConn] err(%v).", err)
 		}
 		space.Stats().RemoveConnection()
+		s.auth.Release(conn)
+		s.clientFences.Release(conn)
 		conn.Close()
 	}()
 
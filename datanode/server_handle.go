@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/tiglabs/containerfs/proto"
 	"github.com/tiglabs/containerfs/storage"
+	"github.com/tiglabs/containerfs/util"
 )
 
 func (s *DataNode) apiGetDisk(w http.ResponseWriter, r *http.Request) {
@@ -23,6 +26,7 @@ func (s *DataNode) apiGetDisk(w http.ResponseWriter, r *http.Request) {
 			Status      int    `json:"status"`
 			RestSize    uint64 `json:"restSize"`
 			Partitions  int    `json:"partitions"`
+			Reason      string `json:"reason,omitempty"`
 		}{
 			Path:        diskItem.Path,
 			Total:       diskItem.Total,
@@ -33,6 +37,7 @@ func (s *DataNode) apiGetDisk(w http.ResponseWriter, r *http.Request) {
 			Status:      diskItem.Status,
 			RestSize:    diskItem.RestSize,
 			Partitions:  diskItem.PartitionCount(),
+			Reason:      diskItem.failReason(),
 		}
 		disks = append(disks, disk)
 	}
@@ -52,6 +57,121 @@ func (s *DataNode) apiGetStat(w http.ResponseWriter, r *http.Request) {
 	s.buildApiSuccessResp(w, response)
 }
 
+func (s *DataNode) apiGetTasks(w http.ResponseWriter, r *http.Request) {
+	records := s.taskEngine.History()
+	result := &struct {
+		Tasks     []*TaskRecord `json:"tasks"`
+		TaskCount int           `json:"taskCount"`
+	}{
+		Tasks:     records,
+		TaskCount: len(records),
+	}
+	s.buildApiSuccessResp(w, result)
+}
+
+func (s *DataNode) apiGetRepairLimits(w http.ResponseWriter, r *http.Request) {
+	s.buildApiSuccessResp(w, gRepairScheduler.View())
+}
+
+// apiSetRepairLimits changes the limits given, the others are kept.
+func (s *DataNode) apiSetRepairLimits(w http.ResponseWriter, r *http.Request) {
+	const (
+		paramBandwidth          = "bandwidthMB"
+		paramConcurrency        = "concurrency"
+		paramOffPeakBandwidth   = "offPeakBandwidthMB"
+		paramOffPeakConcurrency = "offPeakConcurrency"
+		paramOffPeakHours       = "offPeakHours"
+	)
+	var (
+		value int64
+		err   error
+	)
+	if err = r.ParseForm(); err != nil {
+		err = fmt.Errorf("parse form fail: %v", err)
+		s.buildApiFailureResp(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	limits := gRepairScheduler.Limits()
+	for _, param := range []string{paramBandwidth, paramConcurrency, paramOffPeakBandwidth, paramOffPeakConcurrency} {
+		if r.FormValue(param) == "" {
+			continue
+		}
+		if value, err = strconv.ParseInt(r.FormValue(param), 10, 64); err != nil {
+			err = fmt.Errorf("parse param %v fail: %v", param, err)
+			s.buildApiFailureResp(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		switch param {
+		case paramBandwidth:
+			limits.Bandwidth = value * util.MB
+		case paramConcurrency:
+			limits.Concurrency = int(value)
+		case paramOffPeakBandwidth:
+			limits.OffPeakBandwidth = value * util.MB
+		case paramOffPeakConcurrency:
+			limits.OffPeakConcurrency = int(value)
+		}
+	}
+	if hours := r.FormValue(paramOffPeakHours); hours != "" {
+		if limits.OffPeakStart, limits.OffPeakEnd, err = parseOffPeakHours(hours); err != nil {
+			err = fmt.Errorf("parse param %v fail: %v", paramOffPeakHours, hours)
+			s.buildApiFailureResp(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if err = gRepairScheduler.SetLimits(limits); err != nil {
+		s.buildApiFailureResp(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.buildApiSuccessResp(w, gRepairScheduler.View())
+}
+
+func (s *DataNode) apiGetStatusIntervals(w http.ResponseWriter, r *http.Request) {
+	s.buildApiSuccessResp(w, gStatusIntervals.View())
+}
+
+// apiSetStatusIntervals changes the intervals given, the others are kept.
+func (s *DataNode) apiSetStatusIntervals(w http.ResponseWriter, r *http.Request) {
+	const (
+		paramStatusUpdate   = "statusUpdateSeconds"
+		paramUsageReconcile = "usageReconcileMinutes"
+		paramMetricsUpdate  = "metricsUpdateSeconds"
+	)
+	var (
+		value int64
+		err   error
+	)
+	if err = r.ParseForm(); err != nil {
+		err = fmt.Errorf("parse form fail: %v", err)
+		s.buildApiFailureResp(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	intervals := gStatusIntervals.Intervals()
+	for _, param := range []string{paramStatusUpdate, paramUsageReconcile, paramMetricsUpdate} {
+		if r.FormValue(param) == "" {
+			continue
+		}
+		if value, err = strconv.ParseInt(r.FormValue(param), 10, 64); err != nil {
+			err = fmt.Errorf("parse param %v fail: %v", param, err)
+			s.buildApiFailureResp(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		switch param {
+		case paramStatusUpdate:
+			intervals.StatusUpdate = time.Duration(value) * time.Second
+		case paramUsageReconcile:
+			intervals.UsageReconcile = time.Duration(value) * time.Minute
+		case paramMetricsUpdate:
+			intervals.MetricsUpdate = time.Duration(value) * time.Second
+		}
+	}
+	if err = gStatusIntervals.SetIntervals(intervals); err != nil {
+		s.buildApiFailureResp(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.buildApiSuccessResp(w, gStatusIntervals.View())
+}
+
 func (s *DataNode) apiGetPartitions(w http.ResponseWriter, r *http.Request) {
 	partitions := make([]interface{}, 0)
 	s.space.RangePartitions(func(dp DataPartition) bool {
@@ -134,6 +254,139 @@ func (s *DataNode) apiGetPartition(w http.ResponseWriter, r *http.Request) {
 	s.buildApiSuccessResp(w, result)
 }
 
+/*the partition of the param id, the code is the status to reply if err is not nil*/
+func (s *DataNode) parsePartitionParam(r *http.Request) (dp *dataPartition, code int, err error) {
+	const (
+		paramPartitionId = "id"
+	)
+	var partitionId uint64
+	if err = r.ParseForm(); err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("parse form fail: %v", err)
+	}
+	if partitionId, err = strconv.ParseUint(r.FormValue(paramPartitionId), 10, 64); err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("parse param %v fail: %v", paramPartitionId, err)
+	}
+	partition, ok := s.space.GetPartition(uint32(partitionId)).(*dataPartition)
+	if !ok || partition == nil {
+		return nil, http.StatusNotFound, fmt.Errorf("partition not exist")
+	}
+	return partition, http.StatusOK, nil
+}
+
+func (s *DataNode) apiGetPartitionBlobFiles(w http.ResponseWriter, r *http.Request) {
+	var (
+		files []*storage.FileInfo
+	)
+	dp, code, err := s.parsePartitionParam(r)
+	if err != nil {
+		s.buildApiFailureResp(w, code, err.Error())
+		return
+	}
+	if files, err = dp.GetBlobStore().GetAllWatermark(); err != nil {
+		err = fmt.Errorf("get watermark fail: %v", err)
+		s.buildApiFailureResp(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	result := &struct {
+		ID        uint32              `json:"id"`
+		Files     []*storage.FileInfo `json:"files"`
+		FileCount int                 `json:"fileCount"`
+	}{
+		ID:        dp.ID(),
+		Files:     files,
+		FileCount: len(files),
+	}
+	s.buildApiSuccessResp(w, result)
+}
+
+// apiGetPartitionRepair shows the leadership of the partition and the ranges
+// waiting for the repair.
+func (s *DataNode) apiGetPartitionRepair(w http.ResponseWriter, r *http.Request) {
+	dp, code, err := s.parsePartitionParam(r)
+	if err != nil {
+		s.buildApiFailureResp(w, code, err.Error())
+		return
+	}
+	leaseEpoch, leaseExpire := dp.leaderLease()
+	quarantined := dp.Quarantined()
+	result := &struct {
+		ID          uint32                    `json:"id"`
+		Leader      bool                      `json:"leader"`
+		Epoch       uint64                    `json:"epoch"`
+		LeaseEpoch  uint64                    `json:"leaseEpoch"`
+		LeaseExpire time.Time                 `json:"leaseExpire"`
+		Replicas    []string                  `json:"replicas"`
+		WarmHosts   []string                  `json:"warmHosts"`
+		Repairing   bool                      `json:"repairing"`
+		RepairTasks int64                     `json:"repairTasks"`
+		Sealed      bool                      `json:"sealed"`
+		Quarantined []*proto.QuarantinedRange `json:"quarantined"`
+	}{
+		ID:          dp.ID(),
+		Leader:      dp.IsLeader(),
+		Epoch:       dp.Epoch(),
+		LeaseEpoch:  leaseEpoch,
+		LeaseExpire: leaseExpire,
+		Replicas:    dp.ReplicaHosts(),
+		WarmHosts:   dp.warmHosts,
+		Repairing:   atomic.LoadInt32(&dp.isRepairing) == 1,
+		RepairTasks: atomic.LoadInt64(&dp.runtimeMetrics.RepairTasks),
+		Sealed:      atomic.LoadInt32(&dp.isSealed) == 1,
+		Quarantined: quarantined,
+	}
+	s.buildApiSuccessResp(w, result)
+}
+
+func (s *DataNode) apiGetPartitionMetrics(w http.ResponseWriter, r *http.Request) {
+	dp, code, err := s.parsePartitionParam(r)
+	if err != nil {
+		s.buildApiFailureResp(w, code, err.Error())
+		return
+	}
+	m := dp.runtimeMetrics
+	result := &struct {
+		ID              uint32         `json:"id"`
+		WriteLatency    float64        `json:"writeLatency"`
+		ReadLatency     float64        `json:"readLatency"`
+		WriteQueueDepth int64          `json:"writeQueueDepth"`
+		TotalWrites     uint64         `json:"totalWrites"`
+		TotalReads      uint64         `json:"totalReads"`
+		RepairTasks     int64          `json:"repairTasks"`
+		SlowWrites      []*SlowWriteOp `json:"slowWrites"`
+	}{
+		ID:              dp.ID(),
+		WriteLatency:    m.GetWriteLatency(),
+		ReadLatency:     m.GetReadLatency(),
+		WriteQueueDepth: m.GetWriteQueueDepth(),
+		TotalWrites:     atomic.LoadUint64(&m.TotalWrites),
+		TotalReads:      atomic.LoadUint64(&m.TotalReads),
+		RepairTasks:     atomic.LoadInt64(&m.RepairTasks),
+		SlowWrites:      m.SlowWrites(),
+	}
+	s.buildApiSuccessResp(w, result)
+}
+
+// apiUpdatePartitionStatus computes the usage and the status of the partition
+// at once instead of waiting for the next status update.
+func (s *DataNode) apiUpdatePartitionStatus(w http.ResponseWriter, r *http.Request) {
+	dp, code, err := s.parsePartitionParam(r)
+	if err != nil {
+		s.buildApiFailureResp(w, code, err.Error())
+		return
+	}
+	dp.statusUpdate()
+	result := &struct {
+		ID     uint32 `json:"id"`
+		Used   int    `json:"used"`
+		Status int    `json:"status"`
+	}{
+		ID:     dp.ID(),
+		Used:   dp.Used(),
+		Status: dp.Status(),
+	}
+	s.buildApiSuccessResp(w, result)
+}
+
 func (s *DataNode) apiGetExtent(w http.ResponseWriter, r *http.Request) {
 	var (
 		partitionId int
@@ -170,6 +423,32 @@ func (s *DataNode) apiGetExtent(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+func (s *DataNode) apiGetManifest(w http.ResponseWriter, r *http.Request) {
+	var (
+		partitionId int
+		manifest    *proto.PartitionManifest
+		err         error
+	)
+	if err = r.ParseForm(); err != nil {
+		s.buildApiFailureResp(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if partitionId, err = strconv.Atoi(r.FormValue("partitionId")); err != nil {
+		s.buildApiFailureResp(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	partition := s.space.GetPartition(uint32(partitionId))
+	if partition == nil {
+		s.buildApiFailureResp(w, http.StatusNotFound, "partition not exist")
+		return
+	}
+	if manifest, err = partition.Manifest(); err != nil {
+		s.buildApiFailureResp(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.buildApiSuccessResp(w, manifest)
+}
+
 const (
 	VerifyBlobFile = 1
 )
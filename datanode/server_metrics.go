@@ -0,0 +1,104 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/metrics"
+)
+
+func metricsHistogram() *metrics.Histogram {
+	return metrics.NewHistogram(metrics.DefaultLatencyBuckets)
+}
+
+func (s *DataNode) registerMetrics() {
+	registry := metrics.NewRegistry("datanode")
+	registry.Register(s.collectMetrics)
+	http.Handle(metrics.MetricsPath, registry)
+}
+
+func (s *DataNode) collectMetrics(w *metrics.Writer) {
+	stats := s.space.Stats()
+	w.Gauge("datanode_connections", "Current client connections.", float64(atomic.LoadInt64(&stats.CurrentConns)))
+	w.Gauge("datanode_partitions", "Data partitions on the node.", float64(stats.CreatedPartitionCnt))
+	w.Counter("datanode_qos_throttled_total", "Client requests delayed by the qos.", float64(s.qos.Throttled()))
+	w.Counter("datanode_qos_refused_total", "Client requests refused by the qos.", float64(s.qos.Refused()))
+	s.slowOps.Range(func(op string, count uint64) {
+		w.Counter("datanode_slow_ops_total", "Requests served slower than the threshold of their op.", float64(count), "op", op)
+	})
+	w.Counter("datanode_slow_op_alerts_dropped_total", "Alerts of the slow ops the webhook did not get.", float64(s.slowOps.Dropped()))
+	if s.gcTuner != nil {
+		w.Gauge("datanode_gc_percent", "GOGC set by the memory budget.", float64(s.gcTuner.GCPercent()))
+	}
+	pool := proto.Buffers.Stats()
+	w.Gauge("datanode_buffer_pool_max_bytes", "Largest packet buffer pooled.", float64(pool.MaxPooledSize))
+	w.Counter("datanode_buffer_pool_unpooled_total", "Packet buffers allocated over the max pooled size.", float64(pool.Unpooled))
+	for _, t := range pool.Tiers {
+		size := strconv.Itoa(t.Size)
+		w.Counter("datanode_buffer_pool_gets_total", "Packet buffers taken from the pool.", float64(t.Gets), "size", size)
+		w.Counter("datanode_buffer_pool_misses_total", "Packet buffers the pool had to allocate.", float64(t.Misses), "size", size)
+		w.Gauge("datanode_buffer_pool_hit_ratio", "Share of the packet buffers reused by the pool.", t.HitRate(), "size", size)
+	}
+
+	for _, d := range s.space.GetDisks() {
+		d.RLock()
+		w.Gauge("datanode_disk_total_bytes", "Total bytes of disk.", float64(d.Total), "disk", d.Path)
+		w.Gauge("datanode_disk_used_bytes", "Used bytes of disk.", float64(d.Used), "disk", d.Path)
+		w.Gauge("datanode_disk_available_bytes", "Available bytes of disk.", float64(d.Available), "disk", d.Path)
+		w.Counter("datanode_disk_read_errors_total", "Read errors of disk.", float64(d.ReadErrs), "disk", d.Path)
+		w.Counter("datanode_disk_write_errors_total", "Write errors of disk.", float64(d.WriteErrs), "disk", d.Path)
+		w.Gauge("datanode_disk_status", "Status of disk.", float64(d.Status), "disk", d.Path)
+		d.RUnlock()
+		w.Gauge("datanode_disk_repairs_running", "Extent and blob repairs holding a slot of disk.", float64(gRepairScheduler.running(d.Path)), "disk", d.Path)
+	}
+
+	s.space.RangePartitions(func(partition DataPartition) bool {
+		dp, ok := partition.(*dataPartition)
+		if !ok {
+			return true
+		}
+		id := strconv.FormatUint(uint64(dp.ID()), 10)
+		m := dp.runtimeMetrics
+		w.Gauge("datanode_partition_size_bytes", "Size of data partition.", float64(dp.Size()), "partition", id, "vol", dp.volumeId)
+		w.Gauge("datanode_partition_used_bytes", "Used bytes of data partition.", float64(dp.Used()), "partition", id, "vol", dp.volumeId)
+		w.Gauge("datanode_partition_status", "Status of data partition.", float64(dp.Status()), "partition", id, "vol", dp.volumeId)
+		w.Gauge("datanode_partition_leader", "Whether the node leads the data partition.", metrics.Bool(dp.IsLeader()), "partition", id, "vol", dp.volumeId)
+		w.Counter("datanode_partition_reads_total", "Reads of data partition.", float64(atomic.LoadUint64(&m.TotalReads)), "partition", id, "vol", dp.volumeId)
+		w.Counter("datanode_partition_writes_total", "Writes of data partition.", float64(atomic.LoadUint64(&m.TotalWrites)), "partition", id, "vol", dp.volumeId)
+		w.Histogram("datanode_partition_read_latency_seconds", "Read latency of data partition.", m.readLatencySeconds, "partition", id, "vol", dp.volumeId)
+		w.Histogram("datanode_partition_write_latency_seconds", "Write latency of data partition.", m.writeLatencySeconds, "partition", id, "vol", dp.volumeId)
+		w.Gauge("datanode_partition_write_queue_depth", "Max writes in the store during last period.", float64(m.GetWriteQueueDepth()), "partition", id, "vol", dp.volumeId)
+		w.Gauge("datanode_partition_repair_tasks", "Extent and blob repairs in progress.", float64(atomic.LoadInt64(&m.RepairTasks)), "partition", id, "vol", dp.volumeId)
+		if count, size := dp.extentStore.TieredSize(); count != 0 {
+			w.Gauge("datanode_partition_tiered_extents", "Extents of data partition in the cold tier.", float64(count), "partition", id, "vol", dp.volumeId)
+			w.Gauge("datanode_partition_tiered_bytes", "Bytes of the extents of data partition in the cold tier.", float64(size), "partition", id, "vol", dp.volumeId)
+		}
+		if store := dp.GetBlobStore(); store != nil {
+			w.Gauge("datanode_partition_blob_reclaimable_bytes", "Bytes of deleted blob objects not compacted.", float64(store.ReclaimableSize()), "partition", id, "vol", dp.volumeId)
+			w.Counter("datanode_partition_blob_compacted_bytes_total", "Bytes of deleted blob objects released by compaction.", float64(store.CompactedSize()), "partition", id, "vol", dp.volumeId)
+			raw, stored := store.CompressedSize()
+			w.Counter("datanode_partition_blob_written_raw_bytes_total", "Raw bytes of blob objects written.", float64(raw), "partition", id, "vol", dp.volumeId)
+			w.Counter("datanode_partition_blob_written_stored_bytes_total", "Stored bytes of blob objects written, after compression.", float64(stored), "partition", id, "vol", dp.volumeId)
+			if stored != 0 {
+				w.Gauge("datanode_partition_blob_compression_ratio", "Raw over stored bytes of blob objects written.", float64(raw)/float64(stored), "partition", id, "vol", dp.volumeId)
+			}
+		}
+		return true
+	})
+}
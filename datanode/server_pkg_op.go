@@ -18,8 +18,12 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"net"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/juju/errors"
@@ -35,7 +39,7 @@ var (
 	ErrorUnknownOp = errors.New("unknown opcode")
 )
 
-func (s *DataNode) operatePacket(pkg *Packet, c *net.TCPConn) {
+func (s *DataNode) operatePacket(pkg *Packet, c net.Conn) {
 	orgSize := pkg.Size
 	umpKey := fmt.Sprintf("%s_datanode_%s", s.clusterId, pkg.GetOpMsg())
 	tpObject := ump.BeforeTP(umpKey)
@@ -62,6 +66,10 @@ func (s *DataNode) operatePacket(pkg *Packet, c *net.TCPConn) {
 		pkg.Size = resultSize
 		ump.AfterTP(tpObject, err)
 	}()
+	if dp, ok := pkg.DataPartition.(*dataPartition); ok && dp.isRaftReplicated() && pkg.isRaftCommand() {
+		s.handleRaftCommand(dp, pkg)
+		return
+	}
 	switch pkg.Opcode {
 	case proto.OpCreateFile:
 		s.handleCreateFile(pkg)
@@ -75,6 +83,14 @@ func (s *DataNode) operatePacket(pkg *Packet, c *net.TCPConn) {
 		s.handleStreamRead(pkg, c)
 	case proto.OpMarkDelete:
 		s.handleMarkDelete(pkg)
+	case proto.OpSyncExtent:
+		s.handleSyncExtent(pkg)
+	case proto.OpAddExtentRef:
+		s.handleAddExtentRef(pkg)
+	case proto.OpPunchHole:
+		s.handlePunchHole(pkg)
+	case proto.OpExtentReferences:
+		s.handleExtentReferences(pkg)
 	case proto.OpNotifyCompactBlobFile:
 		s.handleNotifyCompact(pkg)
 	case proto.OpNotifyExtentRepair:
@@ -83,6 +99,8 @@ func (s *DataNode) operatePacket(pkg *Packet, c *net.TCPConn) {
 		s.handleNotifyBlobRepair(pkg)
 	case proto.OpGetWatermark:
 		s.handleGetWatermark(pkg)
+	case proto.OpGetBlockCrcs:
+		s.handleGetBlockCrcs(pkg)
 	case proto.OpExtentStoreGetAllWaterMark:
 		s.handleExtentStoreGetAllWatermark(pkg)
 	case proto.OpBlobStoreGetAllWaterMark:
@@ -93,10 +111,32 @@ func (s *DataNode) operatePacket(pkg *Packet, c *net.TCPConn) {
 		s.handleLoadDataPartition(pkg)
 	case proto.OpDeleteDataPartition:
 		s.handleDeleteDataPartition(pkg)
+	case proto.OpArchiveDataPartition:
+		s.handleArchiveDataPartition(pkg)
+	case proto.OpRehydrateDataPartition:
+		s.handleRehydrateDataPartition(pkg)
+	case proto.OpMoveDataPartition:
+		s.handleMoveDataPartition(pkg)
+	case proto.OpOfflineDataPartition:
+		s.handleOfflineDataPartition(pkg)
+	case proto.OpRepairDataPartition:
+		s.handleRepairDataPartition(pkg)
+	case proto.OpVerifyDataPartition:
+		s.handleVerifyDataPartition(pkg)
+	case proto.OpTierExtents:
+		s.handleTierExtents(pkg)
 	case proto.OpDataNodeHeartbeat:
 		s.handleHeartbeats(pkg)
 	case proto.OpGetDataPartitionMetrics:
 		s.handleGetDataPartitionMetrics(pkg)
+	case proto.OpWriteECShard:
+		s.handleWriteECShard(pkg)
+	case proto.OpReadECShard:
+		s.handleReadECShard(pkg)
+	case proto.OpGetECExtents:
+		s.handleGetECExtents(pkg)
+	case proto.OpEncodeDataPartition:
+		s.handleEncodeDataPartition(pkg)
 	default:
 		pkg.PackErrorBody(ErrorUnknownOp.Error(), ErrorUnknownOp.Error()+strconv.Itoa(int(pkg.Opcode)))
 	}
@@ -131,44 +171,82 @@ func (s *DataNode) handleCreateFile(pkg *Packet) {
 		if len(pkg.Data) >= 8 && pkg.Size >= 8 {
 			ino = binary.BigEndian.Uint64(pkg.Data)
 		}
-		err = pkg.DataPartition.GetExtentStore().Create(pkg.FileID, ino, false)
+		store := pkg.DataPartition.GetExtentStore()
+		if err = store.Create(pkg.FileID, ino, false); err != nil {
+			return
+		}
+		// the preallocation is a hint, the extent is usable without it
+		if prealloc := createPrealloc(pkg); prealloc > 0 {
+			if pErr := store.Preallocate(pkg.FileID, prealloc); pErr != nil {
+				log.LogWarnf("action[handleCreateFile] %v preallocate(%v) err(%v).", pkg.GetUniqueLogId(), prealloc, pErr)
+			}
+		}
 	}
 	return
 }
 
+/*the bytes to preallocate for the extent created, following the inode in the data*/
+func createPrealloc(pkg *Packet) int64 {
+	if len(pkg.Data) >= 16 && pkg.Size >= 16 {
+		return int64(binary.BigEndian.Uint64(pkg.Data[8:16]))
+	}
+	return 0
+}
+
 // Handle OpCreateDataPartition packet.
 func (s *DataNode) handleCreateDataPartition(pkg *Packet) {
 	task := &proto.AdminTask{}
 	json.Unmarshal(pkg.Data, task)
 	pkg.PackOkReply()
+	s.taskEngine.Submit(task, s.createDataPartition)
+}
+
+func (s *DataNode) createDataPartition(task *proto.AdminTask) (resp interface{}, status int8) {
 	response := &proto.CreateDataPartitionResponse{}
 	request := &proto.CreateDataPartitionRequest{}
 	if task.OpCode == proto.OpCreateDataPartition {
 		bytes, _ := json.Marshal(task.Request)
 		json.Unmarshal(bytes, request)
-		if _, err := s.space.CreatePartition(request.VolumeId, uint32(request.PartitionId),
-			request.PartitionSize, request.PartitionType); err != nil {
+		if s.isDraining() && s.space.GetPartition(uint32(request.PartitionId)) == nil {
+			response.PartitionId = uint64(request.PartitionId)
+			response.Status = proto.TaskFail
+			response.Result = ErrNodeDraining.Error()
+			response.ErrCode = proto.ErrCodeNodeDraining
+			log.LogErrorf("from master Task(%v) failed,error(%v)", task.ToString(), response.Result)
+		} else if dp, err := s.space.CreatePartition(request.VolumeId, uint32(request.PartitionId),
+			request.PartitionSize, request.PartitionType, request.EncryptKeyId); err != nil {
 			response.PartitionId = uint64(request.PartitionId)
 			response.Status = proto.TaskFail
 			response.Result = err.Error()
+			response.ErrCode = errCodeOf(response.Result)
 			log.LogErrorf("from master Task(%v) failed,error(%v)", task.ToString(), err.Error())
 		} else {
-			response.Status = proto.TaskSuccess
-			response.PartitionId = request.PartitionId
+			if dp == nil {
+				dp = s.space.GetPartition(uint32(request.PartitionId))
+			}
+			dp.UpdateEpoch(request.Epoch)
+			if err = s.createPartitionRaft(dp, request); err == nil {
+				err = s.createPartitionShards(dp, request)
+			}
+			if err != nil {
+				response.PartitionId = uint64(request.PartitionId)
+				response.Status = proto.TaskFail
+				response.Result = err.Error()
+				response.ErrCode = errCodeOf(response.Result)
+				log.LogErrorf("from master Task(%v) failed,error(%v)", task.ToString(), err.Error())
+			} else {
+				response.Status = proto.TaskSuccess
+				response.PartitionId = request.PartitionId
+			}
 		}
 	} else {
 		response.PartitionId = uint64(request.PartitionId)
 		response.Status = proto.TaskFail
 		response.Result = "illegal opcode "
+		response.ErrCode = proto.ErrCodeUnknownOp
 		log.LogErrorf("from master Task(%v) failed,error(%v)", task.ToString(), response.Result)
 	}
-	task.Response = response
-	data, _ := json.Marshal(task)
-	_, err := MasterHelper.Request("POST", master.DataNodeResponse, nil, data)
-	if err != nil {
-		err = errors.Annotatef(err, "create dataPartition failed,partitionId(%v)", request.PartitionId)
-		log.LogError(errors.ErrorStack(err))
-	}
+	return response, int8(response.Status)
 }
 
 // Handle OpHeartbeat packet.
@@ -183,14 +261,35 @@ func (s *DataNode) handleHeartbeats(pkg *Packet) {
 
 	s.fillHeartBeatResponse(response)
 
+	s.reporter.Lock()
+	defer s.reporter.Unlock()
+	var (
+		epoch   uint64
+		reports map[uint64]*proto.PartitionReport
+	)
 	if task.OpCode == proto.OpDataNodeHeartbeat {
 		bytes, _ := json.Marshal(task.Request)
 		json.Unmarshal(bytes, request)
 		response.Status = proto.TaskSuccess
+		response.ClockOffset = time.Now().Unix() - request.CurrTime
+		atomic.StoreInt64(&s.lastHeartbeat, time.Now().Unix())
 		MasterHelper.AddNode(request.MasterAddr)
+		s.setDraining(request.Draining)
+		response.Draining = request.Draining
+		for _, fence := range request.FencedClients {
+			s.clientFences.Fence(fence.Session, fence.ExpireTime)
+		}
+		s.auth.Update(request.VolTokens)
+		s.updatePartitionEpochs(request)
+		s.updateCompression(request.VolCompression)
+		s.updateColdTier(request.VolColdTierDays)
+		s.updateReadOnly(request.VolReadOnly)
+		s.updateVolKeys(request.VolKeys)
+		epoch, reports = s.reporter.MakeReport(request, response)
 	} else {
 		response.Status = proto.TaskFail
 		response.Result = "illegal opcode"
+		response.ErrCode = proto.ErrCodeUnknownOp
 	}
 	task.Response = response
 	data, err := json.Marshal(task)
@@ -205,7 +304,109 @@ func (s *DataNode) handleHeartbeats(pkg *Packet) {
 		log.LogErrorf(errors.ErrorStack(err))
 		return
 	}
-	log.LogDebugf("action[handleHeartbeats] report data len(%v) to master success.", len(data))
+	if reports != nil {
+		s.reporter.Accept(epoch, response.ReportSeq, reports)
+	}
+	log.LogDebugf("action[handleHeartbeats] report data len(%v) delta(%v) to master success.", len(data), response.IsDelta)
+}
+
+// updatePartitionEpochs catches the partitions up with the epochs and the seals
+// of the master, a master without CapChangedEpochs sends the epochs of all the
+// partitions and unseals the ones out of SealedPartitions.
+func (s *DataNode) updatePartitionEpochs(request *proto.HeartBeatRequest) {
+	changedOnly := request.Capabilities&proto.CapChangedEpochs != 0
+	for id, partitionEpoch := range request.PartitionEpochs {
+		if dp := s.space.GetPartition(uint32(id)); dp != nil {
+			dp.UpdateEpoch(partitionEpoch)
+			if changedOnly {
+				continue
+			}
+			inSync, sealed := request.SealedPartitions[id]
+			if partition, ok := dp.(*dataPartition); ok {
+				partition.updateSeal(sealed, inSync)
+			}
+		}
+	}
+	if !changedOnly {
+		return
+	}
+	for id, inSync := range request.SealedPartitions {
+		if partition, ok := s.space.GetPartition(uint32(id)).(*dataPartition); ok {
+			partition.updateSeal(true, inSync)
+		}
+	}
+	for _, id := range request.UnsealedPartitions {
+		if partition, ok := s.space.GetPartition(uint32(id)).(*dataPartition); ok {
+			partition.updateSeal(false, false)
+		}
+	}
+}
+
+/*set the codecs of the blob stores to the compressions of their vols*/
+func (s *DataNode) updateCompression(volCompression map[string]string) {
+	s.space.RangePartitions(func(partition DataPartition) bool {
+		dp, ok := partition.(*dataPartition)
+		if !ok || dp.blobStore == nil {
+			return true
+		}
+		codec, err := storage.ParseCodec(volCompression[dp.volumeId])
+		if err != nil {
+			log.LogErrorf("action[updateCompression] partition(%v) vol(%v) err(%v).", dp.partitionId, dp.volumeId, err)
+			return true
+		}
+		dp.blobStore.SetCodec(codec)
+		return true
+	})
+}
+
+func (s *DataNode) updateReadOnly(volReadOnly map[string]bool) {
+	s.space.RangePartitions(func(partition DataPartition) bool {
+		if dp, ok := partition.(*dataPartition); ok {
+			var v int32
+			if volReadOnly[dp.volumeId] {
+				v = 1
+			}
+			atomic.StoreInt32(&dp.volReadOnly, v)
+		}
+		return true
+	})
+}
+
+/*give the keys of their vols to the encrypted stores, their reads and writes fail until then*/
+func (s *DataNode) updateVolKeys(volKeys map[string]*proto.VolKey) {
+	ciphers := make(map[string]*storage.DataCipher)
+	s.space.RangePartitions(func(partition DataPartition) bool {
+		dp, ok := partition.(*dataPartition)
+		if !ok || dp.extentStore == nil || dp.blobStore == nil {
+			return true
+		}
+		keyId := dp.extentStore.EncryptionKeyId()
+		if keyId == "" {
+			return true
+		}
+		vk, ok := volKeys[dp.volumeId]
+		if !ok || vk.KeyId != keyId {
+			log.LogErrorf("action[updateVolKeys] partition(%v) vol(%v) key(%v) not received.", dp.partitionId, dp.volumeId, keyId)
+			return true
+		}
+		c, ok := ciphers[dp.volumeId]
+		if !ok {
+			var err error
+			if c, err = storage.NewDataCipher(vk.KeyId, vk.Key); err != nil {
+				log.LogErrorf("action[updateVolKeys] vol(%v) key(%v) err(%v).", dp.volumeId, vk.KeyId, err)
+				return true
+			}
+			ciphers[dp.volumeId] = c
+		}
+		if err := dp.extentStore.SetCipher(c); err != nil {
+			log.LogErrorf("action[updateVolKeys] partition(%v) vol(%v) err(%v).", dp.partitionId, dp.volumeId, err)
+			return true
+		}
+		if err := dp.blobStore.SetCipher(c); err != nil {
+			log.LogErrorf("action[updateVolKeys] partition(%v) vol(%v) err(%v).", dp.partitionId, dp.volumeId, err)
+		}
+		return true
+	})
 }
 
 // Handle OpDeleteDataPartition packet.
@@ -213,6 +414,10 @@ func (s *DataNode) handleDeleteDataPartition(pkg *Packet) {
 	task := &proto.AdminTask{}
 	json.Unmarshal(pkg.Data, task)
 	pkg.PackOkReply()
+	s.taskEngine.Submit(task, s.deleteDataPartition)
+}
+
+func (s *DataNode) deleteDataPartition(task *proto.AdminTask) (resp interface{}, status int8) {
 	request := &proto.DeleteDataPartitionRequest{}
 	response := &proto.DeleteDataPartitionResponse{}
 	if task.OpCode == proto.OpDeleteDataPartition {
@@ -222,9 +427,14 @@ func (s *DataNode) handleDeleteDataPartition(pkg *Packet) {
 			response.PartitionId = uint64(request.PartitionId)
 			response.Status = proto.TaskFail
 			response.Result = err.Error()
+			response.ErrCode = proto.ErrCodeArgMismatch
 			log.LogErrorf("action[handleDeleteDataPartition] from master Task(%v) failed, err(%v)", task.ToString(), err)
 		} else {
+			dp, _ := s.space.GetPartition(uint32(request.PartitionId)).(*dataPartition)
 			s.space.DeletePartition(uint32(request.PartitionId))
+			if dp != nil {
+				dp.deleteRaft()
+			}
 			response.PartitionId = uint64(request.PartitionId)
 			response.Status = proto.TaskSuccess
 		}
@@ -232,15 +442,10 @@ func (s *DataNode) handleDeleteDataPartition(pkg *Packet) {
 		response.PartitionId = uint64(request.PartitionId)
 		response.Status = proto.TaskFail
 		response.Result = "illegal opcode "
+		response.ErrCode = proto.ErrCodeUnknownOp
 		log.LogErrorf("action[handleDeleteDataPartition] from master Task(%v) failed, err(%v).", task.ToString(), response.Result)
 	}
-	task.Response = response
-	data, _ := json.Marshal(task)
-	_, err := MasterHelper.Request("POST", master.DataNodeResponse, nil, data)
-	if err != nil {
-		err = errors.Annotatef(err, "delete dataPartition failed,partitionId(%v)", request.PartitionId)
-		log.LogErrorf("action[handleDeleteDataPartition] err(%v).", err)
-	}
+	return response, int8(response.Status)
 }
 
 // Handle OpLoadDataPartition packet.
@@ -248,6 +453,10 @@ func (s *DataNode) handleLoadDataPartition(pkg *Packet) {
 	task := &proto.AdminTask{}
 	json.Unmarshal(pkg.Data, task)
 	pkg.PackOkReply()
+	s.taskEngine.Submit(task, s.loadDataPartition)
+}
+
+func (s *DataNode) loadDataPartition(task *proto.AdminTask) (resp interface{}, status int8) {
 	request := &proto.LoadDataPartitionRequest{}
 	response := &proto.LoadDataPartitionResponse{}
 	if task.OpCode == proto.OpLoadDataPartition {
@@ -258,6 +467,7 @@ func (s *DataNode) handleLoadDataPartition(pkg *Packet) {
 			response.Status = proto.TaskFail
 			response.PartitionId = uint64(request.PartitionId)
 			response.Result = fmt.Sprintf("dataPartition(%v) not found", request.PartitionId)
+			response.ErrCode = proto.ErrCodePartitionNotExist
 			log.LogErrorf("from master Task(%v) failed,error(%v)", task.ToString(), response.Result)
 		} else {
 			response = dp.(*dataPartition).Load()
@@ -267,15 +477,10 @@ func (s *DataNode) handleLoadDataPartition(pkg *Packet) {
 		response.PartitionId = uint64(request.PartitionId)
 		response.Status = proto.TaskFail
 		response.Result = "illegal opcode "
+		response.ErrCode = proto.ErrCodeUnknownOp
 		log.LogErrorf("from master Task(%v) failed,error(%v)", task.ToString(), response.Result)
 	}
-	task.Response = response
-	data, _ := json.Marshal(task)
-	_, err := MasterHelper.Request("POST", master.DataNodeResponse, nil, data)
-	if err != nil {
-		err = errors.Annotatef(err, "load dataPartition failed,partitionId(%v)", request.PartitionId)
-		log.LogError(errors.ErrorStack(err))
-	}
+	return response, int8(response.Status)
 }
 
 // Handle OpMarkDelete packet.
@@ -286,6 +491,9 @@ func (s *DataNode) handleMarkDelete(pkg *Packet) {
 		err = pkg.DataPartition.GetBlobStore().MarkDelete(uint32(pkg.FileID), pkg.Offset, int64(pkg.Size))
 	case proto.ExtentStoreMode:
 		err = pkg.DataPartition.GetExtentStore().MarkDelete(pkg.FileID)
+		if store := pkg.ecStore(); store != nil && err == nil {
+			err = store.MarkDelete(pkg.FileID)
+		}
 	}
 	if err != nil {
 		err = errors.Annotatef(err, "Request(%v) MarkDelete Error", pkg.GetUniqueLogId())
@@ -297,6 +505,91 @@ func (s *DataNode) handleMarkDelete(pkg *Packet) {
 	return
 }
 
+// Handle OpSyncExtent packet, the written data of the file is synchronized
+// to disk on every replica the packet passes.
+func (s *DataNode) handleSyncExtent(pkg *Packet) {
+	var err error
+	switch pkg.StoreMode {
+	case proto.BlobStoreMode:
+		err = pkg.DataPartition.GetBlobStore().Sync(uint32(pkg.FileID))
+	case proto.ExtentStoreMode:
+		err = pkg.DataPartition.GetExtentStore().Sync(pkg.FileID)
+	}
+	if err != nil {
+		err = errors.Annotatef(err, "Request(%v) SyncExtent Error", pkg.GetUniqueLogId())
+		pkg.PackErrorBody(LogSync, err.Error())
+		s.addDiskErrs(pkg.PartitionID, err, WriteFlag)
+	} else {
+		pkg.PackOkReply()
+	}
+
+	return
+}
+
+// Handle OpAddExtentRef packet, the reference is added on every replica the
+// packet passes, the extent is deleted by the mark delete dropping the last one.
+func (s *DataNode) handleAddExtentRef(pkg *Packet) {
+	var err error
+	if pkg.StoreMode != proto.ExtentStoreMode {
+		err = errors.Annotatef(ErrStoreTypeMismatch, "Request(%v) AddExtentRef", pkg.GetUniqueLogId())
+		pkg.PackErrorBody(LogAddExtentRef, err.Error())
+		return
+	}
+	store := pkg.DataPartition.GetExtentStore()
+	if dp, extent := pkg.ecExtent(); extent != nil {
+		store = dp.getECStore().ExtentStore
+	}
+	if _, err = store.AddRef(pkg.FileID); err != nil {
+		err = errors.Annotatef(err, "Request(%v) AddExtentRef Error", pkg.GetUniqueLogId())
+		pkg.PackErrorBody(LogAddExtentRef, err.Error())
+	} else {
+		pkg.PackOkReply()
+	}
+
+	return
+}
+
+// Handle OpPunchHole packet, the range of the extent is zeroed and its space
+// released on every replica the packet passes.
+func (s *DataNode) handlePunchHole(pkg *Packet) {
+	var err error
+	defer func() {
+		if err != nil {
+			err = errors.Annotatef(err, "Request(%v) PunchHole Error", pkg.GetUniqueLogId())
+			pkg.PackErrorBody(LogPunchHole, err.Error())
+		} else {
+			pkg.PackOkReply()
+		}
+	}()
+	if pkg.StoreMode != proto.ExtentStoreMode {
+		err = ErrStoreTypeMismatch
+		return
+	}
+	if len(pkg.Data) < 8 || pkg.Size < 8 {
+		err = storage.NewParamMismatchErr(fmt.Sprintf("punch hole data size=%v", pkg.Size))
+		return
+	}
+	size := int64(binary.BigEndian.Uint64(pkg.Data))
+	err = pkg.DataPartition.GetExtentStore().PunchHole(pkg.FileID, pkg.Offset, size)
+	return
+}
+
+// Handle OpExtentReferences packet, the report of a meta partition is kept by
+// the partition until the next one for the extent GC.
+func (s *DataNode) handleExtentReferences(pkg *Packet) {
+	report := &proto.ExtentReferences{}
+	if err := json.Unmarshal(pkg.Data[:pkg.Size], report); err != nil {
+		err = errors.Annotatef(err, "Request(%v) ExtentReferences Error", pkg.GetUniqueLogId())
+		pkg.PackErrorBody(LogExtentGC, err.Error())
+		return
+	}
+	if dp, ok := pkg.DataPartition.(*dataPartition); ok {
+		dp.extentRefs.update(report)
+	}
+	pkg.PackOkReply()
+	return
+}
+
 // Handle OpWrite packet.
 func (s *DataNode) handleWrite(pkg *Packet) {
 	var err error
@@ -316,6 +609,10 @@ func (s *DataNode) handleWrite(pkg *Packet) {
 		err = storage.ErrSyscallNoSpace
 		return
 	}
+	if dp, ok := pkg.DataPartition.(*dataPartition); ok {
+		dp.runtimeMetrics.BeginWrite()
+		defer dp.runtimeMetrics.EndWrite()
+	}
 	switch pkg.StoreMode {
 	case proto.BlobStoreMode:
 		err = pkg.DataPartition.GetBlobStore().Write(uint32(pkg.FileID), uint64(pkg.Offset), int64(pkg.Size), pkg.Data, pkg.Crc)
@@ -323,8 +620,8 @@ func (s *DataNode) handleWrite(pkg *Packet) {
 	case proto.ExtentStoreMode:
 		err = pkg.DataPartition.GetExtentStore().Write(pkg.FileID, pkg.Offset, int64(pkg.Size), pkg.Data, pkg.Crc)
 		s.addDiskErrs(pkg.PartitionID, err, WriteFlag)
-		if err == nil && pkg.Opcode == proto.OpWrite && pkg.Size == util.BlockSize {
-			proto.Buffers.Put(pkg.Data)
+		if err == nil && pkg.Opcode == proto.OpWrite {
+			proto.Buffers.Free(pkg.Data)
 		}
 	}
 	return
@@ -332,15 +629,23 @@ func (s *DataNode) handleWrite(pkg *Packet) {
 
 // Handle OpRead packet.
 func (s *DataNode) handleRead(pkg *Packet) {
-	pkg.Data = make([]byte, pkg.Size)
+	// the buffer is freed once the reply is written
+	pkg.Data = proto.Buffers.Alloc(int(pkg.Size))
 	var err error
 	switch pkg.StoreMode {
 	case proto.BlobStoreMode:
 		pkg.Crc, err = pkg.DataPartition.GetBlobStore().Read(uint32(pkg.FileID), pkg.Offset, int64(pkg.Size), pkg.Data)
 		s.addDiskErrs(pkg.PartitionID, err, ReadFlag)
 	case proto.ExtentStoreMode:
+		if dp, extent := pkg.ecExtent(); extent != nil {
+			if err = dp.ecRead(extent, pkg.Offset, pkg.Data[:pkg.Size]); err == nil {
+				pkg.Crc = crc32.ChecksumIEEE(pkg.Data[:pkg.Size])
+			}
+			break
+		}
 		pkg.Crc, err = pkg.DataPartition.GetExtentStore().Read(pkg.FileID, pkg.Offset, int64(pkg.Size), pkg.Data)
 		s.addDiskErrs(pkg.PartitionID, err, ReadFlag)
+		s.checkReadCorruption(pkg, err)
 	}
 	if err == nil {
 		pkg.PackOkReadReply()
@@ -351,6 +656,20 @@ func (s *DataNode) handleRead(pkg *Packet) {
 	return
 }
 
+// The data read mismatches the block crc, the store has marked the corrupt
+// blocks and the replica repairs them from the other replicas at once, the client
+// retries the read on another replica meanwhile.
+func (s *DataNode) checkReadCorruption(pkg *Packet, err error) {
+	if err == nil || !strings.Contains(err.Error(), storage.ErrorBlockCrcMismatch.Error()) {
+		return
+	}
+	log.LogErrorf("action[checkReadCorruption] partition(%v) extent(%v) offset(%v) size(%v) err(%v).",
+		pkg.PartitionID, pkg.FileID, pkg.Offset, pkg.Size, err)
+	if dp, ok := pkg.DataPartition.(*dataPartition); ok {
+		go dp.LaunchRepair()
+	}
+}
+
 // Handle OpStreamRead packet.
 func (s *DataNode) handleStreamRead(request *Packet, connect net.Conn) {
 	var (
@@ -360,21 +679,48 @@ func (s *DataNode) handleStreamRead(request *Packet, connect net.Conn) {
 	offset := request.Offset
 	store := request.DataPartition.GetExtentStore()
 	umpKey := fmt.Sprintf("%s_datanode_%s", s.clusterId, "Read")
+	// the extent of an erasure coded partition is read from the shards
+	dp, ecExtent := request.ecExtent()
+	// the full blocks of a zero copy read are sent from the file, the others are read
+	sc, zeroCopy := connect.(syscall.Conn)
+	if zeroCopy = zeroCopy && request.isZeroCopyRead() && ecExtent == nil; zeroCopy {
+		request.Arglen = 0
+	}
 	for {
 		if needReplySize <= 0 {
 			break
 		}
 		err = nil
 		currReadSize := uint32(util.Min(int(needReplySize), util.ReadBlockSize))
-		if currReadSize == util.ReadBlockSize {
-			request.Data, _ = proto.Buffers.Get(util.ReadBlockSize)
-		} else {
-			request.Data = make([]byte, currReadSize)
+		if zeroCopy && currReadSize == util.BlockSize {
+			var sent bool
+			if sent, err = s.sendStreamBlock(request, sc, connect, offset, umpKey); sent {
+				if err != nil {
+					err = fmt.Errorf(request.ActionMsg(ActionWriteToCli, connect.RemoteAddr().String(),
+						request.StartT, err))
+					log.LogErrorf(err.Error())
+					connect.Close()
+					return
+				}
+				needReplySize -= currReadSize
+				offset += int64(currReadSize)
+				continue
+			}
 		}
+		request.Data = proto.Buffers.Alloc(int(currReadSize))
 		tpObject := ump.BeforeTP(umpKey)
-		request.Crc, err = store.Read(request.FileID, offset, int64(currReadSize), request.Data)
+		if ecExtent != nil {
+			if err = dp.ecRead(ecExtent, offset, request.Data[:currReadSize]); err == nil {
+				request.Crc = crc32.ChecksumIEEE(request.Data[:currReadSize])
+			}
+		} else {
+			request.Crc, err = store.Read(request.FileID, offset, int64(currReadSize), request.Data)
+		}
 		ump.AfterTP(tpObject, err)
 		if err != nil {
+			s.addDiskErrs(request.PartitionID, err, ReadFlag)
+			s.checkReadCorruption(request, err)
+			proto.Buffers.Free(request.Data)
 			request.PackErrorBody(ActionStreamRead, err.Error())
 			if err = request.WriteToConn(connect); err != nil {
 				err = fmt.Errorf(request.ActionMsg(ActionWriteToCli, connect.RemoteAddr().String(),
@@ -394,9 +740,25 @@ func (s *DataNode) handleStreamRead(request *Packet, connect net.Conn) {
 		}
 		needReplySize -= currReadSize
 		offset += int64(currReadSize)
-		if currReadSize == util.ReadBlockSize {
-			proto.Buffers.Put(request.Data)
-		}
+		proto.Buffers.Free(request.Data)
+	}
+	return
+}
+
+// sendStreamBlock replies a full block of a stream read with sendfile, sent is
+// false if the block has to be read instead, the reply is not started then.
+func (s *DataNode) sendStreamBlock(request *Packet, sc syscall.Conn, connect net.Conn, offset int64, umpKey string) (sent bool, err error) {
+	tpObject := ump.BeforeTP(umpKey)
+	err = request.DataPartition.GetExtentStore().SendFile(request.FileID, offset, util.BlockSize, sc, func(crc uint32) error {
+		sent = true
+		request.Crc = crc
+		request.Size = util.BlockSize
+		request.ResultCode = proto.OpOk
+		connect.SetWriteDeadline(time.Now().Add(proto.WriteDeadlineTime * time.Second))
+		return request.WriteHeaderToConn(connect)
+	})
+	if sent {
+		ump.AfterTP(tpObject, err)
 	}
 	return
 }
@@ -412,6 +774,10 @@ func (s *DataNode) handleGetWatermark(pkg *Packet) {
 	case proto.BlobStoreMode:
 		fInfo, err = pkg.DataPartition.GetBlobStore().GetWatermark(pkg.FileID)
 	case proto.ExtentStoreMode:
+		if _, extent := pkg.ecExtent(); extent != nil {
+			fInfo = &storage.FileInfo{FileId: int(extent.ExtentId), Inode: extent.Inode, Size: uint64(extent.Size), Refs: extent.Refs}
+			break
+		}
 		fInfo, err = pkg.DataPartition.GetExtentStore().GetWatermark(pkg.FileID, false)
 	}
 	if err != nil {
@@ -425,6 +791,22 @@ func (s *DataNode) handleGetWatermark(pkg *Packet) {
 	return
 }
 
+// Handle OpGetBlockCrcs packet, the body of the reply is the crc of each block
+// from the block of offset to the end of the extent, in big endian.
+func (s *DataNode) handleGetBlockCrcs(pkg *Packet) {
+	crcs, err := pkg.DataPartition.GetExtentStore().BlockCrcs(pkg.FileID, pkg.Offset)
+	if err != nil {
+		err = errors.Annotatef(err, "Request(%v) handleGetBlockCrcs Error", pkg.GetUniqueLogId())
+		pkg.PackErrorBody(LogGetBlockCrcs, err.Error())
+		return
+	}
+	buf := make([]byte, len(crcs)*util.PerBlockCrcSize)
+	for i, crc := range crcs {
+		binary.BigEndian.PutUint32(buf[i*util.PerBlockCrcSize:], crc)
+	}
+	pkg.PackOkWithBody(buf)
+}
+
 // Handle OpExtentStoreGetAllWaterMark packet.
 func (s *DataNode) handleExtentStoreGetAllWatermark(pkg *Packet) {
 	var buf []byte
@@ -526,7 +908,7 @@ func (s *DataNode) handleNotifyBlobRepair(pkg *Packet) {
 	return
 }
 
-func (s *DataNode) handleBlobFileRepairRead(pkg *Packet, conn *net.TCPConn) {
+func (s *DataNode) handleBlobFileRepairRead(pkg *Packet, conn net.Conn) {
 	var (
 		err        error
 		localOid   uint64
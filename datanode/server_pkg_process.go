@@ -16,13 +16,18 @@ package datanode
 
 import (
 	"container/list"
+	"encoding/json"
 	"fmt"
+	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/juju/errors"
 	"github.com/tiglabs/containerfs/proto"
 	"github.com/tiglabs/containerfs/storage"
+	"github.com/tiglabs/containerfs/util/auth"
 	"github.com/tiglabs/containerfs/util/log"
+	"github.com/tiglabs/containerfs/util/trace"
 )
 
 func (s *DataNode) readFromCliAndDeal(msgH *MessageHandler) (err error) {
@@ -39,21 +44,61 @@ func (s *DataNode) readFromCliAndDeal(msgH *MessageHandler) (err error) {
 	log.LogDebugf("action[readFromCliAndDeal] read packet(%v) from remote(%v).",
 		pkg.GetUniqueLogId(), msgH.inConn.RemoteAddr().String())
 	if pkg.IsMasterCommand() {
+		if err = s.auth.Check(msgH.inConn, "", auth.AccessInternal); err != nil {
+			pkg.PackErrorBody(ActionCheckAuth, err.Error())
+			msgH.replyCh <- pkg
+			return
+		}
 		msgH.requestCh <- pkg
 		return
 	}
 	pkg.beforeTp(s.clusterId)
+	pkg.startSpan()
+
+	if pkg.Opcode == proto.OpAuthConn {
+		err = s.authConn(pkg, msgH.inConn)
+		msgH.replyCh <- pkg
+		return
+	}
+	if pkg.Opcode == proto.OpNegotiate {
+		msgH.connCaps = s.negotiate(pkg)
+		msgH.replyCh <- pkg
+		return
+	}
 
 	if err = s.checkPacket(pkg); err != nil {
 		pkg.PackErrorBody("checkPacket", err.Error())
 		msgH.replyCh <- pkg
 		return
 	}
+	if err = s.checkFence(pkg, msgH.inConn); err != nil {
+		pkg.PackErrorBody("checkFence", err.Error())
+		msgH.replyCh <- pkg
+		return
+	}
+	pkg.epochRequired = msgH.connCaps&proto.ConnCapEpoch != 0
 	if err = s.checkAction(pkg); err != nil {
 		pkg.PackErrorBody("checkAction", err.Error())
 		msgH.replyCh <- pkg
 		return
 	}
+	if err = s.auth.Check(msgH.inConn, pkg.DataPartition.Volume(), pkg.access()); err != nil {
+		pkg.PackErrorBody(ActionCheckAuth, err.Error())
+		msgH.replyCh <- pkg
+		return
+	}
+	if err = s.checkReadOnly(pkg); err != nil {
+		pkg.PackErrorBody("checkReadOnly", err.Error())
+		msgH.replyCh <- pkg
+		return
+	}
+	if pkg.isQosLimited() {
+		if err = s.qos.Wait(pkg.DataPartition.Volume(), s.qosClient(msgH.inConn), int(pkg.Size)); err != nil {
+			pkg.PackErrorBody(ActionCheckQos, err.Error())
+			msgH.replyCh <- pkg
+			return
+		}
+	}
 	if err = s.checkAndAddInfo(pkg); err != nil {
 		pkg.PackErrorBody("checkAndAddInfo", err.Error())
 		msgH.replyCh <- pkg
@@ -96,15 +141,21 @@ func (s *DataNode) handleRequest(msgH *MessageHandler) {
 func (s *DataNode) doRequestCh(req *Packet, msgH *MessageHandler) {
 	var err error
 	if !req.IsTransitPkg() {
-		s.operatePacket(req, msgH.inConn)
+		s.operatePacketTraced(req, msgH.inConn)
 		if !(req.Opcode == proto.OpStreamRead) {
 			msgH.replyCh <- req
+		} else {
+			// the stream read replied to the client itself
+			req.endSpan()
+			s.slowOps.Check(req.GetOpMsg(), time.Since(req.tpObject.StartTime), func() string {
+				return req.slowOpContext(msgH.inConn)
+			})
 		}
 
 		return
 	}
 	if err = s.sendToNext(req, msgH); err == nil {
-		s.operatePacket(req, msgH.inConn)
+		s.operatePacketTraced(req, msgH.inConn)
 	} else {
 		log.LogErrorf("action[doRequestCh] %dp.", req.ActionMsg(ActionSendToNext, req.NextAddr,
 			req.StartT, fmt.Errorf("failed to send to : %v", req.NextAddr)))
@@ -117,6 +168,16 @@ func (s *DataNode) doRequestCh(req *Packet, msgH *MessageHandler) {
 	return
 }
 
+/*the local op of a traced packet is a child span, apart from the wait for the next nodes*/
+func (s *DataNode) operatePacketTraced(pkg *Packet, c net.Conn) {
+	span := trace.StartChild(pkg.Trace, "datanode.store", trace.SpanKindInternal)
+	s.operatePacket(pkg, c)
+	if pkg.IsErrPack() {
+		span.SetError(errors.New(pkg.getErr()))
+	}
+	span.End()
+}
+
 func (s *DataNode) doReplyCh(reply *Packet, msgH *MessageHandler) {
 	var err error
 	if reply.IsErrPack() {
@@ -131,22 +192,35 @@ func (s *DataNode) doReplyCh(reply *Packet, msgH *MessageHandler) {
 		log.LogErrorf("action[doReplyCh] %v", err)
 		msgH.Stop()
 	}
+	reply.endSpan()
 	if !reply.IsMasterCommand() {
-		s.addMetrics(reply)
+		s.addMetrics(reply, msgH.inConn)
 		log.LogDebugf("action[doReplyCh] %v", reply.ActionMsg(ActionWriteToCli,
 			msgH.inConn.RemoteAddr().String(), reply.StartT, err))
 		s.statsFlow(reply, OutFlow)
 	}
+	// the data of a read is allocated by handleRead
+	if reply.Opcode == proto.OpRead && !reply.IsErrPack() {
+		proto.Buffers.Free(reply.Data)
+		reply.Data = nil
+	}
 }
 
-func (s *DataNode) addMetrics(reply *Packet) {
+func (s *DataNode) addMetrics(reply *Packet, c net.Conn) {
 	reply.afterTp()
 	latency := time.Since(reply.tpObject.StartTime)
+	s.slowOps.Check(reply.GetOpMsg(), latency, func() string {
+		return reply.slowOpContext(c)
+	})
 	if reply.DataPartition == nil {
 		return
 	}
 	if reply.IsWriteOperation() {
 		reply.DataPartition.AddWriteMetrics(uint64(latency))
+		if dp, ok := reply.DataPartition.(*dataPartition); ok && latency >= SlowWriteLatency {
+			dp.runtimeMetrics.AddSlowWrite(&SlowWriteOp{Opcode: reply.Opcode, ResultCode: reply.ResultCode,
+				FileID: reply.FileID, Offset: reply.Offset, Latency: latency, Time: time.Now()})
+		}
 	} else if reply.IsReadOperation() {
 		reply.DataPartition.AddReadMetrics(uint64(latency))
 	}
@@ -283,6 +357,63 @@ func (s *DataNode) checkPacket(pkg *Packet) error {
 	return nil
 }
 
+// checkFence refuse the modifications from a client session evicted by the master.
+func (s *DataNode) checkFence(pkg *Packet, conn net.Conn) (err error) {
+	if !pkg.IsWriteOperation() && !pkg.IsCreateFileOperation() && !pkg.IsMarkDeleteOperation() &&
+		pkg.Opcode != proto.OpAddExtentRef && pkg.Opcode != proto.OpPunchHole {
+		return
+	}
+	if s.clientFences.IsFenced(conn) {
+		err = errors.Annotatef(ErrClientFenced, "client(%v)", conn.RemoteAddr().String())
+	}
+	return
+}
+
+/*refuse the writes to the partitions of a read only vol, the deletes of the extents freed by the meta nodes go on*/
+func (s *DataNode) checkReadOnly(pkg *Packet) (err error) {
+	if !pkg.IsWriteOperation() && !pkg.IsCreateFileOperation() && pkg.Opcode != proto.OpAddExtentRef &&
+		pkg.Opcode != proto.OpPunchHole {
+		return
+	}
+	if dp, ok := pkg.DataPartition.(*dataPartition); ok && atomic.LoadInt32(&dp.volReadOnly) != 0 {
+		err = errors.Annotatef(ErrVolReadOnly, "partition(%v) vol(%v)", dp.partitionId, dp.volumeId)
+	}
+	return
+}
+
+// authConn records the token or the auth key and the client session presented by the first packet of the connection.
+func (s *DataNode) authConn(pkg *Packet, conn net.Conn) (err error) {
+	req := &proto.AuthConnRequest{}
+	if err = pkg.UnmarshalData(req); err == nil {
+		err = s.auth.Authenticate(conn, req)
+	}
+	if err != nil {
+		pkg.PackErrorBody(ActionCheckAuth, err.Error())
+		return
+	}
+	s.clientFences.SetSession(conn, req.Session)
+	pkg.PackOkReply()
+	return
+}
+
+// negotiate answers the version and the capabilities of the protocol asked by
+// the first packet of the connection, the capabilities both support are returned.
+func (s *DataNode) negotiate(pkg *Packet) (caps uint32) {
+	req := &proto.NegotiateRequest{}
+	if err := pkg.UnmarshalData(req); err != nil {
+		pkg.PackErrorBody(ActionNegotiate, err.Error())
+		return
+	}
+	resp := proto.Negotiate(req)
+	data, err := json.Marshal(resp)
+	if err != nil {
+		pkg.PackErrorBody(ActionNegotiate, err.Error())
+		return
+	}
+	pkg.PackOkWithBody(data)
+	return resp.Capabilities
+}
+
 func (s *DataNode) checkAction(pkg *Packet) (err error) {
 	dp := s.space.GetPartition(pkg.PartitionID)
 	if dp == nil {
@@ -290,12 +421,29 @@ func (s *DataNode) checkAction(pkg *Packet) (err error) {
 		return
 	}
 	pkg.DataPartition = dp
-	if pkg.Opcode == proto.OpWrite || pkg.Opcode == proto.OpCreateFile {
+	// only a legacy sender, not negotiated ConnCapEpoch, may send no epoch
+	if pkg.IsEpochProtected() && (pkg.epoch != 0 || pkg.epochRequired) {
+		if err = dp.CheckEpoch(pkg.epoch); err != nil {
+			return
+		}
+	}
+	// the extent ops of a raft replicated partition are replicated by its raft
+	// group, the packet is not passed down the chain
+	if partition, ok := dp.(*dataPartition); ok && partition.isRaftReplicated() && pkg.isRaftCommand() {
+		pkg.goals = 0
+		pkg.Nodes = 0
+	} else if ok && pkg.isHeadNode() && !partition.IsLeader() {
+		// a leader replaced by the master stops taking writes once its lease expired
+		err = errors.Annotatef(ErrNotLeader, "partition(%v) epoch(%v)", pkg.PartitionID, partition.Epoch())
+		return
+	}
+	if pkg.Opcode == proto.OpWrite || pkg.Opcode == proto.OpCreateFile || pkg.Opcode == proto.OpPunchHole {
 		if pkg.DataPartition.Status() == proto.ReadOnly {
 			err = storage.ErrorPartitionReadOnly
 			return
 		}
-		if pkg.DataPartition.Available() <= 0 {
+		// a punch releases space
+		if pkg.Opcode != proto.OpPunchHole && pkg.DataPartition.Available() <= 0 {
 			err = storage.ErrSyscallNoSpace
 			return
 		}
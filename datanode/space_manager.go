@@ -20,20 +20,21 @@ import (
 	"sync"
 	"time"
 
-	"os"
-
 	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/storage"
 	"github.com/tiglabs/containerfs/util/log"
 )
 
 type SpaceManager interface {
-	LoadDisk(path string, restSize uint64, maxErrs int) (err error)
+	LoadDisk(path string, restSize uint64, maxErrs int, layout string) (err error)
 	GetDisk(path string) (d *Disk, err error)
 	GetPartition(partitionId uint32) (dp DataPartition)
 	Stats() *Stats
 	GetDisks() []*Disk
-	CreatePartition(volId string, partitionId uint32, storeSize int, storeType string) (DataPartition, error)
+	CreatePartition(volId string, partitionId uint32, storeSize int, storeType, encryptKeyId string) (DataPartition, error)
 	DeletePartition(partitionId uint32)
+	DetachPartition(partitionId uint32) DataPartition
+	AttachPartition(dp DataPartition)
 	RangePartitions(f func(partition DataPartition) bool)
 	Stop()
 }
@@ -67,6 +68,14 @@ func (space *spaceManager) Stop() {
 		recover()
 	}()
 	close(space.stopC)
+	// the extent io of a disk is closed once the stores on it are
+	space.RangePartitions(func(dp DataPartition) bool {
+		dp.Stop()
+		return true
+	})
+	for _, d := range space.GetDisks() {
+		d.Stop()
+	}
 }
 
 func (space *spaceManager) RangePartitions(f func(partition DataPartition) bool) {
@@ -101,10 +110,11 @@ func (space *spaceManager) Stats() *Stats {
 	return space.stats
 }
 
-func (space *spaceManager) LoadDisk(path string, restSize uint64, maxErrs int) (err error) {
+func (space *spaceManager) LoadDisk(path string, restSize uint64, maxErrs int, layout string) (err error) {
 	var (
-		disk    *Disk
-		visitor PartitionVisitor
+		disk     *Disk
+		visitor  PartitionVisitor
+		extentIO storage.ExtentIO
 	)
 	log.LogDebugf("action[LoadDisk] load disk from path(%v).", path)
 	visitor = func(dp DataPartition) {
@@ -116,8 +126,11 @@ func (space *spaceManager) LoadDisk(path string, restSize uint64, maxErrs int) (
 		}
 	}
 	if _, err = space.GetDisk(path); err != nil {
-
-		disk = NewDisk(path, restSize, maxErrs, space)
+		// the IO of the extents of a disk is batched through its own queue
+		if extentIO, err = storage.NewExtentIO(ioBackend, ioUringEntries); err != nil {
+			return
+		}
+		disk = NewDisk(path, restSize, maxErrs, layout, extentIO, space)
 		disk.RestorePartition(visitor)
 		space.putDisk(disk)
 		err = nil
@@ -147,26 +160,34 @@ func (space *spaceManager) putDisk(d *Disk) {
 func (space *spaceManager) updateMetrics() {
 	space.diskMu.RLock()
 	var (
-		total, used, available                                   uint64
+		total, used, available, reclaimable                      uint64
 		createdPartitionWeights, remainWeightsForCreatePartition uint64
 		maxWeightsForCreatePartition, partitionCnt               uint64
 	)
 	maxWeightsForCreatePartition = 0
 	for _, d := range space.disks {
+		partitionCnt += uint64(d.PartitionCount())
+		// the master places no partitions on the space of a failed disk
+		if d.isFailed() {
+			continue
+		}
 		total += d.Total
 		used += d.Used
 		available += d.Available
 		createdPartitionWeights += d.Allocated
 		remainWeightsForCreatePartition += d.Unallocated
-		partitionCnt += uint64(d.PartitionCount())
 		if maxWeightsForCreatePartition < d.Unallocated {
 			maxWeightsForCreatePartition = d.Unallocated
 		}
 	}
 	space.diskMu.RUnlock()
-	log.LogDebugf("action[updateMetrics] total(%v) used(%v) available(%v) createdPartitionWeights(%v)  remainWeightsForCreatePartition(%v) "+
-		"partitionCnt(%v) maxWeightsForCreatePartition(%v) ", total, used, available, createdPartitionWeights, remainWeightsForCreatePartition, partitionCnt, maxWeightsForCreatePartition)
-	space.stats.updateMetrics(total, used, available, createdPartitionWeights,
+	space.RangePartitions(func(dp DataPartition) bool {
+		reclaimable += uint64(dp.Reclaimable())
+		return true
+	})
+	log.LogDebugf("action[updateMetrics] total(%v) used(%v) available(%v) reclaimable(%v) createdPartitionWeights(%v)  remainWeightsForCreatePartition(%v) "+
+		"partitionCnt(%v) maxWeightsForCreatePartition(%v) ", total, used, available, reclaimable, createdPartitionWeights, remainWeightsForCreatePartition, partitionCnt, maxWeightsForCreatePartition)
+	space.stats.updateMetrics(total, used, available, reclaimable, createdPartitionWeights,
 		remainWeightsForCreatePartition, maxWeightsForCreatePartition, partitionCnt)
 }
 
@@ -177,6 +198,10 @@ func (space *spaceManager) getMinPartitionCntDisk() (d *Disk) {
 	minPartitionCnt = math.MaxUint64
 	var path string
 	for index, disk := range space.disks {
+		// the new partitions go to the other disks of a failed one
+		if disk.isFailed() {
+			continue
+		}
 		if uint64(disk.PartitionCount()) < minPartitionCnt {
 			minPartitionCnt = uint64(disk.PartitionCount())
 			path = index
@@ -243,6 +268,10 @@ func (space *spaceManager) fileRepair() {
 		return true
 	})
 	for _, partition := range partitions {
+		// nothing to repair on the replicas of a sealed partition with the same seal
+		if dp, ok := partition.(*dataPartition); ok && dp.isSealedInSync() {
+			continue
+		}
 		partition.LaunchRepair()
 	}
 }
@@ -273,7 +302,7 @@ func (space *spaceManager) putPartition(dp DataPartition) {
 	return
 }
 
-func (space *spaceManager) CreatePartition(volId string, partitionId uint32, storeSize int, storeType string) (dp DataPartition, err error) {
+func (space *spaceManager) CreatePartition(volId string, partitionId uint32, storeSize int, storeType, encryptKeyId string) (dp DataPartition, err error) {
 	if space.GetPartition(partitionId) != nil {
 		return
 	}
@@ -281,7 +310,7 @@ func (space *spaceManager) CreatePartition(volId string, partitionId uint32, sto
 	if disk == nil || disk.Available < uint64(storeSize) {
 		return nil, ErrNoDiskForCreatePartition
 	}
-	if dp, err = CreateDataPartition(volId, partitionId, disk, storeSize, storeType); err != nil {
+	if dp, err = CreateDataPartition(volId, partitionId, disk, storeSize, storeType, encryptKeyId); err != nil {
 		return
 	}
 
@@ -293,8 +322,15 @@ func (space *spaceManager) CreatePartition(volId string, partitionId uint32, sto
 }
 
 func (space *spaceManager) DeletePartition(dpId uint32) {
-	dp := space.GetPartition(dpId)
-	if dp == nil {
+	if dp := space.DetachPartition(dpId); dp != nil {
+		dp.Disk().removePartitionDir(dp.Path())
+	}
+}
+
+// DetachPartition stops the partition and removes it from the node, the files
+// of the partition are kept on the disk.
+func (space *spaceManager) DetachPartition(dpId uint32) (dp DataPartition) {
+	if dp = space.GetPartition(dpId); dp == nil {
 		return
 	}
 	space.partitionMu.Lock()
@@ -302,7 +338,12 @@ func (space *spaceManager) DeletePartition(dpId uint32) {
 	space.partitionMu.Unlock()
 	dp.Stop()
 	dp.Disk().DetachDataPartition(dp)
-	os.RemoveAll(dp.Path())
+	return
+}
+
+// AttachPartition adds a partition loaded from the disk to the node.
+func (space *spaceManager) AttachPartition(dp DataPartition) {
+	space.putPartition(dp)
 }
 
 func (s *DataNode) fillHeartBeatResponse(response *proto.DataNodeHeartBeatResponse) {
@@ -312,6 +353,11 @@ func (s *DataNode) fillHeartBeatResponse(response *proto.DataNodeHeartBeatRespon
 	response.Used = stat.Used
 	response.Total = stat.Total
 	response.Available = stat.Available
+	response.Reclaimable = stat.Reclaimable
+	response.ProjectedUsed = stat.Used
+	if stat.Used > stat.Reclaimable {
+		response.ProjectedUsed = stat.Used - stat.Reclaimable
+	}
 	response.CreatedPartitionCnt = uint32(stat.CreatedPartitionCnt)
 	response.CreatedPartitionWeights = stat.CreatedPartitionWeights
 	response.MaxWeightsForCreatePartition = stat.MaxWeightsForCreatePartition
@@ -319,6 +365,14 @@ func (s *DataNode) fillHeartBeatResponse(response *proto.DataNodeHeartBeatRespon
 	stat.Unlock()
 
 	response.RackName = s.rackName
+	response.ZoneName = s.zoneName
+	response.ClientAddr = s.getClientAddr()
+	response.ReplicaAddr = s.getReplicaAddr()
+	if s.raftStore != nil {
+		response.RaftHeartbeatPort = s.raftHeartbeat
+		response.RaftReplicatePort = s.raftReplicate
+	}
+	response.Draining = s.isDraining()
 	response.PartitionInfo = make([]*proto.PartitionReport, 0)
 	space := s.space
 	space.RangePartitions(func(partition DataPartition) bool {
@@ -327,8 +381,33 @@ func (s *DataNode) fillHeartBeatResponse(response *proto.DataNodeHeartBeatRespon
 			PartitionStatus: partition.Status(),
 			Total:           uint64(partition.Size()),
 			Used:            uint64(partition.Used()),
+			Reclaimable:     uint64(partition.Reclaimable()),
+			Quarantined:     partition.Quarantined(),
+			DiskPath:        partition.Disk().Path,
+			Sealed:          partition.IsSealed(),
+			SealCrc:         partition.GetExtentStore().SealCrc(),
+			Epoch:           partition.Epoch(),
+		}
+		if dp, ok := partition.(*dataPartition); ok {
+			vr.WriteLatencyMs = uint32(dp.runtimeMetrics.GetWriteLatency() / float64(time.Millisecond))
+			if dp.isRaftReplicated() {
+				vr.RaftLeader = dp.isRaftLeader()
+			}
 		}
 		response.PartitionInfo = append(response.PartitionInfo, vr)
 		return true
 	})
+	response.Disks = make([]*proto.DiskReport, 0)
+	for _, d := range space.GetDisks() {
+		d.RLock()
+		response.Disks = append(response.Disks, &proto.DiskReport{
+			Path:      d.Path,
+			Total:     d.Total,
+			Used:      d.Used,
+			Available: d.Available,
+			Status:    d.Status,
+			Reason:    d.health.reason,
+		})
+		d.RUnlock()
+	}
 }
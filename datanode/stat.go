@@ -47,10 +47,13 @@ type Stats struct {
 	Total                           uint64
 	Used                            uint64
 	Available                       uint64
+	Reclaimable                     uint64 //bytes released by pending delete, compaction and hole punching
 	CreatedPartitionWeights         uint64 //dataPartitionCnt*dataPartitionSize
 	RemainWeightsForCreatePartition uint64 //all-useddataPartitionsWieghts
 	CreatedPartitionCnt             uint64
 	MaxWeightsForCreatePartition    uint64
+	PartitionsToLoad                int64 //partitions found on the disks at the start
+	PartitionsLoaded                int64 //partitions of them loaded or failed to load
 
 	sync.Mutex
 }
@@ -73,6 +76,18 @@ func (s *Stats) GetConnectionNum() int64 {
 	return atomic.LoadInt64(&s.CurrentConns)
 }
 
+func (s *Stats) AddPartitionToLoad() {
+	atomic.AddInt64(&s.PartitionsToLoad, 1)
+}
+
+func (s *Stats) AddPartitionLoaded() {
+	atomic.AddInt64(&s.PartitionsLoaded, 1)
+}
+
+func (s *Stats) GetLoadProgress() (toLoad, loaded int64) {
+	return atomic.LoadInt64(&s.PartitionsToLoad), atomic.LoadInt64(&s.PartitionsLoaded)
+}
+
 func (s *Stats) AddInDataSize(size uint64) {
 	atomic.AddUint64(&s.inDataSize, size)
 }
@@ -82,13 +97,14 @@ func (s *Stats) AddOutDataSize(size uint64) {
 }
 
 func (s *Stats) updateMetrics(
-	total, used, available, createdPartitionWeights, remainWeightsForCreatePartition,
+	total, used, available, reclaimable, createdPartitionWeights, remainWeightsForCreatePartition,
 	maxWeightsForCreatePartition, dataPartitionCnt uint64) {
 	s.Lock()
 	defer s.Unlock()
 	s.Total = total
 	s.Used = used
 	s.Available = available
+	s.Reclaimable = reclaimable
 	s.CreatedPartitionWeights = createdPartitionWeights
 	s.RemainWeightsForCreatePartition = remainWeightsForCreatePartition
 	s.MaxWeightsForCreatePartition = maxWeightsForCreatePartition
@@ -0,0 +1,104 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tiglabs/containerfs/util/config"
+)
+
+const (
+	DefaultStatusUpdateInterval   = 10 * time.Second
+	DefaultUsageReconcileInterval = time.Hour
+	DefaultMetricsUpdateInterval  = 2 * time.Second
+)
+
+// StatusIntervals are the periods of the background updates of each partition:
+// the status and the used size, the scan correcting the used size kept by the
+// stores, and the latency metrics.
+type StatusIntervals struct {
+	StatusUpdate   time.Duration
+	UsageReconcile time.Duration
+	MetricsUpdate  time.Duration
+}
+
+func (i StatusIntervals) check() (err error) {
+	if i.StatusUpdate <= 0 || i.UsageReconcile <= 0 || i.MetricsUpdate <= 0 {
+		return fmt.Errorf("not positive status intervals %+v", i)
+	}
+	return
+}
+
+type statusIntervals struct {
+	intervals StatusIntervals
+	sync.RWMutex
+}
+
+// set by the config before the disks are loaded, and by /status/setIntervals,
+// the partitions take the new intervals from their next update
+var gStatusIntervals = &statusIntervals{intervals: StatusIntervals{
+	StatusUpdate:   DefaultStatusUpdateInterval,
+	UsageReconcile: DefaultUsageReconcileInterval,
+	MetricsUpdate:  DefaultMetricsUpdateInterval,
+}}
+
+func (s *statusIntervals) Intervals() StatusIntervals {
+	s.RLock()
+	defer s.RUnlock()
+	return s.intervals
+}
+
+func (s *statusIntervals) SetIntervals(intervals StatusIntervals) (err error) {
+	if err = intervals.check(); err != nil {
+		return
+	}
+	s.Lock()
+	s.intervals = intervals
+	s.Unlock()
+	return
+}
+
+func (s *statusIntervals) View() interface{} {
+	intervals := s.Intervals()
+	return &struct {
+		StatusUpdateSeconds   int64 `json:"statusUpdateSeconds"`
+		UsageReconcileMinutes int64 `json:"usageReconcileMinutes"`
+		MetricsUpdateSeconds  int64 `json:"metricsUpdateSeconds"`
+	}{
+		StatusUpdateSeconds:   int64(intervals.StatusUpdate / time.Second),
+		UsageReconcileMinutes: int64(intervals.UsageReconcile / time.Minute),
+		MetricsUpdateSeconds:  int64(intervals.MetricsUpdate / time.Second),
+	}
+}
+
+func parseStatusIntervals(cfg *config.Config) (err error) {
+	intervals := gStatusIntervals.Intervals()
+	if sec := cfg.GetInt(ConfigKeyStatusUpdateInterval); sec != 0 {
+		intervals.StatusUpdate = time.Duration(sec) * time.Second
+	}
+	if min := cfg.GetInt(ConfigKeyUsageReconcileInterval); min != 0 {
+		intervals.UsageReconcile = time.Duration(min) * time.Minute
+	}
+	if sec := cfg.GetInt(ConfigKeyMetricsUpdateInterval); sec != 0 {
+		intervals.MetricsUpdate = time.Duration(sec) * time.Second
+	}
+	if intervals.check() != nil {
+		return ErrBadConfFile
+	}
+	return gStatusIntervals.SetIntervals(intervals)
+}
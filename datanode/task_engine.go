@@ -0,0 +1,241 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/containerfs/master"
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	DefaultTaskDirName     = "tasks"
+	TaskStateFileName      = "task_state"
+	TaskStateFileNameTmp   = ".task_state"
+	DefaultTaskHistoryTime = 24 * time.Hour
+	TaskReportInterval     = time.Minute
+)
+
+// TaskRecord is the persisted state of a task issued by the master.
+type TaskRecord struct {
+	Key        string
+	Task       *proto.AdminTask
+	Status     int8
+	Attempts   int
+	Reported   bool
+	StartTime  int64
+	UpdateTime int64
+	running    bool
+}
+
+type TaskExecutor func(task *proto.AdminTask) (response interface{}, status int8)
+
+// TaskEngine executes the tasks issued by the master at most once per task,
+// a task resent by the master after its response lost is answered with the
+// persisted response instead of being executed again.
+type TaskEngine struct {
+	dir     string
+	records map[string]*TaskRecord
+	stopC   chan bool
+	sync.Mutex
+}
+
+func NewTaskEngine(dir string) (engine *TaskEngine, err error) {
+	engine = &TaskEngine{
+		dir:     dir,
+		records: make(map[string]*TaskRecord),
+		stopC:   make(chan bool, 0),
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	if err = engine.load(); err != nil {
+		return
+	}
+	go engine.reportScheduler()
+	return
+}
+
+func (engine *TaskEngine) Stop() {
+	defer func() {
+		recover()
+	}()
+	close(engine.stopC)
+}
+
+// the master resend a task with the same id and create time
+func taskKey(task *proto.AdminTask) string {
+	return fmt.Sprintf("%v_%v", task.ID, task.CreateTime)
+}
+
+func (engine *TaskEngine) Submit(task *proto.AdminTask, executor TaskExecutor) {
+	key := taskKey(task)
+	engine.Lock()
+	record, ok := engine.records[key]
+	if ok && record.running {
+		engine.Unlock()
+		log.LogDebugf("action[TaskEngine.Submit] task(%v) is running, ignore the duplicate.", key)
+		return
+	}
+	if ok && record.Status != proto.TaskRunning {
+		engine.Unlock()
+		log.LogInfof("action[TaskEngine.Submit] task(%v) already done, report the saved response.", key)
+		engine.report(record)
+		return
+	}
+	if !ok {
+		record = &TaskRecord{Key: key, StartTime: time.Now().Unix()}
+		engine.records[key] = record
+	}
+	record.Task = task
+	record.Status = proto.TaskRunning
+	record.Attempts++
+	record.UpdateTime = time.Now().Unix()
+	record.running = true
+	engine.persist()
+	engine.Unlock()
+
+	response, status := executor(task)
+
+	engine.Lock()
+	task.Response = response
+	record.Status = status
+	record.Reported = false
+	record.running = false
+	record.UpdateTime = time.Now().Unix()
+	engine.persist()
+	engine.Unlock()
+	engine.report(record)
+}
+
+func (engine *TaskEngine) report(record *TaskRecord) {
+	engine.Lock()
+	data, err := json.Marshal(record.Task)
+	engine.Unlock()
+	if err != nil {
+		log.LogErrorf("action[TaskEngine.report] task(%v) marshal err(%v).", record.Key, err)
+		return
+	}
+	if _, err = MasterHelper.Request("POST", master.DataNodeResponse, nil, data); err != nil {
+		err = errors.Annotatef(err, "report task(%v) to master failed", record.Key)
+		log.LogError(errors.ErrorStack(err))
+		return
+	}
+	engine.Lock()
+	record.Reported = true
+	record.UpdateTime = time.Now().Unix()
+	engine.persist()
+	engine.Unlock()
+}
+
+// reportScheduler retry the reports of finished tasks the master has not
+// received, and drop the records out of history time.
+func (engine *TaskEngine) reportScheduler() {
+	ticker := time.NewTicker(TaskReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			unreported := make([]*TaskRecord, 0)
+			engine.Lock()
+			for key, record := range engine.records {
+				if time.Since(time.Unix(record.UpdateTime, 0)) > DefaultTaskHistoryTime {
+					delete(engine.records, key)
+					continue
+				}
+				if record.Status != proto.TaskRunning && !record.Reported {
+					unreported = append(unreported, record)
+				}
+			}
+			engine.persist()
+			engine.Unlock()
+			for _, record := range unreported {
+				engine.report(record)
+			}
+		case <-engine.stopC:
+			return
+		}
+	}
+}
+
+// History return the task records sorted by start time.
+func (engine *TaskEngine) History() (records []*TaskRecord) {
+	engine.Lock()
+	defer engine.Unlock()
+	records = make([]*TaskRecord, 0, len(engine.records))
+	for _, record := range engine.records {
+		r := *record
+		records = append(records, &r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].StartTime < records[j].StartTime
+	})
+	return
+}
+
+func (engine *TaskEngine) load() (err error) {
+	data, err := ioutil.ReadFile(path.Join(engine.dir, TaskStateFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	records := make([]*TaskRecord, 0)
+	if err = json.Unmarshal(data, &records); err != nil {
+		return
+	}
+	for _, record := range records {
+		// tasks interrupted by restart are executed again when the master resend them
+		engine.records[record.Key] = record
+	}
+	log.LogInfof("action[TaskEngine.load] load %v task records from(%v).", len(records), engine.dir)
+	return
+}
+
+// persist write all task records to the state file, the caller must hold the lock.
+func (engine *TaskEngine) persist() {
+	records := make([]*TaskRecord, 0, len(engine.records))
+	for _, record := range engine.records {
+		records = append(records, record)
+	}
+	data, err := json.Marshal(records)
+	if err != nil {
+		log.LogErrorf("action[TaskEngine.persist] marshal err(%v).", err)
+		return
+	}
+	tmpFile := path.Join(engine.dir, TaskStateFileNameTmp)
+	if err = writeFileSync(tmpFile, data); err != nil {
+		log.LogErrorf("action[TaskEngine.persist] write(%v) err(%v).", tmpFile, err)
+		return
+	}
+	if err = os.Rename(tmpFile, path.Join(engine.dir, TaskStateFileName)); err != nil {
+		log.LogErrorf("action[TaskEngine.persist] rename(%v) err(%v).", tmpFile, err)
+		return
+	}
+	if err = syncDir(engine.dir); err != nil {
+		log.LogErrorf("action[TaskEngine.persist] sync(%v) err(%v).", engine.dir, err)
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime/pprof"
+	"time"
+
+	"github.com/tiglabs/containerfs/master"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	DefaultDiagDirName          = "diagnostics"
+	DefaultWriteStallLatency    = 500 * time.Millisecond
+	DefaultWriteStallQueueDepth = 64
+	DefaultWriteStallDuration   = 30 * time.Second
+	WriteStallCheckInterval     = 2 * time.Second
+	WriteStallAlarmInterval     = 10 * time.Minute
+	DefaultDiagHistoryTime      = 24 * time.Hour
+	ProcDiskStats               = "/proc/diskstats"
+)
+
+type writeStall struct {
+	since     time.Time
+	lastAlarm time.Time
+}
+
+// WriteStallDetector watches the write latency and queue depth of every
+// partition, a partition exceeding the thresholds for the sustained duration
+// is escalated: a diagnostic bundle is written into dir and an alarm naming
+// the bundle is raised.
+type WriteStallDetector struct {
+	umpKey     string
+	dir        string
+	latency    time.Duration
+	queueDepth int64
+	duration   time.Duration
+	space      SpaceManager
+	stalls     map[uint32]*writeStall
+	stopC      chan bool
+}
+
+func NewWriteStallDetector(umpKey, dir string, latency time.Duration, queueDepth int64,
+	duration time.Duration, space SpaceManager) (detector *WriteStallDetector, err error) {
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	detector = &WriteStallDetector{
+		umpKey:     umpKey,
+		dir:        dir,
+		latency:    latency,
+		queueDepth: queueDepth,
+		duration:   duration,
+		space:      space,
+		stalls:     make(map[uint32]*writeStall),
+		stopC:      make(chan bool, 0),
+	}
+	go detector.checkScheduler()
+	return
+}
+
+func (detector *WriteStallDetector) Stop() {
+	defer func() {
+		recover()
+	}()
+	close(detector.stopC)
+}
+
+func (detector *WriteStallDetector) checkScheduler() {
+	ticker := time.NewTicker(WriteStallCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			detector.check()
+		case <-detector.stopC:
+			return
+		}
+	}
+}
+
+func (detector *WriteStallDetector) check() {
+	now := time.Now()
+	alive := make(map[uint32]bool)
+	detector.space.RangePartitions(func(partition DataPartition) bool {
+		dp, ok := partition.(*dataPartition)
+		if !ok {
+			return true
+		}
+		alive[dp.ID()] = true
+		stall, ok := detector.stalls[dp.ID()]
+		if !ok {
+			stall = &writeStall{}
+			detector.stalls[dp.ID()] = stall
+		}
+		latency := time.Duration(dp.runtimeMetrics.GetWriteLatency())
+		queueDepth := dp.runtimeMetrics.GetWriteQueueDepth()
+		if latency < detector.latency && queueDepth < detector.queueDepth {
+			stall.since = time.Time{}
+			return true
+		}
+		if stall.since.IsZero() {
+			stall.since = now
+			log.LogWarnf("action[WriteStallDetector.check] partition(%v) write latency(%v) queueDepth(%v) exceed threshold.",
+				dp.ID(), latency, queueDepth)
+		}
+		if now.Sub(stall.since) < detector.duration || now.Sub(stall.lastAlarm) < WriteStallAlarmInterval {
+			return true
+		}
+		stall.lastAlarm = now
+		detector.escalate(dp, now.Sub(stall.since), latency, queueDepth)
+		return true
+	})
+	for id := range detector.stalls {
+		if !alive[id] {
+			delete(detector.stalls, id)
+		}
+	}
+}
+
+func (detector *WriteStallDetector) escalate(dp *dataPartition, stalled, latency time.Duration, queueDepth int64) {
+	bundle := detector.bundle(dp, stalled, latency, queueDepth)
+	fileName := path.Join(detector.dir, fmt.Sprintf("write_stall_%v_%v.log", dp.ID(), time.Now().Unix()))
+	if err := ioutil.WriteFile(fileName, bundle, 0644); err != nil {
+		log.LogErrorf("action[WriteStallDetector.escalate] write bundle(%v) err(%v).", fileName, err)
+		fileName = ""
+	}
+	detector.cleanBundles()
+	msg := fmt.Sprintf("action[WriteStallDetector.escalate] partition(%v) write stalled for %v latency(%v) queueDepth(%v) disk(%v) bundle(%v).",
+		dp.ID(), stalled, latency, queueDepth, dp.Disk().Path, fileName)
+	master.WarnBySpecialUmpKey(detector.umpKey, msg)
+}
+
+// bundle collect the stats of the partition and its disk, the recent slow
+// writes and the goroutine stacks of the process.
+func (detector *WriteStallDetector) bundle(dp *dataPartition, stalled, latency time.Duration, queueDepth int64) []byte {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "time: %v\n", time.Now().Format(TimeLayout))
+	fmt.Fprintf(buf, "partition: %v vol(%v) path(%v) leader(%v) replicas(%v)\n",
+		dp.ID(), dp.volumeId, dp.Path(), dp.IsLeader(), dp.ReplicaHosts())
+	fmt.Fprintf(buf, "stalled: %v latency(%v) queueDepth(%v) threshold latency(%v) queueDepth(%v)\n",
+		stalled, latency, queueDepth, detector.latency, detector.queueDepth)
+
+	d := dp.Disk()
+	d.RLock()
+	fmt.Fprintf(buf, "\n== disk ==\npath(%v) status(%v) total(%v) used(%v) available(%v) readErrs(%v) writeErrs(%v)\n",
+		d.Path, d.Status, d.Total, d.Used, d.Available, d.ReadErrs, d.WriteErrs)
+	d.RUnlock()
+	if diskStats, err := ioutil.ReadFile(ProcDiskStats); err == nil {
+		buf.Write(diskStats)
+	}
+
+	fmt.Fprintf(buf, "\n== recent slow writes ==\n")
+	for _, op := range dp.runtimeMetrics.SlowWrites() {
+		fmt.Fprintf(buf, "%v op(%v) result(%v) fileID(%v) offset(%v) latency(%v)\n",
+			op.Time.Format(TimeLayout), op.Opcode, op.ResultCode, op.FileID, op.Offset, op.Latency)
+	}
+
+	fmt.Fprintf(buf, "\n== goroutines ==\n")
+	pprof.Lookup("goroutine").WriteTo(buf, 2)
+	return buf.Bytes()
+}
+
+func (detector *WriteStallDetector) cleanBundles() {
+	files, err := ioutil.ReadDir(detector.dir)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if time.Since(file.ModTime()) > DefaultDiagHistoryTime {
+			os.Remove(path.Join(detector.dir, file.Name()))
+		}
+	}
+}
@@ -284,6 +284,24 @@ type HandleFlusher interface {
 	Flush(ctx context.Context, req *fuse.FlushRequest) error
 }
 
+type HandleLocker interface {
+	// SetLock takes or releases a lock of the lock owner. If the lock
+	// conflicts with a lock of another owner, it returns fuse.Errno of
+	// EAGAIN, or waits for the conflicting locks if req.Wait.
+	SetLock(ctx context.Context, req *fuse.LockRequest) error
+
+	// QueryLock gets a lock of another owner conflicting with the lock
+	// of the request.
+	QueryLock(ctx context.Context, req *fuse.QueryLockRequest, resp *fuse.QueryLockResponse) error
+}
+
+type HandleFallocater interface {
+	// Fallocate allocates or deallocates the space of the range of the
+	// file by the mode of the request. It returns fuse.Errno of ENOTSUP
+	// for the modes not supported.
+	Fallocate(ctx context.Context, req *fuse.FallocateRequest) error
+}
+
 type HandleReadAller interface {
 	ReadAll(ctx context.Context) ([]byte, error)
 }
@@ -292,6 +310,15 @@ type HandleReadDirAller interface {
 	ReadDirAll(ctx context.Context) ([]fuse.Dirent, error)
 }
 
+type HandleReadDirPager interface {
+	// ReadDirPage returns the entries of the directory following the
+	// marker, and the marker of the next page or "" after the last page.
+	// The first page is read with an empty marker. The entries are read
+	// as the kernel reads the directory, so that a large directory is
+	// never held in memory at once.
+	ReadDirPage(ctx context.Context, marker string) (dirs []fuse.Dirent, next string, err error)
+}
+
 type HandleReader interface {
 	// Read requests to read data from the handle.
 	//
@@ -473,6 +500,46 @@ type serveHandle struct {
 	handle   Handle
 	readData []byte
 	nodeID   fuse.NodeID
+
+	// the window of the directory stream read by HandleReadDirPager,
+	// readData starts at readBase and the pages after dirMarker are
+	// not read yet
+	readBase  int64
+	dirMarker string
+	dirDone   bool
+}
+
+// readDirPages fills the window of the handle up to the end of the
+// request, the entries before the request are dropped.
+func (sh *serveHandle) readDirPages(ctx context.Context, h HandleReadDirPager, r *fuse.ReadRequest, dynamicInode func(name string) uint64) error {
+	if r.Offset == 0 || r.Offset < sh.readBase {
+		// rewinddir(3) or a seek back, read the directory again
+		sh.readData, sh.readBase, sh.dirMarker, sh.dirDone = nil, 0, "", false
+	}
+	for {
+		if skip := r.Offset - sh.readBase; skip > 0 {
+			if skip > int64(len(sh.readData)) {
+				skip = int64(len(sh.readData))
+			}
+			sh.readData = sh.readData[skip:]
+			sh.readBase += skip
+		}
+		if sh.dirDone || (sh.readBase == r.Offset && len(sh.readData) >= r.Size) {
+			return nil
+		}
+		dirs, next, err := h.ReadDirPage(ctx, sh.dirMarker)
+		if err != nil {
+			return err
+		}
+		for _, dir := range dirs {
+			if dir.Inode == 0 {
+				dir.Inode = dynamicInode(dir.Name)
+			}
+			sh.readData = fuse.AppendDirentAt(sh.readData, sh.readBase, dir)
+		}
+		sh.dirMarker = next
+		sh.dirDone = next == ""
+	}
 }
 
 // NodeRef is deprecated. It remains here to decrease code churn on
@@ -1205,6 +1272,21 @@ func (c *Server) handleRequest(ctx context.Context, node Node, snode *serveNode,
 		s := &fuse.ReadResponse{}
 		if r.Dir {
 			s.Data = make([]byte, r.Size)
+			if h, ok := handle.(HandleReadDirPager); ok {
+				dynamicInode := func(name string) uint64 {
+					return c.dynamicInode(snode.inode, name)
+				}
+				if err := shandle.readDirPages(ctx, h, r, dynamicInode); err != nil {
+					return err
+				}
+				// the window starts at the offset of the request
+				req := *r
+				req.Offset -= shandle.readBase
+				fuseutil.HandleRead(&req, s, shandle.readData)
+				done(s)
+				r.Respond(s)
+				return nil
+			}
 			if h, ok := handle.(HandleReadDirAller); ok {
 				// detect rewinddir(3) or similar seek and refresh
 				// contents
@@ -1295,6 +1377,55 @@ func (c *Server) handleRequest(ctx context.Context, node Node, snode *serveNode,
 		r.Respond()
 		return nil
 
+	case *fuse.FallocateRequest:
+		shandle := c.getHandle(r.Handle)
+		if shandle == nil {
+			return fuse.ESTALE
+		}
+		h, ok := shandle.handle.(HandleFallocater)
+		if !ok {
+			return fuse.ENOTSUP
+		}
+		if err := h.Fallocate(ctx, r); err != nil {
+			return err
+		}
+		done(nil)
+		r.Respond()
+		return nil
+
+	case *fuse.LockRequest:
+		shandle := c.getHandle(r.Handle)
+		if shandle == nil {
+			return fuse.ESTALE
+		}
+		h, ok := shandle.handle.(HandleLocker)
+		if !ok {
+			return fuse.ENOTSUP
+		}
+		if err := h.SetLock(ctx, r); err != nil {
+			return err
+		}
+		done(nil)
+		r.Respond()
+		return nil
+
+	case *fuse.QueryLockRequest:
+		shandle := c.getHandle(r.Handle)
+		if shandle == nil {
+			return fuse.ESTALE
+		}
+		h, ok := shandle.handle.(HandleLocker)
+		if !ok {
+			return fuse.ENOTSUP
+		}
+		s := &fuse.QueryLockResponse{Lock: fuse.FileLock{Type: fuse.LockUnlock}}
+		if err := h.QueryLock(ctx, r, s); err != nil {
+			return err
+		}
+		done(s)
+		r.Respond(s)
+		return nil
+
 	case *fuse.ReleaseRequest:
 		shandle := c.getHandle(r.Handle)
 		if shandle == nil {
@@ -956,11 +956,37 @@ loop:
 		}
 
 	case opGetlk:
-		panic("opGetlk")
-	case opSetlk:
-		panic("opSetlk")
-	case opSetlkw:
-		panic("opSetlkw")
+		in := (*lkIn)(m.data())
+		if m.len() < lkInSize(c.proto) {
+			goto corrupt
+		}
+		r := &QueryLockRequest{
+			Header:    m.Header(),
+			Handle:    HandleID(in.Fh),
+			LockOwner: in.Owner,
+			Lock:      fileLockFromKernel(in.Lk),
+		}
+		if c.proto.GE(Protocol{7, 9}) {
+			r.LockFlags = LockFlags(in.LkFlags)
+		}
+		req = r
+
+	case opSetlk, opSetlkw:
+		in := (*lkIn)(m.data())
+		if m.len() < lkInSize(c.proto) {
+			goto corrupt
+		}
+		r := &LockRequest{
+			Header:    m.Header(),
+			Handle:    HandleID(in.Fh),
+			LockOwner: in.Owner,
+			Lock:      fileLockFromKernel(in.Lk),
+			Wait:      m.hdr.Opcode == opSetlkw,
+		}
+		if c.proto.GE(Protocol{7, 9}) {
+			r.LockFlags = LockFlags(in.LkFlags)
+		}
+		req = r
 
 	case opAccess:
 		in := (*accessIn)(m.data())
@@ -1007,6 +1033,19 @@ loop:
 	case opBmap:
 		panic("opBmap")
 
+	case opFallocate:
+		in := (*fallocateIn)(m.data())
+		if m.len() < unsafe.Sizeof(*in) {
+			goto corrupt
+		}
+		req = &FallocateRequest{
+			Header: m.Header(),
+			Handle: HandleID(in.Fh),
+			Offset: in.Offset,
+			Length: in.Length,
+			Mode:   FallocateFlags(in.Mode),
+		}
+
 	case opDestroy:
 		req = &DestroyRequest{
 			Header: m.Header(),
@@ -1798,7 +1837,7 @@ type ReleaseRequest struct {
 	Handle       HandleID
 	Flags        OpenFlags // flags from OpenRequest
 	ReleaseFlags ReleaseFlags
-	LockOwner    uint32
+	LockOwner    uint64
 }
 
 var _ = Request(&ReleaseRequest{})
@@ -1916,12 +1955,19 @@ func (t DirentType) String() string {
 // AppendDirent appends the encoded form of a directory entry to data
 // and returns the resulting slice.
 func AppendDirent(data []byte, dir Dirent) []byte {
+	return AppendDirentAt(data, 0, dir)
+}
+
+// AppendDirentAt appends the encoded form of a directory entry to data,
+// which starts at offset base of the directory stream, and returns the
+// resulting slice.
+func AppendDirentAt(data []byte, base int64, dir Dirent) []byte {
 	de := dirent{
 		Ino:     dir.Inode,
 		Namelen: uint32(len(dir.Name)),
 		Type:    uint32(dir.Type),
 	}
-	de.Off = uint64(len(data) + direntSize + (len(dir.Name)+7)&^7)
+	de.Off = uint64(base) + uint64(len(data)+direntSize+(len(dir.Name)+7)&^7)
 	data = append(data, (*[direntSize]byte)(unsafe.Pointer(&de))[:]...)
 	data = append(data, dir.Name...)
 	n := direntSize + uintptr(len(dir.Name))
@@ -2098,6 +2144,110 @@ func (r *FlushRequest) Respond() {
 	r.respond(buf)
 }
 
+// A LockType is the type of a lock, as the l_type of fcntl.
+type LockType uint32
+
+const (
+	LockRead   LockType = syscall.F_RDLCK
+	LockWrite  LockType = syscall.F_WRLCK
+	LockUnlock LockType = syscall.F_UNLCK
+)
+
+func (t LockType) String() string {
+	switch t {
+	case LockRead:
+		return "LockRead"
+	case LockWrite:
+		return "LockWrite"
+	case LockUnlock:
+		return "LockUnlock"
+	}
+	return fmt.Sprintf("LockType(%d)", uint32(t))
+}
+
+// A FileLock is a lock of the bytes from Start to End included, End is
+// math.MaxUint64 for a lock up to the end of file. A flock lock covers the
+// whole file.
+type FileLock struct {
+	Start uint64
+	End   uint64
+	Type  LockType
+	PID   uint32
+}
+
+func fileLockFromKernel(lk fileLock) FileLock {
+	return FileLock{Start: lk.Start, End: lk.End, Type: LockType(lk.Type), PID: lk.Pid}
+}
+
+func (l FileLock) String() string {
+	return fmt.Sprintf("%v %d-%d pid=%d", l.Type, l.Start, l.End, l.PID)
+}
+
+// A LockRequest asks to take the lock or to release with a lock of type
+// LockUnlock the locks of the range, held by the lock owner. If Wait is set,
+// the request waits for the conflicting locks to be released, and is
+// interrupted if the process gets a signal.
+type LockRequest struct {
+	Header    `json:"-"`
+	Handle    HandleID
+	LockOwner uint64
+	Lock      FileLock
+	LockFlags LockFlags
+	Wait      bool
+}
+
+var _ = Request(&LockRequest{})
+
+func (r *LockRequest) String() string {
+	return fmt.Sprintf("Lock [%s] %v owner=%#x %v fl=%v wait=%v", &r.Header, r.Handle, r.LockOwner, r.Lock, r.LockFlags, r.Wait)
+}
+
+// Respond replies to the request, indicating that the lock is taken or
+// released.
+func (r *LockRequest) Respond() {
+	buf := newBuffer(0)
+	r.respond(buf)
+}
+
+// A QueryLockRequest asks for a lock conflicting with the lock of the
+// request, as F_GETLK.
+type QueryLockRequest struct {
+	Header    `json:"-"`
+	Handle    HandleID
+	LockOwner uint64
+	Lock      FileLock
+	LockFlags LockFlags
+}
+
+var _ = Request(&QueryLockRequest{})
+
+func (r *QueryLockRequest) String() string {
+	return fmt.Sprintf("QueryLock [%s] %v owner=%#x %v fl=%v", &r.Header, r.Handle, r.LockOwner, r.Lock, r.LockFlags)
+}
+
+// Respond replies to the request with the conflicting lock, or with a lock
+// of type LockUnlock if there is none.
+func (r *QueryLockRequest) Respond(resp *QueryLockResponse) {
+	buf := newBuffer(unsafe.Sizeof(lkOut{}))
+	out := (*lkOut)(buf.alloc(unsafe.Sizeof(lkOut{})))
+	out.Lk = fileLock{
+		Start: resp.Lock.Start,
+		End:   resp.Lock.End,
+		Type:  uint32(resp.Lock.Type),
+		Pid:   resp.Lock.PID,
+	}
+	r.respond(buf)
+}
+
+// A QueryLockResponse is the response to a QueryLockRequest.
+type QueryLockResponse struct {
+	Lock FileLock
+}
+
+func (r *QueryLockResponse) String() string {
+	return fmt.Sprintf("QueryLock %v", r.Lock)
+}
+
 // A RemoveRequest asks to remove a file or directory from the
 // directory r.Node.
 type RemoveRequest struct {
@@ -2264,6 +2414,29 @@ func (r *FsyncRequest) Respond() {
 	r.respond(buf)
 }
 
+// A FallocateRequest asks to allocate or deallocate the space of a range of
+// an open file.
+type FallocateRequest struct {
+	Header `json:"-"`
+	Handle HandleID
+	Offset uint64
+	Length uint64
+	Mode   FallocateFlags
+}
+
+var _ = Request(&FallocateRequest{})
+
+func (r *FallocateRequest) String() string {
+	return fmt.Sprintf("Fallocate [%s] Handle %v %d @%d Mode %v", &r.Header, r.Handle, r.Length, r.Offset, r.Mode)
+}
+
+// Respond replies to the request, indicating that the space has been
+// allocated or deallocated.
+func (r *FallocateRequest) Respond() {
+	buf := newBuffer(0)
+	r.respond(buf)
+}
+
 // An InterruptRequest is a request to interrupt another pending request. The
 // response to that request should return an error status of EINTR.
 type InterruptRequest struct {
@@ -336,7 +336,8 @@ func flagString(f uint32, names []flagName) string {
 type ReleaseFlags uint32
 
 const (
-	ReleaseFlush ReleaseFlags = 1 << 0
+	ReleaseFlush       ReleaseFlags = 1 << 0
+	ReleaseFlockUnlock ReleaseFlags = 1 << 1 // the flock locks of the lock owner are released
 )
 
 func (fl ReleaseFlags) String() string {
@@ -345,6 +346,39 @@ func (fl ReleaseFlags) String() string {
 
 var releaseFlagNames = []flagName{
 	{uint32(ReleaseFlush), "ReleaseFlush"},
+	{uint32(ReleaseFlockUnlock), "ReleaseFlockUnlock"},
+}
+
+// The LockFlags are used in the lock requests.
+type LockFlags uint32
+
+const (
+	LockFlock LockFlags = 1 << 0 // a flock lock instead of a POSIX record lock
+)
+
+func (fl LockFlags) String() string {
+	return flagString(uint32(fl), lockFlagNames)
+}
+
+var lockFlagNames = []flagName{
+	{uint32(LockFlock), "LockFlock"},
+}
+
+// The FallocateFlags are the mode of the Fallocate request.
+type FallocateFlags uint32
+
+const (
+	FallocateKeepSize  FallocateFlags = 1 << 0 // the size of the file is not changed
+	FallocatePunchHole FallocateFlags = 1 << 1 // the range is deallocated, only with FallocateKeepSize
+)
+
+func (fl FallocateFlags) String() string {
+	return flagString(uint32(fl), fallocateFlagNames)
+}
+
+var fallocateFlagNames = []flagName{
+	{uint32(FallocateKeepSize), "FallocateKeepSize"},
+	{uint32(FallocatePunchHole), "FallocatePunchHole"},
 }
 
 // Opcodes
@@ -387,6 +421,7 @@ const (
 	opDestroy     = 38
 	opIoctl       = 39 // Linux?
 	opPoll        = 40 // Linux?
+	opFallocate   = 43 // Linux
 
 	// OS X
 	opSetvolname = 61
@@ -546,7 +581,7 @@ type releaseIn struct {
 	Fh           uint64
 	Flags        uint32
 	ReleaseFlags uint32
-	LockOwner    uint32
+	LockOwner    uint64
 }
 
 type flushIn struct {
@@ -645,6 +680,14 @@ type fsyncIn struct {
 	_          uint32
 }
 
+type fallocateIn struct {
+	Fh     uint64
+	Offset uint64
+	Length uint64
+	Mode   uint32
+	_      uint32
+}
+
 type setxattrInCommon struct {
 	Size  uint32
 	Flags uint32
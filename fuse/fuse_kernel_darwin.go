@@ -4,6 +4,9 @@ import (
 	"time"
 )
 
+// OpenDirect is never set, OS X has no O_DIRECT.
+const OpenDirect OpenFlags = 0
+
 type attr struct {
 	Ino        uint64
 	Size       uint64
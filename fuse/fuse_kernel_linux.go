@@ -1,6 +1,12 @@
 package fuse
 
-import "time"
+import (
+	"syscall"
+	"time"
+)
+
+// OpenDirect is set in OpenRequest.Flags if the file is opened with O_DIRECT.
+const OpenDirect OpenFlags = syscall.O_DIRECT
 
 type attr struct {
 	Ino       uint64
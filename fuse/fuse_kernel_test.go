@@ -61,3 +61,15 @@ func TestOpenFlagsString(t *testing.T) {
 		t.Fatalf("OpenFlags.String: %q != %q", g, e)
 	}
 }
+
+func TestLockFlagsString(t *testing.T) {
+	if g, e := (fuse.ReleaseFlush | fuse.ReleaseFlockUnlock).String(), "ReleaseFlush+ReleaseFlockUnlock"; g != e {
+		t.Fatalf("ReleaseFlags.String: %q != %q", g, e)
+	}
+	if g, e := fuse.LockFlock.String(), "LockFlock"; g != e {
+		t.Fatalf("LockFlags.String: %q != %q", g, e)
+	}
+	if g, e := (fuse.FileLock{Start: 0, End: 99, Type: fuse.LockWrite, PID: 7}).String(), "LockWrite 0-99 pid=7"; g != e {
+		t.Fatalf("FileLock.String: %q != %q", g, e)
+	}
+}
@@ -245,6 +245,25 @@ func WritebackCache() MountOption {
 	}
 }
 
+// LockingFlock enables the flock locks of the FUSE server, the handles
+// have to implement fs.HandleLocker. Without this, the kernel keeps the
+// flock locks local to the mount.
+func LockingFlock() MountOption {
+	return func(conf *mountConfig) error {
+		conf.initFlags |= InitFlockLocks
+		return nil
+	}
+}
+
+// LockingPOSIX enables the POSIX record locks of the FUSE server, as
+// LockingFlock the flock locks.
+func LockingPOSIX() MountOption {
+	return func(conf *mountConfig) error {
+		conf.initFlags |= InitPosixLocks
+		return nil
+	}
+}
+
 // OSXFUSEPaths describes the paths used by an installed OSXFUSE
 // version. See OSXFUSELocationV3 for typical values.
 type OSXFUSEPaths struct {
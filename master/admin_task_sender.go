@@ -199,6 +199,12 @@ func (sender *AdminTaskSender) PutTask(t *proto.AdminTask) {
 	}
 }
 
+func (sender *AdminTaskSender) taskCount() int {
+	sender.Lock()
+	defer sender.Unlock()
+	return len(sender.TaskMap)
+}
+
 func (sender *AdminTaskSender) IsExist(t *proto.AdminTask) bool {
 	sender.Lock()
 	defer sender.Unlock()
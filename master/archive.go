@@ -0,0 +1,291 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	ArchiveCheckIntervalSeconds = 60
+)
+
+const (
+	ArchiveStatusArchiving   = "archiving"
+	ArchiveStatusArchived    = "archived"
+	ArchiveStatusRehydrating = "rehydrating"
+)
+
+func (c *Cluster) startCheckArchive() {
+	go func() {
+		for {
+			if c.partition.IsLeader() {
+				c.checkArchive()
+			}
+			time.Sleep(time.Second * ArchiveCheckIntervalSeconds)
+		}
+	}()
+}
+
+// advance the archives and rehydrations in progress, the tasks of a step are sent again
+// after they failed or the leader changed
+func (c *Cluster) checkArchive() {
+	for _, vol := range c.getAllNormalVols() {
+		for _, dp := range vol.getArchivePartitions() {
+			c.advanceArchive(dp)
+		}
+	}
+}
+
+/*the partitions of the vol being archived or rehydrated*/
+func (vol *Vol) getArchivePartitions() (dps []*DataPartition) {
+	dps = make([]*DataPartition, 0)
+	vol.dataPartitions.RLock()
+	defer vol.dataPartitions.RUnlock()
+	for _, dp := range vol.dataPartitions.dataPartitions {
+		if status := dp.getArchiveStatus(); status == ArchiveStatusArchiving || status == ArchiveStatusRehydrating {
+			dps = append(dps, dp)
+		}
+	}
+	return
+}
+
+func (partition *DataPartition) getArchiveStatus() string {
+	partition.RLock()
+	defer partition.RUnlock()
+	return partition.ArchiveStatus
+}
+
+func (partition *DataPartition) generateArchiveTask(addr, target string, export bool) (task *proto.AdminTask) {
+	request := &proto.ArchiveDataPartitionRequest{
+		PartitionType: partition.PartitionType,
+		PartitionId:   partition.PartitionID,
+		Target:        target,
+		Export:        export,
+	}
+	task = proto.NewAdminTask(proto.OpArchiveDataPartition, addr, request)
+	partition.resetTaskID(task)
+	return
+}
+
+func (partition *DataPartition) generateRehydrateTask(addr string) (task *proto.AdminTask) {
+	request := &proto.RehydrateDataPartitionRequest{
+		PartitionType: partition.PartitionType,
+		PartitionId:   partition.PartitionID,
+		VolumeId:      partition.VolName,
+		Target:        partition.ArchiveTarget,
+		Epoch:         partition.Epoch,
+	}
+	task = proto.NewAdminTask(proto.OpRehydrateDataPartition, addr, request)
+	partition.resetTaskID(task)
+	return
+}
+
+// seal the partition and detach its replicas from the data nodes, the leader exports
+// the files to the archive target of the cluster first if it is set
+func (c *Cluster) archiveDataPartition(dp *DataPartition) (err error) {
+	var vol *Vol
+	if vol, err = c.getVol(dp.VolName); err != nil {
+		return
+	}
+	dp.Lock()
+	if dp.ArchiveStatus != "" {
+		err = errors.Annotatef(DataPartitionArchived, "partitionID[%v] %v", dp.PartitionID, dp.ArchiveStatus)
+	} else if dp.PartitionType == proto.ErasureCodePartition || dp.EncodeStep != "" {
+		err = errors.Annotatef(DataPartitionEncoding, "partitionID[%v] type[%v] step[%v]", dp.PartitionID, dp.PartitionType, dp.EncodeStep)
+	} else if dp.isRecover || dp.hasQuarantined() || len(dp.WarmHosts) != 0 {
+		err = errors.Annotatef(UnMatchPara, "partitionID[%v] is recovering or migrating", dp.PartitionID)
+	} else if err = dp.hasMissOne(int(vol.dpReplicaNum)); err == nil {
+		dp.ArchiveStatus = ArchiveStatusArchiving
+		dp.ArchiveTarget = c.archiveTarget
+		if err = c.syncUpdateDataPartition(dp.VolName, dp); err != nil {
+			dp.ArchiveStatus = ""
+			dp.ArchiveTarget = ""
+		} else {
+			dp.Status = proto.ReadOnly
+			dp.archiveProgress = make(map[string]uint8)
+		}
+	}
+	dp.Unlock()
+	if err != nil {
+		return
+	}
+	log.LogWarnf("action[archiveDataPartition] clusterID[%v] partitionID:%v vol[%v] archiving, target[%v]",
+		c.Name, dp.PartitionID, dp.VolName, dp.ArchiveTarget)
+	c.advanceArchive(dp)
+	return
+}
+
+/*attach the replicas of the archived partition to the data nodes again, an archive in progress is aborted*/
+func (c *Cluster) rehydrateDataPartition(dp *DataPartition) (err error) {
+	dp.Lock()
+	status := dp.ArchiveStatus
+	switch status {
+	case ArchiveStatusArchived, ArchiveStatusArchiving:
+		dp.ArchiveStatus = ArchiveStatusRehydrating
+		if err = c.syncUpdateDataPartition(dp.VolName, dp); err != nil {
+			dp.ArchiveStatus = status
+		} else {
+			dp.archiveProgress = make(map[string]uint8)
+		}
+	case ArchiveStatusRehydrating:
+	default:
+		err = errors.Annotatef(UnMatchPara, "partitionID[%v] is not archived", dp.PartitionID)
+	}
+	dp.Unlock()
+	if err != nil {
+		return
+	}
+	log.LogWarnf("action[rehydrateDataPartition] clusterID[%v] partitionID:%v vol[%v] rehydrating from %v",
+		c.Name, dp.PartitionID, dp.VolName, status)
+	c.advanceArchive(dp)
+	return
+}
+
+/*archive the partitions of the vol not archived yet, only the sealed ones if sealedOnly, return the partitions failed*/
+func (c *Cluster) archiveVol(name string, sealedOnly bool) (count int, failed map[uint64]string, err error) {
+	return c.rangeVolArchive(name, "", sealedOnly, c.archiveDataPartition)
+}
+
+/*rehydrate the archived partitions of the vol, return the partitions failed*/
+func (c *Cluster) rehydrateVol(name string) (count int, failed map[uint64]string, err error) {
+	return c.rangeVolArchive(name, ArchiveStatusArchived, false, c.rehydrateDataPartition)
+}
+
+func (c *Cluster) rangeVolArchive(name, archiveStatus string, sealedOnly bool, f func(dp *DataPartition) error) (count int, failed map[uint64]string, err error) {
+	var vol *Vol
+	if vol, err = c.getVol(name); err != nil {
+		return
+	}
+	failed = make(map[uint64]string)
+	vol.dataPartitions.RLock()
+	dps := make([]*DataPartition, 0)
+	for _, dp := range vol.dataPartitions.dataPartitions {
+		if dp.getArchiveStatus() == archiveStatus && (!sealedOnly || dp.isSealed()) {
+			dps = append(dps, dp)
+		}
+	}
+	vol.dataPartitions.RUnlock()
+	for _, dp := range dps {
+		if e := f(dp); e != nil {
+			failed[dp.PartitionID] = e.Error()
+			continue
+		}
+		count++
+	}
+	return
+}
+
+// send the tasks of the current step not sent yet, and move to the next step once all
+// the replicas finished. The leader exports the files before the followers detach theirs
+func (c *Cluster) advanceArchive(dp *DataPartition) {
+	var tasks []*proto.AdminTask
+	dp.Lock()
+	defer func() {
+		dp.Unlock()
+		c.putDataNodeTasks(tasks)
+	}()
+	if len(dp.PersistenceHosts) == 0 {
+		return
+	}
+	tasks = make([]*proto.AdminTask, 0)
+	switch dp.ArchiveStatus {
+	case ArchiveStatusArchiving:
+		leader := dp.PersistenceHosts[0]
+		if dp.archiveProgress[leader] != proto.TaskSuccess {
+			if _, ok := dp.archiveProgress[leader]; !ok {
+				dp.archiveProgress[leader] = proto.TaskRunning
+				tasks = append(tasks, dp.generateArchiveTask(leader, dp.ArchiveTarget, dp.ArchiveTarget != ""))
+			}
+			return
+		}
+		for _, addr := range dp.PersistenceHosts[1:] {
+			if _, ok := dp.archiveProgress[addr]; !ok {
+				dp.archiveProgress[addr] = proto.TaskRunning
+				tasks = append(tasks, dp.generateArchiveTask(addr, dp.ArchiveTarget, false))
+			}
+		}
+		if dp.isArchiveStepDone() {
+			c.finishArchiveStep(dp, ArchiveStatusArchived, proto.Unavaliable)
+		}
+	case ArchiveStatusRehydrating:
+		for _, addr := range dp.PersistenceHosts {
+			if _, ok := dp.archiveProgress[addr]; !ok {
+				dp.archiveProgress[addr] = proto.TaskRunning
+				tasks = append(tasks, dp.generateRehydrateTask(addr))
+			}
+		}
+		if dp.isArchiveStepDone() {
+			c.finishArchiveStep(dp, "", proto.ReadOnly)
+		}
+	}
+}
+
+/*the caller must hold the lock of dp*/
+func (partition *DataPartition) isArchiveStepDone() bool {
+	for _, addr := range partition.PersistenceHosts {
+		if partition.archiveProgress[addr] != proto.TaskSuccess {
+			return false
+		}
+	}
+	return true
+}
+
+/*the caller must hold the lock of dp, the step is finished again in the next check if the update failed*/
+func (c *Cluster) finishArchiveStep(dp *DataPartition, archiveStatus string, status int8) {
+	oldStatus := dp.ArchiveStatus
+	dp.ArchiveStatus = archiveStatus
+	if err := c.syncUpdateDataPartition(dp.VolName, dp); err != nil {
+		dp.ArchiveStatus = oldStatus
+		log.LogWarnf("action[finishArchiveStep] partitionID:%v vol[%v] %v: %v", dp.PartitionID, dp.VolName, archiveStatus, err)
+		return
+	}
+	dp.Status = status
+	dp.archiveProgress = make(map[string]uint8)
+	log.LogWarnf("action[finishArchiveStep] clusterID[%v] partitionID:%v vol[%v] %v finished, hosts%v",
+		c.Name, dp.PartitionID, dp.VolName, oldStatus, dp.PersistenceHosts)
+}
+
+/*the responses of the tasks sent before the step changed are dropped*/
+func (c *Cluster) dealArchiveResponse(nodeAddr string, partitionID uint64, step string, status uint8, result string) (err error) {
+	var dp *DataPartition
+	if dp, err = c.getDataPartitionByID(partitionID); err != nil {
+		return
+	}
+	dp.Lock()
+	if dp.ArchiveStatus != step {
+		dp.Unlock()
+		return
+	}
+	if status == proto.TaskSuccess {
+		dp.archiveProgress[nodeAddr] = proto.TaskSuccess
+	} else {
+		// sent again by the next check
+		delete(dp.archiveProgress, nodeAddr)
+	}
+	dp.Unlock()
+	if status != proto.TaskSuccess {
+		Warn(c.Name, fmt.Sprintf("clusterID[%v] partitionID:%v %v on node[%v] failed,err[%v]",
+			c.Name, partitionID, step, nodeAddr, result))
+		return
+	}
+	c.advanceArchive(dp)
+	return
+}
@@ -0,0 +1,204 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	DefaultClientSessionTimeOutSec = 3 * 60
+	DefaultClientFenceSeconds      = 30 * 60
+)
+
+// a mounted client of a vol, it is reported by the client periodically and
+// kept only in the memory of the leader, a new leader learns the sessions
+// from the next reports
+type ClientSession struct {
+	ID         string
+	VolName    string
+	Addr       string
+	StartTime  int64
+	ReportTime int64
+}
+
+type ClientSessionView struct {
+	ID              string
+	Evicted         bool
+	FenceExpireTime int64
+}
+
+// the sessions are kept by vol and id, a client process reports the same
+// session for all the vols it mounts as it shares the connections among them
+type clientSessions struct {
+	sessions map[string]*ClientSession
+	fences   map[string]*proto.ClientFence // by session id
+	sync.RWMutex
+}
+
+func newClientSessions() (cs *clientSessions) {
+	return &clientSessions{
+		sessions: make(map[string]*ClientSession),
+		fences:   make(map[string]*proto.ClientFence),
+	}
+}
+
+func sessionKey(volName, id string) string {
+	return volName + "/" + id
+}
+
+/*the fence of the session if it is still in force, the caller must hold the lock*/
+func (cs *clientSessions) getFence(id string) (fence *proto.ClientFence) {
+	fence, ok := cs.fences[id]
+	if !ok {
+		return nil
+	}
+	if time.Now().Unix() >= fence.ExpireTime {
+		delete(cs.fences, id)
+		return nil
+	}
+	return
+}
+
+func (c *Cluster) reportClientSession(volName, id, addr string) (view *ClientSessionView, err error) {
+	if _, err = c.getVol(volName); err != nil {
+		return
+	}
+	cs := c.clientSessions
+	cs.Lock()
+	defer cs.Unlock()
+	view = &ClientSessionView{ID: id}
+	key := sessionKey(volName, id)
+	if fence := cs.getFence(id); fence != nil {
+		delete(cs.sessions, key)
+		view.Evicted = true
+		view.FenceExpireTime = fence.ExpireTime
+		return
+	}
+	now := time.Now().Unix()
+	session, ok := cs.sessions[key]
+	if !ok {
+		session = &ClientSession{ID: id, VolName: volName, Addr: addr, StartTime: now}
+		cs.sessions[key] = session
+		log.LogInfof("action[reportClientSession] vol[%v] new client session[%v] addr[%v]", volName, id, addr)
+	}
+	session.ReportTime = now
+	return
+}
+
+/*the active sessions of the vol sorted by start time, the timeout sessions are removed*/
+func (c *Cluster) getClientSessions(volName string) (sessions []*ClientSession) {
+	cs := c.clientSessions
+	cs.Lock()
+	defer cs.Unlock()
+	sessions = make([]*ClientSession, 0)
+	now := time.Now().Unix()
+	for key, session := range cs.sessions {
+		if now-session.ReportTime > DefaultClientSessionTimeOutSec {
+			delete(cs.sessions, key)
+			continue
+		}
+		if session.VolName == volName {
+			s := *session
+			sessions = append(sessions, &s)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].StartTime < sessions[j].StartTime
+	})
+	return
+}
+
+// evict the client session, the session is fenced on all the meta nodes and
+// data nodes by the heartbeats which are sent at once, the nodes refuse the
+// connections it authenticated with. The session is evicted from all the vols
+// the client mounts.
+func (c *Cluster) evictClient(volName, id string, fenceSeconds int64) (fence *proto.ClientFence, err error) {
+	cs := c.clientSessions
+	cs.Lock()
+	session, ok := cs.sessions[sessionKey(volName, id)]
+	if !ok {
+		cs.Unlock()
+		err = errors.Annotatef(ClientSessionNotFound, "vol[%v] session[%v]", volName, id)
+		return
+	}
+	for key, s := range cs.sessions {
+		if s.ID == id {
+			delete(cs.sessions, key)
+		}
+	}
+	fence = &proto.ClientFence{Addr: session.Addr, Session: id, ExpireTime: time.Now().Unix() + fenceSeconds}
+	if old := cs.getFence(id); old != nil && old.ExpireTime > fence.ExpireTime {
+		fence = old
+	}
+	cs.fences[id] = fence
+	cs.Unlock()
+	msg := fmt.Sprintf("action[evictClient] vol[%v] session[%v] addr[%v] fenced until[%v]",
+		volName, id, session.Addr, time.Unix(fence.ExpireTime, 0))
+	Warn(c.Name, msg)
+	c.checkDataNodeHeartbeat()
+	c.checkMetaNodeHeartbeat()
+	return
+}
+
+/*the fences in force, carried by every heartbeat to the nodes*/
+func (c *Cluster) getClientFences() (fences []*proto.ClientFence) {
+	cs := c.clientSessions
+	cs.Lock()
+	defer cs.Unlock()
+	fences = make([]*proto.ClientFence, 0, len(cs.fences))
+	for id := range cs.fences {
+		if fence := cs.getFence(id); fence != nil {
+			fences = append(fences, fence)
+		}
+	}
+	return
+}
+
+/*the ids of the sessions not timed out, meta nodes keep the open files of them*/
+func (c *Cluster) getActiveSessionIDs() (ids []string) {
+	cs := c.clientSessions
+	cs.RLock()
+	defer cs.RUnlock()
+	ids = make([]string, 0, len(cs.sessions))
+	seen := make(map[string]bool, len(cs.sessions))
+	now := time.Now().Unix()
+	for _, session := range cs.sessions {
+		if now-session.ReportTime <= DefaultClientSessionTimeOutSec && !seen[session.ID] {
+			seen[session.ID] = true
+			ids = append(ids, session.ID)
+		}
+	}
+	return
+}
+
+/*the fences with the expire time converted to the clock of the node, the node checks them with its own clock*/
+func fencesInNodeClock(fences []*proto.ClientFence, offset int64) []*proto.ClientFence {
+	if offset == 0 {
+		return fences
+	}
+	converted := make([]*proto.ClientFence, 0, len(fences))
+	for _, fence := range fences {
+		converted = append(converted, &proto.ClientFence{Addr: fence.Addr, Session: fence.Session, ExpireTime: fence.ExpireTime + offset})
+	}
+	return converted
+}
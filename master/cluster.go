@@ -26,20 +26,32 @@ import (
 )
 
 type Cluster struct {
-	Name          string
-	vols          map[string]*Vol
-	dataNodes     sync.Map
-	metaNodes     sync.Map
-	createDpLock  sync.Mutex
-	volsLock      sync.RWMutex
-	leaderInfo    *LeaderInfo
-	cfg           *ClusterConfig
-	fsm           *MetadataFsm
-	partition     raftstore.Partition
-	retainLogs    uint64
-	idAlloc       *IDAllocator
-	t             *Topology
-	compactStatus bool
+	Name           string
+	vols           map[string]*Vol
+	dataNodes      sync.Map
+	metaNodes      sync.Map
+	createDpLock   sync.Mutex
+	volsLock       sync.RWMutex
+	leaderInfo     *LeaderInfo
+	cfg            *ClusterConfig
+	fsm            *MetadataFsm
+	partition      raftstore.Partition
+	retainLogs     uint64
+	idAlloc        *IDAllocator
+	t              *Topology
+	compactStatus  bool
+	clientSessions *clientSessions
+	leaderLeases   *leaderLeases
+	rebalancer     *rebalancer
+	decommissioner *decommissioner
+	leaderTransfer *leaderTransferrer
+	resizer        *resizer
+	placement      *placement
+	usageReporter  *usageReporter
+	notifier       *notifier
+	lifecycle      *lifecycleScanner
+	archiveTarget  string
+	kms            KeyManager
 }
 
 func newCluster(name string, leaderInfo *LeaderInfo, fsm *MetadataFsm, partition raftstore.Partition) (c *Cluster) {
@@ -52,6 +64,15 @@ func newCluster(name string, leaderInfo *LeaderInfo, fsm *MetadataFsm, partition
 	c.partition = partition
 	c.idAlloc = newIDAllocator(c.fsm.store, c.partition)
 	c.t = NewTopology()
+	c.clientSessions = newClientSessions()
+	c.leaderLeases = newLeaderLeases()
+	c.rebalancer = newRebalancer()
+	c.decommissioner = newDecommissioner()
+	c.leaderTransfer = newLeaderTransferrer()
+	c.resizer = newResizer()
+	c.placement = newPlacement()
+	c.lifecycle = newLifecycleScanner()
+	c.kms = newLocalKeyManager()
 	c.startCheckDataPartitions()
 	c.startCheckBackendLoadDataPartitions()
 	c.startCheckReleaseDataPartitions()
@@ -59,6 +80,12 @@ func newCluster(name string, leaderInfo *LeaderInfo, fsm *MetadataFsm, partition
 	c.startCheckMetaPartitions()
 	c.startCheckAvailSpace()
 	c.startCheckVols()
+	c.startCheckRebalance()
+	c.startCheckDecommission()
+	c.startCheckLeaderTransfer()
+	c.startCheckVolResize()
+	c.startCheckArchive()
+	c.startCheckErasureCode()
 	return
 }
 
@@ -92,8 +119,10 @@ func (c *Cluster) checkVolAvailSpace() {
 		}
 		useRate := float64(used) / float64(total)
 		if useRate > SpaceAvailRate {
-			Warn(c.Name, fmt.Sprintf("clusterId[%v] vol[%v] space utilization reached [%v],usedSpace[%v],totalSpace[%v] please allocate dataPartition",
-				c.Name, vol.Name, useRate, used, total))
+			msg := fmt.Sprintf("clusterId[%v] vol[%v] space utilization reached [%v],usedSpace[%v],totalSpace[%v] please allocate dataPartition",
+				c.Name, vol.Name, useRate, used, total)
+			Warn(c.Name, msg)
+			c.notify(NotifyVolNearFull, vol.Name, msg)
 		}
 	}
 }
@@ -157,6 +186,7 @@ func (c *Cluster) checkDataPartitions() {
 		msg := fmt.Sprintf("action[checkDataPartitions],vol[%v] can readWrite dataPartitions:%v  ", vol.Name, vol.dataPartitions.readWriteDataPartitions)
 		log.LogInfo(msg)
 	}
+	c.checkRepairBacklog()
 }
 
 func (c *Cluster) startCheckBackendLoadDataPartitions() {
@@ -223,22 +253,69 @@ func (c *Cluster) checkLeaderAddr() {
 
 func (c *Cluster) checkDataNodeHeartbeat() {
 	tasks := make([]*proto.AdminTask, 0)
+	fences := c.getClientFences()
+	volTokens := c.getVolTokens()
+	volCompression := c.getVolCompression()
+	volKeys := c.getVolKeys()
+	volColdTierDays := c.getVolColdTierDays()
+	volReadOnly := c.getVolReadOnly()
 	c.dataNodes.Range(func(addr, dataNode interface{}) bool {
 		node := dataNode.(*DataNode)
-		node.checkHeartBeat()
-		task := node.generateHeartbeatTask(c.getMasterAddr())
+		if node.checkHeartBeat() {
+			c.notify(NotifyDataNodeDown, node.Addr, fmt.Sprintf("clusterID[%v] dataNode[%v] rack[%v] sent no heartbeat for %vs",
+				c.Name, node.Addr, node.RackName, DefaultNodeTimeOutSec))
+		}
+		epochs, sealed, unsealed := c.getPartitionEpochs(node)
+		task := node.generateHeartbeatTask(c.getMasterAddr(), epochs, sealed, unsealed, fences, volTokens, volCompression,
+			c.getNodeVolKeys(node, volKeys),
+			volColdTierDays, volReadOnly)
 		tasks = append(tasks, task)
 		return true
 	})
 	c.putDataNodeTasks(tasks)
 }
 
+/*membership epochs and seals of the data partitions reported by the node which it must change*/
+func (c *Cluster) getPartitionEpochs(node *DataNode) (epochs map[uint64]uint64, sealed map[uint64]bool, unsealed []uint64) {
+	epochs = make(map[uint64]uint64)
+	sealed = make(map[uint64]bool)
+	unsealed = make([]uint64, 0)
+	for id, vr := range node.getPartitionReports() {
+		if dp, err := c.getDataPartitionByID(id); err == nil {
+			dp.RLock()
+			// only the epochs the node is behind are sent, a node not reporting its epochs gets all
+			if dp.Epoch != vr.Epoch {
+				epochs[id] = dp.Epoch
+			}
+			if dp.Sealed {
+				sealed[id] = dp.isSealedInSync()
+			} else if vr.Sealed {
+				unsealed = append(unsealed, id)
+			}
+			dp.RUnlock()
+		}
+	}
+	return
+}
+
 func (c *Cluster) checkMetaNodeHeartbeat() {
 	tasks := make([]*proto.AdminTask, 0)
+	fences := c.getClientFences()
+	sessions := c.getActiveSessionIDs()
+	volTokens := c.getVolTokens()
+	volLimits := c.getVolLimits()
+	volAudit := c.getVolAudit()
+	volReadOnly := c.getVolReadOnly()
+	volPermission := c.getVolPermission()
+	volLifecycle := c.getVolLifecycleRules()
 	c.metaNodes.Range(func(addr, metaNode interface{}) bool {
 		node := metaNode.(*MetaNode)
-		node.checkHeartbeat()
-		task := node.generateHeartbeatTask(c.getMasterAddr())
+		if node.checkHeartbeat() {
+			c.notify(NotifyMetaNodeDown, node.Addr, fmt.Sprintf("clusterID[%v] metaNode[%v] rack[%v] sent no heartbeat for %vs",
+				c.Name, node.Addr, node.RackName, DefaultNodeTimeOutSec))
+		}
+		task := node.generateHeartbeatTask(c.getMasterAddr(), fences, sessions, volTokens, volLimits, volAudit, volReadOnly,
+			volPermission, volLifecycle)
 		tasks = append(tasks, task)
 		return true
 	})
@@ -290,13 +367,33 @@ errDeal:
 	return
 }
 
-func (c *Cluster) addDataNode(nodeAddr string) (err error) {
+func (c *Cluster) addDataNode(nodeAddr, clientAddr, replicaAddr, rack, zone string) (id uint64, err error) {
 	var dataNode *DataNode
-	if _, ok := c.dataNodes.Load(nodeAddr); ok {
+	if value, ok := c.dataNodes.Load(nodeAddr); ok {
+		dataNode = value.(*DataNode)
+		dataNode.setAdvertisedAddrs(clientAddr, replicaAddr)
+		dataNode.setLabels(rack, zone)
+		if dataNode.ID != 0 {
+			return dataNode.ID, nil
+		}
+		// the node added before the raft replication gets its id now
+		if id, err = c.idAlloc.allocateMetaNodeID(); err != nil {
+			goto errDeal
+		}
+		if err = c.syncAddDataNode(&DataNode{Addr: nodeAddr, ID: id}); err != nil {
+			goto errDeal
+		}
+		dataNode.ID = id
 		return
 	}
 
 	dataNode = NewDataNode(nodeAddr, c.Name)
+	dataNode.setAdvertisedAddrs(clientAddr, replicaAddr)
+	dataNode.setLabels(rack, zone)
+	if id, err = c.idAlloc.allocateMetaNodeID(); err != nil {
+		goto errDeal
+	}
+	dataNode.ID = id
 	if err = c.syncAddDataNode(dataNode); err != nil {
 		goto errDeal
 	}
@@ -306,7 +403,7 @@ errDeal:
 	err = fmt.Errorf("action[addMetaNode],clusterID[%v] dataNodeAddr:%v err:%v ", c.Name, nodeAddr, err.Error())
 	log.LogError(errors.ErrorStack(err))
 	Warn(c.Name, err.Error())
-	return err
+	return 0, err
 }
 
 func (c *Cluster) getDataPartitionByID(partitionID uint64) (dp *DataPartition, err error) {
@@ -369,6 +466,283 @@ func (c *Cluster) markDeleteVol(name string) (err error) {
 	return
 }
 
+func (c *Cluster) setVolImmutable(name string, immutable bool) (err error) {
+	var (
+		vol    *Vol
+		oldVal bool
+	)
+	if vol, err = c.getVol(name); err != nil {
+		return
+	}
+	oldVal = vol.isImmutable()
+	vol.setImmutable(immutable)
+	if err = c.syncUpdateVol(vol); err != nil {
+		vol.setImmutable(oldVal)
+		return
+	}
+	return
+}
+
+func (c *Cluster) setVolFollowerRead(name string, followerRead bool) (err error) {
+	var (
+		vol    *Vol
+		oldVal bool
+	)
+	if vol, err = c.getVol(name); err != nil {
+		return
+	}
+	oldVal = vol.isFollowerRead()
+	vol.setFollowerRead(followerRead)
+	if err = c.syncUpdateVol(vol); err != nil {
+		vol.setFollowerRead(oldVal)
+		return
+	}
+	return
+}
+
+func (c *Cluster) setVolAudit(name string, audit bool) (err error) {
+	var (
+		vol    *Vol
+		oldVal bool
+	)
+	if vol, err = c.getVol(name); err != nil {
+		return
+	}
+	oldVal = vol.isAudit()
+	vol.setAudit(audit)
+	if err = c.syncUpdateVol(vol); err != nil {
+		vol.setAudit(oldVal)
+		return
+	}
+	return
+}
+
+func (c *Cluster) setVolErasureCode(name string, erasureCode bool) (err error) {
+	var (
+		vol    *Vol
+		oldVal bool
+	)
+	if vol, err = c.getVol(name); err != nil {
+		return
+	}
+	if erasureCode && vol.VolType != proto.ExtentPartition {
+		return errors.Annotatef(InvalidDataPartitionType, "vol type[%v] not erasure coded", vol.VolType)
+	}
+	oldVal = vol.isErasureCode()
+	vol.setErasureCode(erasureCode)
+	if err = c.syncUpdateVol(vol); err != nil {
+		vol.setErasureCode(oldVal)
+		return
+	}
+	return
+}
+
+func (c *Cluster) setVolReadOnly(name string, readOnly bool) (err error) {
+	var (
+		vol    *Vol
+		oldVal bool
+	)
+	if vol, err = c.getVol(name); err != nil {
+		return
+	}
+	oldVal = vol.isReadOnly()
+	vol.setReadOnly(readOnly)
+	if err = c.syncUpdateVol(vol); err != nil {
+		vol.setReadOnly(oldVal)
+		return
+	}
+	return
+}
+
+func (c *Cluster) setVolPermission(name string, permission bool) (err error) {
+	var (
+		vol    *Vol
+		oldVal bool
+	)
+	if vol, err = c.getVol(name); err != nil {
+		return
+	}
+	oldVal = vol.isPermission()
+	vol.setPermission(permission)
+	if err = c.syncUpdateVol(vol); err != nil {
+		vol.setPermission(oldVal)
+		return
+	}
+	return
+}
+
+/*the vols with the permission checks, the meta nodes check the callers of their requests*/
+func (c *Cluster) getVolPermission() (volPermission map[string]bool) {
+	volPermission = make(map[string]bool)
+	for name, vol := range c.copyVols() {
+		if vol.isPermission() {
+			volPermission[name] = true
+		}
+	}
+	return
+}
+
+/*the read only vols, the meta nodes refuse their mutations and the data nodes their writes*/
+func (c *Cluster) getVolReadOnly() (volReadOnly map[string]bool) {
+	volReadOnly = make(map[string]bool)
+	for name, vol := range c.copyVols() {
+		if vol.isReadOnly() {
+			volReadOnly[name] = true
+		}
+	}
+	return
+}
+
+/*the vols with the audit, the meta nodes record their namespace mutations*/
+func (c *Cluster) getVolAudit() (volAudit map[string]bool) {
+	volAudit = make(map[string]bool)
+	for name, vol := range c.copyVols() {
+		if vol.isAudit() {
+			volAudit[name] = true
+		}
+	}
+	return
+}
+
+func (c *Cluster) setVolCompression(name, compression string) (err error) {
+	var (
+		vol    *Vol
+		oldVal string
+	)
+	if vol, err = c.getVol(name); err != nil {
+		return
+	}
+	oldVal = vol.getCompression()
+	vol.setCompression(compression)
+	if err = c.syncUpdateVol(vol); err != nil {
+		vol.setCompression(oldVal)
+		return
+	}
+	return
+}
+
+func (c *Cluster) setVolColdTier(name string, days int) (err error) {
+	var (
+		vol    *Vol
+		oldVal int
+	)
+	if vol, err = c.getVol(name); err != nil {
+		return
+	}
+	oldVal = vol.getColdTierDays()
+	vol.setColdTierDays(days)
+	if err = c.syncUpdateVol(vol); err != nil {
+		vol.setColdTierDays(oldVal)
+		return
+	}
+	return
+}
+
+func (c *Cluster) setVolDegradedWrite(name, degradedWrite string) (err error) {
+	var (
+		vol    *Vol
+		oldVal string
+	)
+	if vol, err = c.getVol(name); err != nil {
+		return
+	}
+	oldVal = vol.getDegradedWrite()
+	vol.setDegradedWrite(degradedWrite)
+	if err = c.syncUpdateVol(vol); err != nil {
+		vol.setDegradedWrite(oldVal)
+		return
+	}
+	return
+}
+
+/*compressions of the vols with one, the data nodes compress the blob objects written to them*/
+func (c *Cluster) getVolCompression() (volCompression map[string]string) {
+	volCompression = make(map[string]string)
+	for name, vol := range c.copyVols() {
+		if compression := vol.getCompression(); compression != proto.CompressionNone {
+			volCompression[name] = compression
+		}
+	}
+	return
+}
+
+/*days of the vols with a cold tier, the data nodes move the extents not read for them*/
+func (c *Cluster) getVolColdTierDays() (volColdTierDays map[string]int) {
+	volColdTierDays = make(map[string]int)
+	for name, vol := range c.copyVols() {
+		if days := vol.getColdTierDays(); days > 0 {
+			volColdTierDays[name] = days
+		}
+	}
+	return
+}
+
+func (c *Cluster) setVolSyncOnClose(name string, syncOnClose bool) (err error) {
+	var (
+		vol    *Vol
+		oldVal bool
+	)
+	if vol, err = c.getVol(name); err != nil {
+		return
+	}
+	oldVal = vol.isSyncOnClose()
+	vol.setSyncOnClose(syncOnClose)
+	if err = c.syncUpdateVol(vol); err != nil {
+		vol.setSyncOnClose(oldVal)
+		return
+	}
+	return
+}
+
+func (c *Cluster) setVolQuota(name string, quota uint64) (err error) {
+	var (
+		vol    *Vol
+		oldVal uint64
+	)
+	if vol, err = c.getVol(name); err != nil {
+		return
+	}
+	oldVal = vol.getQuota()
+	vol.setQuota(quota)
+	if err = c.syncUpdateVol(vol); err != nil {
+		vol.setQuota(oldVal)
+		return
+	}
+	return
+}
+
+func (c *Cluster) setVolLimits(name string, maxFileSize, maxFiles uint64) (err error) {
+	var (
+		vol            *Vol
+		oldMaxFileSize uint64
+		oldMaxFiles    uint64
+	)
+	if vol, err = c.getVol(name); err != nil {
+		return
+	}
+	oldMaxFileSize, oldMaxFiles = vol.getLimits()
+	vol.setLimits(maxFileSize, maxFiles)
+	if err = c.syncUpdateVol(vol); err != nil {
+		vol.setLimits(oldMaxFileSize, oldMaxFiles)
+		return
+	}
+	return
+}
+
+/*the limits of the vols with any, the file count is as fresh as the meta partition reports*/
+func (c *Cluster) getVolLimits() (volLimits map[string]*proto.VolLimit) {
+	volLimits = make(map[string]*proto.VolLimit)
+	for name, vol := range c.copyVols() {
+		maxFileSize, maxFiles := vol.getLimits()
+		if maxFileSize == 0 && maxFiles == 0 {
+			continue
+		}
+		volLimits[name] = &proto.VolLimit{MaxFileSize: maxFileSize, MaxFiles: maxFiles,
+			FilesFull: maxFiles != 0 && vol.getFileCount() >= maxFiles}
+	}
+	return
+}
+
 func (c *Cluster) createDataPartition(volName, partitionType string) (dp *DataPartition, err error) {
 	var (
 		vol         *Vol
@@ -389,6 +763,16 @@ func (c *Cluster) createDataPartition(volName, partitionType string) (dp *DataPa
 	}
 	dp = newDataPartition(partitionID, vol.dpReplicaNum, partitionType, volName)
 	dp.PersistenceHosts = targetHosts
+	dp.Epoch = 1
+	if encrypted, keyId, _ := vol.getEncryption(); encrypted {
+		dp.EncryptKeyId = keyId
+	}
+	if vol.Replication == proto.ReplicationRaft && partitionType == proto.ExtentPartition {
+		dp.Replication = vol.Replication
+		if dp.Peers, err = c.getDataPeers(targetHosts); err != nil {
+			goto errDeal
+		}
+	}
 	if err = c.syncAddDataPartition(volName, dp); err != nil {
 		goto errDeal
 	}
@@ -411,6 +795,9 @@ func (c *Cluster) ChooseTargetDataHosts(replicaNum int) (hosts []string, err err
 		racks      []*Rack
 		rack       *Rack
 	)
+	if c.placement.isEnabled() {
+		return c.choosePlacedHosts(replicaNum, nil, nil)
+	}
 	hosts = make([]string, 0)
 	if c.t.isSingleRack() {
 		var newHosts []string
@@ -456,6 +843,41 @@ func (c *Cluster) ChooseTargetDataHosts(replicaNum int) (hosts []string, err err
 	return
 }
 
+//spread the shards of an erasure coded partition over the racks evenly, the hosts
+//are in the order of the shard index. A rack holding more than parityShards shards
+//loses data when it fails, which is warned, and refused with a failure domain set
+func (c *Cluster) chooseErasureCodeHosts(shardNum, parityShards int) (hosts []string, err error) {
+	var (
+		racks []*Rack
+		addrs []string
+	)
+	if c.placement.isEnabled() {
+		return c.choosePlacedShards(shardNum, parityShards)
+	}
+	if racks, err = c.t.allocRacks(shardNum, nil); err != nil {
+		return nil, errors.Trace(err)
+	}
+	rackShards := make([]int, len(racks))
+	for i := 0; i < shardNum; i++ {
+		rackShards[i%len(racks)]++
+	}
+	hosts = make([]string, 0, shardNum)
+	for index, rack := range racks {
+		if addrs, err = rack.getAvailDataNodeHosts(hosts, rackShards[index]); err != nil {
+			return nil, errors.Trace(err)
+		}
+		hosts = append(hosts, addrs...)
+	}
+	if len(hosts) != shardNum {
+		return nil, NoAnyDataNodeForCreateDataPartition
+	}
+	if rackShards[0] > parityShards {
+		log.LogWarnf("action[chooseErasureCodeHosts] %v shards on %v racks, a rack failure loses %v shards more than parity %v",
+			shardNum, len(racks), rackShards[0], parityShards)
+	}
+	return
+}
+
 func (c *Cluster) getDataNode(addr string) (dataNode *DataNode, err error) {
 	value, ok := c.dataNodes.Load(addr)
 	if !ok {
@@ -466,6 +888,23 @@ func (c *Cluster) getDataNode(addr string) (dataNode *DataNode, err error) {
 	return
 }
 
+// getDataNodeByAdvertisedAddr finds the data node by its control, client or replication address.
+func (c *Cluster) getDataNodeByAdvertisedAddr(addr string) (dataNode *DataNode, err error) {
+	if dataNode, err = c.getDataNode(addr); err == nil {
+		return
+	}
+	c.dataNodes.Range(func(key, value interface{}) bool {
+		node := value.(*DataNode)
+		if node.ClientAddr == addr || node.ReplicaAddr == addr {
+			dataNode = node
+			err = nil
+			return false
+		}
+		return true
+	})
+	return
+}
+
 func (c *Cluster) getMetaNode(addr string) (metaNode *MetaNode, err error) {
 	value, ok := c.metaNodes.Load(addr)
 	if !ok {
@@ -517,15 +956,27 @@ func (c *Cluster) dataPartitionOffline(offlineAddr, volName string, dp *DataPart
 	)
 	dp.Lock()
 	defer dp.Unlock()
+	if ok := dp.isInWarmHosts(offlineAddr); ok {
+		c.warmReplicaOffline(offlineAddr, volName, dp, errMsg)
+		return
+	}
 	if ok := dp.isInPersistenceHosts(offlineAddr); !ok {
 		return
 	}
+	if dp.ArchiveStatus != "" {
+		err = DataPartitionArchived
+		goto errDeal
+	}
+	if dp.EncodeStep != "" {
+		err = DataPartitionEncoding
+		goto errDeal
+	}
 
 	if vol, err = c.getVol(volName); err != nil {
 		goto errDeal
 	}
 
-	if err = dp.hasMissOne(int(vol.dpReplicaNum)); err != nil {
+	if err = dp.hasMissOne(dp.getReplicaNum(vol)); err != nil {
 		goto errDeal
 	}
 	if err = dp.canOffLine(offlineAddr); err != nil {
@@ -533,20 +984,33 @@ func (c *Cluster) dataPartitionOffline(offlineAddr, volName string, dp *DataPart
 	}
 	dp.generatorOffLineLog(offlineAddr)
 
-	if dataNode, err = c.getDataNode(offlineAddr); err != nil {
-		goto errDeal
-	}
+	if len(dp.WarmHosts) != 0 {
+		// promote the warm replica, it only catches up the data written since its last repair
+		newAddr = dp.WarmHosts[0]
+	} else if c.placement.isEnabled() {
+		if newAddr, err = c.chooseReplacementHost(dp.PartitionType, dp.PersistenceHosts, offlineAddr); err != nil {
+			goto errDeal
+		}
+	} else {
+		if dataNode, err = c.getDataNode(offlineAddr); err != nil {
+			goto errDeal
+		}
 
-	if dataNode.RackName == "" {
-		return
-	}
-	if rack, err = c.t.getRack(dataNode.RackName); err != nil {
-		goto errDeal
+		if dataNode.RackName == "" {
+			return
+		}
+		if rack, err = c.t.getRack(dataNode.RackName); err != nil {
+			goto errDeal
+		}
+		if newHosts, err = rack.getAvailDataNodeHosts(dp.PersistenceHosts, 1); err != nil {
+			goto errDeal
+		}
+		newAddr = newHosts[0]
 	}
-	if newHosts, err = rack.getAvailDataNodeHosts(dp.PersistenceHosts, 1); err != nil {
+	if dp.isRaftReplicated() {
+		err = c.raftReplicaOffline(offlineAddr, newAddr, volName, dp)
 		goto errDeal
 	}
-	newAddr = newHosts[0]
 	if err = dp.updateForOffline(offlineAddr, newAddr, volName, c); err != nil {
 		goto errDeal
 	}
@@ -569,6 +1033,93 @@ errDeal:
 	return
 }
 
+//remove the warm replica on offlineAddr, the caller must hold the lock of dp
+func (c *Cluster) warmReplicaOffline(offlineAddr, volName string, dp *DataPartition, errMsg string) {
+	orgWarmHosts := dp.WarmHosts
+	dp.removeWarmHost(offlineAddr)
+	if err := c.syncUpdateDataPartition(volName, dp); err != nil {
+		dp.WarmHosts = orgWarmHosts
+		msg := fmt.Sprintf(errMsg+" clusterID[%v] partitionID:%v  warm replica on Node:%v  Err:%v",
+			c.Name, dp.PartitionID, offlineAddr, err)
+		Warn(c.Name, msg)
+		return
+	}
+	c.putDataNodeTasks([]*proto.AdminTask{dp.GenerateDeleteTask(offlineAddr)})
+	log.LogWarnf("action[warmReplicaOffline] clusterID[%v] partitionID:%v warm replica on Node:%v offline, WarmHosts:%v",
+		c.Name, dp.PartitionID, offlineAddr, dp.WarmHosts)
+}
+
+//add a non-voting warm replica to the extent partition, the host is chosen in the rack
+//of the leader if addr is empty, or with a failure domain set in a domain not holding
+//the other replicas than the leader. The leader catches the warm replica up by the extent repair,
+//and it is promoted to PersistenceHosts by dataPartitionOffline on replica loss
+func (c *Cluster) addWarmReplica(volName string, dp *DataPartition, addr string) (warmAddr string, err error) {
+	var (
+		dataNode *DataNode
+		rack     *Rack
+		newHosts []string
+	)
+	if dp.PartitionType != proto.ExtentPartition || dp.isRaftReplicated() {
+		err = errors.Annotatef(InvalidDataPartitionType, "partitionID[%v] type[%v] replication[%v] not support warm replica",
+			dp.PartitionID, dp.PartitionType, dp.Replication)
+		return
+	}
+	dp.Lock()
+	defer dp.Unlock()
+	if len(dp.PersistenceHosts) == 0 {
+		err = errors.Annotatef(DataReplicaNotFound, "partitionID[%v] has no persistence hosts", dp.PartitionID)
+		return
+	}
+	if dp.ArchiveStatus != "" {
+		err = errors.Annotatef(DataPartitionArchived, "partitionID[%v] %v", dp.PartitionID, dp.ArchiveStatus)
+		return
+	}
+	if dp.EncodeStep != "" {
+		err = errors.Annotatef(DataPartitionEncoding, "partitionID[%v] step[%v]", dp.PartitionID, dp.EncodeStep)
+		return
+	}
+	excludeHosts := make([]string, 0, len(dp.PersistenceHosts)+len(dp.WarmHosts))
+	excludeHosts = append(excludeHosts, dp.PersistenceHosts...)
+	excludeHosts = append(excludeHosts, dp.WarmHosts...)
+	if addr == "" && c.placement.isEnabled() {
+		if addr, err = c.chooseReplacementHost(dp.PartitionType, excludeHosts, dp.PersistenceHosts[0]); err != nil {
+			return
+		}
+	} else if addr == "" {
+		if dataNode, err = c.getDataNode(dp.PersistenceHosts[0]); err != nil {
+			return
+		}
+		if rack, err = c.t.getRack(dataNode.RackName); err != nil {
+			return
+		}
+		if newHosts, err = rack.getAvailDataNodeHosts(excludeHosts, 1); err != nil {
+			return
+		}
+		addr = newHosts[0]
+	} else {
+		if _, err = c.getDataNode(addr); err != nil {
+			return
+		}
+		if dp.isInPersistenceHosts(addr) || dp.isInWarmHosts(addr) {
+			err = hasExist(fmt.Sprintf("partitionID[%v] replica on %v", dp.PartitionID, addr))
+			return
+		}
+	}
+	orgWarmHosts := dp.WarmHosts
+	dp.WarmHosts = make([]string, 0, len(orgWarmHosts)+1)
+	dp.WarmHosts = append(dp.WarmHosts, orgWarmHosts...)
+	dp.WarmHosts = append(dp.WarmHosts, addr)
+	if err = c.syncUpdateDataPartition(volName, dp); err != nil {
+		dp.WarmHosts = orgWarmHosts
+		return
+	}
+	c.putDataNodeTasks([]*proto.AdminTask{dp.generateCreateTask(addr)})
+	warmAddr = addr
+	log.LogInfof("action[addWarmReplica] vol[%v] partitionID:%v add warm replica on Node:%v, WarmHosts:%v",
+		volName, dp.PartitionID, addr, dp.WarmHosts)
+	return
+}
+
 func (c *Cluster) metaNodeOffLine(metaNode *MetaNode) {
 	msg := fmt.Sprintf("action[metaNodeOffLine],clusterID[%v] Node[%v] OffLine", c.Name, metaNode.Addr)
 	log.LogWarn(msg)
@@ -595,9 +1146,9 @@ func (c *Cluster) delMetaNodeFromCache(metaNode *MetaNode) {
 	go metaNode.clean()
 }
 
-func (c *Cluster) createVol(name, volType string, replicaNum uint8) (err error) {
+func (c *Cluster) createVol(name, volType string, replicaNum uint8, replication string) (err error) {
 	var vol *Vol
-	if vol, err = c.createVolInternal(name, volType, replicaNum); err != nil {
+	if vol, err = c.createVolInternal(name, volType, replicaNum, replication); err != nil {
 		goto errDeal
 	}
 
@@ -617,12 +1168,13 @@ errDeal:
 	return
 }
 
-func (c *Cluster) createVolInternal(name, volType string, replicaNum uint8) (vol *Vol, err error) {
+func (c *Cluster) createVolInternal(name, volType string, replicaNum uint8, replication string) (vol *Vol, err error) {
 	if _, err = c.getVol(name); err == nil {
 		err = hasExist(name)
 		goto errDeal
 	}
 	vol = NewVol(name, volType, replicaNum)
+	vol.Replication = replication
 	if err = c.syncAddVol(vol); err != nil {
 		goto errDeal
 	}
@@ -675,7 +1227,7 @@ func (c *Cluster) CreateMetaPartition(volName string, start, end uint64) (err er
 		return errors.Annotatef(err, "get vol [%v] err", volName)
 	}
 
-	if hosts, peers, err = c.ChooseTargetMetaHosts(int(vol.mpReplicaNum)); err != nil {
+	if hosts, peers, err = c.ChooseTargetMetaHosts(int(vol.mpReplicaNum), c.getMetaExcludeHosts(vol)); err != nil {
 		return errors.Trace(err)
 	}
 	log.LogInfof("target meta hosts:%v,peers:%v", hosts, peers)
@@ -703,7 +1255,8 @@ func (c *Cluster) hasEnoughWritableMetaHosts(replicaNum int) bool {
 	return false
 }
 
-func (c *Cluster) ChooseTargetMetaHosts(replicaNum int) (hosts []string, peers []proto.Peer, err error) {
+/*choose the hosts of the meta partition out of the meta nodes not in excludeHosts*/
+func (c *Cluster) ChooseTargetMetaHosts(replicaNum int, excludeHosts []string) (hosts []string, peers []proto.Peer, err error) {
 	var (
 		masterAddr []string
 		slaveAddrs []string
@@ -711,7 +1264,7 @@ func (c *Cluster) ChooseTargetMetaHosts(replicaNum int) (hosts []string, peers [
 		slavePeers []proto.Peer
 	)
 	hosts = make([]string, 0)
-	if masterAddr, masterPeer, err = c.getAvailMetaNodeHosts(hosts, 1); err != nil {
+	if masterAddr, masterPeer, err = c.getAvailMetaNodeHosts(excludeHosts, 1); err != nil {
 		return nil, nil, errors.Trace(err)
 	}
 	peers = append(peers, masterPeer...)
@@ -720,7 +1273,7 @@ func (c *Cluster) ChooseTargetMetaHosts(replicaNum int) (hosts []string, peers [
 	if otherReplica == 0 {
 		return
 	}
-	if slaveAddrs, slavePeers, err = c.getAvailMetaNodeHosts(hosts, otherReplica); err != nil {
+	if slaveAddrs, slavePeers, err = c.getAvailMetaNodeHosts(append(hosts, excludeHosts...), otherReplica); err != nil {
 		return nil, nil, errors.Trace(err)
 	}
 	hosts = append(hosts, slaveAddrs...)
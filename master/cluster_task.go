@@ -107,7 +107,7 @@ func (c *Cluster) metaPartitionOffline(volName, nodeAddr string, partitionID uin
 		goto errDeal
 	}
 
-	if newHosts, newPeers, err = c.getAvailMetaNodeHosts(mp.PersistenceHosts, 1); err != nil {
+	if newHosts, newPeers, err = c.getAvailMetaNodeHosts(append(c.getMetaExcludeHosts(vol), mp.PersistenceHosts...), 1); err != nil {
 		goto errDeal
 	}
 
@@ -155,6 +155,9 @@ func (c *Cluster) processLoadMetaPartition(mp *MetaPartition) {
 }
 
 func (c *Cluster) processLoadDataPartition(dp *DataPartition) {
+	if dp.getArchiveStatus() != "" {
+		return
+	}
 	log.LogInfo(fmt.Sprintf("action[processLoadDataPartition],partitionID:%v", dp.PartitionID))
 	loadTasks := dp.generateLoadTasks()
 	c.putDataNodeTasks(loadTasks)
@@ -229,8 +232,8 @@ errDeal:
 func (c *Cluster) dealOfflineMetaPartitionResp(nodeAddr string, resp *proto.MetaPartitionOfflineResponse) (err error) {
 	if resp.Status == proto.TaskFail {
 		msg := fmt.Sprintf("action[dealOfflineMetaPartitionResp],clusterID[%v] nodeAddr %v "+
-			"offline meta partition[%v] failed,err %v",
-			c.Name, nodeAddr, resp.PartitionID, resp.Result)
+			"offline meta partition[%v] failed,err %v code %v",
+			c.Name, nodeAddr, resp.PartitionID, resp.Result, resp.ErrCode)
 		log.LogError(msg)
 		Warn(c.Name, msg)
 		return
@@ -244,8 +247,8 @@ func (c *Cluster) dealLoadMetaPartitionResp(nodeAddr string, resp *proto.LoadMet
 
 func (c *Cluster) dealUpdateMetaPartitionResp(nodeAddr string, resp *proto.UpdateMetaPartitionResponse) (err error) {
 	if resp.Status == proto.TaskFail {
-		msg := fmt.Sprintf("action[dealUpdateMetaPartitionResp],clusterID[%v] nodeAddr %v update meta partition failed,err %v",
-			c.Name, nodeAddr, resp.Result)
+		msg := fmt.Sprintf("action[dealUpdateMetaPartitionResp],clusterID[%v] nodeAddr %v update meta partition failed,err %v code %v",
+			c.Name, nodeAddr, resp.Result, resp.ErrCode)
 		log.LogError(msg)
 		Warn(c.Name, msg)
 	}
@@ -255,7 +258,7 @@ func (c *Cluster) dealUpdateMetaPartitionResp(nodeAddr string, resp *proto.Updat
 func (c *Cluster) dealDeleteMetaPartitionResp(nodeAddr string, resp *proto.DeleteMetaPartitionResponse) (err error) {
 	if resp.Status == proto.TaskFail {
 		msg := fmt.Sprintf("action[dealDeleteMetaPartitionResp],clusterID[%v] nodeAddr %v "+
-			"delete meta partition failed,err %v", c.Name, nodeAddr, resp.Result)
+			"delete meta partition failed,err %v code %v", c.Name, nodeAddr, resp.Result, resp.ErrCode)
 		log.LogError(msg)
 		Warn(c.Name, msg)
 		return
@@ -281,8 +284,8 @@ errDeal:
 func (c *Cluster) dealCreateMetaPartitionResp(nodeAddr string, resp *proto.CreateMetaPartitionResponse) (err error) {
 	log.LogInfof("action[dealCreateMetaPartitionResp] receive resp from nodeAddr[%v] pid[%v]", nodeAddr, resp.PartitionID)
 	if resp.Status == proto.TaskFail {
-		msg := fmt.Sprintf("action[dealCreateMetaPartitionResp],clusterID[%v] nodeAddr %v create meta partition failed,err %v",
-			c.Name, nodeAddr, resp.Result)
+		msg := fmt.Sprintf("action[dealCreateMetaPartitionResp],clusterID[%v] nodeAddr %v create meta partition failed,err %v code %v",
+			c.Name, nodeAddr, resp.Result, resp.ErrCode)
 		log.LogError(msg)
 		Warn(c.Name, msg)
 		return
@@ -324,8 +327,8 @@ func (c *Cluster) dealMetaNodeHeartbeatResp(nodeAddr string, resp *proto.MetaNod
 	)
 	log.LogInfof("action[dealMetaNodeHeartbeatResp],clusterID[%v] receive nodeAddr[%v] heartbeat", c.Name, nodeAddr)
 	if resp.Status == proto.TaskFail {
-		msg := fmt.Sprintf("action[dealMetaNodeHeartbeatResp],clusterID[%v] nodeAddr %v heartbeat failed,err %v",
-			c.Name, nodeAddr, resp.Result)
+		msg := fmt.Sprintf("action[dealMetaNodeHeartbeatResp],clusterID[%v] nodeAddr %v heartbeat failed,err %v code %v",
+			c.Name, nodeAddr, resp.Result, resp.ErrCode)
 		log.LogError(msg)
 		Warn(c.Name, msg)
 		return
@@ -335,10 +338,12 @@ func (c *Cluster) dealMetaNodeHeartbeatResp(nodeAddr string, resp *proto.MetaNod
 		goto errDeal
 	}
 
+	c.checkClockSkew(nodeAddr, metaNode.getClockOffset(), resp.ClockOffset)
 	metaNode.updateMetric(resp, c.cfg.MetaNodeThreshold)
 	metaNode.setNodeAlive()
 	c.UpdateMetaNode(metaNode, resp.MetaPartitionInfo, metaNode.isArriveThreshold())
 	metaNode.metaPartitionInfos = nil
+	c.lifecycle.update(resp.Lifecycle)
 	logMsg = fmt.Sprintf("action[dealMetaNodeHeartbeatResp],metaNode:%v ReportTime:%v  success", metaNode.Addr, time.Now().Unix())
 	log.LogInfof(logMsg)
 	return
@@ -377,6 +382,30 @@ func (c *Cluster) dealDataNodeTaskResponse(nodeAddr string, task *proto.AdminTas
 	case proto.OpLoadDataPartition:
 		response := task.Response.(*proto.LoadDataPartitionResponse)
 		err = c.dealLoadDataPartitionResponse(task.OperatorAddr, response)
+	case proto.OpArchiveDataPartition:
+		response := task.Response.(*proto.ArchiveDataPartitionResponse)
+		err = c.dealArchiveResponse(task.OperatorAddr, response.PartitionId, ArchiveStatusArchiving, response.Status, response.Result)
+	case proto.OpRehydrateDataPartition:
+		response := task.Response.(*proto.RehydrateDataPartitionResponse)
+		err = c.dealArchiveResponse(task.OperatorAddr, response.PartitionId, ArchiveStatusRehydrating, response.Status, response.Result)
+	case proto.OpEncodeDataPartition:
+		response := task.Response.(*proto.EncodeDataPartitionResponse)
+		err = c.dealEncodeResponse(task.OperatorAddr, response)
+	case proto.OpMoveDataPartition:
+		response := task.Response.(*proto.MoveDataPartitionResponse)
+		err = c.dealMoveDataPartitionResponse(task.OperatorAddr, response)
+	case proto.OpOfflineDataPartition:
+		response := task.Response.(*proto.DataPartitionOfflineResponse)
+		err = c.dealOfflineDataPartitionResponse(task.OperatorAddr, response)
+	case proto.OpRepairDataPartition:
+		response := task.Response.(*proto.RepairDataPartitionResponse)
+		err = c.dealRepairDataPartitionResponse(task.OperatorAddr, response)
+	case proto.OpVerifyDataPartition:
+		response := task.Response.(*proto.VerifyDataPartitionResponse)
+		err = c.dealVerifyDataPartitionResponse(task.OperatorAddr, response)
+	case proto.OpTierExtents:
+		response := task.Response.(*proto.TierExtentsResponse)
+		err = c.dealTierExtentsResponse(task.OperatorAddr, response)
 	case proto.OpDataNodeHeartbeat:
 		response := task.Response.(*proto.DataNodeHeartBeatResponse)
 		err = c.dealDataNodeHeartbeatResp(task.OperatorAddr, response)
@@ -436,7 +465,7 @@ errDeal:
 
 func (c *Cluster) createDataPartitionFailTriggerOperator(t *proto.AdminTask, resp *proto.CreateDataPartitionResponse) (err error) {
 	msg := fmt.Sprintf("action[createDataPartitionFailTriggerOperator],taskID:%v, partitionID:%v on :%v  "+
-		"Fail And TrigerChangeOpAddr Fail:%v ", t.ID, resp.PartitionId, t.OperatorAddr, err)
+		"Fail And TrigerChangeOpAddr Fail:%v result:%v code:%v", t.ID, resp.PartitionId, t.OperatorAddr, err, resp.Result, resp.ErrCode)
 	log.LogWarn(msg)
 	return
 }
@@ -454,7 +483,7 @@ func (c *Cluster) dealDeleteDataPartitionResponse(nodeAddr string, resp *proto.D
 		dp.offLineInMem(nodeAddr)
 
 	} else {
-		Warn(c.Name, fmt.Sprintf("clusterID[%v] delete data partition[%v] failed,err[%v]", c.Name, nodeAddr, resp.Result))
+		Warn(c.Name, fmt.Sprintf("clusterID[%v] delete data partition[%v] failed,err[%v] code[%v]", c.Name, nodeAddr, resp.Result, resp.ErrCode))
 	}
 
 	return
@@ -502,10 +531,19 @@ func (c *Cluster) dealDataNodeHeartbeatResp(nodeAddr string, resp *proto.DataNod
 		c.t.putDataNode(dataNode)
 	}
 
+	c.checkClockSkew(nodeAddr, dataNode.getClockOffset(), resp.ClockOffset)
+	// the replicas on a failed disk are reported unavailable and offlined by the
+	// check of the partitions, the other disks of the node keep their replicas
+	for _, d := range dataNode.getNewBadDisks(resp.Disks) {
+		msg := fmt.Sprintf("clusterID[%v] dataNode[%v] disk[%v] unavailable: %v, its replicas are rebuilt",
+			c.Name, nodeAddr, d.Path, d.Reason)
+		Warn(c.Name, msg)
+		c.notify(NotifyDiskFailure, nodeAddr+":"+d.Path, msg)
+	}
 	dataNode.UpdateNodeMetric(resp)
 	dataNode.setNodeAlive()
 	c.t.putDataNode(dataNode)
-	c.UpdateDataNode(dataNode, resp.PartitionInfo)
+	c.UpdateDataNode(dataNode, dataNode.dataPartitionInfos)
 	dataNode.dataPartitionInfos = nil
 	logMsg = fmt.Sprintf("action[dealDataNodeHeartbeatResp],dataNode:%v ReportTime:%v  success", dataNode.Addr, time.Now().Unix())
 	log.LogInfof(logMsg)
@@ -585,3 +623,13 @@ func (c *Cluster) updateEnd(mp *MetaPartition, mr *proto.MetaPartitionReport, th
 		mp.UpdateEnd(c, end)
 	}
 }
+
+/*warn once when the clock of the node becomes skewed or synchronized again*/
+func (c *Cluster) checkClockSkew(nodeAddr string, oldOffset, offset int64) {
+	if isClockSkewed(offset) && !isClockSkewed(oldOffset) {
+		Warn(c.Name, fmt.Sprintf("clusterID[%v] node[%v] clock offset[%vs] exceeds [%vs], no new partitions are placed on it",
+			c.Name, nodeAddr, offset, DefaultMaxClockSkewSec))
+	} else if !isClockSkewed(offset) && isClockSkewed(oldOffset) {
+		log.LogWarnf("action[checkClockSkew] clusterID[%v] node[%v] clock offset[%vs] synchronized", c.Name, nodeAddr, offset)
+	}
+}
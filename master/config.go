@@ -17,9 +17,11 @@ package master
 import (
 	"fmt"
 	"github.com/tiglabs/containerfs/raftstore"
+	"github.com/tiglabs/containerfs/util"
 	"github.com/tiglabs/raft/proto"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -31,6 +33,17 @@ const (
 	EveryLoadDataPartitionCount = "everyLoadDataPartitionCount"
 	FileDelayCheckCrc           = "fileDelayCheckCrc"
 	ReplicaNum                  = "replicaNum"
+	UsageReportIntervalHours    = "usageReportIntervalHours"
+	ArchiveTarget               = "archiveTarget"
+	KmsAddr                     = "kmsAddr"
+	FollowerReadLeaseSec        = "followerReadLeaseSec"
+	NotifyRoutes                = "notifyRoutes"
+	NotifyDedupMinutes          = "notifyDedupMinutes"
+	NotifyRepairBacklogCount    = "notifyRepairBacklog"
+	NotifySMTPAddr              = "notifySmtpAddr"
+	NotifySMTPFrom              = "notifySmtpFrom"
+	NotifySMTPUser              = "notifySmtpUser"
+	NotifySMTPPassword          = "notifySmtpPassword"
 )
 
 const (
@@ -54,6 +67,7 @@ const (
 	DefaultMetaPartitionWarnInterval            = 10 * 60
 	DefaultMetaPartitionThreshold       float32 = 0.75
 	DefaultMetaPartitionCountOnEachNode         = 100
+	DefaultMaxClockSkewSec                      = 10
 )
 
 //AddrDatabase ...
@@ -73,6 +87,14 @@ type ClusterConfig struct {
 	everyLoadDataPartitionCount          int
 	replicaNum                           int
 	MetaNodeThreshold                    float32
+	usageReportInterval                  int64
+	archiveTarget                        string //url prefix of the S3 compatible bucket the archived partitions are exported to
+	kmsAddr                              string //address of the kms keeping the keys of the encrypted vols, the master keeps them if empty
+	readLeaseSeconds                     int64  //lease of the follower reads, not positive disables them
+	notifyRoutes                         []*NotifyRoute
+	notifyDedup                          time.Duration
+	notifyRepairBacklog                  int //not positive disables the notifications of the repair backlog
+	notifySMTP                           SMTPConfig
 
 	peers     []raftstore.PeerAddress
 	peerAddrs []string
@@ -92,20 +114,30 @@ func NewClusterConfig() (cfg *ClusterConfig) {
 	cfg.everyLoadDataPartitionCount = DefaultEveryLoadDataPartitionCount
 	cfg.LoadDataPartitionFrequencyTime = DefaultLoadDataPartitionFrequencyTime
 	cfg.MetaNodeThreshold = DefaultMetaPartitionThreshold
+	cfg.usageReportInterval = DefaultUsageReportIntervalHours * 3600
+	cfg.readLeaseSeconds = DefaultReadLeaseSeconds
+	cfg.notifyDedup = DefaultNotifyDedupMinutes * time.Minute
+	cfg.notifyRepairBacklog = DefaultNotifyRepairBacklog
 	return
 }
 
 func parsePeerAddr(peerAddr string) (id uint64, ip string, port uint64, err error) {
-	peerStr := strings.Split(peerAddr, ColonSplit)
-	id, err = strconv.ParseUint(peerStr[0], 10, 64)
+	// Format "ID:IP:PORT", an IPv6 ip is enclosed in square brackets.
+	first := strings.Index(peerAddr, ColonSplit)
+	last := strings.LastIndex(peerAddr, ColonSplit)
+	if first < 0 || first == last {
+		err = fmt.Errorf("peer address(%v) is invalid", peerAddr)
+		return
+	}
+	id, err = strconv.ParseUint(peerAddr[:first], 10, 64)
 	if err != nil {
 		return
 	}
-	port, err = strconv.ParseUint(peerStr[2], 10, 64)
+	port, err = strconv.ParseUint(peerAddr[last+1:], 10, 64)
 	if err != nil {
 		return
 	}
-	ip = peerStr[1]
+	ip = strings.Trim(peerAddr[first+1:last], "[]")
 	return
 }
 
@@ -118,8 +150,7 @@ func (cfg *ClusterConfig) parsePeers(peerStr string) error {
 			return err
 		}
 		cfg.peers = append(cfg.peers, raftstore.PeerAddress{Peer: proto.Peer{ID: id}, Address: ip})
-		address := fmt.Sprintf("%v:%v", ip, port)
-		fmt.Println(address)
+		address := util.JoinHostPort(ip, port)
 		AddrDatabase[id] = address
 	}
 	return nil
@@ -24,6 +24,31 @@ const (
 	ParaStart             = "start"
 	ParaEnable            = "enable"
 	ParaThreshold         = "threshold"
+	ParaClientAddr        = "clientAddr"
+	ParaReplicaAddr       = "replicaAddr"
+	ParaFenceTime         = "fenceTime"
+	ParaCapacity          = "capacity"
+	ParaDryRun            = "dryRun"
+	ParaTime              = "time"
+	ParaFormat            = "format"
+	ParaToken             = "token"
+	ParaTokenType         = "type"
+	ParaMaxFileSize       = "maxFileSize"
+	ParaMaxFiles          = "maxFiles"
+	ParaSealed            = "sealed"
+	ParaCompression       = "compression"
+	ParaDays              = "days"
+	ParaPrefix            = "prefix"
+	ParaAction            = "action"
+	ParaDisk              = "disk"
+	ParaDegradedWrite     = "degradedWrite"
+	ParaReplication       = "replication"
+	ParaRack              = "rack"
+	ParaZone              = "zone"
+	ParaRacks             = "racks"
+	ParaFailureDomain     = "failureDomain"
+	ParaMemClass          = "memClass"
+	ParaMetaNodes         = "metaNodes"
 )
 
 const (
@@ -60,3 +85,10 @@ const (
 	VolNormal     uint8 = 0
 	VolMarkDelete uint8 = 1
 )
+
+// the writes to a vol while some of its data partitions are below the replica count
+const (
+	DegradedWriteHealthy  = "healthy"  //the degraded partitions are read only, the new extents go to the healthy ones
+	DegradedWriteBackfill = "backfill" //the degraded partitions are written on their live replicas, the others are repaired once back
+	DegradedWriteBlock    = "block"    //all the partitions of the vol are read only until the degraded ones are restored
+)
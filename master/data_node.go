@@ -35,8 +35,16 @@ type DataNode struct {
 	Total                     uint64 `json:"TotalWeight"`
 	Used                      uint64 `json:"UsedWeight"`
 	Available                 uint64
+	Reclaimable               uint64
+	ProjectedUsed             uint64
 	RackName                  string `json:"Rack"`
+	ZoneName                  string `json:"Zone,omitempty"` //zone label of the node, the zone of its rack if empty
+	ID                        uint64 //raft node id of the raft replicated partitions, shared with the meta nodes
 	Addr                      string
+	ClientAddr                string
+	ReplicaAddr               string
+	RaftHeartbeatPort         int `json:",omitempty"` //raft ports reported by the node, the ones of the cluster if 0
+	RaftReplicatePort         int `json:",omitempty"`
 	ReportTime                time.Time
 	isActive                  bool
 	sync.RWMutex
@@ -46,6 +54,13 @@ type DataNode struct {
 	Sender             *AdminTaskSender
 	dataPartitionInfos []*proto.PartitionReport
 	DataPartitionCount uint32
+	reportEpoch        uint64                            //epoch of the full partition report held
+	reportSeq          uint64                            //seq of the last report merged, acked in the next heartbeat
+	partitionReports   map[uint64]*proto.PartitionReport //partition reports merged from full and delta heartbeats
+	disks              []*proto.DiskReport
+	ClockOffset        int64 //seconds the node clock ahead of the master
+	Draining           bool  //the node is decommissioned, it gets no new replicas
+	BadDisks           []string
 }
 
 func NewDataNode(addr, clusterID string) (dataNode *DataNode) {
@@ -53,15 +68,19 @@ func NewDataNode(addr, clusterID string) (dataNode *DataNode) {
 	dataNode.Carry = rand.Float64()
 	dataNode.Total = 1
 	dataNode.Addr = addr
+	dataNode.ClientAddr = addr
+	dataNode.ReplicaAddr = addr
+	dataNode.partitionReports = make(map[uint64]*proto.PartitionReport)
 	dataNode.Sender = NewAdminTaskSender(dataNode.Addr, clusterID)
 	return
 }
 
-/*check node heartbeat if reportTime > DataNodeTimeOut,then IsActive is false*/
-func (dataNode *DataNode) checkHeartBeat() {
+/*check node heartbeat if reportTime > DataNodeTimeOut,then IsActive is false, down is true if the node was active*/
+func (dataNode *DataNode) checkHeartBeat() (down bool) {
 	dataNode.Lock()
 	defer dataNode.Unlock()
 	if time.Since(dataNode.ReportTime) > time.Second*time.Duration(DefaultNodeTimeOutSec) {
+		down = dataNode.isActive
 		dataNode.isActive = false
 	}
 
@@ -85,25 +104,131 @@ func (dataNode *DataNode) UpdateNodeMetric(resp *proto.DataNodeHeartBeatResponse
 	dataNode.Total = resp.Total
 	dataNode.Used = resp.Used
 	dataNode.Available = resp.Available
+	dataNode.Reclaimable = resp.Reclaimable
+	dataNode.ProjectedUsed = resp.ProjectedUsed
+	if dataNode.ProjectedUsed == 0 || dataNode.ProjectedUsed > dataNode.Used {
+		dataNode.ProjectedUsed = dataNode.Used
+	}
 	dataNode.RackName = resp.RackName
+	dataNode.ZoneName = resp.ZoneName
+	if resp.ClientAddr != "" {
+		dataNode.ClientAddr = resp.ClientAddr
+	}
+	if resp.ReplicaAddr != "" {
+		dataNode.ReplicaAddr = resp.ReplicaAddr
+	}
+	dataNode.RaftHeartbeatPort = resp.RaftHeartbeatPort
+	dataNode.RaftReplicatePort = resp.RaftReplicatePort
 	dataNode.DataPartitionCount = resp.CreatedPartitionCnt
-	dataNode.dataPartitionInfos = resp.PartitionInfo
+	dataNode.dataPartitionInfos = dataNode.mergePartitionReports(resp)
+	if resp.Disks != nil {
+		dataNode.disks = resp.Disks
+		dataNode.BadDisks = make([]string, 0)
+		for _, d := range resp.Disks {
+			if d.Status == proto.Unavaliable {
+				dataNode.BadDisks = append(dataNode.BadDisks, d.Path)
+			}
+		}
+	}
+	dataNode.ClockOffset = resp.ClockOffset
 	dataNode.Ratio = (float64)(dataNode.Used) / (float64)(dataNode.Total)
 	dataNode.ReportTime = time.Now()
 }
 
+/*the disks of the heartbeat unavailable since the last one*/
+func (dataNode *DataNode) getNewBadDisks(disks []*proto.DiskReport) (bad []*proto.DiskReport) {
+	dataNode.RLock()
+	defer dataNode.RUnlock()
+	bad = make([]*proto.DiskReport, 0)
+	for _, d := range disks {
+		if d.Status == proto.Unavaliable && !contains(dataNode.BadDisks, d.Path) {
+			bad = append(bad, d)
+		}
+	}
+	return
+}
+
+/*merge the partition reports of heartbeat into the reports held,return all reports of node*/
+func (dataNode *DataNode) mergePartitionReports(resp *proto.DataNodeHeartBeatResponse) (reports []*proto.PartitionReport) {
+	if !resp.IsDelta {
+		dataNode.partitionReports = make(map[uint64]*proto.PartitionReport)
+		dataNode.reportEpoch = resp.ReportEpoch
+		dataNode.reportSeq = resp.ReportSeq
+	} else if resp.ReportEpoch != dataNode.reportEpoch {
+		//the delta is not based on the reports held,ask the node for a full report next time
+		dataNode.reportEpoch = 0
+		dataNode.reportSeq = 0
+	} else {
+		dataNode.reportSeq = resp.ReportSeq
+	}
+	for _, id := range resp.RemovedPartitions {
+		delete(dataNode.partitionReports, id)
+	}
+	for _, vr := range resp.PartitionInfo {
+		if vr == nil {
+			continue
+		}
+		dataNode.partitionReports[vr.PartitionID] = vr
+	}
+	reports = make([]*proto.PartitionReport, 0, len(dataNode.partitionReports))
+	for _, vr := range dataNode.partitionReports {
+		reports = append(reports, vr)
+	}
+	return
+}
+
+/*the labels registered by the node, the heartbeats report them again*/
+func (dataNode *DataNode) setLabels(rack, zone string) {
+	dataNode.Lock()
+	defer dataNode.Unlock()
+	if rack != "" {
+		dataNode.RackName = rack
+	}
+	dataNode.ZoneName = zone
+}
+
+func (dataNode *DataNode) setAdvertisedAddrs(clientAddr, replicaAddr string) {
+	dataNode.Lock()
+	defer dataNode.Unlock()
+	dataNode.ClientAddr = clientAddr
+	dataNode.ReplicaAddr = replicaAddr
+}
+
+/*return client facing address of node,if node not advertise it,return node addr*/
+func (dataNode *DataNode) getZone() (zone string) {
+	dataNode.RLock()
+	defer dataNode.RUnlock()
+	return dataNode.ZoneName
+}
+
+func (dataNode *DataNode) getClientAddr() (addr string) {
+	dataNode.RLock()
+	defer dataNode.RUnlock()
+	if addr = dataNode.ClientAddr; addr == "" {
+		addr = dataNode.Addr
+	}
+	return
+}
+
 func (dataNode *DataNode) IsWriteAble() (ok bool) {
 	dataNode.RLock()
 	defer dataNode.RUnlock()
 
 	if dataNode.isActive == true && dataNode.MaxDiskAvailWeight > (uint64)(util.DefaultDataPartitionSize) &&
-		dataNode.Total-dataNode.Used > (uint64)(util.DefaultDataPartitionSize)*ReservedVolCount {
+		dataNode.Total-dataNode.ProjectedUsed > (uint64)(util.DefaultDataPartitionSize)*ReservedVolCount &&
+		!isClockSkewed(dataNode.ClockOffset) && !dataNode.Draining {
 		ok = true
 	}
 
 	return
 }
 
+func (dataNode *DataNode) getRemainWeight() uint64 {
+	dataNode.RLock()
+	defer dataNode.RUnlock()
+	return dataNode.RemainWeightsForCreateVol
+}
+
 func (dataNode *DataNode) IsAvailCarryNode() (ok bool) {
 	dataNode.RLock()
 	defer dataNode.RUnlock()
@@ -123,6 +248,7 @@ func (dataNode *DataNode) SelectNodeForWrite() {
 	dataNode.Ratio = float64(dataNode.Used) / float64(dataNode.Total)
 	dataNode.SelectCount++
 	dataNode.Used += (uint64)(util.DefaultDataPartitionSize)
+	dataNode.ProjectedUsed += (uint64)(util.DefaultDataPartitionSize)
 	dataNode.Carry = dataNode.Carry - 1.0
 }
 
@@ -133,15 +259,57 @@ func (dataNode *DataNode) clean() {
 	dataNode.Sender.exitCh <- struct{}{}
 }
 
-func (dataNode *DataNode) generateHeartbeatTask(masterAddr string) (task *proto.AdminTask) {
+/*the latest reports of the partitions of the node, by partition id*/
+func (dataNode *DataNode) getPartitionReports() (reports map[uint64]*proto.PartitionReport) {
+	dataNode.RLock()
+	defer dataNode.RUnlock()
+	reports = make(map[uint64]*proto.PartitionReport, len(dataNode.partitionReports))
+	for id, vr := range dataNode.partitionReports {
+		reports[id] = vr
+	}
+	return
+}
+
+func (dataNode *DataNode) generateHeartbeatTask(masterAddr string, partitionEpochs map[uint64]uint64, sealedPartitions map[uint64]bool,
+	unsealedPartitions []uint64, fences []*proto.ClientFence, volTokens map[string][]*proto.TokenDigest, volCompression map[string]string,
+	volKeys map[string]*proto.VolKey, volColdTierDays map[string]int, volReadOnly map[string]bool) (task *proto.AdminTask) {
+	dataNode.RLock()
+	reportEpoch, reportSeq := dataNode.reportEpoch, dataNode.reportSeq
+	draining := dataNode.Draining
+	dataNode.RUnlock()
 	request := &proto.HeartBeatRequest{
-		CurrTime:   time.Now().Unix(),
-		MasterAddr: masterAddr,
+		CurrTime:           time.Now().Unix(),
+		MasterAddr:         masterAddr,
+		Capabilities:       proto.CapDeltaHeartbeat | proto.CapChangedEpochs,
+		ReportEpoch:        reportEpoch,
+		ReportSeq:          reportSeq,
+		PartitionEpochs:    partitionEpochs,
+		SealedPartitions:   sealedPartitions,
+		UnsealedPartitions: unsealedPartitions,
+		FencedClients:      fencesInNodeClock(fences, dataNode.getClockOffset()),
+		Draining:           draining,
+		VolTokens:          volTokens,
+		VolCompression:     volCompression,
+		VolKeys:            volKeys,
+		VolColdTierDays:    volColdTierDays,
+		VolReadOnly:        volReadOnly,
 	}
 	task = proto.NewAdminTask(proto.OpDataNodeHeartbeat, dataNode.Addr, request)
 	return
 }
 
+func (dataNode *DataNode) setDraining(draining bool) {
+	dataNode.Lock()
+	defer dataNode.Unlock()
+	dataNode.Draining = draining
+}
+
+func (dataNode *DataNode) getClockOffset() int64 {
+	dataNode.RLock()
+	defer dataNode.RUnlock()
+	return dataNode.ClockOffset
+}
+
 func (dataNode *DataNode) toJson() (body []byte, err error) {
 	dataNode.RLock()
 	defer dataNode.RUnlock()
@@ -35,12 +35,29 @@ type DataPartition struct {
 	Replicas         []*DataReplica
 	PartitionType    string
 	PersistenceHosts []string
+	Epoch            uint64   //increased whenever PersistenceHosts changed
+	WarmHosts        []string //non-voting replicas, promoted to PersistenceHosts on replica loss
 	sync.RWMutex
-	total         uint64
-	used          uint64
-	FileInCoreMap map[string]*FileInCore
-	MissNodes     map[string]int64
-	VolName       string
+	total           uint64
+	used            uint64
+	FileInCoreMap   map[string]*FileInCore
+	MissNodes       map[string]int64
+	VolName         string
+	warmUsed        map[string]uint64 //used reported by the warm replicas
+	ArchiveStatus   string            //archiving, archived or rehydrating, empty if the partition is active
+	ArchiveTarget   string            //the url the files are exported to, empty if they are kept on the data nodes
+	archiveProgress map[string]uint8  //task status of the hosts in the current archive step
+	Sealed          bool              //the replicas refuse new extents, set for append-once workloads
+	Releasing       bool              //read only and deleted once the files are migrated off, set by the shrink of vol
+	EncryptKeyId    string            //id of the key of vol encrypting the replicas, empty if not encrypted
+	degraded        bool              //fewer live replicas than ReplicaNum at the last check
+	lost            bool              //no live replica at the last check
+	writeHosts      []string          //the live hosts taking the writes of a degraded partition, nil if not degraded
+	Replication     string            //raft, or empty for the replication chain
+	Peers           []proto.Peer      //members of the raft group of a raft replicated partition
+	ShardHosts      []string          //the hosts of the shards of an erasure coded partition by the shard index
+	EncodeStep      string            //prepare, encode or commit while the partition is encoded, empty otherwise
+	encodeProgress  map[string]uint8  //task status of the hosts in the current encode step
 }
 
 func newDataPartition(ID uint64, replicaNum uint8, partitionType, volName string) (partition *DataPartition) {
@@ -49,9 +66,12 @@ func newDataPartition(ID uint64, replicaNum uint8, partitionType, volName string
 	partition.PartitionID = ID
 	partition.PartitionType = partitionType
 	partition.PersistenceHosts = make([]string, 0)
+	partition.WarmHosts = make([]string, 0)
 	partition.Replicas = make([]*DataReplica, 0)
 	partition.FileInCoreMap = make(map[string]*FileInCore, 0)
 	partition.MissNodes = make(map[string]int64)
+	partition.archiveProgress = make(map[string]uint8)
+	partition.encodeProgress = make(map[string]uint8)
 	partition.Status = proto.ReadOnly
 	partition.VolName = volName
 	return
@@ -75,7 +95,13 @@ func (partition *DataPartition) GenerateCreateTasks() (tasks []*proto.AdminTask)
 }
 
 func (partition *DataPartition) generateCreateTask(addr string) (task *proto.AdminTask) {
-	task = proto.NewAdminTask(proto.OpCreateDataPartition, addr, newCreateDataPartitionRequest(partition.PartitionType, partition.VolName, partition.PartitionID))
+	request := newCreateDataPartitionRequest(partition.PartitionType, partition.VolName, partition.PartitionID)
+	request.Epoch = partition.Epoch
+	request.EncryptKeyId = partition.EncryptKeyId
+	request.ReplicationMode = partition.Replication
+	request.Peers = partition.Peers
+	request.ShardHosts = partition.ShardHosts
+	task = proto.NewAdminTask(proto.OpCreateDataPartition, addr, request)
 	partition.resetTaskID(task)
 	return
 }
@@ -100,11 +126,24 @@ func (partition *DataPartition) hasMissOne(replicaNum int) (err error) {
 	return
 }
 
+/*the replicas of the ec partition are its shards, the vol keeps the number of the other ones*/
+func (partition *DataPartition) getReplicaNum(vol *Vol) int {
+	if partition.PartitionType == proto.ErasureCodePartition {
+		return int(partition.ReplicaNum)
+	}
+	return int(vol.dpReplicaNum)
+}
+
 func (partition *DataPartition) canOffLine(offlineAddr string) (err error) {
 	msg := fmt.Sprintf("action[canOffLine],partitionID:%v  RocksDBHost:%v  offLine:%v ",
 		partition.PartitionID, partition.PersistenceHosts, offlineAddr)
 	liveReplicas := partition.getLiveReplicas(DefaultDataPartitionTimeOutSec)
-	if len(liveReplicas) < 2 {
+	minLive := 2
+	if partition.PartitionType == proto.ErasureCodePartition {
+		// the shard of the offline host is rebuilt from the data shards of the others
+		minLive = proto.ECDataShards
+	}
+	if len(liveReplicas) < minLive {
 		msg = fmt.Sprintf(msg+" err:%v  liveReplicas:%v ", CannotOffLineErr, len(liveReplicas))
 		log.LogError(msg)
 		err = fmt.Errorf(msg)
@@ -215,8 +254,37 @@ func (partition *DataPartition) convertToDataPartitionResponse() (dpr *DataParti
 	dpr.Status = partition.Status
 	dpr.ReplicaNum = partition.ReplicaNum
 	dpr.PartitionType = partition.PartitionType
-	dpr.Hosts = make([]string, len(partition.PersistenceHosts))
-	copy(dpr.Hosts, partition.PersistenceHosts)
+	dpr.Epoch = partition.Epoch
+	dpr.ArchiveStatus = partition.ArchiveStatus
+	dpr.Degraded = partition.degraded
+	dpr.Releasing = partition.Releasing
+	hosts := partition.PersistenceHosts
+	if partition.writeHosts != nil {
+		// the clients write to the live replicas only, the others are repaired once back
+		hosts = partition.writeHosts
+	} else if partition.isRaftReplicated() {
+		hosts = partition.raftLeaderFirst(hosts)
+	}
+	dpr.Hosts = make([]string, len(hosts))
+	copy(dpr.Hosts, hosts)
+	dpr.ClientHosts = make([]string, 0, len(hosts))
+	// the zones of the hosts let the clients read from a replica of their zone
+	zones := make([]string, 0, len(hosts))
+	hasZone := false
+	for _, host := range hosts {
+		if replica, ok := partition.IsInReplicas(host); ok {
+			dataNode := replica.GetReplicaNode()
+			dpr.ClientHosts = append(dpr.ClientHosts, dataNode.getClientAddr())
+			zones = append(zones, dataNode.getZone())
+			hasZone = hasZone || zones[len(zones)-1] != ""
+		} else {
+			dpr.ClientHosts = append(dpr.ClientHosts, host)
+			zones = append(zones, "")
+		}
+	}
+	if hasZone {
+		dpr.Zones = zones
+	}
 	return
 }
 
@@ -322,12 +390,72 @@ func (partition *DataPartition) HostsToString() (hosts string) {
 	return strings.Join(partition.PersistenceHosts, UnderlineSeparator)
 }
 
+/*a replica has ranges quarantined waiting for the repair, the caller must hold the lock of partition*/
+func (partition *DataPartition) hasQuarantined() bool {
+	for _, replica := range partition.Replicas {
+		if len(replica.Quarantined) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func (partition *DataPartition) setToNormal() {
 	partition.Lock()
 	defer partition.Unlock()
 	partition.isRecover = false
 }
 
+func (partition *DataPartition) WarmHostsToString() (hosts string) {
+	return strings.Join(partition.WarmHosts, UnderlineSeparator)
+}
+
+func (partition *DataPartition) setWarmHosts(hosts string) {
+	partition.WarmHosts = make([]string, 0)
+	if hosts != "" {
+		partition.WarmHosts = strings.Split(hosts, UnderlineSeparator)
+	}
+}
+
+func (partition *DataPartition) setEncode(shardHosts, encodeStep string) {
+	partition.ShardHosts = make([]string, 0)
+	if shardHosts != "" {
+		partition.ShardHosts = strings.Split(shardHosts, UnderlineSeparator)
+	}
+	partition.EncodeStep = encodeStep
+}
+
+func (partition *DataPartition) ShardHostsToString() (hosts string) {
+	return strings.Join(partition.ShardHosts, UnderlineSeparator)
+}
+
+func (partition *DataPartition) setArchive(archiveStatus, archiveTarget string) {
+	partition.ArchiveStatus = archiveStatus
+	partition.ArchiveTarget = archiveTarget
+	if archiveStatus == ArchiveStatusArchived {
+		partition.Status = proto.Unavaliable
+	}
+}
+
+func (partition *DataPartition) isInWarmHosts(addr string) (ok bool) {
+	for _, host := range partition.WarmHosts {
+		if host == addr {
+			return true
+		}
+	}
+	return
+}
+
+func (partition *DataPartition) removeWarmHost(addr string) {
+	newHosts := make([]string, 0, len(partition.WarmHosts))
+	for _, host := range partition.WarmHosts {
+		if host != addr {
+			newHosts = append(newHosts, host)
+		}
+	}
+	partition.WarmHosts = newHosts
+}
+
 func (partition *DataPartition) isInPersistenceHosts(addr string) (ok bool) {
 	for _, host := range partition.PersistenceHosts {
 		if host == addr {
@@ -366,6 +494,18 @@ func (partition *DataPartition) getLiveReplicasByPersistenceHosts(timeOutSec int
 	return
 }
 
+func (partition *DataPartition) isDegraded() bool {
+	partition.RLock()
+	defer partition.RUnlock()
+	return partition.degraded
+}
+
+func (partition *DataPartition) isLost() bool {
+	partition.RLock()
+	defer partition.RUnlock()
+	return partition.lost
+}
+
 func (partition *DataPartition) checkAndRemoveMissReplica(addr string) {
 	if _, ok := partition.MissNodes[addr]; ok {
 		delete(partition.MissNodes, addr)
@@ -413,18 +553,45 @@ func (partition *DataPartition) updateForOffline(offlineAddr, newAddr, volName s
 	orgHosts := make([]string, len(partition.PersistenceHosts))
 	copy(orgHosts, partition.PersistenceHosts)
 	newHosts := make([]string, 0)
-	for index, addr := range partition.PersistenceHosts {
-		if addr == offlineAddr {
-			after := partition.PersistenceHosts[index+1:]
-			newHosts = partition.PersistenceHosts[:index]
-			newHosts = append(newHosts, after...)
-			break
+	if partition.PartitionType == proto.ErasureCodePartition {
+		//the hosts are in the order of the shard index, the new host takes the shard of the offline one
+		newHosts = append(newHosts, orgHosts...)
+		for index, addr := range newHosts {
+			if addr == offlineAddr {
+				newHosts[index] = newAddr
+			}
+		}
+	} else {
+		for index, addr := range partition.PersistenceHosts {
+			if addr == offlineAddr {
+				after := partition.PersistenceHosts[index+1:]
+				newHosts = partition.PersistenceHosts[:index]
+				newHosts = append(newHosts, after...)
+				break
+			}
 		}
+		newHosts = append(newHosts, newAddr)
+	}
+	orgWarmHosts := partition.WarmHosts
+	orgShardHosts := partition.ShardHosts
+	if len(orgShardHosts) != 0 {
+		shardHosts := make([]string, len(orgShardHosts))
+		for index, addr := range orgShardHosts {
+			shardHosts[index] = addr
+			if addr == offlineAddr {
+				shardHosts[index] = newAddr
+			}
+		}
+		partition.ShardHosts = shardHosts
 	}
-	newHosts = append(newHosts, newAddr)
+	partition.removeWarmHost(newAddr)
 	partition.PersistenceHosts = newHosts
+	partition.Epoch++
 	if err = c.syncUpdateDataPartition(volName, partition); err != nil {
 		partition.PersistenceHosts = orgHosts
+		partition.ShardHosts = orgShardHosts
+		partition.WarmHosts = orgWarmHosts
+		partition.Epoch--
 		return errors.Annotatef(err, "update partition[%v] failed", partition.PartitionID)
 	}
 	msg := fmt.Sprintf("action[updateForOffline]  partitionID:%v offlineAddr:%v newAddr:%v"+
@@ -436,6 +603,10 @@ func (partition *DataPartition) updateForOffline(offlineAddr, newAddr, volName s
 
 func (partition *DataPartition) UpdateMetric(vr *proto.PartitionReport, dataNode *DataNode) {
 
+	if partition.isInWarmHosts(dataNode.Addr) {
+		partition.updateWarmUsed(dataNode.Addr, vr.Used)
+		return
+	}
 	if !partition.isInPersistenceHosts(dataNode.Addr) {
 		return
 	}
@@ -451,10 +622,45 @@ func (partition *DataPartition) UpdateMetric(vr *proto.PartitionReport, dataNode
 	replica.Status = int8(vr.PartitionStatus)
 	replica.Total = vr.Total
 	replica.Used = vr.Used
+	if len(vr.Quarantined) != 0 {
+		msg := fmt.Sprintf("action[UpdateMetric] partitionID:%v on Node:%v has quarantined ranges:%v, waiting for repair",
+			partition.PartitionID, dataNode.Addr, len(vr.Quarantined))
+		log.LogWarn(msg)
+	}
+	replica.Quarantined = vr.Quarantined
+	replica.Sealed = vr.Sealed
+	replica.SealCrc = vr.SealCrc
+	replica.RaftLeader = vr.RaftLeader
+	replica.WriteLatencyMs = vr.WriteLatencyMs
 	replica.SetAlive()
 	partition.checkAndRemoveMissReplica(dataNode.Addr)
 }
 
+func (partition *DataPartition) updateWarmUsed(addr string, used uint64) {
+	partition.Lock()
+	defer partition.Unlock()
+	if partition.warmUsed == nil {
+		partition.warmUsed = make(map[string]uint64)
+	}
+	partition.warmUsed[addr] = used
+}
+
+/*the warm replica on addr has caught up if it reports as many bytes as every persistence replica*/
+func (partition *DataPartition) isWarmReplicaCaughtUp(addr string) (ok bool) {
+	partition.RLock()
+	defer partition.RUnlock()
+	used, reported := partition.warmUsed[addr]
+	if !reported || len(partition.Replicas) < len(partition.PersistenceHosts) {
+		return
+	}
+	for _, replica := range partition.Replicas {
+		if partition.isInPersistenceHosts(replica.Addr) && replica.Used > used {
+			return
+		}
+	}
+	return true
+}
+
 func (partition *DataPartition) toJson() (body []byte, err error) {
 	partition.RLock()
 	defer partition.RUnlock()
@@ -21,19 +21,37 @@ import (
 	"time"
 )
 
-func (partition *DataPartition) checkStatus(needLog bool, dpTimeOutSec int64) {
+func (partition *DataPartition) checkStatus(needLog bool, dpTimeOutSec int64, degradedWrite string) {
 	partition.Lock()
 	defer partition.Unlock()
 	liveReplicas := partition.getLiveReplicasByPersistenceHosts(dpTimeOutSec)
-	switch len(liveReplicas) {
-	case (int)(partition.ReplicaNum):
+	partition.degraded = len(liveReplicas) < int(partition.ReplicaNum)
+	partition.lost = partition.ReplicaNum != 0 && len(liveReplicas) == 0
+	partition.writeHosts = nil
+	switch {
+	case len(liveReplicas) == int(partition.ReplicaNum):
 		partition.Status = proto.ReadOnly
 		if partition.checkReplicaStatusOnLiveNode(liveReplicas) == true {
 			partition.Status = proto.ReadWrite
 		}
+	case partition.isRaftReplicated() && len(liveReplicas) > int(partition.ReplicaNum)/2:
+		// the writes of a raft group are committed by a majority of its replicas
+		partition.Status = proto.ReadOnly
+		if partition.checkReplicaStatusOnLiveNode(liveReplicas) == true {
+			partition.Status = proto.ReadWrite
+		}
+	case degradedWrite == DegradedWriteBackfill && partition.canWriteDegraded(liveReplicas):
+		partition.Status = proto.ReadWrite
+		partition.writeHosts = make([]string, 0, len(liveReplicas))
+		for _, replica := range liveReplicas {
+			partition.writeHosts = append(partition.writeHosts, replica.Addr)
+		}
 	default:
 		partition.Status = proto.ReadOnly
 	}
+	if partition.Sealed || partition.Releasing {
+		partition.Status = proto.ReadOnly
+	}
 	if needLog == true {
 		msg := fmt.Sprintf("action[checkStatus],partitionID:%v  replicaNum:%v  liveReplicas:%v   Status:%v  RocksDBHost:%v ",
 			partition.PartitionID, partition.ReplicaNum, len(liveReplicas), partition.Status, partition.PersistenceHosts)
@@ -41,6 +59,15 @@ func (partition *DataPartition) checkStatus(needLog bool, dpTimeOutSec int64) {
 	}
 }
 
+/*a degraded partition is written if its leader and a majority of its replicas are live and writable*/
+func (partition *DataPartition) canWriteDegraded(liveReplicas []*DataReplica) bool {
+	if len(liveReplicas) <= int(partition.ReplicaNum)/2 || len(partition.PersistenceHosts) == 0 ||
+		liveReplicas[0].Addr != partition.PersistenceHosts[0] {
+		return false
+	}
+	return partition.checkReplicaStatusOnLiveNode(liveReplicas)
+}
+
 func (partition *DataPartition) checkReplicaStatusOnLiveNode(liveReplicas []*DataReplica) (equal bool) {
 	for _, replica := range liveReplicas {
 		if replica.Status != proto.ReadWrite {
@@ -61,6 +61,18 @@ func (dpMap *DataPartitionMap) putDataPartition(dp *DataPartition) {
 	dpMap.dataPartitions = append(dpMap.dataPartitions, dp)
 }
 
+func (dpMap *DataPartitionMap) deleteDataPartition(ID uint64) {
+	dpMap.Lock()
+	defer dpMap.Unlock()
+	delete(dpMap.dataPartitionMap, ID)
+	for i, dp := range dpMap.dataPartitions {
+		if dp.PartitionID == ID {
+			dpMap.dataPartitions = append(dpMap.dataPartitions[:i], dpMap.dataPartitions[i+1:]...)
+			break
+		}
+	}
+}
+
 func (dpMap *DataPartitionMap) putDataPartitionByRaft(dp *DataPartition) {
 	dpMap.Lock()
 	defer dpMap.Unlock()
@@ -0,0 +1,150 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"fmt"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+// The replicas of a raft replicated partition are the members of a raft group
+// on the data nodes, the peers are the ids of the data nodes of PersistenceHosts.
+// An offline replaces the peer of the offline host in the group: the replica is
+// created on the new host, the leader of the group adds the new peer and removes
+// the offline one, and the replica removed is deleted once the change is done.
+
+func (partition *DataPartition) isRaftReplicated() bool {
+	return partition.Replication == proto.ReplicationRaft
+}
+
+func (c *Cluster) getDataPeers(hosts []string) (peers []proto.Peer, err error) {
+	var dataNode *DataNode
+	peers = make([]proto.Peer, 0, len(hosts))
+	for _, host := range hosts {
+		if dataNode, err = c.getDataNode(host); err != nil {
+			return
+		}
+		if dataNode.ID == 0 {
+			return nil, errors.Annotatef(UnMatchPara, "dataNode[%v] has no raft node id", host)
+		}
+		dataNode.RLock()
+		peers = append(peers, proto.Peer{ID: dataNode.ID, Addr: host,
+			HeartbeatPort: dataNode.RaftHeartbeatPort, ReplicatePort: dataNode.RaftReplicatePort})
+		dataNode.RUnlock()
+	}
+	return
+}
+
+/*the live replica leading the raft group, the first host except the offline one if none reported, the caller must hold the lock of partition*/
+func (partition *DataPartition) getRaftLeader(offlineAddr string) (addr string) {
+	for _, replica := range partition.Replicas {
+		if replica.RaftLeader && replica.IsLive(DefaultDataPartitionTimeOutSec) {
+			return replica.Addr
+		}
+	}
+	for _, host := range partition.PersistenceHosts {
+		if host != offlineAddr {
+			return host
+		}
+	}
+	return
+}
+
+/*the hosts with the raft leader first, the clients write to the first host, the caller must hold the lock of partition*/
+func (partition *DataPartition) raftLeaderFirst(hosts []string) (leaderFirst []string) {
+	leaderFirst = make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		if replica, ok := partition.IsInReplicas(host); ok && replica.RaftLeader {
+			leaderFirst = append([]string{host}, leaderFirst...)
+		} else {
+			leaderFirst = append(leaderFirst, host)
+		}
+	}
+	return
+}
+
+func (partition *DataPartition) generateOfflineTask(addr string, removePeer, addPeer proto.Peer) (task *proto.AdminTask) {
+	request := &proto.DataPartitionOfflineRequest{
+		PartitionId: partition.PartitionID,
+		RemovePeer:  removePeer,
+		AddPeer:     addPeer,
+	}
+	task = proto.NewAdminTask(proto.OpOfflineDataPartition, addr, request)
+	partition.resetTaskID(task)
+	return
+}
+
+/*replace the peer of offlineAddr by newAddr in the raft group, the caller must hold the lock of partition*/
+func (c *Cluster) raftReplicaOffline(offlineAddr, newAddr, volName string, partition *DataPartition) (err error) {
+	var (
+		removePeer proto.Peer
+		addPeers   []proto.Peer
+		leaderAddr string
+	)
+	for _, peer := range partition.Peers {
+		if peer.Addr == offlineAddr {
+			removePeer = peer
+		}
+	}
+	if removePeer.ID == 0 {
+		return errors.Annotatef(DataReplicaNotFound, "partitionID[%v] no peer on node[%v]", partition.PartitionID, offlineAddr)
+	}
+	if addPeers, err = c.getDataPeers([]string{newAddr}); err != nil {
+		return
+	}
+	leaderAddr = partition.getRaftLeader(offlineAddr)
+	orgPeers := partition.Peers
+	newPeers := make([]proto.Peer, 0, len(orgPeers))
+	for _, peer := range orgPeers {
+		if peer.ID != removePeer.ID {
+			newPeers = append(newPeers, peer)
+		}
+	}
+	partition.Peers = append(newPeers, addPeers[0])
+	if err = partition.updateForOffline(offlineAddr, newAddr, volName, c); err != nil {
+		partition.Peers = orgPeers
+		return
+	}
+	partition.offLineInMem(offlineAddr)
+	partition.checkAndRemoveMissReplica(offlineAddr)
+	// the new replica starts its raft with the new peers and is caught up by the leader
+	c.putDataNodeTasks([]*proto.AdminTask{
+		partition.generateCreateTask(newAddr),
+		partition.generateOfflineTask(leaderAddr, removePeer, addPeers[0]),
+	})
+	log.LogWarnf("action[raftReplicaOffline] clusterID[%v] partitionID:%v peer[%v] replaced by[%v] on leader[%v]",
+		c.Name, partition.PartitionID, removePeer, addPeers[0], leaderAddr)
+	return
+}
+
+/*the replica removed from the raft group is deleted, it is kept if the change failed*/
+func (c *Cluster) dealOfflineDataPartitionResponse(nodeAddr string, resp *proto.DataPartitionOfflineResponse) (err error) {
+	var dp *DataPartition
+	if resp.Status != proto.TaskSuccess {
+		Warn(c.Name, fmt.Sprintf("clusterID[%v] partitionID:%v remove peer[%v] on leader[%v] failed,err[%v]",
+			c.Name, resp.PartitionId, resp.RemovePeer, nodeAddr, resp.Result))
+		return
+	}
+	if dp, err = c.getDataPartitionByID(resp.PartitionId); err != nil {
+		return
+	}
+	c.putDataNodeTasks([]*proto.AdminTask{dp.GenerateDeleteTask(resp.RemovePeer.Addr)})
+	log.LogWarnf("action[dealOfflineDataPartitionResponse] clusterID[%v] partitionID:%v peer[%v] removed, delete its replica",
+		c.Name, resp.PartitionId, resp.RemovePeer)
+	return
+}
@@ -29,6 +29,13 @@ type DataReplica struct {
 	LoadPartitionIsResponse bool
 	Total                   uint64 `json:"TotalSize"`
 	Used                    uint64 `json:"UsedSize"`
+	Quarantined             []*proto.QuarantinedRange
+	Sealed                  bool
+	SealCrc                 uint32
+	RaftLeader              bool          //the replica leads the raft group of a raft replicated partition
+	WriteLatencyMs          uint32        //average write latency of the last report period
+	LastRepair              *ReplicaCheck `json:",omitempty"` //the last repair asked by the admin
+	LastVerify              *ReplicaCheck `json:",omitempty"` //the last verify asked by the admin
 }
 
 func NewDataReplica(dataNode *DataNode) (replica *DataReplica) {
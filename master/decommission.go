@@ -0,0 +1,284 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	DefaultDecommissionMaxMigrations = 4
+)
+
+type DecommissionView struct {
+	Addr          string
+	MaxMigrations int
+	StartTime     int64
+	Total         int //partitions on the node when the decommission started
+	Remaining     int //partitions still on the node
+	Migrations    []*Migration
+	History       []*Migration
+}
+
+// the drain of a data node: the node gets no new partitions, its replicas are
+// moved off by migrations, and it is removed from the cluster once it is empty
+type decommission struct {
+	addr          string
+	maxMigrations int
+	startTime     int64
+	total         int
+	remaining     int
+	migrations    map[uint64]*Migration
+	history       []*Migration
+}
+
+// the decommission state is kept only in the memory of the leader like the
+// rebalance, the draining nodes have to be decommissioned again after the leader changed
+type decommissioner struct {
+	nodes map[string]*decommission
+	sync.Mutex
+}
+
+func newDecommissioner() *decommissioner {
+	return &decommissioner{nodes: make(map[string]*decommission)}
+}
+
+/*the caller must hold the lock of decommissioner*/
+func (d *decommission) finish(m *Migration, status, msg string) {
+	m.Status = status
+	m.Msg = msg
+	m.EndTime = time.Now().Unix()
+	delete(d.migrations, m.PartitionID)
+	d.history = append(d.history, m)
+	if len(d.history) > MigrationHistoryCount {
+		d.history = d.history[len(d.history)-MigrationHistoryCount:]
+	}
+	log.LogWarnf("action[decommission] partitionID:%v vol[%v] from %v to %v %v: %v",
+		m.PartitionID, m.VolName, m.Source, m.Target, status, msg)
+}
+
+func (c *Cluster) startCheckDecommission() {
+	go func() {
+		for {
+			if c.partition.IsLeader() {
+				c.checkDecommission()
+			}
+			time.Sleep(time.Second * RebalanceCheckIntervalSeconds)
+		}
+	}()
+}
+
+func (c *Cluster) decommissionDataNode(addr string, maxMigrations int) (err error) {
+	var dataNode *DataNode
+	if maxMigrations <= 0 {
+		return errors.Annotatef(UnMatchPara, "maxMigrations[%v]", maxMigrations)
+	}
+	if dataNode, err = c.getDataNode(addr); err != nil {
+		return
+	}
+	dc := c.decommissioner
+	dc.Lock()
+	defer dc.Unlock()
+	if _, ok := dc.nodes[addr]; ok {
+		return hasExist(fmt.Sprintf("decommission of dataNode %v", addr))
+	}
+	dataNode.setDraining(true)
+	total := len(c.getDataNodePartitions(addr))
+	dc.nodes[addr] = &decommission{
+		addr:          addr,
+		maxMigrations: maxMigrations,
+		startTime:     time.Now().Unix(),
+		total:         total,
+		remaining:     total,
+		migrations:    make(map[uint64]*Migration),
+		history:       make([]*Migration, 0),
+	}
+	log.LogWarnf("action[decommissionDataNode] clusterID[%v] node[%v] draining, partitions[%v] maxMigrations[%v]",
+		c.Name, addr, total, maxMigrations)
+	go c.checkDecommission()
+	return
+}
+
+/*cancel the migrations in progress and remove their warm replicas, the node takes new partitions again*/
+func (c *Cluster) cancelDecommission(addr string) (err error) {
+	dc := c.decommissioner
+	dc.Lock()
+	defer dc.Unlock()
+	d, ok := dc.nodes[addr]
+	if !ok {
+		return elementNotFound(fmt.Sprintf("decommission of dataNode %v", addr))
+	}
+	for _, m := range d.migrations {
+		if dp, err := c.getDataPartitionByID(m.PartitionID); err == nil {
+			c.dataPartitionOffline(m.Target, m.VolName, dp, "decommission canceled")
+		}
+		d.finish(m, MigrationCanceled, "decommission canceled")
+	}
+	delete(dc.nodes, addr)
+	if dataNode, err := c.getDataNode(addr); err == nil {
+		dataNode.setDraining(false)
+	}
+	log.LogWarnf("action[cancelDecommission] clusterID[%v] node[%v] canceled", c.Name, addr)
+	return
+}
+
+func (c *Cluster) getDecommissionView(addr string) (view *DecommissionView, err error) {
+	dc := c.decommissioner
+	dc.Lock()
+	defer dc.Unlock()
+	d, ok := dc.nodes[addr]
+	if !ok {
+		return nil, elementNotFound(fmt.Sprintf("decommission of dataNode %v", addr))
+	}
+	view = &DecommissionView{
+		Addr:          d.addr,
+		MaxMigrations: d.maxMigrations,
+		StartTime:     d.startTime,
+		Total:         d.total,
+		Remaining:     d.remaining,
+		Migrations:    make([]*Migration, 0, len(d.migrations)),
+		History:       make([]*Migration, 0, len(d.history)),
+	}
+	for _, m := range d.migrations {
+		migration := *m
+		view.Migrations = append(view.Migrations, &migration)
+	}
+	for _, m := range d.history {
+		migration := *m
+		view.History = append(view.History, &migration)
+	}
+	return
+}
+
+/*the data partitions holding a persistence or warm replica on addr*/
+func (c *Cluster) getDataNodePartitions(addr string) (dps []*DataPartition) {
+	dps = make([]*DataPartition, 0)
+	for _, vol := range c.getAllNormalVols() {
+		vol.dataPartitions.RLock()
+		for _, dp := range vol.dataPartitions.dataPartitions {
+			dp.RLock()
+			if dp.isInPersistenceHosts(addr) || dp.isInWarmHosts(addr) {
+				dps = append(dps, dp)
+			}
+			dp.RUnlock()
+		}
+		vol.dataPartitions.RUnlock()
+	}
+	return
+}
+
+func (c *Cluster) checkDecommission() {
+	dc := c.decommissioner
+	dc.Lock()
+	defer dc.Unlock()
+	for addr, d := range dc.nodes {
+		if c.drainDataNode(d) {
+			delete(dc.nodes, addr)
+		}
+	}
+}
+
+/*advance the drain of the node, return true when the node is empty and removed from the cluster*/
+func (c *Cluster) drainDataNode(d *decommission) (removed bool) {
+	dataNode, err := c.getDataNode(d.addr)
+	if err != nil {
+		log.LogWarnf("action[drainDataNode] clusterID[%v] node[%v]: %v", c.Name, d.addr, err)
+		return true
+	}
+	for _, m := range d.migrations {
+		if status, msg := c.advanceMigration(m, "decommission"); status != "" {
+			d.finish(m, status, msg)
+		} else if msg != "" {
+			m.Msg = msg
+		}
+	}
+	dps := c.getDataNodePartitions(d.addr)
+	d.remaining = len(dps)
+	if len(dps) == 0 && len(d.migrations) == 0 {
+		c.dataNodeOffLine(dataNode)
+		log.LogWarnf("action[drainDataNode] clusterID[%v] node[%v] drained and removed", c.Name, d.addr)
+		return true
+	}
+	for _, dp := range dps {
+		if len(d.migrations) >= d.maxMigrations {
+			break
+		}
+		if _, ok := d.migrations[dp.PartitionID]; ok {
+			continue
+		}
+		c.moveOffDrainingNode(d, dp)
+	}
+	return
+}
+
+/*the caller must hold the lock of decommissioner*/
+func (c *Cluster) moveOffDrainingNode(d *decommission, dp *DataPartition) {
+	dp.RLock()
+	isWarm := dp.isInWarmHosts(d.addr)
+	canWarm := dp.PartitionType == proto.ExtentPartition && !dp.isRaftReplicated()
+	dp.RUnlock()
+	// a warm replica on the node is removed directly, the persistence replicas
+	// of the partitions without warm replica support are rebuilt by the repair
+	// or the raft group
+	if isWarm || !canWarm {
+		c.dataPartitionOffline(d.addr, dp.VolName, dp, "decommission")
+		return
+	}
+	if !c.canDecommission(dp, d.addr) {
+		return
+	}
+	// the warm replica takes the place of the replica on the node, so it goes to a
+	// failure domain not holding the other replicas
+	var target string
+	var err error
+	if c.placement.isEnabled() {
+		dp.RLock()
+		hosts := append(append([]string{}, dp.PersistenceHosts...), dp.WarmHosts...)
+		dp.RUnlock()
+		if target, err = c.chooseReplacementHost(dp.PartitionType, hosts, d.addr); err != nil {
+			log.LogWarnf("action[moveOffDrainingNode] partitionID:%v vol[%v] node[%v] choose target: %v",
+				dp.PartitionID, dp.VolName, d.addr, err)
+			return
+		}
+	}
+	target, err = c.addWarmReplica(dp.VolName, dp, target)
+	if err != nil {
+		log.LogWarnf("action[moveOffDrainingNode] partitionID:%v vol[%v] node[%v] add warm replica: %v",
+			dp.PartitionID, dp.VolName, d.addr, err)
+		return
+	}
+	m := &Migration{PartitionID: dp.PartitionID, VolName: dp.VolName, Source: d.addr, Target: target,
+		Status: MigrationSyncing, StartTime: time.Now().Unix()}
+	d.migrations[dp.PartitionID] = m
+	log.LogWarnf("action[moveOffDrainingNode] partitionID:%v vol[%v] migrate from %v to %v",
+		m.PartitionID, m.VolName, m.Source, m.Target)
+}
+
+func (c *Cluster) canDecommission(dp *DataPartition, source string) bool {
+	vol, err := c.getVol(dp.VolName)
+	if err != nil {
+		return false
+	}
+	dp.RLock()
+	defer dp.RUnlock()
+	return !dp.isRecover && !dp.hasQuarantined() && len(dp.WarmHosts) == 0 && dp.ArchiveStatus == "" && dp.EncodeStep == "" && dp.isInPersistenceHosts(source) &&
+		dp.hasMissOne(dp.getReplicaNum(vol)) == nil
+}
@@ -0,0 +1,272 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	ErasureCodeCheckIntervalSeconds = 60
+)
+
+// The sealed extent partitions of an erasure code vol are encoded into RS shards on
+// hosts spread over the failure domains. The shard hosts open the store of the shards
+// in the prepare step, the leader encodes the extents into them in the encode step,
+// then the partition turns ec with the shard hosts as its hosts, and the shard hosts
+// drop the encoded extents in the commit step.
+func (c *Cluster) startCheckErasureCode() {
+	go func() {
+		for {
+			if c.partition.IsLeader() {
+				c.checkErasureCode()
+			}
+			time.Sleep(time.Second * ErasureCodeCheckIntervalSeconds)
+		}
+	}()
+}
+
+// start the encodes of the partitions sealed in sync of the erasure code vols, and advance the
+// encodes in progress, the tasks of a step are sent again after they failed or the leader changed
+func (c *Cluster) checkErasureCode() {
+	for _, vol := range c.getAllNormalVols() {
+		erasureCode := vol.isErasureCode()
+		for _, dp := range vol.getEncodePartitions(erasureCode) {
+			if dp.getEncodeStep() == "" {
+				c.encodeDataPartition(dp)
+				continue
+			}
+			c.advanceEncode(dp)
+		}
+	}
+}
+
+/*the partitions of the vol being encoded, the ones to encode too if erasureCode*/
+func (vol *Vol) getEncodePartitions(erasureCode bool) (dps []*DataPartition) {
+	dps = make([]*DataPartition, 0)
+	vol.dataPartitions.RLock()
+	defer vol.dataPartitions.RUnlock()
+	for _, dp := range vol.dataPartitions.dataPartitions {
+		dp.RLock()
+		if dp.EncodeStep != "" || (erasureCode && dp.canEncode() == nil) {
+			dps = append(dps, dp)
+		}
+		dp.RUnlock()
+	}
+	return
+}
+
+func (partition *DataPartition) getEncodeStep() string {
+	partition.RLock()
+	defer partition.RUnlock()
+	return partition.EncodeStep
+}
+
+/*the caller must hold the lock of partition*/
+func (partition *DataPartition) canEncode() (err error) {
+	switch {
+	case partition.PartitionType != proto.ExtentPartition || partition.isRaftReplicated():
+		err = fmt.Errorf("partitionID[%v] type[%v] raft[%v] can't be encoded", partition.PartitionID,
+			partition.PartitionType, partition.isRaftReplicated())
+	case partition.EncodeStep != "":
+		err = fmt.Errorf("partitionID[%v] is encoding, step[%v]", partition.PartitionID, partition.EncodeStep)
+	case partition.ArchiveStatus != "" || partition.Releasing || partition.EncryptKeyId != "":
+		err = fmt.Errorf("partitionID[%v] is archived, released or encrypted", partition.PartitionID)
+	case !partition.isSealedInSync():
+		err = fmt.Errorf("partitionID[%v] is not sealed in sync", partition.PartitionID)
+	default:
+		err = partition.hasMissOne(int(partition.ReplicaNum))
+	}
+	return
+}
+
+func (partition *DataPartition) generateEncodeTask(addr, step string) (task *proto.AdminTask) {
+	request := &proto.EncodeDataPartitionRequest{
+		PartitionId:   partition.PartitionID,
+		VolumeId:      partition.VolName,
+		PartitionSize: util.DefaultDataPartitionSize,
+		Step:          step,
+		ShardHosts:    partition.ShardHosts,
+	}
+	task = proto.NewAdminTask(proto.OpEncodeDataPartition, addr, request)
+	partition.resetTaskID(task)
+	return
+}
+
+/*choose the shard hosts of the partition over the failure domains and start its encode*/
+func (c *Cluster) encodeDataPartition(dp *DataPartition) (err error) {
+	var shardHosts []string
+	if shardHosts, err = c.chooseErasureCodeHosts(proto.ECDataShards+proto.ECParityShards, proto.ECParityShards); err != nil {
+		log.LogWarnf("action[encodeDataPartition] clusterID[%v] partitionID:%v vol[%v] err[%v]",
+			c.Name, dp.PartitionID, dp.VolName, err)
+		return
+	}
+	dp.Lock()
+	if err = dp.canEncode(); err == nil {
+		dp.EncodeStep = proto.EncodeStepPrepare
+		dp.ShardHosts = shardHosts
+		if err = c.syncUpdateDataPartition(dp.VolName, dp); err != nil {
+			dp.EncodeStep = ""
+			dp.ShardHosts = nil
+		} else {
+			dp.encodeProgress = make(map[string]uint8)
+		}
+	}
+	dp.Unlock()
+	if err != nil {
+		return
+	}
+	log.LogWarnf("action[encodeDataPartition] clusterID[%v] partitionID:%v vol[%v] encoding, shard hosts%v",
+		c.Name, dp.PartitionID, dp.VolName, shardHosts)
+	c.advanceEncode(dp)
+	return
+}
+
+// send the tasks of the current step not sent yet, and move to the next step once the
+// hosts of the step finished. The partition turns ec once the leader encoded the extents
+func (c *Cluster) advanceEncode(dp *DataPartition) {
+	var tasks []*proto.AdminTask
+	dp.Lock()
+	defer func() {
+		dp.Unlock()
+		c.putDataNodeTasks(tasks)
+	}()
+	if len(dp.PersistenceHosts) == 0 || len(dp.ShardHosts) == 0 {
+		return
+	}
+	tasks = make([]*proto.AdminTask, 0)
+	switch dp.EncodeStep {
+	case proto.EncodeStepPrepare:
+		tasks = dp.generateEncodeStepTasks(dp.ShardHosts)
+		if dp.isEncodeStepDone(dp.ShardHosts) {
+			c.finishEncodeStep(dp, proto.EncodeStepEncode)
+		}
+	case proto.EncodeStepEncode:
+		leader := dp.PersistenceHosts[0]
+		tasks = dp.generateEncodeStepTasks([]string{leader})
+		if dp.isEncodeStepDone([]string{leader}) {
+			tasks = append(tasks, c.commitEncode(dp)...)
+		}
+	case proto.EncodeStepCommit:
+		tasks = dp.generateEncodeStepTasks(dp.ShardHosts)
+		if dp.isEncodeStepDone(dp.ShardHosts) {
+			c.finishEncodeStep(dp, "")
+		}
+	}
+}
+
+/*the caller must hold the lock of dp*/
+func (partition *DataPartition) generateEncodeStepTasks(hosts []string) (tasks []*proto.AdminTask) {
+	tasks = make([]*proto.AdminTask, 0)
+	for _, addr := range hosts {
+		if _, ok := partition.encodeProgress[addr]; !ok {
+			partition.encodeProgress[addr] = proto.TaskRunning
+			tasks = append(tasks, partition.generateEncodeTask(addr, partition.EncodeStep))
+		}
+	}
+	return
+}
+
+/*the caller must hold the lock of dp*/
+func (partition *DataPartition) isEncodeStepDone(hosts []string) bool {
+	for _, addr := range hosts {
+		if partition.encodeProgress[addr] != proto.TaskSuccess {
+			return false
+		}
+	}
+	return true
+}
+
+/*the caller must hold the lock of dp, the step is finished again in the next check if the update failed*/
+func (c *Cluster) finishEncodeStep(dp *DataPartition, step string) {
+	oldStep := dp.EncodeStep
+	dp.EncodeStep = step
+	if err := c.syncUpdateDataPartition(dp.VolName, dp); err != nil {
+		dp.EncodeStep = oldStep
+		log.LogWarnf("action[finishEncodeStep] partitionID:%v vol[%v] %v: %v", dp.PartitionID, dp.VolName, step, err)
+		return
+	}
+	dp.encodeProgress = make(map[string]uint8)
+	log.LogWarnf("action[finishEncodeStep] clusterID[%v] partitionID:%v vol[%v] %v finished, hosts%v",
+		c.Name, dp.PartitionID, dp.VolName, oldStep, dp.PersistenceHosts)
+}
+
+// turn the partition ec with the shard hosts as its hosts, and return the tasks deleting
+// the replicas of the hosts not holding a shard. The caller must hold the lock of dp
+func (c *Cluster) commitEncode(dp *DataPartition) (tasks []*proto.AdminTask) {
+	orgHosts, orgReplicaNum := dp.PersistenceHosts, dp.ReplicaNum
+	dp.PartitionType = proto.ErasureCodePartition
+	dp.PersistenceHosts = make([]string, len(dp.ShardHosts))
+	copy(dp.PersistenceHosts, dp.ShardHosts)
+	dp.ReplicaNum = uint8(len(dp.ShardHosts))
+	dp.EncodeStep = proto.EncodeStepCommit
+	dp.Epoch++
+	if err := c.syncUpdateDataPartition(dp.VolName, dp); err != nil {
+		dp.PartitionType = proto.ExtentPartition
+		dp.PersistenceHosts = orgHosts
+		dp.ReplicaNum = orgReplicaNum
+		dp.EncodeStep = proto.EncodeStepEncode
+		dp.Epoch--
+		log.LogWarnf("action[commitEncode] partitionID:%v vol[%v]: %v", dp.PartitionID, dp.VolName, err)
+		return nil
+	}
+	dp.encodeProgress = make(map[string]uint8)
+	tasks = make([]*proto.AdminTask, 0)
+	for _, addr := range orgHosts {
+		if dp.isInPersistenceHosts(addr) {
+			continue
+		}
+		dp.offLineInMem(addr)
+		dp.checkAndRemoveMissReplica(addr)
+		tasks = append(tasks, dp.GenerateDeleteTask(addr))
+	}
+	tasks = append(tasks, dp.generateEncodeStepTasks(dp.ShardHosts)...)
+	log.LogWarnf("action[commitEncode] clusterID[%v] partitionID:%v vol[%v] encoded, oldHosts%v shard hosts%v",
+		c.Name, dp.PartitionID, dp.VolName, orgHosts, dp.ShardHosts)
+	return
+}
+
+/*the responses of the tasks of another step than the current one are dropped*/
+func (c *Cluster) dealEncodeResponse(nodeAddr string, resp *proto.EncodeDataPartitionResponse) (err error) {
+	step := resp.Step
+	var dp *DataPartition
+	if dp, err = c.getDataPartitionByID(resp.PartitionId); err != nil {
+		return
+	}
+	dp.Lock()
+	if dp.EncodeStep != step {
+		dp.Unlock()
+		return
+	}
+	if resp.Status == proto.TaskSuccess {
+		dp.encodeProgress[nodeAddr] = proto.TaskSuccess
+	} else {
+		// sent again by the next check
+		delete(dp.encodeProgress, nodeAddr)
+	}
+	dp.Unlock()
+	if resp.Status != proto.TaskSuccess {
+		Warn(c.Name, fmt.Sprintf("clusterID[%v] partitionID:%v encode %v on node[%v] failed,err[%v] code[%v]",
+			c.Name, resp.PartitionId, step, nodeAddr, resp.Result, resp.ErrCode))
+		return
+	}
+	c.advanceEncode(dp)
+	return
+}
@@ -30,6 +30,7 @@ var (
 	MetaPartitionNotFound = errors.New("meta partition not found")
 	DataReplicaNotFound   = errors.New("data replica not found")
 	UnMatchPara           = errors.New("para not unmatched")
+	ClientSessionNotFound = errors.New("client session not found")
 
 	DisOrderArrayErr                    = errors.New("dis order array is nil")
 	DataReplicaExcessError              = errors.New("data replica Excess error")
@@ -45,8 +46,10 @@ var (
 	NoHaveMajorityReplica               = errors.New("no have majority replica error")
 	NoLeader                            = errors.New("no leader")
 	ErrBadConfFile                      = errors.New("BadConfFile")
-	InvalidDataPartitionType            = errors.New("invalid data partition type. extent or blob")
+	InvalidDataPartitionType            = errors.New("invalid data partition type. extent, blob or ec")
 	ParaEnableNotFound                  = errors.New("para enable not found")
+	DataPartitionArchived               = errors.New("data partition archived")
+	DataPartitionEncoding               = errors.New("data partition encoding")
 )
 
 func paraNotFound(name string) (err error) {
@@ -0,0 +1,120 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/tiglabs/containerfs/raftstore"
+	"github.com/tiglabs/containerfs/util"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	DefaultReadLeaseSeconds = 10
+)
+
+// the lease held by a follower and the queries it served
+type readLease struct {
+	raftstore.ReadLeaseHolder
+	reads uint64
+}
+
+/*the read only queries a follower with a read lease serves, they only need the state replicated by raft*/
+func isFollowerRead(path string) bool {
+	switch path {
+	case AdminGetDataPartition, AdminGetTopology, DataNodeHosts:
+		return true
+	}
+	return false
+}
+
+func (m *Master) startRenewReadLease() {
+	if m.config.readLeaseSeconds <= 0 {
+		return
+	}
+	go func() {
+		for {
+			if !m.partition.IsLeader() {
+				if err := m.renewReadLease(); err != nil {
+					log.LogWarnf("action[renewReadLease] clusterID[%v] leader[%v]: %v", m.clusterName, m.leaderInfo.addr, err)
+				}
+			}
+			time.Sleep(time.Second * time.Duration(m.config.readLeaseSeconds) / 3)
+		}
+	}()
+}
+
+func (m *Master) renewReadLease() (err error) {
+	leader := m.leaderInfo.addr
+	if leader == "" {
+		return NoLeader
+	}
+	start := time.Now().UnixNano()
+	resp, err := util.NewMasterClient(time.Second * 3).Get(util.MasterURL(leader, AdminGetReadLease))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("statusCode[%v] respBody[%v]", resp.StatusCode, string(body))
+	}
+	lease := &raftstore.ReadLease{}
+	if err = json.Unmarshal(body, lease); err != nil {
+		return
+	}
+	m.readLease.Set(lease, start)
+	return
+}
+
+func (m *Master) getReadLease(w http.ResponseWriter, r *http.Request) {
+	var (
+		body []byte
+		err  error
+	)
+	if m.config.readLeaseSeconds <= 0 {
+		err = fmt.Errorf("follower reads disabled")
+		goto errDeal
+	}
+	if body, err = json.Marshal(raftstore.GrantReadLease(m.partition, m.config.readLeaseSeconds)); err != nil {
+		goto errDeal
+	}
+	io.WriteString(w, string(body))
+	return
+errDeal:
+	logMsg := getReturnMessage("getReadLease", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+/*serve the read only query on the follower if it holds a read lease*/
+func (m *Master) serveFollowerRead(w http.ResponseWriter, r *http.Request) bool {
+	if !isFollowerRead(r.URL.Path) || !m.readLease.Valid(m.partition) {
+		return false
+	}
+	atomic.AddUint64(&m.readLease.reads, 1)
+	m.ServeHTTP(w, r)
+	return true
+}
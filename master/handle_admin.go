@@ -18,11 +18,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"strconv"
+	"time"
 
 	"bytes"
+	"github.com/juju/errors"
 	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util"
 	"github.com/tiglabs/containerfs/util/log"
 	"io/ioutil"
 	"strings"
@@ -93,385 +97,1717 @@ func (m *Master) getCompactStatus(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func (m *Master) getCluster(w http.ResponseWriter, r *http.Request) {
+func (m *Master) getClientSessions(w http.ResponseWriter, r *http.Request) {
 	var (
 		body []byte
+		name string
 		err  error
 	)
-	cv := &ClusterView{
-		Name:               m.cluster.Name,
-		LeaderAddr:         m.leaderInfo.addr,
-		CompactStatus:      m.cluster.compactStatus,
-		Applied:            m.fsm.applied,
-		MaxDataPartitionID: m.cluster.idAlloc.dataPartitionID,
-		MaxMetaNodeID:      m.cluster.idAlloc.metaNodeID,
-		MaxMetaPartitionID: m.cluster.idAlloc.metaPartitionID,
-		Vols:               make([]string, 0),
-		MetaNodes:          make([]MetaNodeView, 0),
-		DataNodes:          make([]DataNodeView, 0),
+	if name, err = parseGetVolPara(r); err != nil {
+		goto errDeal
 	}
-
-	cv.Vols = m.cluster.getAllVols()
-	cv.MetaNodes = m.cluster.getAllMetaNodes()
-	cv.DataNodes = m.cluster.getAllDataNodes()
-	if body, err = json.Marshal(cv); err != nil {
+	if _, err = m.cluster.getVol(name); err != nil {
 		goto errDeal
 	}
-	io.WriteString(w, string(body))
-	return
-
-errDeal:
-	logMsg := getReturnMessage("getCluster", r.RemoteAddr, err.Error(), http.StatusBadRequest)
-	HandleError(logMsg, err, http.StatusBadRequest, w)
-	return
-}
-
-func (m *Master) getIpAndClusterName(w http.ResponseWriter, r *http.Request) {
-	cInfo := &proto.ClusterInfo{Cluster: m.cluster.Name, Ip: strings.Split(r.RemoteAddr, ":")[0]}
-	cInfoBytes, err := json.Marshal(cInfo)
-	if err != nil {
+	if body, err = json.Marshal(m.cluster.getClientSessions(name)); err != nil {
 		goto errDeal
 	}
-	w.Write(cInfoBytes)
+	io.WriteString(w, string(body))
 	return
 errDeal:
-	rstMsg := getReturnMessage("getIpAndClusterName", r.RemoteAddr, err.Error(), http.StatusBadRequest)
-	HandleError(rstMsg, err, http.StatusBadRequest, w)
+	logMsg := getReturnMessage("getClientSessions", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
 	return
 }
 
-func (m *Master) createMetaPartition(w http.ResponseWriter, r *http.Request) {
+func (m *Master) evictClient(w http.ResponseWriter, r *http.Request) {
 	var (
-		volName string
-		start   uint64
-		rstMsg  string
-		err     error
+		name         string
+		id           string
+		fenceSeconds int64
+		fence        *proto.ClientFence
+		err          error
 	)
-
-	if volName, start, err = parseCreateMetaPartitionPara(r); err != nil {
+	if name, id, fenceSeconds, err = parseEvictClientPara(r); err != nil {
 		goto errDeal
 	}
-
-	if err = m.cluster.CreateMetaPartitionForManual(volName, start); err != nil {
+	if fence, err = m.cluster.evictClient(name, id, fenceSeconds); err != nil {
 		goto errDeal
 	}
-
-	io.WriteString(w, fmt.Sprint("createMetaPartition request seccess"))
+	io.WriteString(w, fmt.Sprintf("evict client session[%v] of vol[%v] success, addr[%v] fenced until[%v]",
+		id, name, fence.Addr, time.Unix(fence.ExpireTime, 0)))
 	return
 errDeal:
-	rstMsg = getReturnMessage("createMetaPartition", r.RemoteAddr, err.Error(), http.StatusBadRequest)
-	HandleError(rstMsg, err, http.StatusBadRequest, w)
+	logMsg := getReturnMessage("evictClient", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
 	return
 }
 
-func (m *Master) createDataPartition(w http.ResponseWriter, r *http.Request) {
+func (m *Master) startRebalance(w http.ResponseWriter, r *http.Request) {
 	var (
-		rstMsg                  string
-		volName                 string
-		partitionType           string
-		vol                     *Vol
-		reqCreateCount          int
-		capacity                int
-		lastTotalDataPartitions int
-		err                     error
+		threshold     float64
+		maxMigrations int
+		dryRun        bool
+		plan          *MigrationPlan
+		err           error
 	)
-
-	if reqCreateCount, volName, partitionType, err = parseCreateDataPartitionPara(r); err != nil {
+	if threshold, maxMigrations, err = parseStartRebalancePara(r); err != nil {
 		goto errDeal
 	}
-
-	if vol, err = m.cluster.getVol(volName); err != nil {
+	if dryRun, err = parseDryRun(r); err != nil {
 		goto errDeal
 	}
-	capacity = m.cluster.getDataPartitionCapacity(vol)
-	lastTotalDataPartitions = len(vol.dataPartitions.dataPartitions)
-	for i := 0; i < reqCreateCount; i++ {
-		if (reqCreateCount + lastTotalDataPartitions) < len(vol.dataPartitions.dataPartitions) {
-			break
+	if dryRun {
+		if plan, err = m.cluster.planRebalance(threshold, maxMigrations); err != nil {
+			goto errDeal
 		}
-		if _, err = m.cluster.createDataPartition(volName, partitionType); err != nil {
+		if err = writeMigrationPlan(w, plan); err != nil {
 			goto errDeal
 		}
+		return
 	}
-	rstMsg = fmt.Sprintf(" createDataPartition success. cluster capacity[%v],vol[%v] has %v data partitions last,%v data partitions now",
-		capacity, volName, lastTotalDataPartitions, len(vol.dataPartitions.dataPartitions))
-	io.WriteString(w, rstMsg)
-
+	if err = m.cluster.startRebalance(threshold, maxMigrations); err != nil {
+		goto errDeal
+	}
+	io.WriteString(w, fmt.Sprintf("start rebalance success, threshold[%v] maxMigrations[%v]", threshold, maxMigrations))
 	return
 errDeal:
-	rstMsg = getReturnMessage("createDataPartition", r.RemoteAddr, err.Error(), http.StatusBadRequest)
-	HandleError(rstMsg, err, http.StatusBadRequest, w)
+	logMsg := getReturnMessage("startRebalance", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
 	return
 }
 
-func (m *Master) getDataPartition(w http.ResponseWriter, r *http.Request) {
+func (m *Master) stopRebalance(w http.ResponseWriter, r *http.Request) {
+	m.cluster.stopRebalance()
+	io.WriteString(w, "stop rebalance success")
+	return
+}
+
+func (m *Master) getRebalance(w http.ResponseWriter, r *http.Request) {
 	var (
-		body        []byte
-		dp          *DataPartition
-		partitionID uint64
-		err         error
+		body []byte
+		err  error
 	)
-	if partitionID, err = parseDataPartitionID(r); err != nil {
-		goto errDeal
-	}
-
-	if dp, err = m.cluster.getDataPartitionByID(partitionID); err != nil {
-		goto errDeal
-	}
-	if body, err = dp.toJson(); err != nil {
+	if body, err = json.Marshal(m.cluster.getRebalanceView()); err != nil {
 		goto errDeal
 	}
 	io.WriteString(w, string(body))
-
 	return
 errDeal:
-	logMsg := getReturnMessage("getDataPartition", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	logMsg := getReturnMessage("getRebalance", r.RemoteAddr, err.Error(), http.StatusBadRequest)
 	HandleError(logMsg, err, http.StatusBadRequest, w)
 	return
 }
 
-func (m *Master) loadDataPartition(w http.ResponseWriter, r *http.Request) {
+func (m *Master) setLeaderTransfer(w http.ResponseWriter, r *http.Request) {
 	var (
-		volName     string
-		vol         *Vol
-		msg         string
-		dp          *DataPartition
-		partitionID uint64
-		err         error
+		enabled bool
+		err     error
 	)
-
-	if partitionID, volName, err = parseDataPartitionIDAndVol(r); err != nil {
+	if enabled, err = parseCompactPara(r); err != nil {
 		goto errDeal
 	}
+	m.cluster.setLeaderTransfer(enabled)
+	io.WriteString(w, fmt.Sprintf("set leader transfer to %v success", enabled))
+	return
+errDeal:
+	logMsg := getReturnMessage("setLeaderTransfer", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
 
-	if vol, err = m.cluster.getVol(volName); err != nil {
-		goto errDeal
-	}
-	if dp, err = vol.getDataPartitionByID(partitionID); err != nil {
+func (m *Master) getLeaderTransfer(w http.ResponseWriter, r *http.Request) {
+	var (
+		body []byte
+		err  error
+	)
+	if body, err = json.Marshal(m.cluster.getLeaderTransferView()); err != nil {
 		goto errDeal
 	}
-
-	m.cluster.loadDataPartitionAndCheckResponse(dp)
-	msg = fmt.Sprintf(AdminLoadDataPartition+"partitionID :%v  load data partition success", partitionID)
-	io.WriteString(w, msg)
-
+	io.WriteString(w, string(body))
 	return
 errDeal:
-	logMsg := getReturnMessage(AdminLoadDataPartition, r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	logMsg := getReturnMessage("getLeaderTransfer", r.RemoteAddr, err.Error(), http.StatusBadRequest)
 	HandleError(logMsg, err, http.StatusBadRequest, w)
 	return
 }
 
-func (m *Master) dataPartitionOffline(w http.ResponseWriter, r *http.Request) {
+func (m *Master) getNotifier(w http.ResponseWriter, r *http.Request) {
 	var (
-		volName     string
-		vol         *Vol
-		rstMsg      string
-		dp          *DataPartition
-		addr        string
-		partitionID uint64
-		err         error
+		body []byte
+		err  error
 	)
-
-	if addr, partitionID, volName, err = parseDataPartitionOfflinePara(r); err != nil {
-		goto errDeal
-	}
-	if vol, err = m.cluster.getVol(volName); err != nil {
-		goto errDeal
-	}
-	if dp, err = vol.getDataPartitionByID(partitionID); err != nil {
+	if body, err = json.Marshal(m.cluster.getNotifierView()); err != nil {
 		goto errDeal
 	}
-	m.cluster.dataPartitionOffline(addr, volName, dp, HandleDataPartitionOfflineErr)
-	rstMsg = fmt.Sprintf(AdminDataPartitionOffline+" dataPartitionID :%v  on node:%v  has offline success", partitionID, addr)
-	io.WriteString(w, rstMsg)
+	io.WriteString(w, string(body))
 	return
 errDeal:
-	logMsg := getReturnMessage(AdminDataPartitionOffline, r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	logMsg := getReturnMessage("getNotifier", r.RemoteAddr, err.Error(), http.StatusBadRequest)
 	HandleError(logMsg, err, http.StatusBadRequest, w)
 	return
 }
 
-func (m *Master) markDeleteVol(w http.ResponseWriter, r *http.Request) {
+func (m *Master) setZone(w http.ResponseWriter, r *http.Request) {
 	var (
-		name string
-		err  error
-		msg  string
+		name  string
+		racks []string
+		err   error
 	)
-
-	if name, err = parseDeleteVolPara(r); err != nil {
+	if name, racks, err = parseSetZonePara(r); err != nil {
 		goto errDeal
 	}
-	if err = m.cluster.markDeleteVol(name); err != nil {
+	if err = m.cluster.setZone(name, racks); err != nil {
 		goto errDeal
 	}
-	msg = fmt.Sprintf("delete vol[%v] successed\n", name)
-	log.LogWarn(msg)
-	io.WriteString(w, msg)
+	io.WriteString(w, fmt.Sprintf("set zone[%v] racks%v success", name, racks))
 	return
-
 errDeal:
-	logMsg := getReturnMessage("markDeleteVol", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	logMsg := getReturnMessage("setZone", r.RemoteAddr, err.Error(), http.StatusBadRequest)
 	HandleError(logMsg, err, http.StatusBadRequest, w)
 	return
 }
 
-func (m *Master) createVol(w http.ResponseWriter, r *http.Request) {
+func (m *Master) setFailureDomain(w http.ResponseWriter, r *http.Request) {
 	var (
-		name       string
-		err        error
-		msg        string
-		volType    string
-		replicaNum int
+		failureDomain string
+		err           error
 	)
-
-	if name, volType, replicaNum, err = parseCreateVolPara(r); err != nil {
+	r.ParseForm()
+	failureDomain = r.FormValue(ParaFailureDomain)
+	if err = m.cluster.setFailureDomain(failureDomain); err != nil {
 		goto errDeal
 	}
-	if err = m.cluster.createVol(name, volType, uint8(replicaNum)); err != nil {
+	io.WriteString(w, fmt.Sprintf("set failure domain to %v success", failureDomain))
+	return
+errDeal:
+	logMsg := getReturnMessage("setFailureDomain", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) getTopology(w http.ResponseWriter, r *http.Request) {
+	var (
+		body []byte
+		err  error
+	)
+	if body, err = json.Marshal(m.cluster.getTopologyView()); err != nil {
 		goto errDeal
 	}
-	msg = fmt.Sprintf("create vol[%v] successed\n", name)
-	io.WriteString(w, msg)
+	io.WriteString(w, string(body))
 	return
-
 errDeal:
-	logMsg := getReturnMessage("createVol", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	logMsg := getReturnMessage("getTopology", r.RemoteAddr, err.Error(), http.StatusBadRequest)
 	HandleError(logMsg, err, http.StatusBadRequest, w)
 	return
 }
 
-func (m *Master) addDataNode(w http.ResponseWriter, r *http.Request) {
+func (m *Master) setVolMetaPlacement(w http.ResponseWriter, r *http.Request) {
 	var (
-		nodeAddr string
-		err      error
+		name      string
+		placement MetaPlacement
+		err       error
 	)
-	if nodeAddr, err = parseAddDataNodePara(r); err != nil {
+	if name, placement, err = parseSetVolMetaPlacementPara(r); err != nil {
 		goto errDeal
 	}
-
-	if err = m.cluster.addDataNode(nodeAddr); err != nil {
+	if err = m.cluster.setVolMetaPlacement(name, placement); err != nil {
 		goto errDeal
 	}
-	io.WriteString(w, fmt.Sprintf("addDataNode %v successed\n", nodeAddr))
+	io.WriteString(w, fmt.Sprintf("set vol[%v] meta placement zone[%v] memClass[%v] metaNodes%v success",
+		name, placement.Zone, placement.MemClass, placement.MetaNodes))
 	return
 errDeal:
-	logMsg := getReturnMessage("addDataNode", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	logMsg := getReturnMessage("setVolMetaPlacement", r.RemoteAddr, err.Error(), http.StatusBadRequest)
 	HandleError(logMsg, err, http.StatusBadRequest, w)
 	return
 }
 
-func (m *Master) getDataNode(w http.ResponseWriter, r *http.Request) {
+func (m *Master) getVolMetaPlacement(w http.ResponseWriter, r *http.Request) {
 	var (
-		nodeAddr string
-		dataNode *DataNode
-		body     []byte
-		err      error
+		name string
+		vol  *Vol
+		body []byte
+		err  error
 	)
-	if nodeAddr, err = parseGetDataNodePara(r); err != nil {
+	if name, err = parseGetVolPara(r); err != nil {
 		goto errDeal
 	}
-
-	if dataNode, err = m.cluster.getDataNode(nodeAddr); err != nil {
+	if vol, err = m.cluster.getVol(name); err != nil {
 		goto errDeal
 	}
-	if body, err = dataNode.toJson(); err != nil {
+	if body, err = json.Marshal(vol.getMetaPlacement()); err != nil {
 		goto errDeal
 	}
 	io.WriteString(w, string(body))
-
 	return
 errDeal:
-	logMsg := getReturnMessage("getDataNode", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	logMsg := getReturnMessage("getVolMetaPlacement", r.RemoteAddr, err.Error(), http.StatusBadRequest)
 	HandleError(logMsg, err, http.StatusBadRequest, w)
 	return
 }
 
-func (m *Master) dataNodeOffline(w http.ResponseWriter, r *http.Request) {
+func (m *Master) setVolLifecycle(w http.ResponseWriter, r *http.Request) {
 	var (
-		node        *DataNode
-		rstMsg      string
-		offLineAddr string
-		err         error
+		name string
+		rule *proto.LifecycleRule
+		err  error
 	)
-
-	if offLineAddr, err = parseDataNodeOfflinePara(r); err != nil {
+	if name, rule, err = parseSetVolLifecyclePara(r); err != nil {
 		goto errDeal
 	}
-
-	if node, err = m.cluster.getDataNode(offLineAddr); err != nil {
+	if err = m.cluster.setVolLifecycleRule(name, rule); err != nil {
 		goto errDeal
 	}
-	m.cluster.dataNodeOffLine(node)
-	rstMsg = fmt.Sprintf("dataNodeOffline node [%v] has offline SUCCESS", offLineAddr)
-	io.WriteString(w, rstMsg)
+	io.WriteString(w, fmt.Sprintf("set vol[%v] lifecycle rule[%v] prefix[%v] days[%v] action[%v] success",
+		name, rule.ID, rule.Prefix, rule.Days, rule.Action))
 	return
 errDeal:
-	logMsg := getReturnMessage("dataNodeOffline", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	logMsg := getReturnMessage("setVolLifecycle", r.RemoteAddr, err.Error(), http.StatusBadRequest)
 	HandleError(logMsg, err, http.StatusBadRequest, w)
 	return
 }
 
-func (m *Master) dataNodeTaskResponse(w http.ResponseWriter, r *http.Request) {
+func (m *Master) deleteVolLifecycle(w http.ResponseWriter, r *http.Request) {
 	var (
-		dataNode *DataNode
-		code     = http.StatusOK
-		tr       *proto.AdminTask
-		err      error
+		name string
+		id   string
+		err  error
 	)
-
-	if tr, err = parseTaskResponse(r); err != nil {
-		code = http.StatusBadRequest
+	if name, id, err = parseDeleteVolLifecyclePara(r); err != nil {
 		goto errDeal
 	}
-	io.WriteString(w, fmt.Sprintf("%v", http.StatusOK))
-	if dataNode, err = m.cluster.getDataNode(tr.OperatorAddr); err != nil {
-		code = http.StatusInternalServerError
+	if err = m.cluster.deleteVolLifecycleRule(name, id); err != nil {
 		goto errDeal
 	}
-
-	m.cluster.dealDataNodeTaskResponse(dataNode.Addr, tr)
-
+	io.WriteString(w, fmt.Sprintf("delete vol[%v] lifecycle rule[%v] success", name, id))
 	return
-
 errDeal:
-	logMsg := getReturnMessage("dataNodeTaskResponse", r.RemoteAddr, err.Error(),
-		http.StatusBadRequest)
-	HandleError(logMsg, err, code, w)
+	logMsg := getReturnMessage("deleteVolLifecycle", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
 	return
 }
 
-func (m *Master) addMetaNode(w http.ResponseWriter, r *http.Request) {
+func (m *Master) getVolLifecycle(w http.ResponseWriter, r *http.Request) {
 	var (
-		nodeAddr string
-		id       uint64
-		err      error
+		name  string
+		views []*LifecycleView
+		body  []byte
+		err   error
 	)
-	if nodeAddr, err = parseAddMetaNodePara(r); err != nil {
+	if name, err = parseGetVolPara(r); err != nil {
 		goto errDeal
 	}
-
-	if id, err = m.cluster.addMetaNode(nodeAddr); err != nil {
+	if views, err = m.cluster.getVolLifecycle(name); err != nil {
 		goto errDeal
 	}
-	io.WriteString(w, fmt.Sprintf("%v", id))
+	if body, err = json.Marshal(views); err != nil {
+		goto errDeal
+	}
+	io.WriteString(w, string(body))
 	return
 errDeal:
-	logMsg := getReturnMessage("addMetaNode", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	logMsg := getReturnMessage("getVolLifecycle", r.RemoteAddr, err.Error(), http.StatusBadRequest)
 	HandleError(logMsg, err, http.StatusBadRequest, w)
 	return
 }
 
-func parseAddMetaNodePara(r *http.Request) (nodeAddr string, err error) {
+//the rule is checked by the cluster, an empty prefix is the root of the vol
+func parseSetVolLifecyclePara(r *http.Request) (name string, rule *proto.LifecycleRule, err error) {
 	r.ParseForm()
-	return checkNodeAddr(r)
-}
+	if name, err = checkVolPara(r); err != nil {
+		return
+	}
+	rule = &proto.LifecycleRule{ID: r.FormValue(ParaId), Prefix: r.FormValue(ParaPrefix), Action: r.FormValue(ParaAction)}
+	var value string
+	if value = r.FormValue(ParaDays); value == "" {
+		err = paraNotFound(ParaDays)
+		return
+	}
+	if rule.Days, err = strconv.Atoi(value); err != nil {
+		err = UnMatchPara
+		return
+	}
+	return
+}
+
+func parseDeleteVolLifecyclePara(r *http.Request) (name, id string, err error) {
+	r.ParseForm()
+	if name, err = checkVolPara(r); err != nil {
+		return
+	}
+	if id = r.FormValue(ParaId); id == "" {
+		err = paraNotFound(ParaId)
+		return
+	}
+	return
+}
+
+func parseSetVolMetaPlacementPara(r *http.Request) (name string, placement MetaPlacement, err error) {
+	r.ParseForm()
+	if name, err = checkVolPara(r); err != nil {
+		return
+	}
+	placement.Zone = r.FormValue(ParaZone)
+	placement.MemClass = r.FormValue(ParaMemClass)
+	for _, addr := range strings.Split(r.FormValue(ParaMetaNodes), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			placement.MetaNodes = append(placement.MetaNodes, addr)
+		}
+	}
+	return
+}
+
+func parseSetZonePara(r *http.Request) (name string, racks []string, err error) {
+	r.ParseForm()
+	if name = r.FormValue(ParaName); name == "" {
+		err = paraNotFound(ParaName)
+		return
+	}
+	racks = make([]string, 0)
+	for _, rack := range strings.Split(r.FormValue(ParaRacks), ",") {
+		if rack = strings.TrimSpace(rack); rack != "" {
+			racks = append(racks, rack)
+		}
+	}
+	return
+}
+
+func (m *Master) decommissionDataNode(w http.ResponseWriter, r *http.Request) {
+	var (
+		nodeAddr      string
+		maxMigrations int
+		dryRun        bool
+		plan          *MigrationPlan
+		err           error
+	)
+	if nodeAddr, maxMigrations, err = parseDecommissionDataNodePara(r); err != nil {
+		goto errDeal
+	}
+	if dryRun, err = parseDryRun(r); err != nil {
+		goto errDeal
+	}
+	if dryRun {
+		if plan, err = m.cluster.planDecommission(nodeAddr, maxMigrations); err != nil {
+			goto errDeal
+		}
+		if err = writeMigrationPlan(w, plan); err != nil {
+			goto errDeal
+		}
+		return
+	}
+	if err = m.cluster.decommissionDataNode(nodeAddr, maxMigrations); err != nil {
+		goto errDeal
+	}
+	io.WriteString(w, fmt.Sprintf("decommission dataNode[%v] started, maxMigrations[%v]", nodeAddr, maxMigrations))
+	return
+errDeal:
+	logMsg := getReturnMessage("decommissionDataNode", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) getDecommission(w http.ResponseWriter, r *http.Request) {
+	var (
+		nodeAddr string
+		view     *DecommissionView
+		body     []byte
+		err      error
+	)
+	if nodeAddr, err = parseDataNodeOfflinePara(r); err != nil {
+		goto errDeal
+	}
+	if view, err = m.cluster.getDecommissionView(nodeAddr); err != nil {
+		goto errDeal
+	}
+	if body, err = json.Marshal(view); err != nil {
+		goto errDeal
+	}
+	io.WriteString(w, string(body))
+	return
+errDeal:
+	logMsg := getReturnMessage("getDecommission", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) cancelDecommission(w http.ResponseWriter, r *http.Request) {
+	var (
+		nodeAddr string
+		err      error
+	)
+	if nodeAddr, err = parseDataNodeOfflinePara(r); err != nil {
+		goto errDeal
+	}
+	if err = m.cluster.cancelDecommission(nodeAddr); err != nil {
+		goto errDeal
+	}
+	io.WriteString(w, fmt.Sprintf("cancel decommission of dataNode[%v] success", nodeAddr))
+	return
+errDeal:
+	logMsg := getReturnMessage("cancelDecommission", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) listUsage(w http.ResponseWriter, r *http.Request) {
+	var (
+		name   string
+		usages []*VolUsage
+		body   []byte
+		err    error
+	)
+	if name, err = parseListUsagePara(r); err != nil {
+		goto errDeal
+	}
+	if usages, err = m.cluster.getVolUsages(name); err != nil {
+		goto errDeal
+	}
+	if body, err = json.Marshal(usages); err != nil {
+		goto errDeal
+	}
+	io.WriteString(w, string(body))
+	return
+errDeal:
+	logMsg := getReturnMessage("listUsage", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) getUsage(w http.ResponseWriter, r *http.Request) {
+	var (
+		name          string
+		statementTime int64
+		asCSV         bool
+		statement     *UsageStatement
+		body          []byte
+		err           error
+	)
+	if name, statementTime, asCSV, err = parseGetUsagePara(r); err != nil {
+		goto errDeal
+	}
+	if statement, err = m.cluster.getUsageStatement(name, statementTime); err != nil {
+		goto errDeal
+	}
+	if asCSV {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition",
+			fmt.Sprintf("attachment; filename=\"%v_%v.csv\"", statement.VolName, statement.Time))
+		if err = writeUsageStatementCSV(w, statement); err != nil {
+			log.LogErrorf("action[getUsage] vol[%v] time[%v] write csv: %v", name, statement.Time, err)
+		}
+		return
+	}
+	if body, err = json.Marshal(statement); err != nil {
+		goto errDeal
+	}
+	io.WriteString(w, string(body))
+	return
+errDeal:
+	logMsg := getReturnMessage("getUsage", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) createToken(w http.ResponseWriter, r *http.Request) {
+	var (
+		name      string
+		tokenType string
+		token     *Token
+		body      []byte
+		err       error
+	)
+	if name, tokenType, err = parseCreateTokenPara(r); err != nil {
+		goto errDeal
+	}
+	if token, err = m.cluster.createToken(name, tokenType); err != nil {
+		goto errDeal
+	}
+	if body, err = json.Marshal(token); err != nil {
+		goto errDeal
+	}
+	io.WriteString(w, string(body))
+	return
+errDeal:
+	logMsg := getReturnMessage("createToken", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) revokeToken(w http.ResponseWriter, r *http.Request) {
+	var (
+		name  string
+		value string
+		err   error
+	)
+	if name, value, err = parseTokenPara(r); err != nil {
+		goto errDeal
+	}
+	if err = m.cluster.revokeToken(name, value); err != nil {
+		goto errDeal
+	}
+	io.WriteString(w, fmt.Sprintf("revoke token of vol[%v] success", name))
+	return
+errDeal:
+	logMsg := getReturnMessage("revokeToken", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) rotateToken(w http.ResponseWriter, r *http.Request) {
+	var (
+		name  string
+		value string
+		token *Token
+		body  []byte
+		err   error
+	)
+	if name, value, err = parseTokenPara(r); err != nil {
+		goto errDeal
+	}
+	if token, err = m.cluster.rotateToken(name, value); err != nil {
+		goto errDeal
+	}
+	if body, err = json.Marshal(token); err != nil {
+		goto errDeal
+	}
+	io.WriteString(w, string(body))
+	return
+errDeal:
+	logMsg := getReturnMessage("rotateToken", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) listTokens(w http.ResponseWriter, r *http.Request) {
+	var (
+		name   string
+		tokens []*Token
+		body   []byte
+		err    error
+	)
+	if name, err = parseListTokensPara(r); err != nil {
+		goto errDeal
+	}
+	if tokens, err = m.cluster.listTokens(name); err != nil {
+		goto errDeal
+	}
+	if body, err = json.Marshal(tokens); err != nil {
+		goto errDeal
+	}
+	io.WriteString(w, string(body))
+	return
+errDeal:
+	logMsg := getReturnMessage("listTokens", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func writeMigrationPlan(w http.ResponseWriter, plan *MigrationPlan) (err error) {
+	var body []byte
+	if body, err = json.Marshal(plan); err != nil {
+		return
+	}
+	io.WriteString(w, string(body))
+	return
+}
+
+func (m *Master) getCluster(w http.ResponseWriter, r *http.Request) {
+	var (
+		body []byte
+		err  error
+	)
+	cv := &ClusterView{
+		Name:               m.cluster.Name,
+		LeaderAddr:         m.leaderInfo.addr,
+		CompactStatus:      m.cluster.compactStatus,
+		Applied:            m.fsm.applied,
+		MaxDataPartitionID: m.cluster.idAlloc.dataPartitionID,
+		MaxMetaNodeID:      m.cluster.idAlloc.metaNodeID,
+		MaxMetaPartitionID: m.cluster.idAlloc.metaPartitionID,
+		Vols:               make([]string, 0),
+		MetaNodes:          make([]MetaNodeView, 0),
+		DataNodes:          make([]DataNodeView, 0),
+	}
+
+	cv.Vols = m.cluster.getAllVols()
+	cv.MetaNodes = m.cluster.getAllMetaNodes()
+	cv.DataNodes = m.cluster.getAllDataNodes()
+	if body, err = json.Marshal(cv); err != nil {
+		goto errDeal
+	}
+	io.WriteString(w, string(body))
+	return
+
+errDeal:
+	logMsg := getReturnMessage("getCluster", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) getIpAndClusterName(w http.ResponseWriter, r *http.Request) {
+	cInfo := &proto.ClusterInfo{Cluster: m.cluster.Name, Ip: util.GetHost(r.RemoteAddr)}
+	cInfoBytes, err := json.Marshal(cInfo)
+	if err != nil {
+		goto errDeal
+	}
+	w.Write(cInfoBytes)
+	return
+errDeal:
+	rstMsg := getReturnMessage("getIpAndClusterName", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(rstMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) createMetaPartition(w http.ResponseWriter, r *http.Request) {
+	var (
+		volName string
+		start   uint64
+		rstMsg  string
+		err     error
+	)
+
+	if volName, start, err = parseCreateMetaPartitionPara(r); err != nil {
+		goto errDeal
+	}
+
+	if err = m.cluster.CreateMetaPartitionForManual(volName, start); err != nil {
+		goto errDeal
+	}
+
+	io.WriteString(w, fmt.Sprint("createMetaPartition request seccess"))
+	return
+errDeal:
+	rstMsg = getReturnMessage("createMetaPartition", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(rstMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) createDataPartition(w http.ResponseWriter, r *http.Request) {
+	var (
+		rstMsg                  string
+		volName                 string
+		partitionType           string
+		vol                     *Vol
+		reqCreateCount          int
+		capacity                int
+		lastTotalDataPartitions int
+		err                     error
+	)
+
+	if reqCreateCount, volName, partitionType, err = parseCreateDataPartitionPara(r); err != nil {
+		goto errDeal
+	}
+
+	if vol, err = m.cluster.getVol(volName); err != nil {
+		goto errDeal
+	}
+	capacity = m.cluster.getDataPartitionCapacity(vol)
+	lastTotalDataPartitions = len(vol.dataPartitions.dataPartitions)
+	for i := 0; i < reqCreateCount; i++ {
+		if (reqCreateCount + lastTotalDataPartitions) < len(vol.dataPartitions.dataPartitions) {
+			break
+		}
+		if _, err = m.cluster.createDataPartition(volName, partitionType); err != nil {
+			goto errDeal
+		}
+	}
+	rstMsg = fmt.Sprintf(" createDataPartition success. cluster capacity[%v],vol[%v] has %v data partitions last,%v data partitions now",
+		capacity, volName, lastTotalDataPartitions, len(vol.dataPartitions.dataPartitions))
+	io.WriteString(w, rstMsg)
+
+	return
+errDeal:
+	rstMsg = getReturnMessage("createDataPartition", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(rstMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) getDataPartition(w http.ResponseWriter, r *http.Request) {
+	var (
+		body        []byte
+		dp          *DataPartition
+		partitionID uint64
+		err         error
+	)
+	if partitionID, err = parseDataPartitionID(r); err != nil {
+		goto errDeal
+	}
+
+	if dp, err = m.cluster.getDataPartitionByID(partitionID); err != nil {
+		goto errDeal
+	}
+	if body, err = dp.toJson(); err != nil {
+		goto errDeal
+	}
+	io.WriteString(w, string(body))
+
+	return
+errDeal:
+	logMsg := getReturnMessage("getDataPartition", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) loadDataPartition(w http.ResponseWriter, r *http.Request) {
+	var (
+		volName     string
+		vol         *Vol
+		msg         string
+		dp          *DataPartition
+		partitionID uint64
+		err         error
+	)
+
+	if partitionID, volName, err = parseDataPartitionIDAndVol(r); err != nil {
+		goto errDeal
+	}
+
+	if vol, err = m.cluster.getVol(volName); err != nil {
+		goto errDeal
+	}
+	if dp, err = vol.getDataPartitionByID(partitionID); err != nil {
+		goto errDeal
+	}
+
+	m.cluster.loadDataPartitionAndCheckResponse(dp)
+	msg = fmt.Sprintf(AdminLoadDataPartition+"partitionID :%v  load data partition success", partitionID)
+	io.WriteString(w, msg)
+
+	return
+errDeal:
+	logMsg := getReturnMessage(AdminLoadDataPartition, r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) dataPartitionOffline(w http.ResponseWriter, r *http.Request) {
+	var (
+		volName     string
+		vol         *Vol
+		rstMsg      string
+		dp          *DataPartition
+		addr        string
+		partitionID uint64
+		dryRun      bool
+		plan        *MigrationPlan
+		err         error
+	)
+
+	if addr, partitionID, volName, err = parseDataPartitionOfflinePara(r); err != nil {
+		goto errDeal
+	}
+	if vol, err = m.cluster.getVol(volName); err != nil {
+		goto errDeal
+	}
+	if dp, err = vol.getDataPartitionByID(partitionID); err != nil {
+		goto errDeal
+	}
+	if dryRun, err = parseDryRun(r); err != nil {
+		goto errDeal
+	}
+	if dryRun {
+		if plan, err = m.cluster.planDataPartitionOffline(addr, dp); err != nil {
+			goto errDeal
+		}
+		if err = writeMigrationPlan(w, plan); err != nil {
+			goto errDeal
+		}
+		return
+	}
+	m.cluster.dataPartitionOffline(addr, volName, dp, HandleDataPartitionOfflineErr)
+	rstMsg = fmt.Sprintf(AdminDataPartitionOffline+" dataPartitionID :%v  on node:%v  has offline success", partitionID, addr)
+	io.WriteString(w, rstMsg)
+	return
+errDeal:
+	logMsg := getReturnMessage(AdminDataPartitionOffline, r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) addWarmReplica(w http.ResponseWriter, r *http.Request) {
+	var (
+		volName     string
+		vol         *Vol
+		rstMsg      string
+		dp          *DataPartition
+		addr        string
+		warmAddr    string
+		partitionID uint64
+		err         error
+	)
+
+	if addr, partitionID, volName, err = parseAddWarmReplicaPara(r); err != nil {
+		goto errDeal
+	}
+	if vol, err = m.cluster.getVol(volName); err != nil {
+		goto errDeal
+	}
+	if dp, err = vol.getDataPartitionByID(partitionID); err != nil {
+		goto errDeal
+	}
+	if warmAddr, err = m.cluster.addWarmReplica(volName, dp, addr); err != nil {
+		goto errDeal
+	}
+	rstMsg = fmt.Sprintf(AdminAddWarmReplica+" dataPartitionID :%v  add warm replica on node:%v success", partitionID, warmAddr)
+	io.WriteString(w, rstMsg)
+	return
+errDeal:
+	logMsg := getReturnMessage(AdminAddWarmReplica, r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) archiveDataPartition(w http.ResponseWriter, r *http.Request) {
+	m.changeDataPartitionArchive(w, r, AdminArchiveDataPartition, m.cluster.archiveDataPartition)
+}
+
+func (m *Master) rehydrateDataPartition(w http.ResponseWriter, r *http.Request) {
+	m.changeDataPartitionArchive(w, r, AdminRehydrateDataPart, m.cluster.rehydrateDataPartition)
+}
+
+func (m *Master) moveDataPartitionDisk(w http.ResponseWriter, r *http.Request) {
+	var (
+		volName     string
+		vol         *Vol
+		rstMsg      string
+		dp          *DataPartition
+		addr        string
+		disk        string
+		partitionID uint64
+		err         error
+	)
+
+	if addr, partitionID, volName, err = parseDataPartitionOfflinePara(r); err != nil {
+		goto errDeal
+	}
+	//the disk is chosen by the data node if not specified
+	disk = r.FormValue(ParaDisk)
+	if vol, err = m.cluster.getVol(volName); err != nil {
+		goto errDeal
+	}
+	if dp, err = vol.getDataPartitionByID(partitionID); err != nil {
+		goto errDeal
+	}
+	if err = m.cluster.moveDataPartitionDisk(addr, dp, disk); err != nil {
+		goto errDeal
+	}
+	rstMsg = fmt.Sprintf(AdminMoveDataPartDisk+" dataPartitionID :%v  on node:%v  move to disk[%v] sent", partitionID, addr, disk)
+	io.WriteString(w, rstMsg)
+	return
+errDeal:
+	logMsg := getReturnMessage(AdminMoveDataPartDisk, r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) changeDataPartitionArchive(w http.ResponseWriter, r *http.Request, route string, f func(dp *DataPartition) error) {
+	var (
+		volName     string
+		vol         *Vol
+		rstMsg      string
+		dp          *DataPartition
+		partitionID uint64
+		err         error
+	)
+
+	if partitionID, volName, err = parseDataPartitionIDAndVol(r); err != nil {
+		goto errDeal
+	}
+	if vol, err = m.cluster.getVol(volName); err != nil {
+		goto errDeal
+	}
+	if dp, err = vol.getDataPartitionByID(partitionID); err != nil {
+		goto errDeal
+	}
+	if err = f(dp); err != nil {
+		goto errDeal
+	}
+	rstMsg = fmt.Sprintf(route+" dataPartitionID :%v  %v", partitionID, dp.getArchiveStatus())
+	io.WriteString(w, rstMsg)
+	return
+errDeal:
+	logMsg := getReturnMessage(route, r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) repairDataPartition(w http.ResponseWriter, r *http.Request) {
+	m.checkDataPartition(w, r, AdminRepairDataPartition, m.cluster.repairDataPartition)
+}
+
+func (m *Master) verifyDataPartition(w http.ResponseWriter, r *http.Request) {
+	m.checkDataPartition(w, r, AdminVerifyDataPartition, m.cluster.verifyDataPartition)
+}
+
+/*the result is in the replicas of the partition once the data nodes answered*/
+func (m *Master) checkDataPartition(w http.ResponseWriter, r *http.Request, route string, f func(dp *DataPartition) error) {
+	var (
+		volName     string
+		vol         *Vol
+		dp          *DataPartition
+		partitionID uint64
+		err         error
+	)
+
+	if partitionID, volName, err = parseDataPartitionIDAndVol(r); err != nil {
+		goto errDeal
+	}
+	if vol, err = m.cluster.getVol(volName); err != nil {
+		goto errDeal
+	}
+	if dp, err = vol.getDataPartitionByID(partitionID); err != nil {
+		goto errDeal
+	}
+	if err = f(dp); err != nil {
+		goto errDeal
+	}
+	io.WriteString(w, fmt.Sprintf(route+" dataPartitionID :%v  sent", partitionID))
+	return
+errDeal:
+	logMsg := getReturnMessage(route, r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) sealDataPartition(w http.ResponseWriter, r *http.Request) {
+	var (
+		volName     string
+		vol         *Vol
+		dp          *DataPartition
+		partitionID uint64
+		sealed      bool
+		err         error
+	)
+
+	if partitionID, volName, sealed, err = parseSealDataPartitionPara(r); err != nil {
+		goto errDeal
+	}
+	if vol, err = m.cluster.getVol(volName); err != nil {
+		goto errDeal
+	}
+	if dp, err = vol.getDataPartitionByID(partitionID); err != nil {
+		goto errDeal
+	}
+	if err = m.cluster.sealDataPartition(dp, sealed); err != nil {
+		goto errDeal
+	}
+	io.WriteString(w, fmt.Sprintf(AdminSealDataPartition+" dataPartitionID :%v  sealed[%v]", partitionID, sealed))
+	return
+errDeal:
+	logMsg := getReturnMessage(AdminSealDataPartition, r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+type VolArchiveView struct {
+	Name       string
+	Partitions int               //partitions the archive or rehydration is started for
+	Failed     map[uint64]string //partitions rejected and the reasons
+}
+
+func (m *Master) archiveVol(w http.ResponseWriter, r *http.Request) {
+	m.changeVolArchive(w, r, AdminArchiveVol, func(name string) (int, map[uint64]string, error) {
+		sealedOnly, err := parseSealedOnly(r)
+		if err != nil {
+			return 0, nil, err
+		}
+		return m.cluster.archiveVol(name, sealedOnly)
+	})
+}
+
+func (m *Master) rehydrateVol(w http.ResponseWriter, r *http.Request) {
+	m.changeVolArchive(w, r, AdminRehydrateVol, m.cluster.rehydrateVol)
+}
+
+func (m *Master) changeVolArchive(w http.ResponseWriter, r *http.Request, route string,
+	f func(name string) (int, map[uint64]string, error)) {
+	var (
+		body []byte
+		view *VolArchiveView
+		err  error
+	)
+	view = &VolArchiveView{}
+	if view.Name, err = parseArchiveVolPara(r); err != nil {
+		goto errDeal
+	}
+	if view.Partitions, view.Failed, err = f(view.Name); err != nil {
+		goto errDeal
+	}
+	if body, err = json.Marshal(view); err != nil {
+		goto errDeal
+	}
+	io.WriteString(w, string(body))
+	return
+errDeal:
+	logMsg := getReturnMessage(route, r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) repairVol(w http.ResponseWriter, r *http.Request) {
+	m.checkVol(w, r, AdminRepairVol, m.cluster.repairDataPartition)
+}
+
+func (m *Master) verifyVol(w http.ResponseWriter, r *http.Request) {
+	m.checkVol(w, r, AdminVerifyVol, m.cluster.verifyDataPartition)
+}
+
+func (m *Master) checkVol(w http.ResponseWriter, r *http.Request, route string, f func(dp *DataPartition) error) {
+	var (
+		body []byte
+		view *VolCheckView
+		err  error
+	)
+	view = &VolCheckView{}
+	if view.Name, err = parseArchiveVolPara(r); err != nil {
+		goto errDeal
+	}
+	if view.Partitions, view.Failed, err = m.cluster.rangeVolCheck(view.Name, f); err != nil {
+		goto errDeal
+	}
+	if body, err = json.Marshal(view); err != nil {
+		goto errDeal
+	}
+	io.WriteString(w, string(body))
+	return
+errDeal:
+	logMsg := getReturnMessage(route, r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) markDeleteVol(w http.ResponseWriter, r *http.Request) {
+	var (
+		name string
+		err  error
+		msg  string
+	)
+
+	if name, err = parseDeleteVolPara(r); err != nil {
+		goto errDeal
+	}
+	if err = m.cluster.markDeleteVol(name); err != nil {
+		goto errDeal
+	}
+	msg = fmt.Sprintf("delete vol[%v] successed\n", name)
+	log.LogWarn(msg)
+	io.WriteString(w, msg)
+	return
+
+errDeal:
+	logMsg := getReturnMessage("markDeleteVol", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) setVolImmutable(w http.ResponseWriter, r *http.Request) {
+	var (
+		name      string
+		immutable bool
+		err       error
+		msg       string
+	)
+	if name, immutable, err = parseSetVolImmutablePara(r); err != nil {
+		goto errDeal
+	}
+	if err = m.cluster.setVolImmutable(name, immutable); err != nil {
+		goto errDeal
+	}
+	msg = fmt.Sprintf("set vol[%v] immutable to %v success, mounted clients must remount to apply it\n", name, immutable)
+	log.LogWarn(msg)
+	io.WriteString(w, msg)
+	return
+errDeal:
+	logMsg := getReturnMessage("setVolImmutable", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) setVolSyncOnClose(w http.ResponseWriter, r *http.Request) {
+	var (
+		name        string
+		syncOnClose bool
+		err         error
+		msg         string
+	)
+	if name, syncOnClose, err = parseSetVolSyncOnClosePara(r); err != nil {
+		goto errDeal
+	}
+	if err = m.cluster.setVolSyncOnClose(name, syncOnClose); err != nil {
+		goto errDeal
+	}
+	msg = fmt.Sprintf("set vol[%v] syncOnClose to %v success, mounted clients must remount to apply it\n", name, syncOnClose)
+	log.LogWarn(msg)
+	io.WriteString(w, msg)
+	return
+errDeal:
+	logMsg := getReturnMessage("setVolSyncOnClose", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) setVolFollowerRead(w http.ResponseWriter, r *http.Request) {
+	var (
+		name         string
+		followerRead bool
+		err          error
+		msg          string
+	)
+	if name, followerRead, err = parseSetVolFollowerReadPara(r); err != nil {
+		goto errDeal
+	}
+	if err = m.cluster.setVolFollowerRead(name, followerRead); err != nil {
+		goto errDeal
+	}
+	msg = fmt.Sprintf("set vol[%v] followerRead to %v success, mounted clients must remount to apply it\n", name, followerRead)
+	log.LogWarn(msg)
+	io.WriteString(w, msg)
+	return
+errDeal:
+	logMsg := getReturnMessage("setVolFollowerRead", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) setVolAudit(w http.ResponseWriter, r *http.Request) {
+	var (
+		name  string
+		audit bool
+		err   error
+		msg   string
+	)
+	if name, audit, err = parseSetVolAuditPara(r); err != nil {
+		goto errDeal
+	}
+	if err = m.cluster.setVolAudit(name, audit); err != nil {
+		goto errDeal
+	}
+	msg = fmt.Sprintf("set vol[%v] audit to %v success\n", name, audit)
+	log.LogWarn(msg)
+	io.WriteString(w, msg)
+	return
+errDeal:
+	logMsg := getReturnMessage("setVolAudit", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) setVolErasureCode(w http.ResponseWriter, r *http.Request) {
+	var (
+		name        string
+		erasureCode bool
+		err         error
+		msg         string
+	)
+	if name, erasureCode, err = parseSetVolAuditPara(r); err != nil {
+		goto errDeal
+	}
+	if err = m.cluster.setVolErasureCode(name, erasureCode); err != nil {
+		goto errDeal
+	}
+	msg = fmt.Sprintf("set vol[%v] erasure code to %v success\n", name, erasureCode)
+	log.LogWarn(msg)
+	io.WriteString(w, msg)
+	return
+errDeal:
+	logMsg := getReturnMessage("setVolErasureCode", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) setVolReadOnly(w http.ResponseWriter, r *http.Request) {
+	var (
+		name     string
+		readOnly bool
+		err      error
+		msg      string
+	)
+	if name, readOnly, err = parseSetVolReadOnlyPara(r); err != nil {
+		goto errDeal
+	}
+	if err = m.cluster.setVolReadOnly(name, readOnly); err != nil {
+		goto errDeal
+	}
+	msg = fmt.Sprintf("set vol[%v] readOnly to %v success\n", name, readOnly)
+	log.LogWarn(msg)
+	io.WriteString(w, msg)
+	return
+errDeal:
+	logMsg := getReturnMessage("setVolReadOnly", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) setVolPermission(w http.ResponseWriter, r *http.Request) {
+	var (
+		name       string
+		permission bool
+		err        error
+		msg        string
+	)
+	if name, permission, err = parseSetVolPermissionPara(r); err != nil {
+		goto errDeal
+	}
+	if err = m.cluster.setVolPermission(name, permission); err != nil {
+		goto errDeal
+	}
+	msg = fmt.Sprintf("set vol[%v] permission to %v success\n", name, permission)
+	log.LogWarn(msg)
+	io.WriteString(w, msg)
+	return
+errDeal:
+	logMsg := getReturnMessage("setVolPermission", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) setVolCompression(w http.ResponseWriter, r *http.Request) {
+	var (
+		name        string
+		compression string
+		err         error
+		msg         string
+	)
+	if name, compression, err = parseSetVolCompressionPara(r); err != nil {
+		goto errDeal
+	}
+	if err = m.cluster.setVolCompression(name, compression); err != nil {
+		goto errDeal
+	}
+	msg = fmt.Sprintf("set vol[%v] compression to [%v] success, the blob objects written from now are compressed\n", name, compression)
+	log.LogWarn(msg)
+	io.WriteString(w, msg)
+	return
+errDeal:
+	logMsg := getReturnMessage("setVolCompression", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) setVolColdTier(w http.ResponseWriter, r *http.Request) {
+	var (
+		name string
+		days int
+		err  error
+		msg  string
+	)
+	if name, days, err = parseSetVolColdTierPara(r); err != nil {
+		goto errDeal
+	}
+	if err = m.cluster.setVolColdTier(name, days); err != nil {
+		goto errDeal
+	}
+	msg = fmt.Sprintf("set vol[%v] cold tier days to [%v] success\n", name, days)
+	log.LogWarn(msg)
+	io.WriteString(w, msg)
+	return
+errDeal:
+	logMsg := getReturnMessage("setVolColdTier", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) setVolDegradedWrite(w http.ResponseWriter, r *http.Request) {
+	var (
+		name          string
+		degradedWrite string
+		err           error
+		msg           string
+	)
+	if name, degradedWrite, err = parseSetVolDegradedWritePara(r); err != nil {
+		goto errDeal
+	}
+	if err = m.cluster.setVolDegradedWrite(name, degradedWrite); err != nil {
+		goto errDeal
+	}
+	msg = fmt.Sprintf("set vol[%v] degradedWrite to [%v] success, applied from the next check of the dataPartitions\n", name, degradedWrite)
+	log.LogWarn(msg)
+	io.WriteString(w, msg)
+	return
+errDeal:
+	logMsg := getReturnMessage("setVolDegradedWrite", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) setVolEncryption(w http.ResponseWriter, r *http.Request) {
+	var (
+		name      string
+		encrypted bool
+		err       error
+		msg       string
+	)
+	if name, encrypted, err = parseSetVolEncryptionPara(r); err != nil {
+		goto errDeal
+	}
+	if err = m.cluster.setVolEncryption(name, encrypted); err != nil {
+		goto errDeal
+	}
+	msg = fmt.Sprintf("set vol[%v] encryption to %v success, the data partitions created from now apply it\n", name, encrypted)
+	log.LogWarn(msg)
+	io.WriteString(w, msg)
+	return
+errDeal:
+	logMsg := getReturnMessage("setVolEncryption", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) setVolQuota(w http.ResponseWriter, r *http.Request) {
+	var (
+		name  string
+		quota uint64
+		err   error
+		msg   string
+	)
+	if name, quota, err = parseSetVolQuotaPara(r); err != nil {
+		goto errDeal
+	}
+	if err = m.cluster.setVolQuota(name, quota); err != nil {
+		goto errDeal
+	}
+	msg = fmt.Sprintf("set vol[%v] quota to %v bytes success\n", name, quota)
+	log.LogWarn(msg)
+	io.WriteString(w, msg)
+	return
+errDeal:
+	logMsg := getReturnMessage("setVolQuota", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) resizeVol(w http.ResponseWriter, r *http.Request) {
+	var (
+		name     string
+		capacity uint64
+		err      error
+		msg      string
+	)
+	if name, capacity, err = parseSetVolQuotaPara(r); err != nil {
+		goto errDeal
+	}
+	if err = m.cluster.resizeVol(name, capacity); err != nil {
+		goto errDeal
+	}
+	msg = fmt.Sprintf("resize vol[%v] to %v bytes started\n", name, capacity)
+	log.LogWarn(msg)
+	io.WriteString(w, msg)
+	return
+errDeal:
+	logMsg := getReturnMessage("resizeVol", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) getVolResize(w http.ResponseWriter, r *http.Request) {
+	var (
+		name string
+		view *VolResizeView
+		body []byte
+		err  error
+	)
+	r.ParseForm()
+	if name, err = checkVolPara(r); err != nil {
+		goto errDeal
+	}
+	if view, err = m.cluster.getVolResizeView(name); err != nil {
+		goto errDeal
+	}
+	if body, err = json.Marshal(view); err != nil {
+		goto errDeal
+	}
+	io.WriteString(w, string(body))
+	return
+errDeal:
+	logMsg := getReturnMessage("getVolResize", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) setVolLimits(w http.ResponseWriter, r *http.Request) {
+	var (
+		name        string
+		maxFileSize uint64
+		maxFiles    uint64
+		err         error
+		msg         string
+	)
+	if name, maxFileSize, maxFiles, err = parseSetVolLimitsPara(r); err != nil {
+		goto errDeal
+	}
+	if err = m.cluster.setVolLimits(name, maxFileSize, maxFiles); err != nil {
+		goto errDeal
+	}
+	msg = fmt.Sprintf("set vol[%v] maxFileSize to %v bytes maxFiles to %v success\n", name, maxFileSize, maxFiles)
+	log.LogWarn(msg)
+	io.WriteString(w, msg)
+	return
+errDeal:
+	logMsg := getReturnMessage("setVolLimits", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) createVol(w http.ResponseWriter, r *http.Request) {
+	var (
+		name        string
+		err         error
+		msg         string
+		volType     string
+		replicaNum  int
+		replication string
+	)
+
+	if name, volType, replicaNum, replication, err = parseCreateVolPara(r); err != nil {
+		goto errDeal
+	}
+	if err = m.cluster.createVol(name, volType, uint8(replicaNum), replication); err != nil {
+		goto errDeal
+	}
+	msg = fmt.Sprintf("create vol[%v] successed\n", name)
+	io.WriteString(w, msg)
+	return
+
+errDeal:
+	logMsg := getReturnMessage("createVol", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) addDataNode(w http.ResponseWriter, r *http.Request) {
+	var (
+		nodeAddr    string
+		clientAddr  string
+		replicaAddr string
+		rack        string
+		zone        string
+		id          uint64
+		err         error
+	)
+	if nodeAddr, clientAddr, replicaAddr, rack, zone, err = parseAddDataNodePara(r); err != nil {
+		goto errDeal
+	}
+
+	if id, err = m.cluster.addDataNode(nodeAddr, clientAddr, replicaAddr, rack, zone); err != nil {
+		goto errDeal
+	}
+	io.WriteString(w, fmt.Sprintf("%v", id))
+	return
+errDeal:
+	logMsg := getReturnMessage("addDataNode", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) getDataNode(w http.ResponseWriter, r *http.Request) {
+	var (
+		nodeAddr string
+		dataNode *DataNode
+		body     []byte
+		err      error
+	)
+	if nodeAddr, err = parseGetDataNodePara(r); err != nil {
+		goto errDeal
+	}
+
+	if dataNode, err = m.cluster.getDataNodeByAdvertisedAddr(nodeAddr); err != nil {
+		goto errDeal
+	}
+	if body, err = dataNode.toJson(); err != nil {
+		goto errDeal
+	}
+	io.WriteString(w, string(body))
+
+	return
+errDeal:
+	logMsg := getReturnMessage("getDataNode", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) dataNodeOffline(w http.ResponseWriter, r *http.Request) {
+	var (
+		node        *DataNode
+		rstMsg      string
+		offLineAddr string
+		dryRun      bool
+		plan        *MigrationPlan
+		err         error
+	)
+
+	if offLineAddr, err = parseDataNodeOfflinePara(r); err != nil {
+		goto errDeal
+	}
+	if dryRun, err = parseDryRun(r); err != nil {
+		goto errDeal
+	}
+	if dryRun {
+		if plan, err = m.cluster.planDataNodeOffline(offLineAddr); err != nil {
+			goto errDeal
+		}
+		if err = writeMigrationPlan(w, plan); err != nil {
+			goto errDeal
+		}
+		return
+	}
+
+	if node, err = m.cluster.getDataNode(offLineAddr); err != nil {
+		goto errDeal
+	}
+	m.cluster.dataNodeOffLine(node)
+	rstMsg = fmt.Sprintf("dataNodeOffline node [%v] has offline SUCCESS", offLineAddr)
+	io.WriteString(w, rstMsg)
+	return
+errDeal:
+	logMsg := getReturnMessage("dataNodeOffline", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) dataNodeTaskResponse(w http.ResponseWriter, r *http.Request) {
+	var (
+		dataNode *DataNode
+		code     = http.StatusOK
+		tr       *proto.AdminTask
+		err      error
+	)
+
+	if tr, err = parseTaskResponse(r); err != nil {
+		code = http.StatusBadRequest
+		goto errDeal
+	}
+	io.WriteString(w, fmt.Sprintf("%v", http.StatusOK))
+	if dataNode, err = m.cluster.getDataNode(tr.OperatorAddr); err != nil {
+		code = http.StatusInternalServerError
+		goto errDeal
+	}
+
+	m.cluster.dealDataNodeTaskResponse(dataNode.Addr, tr)
+
+	return
+
+errDeal:
+	logMsg := getReturnMessage("dataNodeTaskResponse", r.RemoteAddr, err.Error(),
+		http.StatusBadRequest)
+	HandleError(logMsg, err, code, w)
+	return
+}
+
+func (m *Master) renewLeaderLeases(w http.ResponseWriter, r *http.Request) {
+	var (
+		body []byte
+		code = http.StatusBadRequest
+		req  *proto.LeaderLeaseRequest
+		resp = &proto.LeaderLeaseResponse{}
+		err  error
+	)
+	if req, err = parseLeaderLeaseRequest(r); err != nil {
+		goto errDeal
+	}
+	if resp.Leases, err = m.cluster.grantLeaderLeases(req.Addr, req.PartitionIDs); err != nil {
+		code = http.StatusInternalServerError
+		goto errDeal
+	}
+	if body, err = json.Marshal(resp); err != nil {
+		code = http.StatusMethodNotAllowed
+		goto errDeal
+	}
+	w.Write(body)
+	return
+errDeal:
+	logMsg := getReturnMessage("renewLeaderLeases", r.RemoteAddr, err.Error(), code)
+	HandleError(logMsg, err, code, w)
+	return
+}
+
+func (m *Master) getReplicaHosts(w http.ResponseWriter, r *http.Request) {
+	var (
+		body []byte
+		code = http.StatusBadRequest
+		req  *proto.ReplicaHostsRequest
+		resp = &proto.ReplicaHostsResponse{}
+		err  error
+	)
+	if req, err = parseReplicaHostsRequest(r); err != nil {
+		goto errDeal
+	}
+	resp.Partitions = m.cluster.getPartitionHosts(req.PartitionIDs)
+	if body, err = json.Marshal(resp); err != nil {
+		code = http.StatusMethodNotAllowed
+		goto errDeal
+	}
+	w.Write(body)
+	return
+errDeal:
+	logMsg := getReturnMessage("getReplicaHosts", r.RemoteAddr, err.Error(), code)
+	HandleError(logMsg, err, code, w)
+	return
+}
+
+/*the extents of the files expired by a lifecycle rule, sent by the meta node walking the vol*/
+func (m *Master) tierExtents(w http.ResponseWriter, r *http.Request) {
+	var (
+		req *proto.LifecycleTierRequest
+		err error
+	)
+	if req, err = parseLifecycleTierRequest(r); err != nil {
+		goto errDeal
+	}
+	if _, err = m.cluster.getVol(req.VolName); err != nil {
+		goto errDeal
+	}
+	m.cluster.tierExtents(req.VolName, req.Extents)
+	io.WriteString(w, fmt.Sprintf("tier the extents of %v partitions of vol[%v] success", len(req.Extents), req.VolName))
+	return
+errDeal:
+	logMsg := getReturnMessage("tierExtents", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
+func (m *Master) addMetaNode(w http.ResponseWriter, r *http.Request) {
+	var (
+		nodeAddr string
+		id       uint64
+		err      error
+	)
+	if nodeAddr, err = parseAddMetaNodePara(r); err != nil {
+		goto errDeal
+	}
+
+	if id, err = m.cluster.addMetaNode(nodeAddr); err != nil {
+		goto errDeal
+	}
+	io.WriteString(w, fmt.Sprintf("%v", id))
+	return
+errDeal:
+	logMsg := getReturnMessage("addMetaNode", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
 
-func parseAddDataNodePara(r *http.Request) (nodeAddr string, err error) {
+func parseAddMetaNodePara(r *http.Request) (nodeAddr string, err error) {
 	r.ParseForm()
 	return checkNodeAddr(r)
 }
 
+func parseAddDataNodePara(r *http.Request) (nodeAddr, clientAddr, replicaAddr, rack, zone string, err error) {
+	r.ParseForm()
+	if nodeAddr, err = checkNodeAddr(r); err != nil {
+		return
+	}
+	if clientAddr = r.FormValue(ParaClientAddr); clientAddr == "" {
+		clientAddr = nodeAddr
+	}
+	if replicaAddr = r.FormValue(ParaReplicaAddr); replicaAddr == "" {
+		replicaAddr = nodeAddr
+	}
+	rack = r.FormValue(ParaRack)
+	zone = r.FormValue(ParaZone)
+	return
+}
+
 func (m *Master) getMetaNode(w http.ResponseWriter, r *http.Request) {
 	var (
 		nodeAddr string
@@ -660,48 +1996,105 @@ func parseRaftNodePara(r *http.Request) (id uint64, host string, err error) {
 		return
 	}
 
-	if arr := strings.Split(host, ColonSplit); len(arr) < 2 {
+	if _, _, err = net.SplitHostPort(host); err != nil {
 		err = UnMatchPara
 		return
 	}
 	return
 }
 
-func parseGetMetaNodePara(r *http.Request) (nodeAddr string, err error) {
+func parseGetMetaNodePara(r *http.Request) (nodeAddr string, err error) {
+	r.ParseForm()
+	return checkNodeAddr(r)
+}
+
+func parseGetDataNodePara(r *http.Request) (nodeAddr string, err error) {
+	r.ParseForm()
+	return checkNodeAddr(r)
+}
+
+func parseDataNodeOfflinePara(r *http.Request) (nodeAddr string, err error) {
+	r.ParseForm()
+	return checkNodeAddr(r)
+}
+
+func parseTaskResponse(r *http.Request) (tr *proto.AdminTask, err error) {
+	var body []byte
+	r.ParseForm()
+
+	if body, err = ioutil.ReadAll(r.Body); err != nil {
+		return
+	}
+	tr = &proto.AdminTask{}
+	decoder := json.NewDecoder(bytes.NewBuffer([]byte(body)))
+	decoder.UseNumber()
+	err = decoder.Decode(tr)
+	return
+}
+
+func parseLeaderLeaseRequest(r *http.Request) (req *proto.LeaderLeaseRequest, err error) {
+	var body []byte
+	if body, err = ioutil.ReadAll(r.Body); err != nil {
+		return
+	}
+	req = &proto.LeaderLeaseRequest{}
+	err = json.Unmarshal(body, req)
+	return
+}
+
+func parseReplicaHostsRequest(r *http.Request) (req *proto.ReplicaHostsRequest, err error) {
+	var body []byte
+	if body, err = ioutil.ReadAll(r.Body); err != nil {
+		return
+	}
+	req = &proto.ReplicaHostsRequest{}
+	err = json.Unmarshal(body, req)
+	return
+}
+
+func parseLifecycleTierRequest(r *http.Request) (req *proto.LifecycleTierRequest, err error) {
+	var body []byte
+	if body, err = ioutil.ReadAll(r.Body); err != nil {
+		return
+	}
+	req = &proto.LifecycleTierRequest{}
+	err = json.Unmarshal(body, req)
+	return
+}
+
+func parseDeleteVolPara(r *http.Request) (name string, err error) {
 	r.ParseForm()
-	return checkNodeAddr(r)
+	return checkVolPara(r)
 }
 
-func parseGetDataNodePara(r *http.Request) (nodeAddr string, err error) {
+func parseArchiveVolPara(r *http.Request) (name string, err error) {
 	r.ParseForm()
-	return checkNodeAddr(r)
+	return checkVolPara(r)
 }
 
-func parseDataNodeOfflinePara(r *http.Request) (nodeAddr string, err error) {
-	r.ParseForm()
-	return checkNodeAddr(r)
+func parseSealedOnly(r *http.Request) (sealedOnly bool, err error) {
+	if value := r.FormValue(ParaSealed); value != "" {
+		if sealedOnly, err = strconv.ParseBool(value); err != nil {
+			err = UnMatchPara
+		}
+	}
+	return
 }
 
-func parseTaskResponse(r *http.Request) (tr *proto.AdminTask, err error) {
-	var body []byte
-	r.ParseForm()
-
-	if body, err = ioutil.ReadAll(r.Body); err != nil {
+func parseSealDataPartitionPara(r *http.Request) (ID uint64, name string, sealed bool, err error) {
+	if ID, name, err = parseDataPartitionIDAndVol(r); err != nil {
 		return
 	}
-	tr = &proto.AdminTask{}
-	decoder := json.NewDecoder(bytes.NewBuffer([]byte(body)))
-	decoder.UseNumber()
-	err = decoder.Decode(tr)
+	sealed = true
+	if value := r.FormValue(ParaEnable); value != "" {
+		if sealed, err = strconv.ParseBool(value); err != nil {
+			err = UnMatchPara
+		}
+	}
 	return
 }
 
-func parseDeleteVolPara(r *http.Request) (name string, err error) {
-	r.ParseForm()
-	return checkVolPara(r)
-}
-
-func parseCreateVolPara(r *http.Request) (name, volType string, replicaNum int, err error) {
+func parseCreateVolPara(r *http.Request) (name, volType string, replicaNum int, replication string, err error) {
 	r.ParseForm()
 	if name, err = checkVolPara(r); err != nil {
 		return
@@ -715,6 +2108,11 @@ func parseCreateVolPara(r *http.Request) (name, volType string, replicaNum int,
 	if volType, err = parseDataPartitionType(r); err != nil {
 		return
 	}
+	// only the extent partitions are replicated by raft
+	if replication = r.FormValue(ParaReplication); replication != "" &&
+		(replication != proto.ReplicationRaft || volType != proto.ExtentPartition) {
+		err = UnMatchPara
+	}
 	return
 }
 
@@ -789,6 +2187,19 @@ func parseDataPartitionOfflinePara(r *http.Request) (nodeAddr string, ID uint64,
 	return
 }
 
+func parseAddWarmReplicaPara(r *http.Request) (nodeAddr string, ID uint64, name string, err error) {
+	r.ParseForm()
+	if ID, err = checkDataPartitionID(r); err != nil {
+		return
+	}
+	if name, err = checkVolPara(r); err != nil {
+		return
+	}
+	//the node of the warm replica is chosen by master if addr is not specified
+	nodeAddr = r.FormValue(ParaNodeAddr)
+	return
+}
+
 func checkNodeAddr(r *http.Request) (nodeAddr string, err error) {
 	if nodeAddr = r.FormValue(ParaNodeAddr); nodeAddr == "" {
 		err = paraNotFound(ParaNodeAddr)
@@ -822,6 +2233,220 @@ func parseMetaPartitionOffline(r *http.Request) (volName, nodeAddr string, parti
 	return
 }
 
+func parseEvictClientPara(r *http.Request) (name, id string, fenceSeconds int64, err error) {
+	if name, id, err = parseClientSessionPara(r); err != nil {
+		return
+	}
+	fenceSeconds = DefaultClientFenceSeconds
+	if value := r.FormValue(ParaFenceTime); value != "" {
+		if fenceSeconds, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return
+		}
+		if fenceSeconds <= 0 {
+			err = errors.Errorf("invalid %v(%v)", ParaFenceTime, value)
+			return
+		}
+	}
+	return
+}
+
+//the compression is lz4, zstd or none
+func parseSetVolCompressionPara(r *http.Request) (name, compression string, err error) {
+	r.ParseForm()
+	if name, err = checkVolPara(r); err != nil {
+		return
+	}
+	switch value := r.FormValue(ParaCompression); value {
+	case "":
+		err = paraNotFound(ParaCompression)
+	case "none":
+		compression = proto.CompressionNone
+	case proto.CompressionLZ4, proto.CompressionZstd:
+		compression = value
+	default:
+		err = UnMatchPara
+	}
+	return
+}
+
+//the days an extent is not read before tiered, 0 keeps the extents local
+func parseSetVolColdTierPara(r *http.Request) (name string, days int, err error) {
+	r.ParseForm()
+	if name, err = checkVolPara(r); err != nil {
+		return
+	}
+	var value string
+	if value = r.FormValue(ParaDays); value == "" {
+		err = paraNotFound(ParaDays)
+		return
+	}
+	if days, err = strconv.Atoi(value); err != nil || days < 0 {
+		err = UnMatchPara
+		return
+	}
+	return
+}
+
+//the degradedWrite is healthy, backfill or block
+func parseSetVolDegradedWritePara(r *http.Request) (name, degradedWrite string, err error) {
+	r.ParseForm()
+	if name, err = checkVolPara(r); err != nil {
+		return
+	}
+	switch value := r.FormValue(ParaDegradedWrite); value {
+	case "":
+		err = paraNotFound(ParaDegradedWrite)
+	case DegradedWriteHealthy, DegradedWriteBackfill, DegradedWriteBlock:
+		degradedWrite = value
+	default:
+		err = UnMatchPara
+	}
+	return
+}
+
+//the capacity is in GB, 0 removes the quota
+func parseSetVolQuotaPara(r *http.Request) (name string, quota uint64, err error) {
+	r.ParseForm()
+	if name, err = checkVolPara(r); err != nil {
+		return
+	}
+	var value string
+	if value = r.FormValue(ParaCapacity); value == "" {
+		err = paraNotFound(ParaCapacity)
+		return
+	}
+	if quota, err = strconv.ParseUint(value, 10, 64); err != nil {
+		err = UnMatchPara
+		return
+	}
+	quota = quota * util.GB
+	return
+}
+
+//the max file size is in bytes, 0 removes the limit
+func parseSetVolLimitsPara(r *http.Request) (name string, maxFileSize, maxFiles uint64, err error) {
+	r.ParseForm()
+	if name, err = checkVolPara(r); err != nil {
+		return
+	}
+	var value string
+	if value = r.FormValue(ParaMaxFileSize); value == "" {
+		err = paraNotFound(ParaMaxFileSize)
+		return
+	}
+	if maxFileSize, err = strconv.ParseUint(value, 10, 64); err != nil {
+		err = UnMatchPara
+		return
+	}
+	if value = r.FormValue(ParaMaxFiles); value == "" {
+		err = paraNotFound(ParaMaxFiles)
+		return
+	}
+	if maxFiles, err = strconv.ParseUint(value, 10, 64); err != nil {
+		err = UnMatchPara
+		return
+	}
+	return
+}
+
+func parseSetVolImmutablePara(r *http.Request) (name string, immutable bool, err error) {
+	r.ParseForm()
+	if name, err = checkVolPara(r); err != nil {
+		return
+	}
+	var value string
+	if value = r.FormValue(ParaEnable); value == "" {
+		err = ParaEnableNotFound
+		return
+	}
+	immutable, err = strconv.ParseBool(value)
+	return
+}
+
+func parseSetVolSyncOnClosePara(r *http.Request) (name string, syncOnClose bool, err error) {
+	r.ParseForm()
+	if name, err = checkVolPara(r); err != nil {
+		return
+	}
+	var value string
+	if value = r.FormValue(ParaEnable); value == "" {
+		err = ParaEnableNotFound
+		return
+	}
+	syncOnClose, err = strconv.ParseBool(value)
+	return
+}
+
+func parseSetVolFollowerReadPara(r *http.Request) (name string, followerRead bool, err error) {
+	r.ParseForm()
+	if name, err = checkVolPara(r); err != nil {
+		return
+	}
+	var value string
+	if value = r.FormValue(ParaEnable); value == "" {
+		err = ParaEnableNotFound
+		return
+	}
+	followerRead, err = strconv.ParseBool(value)
+	return
+}
+
+func parseSetVolAuditPara(r *http.Request) (name string, audit bool, err error) {
+	r.ParseForm()
+	if name, err = checkVolPara(r); err != nil {
+		return
+	}
+	var value string
+	if value = r.FormValue(ParaEnable); value == "" {
+		err = ParaEnableNotFound
+		return
+	}
+	audit, err = strconv.ParseBool(value)
+	return
+}
+
+func parseSetVolReadOnlyPara(r *http.Request) (name string, readOnly bool, err error) {
+	r.ParseForm()
+	if name, err = checkVolPara(r); err != nil {
+		return
+	}
+	var value string
+	if value = r.FormValue(ParaEnable); value == "" {
+		err = ParaEnableNotFound
+		return
+	}
+	readOnly, err = strconv.ParseBool(value)
+	return
+}
+
+func parseSetVolPermissionPara(r *http.Request) (name string, permission bool, err error) {
+	r.ParseForm()
+	if name, err = checkVolPara(r); err != nil {
+		return
+	}
+	var value string
+	if value = r.FormValue(ParaEnable); value == "" {
+		err = ParaEnableNotFound
+		return
+	}
+	permission, err = strconv.ParseBool(value)
+	return
+}
+
+func parseSetVolEncryptionPara(r *http.Request) (name string, encrypted bool, err error) {
+	r.ParseForm()
+	if name, err = checkVolPara(r); err != nil {
+		return
+	}
+	var value string
+	if value = r.FormValue(ParaEnable); value == "" {
+		err = ParaEnableNotFound
+		return
+	}
+	encrypted, err = strconv.ParseBool(value)
+	return
+}
+
 func parseCompactPara(r *http.Request) (status bool, err error) {
 	r.ParseForm()
 	var value string
@@ -848,6 +2473,108 @@ func parseSetMetaNodeThresholdPara(r *http.Request) (threshold float64, err erro
 	return
 }
 
+//the threshold is the skew of disk usage ratio to migrate at, count is the max migrations in progress
+func parseStartRebalancePara(r *http.Request) (threshold float64, maxMigrations int, err error) {
+	r.ParseForm()
+	threshold = DefaultRebalanceThreshold
+	maxMigrations = DefaultRebalanceMaxMigrations
+	if value := r.FormValue(ParaThreshold); value != "" {
+		if threshold, err = strconv.ParseFloat(value, 64); err != nil {
+			err = UnMatchPara
+			return
+		}
+	}
+	if value := r.FormValue(ParaCount); value != "" {
+		if maxMigrations, err = strconv.Atoi(value); err != nil {
+			err = UnMatchPara
+			return
+		}
+	}
+	return
+}
+
+//count is the max migrations in progress of the node
+func parseDecommissionDataNodePara(r *http.Request) (nodeAddr string, maxMigrations int, err error) {
+	r.ParseForm()
+	if nodeAddr, err = checkNodeAddr(r); err != nil {
+		return
+	}
+	maxMigrations = DefaultDecommissionMaxMigrations
+	if value := r.FormValue(ParaCount); value != "" {
+		if maxMigrations, err = strconv.Atoi(value); err != nil {
+			err = UnMatchPara
+			return
+		}
+	}
+	return
+}
+
+//the migration plan is returned without executing it if dryRun is true
+func parseListUsagePara(r *http.Request) (name string, err error) {
+	r.ParseForm()
+	return checkVolPara(r)
+}
+
+func parseGetUsagePara(r *http.Request) (name string, statementTime int64, asCSV bool, err error) {
+	r.ParseForm()
+	if name, err = checkVolPara(r); err != nil {
+		return
+	}
+	if value := r.FormValue(ParaTime); value != "" {
+		if statementTime, err = strconv.ParseInt(value, 10, 64); err != nil {
+			err = UnMatchPara
+			return
+		}
+	}
+	switch r.FormValue(ParaFormat) {
+	case "", "json":
+	case "csv":
+		asCSV = true
+	default:
+		err = UnMatchPara
+	}
+	return
+}
+
+func parseCreateTokenPara(r *http.Request) (name, tokenType string, err error) {
+	r.ParseForm()
+	if name, err = checkVolPara(r); err != nil {
+		return
+	}
+	if tokenType = r.FormValue(ParaTokenType); tokenType == "" {
+		err = paraNotFound(ParaTokenType)
+		return
+	}
+	return
+}
+
+func parseTokenPara(r *http.Request) (name, value string, err error) {
+	r.ParseForm()
+	if name, err = checkVolPara(r); err != nil {
+		return
+	}
+	if value = r.FormValue(ParaToken); value == "" {
+		err = paraNotFound(ParaToken)
+		return
+	}
+	return
+}
+
+func parseListTokensPara(r *http.Request) (name string, err error) {
+	r.ParseForm()
+	return checkVolPara(r)
+}
+
+func parseDryRun(r *http.Request) (dryRun bool, err error) {
+	if value := r.FormValue(ParaDryRun); value != "" {
+		if dryRun, err = strconv.ParseBool(value); err != nil {
+			err = UnMatchPara
+			return
+		}
+	}
+	return
+}
+
 func parseCreateMetaPartitionPara(r *http.Request) (volName string, start uint64, err error) {
 	if volName, err = checkVolPara(r); err != nil {
 		return
@@ -16,8 +16,10 @@ package master
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/juju/errors"
 	"github.com/tiglabs/containerfs/util/log"
+	"net"
 	"net/http"
 	"regexp"
 	"strconv"
@@ -27,6 +29,14 @@ type VolStatInfo struct {
 	Name      string
 	TotalSize uint64
 	UsedSize  uint64
+	Quota     uint64
+	// 0 means no limit, Files is the inodes including the dirs
+	MaxFileSize uint64
+	MaxFiles    uint64
+	Files       uint64
+	// the policy of the writes and the data partitions below the replica count
+	DegradedWrite      string
+	DegradedPartitions int
 }
 
 type DataPartitionResponse struct {
@@ -35,6 +45,12 @@ type DataPartitionResponse struct {
 	ReplicaNum    uint8
 	PartitionType string
 	Hosts         []string
+	ClientHosts   []string
+	Epoch         uint64
+	ArchiveStatus string
+	Degraded      bool     `json:",omitempty"`
+	Releasing     bool     `json:",omitempty"`
+	Zones         []string `json:",omitempty"`
 }
 
 type DataPartitionsView struct {
@@ -59,6 +75,12 @@ type MetaPartitionView struct {
 type VolView struct {
 	Name           string
 	VolType        string
+	Immutable      bool
+	SyncOnClose    bool
+	FollowerRead   bool
+	ReadOnly       bool
+	Permission     bool
+	MaxFileSize    uint64
 	MetaPartitions []*MetaPartitionView
 	DataPartitions []*DataPartitionResponse
 }
@@ -91,6 +113,7 @@ func (m *Master) getDataPartitions(w http.ResponseWriter, r *http.Request) {
 		ok   bool
 		err  error
 	)
+	code = http.StatusBadRequest
 	if name, err = parseGetVolPara(r); err != nil {
 		goto errDeal
 	}
@@ -119,6 +142,7 @@ func (m *Master) getVol(w http.ResponseWriter, r *http.Request) {
 		name string
 		vol  *Vol
 	)
+	code = http.StatusBadRequest
 	if name, err = parseGetVolPara(r); err != nil {
 		goto errDeal
 	}
@@ -147,6 +171,7 @@ func (m *Master) getVolStatInfo(w http.ResponseWriter, r *http.Request) {
 		vol  *Vol
 		ok   bool
 	)
+	code = http.StatusBadRequest
 	if name, err = parseGetVolPara(r); err != nil {
 		goto errDeal
 	}
@@ -166,8 +191,65 @@ errDeal:
 	return
 }
 
+func (m *Master) reportClientSession(w http.ResponseWriter, r *http.Request) {
+	var (
+		body []byte
+		code = http.StatusBadRequest
+		err  error
+		name string
+		id   string
+		host string
+		view *ClientSessionView
+	)
+	if name, id, err = parseClientSessionPara(r); err != nil {
+		goto errDeal
+	}
+	if host, _, err = net.SplitHostPort(r.RemoteAddr); err != nil {
+		goto errDeal
+	}
+	if view, err = m.cluster.reportClientSession(name, id, host); err != nil {
+		goto errDeal
+	}
+	if body, err = json.Marshal(view); err != nil {
+		code = http.StatusMethodNotAllowed
+		goto errDeal
+	}
+	w.Write(body)
+	return
+errDeal:
+	logMsg := getReturnMessage("reportClientSession", r.RemoteAddr, err.Error(), code)
+	HandleError(logMsg, err, code, w)
+	return
+}
+
+func (m *Master) reportVolMigrated(w http.ResponseWriter, r *http.Request) {
+	var (
+		name  string
+		start int64
+		err   error
+	)
+	if name, start, err = parseVolMigratedPara(r); err != nil {
+		goto errDeal
+	}
+	if err = m.cluster.reportVolMigrated(name, start); err != nil {
+		goto errDeal
+	}
+	w.Write([]byte(fmt.Sprintf("report vol[%v] migrated since %v success", name, start)))
+	return
+errDeal:
+	logMsg := getReturnMessage("reportVolMigrated", r.RemoteAddr, err.Error(), http.StatusBadRequest)
+	HandleError(logMsg, err, http.StatusBadRequest, w)
+	return
+}
+
 func (m *Master) getVolView(vol *Vol) (view *VolView) {
 	view = NewVolView(vol.Name, vol.VolType)
+	view.Immutable = vol.isImmutable()
+	view.SyncOnClose = vol.isSyncOnClose()
+	view.FollowerRead = vol.isFollowerRead()
+	view.ReadOnly = vol.isReadOnly()
+	view.Permission = vol.isPermission()
+	view.MaxFileSize, _ = vol.getLimits()
 	setMetaPartitions(vol, view, m.cluster.getLiveMetaNodesRate())
 	setDataPartitions(vol, view, m.cluster.getLiveDataNodesRate())
 	return
@@ -194,10 +276,17 @@ func setMetaPartitions(vol *Vol, view *VolView, liveRate float32) {
 func volStat(vol *Vol) (stat *VolStatInfo) {
 	stat = new(VolStatInfo)
 	stat.Name = vol.Name
+	stat.Quota = vol.getQuota()
+	stat.MaxFileSize, stat.MaxFiles = vol.getLimits()
+	stat.Files = vol.getFileCount()
+	stat.DegradedWrite = vol.getDegradedWrite()
 	for _, dp := range vol.dataPartitions.dataPartitions {
 		stat.TotalSize = stat.TotalSize + dp.total
 		usedSize := dp.getMaxUsedSize()
 		stat.UsedSize = stat.UsedSize + usedSize
+		if dp.isDegraded() {
+			stat.DegradedPartitions++
+		}
 	}
 	if stat.UsedSize > stat.TotalSize {
 		stat.UsedSize = stat.TotalSize
@@ -273,6 +362,36 @@ func checkMetaPartitionID(r *http.Request) (partitionID uint64, err error) {
 	return strconv.ParseUint(value, 10, 64)
 }
 
+func parseClientSessionPara(r *http.Request) (name, id string, err error) {
+	r.ParseForm()
+	if name, err = checkVolPara(r); err != nil {
+		return
+	}
+	if id = r.FormValue(ParaId); id == "" {
+		err = paraNotFound(ParaId)
+		return
+	}
+	return
+}
+
+//start is the unix time the migration pass started at
+func parseVolMigratedPara(r *http.Request) (name string, start int64, err error) {
+	r.ParseForm()
+	if name, err = checkVolPara(r); err != nil {
+		return
+	}
+	var value string
+	if value = r.FormValue(ParaStart); value == "" {
+		err = paraNotFound(ParaStart)
+		return
+	}
+	if start, err = strconv.ParseInt(value, 10, 64); err != nil {
+		err = UnMatchPara
+		return
+	}
+	return
+}
+
 func parseGetVolPara(r *http.Request) (name string, err error) {
 	r.ParseForm()
 	return checkVolPara(r)
@@ -0,0 +1,65 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"github.com/tiglabs/containerfs/util/health"
+)
+
+func (m *Master) registerHealth() {
+	health.Register("master", m.checkHealth, m.checkReady)
+}
+
+/*the master is alive while its raft partition of the metadata exists*/
+func (m *Master) checkHealth() (checks []*health.Check) {
+	checks = append(checks, health.NewCheck("raft", m.partition != nil, "partition[%v]", GroupId))
+	return
+}
+
+/*the master is ready once the raft group has a leader, a follower serves the follower reads only with a read lease*/
+func (m *Master) checkReady() (checks []*health.Check) {
+	checks = m.checkHealth()
+	if m.partition == nil {
+		return
+	}
+	leader, term := m.partition.LeaderTerm()
+	checks = append(checks, health.NewCheck("leader", leader != 0, "leader[%v] addr[%v] term[%v]", leader, AddrDatabase[leader], term))
+	if leader == 0 {
+		return
+	}
+	if !m.partition.IsLeader() {
+		if m.config.readLeaseSeconds > 0 {
+			checks = append(checks, health.NewWarnCheck("readLease", m.readLease.Valid(m.partition), "leader[%v]", m.leaderInfo.addr))
+		}
+		return
+	}
+	// the leader takes the heartbeats, the nodes are active only in its view
+	var dataNodes, activeDataNodes, metaNodes, activeMetaNodes int
+	for _, node := range m.cluster.getAllDataNodes() {
+		dataNodes++
+		if node.Status {
+			activeDataNodes++
+		}
+	}
+	for _, node := range m.cluster.getAllMetaNodes() {
+		metaNodes++
+		if node.Status {
+			activeMetaNodes++
+		}
+	}
+	checks = append(checks, health.NewWarnCheck("dataNodes", activeDataNodes != 0, "%v of %v active", activeDataNodes, dataNodes))
+	checks = append(checks, health.NewWarnCheck("metaNodes", activeMetaNodes != 0, "%v of %v active", activeMetaNodes, metaNodes))
+	return
+}
@@ -29,19 +29,73 @@ const (
 	AdminLoadDataPartition    = "/dataPartition/load"
 	AdminCreateDataPartition  = "/dataPartition/create"
 	AdminDataPartitionOffline = "/dataPartition/offline"
+	AdminAddWarmReplica       = "/dataPartition/addWarmReplica"
+	AdminArchiveDataPartition = "/dataPartition/archive"
+	AdminRehydrateDataPart    = "/dataPartition/rehydrate"
+	AdminMoveDataPartDisk     = "/dataPartition/moveDisk"
+	AdminSealDataPartition    = "/dataPartition/seal"
+	AdminRepairDataPartition  = "/dataPartition/repair"
+	AdminVerifyDataPartition  = "/dataPartition/verify"
+	AdminArchiveVol           = "/vol/archive"
+	AdminRehydrateVol         = "/vol/rehydrate"
+	AdminRepairVol            = "/vol/repair"
+	AdminVerifyVol            = "/vol/verify"
 	AdminDeleteVol            = "/vol/delete"
+	AdminSetVolImmutable      = "/vol/setImmutable"
+	AdminSetVolQuota          = "/vol/setQuota"
+	AdminSetVolSyncOnClose    = "/vol/setSyncOnClose"
+	AdminSetVolFollowerRead   = "/vol/setFollowerRead"
+	AdminSetVolAudit          = "/vol/setAudit"
+	AdminSetVolErasureCode    = "/vol/setErasureCode"
+	AdminSetVolReadOnly       = "/vol/setReadOnly"
+	AdminSetVolPermission     = "/vol/setPermission"
+	AdminSetVolCompression    = "/vol/setCompression"
+	AdminSetVolColdTier       = "/vol/setColdTier"
+	AdminSetVolDegradedWrite  = "/vol/setDegradedWrite"
+	AdminSetVolEncryption     = "/vol/setEncryption"
+	AdminSetVolLimits         = "/vol/setLimits"
+	AdminResizeVol            = "/vol/resize"
+	AdminGetVolResize         = "/vol/getResize"
+	AdminSetVolMetaPlacement  = "/vol/setMetaPlacement"
+	AdminGetVolMetaPlacement  = "/vol/getMetaPlacement"
+	AdminSetVolLifecycle      = "/vol/setLifecycle"
+	AdminDeleteVolLifecycle   = "/vol/deleteLifecycle"
+	AdminGetVolLifecycle      = "/vol/getLifecycle"
 	AdminCreateVol            = "/admin/createVol"
 	AdminGetIp                = "/admin/getIp"
 	AdminCreateMP             = "/metaPartition/create"
 	AdminSetCompactStatus     = "/compactStatus/set"
 	AdminGetCompactStatus     = "/compactStatus/get"
 	AdminSetMetaNodeThreshold = "/threshold/set"
+	AdminGetClientSessions    = "/admin/getClientSessions"
+	AdminEvictClient          = "/admin/evictClient"
+	AdminStartRebalance       = "/rebalance/start"
+	AdminStopRebalance        = "/rebalance/stop"
+	AdminGetRebalance         = "/rebalance/get"
+	AdminSetLeaderTransfer    = "/leaderTransfer/set"
+	AdminGetLeaderTransfer    = "/leaderTransfer/get"
+	AdminDecommissionDataNode = "/dataNode/decommission"
+	AdminGetDecommission      = "/dataNode/getDecommission"
+	AdminCancelDecommission   = "/dataNode/cancelDecommission"
+	AdminListUsage            = "/usage/list"
+	AdminGetUsage             = "/usage/get"
+	AdminCreateToken          = "/token/create"
+	AdminRevokeToken          = "/token/revoke"
+	AdminRotateToken          = "/token/rotate"
+	AdminListTokens           = "/token/list"
+	AdminSetZone              = "/topology/setZone"
+	AdminSetFailureDomain     = "/topology/setFailureDomain"
+	AdminGetTopology          = "/topology/get"
+	AdminGetReadLease         = "/admin/getReadLease"
+	AdminGetNotifier          = "/notify/get"
 
 	// Client APIs
 	ClientDataPartitions = "/client/dataPartitions"
 	ClientVol            = "/client/vol"
 	ClientMetaPartition  = "/client/metaPartition"
 	ClientVolStat        = "/client/volStat"
+	ClientReportSession  = "/client/session"
+	ClientReportMigrated = "/client/migrated"
 
 	//raft node APIs
 	RaftNodeAdd    = "/raftNode/add"
@@ -59,13 +113,23 @@ const (
 
 	// Operation response
 	MetaNodeResponse = "/metaNode/response" // Method: 'POST', ContentType: 'application/json'
+	MetaNodeTier     = "/metaNode/tier"     // Method: 'POST', ContentType: 'application/json'
 	DataNodeResponse = "/dataNode/response" // Method: 'POST', ContentType: 'application/json'
+	DataNodeLease    = "/dataNode/lease"    // Method: 'POST', ContentType: 'application/json'
+	DataNodeHosts    = "/dataNode/hosts"    // Method: 'POST', ContentType: 'application/json'
 )
 
 func (m *Master) startHttpService() (err error) {
 	go func() {
 		m.handleFunctions()
-		http.ListenAndServe(ColonSplit+m.port, nil)
+		if m.tlsConfig == nil {
+			http.ListenAndServe(ColonSplit+m.port, nil)
+			return
+		}
+		server := &http.Server{Addr: ColonSplit + m.port, TLSConfig: m.tlsConfig}
+		if err := server.ListenAndServeTLS("", ""); err != nil {
+			log.LogErrorf("action[startHttpService] listen tls on %v: %v", m.port, err)
+		}
 	}()
 	return
 }
@@ -73,12 +137,40 @@ func (m *Master) startHttpService() (err error) {
 func (m *Master) handleFunctions() {
 	http.HandleFunc(AdminGetIp, m.getIpAndClusterName)
 	http.HandleFunc(AdminGetCluster, m.getCluster)
+	m.registerMetrics()
+	m.registerHealth()
 	http.Handle(AdminGetDataPartition, m.handlerWithInterceptor())
 	http.Handle(AdminCreateDataPartition, m.handlerWithInterceptor())
 	http.Handle(AdminLoadDataPartition, m.handlerWithInterceptor())
 	http.Handle(AdminDataPartitionOffline, m.handlerWithInterceptor())
+	http.Handle(AdminAddWarmReplica, m.handlerWithInterceptor())
+	http.Handle(AdminArchiveDataPartition, m.handlerWithInterceptor())
+	http.Handle(AdminSealDataPartition, m.handlerWithInterceptor())
+	http.Handle(AdminRehydrateDataPart, m.handlerWithInterceptor())
+	http.Handle(AdminMoveDataPartDisk, m.handlerWithInterceptor())
+	http.Handle(AdminRepairDataPartition, m.handlerWithInterceptor())
+	http.Handle(AdminVerifyDataPartition, m.handlerWithInterceptor())
+	http.Handle(AdminArchiveVol, m.handlerWithInterceptor())
+	http.Handle(AdminRehydrateVol, m.handlerWithInterceptor())
+	http.Handle(AdminRepairVol, m.handlerWithInterceptor())
+	http.Handle(AdminVerifyVol, m.handlerWithInterceptor())
 	http.Handle(AdminCreateVol, m.handlerWithInterceptor())
 	http.Handle(AdminDeleteVol, m.handlerWithInterceptor())
+	http.Handle(AdminSetVolImmutable, m.handlerWithInterceptor())
+	http.Handle(AdminSetVolSyncOnClose, m.handlerWithInterceptor())
+	http.Handle(AdminSetVolFollowerRead, m.handlerWithInterceptor())
+	http.Handle(AdminSetVolAudit, m.handlerWithInterceptor())
+	http.Handle(AdminSetVolErasureCode, m.handlerWithInterceptor())
+	http.Handle(AdminSetVolReadOnly, m.handlerWithInterceptor())
+	http.Handle(AdminSetVolPermission, m.handlerWithInterceptor())
+	http.Handle(AdminSetVolCompression, m.handlerWithInterceptor())
+	http.Handle(AdminSetVolColdTier, m.handlerWithInterceptor())
+	http.Handle(AdminSetVolDegradedWrite, m.handlerWithInterceptor())
+	http.Handle(AdminSetVolEncryption, m.handlerWithInterceptor())
+	http.Handle(AdminSetVolQuota, m.handlerWithInterceptor())
+	http.Handle(AdminSetVolLimits, m.handlerWithInterceptor())
+	http.Handle(AdminResizeVol, m.handlerWithInterceptor())
+	http.Handle(AdminGetVolResize, m.handlerWithInterceptor())
 	http.Handle(AddDataNode, m.handlerWithInterceptor())
 	http.Handle(AddMetaNode, m.handlerWithInterceptor())
 	http.Handle(DataNodeOffline, m.handlerWithInterceptor())
@@ -91,7 +183,10 @@ func (m *Master) handleFunctions() {
 	http.Handle(ClientVol, m.handlerWithInterceptor())
 	http.Handle(ClientMetaPartition, m.handlerWithInterceptor())
 	http.Handle(DataNodeResponse, m.handlerWithInterceptor())
+	http.Handle(DataNodeLease, m.handlerWithInterceptor())
+	http.Handle(DataNodeHosts, m.handlerWithInterceptor())
 	http.Handle(MetaNodeResponse, m.handlerWithInterceptor())
+	http.Handle(MetaNodeTier, m.handlerWithInterceptor())
 	http.Handle(AdminCreateMP, m.handlerWithInterceptor())
 	http.Handle(ClientVolStat, m.handlerWithInterceptor())
 	http.Handle(RaftNodeAdd, m.handlerWithInterceptor())
@@ -99,6 +194,34 @@ func (m *Master) handleFunctions() {
 	http.Handle(AdminSetCompactStatus, m.handlerWithInterceptor())
 	http.Handle(AdminGetCompactStatus, m.handlerWithInterceptor())
 	http.Handle(AdminSetMetaNodeThreshold, m.handlerWithInterceptor())
+	http.Handle(AdminGetClientSessions, m.handlerWithInterceptor())
+	http.Handle(AdminEvictClient, m.handlerWithInterceptor())
+	http.Handle(AdminStartRebalance, m.handlerWithInterceptor())
+	http.Handle(AdminStopRebalance, m.handlerWithInterceptor())
+	http.Handle(AdminGetRebalance, m.handlerWithInterceptor())
+	http.Handle(AdminSetLeaderTransfer, m.handlerWithInterceptor())
+	http.Handle(AdminGetLeaderTransfer, m.handlerWithInterceptor())
+	http.Handle(AdminDecommissionDataNode, m.handlerWithInterceptor())
+	http.Handle(AdminGetDecommission, m.handlerWithInterceptor())
+	http.Handle(AdminCancelDecommission, m.handlerWithInterceptor())
+	http.Handle(AdminListUsage, m.handlerWithInterceptor())
+	http.Handle(AdminGetUsage, m.handlerWithInterceptor())
+	http.Handle(AdminCreateToken, m.handlerWithInterceptor())
+	http.Handle(AdminRevokeToken, m.handlerWithInterceptor())
+	http.Handle(AdminRotateToken, m.handlerWithInterceptor())
+	http.Handle(AdminListTokens, m.handlerWithInterceptor())
+	http.Handle(AdminSetZone, m.handlerWithInterceptor())
+	http.Handle(AdminSetVolMetaPlacement, m.handlerWithInterceptor())
+	http.Handle(AdminGetVolMetaPlacement, m.handlerWithInterceptor())
+	http.Handle(AdminSetVolLifecycle, m.handlerWithInterceptor())
+	http.Handle(AdminDeleteVolLifecycle, m.handlerWithInterceptor())
+	http.Handle(AdminGetVolLifecycle, m.handlerWithInterceptor())
+	http.Handle(AdminSetFailureDomain, m.handlerWithInterceptor())
+	http.Handle(AdminGetTopology, m.handlerWithInterceptor())
+	http.Handle(AdminGetReadLease, m.handlerWithInterceptor())
+	http.Handle(AdminGetNotifier, m.handlerWithInterceptor())
+	http.Handle(ClientReportSession, m.handlerWithInterceptor())
+	http.Handle(ClientReportMigrated, m.handlerWithInterceptor())
 
 	return
 }
@@ -108,7 +231,7 @@ func (m *Master) handlerWithInterceptor() http.Handler {
 		func(w http.ResponseWriter, r *http.Request) {
 			if m.partition.IsLeader() {
 				m.ServeHTTP(w, r)
-			} else {
+			} else if !m.serveFollowerRead(w, r) {
 				http.Error(w, m.leaderInfo.addr, http.StatusForbidden)
 			}
 		})
@@ -126,10 +249,62 @@ func (m *Master) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		m.loadDataPartition(w, r)
 	case AdminDataPartitionOffline:
 		m.dataPartitionOffline(w, r)
+	case AdminAddWarmReplica:
+		m.addWarmReplica(w, r)
+	case AdminArchiveDataPartition:
+		m.archiveDataPartition(w, r)
+	case AdminRehydrateDataPart:
+		m.rehydrateDataPartition(w, r)
+	case AdminMoveDataPartDisk:
+		m.moveDataPartitionDisk(w, r)
+	case AdminSealDataPartition:
+		m.sealDataPartition(w, r)
+	case AdminRepairDataPartition:
+		m.repairDataPartition(w, r)
+	case AdminVerifyDataPartition:
+		m.verifyDataPartition(w, r)
+	case AdminArchiveVol:
+		m.archiveVol(w, r)
+	case AdminRehydrateVol:
+		m.rehydrateVol(w, r)
+	case AdminRepairVol:
+		m.repairVol(w, r)
+	case AdminVerifyVol:
+		m.verifyVol(w, r)
 	case AdminCreateVol:
 		m.createVol(w, r)
 	case AdminDeleteVol:
 		m.markDeleteVol(w, r)
+	case AdminSetVolImmutable:
+		m.setVolImmutable(w, r)
+	case AdminSetVolSyncOnClose:
+		m.setVolSyncOnClose(w, r)
+	case AdminSetVolFollowerRead:
+		m.setVolFollowerRead(w, r)
+	case AdminSetVolAudit:
+		m.setVolAudit(w, r)
+	case AdminSetVolErasureCode:
+		m.setVolErasureCode(w, r)
+	case AdminSetVolReadOnly:
+		m.setVolReadOnly(w, r)
+	case AdminSetVolPermission:
+		m.setVolPermission(w, r)
+	case AdminSetVolCompression:
+		m.setVolCompression(w, r)
+	case AdminSetVolColdTier:
+		m.setVolColdTier(w, r)
+	case AdminSetVolDegradedWrite:
+		m.setVolDegradedWrite(w, r)
+	case AdminSetVolEncryption:
+		m.setVolEncryption(w, r)
+	case AdminSetVolQuota:
+		m.setVolQuota(w, r)
+	case AdminSetVolLimits:
+		m.setVolLimits(w, r)
+	case AdminResizeVol:
+		m.resizeVol(w, r)
+	case AdminGetVolResize:
+		m.getVolResize(w, r)
 	case AddDataNode:
 		m.addDataNode(w, r)
 	case GetDataNode:
@@ -138,6 +313,10 @@ func (m *Master) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		m.dataNodeOffline(w, r)
 	case DataNodeResponse:
 		m.dataNodeTaskResponse(w, r)
+	case DataNodeLease:
+		m.renewLeaderLeases(w, r)
+	case DataNodeHosts:
+		m.getReplicaHosts(w, r)
 	case AddMetaNode:
 		m.addMetaNode(w, r)
 	case GetMetaNode:
@@ -146,6 +325,8 @@ func (m *Master) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		m.metaNodeOffline(w, r)
 	case MetaNodeResponse:
 		m.metaNodeTaskResponse(w, r)
+	case MetaNodeTier:
+		m.tierExtents(w, r)
 	case ClientDataPartitions:
 		m.getDataPartitions(w, r)
 	case ClientVol:
@@ -170,6 +351,62 @@ func (m *Master) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		m.getCompactStatus(w, r)
 	case AdminSetMetaNodeThreshold:
 		m.setMetaNodeThreshold(w, r)
+	case AdminGetClientSessions:
+		m.getClientSessions(w, r)
+	case AdminEvictClient:
+		m.evictClient(w, r)
+	case AdminStartRebalance:
+		m.startRebalance(w, r)
+	case AdminStopRebalance:
+		m.stopRebalance(w, r)
+	case AdminGetRebalance:
+		m.getRebalance(w, r)
+	case AdminSetLeaderTransfer:
+		m.setLeaderTransfer(w, r)
+	case AdminGetLeaderTransfer:
+		m.getLeaderTransfer(w, r)
+	case AdminGetNotifier:
+		m.getNotifier(w, r)
+	case AdminDecommissionDataNode:
+		m.decommissionDataNode(w, r)
+	case AdminGetDecommission:
+		m.getDecommission(w, r)
+	case AdminCancelDecommission:
+		m.cancelDecommission(w, r)
+	case AdminListUsage:
+		m.listUsage(w, r)
+	case AdminGetUsage:
+		m.getUsage(w, r)
+	case AdminCreateToken:
+		m.createToken(w, r)
+	case AdminRevokeToken:
+		m.revokeToken(w, r)
+	case AdminRotateToken:
+		m.rotateToken(w, r)
+	case AdminListTokens:
+		m.listTokens(w, r)
+	case AdminSetVolMetaPlacement:
+		m.setVolMetaPlacement(w, r)
+	case AdminGetVolMetaPlacement:
+		m.getVolMetaPlacement(w, r)
+	case AdminSetVolLifecycle:
+		m.setVolLifecycle(w, r)
+	case AdminDeleteVolLifecycle:
+		m.deleteVolLifecycle(w, r)
+	case AdminGetVolLifecycle:
+		m.getVolLifecycle(w, r)
+	case AdminSetZone:
+		m.setZone(w, r)
+	case AdminSetFailureDomain:
+		m.setFailureDomain(w, r)
+	case AdminGetTopology:
+		m.getTopology(w, r)
+	case AdminGetReadLease:
+		m.getReadLease(w, r)
+	case ClientReportSession:
+		m.reportClientSession(w, r)
+	case ClientReportMigrated:
+		m.reportVolMigrated(w, r)
 	default:
 
 	}
@@ -0,0 +1,225 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	EncryptKeySize       = 32
+	KmsRequestTimeoutSec = 5
+)
+
+// KeyManager creates the keys encrypting the data partitions of the vols, the
+// data nodes get them from the master in the heartbeats.
+type KeyManager interface {
+	// CreateKey returns the id of a new key of vol, and the key if it is to be kept by the master
+	CreateKey(volName string) (keyId string, key []byte, err error)
+	// GetKey returns the key of keyId not kept by the master, the heartbeats
+	// call it so it must not block on the kms: a key not at hand is fetched in
+	// the background and an error returned until then
+	GetKey(volName, keyId string) (key []byte, err error)
+}
+
+// the keys created by the master are persisted with their vols, so they are as
+// safe as the store of the master
+type localKeyManager struct{}
+
+func newLocalKeyManager() *localKeyManager {
+	return &localKeyManager{}
+}
+
+func (km *localKeyManager) CreateKey(volName string) (keyId string, key []byte, err error) {
+	key = make([]byte, EncryptKeySize)
+	if _, err = rand.Read(key); err != nil {
+		return
+	}
+	keyId = fmt.Sprintf("%v_%v", volName, time.Now().UnixNano())
+	return
+}
+
+func (km *localKeyManager) GetKey(volName, keyId string) (key []byte, err error) {
+	return nil, elementNotFound(fmt.Sprintf("key %v of vol %v", keyId, volName))
+}
+
+type kmsKey struct {
+	KeyId string
+	Key   []byte
+}
+
+// the keys of an external kms, fetched by GET addr/key/create?vol= and
+// addr/key/get?vol=&id= returning the kmsKey in json, and kept in memory only
+type httpKeyManager struct {
+	addr     string
+	client   *http.Client
+	keys     map[string][]byte
+	fetching map[string]bool //the key ids being fetched in the background
+	sync.Mutex
+}
+
+func newHttpKeyManager(addr string) *httpKeyManager {
+	if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+		addr = "http://" + addr
+	}
+	return &httpKeyManager{
+		addr:     strings.TrimSuffix(addr, "/"),
+		client:   &http.Client{Timeout: KmsRequestTimeoutSec * time.Second},
+		keys:     make(map[string][]byte),
+		fetching: make(map[string]bool),
+	}
+}
+
+func (km *httpKeyManager) CreateKey(volName string) (keyId string, key []byte, err error) {
+	var k *kmsKey
+	if k, err = km.request("/key/create?vol=" + url.QueryEscape(volName)); err != nil {
+		return
+	}
+	km.Lock()
+	km.keys[k.KeyId] = k.Key
+	km.Unlock()
+	return k.KeyId, nil, nil
+}
+
+func (km *httpKeyManager) GetKey(volName, keyId string) (key []byte, err error) {
+	km.Lock()
+	defer km.Unlock()
+	if key, ok := km.keys[keyId]; ok {
+		return key, nil
+	}
+	if !km.fetching[keyId] {
+		km.fetching[keyId] = true
+		go km.fetchKey(volName, keyId)
+	}
+	return nil, fmt.Errorf("key %v of vol %v being fetched from the kms", keyId, volName)
+}
+
+func (km *httpKeyManager) fetchKey(volName, keyId string) {
+	k, err := km.request("/key/get?vol=" + url.QueryEscape(volName) + "&id=" + url.QueryEscape(keyId))
+	if err == nil && k.KeyId != keyId {
+		err = errors.Annotatef(UnMatchPara, "kms returned key %v for %v", k.KeyId, keyId)
+	}
+	km.Lock()
+	delete(km.fetching, keyId)
+	if err == nil {
+		km.keys[keyId] = k.Key
+	}
+	km.Unlock()
+	if err != nil {
+		log.LogErrorf("action[fetchKey] vol[%v] key[%v]: %v", volName, keyId, err)
+	}
+}
+
+func (km *httpKeyManager) request(path string) (k *kmsKey, err error) {
+	var (
+		resp *http.Response
+		body []byte
+	)
+	if resp, err = km.client.Get(km.addr + path); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if body, err = ioutil.ReadAll(resp.Body); err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("kms %v status %v: %v", path, resp.StatusCode, string(body))
+	}
+	k = &kmsKey{}
+	if err = json.Unmarshal(body, k); err != nil {
+		return nil, err
+	}
+	if k.KeyId == "" || len(k.Key) != EncryptKeySize {
+		return nil, fmt.Errorf("kms %v returned key %v of size %v", path, k.KeyId, len(k.Key))
+	}
+	return
+}
+
+/*encrypt the data partitions created from now, a key is created for the vol at the first enable*/
+func (c *Cluster) setVolEncryption(name string, encrypted bool) (err error) {
+	var (
+		vol      *Vol
+		oldVal   bool
+		oldKeyId string
+		oldKey   []byte
+	)
+	if vol, err = c.getVol(name); err != nil {
+		return
+	}
+	oldVal, oldKeyId, oldKey = vol.getEncryption()
+	keyId, key := oldKeyId, oldKey
+	if encrypted && keyId == "" {
+		if keyId, key, err = c.kms.CreateKey(name); err != nil {
+			return
+		}
+	}
+	vol.setEncryption(encrypted, keyId, key)
+	if err = c.syncUpdateVol(vol); err != nil {
+		vol.setEncryption(oldVal, oldKeyId, oldKey)
+		return
+	}
+	log.LogWarnf("action[setVolEncryption] vol[%v] encrypted[%v] key[%v]", name, encrypted, keyId)
+	return
+}
+
+/*keys of the vols with encrypted data partitions*/
+func (c *Cluster) getVolKeys() (volKeys map[string]*proto.VolKey) {
+	volKeys = make(map[string]*proto.VolKey)
+	for name, vol := range c.copyVols() {
+		_, keyId, key := vol.getEncryption()
+		if keyId == "" {
+			continue
+		}
+		if key == nil {
+			var err error
+			if key, err = c.kms.GetKey(name, keyId); err != nil {
+				log.LogErrorf("action[getVolKeys] vol[%v] key[%v]: %v", name, keyId, err)
+				continue
+			}
+		}
+		volKeys[name] = &proto.VolKey{KeyId: keyId, Key: key}
+	}
+	return
+}
+
+/*keys of the vols of the partitions reported by the node, the other nodes never get them*/
+func (c *Cluster) getNodeVolKeys(node *DataNode, volKeys map[string]*proto.VolKey) (nodeKeys map[string]*proto.VolKey) {
+	if len(volKeys) == 0 {
+		return
+	}
+	nodeKeys = make(map[string]*proto.VolKey)
+	for id := range node.getPartitionReports() {
+		dp, err := c.getDataPartitionByID(id)
+		if err != nil {
+			continue
+		}
+		if vk, ok := volKeys[dp.VolName]; ok {
+			nodeKeys[dp.VolName] = vk
+		}
+	}
+	return
+}
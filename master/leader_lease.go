@@ -0,0 +1,115 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	DefaultLeaderLeaseSeconds = 15
+)
+
+// the lease granted to the leader of a data partition at an epoch, the expire
+// time is in unix nanoseconds of the clock of the master
+type leaderLease struct {
+	addr       string
+	epoch      uint64
+	expireTime int64
+}
+
+// the leases are kept only in the memory of the leader, a new leader does not
+// know the leases granted before, so it grants none during the first lease
+// after it is elected
+type leaderLeases struct {
+	leases map[uint64]*leaderLease
+	since  int64
+	sync.Mutex
+}
+
+func newLeaderLeases() *leaderLeases {
+	return &leaderLeases{leases: make(map[uint64]*leaderLease), since: time.Now().UnixNano()}
+}
+
+func (ll *leaderLeases) reset() {
+	ll.Lock()
+	defer ll.Unlock()
+	ll.leases = make(map[uint64]*leaderLease)
+	ll.since = time.Now().UnixNano()
+}
+
+/*the hosts of the partitions, the partitions not found are left out*/
+func (c *Cluster) getPartitionHosts(ids []uint64) (partitions []*proto.PartitionHosts) {
+	partitions = make([]*proto.PartitionHosts, 0, len(ids))
+	for _, id := range ids {
+		dp, err := c.getDataPartitionByID(id)
+		if err != nil {
+			continue
+		}
+		dp.RLock()
+		ph := &proto.PartitionHosts{PartitionID: id, Hosts: append([]string{}, dp.PersistenceHosts...),
+			WarmHosts: append([]string{}, dp.WarmHosts...), Epoch: dp.Epoch}
+		if !dp.isRaftReplicated() && len(dp.PersistenceHosts) != 0 {
+			ph.Leader = dp.PersistenceHosts[0]
+		}
+		dp.RUnlock()
+		partitions = append(partitions, ph)
+	}
+	return
+}
+
+// the leases of the partitions led by addr, the lease of a new leader is granted
+// only after the lease of the old one expired. The leader keeps its lease over
+// an epoch bump, the followers refuse the packets of the old epoch.
+func (c *Cluster) grantLeaderLeases(addr string, ids []uint64) (leases []*proto.LeaderLease, err error) {
+	if _, err = c.getDataNode(addr); err != nil {
+		return
+	}
+	leases = make([]*proto.LeaderLease, 0, len(ids))
+	ll := c.leaderLeases
+	ll.Lock()
+	defer ll.Unlock()
+	now := time.Now().UnixNano()
+	duration := int64(time.Second * DefaultLeaderLeaseSeconds)
+	if now < ll.since+duration {
+		return
+	}
+	for _, id := range ids {
+		dp, err := c.getDataPartitionByID(id)
+		if err != nil {
+			continue
+		}
+		dp.RLock()
+		isLeader := !dp.isRaftReplicated() && len(dp.PersistenceHosts) != 0 && dp.PersistenceHosts[0] == addr
+		epoch := dp.Epoch
+		dp.RUnlock()
+		if !isLeader {
+			continue
+		}
+		old, ok := ll.leases[id]
+		if ok && old.addr != addr && now < old.expireTime {
+			log.LogDebugf("action[grantLeaderLeases] partitionID:%v leader[%v] epoch[%v] waits lease of [%v] epoch[%v] expired",
+				id, addr, epoch, old.addr, old.epoch)
+			continue
+		}
+		ll.leases[id] = &leaderLease{addr: addr, epoch: epoch, expireTime: now + duration}
+		leases = append(leases, &proto.LeaderLease{PartitionID: id, Epoch: epoch, Seconds: DefaultLeaderLeaseSeconds})
+	}
+	return
+}
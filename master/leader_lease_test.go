@@ -0,0 +1,129 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+const (
+	leaseTestLeader   = "10.0.0.1:17310"
+	leaseTestFollower = "10.0.0.2:17310"
+)
+
+// a cluster of two data nodes holding a partition led by the first one, its
+// leases are granted as if the master was elected a lease ago
+func newLeaseTestCluster() (c *Cluster, dp *DataPartition) {
+	c = &Cluster{Name: "test", vols: make(map[string]*Vol), leaderInfo: &LeaderInfo{},
+		clientSessions: newClientSessions(), leaderLeases: newLeaderLeases()}
+	c.leaderLeases.since -= int64(time.Second * DefaultLeaderLeaseSeconds)
+	for _, addr := range []string{leaseTestLeader, leaseTestFollower} {
+		c.dataNodes.Store(addr, &DataNode{Addr: addr, partitionReports: make(map[uint64]*proto.PartitionReport),
+			Sender: &AdminTaskSender{targetAddr: addr, TaskMap: make(map[string]*proto.AdminTask)}})
+	}
+	vol := NewVol("ltptest", proto.ExtentPartition, 2)
+	dp = newDataPartition(7, 2, proto.ExtentPartition, vol.Name)
+	dp.PersistenceHosts = []string{leaseTestLeader, leaseTestFollower}
+	dp.Epoch = 3
+	vol.dataPartitions.putDataPartition(dp)
+	c.vols[vol.Name] = vol
+	return
+}
+
+func grantTestLease(t *testing.T, c *Cluster, addr string) *proto.LeaderLease {
+	leases, err := c.grantLeaderLeases(addr, []uint64{7, 8})
+	if err != nil {
+		t.Fatalf("grant to %v: %v", addr, err)
+	}
+	if len(leases) == 0 {
+		return nil
+	}
+	if len(leases) != 1 || leases[0].PartitionID != 7 || leases[0].Seconds != DefaultLeaderLeaseSeconds {
+		t.Fatalf("leases to %v %+v", addr, leases)
+	}
+	return leases[0]
+}
+
+/*the leader is replaced by the follower, as the offline of a host does*/
+func replaceTestLeader(dp *DataPartition) {
+	dp.Lock()
+	dp.PersistenceHosts = []string{leaseTestFollower}
+	dp.Epoch++
+	dp.Unlock()
+}
+
+func TestGrantLeaderLeases(t *testing.T) {
+	c, dp := newLeaseTestCluster()
+	if _, err := c.grantLeaderLeases("10.0.0.9:17310", []uint64{7}); err == nil {
+		t.Fatalf("granted to a node not in the cluster")
+	}
+	if lease := grantTestLease(t, c, leaseTestFollower); lease != nil {
+		t.Fatalf("granted to a follower %+v", lease)
+	}
+	lease := grantTestLease(t, c, leaseTestLeader)
+	if lease == nil || lease.Epoch != 3 {
+		t.Fatalf("lease of the leader %+v", lease)
+	}
+	// renewed by the leader over an epoch bump, at the new epoch
+	dp.Lock()
+	dp.Epoch++
+	dp.Unlock()
+	if lease = grantTestLease(t, c, leaseTestLeader); lease == nil || lease.Epoch != 4 {
+		t.Fatalf("lease renewed over an epoch bump %+v", lease)
+	}
+
+	// the new leader waits the lease of the old one expired, the old one gets no more
+	replaceTestLeader(dp)
+	if lease = grantTestLease(t, c, leaseTestFollower); lease != nil {
+		t.Fatalf("granted before the lease of the old leader expired %+v", lease)
+	}
+	if lease = grantTestLease(t, c, leaseTestLeader); lease != nil {
+		t.Fatalf("granted to the old leader %+v", lease)
+	}
+	c.leaderLeases.leases[7].expireTime = time.Now().UnixNano()
+	if lease = grantTestLease(t, c, leaseTestFollower); lease == nil || lease.Epoch != 5 {
+		t.Fatalf("lease of the new leader %+v", lease)
+	}
+}
+
+func TestLeaderLeases_LeaderChange(t *testing.T) {
+	c, dp := newLeaseTestCluster()
+	m := &Master{id: 1, clusterName: c.Name, leaderInfo: c.leaderInfo, readLease: &readLease{}, cluster: c}
+	if lease := grantTestLease(t, c, leaseTestLeader); lease == nil {
+		t.Fatalf("no lease of the leader")
+	}
+	replaceTestLeader(dp)
+	// a follower of the raft group of the masters grants nothing, it keeps the leases
+	m.handleLeaderChange(2)
+	if len(c.leaderLeases.leases) != 1 {
+		t.Fatalf("leases reset by the leader change to another master")
+	}
+	// elected, the master doesn't know the leases granted by the old leader of the
+	// masters, it grants none during a lease
+	m.handleLeaderChange(1)
+	if len(c.leaderLeases.leases) != 0 {
+		t.Fatalf("leases %v kept over the election", c.leaderLeases.leases)
+	}
+	if lease := grantTestLease(t, c, leaseTestFollower); lease != nil {
+		t.Fatalf("granted during the first lease after the election %+v", lease)
+	}
+	c.leaderLeases.since -= int64(time.Second * DefaultLeaderLeaseSeconds)
+	if lease := grantTestLease(t, c, leaseTestFollower); lease == nil || lease.Epoch != 4 {
+		t.Fatalf("lease of the new leader %+v", lease)
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	LeaderTransferCheckIntervalSeconds = 60
+	LeaderTransferSlowChecks           = 5    //checks in a row the leader is slow before its leadership is transferred
+	LeaderTransferLatencyRatio         = 4    //the leader is slow if its write latency is that many times the one of every follower
+	LeaderTransferMinLatencyMs         = 50   //a leader faster than it is never slow
+	LeaderTransferCooldownSeconds      = 1800 //a partition is not transferred again before it
+)
+
+// a rotation of the leadership of a partition replicated by the chain, the
+// leader moves to the end of PersistenceHosts and is followed by the others
+type LeaderTransfer struct {
+	PartitionID   uint64
+	VolName       string
+	From          string
+	To            string
+	FromLatencyMs uint32
+	ToLatencyMs   uint32
+	Time          int64
+}
+
+type LeaderTransferView struct {
+	Enabled   bool
+	Transfers []*LeaderTransfer
+}
+
+// the slow checks are kept only in the memory of the leader like the
+// rebalance, they start again from zero after the leader changed
+type leaderTransferrer struct {
+	enabled      bool
+	slowChecks   map[uint64]int   //checks in a row the leader of the partition was slow
+	lastTransfer map[uint64]int64 //time of the last transfer of the partition
+	history      []*LeaderTransfer
+	sync.Mutex
+}
+
+func newLeaderTransferrer() *leaderTransferrer {
+	return &leaderTransferrer{
+		enabled:      true,
+		slowChecks:   make(map[uint64]int),
+		lastTransfer: make(map[uint64]int64),
+		history:      make([]*LeaderTransfer, 0),
+	}
+}
+
+func (c *Cluster) startCheckLeaderTransfer() {
+	go func() {
+		for {
+			if c.partition.IsLeader() {
+				c.checkLeaderTransfer()
+			}
+			time.Sleep(time.Second * LeaderTransferCheckIntervalSeconds)
+		}
+	}()
+}
+
+func (c *Cluster) setLeaderTransfer(enabled bool) {
+	lt := c.leaderTransfer
+	lt.Lock()
+	defer lt.Unlock()
+	lt.enabled = enabled
+	if !enabled {
+		lt.slowChecks = make(map[uint64]int)
+	}
+	log.LogWarnf("action[setLeaderTransfer] clusterID[%v] enabled[%v]", c.Name, enabled)
+}
+
+func (c *Cluster) getLeaderTransferView() (view *LeaderTransferView) {
+	lt := c.leaderTransfer
+	lt.Lock()
+	defer lt.Unlock()
+	view = &LeaderTransferView{Enabled: lt.enabled, Transfers: make([]*LeaderTransfer, 0, len(lt.history))}
+	for _, t := range lt.history {
+		transfer := *t
+		view.Transfers = append(view.Transfers, &transfer)
+	}
+	return
+}
+
+func (c *Cluster) checkLeaderTransfer() {
+	lt := c.leaderTransfer
+	lt.Lock()
+	defer lt.Unlock()
+	if !lt.enabled {
+		return
+	}
+	checked := make(map[uint64]bool)
+	for _, vol := range c.getAllNormalVols() {
+		vol.dataPartitions.RLock()
+		dps := make([]*DataPartition, 0, len(vol.dataPartitions.dataPartitions))
+		for _, dp := range vol.dataPartitions.dataPartitions {
+			dps = append(dps, dp)
+		}
+		vol.dataPartitions.RUnlock()
+		for _, dp := range dps {
+			checked[dp.PartitionID] = true
+			c.checkSlowLeader(lt, dp)
+		}
+	}
+	for id := range lt.slowChecks {
+		if !checked[id] {
+			delete(lt.slowChecks, id)
+		}
+	}
+}
+
+/*the caller must hold the lock of lt*/
+func (c *Cluster) checkSlowLeader(lt *leaderTransferrer, dp *DataPartition) {
+	dp.Lock()
+	defer dp.Unlock()
+	leader, target := dp.getSlowLeader()
+	if leader == nil {
+		delete(lt.slowChecks, dp.PartitionID)
+		return
+	}
+	lt.slowChecks[dp.PartitionID]++
+	if lt.slowChecks[dp.PartitionID] < LeaderTransferSlowChecks ||
+		time.Now().Unix()-lt.lastTransfer[dp.PartitionID] < LeaderTransferCooldownSeconds {
+		return
+	}
+	if err := c.transferLeader(dp, target.Addr); err != nil {
+		Warn(c.Name, fmt.Sprintf("action[checkSlowLeader] clusterID[%v] partitionID:%v from %v to %v err:%v",
+			c.Name, dp.PartitionID, leader.Addr, target.Addr, err))
+		return
+	}
+	delete(lt.slowChecks, dp.PartitionID)
+	lt.lastTransfer[dp.PartitionID] = time.Now().Unix()
+	t := &LeaderTransfer{PartitionID: dp.PartitionID, VolName: dp.VolName, From: leader.Addr, To: target.Addr,
+		FromLatencyMs: leader.WriteLatencyMs, ToLatencyMs: target.WriteLatencyMs, Time: time.Now().Unix()}
+	lt.history = append(lt.history, t)
+	if len(lt.history) > MigrationHistoryCount {
+		lt.history = lt.history[len(lt.history)-MigrationHistoryCount:]
+	}
+	Warn(c.Name, fmt.Sprintf("action[checkSlowLeader] clusterID[%v] partitionID:%v vol[%v] leader transferred from %v(%vms) to %v(%vms)",
+		c.Name, t.PartitionID, t.VolName, t.From, t.FromLatencyMs, t.To, t.ToLatencyMs))
+}
+
+// the leader and the fastest follower if all the replicas are live and the leader
+// writes far slower than every follower, the raft replicated partitions elect
+// their leaders by themselves. The caller must hold the lock of dp
+func (partition *DataPartition) getSlowLeader() (leader, target *DataReplica) {
+	if partition.isRaftReplicated() || partition.ArchiveStatus != "" || partition.isRecover || partition.hasQuarantined() || partition.degraded ||
+		partition.Status != proto.ReadWrite || len(partition.PersistenceHosts) < 2 {
+		return nil, nil
+	}
+	replicas := partition.getLiveReplicasByPersistenceHosts(DefaultDataPartitionTimeOutSec)
+	if len(replicas) != len(partition.PersistenceHosts) || replicas[0].Addr != partition.PersistenceHosts[0] {
+		return nil, nil
+	}
+	leader = replicas[0]
+	if leader.WriteLatencyMs < LeaderTransferMinLatencyMs {
+		return nil, nil
+	}
+	for _, replica := range replicas[1:] {
+		if replica.Status != proto.ReadWrite || replica.WriteLatencyMs*LeaderTransferLatencyRatio > leader.WriteLatencyMs {
+			return nil, nil
+		}
+		if dataNode := replica.GetReplicaNode(); dataNode == nil || !dataNode.isActive || dataNode.Draining {
+			return nil, nil
+		}
+		if target == nil || replica.WriteLatencyMs < target.WriteLatencyMs {
+			target = replica
+		}
+	}
+	return
+}
+
+/*make addr the leader and the old leader the last follower, the caller must hold the lock of dp*/
+func (c *Cluster) transferLeader(dp *DataPartition, addr string) (err error) {
+	if !dp.isInPersistenceHosts(addr) || dp.PersistenceHosts[0] == addr {
+		return errors.Annotatef(UnMatchPara, "partition[%v] host[%v]", dp.PartitionID, addr)
+	}
+	orgHosts := dp.PersistenceHosts
+	newHosts := []string{addr}
+	for _, host := range orgHosts[1:] {
+		if host != addr {
+			newHosts = append(newHosts, host)
+		}
+	}
+	newHosts = append(newHosts, orgHosts[0])
+	dp.PersistenceHosts = newHosts
+	dp.Epoch++
+	if err = c.syncUpdateDataPartition(dp.VolName, dp); err != nil {
+		dp.PersistenceHosts = orgHosts
+		dp.Epoch--
+		return errors.Annotatef(err, "update partition[%v] failed", dp.PartitionID)
+	}
+	log.LogWarnf("action[transferLeader] partitionID:%v oldHosts:%v newHosts:%v epoch:%v",
+		dp.PartitionID, orgHosts, dp.PersistenceHosts, dp.Epoch)
+	return
+}
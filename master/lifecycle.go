@@ -0,0 +1,249 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"fmt"
+	"path"
+	"sync"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	MaxLifecycleRules = 100
+)
+
+type LifecycleView struct {
+	Rule    *proto.LifecycleRule
+	Current *proto.LifecyclePass `json:",omitempty"`
+	Last    *proto.LifecyclePass `json:",omitempty"`
+}
+
+// the rules are walked by the meta nodes leading the root inodes of their vols,
+// the passes reported by their heartbeats are kept only in the memory of the
+// leader, like the rebalance
+type lifecycleScanner struct {
+	reports map[string]map[string]*proto.LifecycleReport //reports of the vols by rule id
+	seq     uint64                                       //tells apart the tier tasks of a partition
+	sync.Mutex
+}
+
+func newLifecycleScanner() *lifecycleScanner {
+	return &lifecycleScanner{reports: make(map[string]map[string]*proto.LifecycleReport)}
+}
+
+/*the reports of a node replace the ones of their vols, the node walking a vol reports all its rules*/
+func (ls *lifecycleScanner) update(reports []*proto.LifecycleReport) {
+	if len(reports) == 0 {
+		return
+	}
+	vols := make(map[string]map[string]*proto.LifecycleReport)
+	for _, report := range reports {
+		if vols[report.VolName] == nil {
+			vols[report.VolName] = make(map[string]*proto.LifecycleReport)
+		}
+		vols[report.VolName][report.Rule.ID] = report
+	}
+	ls.Lock()
+	defer ls.Unlock()
+	for name, rules := range vols {
+		ls.reports[name] = rules
+	}
+}
+
+func (ls *lifecycleScanner) getReport(volName, ruleID string) *proto.LifecycleReport {
+	ls.Lock()
+	defer ls.Unlock()
+	return ls.reports[volName][ruleID]
+}
+
+func (ls *lifecycleScanner) nextSeq() uint64 {
+	ls.Lock()
+	defer ls.Unlock()
+	ls.seq++
+	return ls.seq
+}
+
+func checkLifecycleRule(rule *proto.LifecycleRule) (err error) {
+	if rule.ID == "" {
+		return paraNotFound(ParaId)
+	}
+	if rule.Days <= 0 {
+		return errors.Annotatef(UnMatchPara, "days[%v]", rule.Days)
+	}
+	if rule.Action != proto.LifecycleDelete && rule.Action != proto.LifecycleColdTier {
+		return errors.Annotatef(UnMatchPara, "action[%v]", rule.Action)
+	}
+	rule.Prefix = path.Clean("/" + rule.Prefix)
+	return
+}
+
+func (vol *Vol) setLifecycleRules(rules []*proto.LifecycleRule) {
+	vol.Lock()
+	defer vol.Unlock()
+	vol.LifecycleRules = rules
+}
+
+func (vol *Vol) getLifecycleRules() (rules []*proto.LifecycleRule) {
+	vol.RLock()
+	defer vol.RUnlock()
+	rules = make([]*proto.LifecycleRule, 0, len(vol.LifecycleRules))
+	for _, rule := range vol.LifecycleRules {
+		r := *rule
+		rules = append(rules, &r)
+	}
+	return
+}
+
+/*add the rule to the vol, or replace the rule of the same id, the pass of a replaced rule starts over*/
+func (c *Cluster) setVolLifecycleRule(name string, rule *proto.LifecycleRule) (err error) {
+	var (
+		vol    *Vol
+		oldVal []*proto.LifecycleRule
+	)
+	if err = checkLifecycleRule(rule); err != nil {
+		return
+	}
+	if vol, err = c.getVol(name); err != nil {
+		return
+	}
+	oldVal = vol.getLifecycleRules()
+	rules := make([]*proto.LifecycleRule, 0, len(oldVal)+1)
+	replaced := false
+	for _, r := range oldVal {
+		if r.ID == rule.ID {
+			r = rule
+			replaced = true
+		}
+		rules = append(rules, r)
+	}
+	if !replaced {
+		if len(oldVal) >= MaxLifecycleRules {
+			return errors.Annotatef(UnMatchPara, "vol[%v] has %v lifecycle rules", name, len(oldVal))
+		}
+		rules = append(rules, rule)
+	}
+	vol.setLifecycleRules(rules)
+	if err = c.syncUpdateVol(vol); err != nil {
+		vol.setLifecycleRules(oldVal)
+		return
+	}
+	log.LogWarnf("action[setVolLifecycleRule] clusterID[%v] vol[%v] rule[%v] prefix[%v] days[%v] action[%v]",
+		c.Name, name, rule.ID, rule.Prefix, rule.Days, rule.Action)
+	return
+}
+
+func (c *Cluster) deleteVolLifecycleRule(name, id string) (err error) {
+	var (
+		vol    *Vol
+		oldVal []*proto.LifecycleRule
+	)
+	if vol, err = c.getVol(name); err != nil {
+		return
+	}
+	oldVal = vol.getLifecycleRules()
+	rules := make([]*proto.LifecycleRule, 0, len(oldVal))
+	for _, r := range oldVal {
+		if r.ID != id {
+			rules = append(rules, r)
+		}
+	}
+	if len(rules) == len(oldVal) {
+		return elementNotFound(fmt.Sprintf("lifecycle rule %v of vol %v", id, name))
+	}
+	vol.setLifecycleRules(rules)
+	if err = c.syncUpdateVol(vol); err != nil {
+		vol.setLifecycleRules(oldVal)
+		return
+	}
+	log.LogWarnf("action[deleteVolLifecycleRule] clusterID[%v] vol[%v] rule[%v]", c.Name, name, id)
+	return
+}
+
+/*the rules of the vol with the passes reported to the leader, the passes are empty on the followers*/
+func (c *Cluster) getVolLifecycle(name string) (views []*LifecycleView, err error) {
+	var vol *Vol
+	if vol, err = c.getVol(name); err != nil {
+		return
+	}
+	views = make([]*LifecycleView, 0)
+	for _, rule := range vol.getLifecycleRules() {
+		view := &LifecycleView{Rule: rule}
+		if report := c.lifecycle.getReport(name, rule.ID); report != nil && report.Rule == *rule {
+			view.Current = report.Current
+			view.Last = report.Last
+		}
+		views = append(views, view)
+	}
+	return
+}
+
+/*the lifecycle rules of the vols with any, the meta nodes walk the ones of the vols whose root inode they lead*/
+func (c *Cluster) getVolLifecycleRules() (volRules map[string][]*proto.LifecycleRule) {
+	volRules = make(map[string][]*proto.LifecycleRule)
+	for name, vol := range c.getAllNormalVols() {
+		if rules := vol.getLifecycleRules(); len(rules) != 0 {
+			volRules[name] = rules
+		}
+	}
+	return
+}
+
+/*send the extents to all the replicas of their partitions, each replica tiers its own copy and skips the extents tiered before*/
+func (c *Cluster) tierExtents(volName string, extents map[uint64][]uint64) {
+	tasks := make([]*proto.AdminTask, 0)
+	for partitionID, ids := range extents {
+		dp, err := c.getDataPartitionByID(partitionID)
+		if err != nil {
+			log.LogWarnf("action[tierExtents] vol[%v] partitionID:%v: %v", volName, partitionID, err)
+			continue
+		}
+		if dp.VolName != volName {
+			log.LogWarnf("action[tierExtents] vol[%v] partitionID:%v of vol[%v]", volName, partitionID, dp.VolName)
+			continue
+		}
+		request := &proto.TierExtentsRequest{PartitionId: dp.PartitionID, ExtentIds: ids}
+		seq := c.lifecycle.nextSeq()
+		dp.RLock()
+		if err = dp.canCheck(); err == nil && dp.PartitionType == proto.ExtentPartition && dp.EncodeStep == "" {
+			for _, addr := range dp.PersistenceHosts {
+				tasks = append(tasks, dp.generateTierExtentsTask(addr, request, seq))
+			}
+		}
+		dp.RUnlock()
+	}
+	c.putDataNodeTasks(tasks)
+}
+
+func (partition *DataPartition) generateTierExtentsTask(addr string, request *proto.TierExtentsRequest, seq uint64) (task *proto.AdminTask) {
+	task = proto.NewAdminTask(proto.OpTierExtents, addr, request)
+	partition.resetTaskID(task)
+	task.ID = fmt.Sprintf("%v_seq[%v]", task.ID, seq)
+	return
+}
+
+func (c *Cluster) dealTierExtentsResponse(nodeAddr string, resp *proto.TierExtentsResponse) (err error) {
+	if resp.Status != proto.TaskSuccess {
+		log.LogWarnf("action[dealTierExtentsResponse] clusterID[%v] partitionID:%v tiered[%v] on node[%v] failed,err[%v]",
+			c.Name, resp.PartitionId, resp.Tiered, nodeAddr, resp.Result)
+		return
+	}
+	log.LogInfof("action[dealTierExtentsResponse] clusterID[%v] partitionID:%v tiered[%v] on node[%v]",
+		c.Name, resp.PartitionId, resp.Tiered, nodeAddr)
+	return
+}
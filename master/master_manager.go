@@ -18,7 +18,7 @@ import (
 	"fmt"
 	"github.com/tiglabs/containerfs/util/log"
 	"github.com/tiglabs/raft/proto"
-	"strings"
+	"net"
 )
 
 type LeaderInfo struct {
@@ -30,8 +30,10 @@ func (m *Master) handleLeaderChange(leader uint64) {
 		log.LogWarnf("action[handleLeaderChange] but no leader")
 	}
 	m.leaderInfo.addr = AddrDatabase[leader]
+	m.readLease.Reset()
 	//Once switched to the master, the checkHeartbeat is executed
 	if m.id == leader {
+		m.cluster.leaderLeases.reset()
 		Warn(m.clusterName, fmt.Sprintf("clusterID[%v] leader is changed to %v",
 			m.clusterName, m.leaderInfo.addr))
 		//m.loadMetadata()
@@ -45,12 +47,13 @@ func (m *Master) handlePeerChange(confChange *proto.ConfChange) (err error) {
 	addr := string(confChange.Context)
 	switch confChange.Type {
 	case proto.ConfAddNode:
-		var arr []string
-		if arr = strings.Split(addr, ColonSplit); len(arr) < 2 {
+		var host string
+		if host, _, err = net.SplitHostPort(addr); err != nil {
 			msg = fmt.Sprintf("action[handlePeerChange] clusterID[%v] nodeAddr[%v] is invalid", m.clusterName, addr)
+			err = nil
 			break
 		}
-		m.raftStore.AddNode(confChange.Peer.ID, arr[0])
+		m.raftStore.AddNode(confChange.Peer.ID, host)
 		AddrDatabase[confChange.Peer.ID] = string(confChange.Context)
 		msg = fmt.Sprintf("clusterID[%v] peerID:%v,nodeAddr[%v] has been add", m.clusterName, confChange.Peer.ID, addr)
 	case proto.ConfRemoveNode:
@@ -88,6 +91,10 @@ func (m *Master) loadMetadata() {
 		panic(err)
 	}
 
+	if err = m.cluster.loadPlacement(); err != nil {
+		panic(err)
+	}
+
 	if err = m.cluster.loadMetaNodes(); err != nil {
 		panic(err)
 	}
@@ -96,6 +103,10 @@ func (m *Master) loadMetadata() {
 		panic(err)
 	}
 
+	if err = m.cluster.loadTokens(); err != nil {
+		panic(err)
+	}
+
 	if err = m.cluster.loadMetaPartitions(); err != nil {
 		panic(err)
 	}
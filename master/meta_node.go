@@ -28,6 +28,8 @@ type MetaNode struct {
 	IsActive           bool
 	Sender             *AdminTaskSender
 	RackName           string `json:"Rack"`
+	ZoneName           string `json:"Zone,omitempty"`
+	MemClass           string `json:",omitempty"`
 	MaxMemAvailWeight  uint64 `json:"MaxMemAvailWeight"`
 	Total              uint64 `json:"TotalWeight"`
 	Used               uint64 `json:"UsedWeight"`
@@ -38,6 +40,7 @@ type MetaNode struct {
 	ReportTime         time.Time
 	metaPartitionInfos []*proto.MetaPartitionReport
 	MetaPartitionCount int
+	ClockOffset        int64 //seconds the node clock ahead of the master
 	sync.RWMutex
 }
 
@@ -73,7 +76,8 @@ func (metaNode *MetaNode) IsWriteAble() (ok bool) {
 	metaNode.RLock()
 	defer metaNode.RUnlock()
 	if metaNode.IsActive && metaNode.MaxMemAvailWeight > DefaultMetaNodeReservedMem &&
-		!metaNode.isArriveThreshold() && metaNode.MetaPartitionCount < DefaultMetaPartitionCountOnEachNode {
+		!metaNode.isArriveThreshold() && metaNode.MetaPartitionCount < DefaultMetaPartitionCountOnEachNode &&
+		!isClockSkewed(metaNode.ClockOffset) {
 		ok = true
 	}
 	return
@@ -102,7 +106,10 @@ func (metaNode *MetaNode) updateMetric(resp *proto.MetaNodeHeartbeatResponse, th
 	metaNode.Ratio = float64(resp.Used) / float64(resp.Total)
 	metaNode.MaxMemAvailWeight = resp.Total - resp.Used
 	metaNode.RackName = resp.RackName
+	metaNode.ZoneName = resp.ZoneName
+	metaNode.MemClass = resp.MemClass
 	metaNode.Threshold = threshold
+	metaNode.ClockOffset = resp.ClockOffset
 }
 
 func (metaNode *MetaNode) isArriveThreshold() bool {
@@ -112,21 +119,40 @@ func (metaNode *MetaNode) isArriveThreshold() bool {
 	return float32(float64(metaNode.Used)/float64(metaNode.Total)) > metaNode.Threshold
 }
 
-func (metaNode *MetaNode) generateHeartbeatTask(masterAddr string) (task *proto.AdminTask) {
+func (metaNode *MetaNode) generateHeartbeatTask(masterAddr string, fences []*proto.ClientFence, sessions []string,
+	volTokens map[string][]*proto.TokenDigest, volLimits map[string]*proto.VolLimit, volAudit map[string]bool,
+	volReadOnly map[string]bool, volPermission map[string]bool, volLifecycle map[string][]*proto.LifecycleRule) (task *proto.AdminTask) {
 	request := &proto.HeartBeatRequest{
-		CurrTime:   time.Now().Unix(),
-		MasterAddr: masterAddr,
+		CurrTime:       time.Now().Unix(),
+		MasterAddr:     masterAddr,
+		FencedClients:  fencesInNodeClock(fences, metaNode.getClockOffset()),
+		ActiveSessions: sessions,
+		VolTokens:      volTokens,
+		VolLimits:      volLimits,
+		VolAudit:       volAudit,
+		VolReadOnly:    volReadOnly,
+		VolPermission:  volPermission,
+		VolLifecycle:   volLifecycle,
 	}
 	task = proto.NewAdminTask(proto.OpMetaNodeHeartbeat, metaNode.Addr, request)
 	return
 }
 
-func (metaNode *MetaNode) checkHeartbeat() {
+func (metaNode *MetaNode) getClockOffset() int64 {
+	metaNode.RLock()
+	defer metaNode.RUnlock()
+	return metaNode.ClockOffset
+}
+
+/*down is true if the node was active*/
+func (metaNode *MetaNode) checkHeartbeat() (down bool) {
 	metaNode.Lock()
 	defer metaNode.Unlock()
 	if time.Since(metaNode.ReportTime) > time.Second*time.Duration(DefaultNodeTimeOutSec) {
+		down = metaNode.IsActive
 		metaNode.IsActive = false
 	}
+	return
 }
 
 func (metaNode *MetaNode) toJson() (body []byte, err error) {
@@ -42,6 +42,10 @@ type MetaPartition struct {
 	Start            uint64
 	End              uint64
 	MaxNodeID        uint64
+	InodeCount       uint64
+	UsageFiles       uint64 //regular files aggregated by the leader at UsageTime, zero time if not reported
+	UsageBytes       uint64
+	UsageTime        int64
 	Replicas         []*MetaReplica
 	ReplicaNum       uint8
 	Status           int8
@@ -218,6 +222,12 @@ func (mp *MetaPartition) checkReplicaLeader() {
 	return
 }
 
+func (mp *MetaPartition) isUnavailable() bool {
+	mp.RLock()
+	defer mp.RUnlock()
+	return mp.Status == proto.Unavaliable
+}
+
 func (mp *MetaPartition) checkStatus(writeLog bool, replicaNum int) {
 	mp.Lock()
 	defer mp.Unlock()
@@ -300,6 +310,12 @@ func (mp *MetaPartition) UpdateMetaPartition(mgr *proto.MetaPartitionReport, met
 		mp.addReplica(mr)
 	}
 	mp.MaxNodeID = mgr.MaxInodeID
+	if mgr.IsLeader {
+		mp.InodeCount = mgr.InodeCount
+		if mgr.UsageTime != 0 {
+			mp.UsageFiles, mp.UsageBytes, mp.UsageTime = mgr.UsageFiles, mgr.UsageBytes, mgr.UsageTime
+		}
+	}
 	mr.updateMetric(mgr)
 	mp.checkAndRemoveMissMetaReplica(metaNode.Addr)
 }
@@ -0,0 +1,118 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"fmt"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+// the meta nodes the meta partitions of a vol are placed on, independent of the
+// placement of its data partitions. Empty labels match any meta node. The meta
+// nodes pinned to a vol are dedicated to it, the other vols get no meta partitions
+// on them, and the labels are not checked on them
+type MetaPlacement struct {
+	Zone      string   `json:",omitempty"`
+	MemClass  string   `json:",omitempty"`
+	MetaNodes []string `json:",omitempty"`
+}
+
+func (metaNode *MetaNode) matchLabels(zone, memClass string) bool {
+	metaNode.RLock()
+	defer metaNode.RUnlock()
+	return (zone == "" || metaNode.ZoneName == zone) && (memClass == "" || metaNode.MemClass == memClass)
+}
+
+func (vol *Vol) setMetaPlacement(placement MetaPlacement) {
+	vol.Lock()
+	defer vol.Unlock()
+	vol.MetaPlacement = placement
+}
+
+func (vol *Vol) getMetaPlacement() (placement MetaPlacement) {
+	vol.RLock()
+	defer vol.RUnlock()
+	placement = vol.MetaPlacement
+	placement.MetaNodes = append([]string{}, vol.MetaPlacement.MetaNodes...)
+	return
+}
+
+/*the meta nodes pinned to the vols other than volName, mapped to their vol*/
+func (c *Cluster) getPinnedMetaNodes(volName string) (pinned map[string]string) {
+	pinned = make(map[string]string)
+	for name, vol := range c.copyVols() {
+		if name == volName {
+			continue
+		}
+		for _, addr := range vol.getMetaPlacement().MetaNodes {
+			pinned[addr] = name
+		}
+	}
+	return
+}
+
+/*the meta nodes the meta partitions of the vol can not be placed on*/
+func (c *Cluster) getMetaExcludeHosts(vol *Vol) (excludeHosts []string) {
+	placement := vol.getMetaPlacement()
+	pinned := c.getPinnedMetaNodes(vol.Name)
+	excludeHosts = make([]string, 0)
+	c.metaNodes.Range(func(key, value interface{}) bool {
+		metaNode := value.(*MetaNode)
+		switch {
+		case len(placement.MetaNodes) != 0:
+			if !contains(placement.MetaNodes, metaNode.Addr) {
+				excludeHosts = append(excludeHosts, metaNode.Addr)
+			}
+		case pinned[metaNode.Addr] != "" || !metaNode.matchLabels(placement.Zone, placement.MemClass):
+			excludeHosts = append(excludeHosts, metaNode.Addr)
+		}
+		return true
+	})
+	return
+}
+
+/*the meta partitions created and the replicas moved later follow the placement, the ones placed before are not moved*/
+func (c *Cluster) setVolMetaPlacement(name string, placement MetaPlacement) (err error) {
+	var (
+		vol    *Vol
+		oldVal MetaPlacement
+	)
+	if vol, err = c.getVol(name); err != nil {
+		return
+	}
+	if len(placement.MetaNodes) != 0 && len(placement.MetaNodes) < int(vol.mpReplicaNum) {
+		return errors.Annotatef(UnMatchPara, "%v meta nodes pinned for %v replicas", len(placement.MetaNodes), vol.mpReplicaNum)
+	}
+	pinned := c.getPinnedMetaNodes(name)
+	for _, addr := range placement.MetaNodes {
+		if _, err = c.getMetaNode(addr); err != nil {
+			return
+		}
+		if other, ok := pinned[addr]; ok {
+			return hasExist(fmt.Sprintf("metaNode %v pinned to vol %v", addr, other))
+		}
+	}
+	oldVal = vol.getMetaPlacement()
+	vol.setMetaPlacement(placement)
+	if err = c.syncUpdateVol(vol); err != nil {
+		vol.setMetaPlacement(oldVal)
+		return
+	}
+	log.LogWarnf("action[setVolMetaPlacement] clusterID[%v] vol[%v] zone[%v] memClass[%v] metaNodes%v",
+		c.Name, name, placement.Zone, placement.MemClass, placement.MetaNodes)
+	return
+}
@@ -119,6 +119,14 @@ func (mf *MetadataFsm) Apply(command []byte, index uint64) (resp interface{}, er
 		if err = mf.DelKeyAndPutIndex(cmd.K, cmdMap); err != nil {
 			return
 		}
+	case OpSyncDeleteUsageStatement:
+		if err = mf.DelKeyAndPutIndex(cmd.K, cmdMap); err != nil {
+			return
+		}
+	case OpSyncDeleteToken:
+		if err = mf.DelKeyAndPutIndex(cmd.K, cmdMap); err != nil {
+			return
+		}
 	default:
 		if err = mf.BatchPut(cmdMap); err != nil {
 			return
@@ -43,6 +43,11 @@ const (
 	OpSyncDeleteVol            uint32 = 0x0F
 	OpSyncDeleteDataPartition  uint32 = 0x10
 	OpSyncDeleteMetaPartition  uint32 = 0x11
+	OpSyncPutUsageStatement    uint32 = 0x12
+	OpSyncDeleteUsageStatement uint32 = 0x13
+	OpSyncPutToken             uint32 = 0x14
+	OpSyncDeleteToken          uint32 = 0x15
+	OpSyncPutPlacement         uint32 = 0x16
 )
 
 const (
@@ -53,12 +58,18 @@ const (
 	MetaPartitionAcronym = "mp"
 	VolAcronym           = "vol"
 	ClusterAcronym       = "c"
+	UsageAcronym         = "us"
+	TokenAcronym         = "tk"
+	PlacementAcronym     = "pl"
 	MetaNodePrefix       = KeySeparator + MetaNodeAcronym + KeySeparator
 	DataNodePrefix       = KeySeparator + DataNodeAcronym + KeySeparator
 	DataPartitionPrefix  = KeySeparator + DataPartitionAcronym + KeySeparator
 	VolPrefix            = KeySeparator + VolAcronym + KeySeparator
 	MetaPartitionPrefix  = KeySeparator + MetaPartitionAcronym + KeySeparator
 	ClusterPrefix        = KeySeparator + ClusterAcronym + KeySeparator
+	UsagePrefix          = KeySeparator + UsageAcronym + KeySeparator
+	TokenPrefix          = KeySeparator + TokenAcronym + KeySeparator
+	PlacementPrefix      = KeySeparator + PlacementAcronym + KeySeparator
 )
 
 type MetaPartitionValue struct {
@@ -87,6 +98,17 @@ type DataPartitionValue struct {
 	ReplicaNum    uint8
 	Hosts         string
 	PartitionType string
+	Epoch         uint64
+	WarmHosts     string
+	ArchiveStatus string
+	ArchiveTarget string
+	Sealed        bool
+	Releasing     bool           `json:",omitempty"`
+	EncryptKeyId  string         `json:",omitempty"`
+	Replication   string         `json:",omitempty"`
+	Peers         []bsProto.Peer `json:",omitempty"`
+	ShardHosts    string         `json:",omitempty"`
+	EncodeStep    string         `json:",omitempty"`
 }
 
 func newDataPartitionValue(dp *DataPartition) (dpv *DataPartitionValue) {
@@ -95,21 +117,70 @@ func newDataPartitionValue(dp *DataPartition) (dpv *DataPartitionValue) {
 		ReplicaNum:    dp.ReplicaNum,
 		Hosts:         dp.HostsToString(),
 		PartitionType: dp.PartitionType,
+		Epoch:         dp.Epoch,
+		WarmHosts:     dp.WarmHostsToString(),
+		ArchiveStatus: dp.ArchiveStatus,
+		ArchiveTarget: dp.ArchiveTarget,
+		Sealed:        dp.Sealed,
+		Releasing:     dp.Releasing,
+		EncryptKeyId:  dp.EncryptKeyId,
+		Replication:   dp.Replication,
+		Peers:         dp.Peers,
+		ShardHosts:    dp.ShardHostsToString(),
+		EncodeStep:    dp.EncodeStep,
 	}
 	return
 }
 
 type VolValue struct {
-	VolType    string
-	ReplicaNum uint8
-	Status     uint8
+	VolType       string
+	ReplicaNum    uint8
+	Status        uint8
+	Immutable     bool
+	Quota         uint64
+	SyncOnClose   bool
+	FollowerRead  bool
+	MaxFileSize   uint64
+	MaxFiles      uint64
+	Compression   string
+	ColdTierDays  int    `json:",omitempty"`
+	Audit         bool   `json:",omitempty"`
+	ReadOnly      bool   `json:",omitempty"`
+	Permission    bool   `json:",omitempty"`
+	DegradedWrite string `json:",omitempty"`
+	Replication   string `json:",omitempty"`
+	Encrypted     bool   `json:",omitempty"`
+	EncryptKeyId  string `json:",omitempty"`
+	EncryptKey    []byte `json:",omitempty"` //set only if the key is created by the master
+	ErasureCode   bool   `json:",omitempty"`
+	MetaPlacement MetaPlacement
+	Lifecycle     []*bsProto.LifecycleRule `json:",omitempty"`
 }
 
 func newVolValue(vol *Vol) (vv *VolValue) {
 	vv = &VolValue{
-		VolType:    vol.VolType,
-		ReplicaNum: vol.dpReplicaNum,
-		Status:     vol.Status,
+		VolType:       vol.VolType,
+		ReplicaNum:    vol.dpReplicaNum,
+		Status:        vol.Status,
+		Immutable:     vol.Immutable,
+		Quota:         vol.Quota,
+		SyncOnClose:   vol.SyncOnClose,
+		FollowerRead:  vol.FollowerRead,
+		MaxFileSize:   vol.MaxFileSize,
+		MaxFiles:      vol.MaxFiles,
+		Compression:   vol.Compression,
+		ColdTierDays:  vol.ColdTierDays,
+		Audit:         vol.isAudit(),
+		ReadOnly:      vol.isReadOnly(),
+		Permission:    vol.isPermission(),
+		DegradedWrite: vol.DegradedWrite,
+		Replication:   vol.Replication,
+		Encrypted:     vol.Encrypted,
+		EncryptKeyId:  vol.EncryptKeyId,
+		EncryptKey:    vol.encryptKey,
+		MetaPlacement: vol.getMetaPlacement(),
+		Lifecycle:     vol.getLifecycleRules(),
+		ErasureCode:   vol.isErasureCode(),
 	}
 	return
 }
@@ -159,6 +230,12 @@ func (m *Metadata) setOpType() {
 		m.Op = OpSyncAddVol
 	case ClusterAcronym:
 		m.Op = OpSyncPutCluster
+	case UsageAcronym:
+		m.Op = OpSyncPutUsageStatement
+	case TokenAcronym:
+		m.Op = OpSyncPutToken
+	case PlacementAcronym:
+		m.Op = OpSyncPutPlacement
 	default:
 		log.LogWarnf("action[setOpType] unknown opCode[%v]", keyArr[1])
 	}
@@ -242,6 +319,55 @@ func (c *Cluster) syncDeleteVol(vol *Vol) (err error) {
 	return c.submit(metadata)
 }
 
+//key=#us#volName#time,value=json.Marshal(UsageStatement)
+func (c *Cluster) syncPutUsageStatement(statement *UsageStatement) (err error) {
+	return c.putUsageStatement(OpSyncPutUsageStatement, statement)
+}
+
+func (c *Cluster) syncDeleteUsageStatement(statement *UsageStatement) (err error) {
+	return c.putUsageStatement(OpSyncDeleteUsageStatement, statement)
+}
+
+func (c *Cluster) putUsageStatement(opType uint32, statement *UsageStatement) (err error) {
+	metadata := new(Metadata)
+	metadata.Op = opType
+	metadata.K = UsagePrefix + statement.VolName + KeySeparator + strconv.FormatInt(statement.Time, 10)
+	if metadata.V, err = json.Marshal(statement); err != nil {
+		return errors.New(err.Error())
+	}
+	return c.submit(metadata)
+}
+
+//key=#tk#volName#token,value=json.Marshal(Token)
+func (c *Cluster) syncPutToken(token *Token) (err error) {
+	return c.putToken(OpSyncPutToken, token)
+}
+
+func (c *Cluster) syncDeleteToken(token *Token) (err error) {
+	return c.putToken(OpSyncDeleteToken, token)
+}
+
+func (c *Cluster) putToken(opType uint32, token *Token) (err error) {
+	metadata := new(Metadata)
+	metadata.Op = opType
+	metadata.K = TokenPrefix + token.VolName + KeySeparator + token.Value
+	if metadata.V, err = json.Marshal(token); err != nil {
+		return errors.New(err.Error())
+	}
+	return c.submit(metadata)
+}
+
+//key=#pl#clusterName,value=json.Marshal(PlacementValue)
+func (c *Cluster) syncPutPlacement(value *PlacementValue) (err error) {
+	metadata := new(Metadata)
+	metadata.Op = OpSyncPutPlacement
+	metadata.K = PlacementPrefix + c.Name
+	if metadata.V, err = json.Marshal(value); err != nil {
+		return errors.New(err.Error())
+	}
+	return c.submit(metadata)
+}
+
 ////key=#mp#volName#metaPartitionID,value=json.Marshal(MetaPartitionValue)
 func (c *Cluster) syncAddMetaPartition(volName string, mp *MetaPartition) (err error) {
 	return c.putMetaPartitionInfo(OpSyncAddMetaPartition, volName, mp)
@@ -287,6 +413,7 @@ func (c *Cluster) syncAddDataNode(dataNode *DataNode) (err error) {
 	metadata := new(Metadata)
 	metadata.Op = OpSyncAddDataNode
 	metadata.K = DataNodePrefix + dataNode.Addr
+	metadata.V = []byte(strconv.FormatUint(dataNode.ID, 10))
 	return c.submit(metadata)
 }
 
@@ -346,6 +473,8 @@ func (c *Cluster) handleApply(cmd *Metadata) (err error) {
 		c.applyAddDataPartition(cmd)
 	case OpSyncUpdateDataPartition:
 		c.applyUpdateDataPartition(cmd)
+	case OpSyncDeleteDataPartition:
+		c.applyDeleteDataPartition(cmd)
 	case OpSyncDeleteMetaNode:
 		c.applyDeleteMetaNode(cmd)
 	case OpSyncDeleteDataNode:
@@ -404,7 +533,13 @@ func (c *Cluster) applyAddDataNode(cmd *Metadata) {
 	keys := strings.Split(cmd.K, KeySeparator)
 
 	if keys[1] == DataNodeAcronym {
+		id, _ := strconv.ParseUint(string(cmd.V), 10, 64)
+		if value, ok := c.dataNodes.Load(keys[2]); ok {
+			value.(*DataNode).ID = id
+			return
+		}
 		dataNode := NewDataNode(keys[2], c.Name)
+		dataNode.ID = id
 		c.dataNodes.Store(dataNode.Addr, dataNode)
 	}
 }
@@ -440,6 +575,7 @@ func (c *Cluster) applyAddVol(cmd *Metadata) {
 			return
 		}
 		vol := NewVol(keys[2], vv.VolType, vv.ReplicaNum)
+		vol.Replication = vv.Replication
 		c.putVol(vol)
 	}
 }
@@ -463,6 +599,21 @@ func (c *Cluster) applyUpdateVol(cmd *Metadata) {
 			return
 		}
 		vol.setStatus(vv.Status)
+		vol.setImmutable(vv.Immutable)
+		vol.setQuota(vv.Quota)
+		vol.setSyncOnClose(vv.SyncOnClose)
+		vol.setFollowerRead(vv.FollowerRead)
+		vol.setLimits(vv.MaxFileSize, vv.MaxFiles)
+		vol.setCompression(vv.Compression)
+		vol.setColdTierDays(vv.ColdTierDays)
+		vol.setAudit(vv.Audit)
+		vol.setReadOnly(vv.ReadOnly)
+		vol.setPermission(vv.Permission)
+		vol.setDegradedWrite(vv.DegradedWrite)
+		vol.setEncryption(vv.Encrypted, vv.EncryptKeyId, vv.EncryptKey)
+		vol.setMetaPlacement(vv.MetaPlacement)
+		vol.setLifecycleRules(vv.Lifecycle)
+		vol.setErasureCode(vv.ErasureCode)
 	}
 }
 
@@ -521,6 +672,15 @@ func (c *Cluster) applyAddDataPartition(cmd *Metadata) {
 		vol, _ := c.getVol(keys[2])
 		dp := newDataPartition(dpv.PartitionID, dpv.ReplicaNum, dpv.PartitionType, vol.Name)
 		dp.PersistenceHosts = strings.Split(dpv.Hosts, UnderlineSeparator)
+		dp.Epoch = dpv.Epoch
+		dp.setWarmHosts(dpv.WarmHosts)
+		dp.setArchive(dpv.ArchiveStatus, dpv.ArchiveTarget)
+		dp.Sealed = dpv.Sealed
+		dp.Releasing = dpv.Releasing
+		dp.EncryptKeyId = dpv.EncryptKeyId
+		dp.Replication = dpv.Replication
+		dp.Peers = dpv.Peers
+		dp.setEncode(dpv.ShardHosts, dpv.EncodeStep)
 		vol.dataPartitions.putDataPartitionByRaft(dp)
 	}
 }
@@ -538,10 +698,34 @@ func (c *Cluster) applyUpdateDataPartition(cmd *Metadata) {
 		}
 		dp := newDataPartition(dpv.PartitionID, dpv.ReplicaNum, dpv.PartitionType, vol.Name)
 		dp.PersistenceHosts = strings.Split(dpv.Hosts, UnderlineSeparator)
+		dp.Epoch = dpv.Epoch
+		dp.setWarmHosts(dpv.WarmHosts)
+		dp.setArchive(dpv.ArchiveStatus, dpv.ArchiveTarget)
+		dp.Sealed = dpv.Sealed
+		dp.Releasing = dpv.Releasing
+		dp.EncryptKeyId = dpv.EncryptKeyId
+		dp.Replication = dpv.Replication
+		dp.Peers = dpv.Peers
+		dp.setEncode(dpv.ShardHosts, dpv.EncodeStep)
 		vol.dataPartitions.putDataPartitionByRaft(dp)
 	}
 }
 
+func (c *Cluster) applyDeleteDataPartition(cmd *Metadata) {
+	log.LogInfof("action[applyDeleteDataPartition] cmd:%v", cmd.K)
+	keys := strings.Split(cmd.K, KeySeparator)
+	if keys[1] == DataPartitionAcronym {
+		dpv := &DataPartitionValue{}
+		json.Unmarshal(cmd.V, dpv)
+		vol, err := c.getVol(keys[2])
+		if err != nil {
+			log.LogError(fmt.Sprintf("action[applyDeleteDataPartition] failed,err:%v", err))
+			return
+		}
+		vol.dataPartitions.deleteDataPartition(dpv.PartitionID)
+	}
+}
+
 func (c *Cluster) decodeDataPartitionKey(key string) (acronym, volName string) {
 	return c.decodeAcronymAndNsName(key)
 }
@@ -599,10 +783,14 @@ func (c *Cluster) loadDataNodes() (err error) {
 
 	for ; it.ValidForPrefix(prefixKey); it.Next() {
 		encodedKey := it.Key()
+		encodedValue := it.Value()
 		keys := strings.Split(string(encodedKey.Data()), KeySeparator)
 		dataNode := NewDataNode(keys[2], c.Name)
+		// the nodes added before the raft replication have no id
+		dataNode.ID, _ = strconv.ParseUint(string(encodedValue.Data()), 10, 64)
 		c.dataNodes.Store(dataNode.Addr, dataNode)
 		encodedKey.Free()
+		encodedValue.Free()
 	}
 	return
 }
@@ -663,12 +851,109 @@ func (c *Cluster) loadVols() (err error) {
 		}
 		vol := NewVol(volName, vv.VolType, vv.ReplicaNum)
 		vol.Status = vv.Status
+		vol.Immutable = vv.Immutable
+		vol.Quota = vv.Quota
+		vol.SyncOnClose = vv.SyncOnClose
+		vol.FollowerRead = vv.FollowerRead
+		vol.MaxFileSize = vv.MaxFileSize
+		vol.MaxFiles = vv.MaxFiles
+		vol.Compression = vv.Compression
+		vol.ColdTierDays = vv.ColdTierDays
+		vol.Audit = vv.Audit
+		vol.ReadOnly = vv.ReadOnly
+		vol.Permission = vv.Permission
+		vol.DegradedWrite = vv.DegradedWrite
+		vol.Replication = vv.Replication
+		vol.Encrypted = vv.Encrypted
+		vol.EncryptKeyId = vv.EncryptKeyId
+		vol.encryptKey = vv.EncryptKey
+		vol.ErasureCode = vv.ErasureCode
+		vol.MetaPlacement = vv.MetaPlacement
+		vol.LifecycleRules = vv.Lifecycle
 		c.putVol(vol)
 		encodedKey.Free()
 	}
 	return
 }
 
+/*the statements are read from the store on demand and not kept in memory, the keys sort them by time*/
+func (c *Cluster) loadUsageStatements(volName string) (statements []*UsageStatement, err error) {
+	snapshot := c.fsm.store.RocksDBSnapshot()
+	it := c.fsm.store.Iterator(snapshot)
+	defer func() {
+		it.Close()
+		c.fsm.store.ReleaseSnapshot(snapshot)
+	}()
+	statements = make([]*UsageStatement, 0)
+	prefixKey := []byte(UsagePrefix + volName + KeySeparator)
+	it.Seek(prefixKey)
+	for ; it.ValidForPrefix(prefixKey); it.Next() {
+		encodedKey := it.Key()
+		encodedValue := it.Value()
+		statement := &UsageStatement{}
+		if err = json.Unmarshal(encodedValue.Data(), statement); err != nil {
+			err = fmt.Errorf("action[loadUsageStatements],value:%v,err:%v", encodedValue.Data(), err)
+			return
+		}
+		statements = append(statements, statement)
+		encodedKey.Free()
+	}
+	return
+}
+
+/*the tokens of the vols not loaded are skipped, they are deleted with the vol*/
+func (c *Cluster) loadTokens() (err error) {
+	snapshot := c.fsm.store.RocksDBSnapshot()
+	it := c.fsm.store.Iterator(snapshot)
+	defer func() {
+		it.Close()
+		c.fsm.store.ReleaseSnapshot(snapshot)
+	}()
+	prefixKey := []byte(TokenPrefix)
+	it.Seek(prefixKey)
+	for ; it.ValidForPrefix(prefixKey); it.Next() {
+		encodedKey := it.Key()
+		encodedValue := it.Value()
+		token := &Token{}
+		if err = json.Unmarshal(encodedValue.Data(), token); err != nil {
+			err = fmt.Errorf("action[loadTokens],value:%v,err:%v", encodedValue.Data(), err)
+			return
+		}
+		vol, err1 := c.getVol(token.VolName)
+		if err1 != nil {
+			log.LogWarnf("action[loadTokens] vol[%v]: %v", token.VolName, err1)
+			encodedKey.Free()
+			continue
+		}
+		vol.putToken(token)
+		encodedKey.Free()
+	}
+	return
+}
+
+func (c *Cluster) loadPlacement() (err error) {
+	snapshot := c.fsm.store.RocksDBSnapshot()
+	it := c.fsm.store.Iterator(snapshot)
+	defer func() {
+		it.Close()
+		c.fsm.store.ReleaseSnapshot(snapshot)
+	}()
+	prefixKey := []byte(PlacementPrefix)
+	it.Seek(prefixKey)
+	for ; it.ValidForPrefix(prefixKey); it.Next() {
+		encodedKey := it.Key()
+		encodedValue := it.Value()
+		value := &PlacementValue{}
+		if err = json.Unmarshal(encodedValue.Data(), value); err != nil {
+			err = fmt.Errorf("action[loadPlacement],value:%v,err:%v", encodedValue.Data(), err)
+			return
+		}
+		c.placement.restore(value)
+		encodedKey.Free()
+	}
+	return
+}
+
 func (c *Cluster) loadMetaPartitions() (err error) {
 	snapshot := c.fsm.store.RocksDBSnapshot()
 	it := c.fsm.store.Iterator(snapshot)
@@ -732,6 +1017,15 @@ func (c *Cluster) loadDataPartitions() (err error) {
 		dp := newDataPartition(dpv.PartitionID, dpv.ReplicaNum, dpv.PartitionType, volName)
 		dp.Lock()
 		dp.PersistenceHosts = strings.Split(dpv.Hosts, UnderlineSeparator)
+		dp.Epoch = dpv.Epoch
+		dp.setWarmHosts(dpv.WarmHosts)
+		dp.setArchive(dpv.ArchiveStatus, dpv.ArchiveTarget)
+		dp.Sealed = dpv.Sealed
+		dp.Releasing = dpv.Releasing
+		dp.EncryptKeyId = dpv.EncryptKeyId
+		dp.Replication = dpv.Replication
+		dp.Peers = dpv.Peers
+		dp.setEncode(dpv.ShardHosts, dpv.EncodeStep)
 		dp.Unlock()
 		vol.dataPartitions.putDataPartition(dp)
 		encodedKey.Free()
@@ -0,0 +1,114 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/tiglabs/containerfs/util/metrics"
+)
+
+//the metrics are served by every master, the cluster metrics are only meaningful on the leader
+func (m *Master) registerMetrics() {
+	registry := metrics.NewRegistry("master")
+	registry.Register(m.collectMetrics)
+	http.Handle(metrics.MetricsPath, registry)
+}
+
+func (m *Master) collectMetrics(w *metrics.Writer) {
+	if m.partition != nil {
+		_, term := m.partition.LeaderTerm()
+		w.Gauge("master_raft_leader", "Whether the master is the raft leader.", metrics.Bool(m.partition.IsLeader()))
+		w.Gauge("master_raft_term", "Raft term of the masters.", float64(term))
+		w.Gauge("master_raft_applied", "Applied raft index of the master.", float64(m.partition.AppliedIndex()))
+	}
+	if m.readLease != nil {
+		w.Counter("master_follower_reads_total", "Read only queries served by the master as a follower.", float64(atomic.LoadUint64(&m.readLease.reads)))
+	}
+	if m.fsm != nil {
+		w.Gauge("master_fsm_applied", "Applied index of the metadata fsm.", float64(m.fsm.applied))
+	}
+	if m.cluster == nil {
+		return
+	}
+	m.cluster.collectMetrics(w)
+}
+
+func (c *Cluster) collectMetrics(w *metrics.Writer) {
+	var dataNodes, activeDataNodes, metaNodes, activeMetaNodes int
+	c.dataNodes.Range(func(addr, node interface{}) bool {
+		dataNode := node.(*DataNode)
+		dataNode.RLock()
+		dataNodes++
+		if dataNode.isActive {
+			activeDataNodes++
+		}
+		w.Gauge("master_datanode_total_bytes", "Total bytes of data node.", float64(dataNode.Total), "addr", dataNode.Addr, "rack", dataNode.RackName)
+		w.Gauge("master_datanode_used_bytes", "Used bytes of data node.", float64(dataNode.Used), "addr", dataNode.Addr, "rack", dataNode.RackName)
+		w.Gauge("master_datanode_partitions", "Data partitions of data node.", float64(dataNode.DataPartitionCount), "addr", dataNode.Addr, "rack", dataNode.RackName)
+		w.Gauge("master_datanode_clock_offset_seconds", "Clock offset of data node to the master.", float64(dataNode.ClockOffset), "addr", dataNode.Addr)
+		dataNode.RUnlock()
+		w.Gauge("master_datanode_pending_tasks", "Admin tasks queued for data node, including repairs.", float64(dataNode.Sender.taskCount()), "addr", dataNode.Addr)
+		return true
+	})
+	c.metaNodes.Range(func(addr, node interface{}) bool {
+		metaNode := node.(*MetaNode)
+		metaNode.RLock()
+		metaNodes++
+		if metaNode.IsActive {
+			activeMetaNodes++
+		}
+		w.Gauge("master_metanode_total_bytes", "Total memory of meta node.", float64(metaNode.Total), "addr", metaNode.Addr, "rack", metaNode.RackName)
+		w.Gauge("master_metanode_used_bytes", "Used memory of meta node.", float64(metaNode.Used), "addr", metaNode.Addr, "rack", metaNode.RackName)
+		w.Gauge("master_metanode_partitions", "Meta partitions of meta node.", float64(metaNode.MetaPartitionCount), "addr", metaNode.Addr, "rack", metaNode.RackName)
+		w.Gauge("master_metanode_clock_offset_seconds", "Clock offset of meta node to the master.", float64(metaNode.ClockOffset), "addr", metaNode.Addr)
+		metaNode.RUnlock()
+		w.Gauge("master_metanode_pending_tasks", "Admin tasks queued for meta node.", float64(metaNode.Sender.taskCount()), "addr", metaNode.Addr)
+		return true
+	})
+	w.Gauge("master_datanodes", "Data nodes of the cluster.", float64(dataNodes))
+	w.Gauge("master_datanodes_active", "Active data nodes of the cluster.", float64(activeDataNodes))
+	w.Gauge("master_metanodes", "Meta nodes of the cluster.", float64(metaNodes))
+	w.Gauge("master_metanodes_active", "Active meta nodes of the cluster.", float64(activeMetaNodes))
+	if c.notifier != nil {
+		view := c.notifier.getView()
+		for event, count := range view.Sent {
+			w.Counter("master_notifications_total", "Notifications of the events sent to the routes.", float64(count), "event", event)
+		}
+		for event, count := range view.Deduplicated {
+			w.Counter("master_notifications_deduplicated_total", "Notifications of the events dropped in the dedup window.", float64(count), "event", event)
+		}
+		w.Counter("master_notifications_failed_total", "Notifications a target did not get.", float64(view.Failed))
+	}
+
+	for name, vol := range c.copyVols() {
+		used, total := vol.statSpace()
+		vol.dataPartitions.RLock()
+		dps := len(vol.dataPartitions.dataPartitionMap)
+		rwDps := vol.dataPartitions.readWriteDataPartitions
+		vol.dataPartitions.RUnlock()
+		vol.mpsLock.RLock()
+		mps := len(vol.MetaPartitions)
+		vol.mpsLock.RUnlock()
+		w.Gauge("master_vol_total_bytes", "Capacity of vol data partitions.", float64(total), "vol", name)
+		w.Gauge("master_vol_used_bytes", "Used bytes of vol.", float64(used), "vol", name)
+		w.Gauge("master_vol_quota_bytes", "Quota of vol, 0 means no quota.", float64(vol.getQuota()), "vol", name)
+		w.Gauge("master_vol_files", "Inodes of vol reported by the meta partition leaders.", float64(vol.getFileCount()), "vol", name)
+		w.Gauge("master_vol_data_partitions", "Data partitions of vol.", float64(dps), "vol", name)
+		w.Gauge("master_vol_rw_data_partitions", "Writable data partitions of vol.", float64(rwDps), "vol", name)
+		w.Gauge("master_vol_meta_partitions", "Meta partitions of vol.", float64(mps), "vol", name)
+	}
+}
@@ -0,0 +1,342 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"sort"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util"
+)
+
+const (
+	DefaultMigrationBandwidth = 50 * util.MB //assumed bytes per second a new replica is caught up at
+	MaxPlannedMigrations      = 1000
+)
+
+// a replica move of a dry run, Target is empty if the replica is only removed
+// or no data node can take it, Msg tells which
+type PlannedMigration struct {
+	PartitionID uint64
+	VolName     string
+	Source      string
+	SourceDisk  string
+	Target      string
+	Bytes       uint64
+	Msg         string
+}
+
+// the moves a rebalance, decommission or offline would schedule now, the targets
+// are estimated on the current usage, the placement at execution may differ
+type MigrationPlan struct {
+	Migrations       []*PlannedMigration
+	TotalBytes       uint64
+	MaxMigrations    int
+	EstimatedSeconds int64
+	SkewBefore       float64
+	SkewAfter        float64
+}
+
+type planNode struct {
+	addr  string
+	rack  string
+	used  uint64
+	total uint64
+}
+
+func newMigrationPlan(maxMigrations int) (plan *MigrationPlan) {
+	if maxMigrations <= 0 {
+		maxMigrations = 1
+	}
+	return &MigrationPlan{Migrations: make([]*PlannedMigration, 0), MaxMigrations: maxMigrations}
+}
+
+/*estimate the duration with MaxMigrations moves in parallel, a move starts at least startInterval seconds after the previous one*/
+func (plan *MigrationPlan) estimate(startInterval int64) {
+	slots := make([]int64, plan.MaxMigrations)
+	var started int64
+	for _, m := range plan.Migrations {
+		if m.Target == "" {
+			continue
+		}
+		plan.TotalBytes += m.Bytes
+		free := 0
+		for i := range slots {
+			if slots[i] < slots[free] {
+				free = i
+			}
+		}
+		start := slots[free]
+		if s := started * startInterval; s > start {
+			start = s
+		}
+		started++
+		// the catch up of a replica is found by the check after it finished
+		slots[free] = start + int64(m.Bytes/DefaultMigrationBandwidth) + RebalanceCheckIntervalSeconds
+		if slots[free] > plan.EstimatedSeconds {
+			plan.EstimatedSeconds = slots[free]
+		}
+	}
+}
+
+/*the data nodes which can take a migrated replica, with the same conditions as the rebalance target*/
+func (c *Cluster) getPlanNodes() (nodes []*planNode) {
+	nodes = make([]*planNode, 0)
+	c.dataNodes.Range(func(addr, node interface{}) bool {
+		dataNode := node.(*DataNode)
+		dataNode.RLock()
+		defer dataNode.RUnlock()
+		if !dataNode.isActive || dataNode.Total == 0 || isClockSkewed(dataNode.ClockOffset) || dataNode.Draining {
+			return true
+		}
+		nodes = append(nodes, &planNode{addr: dataNode.Addr, rack: dataNode.RackName, used: dataNode.Used, total: dataNode.Total})
+		return true
+	})
+	return
+}
+
+func (c *Cluster) getPlacedPlanNodes(nodes []*planNode, partitionType string, hosts []string, source string) (placed []*planNode) {
+	placed = make([]*planNode, 0, len(nodes))
+	for _, n := range nodes {
+		if c.isPlacementAllowed(partitionType, hosts, source, n.addr) {
+			placed = append(placed, n)
+		}
+	}
+	return
+}
+
+/*the least utilized node not holding the partition with room for the replica, rack is ignored if empty*/
+func pickPlanTarget(nodes []*planNode, hosts []string, rack string, bytes uint64) (target *planNode) {
+	minRatio := 1.0
+	for _, n := range nodes {
+		if contains(hosts, n.addr) || (rack != "" && n.rack != rack) || n.total < n.used+bytes {
+			continue
+		}
+		if ratio := float64(n.used) / float64(n.total); ratio < minRatio {
+			minRatio = ratio
+			target = n
+		}
+	}
+	if target != nil {
+		target.used += bytes
+	}
+	return
+}
+
+/*the partition reports of the source disk, the most used first*/
+func (c *Cluster) getDiskPartitionReports(source *DiskUsage) (reports []*proto.PartitionReport, err error) {
+	var sourceNode *DataNode
+	if sourceNode, err = c.getDataNode(source.Addr); err != nil {
+		return
+	}
+	sourceNode.RLock()
+	reports = make([]*proto.PartitionReport, 0)
+	for _, vr := range sourceNode.partitionReports {
+		if vr.DiskPath == source.Path {
+			reports = append(reports, vr)
+		}
+	}
+	sourceNode.RUnlock()
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Used > reports[j].Used
+	})
+	return
+}
+
+/*simulate the rebalance checks on the current disk usage until the skew is under threshold*/
+func (c *Cluster) planRebalance(threshold float64, maxMigrations int) (plan *MigrationPlan, err error) {
+	if err = checkRebalancePara(threshold, maxMigrations); err != nil {
+		return
+	}
+	plan = newMigrationPlan(maxMigrations)
+	disks := c.getDiskUsages()
+	nodes := c.getPlanNodes()
+	plan.SkewBefore = diskSkew(disks)
+	planned := make(map[uint64]bool)
+	rb := c.rebalancer
+	rb.Lock()
+	for id := range rb.migrations {
+		planned[id] = true
+	}
+	rb.Unlock()
+	for len(plan.Migrations) < MaxPlannedMigrations && diskSkew(disks) > threshold {
+		source := disks[0]
+		m := c.planRebalanceMove(source, nodes, planned)
+		if m == nil {
+			break
+		}
+		plan.Migrations = append(plan.Migrations, m)
+		planned[m.PartitionID] = true
+		moveDiskUsage(disks, source, m.Target, m.Bytes)
+	}
+	plan.SkewAfter = diskSkew(disks)
+	// the rebalance starts one migration in each check
+	plan.estimate(RebalanceCheckIntervalSeconds)
+	return
+}
+
+func (c *Cluster) planRebalanceMove(source *DiskUsage, nodes []*planNode, planned map[uint64]bool) (m *PlannedMigration) {
+	var target *planNode
+	minRatio := 1.0
+	for _, n := range nodes {
+		if n.addr == source.Addr {
+			continue
+		}
+		if ratio := float64(n.used) / float64(n.total); ratio < minRatio {
+			minRatio = ratio
+			target = n
+		}
+	}
+	if target == nil {
+		return
+	}
+	reports, err := c.getDiskPartitionReports(source)
+	if err != nil {
+		return
+	}
+	for _, vr := range reports {
+		if planned[vr.PartitionID] {
+			continue
+		}
+		dp, err := c.getDataPartitionByID(vr.PartitionID)
+		if err != nil || !c.canRebalance(dp, source.Addr, target.addr) {
+			continue
+		}
+		m = &PlannedMigration{PartitionID: dp.PartitionID, VolName: dp.VolName, Source: source.Addr,
+			SourceDisk: source.Path, Target: target.addr, Bytes: dp.getMaxUsedSize(), Msg: "warm replica promoted"}
+		target.used += m.Bytes
+		return
+	}
+	return
+}
+
+/*move bytes from the source disk to the least utilized disk of the target, keep the disks sorted*/
+func moveDiskUsage(disks []*DiskUsage, source *DiskUsage, target string, bytes uint64) {
+	if bytes > source.Used {
+		bytes = source.Used
+	}
+	source.Used -= bytes
+	source.Ratio = float64(source.Used) / float64(source.Total)
+	var dst *DiskUsage
+	for _, d := range disks {
+		if d.Addr == target && (dst == nil || d.Ratio < dst.Ratio) {
+			dst = d
+		}
+	}
+	if dst != nil {
+		dst.Used += bytes
+		dst.Ratio = float64(dst.Used) / float64(dst.Total)
+	}
+	sort.Slice(disks, func(i, j int) bool {
+		return disks[i].Ratio > disks[j].Ratio
+	})
+}
+
+/*the moves to drain the node, maxMigrations of them in parallel*/
+func (c *Cluster) planDecommission(addr string, maxMigrations int) (plan *MigrationPlan, err error) {
+	if maxMigrations <= 0 {
+		return nil, errors.Annotatef(UnMatchPara, "maxMigrations[%v]", maxMigrations)
+	}
+	return c.planDataNodeMoves(addr, maxMigrations, true)
+}
+
+/*the moves of the offline of the node, all of them are started at once*/
+func (c *Cluster) planDataNodeOffline(addr string) (plan *MigrationPlan, err error) {
+	return c.planDataNodeMoves(addr, 0, false)
+}
+
+func (c *Cluster) planDataNodeMoves(addr string, maxMigrations int, useWarmReplica bool) (plan *MigrationPlan, err error) {
+	var dataNode *DataNode
+	if dataNode, err = c.getDataNode(addr); err != nil {
+		return
+	}
+	dps := c.getDataNodePartitions(addr)
+	if maxMigrations <= 0 {
+		maxMigrations = len(dps)
+	}
+	plan = newMigrationPlan(maxMigrations)
+	nodes := c.getPlanNodes()
+	for _, dp := range dps {
+		plan.Migrations = append(plan.Migrations, c.planMoveOff(dp, addr, dataNode.RackName, nodes, useWarmReplica))
+	}
+	plan.estimate(0)
+	return
+}
+
+/*the move of the replica of a partition off a node*/
+func (c *Cluster) planDataPartitionOffline(addr string, dp *DataPartition) (plan *MigrationPlan, err error) {
+	var dataNode *DataNode
+	if dataNode, err = c.getDataNode(addr); err != nil {
+		return
+	}
+	plan = newMigrationPlan(1)
+	plan.Migrations = append(plan.Migrations, c.planMoveOff(dp, addr, dataNode.RackName, c.getPlanNodes(), false))
+	plan.estimate(0)
+	return
+}
+
+func (c *Cluster) planMoveOff(dp *DataPartition, addr, rack string, nodes []*planNode, useWarmReplica bool) (m *PlannedMigration) {
+	m = &PlannedMigration{PartitionID: dp.PartitionID, VolName: dp.VolName, Source: addr}
+	vol, err := c.getVol(dp.VolName)
+	if err != nil {
+		m.Msg = err.Error()
+		return
+	}
+	m.Bytes = dp.getMaxUsedSize()
+	dp.RLock()
+	isWarm := dp.isInWarmHosts(addr)
+	warmHosts := append([]string{}, dp.WarmHosts...)
+	hosts := append(append([]string{}, dp.PersistenceHosts...), dp.WarmHosts...)
+	canWarm := useWarmReplica && dp.PartitionType == proto.ExtentPartition && !dp.isRaftReplicated() && dp.EncodeStep == ""
+	partitionType := dp.PartitionType
+	err = dp.hasMissOne(dp.getReplicaNum(vol))
+	if err == nil {
+		err = dp.canOffLine(addr)
+	}
+	dp.RUnlock()
+	switch {
+	case isWarm:
+		m.Bytes = 0
+		m.Msg = "warm replica removed"
+	case err != nil:
+		m.Msg = err.Error()
+	case !useWarmReplica && len(warmHosts) != 0:
+		// the offline promotes the warm replica, it only catches up the recent writes
+		m.Target = warmHosts[0]
+		m.Bytes = 0
+		m.Msg = "warm replica promoted"
+	default:
+		if c.placement.isEnabled() {
+			// the target is in a free failure domain instead of the rack of the source
+			rack = ""
+			nodes = c.getPlacedPlanNodes(nodes, partitionType, hosts, addr)
+		}
+		target := pickPlanTarget(nodes, hosts, rack, m.Bytes)
+		if target == nil {
+			m.Msg = NoHaveAnyDataNodeToWrite.Error()
+			return
+		}
+		m.Target = target.addr
+		if canWarm {
+			m.Msg = "warm replica promoted"
+		} else if dp.isRaftReplicated() {
+			m.Msg = "replica caught up by raft"
+		} else {
+			m.Msg = "replica rebuilt by repair"
+		}
+	}
+	return
+}
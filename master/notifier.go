@@ -0,0 +1,293 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	NotifyDataNodeDown         = "dataNodeDown"
+	NotifyMetaNodeDown         = "metaNodeDown"
+	NotifyDiskFailure          = "diskFailure"
+	NotifyPartitionUnavailable = "partitionUnavailable"
+	NotifyVolNearFull          = "volNearFull"
+	NotifyRepairBacklog        = "repairBacklog"
+	NotifyAllEvents            = "*"
+	NotifyMailPrefix           = "mailto:"
+)
+
+const (
+	DefaultNotifyDedupMinutes  = 30
+	DefaultNotifyRepairBacklog = 100 //data partitions rebuilding a replica
+	NotifyQueueCount           = 1000
+	NotifyHistoryCount         = 100
+	NotifyTimeout              = 10 * time.Second
+)
+
+var notifyEvents = []string{NotifyDataNodeDown, NotifyMetaNodeDown, NotifyDiskFailure,
+	NotifyPartitionUnavailable, NotifyVolNearFull, NotifyRepairBacklog}
+
+// a notification is posted as JSON to the webhooks and sent as the body of the mails
+type Notification struct {
+	Cluster string
+	Event   string
+	Key     string //the node, disk, partition or vol of the event
+	Msg     string
+	Time    int64
+}
+
+// the targets get the notifications of the events, a target is a webhook URL
+// or mailto: with the recipients separated by comma
+type NotifyRoute struct {
+	Events []string
+	Target string
+}
+
+type SMTPConfig struct {
+	Addr     string
+	From     string
+	User     string
+	Password string `json:"-"`
+}
+
+type NotifierView struct {
+	Routes        []*NotifyRoute
+	DedupSeconds  int64
+	RepairBacklog int
+	Sent          map[string]uint64 //notifications of each event
+	Deduplicated  map[string]uint64 //notifications of each event dropped in the dedup window
+	Failed        uint64            //deliveries to a target failed or dropped for a full queue
+	History       []*Notification
+}
+
+// the dedup state and the history are kept only in the memory of the leader
+// like the rebalance, a new leader notifies the events still going on again
+type notifier struct {
+	cluster       string
+	routes        []*NotifyRoute
+	smtp          SMTPConfig
+	dedup         time.Duration
+	repairBacklog int
+	fired         map[string]time.Time //event and key -> last notified
+	sent          map[string]uint64
+	deduplicated  map[string]uint64
+	failed        uint64
+	history       []*Notification
+	queue         chan *Notification
+	client        *http.Client
+	sync.Mutex
+}
+
+/*a route is "EVENT[,EVENT...]=TARGET", * matches all the events*/
+func parseNotifyRoute(value string) (route *NotifyRoute, err error) {
+	i := strings.Index(value, "=")
+	if i <= 0 || i == len(value)-1 {
+		return nil, fmt.Errorf("notify route(%v) is invalid", value)
+	}
+	route = &NotifyRoute{Events: strings.Split(value[:i], CommaSplit), Target: value[i+1:]}
+	for _, event := range route.Events {
+		if event != NotifyAllEvents && !contains(notifyEvents, event) {
+			return nil, fmt.Errorf("notify route(%v) has unknown event(%v)", value, event)
+		}
+	}
+	if !strings.HasPrefix(route.Target, "http://") && !strings.HasPrefix(route.Target, "https://") &&
+		!strings.HasPrefix(route.Target, NotifyMailPrefix) {
+		return nil, fmt.Errorf("notify route(%v) target is neither a URL nor mailto:", value)
+	}
+	return
+}
+
+/*no route disables the notifications*/
+func newNotifier(cluster string, routes []*NotifyRoute, smtpCfg SMTPConfig, dedup time.Duration, repairBacklog int) *notifier {
+	n := &notifier{
+		cluster:       cluster,
+		routes:        routes,
+		smtp:          smtpCfg,
+		dedup:         dedup,
+		repairBacklog: repairBacklog,
+		fired:         make(map[string]time.Time),
+		sent:          make(map[string]uint64),
+		deduplicated:  make(map[string]uint64),
+		history:       make([]*Notification, 0),
+		queue:         make(chan *Notification, NotifyQueueCount),
+		client:        &http.Client{Timeout: NotifyTimeout},
+	}
+	if len(routes) != 0 {
+		go n.sendScheduler()
+	}
+	return n
+}
+
+func (r *NotifyRoute) matches(event string) bool {
+	return contains(r.Events, NotifyAllEvents) || contains(r.Events, event)
+}
+
+/*notify the event of key unless it was notified in the dedup window, a nil notifier notifies nothing*/
+func (n *notifier) notify(event, key, msg string) {
+	if n == nil || len(n.routes) == 0 {
+		return
+	}
+	now := time.Now()
+	n.Lock()
+	id := event + "/" + key
+	if last, ok := n.fired[id]; ok && now.Sub(last) < n.dedup {
+		n.deduplicated[event]++
+		n.Unlock()
+		return
+	}
+	n.fired[id] = now
+	for k, last := range n.fired {
+		if now.Sub(last) >= n.dedup {
+			delete(n.fired, k)
+		}
+	}
+	notification := &Notification{Cluster: n.cluster, Event: event, Key: key, Msg: msg, Time: now.Unix()}
+	n.sent[event]++
+	n.history = append(n.history, notification)
+	if len(n.history) > NotifyHistoryCount {
+		n.history = n.history[len(n.history)-NotifyHistoryCount:]
+	}
+	n.Unlock()
+	select {
+	case n.queue <- notification:
+	default:
+		n.addFailed()
+		log.LogWarnf("action[notify] event[%v] key[%v] dropped, the queue is full", event, key)
+	}
+}
+
+func (n *notifier) addFailed() {
+	n.Lock()
+	n.failed++
+	n.Unlock()
+}
+
+func (n *notifier) sendScheduler() {
+	for notification := range n.queue {
+		for _, route := range n.routes {
+			if !route.matches(notification.Event) {
+				continue
+			}
+			var err error
+			if strings.HasPrefix(route.Target, NotifyMailPrefix) {
+				err = n.mail(route.Target[len(NotifyMailPrefix):], notification)
+			} else {
+				err = n.post(route.Target, notification)
+			}
+			if err != nil {
+				n.addFailed()
+				log.LogWarnf("action[notify] event[%v] key[%v] to target[%v]: %v",
+					notification.Event, notification.Key, route.Target, err)
+			}
+		}
+	}
+}
+
+func (n *notifier) post(url string, notification *Notification) (err error) {
+	data, err := json.Marshal(notification)
+	if err != nil {
+		return
+	}
+	resp, err := n.client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		err = fmt.Errorf("status %v", resp.StatusCode)
+	}
+	return
+}
+
+func (n *notifier) mail(recipients string, notification *Notification) (err error) {
+	if n.smtp.Addr == "" {
+		return fmt.Errorf("no smtp server")
+	}
+	to := strings.Split(recipients, CommaSplit)
+	var auth smtp.Auth
+	if n.smtp.User != "" {
+		host, _, _ := net.SplitHostPort(n.smtp.Addr)
+		auth = smtp.PlainAuth("", n.smtp.User, n.smtp.Password, host)
+	}
+	body := new(bytes.Buffer)
+	fmt.Fprintf(body, "From: %v\r\nTo: %v\r\nSubject: [%v] %v %v\r\n\r\n%v\r\n",
+		n.smtp.From, recipients, notification.Cluster, notification.Event, notification.Key, notification.Msg)
+	fmt.Fprintf(body, "\r\ntime: %v\r\n", time.Unix(notification.Time, 0).Format(time.RFC3339))
+	return smtp.SendMail(n.smtp.Addr, auth, n.smtp.From, to, body.Bytes())
+}
+
+func (n *notifier) getView() (view *NotifierView) {
+	view = &NotifierView{Routes: make([]*NotifyRoute, 0), Sent: make(map[string]uint64),
+		Deduplicated: make(map[string]uint64), History: make([]*Notification, 0)}
+	if n == nil {
+		return
+	}
+	n.Lock()
+	defer n.Unlock()
+	view.Routes = n.routes
+	view.DedupSeconds = int64(n.dedup / time.Second)
+	view.RepairBacklog = n.repairBacklog
+	for event, count := range n.sent {
+		view.Sent[event] = count
+	}
+	for event, count := range n.deduplicated {
+		view.Deduplicated[event] = count
+	}
+	view.Failed = n.failed
+	view.History = append(view.History, n.history...)
+	return
+}
+
+func (c *Cluster) notify(event, key, msg string) {
+	c.notifier.notify(event, key, msg)
+}
+
+func (c *Cluster) getNotifierView() (view *NotifierView) {
+	return c.notifier.getView()
+}
+
+/*the partitions rebuilding a replica over the threshold are notified as a backlog of the repairs*/
+func (c *Cluster) checkRepairBacklog() {
+	if c.notifier == nil || c.notifier.repairBacklog <= 0 {
+		return
+	}
+	recovering := 0
+	for _, vol := range c.getAllNormalVols() {
+		vol.dataPartitions.RLock()
+		for _, dp := range vol.dataPartitions.dataPartitionMap {
+			dp.RLock()
+			if dp.isRecover {
+				recovering++
+			}
+			dp.RUnlock()
+		}
+		vol.dataPartitions.RUnlock()
+	}
+	if recovering > c.notifier.repairBacklog {
+		c.notify(NotifyRepairBacklog, c.Name, fmt.Sprintf("clusterID[%v] %v data partitions rebuilding a replica, over the threshold %v",
+			c.Name, recovering, c.notifier.repairBacklog))
+	}
+}
@@ -63,6 +63,22 @@ func UnmarshalTaskResponse(task *proto.AdminTask) (err error) {
 		response = &proto.DeleteDataPartitionResponse{}
 	case proto.OpLoadDataPartition:
 		response = &proto.LoadDataPartitionResponse{}
+	case proto.OpArchiveDataPartition:
+		response = &proto.ArchiveDataPartitionResponse{}
+	case proto.OpRehydrateDataPartition:
+		response = &proto.RehydrateDataPartitionResponse{}
+	case proto.OpEncodeDataPartition:
+		response = &proto.EncodeDataPartitionResponse{}
+	case proto.OpMoveDataPartition:
+		response = &proto.MoveDataPartitionResponse{}
+	case proto.OpOfflineDataPartition:
+		response = &proto.DataPartitionOfflineResponse{}
+	case proto.OpRepairDataPartition:
+		response = &proto.RepairDataPartitionResponse{}
+	case proto.OpVerifyDataPartition:
+		response = &proto.VerifyDataPartitionResponse{}
+	case proto.OpTierExtents:
+		response = &proto.TierExtentsResponse{}
 	case proto.OpDeleteFile:
 		response = &proto.DeleteFileResponse{}
 	case proto.OpMetaNodeHeartbeat:
@@ -106,6 +122,11 @@ func contains(arr []string, element string) (ok bool) {
 	return
 }
 
+/*the node clock differs too much from the master, new partitions are not placed on it*/
+func isClockSkewed(offset int64) bool {
+	return offset > DefaultMaxClockSkewSec || offset < -DefaultMaxClockSkewSec
+}
+
 func Warn(clusterID, msg string) {
 	umpKey := fmt.Sprintf("%s_%s", clusterID, UmpModuleName)
 	WarnBySpecialUmpKey(umpKey, msg)
@@ -0,0 +1,212 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	CheckRunning = "running"
+	CheckDone    = "done"
+	CheckFailed  = "failed"
+)
+
+// the last repair or verify asked for a replica, shown in the replicas of the
+// partition. It is kept only in the memory of the leader, like the rebalance
+type ReplicaCheck struct {
+	StartTime   int64
+	EndTime     int64
+	Status      string
+	Result      string
+	Quarantined int //ranges waiting for repair after the verify
+}
+
+type VolCheckView struct {
+	Name       string
+	Partitions int               //partitions the repair or verify is sent for
+	Failed     map[uint64]string //partitions rejected and the reasons
+}
+
+func (partition *DataPartition) generateRepairTask(addr string) (task *proto.AdminTask) {
+	task = proto.NewAdminTask(proto.OpRepairDataPartition, addr, &proto.RepairDataPartitionRequest{PartitionId: partition.PartitionID})
+	partition.resetTaskID(task)
+	return
+}
+
+func (partition *DataPartition) generateVerifyTask(addr string) (task *proto.AdminTask) {
+	task = proto.NewAdminTask(proto.OpVerifyDataPartition, addr, &proto.VerifyDataPartitionRequest{PartitionId: partition.PartitionID})
+	partition.resetTaskID(task)
+	return
+}
+
+/*the caller must hold the lock of partition*/
+func (partition *DataPartition) canCheck() (err error) {
+	if partition.ArchiveStatus != "" {
+		return errors.Annotatef(DataPartitionArchived, "partitionID[%v] %v", partition.PartitionID, partition.ArchiveStatus)
+	}
+	if len(partition.PersistenceHosts) == 0 {
+		return errors.Annotatef(DataReplicaNotFound, "partitionID[%v] has no hosts", partition.PartitionID)
+	}
+	return
+}
+
+/*ask the leader to repair the replicas of the partition at once*/
+func (c *Cluster) repairDataPartition(dp *DataPartition) (err error) {
+	var replica *DataReplica
+	dp.Lock()
+	defer dp.Unlock()
+	if err = dp.canCheck(); err != nil {
+		return
+	}
+	if dp.isRaftReplicated() || dp.PartitionType == proto.ErasureCodePartition {
+		return errors.Annotatef(InvalidDataPartitionType, "partitionID[%v] type[%v] replication[%v] not repaired from the leader",
+			dp.PartitionID, dp.PartitionType, dp.Replication)
+	}
+	leader := dp.PersistenceHosts[0]
+	if replica, err = dp.getReplica(leader); err != nil {
+		return
+	}
+	replica.LastRepair = &ReplicaCheck{StartTime: time.Now().Unix(), Status: CheckRunning}
+	c.putDataNodeTasks([]*proto.AdminTask{dp.generateRepairTask(leader)})
+	log.LogWarnf("action[repairDataPartition] clusterID[%v] partitionID:%v vol[%v] repair on leader[%v] sent",
+		c.Name, dp.PartitionID, dp.VolName, leader)
+	return
+}
+
+/*ask every replica of the partition to verify its crcs at once*/
+func (c *Cluster) verifyDataPartition(dp *DataPartition) (err error) {
+	var replica *DataReplica
+	dp.Lock()
+	defer dp.Unlock()
+	if err = dp.canCheck(); err != nil {
+		return
+	}
+	replicas := make([]*DataReplica, 0, len(dp.PersistenceHosts))
+	for _, host := range dp.PersistenceHosts {
+		if replica, err = dp.getReplica(host); err != nil {
+			return
+		}
+		replicas = append(replicas, replica)
+	}
+	tasks := make([]*proto.AdminTask, 0, len(replicas))
+	for _, replica = range replicas {
+		replica.LastVerify = &ReplicaCheck{StartTime: time.Now().Unix(), Status: CheckRunning}
+		tasks = append(tasks, dp.generateVerifyTask(replica.Addr))
+	}
+	c.putDataNodeTasks(tasks)
+	log.LogWarnf("action[verifyDataPartition] clusterID[%v] partitionID:%v vol[%v] verify on hosts%v sent",
+		c.Name, dp.PartitionID, dp.VolName, dp.PersistenceHosts)
+	return
+}
+
+/*send the repair or the verify for the partitions of the vol not archived, return the partitions failed*/
+func (c *Cluster) rangeVolCheck(name string, f func(dp *DataPartition) error) (count int, failed map[uint64]string, err error) {
+	var vol *Vol
+	if vol, err = c.getVol(name); err != nil {
+		return
+	}
+	failed = make(map[uint64]string)
+	vol.dataPartitions.RLock()
+	dps := make([]*DataPartition, 0, len(vol.dataPartitions.dataPartitions))
+	for _, dp := range vol.dataPartitions.dataPartitions {
+		if dp.getArchiveStatus() == "" {
+			dps = append(dps, dp)
+		}
+	}
+	vol.dataPartitions.RUnlock()
+	for _, dp := range dps {
+		if e := f(dp); e != nil {
+			failed[dp.PartitionID] = e.Error()
+			continue
+		}
+		count++
+	}
+	return
+}
+
+/*a check sent by a former leader only gets its end*/
+func finishCheck(check *ReplicaCheck, status uint8, result string) *ReplicaCheck {
+	now := time.Now().Unix()
+	if check == nil {
+		check = &ReplicaCheck{StartTime: now}
+	}
+	check.EndTime = now
+	check.Result = result
+	check.Status = CheckDone
+	if status != proto.TaskSuccess {
+		check.Status = CheckFailed
+	}
+	return check
+}
+
+func (c *Cluster) dealRepairDataPartitionResponse(nodeAddr string, resp *proto.RepairDataPartitionResponse) (err error) {
+	var (
+		dp      *DataPartition
+		replica *DataReplica
+	)
+	if dp, err = c.getDataPartitionByID(resp.PartitionId); err != nil {
+		return
+	}
+	dp.Lock()
+	defer dp.Unlock()
+	if replica, err = dp.getReplica(nodeAddr); err != nil {
+		return
+	}
+	replica.LastRepair = finishCheck(replica.LastRepair, resp.Status, resp.Result)
+	if resp.Status != proto.TaskSuccess {
+		Warn(c.Name, fmt.Sprintf("clusterID[%v] partitionID:%v repair on node[%v] failed,err[%v]",
+			c.Name, resp.PartitionId, nodeAddr, resp.Result))
+		return
+	}
+	log.LogWarnf("action[dealRepairDataPartitionResponse] clusterID[%v] partitionID:%v repaired by node[%v]",
+		c.Name, resp.PartitionId, nodeAddr)
+	return
+}
+
+func (c *Cluster) dealVerifyDataPartitionResponse(nodeAddr string, resp *proto.VerifyDataPartitionResponse) (err error) {
+	var (
+		dp      *DataPartition
+		replica *DataReplica
+	)
+	if dp, err = c.getDataPartitionByID(resp.PartitionId); err != nil {
+		return
+	}
+	dp.Lock()
+	defer dp.Unlock()
+	if replica, err = dp.getReplica(nodeAddr); err != nil {
+		return
+	}
+	replica.LastVerify = finishCheck(replica.LastVerify, resp.Status, resp.Result)
+	replica.LastVerify.Quarantined = len(resp.Quarantined)
+	if resp.Status != proto.TaskSuccess {
+		Warn(c.Name, fmt.Sprintf("clusterID[%v] partitionID:%v verify on node[%v] failed,err[%v]",
+			c.Name, resp.PartitionId, nodeAddr, resp.Result))
+		return
+	}
+	if len(resp.Quarantined) != 0 {
+		Warn(c.Name, fmt.Sprintf("clusterID[%v] partitionID:%v verify on node[%v] found %v ranges corrupted, waiting for repair",
+			c.Name, resp.PartitionId, nodeAddr, len(resp.Quarantined)))
+		return
+	}
+	log.LogWarnf("action[dealVerifyDataPartitionResponse] clusterID[%v] partitionID:%v verified on node[%v]",
+		c.Name, resp.PartitionId, nodeAddr)
+	return
+}
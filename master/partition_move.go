@@ -0,0 +1,66 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"fmt"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+func (partition *DataPartition) generateMoveTask(addr, disk string) (task *proto.AdminTask) {
+	request := &proto.MoveDataPartitionRequest{
+		PartitionId: partition.PartitionID,
+		Disk:        disk,
+	}
+	task = proto.NewAdminTask(proto.OpMoveDataPartition, addr, request)
+	partition.resetTaskID(task)
+	return
+}
+
+/*move the replica on addr to another disk of the node, the disk with the most available space if disk is empty*/
+func (c *Cluster) moveDataPartitionDisk(addr string, dp *DataPartition, disk string) (err error) {
+	if _, err = c.getDataNode(addr); err != nil {
+		return
+	}
+	dp.RLock()
+	if !dp.isInPersistenceHosts(addr) && !dp.isInWarmHosts(addr) {
+		err = errors.Annotatef(DataReplicaNotFound, "partitionID[%v] has no replica on node[%v]", dp.PartitionID, addr)
+	} else if dp.ArchiveStatus != "" {
+		err = errors.Annotatef(DataPartitionArchived, "partitionID[%v] %v", dp.PartitionID, dp.ArchiveStatus)
+	}
+	dp.RUnlock()
+	if err != nil {
+		return
+	}
+	c.putDataNodeTasks([]*proto.AdminTask{dp.generateMoveTask(addr, disk)})
+	log.LogWarnf("action[moveDataPartitionDisk] clusterID[%v] partitionID:%v vol[%v] node[%v] move to disk[%v]",
+		c.Name, dp.PartitionID, dp.VolName, addr, disk)
+	return
+}
+
+/*the disk of the replica is updated by the next report of the node*/
+func (c *Cluster) dealMoveDataPartitionResponse(nodeAddr string, resp *proto.MoveDataPartitionResponse) (err error) {
+	if resp.Status != proto.TaskSuccess {
+		Warn(c.Name, fmt.Sprintf("clusterID[%v] partitionID:%v move disk on node[%v] failed,err[%v]",
+			c.Name, resp.PartitionId, nodeAddr, resp.Result))
+		return
+	}
+	log.LogWarnf("action[dealMoveDataPartitionResponse] clusterID[%v] partitionID:%v on node[%v] moved to disk[%v]",
+		c.Name, resp.PartitionId, nodeAddr, resp.Disk)
+	return
+}
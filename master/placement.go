@@ -0,0 +1,385 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	FailureDomainNode      = "node" //replicas on distinct nodes, placed over the racks as before
+	FailureDomainRack      = "rack"
+	FailureDomainZone      = "zone"
+	MaxPlacementViolations = 1000
+)
+
+// the placement policy persisted by the leader, Zones maps a zone to its racks
+type PlacementValue struct {
+	FailureDomain string
+	Zones         map[string][]string
+}
+
+type RackView struct {
+	Name      string
+	DataNodes []string
+}
+
+type ZoneView struct {
+	Name  string
+	Racks []*RackView
+}
+
+type TopologyView struct {
+	FailureDomain string
+	Zones         []*ZoneView
+	Violations    []uint64 //partitions holding more replicas in a failure domain than allowed
+}
+
+// the failure domain of a data node is its rack or its zone. The zone of a node
+// is the zone label it registered with, else the zone its rack is assigned to,
+// else a zone of its own rack. With a rack or zone failure domain no two replicas
+// of a partition are placed in the same domain, and no more than the parity
+// shards of an erasure coded partition
+type placement struct {
+	failureDomain string
+	zones         map[string][]string
+	rackZones     map[string]string
+	sync.RWMutex
+}
+
+func newPlacement() *placement {
+	return &placement{
+		failureDomain: FailureDomainNode,
+		zones:         make(map[string][]string),
+		rackZones:     make(map[string]string),
+	}
+}
+
+func (pl *placement) isEnabled() bool {
+	pl.RLock()
+	defer pl.RUnlock()
+	return pl.failureDomain != FailureDomainNode
+}
+
+func (pl *placement) zoneOf(rack, zone string) string {
+	pl.RLock()
+	defer pl.RUnlock()
+	if zone != "" {
+		return zone
+	}
+	if zone, ok := pl.rackZones[rack]; ok {
+		return zone
+	}
+	return rack
+}
+
+/*the failure domain of a node, a node without the label of the domain is a domain of its own*/
+func (pl *placement) domainOf(addr, rack, zone string) (domain string) {
+	pl.RLock()
+	failureDomain := pl.failureDomain
+	pl.RUnlock()
+	switch failureDomain {
+	case FailureDomainRack:
+		domain = rack
+	case FailureDomainZone:
+		domain = pl.zoneOf(rack, zone)
+	}
+	if domain == "" {
+		domain = addr
+	}
+	return
+}
+
+func (pl *placement) value() (value *PlacementValue) {
+	pl.RLock()
+	defer pl.RUnlock()
+	value = &PlacementValue{FailureDomain: pl.failureDomain, Zones: make(map[string][]string, len(pl.zones))}
+	for zone, racks := range pl.zones {
+		value.Zones[zone] = append([]string{}, racks...)
+	}
+	return
+}
+
+func (pl *placement) restore(value *PlacementValue) {
+	pl.Lock()
+	defer pl.Unlock()
+	pl.failureDomain = value.FailureDomain
+	if pl.failureDomain == "" {
+		pl.failureDomain = FailureDomainNode
+	}
+	pl.zones = make(map[string][]string, len(value.Zones))
+	pl.rackZones = make(map[string]string)
+	for zone, racks := range value.Zones {
+		pl.zones[zone] = append([]string{}, racks...)
+		for _, rack := range racks {
+			pl.rackZones[rack] = zone
+		}
+	}
+}
+
+/*the replicas of a partition a failure domain can hold*/
+func maxReplicasPerDomain(partitionType string) int {
+	if partitionType == proto.ErasureCodePartition {
+		return proto.ECParityShards
+	}
+	return 1
+}
+
+func (c *Cluster) setFailureDomain(failureDomain string) (err error) {
+	switch failureDomain {
+	case FailureDomainNode, FailureDomainRack, FailureDomainZone:
+	default:
+		return errors.Annotatef(UnMatchPara, "failureDomain[%v] not in node,rack,zone", failureDomain)
+	}
+	value := c.placement.value()
+	value.FailureDomain = failureDomain
+	if err = c.syncPutPlacement(value); err != nil {
+		return
+	}
+	c.placement.restore(value)
+	// the replicas placed before are not moved, the offline and the rebalance
+	// of a violating replica place its replacement in a free domain
+	log.LogWarnf("action[setFailureDomain] clusterID[%v] failureDomain[%v] violations[%v]",
+		c.Name, failureDomain, len(c.getPlacementViolations()))
+	return
+}
+
+/*assign the racks to the zone, a rack is moved from its previous zone. The zone is removed if racks is empty*/
+func (c *Cluster) setZone(name string, racks []string) (err error) {
+	if name == "" {
+		return errors.Annotatef(UnMatchPara, "zone name is empty")
+	}
+	value := c.placement.value()
+	delete(value.Zones, name)
+	for zone, zoneRacks := range value.Zones {
+		kept := make([]string, 0, len(zoneRacks))
+		for _, rack := range zoneRacks {
+			if !contains(racks, rack) {
+				kept = append(kept, rack)
+			}
+		}
+		if len(kept) == 0 {
+			delete(value.Zones, zone)
+			continue
+		}
+		value.Zones[zone] = kept
+	}
+	if len(racks) != 0 {
+		value.Zones[name] = racks
+	}
+	if err = c.syncPutPlacement(value); err != nil {
+		return
+	}
+	c.placement.restore(value)
+	log.LogWarnf("action[setZone] clusterID[%v] zone[%v] racks%v", c.Name, name, racks)
+	return
+}
+
+func (c *Cluster) getNodeFailureDomain(dataNode *DataNode) string {
+	dataNode.RLock()
+	addr, rack, zone := dataNode.Addr, dataNode.RackName, dataNode.ZoneName
+	dataNode.RUnlock()
+	return c.placement.domainOf(addr, rack, zone)
+}
+
+/*the failure domain of the host, empty if the host is not a data node of the cluster*/
+func (c *Cluster) getHostFailureDomain(host string) string {
+	dataNode, err := c.getDataNode(host)
+	if err != nil {
+		return ""
+	}
+	return c.getNodeFailureDomain(dataNode)
+}
+
+/*the domains holding max replicas of hosts, the replica on source is not counted*/
+func (c *Cluster) getFullDomains(hosts []string, source string, max int) (domains []string) {
+	counts := make(map[string]int)
+	domains = make([]string, 0)
+	for _, host := range hosts {
+		if host == source {
+			continue
+		}
+		domain := c.getHostFailureDomain(host)
+		if domain == "" {
+			continue
+		}
+		if counts[domain]++; counts[domain] == max {
+			domains = append(domains, domain)
+		}
+	}
+	return
+}
+
+/*the writable data nodes grouped by failure domain, the most remaining weight first*/
+func (c *Cluster) getDomainDataNodes(excludeHosts, excludeDomains []string) (domains [][]*DataNode) {
+	nodes := make(map[string][]*DataNode)
+	c.dataNodes.Range(func(addr, value interface{}) bool {
+		dataNode := value.(*DataNode)
+		if contains(excludeHosts, dataNode.Addr) || !dataNode.IsWriteAble() {
+			return true
+		}
+		domain := c.getNodeFailureDomain(dataNode)
+		if contains(excludeDomains, domain) {
+			return true
+		}
+		nodes[domain] = append(nodes[domain], dataNode)
+		return true
+	})
+	domains = make([][]*DataNode, 0, len(nodes))
+	for _, domainNodes := range nodes {
+		sort.Slice(domainNodes, func(i, j int) bool {
+			return domainNodes[i].getRemainWeight() > domainNodes[j].getRemainWeight()
+		})
+		domains = append(domains, domainNodes)
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		return domains[i][0].getRemainWeight() > domains[j][0].getRemainWeight()
+	})
+	return
+}
+
+/*choose the hosts of replicaNum replicas in distinct failure domains, the leader is chosen at random*/
+func (c *Cluster) choosePlacedHosts(replicaNum int, excludeHosts, excludeDomains []string) (hosts []string, err error) {
+	domains := c.getDomainDataNodes(excludeHosts, excludeDomains)
+	if len(domains) < replicaNum {
+		return nil, errors.Annotatef(NoAnyDataNodeForCreateDataPartition, "%v writable failure domains for %v replicas",
+			len(domains), replicaNum)
+	}
+	hosts = make([]string, replicaNum)
+	for i, index := range rand.Perm(replicaNum) {
+		node := domains[index][0]
+		node.SelectNodeForWrite()
+		hosts[i] = node.Addr
+	}
+	return
+}
+
+/*spread the shards over the failure domains, a domain holds no more than parityShards of them*/
+func (c *Cluster) choosePlacedShards(shardNum, parityShards int) (hosts []string, err error) {
+	domains := c.getDomainDataNodes(nil, nil)
+	nodes := make([]*DataNode, 0, shardNum)
+	for round := 0; round < parityShards && len(nodes) < shardNum; round++ {
+		for _, domainNodes := range domains {
+			if round < len(domainNodes) && len(nodes) < shardNum {
+				nodes = append(nodes, domainNodes[round])
+			}
+		}
+	}
+	if len(nodes) < shardNum {
+		return nil, errors.Annotatef(NoAnyDataNodeForCreateDataPartition, "%v writable failure domains for %v shards, parity %v",
+			len(domains), shardNum, parityShards)
+	}
+	hosts = make([]string, 0, shardNum)
+	for _, node := range nodes {
+		node.SelectNodeForWrite()
+		hosts = append(hosts, node.Addr)
+	}
+	return
+}
+
+/*the host for the replica replacing the one on source, in a failure domain which can hold it*/
+func (c *Cluster) chooseReplacementHost(partitionType string, hosts []string, source string) (addr string, err error) {
+	excludeDomains := c.getFullDomains(hosts, source, maxReplicasPerDomain(partitionType))
+	var newHosts []string
+	if newHosts, err = c.choosePlacedHosts(1, hosts, excludeDomains); err != nil {
+		return
+	}
+	return newHosts[0], nil
+}
+
+/*whether the replica on source can be moved to target without violating the failure domains*/
+func (c *Cluster) isPlacementAllowed(partitionType string, hosts []string, source, target string) bool {
+	if !c.placement.isEnabled() {
+		return true
+	}
+	domain := c.getHostFailureDomain(target)
+	return domain != "" && !contains(c.getFullDomains(hosts, source, maxReplicasPerDomain(partitionType)), domain)
+}
+
+/*the partitions with more replicas in a failure domain than allowed*/
+func (c *Cluster) getPlacementViolations() (ids []uint64) {
+	ids = make([]uint64, 0)
+	if !c.placement.isEnabled() {
+		return
+	}
+	for _, vol := range c.getAllNormalVols() {
+		vol.dataPartitions.RLock()
+		for _, dp := range vol.dataPartitions.dataPartitions {
+			dp.RLock()
+			hosts := append([]string{}, dp.PersistenceHosts...)
+			max := maxReplicasPerDomain(dp.PartitionType)
+			dp.RUnlock()
+			counts := make(map[string]int)
+			for _, host := range hosts {
+				if domain := c.getHostFailureDomain(host); domain != "" {
+					counts[domain]++
+					if counts[domain] == max+1 {
+						ids = append(ids, dp.PartitionID)
+					}
+				}
+			}
+			if len(ids) >= MaxPlacementViolations {
+				break
+			}
+		}
+		vol.dataPartitions.RUnlock()
+		if len(ids) >= MaxPlacementViolations {
+			break
+		}
+	}
+	return
+}
+
+func (c *Cluster) getTopologyView() (view *TopologyView) {
+	value := c.placement.value()
+	zones := make(map[string]map[string][]string)
+	for zone, racks := range value.Zones {
+		zones[zone] = make(map[string][]string)
+		for _, rack := range racks {
+			zones[zone][rack] = make([]string, 0)
+		}
+	}
+	c.dataNodes.Range(func(key, node interface{}) bool {
+		dataNode := node.(*DataNode)
+		dataNode.RLock()
+		addr, rack, zone := dataNode.Addr, dataNode.RackName, dataNode.ZoneName
+		dataNode.RUnlock()
+		zone = c.placement.zoneOf(rack, zone)
+		if zones[zone] == nil {
+			zones[zone] = make(map[string][]string)
+		}
+		zones[zone][rack] = append(zones[zone][rack], addr)
+		return true
+	})
+	view = &TopologyView{FailureDomain: value.FailureDomain, Zones: make([]*ZoneView, 0, len(zones)),
+		Violations: c.getPlacementViolations()}
+	for zone, racks := range zones {
+		zv := &ZoneView{Name: zone, Racks: make([]*RackView, 0, len(racks))}
+		for rack, nodes := range racks {
+			sort.Strings(nodes)
+			zv.Racks = append(zv.Racks, &RackView{Name: rack, DataNodes: nodes})
+		}
+		sort.Slice(zv.Racks, func(i, j int) bool { return zv.Racks[i].Name < zv.Racks[j].Name })
+		view.Zones = append(view.Zones, zv)
+	}
+	sort.Slice(view.Zones, func(i, j int) bool { return view.Zones[i].Name < view.Zones[j].Name })
+	return
+}
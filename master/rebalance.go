@@ -0,0 +1,406 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	DefaultRebalanceThreshold     = 0.1
+	DefaultRebalanceMaxMigrations = 4
+	RebalanceCheckIntervalSeconds = 60
+	MigrationSyncTimeoutSeconds   = 6 * 3600
+	MigrationHistoryCount         = 100
+)
+
+const (
+	MigrationSyncing  = "syncing"
+	MigrationDone     = "done"
+	MigrationFailed   = "failed"
+	MigrationCanceled = "canceled"
+)
+
+// a move of the replica of an extent partition from Source to Target: a warm
+// replica is created on Target and caught up by the extent repair, then Source
+// is decommissioned and the warm replica is promoted in its place
+type Migration struct {
+	PartitionID uint64
+	VolName     string
+	Source      string
+	SourceDisk  string
+	Target      string
+	Status      string
+	StartTime   int64
+	EndTime     int64
+	Msg         string
+}
+
+type DiskUsage struct {
+	Addr  string
+	Path  string
+	Total uint64
+	Used  uint64
+	Ratio float64
+}
+
+type RebalanceView struct {
+	Running       bool
+	Threshold     float64
+	MaxMigrations int
+	Skew          float64
+	Disks         []*DiskUsage
+	Migrations    []*Migration
+	History       []*Migration
+}
+
+// the rebalance state is kept only in the memory of the leader, the warm replicas
+// of the migrations in progress stay as warm replicas after the leader changed.
+// The lock guards the state only, the checks are serialized by checkLock and
+// send the tasks and sync the partitions without holding the lock
+type rebalancer struct {
+	running       bool
+	threshold     float64
+	maxMigrations int
+	migrations    map[uint64]*Migration
+	history       []*Migration
+	checkLock     sync.Mutex
+	sync.Mutex
+}
+
+func newRebalancer() *rebalancer {
+	return &rebalancer{
+		threshold:     DefaultRebalanceThreshold,
+		maxMigrations: DefaultRebalanceMaxMigrations,
+		migrations:    make(map[uint64]*Migration),
+		history:       make([]*Migration, 0),
+	}
+}
+
+/*the caller must hold the lock of rb*/
+func (rb *rebalancer) finish(m *Migration, status, msg string) {
+	m.Status = status
+	m.Msg = msg
+	m.EndTime = time.Now().Unix()
+	delete(rb.migrations, m.PartitionID)
+	rb.history = append(rb.history, m)
+	if len(rb.history) > MigrationHistoryCount {
+		rb.history = rb.history[len(rb.history)-MigrationHistoryCount:]
+	}
+	log.LogWarnf("action[rebalance] partitionID:%v vol[%v] from %v disk[%v] to %v %v: %v",
+		m.PartitionID, m.VolName, m.Source, m.SourceDisk, m.Target, status, msg)
+}
+
+func (c *Cluster) startCheckRebalance() {
+	go func() {
+		for {
+			if c.partition.IsLeader() {
+				c.checkRebalance()
+			}
+			time.Sleep(time.Second * RebalanceCheckIntervalSeconds)
+		}
+	}()
+}
+
+func checkRebalancePara(threshold float64, maxMigrations int) (err error) {
+	if threshold <= 0 || threshold >= 1 {
+		return errors.Annotatef(UnMatchPara, "threshold[%v] not in (0,1)", threshold)
+	}
+	if maxMigrations <= 0 {
+		return errors.Annotatef(UnMatchPara, "maxMigrations[%v]", maxMigrations)
+	}
+	return
+}
+
+func (c *Cluster) startRebalance(threshold float64, maxMigrations int) (err error) {
+	if err = checkRebalancePara(threshold, maxMigrations); err != nil {
+		return
+	}
+	rb := c.rebalancer
+	rb.Lock()
+	rb.running = true
+	rb.threshold = threshold
+	rb.maxMigrations = maxMigrations
+	rb.Unlock()
+	log.LogWarnf("action[startRebalance] clusterID[%v] threshold[%v] maxMigrations[%v]", c.Name, threshold, maxMigrations)
+	go c.checkRebalance()
+	return
+}
+
+/*stop scheduling migrations and cancel the ones in progress, their warm replicas are removed*/
+func (c *Cluster) stopRebalance() {
+	rb := c.rebalancer
+	rb.checkLock.Lock()
+	defer rb.checkLock.Unlock()
+	rb.Lock()
+	rb.running = false
+	canceled := make([]*Migration, 0, len(rb.migrations))
+	for _, m := range rb.migrations {
+		canceled = append(canceled, m)
+		rb.finish(m, MigrationCanceled, "rebalance stopped")
+	}
+	rb.Unlock()
+	for _, m := range canceled {
+		if dp, err := c.getDataPartitionByID(m.PartitionID); err == nil {
+			c.dataPartitionOffline(m.Target, m.VolName, dp, "rebalance canceled")
+		}
+	}
+	log.LogWarnf("action[stopRebalance] clusterID[%v] stopped", c.Name)
+}
+
+func (c *Cluster) getRebalanceView() (view *RebalanceView) {
+	disks := c.getDiskUsages()
+	rb := c.rebalancer
+	rb.Lock()
+	defer rb.Unlock()
+	view = &RebalanceView{
+		Running:       rb.running,
+		Threshold:     rb.threshold,
+		MaxMigrations: rb.maxMigrations,
+		Skew:          diskSkew(disks),
+		Disks:         disks,
+		Migrations:    make([]*Migration, 0, len(rb.migrations)),
+		History:       make([]*Migration, 0, len(rb.history)),
+	}
+	for _, m := range rb.migrations {
+		migration := *m
+		view.Migrations = append(view.Migrations, &migration)
+	}
+	for _, m := range rb.history {
+		migration := *m
+		view.History = append(view.History, &migration)
+	}
+	return
+}
+
+/*the disks of the active data nodes sorted by utilization, the most utilized first*/
+func (c *Cluster) getDiskUsages() (disks []*DiskUsage) {
+	disks = make([]*DiskUsage, 0)
+	c.dataNodes.Range(func(addr, node interface{}) bool {
+		dataNode := node.(*DataNode)
+		dataNode.RLock()
+		defer dataNode.RUnlock()
+		if !dataNode.isActive {
+			return true
+		}
+		for _, d := range dataNode.disks {
+			if d.Total == 0 || d.Status == proto.Unavaliable {
+				continue
+			}
+			disks = append(disks, &DiskUsage{Addr: dataNode.Addr, Path: d.Path, Total: d.Total, Used: d.Used,
+				Ratio: float64(d.Used) / float64(d.Total)})
+		}
+		return true
+	})
+	sort.Slice(disks, func(i, j int) bool {
+		return disks[i].Ratio > disks[j].Ratio
+	})
+	return
+}
+
+func diskSkew(disks []*DiskUsage) float64 {
+	if len(disks) < 2 {
+		return 0
+	}
+	return disks[0].Ratio - disks[len(disks)-1].Ratio
+}
+
+func (c *Cluster) checkRebalance() {
+	rb := c.rebalancer
+	rb.checkLock.Lock()
+	defer rb.checkLock.Unlock()
+	rb.Lock()
+	if !rb.running {
+		rb.Unlock()
+		return
+	}
+	migrations := make([]*Migration, 0, len(rb.migrations))
+	for _, m := range rb.migrations {
+		migrations = append(migrations, m)
+	}
+	rb.Unlock()
+	for _, m := range migrations {
+		status, msg := c.advanceMigration(m, "rebalance")
+		rb.Lock()
+		if status != "" {
+			rb.finish(m, status, msg)
+		} else if msg != "" {
+			m.Msg = msg
+		}
+		rb.Unlock()
+	}
+
+	rb.Lock()
+	threshold := rb.threshold
+	full := len(rb.migrations) >= rb.maxMigrations
+	migrating := make(map[uint64]bool, len(rb.migrations))
+	migratingDisks := make(map[string]bool, len(rb.migrations))
+	for id, m := range rb.migrations {
+		migrating[id] = true
+		migratingDisks[m.Source+m.SourceDisk] = true
+	}
+	rb.Unlock()
+	if full {
+		return
+	}
+	disks := c.getDiskUsages()
+	if skew := diskSkew(disks); skew <= threshold {
+		return
+	}
+	// move one replica off the most utilized disk in each check, the usage
+	// reported by heartbeats changes only after the data is moved, so a disk
+	// with a migration in progress is left to the next disks over the threshold
+	var (
+		source *DiskUsage
+		target string
+		dp     *DataPartition
+		err    error
+	)
+	for _, d := range disks {
+		if d.Ratio-disks[len(disks)-1].Ratio <= threshold {
+			break
+		}
+		if migratingDisks[d.Addr+d.Path] {
+			continue
+		}
+		if target, err = c.getRebalanceTarget(d.Addr); err != nil {
+			log.LogWarnf("action[checkRebalance] clusterID[%v] source[%v] disk[%v]: %v", c.Name, d.Addr, d.Path, err)
+			continue
+		}
+		if dp, err = c.getRebalancePartition(d, target, migrating); err != nil {
+			log.LogWarnf("action[checkRebalance] clusterID[%v] source[%v] disk[%v] target[%v]: %v",
+				c.Name, d.Addr, d.Path, target, err)
+			continue
+		}
+		source = d
+		break
+	}
+	if source == nil {
+		return
+	}
+	m := &Migration{PartitionID: dp.PartitionID, VolName: dp.VolName, Source: source.Addr, SourceDisk: source.Path,
+		Target: target, Status: MigrationSyncing, StartTime: time.Now().Unix()}
+	_, err = c.addWarmReplica(dp.VolName, dp, target)
+	rb.Lock()
+	defer rb.Unlock()
+	if err != nil {
+		rb.finish(m, MigrationFailed, fmt.Sprintf("add warm replica: %v", err))
+		return
+	}
+	rb.migrations[dp.PartitionID] = m
+	log.LogWarnf("action[checkRebalance] partitionID:%v vol[%v] migrate from %v disk[%v] to %v",
+		m.PartitionID, m.VolName, m.Source, m.SourceDisk, m.Target)
+}
+
+// advanceMigration decommissions the source of m once the warm replica on the
+// target caught up, it returns the status m finished with, none while it keeps
+// syncing, and the msg to set. The caller applies them under the lock of the
+// owner of m, the offlines send tasks and sync the partition.
+func (c *Cluster) advanceMigration(m *Migration, reason string) (status, msg string) {
+	dp, err := c.getDataPartitionByID(m.PartitionID)
+	if err != nil {
+		return MigrationFailed, err.Error()
+	}
+	dp.RLock()
+	isWarm := dp.isInWarmHosts(m.Target)
+	promoted := dp.isInPersistenceHosts(m.Target) && !dp.isInPersistenceHosts(m.Source)
+	dp.RUnlock()
+	if promoted {
+		return MigrationDone, "source decommissioned"
+	}
+	if !isWarm {
+		return MigrationFailed, "warm replica on target removed"
+	}
+	if time.Now().Unix()-m.StartTime > MigrationSyncTimeoutSeconds {
+		c.dataPartitionOffline(m.Target, m.VolName, dp, reason+" timeout")
+		return MigrationFailed, "sync timeout"
+	}
+	if !dp.isWarmReplicaCaughtUp(m.Target) {
+		return
+	}
+	c.dataPartitionOffline(m.Source, m.VolName, dp, reason)
+	dp.RLock()
+	promoted = dp.isInPersistenceHosts(m.Target) && !dp.isInPersistenceHosts(m.Source)
+	dp.RUnlock()
+	if promoted {
+		return MigrationDone, "source decommissioned"
+	}
+	// keep syncing, the offline is retried in the next check until the timeout
+	return "", "decommission source failed, retry"
+}
+
+/*the active data node with the lowest utilization except the source*/
+func (c *Cluster) getRebalanceTarget(source string) (target string, err error) {
+	minRatio := 1.0
+	c.dataNodes.Range(func(addr, node interface{}) bool {
+		dataNode := node.(*DataNode)
+		dataNode.RLock()
+		defer dataNode.RUnlock()
+		if !dataNode.isActive || dataNode.Addr == source || dataNode.Total == 0 || isClockSkewed(dataNode.ClockOffset) ||
+			dataNode.Draining {
+			return true
+		}
+		if ratio := float64(dataNode.Used) / float64(dataNode.Total); ratio < minRatio {
+			minRatio = ratio
+			target = dataNode.Addr
+		}
+		return true
+	})
+	if target == "" {
+		err = errors.Annotatef(NoAnyDataNodeForCreateDataPartition, "no target for source[%v]", source)
+	}
+	return
+}
+
+/*the most used extent partition of the source disk not migrating which can be moved to the target*/
+func (c *Cluster) getRebalancePartition(source *DiskUsage, target string, migrating map[uint64]bool) (dp *DataPartition, err error) {
+	var reports []*proto.PartitionReport
+	if reports, err = c.getDiskPartitionReports(source); err != nil {
+		return
+	}
+	for _, vr := range reports {
+		if migrating[vr.PartitionID] {
+			continue
+		}
+		var candidate *DataPartition
+		if candidate, err = c.getDataPartitionByID(vr.PartitionID); err != nil {
+			continue
+		}
+		if c.canRebalance(candidate, source.Addr, target) {
+			return candidate, nil
+		}
+	}
+	err = errors.Annotatef(DataPartitionNotFound, "no partition can be moved from disk[%v]", source.Path)
+	return
+}
+
+func (c *Cluster) canRebalance(dp *DataPartition, source, target string) bool {
+	vol, err := c.getVol(dp.VolName)
+	if err != nil {
+		return false
+	}
+	dp.RLock()
+	defer dp.RUnlock()
+	return dp.PartitionType == proto.ExtentPartition && !dp.isRaftReplicated() && !dp.isRecover && !dp.hasQuarantined() && dp.Status != proto.Unavaliable &&
+		len(dp.WarmHosts) == 0 && dp.ArchiveStatus == "" && dp.EncodeStep == "" && !dp.Releasing && dp.isInPersistenceHosts(source) && !dp.isInPersistenceHosts(target) &&
+		dp.hasMissOne(int(vol.dpReplicaNum)) == nil && c.isPlacementAllowed(dp.PartitionType, dp.PersistenceHosts, source, target)
+}
@@ -0,0 +1,72 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"github.com/juju/errors"
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+// seal the partition of an append-once workload: the master keeps it read only and
+// lists it in the heartbeats of its data nodes, the replicas refuse the new extents and
+// record the extents they have in their seal. The periodic repair of the partition is
+// skipped while all the replicas report the same seal crc
+func (c *Cluster) sealDataPartition(dp *DataPartition, sealed bool) (err error) {
+	dp.Lock()
+	defer dp.Unlock()
+	if dp.PartitionType != proto.ExtentPartition {
+		return errors.Annotatef(UnMatchPara, "partitionID[%v] type[%v] can't be sealed", dp.PartitionID, dp.PartitionType)
+	}
+	if dp.Sealed == sealed {
+		return
+	}
+	if dp.EncodeStep != "" {
+		return errors.Annotatef(DataPartitionEncoding, "partitionID[%v] step[%v]", dp.PartitionID, dp.EncodeStep)
+	}
+	dp.Sealed = sealed
+	if err = c.syncUpdateDataPartition(dp.VolName, dp); err != nil {
+		dp.Sealed = !sealed
+		return
+	}
+	if sealed {
+		dp.Status = proto.ReadOnly
+	}
+	log.LogWarnf("action[sealDataPartition] clusterID[%v] partitionID:%v vol[%v] sealed[%v]",
+		c.Name, dp.PartitionID, dp.VolName, sealed)
+	return
+}
+
+func (partition *DataPartition) isSealed() bool {
+	partition.RLock()
+	defer partition.RUnlock()
+	return partition.Sealed
+}
+
+/*all the persistence replicas have sealed the partition with the same crc, the caller must hold the lock of partition*/
+func (partition *DataPartition) isSealedInSync() bool {
+	if !partition.Sealed || len(partition.WarmHosts) != 0 || partition.isRecover || partition.hasQuarantined() {
+		return false
+	}
+	var sealCrc uint32
+	for i, host := range partition.PersistenceHosts {
+		replica, ok := partition.IsInReplicas(host)
+		if !ok || !replica.Sealed || (i != 0 && replica.SealCrc != sealCrc) {
+			return false
+		}
+		sealCrc = replica.SealCrc
+	}
+	return true
+}
@@ -15,6 +15,7 @@
 package master
 
 import (
+	"crypto/tls"
 	"fmt"
 	"github.com/juju/errors"
 	"github.com/tiglabs/containerfs/raftstore"
@@ -22,7 +23,9 @@ import (
 	"github.com/tiglabs/containerfs/util/log"
 	"github.com/tiglabs/containerfs/util/ump"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 //config keys
@@ -49,11 +52,13 @@ type Master struct {
 	storeDir    string
 	retainLogs  uint64
 	leaderInfo  *LeaderInfo
+	readLease   *readLease
 	config      *ClusterConfig
 	cluster     *Cluster
 	raftStore   raftstore.RaftStore
 	fsm         *MetadataFsm
 	partition   raftstore.Partition
+	tlsConfig   *tls.Config //the admin API is served over https if it is set
 	wg          sync.WaitGroup
 }
 
@@ -64,6 +69,7 @@ func NewServer() *Master {
 func (m *Master) Start(cfg *config.Config) (err error) {
 	m.config = NewClusterConfig()
 	m.leaderInfo = &LeaderInfo{}
+	m.readLease = &readLease{}
 
 	if err = m.checkConfig(cfg); err != nil {
 		log.LogError(errors.ErrorStack(err))
@@ -76,8 +82,17 @@ func (m *Master) Start(cfg *config.Config) (err error) {
 	}
 	m.cluster = newCluster(m.clusterName, m.leaderInfo, m.fsm, m.partition)
 	m.cluster.retainLogs = m.retainLogs
+	m.cluster.usageReporter = newUsageReporter(m.config.usageReportInterval)
+	m.cluster.startCheckUsageReport()
+	m.cluster.archiveTarget = m.config.archiveTarget
+	m.cluster.notifier = newNotifier(m.clusterName, m.config.notifyRoutes, m.config.notifySMTP,
+		m.config.notifyDedup, m.config.notifyRepairBacklog)
+	if m.config.kmsAddr != "" {
+		m.cluster.kms = newHttpKeyManager(m.config.kmsAddr)
+	}
 	m.loadMetadata()
 	m.startHttpService()
+	m.startRenewReadLease()
 	m.wg.Add(1)
 	return nil
 }
@@ -99,6 +114,33 @@ func (m *Master) checkConfig(cfg *config.Config) (err error) {
 	dataPartitionTimeOutSec := cfg.GetString(DataPartitionTimeOutSec)
 	everyLoadDataPartitionCount := cfg.GetString(EveryLoadDataPartitionCount)
 	replicaNum := cfg.GetString(ReplicaNum)
+	usageReportIntervalHours := cfg.GetString(UsageReportIntervalHours)
+	readLeaseSeconds := cfg.GetString(FollowerReadLeaseSec)
+	m.config.archiveTarget = strings.TrimSuffix(cfg.GetString(ArchiveTarget), "/")
+	m.config.kmsAddr = cfg.GetString(KmsAddr)
+	for _, v := range cfg.GetArray(NotifyRoutes) {
+		var route *NotifyRoute
+		value, _ := v.(string)
+		if route, err = parseNotifyRoute(value); err != nil {
+			return fmt.Errorf("%v,err:%v", ErrBadConfFile, err.Error())
+		}
+		m.config.notifyRoutes = append(m.config.notifyRoutes, route)
+	}
+	if minutes := cfg.GetInt(NotifyDedupMinutes); minutes > 0 {
+		m.config.notifyDedup = time.Duration(minutes) * time.Minute
+	}
+	if backlog := cfg.GetInt(NotifyRepairBacklogCount); backlog != 0 {
+		m.config.notifyRepairBacklog = int(backlog)
+	}
+	m.config.notifySMTP = SMTPConfig{
+		Addr:     cfg.GetString(NotifySMTPAddr),
+		From:     cfg.GetString(NotifySMTPFrom),
+		User:     cfg.GetString(NotifySMTPUser),
+		Password: cfg.GetString(NotifySMTPPassword),
+	}
+	if m.tlsConfig, err = cfg.ServerTLSConfig(false); err != nil {
+		return fmt.Errorf("%v,err:%v", ErrBadConfFile, err.Error())
+	}
 	m.walDir = cfg.GetString(WalDir)
 	m.storeDir = cfg.GetString(StoreDir)
 	peerAddrs := cfg.GetString(CfgPeers)
@@ -152,6 +194,18 @@ func (m *Master) checkConfig(cfg *config.Config) (err error) {
 			return fmt.Errorf("%v,err:%v", ErrBadConfFile, err.Error())
 		}
 	}
+	if usageReportIntervalHours != "" {
+		var hours int64
+		if hours, err = strconv.ParseInt(usageReportIntervalHours, 10, 0); err != nil {
+			return fmt.Errorf("%v,err:%v", ErrBadConfFile, err.Error())
+		}
+		m.config.usageReportInterval = hours * 3600
+	}
+	if readLeaseSeconds != "" {
+		if m.config.readLeaseSeconds, err = strconv.ParseInt(readLeaseSeconds, 10, 0); err != nil {
+			return fmt.Errorf("%v,err:%v", ErrBadConfFile, err.Error())
+		}
+	}
 	if m.config.everyLoadDataPartitionCount <= 40 {
 		m.config.everyLoadDataPartitionCount = 40
 	}
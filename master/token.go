@@ -0,0 +1,181 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	TokenBytes = 16
+)
+
+// an access token of a vol, the nodes get only the digests of the tokens from
+// the heartbeats and refuse the clients of a vol with tokens presenting none
+type Token struct {
+	VolName    string
+	Value      string
+	Type       string
+	CreateTime int64
+}
+
+func newToken(volName, tokenType string) (token *Token, err error) {
+	b := make([]byte, TokenBytes)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+	token = &Token{VolName: volName, Value: hex.EncodeToString(b), Type: tokenType, CreateTime: time.Now().Unix()}
+	return
+}
+
+func checkTokenType(tokenType string) (err error) {
+	if tokenType != proto.TokenReadOnly && tokenType != proto.TokenReadWrite {
+		return errors.Annotatef(UnMatchPara, "token type[%v] not %v or %v", tokenType, proto.TokenReadOnly, proto.TokenReadWrite)
+	}
+	return
+}
+
+func (vol *Vol) putToken(token *Token) {
+	vol.tokensLock.Lock()
+	defer vol.tokensLock.Unlock()
+	vol.tokens[token.Value] = token
+}
+
+func (vol *Vol) deleteToken(value string) {
+	vol.tokensLock.Lock()
+	defer vol.tokensLock.Unlock()
+	delete(vol.tokens, value)
+}
+
+func (vol *Vol) getToken(value string) (token *Token, err error) {
+	vol.tokensLock.RLock()
+	defer vol.tokensLock.RUnlock()
+	token, ok := vol.tokens[value]
+	if !ok {
+		err = elementNotFound(fmt.Sprintf("token of vol %v", vol.Name))
+	}
+	return
+}
+
+func (vol *Vol) getTokens() (tokens []*Token) {
+	vol.tokensLock.RLock()
+	defer vol.tokensLock.RUnlock()
+	tokens = make([]*Token, 0, len(vol.tokens))
+	for _, token := range vol.tokens {
+		tokens = append(tokens, token)
+	}
+	return
+}
+
+func (vol *Vol) getTokenDigests() (digests []*proto.TokenDigest) {
+	vol.tokensLock.RLock()
+	defer vol.tokensLock.RUnlock()
+	digests = make([]*proto.TokenDigest, 0, len(vol.tokens))
+	for _, token := range vol.tokens {
+		digests = append(digests, &proto.TokenDigest{Digest: proto.TokenDigestOf(token.Value), Type: token.Type})
+	}
+	return
+}
+
+func (vol *Vol) deleteTokensFromStore(c *Cluster) {
+	for _, token := range vol.getTokens() {
+		c.syncDeleteToken(token)
+	}
+}
+
+func (c *Cluster) createToken(volName, tokenType string) (token *Token, err error) {
+	var vol *Vol
+	if err = checkTokenType(tokenType); err != nil {
+		return
+	}
+	if vol, err = c.getVol(volName); err != nil {
+		return
+	}
+	if token, err = newToken(volName, tokenType); err != nil {
+		return
+	}
+	if err = c.syncPutToken(token); err != nil {
+		return
+	}
+	vol.putToken(token)
+	log.LogWarnf("action[createToken] vol[%v] type[%v] token created", volName, tokenType)
+	return
+}
+
+func (c *Cluster) revokeToken(volName, value string) (err error) {
+	var (
+		vol   *Vol
+		token *Token
+	)
+	if vol, err = c.getVol(volName); err != nil {
+		return
+	}
+	if token, err = vol.getToken(value); err != nil {
+		return
+	}
+	if err = c.syncDeleteToken(token); err != nil {
+		return
+	}
+	vol.deleteToken(value)
+	log.LogWarnf("action[revokeToken] vol[%v] type[%v] token revoked", volName, token.Type)
+	return
+}
+
+/*a new token of the same type replaces the old one, the old token is refused once the nodes got the next heartbeat*/
+func (c *Cluster) rotateToken(volName, value string) (token *Token, err error) {
+	var (
+		vol *Vol
+		old *Token
+	)
+	if vol, err = c.getVol(volName); err != nil {
+		return
+	}
+	if old, err = vol.getToken(value); err != nil {
+		return
+	}
+	if token, err = c.createToken(volName, old.Type); err != nil {
+		return
+	}
+	if err = c.revokeToken(volName, value); err != nil {
+		return
+	}
+	return
+}
+
+func (c *Cluster) listTokens(volName string) (tokens []*Token, err error) {
+	var vol *Vol
+	if vol, err = c.getVol(volName); err != nil {
+		return
+	}
+	return vol.getTokens(), nil
+}
+
+/*the token digests of the vols with tokens, sent to the nodes in the heartbeats*/
+func (c *Cluster) getVolTokens() (volTokens map[string][]*proto.TokenDigest) {
+	volTokens = make(map[string][]*proto.TokenDigest)
+	for name, vol := range c.copyVols() {
+		if digests := vol.getTokenDigests(); len(digests) != 0 {
+			volTokens[name] = digests
+		}
+	}
+	return
+}
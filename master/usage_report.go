@@ -0,0 +1,317 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/sdk/meta"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	DefaultUsageReportIntervalHours = 24
+	UsageReportCheckIntervalSeconds = 10 * 60
+	UsageStatementCount             = 90 //statements kept for each vol
+	UsageReportBatchInodes          = 1000
+	UsageRootFilesDir               = "/"
+)
+
+// the usage of a vol at the end of a period, the growth is against the
+// statement of the previous period and zero in the first statement. The bytes
+// and the files are aggregated by the meta partitions if all of them reported
+// it, an inode is counted once then, else they are the sums of the dirs
+type VolUsage struct {
+	VolName     string
+	Time        int64
+	PeriodStart int64
+	Bytes       uint64
+	Files       uint64
+	GrowthBytes int64
+	GrowthFiles int64
+	Aggregated  bool `json:",omitempty"`
+}
+
+// the usage of a top level dir of the vol, the files directly under the
+// root of the vol are reported as the dir "/"
+type DirUsage struct {
+	Name        string
+	Bytes       uint64
+	Files       uint64
+	GrowthBytes int64
+	GrowthFiles int64
+}
+
+type UsageStatement struct {
+	VolUsage
+	Dirs []*DirUsage
+}
+
+// the meta wrappers walking the vols are kept by the leader between the reports,
+// the wrapper of a vol is closed once the vol is deleted
+type usageReporter struct {
+	interval int64
+	wrappers map[string]*meta.MetaWrapper
+}
+
+/*a non positive interval disables the reports*/
+func newUsageReporter(interval int64) *usageReporter {
+	return &usageReporter{
+		interval: interval,
+		wrappers: make(map[string]*meta.MetaWrapper),
+	}
+}
+
+func (c *Cluster) startCheckUsageReport() {
+	go func() {
+		for {
+			if c.partition.IsLeader() && c.usageReporter.interval > 0 {
+				c.checkUsageReport()
+			}
+			time.Sleep(time.Second * UsageReportCheckIntervalSeconds)
+		}
+	}()
+}
+
+/*the caller is the only goroutine running the reports*/
+func (c *Cluster) checkUsageReport() {
+	ur := c.usageReporter
+	vols := c.getAllNormalVols()
+	for name, mw := range ur.wrappers {
+		if _, ok := vols[name]; !ok {
+			mw.Close()
+			delete(ur.wrappers, name)
+		}
+	}
+	now := time.Now().Unix()
+	for name := range vols {
+		statements, err := c.loadUsageStatements(name)
+		if err != nil {
+			log.LogWarnf("action[checkUsageReport] vol[%v]: %v", name, err)
+			continue
+		}
+		var prev *UsageStatement
+		if len(statements) != 0 {
+			prev = statements[len(statements)-1]
+		}
+		if prev != nil && now-prev.Time < ur.interval {
+			continue
+		}
+		if err = c.reportVolUsage(name, prev); err != nil {
+			log.LogWarnf("action[checkUsageReport] vol[%v]: %v", name, err)
+			continue
+		}
+		for len(statements) >= UsageStatementCount {
+			if err = c.syncDeleteUsageStatement(statements[0]); err != nil {
+				log.LogWarnf("action[checkUsageReport] vol[%v] delete statement[%v]: %v", name, statements[0].Time, err)
+				break
+			}
+			statements = statements[1:]
+		}
+	}
+}
+
+func (c *Cluster) getUsageMetaWrapper(volName string) (mw *meta.MetaWrapper, err error) {
+	ur := c.usageReporter
+	if mw = ur.wrappers[volName]; mw != nil {
+		return
+	}
+	if mw, err = meta.NewMetaWrapper(volName, c.leaderInfo.addr); err != nil {
+		return
+	}
+	// the walk reads the whole vol, for root
+	mw.SetCaller(0, 0)
+	ur.wrappers[volName] = mw
+	return
+}
+
+/*walk the vol and persist its statement of the period since prev*/
+func (c *Cluster) reportVolUsage(volName string, prev *UsageStatement) (err error) {
+	var (
+		mw  *meta.MetaWrapper
+		vol *Vol
+	)
+	if vol, err = c.getVol(volName); err != nil {
+		return
+	}
+	if mw, err = c.getUsageMetaWrapper(volName); err != nil {
+		return
+	}
+	start := time.Now()
+	statement := &UsageStatement{VolUsage: VolUsage{VolName: volName}}
+	if statement.Dirs, err = walkVolUsage(mw); err != nil {
+		return
+	}
+	statement.Time = time.Now().Unix()
+	if files, bytes, ok := vol.getUsage(); ok {
+		statement.Files, statement.Bytes, statement.Aggregated = files, bytes, true
+	}
+	if prev != nil {
+		statement.PeriodStart = prev.Time
+	}
+	statement.setGrowth(prev)
+	if err = c.syncPutUsageStatement(statement); err != nil {
+		return
+	}
+	log.LogWarnf("action[reportVolUsage] vol[%v] bytes[%v] files[%v] dirs[%v] cost[%v]",
+		volName, statement.Bytes, statement.Files, len(statement.Dirs), time.Since(start))
+	return
+}
+
+/*sum the usage of the vol from its dirs unless aggregated and set the growth since prev*/
+func (statement *UsageStatement) setGrowth(prev *UsageStatement) {
+	prevDirs := make(map[string]*DirUsage)
+	if prev != nil {
+		for _, d := range prev.Dirs {
+			prevDirs[d.Name] = d
+		}
+	}
+	for _, d := range statement.Dirs {
+		if !statement.Aggregated {
+			statement.Bytes += d.Bytes
+			statement.Files += d.Files
+		}
+		if p, ok := prevDirs[d.Name]; ok {
+			d.GrowthBytes = int64(d.Bytes) - int64(p.Bytes)
+			d.GrowthFiles = int64(d.Files) - int64(p.Files)
+		} else if prev != nil {
+			d.GrowthBytes = int64(d.Bytes)
+			d.GrowthFiles = int64(d.Files)
+		}
+	}
+	if prev != nil {
+		statement.GrowthBytes = int64(statement.Bytes) - int64(prev.Bytes)
+		statement.GrowthFiles = int64(statement.Files) - int64(prev.Files)
+	}
+}
+
+/*the usage of the top level dirs of the vol sorted by name, the vol is not frozen so the walk sees the changes made meanwhile*/
+func walkVolUsage(mw *meta.MetaWrapper) (dirs []*DirUsage, err error) {
+	var children []proto.Dentry
+	if children, err = mw.ReadDir_ll(proto.RootIno); err != nil {
+		return
+	}
+	root := &DirUsage{Name: UsageRootFilesDir}
+	files := make([]uint64, 0)
+	dirs = []*DirUsage{root}
+	for _, child := range children {
+		if !proto.IsDir(child.Type) {
+			files = append(files, child.Inode)
+			continue
+		}
+		d := &DirUsage{Name: UsageRootFilesDir + child.Name}
+		if err = walkDirUsage(mw, child.Inode, d); err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, d)
+	}
+	addFilesUsage(mw, files, root)
+	sort.Slice(dirs, func(i, j int) bool {
+		return dirs[i].Name < dirs[j].Name
+	})
+	return
+}
+
+/*add the files under the dir to d, a hard link is counted once for each of its names*/
+func walkDirUsage(mw *meta.MetaWrapper, ino uint64, d *DirUsage) (err error) {
+	pending := []uint64{ino}
+	for len(pending) != 0 {
+		parent := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		var children []proto.Dentry
+		if children, err = mw.ReadDir_ll(parent); err == syscall.ENOENT {
+			// removed during the walk
+			err = nil
+			continue
+		} else if err != nil {
+			return
+		}
+		files := make([]uint64, 0, len(children))
+		for _, child := range children {
+			if proto.IsDir(child.Type) {
+				pending = append(pending, child.Inode)
+			} else {
+				files = append(files, child.Inode)
+			}
+		}
+		addFilesUsage(mw, files, d)
+	}
+	return
+}
+
+func addFilesUsage(mw *meta.MetaWrapper, inodes []uint64, d *DirUsage) {
+	for start := 0; start < len(inodes); start += UsageReportBatchInodes {
+		end := start + UsageReportBatchInodes
+		if end > len(inodes) {
+			end = len(inodes)
+		}
+		for _, info := range mw.BatchInodeGet(inodes[start:end]) {
+			d.Files++
+			d.Bytes += info.Size
+		}
+	}
+}
+
+/*the statement of the vol at the time, the latest one if the time is zero*/
+func (c *Cluster) getUsageStatement(volName string, statementTime int64) (statement *UsageStatement, err error) {
+	var statements []*UsageStatement
+	if statements, err = c.loadUsageStatements(volName); err != nil {
+		return
+	}
+	for i := len(statements) - 1; i >= 0; i-- {
+		if statementTime == 0 || statements[i].Time == statementTime {
+			return statements[i], nil
+		}
+	}
+	return nil, elementNotFound(fmt.Sprintf("usage statement of vol %v at %v", volName, statementTime))
+}
+
+/*the vol usage of the statements kept for the vol, the oldest first*/
+func (c *Cluster) getVolUsages(volName string) (usages []*VolUsage, err error) {
+	var statements []*UsageStatement
+	if statements, err = c.loadUsageStatements(volName); err != nil {
+		return
+	}
+	usages = make([]*VolUsage, 0, len(statements))
+	for _, statement := range statements {
+		usage := statement.VolUsage
+		usages = append(usages, &usage)
+	}
+	return
+}
+
+/*one row for each dir after a row of the vol with an empty dir*/
+func writeUsageStatementCSV(w io.Writer, statement *UsageStatement) (err error) {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"vol", "time", "periodStart", "dir", "bytes", "files", "growthBytes", "growthFiles"})
+	row := func(dir string, bytes, files uint64, growthBytes, growthFiles int64) []string {
+		return []string{statement.VolName, strconv.FormatInt(statement.Time, 10), strconv.FormatInt(statement.PeriodStart, 10), dir,
+			strconv.FormatUint(bytes, 10), strconv.FormatUint(files, 10),
+			strconv.FormatInt(growthBytes, 10), strconv.FormatInt(growthFiles, 10)}
+	}
+	cw.Write(row("", statement.Bytes, statement.Files, statement.GrowthBytes, statement.GrowthFiles))
+	for _, d := range statement.Dirs {
+		cw.Write(row(d.Name, d.Bytes, d.Files, d.GrowthBytes, d.GrowthFiles))
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -31,11 +31,33 @@ type Vol struct {
 	mpsLock        sync.RWMutex
 	dataPartitions *DataPartitionMap
 	Status         uint8
+	Immutable      bool   //the data and metadata of vol are advertised as never changing
+	Quota          uint64 //bytes reported as the capacity of vol to clients, 0 means the cluster capacity
+	SyncOnClose    bool   //close of a file is a durable flush of its written data on all replicas
+	FollowerRead   bool   //clients read from the followers when the leader of a data partition is unreachable
+	MaxFileSize    uint64 //bytes of a single file, 0 means no limit
+	MaxFiles       uint64 //inodes of vol including the dirs, 0 means no limit
+	Compression    string //codec of the blob objects written by the data nodes, empty means none
+	ColdTierDays   int    //days an extent is not read before the data nodes move it to their cold tier, 0 keeps it local
+	Audit          bool   //the meta nodes record the namespace mutations of vol in their audit logs
+	ReadOnly       bool   //the meta nodes and the data nodes refuse the mutations and the writes of vol
+	Permission     bool   //the meta nodes check the owners and the modes of the inodes of vol against the callers
+	DegradedWrite  string //how the writes go while data partitions are below the replica count, empty means healthy
+	Replication    string //raft, or empty for the replication chain, of the data partitions created
+	Encrypted      bool   //the data partitions created are encrypted at rest
+	EncryptKeyId   string //id of the key of the encrypted data partitions, kept after the encryption is disabled
+	encryptKey     []byte //the key of EncryptKeyId if it is created by the master, nil if kept by the kms
+	ErasureCode    bool   //the sealed extent partitions of vol are encoded into RS 4+2 shards
+	MetaPlacement  MetaPlacement
+	LifecycleRules []*proto.LifecycleRule
+	tokens         map[string]*Token
+	tokensLock     sync.RWMutex
 	sync.RWMutex
 }
 
 func NewVol(name, volType string, replicaNum uint8) (vol *Vol) {
 	vol = &Vol{Name: name, VolType: volType, MetaPartitions: make(map[uint64]*MetaPartition, 0)}
+	vol.tokens = make(map[string]*Token)
 	vol.dataPartitions = NewDataPartitionMap(name)
 	vol.dpReplicaNum = replicaNum
 	vol.threshold = DefaultMetaPartitionThreshold
@@ -97,9 +119,22 @@ func (vol *Vol) getDataPartitionByID(partitionID uint64) (dp *DataPartition, err
 func (vol *Vol) checkDataPartitions(c *Cluster) (readWriteDataPartitions int) {
 	vol.dataPartitions.RLock()
 	defer vol.dataPartitions.RUnlock()
+	degradedWrite := vol.getDegradedWrite()
+	degraded := 0
 	for _, dp := range vol.dataPartitions.dataPartitionMap {
+		// the replicas of the partitions in archive are detached from the data nodes
+		if dp.getArchiveStatus() != "" {
+			continue
+		}
 		dp.checkReplicaStatus(c.cfg.DataPartitionTimeOutSec)
-		dp.checkStatus(true, c.cfg.DataPartitionTimeOutSec)
+		dp.checkStatus(true, c.cfg.DataPartitionTimeOutSec, degradedWrite)
+		if dp.isDegraded() {
+			degraded++
+		}
+		if dp.isLost() {
+			c.notify(NotifyPartitionUnavailable, fmt.Sprintf("dp%v", dp.PartitionID), fmt.Sprintf("clusterID[%v] vol[%v] dataPartition[%v] has no live replica, hosts[%v]",
+				c.Name, vol.Name, dp.PartitionID, dp.HostsToString()))
+		}
 		dp.checkMiss(c.Name, c.cfg.DataPartitionMissSec, c.cfg.DataPartitionWarnInterval)
 		dp.checkReplicaNum(c, vol.Name)
 		if dp.Status == proto.ReadWrite {
@@ -114,6 +149,16 @@ func (vol *Vol) checkDataPartitions(c *Cluster) (readWriteDataPartitions int) {
 		tasks := dp.checkReplicationTask()
 		c.putDataNodeTasks(tasks)
 	}
+	if degradedWrite == DegradedWriteBlock && degraded != 0 {
+		// the writes of vol wait until the partitions below the replica count are restored
+		for _, dp := range vol.dataPartitions.dataPartitionMap {
+			dp.Lock()
+			dp.Status = proto.ReadOnly
+			dp.Unlock()
+		}
+		readWriteDataPartitions = 0
+		Warn(c.Name, fmt.Sprintf("vol[%v] writes blocked, %v dataPartitions degraded", vol.Name, degraded))
+	}
 	return
 }
 
@@ -145,6 +190,10 @@ func (vol *Vol) checkMetaPartitions(c *Cluster) {
 	mps := vol.cloneMetaPartitionMap()
 	for _, mp := range mps {
 		mp.checkStatus(true, int(vol.mpReplicaNum))
+		if mp.isUnavailable() {
+			c.notify(NotifyPartitionUnavailable, fmt.Sprintf("mp%v", mp.PartitionID), fmt.Sprintf("clusterID[%v] vol[%v] metaPartition[%v] has no live majority or leader, hosts[%v]",
+				c.Name, vol.Name, mp.PartitionID, mp.PersistenceHosts))
+		}
 		mp.checkReplicaLeader()
 		mp.checkReplicaNum(c, vol.Name, vol.mpReplicaNum)
 		mp.checkEnd(c, maxPartitionID)
@@ -180,6 +229,198 @@ func (vol *Vol) setStatus(status uint8) {
 	vol.Status = status
 }
 
+func (vol *Vol) setImmutable(immutable bool) {
+	vol.Lock()
+	defer vol.Unlock()
+	vol.Immutable = immutable
+}
+
+func (vol *Vol) isImmutable() bool {
+	vol.RLock()
+	defer vol.RUnlock()
+	return vol.Immutable
+}
+
+func (vol *Vol) setSyncOnClose(syncOnClose bool) {
+	vol.Lock()
+	defer vol.Unlock()
+	vol.SyncOnClose = syncOnClose
+}
+
+func (vol *Vol) isSyncOnClose() bool {
+	vol.RLock()
+	defer vol.RUnlock()
+	return vol.SyncOnClose
+}
+
+func (vol *Vol) setFollowerRead(followerRead bool) {
+	vol.Lock()
+	defer vol.Unlock()
+	vol.FollowerRead = followerRead
+}
+
+func (vol *Vol) isFollowerRead() bool {
+	vol.RLock()
+	defer vol.RUnlock()
+	return vol.FollowerRead
+}
+
+func (vol *Vol) setAudit(audit bool) {
+	vol.Lock()
+	defer vol.Unlock()
+	vol.Audit = audit
+}
+
+func (vol *Vol) isAudit() bool {
+	vol.RLock()
+	defer vol.RUnlock()
+	return vol.Audit
+}
+
+func (vol *Vol) setErasureCode(erasureCode bool) {
+	vol.Lock()
+	defer vol.Unlock()
+	vol.ErasureCode = erasureCode
+}
+
+func (vol *Vol) isErasureCode() bool {
+	vol.RLock()
+	defer vol.RUnlock()
+	return vol.ErasureCode
+}
+
+func (vol *Vol) setReadOnly(readOnly bool) {
+	vol.Lock()
+	defer vol.Unlock()
+	vol.ReadOnly = readOnly
+}
+
+func (vol *Vol) isReadOnly() bool {
+	vol.RLock()
+	defer vol.RUnlock()
+	return vol.ReadOnly
+}
+
+func (vol *Vol) setPermission(permission bool) {
+	vol.Lock()
+	defer vol.Unlock()
+	vol.Permission = permission
+}
+
+func (vol *Vol) isPermission() bool {
+	vol.RLock()
+	defer vol.RUnlock()
+	return vol.Permission
+}
+
+func (vol *Vol) setCompression(compression string) {
+	vol.Lock()
+	defer vol.Unlock()
+	vol.Compression = compression
+}
+
+func (vol *Vol) getCompression() string {
+	vol.RLock()
+	defer vol.RUnlock()
+	return vol.Compression
+}
+
+func (vol *Vol) setColdTierDays(days int) {
+	vol.Lock()
+	defer vol.Unlock()
+	vol.ColdTierDays = days
+}
+
+func (vol *Vol) getColdTierDays() int {
+	vol.RLock()
+	defer vol.RUnlock()
+	return vol.ColdTierDays
+}
+
+func (vol *Vol) setDegradedWrite(degradedWrite string) {
+	vol.Lock()
+	defer vol.Unlock()
+	vol.DegradedWrite = degradedWrite
+}
+
+func (vol *Vol) getDegradedWrite() string {
+	vol.RLock()
+	defer vol.RUnlock()
+	if vol.DegradedWrite == "" {
+		return DegradedWriteHealthy
+	}
+	return vol.DegradedWrite
+}
+
+func (vol *Vol) setEncryption(encrypted bool, keyId string, key []byte) {
+	vol.Lock()
+	defer vol.Unlock()
+	vol.Encrypted = encrypted
+	vol.EncryptKeyId = keyId
+	vol.encryptKey = key
+}
+
+func (vol *Vol) getEncryption() (encrypted bool, keyId string, key []byte) {
+	vol.RLock()
+	defer vol.RUnlock()
+	return vol.Encrypted, vol.EncryptKeyId, vol.encryptKey
+}
+
+func (vol *Vol) setQuota(quota uint64) {
+	vol.Lock()
+	defer vol.Unlock()
+	vol.Quota = quota
+}
+
+func (vol *Vol) getQuota() uint64 {
+	vol.RLock()
+	defer vol.RUnlock()
+	return vol.Quota
+}
+
+func (vol *Vol) setLimits(maxFileSize, maxFiles uint64) {
+	vol.Lock()
+	defer vol.Unlock()
+	vol.MaxFileSize = maxFileSize
+	vol.MaxFiles = maxFiles
+}
+
+func (vol *Vol) getLimits() (maxFileSize, maxFiles uint64) {
+	vol.RLock()
+	defer vol.RUnlock()
+	return vol.MaxFileSize, vol.MaxFiles
+}
+
+/*the inodes of vol reported by the leaders of its meta partitions*/
+func (vol *Vol) getFileCount() (files uint64) {
+	vol.mpsLock.RLock()
+	defer vol.mpsLock.RUnlock()
+	for _, mp := range vol.MetaPartitions {
+		mp.RLock()
+		files += mp.InodeCount
+		mp.RUnlock()
+	}
+	return
+}
+
+// getUsage sums the usage aggregated by the leaders of the meta partitions of
+// vol, ok is false while a partition has not reported one.
+func (vol *Vol) getUsage() (files, bytes uint64, ok bool) {
+	vol.mpsLock.RLock()
+	defer vol.mpsLock.RUnlock()
+	for _, mp := range vol.MetaPartitions {
+		mp.RLock()
+		reported := mp.UsageTime != 0
+		files += mp.UsageFiles
+		bytes += mp.UsageBytes
+		mp.RUnlock()
+		if !reported {
+			return 0, 0, false
+		}
+	}
+	return files, bytes, len(vol.MetaPartitions) != 0
+}
+
 func (vol *Vol) checkStatus(c *Cluster) {
 	vol.Lock()
 	defer vol.Unlock()
@@ -204,6 +445,7 @@ func (vol *Vol) deleteVolFromStore(c *Cluster) {
 	//delete mp and dp metadata first, then delete vol in case new vol with same name create
 	vol.deleteDataPartitionsFromStore(c)
 	vol.deleteMetaPartitionsFromStore(c)
+	vol.deleteTokensFromStore(c)
 	c.deleteVol(vol.Name)
 }
 
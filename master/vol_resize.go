@@ -0,0 +1,430 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	VolResizeCheckIntervalSeconds = 60
+	// the clients refresh their partition views every minute, a migration pass
+	// started after the grace sees the partition releasing
+	ResizeReleaseGraceSeconds = 300
+)
+
+const (
+	ResizeGrowing   = "growing"
+	ResizeShrinking = "shrinking"
+	ResizeDone      = "done"
+	ResizeFailed    = "failed"
+)
+
+type ReleasingPartition struct {
+	PartitionID uint64
+	Used        uint64
+	MarkTime    int64
+}
+
+type VolResizeView struct {
+	Name         string
+	Status       string
+	Capacity     uint64 //bytes the vol is resized to
+	Partitions   int    //data partitions not releasing
+	ToCreate     int
+	Created      int
+	Releasing    []*ReleasingPartition
+	Released     []uint64
+	LastMigrated int64 //start of the last migration pass reported by a client
+	StartTime    int64
+	EndTime      int64
+	Msg          string
+}
+
+// the resize of a vol: a grow creates the partitions the capacity lacks, a shrink
+// marks the least used partitions releasing, they are read only and the clients
+// migrating the vol copy the files off them, a partition is deleted once a
+// migration pass started after its mark is reported
+type volResize struct {
+	name         string
+	status       string
+	capacity     uint64
+	toCreate     int
+	created      int
+	releasing    map[uint64]*ReleasingPartition
+	released     []uint64
+	lastMigrated int64
+	startTime    int64
+	endTime      int64
+	msg          string
+}
+
+// the resize state is kept only in the memory of the leader, the releasing flag of
+// the partitions is persisted and the next leader takes the shrink over in its first
+// check, the releasing partitions wait for a migration pass started after that
+type resizer struct {
+	vols map[string]*volResize
+	sync.Mutex
+}
+
+func newResizer() *resizer {
+	return &resizer{vols: make(map[string]*volResize)}
+}
+
+func newVolResize(name, status string, capacity uint64) *volResize {
+	return &volResize{
+		name:      name,
+		status:    status,
+		capacity:  capacity,
+		releasing: make(map[uint64]*ReleasingPartition),
+		released:  make([]uint64, 0),
+		startTime: time.Now().Unix(),
+	}
+}
+
+/*the caller must hold the lock of resizer*/
+func (r *volResize) finish(status, msg string) {
+	r.status = status
+	r.msg = msg
+	r.endTime = time.Now().Unix()
+	log.LogWarnf("action[resizeVol] vol[%v] capacity[%v] %v: %v", r.name, r.capacity, status, msg)
+}
+
+func (c *Cluster) startCheckVolResize() {
+	go func() {
+		for {
+			if c.partition.IsLeader() {
+				c.checkVolResize()
+			}
+			time.Sleep(time.Second * VolResizeCheckIntervalSeconds)
+		}
+	}()
+}
+
+/*the partitions of vol not in archive, split by the releasing flag*/
+func (vol *Vol) getResizablePartitions() (active, releasing []*DataPartition) {
+	vol.dataPartitions.RLock()
+	defer vol.dataPartitions.RUnlock()
+	active = make([]*DataPartition, 0)
+	releasing = make([]*DataPartition, 0)
+	for _, dp := range vol.dataPartitions.dataPartitions {
+		dp.RLock()
+		switch {
+		case dp.ArchiveStatus != "":
+		case dp.Releasing:
+			releasing = append(releasing, dp)
+		default:
+			active = append(active, dp)
+		}
+		dp.RUnlock()
+	}
+	return
+}
+
+/*the max used of the replicas in their last heartbeats*/
+func (partition *DataPartition) getReplicasUsed() (used uint64) {
+	partition.RLock()
+	defer partition.RUnlock()
+	for _, replica := range partition.Replicas {
+		if replica.Used > used {
+			used = replica.Used
+		}
+	}
+	return
+}
+
+func (c *Cluster) setDataPartitionReleasing(dp *DataPartition, releasing bool) (err error) {
+	dp.Lock()
+	defer dp.Unlock()
+	if dp.Releasing == releasing {
+		return
+	}
+	dp.Releasing = releasing
+	if err = c.syncUpdateDataPartition(dp.VolName, dp); err != nil {
+		dp.Releasing = !releasing
+		return
+	}
+	if releasing {
+		dp.Status = proto.ReadOnly
+	}
+	log.LogWarnf("action[setDataPartitionReleasing] clusterID[%v] partitionID:%v vol[%v] releasing[%v]",
+		c.Name, dp.PartitionID, dp.VolName, releasing)
+	return
+}
+
+// set the quota of vol to capacity and change its partitions to match, the
+// partitions are of the default size, the capacity can't be less than the used
+func (c *Cluster) resizeVol(name string, capacity uint64) (err error) {
+	var vol *Vol
+	if vol, err = c.getVol(name); err != nil {
+		return
+	}
+	if capacity == 0 {
+		return errors.Annotatef(UnMatchPara, "capacity[%v]", capacity)
+	}
+	if used, _ := vol.statSpace(); capacity < used {
+		return errors.Annotatef(UnMatchPara, "capacity[%v] less than used[%v] of vol[%v]", capacity, used, name)
+	}
+	rs := c.resizer
+	rs.Lock()
+	defer rs.Unlock()
+	old, ok := rs.vols[name]
+	if ok && old.status == ResizeGrowing {
+		return hasExist(fmt.Sprintf("grow of vol %v", name))
+	}
+	if err = c.setVolQuota(name, capacity); err != nil {
+		return
+	}
+	r := newVolResize(name, ResizeDone, capacity)
+	if ok {
+		r.releasing = old.releasing
+		r.lastMigrated = old.lastMigrated
+	}
+	rs.vols[name] = r
+	size := uint64(util.DefaultDataPartitionSize)
+	active, releasing := vol.getResizablePartitions()
+	have := uint64(len(active)) * size
+	if have < capacity {
+		have = c.unmarkReleasing(r, have, releasing)
+		if have < capacity {
+			r.toCreate = int((capacity - have + size - 1) / size)
+		}
+	} else if have-capacity >= size {
+		c.markReleasing(r, have, active)
+	}
+	switch {
+	case r.toCreate != 0:
+		r.status = ResizeGrowing
+		go c.growVol(vol, r)
+	case len(r.releasing) != 0:
+		r.status = ResizeShrinking
+	default:
+		r.finish(ResizeDone, "partitions match the capacity")
+	}
+	log.LogWarnf("action[resizeVol] clusterID[%v] vol[%v] capacity[%v] partitions[%v] toCreate[%v] releasing[%v]",
+		c.Name, name, capacity, len(active), r.toCreate, len(r.releasing))
+	return
+}
+
+/*keep the releasing partitions holding the most data first, the caller must hold the lock of resizer*/
+func (c *Cluster) unmarkReleasing(r *volResize, have uint64, releasing []*DataPartition) uint64 {
+	sort.Slice(releasing, func(i, j int) bool {
+		return releasing[i].getReplicasUsed() > releasing[j].getReplicasUsed()
+	})
+	for _, dp := range releasing {
+		if have >= r.capacity {
+			break
+		}
+		if err := c.setDataPartitionReleasing(dp, false); err != nil {
+			log.LogWarnf("action[unmarkReleasing] partitionID:%v vol[%v]: %v", dp.PartitionID, r.name, err)
+			continue
+		}
+		delete(r.releasing, dp.PartitionID)
+		have += uint64(util.DefaultDataPartitionSize)
+	}
+	return have
+}
+
+/*release the least used writable partitions, one writable partition is kept, the caller must hold the lock of resizer*/
+func (c *Cluster) markReleasing(r *volResize, have uint64, active []*DataPartition) {
+	size := uint64(util.DefaultDataPartitionSize)
+	candidates := make([]*DataPartition, 0, len(active))
+	for _, dp := range active {
+		dp.RLock()
+		if dp.Status == proto.ReadWrite && !dp.Sealed {
+			candidates = append(candidates, dp)
+		}
+		dp.RUnlock()
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].getReplicasUsed() < candidates[j].getReplicasUsed()
+	})
+	now := time.Now().Unix()
+	for i := 0; i < len(candidates)-1 && have-r.capacity >= size; i++ {
+		dp := candidates[i]
+		if err := c.setDataPartitionReleasing(dp, true); err != nil {
+			log.LogWarnf("action[markReleasing] partitionID:%v vol[%v]: %v", dp.PartitionID, r.name, err)
+			continue
+		}
+		r.releasing[dp.PartitionID] = &ReleasingPartition{PartitionID: dp.PartitionID, Used: dp.getReplicasUsed(), MarkTime: now}
+		have -= size
+	}
+	if have-r.capacity >= size {
+		r.msg = fmt.Sprintf("%v bytes over the capacity, no more writable partition to release", have-r.capacity)
+	}
+}
+
+func (c *Cluster) growVol(vol *Vol, r *volResize) {
+	rs := c.resizer
+	for {
+		rs.Lock()
+		if rs.vols[vol.Name] != r || r.created >= r.toCreate {
+			rs.Unlock()
+			break
+		}
+		rs.Unlock()
+		_, err := c.createDataPartition(vol.Name, vol.VolType)
+		rs.Lock()
+		if err != nil {
+			r.finish(ResizeFailed, fmt.Sprintf("create data partition: %v", err))
+			rs.Unlock()
+			return
+		}
+		r.created++
+		rs.Unlock()
+	}
+	rs.Lock()
+	defer rs.Unlock()
+	if r.status != ResizeGrowing {
+		return
+	}
+	if len(r.releasing) != 0 {
+		r.status = ResizeShrinking
+		return
+	}
+	r.finish(ResizeDone, fmt.Sprintf("%v partitions created", r.created))
+}
+
+/*a client migrating vol finished a pass started at start, the files of the pass are off the releasing partitions*/
+func (c *Cluster) reportVolMigrated(name string, start int64) (err error) {
+	if _, err = c.getVol(name); err != nil {
+		return
+	}
+	if start > time.Now().Unix() {
+		return errors.Annotatef(UnMatchPara, "start[%v] in the future", start)
+	}
+	rs := c.resizer
+	rs.Lock()
+	defer rs.Unlock()
+	if r, ok := rs.vols[name]; ok && start > r.lastMigrated {
+		r.lastMigrated = start
+	}
+	return
+}
+
+func (c *Cluster) getVolResizeView(name string) (view *VolResizeView, err error) {
+	var vol *Vol
+	if vol, err = c.getVol(name); err != nil {
+		return
+	}
+	active, _ := vol.getResizablePartitions()
+	rs := c.resizer
+	rs.Lock()
+	defer rs.Unlock()
+	r, ok := rs.vols[name]
+	if !ok {
+		return nil, elementNotFound(fmt.Sprintf("resize of vol %v", name))
+	}
+	view = &VolResizeView{
+		Name:         r.name,
+		Status:       r.status,
+		Capacity:     r.capacity,
+		Partitions:   len(active),
+		ToCreate:     r.toCreate,
+		Created:      r.created,
+		Releasing:    make([]*ReleasingPartition, 0, len(r.releasing)),
+		Released:     append([]uint64{}, r.released...),
+		LastMigrated: r.lastMigrated,
+		StartTime:    r.startTime,
+		EndTime:      r.endTime,
+		Msg:          r.msg,
+	}
+	for _, p := range r.releasing {
+		partition := *p
+		view.Releasing = append(view.Releasing, &partition)
+	}
+	return
+}
+
+func (c *Cluster) checkVolResize() {
+	rs := c.resizer
+	rs.Lock()
+	defer rs.Unlock()
+	vols := c.getAllNormalVols()
+	for name := range rs.vols {
+		if _, ok := vols[name]; !ok {
+			delete(rs.vols, name)
+		}
+	}
+	for name, vol := range vols {
+		_, releasing := vol.getResizablePartitions()
+		r, ok := rs.vols[name]
+		if !ok {
+			if len(releasing) == 0 {
+				continue
+			}
+			// a shrink started by the previous leader
+			r = newVolResize(name, ResizeShrinking, vol.getQuota())
+			rs.vols[name] = r
+		}
+		c.releaseMigratedPartitions(vol, r, releasing)
+	}
+}
+
+/*the caller must hold the lock of resizer*/
+func (c *Cluster) releaseMigratedPartitions(vol *Vol, r *volResize, releasing []*DataPartition) {
+	now := time.Now().Unix()
+	marks := make(map[uint64]*ReleasingPartition, len(releasing))
+	for _, dp := range releasing {
+		p, ok := r.releasing[dp.PartitionID]
+		if !ok {
+			p = &ReleasingPartition{PartitionID: dp.PartitionID, MarkTime: now}
+		}
+		p.Used = dp.getReplicasUsed()
+		if r.lastMigrated < p.MarkTime+ResizeReleaseGraceSeconds {
+			marks[dp.PartitionID] = p
+			continue
+		}
+		if err := c.releaseDataPartition(vol, dp); err != nil {
+			log.LogWarnf("action[releaseMigratedPartitions] partitionID:%v vol[%v]: %v", dp.PartitionID, vol.Name, err)
+			marks[dp.PartitionID] = p
+			continue
+		}
+		r.released = append(r.released, dp.PartitionID)
+		if len(r.released) > MigrationHistoryCount {
+			r.released = r.released[len(r.released)-MigrationHistoryCount:]
+		}
+	}
+	r.releasing = marks
+	if r.status == ResizeShrinking && len(r.releasing) == 0 {
+		r.finish(ResizeDone, "releasing partitions released")
+	}
+}
+
+// delete the replicas of the partition and remove it from vol, the partition is no
+// longer in the views of the clients and its replicas are deleted by the tasks
+func (c *Cluster) releaseDataPartition(vol *Vol, dp *DataPartition) (err error) {
+	dp.RLock()
+	tasks := make([]*proto.AdminTask, 0, len(dp.PersistenceHosts)+len(dp.WarmHosts))
+	for _, host := range append(append([]string{}, dp.PersistenceHosts...), dp.WarmHosts...) {
+		tasks = append(tasks, dp.GenerateDeleteTask(host))
+	}
+	dp.RUnlock()
+	if err = c.syncDeleteDataPartition(vol.Name, dp); err != nil {
+		return
+	}
+	vol.dataPartitions.deleteDataPartition(dp.PartitionID)
+	c.putDataNodeTasks(tasks)
+	log.LogWarnf("action[releaseDataPartition] clusterID[%v] partitionID:%v vol[%v] released", c.Name, dp.PartitionID, vol.Name)
+	return
+}
@@ -0,0 +1,116 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/audit"
+)
+
+// volAudit keeps the vols with the audit enabled by the master heartbeats, the
+// namespace mutations of them served by the node are recorded by the logger. A
+// node without an audit log records nothing whatever the vols.
+type volAudit struct {
+	logger *audit.MetaLogger
+	vols   map[string]bool
+	sync.RWMutex
+}
+
+func newVolAudit(logger *audit.MetaLogger) *volAudit {
+	return &volAudit{logger: logger, vols: make(map[string]bool)}
+}
+
+func (a *volAudit) update(vols map[string]bool) {
+	if vols == nil {
+		vols = make(map[string]bool)
+	}
+	a.Lock()
+	a.vols = vols
+	a.Unlock()
+}
+
+func (a *volAudit) enabled(volName string) bool {
+	if a == nil || a.logger == nil {
+		return false
+	}
+	a.RLock()
+	defer a.RUnlock()
+	return a.vols[volName]
+}
+
+func (a *volAudit) close() {
+	if a != nil && a.logger != nil {
+		a.logger.Close()
+	}
+}
+
+// the inode created or deleted by an op, taken from the response if the
+// request does not name it
+type auditResponse struct {
+	Info  *proto.InodeInfo `json:"info"`
+	Inode uint64           `json:"ino"`
+}
+
+func txOpName(op uint8) string {
+	if op == proto.TxDeleteDentry {
+		return "deleteDentry"
+	}
+	return "createDentry"
+}
+
+// clientOf returns the ip of the client of p, and the one of the meta node
+// that proxied it, empty if it is not proxied. A proxy puts the ip of the
+// client in the arg of the packet, it is taken from the nodes of the cluster
+// only, or from anyone on a cluster without the auth.
+func (m *metaManager) clientOf(conn net.Conn, p *Packet) (client, proxy string) {
+	client = conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	if p.Arglen > 0 && (!m.auth.Enabled() || m.auth.Internal(conn)) {
+		return string(p.Arg[:p.Arglen]), client
+	}
+	return client, ""
+}
+
+// auditOp records the op served for the partition with the result in p, the
+// ops proxied to the leader are recorded by the leader with the address of
+// the client and the one of the proxy.
+func (m *metaManager) auditOp(mp MetaPartition, p *Packet, e *audit.MetaEntry) {
+	conf := mp.GetBaseConfig()
+	if !m.audit.enabled(conf.VolName) {
+		return
+	}
+	e.Vol = conf.VolName
+	e.Partition = conf.PartitionId
+	e.Op = p.GetOpMsg()
+	e.Result = p.GetResultMesg()
+	e.Client, e.Proxy = p.client, p.proxy
+	if e.Inode == 0 && p.ResultCode == proto.OpOk && len(p.Data) != 0 {
+		resp := &auditResponse{}
+		if json.Unmarshal(p.Data, resp) == nil {
+			if resp.Info != nil {
+				e.Inode = resp.Info.Inode
+			} else {
+				e.Inode = resp.Inode
+			}
+		}
+	}
+	m.audit.logger.Log(e)
+}
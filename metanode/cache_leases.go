@@ -0,0 +1,249 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+type leaseKey struct {
+	sessionID   string
+	partitionID uint64
+}
+
+type sessionLeases struct {
+	inodes      map[uint64]bool  // the inodes of the partition opened with a lease
+	timed       map[uint64]int64 // the end of the leases of the lookups, the readdirs and the inode gets
+	invalidated map[uint64]bool  // the leased inodes changed since the last renew
+	reset       bool
+	lastRenew   int64
+}
+
+// cacheLeases keeps the inodes the client sessions cache the pages, the attrs
+// or the dentries of, like fileLocks in the memory of the partition leaders
+// only. The inodes opened with a lease are leased until they are not renewed
+// any more, the inodes and the dirs read with a lease are leased for its
+// seconds. A change of a leased inode by another session is queued to the
+// sessions holding the lease and returned by their next renew. A session
+// leasing a partition the leader has no lease of is reset, it may have
+// missed the changes on the previous leader or while its leases were expired.
+type cacheLeases struct {
+	inodes   map[openKey]map[string]bool // the sessions leasing the inode
+	sessions map[leaseKey]*sessionLeases
+	sync.Mutex
+}
+
+func newCacheLeases() *cacheLeases {
+	return &cacheLeases{
+		inodes:   make(map[openKey]map[string]bool),
+		sessions: make(map[leaseKey]*sessionLeases),
+	}
+}
+
+/*the leases of the session on the partition, created reset if the leader has none, the caller must hold the lock of cacheLeases*/
+func (l *cacheLeases) session(sessionID string, partitionID uint64) (s *sessionLeases) {
+	key := leaseKey{sessionID: sessionID, partitionID: partitionID}
+	if s = l.sessions[key]; s == nil {
+		s = &sessionLeases{
+			inodes:      make(map[uint64]bool),
+			timed:       make(map[uint64]int64),
+			invalidated: make(map[uint64]bool),
+			reset:       true,
+			lastRenew:   time.Now().Unix(),
+		}
+		l.sessions[key] = s
+	}
+	return
+}
+
+/*the caller must hold the lock of cacheLeases*/
+func (l *cacheLeases) index(key leaseKey, ino uint64) {
+	inoKey := openKey{partitionID: key.partitionID, ino: ino}
+	if l.inodes[inoKey] == nil {
+		l.inodes[inoKey] = make(map[string]bool)
+	}
+	l.inodes[inoKey][key.sessionID] = true
+}
+
+/*drop the session from the sessions leasing the inode once it has no lease of it, the caller must hold the lock of cacheLeases*/
+func (l *cacheLeases) unindex(key leaseKey, s *sessionLeases, ino uint64) {
+	if s != nil && (s.inodes[ino] || s.timed[ino] != 0) {
+		return
+	}
+	inoKey := openKey{partitionID: key.partitionID, ino: ino}
+	delete(l.inodes[inoKey], key.sessionID)
+	if len(l.inodes[inoKey]) == 0 {
+		delete(l.inodes, inoKey)
+	}
+}
+
+/*drop the opened inodes of the session, the caller must hold the lock of cacheLeases*/
+func (l *cacheLeases) unlease(key leaseKey, s *sessionLeases) {
+	inodes := s.inodes
+	s.inodes = make(map[uint64]bool)
+	for ino := range inodes {
+		l.unindex(key, s, ino)
+	}
+}
+
+/*drop the timed leases ended before now, the caller must hold the lock of cacheLeases*/
+func (l *cacheLeases) expireTimed(key leaseKey, s *sessionLeases, now int64) {
+	for ino, end := range s.timed {
+		if end < now {
+			delete(s.timed, ino)
+			l.unindex(key, s, ino)
+		}
+	}
+}
+
+/*the caller must hold the lock of cacheLeases*/
+func (l *cacheLeases) remove(key leaseKey, s *sessionLeases) {
+	for ino := range s.inodes {
+		l.unindex(key, nil, ino)
+	}
+	for ino := range s.timed {
+		l.unindex(key, nil, ino)
+	}
+	delete(l.sessions, key)
+}
+
+// lease adds the inode opened by the session to its leases, the requests of
+// old clients without the session are not leased.
+func (l *cacheLeases) lease(sessionID string, partitionID, ino uint64) {
+	if sessionID == "" {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	key := leaseKey{sessionID: sessionID, partitionID: partitionID}
+	l.session(sessionID, partitionID).inodes[ino] = true
+	l.index(key, ino)
+}
+
+// grant leases the inodes to the session for the seconds, at most
+// MaxCacheLeaseSeconds. The lease is kept for the timeout of the renews
+// beyond, the session takes it when it gets the reply.
+func (l *cacheLeases) grant(sessionID string, partitionID uint64, seconds int64, inodes ...uint64) {
+	if sessionID == "" || seconds <= 0 {
+		return
+	}
+	if seconds > proto.MaxCacheLeaseSeconds {
+		seconds = proto.MaxCacheLeaseSeconds
+	}
+	end := time.Now().Unix() + seconds + int64(cacheLeaseTimeout/time.Second)
+	l.Lock()
+	defer l.Unlock()
+	key := leaseKey{sessionID: sessionID, partitionID: partitionID}
+	s := l.session(sessionID, partitionID)
+	for _, ino := range inodes {
+		if s.timed[ino] < end {
+			s.timed[ino] = end
+		}
+		l.index(key, ino)
+	}
+}
+
+// renew replaces the opened inodes of the session on the partition with the
+// inodes it has open, and returns the leased inodes changed by the other
+// sessions meanwhile.
+func (l *cacheLeases) renew(sessionID string, partitionID uint64, inodes []uint64) (invalidated []uint64, reset bool) {
+	now := time.Now().Unix()
+	l.Lock()
+	defer l.Unlock()
+	key := leaseKey{sessionID: sessionID, partitionID: partitionID}
+	if s, ok := l.sessions[key]; ok && l.isExpired(s, now) {
+		// the changes are not queued to the expired leases
+		l.remove(key, s)
+	}
+	s := l.session(sessionID, partitionID)
+	for ino := range s.invalidated {
+		invalidated = append(invalidated, ino)
+	}
+	reset = s.reset
+	s.invalidated = make(map[uint64]bool)
+	s.reset = false
+	s.lastRenew = now
+	l.unlease(key, s)
+	for _, ino := range inodes {
+		s.inodes[ino] = true
+		l.index(key, ino)
+	}
+	l.expireTimed(key, s, now)
+	return
+}
+
+// invalidate queues the change of the inode to the sessions leasing it but
+// the session making it, a change of an old client invalidates them all.
+func (l *cacheLeases) invalidate(sessionID string, partitionID, ino uint64) {
+	now := time.Now().Unix()
+	l.Lock()
+	defer l.Unlock()
+	for id := range l.inodes[openKey{partitionID: partitionID, ino: ino}] {
+		if id == sessionID {
+			continue
+		}
+		s := l.sessions[leaseKey{sessionID: id, partitionID: partitionID}]
+		if s != nil && (s.inodes[ino] || s.timed[ino] >= now) {
+			s.invalidated[ino] = true
+		}
+	}
+}
+
+/*the caller must hold the lock of cacheLeases*/
+func (l *cacheLeases) isExpired(s *sessionLeases, now int64) bool {
+	return now-s.lastRenew > int64(cacheLeaseTimeout/time.Second)
+}
+
+// resetPartition drops the leases of the partition after a leader change,
+// the sessions are reset at their next renew to the new leader.
+func (l *cacheLeases) resetPartition(partitionID uint64) {
+	l.Lock()
+	defer l.Unlock()
+	for key, s := range l.sessions {
+		if key.partitionID == partitionID {
+			l.remove(key, s)
+		}
+	}
+}
+
+// expire drops the leases the sessions did not renew for the timeout, their
+// clients are gone or reset at their next renew, and the timed leases ended.
+func (l *cacheLeases) expire() {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now().Unix()
+	for key, s := range l.sessions {
+		if l.isExpired(s, now) {
+			l.remove(key, s)
+		} else {
+			l.expireTimed(key, s, now)
+		}
+	}
+}
+
+// count returns the number of the leased inodes and of the sessions leasing
+// them.
+func (l *cacheLeases) count() (inodes, sessions int) {
+	l.Lock()
+	defer l.Unlock()
+	sessionIDs := make(map[string]bool)
+	for key := range l.sessions {
+		sessionIDs[key.sessionID] = true
+	}
+	return len(l.inodes), len(sessionIDs)
+}
@@ -0,0 +1,129 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+func TestCacheLeases(t *testing.T) {
+	l := newCacheLeases()
+	renew := func(sessionID string, inodes ...uint64) ([]uint64, bool) {
+		invalidated, reset := l.renew(sessionID, 1, inodes)
+		sort.Slice(invalidated, func(i, j int) bool { return invalidated[i] < invalidated[j] })
+		return invalidated, reset
+	}
+
+	// the first renew of a session resets its caches
+	l.lease("a", 1, 2)
+	if invalidated, reset := renew("a", 2, 3); len(invalidated) != 0 || !reset {
+		t.Fatalf("first renew: %v %v", invalidated, reset)
+	}
+	if invalidated, reset := renew("b", 2); len(invalidated) != 0 || !reset {
+		t.Fatalf("first renew of b: %v %v", invalidated, reset)
+	}
+
+	// a change is queued to the other sessions leasing the inode only
+	l.invalidate("b", 1, 2)
+	l.invalidate("b", 1, 3)
+	l.invalidate("b", 1, 4)
+	l.invalidate("b", 2, 3)
+	if invalidated, reset := renew("a", 2, 3); len(invalidated) != 2 || invalidated[0] != 2 || invalidated[1] != 3 || reset {
+		t.Fatalf("renew after the changes of b: %v %v", invalidated, reset)
+	}
+	if invalidated, _ := renew("b", 2); len(invalidated) != 0 {
+		t.Fatalf("changes of b queued to b: %v", invalidated)
+	}
+	if invalidated, _ := renew("a", 2, 3); len(invalidated) != 0 {
+		t.Fatalf("changes returned twice: %v", invalidated)
+	}
+
+	// a change of an old client without the session invalidates all
+	l.invalidate("", 1, 2)
+	if invalidated, _ := renew("b"); len(invalidated) != 1 {
+		t.Fatalf("change of an old client: %v", invalidated)
+	}
+	l.invalidate("", 1, 2)
+	if invalidated, _ := renew("b"); len(invalidated) != 0 {
+		t.Fatalf("change of an inode not leased any more: %v", invalidated)
+	}
+
+	// the sessions are reset after a leader change or an expiry
+	l.resetPartition(1)
+	if len(l.inodes) != 0 || len(l.sessions) != 0 {
+		t.Fatalf("leases after the leader change: %v %v", l.inodes, l.sessions)
+	}
+	if _, reset := renew("a", 2, 3); !reset {
+		t.Fatalf("renew after the leader change not reset")
+	}
+	l.sessions[leaseKey{sessionID: "a", partitionID: 1}].lastRenew = time.Now().Add(-2 * cacheLeaseTimeout).Unix()
+	if _, reset := renew("a", 2, 3); !reset {
+		t.Fatalf("renew after the expiry not reset")
+	}
+	if inodes, sessions := l.count(); inodes != 2 || sessions != 1 {
+		t.Fatalf("count: %v %v", inodes, sessions)
+	}
+	l.sessions[leaseKey{sessionID: "a", partitionID: 1}].lastRenew = time.Now().Add(-2 * cacheLeaseTimeout).Unix()
+	l.expire()
+	if len(l.inodes) != 0 || len(l.sessions) != 0 {
+		t.Fatalf("expired leases kept: %v %v", l.inodes, l.sessions)
+	}
+}
+
+func TestCacheLeasesGrant(t *testing.T) {
+	l := newCacheLeases()
+	l.grant("a", 1, 30, 2, 3)
+	l.grant("", 1, 30, 4)
+	l.grant("a", 1, 0, 5)
+	if invalidated, reset := l.renew("a", 1, nil); len(invalidated) != 0 || !reset {
+		t.Fatalf("first renew: %v %v", invalidated, reset)
+	}
+	if len(l.inodes) != 2 {
+		t.Fatalf("granted inodes: %v", l.inodes)
+	}
+
+	// the timed leases are kept by the renews without the inodes
+	l.invalidate("b", 1, 2)
+	if invalidated, _ := l.renew("a", 1, nil); len(invalidated) != 1 || invalidated[0] != 2 {
+		t.Fatalf("change of a granted inode: %v", invalidated)
+	}
+
+	// an opened inode unleased by a renew keeps its timed lease
+	l.lease("a", 1, 3)
+	l.renew("a", 1, nil)
+	l.invalidate("b", 1, 3)
+	if invalidated, _ := l.renew("a", 1, nil); len(invalidated) != 1 || invalidated[0] != 3 {
+		t.Fatalf("change of an unleased granted inode: %v", invalidated)
+	}
+
+	// the lease is capped and dropped when it ends
+	l.grant("a", 1, 10*proto.MaxCacheLeaseSeconds, 4)
+	s := l.sessions[leaseKey{sessionID: "a", partitionID: 1}]
+	if end := s.timed[4]; end > time.Now().Add(11*time.Minute).Unix() {
+		t.Fatalf("lease not capped: %v", end)
+	}
+	for ino := range s.timed {
+		s.timed[ino] = time.Now().Add(-time.Second).Unix()
+	}
+	l.invalidate("b", 1, 2)
+	l.expire()
+	if len(l.inodes) != 0 || len(s.timed) != 0 || len(s.invalidated) != 0 {
+		t.Fatalf("ended leases kept: %v %v %v", l.inodes, s.timed, s.invalidated)
+	}
+}
@@ -0,0 +1,359 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+// The compat tests check the META, inode and dentry files of a partition, the
+// raft snapshot and the raft log against the golden files of every release under
+// testdata/compat like the wire formats of proto: a file of any release must be
+// loaded as it was written, the current release must write the same bytes.
+// Rerun with -update only for an intended format change.
+var update = flag.Bool("update", false, "rewrite the golden files of the current release")
+
+const (
+	compatRelease = "1.0"
+	compatDir     = "testdata/compat"
+)
+
+func compatReleases(t *testing.T) (releases []string) {
+	infos, err := ioutil.ReadDir(compatDir)
+	if err != nil {
+		t.Fatalf("read %v: %v", compatDir, err)
+	}
+	for _, info := range infos {
+		if info.IsDir() {
+			releases = append(releases, info.Name())
+		}
+	}
+	sort.Strings(releases)
+	return
+}
+
+/*write the golden file of the current release with -update, compare with it otherwise*/
+func checkGolden(t *testing.T, name string, data []byte) {
+	filename := path.Join(compatDir, compatRelease, name)
+	if *update {
+		os.MkdirAll(path.Dir(filename), 0755)
+		if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+			t.Fatalf("write %v: %v", filename, err)
+		}
+		return
+	}
+	golden, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("read %v: %v", filename, err)
+	}
+	if !bytes.Equal(golden, data) {
+		t.Fatalf("%v changed, run with -update if the format change is intended:\nhave %q\nwant %q",
+			filename, data, golden)
+	}
+}
+
+/*call fn with the golden file or dir of every release which has it*/
+func rangeGolden(t *testing.T, name string, fn func(release, filename string)) {
+	for _, release := range compatReleases(t) {
+		filename := path.Join(compatDir, release, name)
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			continue
+		}
+		fn(release, filename)
+	}
+}
+
+func compatConfig(rootDir string) *MetaPartitionConfig {
+	return &MetaPartitionConfig{
+		PartitionId: 1,
+		VolName:     "intest",
+		Start:       1,
+		End:         1 << 24,
+		Peers:       []proto.Peer{{ID: 2, Addr: "10.0.0.2:9021"}, {ID: 3, Addr: "10.0.0.3:9021"}},
+		RootDir:     rootDir,
+	}
+}
+
+func compatInodes() []*Inode {
+	dir := NewInode(1, uint32(os.ModeDir|0755))
+	file := NewInode(2, 0644)
+	file.Extents.Put(proto.ExtentKey{PartitionId: 12, ExtentId: 1024, Size: 65536, Crc: 0x1F2E3D4C})
+	file.Extents.Put(proto.ExtentKey{PartitionId: 13, ExtentId: 7, Size: 4096})
+	file.Size = file.Extents.Size()
+	link := NewInode(3, uint32(os.ModeSymlink|0777))
+	link.LinkTarget = []byte("file")
+	deleted := NewInode(4, 0644)
+	deleted.NLink = 0
+	deleted.MarkDelete = 1
+	inodes := []*Inode{dir, file, link, deleted}
+	for _, ino := range inodes {
+		ino.Uid = 500
+		ino.Gid = 500
+		ino.CreateTime = 1540000000
+		ino.AccessTime = 1540000100
+		ino.ModifyTime = 1540000200
+	}
+	return inodes
+}
+
+func compatDentries() []*Dentry {
+	return []*Dentry{
+		{ParentId: 1, Name: "file", Inode: 2, Type: 0644},
+		{ParentId: 1, Name: "link", Inode: 3, Type: uint32(os.ModeSymlink | 0777)},
+	}
+}
+
+/*the partition with the fixtures*/
+func newCompatPartition(rootDir string) *metaPartition {
+	mp := NewMetaPartition(compatConfig(rootDir)).(*metaPartition)
+	mp.applyID = 42
+	for _, ino := range compatInodes() {
+		mp.inodeTree.ReplaceOrInsert(ino, true)
+	}
+	for _, dentry := range compatDentries() {
+		mp.dentryTree.ReplaceOrInsert(dentry, true)
+	}
+	return mp
+}
+
+/*check the inodes, dentries and apply id of the partition are the fixtures*/
+func checkCompatPartition(t *testing.T, from string, mp *metaPartition, applyID uint64) {
+	inodes := make([]*Inode, 0)
+	mp.inodeTree.Ascend(func(i BtreeItem) bool {
+		inodes = append(inodes, i.(*Inode))
+		return true
+	})
+	if want := compatInodes(); !reflect.DeepEqual(inodes, want) {
+		t.Errorf("%v inodes:\nhave %v\nwant %v", from, inodes, want)
+	}
+	dentries := make([]*Dentry, 0)
+	mp.dentryTree.Ascend(func(i BtreeItem) bool {
+		dentries = append(dentries, i.(*Dentry))
+		return true
+	})
+	if want := compatDentries(); !reflect.DeepEqual(dentries, want) {
+		t.Errorf("%v dentries:\nhave %v\nwant %v", from, dentries, want)
+	}
+	if mp.applyID != applyID {
+		t.Errorf("%v applyID %v, want %v", from, mp.applyID, applyID)
+	}
+}
+
+func TestCompatPartitionFiles(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "compat")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(rootDir)
+	mp := newCompatPartition(rootDir)
+	sm := &storeMsg{applyIndex: mp.applyID, inodeTree: mp.inodeTree, dentryTree: mp.dentryTree}
+	if err = mp.storeMeta(); err != nil {
+		t.Fatalf("store meta: %v", err)
+	}
+	if err = mp.storeInode(sm); err != nil {
+		t.Fatalf("store inode: %v", err)
+	}
+	if err = mp.storeDentry(sm); err != nil {
+		t.Fatalf("store dentry: %v", err)
+	}
+	if err = mp.storeApplyID(sm); err != nil {
+		t.Fatalf("store apply: %v", err)
+	}
+	for _, name := range []string{metaFile, inodeFile, dentryFile, applyIDFile} {
+		data, err := ioutil.ReadFile(path.Join(rootDir, name))
+		if err != nil {
+			t.Fatalf("read %v: %v", name, err)
+		}
+		checkGolden(t, path.Join("partition", name), data)
+	}
+	rangeGolden(t, "partition", func(release, dir string) {
+		loaded := NewMetaPartition(&MetaPartitionConfig{RootDir: dir}).(*metaPartition)
+		for name, load := range map[string]func() error{
+			metaFile:    loaded.loadMeta,
+			inodeFile:   loaded.loadInode,
+			dentryFile:  loaded.loadDentry,
+			applyIDFile: loaded.loadApplyID,
+		} {
+			if err := load(); err != nil {
+				t.Fatalf("release %v load %v: %v", release, name, err)
+			}
+		}
+		conf, want := loaded.config, compatConfig(dir)
+		if conf.PartitionId != want.PartitionId || conf.VolName != want.VolName || conf.Start != want.Start ||
+			conf.End != want.End || !reflect.DeepEqual(conf.Peers, want.Peers) {
+			t.Errorf("release %v meta:\nhave %+v\nwant %+v", release, conf, want)
+		}
+		checkCompatPartition(t, "release "+release, loaded, 42)
+	})
+}
+
+type compatSnapIterator struct {
+	frames [][]byte
+}
+
+func (it *compatSnapIterator) Next() (data []byte, err error) {
+	if len(it.frames) == 0 {
+		return nil, io.EOF
+	}
+	data = it.frames[0]
+	it.frames = it.frames[1:]
+	return
+}
+
+// The snapshot golden file keeps the items sent by the snapshot iterator, each
+// after its length in 4 bytes.
+func TestCompatSnapshot(t *testing.T) {
+	mp := newCompatPartition("")
+	iter := NewMetaItemIterator(mp.applyID, mp.inodeTree, mp.dentryTree)
+	buff := bytes.NewBuffer(nil)
+	for {
+		data, err := iter.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("snapshot next: %v", err)
+		}
+		binary.Write(buff, binary.BigEndian, uint32(len(data)))
+		buff.Write(data)
+	}
+	checkGolden(t, "snapshot.golden", buff.Bytes())
+	rangeGolden(t, "snapshot.golden", func(release, filename string) {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("release %v read snapshot: %v", release, err)
+		}
+		it := &compatSnapIterator{}
+		for len(data) >= 4 {
+			length := binary.BigEndian.Uint32(data)
+			if uint32(len(data)-4) < length {
+				t.Fatalf("release %v truncated snapshot", release)
+			}
+			it.frames = append(it.frames, data[4:4+length])
+			data = data[4+length:]
+		}
+		applied := NewMetaPartition(&MetaPartitionConfig{}).(*metaPartition)
+		if err = applied.ApplySnapshot(nil, it); err != nil {
+			t.Fatalf("release %v apply snapshot: %v", release, err)
+		}
+		checkCompatPartition(t, "release "+release+" snapshot", applied, 42)
+		if applied.config.Cursor != 4 {
+			t.Errorf("release %v snapshot cursor %v, want 4", release, applied.config.Cursor)
+		}
+	})
+}
+
+// The raft log golden file keeps a command submitted by Put in each line.
+func TestCompatRaftLog(t *testing.T) {
+	buff := bytes.NewBuffer(nil)
+	for _, ino := range compatInodes() {
+		val, err := ino.Marshal()
+		if err != nil {
+			t.Fatalf("marshal inode: %v", err)
+		}
+		cmd, _ := NewMetaItem(opCreateInode, nil, val).MarshalJson()
+		buff.Write(append(cmd, '\n'))
+	}
+	for _, dentry := range compatDentries() {
+		val, err := dentry.Marshal()
+		if err != nil {
+			t.Fatalf("marshal dentry: %v", err)
+		}
+		cmd, _ := NewMetaItem(opCreateDentry, nil, val).MarshalJson()
+		buff.Write(append(cmd, '\n'))
+	}
+	checkGolden(t, "raft_log.golden", buff.Bytes())
+	rangeGolden(t, "raft_log.golden", func(release, filename string) {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("release %v read raft log: %v", release, err)
+		}
+		applied := NewMetaPartition(&MetaPartitionConfig{}).(*metaPartition)
+		cmds := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+		for i, cmd := range cmds {
+			if _, err = applied.Apply(cmd, uint64(i+1)); err != nil {
+				t.Fatalf("release %v apply command %v: %v", release, i, err)
+			}
+		}
+		checkCompatPartition(t, "release "+release+" raft log", applied, uint64(len(cmds)))
+	})
+}
+
+var compatFSMOps = []struct {
+	name string
+	op   uint32
+}{
+	{"opCreateInode", opCreateInode},
+	{"opDeleteInode", opDeleteInode},
+	{"opCreateDentry", opCreateDentry},
+	{"opDeleteDentry", opDeleteDentry},
+	{"opOpen", opOpen},
+	{"opDeletePartition", opDeletePartition},
+	{"opUpdatePartition", opUpdatePartition},
+	{"opOfflinePartition", opOfflinePartition},
+	{"opExtentsAdd", opExtentsAdd},
+	{"opStoreTick", opStoreTick},
+	{"startStoreTick", startStoreTick},
+	{"stopStoreTick", stopStoreTick},
+	{"opUpdateDentry", opUpdateDentry},
+	{"opFSMExtentTruncate", opFSMExtentTruncate},
+	{"opFSMCreateLinkInode", opFSMCreateLinkInode},
+	{"opFSMEvictInode", opFSMEvictInode},
+	{"opFSMInternalDeleteInode", opFSMInternalDeleteInode},
+	{"opFSMSetAttr", opFSMSetAttr},
+}
+
+// The ops of the raft log and snapshot items are an iota, a new op must be
+// appended, an op inserted in the middle renumbers the log of the older releases.
+func TestCompatFSMOps(t *testing.T) {
+	ops := make(map[string]uint32)
+	buff := bytes.NewBuffer(nil)
+	for _, op := range compatFSMOps {
+		ops[op.name] = op.op
+		fmt.Fprintf(buff, "%v %d\n", op.name, op.op)
+	}
+	checkGolden(t, "fsm_ops.golden", buff.Bytes())
+	rangeGolden(t, "fsm_ops.golden", func(release, filename string) {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("release %v read fsm ops: %v", release, err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var (
+				name string
+				op   uint32
+			)
+			if _, err = fmt.Sscanf(line, "%s %d", &name, &op); err != nil {
+				t.Fatalf("release %v fsm ops line %q: %v", release, line, err)
+			}
+			if o, ok := ops[name]; ok && o != op {
+				t.Errorf("release %v %v is %v, now %v", release, name, op, o)
+			}
+		}
+	})
+}
@@ -17,6 +17,9 @@ package metanode
 import (
 	"github.com/juju/errors"
 	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -66,6 +69,8 @@ type (
 	LookupResp = proto.LookupResponse
 	// Client -> MetaNode open file request struct
 	OpenReq = proto.OpenRequest
+	// Client -> MetaNode release open file request struct
+	ReleaseOpenReq = proto.ReleaseOpenRequest
 	// Client -> MetaNode
 	InodeGetReq = proto.InodeGetRequest
 	// Client -> MetaNode
@@ -105,28 +110,105 @@ const (
 	opFSMEvictInode
 	opFSMInternalDeleteInode
 	opFSMSetAttr
+	opFSMSnapshotBatch
+	opFSMSetXAttr
+	opFSMRemoveXAttr
+	opFSMTxPrepare
+	opFSMTxCommit
+	opFSMTxAbort
+	opFSMTxSnapshot
+	opFSMExtentsReplace
+	opFSMTxUnlinked
+	opFSMDeleteDentryIno
 )
 
 var (
 	masterAddrs   []string
+	masterCfgs    []string // master addresses as configured, may be SRV records or DNS names
+	masterLock    sync.RWMutex
 	curMasterAddr string
 	UMPKey        string
+
+	lastMasterHeartbeat int64 // unix time of the last heartbeat of the master, accessed atomically
 )
 
 var (
-	ErrNonLeader = errors.New("non leader")
-	ErrNotLeader = errors.New("not leader")
+	ErrNonLeader    = errors.New("non leader")
+	ErrNotLeader    = errors.New("not leader")
+	ErrClientFenced = errors.New("client is evicted by master")
+	ErrVolReadOnly  = errors.New("vol is read only")
+
+	ErrTooManyOpenFiles = errors.New("too many open files of the client session")
+	ErrSnapshotBatch    = errors.New("truncated snapshot batch")
+	ErrLockConflict     = errors.New("conflicting lock of another owner")
+	ErrLockGrace        = errors.New("locks are restored after a leader change")
 )
 
+// the codes of the errors of the meta node, the messages are matched since
+// the errors of the raft and the partitions are annotated
+var errCodes = []struct {
+	err  error
+	code proto.ErrCode
+}{
+	{ErrNonLeader, proto.ErrCodeNotLeader},
+	{ErrNotLeader, proto.ErrCodeNotLeader},
+	{ErrClientFenced, proto.ErrCodeClientFenced},
+	{ErrTooManyOpenFiles, proto.ErrCodeTooManyOpen},
+	{ErrLockConflict, proto.ErrCodeExist},
+	{ErrLockGrace, proto.ErrCodeLockGrace},
+	{ErrInodeOutOfRange, proto.ErrCodeInodeOutOfRange},
+	{ErrIllegalHeartbeatAddress, proto.ErrCodeArgMismatch},
+	{ErrIllegalReplicateAddress, proto.ErrCodeArgMismatch},
+}
+
+/*the code of the error, ErrCodeInternal if it is none of the known errors*/
+func errCodeOf(err error) proto.ErrCode {
+	for _, e := range errCodes {
+		if strings.Contains(err.Error(), e.err.Error()) {
+			return e.code
+		}
+	}
+	return proto.ErrCodeInternal
+}
+
 // default config
 const (
 	defaultMetaDir = "metaDir"
 	defaultRaftDir = "raftDir"
+
+	defaultMaxOpenFilesPerSession = 100000
+	// sessions neither reported to master nor opening or releasing files for
+	// the timeout are dropped
+	openFilesSessionTimeout = 10 * time.Minute
+	// the extents of an unlinked inode still open are deleted after the timeout
+	openDeleteDeferTimeout = 24 * time.Hour
+	// the locks of a session not renewed for the lease are dropped, a new
+	// leader of a partition takes no new lock for the grace period
+	fileLockLeaseTimeout = 30 * time.Second
+	fileLockGracePeriod  = 15 * time.Second
+	// the changes of the inodes are not queued to the cache leases of a
+	// session not renewed for the timeout, the session is reset instead
+	cacheLeaseTimeout = 10 * time.Second
+	// the leader resolves the prepared parts of the rename transactions past
+	// their timeout once every interval, the primary keeps the decisions of
+	// its transactions for the retention
+	txResolveInterval   = 5 * time.Second
+	txDecisionRetention = 10 * time.Minute
+	maxTxTimeout        = time.Minute
+	// the leader of a partition reports the extents referenced by its inodes
+	// to the data partitions once every interval
+	defaultExtentReferenceInterval = time.Hour
+	// the snapshots sent by the node are paced to the bandwidth
+	defaultSnapshotBandwidth = 64 * util.MB
+	// the raft log entries kept below the stored apply id, a replica lagging
+	// less than them catches up from the log instead of a snapshot
+	defaultRaftLogRetain = 100000
 )
 
 const (
 	metaNodeURL     = "/metaNode/add"
 	metaNodeGetName = "/admin/getIp"
+	metaNodeTierURL = "/metaNode/tier"
 )
 
 // Configuration keys
@@ -137,6 +219,39 @@ const (
 	cfgMasterAddrs       = "masterAddrs"
 	cfgRaftHeartbeatPort = "raftHeartbeatPort"
 	cfgRaftReplicatePort = "raftReplicatePort"
+	cfgZone              = "zone"
+	cfgMemClass          = "memClass"
+
+	cfgMaxOpenFilesPerSession = "maxOpenFilesPerSession"
+	cfgMemoryBudget           = "memoryBudgetMB"
+	cfgMemoryBallast          = "memoryBallastMB"
+
+	cfgExtentReferenceInterval = "extentReferenceIntervalMinutes"
+
+	cfgSnapshotBandwidth = "snapshotBandwidthMB"
+	cfgSnapshotBatchSize = "snapshotBatchKB"
+	cfgRaftLogRetain     = "raftLogRetainEntries"
+
+	cfgGrpc = "grpc"
+
+	cfgAuditLog        = "auditLog"
+	cfgAuditLogMaxSize = "auditLogMaxSizeMB"
+	cfgAuditLogBackups = "auditLogBackups"
+	cfgAuditSink       = "auditSink"
+
+	cfgSlowOpMs      = "slowOpMs"      // int, negative disables the slow ops without a threshold of their own
+	cfgSlowOps       = "slowOps"       // array, "OP:MS" overriding the threshold of the op
+	cfgSlowOpWebhook = "slowOpWebhook" // string, URL the alerts of the slow ops are posted to
+
+	cfgMetaFormatVersion = "metaFormatVersion" // int, the format of the inodes the node writes, 2 allows the xattrs
+)
+
+const (
+	maxSlowOpArgs = 1024 // bytes of the args of a slow op logged
+)
+
+const (
+	masterHeartbeatTimeout = 3 * 60 // seconds without heartbeat the master counts the node down after
 )
 
 const (
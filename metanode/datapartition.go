@@ -30,10 +30,11 @@ type DataPartition struct {
 	ReplicaNum    uint8
 	PartitionType string
 	Hosts         []string
+	Epoch         uint64
 }
 
 func (dp *DataPartition) GetAllAddrs() (m string) {
-	return strings.Join(dp.Hosts[1:], proto.AddrSplit) + proto.AddrSplit
+	return string(proto.ArgWithEpoch(strings.Join(dp.Hosts[1:], proto.AddrSplit)+proto.AddrSplit, dp.Epoch))
 }
 
 type DataPartitionsView struct {
@@ -57,6 +58,16 @@ func (v *Vol) GetPartition(partitionID uint32) *DataPartition {
 	return v.dataPartitionView[partitionID]
 }
 
+func (v *Vol) GetPartitions() (partitions []*DataPartition) {
+	v.RLock()
+	defer v.RUnlock()
+	partitions = make([]*DataPartition, 0, len(v.dataPartitionView))
+	for _, dp := range v.dataPartitionView {
+		partitions = append(partitions, dp)
+	}
+	return
+}
+
 func (v *Vol) UpdatePartitions(partitions *DataPartitionsView) {
 	for _, dp := range partitions.DataPartitions {
 		v.replaceOrInsert(dp)
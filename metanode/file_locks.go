@@ -0,0 +1,268 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+// SessionFileLocks is the number of locks a client session holds on the
+// partitions led by this node.
+type SessionFileLocks struct {
+	SessionID string
+	Locks     int
+	Conflicts uint64
+	LastRenew int64
+}
+
+type heldLock struct {
+	sessionID string
+	proto.FileLock
+}
+
+// fileLocks keeps the advisory locks of the client sessions like openFiles,
+// in the memory of the partition leaders only. A session renews the lease of
+// its locks with all the locks it holds, its locks are dropped if it does not
+// renew them for the lease. A new leader takes no new lock for the grace
+// period, so that the sessions restore their locks first.
+type fileLocks struct {
+	inodes   map[openKey][]*heldLock
+	sessions map[string]*SessionFileLocks
+	grace    map[uint64]time.Time // the end of the grace period of a partition
+	sync.Mutex
+}
+
+func newFileLocks() *fileLocks {
+	return &fileLocks{
+		inodes:   make(map[openKey][]*heldLock),
+		sessions: make(map[string]*SessionFileLocks),
+		grace:    make(map[uint64]time.Time),
+	}
+}
+
+func (a *heldLock) conflicts(sessionID string, lock *proto.FileLock) bool {
+	return a.Flock == lock.Flock && !a.isOwner(sessionID, lock) && a.Start <= lock.End && lock.Start <= a.End &&
+		(a.Type == proto.LockWrite || lock.Type == proto.LockWrite)
+}
+
+func (a *heldLock) isOwner(sessionID string, lock *proto.FileLock) bool {
+	return a.sessionID == sessionID && a.Owner == lock.Owner
+}
+
+/*the session renewing its lease, the locks of an expired session are dropped first, the caller must hold the lock of fileLocks*/
+func (l *fileLocks) session(sessionID string) (s *SessionFileLocks) {
+	now := time.Now().Unix()
+	s, ok := l.sessions[sessionID]
+	if ok && l.isExpired(sessionID, now) {
+		l.removeLocks(func(_ openKey, h *heldLock) bool {
+			return h.sessionID == sessionID
+		})
+	}
+	if !ok {
+		s = &SessionFileLocks{SessionID: sessionID}
+		l.sessions[sessionID] = s
+	}
+	s.LastRenew = now
+	return
+}
+
+/*the caller must hold the lock of fileLocks*/
+func (l *fileLocks) removeLocks(match func(key openKey, h *heldLock) bool) {
+	for key, held := range l.inodes {
+		kept := held[:0]
+		for _, h := range held {
+			if !match(key, h) {
+				kept = append(kept, h)
+				continue
+			}
+			if s, ok := l.sessions[h.sessionID]; ok {
+				s.Locks--
+			}
+		}
+		if len(kept) == 0 {
+			delete(l.inodes, key)
+		} else {
+			l.inodes[key] = kept
+		}
+	}
+}
+
+/*the caller must hold the lock of fileLocks*/
+func (l *fileLocks) isExpired(sessionID string, now int64) bool {
+	s, ok := l.sessions[sessionID]
+	return !ok || now-s.LastRenew > int64(fileLockLeaseTimeout/time.Second)
+}
+
+/*the first lock of another owner conflicting with the lock, the caller must hold the lock of fileLocks*/
+func (l *fileLocks) conflict(key openKey, sessionID string, lock *proto.FileLock) *heldLock {
+	now := time.Now().Unix()
+	for _, h := range l.inodes[key] {
+		if h.conflicts(sessionID, lock) && !l.isExpired(h.sessionID, now) {
+			return h
+		}
+	}
+	return nil
+}
+
+/*remove the range of the lock from the locks of its owner, the caller must hold the lock of fileLocks*/
+func (l *fileLocks) unlock(key openKey, sessionID string, lock *proto.FileLock) {
+	locks := l.inodes[key]
+	kept := make([]*heldLock, 0, len(locks)+1)
+	for _, h := range locks {
+		if !h.isOwner(sessionID, lock) || h.Flock != lock.Flock || h.End < lock.Start || lock.End < h.Start {
+			kept = append(kept, h)
+			continue
+		}
+		// the parts of the held lock out of the range are kept
+		s := l.sessions[sessionID]
+		if h.Start < lock.Start {
+			left := *h
+			left.End = lock.Start - 1
+			kept = append(kept, &left)
+			s.Locks++
+		}
+		if lock.End < h.End {
+			right := *h
+			right.Start = lock.End + 1
+			kept = append(kept, &right)
+			s.Locks++
+		}
+		s.Locks--
+	}
+	if len(kept) == 0 {
+		delete(l.inodes, key)
+		return
+	}
+	l.inodes[key] = kept
+}
+
+/*the caller must hold the lock of fileLocks*/
+func (l *fileLocks) lock(key openKey, sessionID string, lock *proto.FileLock) (err error) {
+	s := l.session(sessionID)
+	if lock.Type != proto.LockUnlock {
+		if l.conflict(key, sessionID, lock) != nil {
+			s.Conflicts++
+			return ErrLockConflict
+		}
+	}
+	// a lock of the owner replaces its locks of the range, a POSIX lock is
+	// split into the parts before and after the range
+	l.unlock(key, sessionID, lock)
+	if lock.Type == proto.LockUnlock {
+		return
+	}
+	l.inodes[key] = append(l.inodes[key], &heldLock{sessionID: sessionID, FileLock: *lock})
+	s.Locks++
+	return
+}
+
+// set takes or releases a lock of the inode, a new lock is refused in the
+// grace period of the partition.
+func (l *fileLocks) set(sessionID string, partitionID, ino uint64, lock *proto.FileLock) (err error) {
+	l.Lock()
+	defer l.Unlock()
+	if lock.Type != proto.LockUnlock && time.Now().Before(l.grace[partitionID]) {
+		return ErrLockGrace
+	}
+	return l.lock(openKey{partitionID: partitionID, ino: ino}, sessionID, lock)
+}
+
+// get returns the lock of another owner conflicting with the lock.
+func (l *fileLocks) get(sessionID string, partitionID, ino uint64, lock *proto.FileLock) (conflict proto.FileLock) {
+	l.Lock()
+	defer l.Unlock()
+	conflict.Type = proto.LockUnlock
+	h := l.conflict(openKey{partitionID: partitionID, ino: ino}, sessionID, lock)
+	if h == nil {
+		return
+	}
+	conflict = h.FileLock
+	if h.sessionID != sessionID {
+		conflict.Pid = 0
+	}
+	return
+}
+
+// renew replaces the locks of the session on the partition with the locks
+// it holds, and returns the ones taken by another session meanwhile.
+func (l *fileLocks) renew(sessionID string, partitionID uint64, locks []proto.InodeLock) (lost []proto.InodeLock) {
+	l.Lock()
+	defer l.Unlock()
+	l.session(sessionID)
+	l.removeLocks(func(key openKey, h *heldLock) bool {
+		return key.partitionID == partitionID && h.sessionID == sessionID
+	})
+	for i := range locks {
+		key := openKey{partitionID: partitionID, ino: locks[i].Inode}
+		if err := l.lock(key, sessionID, &locks[i].Lock); err != nil {
+			lost = append(lost, locks[i])
+		}
+	}
+	return
+}
+
+// resetPartition drops the locks of the partition after a leader change,
+// the new leader starts a grace period.
+func (l *fileLocks) resetPartition(partitionID uint64, isLeader bool) {
+	l.Lock()
+	defer l.Unlock()
+	l.removeLocks(func(key openKey, _ *heldLock) bool {
+		return key.partitionID == partitionID
+	})
+	delete(l.grace, partitionID)
+	if isLeader {
+		l.grace[partitionID] = time.Now().Add(fileLockGracePeriod)
+	}
+}
+
+// expire drops the sessions not renewing their locks for the lease with
+// their locks, their clients are considered gone.
+func (l *fileLocks) expire() {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now().Unix()
+	l.removeLocks(func(_ openKey, h *heldLock) bool {
+		return l.isExpired(h.sessionID, now)
+	})
+	for id := range l.sessions {
+		if l.isExpired(id, now) {
+			delete(l.sessions, id)
+		}
+	}
+	for id, end := range l.grace {
+		if time.Now().After(end) {
+			delete(l.grace, id)
+		}
+	}
+}
+
+// stats returns the sessions sorted by locks, the most first.
+func (l *fileLocks) stats() (stats []*SessionFileLocks) {
+	l.Lock()
+	defer l.Unlock()
+	stats = make([]*SessionFileLocks, 0, len(l.sessions))
+	for _, s := range l.sessions {
+		stat := *s
+		stats = append(stats, &stat)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Locks > stats[j].Locks
+	})
+	return
+}
@@ -0,0 +1,95 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+func TestFileLocks(t *testing.T) {
+	l := newFileLocks()
+	posix := func(owner uint64, start, end uint64, typ uint8) *proto.FileLock {
+		return &proto.FileLock{Owner: owner, Pid: uint32(owner), Start: start, End: end, Type: typ}
+	}
+
+	if err := l.set("a", 1, 2, posix(1, 0, 99, proto.LockWrite)); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	if err := l.set("b", 1, 2, posix(1, 50, 60, proto.LockRead)); err != ErrLockConflict {
+		t.Fatalf("lock of a locked range: %v", err)
+	}
+	if err := l.set("b", 1, 3, posix(1, 50, 60, proto.LockRead)); err != nil {
+		t.Fatalf("lock of another inode: %v", err)
+	}
+	if err := l.set("a", 1, 2, &proto.FileLock{Owner: 2, Start: 0, End: math.MaxUint64, Type: proto.LockWrite, Flock: true}); err != nil {
+		t.Fatalf("flock beside posix lock: %v", err)
+	}
+
+	// unlocking the middle keeps the parts before and after it
+	if err := l.set("a", 1, 2, posix(1, 40, 59, proto.LockUnlock)); err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+	if conflict := l.get("b", 1, 2, posix(1, 40, 59, proto.LockWrite)); conflict.Type != proto.LockUnlock {
+		t.Fatalf("unlocked range held by %v", conflict)
+	}
+	conflict := l.get("b", 1, 2, posix(1, 60, 60, proto.LockRead))
+	if conflict.Type != proto.LockWrite || conflict.Start != 60 || conflict.End != 99 || conflict.Pid != 0 {
+		t.Fatalf("conflict of another session: %+v", conflict)
+	}
+	if s := l.sessions["a"]; s.Locks != 3 {
+		t.Fatalf("locks of session a: %v", s.Locks)
+	}
+
+	// the renew replaces the locks of the session, the ones taken meanwhile are lost
+	if err := l.set("b", 1, 2, posix(1, 40, 59, proto.LockWrite)); err != nil {
+		t.Fatalf("lock of unlocked range: %v", err)
+	}
+	lost := l.renew("a", 1, []proto.InodeLock{
+		{Inode: 2, Lock: *posix(1, 0, 49, proto.LockWrite)},
+		{Inode: 2, Lock: *posix(1, 60, 99, proto.LockWrite)},
+	})
+	if len(lost) != 1 || lost[0].Lock.Start != 0 {
+		t.Fatalf("lost locks: %+v", lost)
+	}
+	if s := l.sessions["a"]; s.Locks != 1 {
+		t.Fatalf("locks of session a after renew: %v", s.Locks)
+	}
+
+	// a new leader takes no new lock in the grace period
+	l.resetPartition(1, true)
+	if len(l.inodes) != 0 {
+		t.Fatalf("locks after the leader change: %v", l.inodes)
+	}
+	if err := l.set("a", 1, 2, posix(1, 0, 99, proto.LockWrite)); err != ErrLockGrace {
+		t.Fatalf("lock in grace period: %v", err)
+	}
+	if lost := l.renew("a", 1, []proto.InodeLock{{Inode: 2, Lock: *posix(1, 0, 99, proto.LockWrite)}}); len(lost) != 0 {
+		t.Fatalf("lost locks restored in grace period: %+v", lost)
+	}
+
+	// the locks of a session not renewing them are dropped
+	l.sessions["a"].LastRenew = time.Now().Add(-2 * fileLockLeaseTimeout).Unix()
+	if conflict := l.get("b", 1, 2, posix(1, 0, 99, proto.LockWrite)); conflict.Type != proto.LockUnlock {
+		t.Fatalf("lock of expired session: %v", conflict)
+	}
+	l.expire()
+	if _, ok := l.sessions["a"]; ok || len(l.inodes) != 0 {
+		t.Fatalf("expired session kept: %v %v", l.sessions, l.inodes)
+	}
+}
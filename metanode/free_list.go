@@ -51,6 +51,13 @@ func (i *freeList) Push(ino *Inode) {
 	i.list.PushBack(ino)
 }
 
+// Len returns the inodes in the list
+func (i *freeList) Len() int {
+	i.RLock()
+	defer i.RUnlock()
+	return i.list.Len()
+}
+
 // Only get the first item of list, don't delete item
 // if list is empty, return nil
 func (i *freeList) GetFront() (ino *Inode) {
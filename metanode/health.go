@@ -0,0 +1,71 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/tiglabs/containerfs/util/health"
+)
+
+func (m *MetaNode) registerHealth() {
+	health.Register("metanode", m.checkHealth, m.checkReady)
+}
+
+/*the node is alive from the start until it shuts down*/
+func (m *MetaNode) checkHealth() (checks []*health.Check) {
+	state := atomic.LoadUint32(&m.state)
+	checks = append(checks, health.NewCheck("state", state == StateStart || state == StateRunning, "%v", stateName(state)))
+	return
+}
+
+/*the node is ready once it registered to the master and loaded its partitions*/
+func (m *MetaNode) checkReady() (checks []*health.Check) {
+	state := atomic.LoadUint32(&m.state)
+	checks = append(checks, health.NewCheck("state", state == StateRunning, "%v", stateName(state)))
+	checks = append(checks, health.NewCheck("register", m.nodeId != 0, "nodeID[%v] master[%v]", m.nodeId, curMasterAddr))
+	checks = append(checks, health.NewCheck("raft", m.raftStore != nil, "dir[%v]", m.raftDir))
+	total, loaded := atomic.LoadInt64(&m.progress.Total), atomic.LoadInt64(&m.progress.Loaded)
+	checks = append(checks, health.NewCheck("partitions", state == StateRunning && loaded == total,
+		"%v of %v loaded", loaded, total))
+	checks = append(checks, checkMasterHeartbeat(atomic.LoadInt64(&lastMasterHeartbeat)))
+	return
+}
+
+/*the master sends the heartbeats only to the nodes it knows, a node missing them is known down*/
+func checkMasterHeartbeat(last int64) *health.Check {
+	if last == 0 {
+		return health.NewWarnCheck("masterHeartbeat", false, "no heartbeat")
+	}
+	elapsed := time.Now().Unix() - last
+	return health.NewWarnCheck("masterHeartbeat", elapsed < masterHeartbeatTimeout, "last heartbeat %vs ago", elapsed)
+}
+
+func stateName(state uint32) string {
+	switch state {
+	case StateStandby:
+		return "standby"
+	case StateStart:
+		return "starting"
+	case StateRunning:
+		return "running"
+	case StateShutdown:
+		return "shutting down"
+	case StateStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
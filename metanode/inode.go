@@ -38,6 +38,14 @@ import (
 //  +-------+------+------+-----+----+----+----+--------+------------------+
 //  | bytes |  4   |  8   |  8  | 8  | 8  | 8  |   4    |      ExtLen      |
 //  +-------+------+------+-----+----+----+----+--------+------------------+
+// The xattrs are written before the extents, only if there are some, and the
+// xattrFlag bit of the MarkDelete byte tells they follow:
+//  +-------+-------+--------+--------+--------+--------+
+//  | item  | Count | KeyLen |  Key   | ValLen | Value  |
+//  +-------+-------+--------+--------+--------+--------+
+//  | bytes |   4   |   4    | KeyLen |   4    | ValLen |
+//  +-------+-------+--------+--------+--------+--------+
+// with KeyLen, Key, ValLen and Value repeated Count times.
 // Marshal entity:
 //  +-------+-----------+--------------+-----------+--------------+
 //  | item  | KeyLength | MarshaledKey | ValLength | MarshaledVal |
@@ -58,8 +66,22 @@ type Inode struct {
 	NLink      uint32 // NodeLink counts
 	MarkDelete uint8  // 0: false; 1: true
 	Extents    *proto.StreamKey
+	// nil if the inode has no xattrs, the map is replaced and never modified in place
+	XAttrs map[string][]byte
 }
 
+// the bit of the marshaled MarkDelete telling the xattrs follow, an inode
+// without xattrs is marshaled as by the releases before them
+const xattrFlag uint8 = 0x80
+
+// The versions of the format of the inodes. The xattrs are set only by the
+// nodes configured with metaFormatXAttrs, until then the inodes are loaded by
+// the releases before the xattrs and the nodes can be downgraded.
+const (
+	metaFormatBase   = 1
+	metaFormatXAttrs = 2
+)
+
 func (i *Inode) String() string {
 	buff := bytes.NewBuffer(make([]byte, 0))
 	buff.WriteString("Inode{")
@@ -75,6 +97,7 @@ func (i *Inode) String() string {
 	buff.WriteString(fmt.Sprintf("LinkT[%s]", i.LinkTarget))
 	buff.WriteString(fmt.Sprintf("NLink[%d]", i.NLink))
 	buff.WriteString(fmt.Sprintf("MD[%d]", i.MarkDelete))
+	buff.WriteString(fmt.Sprintf("XAttrs[%d]", len(i.XAttrs)))
 	buff.WriteString(fmt.Sprintf("Extents[%s]", i.Extents))
 	buff.WriteString("}")
 	return buff.String()
@@ -211,9 +234,16 @@ func (i *Inode) MarshalValue() (val []byte) {
 	if err = binary.Write(buff, binary.BigEndian, &i.NLink); err != nil {
 		panic(err)
 	}
-	if err = binary.Write(buff, binary.BigEndian, &i.MarkDelete); err != nil {
+	markDelete := i.MarkDelete
+	if len(i.XAttrs) != 0 {
+		markDelete |= xattrFlag
+	}
+	if err = binary.Write(buff, binary.BigEndian, &markDelete); err != nil {
 		panic(err)
 	}
+	if len(i.XAttrs) != 0 {
+		i.marshalXAttrs(buff)
+	}
 	if i.Extents.Size() != 0 {
 		// Marshal ExtentsKey
 		extData, err := i.Extents.MarshalBinary()
@@ -274,6 +304,12 @@ func (i *Inode) UnmarshalValue(val []byte) (err error) {
 	if err = binary.Read(buff, binary.BigEndian, &i.MarkDelete); err != nil {
 		return
 	}
+	if i.MarkDelete&xattrFlag != 0 {
+		i.MarkDelete &^= xattrFlag
+		if err = i.unmarshalXAttrs(buff); err != nil {
+			return
+		}
+	}
 	if i.Extents == nil {
 		i.Extents = proto.NewStreamKey(i.Inode)
 	} else {
@@ -289,6 +325,57 @@ func (i *Inode) UnmarshalValue(val []byte) (err error) {
 	return
 }
 
+func (i *Inode) marshalXAttrs(buff *bytes.Buffer) {
+	var err error
+	count := uint32(len(i.XAttrs))
+	if err = binary.Write(buff, binary.BigEndian, &count); err != nil {
+		panic(err)
+	}
+	for key, val := range i.XAttrs {
+		keyLen := uint32(len(key))
+		if err = binary.Write(buff, binary.BigEndian, &keyLen); err != nil {
+			panic(err)
+		}
+		if _, err = buff.WriteString(key); err != nil {
+			panic(err)
+		}
+		valLen := uint32(len(val))
+		if err = binary.Write(buff, binary.BigEndian, &valLen); err != nil {
+			panic(err)
+		}
+		if _, err = buff.Write(val); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func (i *Inode) unmarshalXAttrs(buff *bytes.Buffer) (err error) {
+	var count uint32
+	if err = binary.Read(buff, binary.BigEndian, &count); err != nil {
+		return
+	}
+	i.XAttrs = make(map[string][]byte, count)
+	for n := uint32(0); n < count; n++ {
+		var keyLen, valLen uint32
+		if err = binary.Read(buff, binary.BigEndian, &keyLen); err != nil {
+			return
+		}
+		key := make([]byte, keyLen)
+		if _, err = io.ReadFull(buff, key); err != nil {
+			return
+		}
+		if err = binary.Read(buff, binary.BigEndian, &valLen); err != nil {
+			return
+		}
+		val := make([]byte, valLen)
+		if _, err = io.ReadFull(buff, val); err != nil {
+			return
+		}
+		i.XAttrs[string(key)] = val
+	}
+	return
+}
+
 func (i *Inode) AppendExtents(ext proto.ExtentKey) {
 	i.Extents.Put(ext)
 	i.Size = i.Extents.Size()
@@ -72,6 +72,39 @@ func Test_Inode(t *testing.T) {
 	}
 }
 
+func Test_InodeXAttrs(t *testing.T) {
+	ino := NewInode(1, 0)
+	ino.Extents.Put(proto.ExtentKey{
+		PartitionId: 1000,
+		ExtentId:    1222,
+		Size:        10234,
+	})
+	ino.MarkDelete = 1
+	ino.XAttrs = map[string][]byte{
+		"user.empty":       {},
+		"security.selinux": []byte("system_u:object_r:container_file_t:s0"),
+	}
+	data, err := ino.Marshal()
+	if err != nil {
+		t.Fatalf("inode marshal fail: %v", err)
+	}
+	inoTmp := NewInode(0, 0)
+	if err = inoTmp.Unmarshal(data); err != nil {
+		t.Fatalf("inode unmarshal fail: %v.", err)
+	}
+	if !reflect.DeepEqual(inoTmp, ino) {
+		t.Fatalf("inode with xattrs: have %v %v, want %v %v", inoTmp, inoTmp.XAttrs, ino, ino.XAttrs)
+	}
+
+	// an inode without xattrs is marshaled without the xattr flag
+	ino.XAttrs = nil
+	data, _ = ino.Marshal()
+	inoTmp = NewInode(0, 0)
+	if err = inoTmp.Unmarshal(data); err != nil || !reflect.DeepEqual(inoTmp, ino) {
+		t.Fatalf("inode without xattrs: have %v, want %v, err %v", inoTmp, ino, err)
+	}
+}
+
 func TestDentryBtree(t *testing.T) {
 	dTree := btree.New(32)
 	dentry := &Dentry{
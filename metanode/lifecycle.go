@@ -0,0 +1,399 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/sdk/meta"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	lifecycleCheckInterval = time.Minute
+	lifecyclePassInterval  = time.Hour //least time between the starts of two passes of a rule
+	lifecycleScanPages     = 10        //pages of dentries a rule reads in each check
+	lifecycleBatchDentries = 1000
+)
+
+// lifecycleClient is the client of a vol the rules are walked with, the
+// requests are sent on the connections of the node, authenticated as internal.
+type lifecycleClient interface {
+	Lookup_ll(parentID uint64, name string) (inode uint64, mode uint32, err error)
+	ReadDirLimit_ll(parentID uint64, marker string, limit uint64) ([]proto.Dentry, string, error)
+	BatchInodeGet(inodes []uint64) []*proto.InodeInfo
+	DeleteIf_ll(parentID uint64, name string, ino uint64) (*proto.InodeInfo, error)
+	GetExtents(inode uint64) ([]proto.ExtentKey, error)
+	Close()
+}
+
+// the walk of a rule is resumed from the dir and the marker it stopped at by the
+// next check, so a pass over a large dir is spread over many checks
+type lifecycleScan struct {
+	rule    proto.LifecycleRule
+	pending []uint64 //dirs not read yet
+	parent  uint64   //dir being read, 0 if the next one is taken from pending
+	marker  string
+	current *proto.LifecyclePass
+	last    *proto.LifecyclePass
+}
+
+// lifecycleScanner walks the dirs of the lifecycle rules pushed by the master
+// heartbeats, for the vols whose root inode is in a partition the node leads,
+// and reports the passes in the heartbeat responses. The scans are walked by
+// a single goroutine, the lock guards only the rules, the scans map and the
+// passes, so the reports never wait on the requests of the walk. The passes
+// are kept in memory and start over after the leader of the root changed.
+type lifecycleScanner struct {
+	rules     map[string][]*proto.LifecycleRule
+	scans     map[string]map[string]*lifecycleScan //scans of the vols by rule id
+	clients   map[string]lifecycleClient           //used by the walk only
+	walks     func(volName string) bool
+	newClient func(volName string) (lifecycleClient, error)
+	tier      func(req *proto.LifecycleTierRequest) error
+	stopC     chan struct{}
+	sync.Mutex
+}
+
+func newLifecycleScanner(walks func(volName string) bool) *lifecycleScanner {
+	return &lifecycleScanner{
+		rules:     make(map[string][]*proto.LifecycleRule),
+		scans:     make(map[string]map[string]*lifecycleScan),
+		clients:   make(map[string]lifecycleClient),
+		walks:     walks,
+		newClient: newLifecycleClient,
+		tier:      tierLifecycleExtents,
+		stopC:     make(chan struct{}),
+	}
+}
+
+func newLifecycleClient(volName string) (lifecycleClient, error) {
+	mw, err := meta.NewMetaWrapper(volName, strings.Join(getMasterAddrs(), meta.HostsSeparator))
+	if err != nil {
+		return nil, err
+	}
+	// the walk works for the vol, its requests are made for root
+	mw.SetCaller(0, 0)
+	return mw, nil
+}
+
+/*the master sends the extents to the replicas of their partitions*/
+func tierLifecycleExtents(req *proto.LifecycleTierRequest) (err error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+	_, err = postToMaster("POST", metaNodeTierURL, data)
+	return
+}
+
+// walksLifecycle is true if the node leads the partition of the root inode
+// of the vol, the rules of a vol are walked by a single node.
+func (m *metaManager) walksLifecycle(volName string) (walks bool) {
+	m.Range(func(id uint64, partition MetaPartition) bool {
+		conf := partition.GetBaseConfig()
+		if conf.VolName != volName || conf.Start > proto.RootIno || conf.End < proto.RootIno {
+			return true
+		}
+		_, walks = partition.IsLeader()
+		return false
+	})
+	return
+}
+
+func (ls *lifecycleScanner) update(rules map[string][]*proto.LifecycleRule) {
+	if rules == nil {
+		rules = make(map[string][]*proto.LifecycleRule)
+	}
+	ls.Lock()
+	ls.rules = rules
+	ls.Unlock()
+}
+
+/*the passes of the rules of the vols the node walks*/
+func (ls *lifecycleScanner) reports() (reports []*proto.LifecycleReport) {
+	ls.Lock()
+	defer ls.Unlock()
+	for name, scans := range ls.scans {
+		for _, scan := range scans {
+			reports = append(reports, &proto.LifecycleReport{VolName: name, Rule: scan.rule,
+				Current: copyLifecyclePass(scan.current), Last: copyLifecyclePass(scan.last)})
+		}
+	}
+	return
+}
+
+func copyLifecyclePass(pass *proto.LifecyclePass) *proto.LifecyclePass {
+	if pass == nil {
+		return nil
+	}
+	p := *pass
+	return &p
+}
+
+func (ls *lifecycleScanner) start() {
+	go func() {
+		ticker := time.NewTicker(lifecycleCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ls.stopC:
+				for name, client := range ls.clients {
+					client.Close()
+					delete(ls.clients, name)
+				}
+				return
+			case <-ticker.C:
+				ls.check()
+			}
+		}
+	}()
+}
+
+func (ls *lifecycleScanner) stop() {
+	close(ls.stopC)
+}
+
+func (ls *lifecycleScanner) check() {
+	ls.Lock()
+	rules := ls.rules
+	ls.Unlock()
+	walked := make(map[string]bool)
+	for name, volRules := range rules {
+		if len(volRules) != 0 && ls.walks(name) {
+			walked[name] = true
+		}
+	}
+	for name, client := range ls.clients {
+		if !walked[name] {
+			client.Close()
+			delete(ls.clients, name)
+		}
+	}
+	for name, scans := range ls.syncScans(rules, walked) {
+		client, err := ls.getClient(name)
+		if err != nil {
+			log.LogWarnf("action[lifecycleCheck] vol[%v]: %v", name, err)
+			continue
+		}
+		for _, scan := range scans {
+			ls.advance(client, name, scan)
+		}
+	}
+}
+
+/*keep the scans of the rules of the walked vols, the pass of a changed rule starts over*/
+func (ls *lifecycleScanner) syncScans(rules map[string][]*proto.LifecycleRule, walked map[string]bool) (active map[string][]*lifecycleScan) {
+	ls.Lock()
+	defer ls.Unlock()
+	active = make(map[string][]*lifecycleScan)
+	all := make(map[string]map[string]*lifecycleScan)
+	for name := range walked {
+		scans := make(map[string]*lifecycleScan)
+		for _, rule := range rules[name] {
+			scan := ls.scans[name][rule.ID]
+			if scan == nil || scan.rule != *rule {
+				scan = &lifecycleScan{rule: *rule}
+			}
+			scans[rule.ID] = scan
+			active[name] = append(active[name], scan)
+		}
+		all[name] = scans
+	}
+	ls.scans = all
+	return
+}
+
+func (ls *lifecycleScanner) getClient(volName string) (client lifecycleClient, err error) {
+	if client = ls.clients[volName]; client != nil {
+		return
+	}
+	if client, err = ls.newClient(volName); err != nil {
+		return
+	}
+	ls.clients[volName] = client
+	return
+}
+
+/*walk the next pages of the pass of the rule, a new pass starts lifecyclePassInterval after the start of the last one*/
+func (ls *lifecycleScanner) advance(client lifecycleClient, volName string, scan *lifecycleScan) {
+	now := time.Now()
+	if scan.current == nil {
+		if scan.last != nil && now.Sub(time.Unix(scan.last.Start, 0)) < lifecyclePassInterval {
+			return
+		}
+		root, err := lookupLifecycleDir(client, scan.rule.Prefix)
+		if err != nil && err != syscall.ENOENT && err != syscall.ENOTDIR {
+			log.LogWarnf("action[lifecycleAdvance] vol[%v] rule[%v] lookup %v: %v", volName, scan.rule.ID, scan.rule.Prefix, err)
+			return
+		}
+		scan.pending = make([]uint64, 0)
+		if err == nil {
+			scan.pending = append(scan.pending, root)
+		}
+		ls.Lock()
+		scan.current = &proto.LifecyclePass{Start: now.Unix()}
+		ls.Unlock()
+	}
+	expire := now.AddDate(0, 0, -scan.rule.Days)
+	for pages := 0; pages < lifecycleScanPages; {
+		if scan.parent == 0 {
+			if len(scan.pending) == 0 {
+				ls.finish(volName, scan)
+				return
+			}
+			scan.parent = scan.pending[len(scan.pending)-1]
+			scan.pending = scan.pending[:len(scan.pending)-1]
+			scan.marker = ""
+		}
+		children, next, err := client.ReadDirLimit_ll(scan.parent, scan.marker, lifecycleBatchDentries)
+		if err == syscall.ENOENT {
+			// removed during the walk
+			scan.parent = 0
+			continue
+		} else if err != nil {
+			// the page is read again by the next check
+			log.LogWarnf("action[lifecycleAdvance] vol[%v] rule[%v] read dir %v: %v", volName, scan.rule.ID, scan.parent, err)
+			return
+		}
+		pages++
+		files := make([]proto.Dentry, 0, len(children))
+		for _, child := range children {
+			if proto.IsDir(child.Type) {
+				scan.pending = append(scan.pending, child.Inode)
+			} else if proto.IsRegular(child.Type) {
+				files = append(files, child)
+			}
+		}
+		ls.expireFiles(client, volName, scan, files, expire)
+		if scan.marker = next; next == "" {
+			scan.parent = 0
+		}
+	}
+}
+
+func (ls *lifecycleScanner) finish(volName string, scan *lifecycleScan) {
+	ls.Lock()
+	pass := scan.current
+	pass.End = time.Now().Unix()
+	scan.last = pass
+	scan.current = nil
+	ls.Unlock()
+	log.LogWarnf("action[lifecycleAdvance] vol[%v] rule[%v] %v files under %v not modified for %v days: scanned[%v] expired[%v] failed[%v] cost[%vs]",
+		volName, scan.rule.ID, scan.rule.Action, scan.rule.Prefix, scan.rule.Days, pass.Scanned, pass.Expired, pass.Failed, pass.End-pass.Start)
+}
+
+func (ls *lifecycleScanner) count(scan *lifecycleScan, scanned, expired, failed uint64) {
+	ls.Lock()
+	defer ls.Unlock()
+	scan.current.Scanned += scanned
+	scan.current.Expired += expired
+	scan.current.Failed += failed
+}
+
+/*the inode of the dir at the path of the vol, the path is clean and absolute*/
+func lookupLifecycleDir(client lifecycleClient, dir string) (ino uint64, err error) {
+	var mode uint32
+	ino = proto.RootIno
+	for _, name := range strings.Split(dir, "/") {
+		if name == "" {
+			continue
+		}
+		if ino, mode, err = client.Lookup_ll(ino, name); err != nil {
+			return
+		}
+		if !proto.IsDir(mode) {
+			return 0, syscall.ENOTDIR
+		}
+	}
+	return
+}
+
+// expireFiles applies the action of the rule to the files of the page of
+// scan.parent not modified since expire. A file is deleted only if its name is
+// still of the inode checked, the inodes unlinked are left to the clients
+// holding them open and to the orphan listing.
+func (ls *lifecycleScanner) expireFiles(client lifecycleClient, volName string, scan *lifecycleScan, files []proto.Dentry, expire time.Time) {
+	if len(files) == 0 {
+		return
+	}
+	inodes := make([]uint64, 0, len(files))
+	for _, file := range files {
+		inodes = append(inodes, file.Inode)
+	}
+	expiredInodes := make(map[uint64]bool)
+	for _, info := range client.BatchInodeGet(inodes) {
+		if info.ModifyTime.Before(expire) {
+			expiredInodes[info.Inode] = true
+		}
+	}
+	var expired, failed uint64
+	switch scan.rule.Action {
+	case proto.LifecycleDelete:
+		for _, file := range files {
+			if !expiredInodes[file.Inode] {
+				continue
+			}
+			if _, err := client.DeleteIf_ll(scan.parent, file.Name, file.Inode); err == syscall.ENOENT {
+				// removed, or renamed over by another file since the page was read
+				continue
+			} else if err != nil {
+				failed++
+				log.LogWarnf("action[lifecycleExpire] vol[%v] rule[%v] delete %v of dir %v: %v", volName, scan.rule.ID, file.Name, scan.parent, err)
+				continue
+			}
+			expired++
+		}
+	case proto.LifecycleColdTier:
+		extents := make(map[uint64]map[uint64]bool)
+		for ino := range expiredInodes {
+			eks, err := client.GetExtents(ino)
+			if err == syscall.ENOENT {
+				continue
+			} else if err != nil {
+				failed++
+				log.LogWarnf("action[lifecycleExpire] vol[%v] rule[%v] get extents of inode %v: %v", volName, scan.rule.ID, ino, err)
+				continue
+			}
+			for _, ek := range eks {
+				partitionID := uint64(ek.PartitionId)
+				if extents[partitionID] == nil {
+					extents[partitionID] = make(map[uint64]bool)
+				}
+				extents[partitionID][ek.ExtentId] = true
+			}
+			expired++
+		}
+		if len(extents) != 0 {
+			req := &proto.LifecycleTierRequest{VolName: volName, Extents: make(map[uint64][]uint64, len(extents))}
+			for partitionID, ids := range extents {
+				for id := range ids {
+					req.Extents[partitionID] = append(req.Extents[partitionID], id)
+				}
+			}
+			if err := ls.tier(req); err != nil {
+				log.LogWarnf("action[lifecycleExpire] vol[%v] rule[%v] tier the extents of %v partitions: %v", volName, scan.rule.ID, len(extents), err)
+				failed += expired
+				expired = 0
+			}
+		}
+	}
+	ls.count(scan, uint64(len(files)), expired, failed)
+}
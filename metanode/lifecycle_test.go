@@ -0,0 +1,247 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+var (
+	testDirMode  = uint32(os.ModeDir | 0755)
+	testFileMode = uint32(0644)
+)
+
+// testLifecycleClient is a namespace in memory, onRead is called with the dir
+// of each page read once the page is taken
+type testLifecycleClient struct {
+	dentries map[uint64]map[string]proto.Dentry
+	infos    map[uint64]*proto.InodeInfo
+	extents  map[uint64][]proto.ExtentKey
+	onRead   func(parentID uint64)
+	closed   bool
+}
+
+func newTestLifecycleClient() *testLifecycleClient {
+	c := &testLifecycleClient{
+		dentries: make(map[uint64]map[string]proto.Dentry),
+		infos:    make(map[uint64]*proto.InodeInfo),
+		extents:  make(map[uint64][]proto.ExtentKey),
+	}
+	c.infos[proto.RootIno] = &proto.InodeInfo{Inode: proto.RootIno, Mode: testDirMode, Nlink: 2}
+	return c
+}
+
+func (c *testLifecycleClient) add(parentID uint64, name string, ino uint64, mode uint32, mtime time.Time) {
+	if c.dentries[parentID] == nil {
+		c.dentries[parentID] = make(map[string]proto.Dentry)
+	}
+	c.dentries[parentID][name] = proto.Dentry{Name: name, Inode: ino, Type: mode}
+	c.infos[ino] = &proto.InodeInfo{Inode: ino, Mode: mode, Nlink: 1, ModifyTime: mtime}
+}
+
+func (c *testLifecycleClient) Lookup_ll(parentID uint64, name string) (uint64, uint32, error) {
+	d, ok := c.dentries[parentID][name]
+	if !ok {
+		return 0, 0, syscall.ENOENT
+	}
+	return d.Inode, d.Type, nil
+}
+
+func (c *testLifecycleClient) ReadDirLimit_ll(parentID uint64, marker string, limit uint64) ([]proto.Dentry, string, error) {
+	if c.infos[parentID] == nil {
+		return nil, "", syscall.ENOENT
+	}
+	names := make([]string, 0)
+	for name := range c.dentries[parentID] {
+		if name >= marker {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	next := ""
+	if uint64(len(names)) > limit {
+		names, next = names[:limit], names[limit]
+	}
+	children := make([]proto.Dentry, 0, len(names))
+	for _, name := range names {
+		children = append(children, c.dentries[parentID][name])
+	}
+	if c.onRead != nil {
+		c.onRead(parentID)
+	}
+	return children, next, nil
+}
+
+func (c *testLifecycleClient) BatchInodeGet(inodes []uint64) []*proto.InodeInfo {
+	infos := make([]*proto.InodeInfo, 0, len(inodes))
+	for _, ino := range inodes {
+		if info := c.infos[ino]; info != nil {
+			i := *info
+			infos = append(infos, &i)
+		}
+	}
+	return infos
+}
+
+func (c *testLifecycleClient) DeleteIf_ll(parentID uint64, name string, ino uint64) (*proto.InodeInfo, error) {
+	d, ok := c.dentries[parentID][name]
+	if !ok || d.Inode != ino {
+		return nil, syscall.ENOENT
+	}
+	delete(c.dentries[parentID], name)
+	info := c.infos[ino]
+	info.Nlink--
+	return info, nil
+}
+
+func (c *testLifecycleClient) GetExtents(inode uint64) ([]proto.ExtentKey, error) {
+	if c.infos[inode] == nil {
+		return nil, syscall.ENOENT
+	}
+	return c.extents[inode], nil
+}
+
+func (c *testLifecycleClient) Close() {
+	c.closed = true
+}
+
+func newTestLifecycleScanner(client *testLifecycleClient, walks *bool) (ls *lifecycleScanner, tiered *[]*proto.LifecycleTierRequest) {
+	tiered = new([]*proto.LifecycleTierRequest)
+	ls = newLifecycleScanner(func(volName string) bool { return *walks })
+	ls.newClient = func(volName string) (lifecycleClient, error) {
+		client.closed = false
+		return client, nil
+	}
+	ls.tier = func(req *proto.LifecycleTierRequest) error {
+		*tiered = append(*tiered, req)
+		return nil
+	}
+	return
+}
+
+func TestLifecycleScanner_Delete(t *testing.T) {
+	old, now := time.Now().AddDate(0, 0, -40), time.Now()
+	client := newTestLifecycleClient()
+	client.add(proto.RootIno, "logs", 2, testDirMode, now)
+	client.add(proto.RootIno, "keep", 20, testFileMode, old)
+	client.add(2, "a", 10, testFileMode, old)
+	client.add(2, "b", 11, testFileMode, now.AddDate(0, 0, -10))
+	client.add(2, "c", 12, testFileMode, old)
+	client.add(2, "sub", 3, testDirMode, now)
+	client.add(3, "d", 13, testFileMode, old)
+	// b, not expired, is renamed over c once the page of the dir is read
+	client.onRead = func(parentID uint64) {
+		if parentID == 2 && client.dentries[2]["b"].Inode == 11 {
+			client.dentries[2]["c"] = proto.Dentry{Name: "c", Inode: 11, Type: testFileMode}
+			delete(client.dentries[2], "b")
+		}
+	}
+	walks := true
+	ls, _ := newTestLifecycleScanner(client, &walks)
+	rule := &proto.LifecycleRule{ID: "logs", Prefix: "/logs", Days: 30, Action: proto.LifecycleDelete}
+	ls.update(map[string][]*proto.LifecycleRule{"ltptest": {rule}})
+	ls.check()
+
+	if _, ok := client.dentries[2]["a"]; ok {
+		t.Fatalf("expired file a not deleted")
+	}
+	if _, ok := client.dentries[3]["d"]; ok {
+		t.Fatalf("expired file d of the subdir not deleted")
+	}
+	if d, ok := client.dentries[2]["c"]; !ok || d.Inode != 11 {
+		t.Fatalf("file renamed over an expired one deleted: %v %v", d, ok)
+	}
+	if _, ok := client.dentries[proto.RootIno]["keep"]; !ok {
+		t.Fatalf("file out of the prefix deleted")
+	}
+	// the inodes unlinked are not evicted by the walk
+	if info := client.infos[10]; info == nil || info.Nlink != 0 {
+		t.Fatalf("inode of a deleted file %v", info)
+	}
+	reports := ls.reports()
+	if len(reports) != 1 || reports[0].VolName != "ltptest" || reports[0].Rule != *rule || reports[0].Current != nil {
+		t.Fatalf("reports %v", reports)
+	}
+	if last := reports[0].Last; last == nil || last.End == 0 || last.Scanned != 4 || last.Expired != 2 || last.Failed != 0 {
+		t.Fatalf("last pass %+v", last)
+	}
+
+	// no new pass within the interval, a changed rule starts over
+	ls.check()
+	if last := ls.reports()[0].Last; last == nil || last.Scanned != 4 {
+		t.Fatalf("last pass after a check %+v", last)
+	}
+	rule = &proto.LifecycleRule{ID: "logs", Prefix: "/logs", Days: 1, Action: proto.LifecycleDelete}
+	ls.update(map[string][]*proto.LifecycleRule{"ltptest": {rule}})
+	ls.check()
+	if _, ok := client.dentries[2]["c"]; ok {
+		t.Fatalf("file expired by the changed rule not deleted")
+	}
+
+	// the vol is no more walked by the node
+	walks = false
+	ls.check()
+	if reports = ls.reports(); len(reports) != 0 || !client.closed {
+		t.Fatalf("reports %v of a vol not walked, client closed(%v)", reports, client.closed)
+	}
+}
+
+func TestLifecycleScanner_ColdTier(t *testing.T) {
+	old, now := time.Now().AddDate(0, 0, -40), time.Now()
+	client := newTestLifecycleClient()
+	client.add(proto.RootIno, "a", 10, testFileMode, old)
+	client.add(proto.RootIno, "b", 11, testFileMode, now)
+	client.extents[10] = []proto.ExtentKey{{PartitionId: 5, ExtentId: 1}, {PartitionId: 5, ExtentId: 2}, {PartitionId: 6, ExtentId: 3}}
+	client.extents[11] = []proto.ExtentKey{{PartitionId: 5, ExtentId: 4}}
+	walks := true
+	ls, tiered := newTestLifecycleScanner(client, &walks)
+	rule := &proto.LifecycleRule{ID: "cold", Prefix: "/", Days: 30, Action: proto.LifecycleColdTier}
+	ls.update(map[string][]*proto.LifecycleRule{"ltptest": {rule}})
+	ls.check()
+
+	if len(*tiered) != 1 {
+		t.Fatalf("%v tier requests", len(*tiered))
+	}
+	req := (*tiered)[0]
+	for _, ids := range req.Extents {
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	}
+	if req.VolName != "ltptest" || len(req.Extents) != 2 || len(req.Extents[5]) != 2 || req.Extents[5][1] != 2 ||
+		len(req.Extents[6]) != 1 || req.Extents[6][0] != 3 {
+		t.Fatalf("tier request %+v", req)
+	}
+	if _, ok := client.dentries[proto.RootIno]["a"]; !ok {
+		t.Fatalf("file of a tiered rule deleted")
+	}
+	if last := ls.reports()[0].Last; last == nil || last.Scanned != 2 || last.Expired != 1 {
+		t.Fatalf("last pass %+v", last)
+	}
+
+	// the files of a tier request failed are counted failed
+	ls.tier = func(req *proto.LifecycleTierRequest) error { return errors.New("no master") }
+	rule = &proto.LifecycleRule{ID: "cold", Prefix: "/", Days: 20, Action: proto.LifecycleColdTier}
+	ls.update(map[string][]*proto.LifecycleRule{"ltptest": {rule}})
+	ls.check()
+	if last := ls.reports()[0].Last; last == nil || last.Expired != 0 || last.Failed != 1 {
+		t.Fatalf("last pass of a failed tier %+v", last)
+	}
+}
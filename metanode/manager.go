@@ -26,12 +26,18 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/juju/errors"
 	"github.com/tiglabs/containerfs/proto"
 	"github.com/tiglabs/containerfs/raftstore"
+	"github.com/tiglabs/containerfs/util"
+	"github.com/tiglabs/containerfs/util/audit"
+	"github.com/tiglabs/containerfs/util/auth"
 	"github.com/tiglabs/containerfs/util/log"
 	"github.com/tiglabs/containerfs/util/pool"
+	"github.com/tiglabs/containerfs/util/slowop"
+	"github.com/tiglabs/containerfs/util/trace"
 	"github.com/tiglabs/containerfs/util/ump"
 )
 
@@ -51,6 +57,38 @@ type MetaManagerConfig struct {
 	NodeID    uint64
 	RootDir   string
 	RaftStore raftstore.RaftStore
+	// limit of open handles per client session, 0 means the default
+	MaxOpenFilesPerSession int
+	// interval of the extent reference reports of the partitions, negative disables them
+	ExtentRefInterval time.Duration
+	// bytes per second of the snapshots sent by the node, not positive leaves them unpaced
+	SnapshotBandwidth int64
+	// bytes of items in a snapshot frame, 0 sends an item per frame as the older releases
+	SnapshotBatchSize int
+	// raft log entries of a partition kept below its stored apply id
+	RaftLogRetain uint64
+	// checks the connections against the vol tokens, nil disables the checks
+	Auth *auth.Checker
+	// the client sessions of the connections evicted by master, nil keeps them in the manager
+	Fences *util.ClientFences
+	// labels reported in the heartbeats, the master places the meta partitions of a vol by them
+	Zone     string
+	MemClass string
+	// the format of the inodes written, the xattrs are refused below metaFormatXAttrs
+	FormatVersion int
+	// records the namespace mutations of the vols with the audit, nil records nothing
+	AuditLog *audit.MetaLogger
+	// reports the ops served slower than their threshold, nil reports nothing
+	SlowOps *slowop.Detector
+	// counts the partitions loaded by the start, nil keeps the count in the manager
+	Progress *LoadProgress
+}
+
+// LoadProgress counts the partitions of the meta dir loaded by the start of
+// the manager, the fields are accessed atomically.
+type LoadProgress struct {
+	Total  int64
+	Loaded int64
 }
 
 type metaManager struct {
@@ -61,14 +99,78 @@ type metaManager struct {
 	state      uint32
 	mu         sync.RWMutex
 	partitions map[uint64]MetaPartition // Key: metaRangeId, Val: metaPartition
+	fences     *util.ClientFences       // client sessions evicted by master
+	openFiles  *openFiles               // open handles of client sessions
+	fileLocks  *fileLocks               // advisory locks of client sessions
+	leases     *cacheLeases             // inodes cached by client sessions
+	auth       *auth.Checker            // access of the connections to the vols
+	limits     *volLimits               // file size and file count limits of the vols
+	audit      *volAudit                // namespace mutations of the vols with the audit
+	readOnly   *volReadOnly             // vols whose mutations are refused
+	permission *volPermission           // vols whose ops are checked for the callers
+	lifecycle  *lifecycleScanner        // lifecycle rules of the vols whose root the node leads
+	opMetrics  opMetrics
+	slowOps    *slowop.Detector
+	snapshots  *snapshotSender // paces the snapshots sent by the partitions
+	progress   *LoadProgress
+
+	extentRefInterval time.Duration
+	raftLogRetain     uint64
+	zone              string
+	memClass          string
+	formatVersion     int
 }
 
 func (m *metaManager) HandleMetaOperation(conn net.Conn, p *Packet) (err error) {
 	umpKey := UMPKey + "_" + p.GetOpMsg()
 	tpObject := ump.BeforeTP(umpKey)
 	defer ump.AfterTP(tpObject, err)
+	start := time.Now()
+	// the data of the packet is replaced by the reply
+	args := p.Data
+	p.client, p.proxy = m.clientOf(conn, p)
+	defer func() {
+		latency := time.Since(start)
+		m.opMetrics.observe(p.GetOpMsg(), latency)
+		m.slowOps.Check(p.GetOpMsg(), latency, func() string {
+			return slowOpContext(conn, p, args)
+		})
+	}()
+	// the op proxied to the leader is a child of the span of this node
+	span := trace.StartChild(p.Trace, "metanode."+p.GetOpMsg(), trace.SpanKindServer)
+	p.SetTrace(span.Context())
+	span.SetAttribute("partition", p.PartitionID)
+	defer func() {
+		if p.ResultCode != proto.OpOk {
+			span.SetError(errors.New(p.GetResultMesg()))
+		}
+		span.End()
+	}()
 
+	if !isMasterCommand(p.Opcode) && p.Opcode != proto.OpNegotiate && m.fences.IsFenced(conn) {
+		// The client is evicted, all of its requests are refused.
+		p.PackErrorWithCode(proto.ErrCodeClientFenced, ErrClientFenced.Error())
+		m.respondToClient(conn, p)
+		err = errors.Errorf("[%s]: client(%s) is fenced", p.GetOpMsg(),
+			conn.RemoteAddr().String())
+		return
+	}
+	if code, err := m.checkAuth(conn, p); err != nil {
+		p.PackErrorWithCode(code, err.Error())
+		m.respondToClient(conn, p)
+		return errors.Errorf("[%s]: client(%s) %s", p.GetOpMsg(),
+			conn.RemoteAddr().String(), err.Error())
+	}
+	if err = m.checkReadOnly(p); err != nil {
+		p.PackErrorWithCode(proto.ErrCodeReadOnly, err.Error())
+		m.respondToClient(conn, p)
+		return
+	}
 	switch p.Opcode {
+	case proto.OpNegotiate:
+		err = m.opNegotiate(conn, p)
+	case proto.OpAuthConn:
+		err = m.opAuthConn(conn, p)
 	case proto.OpMetaCreateInode:
 		err = m.opCreateInode(conn, p)
 	case proto.OpMetaLinkInode:
@@ -81,6 +183,30 @@ func (m *metaManager) HandleMetaOperation(conn net.Conn, p *Packet) (err error)
 		err = m.opMetaEvictInode(conn, p)
 	case proto.OpMetaSetattr:
 		err = m.opSetattr(conn, p)
+	case proto.OpMetaSetXAttr:
+		err = m.opSetXAttr(conn, p)
+	case proto.OpMetaGetXAttr:
+		err = m.opGetXAttr(conn, p)
+	case proto.OpMetaListXAttr:
+		err = m.opListXAttr(conn, p)
+	case proto.OpMetaRemoveXAttr:
+		err = m.opRemoveXAttr(conn, p)
+	case proto.OpMetaSetLock:
+		err = m.opSetLock(conn, p)
+	case proto.OpMetaGetLock:
+		err = m.opGetLock(conn, p)
+	case proto.OpMetaRenewLocks:
+		err = m.opRenewLocks(conn, p)
+	case proto.OpMetaRenewLeases:
+		err = m.opRenewLeases(conn, p)
+	case proto.OpMetaTxPrepare:
+		err = m.opTxPrepare(conn, p)
+	case proto.OpMetaTxCommit:
+		err = m.opTxCommit(conn, p)
+	case proto.OpMetaTxAbort:
+		err = m.opTxAbort(conn, p)
+	case proto.OpMetaTxStatus:
+		err = m.opTxStatus(conn, p)
 	case proto.OpMetaCreateDentry:
 		err = m.opCreateDentry(conn, p)
 	case proto.OpMetaDeleteDentry:
@@ -91,6 +217,8 @@ func (m *metaManager) HandleMetaOperation(conn net.Conn, p *Packet) (err error)
 		err = m.opReadDir(conn, p)
 	case proto.OpMetaOpen:
 		err = m.opOpen(conn, p)
+	case proto.OpMetaReleaseOpen:
+		err = m.opReleaseOpen(conn, p)
 	case proto.OpCreateMetaPartition:
 		err = m.opCreateMetaPartition(conn, p)
 	case proto.OpMetaNodeHeartbeat:
@@ -101,6 +229,10 @@ func (m *metaManager) HandleMetaOperation(conn net.Conn, p *Packet) (err error)
 		err = m.opMetaExtentsList(conn, p)
 	case proto.OpMetaExtentsDel:
 		err = m.opMetaExtentsDel(conn, p)
+	case proto.OpMetaExtentsReplace:
+		err = m.opMetaExtentsReplace(conn, p)
+	case proto.OpMetaListOrphans:
+		err = m.opMetaListOrphans(conn, p)
 	case proto.OpMetaTruncate:
 		err = m.opMetaExtentsTruncate(conn, p)
 	case proto.OpMetaLookup:
@@ -117,7 +249,10 @@ func (m *metaManager) HandleMetaOperation(conn net.Conn, p *Packet) (err error)
 		err = m.opMetaBatchInodeGet(conn, p)
 	case proto.OpPing:
 	default:
+		// answered so that a newer client does not wait for the reply of an op this node does not know
 		err = fmt.Errorf("unknown Opcode: %d", p.Opcode)
+		p.PackErrorWithCode(proto.ErrCodeUnknownOp, err.Error())
+		m.respondToClient(conn, p)
 	}
 	if err != nil {
 		err = errors.Errorf("[%s]: %s", p.GetOpMsg(), err.Error())
@@ -125,6 +260,25 @@ func (m *metaManager) HandleMetaOperation(conn net.Conn, p *Packet) (err error)
 	return
 }
 
+/*the context of a slow op, the args and the error are cut to maxSlowOpArgs bytes*/
+func slowOpContext(conn net.Conn, p *Packet, args []byte) string {
+	if len(args) > maxSlowOpArgs {
+		args = args[:maxSlowOpArgs]
+	}
+	msg := fmt.Sprintf("id[%v] remote[%v] args[%s]", p.GetUniqueLogId(), conn.RemoteAddr(), args)
+	if p.ResultCode != proto.OpOk {
+		reply := p.Data
+		if len(reply) > maxSlowOpArgs {
+			reply = reply[:maxSlowOpArgs]
+		}
+		msg += fmt.Sprintf(" err[%s]", reply)
+	}
+	if p.IsTraced() {
+		msg += fmt.Sprintf(" trace[%v]", p.Trace)
+	}
+	return msg
+}
+
 func (m *metaManager) Start() (err error) {
 	if atomic.CompareAndSwapUint32(&m.state, StateStandby, StateStart) {
 		defer func() {
@@ -150,7 +304,10 @@ func (m *metaManager) Stop() {
 
 func (m *metaManager) onStart() (err error) {
 	m.connPool = pool.NewConnPool()
-	err = m.loadPartitions()
+	if err = m.loadPartitions(); err != nil {
+		return
+	}
+	m.lifecycle.start()
 	return
 }
 
@@ -160,6 +317,9 @@ func (m *metaManager) onStop() {
 			partition.Stop()
 		}
 	}
+	m.lifecycle.stop()
+	m.audit.close()
+	m.slowOps.Close()
 	return
 }
 
@@ -199,7 +359,9 @@ func (m *metaManager) loadPartitions() (err error) {
 	for _, fileInfo := range fileInfoList {
 		if fileInfo.IsDir() && strings.HasPrefix(fileInfo.Name(), partitionPrefix) {
 			wg.Add(1)
+			atomic.AddInt64(&m.progress.Total, 1)
 			go func(fileName string) {
+				defer atomic.AddInt64(&m.progress.Loaded, 1)
 				if len(fileName) < 10 {
 					log.LogWarnf("ignore unknown partition dir: %s", fileName)
 					wg.Done()
@@ -214,10 +376,18 @@ func (m *metaManager) loadPartitions() (err error) {
 					return
 				}
 				partitionConfig := &MetaPartitionConfig{
-					NodeId:    m.nodeId,
-					RaftStore: m.raftStore,
-					RootDir:   path.Join(m.rootDir, fileName),
-					ConnPool:  m.connPool,
+					NodeId:     m.nodeId,
+					RaftStore:  m.raftStore,
+					RootDir:    path.Join(m.rootDir, fileName),
+					ConnPool:   m.connPool,
+					OpenFiles:  m.openFiles,
+					FileLocks:  m.fileLocks,
+					Leases:     m.leases,
+					Snapshots:  m.snapshots,
+					Permission: m.permission,
+
+					ExtentRefInterval: m.extentRefInterval,
+					RaftLogRetain:     m.raftLogRetain,
 				}
 				partitionConfig.AfterStop = func() {
 					m.detachPartition(id)
@@ -279,6 +449,14 @@ func (m *metaManager) createPartition(id uint64, volName string, start,
 		NodeId:      m.nodeId,
 		RootDir:     path.Join(m.rootDir, partitionPrefix+partId),
 		ConnPool:    m.connPool,
+		OpenFiles:   m.openFiles,
+		FileLocks:   m.fileLocks,
+		Leases:      m.leases,
+		Snapshots:   m.snapshots,
+		Permission:  m.permission,
+
+		ExtentRefInterval: m.extentRefInterval,
+		RaftLogRetain:     m.raftLogRetain,
 	}
 	mpc.AfterStop = func() {
 		m.detachPartition(id)
@@ -322,10 +500,89 @@ func (m *metaManager) PartitionsMarshalJSON() (data []byte, err error) {
 }
 
 func NewMetaManager(conf MetaManagerConfig) MetaManager {
-	return &metaManager{
+	if conf.Progress == nil {
+		conf.Progress = &LoadProgress{}
+	}
+	if conf.Fences == nil {
+		conf.Fences = util.NewClientFences()
+	}
+	m := &metaManager{
 		nodeId:     conf.NodeID,
 		rootDir:    conf.RootDir,
 		raftStore:  conf.RaftStore,
 		partitions: make(map[uint64]MetaPartition),
+		fences:     conf.Fences,
+		openFiles:  newOpenFiles(conf.MaxOpenFilesPerSession),
+		fileLocks:  newFileLocks(),
+		leases:     newCacheLeases(),
+		auth:       conf.Auth,
+		limits:     newVolLimits(),
+		audit:      newVolAudit(conf.AuditLog),
+		readOnly:   newVolReadOnly(),
+		permission: newVolPermission(),
+		slowOps:    conf.SlowOps,
+		snapshots:  newSnapshotSender(conf.SnapshotBandwidth, conf.SnapshotBatchSize),
+		progress:   conf.Progress,
+
+		extentRefInterval: conf.ExtentRefInterval,
+		raftLogRetain:     conf.RaftLogRetain,
+		zone:              conf.Zone,
+		memClass:          conf.MemClass,
+		formatVersion:     conf.FormatVersion,
+	}
+	m.lifecycle = newLifecycleScanner(m.walksLifecycle)
+	return m
+}
+
+// checkAuth checks the access of the request to the vol of its partition, a
+// request to an unknown partition is refused since its vol is unknown.
+func (m *metaManager) checkAuth(conn net.Conn, p *Packet) (code proto.ErrCode, err error) {
+	code = proto.ErrCodeNotPerm
+	if !m.auth.Enabled() || p.Opcode == proto.OpAuthConn || p.Opcode == proto.OpNegotiate || p.Opcode == proto.OpPing {
+		return
+	}
+	access := metaAccess(p.Opcode)
+	if access == auth.AccessInternal {
+		err = m.auth.Check(conn, "", access)
+		return
+	}
+	req := &struct {
+		PartitionID uint64 `json:"pid"`
+	}{}
+	if err = json.Unmarshal(p.Data, req); err != nil {
+		return
+	}
+	mp, err := m.getPartition(req.PartitionID)
+	if err != nil {
+		code = proto.ErrCodePartitionNotExist
+		return
+	}
+	err = m.auth.Check(conn, mp.GetBaseConfig().VolName, access)
+	return
+}
+
+func metaAccess(opcode uint8) auth.Access {
+	switch opcode {
+	case proto.OpMetaLookup, proto.OpMetaReadDir, proto.OpMetaInodeGet, proto.OpMetaBatchInodeGet,
+		proto.OpMetaExtentsList, proto.OpMetaOpen, proto.OpMetaReleaseOpen, proto.OpMetaGetXAttr, proto.OpMetaListXAttr,
+		proto.OpMetaSetLock, proto.OpMetaGetLock, proto.OpMetaRenewLocks, proto.OpMetaRenewLeases, proto.OpMetaListOrphans:
+		return auth.AccessRead
+	case proto.OpMetaCreateInode, proto.OpMetaLinkInode, proto.OpMetaDeleteInode, proto.OpMetaEvictInode,
+		proto.OpMetaSetattr, proto.OpMetaCreateDentry, proto.OpMetaDeleteDentry, proto.OpMetaUpdateDentry,
+		proto.OpMetaExtentsAdd, proto.OpMetaTruncate, proto.OpMetaSetXAttr, proto.OpMetaRemoveXAttr,
+		proto.OpMetaTxPrepare, proto.OpMetaTxCommit, proto.OpMetaTxAbort, proto.OpMetaExtentsReplace:
+		return auth.AccessWrite
+	}
+	return auth.AccessInternal
+}
+
+func isMasterCommand(opcode uint8) bool {
+	switch opcode {
+	case proto.OpCreateMetaPartition, proto.OpMetaNodeHeartbeat,
+		proto.OpDeleteMetaPartition, proto.OpUpdateMetaPartition,
+		proto.OpLoadMetaPartition, proto.OpOfflineMetaPartition,
+		proto.OpPing:
+		return true
 	}
+	return false
 }
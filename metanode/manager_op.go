@@ -18,11 +18,14 @@ import (
 	"encoding/json"
 	"net"
 	"os"
+	"sync/atomic"
+	"time"
 
 	"bytes"
 	"github.com/juju/errors"
 	"github.com/tiglabs/containerfs/proto"
 	"github.com/tiglabs/containerfs/util"
+	"github.com/tiglabs/containerfs/util/audit"
 	"github.com/tiglabs/containerfs/util/log"
 	raftProto "github.com/tiglabs/raft/proto"
 	"runtime"
@@ -31,6 +34,7 @@ import (
 func (m *metaManager) opMasterHeartbeat(conn net.Conn, p *Packet) (err error) {
 	// For ack to master
 	m.responseAckOKToMaster(conn, p)
+	atomic.StoreInt64(&lastMasterHeartbeat, time.Now().Unix())
 	var (
 		req       = &proto.HeartBeatRequest{}
 		resp      = &proto.MetaNodeHeartbeatResponse{}
@@ -42,22 +46,41 @@ func (m *metaManager) opMasterHeartbeat(conn net.Conn, p *Packet) (err error) {
 	if err = decode.Decode(adminTask); err != nil {
 		resp.Status = proto.TaskFail
 		resp.Result = err.Error()
+		resp.ErrCode = proto.ErrCodeArgMismatch
 		goto end
 	}
 	reqData, err = json.Marshal(adminTask.Request)
 	if err != nil {
 		resp.Status = proto.TaskFail
 		resp.Result = err.Error()
+		resp.ErrCode = proto.ErrCodeArgMismatch
 		return
 	}
 	if err = json.Unmarshal(reqData, req); err != nil {
 		resp.Status = proto.TaskFail
 		resp.Result = err.Error()
+		resp.ErrCode = proto.ErrCodeArgMismatch
 		return
 	}
 	if curMasterAddr != req.MasterAddr {
 		curMasterAddr = req.MasterAddr
 	}
+	resp.ClockOffset = time.Now().Unix() - req.CurrTime
+	resp.ZoneName = m.zone
+	resp.MemClass = m.memClass
+	for _, fence := range req.FencedClients {
+		m.fences.Fence(fence.Session, fence.ExpireTime)
+	}
+	m.auth.Update(req.VolTokens)
+	m.limits.update(req.VolLimits)
+	m.audit.update(req.VolAudit)
+	m.readOnly.update(req.VolReadOnly)
+	m.permission.update(req.VolPermission)
+	m.lifecycle.update(req.VolLifecycle)
+	m.openFiles.touch(req.ActiveSessions)
+	m.openFiles.expire(openFilesSessionTimeout)
+	m.fileLocks.expire()
+	m.leases.expire()
 	// collect used info
 	// machine mem total and used
 	resp.Total, _, err = util.GetMemInfo()
@@ -79,7 +102,9 @@ func (m *metaManager) opMasterHeartbeat(conn net.Conn, p *Packet) (err error) {
 			End:         mConf.End,
 			Status:      proto.ReadWrite,
 			MaxInodeID:  mConf.Cursor,
+			InodeCount:  partition.GetInodeCount(),
 		}
+		mpr.UsageFiles, mpr.UsageBytes, mpr.UsageTime = partition.GetUsage()
 		addr, isLeader := partition.IsLeader()
 		if addr == "" {
 			mpr.Status = proto.Unavaliable
@@ -91,6 +116,7 @@ func (m *metaManager) opMasterHeartbeat(conn net.Conn, p *Packet) (err error) {
 		resp.MetaPartitionInfo = append(resp.MetaPartitionInfo, mpr)
 		return true
 	})
+	resp.Lifecycle = m.lifecycle.reports()
 	resp.Status = proto.TaskSuccess
 	adminTask.Request = nil
 	adminTask.Response = resp
@@ -146,6 +172,7 @@ func (m *metaManager) opCreateMetaPartition(conn net.Conn, p *Packet) (err error
 		req.Members); err != nil {
 		resp.Status = proto.TaskFail
 		resp.Result = err.Error()
+		resp.ErrCode = errCodeOf(err)
 		err = errors.Errorf("[opCreateMetaPartition]->%s; request message: %v",
 			err.Error(), adminTask.Request)
 	}
@@ -165,16 +192,26 @@ func (m *metaManager) opCreateInode(conn net.Conn, p *Packet) (err error) {
 	}
 	mp, err := m.getPartition(req.PartitionID)
 	if err != nil {
-		p.PackErrorWithBody(proto.OpNotExistErr, []byte(err.Error()))
+		p.PackErrorWithCode(proto.ErrCodePartitionNotExist, err.Error())
 		m.respondToClient(conn, p)
 		return
 	}
+	if !m.checkCaller(conn, mp, p, req.Caller) {
+		return
+	}
 	if !m.serveProxy(conn, mp, p) {
 		return
 	}
+	if m.limits.filesFull(mp.GetBaseConfig().VolName) {
+		p.PackErrorWithBody(proto.OpTooManyFilesErr, nil)
+		m.respondToClient(conn, p)
+		return
+	}
+	req.Caller = m.callerOf(mp, req.Caller)
 	err = mp.CreateInode(req, p)
 	// Reply operation result to client though TCP connection.
 	m.respondToClient(conn, p)
+	m.auditOp(mp, p, &audit.MetaEntry{Mode: req.Mode})
 	log.LogDebugf("[opCreateInode] req:%v; resp: %v, body: %s", req, p.GetResultMesg(), p.Data)
 	return
 }
@@ -188,7 +225,7 @@ func (m *metaManager) opMetaLinkInode(conn net.Conn, p *Packet) (err error) {
 	}
 	mp, err := m.getPartition(req.PartitionID)
 	if err != nil {
-		p.PackErrorWithBody(proto.OpNotExistErr, []byte(err.Error()))
+		p.PackErrorWithCode(proto.ErrCodePartitionNotExist, err.Error())
 		m.respondToClient(conn, p)
 		return
 	}
@@ -196,7 +233,11 @@ func (m *metaManager) opMetaLinkInode(conn net.Conn, p *Packet) (err error) {
 		return
 	}
 	err = mp.CreateLinkInode(req, p)
+	if p.ResultCode == proto.OpOk {
+		m.leases.invalidate("", req.PartitionID, req.Inode)
+	}
 	m.respondToClient(conn, p)
+	m.auditOp(mp, p, &audit.MetaEntry{Inode: req.Inode})
 	log.LogDebugf("[opMetaLinkInode] req: %v, resp: %v, body: %s", req, p.GetResultMesg(), p.Data)
 	return
 }
@@ -211,16 +252,24 @@ func (m *metaManager) opCreateDentry(conn net.Conn, p *Packet) (err error) {
 	}
 	mp, err := m.getPartition(req.PartitionID)
 	if err != nil {
-		p.PackErrorWithBody(proto.OpNotExistErr, []byte(err.Error()))
+		p.PackErrorWithCode(proto.ErrCodePartitionNotExist, err.Error())
 		m.respondToClient(conn, p)
 		return
 	}
+	if !m.checkCaller(conn, mp, p, req.Caller) {
+		return
+	}
 	if !m.serveProxy(conn, mp, p) {
 		return
 	}
+	req.Caller = m.callerOf(mp, req.Caller)
 	err = mp.CreateDentry(req, p)
+	if p.ResultCode == proto.OpOk {
+		m.leases.invalidate("", req.PartitionID, req.ParentID)
+	}
 	// Reply operation result to client though TCP connection.
 	m.respondToClient(conn, p)
+	m.auditOp(mp, p, &audit.MetaEntry{Parent: req.ParentID, Name: req.Name, Path: req.Path, Inode: req.Inode, Mode: req.Mode})
 	log.LogDebugf("[opCreateDentry] req:%v; resp: %v, body: %s", req, p.GetResultMesg(), p.Data)
 	return
 }
@@ -235,16 +284,24 @@ func (m *metaManager) opDeleteDentry(conn net.Conn, p *Packet) (err error) {
 	}
 	mp, err := m.getPartition(req.PartitionID)
 	if err != nil {
-		p.PackErrorWithBody(proto.OpNotExistErr, nil)
+		p.PackErrorWithCode(proto.ErrCodePartitionNotExist, err.Error())
 		m.respondToClient(conn, p)
 		return
 	}
+	if !m.checkCaller(conn, mp, p, req.Caller) {
+		return
+	}
 	if !m.serveProxy(conn, mp, p) {
 		return
 	}
+	req.Caller = m.callerOf(mp, req.Caller)
 	err = mp.DeleteDentry(req, p)
+	if p.ResultCode == proto.OpOk {
+		m.leases.invalidate("", req.PartitionID, req.ParentID)
+	}
 	// Reply operation result to client though TCP connection.
 	m.respondToClient(conn, p)
+	m.auditOp(mp, p, &audit.MetaEntry{Parent: req.ParentID, Name: req.Name, Path: req.Path})
 	log.LogDebugf("[opDeleteDentry] req:%v; resp: %v, body: %s", req,
 		p.GetResultMesg(), p.Data)
 	return
@@ -259,15 +316,23 @@ func (m *metaManager) opUpdateDentry(conn net.Conn, p *Packet) (err error) {
 	}
 	mp, err := m.getPartition(req.PartitionID)
 	if err != nil {
-		p.PackErrorWithBody(proto.OpNotExistErr, nil)
+		p.PackErrorWithCode(proto.ErrCodePartitionNotExist, err.Error())
 		m.respondToClient(conn, p)
 		return
 	}
+	if !m.checkCaller(conn, mp, p, req.Caller) {
+		return
+	}
 	if !m.serveProxy(conn, mp, p) {
 		return
 	}
+	req.Caller = m.callerOf(mp, req.Caller)
 	err = mp.UpdateDentry(req, p)
+	if p.ResultCode == proto.OpOk {
+		m.leases.invalidate("", req.PartitionID, req.ParentID)
+	}
 	m.respondToClient(conn, p)
+	m.auditOp(mp, p, &audit.MetaEntry{Parent: req.ParentID, Name: req.Name, Path: req.Path, Inode: req.Inode})
 	log.LogDebugf("[opUpdateDentry] req: %v; resp: %v, body: %s",
 		req, p.GetResultMesg(), p.Data)
 	return
@@ -282,7 +347,7 @@ func (m *metaManager) opDeleteInode(conn net.Conn, p *Packet) (err error) {
 	}
 	mp, err := m.getPartition(req.PartitionID)
 	if err != nil {
-		p.PackErrorWithBody(proto.OpNotExistErr, nil)
+		p.PackErrorWithCode(proto.ErrCodePartitionNotExist, err.Error())
 		m.respondToClient(conn, p)
 		return
 	}
@@ -290,7 +355,11 @@ func (m *metaManager) opDeleteInode(conn net.Conn, p *Packet) (err error) {
 		return
 	}
 	err = mp.DeleteInode(req, p)
+	if p.ResultCode == proto.OpOk {
+		m.leases.invalidate("", req.PartitionID, req.Inode)
+	}
 	m.respondToClient(conn, p)
+	m.auditOp(mp, p, &audit.MetaEntry{Inode: req.Inode})
 	log.LogDebugf("[opDeleteInode] req:%v; resp: %v, body: %s", req,
 		p.GetResultMesg(), p.Data)
 	return
@@ -306,13 +375,19 @@ func (m *metaManager) opReadDir(conn net.Conn, p *Packet) (err error) {
 	}
 	mp, err := m.getPartition(req.PartitionID)
 	if err != nil {
-		p.PackErrorWithBody(proto.OpNotExistErr, nil)
+		p.PackErrorWithCode(proto.ErrCodePartitionNotExist, err.Error())
 		m.respondToClient(conn, p)
 		return
 	}
+	if !m.checkCaller(conn, mp, p, req.Caller) {
+		return
+	}
 	if !m.serveProxy(conn, mp, p) {
 		return
 	}
+	// the lease is granted before the read, so a change after it is notified
+	m.leases.grant(req.SessionID, req.PartitionID, req.LeaseSeconds, req.ParentID)
+	req.Caller = m.callerOf(mp, req.Caller)
 	err = mp.ReadDir(req, p)
 	// Reply operation result to client though TCP connection.
 	m.respondToClient(conn, p)
@@ -331,14 +406,30 @@ func (m *metaManager) opOpen(conn net.Conn, p *Packet) (err error) {
 	}
 	mp, err := m.getPartition(req.PartitionID)
 	if err != nil {
-		p.PackErrorWithBody(proto.OpNotExistErr, nil)
+		p.PackErrorWithCode(proto.ErrCodePartitionNotExist, err.Error())
 		m.respondToClient(conn, p)
 		return
 	}
+	if !m.checkCaller(conn, mp, p, req.Caller) {
+		return
+	}
 	if ok := m.serveProxy(conn, mp, p); !ok {
 		return
 	}
+	req.Caller = m.callerOf(mp, req.Caller)
+	if err = m.openFiles.open(req.SessionID, req.PartitionID, req.Inode); err != nil {
+		p.PackErrorWithCode(proto.ErrCodeTooManyOpen, err.Error())
+		m.respondToClient(conn, p)
+		err = errors.Errorf("[opOpen] session(%v) inode(%v): %s",
+			req.SessionID, req.Inode, err.Error())
+		return
+	}
 	err = mp.Open(req, p)
+	if p.ResultCode != proto.OpOk {
+		m.openFiles.release(req.SessionID, req.PartitionID, req.Inode)
+	} else if req.Lease {
+		m.leases.lease(req.SessionID, req.PartitionID, req.Inode)
+	}
 	// Reply operation result to client though TCP connection.
 	m.respondToClient(conn, p)
 	log.LogDebugf("[opOpen] req:%v; resp: %v, body: %s", req,
@@ -346,6 +437,34 @@ func (m *metaManager) opOpen(conn net.Conn, p *Packet) (err error) {
 	return
 }
 
+// opReleaseOpen release a handle opened by opOpen, it is accounted by the
+// partition leader only and not replicated.
+func (m *metaManager) opReleaseOpen(conn net.Conn, p *Packet) (err error) {
+	req := &ReleaseOpenReq{}
+	if err = json.Unmarshal(p.Data, req); err != nil {
+		p.PackErrorWithBody(proto.OpErr, nil)
+		m.respondToClient(conn, p)
+		err = errors.Errorf("[opReleaseOpen]: %s", err.Error())
+		return
+	}
+	mp, err := m.getPartition(req.PartitionID)
+	if err != nil {
+		p.PackErrorWithCode(proto.ErrCodePartitionNotExist, err.Error())
+		m.respondToClient(conn, p)
+		err = errors.Errorf("[opReleaseOpen] %s, req: %s", err.Error(),
+			string(p.Data))
+		return
+	}
+	if !m.serveProxy(conn, mp, p) {
+		return
+	}
+	m.openFiles.release(req.SessionID, req.PartitionID, req.Inode)
+	p.PackOkReply()
+	m.respondToClient(conn, p)
+	log.LogDebugf("[opReleaseOpen] req:%v; resp: %v", req, p.GetResultMesg())
+	return
+}
+
 func (m *metaManager) opMetaInodeGet(conn net.Conn, p *Packet) (err error) {
 	req := &InodeGetReq{}
 	if err = json.Unmarshal(p.Data, req); err != nil {
@@ -356,7 +475,7 @@ func (m *metaManager) opMetaInodeGet(conn net.Conn, p *Packet) (err error) {
 	}
 	mp, err := m.getPartition(req.PartitionID)
 	if err != nil {
-		p.PackErrorWithBody(proto.OpNotExistErr, nil)
+		p.PackErrorWithCode(proto.ErrCodePartitionNotExist, err.Error())
 		m.respondToClient(conn, p)
 		err = errors.Errorf("[opMetaInodeGet] %s, req: %s", err.Error(),
 			string(p.Data))
@@ -365,6 +484,7 @@ func (m *metaManager) opMetaInodeGet(conn net.Conn, p *Packet) (err error) {
 	if !m.serveProxy(conn, mp, p) {
 		return
 	}
+	m.leases.grant(req.SessionID, req.PartitionID, req.LeaseSeconds, req.Inode)
 	if err = mp.InodeGet(req, p); err != nil {
 		err = errors.Errorf("[opMetaInodeGet] %s, req: %s", err.Error(),
 			string(p.Data))
@@ -385,7 +505,7 @@ func (m *metaManager) opMetaEvictInode(conn net.Conn, p *Packet) (err error) {
 	}
 	mp, err := m.getPartition(req.PartitionID)
 	if err != nil {
-		p.PackErrorWithBody(proto.OpNotExistErr, nil)
+		p.PackErrorWithCode(proto.ErrCodePartitionNotExist, err.Error())
 		m.respondToClient(conn, p)
 		err = errors.Errorf("[opMetaEvictInode] req: %s, resp: %v", req, err.Error())
 		return
@@ -397,7 +517,11 @@ func (m *metaManager) opMetaEvictInode(conn net.Conn, p *Packet) (err error) {
 	if err = mp.EvictInode(req, p); err != nil {
 		err = errors.Errorf("[opMetaEvictInode] req: %s, resp: %v", req, err.Error())
 	}
+	if p.ResultCode == proto.OpOk {
+		m.leases.invalidate("", req.PartitionID, req.Inode)
+	}
 	m.respondToClient(conn, p)
+	m.auditOp(mp, p, &audit.MetaEntry{Inode: req.Inode})
 	log.LogDebugf("[opMetaEvictInode] req: %v, resp: %v, body: %s", req,
 		p.GetResultMesg(), p.Data)
 	return
@@ -414,24 +538,343 @@ func (m *metaManager) opSetattr(conn net.Conn, p *Packet) (err error) {
 
 	mp, err := m.getPartition(req.PartitionID)
 	if err != nil {
-		p.PackErrorWithBody(proto.OpErr, []byte(err.Error()))
+		p.PackErrorWithResult(proto.OpErr, proto.ErrCodePartitionNotExist, err.Error())
 		m.respondToClient(conn, p)
 		err = errors.Errorf("[opSetattr] req: %v, error: %v", req, err.Error())
 		return
 	}
 
+	if !m.checkCaller(conn, mp, p, req.Caller) {
+		return
+	}
 	if !m.serveProxy(conn, mp, p) {
 		return
 	}
-	if err = mp.SetAttr(p.Data, p); err != nil {
+	req.Caller = m.callerOf(mp, req.Caller)
+	if err = mp.SetAttr(req, p); err != nil {
 		err = errors.Errorf("[opSetattr] req: %v, error: %s", req, err.Error())
 	}
+	if p.ResultCode == proto.OpOk {
+		m.leases.invalidate(req.SessionID, req.PartitionID, req.Inode)
+	}
 	m.respondToClient(conn, p)
+	m.auditOp(mp, p, &audit.MetaEntry{Inode: req.Inode, Mode: req.Mode, Uid: req.Uid, Gid: req.Gid, Valid: req.Valid})
 	log.LogDebugf("[opSetattr] req: %v, resp: %v, body: %s", req,
 		p.GetResultMesg(), p.Data)
 	return
 }
 
+func (m *metaManager) opSetXAttr(conn net.Conn, p *Packet) (err error) {
+	req := &proto.SetXAttrRequest{}
+	if err = json.Unmarshal(p.Data, req); err != nil {
+		p.PackErrorWithBody(proto.OpErr, []byte(err.Error()))
+		m.respondToClient(conn, p)
+		err = errors.Errorf("[opSetXAttr] req: %v, error: %v", req, err.Error())
+		return
+	}
+	mp, err := m.getPartition(req.PartitionID)
+	if err != nil {
+		p.PackErrorWithCode(proto.ErrCodePartitionNotExist, err.Error())
+		m.respondToClient(conn, p)
+		err = errors.Errorf("[opSetXAttr] req: %v, error: %v", req, err.Error())
+		return
+	}
+	if !m.checkCaller(conn, mp, p, req.Caller) {
+		return
+	}
+	if !m.serveProxy(conn, mp, p) {
+		return
+	}
+	if m.formatVersion < metaFormatXAttrs {
+		// the inodes with xattrs can't be loaded by the releases before them
+		p.PackErrorWithCode(proto.ErrCodeUnknownOp, "xattrs need "+cfgMetaFormatVersion+" 2")
+		m.respondToClient(conn, p)
+		return
+	}
+	req.Caller = m.callerOf(mp, req.Caller)
+	if err = mp.SetXAttr(req, p); err != nil {
+		err = errors.Errorf("[opSetXAttr] req: %v, error: %s", req, err.Error())
+	}
+	m.respondToClient(conn, p)
+	m.auditOp(mp, p, &audit.MetaEntry{Inode: req.Inode, Name: req.Name})
+	log.LogDebugf("[opSetXAttr] req: %v, resp: %v", req, p.GetResultMesg())
+	return
+}
+
+func (m *metaManager) opGetXAttr(conn net.Conn, p *Packet) (err error) {
+	req := &proto.GetXAttrRequest{}
+	if err = json.Unmarshal(p.Data, req); err != nil {
+		p.PackErrorWithBody(proto.OpErr, []byte(err.Error()))
+		m.respondToClient(conn, p)
+		err = errors.Errorf("[opGetXAttr] req: %v, error: %v", req, err.Error())
+		return
+	}
+	mp, err := m.getPartition(req.PartitionID)
+	if err != nil {
+		p.PackErrorWithCode(proto.ErrCodePartitionNotExist, err.Error())
+		m.respondToClient(conn, p)
+		err = errors.Errorf("[opGetXAttr] req: %v, error: %v", req, err.Error())
+		return
+	}
+	if !m.checkCaller(conn, mp, p, req.Caller) {
+		return
+	}
+	if !m.serveProxy(conn, mp, p) {
+		return
+	}
+	req.Caller = m.callerOf(mp, req.Caller)
+	if err = mp.GetXAttr(req, p); err != nil {
+		err = errors.Errorf("[opGetXAttr] req: %v, error: %s", req, err.Error())
+	}
+	m.respondToClient(conn, p)
+	log.LogDebugf("[opGetXAttr] req: %v, resp: %v", req, p.GetResultMesg())
+	return
+}
+
+func (m *metaManager) opListXAttr(conn net.Conn, p *Packet) (err error) {
+	req := &proto.ListXAttrRequest{}
+	if err = json.Unmarshal(p.Data, req); err != nil {
+		p.PackErrorWithBody(proto.OpErr, []byte(err.Error()))
+		m.respondToClient(conn, p)
+		err = errors.Errorf("[opListXAttr] req: %v, error: %v", req, err.Error())
+		return
+	}
+	mp, err := m.getPartition(req.PartitionID)
+	if err != nil {
+		p.PackErrorWithCode(proto.ErrCodePartitionNotExist, err.Error())
+		m.respondToClient(conn, p)
+		err = errors.Errorf("[opListXAttr] req: %v, error: %v", req, err.Error())
+		return
+	}
+	if !m.serveProxy(conn, mp, p) {
+		return
+	}
+	if err = mp.ListXAttr(req, p); err != nil {
+		err = errors.Errorf("[opListXAttr] req: %v, error: %s", req, err.Error())
+	}
+	m.respondToClient(conn, p)
+	log.LogDebugf("[opListXAttr] req: %v, resp: %v", req, p.GetResultMesg())
+	return
+}
+
+func (m *metaManager) opRemoveXAttr(conn net.Conn, p *Packet) (err error) {
+	req := &proto.RemoveXAttrRequest{}
+	if err = json.Unmarshal(p.Data, req); err != nil {
+		p.PackErrorWithBody(proto.OpErr, []byte(err.Error()))
+		m.respondToClient(conn, p)
+		err = errors.Errorf("[opRemoveXAttr] req: %v, error: %v", req, err.Error())
+		return
+	}
+	mp, err := m.getPartition(req.PartitionID)
+	if err != nil {
+		p.PackErrorWithCode(proto.ErrCodePartitionNotExist, err.Error())
+		m.respondToClient(conn, p)
+		err = errors.Errorf("[opRemoveXAttr] req: %v, error: %v", req, err.Error())
+		return
+	}
+	if !m.checkCaller(conn, mp, p, req.Caller) {
+		return
+	}
+	if !m.serveProxy(conn, mp, p) {
+		return
+	}
+	req.Caller = m.callerOf(mp, req.Caller)
+	if err = mp.RemoveXAttr(req, p); err != nil {
+		err = errors.Errorf("[opRemoveXAttr] req: %v, error: %s", req, err.Error())
+	}
+	m.respondToClient(conn, p)
+	m.auditOp(mp, p, &audit.MetaEntry{Inode: req.Inode, Name: req.Name})
+	log.LogDebugf("[opRemoveXAttr] req: %v, resp: %v", req, p.GetResultMesg())
+	return
+}
+
+// opSetLock takes or releases a lock of a session, the locks are kept by
+// the partition leader only and not replicated like the open handles.
+func (m *metaManager) opSetLock(conn net.Conn, p *Packet) (err error) {
+	req := &proto.SetLockRequest{}
+	if err = json.Unmarshal(p.Data, req); err != nil {
+		p.PackErrorWithBody(proto.OpErr, nil)
+		m.respondToClient(conn, p)
+		err = errors.Errorf("[opSetLock]: %s", err.Error())
+		return
+	}
+	mp, err := m.getPartition(req.PartitionID)
+	if err != nil {
+		p.PackErrorWithCode(proto.ErrCodePartitionNotExist, err.Error())
+		m.respondToClient(conn, p)
+		err = errors.Errorf("[opSetLock] %s, req: %s", err.Error(), string(p.Data))
+		return
+	}
+	if !m.serveProxy(conn, mp, p) {
+		return
+	}
+	if req.SessionID == "" || req.Lock.Type > proto.LockUnlock || req.Lock.Start > req.Lock.End {
+		p.PackErrorWithBody(proto.OpArgMismatchErr, nil)
+		m.respondToClient(conn, p)
+		return
+	}
+	if err = m.fileLocks.set(req.SessionID, req.PartitionID, req.Inode, &req.Lock); err != nil {
+		// a conflict is the answer to the request, not a failure
+		p.PackErrorWithCode(errCodeOf(err), err.Error())
+		err = nil
+	} else {
+		p.PackOkReply()
+	}
+	m.respondToClient(conn, p)
+	log.LogDebugf("[opSetLock] req:%v; resp: %v", req, p.GetResultMesg())
+	return
+}
+
+func (m *metaManager) opGetLock(conn net.Conn, p *Packet) (err error) {
+	req := &proto.GetLockRequest{}
+	if err = json.Unmarshal(p.Data, req); err != nil {
+		p.PackErrorWithBody(proto.OpErr, nil)
+		m.respondToClient(conn, p)
+		err = errors.Errorf("[opGetLock]: %s", err.Error())
+		return
+	}
+	mp, err := m.getPartition(req.PartitionID)
+	if err != nil {
+		p.PackErrorWithCode(proto.ErrCodePartitionNotExist, err.Error())
+		m.respondToClient(conn, p)
+		err = errors.Errorf("[opGetLock] %s, req: %s", err.Error(), string(p.Data))
+		return
+	}
+	if !m.serveProxy(conn, mp, p) {
+		return
+	}
+	resp := &proto.GetLockResponse{Lock: m.fileLocks.get(req.SessionID, req.PartitionID, req.Inode, &req.Lock)}
+	reply, err := json.Marshal(resp)
+	if err != nil {
+		p.PackErrorWithBody(proto.OpErr, nil)
+	} else {
+		p.PackOkWithBody(reply)
+	}
+	m.respondToClient(conn, p)
+	log.LogDebugf("[opGetLock] req:%v; resp: %v, body: %s", req, p.GetResultMesg(), p.Data)
+	return
+}
+
+func (m *metaManager) opRenewLocks(conn net.Conn, p *Packet) (err error) {
+	req := &proto.RenewLocksRequest{}
+	if err = json.Unmarshal(p.Data, req); err != nil {
+		p.PackErrorWithBody(proto.OpErr, nil)
+		m.respondToClient(conn, p)
+		err = errors.Errorf("[opRenewLocks]: %s", err.Error())
+		return
+	}
+	mp, err := m.getPartition(req.PartitionID)
+	if err != nil {
+		p.PackErrorWithCode(proto.ErrCodePartitionNotExist, err.Error())
+		m.respondToClient(conn, p)
+		err = errors.Errorf("[opRenewLocks] %s, req: %s", err.Error(), string(p.Data))
+		return
+	}
+	if !m.serveProxy(conn, mp, p) {
+		return
+	}
+	resp := &proto.RenewLocksResponse{Lost: m.fileLocks.renew(req.SessionID, req.PartitionID, req.Locks)}
+	if len(resp.Lost) != 0 {
+		log.LogWarnf("[opRenewLocks] session(%v) partition(%v) lost locks: %v", req.SessionID, req.PartitionID, resp.Lost)
+	}
+	reply, err := json.Marshal(resp)
+	if err != nil {
+		p.PackErrorWithBody(proto.OpErr, nil)
+	} else {
+		p.PackOkWithBody(reply)
+	}
+	m.respondToClient(conn, p)
+	log.LogDebugf("[opRenewLocks] session(%v) partition(%v) locks(%v); resp: %v", req.SessionID, req.PartitionID,
+		len(req.Locks), p.GetResultMesg())
+	return
+}
+
+// opRenewLeases renews the cache leases of a session, the leases are kept by
+// the partition leader only like the locks.
+func (m *metaManager) opRenewLeases(conn net.Conn, p *Packet) (err error) {
+	req := &proto.RenewLeasesRequest{}
+	if err = json.Unmarshal(p.Data, req); err != nil {
+		p.PackErrorWithBody(proto.OpErr, nil)
+		m.respondToClient(conn, p)
+		err = errors.Errorf("[opRenewLeases]: %s", err.Error())
+		return
+	}
+	mp, err := m.getPartition(req.PartitionID)
+	if err != nil {
+		p.PackErrorWithCode(proto.ErrCodePartitionNotExist, err.Error())
+		m.respondToClient(conn, p)
+		err = errors.Errorf("[opRenewLeases] %s, req: %s", err.Error(), string(p.Data))
+		return
+	}
+	if !m.serveProxy(conn, mp, p) {
+		return
+	}
+	if req.SessionID == "" {
+		p.PackErrorWithBody(proto.OpArgMismatchErr, nil)
+		m.respondToClient(conn, p)
+		return
+	}
+	resp := &proto.RenewLeasesResponse{}
+	resp.Invalidated, resp.Reset = m.leases.renew(req.SessionID, req.PartitionID, req.Inodes)
+	reply, err := json.Marshal(resp)
+	if err != nil {
+		p.PackErrorWithBody(proto.OpErr, nil)
+	} else {
+		p.PackOkWithBody(reply)
+	}
+	m.respondToClient(conn, p)
+	log.LogDebugf("[opRenewLeases] session(%v) partition(%v) inodes(%v); resp: %v, invalidated(%v) reset(%v)",
+		req.SessionID, req.PartitionID, len(req.Inodes), p.GetResultMesg(), len(resp.Invalidated), resp.Reset)
+	return
+}
+
+/*the inodes of the range of the partition, a batch get may carry the others*/
+func partitionInodes(mp MetaPartition, inodes []uint64) (inos []uint64) {
+	conf := mp.GetBaseConfig()
+	for _, ino := range inodes {
+		if ino >= conf.Start && ino <= conf.End {
+			inos = append(inos, ino)
+		}
+	}
+	return
+}
+
+func (m *metaManager) opAuthConn(conn net.Conn, p *Packet) (err error) {
+	req := &proto.AuthConnRequest{}
+	if err = json.Unmarshal(p.Data, req); err != nil {
+		p.PackErrorWithBody(proto.OpErr, nil)
+		m.respondToClient(conn, p)
+		return
+	}
+	if err = m.auth.Authenticate(conn, req); err != nil {
+		p.PackErrorWithBody(proto.OpNotPermErr, []byte(err.Error()))
+		m.respondToClient(conn, p)
+		return
+	}
+	m.fences.SetSession(conn, req.Session)
+	p.PackOkReply()
+	m.respondToClient(conn, p)
+	return
+}
+
+func (m *metaManager) opNegotiate(conn net.Conn, p *Packet) (err error) {
+	req := &proto.NegotiateRequest{}
+	if err = json.Unmarshal(p.Data, req); err != nil {
+		p.PackErrorWithBody(proto.OpErr, nil)
+		m.respondToClient(conn, p)
+		return
+	}
+	reply, err := json.Marshal(proto.Negotiate(req))
+	if err != nil {
+		p.PackErrorWithBody(proto.OpErr, nil)
+		m.respondToClient(conn, p)
+		return
+	}
+	p.PackOkWithBody(reply)
+	m.respondToClient(conn, p)
+	return
+}
+
 func (m *metaManager) opMetaLookup(conn net.Conn, p *Packet) (err error) {
 	req := &proto.LookupRequest{}
 	if err = json.Unmarshal(p.Data, req); err != nil {
@@ -441,13 +884,18 @@ func (m *metaManager) opMetaLookup(conn net.Conn, p *Packet) (err error) {
 	}
 	mp, err := m.getPartition(req.PartitionID)
 	if err != nil {
-		p.PackErrorWithBody(proto.OpNotExistErr, nil)
+		p.PackErrorWithCode(proto.ErrCodePartitionNotExist, err.Error())
 		m.respondToClient(conn, p)
 		return
 	}
+	if !m.checkCaller(conn, mp, p, req.Caller) {
+		return
+	}
 	if !m.serveProxy(conn, mp, p) {
 		return
 	}
+	m.leases.grant(req.SessionID, req.PartitionID, req.LeaseSeconds, req.ParentID)
+	req.Caller = m.callerOf(mp, req.Caller)
 	err = mp.Lookup(req, p)
 	m.respondToClient(conn, p)
 	log.LogDebugf("[opMetaLookup] req:%v; resp: %v, body: %s", req,
@@ -464,16 +912,23 @@ func (m *metaManager) opMetaExtentsAdd(conn net.Conn, p *Packet) (err error) {
 	}
 	mp, err := m.getPartition(req.PartitionID)
 	if err != nil {
-		p.PackErrorWithBody(proto.OpNotExistErr, nil)
+		p.PackErrorWithCode(proto.ErrCodePartitionNotExist, err.Error())
 		m.respondToClient(conn, p)
 		err = errors.Errorf("%s, response to client: %s", err.Error(),
 			p.GetResultMesg())
 		return
 	}
+	if !m.checkCaller(conn, mp, p, req.Caller) {
+		return
+	}
 	if !m.serveProxy(conn, mp, p) {
 		return
 	}
-	err = mp.ExtentAppend(req, p)
+	req.Caller = m.callerOf(mp, req.Caller)
+	err = mp.ExtentAppend(req, m.limits.maxFileSize(mp.GetBaseConfig().VolName), p)
+	if p.ResultCode == proto.OpOk {
+		m.leases.invalidate(req.SessionID, req.PartitionID, req.Inode)
+	}
 	m.respondToClient(conn, p)
 	if err != nil {
 		log.LogErrorf("[opMetaExtentsAdd] ExtentAppend: %s, "+
@@ -493,13 +948,17 @@ func (m *metaManager) opMetaExtentsList(conn net.Conn, p *Packet) (err error) {
 	}
 	mp, err := m.getPartition(req.PartitionID)
 	if err != nil {
-		p.PackErrorWithBody(proto.OpNotExistErr, nil)
+		p.PackErrorWithCode(proto.ErrCodePartitionNotExist, err.Error())
 		m.respondToClient(conn, p)
 		return
 	}
+	if !m.checkCaller(conn, mp, p, req.Caller) {
+		return
+	}
 	if !m.serveProxy(conn, mp, p) {
 		return
 	}
+	req.Caller = m.callerOf(mp, req.Caller)
 
 	err = mp.ExtentsList(req, p)
 	m.respondToClient(conn, p)
@@ -508,6 +967,53 @@ func (m *metaManager) opMetaExtentsList(conn net.Conn, p *Packet) (err error) {
 	return
 }
 
+func (m *metaManager) opMetaExtentsReplace(conn net.Conn, p *Packet) (err error) {
+	req := &proto.ReplaceExtentKeysRequest{}
+	if err = json.Unmarshal(p.Data, req); err != nil {
+		p.PackErrorWithBody(proto.OpErr, nil)
+		m.respondToClient(conn, p)
+		return
+	}
+	mp, err := m.getPartition(req.PartitionID)
+	if err != nil {
+		p.PackErrorWithCode(proto.ErrCodePartitionNotExist, err.Error())
+		m.respondToClient(conn, p)
+		return
+	}
+	if !m.serveProxy(conn, mp, p) {
+		return
+	}
+	err = mp.ExtentsReplace(req, p)
+	if p.ResultCode == proto.OpOk {
+		m.leases.invalidate("", req.PartitionID, req.Inode)
+	}
+	m.respondToClient(conn, p)
+	log.LogDebugf("[opMetaExtentsReplace] req: %v, resp: %v", req, p.GetResultMesg())
+	return
+}
+
+func (m *metaManager) opMetaListOrphans(conn net.Conn, p *Packet) (err error) {
+	req := &proto.ListOrphansRequest{}
+	if err = json.Unmarshal(p.Data, req); err != nil {
+		p.PackErrorWithBody(proto.OpErr, nil)
+		m.respondToClient(conn, p)
+		return
+	}
+	mp, err := m.getPartition(req.PartitionID)
+	if err != nil {
+		p.PackErrorWithCode(proto.ErrCodePartitionNotExist, err.Error())
+		m.respondToClient(conn, p)
+		return
+	}
+	if !m.serveProxy(conn, mp, p) {
+		return
+	}
+	err = mp.ListOrphans(req, p)
+	m.respondToClient(conn, p)
+	log.LogDebugf("[opMetaListOrphans] req: %v, resp: %v", req, p.GetResultMesg())
+	return
+}
+
 func (m *metaManager) opMetaExtentsDel(conn net.Conn, p *Packet) (err error) {
 	// TODO: not implement yet
 	panic("not implement yet")
@@ -522,15 +1028,23 @@ func (m *metaManager) opMetaExtentsTruncate(conn net.Conn, p *Packet) (err error
 	}
 	mp, err := m.getPartition(req.PartitionID)
 	if err != nil {
-		p.PackErrorWithBody(proto.OpNotExistErr, nil)
+		p.PackErrorWithCode(proto.ErrCodePartitionNotExist, err.Error())
 		m.respondToClient(conn, p)
 		return
 	}
+	if !m.checkCaller(conn, mp, p, req.Caller) {
+		return
+	}
 	if !m.serveProxy(conn, mp, p) {
 		return
 	}
+	req.Caller = m.callerOf(mp, req.Caller)
 	mp.ExtentsTruncate(req, p)
+	if p.ResultCode == proto.OpOk {
+		m.leases.invalidate(req.SessionID, req.PartitionID, req.Inode)
+	}
 	m.respondToClient(conn, p)
+	m.auditOp(mp, p, &audit.MetaEntry{Inode: req.Inode})
 	return
 }
 
@@ -557,7 +1071,7 @@ func (m *metaManager) opDeleteMetaPartition(conn net.Conn, p *Packet) (err error
 	}
 	mp, err := m.getPartition(req.PartitionID)
 	if err != nil {
-		p.PackErrorWithBody(proto.OpNotExistErr, nil)
+		p.PackErrorWithCode(proto.ErrCodePartitionNotExist, err.Error())
 		m.respondToClient(conn, p)
 		return
 	}
@@ -609,7 +1123,7 @@ func (m *metaManager) opUpdateMetaPartition(conn net.Conn, p *Packet) (err error
 	}
 	mp, err := m.getPartition(req.PartitionID)
 	if err != nil {
-		p.PackErrorWithBody(proto.OpErr, nil)
+		p.PackErrorWithResult(proto.OpErr, proto.ErrCodePartitionNotExist, err.Error())
 		m.respondToClient(conn, p)
 		return
 	}
@@ -659,6 +1173,7 @@ func (m *metaManager) opLoadMetaPartition(conn net.Conn, p *Packet) (err error)
 	if err != nil {
 		resp.Status = proto.OpErr
 		resp.Result = err.Error()
+		resp.ErrCode = proto.ErrCodePartitionNotExist
 		adminTask.Response = resp
 		adminTask.Request = nil
 		m.respondToMaster(adminTask)
@@ -703,7 +1218,7 @@ func (m *metaManager) opOfflineMetaPartition(conn net.Conn, p *Packet) (err erro
 	}
 	mp, err := m.getPartition(req.PartitionID)
 	if err != nil {
-		p.PackErrorWithBody(proto.OpErr, nil)
+		p.PackErrorWithResult(proto.OpErr, proto.ErrCodePartitionNotExist, err.Error())
 		m.respondToClient(conn, p)
 		return
 	}
@@ -719,18 +1234,21 @@ func (m *metaManager) opOfflineMetaPartition(conn net.Conn, p *Packet) (err erro
 	if req.AddPeer.ID == req.RemovePeer.ID {
 		err = errors.Errorf("[opOfflineMetaPartition]: AddPeer[%v] same withRemovePeer[%v]", req.AddPeer, req.RemovePeer)
 		resp.Result = err.Error()
+		resp.ErrCode = proto.ErrCodeArgMismatch
 		goto end
 	}
 	_, err = mp.ChangeMember(raftProto.ConfAddNode,
 		raftProto.Peer{ID: req.AddPeer.ID}, reqData)
 	if err != nil {
 		resp.Result = err.Error()
+		resp.ErrCode = errCodeOf(err)
 		goto end
 	}
 	_, err = mp.ChangeMember(raftProto.ConfRemoveNode,
 		raftProto.Peer{ID: req.RemovePeer.ID}, reqData)
 	if err != nil {
 		resp.Result = err.Error()
+		resp.ErrCode = errCodeOf(err)
 		goto end
 	}
 	resp.Status = proto.TaskSuccess
@@ -750,12 +1268,120 @@ func (m *metaManager) opMetaBatchInodeGet(conn net.Conn, p *Packet) (err error)
 	}
 	mp, err := m.getPartition(req.PartitionID)
 	if err != nil {
-		p.PackErrorWithBody(proto.OpNotExistErr, nil)
+		p.PackErrorWithCode(proto.ErrCodePartitionNotExist, err.Error())
 		return
 	}
+	// the batch gets are served by the followers too, only the leader leases
+	if _, isLeader := mp.IsLeader(); isLeader && req.SessionID != "" {
+		m.leases.grant(req.SessionID, req.PartitionID, req.LeaseSeconds, partitionInodes(mp, req.Inodes)...)
+	}
 	err = mp.InodeGetBatch(req, p)
 	m.respondToClient(conn, p)
 	log.LogDebugf("[opMetaBatchInodeGet] req[%v], resp[%v], body: %s", req,
 		p.GetResultMesg(), p.Data)
 	return
 }
+
+func (m *metaManager) opTxPrepare(conn net.Conn, p *Packet) (err error) {
+	req := &proto.TxPrepareRequest{}
+	if err = json.Unmarshal(p.Data, req); err != nil {
+		p.PackErrorWithBody(proto.OpErr, nil)
+		m.respondToClient(conn, p)
+		err = errors.Errorf("[opTxPrepare]: %s", err.Error())
+		return
+	}
+	mp, err := m.getPartition(req.PartitionID)
+	if err != nil {
+		p.PackErrorWithCode(proto.ErrCodePartitionNotExist, err.Error())
+		m.respondToClient(conn, p)
+		err = errors.Errorf("[opTxPrepare] %s, req: %s", err.Error(), string(p.Data))
+		return
+	}
+	if !m.checkCaller(conn, mp, p, req.Caller) {
+		return
+	}
+	if !m.serveProxy(conn, mp, p) {
+		return
+	}
+	req.Caller = m.callerOf(mp, req.Caller)
+	err = mp.TxPrepare(req, p)
+	m.respondToClient(conn, p)
+	m.auditOp(mp, p, &audit.MetaEntry{Parent: req.ParentID, Name: req.Name, Path: req.Path, Inode: req.Inode, Mode: req.Mode, TxID: req.TxID, TxOp: txOpName(req.Op)})
+	log.LogDebugf("[opTxPrepare] req: %v; resp: %v, body: %s", req, p.GetResultMesg(), p.Data)
+	return
+}
+
+func (m *metaManager) opTxCommit(conn net.Conn, p *Packet) (err error) {
+	req := &proto.TxRequest{}
+	if err = json.Unmarshal(p.Data, req); err != nil {
+		p.PackErrorWithBody(proto.OpErr, nil)
+		m.respondToClient(conn, p)
+		err = errors.Errorf("[opTxCommit]: %s", err.Error())
+		return
+	}
+	mp, err := m.getPartition(req.PartitionID)
+	if err != nil {
+		p.PackErrorWithCode(proto.ErrCodePartitionNotExist, err.Error())
+		m.respondToClient(conn, p)
+		err = errors.Errorf("[opTxCommit] %s, req: %s", err.Error(), string(p.Data))
+		return
+	}
+	if !m.serveProxy(conn, mp, p) {
+		return
+	}
+	err = mp.TxCommit(req, p)
+	m.respondToClient(conn, p)
+	m.auditOp(mp, p, &audit.MetaEntry{TxID: req.TxID})
+	log.LogDebugf("[opTxCommit] req: %v; resp: %v", req, p.GetResultMesg())
+	return
+}
+
+func (m *metaManager) opTxAbort(conn net.Conn, p *Packet) (err error) {
+	req := &proto.TxRequest{}
+	if err = json.Unmarshal(p.Data, req); err != nil {
+		p.PackErrorWithBody(proto.OpErr, nil)
+		m.respondToClient(conn, p)
+		err = errors.Errorf("[opTxAbort]: %s", err.Error())
+		return
+	}
+	mp, err := m.getPartition(req.PartitionID)
+	if err != nil {
+		p.PackErrorWithCode(proto.ErrCodePartitionNotExist, err.Error())
+		m.respondToClient(conn, p)
+		err = errors.Errorf("[opTxAbort] %s, req: %s", err.Error(), string(p.Data))
+		return
+	}
+	if !m.serveProxy(conn, mp, p) {
+		return
+	}
+	err = mp.TxAbort(req, p)
+	m.respondToClient(conn, p)
+	m.auditOp(mp, p, &audit.MetaEntry{TxID: req.TxID})
+	log.LogDebugf("[opTxAbort] req: %v; resp: %v", req, p.GetResultMesg())
+	return
+}
+
+// the status of a transaction asked by the other partitions of it
+func (m *metaManager) opTxStatus(conn net.Conn, p *Packet) (err error) {
+	req := &proto.TxRequest{}
+	if err = json.Unmarshal(p.Data, req); err != nil {
+		p.PackErrorWithBody(proto.OpErr, nil)
+		m.respondToClient(conn, p)
+		err = errors.Errorf("[opTxStatus]: %s", err.Error())
+		return
+	}
+	mp, err := m.getPartition(req.PartitionID)
+	if err != nil {
+		p.PackErrorWithCode(proto.ErrCodePartitionNotExist, err.Error())
+		m.respondToClient(conn, p)
+		err = errors.Errorf("[opTxStatus] %s, req: %s", err.Error(), string(p.Data))
+		return
+	}
+	if !m.serveProxy(conn, mp, p) {
+		return
+	}
+	err = mp.TxStatus(req, p)
+	m.respondToClient(conn, p)
+	log.LogDebugf("[opTxStatus] req: %v; resp: %v, body: %s", req, p.GetResultMesg(), p.Data)
+	return
+}
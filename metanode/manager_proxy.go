@@ -29,7 +29,7 @@ const (
 func (m *metaManager) serveProxy(conn net.Conn, mp MetaPartition,
 	p *Packet) (ok bool) {
 	var (
-		mConn      *net.TCPConn
+		mConn      net.Conn
 		leaderAddr string
 		err        error
 	)
@@ -38,7 +38,7 @@ func (m *metaManager) serveProxy(conn net.Conn, mp MetaPartition,
 	}
 	if leaderAddr == "" {
 		err = ErrNonLeader
-		p.PackErrorWithBody(proto.OpAgain, []byte(err.Error()))
+		p.PackErrorWithCode(proto.ErrCodeNotLeader, err.Error())
 		goto end
 	}
 	// Get Master Conn
@@ -48,6 +48,8 @@ func (m *metaManager) serveProxy(conn net.Conn, mp MetaPartition,
 		m.connPool.Put(mConn, ForceCloseConnect)
 		goto end
 	}
+	// the leader audits the op for the client, not for this node
+	p.Arg, p.Arglen = []byte(p.client), uint32(len(p.client))
 	// Send Master Conn
 	if err = p.WriteToConn(mConn); err != nil {
 		p.PackErrorWithBody(proto.OpErr, []byte(err.Error()))
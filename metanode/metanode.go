@@ -16,6 +16,7 @@ package metanode
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -31,8 +32,13 @@ import (
 	"github.com/tiglabs/containerfs/proto"
 	"github.com/tiglabs/containerfs/raftstore"
 	"github.com/tiglabs/containerfs/util"
+	"github.com/tiglabs/containerfs/util/audit"
+	"github.com/tiglabs/containerfs/util/auth"
 	"github.com/tiglabs/containerfs/util/config"
+	"github.com/tiglabs/containerfs/util/gctuner"
 	"github.com/tiglabs/containerfs/util/log"
+	"github.com/tiglabs/containerfs/util/rpc"
+	"github.com/tiglabs/containerfs/util/slowop"
 	"github.com/tiglabs/containerfs/util/ump"
 )
 
@@ -50,7 +56,32 @@ type MetaNode struct {
 	raftStore         raftstore.RaftStore
 	raftHeartbeatPort string
 	raftReplicatePort string
+	zone              string // labels reported to the master for the meta partition placement
+	memClass          string
+	formatVersion     int    // the format of the inodes written
+	maxOpenFiles      int    // per client session
+	memoryBudget      uint64 // bytes the GOGC is tuned to, 0 leaves GOGC untouched
+	memoryBallast     uint64
+	extentRefInterval time.Duration // negative disables the extent reference reports
+	snapshotBandwidth int64         // bytes per second of the snapshots sent, not positive leaves them unpaced
+	snapshotBatchSize int           // bytes of items in a snapshot frame, 0 sends an item per frame
+	raftLogRetain     uint64        // raft log entries kept below the stored apply id
+	gcTuner           *gctuner.Tuner
+	fences            *util.ClientFences
+	tlsConfig         *tls.Config   // the master and the clients connect over TLS if it is set
+	auth              *auth.Checker // checks the connections against the vol tokens, disabled without auth key
+	grpc              bool          // serves gRPC besides the packet protocol on the listen port
+	auditLog          string        // file of the audit of the namespace mutations, empty disables the audit
+	auditLogMaxSize   int64
+	auditLogBackups   int
+	auditSink         string // URL the audit entries are posted to besides the file
+	slowOp            time.Duration
+	slowOps           map[string]time.Duration // thresholds of the ops overriding slowOp
+	slowOpWebhook     string
+	progress          LoadProgress // partitions loaded by the start of the meta manager
+	rpc               *rpc.Server
 	httpStopC         chan uint8
+	stopC             chan bool
 	state             uint32
 	wg                sync.WaitGroup
 }
@@ -89,9 +120,14 @@ func (m *MetaNode) Shutdown() {
 }
 
 func (m *MetaNode) onStart(cfg *config.Config) (err error) {
+	m.stopC = make(chan bool)
 	if err = m.parseConfig(cfg); err != nil {
 		return
 	}
+	m.gcTuner = gctuner.New(m.memoryBudget, m.memoryBallast)
+	m.gcTuner.Start()
+	// the probes are served on the prof port while the node registers and loads
+	m.registerHealth()
 	if err = m.register(); err != nil {
 		return
 	}
@@ -115,9 +151,13 @@ func (m *MetaNode) onStart(cfg *config.Config) (err error) {
 
 func (m *MetaNode) onShutdown() {
 	// Shutdown node and release resource.
+	close(m.stopC)
 	m.stopServer()
 	m.stopMetaManager()
 	m.stopRaftServer()
+	if m.gcTuner != nil {
+		m.gcTuner.Stop()
+	}
 }
 
 // Sync will block invoker goroutine until this MetaNode shutdown.
@@ -137,17 +177,79 @@ func (m *MetaNode) parseConfig(cfg *config.Config) (err error) {
 	m.raftDir = cfg.GetString(cfgRaftDir)
 	m.raftHeartbeatPort = cfg.GetString(cfgRaftHeartbeatPort)
 	m.raftReplicatePort = cfg.GetString(cfgRaftReplicatePort)
+	m.zone = cfg.GetString(cfgZone)
+	m.memClass = cfg.GetString(cfgMemClass)
+	m.formatVersion = metaFormatBase
+	if version := cfg.GetInt(cfgMetaFormatVersion); version != 0 {
+		m.formatVersion = int(version)
+	}
+	m.maxOpenFiles = int(cfg.GetInt(cfgMaxOpenFilesPerSession))
+	m.memoryBudget = uint64(cfg.GetInt(cfgMemoryBudget)) * util.MB
+	m.memoryBallast = uint64(cfg.GetInt(cfgMemoryBallast)) * util.MB
+	m.extentRefInterval = defaultExtentReferenceInterval
+	if minutes := cfg.GetInt(cfgExtentReferenceInterval); minutes != 0 {
+		m.extentRefInterval = time.Duration(minutes) * time.Minute
+	}
+	m.snapshotBandwidth = defaultSnapshotBandwidth
+	if mb := cfg.GetInt(cfgSnapshotBandwidth); mb != 0 {
+		m.snapshotBandwidth = mb * util.MB
+	}
+	m.snapshotBatchSize = int(cfg.GetInt(cfgSnapshotBatchSize)) * util.KB
+	m.raftLogRetain = defaultRaftLogRetain
+	if entries := cfg.GetInt(cfgRaftLogRetain); entries < 0 {
+		m.raftLogRetain = 0
+	} else if entries > 0 {
+		m.raftLogRetain = uint64(entries)
+	}
+	if m.tlsConfig, err = cfg.ServerTLSConfig(true); err != nil {
+		return
+	}
+	m.auth = auth.NewChecker(cfg.GetString(auth.AuthKey))
+	m.fences = util.NewClientFences()
+	m.grpc = cfg.GetBool(cfgGrpc)
+	m.auditLog = cfg.GetString(cfgAuditLog)
+	m.auditLogMaxSize = audit.DefaultMetaMaxSize
+	if mb := cfg.GetInt(cfgAuditLogMaxSize); mb != 0 {
+		m.auditLogMaxSize = mb * util.MB
+	}
+	m.auditLogBackups = audit.DefaultMetaBackups
+	if backups := cfg.GetInt(cfgAuditLogBackups); backups != 0 {
+		m.auditLogBackups = int(backups)
+	}
+	m.auditSink = cfg.GetString(cfgAuditSink)
+	m.slowOp = slowop.DefaultThreshold
+	if ms := cfg.GetInt(cfgSlowOpMs); ms != 0 {
+		m.slowOp = time.Duration(ms) * time.Millisecond
+	}
+	if m.slowOps, err = slowop.ParseThresholds(cfg.GetArray(cfgSlowOps)); err != nil {
+		return
+	}
+	m.slowOpWebhook = cfg.GetString(cfgSlowOpWebhook)
 
 	log.LogDebugf("action[parseConfig] load listen[%v].", m.listen)
 	log.LogDebugf("action[parseConfig] load metaDir[%v].", m.metaDir)
 	log.LogDebugf("action[parseConfig] load raftDir[%v].", m.raftDir)
 	log.LogDebugf("action[parseConfig] load raftHeartbeatPort[%v].", m.raftHeartbeatPort)
 	log.LogDebugf("action[parseConfig] load raftReplicatePort[%v].", m.raftReplicatePort)
+	log.LogDebugf("action[parseConfig] load maxOpenFilesPerSession[%v].", m.maxOpenFiles)
+	log.LogDebugf("action[parseConfig] load metaFormatVersion[%v].", m.formatVersion)
+	log.LogDebugf("action[parseConfig] load memoryBudget[%v] memoryBallast[%v].", m.memoryBudget, m.memoryBallast)
+	log.LogDebugf("action[parseConfig] load extentReferenceInterval[%v].", m.extentRefInterval)
+	log.LogDebugf("action[parseConfig] load snapshotBandwidth[%v] snapshotBatchSize[%v] raftLogRetain[%v].",
+		m.snapshotBandwidth, m.snapshotBatchSize, m.raftLogRetain)
+	log.LogDebugf("action[parseConfig] load tls[%v].", m.tlsConfig != nil)
+	log.LogDebugf("action[parseConfig] load auth[%v].", m.auth.Enabled())
+	log.LogDebugf("action[parseConfig] load grpc[%v].", m.grpc)
+	log.LogDebugf("action[parseConfig] load auditLog[%v] auditLogMaxSize[%v] auditLogBackups[%v] auditSink[%v].",
+		m.auditLog, m.auditLogMaxSize, m.auditLogBackups, m.auditSink)
+	log.LogDebugf("action[parseConfig] load slowOp[%v] slowOps[%v] slowOpWebhook[%v].",
+		m.slowOp, m.slowOps, m.slowOpWebhook)
 
 	addrs := cfg.GetArray(cfgMasterAddrs)
 	for _, addr := range addrs {
-		masterAddrs = append(masterAddrs, addr.(string))
+		masterCfgs = append(masterCfgs, addr.(string))
 	}
+	resolveMasterAddrs()
 	err = m.validConfig()
 	return
 }
@@ -163,24 +265,92 @@ func (m *MetaNode) validConfig() (err error) {
 	if m.raftDir == "" {
 		m.raftDir = defaultRaftDir
 	}
-	if len(masterAddrs) == 0 {
+	if len(getMasterAddrs()) == 0 {
 		err = errors.New("master address list is empty")
 		return
 	}
+	for _, addr := range masterCfgs {
+		if util.IsDomainAddr(addr) {
+			go resolveMasterScheduler(util.MasterResolveInterval, m.stopC)
+			break
+		}
+	}
 	return
 }
 
+func getMasterAddrs() []string {
+	masterLock.RLock()
+	defer masterLock.RUnlock()
+	return masterAddrs
+}
+
+// the resolver of the configured master addresses, swapped by the tests
+var resolveMasterAddr = util.ResolveMasterAddr
+
+// resolveMasterAddrs expand the configured master SRV records and DNS names
+// into master addresses, the previous addresses are kept if nothing resolved.
+func resolveMasterAddrs() {
+	addrs := make([]string, 0, len(masterCfgs))
+	for _, cfgAddr := range masterCfgs {
+		resolved, err := resolveMasterAddr(cfgAddr)
+		if err != nil {
+			log.LogWarnf("[resolveMasterAddrs] resolve master[%v]: %s", cfgAddr, err.Error())
+			continue
+		}
+		addrs = append(addrs, resolved...)
+	}
+	if len(addrs) == 0 {
+		return
+	}
+	masterLock.Lock()
+	masterAddrs = addrs
+	masterLock.Unlock()
+}
+
+/*resolve the configured master addresses every interval until the node stops*/
+func resolveMasterScheduler(interval time.Duration, stopC chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopC:
+			return
+		case <-ticker.C:
+			resolveMasterAddrs()
+		}
+	}
+}
+
 func (m *MetaNode) startMetaManager() (err error) {
 	if _, err = os.Stat(m.metaDir); err != nil {
 		if err = os.MkdirAll(m.metaDir, 0755); err != nil {
 			return
 		}
 	}
+	var auditLog *audit.MetaLogger
+	if m.auditLog != "" {
+		if auditLog, err = audit.NewMetaLogger(m.auditLog, m.auditLogMaxSize, m.auditLogBackups, m.auditSink); err != nil {
+			return
+		}
+	}
 	// Load metaManager
 	conf := MetaManagerConfig{
-		NodeID:    m.nodeId,
-		RootDir:   m.metaDir,
-		RaftStore: m.raftStore,
+		NodeID:                 m.nodeId,
+		RootDir:                m.metaDir,
+		RaftStore:              m.raftStore,
+		MaxOpenFilesPerSession: m.maxOpenFiles,
+		ExtentRefInterval:      m.extentRefInterval,
+		SnapshotBandwidth:      m.snapshotBandwidth,
+		SnapshotBatchSize:      m.snapshotBatchSize,
+		RaftLogRetain:          m.raftLogRetain,
+		Auth:                   m.auth,
+		Fences:                 m.fences,
+		Zone:                   m.zone,
+		MemClass:               m.memClass,
+		FormatVersion:          m.formatVersion,
+		AuditLog:               auditLog,
+		SlowOps:                slowop.NewDetector("metanode", util.JoinHostPort(m.localAddr, m.listen), m.slowOp, m.slowOps, m.slowOpWebhook),
+		Progress:               &m.progress,
 	}
 	m.metaManager = NewMetaManager(conf)
 	err = m.metaManager.Start()
@@ -212,7 +382,7 @@ func (m *MetaNode) register() (err error) {
 }
 
 func (m *MetaNode) postNodeID() (err error) {
-	reqPath := fmt.Sprintf("%s?addr=%s:%s", metaNodeURL, m.localAddr, m.listen)
+	reqPath := fmt.Sprintf("%s?addr=%s", metaNodeURL, util.JoinHostPort(m.localAddr, m.listen))
 	msg, err := postToMaster("POST", reqPath, nil)
 	if err != nil {
 		err = errors.Errorf("[postNodeID] %s", err.Error())
@@ -233,12 +403,18 @@ func postToMaster(method string, reqPath string, body []byte) (msg []byte,
 		req  *http.Request
 		resp *http.Response
 	)
-	client := &http.Client{Timeout: 2 * time.Second}
-	for _, maddr := range masterAddrs {
+	client := util.NewMasterClient(2 * time.Second)
+	defer func() {
+		// masters may have been replaced, resolve again for the next request.
+		if err != nil {
+			resolveMasterAddrs()
+		}
+	}()
+	for _, maddr := range getMasterAddrs() {
 		if curMasterAddr == "" {
 			curMasterAddr = maddr
 		}
-		reqURL := fmt.Sprintf("http://%s%s", curMasterAddr, reqPath)
+		reqURL := util.MasterURL(curMasterAddr, reqPath)
 		reqBody := bytes.NewBuffer(body)
 		req, err = http.NewRequest(method, reqURL, reqBody)
 		if err != nil {
@@ -280,13 +456,8 @@ func postToMaster(method string, reqPath string, body []byte) (msg []byte,
 }
 
 func (m *MetaNode) startUMP() (err error) {
-	defaultTimeout := http.DefaultClient.Timeout
-	defer func() {
-		http.DefaultClient.Timeout = defaultTimeout
-	}()
 	// Get cluster name from master
-	http.DefaultClient.Timeout = 2 * time.Second
-	resp, err := http.Get(fmt.Sprintf("http://%s%s", curMasterAddr, metaNodeGetName))
+	resp, err := util.NewMasterClient(2 * time.Second).Get(util.MasterURL(curMasterAddr, metaNodeGetName))
 	if err != nil {
 		err = errors.Errorf("[startUMP]: %s", err.Error())
 		return
@@ -30,8 +30,34 @@ func (m *MetaNode) registerHandler() (err error) {
 	http.HandleFunc("/getInodeRange", m.rangeHandle)
 	http.HandleFunc("/getExtents", m.getExtents)
 	http.HandleFunc("/getDentry", m.getDentryHandle)
+	http.HandleFunc("/getOpenFiles", m.openFilesHandle)
+	http.HandleFunc("/getFileLocks", m.fileLocksHandle)
+	m.registerMetrics()
 	return
 }
+
+func (m *MetaNode) openFilesHandle(w http.ResponseWriter, r *http.Request) {
+	mm := m.metaManager.(*metaManager)
+	data, err := json.Marshal(mm.openFiles.stats())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write(data)
+}
+
+func (m *MetaNode) fileLocksHandle(w http.ResponseWriter, r *http.Request) {
+	mm := m.metaManager.(*metaManager)
+	data, err := json.Marshal(mm.fileLocks.stats())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write(data)
+}
+
 func (m *MetaNode) allPartitionsHandle(w http.ResponseWriter, r *http.Request) {
 	mm := m.metaManager.(*metaManager)
 	data, err := mm.PartitionsMarshalJSON()
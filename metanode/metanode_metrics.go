@@ -0,0 +1,95 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tiglabs/containerfs/util/metrics"
+)
+
+// opMetrics keeps the latency histogram of each operation served by the
+// meta manager, keyed by the op message of the packet.
+type opMetrics struct {
+	latency sync.Map
+}
+
+func (o *opMetrics) observe(op string, latency time.Duration) {
+	h, ok := o.latency.Load(op)
+	if !ok {
+		h, _ = o.latency.LoadOrStore(op, metrics.NewHistogram(metrics.DefaultLatencyBuckets))
+	}
+	h.(*metrics.Histogram).Observe(latency.Seconds())
+}
+
+func (o *opMetrics) collect(w *metrics.Writer) {
+	o.latency.Range(func(op, h interface{}) bool {
+		w.Histogram("metanode_op_latency_seconds", "Latency of meta operation.", h.(*metrics.Histogram), "op", op.(string))
+		return true
+	})
+}
+
+func (m *MetaNode) registerMetrics() {
+	registry := metrics.NewRegistry("metanode")
+	registry.Register(m.collectMetrics)
+	http.Handle(metrics.MetricsPath, registry)
+}
+
+func (m *MetaNode) collectMetrics(w *metrics.Writer) {
+	if m.gcTuner != nil {
+		w.Gauge("metanode_gc_percent", "GOGC set by the memory budget.", float64(m.gcTuner.GCPercent()))
+	}
+	mm, ok := m.metaManager.(*metaManager)
+	if !ok {
+		return
+	}
+	mm.opMetrics.collect(w)
+	mm.slowOps.Range(func(op string, count uint64) {
+		w.Counter("metanode_slow_ops_total", "Meta operations served slower than their threshold.", float64(count), "op", op)
+	})
+	w.Counter("metanode_slow_op_alerts_dropped_total", "Alerts of the slow ops the webhook did not get.", float64(mm.slowOps.Dropped()))
+	sessions := mm.openFiles.stats()
+	var opens int
+	for _, s := range sessions {
+		opens += s.OpenFiles
+	}
+	w.Gauge("metanode_open_sessions", "Client sessions holding open files.", float64(len(sessions)))
+	w.Gauge("metanode_open_files", "Open file handles of all client sessions.", float64(opens))
+	leasedInodes, leaseSessions := mm.leases.count()
+	w.Gauge("metanode_cache_lease_sessions", "Client sessions leasing the caches of inodes.", float64(leaseSessions))
+	w.Gauge("metanode_cache_lease_inodes", "Inodes cached by client sessions with a lease.", float64(leasedInodes))
+
+	mm.Range(func(id uint64, p MetaPartition) bool {
+		mp, ok := p.(*metaPartition)
+		if !ok || mp.raftPartition == nil {
+			return true
+		}
+		pid := strconv.FormatUint(id, 10)
+		vol := mp.config.VolName
+		_, isLeader := mp.IsLeader()
+		_, term := mp.raftPartition.LeaderTerm()
+		w.Gauge("metanode_partition_leader", "Whether the node leads the meta partition.", metrics.Bool(isLeader), "partition", pid, "vol", vol)
+		w.Gauge("metanode_partition_raft_term", "Raft term of the meta partition.", float64(term), "partition", pid, "vol", vol)
+		w.Gauge("metanode_partition_raft_applied", "Applied raft index of the meta partition.", float64(mp.raftPartition.AppliedIndex()), "partition", pid, "vol", vol)
+		w.Gauge("metanode_partition_inodes", "Inodes of the meta partition.", float64(mp.inodeTree.Len()), "partition", pid, "vol", vol)
+		w.Gauge("metanode_partition_dentries", "Dentries of the meta partition.", float64(mp.dentryTree.Len()), "partition", pid, "vol", vol)
+		w.Gauge("metanode_partition_cursor", "Max inode allocated by the meta partition.", float64(mp.GetCursor()), "partition", pid, "vol", vol)
+		w.Gauge("metanode_partition_delete_queue_inodes", "Unlinked inodes of the meta partition whose extents are not deleted yet.", float64(mp.freeList.Len()), "partition", pid, "vol", vol)
+		return true
+	})
+}
@@ -18,9 +18,13 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/tiglabs/containerfs/util"
 	"github.com/tiglabs/containerfs/util/config"
 	"github.com/tiglabs/containerfs/util/log"
 )
@@ -101,3 +105,56 @@ func Test_parseConfig(t *testing.T) {
 	}
 
 }
+
+func TestResolveMasterScheduler(t *testing.T) {
+	var lock sync.Mutex
+	resolved := []string{"10.0.0.1:17010", "10.0.0.2:17010"}
+	setResolved := func(addrs ...string) {
+		lock.Lock()
+		resolved = addrs
+		lock.Unlock()
+	}
+	resolveMasterAddr = func(addr string) ([]string, error) {
+		if !util.IsDomainAddr(addr) {
+			return []string{addr}, nil
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		return resolved, nil
+	}
+	orgCfgs, orgAddrs := masterCfgs, getMasterAddrs()
+	defer func() {
+		resolveMasterAddr = util.ResolveMasterAddr
+		masterCfgs = orgCfgs
+		masterAddrs = orgAddrs
+	}()
+	masterCfgs = []string{"10.0.0.9:17010", "master.test:17010"}
+	resolveMasterAddrs()
+	waitMasters := func(expect []string) {
+		for i := 0; i < 100 && !reflect.DeepEqual(getMasterAddrs(), expect); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if addrs := getMasterAddrs(); !reflect.DeepEqual(addrs, expect) {
+			t.Fatalf("masters %v expect %v", addrs, expect)
+		}
+	}
+	waitMasters([]string{"10.0.0.9:17010", "10.0.0.1:17010", "10.0.0.2:17010"})
+
+	stopC := make(chan bool)
+	done := make(chan struct{})
+	go func() {
+		resolveMasterScheduler(10*time.Millisecond, stopC)
+		close(done)
+	}()
+	setResolved("10.0.0.3:17010")
+	waitMasters([]string{"10.0.0.9:17010", "10.0.0.3:17010"})
+	close(stopC)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("resolve not stopped by the stop channel")
+	}
+	setResolved("10.0.0.4:17010")
+	time.Sleep(50 * time.Millisecond)
+	waitMasters([]string{"10.0.0.9:17010", "10.0.0.3:17010"})
+}
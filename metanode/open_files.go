@@ -0,0 +1,172 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// SessionOpenFiles is the number of handles a client session holds on the
+// partitions led by this node.
+type SessionOpenFiles struct {
+	SessionID  string
+	OpenFiles  int
+	Refused    uint64
+	LastActive int64
+}
+
+// inodes of different vols may have the same number, so the partition is
+// part of the key.
+type openKey struct {
+	partitionID uint64
+	ino         uint64
+}
+
+type sessionOpens struct {
+	opens map[openKey]int // handles of the inode
+	SessionOpenFiles
+}
+
+// openFiles accounts the open handles per client session, the counts are
+// kept in the memory of the partition leaders only, so they restart from
+// zero after a leader change.
+type openFiles struct {
+	limit    int
+	sessions map[string]*sessionOpens
+	inodes   map[openKey]int // handles of the inode of all sessions
+	sync.Mutex
+}
+
+func newOpenFiles(limit int) *openFiles {
+	if limit <= 0 {
+		limit = defaultMaxOpenFilesPerSession
+	}
+	return &openFiles{
+		limit:    limit,
+		sessions: make(map[string]*sessionOpens),
+		inodes:   make(map[openKey]int),
+	}
+}
+
+// open account a handle of the inode, the requests of old clients without
+// the session are not accounted.
+func (o *openFiles) open(sessionID string, partitionID, ino uint64) (err error) {
+	if sessionID == "" {
+		return
+	}
+	o.Lock()
+	defer o.Unlock()
+	s, ok := o.sessions[sessionID]
+	if !ok {
+		s = &sessionOpens{opens: make(map[openKey]int)}
+		s.SessionID = sessionID
+		o.sessions[sessionID] = s
+	}
+	s.LastActive = time.Now().Unix()
+	if s.OpenFiles >= o.limit {
+		s.Refused++
+		return ErrTooManyOpenFiles
+	}
+	key := openKey{partitionID: partitionID, ino: ino}
+	s.opens[key]++
+	s.OpenFiles++
+	o.inodes[key]++
+	return
+}
+
+func (o *openFiles) release(sessionID string, partitionID, ino uint64) {
+	if sessionID == "" {
+		return
+	}
+	o.Lock()
+	defer o.Unlock()
+	s, ok := o.sessions[sessionID]
+	if !ok {
+		return
+	}
+	s.LastActive = time.Now().Unix()
+	key := openKey{partitionID: partitionID, ino: ino}
+	if s.opens[key] == 0 {
+		return
+	}
+	s.releaseAll(key, 1, o.inodes)
+}
+
+// releaseAll drop n handles of the key held by the session.
+func (s *sessionOpens) releaseAll(key openKey, n int, inodes map[openKey]int) {
+	s.opens[key] -= n
+	s.OpenFiles -= n
+	if s.opens[key] <= 0 {
+		delete(s.opens, key)
+	}
+	inodes[key] -= n
+	if inodes[key] <= 0 {
+		delete(inodes, key)
+	}
+}
+
+// isOpen return if any session holds a handle of the inode.
+func (o *openFiles) isOpen(partitionID, ino uint64) bool {
+	o.Lock()
+	defer o.Unlock()
+	return o.inodes[openKey{partitionID: partitionID, ino: ino}] > 0
+}
+
+// touch mark the sessions active, they are the sessions reported to master
+// by the mounted clients.
+func (o *openFiles) touch(sessionIDs []string) {
+	o.Lock()
+	defer o.Unlock()
+	now := time.Now().Unix()
+	for _, id := range sessionIDs {
+		if s, ok := o.sessions[id]; ok {
+			s.LastActive = now
+		}
+	}
+}
+
+// expire drop the sessions not active for the timeout with their handles,
+// their clients are considered gone.
+func (o *openFiles) expire(timeout time.Duration) {
+	o.Lock()
+	defer o.Unlock()
+	now := time.Now().Unix()
+	for id, s := range o.sessions {
+		if now-s.LastActive <= int64(timeout/time.Second) {
+			continue
+		}
+		for key, n := range s.opens {
+			s.releaseAll(key, n, o.inodes)
+		}
+		delete(o.sessions, id)
+	}
+}
+
+// stats return the sessions sorted by open handles, the most first.
+func (o *openFiles) stats() (stats []*SessionOpenFiles) {
+	o.Lock()
+	defer o.Unlock()
+	stats = make([]*SessionOpenFiles, 0, len(o.sessions))
+	for _, s := range o.sessions {
+		stat := s.SessionOpenFiles
+		stats = append(stats, &stat)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].OpenFiles > stats[j].OpenFiles
+	})
+	return
+}
@@ -18,6 +18,9 @@ import "github.com/tiglabs/containerfs/proto"
 
 type Packet struct {
 	proto.Packet
+	// ip of the client of a request and of the meta node that proxied it,
+	// taken from the request before it is replaced by the reply
+	client, proxy string
 }
 
 // For send delete request to dataNode
@@ -35,3 +38,17 @@ func NewExtentDeletePacket(dp *DataPartition, extentId uint64) *Packet {
 
 	return p
 }
+
+// For send the extents referenced by a meta partition to the leader of dataNode
+func NewExtentReferencesPacket(dp *DataPartition, data []byte) *Packet {
+	p := new(Packet)
+	p.Magic = proto.ProtoMagic
+	p.Opcode = proto.OpExtentReferences
+	p.StoreMode = proto.ExtentStoreMode
+	p.PartitionID = dp.PartitionID
+	p.ReqID = proto.GetReqID()
+	p.Data = data
+	p.Size = uint32(len(data))
+
+	return p
+}
@@ -16,14 +16,16 @@ package metanode
 
 import (
 	"encoding/json"
+	"net"
 	"sort"
 	"strconv"
-	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/juju/errors"
 	"github.com/tiglabs/containerfs/proto"
 	"github.com/tiglabs/containerfs/raftstore"
+	"github.com/tiglabs/containerfs/util"
 	"github.com/tiglabs/containerfs/util/log"
 	"github.com/tiglabs/containerfs/util/pool"
 	raftproto "github.com/tiglabs/raft/proto"
@@ -74,6 +76,14 @@ type MetaPartitionConfig struct {
 	AfterStop   func()              `json:"-"`
 	RaftStore   raftstore.RaftStore `json:"-"`
 	ConnPool    *pool.ConnectPool   `json:"-"`
+	OpenFiles   *openFiles          `json:"-"`
+	FileLocks   *fileLocks          `json:"-"`
+	Leases      *cacheLeases        `json:"-"`
+	Snapshots   *snapshotSender     `json:"-"`
+	Permission  *volPermission      `json:"-"`
+
+	ExtentRefInterval time.Duration `json:"-"`
+	RaftLogRetain     uint64        `json:"-"`
 }
 
 func (c *MetaPartitionConfig) Dump() ([]byte, error) {
@@ -119,7 +129,11 @@ type OpInode interface {
 	Open(req *OpenReq, p *Packet) (err error)
 	CreateLinkInode(req *LinkInodeReq, p *Packet) (err error)
 	EvictInode(req *EvictInodeReq, p *Packet) (err error)
-	SetAttr(reqData []byte, p *Packet) (err error)
+	SetAttr(req *SetattrRequest, p *Packet) (err error)
+	SetXAttr(req *proto.SetXAttrRequest, p *Packet) (err error)
+	GetXAttr(req *proto.GetXAttrRequest, p *Packet) (err error)
+	ListXAttr(req *proto.ListXAttrRequest, p *Packet) (err error)
+	RemoveXAttr(req *proto.RemoveXAttrRequest, p *Packet) (err error)
 }
 
 type OpDentry interface {
@@ -128,11 +142,17 @@ type OpDentry interface {
 	UpdateDentry(req *UpdateDentryReq, p *Packet) (err error)
 	ReadDir(req *ReadDirReq, p *Packet) (err error)
 	Lookup(req *LookupReq, p *Packet) (err error)
+	TxPrepare(req *proto.TxPrepareRequest, p *Packet) (err error)
+	TxCommit(req *proto.TxRequest, p *Packet) (err error)
+	TxAbort(req *proto.TxRequest, p *Packet) (err error)
+	TxStatus(req *proto.TxRequest, p *Packet) (err error)
 }
 
 type OpExtent interface {
-	ExtentAppend(req *proto.AppendExtentKeyRequest, p *Packet) (err error)
+	ExtentAppend(req *proto.AppendExtentKeyRequest, maxFileSize uint64, p *Packet) (err error)
 	ExtentsList(req *proto.GetExtentsRequest, p *Packet) (err error)
+	ExtentsReplace(req *proto.ReplaceExtentKeysRequest, p *Packet) (err error)
+	ListOrphans(req *proto.ListOrphansRequest, p *Packet) (err error)
 	ExtentsTruncate(req *ExtentsTruncateReq, p *Packet) (err error)
 }
 
@@ -146,6 +166,8 @@ type OpMeta interface {
 type OpPartition interface {
 	IsLeader() (leaderAddr string, isLeader bool)
 	GetCursor() uint64
+	GetInodeCount() uint64
+	GetUsage() (files, bytes uint64, time int64)
 	GetBaseConfig() MetaPartitionConfig
 	StoreMeta() (err error)
 	ChangeMember(changeType raftproto.ConfChangeType, peer raftproto.Peer, context []byte) (resp interface{}, err error)
@@ -178,6 +200,11 @@ type metaPartition struct {
 	state         uint32
 	freeList      *freeList // Free inode list
 	vol           *Vol
+	deferDeletes  map[uint64]int64 // unlinked inodes still open -> first deferred time, used by deleteWorker only
+	txs           *txTable         // rename transactions of the dentries
+	usageFiles    uint64           // regular files aggregated by usageWorker
+	usageBytes    uint64
+	usageTime     int64
 }
 
 func (mp *metaPartition) Start() (err error) {
@@ -234,6 +261,7 @@ func (mp *metaPartition) onStart() (err error) {
 	}
 	mp.startSchedule(mp.applyID)
 	mp.startFreeList()
+	go mp.txResolveWorker()
 	return
 }
 
@@ -252,7 +280,7 @@ func (mp *metaPartition) startRaft() (err error) {
 		return
 	}
 	for _, peer := range mp.config.Peers {
-		addr := strings.Split(peer.Addr, ":")[0]
+		addr := util.GetHost(peer.Addr)
 		rp := raftstore.PeerAddress{
 			Peer: raftproto.Peer{
 				ID: peer.ID,
@@ -284,21 +312,21 @@ func (mp *metaPartition) stopRaft() {
 
 func (mp *metaPartition) getRaftPort() (heartbeat, replicate int, err error) {
 	raftConfig := mp.config.RaftStore.RaftConfig()
-	heartbeatAddrParts := strings.Split(raftConfig.HeartbeatAddr, ":")
-	replicateAddrParts := strings.Split(raftConfig.ReplicateAddr, ":")
-	if len(heartbeatAddrParts) != 2 {
+	_, heartbeatPort, e := net.SplitHostPort(raftConfig.HeartbeatAddr)
+	if e != nil {
 		err = ErrIllegalHeartbeatAddress
 		return
 	}
-	if len(replicateAddrParts) != 2 {
+	_, replicatePort, e := net.SplitHostPort(raftConfig.ReplicateAddr)
+	if e != nil {
 		err = ErrIllegalReplicateAddress
 		return
 	}
-	heartbeat, err = strconv.Atoi(heartbeatAddrParts[1])
+	heartbeat, err = strconv.Atoi(heartbeatPort)
 	if err != nil {
 		return
 	}
-	replicate, err = strconv.Atoi(replicateAddrParts[1])
+	replicate, err = strconv.Atoi(replicatePort)
 	if err != nil {
 		return
 	}
@@ -308,13 +336,15 @@ func (mp *metaPartition) getRaftPort() (heartbeat, replicate int, err error) {
 // NewMetaPartition create and init a new meta partition with specified configuration.
 func NewMetaPartition(conf *MetaPartitionConfig) MetaPartition {
 	mp := &metaPartition{
-		config:     conf,
-		dentryTree: NewBtree(),
-		inodeTree:  NewBtree(),
-		stopC:      make(chan bool),
-		storeChan:  make(chan *storeMsg, 5),
-		freeList:   newFreeList(),
-		vol:        NewVol(),
+		config:       conf,
+		dentryTree:   NewBtree(),
+		inodeTree:    NewBtree(),
+		stopC:        make(chan bool),
+		storeChan:    make(chan *storeMsg, 5),
+		freeList:     newFreeList(),
+		vol:          NewVol(),
+		deferDeletes: make(map[uint64]int64),
+		txs:          newTxTable(),
 	}
 	return mp
 }
@@ -338,6 +368,10 @@ func (mp *metaPartition) GetCursor() uint64 {
 	return mp.config.Cursor
 }
 
+func (mp *metaPartition) GetInodeCount() uint64 {
+	return uint64(mp.inodeTree.Len())
+}
+
 func (mp *metaPartition) StoreMeta() (err error) {
 	mp.config.sortPeers()
 	err = mp.storeMeta()
@@ -355,6 +389,9 @@ func (mp *metaPartition) load() (err error) {
 	if err = mp.loadDentry(); err != nil {
 		return
 	}
+	if err = mp.loadTx(); err != nil {
+		return
+	}
 	err = mp.loadApplyID()
 	return
 }
@@ -366,6 +403,9 @@ func (mp *metaPartition) store(sm *storeMsg) (err error) {
 	if err = mp.storeDentry(sm); err != nil {
 		return
 	}
+	if err = mp.storeTx(sm); err != nil {
+		return
+	}
 	if err = mp.storeApplyID(sm); err != nil {
 		return
 	}
@@ -418,12 +458,14 @@ func (mp *metaPartition) UpdatePartition(req *UpdatePartitionReq,
 	if err != nil {
 		resp.Status = proto.TaskFail
 		resp.Result = err.Error()
+		resp.ErrCode = proto.ErrCodeArgMismatch
 		return
 	}
 	r, err := mp.Put(opUpdatePartition, reqData)
 	if err != nil {
 		resp.Status = proto.TaskFail
 		resp.Result = err.Error()
+		resp.ErrCode = errCodeOf(err)
 		return
 	}
 	if status := r.(uint8); status != proto.OpOk {
@@ -432,6 +474,7 @@ func (mp *metaPartition) UpdatePartition(req *UpdatePartitionReq,
 		p.ResultCode = status
 		err = errors.Errorf("[UpdatePartition]: %s", p.GetResultMesg())
 		resp.Result = p.GetResultMesg()
+		resp.ErrCode = proto.ResultErrCode(status)
 	}
 	resp.Status = proto.TaskSuccess
 	return
@@ -0,0 +1,116 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+// The delete of the extents of an inode is sent to the data nodes once, the
+// extents are left on the data nodes if it is lost. The leader of the partition
+// reports the extents referenced by all its inodes, including the ones waiting
+// in the free list, to the leader of every extent partition of the vol, and the
+// data node collects the extents referenced by none of the meta partitions.
+func (mp *metaPartition) extentReferenceWorker() {
+	if mp.config.ExtentRefInterval <= 0 {
+		return
+	}
+	t := time.NewTicker(mp.config.ExtentRefInterval)
+	for {
+		select {
+		case <-mp.stopC:
+			t.Stop()
+			return
+		case <-t.C:
+			if _, isLeader := mp.IsLeader(); !isLeader {
+				continue
+			}
+			mp.reportExtentReferences()
+		}
+	}
+}
+
+/*the extent ids of each data partition referenced by the inodes*/
+func (mp *metaPartition) collectExtentReferences() (refs map[uint32][]uint64) {
+	refs = make(map[uint32][]uint64)
+	mp.inodeTree.Ascend(func(i BtreeItem) bool {
+		ino := i.(*Inode)
+		ino.Extents.Range(func(_ int, ek proto.ExtentKey) bool {
+			refs[ek.PartitionId] = append(refs[ek.PartitionId], ek.ExtentId)
+			return true
+		})
+		return true
+	})
+	return
+}
+
+func (mp *metaPartition) reportExtentReferences() {
+	start := time.Now()
+	refs := mp.collectExtentReferences()
+	var failed int
+	dps := mp.vol.GetPartitions()
+	for _, dp := range dps {
+		if dp.PartitionType != proto.ExtentPartition || len(dp.Hosts) == 0 {
+			continue
+		}
+		// a partition referenced by none of the inodes gets an empty report,
+		// the data node waits for the reports of all the meta partitions
+		report := &proto.ExtentReferences{
+			VolName:         mp.config.VolName,
+			MetaPartitionID: mp.config.PartitionId,
+			DataPartitionID: dp.PartitionID,
+			AgeMs:           int64(time.Since(start) / time.Millisecond),
+			Extents:         refs[dp.PartitionID],
+		}
+		if err := mp.sendExtentReferences(dp, report); err != nil {
+			failed++
+			log.LogWarnf("[reportExtentReferences] partitionID(%v) dataPartition(%v) err(%v)",
+				mp.config.PartitionId, dp.PartitionID, err)
+		}
+	}
+	log.LogInfof("[reportExtentReferences] partitionID(%v) dataPartitions(%v) failed(%v) cost(%v)",
+		mp.config.PartitionId, len(dps), failed, time.Since(start))
+}
+
+func (mp *metaPartition) sendExtentReferences(dp *DataPartition, report *proto.ExtentReferences) (err error) {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return
+	}
+	conn, err := mp.config.ConnPool.Get(dp.Hosts[0])
+	if err != nil {
+		mp.config.ConnPool.Put(conn, ForceCloseConnect)
+		return errors.Errorf("get conn from pool %s: %s", dp.Hosts[0], err.Error())
+	}
+	p := NewExtentReferencesPacket(dp, data)
+	if err = p.WriteToConn(conn); err != nil {
+		mp.config.ConnPool.Put(conn, ForceCloseConnect)
+		return errors.Errorf("write to dataNode %s, %s", p.GetUniqueLogId(), err.Error())
+	}
+	if err = p.ReadFromConn(conn, proto.ReadDeadlineTime); err != nil {
+		mp.config.ConnPool.Put(conn, ForceCloseConnect)
+		return errors.Errorf("read response from dataNode %s, %s", p.GetUniqueLogId(), err.Error())
+	}
+	mp.config.ConnPool.Put(conn, NoCloseConnect)
+	if p.ResultCode != proto.OpOk {
+		return errors.Errorf("dataNode %s: %s", p.GetUniqueLogId(), string(p.Data[:p.Size]))
+	}
+	return
+}
@@ -28,6 +28,7 @@ const (
 	AsyncDeleteInterval = 10 * time.Second
 	UpdateVolTicket     = 5 * time.Minute
 	BatchCounts         = 100
+	DeleteBatchExtents  = 128 // deletes written to a data node before reading their replies
 )
 
 func (mp *metaPartition) startFreeList() {
@@ -36,6 +37,8 @@ func (mp *metaPartition) startFreeList() {
 
 	go mp.deleteWorker()
 	go mp.checkFreelistWorker()
+	go mp.extentReferenceWorker()
+	go mp.usageWorker()
 }
 
 func (mp *metaPartition) updateVolWorker() {
@@ -93,14 +96,47 @@ Begin:
 		if len(buffSlice) == 0 {
 			goto Begin
 		}
-		mp.deleteDataPartitionMark(buffSlice)
-		if len(buffSlice) < BatchCounts {
+		batchCount := len(buffSlice)
+		buffSlice = mp.filterOpenInodes(buffSlice)
+		if len(buffSlice) > 0 {
+			mp.deleteDataPartitionMark(buffSlice)
+		}
+		if batchCount < BatchCounts || len(buffSlice) == 0 {
 			goto Begin
 		}
 		runtime.Gosched()
 	}
 }
 
+// filterOpenInodes put back the unlinked inodes still open by some client
+// sessions to the free list, the remaining readers keep reading the extents
+// until the handles are released or the defer timeout.
+func (mp *metaPartition) filterOpenInodes(inoSlice []*Inode) (deletes []*Inode) {
+	deletes = inoSlice[:0]
+	now := time.Now().Unix()
+	for _, ino := range inoSlice {
+		if mp.config.OpenFiles == nil || !mp.config.OpenFiles.isOpen(mp.config.PartitionId, ino.Inode) {
+			delete(mp.deferDeletes, ino.Inode)
+			deletes = append(deletes, ino)
+			continue
+		}
+		first, ok := mp.deferDeletes[ino.Inode]
+		if !ok {
+			mp.deferDeletes[ino.Inode] = now
+			log.LogInfof("[deleteWorker] partitionID(%v) defer deleting inode(%v) still open",
+				mp.config.PartitionId, ino.Inode)
+		} else if now-first > int64(openDeleteDeferTimeout/time.Second) {
+			log.LogWarnf("[deleteWorker] partitionID(%v) inode(%v) still open after %v, delete it",
+				mp.config.PartitionId, ino.Inode, openDeleteDeferTimeout)
+			delete(mp.deferDeletes, ino.Inode)
+			deletes = append(deletes, ino)
+			continue
+		}
+		mp.freeList.Push(ino)
+	}
+	return
+}
+
 func (mp *metaPartition) checkFreelistWorker() {
 	var (
 		idx      int
@@ -138,50 +174,31 @@ func (mp *metaPartition) checkFreelistWorker() {
 	}
 }
 
+// deleteDataPartitionMark deletes the extents of the inodes, grouped by their
+// data partitions, and commits the delete of the inodes all of whose extents
+// are deleted. The inodes with extents left go back to the free list.
 func (mp *metaPartition) deleteDataPartitionMark(inoSlice []*Inode) {
-	stepFunc := func(ext proto.ExtentKey) (err error) {
-		// get dataNode View
-		dp := mp.vol.GetPartition(ext.PartitionId)
-		if dp == nil {
-			err = errors.Errorf("unknown dataPartitionID=%d in vol",
-				ext.PartitionId)
-			return
-		}
-		// delete dataNode
-		conn, err := mp.config.ConnPool.Get(dp.Hosts[0])
-		if err != nil {
-			mp.config.ConnPool.Put(conn, ForceCloseConnect)
-			err = errors.Errorf("get conn from pool %s, "+
-				"extents partitionId=%d, extentId=%d",
-				err.Error(), ext.PartitionId, ext.ExtentId)
-			return
-		}
-		p := NewExtentDeletePacket(dp, ext.ExtentId)
-		if err = p.WriteToConn(conn); err != nil {
-			mp.config.ConnPool.Put(conn, ForceCloseConnect)
-			err = errors.Errorf("write to dataNode %s, %s", p.GetUniqueLogId(),
-				err.Error())
-			return
-		}
-		if err = p.ReadFromConn(conn, proto.ReadDeadlineTime); err != nil {
-			mp.config.ConnPool.Put(conn, ForceCloseConnect)
-			err = errors.Errorf("read response from dataNode %s, %s",
-				p.GetUniqueLogId(), err.Error())
-			return
+	// an extent shared by two inodes is deleted once for each of them
+	partitionExts := make(map[uint32][]proto.ExtentKey)
+	for _, ino := range inoSlice {
+		ino.Extents.Range(func(i int, v proto.ExtentKey) bool {
+			partitionExts[v.PartitionId] = append(partitionExts[v.PartitionId], v)
+			return true
+		})
+	}
+	failed := make(map[proto.ExtentKey]int)
+	for partitionID, exts := range partitionExts {
+		for _, ext := range mp.deleteExtents(partitionID, exts) {
+			failed[ext]++
 		}
-		log.LogDebugf("[deleteDataPartitionMark] %v", p.GetUniqueLogId())
-		mp.config.ConnPool.Put(conn, NoCloseConnect)
-		return
 	}
 	shouldCommit := make([]*Inode, 0, BatchCounts)
-	var err error
 	for _, ino := range inoSlice {
 		var reExt []proto.ExtentKey
 		ino.Extents.Range(func(i int, v proto.ExtentKey) bool {
-			if err = stepFunc(v); err != nil {
+			if failed[v] > 0 {
+				failed[v]--
 				reExt = append(reExt, v)
-				log.LogWarnf("[deleteDataPartitionMark] extentKey: %s, "+
-					"err: %s", v.String(), err.Error())
 			}
 			return true
 		})
@@ -213,3 +230,65 @@ func (mp *metaPartition) deleteDataPartitionMark(inoSlice []*Inode) {
 	}
 
 }
+
+// deleteExtents sends the deletes of the extents of a data partition to its
+// leader, DeleteBatchExtents of them are written to the connection before
+// their replies are read. It returns the extents to retry.
+func (mp *metaPartition) deleteExtents(partitionID uint32, exts []proto.ExtentKey) (failed []proto.ExtentKey) {
+	dp := mp.vol.GetPartition(partitionID)
+	if dp == nil {
+		log.LogWarnf("[deleteExtents] unknown dataPartitionID=%d in vol, %v extents", partitionID, len(exts))
+		return exts
+	}
+	for start := 0; start < len(exts); start += DeleteBatchExtents {
+		end := start + DeleteBatchExtents
+		if end > len(exts) {
+			end = len(exts)
+		}
+		if err := mp.deleteExtentBatch(dp, exts[start:end]); err != nil {
+			log.LogWarnf("[deleteExtents] dataPartitionID=%d extents %v: %s", partitionID, exts[start:end], err.Error())
+			failed = append(failed, exts[start:end]...)
+		}
+	}
+	return
+}
+
+// deleteExtentBatch fails as a whole if a reply is lost, the delete of an
+// extent already deleted succeeds on a retry.
+func (mp *metaPartition) deleteExtentBatch(dp *DataPartition, exts []proto.ExtentKey) (err error) {
+	conn, err := mp.config.ConnPool.Get(dp.Hosts[0])
+	if err != nil {
+		mp.config.ConnPool.Put(conn, ForceCloseConnect)
+		err = errors.Errorf("get conn from pool %s", err.Error())
+		return
+	}
+	reqs := make([]*Packet, 0, len(exts))
+	for _, ext := range exts {
+		p := NewExtentDeletePacket(dp, ext.ExtentId)
+		if err = p.WriteToConn(conn); err != nil {
+			mp.config.ConnPool.Put(conn, ForceCloseConnect)
+			err = errors.Errorf("write to dataNode %s, %s", p.GetUniqueLogId(),
+				err.Error())
+			return
+		}
+		reqs = append(reqs, p)
+	}
+	for _, p := range reqs {
+		reply := new(Packet)
+		if err = reply.ReadFromConn(conn, proto.ReadDeadlineTime); err != nil {
+			mp.config.ConnPool.Put(conn, ForceCloseConnect)
+			err = errors.Errorf("read response from dataNode %s, %s",
+				p.GetUniqueLogId(), err.Error())
+			return
+		}
+		if reply.ReqID != p.ReqID {
+			mp.config.ConnPool.Put(conn, ForceCloseConnect)
+			err = errors.Errorf("response %s of dataNode to %s",
+				reply.GetUniqueLogId(), p.GetUniqueLogId())
+			return
+		}
+		log.LogDebugf("[deleteDataPartitionMark] %v", reply.GetUniqueLogId())
+	}
+	mp.config.ConnPool.Put(conn, NoCloseConnect)
+	return
+}
@@ -0,0 +1,97 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"net"
+	"testing"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/pool"
+)
+
+// replies to the deletes of the connections, a reply of another request id
+// for the extents of ids over lost
+func serveExtentDeletes(t *testing.T, lost uint64) (ln net.Listener, received chan uint64) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	received = make(chan uint64, 1024)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				for {
+					p := new(Packet)
+					if err := p.ReadFromConn(conn, proto.NoReadDeadlineTime); err != nil {
+						return
+					}
+					// the negotiation of the connection is not a delete
+					if p.Opcode == proto.OpMarkDelete {
+						received <- p.FileID
+						if p.FileID > lost {
+							p.ReqID++
+						}
+					}
+					p.PackOkReply()
+					if err := p.WriteToConn(conn); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return
+}
+
+func TestDeleteExtentBatch(t *testing.T) {
+	ln, received := serveExtentDeletes(t, 300)
+	defer ln.Close()
+	mp := NewMetaPartition(compatConfig("")).(*metaPartition)
+	mp.config.ConnPool = pool.NewConnPool()
+	dp := &DataPartition{PartitionID: 7, Hosts: []string{ln.Addr().String()}}
+
+	exts := make([]proto.ExtentKey, 0, 300)
+	for i := 1; i <= 300; i++ {
+		exts = append(exts, proto.ExtentKey{PartitionId: 7, ExtentId: uint64(i)})
+	}
+	for start := 0; start < len(exts); start += DeleteBatchExtents {
+		end := start + DeleteBatchExtents
+		if end > len(exts) {
+			end = len(exts)
+		}
+		if err := mp.deleteExtentBatch(dp, exts[start:end]); err != nil {
+			t.Fatalf("delete extents %v-%v: %v", start, end, err)
+		}
+	}
+	if len(received) != 300 {
+		t.Fatalf("%v deletes received, want 300", len(received))
+	}
+	for i := 1; i <= 300; i++ {
+		if id := <-received; id != uint64(i) {
+			t.Fatalf("delete of extent %v received as %v", i, id)
+		}
+	}
+
+	// a reply of another request fails the batch
+	if err := mp.deleteExtentBatch(dp, []proto.ExtentKey{{PartitionId: 7, ExtentId: 301}}); err == nil {
+		t.Fatalf("delete with a mismatched reply succeeded")
+	}
+}
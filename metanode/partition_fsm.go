@@ -78,6 +78,18 @@ func (mp *metaPartition) Apply(command []byte, index uint64) (resp interface{},
 			return
 		}
 		err = mp.setAttr(req)
+	case opFSMSetXAttr:
+		req := &proto.SetXAttrRequest{}
+		if err = json.Unmarshal(msg.V, req); err != nil {
+			return
+		}
+		resp = mp.setXAttr(req)
+	case opFSMRemoveXAttr:
+		req := &proto.RemoveXAttrRequest{}
+		if err = json.Unmarshal(msg.V, req); err != nil {
+			return
+		}
+		resp = mp.removeXAttr(req)
 	case opCreateDentry:
 		den := &Dentry{}
 		if err = den.Unmarshal(msg.V); err != nil {
@@ -90,6 +102,12 @@ func (mp *metaPartition) Apply(command []byte, index uint64) (resp interface{},
 			return
 		}
 		resp = mp.deleteDentry(den)
+	case opFSMDeleteDentryIno:
+		den := &Dentry{}
+		if err = den.Unmarshal(msg.V); err != nil {
+			return
+		}
+		resp = mp.deleteDentryIno(den)
 	case opUpdateDentry:
 		den := &Dentry{}
 		if err = den.Unmarshal(msg.V); err != nil {
@@ -116,6 +134,24 @@ func (mp *metaPartition) Apply(command []byte, index uint64) (resp interface{},
 			return
 		}
 		resp = mp.appendExtents(ino)
+	case opFSMExtentsReplace:
+		req := &proto.ReplaceExtentKeysRequest{}
+		if err = json.Unmarshal(msg.V, req); err != nil {
+			return
+		}
+		resp = mp.extentsReplace(req)
+	case opFSMTxPrepare:
+		r := &txRecord{}
+		if err = json.Unmarshal(msg.V, r); err != nil {
+			return
+		}
+		resp = mp.txPrepare(r)
+	case opFSMTxCommit:
+		resp = mp.txCommit(string(msg.V))
+	case opFSMTxAbort:
+		resp = mp.txAbort(string(msg.V))
+	case opFSMTxUnlinked:
+		mp.txs.unlinked(string(msg.V))
 	case opStoreTick:
 		msg := &storeMsg{
 			command:    opStoreTick,
@@ -123,6 +159,9 @@ func (mp *metaPartition) Apply(command []byte, index uint64) (resp interface{},
 			inodeTree:  mp.getInodeTree(),
 			dentryTree: mp.getDentryTree(),
 		}
+		if msg.txs, err = mp.txs.marshal(); err != nil {
+			return
+		}
 		mp.storeChan <- msg
 	case opFSMInternalDeleteInode:
 		err = mp.internalDelete(msg.V)
@@ -170,6 +209,12 @@ func (mp *metaPartition) Snapshot() (raftproto.Snapshot, error) {
 	ino := mp.getInodeTree()
 	dentry := mp.getDentryTree()
 	snapIter := NewMetaItemIterator(applyID, ino, dentry)
+	snapIter.sender = mp.config.Snapshots
+	txs, err := mp.txs.marshal()
+	if err != nil {
+		return nil, err
+	}
+	snapIter.setTxs(txs)
 	return snapIter, nil
 }
 
@@ -182,21 +227,25 @@ func (mp *metaPartition) ApplySnapshot(peers []raftproto.Peer,
 		cursor     uint64
 		inodeTree  = NewBtree()
 		dentryTree = NewBtree()
+		txs        = newTxTable()
 	)
 	defer func() {
 		if err == io.EOF {
 			mp.applyID = appIndexID
 			mp.inodeTree = inodeTree
 			mp.dentryTree = dentryTree
+			mp.txs.replace(txs)
 			mp.config.Cursor = cursor
 			err = nil
 			// store message
-			mp.storeChan <- &storeMsg{
+			sm := &storeMsg{
 				command:    opStoreTick,
 				applyIndex: mp.applyID,
 				inodeTree:  mp.inodeTree,
 				dentryTree: mp.dentryTree,
 			}
+			sm.txs, _ = mp.txs.marshal()
+			mp.storeChan <- sm
 			log.LogDebugf("[ApplySnapshot] successful.")
 			return
 		}
@@ -216,29 +265,52 @@ func (mp *metaPartition) ApplySnapshot(peers []raftproto.Peer,
 		if err = snap.UnmarshalBinary(data); err != nil {
 			return
 		}
-		switch snap.Op {
-		case opCreateInode:
-			ino := NewInode(0, 0)
-			ino.UnmarshalKey(snap.K)
-			ino.UnmarshalValue(snap.V)
-			if cursor < ino.Inode {
-				cursor = ino.Inode
+		if snap.Op != opFSMSnapshotBatch {
+			if err = applySnapshotItem(snap, inodeTree, dentryTree, txs, &cursor); err != nil {
+				return
+			}
+			continue
+		}
+		// a batch frame of a sender with a batch size
+		err = rangeSnapshotBatch(snap.V, func(item []byte) (err error) {
+			snap := NewMetaItem(0, nil, nil)
+			if err = snap.UnmarshalBinary(item); err != nil {
+				return
 			}
-			inodeTree.ReplaceOrInsert(ino, true)
-			log.LogDebugf("action[ApplySnapshot] create inode[%v].", ino)
-		case opCreateDentry:
-			dentry := &Dentry{}
-			dentry.UnmarshalKey(snap.K)
-			dentry.UnmarshalValue(snap.V)
-			dentryTree.ReplaceOrInsert(dentry, true)
-			log.LogDebugf("action[ApplySnapshot] create dentry[%v].", dentry)
-		default:
-			err = fmt.Errorf("unknown op=%d", snap.Op)
+			return applySnapshotItem(snap, inodeTree, dentryTree, txs, &cursor)
+		})
+		if err != nil {
 			return
 		}
 	}
 }
 
+func applySnapshotItem(snap *MetaItem, inodeTree, dentryTree *BTree, txs *txTable, cursor *uint64) (err error) {
+	switch snap.Op {
+	case opCreateInode:
+		ino := NewInode(0, 0)
+		ino.UnmarshalKey(snap.K)
+		ino.UnmarshalValue(snap.V)
+		if *cursor < ino.Inode {
+			*cursor = ino.Inode
+		}
+		inodeTree.ReplaceOrInsert(ino, true)
+		log.LogDebugf("action[ApplySnapshot] create inode[%v].", ino)
+	case opCreateDentry:
+		dentry := &Dentry{}
+		dentry.UnmarshalKey(snap.K)
+		dentry.UnmarshalValue(snap.V)
+		dentryTree.ReplaceOrInsert(dentry, true)
+		log.LogDebugf("action[ApplySnapshot] create dentry[%v].", dentry)
+	case opFSMTxSnapshot:
+		err = txs.unmarshal(snap.V)
+		log.LogDebugf("action[ApplySnapshot] rename transactions[%s].", snap.V)
+	default:
+		err = fmt.Errorf("unknown op=%d", snap.Op)
+	}
+	return
+}
+
 func (mp *metaPartition) HandleFatalEvent(err *raft.FatalError) {
 	// Panic while fatal event happen.
 	log.LogFatalf("action[HandleFatalEvent] err[%v].", err)
@@ -247,6 +319,12 @@ func (mp *metaPartition) HandleFatalEvent(err *raft.FatalError) {
 func (mp *metaPartition) HandleLeaderChange(leader uint64) {
 	ump.Alarm(UMPKey, fmt.Sprintf("LeaderChange: partition=%d, "+
 		"newLeader=%d", mp.config.PartitionId, leader))
+	if mp.config.FileLocks != nil {
+		mp.config.FileLocks.resetPartition(mp.config.PartitionId, mp.config.NodeId == leader)
+	}
+	if mp.config.Leases != nil {
+		mp.config.Leases.resetPartition(mp.config.PartitionId)
+	}
 	if mp.config.NodeId != leader {
 		mp.storeChan <- &storeMsg{
 			command: stopStoreTick,
@@ -16,10 +16,10 @@ package metanode
 
 import (
 	"os"
-	"strings"
 	"time"
 
 	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util"
 	"github.com/tiglabs/containerfs/util/log"
 )
 
@@ -112,7 +112,7 @@ func (mp *metaPartition) confAddNode(req *proto.
 		return
 	}
 	mp.config.Peers = append(mp.config.Peers, req.AddPeer)
-	addr := strings.Split(req.AddPeer.Addr, ":")[0]
+	addr := util.GetHost(req.AddPeer.Addr)
 	mp.config.RaftStore.AddNodeWithPort(req.AddPeer.ID, addr, heartbeatPort, replicatePort)
 	return
 }
@@ -32,6 +32,9 @@ func NewResponseDentry() *ResponseDentry {
 // CreateDentry insert dentry into dentry tree.
 func (mp *metaPartition) createDentry(dentry *Dentry) (status uint8) {
 	status = proto.OpOk
+	if mp.txs.locked(dentry.ParentId, dentry.Name) {
+		return proto.OpAgain
+	}
 	if _, ok := mp.dentryTree.ReplaceOrInsert(dentry, false); !ok {
 		status = proto.OpExistErr
 	}
@@ -54,6 +57,10 @@ func (mp *metaPartition) getDentry(dentry *Dentry) (*Dentry, uint8) {
 func (mp *metaPartition) deleteDentry(dentry *Dentry) (resp *ResponseDentry) {
 	resp = NewResponseDentry()
 	resp.Status = proto.OpOk
+	if mp.txs.locked(dentry.ParentId, dentry.Name) {
+		resp.Status = proto.OpAgain
+		return
+	}
 	item := mp.dentryTree.Delete(dentry)
 	if item == nil {
 		resp.Status = proto.OpNotExistErr
@@ -63,9 +70,24 @@ func (mp *metaPartition) deleteDentry(dentry *Dentry) (resp *ResponseDentry) {
 	return
 }
 
+// deleteDentryIno deletes the dentry only if it is still of the inode of the
+// one given, a name renamed over or created again in between is kept.
+func (mp *metaPartition) deleteDentryIno(dentry *Dentry) (resp *ResponseDentry) {
+	if item := mp.dentryTree.Get(dentry); item == nil || item.(*Dentry).Inode != dentry.Inode {
+		resp = NewResponseDentry()
+		resp.Status = proto.OpNotExistErr
+		return
+	}
+	return mp.deleteDentry(dentry)
+}
+
 func (mp *metaPartition) updateDentry(dentry *Dentry) (resp *ResponseDentry) {
 	resp = NewResponseDentry()
 	resp.Status = proto.OpOk
+	if mp.txs.locked(dentry.ParentId, dentry.Name) {
+		resp.Status = proto.OpAgain
+		return
+	}
 	item := mp.dentryTree.Get(dentry)
 	if item == nil {
 		resp.Status = proto.OpNotExistErr
@@ -81,16 +103,30 @@ func (mp *metaPartition) getDentryTree() *BTree {
 	return mp.dentryTree.GetTree()
 }
 
+// readDir returns the dentries of the dir after the marker, at most limit of
+// them and the marker of the next page if there are more.
 func (mp *metaPartition) readDir(req *ReadDirReq) (resp *ReadDirResp) {
 	resp = &ReadDirResp{}
+	limit := req.Limit
+	if limit > proto.MaxReadDirLimit {
+		limit = proto.MaxReadDirLimit
+	}
 	begDentry := &Dentry{
 		ParentId: req.ParentID,
+		Name:     req.Marker,
 	}
 	endDentry := &Dentry{
 		ParentId: req.ParentID + 1,
 	}
 	mp.dentryTree.AscendRange(begDentry, endDentry, func(i BtreeItem) bool {
 		d := i.(*Dentry)
+		if req.Marker != "" && d.Name == req.Marker {
+			return true
+		}
+		if limit != 0 && uint64(len(resp.Children)) == limit {
+			resp.Next = resp.Children[len(resp.Children)-1].Name
+			return false
+		}
 		resp.Children = append(resp.Children, proto.Dentry{
 			Inode: d.Inode,
 			Type:  d.Type,
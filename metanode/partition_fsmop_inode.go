@@ -120,7 +120,11 @@ func (mp *metaPartition) deleteInode(ino *Inode) (resp *ResponseInode) {
 		inode := i.(*Inode)
 		resp.Msg = inode
 		if proto.IsRegular(inode.Type) {
-			inode.NLink--
+			// a regular inode is referenced by the dentries of its links, it
+			// is evicted once the last one is deleted
+			if inode.NLink > 0 {
+				inode.NLink--
+			}
 			return
 		}
 		// should delete inode
@@ -183,6 +187,42 @@ func (mp *metaPartition) appendExtents(ino *Inode) (status uint8) {
 	return
 }
 
+// extentsReplace replaces the extent keys of the inode if they are still the
+// ones of the request, an orphan inode included. The keys replaced are not
+// deleted and the modify time is kept, the data of the file is the same.
+func (mp *metaPartition) extentsReplace(req *proto.ReplaceExtentKeysRequest) (status uint8) {
+	item := mp.inodeTree.Get(NewInode(req.Inode, 0))
+	if item == nil {
+		return proto.OpNotExistErr
+	}
+	ino := item.(*Inode)
+	if !proto.IsRegular(ino.Type) {
+		return proto.OpArgMismatchErr
+	}
+	if !extentKeysEqual(ino.Extents, req.OldExtents) {
+		// changed since the client got them
+		return proto.OpAgain
+	}
+	extents := proto.NewStreamKey(ino.Inode)
+	extents.Extents = append(extents.Extents, req.NewExtents...)
+	ino.Extents = extents
+	ino.Size = extents.Size()
+	ino.Generation++
+	return proto.OpOk
+}
+
+func extentKeysEqual(sk *proto.StreamKey, eks []proto.ExtentKey) (equal bool) {
+	if sk.GetExtentLen() != len(eks) {
+		return false
+	}
+	equal = true
+	sk.Range(func(i int, ek proto.ExtentKey) bool {
+		equal = ek == eks[i]
+		return equal
+	})
+	return
+}
+
 func (mp *metaPartition) extentsTruncate(ino *Inode) (resp *ResponseInode) {
 	resp = NewResponseInode()
 	resp.Status = proto.OpOk
@@ -0,0 +1,134 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"os"
+	"testing"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+func TestInodeLinks(t *testing.T) {
+	mp := NewMetaPartition(compatConfig("")).(*metaPartition)
+	mp.inodeTree.ReplaceOrInsert(NewInode(2, proto.Mode(0644)), true)
+	mp.inodeTree.ReplaceOrInsert(NewInode(3, proto.Mode(os.ModeDir|0755)), true)
+
+	for i := 0; i < 2; i++ {
+		if resp := mp.createLinkInode(NewInode(2, 0)); resp.Status != proto.OpOk {
+			t.Fatalf("link: status %v", resp.Status)
+		}
+	}
+	if resp := mp.createLinkInode(NewInode(3, 0)); resp.Status != proto.OpArgMismatchErr {
+		t.Fatalf("link of dir: status %v", resp.Status)
+	}
+	if nlink := mp.getInode(NewInode(2, 0)).Msg.NLink; nlink != 3 {
+		t.Fatalf("nlink after 2 links: %v", nlink)
+	}
+
+	// the inode is kept until its last link is deleted and it is evicted
+	for i := 2; i >= 0; i-- {
+		if resp := mp.deleteInode(NewInode(2, 0)); resp.Status != proto.OpOk || resp.Msg.NLink != uint32(i) {
+			t.Fatalf("unlink: status %v nlink %v, want %v", resp.Status, resp.Msg.NLink, i)
+		}
+		mp.evictInode(NewInode(2, 0))
+		if i > 0 && !mp.hasInode(NewInode(2, 0)) {
+			t.Fatalf("inode evicted with %v links", i)
+		}
+	}
+	if mp.hasInode(NewInode(2, 0)) {
+		t.Fatalf("inode not evicted after the last unlink")
+	}
+	if resp := mp.deleteInode(NewInode(2, 0)); resp.Msg.NLink != 0 {
+		t.Fatalf("nlink after an unlink of no link: %v", resp.Msg.NLink)
+	}
+}
+
+func TestExtentsReplace(t *testing.T) {
+	mp := NewMetaPartition(compatConfig("")).(*metaPartition)
+	file := NewInode(2, proto.Mode(0644))
+	file.Extents.Put(proto.ExtentKey{PartitionId: 12, ExtentId: 1, Size: 4096})
+	file.Extents.Put(proto.ExtentKey{PartitionId: 13, ExtentId: 2, Size: 1024})
+	file.Size = file.Extents.Size()
+	file.ModifyTime = 1540000200
+	mp.inodeTree.ReplaceOrInsert(file, true)
+	mp.inodeTree.ReplaceOrInsert(NewInode(3, proto.Mode(os.ModeDir|0755)), true)
+
+	old := []proto.ExtentKey{{PartitionId: 12, ExtentId: 1, Size: 4096}, {PartitionId: 13, ExtentId: 2, Size: 1024}}
+	migrated := []proto.ExtentKey{
+		{PartitionId: 20, ExtentId: 5, Size: 2048},
+		{PartitionId: 21, ExtentId: 6, Size: 2048},
+		{PartitionId: 13, ExtentId: 2, Size: 1024},
+	}
+	req := &proto.ReplaceExtentKeysRequest{Inode: 2, OldExtents: old[:1], NewExtents: migrated}
+	if status := mp.extentsReplace(req); status != proto.OpAgain {
+		t.Fatalf("replace of the keys changed: status %v", status)
+	}
+	req.OldExtents = old
+	if status := mp.extentsReplace(req); status != proto.OpOk {
+		t.Fatalf("replace: status %v", status)
+	}
+	ino := mp.getInode(NewInode(2, 0)).Msg
+	if !extentKeysEqual(ino.Extents, migrated) || ino.Size != 5120 || ino.ModifyTime != 1540000200 {
+		t.Fatalf("replaced: extents %v size %v mtime %v", ino.Extents, ino.Size, ino.ModifyTime)
+	}
+	// the replace is not repeated once the keys changed
+	if status := mp.extentsReplace(req); status != proto.OpAgain {
+		t.Fatalf("replace repeated: status %v", status)
+	}
+
+	if status := mp.extentsReplace(&proto.ReplaceExtentKeysRequest{Inode: 3}); status != proto.OpArgMismatchErr {
+		t.Fatalf("replace of a dir: status %v", status)
+	}
+	if status := mp.extentsReplace(&proto.ReplaceExtentKeysRequest{Inode: 4}); status != proto.OpNotExistErr {
+		t.Fatalf("replace of no inode: status %v", status)
+	}
+
+	// the keys of a temp file moved to the file are dropped without a delete
+	req = &proto.ReplaceExtentKeysRequest{Inode: 2, OldExtents: migrated}
+	if status := mp.extentsReplace(req); status != proto.OpOk {
+		t.Fatalf("replace with no keys: status %v", status)
+	}
+	if ino.Extents.GetExtentLen() != 0 || ino.Size != 0 {
+		t.Fatalf("emptied: extents %v size %v", ino.Extents, ino.Size)
+	}
+}
+
+func TestOrphanInodes(t *testing.T) {
+	mp := NewMetaPartition(compatConfig("")).(*metaPartition)
+	mp.config.OpenFiles = newOpenFiles(10)
+	linked := NewInode(2, proto.Mode(0644))
+	unlinked := NewInode(3, proto.Mode(0644))
+	unlinked.NLink = 0
+	open := NewInode(4, proto.Mode(0644))
+	open.NLink = 0
+	open.MarkDelete = 1
+	deleted := NewInode(5, proto.Mode(0644))
+	deleted.NLink = 0
+	deleted.MarkDelete = 1
+	dir := NewInode(6, proto.Mode(os.ModeDir|0755))
+	dir.NLink = 0
+	for _, ino := range []*Inode{linked, unlinked, open, deleted, dir} {
+		mp.inodeTree.ReplaceOrInsert(ino, true)
+	}
+	if err := mp.config.OpenFiles.open("session", mp.config.PartitionId, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	inos := mp.orphanInodes()
+	if len(inos) != 2 || inos[0] != 3 || inos[1] != 4 {
+		t.Fatalf("orphans %v, want [3 4]", inos)
+	}
+}
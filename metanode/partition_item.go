@@ -118,6 +118,8 @@ type ItemIterator struct {
 	dentryLen  int
 	dentryTree *BTree
 	total      int
+	txs        []byte          // the rename transactions sent after the dentries, nil if there is none
+	sender     *snapshotSender // paces and batches the items, nil sends them as they are
 }
 
 func NewMetaItemIterator(applyID uint64, ino, den *BTree) *ItemIterator {
@@ -132,6 +134,16 @@ func NewMetaItemIterator(applyID uint64, ino, den *BTree) *ItemIterator {
 	return si
 }
 
+// setTxs sends the rename transactions as the last item, the older releases
+// can't apply it so it is sent only if there is a transaction.
+func (si *ItemIterator) setTxs(txs []byte) {
+	if txs == nil {
+		return
+	}
+	si.txs = txs
+	si.total++
+}
+
 func (si *ItemIterator) ApplyIndex() uint64 {
 	return si.applyID
 }
@@ -141,7 +153,33 @@ func (si *ItemIterator) Close() {
 	return
 }
 
+// Next returns the apply id and then the items, several items are sent in a
+// batch frame if the sender has a batch size.
 func (si *ItemIterator) Next() (data []byte, err error) {
+	if data, err = si.nextItem(); err != nil || si.cur == 1 || si.sender.batch() <= 0 {
+		si.sender.wait(len(data))
+		return
+	}
+	buff := bytes.NewBuffer(make([]byte, 0, si.sender.batch()+len(data)))
+	appendSnapshotBatch(buff, data)
+	for buff.Len() < si.sender.batch() {
+		if data, err = si.nextItem(); err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			return
+		}
+		appendSnapshotBatch(buff, data)
+	}
+	if data, err = NewMetaItem(opFSMSnapshotBatch, nil, buff.Bytes()).MarshalBinary(); err != nil {
+		return
+	}
+	si.sender.wait(len(data))
+	return
+}
+
+func (si *ItemIterator) nextItem() (data []byte, err error) {
 	// TODO: Redesign iterator to improve performance. [Mervin]
 	if si.cur > si.total {
 		err = io.EOF
@@ -173,6 +211,11 @@ func (si *ItemIterator) Next() (data []byte, err error) {
 		return
 	}
 
+	if si.txs != nil && si.cur == si.total {
+		data, err = NewMetaItem(opFSMTxSnapshot, nil, si.txs).MarshalBinary()
+		si.cur++
+		return
+	}
 	// ascend range dentry tree
 	if si.cur == (si.inoLen + 1) {
 		si.curItem = nil
@@ -21,6 +21,10 @@ import (
 )
 
 func (mp *metaPartition) CreateDentry(req *CreateDentryReq, p *Packet) (err error) {
+	if status := mp.checkAccess(req.Caller, req.ParentID, accessWrite|accessExec); status != proto.OpOk {
+		p.PackErrorWithBody(status, nil)
+		return
+	}
 	dentry := &Dentry{
 		ParentId: req.ParentID,
 		Name:     req.Name,
@@ -41,16 +45,25 @@ func (mp *metaPartition) CreateDentry(req *CreateDentryReq, p *Packet) (err erro
 }
 
 func (mp *metaPartition) DeleteDentry(req *DeleteDentryReq, p *Packet) (err error) {
+	if status := mp.checkRemove(req.Caller, req.ParentID, req.Name); status != proto.OpOk {
+		p.PackErrorWithBody(status, nil)
+		return
+	}
 	dentry := &Dentry{
 		ParentId: req.ParentID,
 		Name:     req.Name,
+		Inode:    req.Inode,
 	}
 	val, err := dentry.Marshal()
 	if err != nil {
 		p.ResultCode = proto.OpErr
 		return
 	}
-	r, err := mp.Put(opDeleteDentry, val)
+	op := opDeleteDentry
+	if req.Inode != 0 {
+		op = opFSMDeleteDentryIno
+	}
+	r, err := mp.Put(op, val)
 	if err != nil {
 		p.PackErrorWithBody(proto.OpAgain, []byte(err.Error()))
 		return
@@ -70,6 +83,10 @@ func (mp *metaPartition) DeleteDentry(req *DeleteDentryReq, p *Packet) (err erro
 }
 
 func (mp *metaPartition) UpdateDentry(req *UpdateDentryReq, p *Packet) (err error) {
+	if status := mp.checkRemove(req.Caller, req.ParentID, req.Name); status != proto.OpOk {
+		p.PackErrorWithBody(status, nil)
+		return
+	}
 	dentry := &Dentry{
 		ParentId: req.ParentID,
 		Name:     req.Name,
@@ -99,6 +116,10 @@ func (mp *metaPartition) UpdateDentry(req *UpdateDentryReq, p *Packet) (err erro
 }
 
 func (mp *metaPartition) ReadDir(req *ReadDirReq, p *Packet) (err error) {
+	if status := mp.checkAccess(req.Caller, req.ParentID, accessRead); status != proto.OpOk {
+		p.PackErrorWithBody(status, nil)
+		return
+	}
 	resp := mp.readDir(req)
 	reply, err := json.Marshal(resp)
 	if err != nil {
@@ -110,6 +131,10 @@ func (mp *metaPartition) ReadDir(req *ReadDirReq, p *Packet) (err error) {
 }
 
 func (mp *metaPartition) Lookup(req *LookupReq, p *Packet) (err error) {
+	if status := mp.checkAccess(req.Caller, req.ParentID, accessExec); status != proto.OpOk {
+		p.PackErrorWithBody(status, nil)
+		return
+	}
 	dentry := &Dentry{
 		ParentId: req.ParentID,
 		Name:     req.Name,
@@ -15,8 +15,67 @@
 package metanode
 
 import (
+	"fmt"
 	"testing"
+
+	"github.com/tiglabs/containerfs/proto"
 )
 
 func Test_CreateDentry(t *testing.T) {
 }
+
+func TestReadDirPages(t *testing.T) {
+	mp := NewMetaPartition(compatConfig("")).(*metaPartition)
+	for i := 0; i < 25; i++ {
+		mp.dentryTree.ReplaceOrInsert(&Dentry{ParentId: 1, Name: fmt.Sprintf("f%02d", i), Inode: uint64(100 + i)}, true)
+	}
+	mp.dentryTree.ReplaceOrInsert(&Dentry{ParentId: 2, Name: "other", Inode: 200}, true)
+
+	if resp := mp.readDir(&ReadDirReq{ParentID: 1}); len(resp.Children) != 25 || resp.Next != "" {
+		t.Fatalf("readdir of no limit: %v dentries next %q", len(resp.Children), resp.Next)
+	}
+	var names []string
+	marker := ""
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatalf("readdir of 25 dentries in pages of 10 not done after %v pages", pages)
+		}
+		resp := mp.readDir(&ReadDirReq{ParentID: 1, Marker: marker, Limit: 10})
+		for _, child := range resp.Children {
+			names = append(names, child.Name)
+		}
+		if resp.Next == "" {
+			break
+		}
+		marker = resp.Next
+	}
+	if len(names) != 25 || names[0] != "f00" || names[10] != "f10" || names[24] != "f24" {
+		t.Fatalf("readdir pages: %v", names)
+	}
+	if resp := mp.readDir(&ReadDirReq{ParentID: 1, Marker: "f19", Limit: 5}); len(resp.Children) != 5 || resp.Next != "" {
+		t.Fatalf("last full page: %v dentries next %q", len(resp.Children), resp.Next)
+	}
+}
+
+func TestDeleteDentryIno(t *testing.T) {
+	mp := NewMetaPartition(compatConfig("")).(*metaPartition)
+	mp.dentryTree.ReplaceOrInsert(&Dentry{ParentId: 1, Name: "a", Inode: 100}, true)
+
+	// the name renamed over by another inode is kept
+	if resp := mp.deleteDentryIno(&Dentry{ParentId: 1, Name: "a", Inode: 101}); resp.Status != proto.OpNotExistErr {
+		t.Fatalf("delete of the dentry of another inode: status %v", resp.Status)
+	}
+	if mp.dentryTree.Get(&Dentry{ParentId: 1, Name: "a"}) == nil {
+		t.Fatalf("dentry of another inode deleted")
+	}
+	if resp := mp.deleteDentryIno(&Dentry{ParentId: 1, Name: "b", Inode: 100}); resp.Status != proto.OpNotExistErr {
+		t.Fatalf("delete of a missing dentry: status %v", resp.Status)
+	}
+	resp := mp.deleteDentryIno(&Dentry{ParentId: 1, Name: "a", Inode: 100})
+	if resp.Status != proto.OpOk || resp.Msg == nil || resp.Msg.Inode != 100 {
+		t.Fatalf("delete of the dentry of the inode: status %v msg %v", resp.Status, resp.Msg)
+	}
+	if mp.dentryTree.Get(&Dentry{ParentId: 1, Name: "a"}) != nil {
+		t.Fatalf("dentry of the inode not deleted")
+	}
+}
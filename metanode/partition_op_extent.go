@@ -21,7 +21,16 @@ import (
 	"os"
 )
 
-func (mp *metaPartition) ExtentAppend(req *proto.AppendExtentKeyRequest, p *Packet) (err error) {
+// ExtentAppend refuses the extent growing the file beyond maxFileSize, 0 means no limit.
+func (mp *metaPartition) ExtentAppend(req *proto.AppendExtentKeyRequest, maxFileSize uint64, p *Packet) (err error) {
+	if status := mp.checkAccess(req.Caller, req.Inode, accessWrite); status != proto.OpOk {
+		p.PackErrorWithBody(status, nil)
+		return
+	}
+	if maxFileSize != 0 && mp.sizeAfterAppend(req.Inode, req.Extent) > maxFileSize {
+		p.PackErrorWithBody(proto.OpFileTooLargeErr, nil)
+		return
+	}
 	ino := NewInode(req.Inode, 0)
 	ino.Extents.Put(req.Extent)
 	val, err := ino.Marshal()
@@ -38,6 +47,27 @@ func (mp *metaPartition) ExtentAppend(req *proto.AppendExtentKeyRequest, p *Pack
 	return
 }
 
+// the size of the inode once the extent is put, 0 if the inode doesn't exist
+func (mp *metaPartition) sizeAfterAppend(ino uint64, ek proto.ExtentKey) (size uint64) {
+	retMsg := mp.getInode(NewInode(ino, 0))
+	if retMsg.Status != proto.OpOk {
+		return
+	}
+	grown := uint64(ek.Size)
+	retMsg.Msg.Extents.Range(func(i int, v proto.ExtentKey) bool {
+		size += uint64(v.Size)
+		if v.PartitionId == ek.PartitionId && v.ExtentId == ek.ExtentId {
+			// the put only extends an extent already in the inode
+			grown = 0
+			if ek.Size > v.Size {
+				grown = uint64(ek.Size - v.Size)
+			}
+		}
+		return true
+	})
+	return size + grown
+}
+
 func (mp *metaPartition) ExtentsList(req *proto.GetExtentsRequest,
 	p *Packet) (err error) {
 	ino := NewInode(req.Inode, 0)
@@ -47,6 +77,13 @@ func (mp *metaPartition) ExtentsList(req *proto.GetExtentsRequest,
 		reply  []byte
 		status = retMsg.Status
 	)
+	if status == proto.OpNotExistErr {
+		// an unlinked inode is readable until all the open handles are released
+		ino, status = mp.getOpenUnlinkedInode(req.Inode)
+	}
+	if status == proto.OpOk && req.Caller != nil && !hasAccess(req.Caller, ino, accessRead) {
+		status = proto.OpAccessErr
+	}
 	if status == proto.OpOk {
 		resp := &proto.GetExtentsResponse{}
 		ino.Extents.Range(func(i int, ext proto.ExtentKey) bool {
@@ -62,8 +99,71 @@ func (mp *metaPartition) ExtentsList(req *proto.GetExtentsRequest,
 	return
 }
 
+// ExtentsReplace replaces the extent keys of the inode got by the client, the
+// keys of a file migrated off the data partitions released.
+func (mp *metaPartition) ExtentsReplace(req *proto.ReplaceExtentKeysRequest, p *Packet) (err error) {
+	val, err := json.Marshal(req)
+	if err != nil {
+		p.PackErrorWithBody(proto.OpErr, nil)
+		return
+	}
+	resp, err := mp.Put(opFSMExtentsReplace, val)
+	if err != nil {
+		p.PackErrorWithBody(proto.OpAgain, []byte(err.Error()))
+		return
+	}
+	p.PackErrorWithBody(resp.(uint8), nil)
+	return
+}
+
+// ListOrphans lists the regular inodes whose last link is deleted but which
+// are not released: not evicted yet, or deleted with an open handle left.
+func (mp *metaPartition) ListOrphans(req *proto.ListOrphansRequest, p *Packet) (err error) {
+	resp := &proto.ListOrphansResponse{Inodes: mp.orphanInodes()}
+	reply, err := json.Marshal(resp)
+	if err != nil {
+		p.PackErrorWithBody(proto.OpErr, nil)
+		return
+	}
+	p.PackOkWithBody(reply)
+	return
+}
+
+func (mp *metaPartition) orphanInodes() (inos []uint64) {
+	inos = make([]uint64, 0)
+	mp.inodeTree.Ascend(func(i BtreeItem) bool {
+		ino := i.(*Inode)
+		if !proto.IsRegular(ino.Type) || ino.NLink > 0 {
+			return true
+		}
+		if ino.MarkDelete == 0 || mp.config.OpenFiles != nil && mp.config.OpenFiles.isOpen(mp.config.PartitionId, ino.Inode) {
+			inos = append(inos, ino.Inode)
+		}
+		return true
+	})
+	return
+}
+
+func (mp *metaPartition) getOpenUnlinkedInode(inode uint64) (ino *Inode, status uint8) {
+	status = proto.OpNotExistErr
+	item := mp.inodeTree.Get(NewInode(inode, 0))
+	if item == nil {
+		return
+	}
+	ino = item.(*Inode)
+	if ino.MarkDelete == 1 && mp.config.OpenFiles != nil &&
+		mp.config.OpenFiles.isOpen(mp.config.PartitionId, inode) {
+		status = proto.OpOk
+	}
+	return
+}
+
 func (mp *metaPartition) ExtentsTruncate(req *ExtentsTruncateReq,
 	p *Packet) (err error) {
+	if status := mp.checkAccess(req.Caller, req.Inode, accessWrite); status != proto.OpOk {
+		p.PackErrorWithBody(status, nil)
+		return
+	}
 	ino := NewInode(req.Inode, proto.Mode(os.ModePerm))
 	nextIno, err := mp.nextInodeID()
 	if err != nil {
@@ -16,6 +16,7 @@ package metanode
 
 import (
 	"encoding/json"
+	"fmt"
 	"time"
 
 	"github.com/tiglabs/containerfs/proto"
@@ -34,6 +35,15 @@ func replyInfo(info *proto.InodeInfo, ino *Inode) {
 }
 
 func (mp *metaPartition) CreateInode(req *CreateInoReq, p *Packet) (err error) {
+	if status := mp.checkCreate(req); status != proto.OpOk {
+		p.PackErrorWithBody(status, nil)
+		return
+	}
+	if len(req.Target) > proto.MaxSymlinkTargetSize {
+		err = fmt.Errorf("symlink target of %v bytes over %v", len(req.Target), proto.MaxSymlinkTargetSize)
+		p.PackErrorWithBody(proto.OpArgMismatchErr, []byte(err.Error()))
+		return
+	}
 	inoID, err := mp.nextInodeID()
 	if err != nil {
 		p.PackErrorWithBody(proto.OpInodeFullErr, []byte(err.Error()))
@@ -41,6 +51,8 @@ func (mp *metaPartition) CreateInode(req *CreateInoReq, p *Packet) (err error) {
 	}
 	ino := NewInode(inoID, req.Mode)
 	ino.LinkTarget = req.Target
+	ino.Uid = req.Uid
+	ino.Gid = req.Gid
 	val, err := ino.Marshal()
 	if err != nil {
 		p.PackErrorWithBody(proto.OpErr, []byte(err.Error()))
@@ -68,6 +80,8 @@ func (mp *metaPartition) CreateInode(req *CreateInoReq, p *Packet) (err error) {
 		resp.Info.AccessTime = time.Unix(ino.AccessTime, 0)
 		resp.Info.Target = ino.LinkTarget
 		resp.Info.Nlink = ino.NLink
+		resp.Info.Uid = ino.Uid
+		resp.Info.Gid = ino.Gid
 		reply, err = json.Marshal(resp)
 		if err != nil {
 			status = proto.OpErr
@@ -107,6 +121,10 @@ func (mp *metaPartition) DeleteInode(req *DeleteInoReq, p *Packet) (err error) {
 }
 
 func (mp *metaPartition) Open(req *OpenReq, p *Packet) (err error) {
+	if status := mp.checkAccess(req.Caller, req.Inode, openAccess(req.Flag)); status != proto.OpOk {
+		p.PackErrorWithBody(status, nil)
+		return
+	}
 	ino := NewInode(req.Inode, 0)
 	val, err := ino.Marshal()
 	if err != nil {
@@ -245,8 +263,20 @@ func (mp *metaPartition) EvictInode(req *EvictInodeReq, p *Packet) (err error) {
 	return
 }
 
-func (mp *metaPartition) SetAttr(reqData []byte, p *Packet) (err error) {
-	_, err = mp.Put(opFSMSetAttr, reqData)
+func (mp *metaPartition) SetAttr(req *SetattrRequest, p *Packet) (err error) {
+	if status := mp.checkSetAttr(req); status != proto.OpOk {
+		p.PackErrorWithBody(status, nil)
+		return
+	}
+	// the caller is checked by the leader only
+	r := *req
+	r.Caller = nil
+	val, err := json.Marshal(&r)
+	if err != nil {
+		p.PackErrorWithBody(proto.OpErr, []byte(err.Error()))
+		return
+	}
+	_, err = mp.Put(opFSMSetAttr, val)
 	if err != nil {
 		p.PackErrorWithBody(proto.OpAgain, []byte(err.Error()))
 		return
@@ -0,0 +1,83 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// snapshotSender paces the snapshots sent by all the partitions of the node,
+// replicas added at once share the bandwidth so their bootstrap does not take
+// the disks and the network from serving.
+type snapshotSender struct {
+	bytesPerSec int64 // 0 leaves the snapshots unpaced
+	batchSize   int   // bytes of items sent in a frame, 0 sends every item in its own frame
+	mu          sync.Mutex
+	next        time.Time // when the bytes sent so far are due
+}
+
+func newSnapshotSender(bytesPerSec int64, batchSize int) *snapshotSender {
+	return &snapshotSender{bytesPerSec: bytesPerSec, batchSize: batchSize}
+}
+
+/*block until n more bytes can be sent, the caller is the snapshot iterator so raft is held back*/
+func (s *snapshotSender) wait(n int) {
+	if s == nil || s.bytesPerSec <= 0 {
+		return
+	}
+	s.mu.Lock()
+	now := time.Now()
+	if s.next.Before(now) {
+		s.next = now
+	}
+	s.next = s.next.Add(time.Duration(int64(n) * int64(time.Second) / s.bytesPerSec))
+	due := s.next
+	s.mu.Unlock()
+	time.Sleep(due.Sub(now))
+}
+
+func (s *snapshotSender) batch() int {
+	if s == nil {
+		return 0
+	}
+	return s.batchSize
+}
+
+// a batch frame is the MetaItem of opFSMSnapshotBatch, its value keeps the
+// binary of the items, each after its length in 4 bytes
+func appendSnapshotBatch(buff *bytes.Buffer, item []byte) {
+	binary.Write(buff, binary.BigEndian, uint32(len(item)))
+	buff.Write(item)
+}
+
+func rangeSnapshotBatch(data []byte, fn func(item []byte) error) (err error) {
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return ErrSnapshotBatch
+		}
+		length := binary.BigEndian.Uint32(data)
+		if uint32(len(data)-4) < length {
+			return ErrSnapshotBatch
+		}
+		if err = fn(data[4 : 4+length]); err != nil {
+			return
+		}
+		data = data[4+length:]
+	}
+	return
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+type snapFrames struct {
+	frames [][]byte
+}
+
+func (it *snapFrames) Next() (data []byte, err error) {
+	if len(it.frames) == 0 {
+		return nil, io.EOF
+	}
+	data = it.frames[0]
+	it.frames = it.frames[1:]
+	return
+}
+
+func TestSnapshotBatch(t *testing.T) {
+	mp := newCompatPartition("")
+	mp.config.Snapshots = newSnapshotSender(0, 4<<10)
+	snap, err := mp.Snapshot()
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	it := &snapFrames{}
+	for {
+		data, err := snap.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("snapshot next: %v", err)
+		}
+		it.frames = append(it.frames, data)
+	}
+	// the apply id and a batch of all the items
+	if len(it.frames) != 2 {
+		t.Fatalf("%v frames, want 2", len(it.frames))
+	}
+	applied := NewMetaPartition(&MetaPartitionConfig{}).(*metaPartition)
+	if err = applied.ApplySnapshot(nil, it); err != nil {
+		t.Fatalf("apply snapshot: %v", err)
+	}
+	checkCompatPartition(t, "batched snapshot", applied, 42)
+	if applied.config.Cursor != 4 {
+		t.Errorf("snapshot cursor %v, want 4", applied.config.Cursor)
+	}
+}
+
+func TestSnapshotBatchTruncated(t *testing.T) {
+	frame, _ := NewMetaItem(opFSMSnapshotBatch, nil, []byte{0, 0, 0, 9, 1}).MarshalBinary()
+	it := &snapFrames{frames: [][]byte{make([]byte, 8), frame}}
+	applied := NewMetaPartition(&MetaPartitionConfig{}).(*metaPartition)
+	if err := applied.ApplySnapshot(nil, it); err != ErrSnapshotBatch {
+		t.Fatalf("apply truncated batch: %v, want %v", err, ErrSnapshotBatch)
+	}
+}
+
+func TestSnapshotSenderPace(t *testing.T) {
+	s := newSnapshotSender(1<<20, 0)
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		s.wait(64 << 10)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("256KB sent in %v at 1MB/s", elapsed)
+	}
+	var unpaced *snapshotSender
+	unpaced.wait(1 << 30)
+}
@@ -37,6 +37,8 @@ const (
 	metaFileTmp    = ".meta"
 	applyIDFile    = "apply"
 	applyIDFileTmp = ".apply"
+	txFile         = "tx"
+	txFileTmp      = ".tx"
 )
 
 // Load struct from meta
@@ -168,6 +170,23 @@ func (mp *metaPartition) loadDentry() (err error) {
 	}
 }
 
+// Load the rename transactions, there is no file if there is none
+func (mp *metaPartition) loadTx() (err error) {
+	data, err := ioutil.ReadFile(path.Join(mp.config.RootDir, txFile))
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		err = errors.Errorf("[loadTx] ReadFile: %s", err.Error())
+		return
+	}
+	if err = mp.txs.unmarshal(data); err != nil {
+		err = errors.Errorf("[loadTx] Unmarshal: %s", err.Error())
+	}
+	return
+}
+
 func (mp *metaPartition) loadApplyID() (err error) {
 	filename := path.Join(mp.config.RootDir, applyIDFile)
 	if _, err = os.Stat(filename); err != nil {
@@ -241,6 +260,31 @@ func (mp *metaPartition) storeApplyID(sm *storeMsg) (err error) {
 	return
 }
 
+func (mp *metaPartition) storeTx(sm *storeMsg) (err error) {
+	if sm.txs == nil {
+		if err = os.Remove(path.Join(mp.config.RootDir, txFile)); os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	filename := path.Join(mp.config.RootDir, txFileTmp)
+	fp, err := os.OpenFile(filename, os.O_RDWR|os.O_APPEND|os.O_TRUNC|os.
+		O_CREATE, 0755)
+	if err != nil {
+		return
+	}
+	defer func() {
+		fp.Sync()
+		fp.Close()
+		os.Remove(filename)
+	}()
+	if _, err = fp.Write(sm.txs); err != nil {
+		return
+	}
+	err = os.Rename(filename, path.Join(mp.config.RootDir, txFile))
+	return
+}
+
 func (mp *metaPartition) storeInode(sm *storeMsg) (err error) {
 	filename := path.Join(mp.config.RootDir, inodeFileTmp)
 	fp, err := os.OpenFile(filename, os.O_RDWR|os.O_TRUNC|os.O_APPEND|os.
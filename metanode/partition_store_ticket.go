@@ -27,6 +27,7 @@ type storeMsg struct {
 	applyIndex uint64
 	inodeTree  *BTree
 	dentryTree *BTree
+	txs        []byte // the marshaled txTable, nil if there is no transaction
 }
 
 func (mp *metaPartition) startSchedule(curIndex uint64) {
@@ -48,8 +49,11 @@ func (mp *metaPartition) startSchedule(curIndex uint64) {
 		} else {
 			curIndex = msg.applyIndex
 		}
-		// Truncate raft log
-		mp.raftPartition.Truncate(curIndex)
+		// Truncate raft log, the retained entries let a lagging replica
+		// catch up from the log instead of a new snapshot
+		if curIndex > mp.config.RaftLogRetain {
+			mp.raftPartition.Truncate(curIndex - mp.config.RaftLogRetain)
+		}
 		if _, ok := mp.IsLeader(); ok {
 			timer.Reset(storeTimeTicker)
 		}
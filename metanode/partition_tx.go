@@ -0,0 +1,486 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/log"
+	"github.com/tiglabs/containerfs/util/ump"
+)
+
+// A rename between the dirs of two partitions is a transaction of two parts
+// coordinated by the client: the dentry of the destination is prepared on
+// its partition, the primary, then the dentry of the source on its own, and
+// both are committed in the same order. A prepared dentry is changed by no
+// other op until its part is committed or aborted. The primary decides the
+// transaction at its commit, or aborts it once the timeout is passed, and
+// the leader of the other part asks the primary for the decision if the
+// client does not commit or abort it in time. The partition committing the
+// dentry of the destination unlinks the inode it replaced, the part stays
+// prepared if the primary has no decision for it any more.
+
+// txRecord is a part of a rename transaction prepared on the partition.
+type txRecord struct {
+	proto.TxPrepareRequest
+	OldInode uint64 `json:"oino"`
+	Deadline int64  `json:"deadline"` // unix seconds, the leader resolves the part after it
+	alarmed  bool   // the leader alarmed the part has no decision
+}
+
+func (r *txRecord) locks(parentID uint64, name string) bool {
+	return r.ParentID == parentID && r.Name == name
+}
+
+// txDecision is the outcome of a transaction, kept by the primary for the
+// other part to ask.
+type txDecision struct {
+	Status uint8 `json:"status"`
+	Expire int64 `json:"expire"`
+}
+
+// txUnlink is an inode replaced by a committed transaction, the leader
+// unlinks it from its partition.
+type txUnlink struct {
+	Inode       uint64   `json:"ino"`
+	PartitionID uint64   `json:"pid"`
+	Addrs       []string `json:"addrs"`
+}
+
+// txTable is the transactions of the partition, changed by the fsm only and
+// kept with the inodes and the dentries in the stored files and snapshots.
+type txTable struct {
+	Prepared     map[string]*txRecord   `json:"prepared"`
+	Decided      map[string]*txDecision `json:"decided"`
+	Unlinks      map[string]*txUnlink   `json:"unlinks,omitempty"`
+	sync.RWMutex `json:"-"`
+}
+
+type ResponseTx struct {
+	Status   uint8
+	OldInode uint64
+}
+
+func newTxTable() *txTable {
+	return &txTable{
+		Prepared: make(map[string]*txRecord),
+		Decided:  make(map[string]*txDecision),
+		Unlinks:  make(map[string]*txUnlink),
+	}
+}
+
+// marshal returns nil if there is no transaction.
+func (t *txTable) marshal() (data []byte, err error) {
+	t.RLock()
+	defer t.RUnlock()
+	if len(t.Prepared) == 0 && len(t.Decided) == 0 && len(t.Unlinks) == 0 {
+		return
+	}
+	return json.Marshal(t)
+}
+
+func (t *txTable) unmarshal(data []byte) (err error) {
+	table := newTxTable()
+	if err = json.Unmarshal(data, table); err != nil {
+		return
+	}
+	t.replace(table)
+	return
+}
+
+func (t *txTable) replace(table *txTable) {
+	t.Lock()
+	defer t.Unlock()
+	t.Prepared, t.Decided, t.Unlinks = table.Prepared, table.Decided, table.Unlinks
+	if t.Prepared == nil {
+		t.Prepared = make(map[string]*txRecord)
+	}
+	if t.Decided == nil {
+		t.Decided = make(map[string]*txDecision)
+	}
+	if t.Unlinks == nil {
+		t.Unlinks = make(map[string]*txUnlink)
+	}
+}
+
+/*the dentry is prepared by a transaction*/
+func (t *txTable) locked(parentID uint64, name string) bool {
+	t.RLock()
+	defer t.RUnlock()
+	for _, r := range t.Prepared {
+		if r.locks(parentID, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *txTable) status(txID string) uint8 {
+	t.RLock()
+	defer t.RUnlock()
+	if _, ok := t.Prepared[txID]; ok {
+		return proto.TxStatusPrepared
+	}
+	if d, ok := t.Decided[txID]; ok {
+		return d.Status
+	}
+	return proto.TxStatusUnknown
+}
+
+/*the prepared parts passed their deadline*/
+func (t *txTable) expired(now int64) (records []*txRecord) {
+	t.RLock()
+	defer t.RUnlock()
+	for _, r := range t.Prepared {
+		if r.Deadline < now {
+			records = append(records, r)
+		}
+	}
+	return
+}
+
+/*the replaced inodes not unlinked yet*/
+func (t *txTable) unlinks() map[string]*txUnlink {
+	t.RLock()
+	defer t.RUnlock()
+	unlinks := make(map[string]*txUnlink, len(t.Unlinks))
+	for id, u := range t.Unlinks {
+		unlinks[id] = u
+	}
+	return unlinks
+}
+
+func (t *txTable) unlinked(txID string) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.Unlinks, txID)
+}
+
+/*the caller must hold the lock of txTable*/
+func (t *txTable) decide(partitionID uint64, r *txRecord, status uint8) {
+	delete(t.Prepared, r.TxID)
+	if r.Primary != partitionID {
+		return
+	}
+	now := time.Now().Unix()
+	for id, d := range t.Decided {
+		if d.Expire < now {
+			delete(t.Decided, id)
+		}
+	}
+	t.Decided[r.TxID] = &txDecision{Status: status, Expire: now + int64(txDecisionRetention/time.Second)}
+}
+
+func (mp *metaPartition) TxPrepare(req *proto.TxPrepareRequest, p *Packet) (err error) {
+	if req.TxID == "" || req.Name == "" || (req.Op != proto.TxCreateDentry && req.Op != proto.TxDeleteDentry) {
+		p.PackErrorWithBody(proto.OpArgMismatchErr, nil)
+		return
+	}
+	status := proto.OpOk
+	switch req.Op {
+	case proto.TxCreateDentry:
+		if _, exist := mp.getDentry(&Dentry{ParentId: req.ParentID, Name: req.Name}); exist == proto.OpOk {
+			status = mp.checkRemove(req.Caller, req.ParentID, req.Name)
+		} else {
+			status = mp.checkAccess(req.Caller, req.ParentID, accessWrite|accessExec)
+		}
+	case proto.TxDeleteDentry:
+		status = mp.checkRemove(req.Caller, req.ParentID, req.Name)
+	}
+	if status != proto.OpOk {
+		p.PackErrorWithBody(status, nil)
+		return
+	}
+	timeout := req.Timeout
+	if timeout <= 0 || timeout > int64(maxTxTimeout/time.Second) {
+		timeout = int64(maxTxTimeout / time.Second)
+	}
+	r := &txRecord{TxPrepareRequest: *req, Deadline: time.Now().Unix() + timeout}
+	// the caller is checked by the leader only, the record does not keep it
+	r.Caller = nil
+	val, err := json.Marshal(r)
+	if err != nil {
+		p.PackErrorWithBody(proto.OpErr, []byte(err.Error()))
+		return
+	}
+	resp, err := mp.Put(opFSMTxPrepare, val)
+	if err != nil {
+		p.PackErrorWithBody(proto.OpAgain, []byte(err.Error()))
+		return
+	}
+	msg := resp.(*ResponseTx)
+	var reply []byte
+	if msg.Status == proto.OpOk {
+		if reply, err = json.Marshal(&proto.TxPrepareResponse{OldInode: msg.OldInode}); err != nil {
+			msg.Status = proto.OpErr
+		}
+	}
+	p.PackErrorWithBody(msg.Status, reply)
+	return
+}
+
+func (mp *metaPartition) TxCommit(req *proto.TxRequest, p *Packet) (err error) {
+	resp, err := mp.Put(opFSMTxCommit, []byte(req.TxID))
+	if err != nil {
+		p.PackErrorWithBody(proto.OpAgain, []byte(err.Error()))
+		return
+	}
+	p.PackErrorWithBody(resp.(uint8), nil)
+	return
+}
+
+func (mp *metaPartition) TxAbort(req *proto.TxRequest, p *Packet) (err error) {
+	resp, err := mp.Put(opFSMTxAbort, []byte(req.TxID))
+	if err != nil {
+		p.PackErrorWithBody(proto.OpAgain, []byte(err.Error()))
+		return
+	}
+	p.PackErrorWithBody(resp.(uint8), nil)
+	return
+}
+
+func (mp *metaPartition) TxStatus(req *proto.TxRequest, p *Packet) (err error) {
+	reply, err := json.Marshal(&proto.TxStatusResponse{Status: mp.txs.status(req.TxID)})
+	if err != nil {
+		p.PackErrorWithBody(proto.OpErr, []byte(err.Error()))
+		return
+	}
+	p.PackOkWithBody(reply)
+	return
+}
+
+// txPrepare checks the dentry of the part and records it, a retry of the
+// prepare gets the same result.
+func (mp *metaPartition) txPrepare(r *txRecord) (resp *ResponseTx) {
+	resp = &ResponseTx{Status: proto.OpOk}
+	t := mp.txs
+	t.Lock()
+	defer t.Unlock()
+	if prepared, ok := t.Prepared[r.TxID]; ok {
+		resp.OldInode = prepared.OldInode
+		return
+	}
+	if _, ok := t.Decided[r.TxID]; ok {
+		resp.Status = proto.OpArgMismatchErr
+		return
+	}
+	for _, prepared := range t.Prepared {
+		if prepared.locks(r.ParentID, r.Name) {
+			resp.Status = proto.OpAgain
+			return
+		}
+	}
+	item := mp.dentryTree.Get(&Dentry{ParentId: r.ParentID, Name: r.Name})
+	switch r.Op {
+	case proto.TxCreateDentry:
+		if item != nil {
+			r.OldInode = item.(*Dentry).Inode
+		}
+		if r.OldInode != r.Replaced {
+			// the client routes the unlink of the inode it looked up
+			resp.Status = proto.OpExistErr
+			return
+		}
+	case proto.TxDeleteDentry:
+		if item == nil || item.(*Dentry).Inode != r.Inode {
+			resp.Status = proto.OpNotExistErr
+			return
+		}
+	}
+	t.Prepared[r.TxID] = r
+	resp.OldInode = r.OldInode
+	return
+}
+
+// txCommit applies the dentry of the part, the commit of a part already
+// committed succeeds.
+func (mp *metaPartition) txCommit(txID string) (status uint8) {
+	status = proto.OpOk
+	t := mp.txs
+	t.Lock()
+	defer t.Unlock()
+	r, ok := t.Prepared[txID]
+	if !ok {
+		if d, ok := t.Decided[txID]; !ok || d.Status != proto.TxStatusCommitted {
+			status = proto.OpNotExistErr
+		}
+		return
+	}
+	switch r.Op {
+	case proto.TxCreateDentry:
+		mp.dentryTree.ReplaceOrInsert(&Dentry{ParentId: r.ParentID, Name: r.Name, Inode: r.Inode, Type: r.Mode}, true)
+		if r.OldInode != 0 {
+			t.Unlinks[txID] = &txUnlink{Inode: r.OldInode, PartitionID: r.ReplacedPartition, Addrs: r.ReplacedAddrs}
+		}
+	case proto.TxDeleteDentry:
+		mp.dentryTree.Delete(&Dentry{ParentId: r.ParentID, Name: r.Name})
+	}
+	// only the leader has the leases of the dir
+	if mp.config.Leases != nil {
+		mp.config.Leases.invalidate("", mp.config.PartitionId, r.ParentID)
+	}
+	t.decide(mp.config.PartitionId, r, proto.TxStatusCommitted)
+	return
+}
+
+// txAbort drops the part, a committed transaction is not aborted.
+func (mp *metaPartition) txAbort(txID string) (status uint8) {
+	status = proto.OpOk
+	t := mp.txs
+	t.Lock()
+	defer t.Unlock()
+	r, ok := t.Prepared[txID]
+	if !ok {
+		if d, ok := t.Decided[txID]; ok && d.Status == proto.TxStatusCommitted {
+			status = proto.OpArgMismatchErr
+		}
+		return
+	}
+	t.decide(mp.config.PartitionId, r, proto.TxStatusAborted)
+	return
+}
+
+// txResolveWorker resolves the parts the clients did not commit or abort in
+// time and unlinks the replaced inodes on the leader.
+func (mp *metaPartition) txResolveWorker() {
+	t := time.NewTicker(txResolveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-mp.stopC:
+			return
+		case <-t.C:
+		}
+		if _, ok := mp.IsLeader(); !ok {
+			continue
+		}
+		for _, r := range mp.txs.expired(time.Now().Unix()) {
+			mp.resolveTx(r)
+		}
+		for txID, u := range mp.txs.unlinks() {
+			mp.unlinkReplaced(txID, u)
+		}
+	}
+}
+
+func (mp *metaPartition) resolveTx(r *txRecord) {
+	op := opFSMTxAbort
+	if r.Primary != mp.config.PartitionId {
+		status, err := mp.primaryTxStatus(r)
+		if err != nil {
+			log.LogWarnf("[resolveTx] partition(%v) tx(%v): %v", mp.config.PartitionId, r.TxID, err)
+			return
+		}
+		switch status {
+		case proto.TxStatusPrepared:
+			// the primary aborts it once its own deadline is passed
+			return
+		case proto.TxStatusCommitted:
+			op = opFSMTxCommit
+		case proto.TxStatusUnknown:
+			// the decision expired or was lost, the primary may have committed
+			// it, the part is asked again until an operator resolves it
+			msg := fmt.Sprintf("partition(%v) tx(%v) parent(%v) name(%v): no decision on primary partition(%v)",
+				mp.config.PartitionId, r.TxID, r.ParentID, r.Name, r.Primary)
+			log.LogErrorf("[resolveTx] %v", msg)
+			if !r.alarmed {
+				r.alarmed = true
+				ump.Alarm(UMPKey, "resolveTx: "+msg)
+			}
+			return
+		}
+	}
+	if _, err := mp.Put(op, []byte(r.TxID)); err != nil {
+		log.LogWarnf("[resolveTx] partition(%v) tx(%v): %v", mp.config.PartitionId, r.TxID, err)
+		return
+	}
+	log.LogWarnf("[resolveTx] partition(%v) tx(%v) op(%v) parent(%v) name(%v) resolved, committed(%v)",
+		mp.config.PartitionId, r.TxID, r.Op, r.ParentID, r.Name, op == opFSMTxCommit)
+}
+
+// unlinkReplaced unlinks the inode replaced by the transaction from its
+// partition, the unlink is sent again at the next interval if no member of the
+// partition took it.
+func (mp *metaPartition) unlinkReplaced(txID string, u *txUnlink) {
+	req := &proto.DeleteInodeRequest{VolName: mp.config.VolName, PartitionID: u.PartitionID, Inode: u.Inode}
+	var err error
+	for _, addr := range u.Addrs {
+		var p *proto.Packet
+		if p, err = mp.sendToMember(addr, proto.OpMetaDeleteInode, req); err != nil {
+			continue
+		}
+		if p.ResultCode != proto.OpOk && p.ResultCode != proto.OpNotExistErr {
+			err = fmt.Errorf("unlink from %v: %v", addr, p.GetResultMesg())
+			continue
+		}
+		if _, err = mp.Put(opFSMTxUnlinked, []byte(txID)); err != nil {
+			break
+		}
+		log.LogDebugf("[unlinkReplaced] partition(%v) tx(%v) ino(%v) of partition(%v) unlinked",
+			mp.config.PartitionId, txID, u.Inode, u.PartitionID)
+		return
+	}
+	log.LogWarnf("[unlinkReplaced] partition(%v) tx(%v) ino(%v) of partition(%v): %v",
+		mp.config.PartitionId, txID, u.Inode, u.PartitionID, err)
+}
+
+/*ask the members of the primary partition for the status of the transaction*/
+func (mp *metaPartition) primaryTxStatus(r *txRecord) (status uint8, err error) {
+	req := &proto.TxRequest{VolName: mp.config.VolName, PartitionID: r.Primary, TxID: r.TxID}
+	err = fmt.Errorf("no member of primary partition(%v)", r.Primary)
+	for _, addr := range r.PrimaryAddrs {
+		var p *proto.Packet
+		if p, err = mp.sendToMember(addr, proto.OpMetaTxStatus, req); err != nil {
+			continue
+		}
+		if p.ResultCode != proto.OpOk {
+			err = fmt.Errorf("status of tx from %v: %v", addr, p.GetResultMesg())
+			continue
+		}
+		resp := &proto.TxStatusResponse{}
+		if err = p.UnmarshalData(resp); err == nil {
+			return resp.Status, nil
+		}
+	}
+	return
+}
+
+/*send a request to a member of another partition*/
+func (mp *metaPartition) sendToMember(addr string, opcode uint8, req interface{}) (p *proto.Packet, err error) {
+	p = proto.NewPacket()
+	p.Opcode = opcode
+	p.ReqID = proto.GetReqID()
+	if err = p.MarshalData(req); err != nil {
+		return
+	}
+	conn, err := mp.config.ConnPool.Get(addr)
+	if err != nil {
+		return
+	}
+	if err = p.WriteToConn(conn); err != nil {
+		mp.config.ConnPool.Put(conn, ForceCloseConnect)
+		return
+	}
+	if err = p.ReadFromConn(conn, proto.ReadDeadlineTime); err != nil {
+		mp.config.ConnPool.Put(conn, ForceCloseConnect)
+		return
+	}
+	mp.config.ConnPool.Put(conn, NoCloseConnect)
+	return
+}
@@ -0,0 +1,187 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+func newTestTx(txID string, op uint8, parentID uint64, name string, inode uint64, primary uint64) *txRecord {
+	return &txRecord{
+		TxPrepareRequest: proto.TxPrepareRequest{TxID: txID, Op: op, ParentID: parentID, Name: name,
+			Inode: inode, Primary: primary},
+		Deadline: time.Now().Unix() + 10,
+	}
+}
+
+func TestTxRename(t *testing.T) {
+	src := NewMetaPartition(compatConfig("")).(*metaPartition)
+	dst := NewMetaPartition(compatConfig("")).(*metaPartition)
+	dst.config.PartitionId = 2
+	src.dentryTree.ReplaceOrInsert(&Dentry{ParentId: 1, Name: "a", Inode: 10}, true)
+	dst.dentryTree.ReplaceOrInsert(&Dentry{ParentId: 5, Name: "b", Inode: 11}, true)
+
+	dstTx := newTestTx("tx1", proto.TxCreateDentry, 5, "b", 10, 2)
+	dstTx.Replaced, dstTx.ReplacedPartition = 11, 3
+	if resp := dst.txPrepare(newTestTx("tx1", proto.TxCreateDentry, 5, "b", 10, 2)); resp.Status != proto.OpExistErr {
+		t.Fatalf("prepare dst replacing another inode: status %v", resp.Status)
+	}
+	if resp := dst.txPrepare(dstTx); resp.Status != proto.OpOk || resp.OldInode != 11 {
+		t.Fatalf("prepare dst: status %v old inode %v", resp.Status, resp.OldInode)
+	}
+	// a retry of the prepare gets the same result
+	if resp := dst.txPrepare(dstTx); resp.Status != proto.OpOk || resp.OldInode != 11 {
+		t.Fatalf("prepare dst again: status %v old inode %v", resp.Status, resp.OldInode)
+	}
+	if resp := src.txPrepare(newTestTx("tx1", proto.TxDeleteDentry, 1, "a", 99, 2)); resp.Status != proto.OpNotExistErr {
+		t.Fatalf("prepare src of another inode: status %v", resp.Status)
+	}
+	if resp := src.txPrepare(newTestTx("tx1", proto.TxDeleteDentry, 1, "a", 10, 2)); resp.Status != proto.OpOk {
+		t.Fatalf("prepare src: status %v", resp.Status)
+	}
+
+	// the prepared dentries are changed by no other op
+	if status := dst.createDentry(&Dentry{ParentId: 5, Name: "b", Inode: 12}); status != proto.OpAgain {
+		t.Fatalf("create of a prepared dentry: status %v", status)
+	}
+	if resp := src.deleteDentry(&Dentry{ParentId: 1, Name: "a"}); resp.Status != proto.OpAgain {
+		t.Fatalf("delete of a prepared dentry: status %v", resp.Status)
+	}
+	if resp := src.txPrepare(newTestTx("tx2", proto.TxDeleteDentry, 1, "a", 10, 2)); resp.Status != proto.OpAgain {
+		t.Fatalf("prepare of a prepared dentry: status %v", resp.Status)
+	}
+	if status := dst.txs.status("tx1"); status != proto.TxStatusPrepared {
+		t.Fatalf("status of the prepared tx: %v", status)
+	}
+
+	if status := dst.txCommit("tx1"); status != proto.OpOk {
+		t.Fatalf("commit dst: status %v", status)
+	}
+	if status := dst.txCommit("tx1"); status != proto.OpOk {
+		t.Fatalf("commit dst again: status %v", status)
+	}
+	if status := dst.txAbort("tx1"); status != proto.OpArgMismatchErr {
+		t.Fatalf("abort of a committed tx: status %v", status)
+	}
+	if status := dst.txs.status("tx1"); status != proto.TxStatusCommitted {
+		t.Fatalf("status of the committed tx: %v", status)
+	}
+	// the partition of the dst unlinks the inode it replaced
+	if u := dst.txs.unlinks()["tx1"]; u == nil || u.Inode != 11 || u.PartitionID != 3 {
+		t.Fatalf("unlink of the replaced inode: %v", u)
+	}
+	dst.txs.unlinked("tx1")
+	if len(dst.txs.unlinks()) != 0 {
+		t.Fatalf("replaced inode not unlinked")
+	}
+	if status := src.txCommit("tx1"); status != proto.OpOk {
+		t.Fatalf("commit src: status %v", status)
+	}
+	// only the primary keeps the decision
+	if status := src.txs.status("tx1"); status != proto.TxStatusUnknown {
+		t.Fatalf("status of the tx on the other part: %v", status)
+	}
+
+	if item := dst.dentryTree.Get(&Dentry{ParentId: 5, Name: "b"}); item == nil || item.(*Dentry).Inode != 10 {
+		t.Fatalf("dst dentry after commit: %v", item)
+	}
+	if item := src.dentryTree.Get(&Dentry{ParentId: 1, Name: "a"}); item != nil {
+		t.Fatalf("src dentry after commit: %v", item)
+	}
+	if len(src.txs.unlinks()) != 0 {
+		t.Fatalf("src unlinks an inode: %v", src.txs.unlinks())
+	}
+	if status := dst.createDentry(&Dentry{ParentId: 5, Name: "c", Inode: 12}); status != proto.OpOk {
+		t.Fatalf("create after commit: status %v", status)
+	}
+}
+
+func TestTxAbort(t *testing.T) {
+	mp := NewMetaPartition(compatConfig("")).(*metaPartition)
+	mp.dentryTree.ReplaceOrInsert(&Dentry{ParentId: 1, Name: "a", Inode: 10}, true)
+	if resp := mp.txPrepare(newTestTx("tx1", proto.TxDeleteDentry, 1, "a", 10, 1)); resp.Status != proto.OpOk {
+		t.Fatalf("prepare: status %v", resp.Status)
+	}
+	if status := mp.txAbort("tx1"); status != proto.OpOk {
+		t.Fatalf("abort: status %v", status)
+	}
+	if status := mp.txCommit("tx1"); status != proto.OpNotExistErr {
+		t.Fatalf("commit of an aborted tx: status %v", status)
+	}
+	if resp := mp.txPrepare(newTestTx("tx1", proto.TxDeleteDentry, 1, "a", 10, 1)); resp.Status != proto.OpArgMismatchErr {
+		t.Fatalf("prepare of an aborted tx: status %v", resp.Status)
+	}
+	if status := mp.txs.status("tx1"); status != proto.TxStatusAborted {
+		t.Fatalf("status of the aborted tx: %v", status)
+	}
+	if item := mp.dentryTree.Get(&Dentry{ParentId: 1, Name: "a"}); item == nil {
+		t.Fatalf("dentry deleted by an aborted tx")
+	}
+	if resp := mp.deleteDentry(&Dentry{ParentId: 1, Name: "a"}); resp.Status != proto.OpOk {
+		t.Fatalf("delete after abort: status %v", resp.Status)
+	}
+}
+
+func TestTxSnapshot(t *testing.T) {
+	mp := NewMetaPartition(compatConfig("")).(*metaPartition)
+	mp.dentryTree.ReplaceOrInsert(&Dentry{ParentId: 1, Name: "a", Inode: 10}, true)
+	mp.txPrepare(newTestTx("tx1", proto.TxDeleteDentry, 1, "a", 10, 2))
+	mp.txPrepare(newTestTx("tx2", proto.TxCreateDentry, 1, "b", 11, 1))
+	mp.txAbort("tx2")
+	mp.txs.Unlinks["tx3"] = &txUnlink{Inode: 12, PartitionID: 3}
+
+	snap, err := mp.Snapshot()
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	it := &snapFrames{}
+	for {
+		data, err := snap.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("snapshot next: %v", err)
+		}
+		it.frames = append(it.frames, data)
+	}
+	// the apply id, the dentry and the transactions
+	if len(it.frames) != 3 {
+		t.Fatalf("%v frames, want 3", len(it.frames))
+	}
+	applied := NewMetaPartition(&MetaPartitionConfig{PartitionId: 1}).(*metaPartition)
+	if err = applied.ApplySnapshot(nil, it); err != nil {
+		t.Fatalf("apply snapshot: %v", err)
+	}
+	if !applied.txs.locked(1, "a") || applied.txs.status("tx1") != proto.TxStatusPrepared {
+		t.Fatalf("prepared tx not in the snapshot")
+	}
+	if applied.txs.status("tx2") != proto.TxStatusAborted {
+		t.Fatalf("decided tx not in the snapshot")
+	}
+	if u := applied.txs.unlinks()["tx3"]; u == nil || u.Inode != 12 {
+		t.Fatalf("replaced inode not in the snapshot")
+	}
+
+	// no transaction leaves the snapshot as the older releases
+	empty := NewMetaPartition(compatConfig("")).(*metaPartition)
+	if data, _ := empty.txs.marshal(); data != nil {
+		t.Fatalf("marshal of no transaction: %s", data)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	UsageAggregateInterval = 10 * time.Minute
+)
+
+// usageWorker aggregates the regular files of the partition and their bytes
+// on the leader, the heartbeats report the last aggregation to the master,
+// which sums the partitions of a vol into its usage statements.
+func (mp *metaPartition) usageWorker() {
+	t := time.NewTicker(UsageAggregateInterval)
+	for {
+		select {
+		case <-mp.stopC:
+			t.Stop()
+			return
+		case <-t.C:
+			if _, isLeader := mp.IsLeader(); !isLeader {
+				continue
+			}
+			mp.aggregateUsage()
+		}
+	}
+}
+
+func (mp *metaPartition) aggregateUsage() {
+	var files, bytes uint64
+	start := time.Now()
+	mp.inodeTree.Ascend(func(i BtreeItem) bool {
+		ino := i.(*Inode)
+		if ino.MarkDelete != 1 && proto.IsRegular(ino.Type) {
+			files++
+			bytes += ino.Size
+		}
+		return true
+	})
+	atomic.StoreUint64(&mp.usageFiles, files)
+	atomic.StoreUint64(&mp.usageBytes, bytes)
+	atomic.StoreInt64(&mp.usageTime, time.Now().Unix())
+	log.LogInfof("[aggregateUsage] partitionID(%v) files(%v) bytes(%v) cost(%v)",
+		mp.config.PartitionId, files, bytes, time.Since(start))
+}
+
+// GetUsage returns the last aggregation of the leader, time is zero before the first one.
+func (mp *metaPartition) GetUsage() (files, bytes uint64, time int64) {
+	return atomic.LoadUint64(&mp.usageFiles), atomic.LoadUint64(&mp.usageBytes), atomic.LoadInt64(&mp.usageTime)
+}
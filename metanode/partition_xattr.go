@@ -0,0 +1,205 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"encoding/json"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+// The xattrs are kept in the inode and replicated by raft with it. The set and
+// the remove are applied by the fsm, which checks the flags of the set so that
+// the replicas agree on the result, the get and the list read the leader.
+
+func (mp *metaPartition) SetXAttr(req *proto.SetXAttrRequest, p *Packet) (err error) {
+	if len(req.Name) == 0 || len(req.Name) > proto.MaxXAttrNameSize || len(req.Value) > proto.MaxXAttrValueSize {
+		p.PackErrorWithBody(proto.OpArgMismatchErr, nil)
+		return
+	}
+	if status := mp.checkAccess(req.Caller, req.Inode, accessWrite); status != proto.OpOk {
+		p.PackErrorWithBody(status, nil)
+		return
+	}
+	r := *req
+	r.Caller = nil
+	val, err := json.Marshal(&r)
+	if err != nil {
+		p.PackErrorWithBody(proto.OpErr, []byte(err.Error()))
+		return
+	}
+	resp, err := mp.Put(opFSMSetXAttr, val)
+	if err != nil {
+		p.PackErrorWithBody(proto.OpAgain, []byte(err.Error()))
+		return
+	}
+	p.ResultCode = resp.(uint8)
+	return
+}
+
+func (mp *metaPartition) RemoveXAttr(req *proto.RemoveXAttrRequest, p *Packet) (err error) {
+	if status := mp.checkAccess(req.Caller, req.Inode, accessWrite); status != proto.OpOk {
+		p.PackErrorWithBody(status, nil)
+		return
+	}
+	r := *req
+	r.Caller = nil
+	val, err := json.Marshal(&r)
+	if err != nil {
+		p.PackErrorWithBody(proto.OpErr, []byte(err.Error()))
+		return
+	}
+	resp, err := mp.Put(opFSMRemoveXAttr, val)
+	if err != nil {
+		p.PackErrorWithBody(proto.OpAgain, []byte(err.Error()))
+		return
+	}
+	p.ResultCode = resp.(uint8)
+	return
+}
+
+func (mp *metaPartition) GetXAttr(req *proto.GetXAttrRequest, p *Packet) (err error) {
+	if status := mp.checkAccess(req.Caller, req.Inode, accessRead); status != proto.OpOk {
+		p.PackErrorWithBody(status, nil)
+		return
+	}
+	xattrs, status := mp.getXAttrs(req.Inode)
+	if status != proto.OpOk {
+		p.PackErrorWithBody(status, nil)
+		return
+	}
+	value, ok := xattrs[req.Name]
+	if !ok {
+		p.PackErrorWithBody(proto.OpNotExistErr, nil)
+		return
+	}
+	reply, err := json.Marshal(&proto.GetXAttrResponse{Value: value})
+	if err != nil {
+		p.PackErrorWithBody(proto.OpErr, nil)
+		return
+	}
+	p.PackOkWithBody(reply)
+	return
+}
+
+func (mp *metaPartition) ListXAttr(req *proto.ListXAttrRequest, p *Packet) (err error) {
+	xattrs, status := mp.getXAttrs(req.Inode)
+	if status != proto.OpOk {
+		p.PackErrorWithBody(status, nil)
+		return
+	}
+	resp := &proto.ListXAttrResponse{Names: make([]string, 0, len(xattrs))}
+	for name := range xattrs {
+		resp.Names = append(resp.Names, name)
+	}
+	reply, err := json.Marshal(resp)
+	if err != nil {
+		p.PackErrorWithBody(proto.OpErr, nil)
+		return
+	}
+	p.PackOkWithBody(reply)
+	return
+}
+
+// getXAttrs returns the xattrs of the inode, the map is got under the lock of
+// the tree which the fsm holds to replace it, and is never modified after.
+func (mp *metaPartition) getXAttrs(inode uint64) (xattrs map[string][]byte, status uint8) {
+	status = proto.OpNotExistErr
+	mp.inodeTree.Find(NewInode(inode, 0), func(item BtreeItem) {
+		i := item.(*Inode)
+		if i.MarkDelete == 1 {
+			return
+		}
+		xattrs = i.XAttrs
+		status = proto.OpOk
+	})
+	return
+}
+
+/*the size of the list of the xattr names returned to listxattr, each name ends with a null*/
+func xattrListSize(xattrs map[string][]byte) (size int) {
+	for name := range xattrs {
+		size += len(name) + 1
+	}
+	return
+}
+
+func (mp *metaPartition) setXAttr(req *proto.SetXAttrRequest) (status uint8) {
+	status = proto.OpOk
+	isFind := false
+	mp.inodeTree.Find(NewInode(req.Inode, 0), func(item BtreeItem) {
+		isFind = true
+		i := item.(*Inode)
+		if i.MarkDelete == 1 {
+			status = proto.OpNotExistErr
+			return
+		}
+		_, exist := i.XAttrs[req.Name]
+		if exist && req.Flags&proto.XAttrCreate != 0 {
+			status = proto.OpExistErr
+			return
+		}
+		if !exist && req.Flags&proto.XAttrReplace != 0 {
+			status = proto.OpNotExistErr
+			return
+		}
+		if !exist && xattrListSize(i.XAttrs)+len(req.Name)+1 > proto.MaxXAttrListSize {
+			status = proto.OpArgMismatchErr
+			return
+		}
+		// the readers hold the old map, a new one replaces it
+		xattrs := make(map[string][]byte, len(i.XAttrs)+1)
+		for name, value := range i.XAttrs {
+			xattrs[name] = value
+		}
+		xattrs[req.Name] = req.Value
+		i.XAttrs = xattrs
+	})
+	if !isFind {
+		status = proto.OpNotExistErr
+	}
+	return
+}
+
+func (mp *metaPartition) removeXAttr(req *proto.RemoveXAttrRequest) (status uint8) {
+	status = proto.OpOk
+	isFind := false
+	mp.inodeTree.Find(NewInode(req.Inode, 0), func(item BtreeItem) {
+		isFind = true
+		i := item.(*Inode)
+		if i.MarkDelete == 1 {
+			status = proto.OpNotExistErr
+			return
+		}
+		if _, exist := i.XAttrs[req.Name]; !exist {
+			status = proto.OpNotExistErr
+			return
+		}
+		var xattrs map[string][]byte
+		if len(i.XAttrs) > 1 {
+			xattrs = make(map[string][]byte, len(i.XAttrs)-1)
+			for name, value := range i.XAttrs {
+				if name != req.Name {
+					xattrs[name] = value
+				}
+			}
+		}
+		i.XAttrs = xattrs
+	})
+	if !isFind {
+		status = proto.OpNotExistErr
+	}
+	return
+}
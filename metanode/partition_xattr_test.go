@@ -0,0 +1,93 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"testing"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+func TestXAttrFlags(t *testing.T) {
+	mp := NewMetaPartition(compatConfig("")).(*metaPartition)
+	mp.inodeTree.ReplaceOrInsert(NewInode(2, 0644), true)
+	set := func(name, value string, flags uint32) uint8 {
+		return mp.setXAttr(&proto.SetXAttrRequest{Inode: 2, Name: name, Value: []byte(value), Flags: flags})
+	}
+	get := func(name string) (value string, ok bool) {
+		v, ok := mp.getInode(NewInode(2, 0)).Msg.XAttrs[name]
+		return string(v), ok
+	}
+
+	if status := set("user.a", "1", proto.XAttrReplace); status != proto.OpNotExistErr {
+		t.Fatalf("replace of missing xattr: status %v", status)
+	}
+	if status := set("user.a", "1", proto.XAttrCreate); status != proto.OpOk {
+		t.Fatalf("create: status %v", status)
+	}
+	if status := set("user.a", "2", proto.XAttrCreate); status != proto.OpExistErr {
+		t.Fatalf("create of existing xattr: status %v", status)
+	}
+	old := mp.getInode(NewInode(2, 0)).Msg.XAttrs
+	if status := set("user.a", "3", proto.XAttrReplace); status != proto.OpOk {
+		t.Fatalf("replace: status %v", status)
+	}
+	if v, _ := get("user.a"); v != "3" || string(old["user.a"]) != "1" {
+		t.Fatalf("replace: value %q, map held by a reader %q", v, old["user.a"])
+	}
+	if status := set("user.b", "", 0); status != proto.OpOk {
+		t.Fatalf("set: status %v", status)
+	}
+	if status := mp.removeXAttr(&proto.RemoveXAttrRequest{Inode: 2, Name: "user.a"}); status != proto.OpOk {
+		t.Fatalf("remove: status %v", status)
+	}
+	if status := mp.removeXAttr(&proto.RemoveXAttrRequest{Inode: 2, Name: "user.a"}); status != proto.OpNotExistErr {
+		t.Fatalf("remove of missing xattr: status %v", status)
+	}
+	if _, ok := get("user.b"); !ok {
+		t.Fatalf("user.b removed with user.a")
+	}
+	mp.removeXAttr(&proto.RemoveXAttrRequest{Inode: 2, Name: "user.b"})
+	if xattrs := mp.getInode(NewInode(2, 0)).Msg.XAttrs; xattrs != nil {
+		t.Fatalf("xattrs of the inode after the last remove: %v", xattrs)
+	}
+	if status := set("user.a", "1", 0); status != proto.OpOk {
+		t.Fatalf("set: status %v", status)
+	}
+	if status := mp.setXAttr(&proto.SetXAttrRequest{Inode: 3, Name: "user.a"}); status != proto.OpNotExistErr {
+		t.Fatalf("set on missing inode: status %v", status)
+	}
+}
+
+func TestGetXAttrs(t *testing.T) {
+	mp := NewMetaPartition(compatConfig("")).(*metaPartition)
+	mp.inodeTree.ReplaceOrInsert(NewInode(2, 0644), true)
+	deleted := NewInode(3, 0644)
+	deleted.MarkDelete = 1
+	mp.inodeTree.ReplaceOrInsert(deleted, true)
+
+	if xattrs, status := mp.getXAttrs(2); status != proto.OpOk || xattrs != nil {
+		t.Fatalf("inode without xattrs: %v status %v", xattrs, status)
+	}
+	mp.setXAttr(&proto.SetXAttrRequest{Inode: 2, Name: "user.a", Value: []byte("1")})
+	if xattrs, status := mp.getXAttrs(2); status != proto.OpOk || string(xattrs["user.a"]) != "1" {
+		t.Fatalf("inode with xattrs: %v status %v", xattrs, status)
+	}
+	for _, ino := range []uint64{3, 4} {
+		if _, status := mp.getXAttrs(ino); status != proto.OpNotExistErr {
+			t.Fatalf("inode %v deleted or missing: status %v", ino, status)
+		}
+	}
+}
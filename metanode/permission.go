@@ -0,0 +1,312 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/sdk/meta"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+// volPermission keeps the vols with the permission checks pushed by the master
+// heartbeats. The ops of their clients are checked against the owner, the group
+// and the mode of the inodes for the caller of the request, the caller is the
+// one the client tells and only its primary group is checked. A request without
+// a caller, from an older client, is refused, but the ones of the nodes of the
+// cluster which are not checked. The inodes of the other partitions of a vol
+// the checks need are got from their leaders.
+type volPermission struct {
+	vols map[string]bool
+	sync.RWMutex
+
+	clients     map[string]inodeClient
+	newClient   func(volName string) (inodeClient, error)
+	clientsLock sync.Mutex
+}
+
+// inodeClient gets the inodes of the partitions of a vol, the requests are
+// sent on the connections of the node, authenticated as internal.
+type inodeClient interface {
+	InodeGet_ll(inode uint64) (*proto.InodeInfo, error)
+	Close()
+}
+
+func newVolPermission() *volPermission {
+	return &volPermission{
+		vols:      make(map[string]bool),
+		clients:   make(map[string]inodeClient),
+		newClient: newInodeClient,
+	}
+}
+
+func newInodeClient(volName string) (inodeClient, error) {
+	mw, err := meta.NewMetaWrapper(volName, strings.Join(getMasterAddrs(), meta.HostsSeparator))
+	if err != nil {
+		return nil, err
+	}
+	return mw, nil
+}
+
+func (v *volPermission) update(vols map[string]bool) {
+	if vols == nil {
+		vols = make(map[string]bool)
+	}
+	v.Lock()
+	v.vols = vols
+	v.Unlock()
+	v.clientsLock.Lock()
+	defer v.clientsLock.Unlock()
+	for name, client := range v.clients {
+		if !vols[name] {
+			client.Close()
+			delete(v.clients, name)
+		}
+	}
+}
+
+func (v *volPermission) enabled(volName string) bool {
+	v.RLock()
+	defer v.RUnlock()
+	return v.vols[volName]
+}
+
+// inodeGet gets the inode of another partition of the vol from its leader.
+func (v *volPermission) inodeGet(volName string, ino uint64) (info *proto.InodeInfo, status uint8) {
+	v.clientsLock.Lock()
+	client := v.clients[volName]
+	var err error
+	if client == nil {
+		if client, err = v.newClient(volName); err != nil {
+			v.clientsLock.Unlock()
+			log.LogWarnf("[inodeGet] vol(%v) ino(%v): %v", volName, ino, err)
+			return nil, proto.OpAgain
+		}
+		v.clients[volName] = client
+	}
+	v.clientsLock.Unlock()
+	if info, err = client.InodeGet_ll(ino); err == syscall.ENOENT {
+		return nil, proto.OpNotExistErr
+	} else if err != nil {
+		log.LogWarnf("[inodeGet] vol(%v) ino(%v): %v", volName, ino, err)
+		return nil, proto.OpAgain
+	}
+	return info, proto.OpOk
+}
+
+// checkCaller refuses a request without a caller to a vol with the permission
+// checks, but from a node of the cluster, it returns false once the refusal is
+// replied. It is checked before the request is proxied to the leader, which
+// takes the proxied requests as from a node of the cluster.
+func (m *metaManager) checkCaller(conn net.Conn, mp MetaPartition, p *Packet, caller *proto.Caller) bool {
+	if caller != nil || !m.permission.enabled(mp.GetBaseConfig().VolName) || m.auth.Internal(conn) {
+		return true
+	}
+	p.PackErrorWithBody(proto.OpAccessErr, []byte("no caller of the request to a vol with the permission checks"))
+	m.respondToClient(conn, p)
+	return false
+}
+
+// callerOf returns the caller the op of mp is checked for, nil if the vol of
+// mp has no permission checks.
+func (m *metaManager) callerOf(mp MetaPartition, caller *proto.Caller) *proto.Caller {
+	if caller == nil || !m.permission.enabled(mp.GetBaseConfig().VolName) {
+		return nil
+	}
+	return caller
+}
+
+// the access bits of a class of the mode
+const (
+	accessExec  uint32 = 1
+	accessWrite uint32 = 2
+	accessRead  uint32 = 4
+)
+
+// hasAccess tells if the class of the caller in the mode of the inode has the
+// access bits, root has all of them but the exec of a file nobody may exec.
+func hasAccess(caller *proto.Caller, ino *Inode, access uint32) bool {
+	perm := uint32(proto.OsMode(ino.Type).Perm())
+	if caller.IsRoot() {
+		return access&accessExec == 0 || proto.IsDir(ino.Type) || perm&0111 != 0
+	}
+	switch {
+	case caller.Uid == ino.Uid:
+		perm >>= 6
+	case caller.Gid == ino.Gid:
+		perm >>= 3
+	}
+	return perm&access == access
+}
+
+// openAccess returns the access bits the open flags ask for.
+func openAccess(flag uint32) (access uint32) {
+	switch flag & syscall.O_ACCMODE {
+	case syscall.O_RDONLY:
+		access = accessRead
+	case syscall.O_WRONLY:
+		access = accessWrite
+	default:
+		access = accessRead | accessWrite
+	}
+	if flag&syscall.O_TRUNC != 0 {
+		access |= accessWrite
+	}
+	return
+}
+
+// inodeOf returns the inode of the partition or of another partition of the
+// vol, only the type and the owner of the ones of another partition are got.
+func (mp *metaPartition) inodeOf(ino uint64) (*Inode, uint8) {
+	if ino >= mp.config.Start && ino <= mp.config.End {
+		resp := mp.getInode(NewInode(ino, 0))
+		return resp.Msg, resp.Status
+	}
+	info, status := mp.config.Permission.inodeGet(mp.config.VolName, ino)
+	if status != proto.OpOk {
+		return nil, status
+	}
+	i := NewInode(ino, info.Mode)
+	i.Uid, i.Gid = info.Uid, info.Gid
+	return i, proto.OpOk
+}
+
+// checkAccess returns the status of the access of the caller to the inode of
+// the partition, the ops without a caller are allowed.
+func (mp *metaPartition) checkAccess(caller *proto.Caller, inode uint64, access uint32) (status uint8) {
+	if caller == nil {
+		return proto.OpOk
+	}
+	resp := mp.getInode(NewInode(inode, 0))
+	if resp.Status != proto.OpOk {
+		return resp.Status
+	}
+	if !hasAccess(caller, resp.Msg, access) {
+		return proto.OpAccessErr
+	}
+	return proto.OpOk
+}
+
+// checkRemove returns the status of the removal or the replacement of the
+// dentry of the dir by the caller. The dentry of a sticky dir may be removed
+// only by root, the owner of the dir or the owner of its inode, which may be in
+// another partition.
+func (mp *metaPartition) checkRemove(caller *proto.Caller, parentID uint64, name string) (status uint8) {
+	if caller == nil {
+		return proto.OpOk
+	}
+	resp := mp.getInode(NewInode(parentID, 0))
+	if resp.Status != proto.OpOk {
+		return resp.Status
+	}
+	dir := resp.Msg
+	if !hasAccess(caller, dir, accessWrite|accessExec) {
+		return proto.OpAccessErr
+	}
+	if caller.IsRoot() || caller.Uid == dir.Uid || proto.OsMode(dir.Type)&os.ModeSticky == 0 {
+		return proto.OpOk
+	}
+	dentry, status := mp.getDentry(&Dentry{ParentId: parentID, Name: name})
+	if status != proto.OpOk {
+		// nothing is removed, the op fails on the missing dentry
+		return proto.OpOk
+	}
+	child, status := mp.inodeOf(dentry.Inode)
+	if status != proto.OpOk {
+		return status
+	}
+	if child.Uid != caller.Uid {
+		return proto.OpNotPermErr
+	}
+	return proto.OpOk
+}
+
+// checkCreate returns the status of the create of the inode of req by the
+// caller, who owns it. The group of the inode is the one of the caller, or the
+// one of the dir for a setgid dir, a dir created in it is setgid too, the group
+// and the mode of req are set so. The group of an older client not telling the
+// dir is the one of the caller.
+func (mp *metaPartition) checkCreate(req *CreateInoReq) (status uint8) {
+	caller := req.Caller
+	if caller == nil || caller.IsRoot() {
+		return proto.OpOk
+	}
+	if req.Uid != caller.Uid {
+		return proto.OpNotPermErr
+	}
+	req.Gid = caller.Gid
+	if req.ParentID == 0 {
+		return proto.OpOk
+	}
+	dir, status := mp.inodeOf(req.ParentID)
+	if status != proto.OpOk {
+		return status
+	}
+	if proto.OsMode(dir.Type)&os.ModeSetgid != 0 {
+		req.Gid = dir.Gid
+		if proto.IsDir(req.Mode) {
+			req.Mode |= proto.Mode(os.ModeSetgid)
+		}
+	}
+	return proto.OpOk
+}
+
+// checkSetAttr returns the status of the setattr of the caller. Only the owner
+// may change the mode, and the group to its own one, the owner is changed by
+// root only. The setgid bit of a file is dropped by a chmod of a caller out of
+// its group, the setuid and the setgid bits by a chown, as the kernel does.
+func (mp *metaPartition) checkSetAttr(req *SetattrRequest) (status uint8) {
+	caller := req.Caller
+	if caller == nil || caller.IsRoot() {
+		return proto.OpOk
+	}
+	resp := mp.getInode(NewInode(req.Inode, 0))
+	if resp.Status != proto.OpOk {
+		return resp.Status
+	}
+	ino := resp.Msg
+	owner := caller.Uid == ino.Uid
+	gid := ino.Gid
+	if req.Valid&proto.AttrUid != 0 && req.Uid != ino.Uid {
+		return proto.OpNotPermErr
+	}
+	if req.Valid&proto.AttrGid != 0 && req.Gid != ino.Gid {
+		if !owner || req.Gid != caller.Gid {
+			return proto.OpNotPermErr
+		}
+		gid = req.Gid
+		if !proto.IsDir(ino.Type) {
+			if req.Valid&proto.AttrMode == 0 {
+				req.Mode = ino.Type
+				req.Valid |= proto.AttrMode
+			}
+			req.Mode &^= proto.Mode(os.ModeSetuid | os.ModeSetgid)
+		}
+	}
+	if req.Valid&proto.AttrMode != 0 {
+		if !owner {
+			return proto.OpNotPermErr
+		}
+		if !proto.IsDir(ino.Type) && gid != caller.Gid {
+			req.Mode &^= proto.Mode(os.ModeSetgid)
+		}
+	}
+	return proto.OpOk
+}
@@ -0,0 +1,245 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/auth"
+)
+
+func newPermissionInode(ino uint64, mode os.FileMode, uid, gid uint32) *Inode {
+	i := NewInode(ino, proto.Mode(mode))
+	i.Uid, i.Gid = uid, gid
+	return i
+}
+
+// testInodeClient is the inodes of the other partitions of the vol
+type testInodeClient map[uint64]*proto.InodeInfo
+
+func (c testInodeClient) InodeGet_ll(inode uint64) (*proto.InodeInfo, error) {
+	if info := c[inode]; info != nil {
+		return info, nil
+	}
+	return nil, syscall.ENOENT
+}
+
+func (c testInodeClient) Close() {}
+
+// newPermissionPartition returns a partition of the inodes up to 100, the
+// others are got from remote
+func newPermissionPartition(remote testInodeClient) *metaPartition {
+	conf := compatConfig("")
+	conf.End = 100
+	conf.Permission = newVolPermission()
+	conf.Permission.newClient = func(volName string) (inodeClient, error) { return remote, nil }
+	return NewMetaPartition(conf).(*metaPartition)
+}
+
+func TestPermission_Access(t *testing.T) {
+	file := newPermissionInode(3, 0640, 1001, 100)
+	cases := []struct {
+		caller proto.Caller
+		access uint32
+		ok     bool
+	}{
+		{proto.Caller{Uid: 1001, Gid: 200}, accessRead | accessWrite, true},
+		{proto.Caller{Uid: 1001, Gid: 100}, accessExec, false},
+		{proto.Caller{Uid: 1002, Gid: 100}, accessRead, true},
+		{proto.Caller{Uid: 1002, Gid: 100}, accessWrite, false},
+		{proto.Caller{Uid: 1002, Gid: 200}, accessRead, false},
+		{proto.Caller{Uid: 0, Gid: 0}, accessRead | accessWrite, true},
+		{proto.Caller{Uid: 0, Gid: 0}, accessExec, false},
+	}
+	for _, c := range cases {
+		if ok := hasAccess(&c.caller, file, c.access); ok != c.ok {
+			t.Errorf("caller %v access %v: %v", c.caller, c.access, ok)
+		}
+	}
+	dir := newPermissionInode(2, os.ModeDir|0700, 1001, 100)
+	if !hasAccess(&proto.Caller{}, dir, accessExec) {
+		t.Fatalf("root may not search a dir")
+	}
+}
+
+func TestPermission_Remove(t *testing.T) {
+	remote := testInodeClient{1000: {Inode: 1000, Mode: 0644, Uid: 1002, Gid: 100}}
+	mp := newPermissionPartition(remote)
+	mp.inodeTree.ReplaceOrInsert(newPermissionInode(2, os.ModeDir|os.ModeSticky|0777, 0, 0), true)
+	mp.inodeTree.ReplaceOrInsert(newPermissionInode(3, 0644, 1001, 100), true)
+	mp.inodeTree.ReplaceOrInsert(newPermissionInode(4, os.ModeDir|0755, 0, 0), true)
+	mp.dentryTree.ReplaceOrInsert(&Dentry{ParentId: 2, Name: "local", Inode: 3}, true)
+	mp.dentryTree.ReplaceOrInsert(&Dentry{ParentId: 2, Name: "remote", Inode: 1000}, true)
+	mp.dentryTree.ReplaceOrInsert(&Dentry{ParentId: 2, Name: "dangling", Inode: 1001}, true)
+	mp.dentryTree.ReplaceOrInsert(&Dentry{ParentId: 4, Name: "a", Inode: 3}, true)
+
+	owner := &proto.Caller{Uid: 1001, Gid: 100}
+	other := &proto.Caller{Uid: 1002, Gid: 100}
+	if status := mp.checkRemove(other, 2, "local"); status != proto.OpNotPermErr {
+		t.Fatalf("remove of a local inode of another user from a sticky dir: status %v", status)
+	}
+	if status := mp.checkRemove(owner, 2, "local"); status != proto.OpOk {
+		t.Fatalf("remove of an owned inode from a sticky dir: status %v", status)
+	}
+	// the owner of a remote inode is got from its partition
+	if status := mp.checkRemove(other, 2, "remote"); status != proto.OpOk {
+		t.Fatalf("remove of a remote inode of the caller from a sticky dir: status %v", status)
+	}
+	if status := mp.checkRemove(owner, 2, "remote"); status != proto.OpNotPermErr {
+		t.Fatalf("remove of a remote inode of another user from a sticky dir: status %v", status)
+	}
+	if status := mp.checkRemove(owner, 2, "dangling"); status != proto.OpNotExistErr {
+		t.Fatalf("remove of a dentry of a missing remote inode from a sticky dir: status %v", status)
+	}
+	if status := mp.checkRemove(owner, 2, "missing"); status != proto.OpOk {
+		t.Fatalf("remove of a missing dentry: status %v", status)
+	}
+	if status := mp.checkRemove(owner, 4, "a"); status != proto.OpAccessErr {
+		t.Fatalf("remove from a dir not writable: status %v", status)
+	}
+	if status := mp.checkRemove(nil, 4, "a"); status != proto.OpOk {
+		t.Fatalf("remove without a caller: status %v", status)
+	}
+	if status := mp.checkRemove(&proto.Caller{}, 2, "local"); status != proto.OpOk {
+		t.Fatalf("remove by root from a sticky dir: status %v", status)
+	}
+}
+
+func TestPermission_SetAttr(t *testing.T) {
+	mp := NewMetaPartition(compatConfig("")).(*metaPartition)
+	mode := proto.Mode(os.ModeSetuid | os.ModeSetgid | 0750)
+	mp.inodeTree.ReplaceOrInsert(newPermissionInode(3, os.ModeSetuid|os.ModeSetgid|0750, 1001, 100), true)
+	owner := &proto.Caller{Uid: 1001, Gid: 200}
+
+	req := &SetattrRequest{Inode: 3, Valid: proto.AttrMode, Mode: mode, Caller: &proto.Caller{Uid: 1002, Gid: 100}}
+	if status := mp.checkSetAttr(req); status != proto.OpNotPermErr {
+		t.Fatalf("chmod by another user: status %v", status)
+	}
+	req = &SetattrRequest{Inode: 3, Valid: proto.AttrMode, Mode: mode, Caller: owner}
+	if status := mp.checkSetAttr(req); status != proto.OpOk || req.Mode != proto.Mode(os.ModeSetuid|0750) {
+		t.Fatalf("chmod by the owner out of the group: status %v mode %v", status, proto.OsMode(req.Mode))
+	}
+	req = &SetattrRequest{Inode: 3, Valid: proto.AttrUid, Uid: 1002, Caller: owner}
+	if status := mp.checkSetAttr(req); status != proto.OpNotPermErr {
+		t.Fatalf("chown by the owner: status %v", status)
+	}
+	req = &SetattrRequest{Inode: 3, Valid: proto.AttrGid, Gid: 300, Caller: owner}
+	if status := mp.checkSetAttr(req); status != proto.OpNotPermErr {
+		t.Fatalf("chgrp to another group: status %v", status)
+	}
+	req = &SetattrRequest{Inode: 3, Valid: proto.AttrGid, Gid: 200, Caller: owner}
+	if status := mp.checkSetAttr(req); status != proto.OpOk || req.Valid&proto.AttrMode == 0 || req.Mode != proto.Mode(0750) {
+		t.Fatalf("chgrp to the group of the owner: status %v mode %v", status, proto.OsMode(req.Mode))
+	}
+	req = &SetattrRequest{Inode: 3, Valid: proto.AttrUid | proto.AttrGid, Uid: 1002, Gid: 300, Caller: &proto.Caller{}}
+	if status := mp.checkSetAttr(req); status != proto.OpOk {
+		t.Fatalf("chown by root: status %v", status)
+	}
+}
+
+func TestPermission_Create(t *testing.T) {
+	remote := testInodeClient{1000: {Inode: 1000, Mode: proto.Mode(os.ModeDir | os.ModeSetgid | 0775), Uid: 0, Gid: 300}}
+	mp := newPermissionPartition(remote)
+	mp.inodeTree.ReplaceOrInsert(newPermissionInode(2, os.ModeDir|0777, 0, 0), true)
+	mp.inodeTree.ReplaceOrInsert(newPermissionInode(3, os.ModeDir|os.ModeSetgid|0777, 0, 200), true)
+	caller := &proto.Caller{Uid: 1001, Gid: 100}
+
+	req := &CreateInoReq{Mode: 0644, Uid: 1002, Gid: 100, ParentID: 2, Caller: caller}
+	if status := mp.checkCreate(req); status != proto.OpNotPermErr {
+		t.Fatalf("create for another user: status %v", status)
+	}
+	req = &CreateInoReq{Mode: 0644, Uid: 1001, Gid: 200, ParentID: 2, Caller: caller}
+	if status := mp.checkCreate(req); status != proto.OpOk || req.Gid != 100 {
+		t.Fatalf("create in another group: status %v gid %v", status, req.Gid)
+	}
+	req = &CreateInoReq{Mode: proto.Mode(os.ModeDir | 0755), Uid: 1001, Gid: 100, ParentID: 3, Caller: caller}
+	if status := mp.checkCreate(req); status != proto.OpOk || req.Gid != 200 || proto.OsMode(req.Mode)&os.ModeSetgid == 0 {
+		t.Fatalf("mkdir in a setgid dir: status %v gid %v mode %v", status, req.Gid, proto.OsMode(req.Mode))
+	}
+	// the dir is in another partition
+	req = &CreateInoReq{Mode: 0644, Uid: 1001, Gid: 100, ParentID: 1000, Caller: caller}
+	if status := mp.checkCreate(req); status != proto.OpOk || req.Gid != 300 || proto.OsMode(req.Mode)&os.ModeSetgid != 0 {
+		t.Fatalf("create in a remote setgid dir: status %v gid %v mode %v", status, req.Gid, proto.OsMode(req.Mode))
+	}
+	req = &CreateInoReq{Mode: 0644, Uid: 1001, Gid: 100, ParentID: 1001, Caller: caller}
+	if status := mp.checkCreate(req); status != proto.OpNotExistErr {
+		t.Fatalf("create in a missing dir: status %v", status)
+	}
+	req = &CreateInoReq{Mode: 0644, Uid: 1002, Gid: 400, ParentID: 3, Caller: &proto.Caller{}}
+	if status := mp.checkCreate(req); status != proto.OpOk || req.Gid != 400 {
+		t.Fatalf("create by root: status %v gid %v", status, req.Gid)
+	}
+}
+
+func TestPermission_OpenAccess(t *testing.T) {
+	cases := map[uint32]uint32{
+		syscall.O_RDONLY:                    accessRead,
+		syscall.O_WRONLY | syscall.O_APPEND: accessWrite,
+		syscall.O_RDWR:                      accessRead | accessWrite,
+		syscall.O_RDONLY | syscall.O_TRUNC:  accessRead | accessWrite,
+	}
+	for flag, access := range cases {
+		if a := openAccess(flag); a != access {
+			t.Errorf("flag %#o: access %v, want %v", flag, a, access)
+		}
+	}
+}
+
+func TestPermission_Caller(t *testing.T) {
+	checker := auth.NewChecker("key")
+	m := &metaManager{permission: newVolPermission(), auth: checker}
+	mp := NewMetaPartition(compatConfig(""))
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	replies := make(chan *proto.Packet, 1)
+	go func() {
+		for {
+			p := proto.NewPacket()
+			if err := p.ReadFromConn(client, proto.NoReadDeadlineTime); err != nil {
+				close(replies)
+				return
+			}
+			replies <- p
+		}
+	}()
+
+	if !m.checkCaller(server, mp, &Packet{Packet: *proto.NewPacket()}, nil) {
+		t.Fatalf("request without a caller to a vol without the checks refused")
+	}
+	m.permission.update(map[string]bool{"intest": true})
+	if !m.checkCaller(server, mp, &Packet{Packet: *proto.NewPacket()}, &proto.Caller{Uid: 1001}) {
+		t.Fatalf("request with a caller refused")
+	}
+	p := &Packet{Packet: *proto.NewPacket()}
+	p.Opcode, p.ReqID = proto.OpMetaReadDir, proto.GetReqID()
+	if m.checkCaller(server, mp, p, nil) {
+		t.Fatalf("request without a caller to a vol with the checks allowed")
+	}
+	if reply := <-replies; reply == nil || reply.ReqID != p.ReqID || reply.ResultCode != proto.OpAccessErr {
+		t.Fatalf("reply %v of a request without a caller", reply)
+	}
+	// a node of the cluster, like the lifecycle walk or a proxying follower
+	if err := checker.Authenticate(server, &proto.AuthConnRequest{Token: "key"}); err != nil {
+		t.Fatalf("auth: %v", err)
+	}
+	if !m.checkCaller(server, mp, &Packet{Packet: *proto.NewPacket()}, nil) {
+		t.Fatalf("request without a caller of a node of the cluster refused")
+	}
+}
@@ -20,6 +20,8 @@ import (
 
 	"github.com/tiglabs/containerfs/proto"
 	"github.com/tiglabs/containerfs/util/log"
+	"github.com/tiglabs/containerfs/util/pool"
+	"github.com/tiglabs/containerfs/util/rpc"
 )
 
 // StartTcpService bind and listen specified port and accept tcp connections.
@@ -30,6 +32,12 @@ func (m *MetaNode) startServer() (err error) {
 	if err != nil {
 		return
 	}
+	if m.grpc {
+		stopC := m.httpStopC
+		m.rpc = rpc.NewServer(func(conn net.Conn) {
+			m.serveConn(conn, stopC)
+		}, rpc.MetaService, rpc.AdminService)
+	}
 	// Start goroutine for tcp accept handing.
 	go func(stopC chan uint8) {
 		defer ln.Close()
@@ -44,7 +52,11 @@ func (m *MetaNode) startServer() (err error) {
 				continue
 			}
 			// Start a goroutine for tcp connection handling.
-			go m.serveConn(conn, stopC)
+			if m.rpc != nil {
+				go m.rpc.ServeConn(pool.ServerConn(conn, m.tlsConfig))
+			} else {
+				go m.serveConn(pool.ServerConn(conn, m.tlsConfig), stopC)
+			}
 		}
 	}(m.httpStopC)
 	log.LogDebugf("start Server over...")
@@ -60,15 +72,17 @@ func (m *MetaNode) stopServer() {
 		}()
 		close(m.httpStopC)
 	}
+	if m.rpc != nil {
+		m.rpc.Stop()
+	}
 }
 
 // ServeConn read data from specified tco connection until connection
 // closed by remote or tcp service have been shutdown.
 func (m *MetaNode) serveConn(conn net.Conn, stopC chan uint8) {
 	defer conn.Close()
-	c := conn.(*net.TCPConn)
-	c.SetKeepAlive(true)
-	c.SetNoDelay(true)
+	defer m.auth.Release(conn)
+	defer m.fences.Release(conn)
 	for {
 		select {
 		case <-stopC:
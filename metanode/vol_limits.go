@@ -0,0 +1,58 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"sync"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+// volLimits keeps the limits of the vols pushed by the master heartbeats, a
+// vol without limits is absent. The file count of a vol is only as fresh as
+// the heartbeats, so the inodes created in between may overshoot MaxFiles.
+type volLimits struct {
+	limits map[string]*proto.VolLimit
+	sync.RWMutex
+}
+
+func newVolLimits() *volLimits {
+	return &volLimits{limits: make(map[string]*proto.VolLimit)}
+}
+
+func (l *volLimits) update(limits map[string]*proto.VolLimit) {
+	if limits == nil {
+		limits = make(map[string]*proto.VolLimit)
+	}
+	l.Lock()
+	l.limits = limits
+	l.Unlock()
+}
+
+func (l *volLimits) filesFull(volName string) bool {
+	l.RLock()
+	defer l.RUnlock()
+	limit, ok := l.limits[volName]
+	return ok && limit.FilesFull
+}
+
+func (l *volLimits) maxFileSize(volName string) uint64 {
+	l.RLock()
+	defer l.RUnlock()
+	if limit, ok := l.limits[volName]; ok {
+		return limit.MaxFileSize
+	}
+	return 0
+}
@@ -0,0 +1,71 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"testing"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+func TestVolLimits(t *testing.T) {
+	l := newVolLimits()
+	if l.filesFull("intest") || l.maxFileSize("intest") != 0 {
+		t.Fatalf("a vol without limits is limited")
+	}
+	l.update(map[string]*proto.VolLimit{
+		"intest": {MaxFileSize: 1 << 20, MaxFiles: 10, FilesFull: true},
+		"other":  {MaxFiles: 10},
+	})
+	if !l.filesFull("intest") || l.maxFileSize("intest") != 1<<20 {
+		t.Fatalf("limits of intest: full %v max size %v", l.filesFull("intest"), l.maxFileSize("intest"))
+	}
+	if l.filesFull("other") || l.maxFileSize("other") != 0 {
+		t.Fatalf("limits of other: full %v max size %v", l.filesFull("other"), l.maxFileSize("other"))
+	}
+	l.update(nil)
+	if l.filesFull("intest") || l.maxFileSize("intest") != 0 {
+		t.Fatalf("the limits are kept after a heartbeat without them")
+	}
+}
+
+func TestVolLimits_SizeAfterAppend(t *testing.T) {
+	mp := NewMetaPartition(compatConfig("")).(*metaPartition)
+	file := NewInode(3, 0644)
+	file.Extents.Put(proto.ExtentKey{PartitionId: 12, ExtentId: 1, Size: 4096})
+	file.Extents.Put(proto.ExtentKey{PartitionId: 12, ExtentId: 2, Size: 4096})
+	mp.inodeTree.ReplaceOrInsert(file, true)
+	cases := []struct {
+		ek   proto.ExtentKey
+		size uint64
+	}{
+		{proto.ExtentKey{PartitionId: 12, ExtentId: 3, Size: 1024}, 9216},
+		{proto.ExtentKey{PartitionId: 12, ExtentId: 2, Size: 6144}, 10240},
+		{proto.ExtentKey{PartitionId: 12, ExtentId: 2, Size: 1024}, 8192},
+	}
+	for _, c := range cases {
+		if size := mp.sizeAfterAppend(3, c.ek); size != c.size {
+			t.Errorf("size after append of %v: %v, expected %v", c.ek, size, c.size)
+		}
+	}
+	if size := mp.sizeAfterAppend(4, cases[0].ek); size != 0 {
+		t.Fatalf("size after append to an unknown inode: %v", size)
+	}
+	p := new(Packet)
+	req := &proto.AppendExtentKeyRequest{Inode: 3, Extent: cases[0].ek}
+	if err := mp.ExtentAppend(req, 8192, p); err != nil || p.ResultCode != proto.OpFileTooLargeErr {
+		t.Fatalf("append beyond the max file size: err %v result %v", err, p.ResultCode)
+	}
+}
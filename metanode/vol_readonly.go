@@ -0,0 +1,80 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/auth"
+)
+
+// volReadOnly keeps the read only vols pushed by the master heartbeats, the
+// node refuses the mutations of their clients. A vol set read only between
+// two heartbeats is mutable until the next one.
+type volReadOnly struct {
+	vols map[string]bool
+	sync.RWMutex
+}
+
+func newVolReadOnly() *volReadOnly {
+	return &volReadOnly{vols: make(map[string]bool)}
+}
+
+func (r *volReadOnly) update(vols map[string]bool) {
+	if vols == nil {
+		vols = make(map[string]bool)
+	}
+	r.Lock()
+	r.vols = vols
+	r.Unlock()
+}
+
+func (r *volReadOnly) empty() bool {
+	r.RLock()
+	defer r.RUnlock()
+	return len(r.vols) == 0
+}
+
+func (r *volReadOnly) isReadOnly(volName string) bool {
+	r.RLock()
+	defer r.RUnlock()
+	return r.vols[volName]
+}
+
+// checkReadOnly refuses the mutations of the read only vols. The commit and
+// the abort of a transaction prepared before the vol was set read only go on,
+// so that its dentries are not left locked.
+func (m *metaManager) checkReadOnly(p *Packet) (err error) {
+	if metaAccess(p.Opcode) != auth.AccessWrite || p.Opcode == proto.OpMetaTxCommit || p.Opcode == proto.OpMetaTxAbort ||
+		m.readOnly.empty() {
+		return
+	}
+	req := &struct {
+		PartitionID uint64 `json:"pid"`
+	}{}
+	if err = json.Unmarshal(p.Data, req); err != nil {
+		return nil
+	}
+	mp, err := m.getPartition(req.PartitionID)
+	if err != nil {
+		return nil
+	}
+	if m.readOnly.isReadOnly(mp.GetBaseConfig().VolName) {
+		return ErrVolReadOnly
+	}
+	return
+}
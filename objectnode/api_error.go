@@ -0,0 +1,86 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package objectnode
+
+import (
+	"encoding/xml"
+	"net/http"
+	"syscall"
+
+	"github.com/juju/errors"
+)
+
+var (
+	ErrInvalidKey = errors.New("invalid object key")
+)
+
+// APIError is the error response of the S3 API.
+type APIError struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource,omitempty"`
+	Status   int      `xml:"-"`
+}
+
+var (
+	ErrAccessDenied       = &APIError{Code: "AccessDenied", Message: "Access Denied, the vol is immutable", Status: http.StatusForbidden}
+	ErrEntityTooLarge     = &APIError{Code: "EntityTooLarge", Message: "Your proposed upload exceeds the max file size of the vol.", Status: http.StatusBadRequest}
+	ErrTooManyObjects     = &APIError{Code: "InvalidRequest", Message: "The vol reached its max file count.", Status: http.StatusForbidden}
+	ErrBadDigest          = &APIError{Code: "BadDigest", Message: "The Content-MD5 you specified did not match what we received.", Status: http.StatusBadRequest}
+	ErrInvalidArgument    = &APIError{Code: "InvalidArgument", Message: "Invalid Argument", Status: http.StatusBadRequest}
+	ErrInvalidObjectName  = &APIError{Code: "InvalidObjectName", Message: "The object key is not a valid path of the vol.", Status: http.StatusBadRequest}
+	ErrInvalidPart        = &APIError{Code: "InvalidPart", Message: "One or more of the specified parts could not be found.", Status: http.StatusBadRequest}
+	ErrInvalidPartOrder   = &APIError{Code: "InvalidPartOrder", Message: "The list of parts was not in ascending order.", Status: http.StatusBadRequest}
+	ErrInvalidRange       = &APIError{Code: "InvalidRange", Message: "The requested range is not satisfiable", Status: http.StatusRequestedRangeNotSatisfiable}
+	ErrMalformedXML       = &APIError{Code: "MalformedXML", Message: "The XML you provided was not well-formed.", Status: http.StatusBadRequest}
+	ErrMethodNotAllowed   = &APIError{Code: "MethodNotAllowed", Message: "The specified method is not allowed against this resource.", Status: http.StatusMethodNotAllowed}
+	ErrNoSuchBucket       = &APIError{Code: "NoSuchBucket", Message: "The specified bucket does not exist.", Status: http.StatusNotFound}
+	ErrNoSuchKey          = &APIError{Code: "NoSuchKey", Message: "The specified key does not exist.", Status: http.StatusNotFound}
+	ErrNoSuchUpload       = &APIError{Code: "NoSuchUpload", Message: "The specified multipart upload does not exist.", Status: http.StatusNotFound}
+	ErrNotImplemented     = &APIError{Code: "NotImplemented", Message: "A header or query you provided implies functionality that is not implemented.", Status: http.StatusNotImplemented}
+	ErrObjectConflict     = &APIError{Code: "InvalidRequest", Message: "The key conflicts with an object or a dir of the vol.", Status: http.StatusConflict}
+	ErrDirNotEmpty        = &APIError{Code: "InvalidRequest", Message: "The dir of the key is not empty.", Status: http.StatusConflict}
+	ErrInternalError      = &APIError{Code: "InternalError", Message: "We encountered an internal error. Please try again.", Status: http.StatusInternalServerError}
+	ErrServiceUnavailable = &APIError{Code: "ServiceUnavailable", Message: "Reduce your request rate.", Status: http.StatusServiceUnavailable}
+)
+
+func (e *APIError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+/*the api error of the error of a vol operation*/
+func toAPIError(err error) *APIError {
+	switch err {
+	case ErrInvalidKey:
+		return ErrInvalidObjectName
+	case syscall.ENOENT:
+		return ErrNoSuchKey
+	case syscall.ENOTDIR, syscall.EISDIR, syscall.EEXIST:
+		return ErrObjectConflict
+	case syscall.ENOTEMPTY:
+		return ErrDirNotEmpty
+	case syscall.EAGAIN, syscall.ENOMEM:
+		return ErrServiceUnavailable
+	case syscall.EFBIG:
+		return ErrEntityTooLarge
+	case syscall.EDQUOT:
+		return ErrTooManyObjects
+	}
+	if apiErr, ok := err.(*APIError); ok {
+		return apiErr
+	}
+	return ErrInternalError
+}
@@ -0,0 +1,63 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package objectnode
+
+import (
+	"os"
+	"time"
+
+	"github.com/tiglabs/containerfs/util"
+)
+
+const (
+	Standby uint32 = iota
+	Start
+	Running
+	Shutdown
+	Stopped
+)
+
+const (
+	ConfigKeyListen     = "listen"     // string
+	ConfigKeyMasterAddr = "masterAddr" // array
+	ConfigKeyVolName    = "volName"    // string
+)
+
+const (
+	// SystemDir is the hidden dir at the root of the vol keeping the objects
+	// being written and the multipart uploads, it is not visible as objects.
+	SystemDir  = ".objectnode"
+	UploadsDir = "uploads"
+	TempDir    = "tmp"
+
+	// UploadKeyName is a symlink in the dir of an upload pointing to its key.
+	UploadKeyName = "key"
+)
+
+const (
+	DefaultFileMode = 0644
+	DefaultDirMode  = os.ModeDir | 0755
+
+	BufferSize     = 128 * util.KB
+	MaxNameLen     = 256
+	DefaultMaxKeys = 1000
+	MaxPartNumber  = 10000
+
+	TempFileExpiration = 24 * time.Hour
+)
+
+const (
+	XMLNS = "http://s3.amazonaws.com/doc/2006-03-01/"
+)
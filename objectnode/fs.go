@@ -0,0 +1,284 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package objectnode
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"hash"
+	"io"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/sdk/data/stream"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+/*the dirs and the name of an object key, the name is empty if the key ends with / and stands for a dir*/
+func splitKey(key string) (dirs []string, name string, err error) {
+	names := strings.Split(strings.TrimSuffix(key, "/"), "/")
+	for _, n := range names {
+		if n == "" || n == "." || n == ".." || len(n) > MaxNameLen {
+			return nil, "", ErrInvalidKey
+		}
+	}
+	if names[0] == SystemDir {
+		return nil, "", ErrInvalidKey
+	}
+	if strings.HasSuffix(key, "/") {
+		return names, "", nil
+	}
+	return names[:len(names)-1], names[len(names)-1], nil
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+/*the inode of the dir at the path of names from the root*/
+func (o *ObjectNode) lookupDir(names []string) (ino uint64, err error) {
+	var mode uint32
+	ino = proto.RootIno
+	for _, name := range names {
+		if ino, mode, err = o.mw.Lookup_ll(ino, name); err != nil {
+			return
+		}
+		if !proto.IsDir(mode) {
+			return 0, syscall.ENOTDIR
+		}
+	}
+	return
+}
+
+/*create the missing dirs at the path of names from the root*/
+func (o *ObjectNode) mkdirAll(names []string) (ino uint64, err error) {
+	var (
+		mode  uint32
+		child uint64
+		info  *proto.InodeInfo
+	)
+	ino = proto.RootIno
+	for _, name := range names {
+		child, mode, err = o.mw.Lookup_ll(ino, name)
+		if err == syscall.ENOENT {
+			info, err = o.mw.Create_ll(ino, name, proto.Mode(DefaultDirMode), nil)
+			if err == syscall.EEXIST {
+				// created by a concurrent put
+				child, mode, err = o.mw.Lookup_ll(ino, name)
+			} else if err == nil {
+				child, mode = info.Inode, info.Mode
+			}
+		}
+		if err != nil {
+			return
+		}
+		if !proto.IsDir(mode) {
+			return 0, syscall.ENOTDIR
+		}
+		ino = child
+	}
+	return
+}
+
+/*remove the dentry, the inode and its extents are evicted once it has no link*/
+func (o *ObjectNode) deleteFile(parent uint64, name string) (err error) {
+	var info *proto.InodeInfo
+	if info, err = o.mw.Delete_ll(parent, name); err != nil {
+		return
+	}
+	if info != nil && info.Nlink == 0 {
+		if err = o.mw.Evict(info.Inode); err != nil {
+			log.LogWarnf("action[deleteFile] parent[%v] name[%v] evict ino[%v] err[%v]", parent, name, info.Inode, err)
+			err = nil
+		}
+	}
+	return
+}
+
+/*remove the dir and everything in it*/
+func (o *ObjectNode) deleteDirAll(parent uint64, name string) (err error) {
+	var (
+		ino      uint64
+		mode     uint32
+		children []proto.Dentry
+	)
+	if ino, mode, err = o.mw.Lookup_ll(parent, name); err != nil {
+		return
+	}
+	if proto.IsDir(mode) {
+		if children, err = o.mw.ReadDir_ll(ino); err != nil {
+			return
+		}
+		for _, child := range children {
+			if err = o.deleteDirAll(ino, child.Name); err != nil {
+				return
+			}
+		}
+	}
+	return o.deleteFile(parent, name)
+}
+
+/*remove the empty dirs of the path of names bottom up, the implicit dirs of a key go with its last object*/
+func (o *ObjectNode) pruneDirs(names []string) {
+	for i := len(names); i > 0; i-- {
+		parent, err := o.lookupDir(names[:i-1])
+		if err != nil {
+			return
+		}
+		ino, _, err := o.mw.Lookup_ll(parent, names[i-1])
+		if err != nil {
+			return
+		}
+		children, err := o.mw.ReadDir_ll(ino)
+		if err != nil || len(children) != 0 {
+			return
+		}
+		if err = o.deleteFile(parent, names[i-1]); err != nil {
+			return
+		}
+	}
+}
+
+// write the data of r to a temp file and move it to name in parent replacing the
+// object there, the object is synchronized to disk on all the replicas and checked
+// by verify if not nil before it is visible
+func (o *ObjectNode) writeFile(parent uint64, name string, r io.Reader, verify func(md5sum []byte) error) (md5sum []byte, size uint64, err error) {
+	var info *proto.InodeInfo
+	tmpName := newID()
+	if info, err = o.mw.Create_ll(o.tmpIno, tmpName, proto.Mode(DefaultFileMode), nil); err != nil {
+		return
+	}
+	ino := info.Inode
+	h := md5.New()
+	o.ec.OpenForWrite(ino, 0)
+	size, err = o.writeStream(ino, r, h)
+	if err == nil {
+		err = o.ec.Sync(ino)
+	}
+	if closeErr := o.ec.CloseForWrite(ino); err == nil {
+		err = closeErr
+	}
+	md5sum = h.Sum(nil)
+	if err == nil && verify != nil {
+		err = verify(md5sum)
+	}
+	if err == nil {
+		err = o.replaceFile(parent, name, tmpName)
+	}
+	if err != nil {
+		log.LogErrorf("action[writeFile] parent[%v] name[%v] ino[%v] err[%v]", parent, name, ino, err)
+		o.deleteFile(o.tmpIno, tmpName)
+		return nil, 0, err
+	}
+	return
+}
+
+func (o *ObjectNode) writeStream(ino uint64, r io.Reader, h hash.Hash) (size uint64, err error) {
+	buf := make([]byte, BufferSize)
+	for {
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			h.Write(buf[:n])
+			if _, err = o.ec.Write(ino, int(size), buf[:n]); err != nil {
+				return
+			}
+			size += uint64(n)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			return
+		}
+		if readErr != nil {
+			return size, readErr
+		}
+	}
+}
+
+/*remove the temp files older than TempFileExpiration, left by the puts of a crashed object node*/
+func (o *ObjectNode) cleanTempFiles() {
+	children, err := o.mw.ReadDir_ll(o.tmpIno)
+	if err != nil {
+		log.LogWarnf("action[cleanTempFiles] readdir err[%v]", err)
+		return
+	}
+	for _, child := range children {
+		info, err := o.mw.InodeGet_ll(child.Inode)
+		if err != nil || time.Since(info.ModifyTime) < TempFileExpiration {
+			continue
+		}
+		if err = o.deleteFile(o.tmpIno, child.Name); err != nil {
+			log.LogWarnf("action[cleanTempFiles] name[%v] err[%v]", child.Name, err)
+		}
+	}
+}
+
+/*move the temp file to name in parent, the replaced object is evicted*/
+func (o *ObjectNode) replaceFile(parent uint64, name, tmpName string) (err error) {
+	_, mode, err := o.mw.Lookup_ll(parent, name)
+	switch {
+	case err == syscall.ENOENT:
+	case err != nil:
+		return
+	case proto.IsDir(mode):
+		return syscall.EISDIR
+	default:
+		if err = o.deleteFile(parent, name); err != nil && err != syscall.ENOENT {
+			return
+		}
+	}
+	return o.mw.Rename_ll(o.tmpIno, tmpName, parent, name)
+}
+
+type objectReader struct {
+	o      *ObjectNode
+	ino    uint64
+	stream *stream.StreamReader
+	offset uint64
+	end    uint64
+}
+
+/*a reader of the bytes [offset, end) of the file*/
+func (o *ObjectNode) newObjectReader(ino, offset, end uint64) (r *objectReader, err error) {
+	r = &objectReader{o: o, ino: ino, offset: offset, end: end}
+	if r.stream, err = o.ec.OpenForRead(ino); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (r *objectReader) Read(p []byte) (n int, err error) {
+	if r.offset >= r.end {
+		return 0, io.EOF
+	}
+	size := len(p)
+	if remain := r.end - r.offset; uint64(size) > remain {
+		size = int(remain)
+	}
+	n, err = r.o.ec.Read(r.stream, r.ino, p[:size], int(r.offset), size)
+	r.offset += uint64(n)
+	if err == io.EOF && r.offset < r.end {
+		err = io.ErrUnexpectedEOF
+	} else if err == io.EOF {
+		err = nil
+	}
+	if n == 0 && err == nil {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
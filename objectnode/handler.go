@@ -0,0 +1,461 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package objectnode
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+type Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type ListAllMyBucketsResult struct {
+	XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Owner   Owner    `xml:"Owner"`
+	Buckets []Bucket `xml:"Buckets>Bucket"`
+}
+
+type Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type Content struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	Size         uint64 `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type ListBucketResult struct {
+	XMLName               xml.Name       `xml:"ListBucketResult"`
+	Xmlns                 string         `xml:"xmlns,attr"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	Marker                string         `xml:"Marker,omitempty"`
+	NextMarker            string         `xml:"NextMarker,omitempty"`
+	StartAfter            string         `xml:"StartAfter,omitempty"`
+	ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	KeyCount              int            `xml:"KeyCount,omitempty"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	Delimiter             string         `xml:"Delimiter,omitempty"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	Contents              []Content      `xml:"Contents"`
+	CommonPrefixes        []CommonPrefix `xml:"CommonPrefixes"`
+}
+
+// ServeHTTP routes the path style requests, the bucket is the first element of
+// the path and the rest is the key of the object.
+func (o *ObjectNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	bucket, key := splitPath(r.URL.Path)
+	var err error
+	switch {
+	case bucket == "":
+		err = o.serviceHandler(w, r)
+	case bucket != o.volName:
+		err = ErrNoSuchBucket
+	case key == "":
+		err = o.bucketHandler(w, r)
+	default:
+		err = o.objectHandler(w, r, key)
+	}
+	if err != nil {
+		apiErr := toAPIError(err)
+		if apiErr == ErrInternalError || apiErr == ErrServiceUnavailable {
+			log.LogErrorf("action[ServeHTTP] %v %v err[%v]", r.Method, r.URL, err)
+		}
+		writeError(w, r, apiErr)
+	}
+	log.LogDebugf("action[ServeHTTP] %v %v err[%v] (%v)", r.Method, r.URL, err, time.Since(start))
+}
+
+func splitPath(path string) (bucket, key string) {
+	path = strings.TrimPrefix(path, "/")
+	if i := strings.Index(path, "/"); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+	return path, ""
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, apiErr *APIError) {
+	resp := *apiErr
+	resp.Resource = r.URL.Path
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(apiErr.Status)
+	if r.Method != http.MethodHead {
+		writeXML(w, &resp)
+	}
+}
+
+func writeXML(w io.Writer, v interface{}) {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		log.LogErrorf("action[writeXML] marshal %v err[%v]", v, err)
+		return
+	}
+	io.WriteString(w, xml.Header)
+	w.Write(data)
+}
+
+func writeXMLResponse(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	writeXML(w, v)
+}
+
+func lastModified(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+func etag(md5sum []byte) string {
+	return "\"" + hex.EncodeToString(md5sum) + "\""
+}
+
+func (o *ObjectNode) checkWritable() error {
+	if o.mw.Immutable() {
+		return ErrAccessDenied
+	}
+	return nil
+}
+
+func (o *ObjectNode) serviceHandler(w http.ResponseWriter, r *http.Request) (err error) {
+	if r.Method != http.MethodGet {
+		return ErrMethodNotAllowed
+	}
+	info, err := o.mw.InodeGet_ll(proto.RootIno)
+	if err != nil {
+		return
+	}
+	writeXMLResponse(w, &ListAllMyBucketsResult{
+		Xmlns:   XMLNS,
+		Owner:   Owner{ID: o.mw.Cluster(), DisplayName: o.mw.Cluster()},
+		Buckets: []Bucket{{Name: o.volName, CreationDate: lastModified(info.CreateTime)}},
+	})
+	return
+}
+
+func (o *ObjectNode) bucketHandler(w http.ResponseWriter, r *http.Request) (err error) {
+	switch r.Method {
+	case http.MethodHead:
+		return
+	case http.MethodPut:
+		// the bucket is the vol created by the master
+		return
+	case http.MethodGet:
+		return o.listBucket(w, r)
+	}
+	return ErrMethodNotAllowed
+}
+
+func (o *ObjectNode) objectHandler(w http.ResponseWriter, r *http.Request, key string) (err error) {
+	query := r.URL.Query()
+	_, isInitiate := query["uploads"]
+	uploadID := query.Get("uploadId")
+	switch {
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return o.getObject(w, r, key)
+	case r.Method == http.MethodPut && uploadID != "":
+		return o.uploadPart(w, r, key, uploadID)
+	case r.Method == http.MethodPut:
+		return o.putObject(w, r, key)
+	case r.Method == http.MethodDelete && uploadID != "":
+		return o.abortMultipartUpload(w, r, key, uploadID)
+	case r.Method == http.MethodDelete:
+		return o.deleteObject(w, r, key)
+	case r.Method == http.MethodPost && isInitiate:
+		return o.initiateMultipartUpload(w, r, key)
+	case r.Method == http.MethodPost && uploadID != "":
+		return o.completeMultipartUpload(w, r, key, uploadID)
+	}
+	return ErrMethodNotAllowed
+}
+
+func (o *ObjectNode) listBucket(w http.ResponseWriter, r *http.Request) (err error) {
+	query := r.URL.Query()
+	isV2 := query.Get("list-type") == "2"
+	maxKeys := DefaultMaxKeys
+	if value := query.Get("max-keys"); value != "" {
+		if maxKeys, err = strconv.Atoi(value); err != nil || maxKeys < 0 {
+			return ErrInvalidArgument
+		}
+		if maxKeys > DefaultMaxKeys {
+			maxKeys = DefaultMaxKeys
+		}
+	}
+	result := &ListBucketResult{
+		Xmlns:     XMLNS,
+		Name:      o.volName,
+		Prefix:    query.Get("prefix"),
+		Delimiter: query.Get("delimiter"),
+		MaxKeys:   maxKeys,
+	}
+	marker := query.Get("marker")
+	if isV2 {
+		result.StartAfter = query.Get("start-after")
+		result.ContinuationToken = query.Get("continuation-token")
+		marker = result.StartAfter
+		if result.ContinuationToken != "" {
+			data, decodeErr := base64.StdEncoding.DecodeString(result.ContinuationToken)
+			if decodeErr != nil {
+				return ErrInvalidArgument
+			}
+			marker = string(data)
+		}
+	} else {
+		result.Marker = marker
+	}
+	l, err := o.listObjects(result.Prefix, result.Delimiter, marker, maxKeys)
+	if err != nil {
+		return
+	}
+	infos := l.inodeInfos()
+	for _, e := range l.objects {
+		content := Content{Key: e.key, StorageClass: "STANDARD"}
+		if info, ok := infos[e.inode]; ok {
+			content.LastModified = lastModified(info.ModifyTime)
+			if !e.isDir {
+				content.Size = info.Size
+			}
+		}
+		result.Contents = append(result.Contents, content)
+	}
+	for _, prefix := range l.prefixes {
+		result.CommonPrefixes = append(result.CommonPrefixes, CommonPrefix{Prefix: prefix})
+	}
+	result.IsTruncated = l.truncated
+	if isV2 {
+		result.KeyCount = l.count
+		if l.truncated {
+			result.NextContinuationToken = base64.StdEncoding.EncodeToString([]byte(l.next))
+		}
+	} else if l.truncated && result.Delimiter != "" {
+		result.NextMarker = l.next
+	}
+	writeXMLResponse(w, result)
+	return
+}
+
+func (o *ObjectNode) putObject(w http.ResponseWriter, r *http.Request, key string) (err error) {
+	if err = o.checkWritable(); err != nil {
+		return
+	}
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		return ErrNotImplemented
+	}
+	dirs, name, err := splitKey(key)
+	if err != nil {
+		return
+	}
+	parent, err := o.mkdirAll(dirs)
+	if err != nil {
+		return
+	}
+	if name == "" {
+		// a key with / is a dir, it has no data
+		w.Header().Set("ETag", etag(md5.New().Sum(nil)))
+		return
+	}
+	var verify func(md5sum []byte) error
+	if value := r.Header.Get("Content-MD5"); value != "" {
+		expectMD5, decodeErr := base64.StdEncoding.DecodeString(value)
+		if decodeErr != nil {
+			return ErrInvalidArgument
+		}
+		verify = func(md5sum []byte) error {
+			if !bytes.Equal(expectMD5, md5sum) {
+				return ErrBadDigest
+			}
+			return nil
+		}
+	}
+	md5sum, size, err := o.writeFile(parent, name, r.Body, verify)
+	if err != nil {
+		return
+	}
+	log.LogDebugf("action[putObject] key[%v] size[%v]", key, size)
+	w.Header().Set("ETag", etag(md5sum))
+	return
+}
+
+func (o *ObjectNode) getObject(w http.ResponseWriter, r *http.Request, key string) (err error) {
+	dirs, name, err := splitKey(key)
+	if err != nil {
+		return
+	}
+	parent, err := o.lookupDir(dirs)
+	if err == nil && name == "" {
+		// a dir is an object without data
+		w.Header().Set("Content-Length", "0")
+		return
+	}
+	if err != nil {
+		if err == syscall.ENOTDIR {
+			err = ErrNoSuchKey
+		}
+		return
+	}
+	ino, mode, err := o.mw.Lookup_ll(parent, name)
+	if err != nil {
+		return
+	}
+	if !proto.IsRegular(mode) {
+		return ErrNoSuchKey
+	}
+	info, err := o.mw.InodeGet_ll(ino)
+	if err != nil {
+		return
+	}
+	start, end, isRange, err := parseRange(r.Header.Get("Range"), info.Size)
+	if err != nil {
+		return
+	}
+	header := w.Header()
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Last-Modified", info.ModifyTime.UTC().Format(http.TimeFormat))
+	header.Set("Accept-Ranges", "bytes")
+	header.Set("Content-Length", strconv.FormatUint(end-start, 10))
+	status := http.StatusOK
+	if isRange {
+		header.Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", start, end-1, info.Size))
+		status = http.StatusPartialContent
+	}
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+	reader, err := o.newObjectReader(ino, start, end)
+	if err != nil {
+		return
+	}
+	w.WriteHeader(status)
+	if _, copyErr := io.CopyBuffer(w, reader, make([]byte, BufferSize)); copyErr != nil {
+		// the status is sent, the client sees a short body
+		log.LogErrorf("action[getObject] key[%v] ino[%v] range[%v,%v) err[%v]", key, ino, start, end, copyErr)
+	}
+	return
+}
+
+/*the bytes [start, end) of the range header, the whole object without the header*/
+func parseRange(value string, size uint64) (start, end uint64, isRange bool, err error) {
+	if value == "" {
+		return 0, size, false, nil
+	}
+	spec := strings.TrimPrefix(value, "bytes=")
+	dash := strings.Index(spec, "-")
+	if spec == value || dash < 0 || strings.Contains(spec, ",") {
+		// a malformed or multiple range is ignored like s3 does
+		return 0, size, false, nil
+	}
+	first, last := spec[:dash], spec[dash+1:]
+	switch {
+	case first == "":
+		var suffix uint64
+		if suffix, err = strconv.ParseUint(last, 10, 64); err != nil || suffix == 0 {
+			return 0, 0, false, ErrInvalidRange
+		}
+		if suffix > size {
+			suffix = size
+		}
+		start, end = size-suffix, size
+	default:
+		if start, err = strconv.ParseUint(first, 10, 64); err != nil || start >= size {
+			return 0, 0, false, ErrInvalidRange
+		}
+		end = size
+		if last != "" {
+			var lastByte uint64
+			if lastByte, err = strconv.ParseUint(last, 10, 64); err != nil || lastByte < start {
+				return 0, 0, false, ErrInvalidRange
+			}
+			if lastByte+1 < size {
+				end = lastByte + 1
+			}
+		}
+	}
+	return start, end, true, nil
+}
+
+func (o *ObjectNode) deleteObject(w http.ResponseWriter, r *http.Request, key string) (err error) {
+	if err = o.checkWritable(); err != nil {
+		return
+	}
+	dirs, name, err := splitKey(key)
+	if err != nil {
+		return
+	}
+	isDir := name == ""
+	if isDir {
+		// the dir of a key with / is removed only if empty
+		name, dirs = dirs[len(dirs)-1], dirs[:len(dirs)-1]
+	}
+	parent, err := o.lookupDir(dirs)
+	if err == nil {
+		err = o.deleteObjectOf(parent, name, isDir)
+	}
+	switch err {
+	case nil:
+		o.pruneDirs(dirs)
+	case syscall.ENOENT, syscall.ENOTDIR:
+		// deleting a missing object succeeds
+		err = nil
+	default:
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return
+}
+
+func (o *ObjectNode) deleteObjectOf(parent uint64, name string, isDir bool) (err error) {
+	ino, mode, err := o.mw.Lookup_ll(parent, name)
+	if err != nil {
+		return
+	}
+	if proto.IsDir(mode) != isDir {
+		// a key with / names only a dir, a key without names only a file
+		return syscall.ENOENT
+	}
+	if isDir {
+		children, err := o.mw.ReadDir_ll(ino)
+		if err != nil {
+			return err
+		}
+		if len(children) != 0 {
+			return syscall.ENOTEMPTY
+		}
+	}
+	return o.deleteFile(parent, name)
+}
@@ -0,0 +1,150 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package objectnode
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+type listEntry struct {
+	key   string
+	inode uint64
+	isDir bool
+}
+
+// the listing walks the dirs of the vol in the order of the keys, the key of a
+// dir sorts as its name with /, and skips the dirs which can not hold a key
+// after the marker with the prefix
+type lister struct {
+	o         *ObjectNode
+	prefix    string
+	delimiter string
+	marker    string
+	maxKeys   int
+	count     int
+	objects   []*listEntry
+	prefixes  []string
+	truncated bool
+	next      string
+}
+
+func (o *ObjectNode) listObjects(prefix, delimiter, marker string, maxKeys int) (l *lister, err error) {
+	l = &lister{o: o, prefix: prefix, delimiter: delimiter, marker: marker, maxKeys: maxKeys,
+		objects: make([]*listEntry, 0), prefixes: make([]string, 0)}
+	if maxKeys <= 0 {
+		return
+	}
+	_, err = l.walk(proto.RootIno, "")
+	return
+}
+
+func (l *lister) walk(ino uint64, dirKey string) (stop bool, err error) {
+	children, err := l.o.mw.ReadDir_ll(ino)
+	if err != nil {
+		return
+	}
+	if len(children) == 0 && dirKey != "" {
+		// an empty dir is listed as an object of the key with /
+		return l.emit(&listEntry{key: dirKey, inode: ino, isDir: true}), nil
+	}
+	entries := make([]*listEntry, 0, len(children))
+	for _, child := range children {
+		if dirKey == "" && child.Name == SystemDir {
+			continue
+		}
+		e := &listEntry{key: dirKey + child.Name, inode: child.Inode, isDir: proto.IsDir(child.Type)}
+		if e.isDir {
+			e.key += "/"
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+	for _, e := range entries {
+		if !e.isDir {
+			if stop = l.emit(e); stop {
+				return
+			}
+			continue
+		}
+		if !strings.HasPrefix(e.key, l.prefix) && !strings.HasPrefix(l.prefix, e.key) {
+			continue
+		}
+		if e.key < l.marker && !strings.HasPrefix(l.marker, e.key) {
+			continue
+		}
+		if l.delimiter == "/" && strings.HasPrefix(e.key, l.prefix) {
+			// the dir is the common prefix of all the keys in it
+			if stop = l.emitPrefix(e.key); stop {
+				return
+			}
+			continue
+		}
+		if stop, err = l.walk(e.inode, e.key); stop || err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (l *lister) emit(e *listEntry) (stop bool) {
+	if !strings.HasPrefix(e.key, l.prefix) || e.key <= l.marker {
+		return
+	}
+	if l.delimiter != "" {
+		if i := strings.Index(e.key[len(l.prefix):], l.delimiter); i >= 0 {
+			return l.emitPrefix(e.key[:len(l.prefix)+i+len(l.delimiter)])
+		}
+	}
+	if l.count >= l.maxKeys {
+		l.truncated = true
+		return true
+	}
+	l.objects = append(l.objects, e)
+	l.count++
+	l.next = e.key
+	return
+}
+
+func (l *lister) emitPrefix(prefix string) (stop bool) {
+	if prefix <= l.marker || (len(l.prefixes) != 0 && l.prefixes[len(l.prefixes)-1] == prefix) {
+		return
+	}
+	if l.count >= l.maxKeys {
+		l.truncated = true
+		return true
+	}
+	l.prefixes = append(l.prefixes, prefix)
+	l.count++
+	l.next = prefix
+	return
+}
+
+/*the inode infos of the listed objects*/
+func (l *lister) inodeInfos() (infos map[uint64]*proto.InodeInfo) {
+	inodes := make([]uint64, 0, len(l.objects))
+	for _, e := range l.objects {
+		inodes = append(inodes, e.inode)
+	}
+	infos = make(map[uint64]*proto.InodeInfo, len(inodes))
+	for _, info := range l.o.mw.BatchInodeGet(inodes) {
+		infos[info.Inode] = info
+	}
+	return
+}
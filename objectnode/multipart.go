@@ -0,0 +1,235 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package objectnode
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+// the parts of an upload are files in its dir under SystemDir/UploadsDir, they
+// are copied into the object on complete and removed with the dir
+
+type InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadId string   `xml:"UploadId"`
+}
+
+type CompletePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type CompleteMultipartUpload struct {
+	XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+	Parts   []CompletePart `xml:"Part"`
+}
+
+type CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+func partName(partNumber int) string {
+	return fmt.Sprintf("%05d", partNumber)
+}
+
+func (o *ObjectNode) initiateMultipartUpload(w http.ResponseWriter, r *http.Request, key string) (err error) {
+	if err = o.checkWritable(); err != nil {
+		return
+	}
+	_, name, err := splitKey(key)
+	if err != nil {
+		return
+	}
+	if name == "" {
+		return ErrInvalidObjectName
+	}
+	uploadID := newID()
+	info, err := o.mw.Create_ll(o.uploadsIno, uploadID, proto.Mode(DefaultDirMode), nil)
+	if err != nil {
+		return
+	}
+	if _, err = o.mw.Create_ll(info.Inode, UploadKeyName, proto.Mode(os.ModeSymlink|os.ModePerm), []byte(key)); err != nil {
+		o.deleteDirAll(o.uploadsIno, uploadID)
+		return
+	}
+	log.LogInfof("action[initiateMultipartUpload] key[%v] uploadId[%v]", key, uploadID)
+	writeXMLResponse(w, &InitiateMultipartUploadResult{Xmlns: XMLNS, Bucket: o.volName, Key: key, UploadId: uploadID})
+	return
+}
+
+/*the dir of the upload of the key*/
+func (o *ObjectNode) getUpload(key, uploadID string) (ino uint64, err error) {
+	if _, decodeErr := hex.DecodeString(uploadID); decodeErr != nil || len(uploadID) != 32 {
+		return 0, ErrNoSuchUpload
+	}
+	if ino, _, err = o.mw.Lookup_ll(o.uploadsIno, uploadID); err != nil {
+		if err == syscall.ENOENT {
+			err = ErrNoSuchUpload
+		}
+		return
+	}
+	keyIno, _, err := o.mw.Lookup_ll(ino, UploadKeyName)
+	if err != nil {
+		return 0, ErrNoSuchUpload
+	}
+	info, err := o.mw.InodeGet_ll(keyIno)
+	if err != nil {
+		return
+	}
+	if string(info.Target) != key {
+		return 0, ErrNoSuchUpload
+	}
+	return
+}
+
+func (o *ObjectNode) uploadPart(w http.ResponseWriter, r *http.Request, key, uploadID string) (err error) {
+	if err = o.checkWritable(); err != nil {
+		return
+	}
+	partNumber, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > MaxPartNumber {
+		return ErrInvalidArgument
+	}
+	ino, err := o.getUpload(key, uploadID)
+	if err != nil {
+		return
+	}
+	md5sum, size, err := o.writeFile(ino, partName(partNumber), r.Body, nil)
+	if err != nil {
+		return
+	}
+	log.LogDebugf("action[uploadPart] key[%v] uploadId[%v] part[%v] size[%v]", key, uploadID, partNumber, size)
+	w.Header().Set("ETag", etag(md5sum))
+	return
+}
+
+func (o *ObjectNode) completeMultipartUpload(w http.ResponseWriter, r *http.Request, key, uploadID string) (err error) {
+	if err = o.checkWritable(); err != nil {
+		return
+	}
+	ino, err := o.getUpload(key, uploadID)
+	if err != nil {
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+	complete := &CompleteMultipartUpload{}
+	if err = xml.Unmarshal(data, complete); err != nil || len(complete.Parts) == 0 {
+		return ErrMalformedXML
+	}
+	readers := make([]io.Reader, 0, len(complete.Parts))
+	hashes := make([]hash.Hash, 0, len(complete.Parts))
+	expects := make([][]byte, 0, len(complete.Parts))
+	for i, part := range complete.Parts {
+		if i > 0 && part.PartNumber <= complete.Parts[i-1].PartNumber {
+			return ErrInvalidPartOrder
+		}
+		expect, decodeErr := hex.DecodeString(strings.Trim(part.ETag, "\""))
+		if decodeErr != nil {
+			return ErrInvalidPart
+		}
+		partIno, _, lookupErr := o.mw.Lookup_ll(ino, partName(part.PartNumber))
+		if lookupErr != nil {
+			return ErrInvalidPart
+		}
+		info, err := o.mw.InodeGet_ll(partIno)
+		if err != nil {
+			return err
+		}
+		reader, err := o.newObjectReader(partIno, 0, info.Size)
+		if err != nil {
+			return err
+		}
+		h := md5.New()
+		readers = append(readers, io.TeeReader(reader, h))
+		hashes = append(hashes, h)
+		expects = append(expects, expect)
+	}
+	// the parts are checked while copied, a part replaced after its etag
+	// was returned fails the complete
+	verify := func(md5sum []byte) error {
+		for i, h := range hashes {
+			if !bytes.Equal(h.Sum(nil), expects[i]) {
+				return ErrInvalidPart
+			}
+		}
+		return nil
+	}
+	dirs, name, err := splitKey(key)
+	if err != nil {
+		return
+	}
+	parent, err := o.mkdirAll(dirs)
+	if err != nil {
+		return
+	}
+	if _, _, err = o.writeFile(parent, name, io.MultiReader(readers...), verify); err != nil {
+		return
+	}
+	if err = o.deleteDirAll(o.uploadsIno, uploadID); err != nil {
+		log.LogWarnf("action[completeMultipartUpload] key[%v] uploadId[%v] remove upload err[%v]", key, uploadID, err)
+		err = nil
+	}
+	// the etag of a multipart object is the md5 of the md5 of its parts
+	h := md5.New()
+	for _, expect := range expects {
+		h.Write(expect)
+	}
+	tag := fmt.Sprintf("\"%v-%v\"", hex.EncodeToString(h.Sum(nil)), len(expects))
+	log.LogInfof("action[completeMultipartUpload] key[%v] uploadId[%v] parts[%v]", key, uploadID, len(expects))
+	writeXMLResponse(w, &CompleteMultipartUploadResult{Xmlns: XMLNS, Location: "/" + o.volName + "/" + key,
+		Bucket: o.volName, Key: key, ETag: tag})
+	return
+}
+
+func (o *ObjectNode) abortMultipartUpload(w http.ResponseWriter, r *http.Request, key, uploadID string) (err error) {
+	if err = o.checkWritable(); err != nil {
+		return
+	}
+	if _, err = o.getUpload(key, uploadID); err != nil {
+		return
+	}
+	if err = o.deleteDirAll(o.uploadsIno, uploadID); err != nil {
+		return
+	}
+	log.LogInfof("action[abortMultipartUpload] key[%v] uploadId[%v]", key, uploadID)
+	w.WriteHeader(http.StatusNoContent)
+	return
+}
@@ -0,0 +1,150 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package objectnode
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/containerfs/sdk/data/stream"
+	"github.com/tiglabs/containerfs/sdk/meta"
+	"github.com/tiglabs/containerfs/util/auth"
+	"github.com/tiglabs/containerfs/util/config"
+	"github.com/tiglabs/containerfs/util/log"
+	"github.com/tiglabs/containerfs/util/pool"
+)
+
+var (
+	ErrBadConfFile = errors.New("bad config file")
+)
+
+// ObjectNode serves a vol as a bucket of an S3 compatible http API, the key of
+// an object is its path in the vol. The extent client of the sdk keeps its data
+// partitions in a global, so an object node serves only one vol.
+type ObjectNode struct {
+	listen     string
+	masterAddr string
+	volName    string
+	session    string // presented on the connections to the nodes
+	mw         *meta.MetaWrapper
+	ec         *stream.ExtentClient
+	tmpIno     uint64
+	uploadsIno uint64
+	httpServer *http.Server
+	state      uint32
+	wg         sync.WaitGroup
+}
+
+func NewServer() *ObjectNode {
+	return &ObjectNode{}
+}
+
+func (o *ObjectNode) Start(cfg *config.Config) (err error) {
+	if atomic.CompareAndSwapUint32(&o.state, Standby, Start) {
+		defer func() {
+			if err != nil {
+				atomic.StoreUint32(&o.state, Standby)
+			} else {
+				atomic.StoreUint32(&o.state, Running)
+			}
+		}()
+		if err = o.onStart(cfg); err != nil {
+			return
+		}
+		o.wg.Add(1)
+	}
+	return
+}
+
+func (o *ObjectNode) Shutdown() {
+	if atomic.CompareAndSwapUint32(&o.state, Running, Shutdown) {
+		o.onShutdown()
+		o.wg.Done()
+		atomic.StoreUint32(&o.state, Stopped)
+	}
+}
+
+func (o *ObjectNode) Sync() {
+	if atomic.LoadUint32(&o.state) == Running {
+		o.wg.Wait()
+	}
+}
+
+func (o *ObjectNode) onStart(cfg *config.Config) (err error) {
+	if err = o.parseConfig(cfg); err != nil {
+		return
+	}
+	if o.mw, err = meta.NewMetaWrapperWithConns(o.volName, o.masterAddr, o.session, pool.NewConnPool()); err != nil {
+		return errors.Annotatef(err, "NewMetaWrapper vol[%v]", o.volName)
+	}
+	// the gateway is trusted with the vol by its token, its requests are
+	// made for root
+	o.mw.SetCaller(0, 0)
+	if o.ec, err = stream.NewExtentClient(o.volName, o.masterAddr, o.mw.AppendExtentKey, o.mw.GetExtents); err != nil {
+		return errors.Annotatef(err, "NewExtentClient vol[%v]", o.volName)
+	}
+	if o.tmpIno, err = o.mkdirAll([]string{SystemDir, TempDir}); err != nil {
+		return errors.Annotatef(err, "create dir %v/%v", SystemDir, TempDir)
+	}
+	if o.uploadsIno, err = o.mkdirAll([]string{SystemDir, UploadsDir}); err != nil {
+		return errors.Annotatef(err, "create dir %v/%v", SystemDir, UploadsDir)
+	}
+	go o.cleanTempFiles()
+	o.httpServer = &http.Server{Addr: ":" + o.listen, Handler: o}
+	go func() {
+		if err := o.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.LogErrorf("action[onStart] listen[%v] err[%v]", o.listen, err)
+		}
+	}()
+	log.LogInfof("action[onStart] objectNode listen[%v] vol[%v] cluster[%v] immutable[%v]",
+		o.listen, o.volName, o.mw.Cluster(), o.mw.Immutable())
+	return
+}
+
+func (o *ObjectNode) onShutdown() {
+	if o.httpServer != nil {
+		o.httpServer.Close()
+	}
+	return
+}
+
+func (o *ObjectNode) parseConfig(cfg *config.Config) (err error) {
+	var regexpPort *regexp.Regexp
+	o.listen = cfg.GetString(ConfigKeyListen)
+	if regexpPort, err = regexp.Compile("^(\\d)+$"); err != nil {
+		return
+	}
+	if !regexpPort.MatchString(o.listen) {
+		return errors.Annotatef(ErrBadConfFile, "listen[%v]", o.listen)
+	}
+	addrs := make([]string, 0)
+	for _, addr := range cfg.GetArray(ConfigKeyMasterAddr) {
+		addrs = append(addrs, addr.(string))
+	}
+	o.masterAddr = strings.Join(addrs, ",")
+	o.volName = cfg.GetString(ConfigKeyVolName)
+	if o.masterAddr == "" || o.volName == "" {
+		return errors.Annotatef(ErrBadConfFile, "masterAddr[%v] volName[%v]", o.masterAddr, o.volName)
+	}
+	// the connections present the session, the nodes fence them once it is evicted
+	o.session = meta.NewSessionID()
+	pool.SetDialHook(auth.ConnectHook(o.volName, cfg.GetString(auth.Token), o.session))
+	log.LogInfof("action[parseConfig] listen[%v] masterAddr[%v] volName[%v]", o.listen, o.masterAddr, o.volName)
+	return
+}
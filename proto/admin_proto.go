@@ -29,16 +29,22 @@ type ClusterInfo struct {
 }
 
 type CreateDataPartitionRequest struct {
-	PartitionType string
-	PartitionId   uint64
-	PartitionSize int
-	VolumeId      string
+	PartitionType   string
+	PartitionId     uint64
+	PartitionSize   int
+	VolumeId        string
+	Epoch           uint64
+	EncryptKeyId    string   `json:",omitempty"` //the data of the partition is encrypted by the key of the vol
+	ReplicationMode string   `json:",omitempty"` //raft, or empty for the replication chain
+	Peers           []Peer   `json:",omitempty"` //members of the raft group of a raft replicated partition
+	ShardHosts      []string `json:",omitempty"` //the hosts of the shards of an erasure coded partition by the shard index
 }
 
 type CreateDataPartitionResponse struct {
 	PartitionId uint64
 	Status      uint8
 	Result      string
+	ErrCode     ErrCode `json:",omitempty"`
 }
 
 type DeleteDataPartitionRequest struct {
@@ -50,6 +56,7 @@ type DeleteDataPartitionRequest struct {
 type DeleteDataPartitionResponse struct {
 	Status      uint8
 	Result      string
+	ErrCode     ErrCode `json:",omitempty"`
 	PartitionId uint64
 }
 
@@ -66,6 +73,7 @@ type LoadDataPartitionResponse struct {
 	Status            uint8
 	PartitionStatus   int
 	Result            string
+	ErrCode           ErrCode `json:",omitempty"`
 }
 
 type File struct {
@@ -91,11 +99,123 @@ type LoadMetaPartitionMetricResponse struct {
 	MaxInode uint64
 	Status   uint8
 	Result   string
+	ErrCode  ErrCode `json:",omitempty"`
 }
 
+// Heartbeat capability flags, the master announce what it supports in
+// HeartBeatRequest and the node answer with the flags it actually used.
+const (
+	// CapDeltaHeartbeat allows the node to report only the partitions
+	// changed since the last report accepted by the master.
+	CapDeltaHeartbeat uint32 = 1 << iota
+	// CapChangedEpochs tells PartitionEpochs only holds the epochs the node
+	// reported behind, SealedPartitions the sealed partitions and
+	// UnsealedPartitions the ones the node reported sealed by mistake.
+	CapChangedEpochs
+)
+
 type HeartBeatRequest struct {
-	CurrTime   int64
-	MasterAddr string
+	CurrTime        int64
+	MasterAddr      string
+	Capabilities    uint32
+	ReportEpoch     uint64            //epoch of the last full report the master holds, 0 means none
+	ReportSeq       uint64            `json:",omitempty"` //seq of the last report the master merged into ReportEpoch
+	PartitionEpochs map[uint64]uint64 //membership epoch of the data partitions on the node
+	FencedClients   []*ClientFence    //evicted clients the node must refuse
+	ActiveSessions  []string          //client sessions reported to master, sent to meta nodes only
+	Draining        bool              //the data node is decommissioned and must refuse new partitions
+	// token digests of the vols with tokens, the node refuses the clients of these vols without one
+	VolTokens map[string][]*TokenDigest
+	// limits of the vols with any, sent to meta nodes only
+	VolLimits map[string]*VolLimit
+	// sealed data partitions of PartitionEpochs, true if their replicas have the same seal crc
+	SealedPartitions map[uint64]bool `json:",omitempty"`
+	// partitions reported sealed the master does not seal, with CapChangedEpochs only
+	UnsealedPartitions []uint64 `json:",omitempty"`
+	// compression codecs of the vols with one, sent to data nodes only
+	VolCompression map[string]string `json:",omitempty"`
+	// keys of the encrypted vols, sent to data nodes only
+	VolKeys map[string]*VolKey `json:",omitempty"`
+	// days the extents of the vols with a cold tier are not read before tiered, sent to data nodes only
+	VolColdTierDays map[string]int `json:",omitempty"`
+	// vols with the audit of their namespace mutations, sent to meta nodes only
+	VolAudit map[string]bool `json:",omitempty"`
+	// read only vols, the meta nodes refuse their mutations and the data nodes their writes
+	VolReadOnly map[string]bool `json:",omitempty"`
+	// vols with the permission checks of the callers, sent to meta nodes only
+	VolPermission map[string]bool `json:",omitempty"`
+	// lifecycle rules of the vols with any, sent to meta nodes only
+	VolLifecycle map[string][]*LifecycleRule `json:",omitempty"`
+}
+
+// Compression codecs of the blob objects of a vol.
+const (
+	CompressionNone = ""
+	CompressionLZ4  = "lz4"
+	CompressionZstd = "zstd"
+)
+
+// VolKey is the key encrypting the data partitions of a vol at rest, the data
+// nodes keep it in memory only.
+type VolKey struct {
+	KeyId string
+	Key   []byte
+}
+
+// VolLimit is enforced by the meta nodes on the inode creations and the
+// extent appends of the vol, 0 means no limit.
+type VolLimit struct {
+	MaxFileSize uint64
+	MaxFiles    uint64
+	FilesFull   bool //the inodes of the vol reported by the last heartbeats reached MaxFiles
+}
+
+// ClientFence asks the node to refuse the requests from an evicted client
+// host until ExpireTime (unix seconds).
+type ClientFence struct {
+	Addr       string //host of the session
+	Session    string `json:",omitempty"`
+	ExpireTime int64
+}
+
+// LeaderLeaseRequest renews the leader leases of the data partitions of the
+// node, the master grants the leases of the partitions the node leads.
+type LeaderLeaseRequest struct {
+	Addr         string
+	PartitionIDs []uint64
+}
+
+// LeaderLease lets the node lead the partition at Epoch for Seconds, counted by
+// the node from the time it sent the request.
+type LeaderLease struct {
+	PartitionID uint64
+	Epoch       uint64
+	Seconds     int64
+}
+
+type LeaderLeaseResponse struct {
+	Leases []*LeaderLease
+}
+
+// ReplicaHostsRequest gets the hosts of the data partitions of the node in one
+// request instead of one request per partition.
+type ReplicaHostsRequest struct {
+	Addr         string
+	PartitionIDs []uint64
+}
+
+// PartitionHosts are the replica hosts of a data partition at Epoch, Leader is
+// the head of the chain, empty for a raft replicated partition electing its own.
+type PartitionHosts struct {
+	PartitionID uint64
+	Hosts       []string
+	WarmHosts   []string
+	Epoch       uint64
+	Leader      string
+}
+
+type ReplicaHostsResponse struct {
+	Partitions []*PartitionHosts
 }
 
 type PartitionReport struct {
@@ -103,20 +223,75 @@ type PartitionReport struct {
 	PartitionStatus int
 	Total           uint64
 	Used            uint64
+	Reclaimable     uint64
+	Quarantined     []*QuarantinedRange
+	DiskPath        string
+	Sealed          bool   `json:",omitempty"`
+	SealCrc         uint32 `json:",omitempty"` //crc of the extent sizes and crcs recorded by the seal
+	RaftLeader      bool   `json:",omitempty"` //the node leads the raft group of a raft replicated partition
+	WriteLatencyMs  uint32 `json:",omitempty"` //average write latency of the last period, the forwarding to the followers included on the leader
+	Epoch           uint64 `json:",omitempty"` //membership epoch the node holds, the master sends the partition epoch only when it differs
+}
+
+// DiskReport is the usage of a disk of data node.
+type DiskReport struct {
+	Path      string
+	Total     uint64
+	Used      uint64
+	Available uint64
+	Status    int
+	Reason    string `json:",omitempty"` //why the disk is unavailable
+}
+
+// QuarantinedRange describes a range of a data partition file which failed the
+// startup consistency check and must be repaired from other replicas.
+// For extent files Start and End are byte offsets, for blob files they are object ids.
+type QuarantinedRange struct {
+	FileId uint64
+	Start  uint64
+	End    uint64
+	Reason string
+}
+
+// ExtentReferences are the extents of a data partition referenced by the inodes
+// of a meta partition, the leader of the meta partition reports them to the leader
+// of the data partition which collects the extents no meta partition references.
+type ExtentReferences struct {
+	VolName         string
+	MetaPartitionID uint64
+	DataPartitionID uint32
+	AgeMs           int64 //how long ago the references were collected when sent
+	Extents         []uint64
 }
 
 type DataNodeHeartBeatResponse struct {
 	Total                           uint64
 	Used                            uint64
 	Available                       uint64
+	Reclaimable                     uint64 //bytes released by pending delete,compaction and hole punching
+	ProjectedUsed                   uint64 //used after reclaimable bytes released
 	CreatedPartitionWeights         uint64 //volCnt*volsize
 	RemainWeightsForCreatePartition uint64 //all-usedvolsWieghts
 	CreatedPartitionCnt             uint32
 	MaxWeightsForCreatePartition    uint64
 	RackName                        string
+	ZoneName                        string `json:",omitempty"` //failure domain above the rack, empty if the master assigns the rack to a zone
+	ClientAddr                      string
+	ReplicaAddr                     string
+	RaftHeartbeatPort               int `json:",omitempty"` //raft ports of the raft replicated partitions, 0 if the node has no raft
+	RaftReplicatePort               int `json:",omitempty"`
+	Capabilities                    uint32
+	IsDelta                         bool     //PartitionInfo only holds partitions changed since last report
+	ReportEpoch                     uint64   //epoch of the full report the delta based on
+	ReportSeq                       uint64   `json:",omitempty"` //seq of the report, acked back in the next heartbeat request
+	RemovedPartitions               []uint64 //partitions no longer on the node, only set in delta report
 	PartitionInfo                   []*PartitionReport
+	Disks                           []*DiskReport
+	ClockOffset                     int64 //seconds the node clock ahead of the master, measured with CurrTime of the request
+	Draining                        bool  //the node is draining its partitions for decommission
 	Status                          uint8
 	Result                          string
+	ErrCode                         ErrCode `json:",omitempty"`
 }
 
 type MetaPartitionReport struct {
@@ -126,15 +301,206 @@ type MetaPartitionReport struct {
 	Status      int
 	MaxInodeID  uint64
 	IsLeader    bool
+	InodeCount  uint64
+	UsageFiles  uint64 `json:",omitempty"` //regular files of the partition aggregated by the leader at UsageTime
+	UsageBytes  uint64 `json:",omitempty"`
+	UsageTime   int64  `json:",omitempty"`
 }
 
 type MetaNodeHeartbeatResponse struct {
 	RackName          string
+	ZoneName          string `json:",omitempty"` //zone label of the node for the meta partition placement
+	MemClass          string `json:",omitempty"` //memory class label of the node for the meta partition placement
 	Total             uint64
 	Used              uint64
 	MetaPartitionInfo []*MetaPartitionReport
+	ClockOffset       int64 //seconds the node clock ahead of the master, measured with CurrTime of the request
 	Status            uint8
 	Result            string
+	ErrCode           ErrCode `json:",omitempty"`
+	// rules of the vols the node walks
+	Lifecycle []*LifecycleReport `json:",omitempty"`
+}
+
+// ArchiveDataPartitionRequest asks the node to seal its replica of the partition,
+// flush it to disk and detach it. The replica exports the files to Target first
+// if Export is set, the files are kept on the node if Target is empty.
+type ArchiveDataPartitionRequest struct {
+	PartitionType string
+	PartitionId   uint64
+	Target        string
+	Export        bool
+}
+
+type ArchiveDataPartitionResponse struct {
+	PartitionId uint64
+	Status      uint8
+	Result      string
+	ErrCode     ErrCode `json:",omitempty"`
+}
+
+// RehydrateDataPartitionRequest asks the node to attach its archived replica of
+// the partition again, from the files kept on the node or imported from Target.
+type RehydrateDataPartitionRequest struct {
+	PartitionType string
+	PartitionId   uint64
+	VolumeId      string
+	Target        string
+	Epoch         uint64
+}
+
+type RehydrateDataPartitionResponse struct {
+	PartitionId uint64
+	Status      uint8
+	Result      string
+	ErrCode     ErrCode `json:",omitempty"`
+}
+
+// MoveDataPartitionRequest asks the node to move its replica of the partition
+// to another of its disks, to the disk with the most available space if Disk is empty.
+type MoveDataPartitionRequest struct {
+	PartitionId uint64
+	Disk        string
+}
+
+type MoveDataPartitionResponse struct {
+	PartitionId uint64
+	Disk        string //the disk the replica is on after the move
+	Status      uint8
+	Result      string
+	ErrCode     ErrCode `json:",omitempty"`
+}
+
+// DataPartitionOfflineRequest asks the raft leader of the partition to replace
+// RemovePeer by AddPeer in the raft group.
+type DataPartitionOfflineRequest struct {
+	PartitionId uint64
+	RemovePeer  Peer
+	AddPeer     Peer
+}
+
+type DataPartitionOfflineResponse struct {
+	PartitionId uint64
+	RemovePeer  Peer
+	Status      uint8
+	Result      string
+	ErrCode     ErrCode `json:",omitempty"`
+}
+
+// RepairDataPartitionRequest asks the leader of the partition to repair its
+// replicas at once instead of at the next periodic repair.
+type RepairDataPartitionRequest struct {
+	PartitionId uint64
+}
+
+type RepairDataPartitionResponse struct {
+	PartitionId uint64
+	Status      uint8
+	Result      string
+	ErrCode     ErrCode `json:",omitempty"`
+}
+
+// VerifyDataPartitionRequest asks a replica of the partition to check the crcs
+// of its extents and blob objects at once instead of at the next scrub.
+type VerifyDataPartitionRequest struct {
+	PartitionId uint64
+}
+
+type VerifyDataPartitionResponse struct {
+	PartitionId uint64
+	Quarantined []*QuarantinedRange //ranges of the replica waiting for repair after the check
+	Status      uint8
+	Result      string
+	ErrCode     ErrCode `json:",omitempty"`
+}
+
+// TierExtentsRequest asks a replica of the partition to move the extents to
+// its cold tier, for the lifecycle rules of the vol.
+type TierExtentsRequest struct {
+	PartitionId uint64
+	ExtentIds   []uint64
+}
+
+type TierExtentsResponse struct {
+	PartitionId uint64
+	Tiered      int //extents in the cold tier after the task, including the ones tiered before
+	Status      uint8
+	Result      string
+	ErrCode     ErrCode `json:",omitempty"`
+}
+
+// the steps of the encode of a sealed extent partition into an erasure coded one
+const (
+	EncodeStepPrepare = "prepare" //the shard hosts create the partition or the store of its shards
+	EncodeStepEncode  = "encode"  //the leader encodes the extents into the shards on the shard hosts
+	EncodeStepCommit  = "commit"  //the shard hosts serve the partition from the shards, the extents are dropped
+)
+
+// EncodeDataPartitionRequest asks a node the Step of the encode of the partition,
+// ShardHosts are in the order of the shard index.
+type EncodeDataPartitionRequest struct {
+	PartitionId   uint64
+	VolumeId      string
+	PartitionSize int
+	Step          string
+	ShardHosts    []string
+}
+
+type EncodeDataPartitionResponse struct {
+	PartitionId uint64
+	Step        string
+	Status      uint8
+	Result      string
+	ErrCode     ErrCode `json:",omitempty"`
+}
+
+// ECExtent is an extent of an erasure coded partition, Size is the size of the
+// data its shards are encoded from.
+type ECExtent struct {
+	ExtentId uint64
+	Inode    uint64
+	Size     int64
+	Refs     uint32 `json:",omitempty"`
+}
+
+// the actions on the expired files of a lifecycle rule
+const (
+	LifecycleDelete   = "delete"
+	LifecycleColdTier = "coldTier" //the extents of the files are moved to the cold tier of the data nodes
+)
+
+// LifecycleRule gives the Action to the files under the dir Prefix of a vol
+// not modified for Days.
+type LifecycleRule struct {
+	ID     string
+	Prefix string
+	Days   int
+	Action string
+}
+
+// LifecyclePass is a walk of a rule over its dir, End is zero while it is in
+// progress.
+type LifecyclePass struct {
+	Start   int64
+	End     int64
+	Scanned uint64 //files checked
+	Expired uint64 //files deleted or with their extents sent to tier
+	Failed  uint64
+}
+
+// LifecycleReport is the state of a rule on the meta node walking its vol.
+type LifecycleReport struct {
+	VolName string
+	Rule    LifecycleRule
+	Current *LifecyclePass `json:",omitempty"`
+	Last    *LifecyclePass `json:",omitempty"`
+}
+
+// LifecycleTierRequest asks the master to send the extents of the expired
+// files of a vol, by data partition, to the replicas of their partitions.
+type LifecycleTierRequest struct {
+	VolName string
+	Extents map[uint64][]uint64
 }
 
 type DeleteFileRequest struct {
@@ -143,10 +509,11 @@ type DeleteFileRequest struct {
 }
 
 type DeleteFileResponse struct {
-	Status uint8
-	Result string
-	VolId  uint64
-	Name   string
+	Status  uint8
+	Result  string
+	ErrCode ErrCode `json:",omitempty"`
+	VolId   uint64
+	Name    string
 }
 
 type DeleteMetaPartitionRequest struct {
@@ -157,6 +524,7 @@ type DeleteMetaPartitionResponse struct {
 	PartitionID uint64
 	Status      uint8
 	Result      string
+	ErrCode     ErrCode `json:",omitempty"`
 }
 
 type UpdateMetaPartitionRequest struct {
@@ -172,6 +540,7 @@ type UpdateMetaPartitionResponse struct {
 	End         uint64
 	Status      uint8
 	Result      string
+	ErrCode     ErrCode `json:",omitempty"`
 }
 
 type MetaPartitionOfflineRequest struct {
@@ -186,4 +555,5 @@ type MetaPartitionOfflineResponse struct {
 	VolName     string
 	Status      uint8
 	Result      string
+	ErrCode     ErrCode `json:",omitempty"`
 }
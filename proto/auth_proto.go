@@ -0,0 +1,61 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package proto
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+const (
+	TokenReadOnly  = "ro"
+	TokenReadWrite = "rw"
+)
+
+// sent in the OpAuthConn packet, a node of the cluster authenticates with an
+// empty VolName and the auth key of the cluster as Token. A client presents
+// its session, the nodes refuse the connections of the sessions fenced by the
+// master; a request with only the session authenticates nothing.
+type AuthConnRequest struct {
+	VolName string `json:"vol"`
+	Token   string `json:"token"`
+	Session string `json:"session,omitempty"`
+}
+
+// the tokens of a vol the nodes check the connections against, the vol is open
+// to the connections without token if it has none
+type VolTokensView struct {
+	Name   string
+	Tokens []*TokenDigest
+}
+
+type TokenDigest struct {
+	Digest string
+	Type   string
+}
+
+// the digest of the token kept by the nodes, they don't know the tokens themselves
+func TokenDigestOf(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func NewAuthConnPacket(volName, token, session string) (p *Packet, err error) {
+	p = NewPacket()
+	p.Opcode = OpAuthConn
+	p.ReqID = GetReqID()
+	err = p.MarshalData(&AuthConnRequest{VolName: volName, Token: token, Session: session})
+	return
+}
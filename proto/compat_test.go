@@ -0,0 +1,442 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package proto
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/tiglabs/containerfs/util/trace"
+)
+
+// The compat tests check the wire formats against the golden files of every
+// release under testdata/compat: the files of each release must still be
+// decoded to the same values, and the files of the current release must be
+// encoded byte for byte. An intentional change of the current release is
+// frozen by running the tests with -update, a new release gets its own dir by bumping compatRelease before updating,
+// the dirs of the older releases must never be rewritten.
+var update = flag.Bool("update", false, "rewrite the golden files of the current release")
+
+const (
+	compatRelease = "1.0"
+	compatDir     = "testdata/compat"
+)
+
+func compatReleases(t *testing.T) (releases []string) {
+	infos, err := ioutil.ReadDir(compatDir)
+	if err != nil {
+		t.Fatalf("read %v: %v", compatDir, err)
+	}
+	for _, info := range infos {
+		if info.IsDir() {
+			releases = append(releases, info.Name())
+		}
+	}
+	sort.Strings(releases)
+	return
+}
+
+/*write the golden file of the current release with -update, compare with it otherwise*/
+func checkGolden(t *testing.T, name string, data []byte) {
+	filename := path.Join(compatDir, compatRelease, name)
+	if *update {
+		os.MkdirAll(path.Dir(filename), 0755)
+		if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+			t.Fatalf("write %v: %v", filename, err)
+		}
+		return
+	}
+	golden, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("read %v: %v", filename, err)
+	}
+	if !bytes.Equal(golden, data) {
+		t.Fatalf("%v changed, run with -update if the format change is intended:\nhave %q\nwant %q",
+			filename, data, golden)
+	}
+}
+
+/*call fn with the golden file of every release which has it*/
+func rangeGolden(t *testing.T, name string, fn func(release string, data []byte)) {
+	for _, release := range compatReleases(t) {
+		data, err := ioutil.ReadFile(path.Join(compatDir, release, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			t.Fatalf("release %v read %v: %v", release, name, err)
+		}
+		fn(release, data)
+	}
+}
+
+// jsonSubset tests whether every field of old is kept in cur with the same
+// value, the fields added since are ignored.
+func jsonSubset(old, cur interface{}) bool {
+	switch o := old.(type) {
+	case map[string]interface{}:
+		c, ok := cur.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for k, v := range o {
+			if !jsonSubset(v, c[k]) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		c, ok := cur.([]interface{})
+		if !ok || len(c) != len(o) {
+			return false
+		}
+		for i := range o {
+			if !jsonSubset(o[i], c[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(old, cur)
+	}
+}
+
+var compatOpCodes = []struct {
+	name string
+	code uint8
+}{
+	{"OpInitResultCode", OpInitResultCode},
+	{"OpCreateFile", OpCreateFile},
+	{"OpMarkDelete", OpMarkDelete},
+	{"OpWrite", OpWrite},
+	{"OpRead", OpRead},
+	{"OpStreamRead", OpStreamRead},
+	{"OpGetWatermark", OpGetWatermark},
+	{"OpExtentStoreGetAllWaterMark", OpExtentStoreGetAllWaterMark},
+	{"OpNotifyExtentRepair", OpNotifyExtentRepair},
+	{"OpERepairRead", OpERepairRead},
+	{"OpBlobFileRepairRead", OpBlobFileRepairRead},
+	{"OpFlowInfo", OpFlowInfo},
+	{"OpSyncDelNeedle", OpSyncDelNeedle},
+	{"OpNotifyCompactBlobFile", OpNotifyCompactBlobFile},
+	{"OpGetDataPartitionMetrics", OpGetDataPartitionMetrics},
+	{"OpBlobStoreGetAllWaterMark", OpBlobStoreGetAllWaterMark},
+	{"OpNotifyBlobRepair", OpNotifyBlobRepair},
+	{"OpSyncExtent", OpSyncExtent},
+	{"OpExtentReferences", OpExtentReferences},
+	{"OpMetaCreateInode", OpMetaCreateInode},
+	{"OpMetaDeleteInode", OpMetaDeleteInode},
+	{"OpMetaCreateDentry", OpMetaCreateDentry},
+	{"OpMetaDeleteDentry", OpMetaDeleteDentry},
+	{"OpMetaOpen", OpMetaOpen},
+	{"OpMetaLookup", OpMetaLookup},
+	{"OpMetaReadDir", OpMetaReadDir},
+	{"OpMetaInodeGet", OpMetaInodeGet},
+	{"OpMetaBatchInodeGet", OpMetaBatchInodeGet},
+	{"OpMetaExtentsAdd", OpMetaExtentsAdd},
+	{"OpMetaExtentsDel", OpMetaExtentsDel},
+	{"OpMetaExtentsList", OpMetaExtentsList},
+	{"OpMetaUpdateDentry", OpMetaUpdateDentry},
+	{"OpMetaTruncate", OpMetaTruncate},
+	{"OpMetaLinkInode", OpMetaLinkInode},
+	{"OpMetaEvictInode", OpMetaEvictInode},
+	{"OpMetaSetattr", OpMetaSetattr},
+	{"OpMetaReleaseOpen", OpMetaReleaseOpen},
+	{"OpCreateMetaPartition", OpCreateMetaPartition},
+	{"OpMetaNodeHeartbeat", OpMetaNodeHeartbeat},
+	{"OpDeleteMetaPartition", OpDeleteMetaPartition},
+	{"OpUpdateMetaPartition", OpUpdateMetaPartition},
+	{"OpLoadMetaPartition", OpLoadMetaPartition},
+	{"OpOfflineMetaPartition", OpOfflineMetaPartition},
+	{"OpCreateDataPartition", OpCreateDataPartition},
+	{"OpDeleteDataPartition", OpDeleteDataPartition},
+	{"OpLoadDataPartition", OpLoadDataPartition},
+	{"OpDataNodeHeartbeat", OpDataNodeHeartbeat},
+	{"OpReplicateFile", OpReplicateFile},
+	{"OpDeleteFile", OpDeleteFile},
+	{"OpIntraGroupNetErr", OpIntraGroupNetErr},
+	{"OpArgMismatchErr", OpArgMismatchErr},
+	{"OpNotExistErr", OpNotExistErr},
+	{"OpDiskNoSpaceErr", OpDiskNoSpaceErr},
+	{"OpDiskErr", OpDiskErr},
+	{"OpErr", OpErr},
+	{"OpAgain", OpAgain},
+	{"OpExistErr", OpExistErr},
+	{"OpInodeFullErr", OpInodeFullErr},
+	{"OpTooManyOpenErr", OpTooManyOpenErr},
+	{"OpOk", OpOk},
+	{"OpPing", OpPing},
+	{"OpNegotiate", OpNegotiate},
+	{"BlobStoreMode", BlobStoreMode},
+	{"ExtentStoreMode", ExtentStoreMode},
+}
+
+func TestCompatOpCodes(t *testing.T) {
+	codes := make(map[string]uint8)
+	buff := bytes.NewBuffer(nil)
+	for _, op := range compatOpCodes {
+		codes[op.name] = op.code
+		fmt.Fprintf(buff, "%v 0x%02X\n", op.name, op.code)
+	}
+	checkGolden(t, "opcodes.golden", buff.Bytes())
+	// an op code of a release may be deprecated but never reused
+	rangeGolden(t, "opcodes.golden", func(release string, data []byte) {
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var (
+				name string
+				code uint8
+			)
+			if _, err := fmt.Sscanf(line, "%s 0x%X", &name, &code); err != nil {
+				t.Fatalf("release %v opcodes line %q: %v", release, line, err)
+			}
+			if c, ok := codes[name]; ok && c != code {
+				t.Errorf("release %v %v is 0x%02X, now 0x%02X", release, name, code, c)
+			}
+		}
+	})
+}
+
+func TestCompatErrCodes(t *testing.T) {
+	codes := ErrCodes()
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	names := make(map[string]ErrCode)
+	buff := bytes.NewBuffer(nil)
+	for _, c := range codes {
+		names[c.String()] = c
+		fmt.Fprintf(buff, "%v %d\n", c, uint16(c))
+	}
+	checkGolden(t, "errcodes.golden", buff.Bytes())
+	// an error code of a release may be deprecated but never reused
+	rangeGolden(t, "errcodes.golden", func(release string, data []byte) {
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var (
+				name string
+				code uint16
+			)
+			if _, err := fmt.Sscanf(line, "%s %d", &name, &code); err != nil {
+				t.Fatalf("release %v errcodes line %q: %v", release, line, err)
+			}
+			if c, ok := names[name]; ok && uint16(c) != code {
+				t.Errorf("release %v %v is %v, now %v", release, name, code, uint16(c))
+			}
+			if ErrCode(code).String() != name {
+				t.Errorf("release %v code %v of %v is now %v", release, code, name, ErrCode(code))
+			}
+		}
+	})
+}
+
+func compatPackets() map[string]*Packet {
+	return map[string]*Packet{
+		"packet_write.golden": {
+			Magic:       ProtoMagic,
+			StoreMode:   ExtentStoreMode,
+			Opcode:      OpWrite,
+			Nodes:       2,
+			Crc:         0x1F2E3D4C,
+			Size:        11,
+			PartitionID: 12,
+			FileID:      1024,
+			Offset:      65536,
+			ReqID:       3001,
+			Arg:         ArgWithEpoch("10.0.0.2:17310/10.0.0.3:17310/", 7),
+			Data:        []byte("hello world"),
+		},
+		"packet_mark_delete.golden": {
+			Magic:       ProtoMagic,
+			StoreMode:   ExtentStoreMode,
+			Opcode:      OpMarkDelete,
+			Nodes:       2,
+			PartitionID: 12,
+			FileID:      1025,
+			ReqID:       3002,
+			Arg:         []byte("10.0.0.2:17310/10.0.0.3:17310/"),
+		},
+		"packet_write_traced.golden": {
+			Magic:       ProtoMagicTraced,
+			StoreMode:   ExtentStoreMode,
+			Opcode:      OpWrite,
+			Nodes:       2,
+			Crc:         0x1F2E3D4C,
+			Size:        11,
+			PartitionID: 12,
+			FileID:      1024,
+			Offset:      65536,
+			ReqID:       3004,
+			Arg:         ArgWithEpoch("10.0.0.2:17310/10.0.0.3:17310/", 7),
+			Data:        []byte("hello world"),
+			Trace: trace.SpanContext{
+				TraceID: [16]byte{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36},
+				SpanID:  [8]byte{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+				Flags:   trace.FlagSampled,
+			},
+		},
+		"packet_read_reply.golden": {
+			Magic:       ProtoMagic,
+			StoreMode:   BlobStoreMode,
+			Opcode:      OpRead,
+			ResultCode:  OpOk,
+			Crc:         0x0A0B0C0D,
+			Size:        4,
+			PartitionID: 13,
+			FileID:      3,
+			Offset:      4096,
+			ReqID:       3003,
+			Data:        []byte("data"),
+		},
+	}
+}
+
+func TestCompatPackets(t *testing.T) {
+	for name, p := range compatPackets() {
+		p.Arglen = uint32(len(p.Arg))
+		c1, c2 := net.Pipe()
+		go func() {
+			p.WriteToConn(c1)
+			c1.Close()
+		}()
+		data, err := ioutil.ReadAll(c2)
+		if err != nil {
+			t.Fatalf("%v write: %v", name, err)
+		}
+		checkGolden(t, name, data)
+		rangeGolden(t, name, func(release string, data []byte) {
+			c1, c2 := net.Pipe()
+			go func() {
+				c1.Write(data)
+				c1.Close()
+			}()
+			read := new(Packet)
+			err := read.ReadFromConn(c2, ReadDeadlineTime)
+			c2.Close()
+			if err != nil {
+				t.Fatalf("release %v %v read: %v", release, name, err)
+			}
+			if len(read.Arg) == 0 {
+				read.Arg = nil
+			}
+			if len(read.Data) == 0 {
+				read.Data = nil
+			}
+			if !reflect.DeepEqual(read, p) {
+				t.Errorf("release %v %v:\nhave %+v\nwant %+v", release, name, read, p)
+			}
+		})
+	}
+}
+
+func compatMessages() map[string]func() (interface{}, interface{}) {
+	return map[string]func() (interface{}, interface{}){
+		"create_data_partition_task.golden": func() (interface{}, interface{}) {
+			fixture := &AdminTask{
+				ID:           "12_create_data_partition",
+				OpCode:       OpCreateDataPartition,
+				OperatorAddr: "10.0.0.2:17310",
+				SendTime:     1540000000,
+				CreateTime:   1540000000,
+				SendCount:    1,
+				Request: &CreateDataPartitionRequest{
+					PartitionType: ExtentPartition,
+					PartitionId:   12,
+					PartitionSize: 120 * 1024 * 1024 * 1024,
+					VolumeId:      "intest",
+					Epoch:         7,
+				},
+			}
+			return fixture, &AdminTask{Request: &CreateDataPartitionRequest{}}
+		},
+		"heartbeat_request.golden": func() (interface{}, interface{}) {
+			fixture := &HeartBeatRequest{
+				CurrTime:        1540000000,
+				MasterAddr:      "10.0.0.1:80",
+				Capabilities:    CapDeltaHeartbeat,
+				ReportEpoch:     5,
+				PartitionEpochs: map[uint64]uint64{12: 7},
+				FencedClients:   []*ClientFence{{Addr: "10.0.0.9", ExpireTime: 1540000600}},
+				Draining:        true,
+			}
+			return fixture, &HeartBeatRequest{}
+		},
+		"datanode_heartbeat_response.golden": func() (interface{}, interface{}) {
+			fixture := &DataNodeHeartBeatResponse{
+				Total:               1 << 40,
+				Used:                1 << 30,
+				Available:           1<<40 - 1<<30,
+				CreatedPartitionCnt: 1,
+				RackName:            "rack1",
+				ClientAddr:          "10.0.0.2:17310",
+				ReplicaAddr:         "10.0.0.2:17320",
+				Capabilities:        CapDeltaHeartbeat,
+				ReportEpoch:         5,
+				PartitionInfo: []*PartitionReport{{PartitionID: 12, PartitionStatus: 1, Total: 1 << 30,
+					Used: 1 << 20, DiskPath: "/data0"}},
+				Disks:  []*DiskReport{{Path: "/data0", Total: 1 << 40, Used: 1 << 30, Available: 1<<40 - 1<<30}},
+				Status: TaskSuccess,
+			}
+			return fixture, &DataNodeHeartBeatResponse{}
+		},
+		"negotiate_request.golden": func() (interface{}, interface{}) {
+			fixture := &NegotiateRequest{Version: ProtoVersion, Capabilities: ConnCapTrace | ConnCapBlockCrcs}
+			return fixture, &NegotiateRequest{}
+		},
+		"extent_references.golden": func() (interface{}, interface{}) {
+			fixture := &ExtentReferences{
+				VolName:         "intest",
+				MetaPartitionID: 1,
+				DataPartitionID: 12,
+				AgeMs:           1500,
+				Extents:         []uint64{1024, 1025},
+			}
+			return fixture, &ExtentReferences{}
+		},
+	}
+}
+
+func TestCompatMessages(t *testing.T) {
+	for name, fn := range compatMessages() {
+		fixture, _ := fn()
+		data, err := json.Marshal(fixture)
+		if err != nil {
+			t.Fatalf("%v marshal: %v", name, err)
+		}
+		checkGolden(t, name, data)
+		rangeGolden(t, name, func(release string, data []byte) {
+			_, decoded := fn()
+			if err := json.Unmarshal(data, decoded); err != nil {
+				t.Fatalf("release %v %v unmarshal: %v", release, name, err)
+			}
+			cur, err := json.Marshal(decoded)
+			if err != nil {
+				t.Fatalf("release %v %v marshal: %v", release, name, err)
+			}
+			var oldFields, curFields interface{}
+			json.Unmarshal(data, &oldFields)
+			json.Unmarshal(cur, &curFields)
+			if !jsonSubset(oldFields, curFields) {
+				t.Errorf("release %v %v lost fields:\nhave %s\nwant %s", release, name, cur, data)
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package proto
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrCategory tells a client how to handle a failed request, it is the
+// thousands of the error code so that a client knows the category of the
+// codes added after its release.
+type ErrCategory uint16
+
+const (
+	ErrCategoryNone      ErrCategory = iota
+	ErrCategoryRetryable             //the request may succeed if retried later or on another replica
+	ErrCategoryFatal                 //the request fails whatever the retries
+	ErrCategoryMisrouted             //the request reached the wrong node or a stale view, retry after refreshing the routing
+	ErrCategoryQuota                 //a limit of the vol or the node is reached, retry only once the usage dropped
+)
+
+// ErrCode is the number of an error of the catalog, it is returned in the
+// body of the failed packets and in the responses of the admin tasks. The
+// codes are stable: a code of a release may be deprecated but never reused.
+type ErrCode uint16
+
+const (
+	ErrCodeOk ErrCode = 0
+
+	ErrCodeAgain         ErrCode = 1001
+	ErrCodeIntraGroupNet ErrCode = 1002
+	ErrCodeDisk          ErrCode = 1003
+	ErrCodeThrottled     ErrCode = 1004
+	ErrCodeInternal      ErrCode = 1005
+
+	ErrCodeUnknown      ErrCode = 2001
+	ErrCodeArgMismatch  ErrCode = 2002
+	ErrCodeNotExist     ErrCode = 2003
+	ErrCodeExist        ErrCode = 2004
+	ErrCodeNotPerm      ErrCode = 2005
+	ErrCodeUnknownOp    ErrCode = 2006
+	ErrCodeClientFenced ErrCode = 2007
+	ErrCodeReadOnly     ErrCode = 2008
+	ErrCodeAccessDenied ErrCode = 2009
+	ErrCodeLockGrace    ErrCode = 2010 //a new leader takes no lock before the clients restored theirs, not retried by the clients
+	ErrCodeExtentShared ErrCode = 2011 //the extent is shared by other files and can't be changed in place
+
+	ErrCodeNotLeader         ErrCode = 3001
+	ErrCodePartitionNotExist ErrCode = 3002
+	ErrCodeStaleEpoch        ErrCode = 3003
+	ErrCodeNodeDraining      ErrCode = 3004
+	ErrCodeInodeOutOfRange   ErrCode = 3005
+
+	ErrCodeDiskNoSpace  ErrCode = 4001
+	ErrCodeInodeFull    ErrCode = 4002
+	ErrCodeTooManyOpen  ErrCode = 4003
+	ErrCodeTooManyFiles ErrCode = 4004
+	ErrCodeFileTooLarge ErrCode = 4005
+)
+
+const (
+	ErrBodyPrefix = "[E"
+	ErrBodySuffix = "] "
+)
+
+type errCodeInfo struct {
+	name       string
+	resultCode uint8 //the result code of the packets failed with the code
+}
+
+var errCatalog = map[ErrCode]errCodeInfo{
+	ErrCodeOk:                {"Ok", OpOk},
+	ErrCodeAgain:             {"Again", OpAgain},
+	ErrCodeIntraGroupNet:     {"IntraGroupNet", OpIntraGroupNetErr},
+	ErrCodeDisk:              {"Disk", OpDiskErr},
+	ErrCodeThrottled:         {"Throttled", OpAgain},
+	ErrCodeInternal:          {"Internal", OpErr},
+	ErrCodeUnknown:           {"Unknown", OpErr},
+	ErrCodeArgMismatch:       {"ArgMismatch", OpArgMismatchErr},
+	ErrCodeNotExist:          {"NotExist", OpNotExistErr},
+	ErrCodeExist:             {"Exist", OpExistErr},
+	ErrCodeNotPerm:           {"NotPerm", OpNotPermErr},
+	ErrCodeUnknownOp:         {"UnknownOp", OpArgMismatchErr},
+	ErrCodeClientFenced:      {"ClientFenced", OpErr},
+	ErrCodeReadOnly:          {"ReadOnly", OpReadOnlyErr},
+	ErrCodeAccessDenied:      {"AccessDenied", OpAccessErr},
+	ErrCodeLockGrace:         {"LockGrace", OpExistErr},
+	ErrCodeExtentShared:      {"ExtentShared", OpArgMismatchErr},
+	ErrCodeNotLeader:         {"NotLeader", OpAgain},
+	ErrCodePartitionNotExist: {"PartitionNotExist", OpNotExistErr},
+	ErrCodeStaleEpoch:        {"StaleEpoch", OpIntraGroupNetErr},
+	ErrCodeNodeDraining:      {"NodeDraining", OpIntraGroupNetErr},
+	ErrCodeInodeOutOfRange:   {"InodeOutOfRange", OpAgain},
+	ErrCodeDiskNoSpace:       {"DiskNoSpace", OpDiskNoSpaceErr},
+	ErrCodeInodeFull:         {"InodeFull", OpInodeFullErr},
+	ErrCodeTooManyOpen:       {"TooManyOpen", OpTooManyOpenErr},
+	ErrCodeTooManyFiles:      {"TooManyFiles", OpTooManyFilesErr},
+	ErrCodeFileTooLarge:      {"FileTooLarge", OpFileTooLargeErr},
+}
+
+// the codes of the packets failed without a code in the body, the replies of
+// the nodes of the older releases
+var resultErrCodes = map[uint8]ErrCode{
+	OpOk:               ErrCodeOk,
+	OpAgain:            ErrCodeAgain,
+	OpErr:              ErrCodeInternal,
+	OpIntraGroupNetErr: ErrCodeIntraGroupNet,
+	OpDiskErr:          ErrCodeDisk,
+	OpArgMismatchErr:   ErrCodeArgMismatch,
+	OpNotExistErr:      ErrCodeNotExist,
+	OpExistErr:         ErrCodeExist,
+	OpNotPermErr:       ErrCodeNotPerm,
+	OpDiskNoSpaceErr:   ErrCodeDiskNoSpace,
+	OpInodeFullErr:     ErrCodeInodeFull,
+	OpTooManyOpenErr:   ErrCodeTooManyOpen,
+	OpTooManyFilesErr:  ErrCodeTooManyFiles,
+	OpFileTooLargeErr:  ErrCodeFileTooLarge,
+	OpReadOnlyErr:      ErrCodeReadOnly,
+	OpAccessErr:        ErrCodeAccessDenied,
+}
+
+func (c ErrCategory) String() string {
+	switch c {
+	case ErrCategoryNone:
+		return "none"
+	case ErrCategoryRetryable:
+		return "retryable"
+	case ErrCategoryFatal:
+		return "fatal"
+	case ErrCategoryMisrouted:
+		return "misrouted"
+	case ErrCategoryQuota:
+		return "quota"
+	}
+	return fmt.Sprintf("ErrCategory(%d)", uint16(c))
+}
+
+func (c ErrCode) Category() ErrCategory {
+	return ErrCategory(c / 1000)
+}
+
+func (c ErrCode) String() string {
+	if info, ok := errCatalog[c]; ok {
+		return info.name
+	}
+	return fmt.Sprintf("ErrCode(%d)", uint16(c))
+}
+
+// ResultCode returns the result code of the packets failed with the code,
+// the unknown codes fail as OpErr.
+func (c ErrCode) ResultCode() uint8 {
+	if info, ok := errCatalog[c]; ok {
+		return info.resultCode
+	}
+	return OpErr
+}
+
+// ShallRetry tells whether a request failed with the code may succeed if
+// sent again, to the same replica or after refreshing the routing.
+func (c ErrCode) ShallRetry() bool {
+	return c.Category() == ErrCategoryRetryable || c.Category() == ErrCategoryMisrouted
+}
+
+// ResultErrCode returns the code of a packet failed with the result code
+// and no code in its body.
+func ResultErrCode(resultCode uint8) ErrCode {
+	if c, ok := resultErrCodes[resultCode]; ok {
+		return c
+	}
+	return ErrCodeUnknown
+}
+
+// ErrCodes returns the codes of the catalog.
+func ErrCodes() (codes []ErrCode) {
+	for c := range errCatalog {
+		codes = append(codes, c)
+	}
+	return
+}
+
+// Error is an error of the catalog, a role returns it to tell the code of
+// the error to the packet and task responses.
+type Error struct {
+	Code ErrCode
+	Msg  string
+}
+
+func NewError(code ErrCode, msg string) *Error {
+	return &Error{Code: code, Msg: msg}
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+// ErrCodeOf returns the code of an error of the catalog, errCode otherwise.
+// The annotated errors have to be unwrapped by the caller.
+func ErrCodeOf(err error, errCode ErrCode) ErrCode {
+	if e, ok := err.(*Error); ok {
+		return e.Code
+	}
+	return errCode
+}
+
+// ErrBody formats the body of a failed packet, the code goes before the
+// message so that the older clients still log the message.
+func ErrBody(code ErrCode, msg string) []byte {
+	return []byte(ErrBodyPrefix + strconv.Itoa(int(code)) + ErrBodySuffix + msg)
+}
+
+// ParseErrBody splits the code from the body of a failed packet, code is
+// ErrCodeOk if the body carries none.
+func ParseErrBody(body []byte) (code ErrCode, msg string) {
+	msg = string(body)
+	if !strings.HasPrefix(msg, ErrBodyPrefix) {
+		return
+	}
+	end := strings.Index(msg, ErrBodySuffix)
+	if end < 0 {
+		return
+	}
+	c, err := strconv.ParseUint(msg[len(ErrBodyPrefix):end], 10, 16)
+	if err != nil {
+		return
+	}
+	return ErrCode(c), msg[end+len(ErrBodySuffix):]
+}
+
+// PackErrorWithCode packs a reply failed with the code and the message.
+func (p *Packet) PackErrorWithCode(code ErrCode, msg string) {
+	p.PackErrorWithBody(code.ResultCode(), ErrBody(code, msg))
+}
+
+// PackErrorWithResult packs a reply failed with the code and the message which
+// keeps the result code it had before the codes, for the older clients.
+func (p *Packet) PackErrorWithResult(resultCode uint8, code ErrCode, msg string) {
+	p.PackErrorWithBody(resultCode, ErrBody(code, msg))
+}
+
+// GetErrCode returns the code of a failed reply, from its body or from its
+// result code if the body carries none.
+func (p *Packet) GetErrCode() ErrCode {
+	if p == nil || p.ResultCode == OpOk {
+		return ErrCodeOk
+	}
+	if p.Size > 0 && int(p.Size) <= len(p.Data) {
+		if code, _ := ParseErrBody(p.Data[:p.Size]); code != ErrCodeOk {
+			return code
+		}
+	}
+	return ResultErrCode(p.ResultCode)
+}
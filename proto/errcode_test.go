@@ -0,0 +1,72 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package proto
+
+import (
+	"testing"
+)
+
+func TestErrCode_Catalog(t *testing.T) {
+	for _, c := range ErrCodes() {
+		if c != ErrCodeOk && (c.Category() < ErrCategoryRetryable || c.Category() > ErrCategoryQuota) {
+			t.Errorf("%v(%d) has no category", c, uint16(c))
+		}
+		if c != ErrCodeOk && c.ResultCode() == OpOk {
+			t.Errorf("%v(%d) fails as OpOk", c, uint16(c))
+		}
+	}
+	if !ErrCodeNotLeader.ShallRetry() || !ErrCodeAgain.ShallRetry() {
+		t.Fatalf("retryable and misrouted codes not retried")
+	}
+	if ErrCodeClientFenced.ShallRetry() || ErrCodeReadOnly.ShallRetry() || ErrCodeAccessDenied.ShallRetry() || ErrCodeLockGrace.ShallRetry() || ErrCodeTooManyFiles.ShallRetry() {
+		t.Fatalf("fatal and quota codes retried")
+	}
+	if c := ErrCode(3999); c.Category() != ErrCategoryMisrouted || !c.ShallRetry() {
+		t.Fatalf("unknown code %v of category %v", c, c.Category())
+	}
+}
+
+func TestErrCode_Packet(t *testing.T) {
+	p := new(Packet)
+	p.PackErrorWithCode(ErrCodeStaleEpoch, "stale partition epoch")
+	if p.ResultCode != OpIntraGroupNetErr || p.GetErrCode() != ErrCodeStaleEpoch {
+		t.Fatalf("result %v code %v", p.GetResultMesg(), p.GetErrCode())
+	}
+	if code, msg := ParseErrBody(p.Data[:p.Size]); code != ErrCodeStaleEpoch || msg != "stale partition epoch" {
+		t.Fatalf("parsed code %v msg %q", code, msg)
+	}
+	if !p.ShallRetry() {
+		t.Fatalf("misrouted reply not retried")
+	}
+
+	// the replies of the older nodes have no code in the body
+	p.PackErrorWithBody(OpAgain, []byte("[E] not a code"))
+	if p.GetErrCode() != ErrCodeAgain || !p.ShallRetry() {
+		t.Fatalf("legacy reply code %v", p.GetErrCode())
+	}
+	p.PackErrorWithBody(OpNotExistErr, nil)
+	if p.GetErrCode() != ErrCodeNotExist || p.ShallRetry() {
+		t.Fatalf("legacy reply code %v", p.GetErrCode())
+	}
+	// a reply keeping its result code of before the codes still carries the code
+	p.PackErrorWithResult(OpErr, ErrCodePartitionNotExist, "unknown meta partition: 3")
+	if p.ResultCode != OpErr || p.GetErrCode() != ErrCodePartitionNotExist {
+		t.Fatalf("reply with result %v code %v", p.GetResultMesg(), p.GetErrCode())
+	}
+	p.PackOkReply()
+	if p.GetErrCode() != ErrCodeOk {
+		t.Fatalf("ok reply code %v", p.GetErrCode())
+	}
+}
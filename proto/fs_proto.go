@@ -72,11 +72,29 @@ func (d Dentry) String() string {
 	return fmt.Sprintf("Dentry{Name(%v),Inode(%v),Type(%v)}", d.Name, d.Inode, d.Type)
 }
 
+// Caller is the user a request is made for, the meta nodes of a vol with the
+// permission checks check it against the owner and the mode of the inodes. They
+// refuse the requests without a caller, but the ones of the nodes of the
+// cluster.
+type Caller struct {
+	Uid uint32 `json:"uid"`
+	Gid uint32 `json:"gid"`
+}
+
+// IsRoot returns if the caller bypasses the permission checks.
+func (c *Caller) IsRoot() bool {
+	return c.Uid == 0
+}
+
 type CreateInodeRequest struct {
-	VolName     string `json:"vol"`
-	PartitionID uint64 `json:"pid"`
-	Mode        uint32 `json:"mode"`
-	Target      []byte `json:"tgt"`
+	VolName     string  `json:"vol"`
+	PartitionID uint64  `json:"pid"`
+	Mode        uint32  `json:"mode"`
+	Target      []byte  `json:"tgt"`
+	Uid         uint32  `json:"uid,omitempty"` //the owner of the inode
+	Gid         uint32  `json:"gid,omitempty"`
+	Caller      *Caller `json:"caller,omitempty"`
+	ParentID    uint64  `json:"pino,omitempty"` //the dir the inode is created in, its group is checked for the caller
 }
 
 type CreateInodeResponse struct {
@@ -111,20 +129,24 @@ type EvictInodeRequest struct {
 }
 
 type CreateDentryRequest struct {
-	VolName     string `json:"vol"`
-	PartitionID uint64 `json:"pid"`
-	ParentID    uint64 `json:"pino"`
-	Inode       uint64 `json:"ino"`
-	Name        string `json:"name"`
-	Mode        uint32 `json:"mode"`
+	VolName     string  `json:"vol"`
+	PartitionID uint64  `json:"pid"`
+	ParentID    uint64  `json:"pino"`
+	Inode       uint64  `json:"ino"`
+	Name        string  `json:"name"`
+	Mode        uint32  `json:"mode"`
+	Caller      *Caller `json:"caller,omitempty"`
+	Path        string  `json:"path,omitempty"` //the path of the dentry the client asked for, audited by the meta nodes
 }
 
 type UpdateDentryRequest struct {
-	VolName     string `json:"vol"`
-	PartitionID uint64 `json:"pid"`
-	ParentID    uint64 `json:"pino"`
-	Name        string `json:"name"`
-	Inode       uint64 `json:"ino"` // new inode number
+	VolName     string  `json:"vol"`
+	PartitionID uint64  `json:"pid"`
+	ParentID    uint64  `json:"pino"`
+	Name        string  `json:"name"`
+	Inode       uint64  `json:"ino"` // new inode number
+	Caller      *Caller `json:"caller,omitempty"`
+	Path        string  `json:"path,omitempty"`
 }
 
 type UpdateDentryResponse struct {
@@ -132,10 +154,13 @@ type UpdateDentryResponse struct {
 }
 
 type DeleteDentryRequest struct {
-	VolName     string `json:"vol"`
-	PartitionID uint64 `json:"pid"`
-	ParentID    uint64 `json:"pino"`
-	Name        string `json:"name"`
+	VolName     string  `json:"vol"`
+	PartitionID uint64  `json:"pid"`
+	ParentID    uint64  `json:"pino"`
+	Name        string  `json:"name"`
+	Caller      *Caller `json:"caller,omitempty"`
+	Inode       uint64  `json:"ino,omitempty"` //the dentry is deleted only if it is of the inode
+	Path        string  `json:"path,omitempty"`
 }
 
 type DeleteDentryResponse struct {
@@ -143,16 +168,34 @@ type DeleteDentryResponse struct {
 }
 
 type OpenRequest struct {
+	VolName     string  `json:"vol"`
+	PartitionID uint64  `json:"pid"`
+	Inode       uint64  `json:"ino"`
+	SessionID   string  `json:"sid"`
+	Lease       bool    `json:"lease,omitempty"` //the session caches the inode until the changes are notified
+	Flag        uint32  `json:"flag,omitempty"`  //the flags of the open, its access is checked for the caller
+	Caller      *Caller `json:"caller,omitempty"`
+}
+
+type ReleaseOpenRequest struct {
 	VolName     string `json:"vol"`
 	PartitionID uint64 `json:"pid"`
 	Inode       uint64 `json:"ino"`
+	SessionID   string `json:"sid"`
 }
 
+// the max seconds of the cache lease of a lookup, a readdir or an inode get,
+// the session caches the result up to it and the changes are notified
+const MaxCacheLeaseSeconds = 600
+
 type LookupRequest struct {
-	VolName     string `json:"vol"`
-	PartitionID uint64 `json:"pid"`
-	ParentID    uint64 `json:"pino"`
-	Name        string `json:"name"`
+	VolName      string  `json:"vol"`
+	PartitionID  uint64  `json:"pid"`
+	ParentID     uint64  `json:"pino"`
+	Name         string  `json:"name"`
+	SessionID    string  `json:"sid,omitempty"`
+	LeaseSeconds int64   `json:"lsec,omitempty"` //the session caches the dentries of the parent with a lease
+	Caller       *Caller `json:"caller,omitempty"`
 }
 
 type LookupResponse struct {
@@ -161,9 +204,11 @@ type LookupResponse struct {
 }
 
 type InodeGetRequest struct {
-	VolName     string `json:"vol"`
-	PartitionID uint64 `json:"pid"`
-	Inode       uint64 `json:"ino"`
+	VolName      string `json:"vol"`
+	PartitionID  uint64 `json:"pid"`
+	Inode        uint64 `json:"ino"`
+	SessionID    string `json:"sid,omitempty"`
+	LeaseSeconds int64  `json:"lsec,omitempty"` //the session caches the inode with a lease
 }
 
 type InodeGetResponse struct {
@@ -171,23 +216,35 @@ type InodeGetResponse struct {
 }
 
 type BatchInodeGetRequest struct {
-	VolName     string   `json:"vol"`
-	PartitionID uint64   `json:"pid"`
-	Inodes      []uint64 `json:"inos"`
+	VolName      string   `json:"vol"`
+	PartitionID  uint64   `json:"pid"`
+	Inodes       []uint64 `json:"inos"`
+	SessionID    string   `json:"sid,omitempty"`
+	LeaseSeconds int64    `json:"lsec,omitempty"`
 }
 
 type BatchInodeGetResponse struct {
 	Infos []*InodeInfo `json:"infos"`
 }
 
+// the max dentries of a page of readdir, a request of no limit gets all the
+// dentries of the dir as the older releases
+const MaxReadDirLimit = 10000
+
 type ReadDirRequest struct {
-	VolName     string `json:"vol"`
-	PartitionID uint64 `json:"pid"`
-	ParentID    uint64 `json:"pino"`
+	VolName      string  `json:"vol"`
+	PartitionID  uint64  `json:"pid"`
+	ParentID     uint64  `json:"pino"`
+	Marker       string  `json:"marker,omitempty"` //the dentries after the name
+	Limit        uint64  `json:"limit,omitempty"`
+	SessionID    string  `json:"sid,omitempty"`
+	LeaseSeconds int64   `json:"lsec,omitempty"`
+	Caller       *Caller `json:"caller,omitempty"`
 }
 
 type ReadDirResponse struct {
 	Children []Dentry `json:"children"`
+	Next     string   `json:"next,omitempty"` //the marker of the next page, empty after the last page
 }
 
 type AppendExtentKeyRequest struct {
@@ -195,24 +252,51 @@ type AppendExtentKeyRequest struct {
 	PartitionID uint64    `json:"pid"`
 	Inode       uint64    `json:"ino"`
 	Extent      ExtentKey `json:"ek"`
+	SessionID   string    `json:"sid,omitempty"` //the writer, its cache of the inode is not invalidated
+	Caller      *Caller   `json:"caller,omitempty"`
 }
 
 type GetExtentsRequest struct {
-	VolName     string `json:"vol"`
-	PartitionID uint64 `json:"pid"`
-	Inode       uint64 `json:"ino"`
+	VolName     string  `json:"vol"`
+	PartitionID uint64  `json:"pid"`
+	Inode       uint64  `json:"ino"`
+	Caller      *Caller `json:"caller,omitempty"`
 }
 
 type GetExtentsResponse struct {
 	Extents []ExtentKey `json:"eks"`
 }
 
-type TruncateRequest struct {
+// ReplaceExtentKeysRequest replaces the extent keys of the inode with
+// NewExtents if they are still OldExtents. The keys replaced are not deleted,
+// they are on a data partition released or kept by another inode.
+type ReplaceExtentKeysRequest struct {
+	VolName     string      `json:"vol"`
+	PartitionID uint64      `json:"pid"`
+	Inode       uint64      `json:"ino"`
+	OldExtents  []ExtentKey `json:"oeks"`
+	NewExtents  []ExtentKey `json:"neks"`
+}
+
+type ListOrphansRequest struct {
 	VolName     string `json:"vol"`
 	PartitionID uint64 `json:"pid"`
-	Inode       uint64 `json:"ino"`
-	FileOffset  uint64 `json:"fof"` // always 0 for now
-	Size        uint64 `json:"sz"`  // always 0 for now
+}
+
+// ListOrphansResponse has the regular inodes of the partition whose last link
+// is deleted while a client still has them open.
+type ListOrphansResponse struct {
+	Inodes []uint64 `json:"inos"`
+}
+
+type TruncateRequest struct {
+	VolName     string  `json:"vol"`
+	PartitionID uint64  `json:"pid"`
+	Inode       uint64  `json:"ino"`
+	FileOffset  uint64  `json:"fof"` // always 0 for now
+	Size        uint64  `json:"sz"`  // always 0 for now
+	SessionID   string  `json:"sid,omitempty"`
+	Caller      *Caller `json:"caller,omitempty"`
 }
 
 type TruncateResponse struct {
@@ -220,13 +304,15 @@ type TruncateResponse struct {
 }
 
 type SetattrRequest struct {
-	VolName     string `json:"vol"`
-	PartitionID uint64 `json:"pid"`
-	Inode       uint64 `json:"ino"`
-	Mode        uint32 `json:"mode"`
-	Uid         uint32 `json:"uid"`
-	Gid         uint32 `json:"gid"`
-	Valid       uint32 `json:"valid"`
+	VolName     string  `json:"vol"`
+	PartitionID uint64  `json:"pid"`
+	Inode       uint64  `json:"ino"`
+	Mode        uint32  `json:"mode"`
+	Uid         uint32  `json:"uid"`
+	Gid         uint32  `json:"gid"`
+	Valid       uint32  `json:"valid"`
+	SessionID   string  `json:"sid,omitempty"`
+	Caller      *Caller `json:"caller,omitempty"`
 }
 
 const (
@@ -234,3 +320,200 @@ const (
 	AttrUid
 	AttrGid
 )
+
+// the max length of the target of a symlink, PATH_MAX of linux
+const MaxSymlinkTargetSize = 4096
+
+// the limits of the xattrs of an inode, as the limits of linux
+const (
+	MaxXAttrNameSize  = 255
+	MaxXAttrValueSize = 64 * 1024
+	MaxXAttrListSize  = 64 * 1024 //the names of the xattrs of an inode, each with a terminating null
+)
+
+// the flags of setxattr
+const (
+	XAttrCreate  uint32 = 1 << iota //fails if the xattr exists
+	XAttrReplace                    //fails if the xattr does not exist
+)
+
+type SetXAttrRequest struct {
+	VolName     string  `json:"vol"`
+	PartitionID uint64  `json:"pid"`
+	Inode       uint64  `json:"ino"`
+	Name        string  `json:"name"`
+	Value       []byte  `json:"val"`
+	Flags       uint32  `json:"flags"`
+	Caller      *Caller `json:"caller,omitempty"`
+}
+
+type GetXAttrRequest struct {
+	VolName     string  `json:"vol"`
+	PartitionID uint64  `json:"pid"`
+	Inode       uint64  `json:"ino"`
+	Name        string  `json:"name"`
+	Caller      *Caller `json:"caller,omitempty"`
+}
+
+type GetXAttrResponse struct {
+	Value []byte `json:"val"`
+}
+
+type ListXAttrRequest struct {
+	VolName     string `json:"vol"`
+	PartitionID uint64 `json:"pid"`
+	Inode       uint64 `json:"ino"`
+}
+
+type ListXAttrResponse struct {
+	Names []string `json:"names"`
+}
+
+type RemoveXAttrRequest struct {
+	VolName     string  `json:"vol"`
+	PartitionID uint64  `json:"pid"`
+	Inode       uint64  `json:"ino"`
+	Name        string  `json:"name"`
+	Caller      *Caller `json:"caller,omitempty"`
+}
+
+// the types of a FileLock
+const (
+	LockRead uint8 = iota
+	LockWrite
+	LockUnlock
+)
+
+// FileLock is an advisory lock of a file held by a lock owner of a client
+// session, from Start to End included. The flock locks and the POSIX record
+// locks of a file don't conflict with each other.
+type FileLock struct {
+	Owner uint64 `json:"owner"`
+	Pid   uint32 `json:"lpid"`
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+	Type  uint8  `json:"type"`
+	Flock bool   `json:"flock"`
+}
+
+type InodeLock struct {
+	Inode uint64   `json:"ino"`
+	Lock  FileLock `json:"lock"`
+}
+
+// SetLockRequest takes or releases, with a lock of type LockUnlock, a lock
+// of the inode. It fails with OpExistErr if the lock conflicts with a lock of
+// another owner.
+type SetLockRequest struct {
+	VolName     string   `json:"vol"`
+	PartitionID uint64   `json:"pid"`
+	Inode       uint64   `json:"ino"`
+	SessionID   string   `json:"sid"`
+	Lock        FileLock `json:"lock"`
+}
+
+type GetLockRequest struct {
+	VolName     string   `json:"vol"`
+	PartitionID uint64   `json:"pid"`
+	Inode       uint64   `json:"ino"`
+	SessionID   string   `json:"sid"`
+	Lock        FileLock `json:"lock"`
+}
+
+// GetLockResponse is the lock conflicting with the lock of the request, of
+// type LockUnlock if there is none. The Pid is 0 for a lock of another client.
+type GetLockResponse struct {
+	Lock FileLock `json:"lock"`
+}
+
+// RenewLocksRequest renews the lease of the locks of the session, the locks
+// are all the locks the session holds on the partition and replace the locks
+// kept by the leader.
+type RenewLocksRequest struct {
+	VolName     string      `json:"vol"`
+	PartitionID uint64      `json:"pid"`
+	SessionID   string      `json:"sid"`
+	Locks       []InodeLock `json:"locks"`
+}
+
+// RenewLocksResponse is the locks of the request taken by another session
+// meanwhile, after a leader change, the session does not hold them anymore.
+type RenewLocksResponse struct {
+	Lost []InodeLock `json:"lost"`
+}
+
+// RenewLeasesRequest renews the leases of the inodes the session caches the
+// pages and the attrs of, the inodes are all the inodes of the partition the
+// session caches and replace the leases kept by the leader.
+type RenewLeasesRequest struct {
+	VolName     string   `json:"vol"`
+	PartitionID uint64   `json:"pid"`
+	SessionID   string   `json:"sid"`
+	Inodes      []uint64 `json:"inos"`
+}
+
+// RenewLeasesResponse is the leased inodes changed by the other sessions
+// since the last renew. Reset is set if the leader had no lease of the
+// session, after a leader change or an expiry, the session drops the caches
+// of all its inodes of the partition then.
+type RenewLeasesResponse struct {
+	Invalidated []uint64 `json:"inos"`
+	Reset       bool     `json:"reset,omitempty"`
+}
+
+// the parts of a rename transaction
+const (
+	TxCreateDentry uint8 = iota // create the dentry, or replace the inode of the existing one
+	TxDeleteDentry              // delete the dentry of the inode
+)
+
+// the status of a rename transaction on its primary partition
+const (
+	TxStatusUnknown uint8 = iota
+	TxStatusPrepared
+	TxStatusCommitted
+	TxStatusAborted
+)
+
+// TxPrepareRequest prepares a part of a rename transaction on the partition
+// of its dentry, the dentry is changed by the commit and no other op changes
+// it until the transaction is committed or aborted. The primary partition
+// decides the transaction, a part prepared on another partition and not
+// committed in Timeout seconds asks the primary whether it was committed.
+type TxPrepareRequest struct {
+	VolName      string   `json:"vol"`
+	PartitionID  uint64   `json:"pid"`
+	TxID         string   `json:"tx"`
+	Op           uint8    `json:"op"`
+	ParentID     uint64   `json:"pino"`
+	Name         string   `json:"name"`
+	Inode        uint64   `json:"ino"`
+	Mode         uint32   `json:"mode"`
+	Primary      uint64   `json:"primary"`
+	PrimaryAddrs []string `json:"paddrs"`
+	Timeout      int64    `json:"timeout"`
+	Caller       *Caller  `json:"caller,omitempty"`
+	Path         string   `json:"path,omitempty"`
+	// the inode a TxCreateDentry replaces, 0 if the dentry does not exist,
+	// and its partition, which the meta nodes unlink it from at the commit
+	Replaced          uint64   `json:"replaced,omitempty"`
+	ReplacedPartition uint64   `json:"rpid,omitempty"`
+	ReplacedAddrs     []string `json:"raddrs,omitempty"`
+}
+
+// TxPrepareResponse is the inode replaced by a TxCreateDentry, 0 if the
+// dentry does not exist.
+type TxPrepareResponse struct {
+	OldInode uint64 `json:"oino"`
+}
+
+// TxRequest commits, aborts or gets the status of a rename transaction.
+type TxRequest struct {
+	VolName     string `json:"vol"`
+	PartitionID uint64 `json:"pid"`
+	TxID        string `json:"tx"`
+}
+
+type TxStatusResponse struct {
+	Status uint8 `json:"status"`
+}
@@ -0,0 +1,85 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package proto
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"sort"
+)
+
+const (
+	ExtentDigestSize = 20 //extent id, size and header crc, the record of EXTENT_SEAL
+)
+
+// ExtentDigest is the size and the crc of the header of an extent, the header
+// holds the crc of each block so the digest covers all the data of the extent.
+type ExtentDigest struct {
+	ExtentId uint64
+	Size     uint64
+	Crc      uint32
+}
+
+// PartitionManifest is the content of a data partition, two copies of the
+// partition hold the same data if their manifests have the same crc. The digests
+// of a sealed partition are those of its seal, the others are read when the
+// manifest is made and are stable only if the partition is not written.
+type PartitionManifest struct {
+	PartitionID uint64
+	VolName     string
+	Sealed      bool
+	Extents     []*ExtentDigest //in the order of the extent id
+	Crc         uint32          //crc of the digests, the seal crc of a sealed partition not deleted from
+}
+
+// NewPartitionManifest sorts the digests and computes the crc of the manifest.
+func NewPartitionManifest(partitionID uint64, volName string, sealed bool, extents []*ExtentDigest) (m *PartitionManifest) {
+	sort.Slice(extents, func(i, j int) bool {
+		return extents[i].ExtentId < extents[j].ExtentId
+	})
+	m = &PartitionManifest{PartitionID: partitionID, VolName: volName, Sealed: sealed, Extents: extents}
+	data := make([]byte, len(extents)*ExtentDigestSize)
+	for i, e := range extents {
+		record := data[i*ExtentDigestSize : (i+1)*ExtentDigestSize]
+		binary.BigEndian.PutUint64(record[:8], e.ExtentId)
+		binary.BigEndian.PutUint64(record[8:16], e.Size)
+		binary.BigEndian.PutUint32(record[16:], e.Crc)
+	}
+	m.Crc = crc32.ChecksumIEEE(data)
+	return
+}
+
+// Diff returns the extents of m missing or different in other, and the extents
+// of other not in m, in the order of the extent id.
+func (m *PartitionManifest) Diff(other *PartitionManifest) (extents []uint64) {
+	extents = make([]uint64, 0)
+	others := make(map[uint64]*ExtentDigest, len(other.Extents))
+	for _, e := range other.Extents {
+		others[e.ExtentId] = e
+	}
+	for _, e := range m.Extents {
+		if o, ok := others[e.ExtentId]; !ok || o.Size != e.Size || o.Crc != e.Crc {
+			extents = append(extents, e.ExtentId)
+		}
+		delete(others, e.ExtentId)
+	}
+	for id := range others {
+		extents = append(extents, id)
+	}
+	sort.Slice(extents, func(i, j int) bool {
+		return extents[i] < extents[j]
+	})
+	return
+}
@@ -0,0 +1,50 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package proto
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPartitionManifest_Diff(t *testing.T) {
+	source := NewPartitionManifest(1, "vol", true, []*ExtentDigest{
+		{ExtentId: 1025, Size: 4096, Crc: 11},
+		{ExtentId: 1024, Size: 8192, Crc: 10},
+		{ExtentId: 1026, Size: 100, Crc: 12},
+	})
+	if source.Extents[0].ExtentId != 1024 {
+		t.Fatalf("digests not sorted: %v", source.Extents[0].ExtentId)
+	}
+	copied := NewPartitionManifest(1, "vol", true, []*ExtentDigest{
+		{ExtentId: 1024, Size: 8192, Crc: 10},
+		{ExtentId: 1025, Size: 4096, Crc: 11},
+		{ExtentId: 1026, Size: 100, Crc: 12},
+	})
+	if copied.Crc != source.Crc || len(source.Diff(copied)) != 0 {
+		t.Fatalf("same copies differ: crc %v %v diff %v", source.Crc, copied.Crc, source.Diff(copied))
+	}
+	remote := NewPartitionManifest(1, "vol", true, []*ExtentDigest{
+		{ExtentId: 1024, Size: 8192, Crc: 10},
+		{ExtentId: 1025, Size: 4096, Crc: 13},
+		{ExtentId: 1027, Size: 1, Crc: 14},
+	})
+	if remote.Crc == source.Crc {
+		t.Fatalf("different copies have the same crc %v", remote.Crc)
+	}
+	if diff := source.Diff(remote); !reflect.DeepEqual(diff, []uint64{1025, 1026, 1027}) {
+		t.Fatalf("diff %v", diff)
+	}
+}
@@ -24,8 +24,10 @@ type CreateNameSpaceResponse struct {
 }
 
 type Peer struct {
-	ID   uint64 `json:"id"`
-	Addr string `json:"addr"`
+	ID            uint64 `json:"id"`
+	Addr          string `json:"addr"`
+	HeartbeatPort int    `json:"heartbeatPort,omitempty"` //raft ports of a data node, the ones of the cluster if 0
+	ReplicatePort int    `json:"replicatePort,omitempty"`
 }
 type CreateMetaPartitionRequest struct {
 	MetaId      string
@@ -41,4 +43,5 @@ type CreateMetaPartitionResponse struct {
 	PartitionID uint64
 	Status      uint8
 	Result      string
+	ErrCode     ErrCode `json:",omitempty"`
 }
@@ -0,0 +1,146 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package proto
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Versions of the packet protocol, the releases before the negotiation are
+// ProtoVersionLegacy and negotiate nothing.
+const (
+	ProtoVersionLegacy uint32 = 1
+	ProtoVersion       uint32 = 2
+)
+
+// Connection capability flags, the dialer announces what it supports in
+// NegotiateRequest and the node answers with the flags both support. A sender
+// uses the packets of a flag only with the peers which negotiated it.
+const (
+	// ConnCapTrace allows the packets with ProtoMagicTraced.
+	ConnCapTrace uint32 = 1 << iota
+	// ConnCapBlockCrcs allows OpGetBlockCrcs.
+	ConnCapBlockCrcs
+	// ConnCapPunchHole allows OpPunchHole.
+	ConnCapPunchHole
+	// ConnCapMetaTx allows the OpMetaTx ops.
+	ConnCapMetaTx
+	// ConnCapEpoch tells the epoch protected packets carry the partition
+	// epoch of the sender, an arg without one means epoch 0.
+	ConnCapEpoch
+	// ConnCapSession allows an OpAuthConn carrying only the client session.
+	ConnCapSession
+
+	ConnCapabilities = ConnCapTrace | ConnCapBlockCrcs | ConnCapPunchHole | ConnCapMetaTx | ConnCapEpoch | ConnCapSession
+)
+
+const (
+	NegotiateTimeoutSeconds = 2
+	LegacyPeerRecheck       = 10 * time.Minute //a legacy peer is negotiated again after, it may have been upgraded
+)
+
+// sent in the OpNegotiate packet, the first packet of a connection to a
+// metanode or datanode, the reply carries the NegotiateResponse
+type NegotiateRequest struct {
+	Version      uint32 `json:"ver"`
+	Capabilities uint32 `json:"caps"`
+}
+
+type NegotiateResponse struct {
+	Version      uint32 `json:"ver"`
+	Capabilities uint32 `json:"caps"`
+}
+
+// PeerProtocol is the protocol negotiated with a peer by the latest connection to it
+type PeerProtocol struct {
+	Version      uint32
+	Capabilities uint32
+	Time         time.Time
+}
+
+var peerProtocols sync.Map //remote address -> *PeerProtocol
+
+func NewNegotiatePacket() (p *Packet, err error) {
+	p = NewPacket()
+	p.Opcode = OpNegotiate
+	p.ReqID = GetReqID()
+	err = p.MarshalData(&NegotiateRequest{Version: ProtoVersion, Capabilities: ConnCapabilities})
+	return
+}
+
+// Negotiate answers the request with the lower version and the capabilities both support
+func Negotiate(req *NegotiateRequest) *NegotiateResponse {
+	resp := &NegotiateResponse{Version: ProtoVersion, Capabilities: req.Capabilities & ConnCapabilities}
+	if req.Version < resp.Version {
+		resp.Version = req.Version
+	}
+	return resp
+}
+
+// GetPeerProtocol returns the protocol negotiated with the peer at addr, false
+// if no connection to it negotiated
+func GetPeerProtocol(addr string) (pp *PeerProtocol, ok bool) {
+	value, ok := peerProtocols.Load(addr)
+	if !ok {
+		return
+	}
+	return value.(*PeerProtocol), true
+}
+
+func setPeerProtocol(addr string, version, caps uint32) {
+	peerProtocols.Store(addr, &PeerProtocol{Version: version, Capabilities: caps, Time: time.Now()})
+}
+
+// PeerSupports tells if the peer at addr negotiated the capability flags, a
+// peer not negotiated with is assumed to support them as before the negotiation
+func PeerSupports(addr string, caps uint32) bool {
+	pp, ok := GetPeerProtocol(addr)
+	return !ok || pp.Capabilities&caps == caps
+}
+
+// NegotiateConn negotiates the protocol with the peer of conn by its first
+// packet. A legacy datanode answers the unknown op with an error and closes the
+// conn, a legacy metanode does not answer at all: the peer is recorded legacy
+// and an error is returned, the conn must be closed and replaced by a new one,
+// which is not negotiated. The legacy peers are not negotiated again for
+// LegacyPeerRecheck.
+func NegotiateConn(conn net.Conn) (err error) {
+	addr := conn.RemoteAddr().String()
+	if pp, ok := GetPeerProtocol(addr); ok && pp.Version == ProtoVersionLegacy && time.Since(pp.Time) < LegacyPeerRecheck {
+		return
+	}
+	var p *Packet
+	if p, err = NewNegotiatePacket(); err != nil {
+		return
+	}
+	if err = p.WriteToConn(conn); err != nil {
+		return
+	}
+	if err = p.ReadFromConn(conn, NegotiateTimeoutSeconds); err != nil {
+		setPeerProtocol(addr, ProtoVersionLegacy, 0)
+		return fmt.Errorf("negotiate with %v: %v", addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+	resp := &NegotiateResponse{}
+	if p.ResultCode != OpOk || p.UnmarshalData(resp) != nil || resp.Version <= ProtoVersionLegacy {
+		setPeerProtocol(addr, ProtoVersionLegacy, 0)
+		return fmt.Errorf("negotiate with %v: legacy peer", addr)
+	}
+	setPeerProtocol(addr, resp.Version, resp.Capabilities&ConnCapabilities)
+	return
+}
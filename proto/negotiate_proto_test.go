@@ -0,0 +1,124 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package proto
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/tiglabs/containerfs/util/trace"
+)
+
+/*a peer answering the negotiation as a node of this release, or as a legacy datanode with an error closing the conn*/
+func startNegotiatePeer(t *testing.T, legacy bool) (ln net.Listener, traced chan bool) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	traced = make(chan bool, 1)
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		for {
+			p := NewPacket()
+			if err := p.ReadFromConn(conn, ReadDeadlineTime); err != nil {
+				return
+			}
+			if p.Opcode != OpNegotiate {
+				traced <- p.IsTraced()
+				continue
+			}
+			if legacy {
+				p.PackErrorWithCode(ErrCodeUnknownOp, "unknown Opcode")
+				p.WriteToConn(conn)
+				return
+			}
+			req := &NegotiateRequest{}
+			p.UnmarshalData(req)
+			reply, _ := json.Marshal(Negotiate(req))
+			p.PackOkWithBody(reply)
+			p.WriteToConn(conn)
+		}
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return ln, traced
+}
+
+func TestNegotiateConn(t *testing.T) {
+	for _, legacy := range []bool{false, true} {
+		ln, traced := startNegotiatePeer(t, legacy)
+		addr := ln.Addr().String()
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = NegotiateConn(conn); err != nil && !legacy {
+			t.Fatalf("negotiate: %v", err)
+		} else if legacy {
+			// the conn closed by the legacy peer is replaced, the new one is not negotiated
+			if err == nil {
+				t.Fatalf("negotiate with a legacy peer: conn kept")
+			}
+			conn.Close()
+			if conn, err = net.Dial("tcp", addr); err != nil {
+				t.Fatal(err)
+			}
+			if err = NegotiateConn(conn); err != nil {
+				t.Fatalf("negotiate again with a legacy peer: %v", err)
+			}
+		}
+		pp, ok := GetPeerProtocol(conn.RemoteAddr().String())
+		if !ok {
+			t.Fatalf("legacy(%v) peer protocol not recorded", legacy)
+		}
+		version, caps := ProtoVersion, ConnCapabilities
+		if legacy {
+			version, caps = ProtoVersionLegacy, 0
+		}
+		if pp.Version != version || pp.Capabilities != caps {
+			t.Fatalf("legacy(%v) peer protocol %+v", legacy, pp)
+		}
+		// the traces are sent only to the peers negotiating them
+		p := NewPacket()
+		p.Opcode = OpPing
+		p.SetTrace(trace.SpanContext{TraceID: [16]byte{1}, SpanID: [8]byte{1}})
+		if err = p.WriteToConn(conn); err != nil {
+			t.Fatal(err)
+		}
+		if <-traced == legacy {
+			t.Fatalf("legacy(%v) peer got a traced packet %v", legacy, !legacy)
+		}
+		conn.Close()
+		ln.Close()
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	resp := Negotiate(&NegotiateRequest{Version: ProtoVersion + 1, Capabilities: ConnCapTrace | 1<<31})
+	if resp.Version != ProtoVersion || resp.Capabilities != ConnCapTrace {
+		t.Fatalf("negotiated %+v", resp)
+	}
+	if !PeerSupports("10.0.0.1:17310", ConnCapTrace) {
+		t.Fatalf("peer not negotiated should keep the capabilities")
+	}
+}
@@ -21,16 +21,18 @@ import (
 	"fmt"
 	"github.com/tiglabs/containerfs/util"
 	"github.com/tiglabs/containerfs/util/buf"
+	"github.com/tiglabs/containerfs/util/trace"
 	"io"
 	"net"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 )
 
 var (
 	ReqIDGlobal = int64(1)
-	Buffers     = buf.NewBufferPool()
+	Buffers     = buf.Buffers
 )
 
 func GetReqID() int64 {
@@ -39,13 +41,26 @@ func GetReqID() int64 {
 
 const (
 	AddrSplit       = "/"
+	EpochSplit      = "@"
+	ArgZeroCopy     = "zerocopy" //arg of a stream read to send the full blocks with sendfile
 	ExtentPartition = "extent"
 	BlobPartition   = "blob"
+
+	// an erasure coded partition keeps a shard of each extent on every host instead
+	// of a replica, the sealed extent partitions of an erasure coded vol are encoded
+	ErasureCodePartition = "ec"
+	ECDataShards         = 4
+	ECParityShards       = 2
+
+	// the writes of a raft replicated partition are committed by a majority of
+	// its replicas, the partitions of the other modes are replicated by the chain
+	ReplicationRaft = "raft"
 )
 
 //operations
 const (
 	ProtoMagic                   uint8 = 0xFF
+	ProtoMagicTraced             uint8 = 0xFE //the header is followed by the span context of the trace
 	OpInitResultCode             uint8 = 0x00
 	OpCreateFile                 uint8 = 0x01
 	OpMarkDelete                 uint8 = 0x02
@@ -64,6 +79,16 @@ const (
 	OpGetDataPartitionMetrics  uint8 = 0x0E
 	OpBlobStoreGetAllWaterMark uint8 = 0x0F
 	OpNotifyBlobRepair         uint8 = 0x10
+	OpSyncExtent               uint8 = 0x11
+	OpExtentReferences         uint8 = 0x12
+	OpAuthConn                 uint8 = 0x13 //the first packet of a connection to a metanode or datanode requiring a token
+	OpAddExtentRef             uint8 = 0x14 //another file shares the extent, dropped by a mark delete
+	OpGetBlockCrcs             uint8 = 0x15 //the block crcs of the extent from offset, the repair fetches only the blocks differing
+	OpPunchHole                uint8 = 0x16 //zero the range of the extent from offset and release its space, the length is in the data
+	OpNegotiate                uint8 = 0x17 //the first packet of a connection to a metanode or datanode, negotiates the version and the capabilities
+	OpWriteECShard             uint8 = 0x18 //write a range of the shard of an extent to a shard host, the logical size, the inode and the refs of the extent lead the data
+	OpReadECShard              uint8 = 0x19 //read a range of the shard of an extent held by the node
+	OpGetECExtents             uint8 = 0x1A //the extents the node holds a shard of with their logical sizes
 
 	// Operations: Client -> MetaNode.
 	OpMetaCreateInode   uint8 = 0x20
@@ -83,6 +108,23 @@ const (
 	OpMetaLinkInode     uint8 = 0x2E
 	OpMetaEvictInode    uint8 = 0x2F
 	OpMetaSetattr       uint8 = 0x30
+	OpMetaReleaseOpen   uint8 = 0x31
+	OpMetaSetXAttr      uint8 = 0x32
+	OpMetaGetXAttr      uint8 = 0x33
+	OpMetaListXAttr     uint8 = 0x34
+	OpMetaRemoveXAttr   uint8 = 0x35
+	OpMetaSetLock       uint8 = 0x36
+	OpMetaGetLock       uint8 = 0x37
+	OpMetaRenewLocks    uint8 = 0x38
+	OpMetaTxPrepare     uint8 = 0x39
+	OpMetaTxCommit      uint8 = 0x3A
+	OpMetaTxAbort       uint8 = 0x3B
+	OpMetaTxStatus      uint8 = 0x3C
+	OpMetaRenewLeases   uint8 = 0x3D
+
+	// Operations: the migration of the files off the data partitions released
+	OpMetaExtentsReplace uint8 = 0x3E //replace the extent keys of an inode if unchanged, the file is rewritten in place
+	OpMetaListOrphans    uint8 = 0x3F //the regular inodes unlinked but still open
 
 	// Operations: Master -> MetaNode
 	OpCreateMetaPartition  uint8 = 0x40
@@ -93,12 +135,20 @@ const (
 	OpOfflineMetaPartition uint8 = 0x45
 
 	// Operations: Master -> DataNode
-	OpCreateDataPartition uint8 = 0x60
-	OpDeleteDataPartition uint8 = 0x61
-	OpLoadDataPartition   uint8 = 0x62
-	OpDataNodeHeartbeat   uint8 = 0x63
-	OpReplicateFile       uint8 = 0x64
-	OpDeleteFile          uint8 = 0x65
+	OpCreateDataPartition    uint8 = 0x60
+	OpDeleteDataPartition    uint8 = 0x61
+	OpLoadDataPartition      uint8 = 0x62
+	OpDataNodeHeartbeat      uint8 = 0x63
+	OpReplicateFile          uint8 = 0x64
+	OpDeleteFile             uint8 = 0x65
+	OpArchiveDataPartition   uint8 = 0x66
+	OpRehydrateDataPartition uint8 = 0x67
+	OpMoveDataPartition      uint8 = 0x68
+	OpOfflineDataPartition   uint8 = 0x69
+	OpRepairDataPartition    uint8 = 0x6A
+	OpVerifyDataPartition    uint8 = 0x6B
+	OpTierExtents            uint8 = 0x6C
+	OpEncodeDataPartition    uint8 = 0x6D
 
 	// Commons
 	OpIntraGroupNetErr uint8 = 0xF3
@@ -110,6 +160,12 @@ const (
 	OpAgain            uint8 = 0xF9
 	OpExistErr         uint8 = 0xFA
 	OpInodeFullErr     uint8 = 0xFB
+	OpTooManyOpenErr   uint8 = 0xFC
+	OpNotPermErr       uint8 = 0xF2
+	OpTooManyFilesErr  uint8 = 0xFD
+	OpFileTooLargeErr  uint8 = 0xFE
+	OpReadOnlyErr      uint8 = 0xF1
+	OpAccessErr        uint8 = 0xEF
 	OpOk               uint8 = 0xF0
 
 	// For connection diagnosis
@@ -144,6 +200,7 @@ type Packet struct {
 	Arg         []byte //if create or append ops, data contains addrs
 	Data        []byte
 	StartT      int64
+	Trace       trace.SpanContext
 }
 
 func NewPacket() *Packet {
@@ -228,6 +285,36 @@ func (p *Packet) GetOpMsg() (m string) {
 		m = "OpMetaEvictInode"
 	case OpMetaSetattr:
 		m = "OpMetaSetattr"
+	case OpMetaReleaseOpen:
+		m = "OpMetaReleaseOpen"
+	case OpMetaSetXAttr:
+		m = "OpMetaSetXAttr"
+	case OpMetaGetXAttr:
+		m = "OpMetaGetXAttr"
+	case OpMetaListXAttr:
+		m = "OpMetaListXAttr"
+	case OpMetaRemoveXAttr:
+		m = "OpMetaRemoveXAttr"
+	case OpMetaSetLock:
+		m = "OpMetaSetLock"
+	case OpMetaGetLock:
+		m = "OpMetaGetLock"
+	case OpMetaRenewLocks:
+		m = "OpMetaRenewLocks"
+	case OpMetaTxPrepare:
+		m = "OpMetaTxPrepare"
+	case OpMetaTxCommit:
+		m = "OpMetaTxCommit"
+	case OpMetaTxAbort:
+		m = "OpMetaTxAbort"
+	case OpMetaTxStatus:
+		m = "OpMetaTxStatus"
+	case OpMetaRenewLeases:
+		m = "OpMetaRenewLeases"
+	case OpMetaExtentsReplace:
+		m = "OpMetaExtentsReplace"
+	case OpMetaListOrphans:
+		m = "OpMetaListOrphans"
 	case OpCreateMetaPartition:
 		m = "OpCreateMetaPartition"
 	case OpMetaNodeHeartbeat:
@@ -252,6 +339,22 @@ func (p *Packet) GetOpMsg() (m string) {
 		m = "OpReplicateFile"
 	case OpDeleteFile:
 		m = "OpDeleteFile"
+	case OpArchiveDataPartition:
+		m = "OpArchiveDataPartition"
+	case OpRehydrateDataPartition:
+		m = "OpRehydrateDataPartition"
+	case OpMoveDataPartition:
+		m = "OpMoveDataPartition"
+	case OpOfflineDataPartition:
+		m = "OpOfflineDataPartition"
+	case OpRepairDataPartition:
+		m = "OpRepairDataPartition"
+	case OpVerifyDataPartition:
+		m = "OpVerifyDataPartition"
+	case OpTierExtents:
+		m = "OpTierExtents"
+	case OpEncodeDataPartition:
+		m = "OpEncodeDataPartition"
 	case OpPing:
 		m = "OpPing"
 	case OpGetDataPartitionMetrics:
@@ -260,6 +363,26 @@ func (p *Packet) GetOpMsg() (m string) {
 		m = "OpBlobStoreGetAllWaterMark"
 	case OpNotifyBlobRepair:
 		m = "OpNotifyBlobRepair"
+	case OpSyncExtent:
+		m = "SyncExtent"
+	case OpExtentReferences:
+		m = "ExtentReferences"
+	case OpAuthConn:
+		m = "AuthConn"
+	case OpAddExtentRef:
+		m = "AddExtentRef"
+	case OpGetBlockCrcs:
+		m = "GetBlockCrcs"
+	case OpPunchHole:
+		m = "PunchHole"
+	case OpNegotiate:
+		m = "Negotiate"
+	case OpWriteECShard:
+		m = "WriteECShard"
+	case OpReadECShard:
+		m = "ReadECShard"
+	case OpGetECExtents:
+		m = "GetECExtents"
 
 	}
 	return
@@ -289,10 +412,22 @@ func (p *Packet) GetResultMesg() (m string) {
 		m = "ExistErr"
 	case OpInodeFullErr:
 		m = "InodeFullErr"
+	case OpTooManyOpenErr:
+		m = "TooManyOpenErr"
 	case OpArgMismatchErr:
 		m = "ArgUnmatchErr"
 	case OpNotExistErr:
 		m = "NotExistErr"
+	case OpNotPermErr:
+		m = "NotPermErr"
+	case OpTooManyFilesErr:
+		m = "TooManyFilesErr"
+	case OpFileTooLargeErr:
+		m = "FileTooLargeErr"
+	case OpReadOnlyErr:
+		m = "ReadOnlyErr"
+	case OpAccessErr:
+		m = "AccessErr"
 	default:
 		return fmt.Sprintf("Unknown ResultCode(%v)", p.ResultCode)
 	}
@@ -306,6 +441,36 @@ func (p *Packet) GetData() string {
 	return string(p.Data)
 }
 
+// SetTrace sends the packet with the span context of a trace, an invalid span
+// context leaves the packet untraced.
+func (p *Packet) SetTrace(sc trace.SpanContext) {
+	if !sc.IsValid() {
+		return
+	}
+	p.Trace = sc
+	p.Magic = ProtoMagicTraced
+}
+
+func (p *Packet) IsTraced() bool {
+	return p.Magic == ProtoMagicTraced
+}
+
+/*a traced packet is sent untraced to a peer which did not negotiate the traces*/
+func (p *Packet) untraceFor(c net.Conn) {
+	if p.IsTraced() && !PeerSupports(c.RemoteAddr().String(), ConnCapTrace) {
+		p.Magic = ProtoMagic
+	}
+}
+
+/*the bytes of the header, with the span context of a traced packet*/
+func (p *Packet) HeaderSize() int {
+	if p.IsTraced() {
+		return util.PacketHeaderSize + trace.SpanContextSize
+	}
+	return util.PacketHeaderSize
+}
+
+/*out must hold HeaderSize bytes*/
 func (p *Packet) MarshalHeader(out []byte) {
 	out[0] = p.Magic
 	out[1] = p.StoreMode
@@ -319,12 +484,15 @@ func (p *Packet) MarshalHeader(out []byte) {
 	binary.BigEndian.PutUint64(out[21:29], p.FileID)
 	binary.BigEndian.PutUint64(out[29:37], uint64(p.Offset))
 	binary.BigEndian.PutUint64(out[37:util.PacketHeaderSize], uint64(p.ReqID))
+	if p.IsTraced() {
+		p.Trace.Marshal(out[util.PacketHeaderSize:])
+	}
 	return
 }
 
 func (p *Packet) UnmarshalHeader(in []byte) error {
 	p.Magic = in[0]
-	if p.Magic != ProtoMagic {
+	if p.Magic != ProtoMagic && p.Magic != ProtoMagicTraced {
 		return errors.New("Bad Magic " + strconv.Itoa(int(p.Magic)))
 	}
 
@@ -343,6 +511,20 @@ func (p *Packet) UnmarshalHeader(in []byte) error {
 	return nil
 }
 
+// ReadTraceFromConn reads the span context following the header of a traced
+// packet, it reads nothing for the other packets.
+func (p *Packet) ReadTraceFromConn(c io.Reader) (err error) {
+	if !p.IsTraced() {
+		return
+	}
+	var in [trace.SpanContextSize]byte
+	if _, err = io.ReadFull(c, in[:]); err != nil {
+		return
+	}
+	p.Trace = trace.UnmarshalSpanContext(in[:])
+	return
+}
+
 func (p *Packet) MarshalData(v interface{}) error {
 	data, err := json.Marshal(v)
 	if err == nil {
@@ -357,9 +539,10 @@ func (p *Packet) UnmarshalData(v interface{}) error {
 }
 
 func (p *Packet) WriteToNoDeadLineConn(c net.Conn) (err error) {
-	header, err := Buffers.Get(util.PacketHeaderSize)
+	p.untraceFor(c)
+	header, err := Buffers.Get(p.HeaderSize())
 	if err != nil {
-		header = make([]byte, util.PacketHeaderSize)
+		header = make([]byte, p.HeaderSize())
 	}
 	defer Buffers.Put(header)
 
@@ -377,9 +560,10 @@ func (p *Packet) WriteToNoDeadLineConn(c net.Conn) (err error) {
 
 func (p *Packet) WriteToConn(c net.Conn) (err error) {
 	c.SetWriteDeadline(time.Now().Add(WriteDeadlineTime * time.Second))
-	header, err := Buffers.Get(util.PacketHeaderSize)
+	p.untraceFor(c)
+	header, err := Buffers.Get(p.HeaderSize())
 	if err != nil {
-		header = make([]byte, util.PacketHeaderSize)
+		header = make([]byte, p.HeaderSize())
 	}
 	defer Buffers.Put(header)
 
@@ -396,9 +580,10 @@ func (p *Packet) WriteToConn(c net.Conn) (err error) {
 }
 
 func (p *Packet) WriteHeaderToConn(c net.Conn) (err error) {
-	header, err := Buffers.Get(util.PacketHeaderSize)
+	p.untraceFor(c)
+	header, err := Buffers.Get(p.HeaderSize())
 	if err != nil {
-		header = make([]byte, util.PacketHeaderSize)
+		header = make([]byte, p.HeaderSize())
 	}
 	defer Buffers.Put(header)
 	p.MarshalHeader(header)
@@ -428,6 +613,9 @@ func (p *Packet) ReadFromConn(c net.Conn, timeoutSec int) (err error) {
 	if err = p.UnmarshalHeader(header); err != nil {
 		return
 	}
+	if err = p.ReadTraceFromConn(c); err != nil {
+		return
+	}
 
 	if p.Arglen > 0 {
 		if err = ReadFull(c, &p.Arg, int(p.Arglen)); err != nil {
@@ -511,7 +699,27 @@ func (p *Packet) ActionMsg(action, remote string, start int64, err error) (m str
 }
 
 func (p *Packet) ShallRetry() bool {
-	return p.ResultCode == OpAgain || p.ResultCode == OpErr
+	return p.GetErrCode().ShallRetry()
+}
+
+// ArgWithEpoch append the partition membership epoch to the addresses arg
+// of a packet, the datanode rejects the packet if the epoch is stale.
+func ArgWithEpoch(addrs string, epoch uint64) []byte {
+	if epoch == 0 {
+		return []byte(addrs)
+	}
+	return []byte(addrs + EpochSplit + strconv.FormatUint(epoch, 10))
+}
+
+// SplitEpochArg split the partition membership epoch from the arg of a
+// packet, epoch is 0 if the arg carries none.
+func SplitEpochArg(arg string) (addrs string, epoch uint64) {
+	index := strings.LastIndex(arg, EpochSplit)
+	if index < 0 {
+		return arg, 0
+	}
+	epoch, _ = strconv.ParseUint(arg[index+1:], 10, 64)
+	return arg[:index], epoch
 }
 
 func NewPingPacket() *Packet {
@@ -21,6 +21,7 @@ import (
 	"github.com/tiglabs/raft/proto"
 	"github.com/tiglabs/raft/storage/wal"
 	raftlog "github.com/tiglabs/raft/util/log"
+	"net"
 	"os"
 	"path"
 	"strconv"
@@ -106,8 +107,8 @@ func NewRaftStore(cfg *Config) (mr RaftStore, err error) {
 	if cfg.RetainLogs == 0 {
 		cfg.RetainLogs = DefaultRetainLogs
 	}
-	rc.HeartbeatAddr = fmt.Sprintf("%s:%d", cfg.IpAddr, cfg.HeartbeatPort)
-	rc.ReplicateAddr = fmt.Sprintf("%s:%d", cfg.IpAddr, cfg.ReplicatePort)
+	rc.HeartbeatAddr = net.JoinHostPort(cfg.IpAddr, strconv.Itoa(cfg.HeartbeatPort))
+	rc.ReplicateAddr = net.JoinHostPort(cfg.IpAddr, strconv.Itoa(cfg.ReplicatePort))
 	rc.Resolver = resolver
 	rc.RetainLogs = cfg.RetainLogs
 	rc.TickInterval = 300 * time.Millisecond
@@ -0,0 +1,71 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package raftstore
+
+import (
+	"sync"
+	"time"
+)
+
+// ReadLease is granted by the leader to a follower, the follower serves the
+// read only queries until the lease expires once it applied up to Index.
+type ReadLease struct {
+	Term    uint64
+	Index   uint64
+	Seconds int64
+}
+
+// GrantReadLease returns the lease of the term of the leader, the writes it
+// acknowledged are applied up to its applied index.
+func GrantReadLease(p Partition, seconds int64) *ReadLease {
+	_, term := p.LeaderTerm()
+	return &ReadLease{Term: term, Index: p.AppliedIndex(), Seconds: seconds}
+}
+
+// ReadLeaseHolder is the lease held by a follower, the expire time is in unix
+// nanoseconds of the clock of the follower counted from the request of the
+// lease, so the clocks of the replicas need not agree. The queries it serves
+// are at most a lease behind the leader.
+type ReadLeaseHolder struct {
+	term       uint64
+	index      uint64
+	expireTime int64
+	sync.RWMutex
+}
+
+// Set holds the lease requested at start.
+func (h *ReadLeaseHolder) Set(lease *ReadLease, start int64) {
+	h.Lock()
+	defer h.Unlock()
+	h.term = lease.Term
+	h.index = lease.Index
+	h.expireTime = start + lease.Seconds*int64(time.Second)
+}
+
+// Reset drops the lease, as the leader changed.
+func (h *ReadLeaseHolder) Reset() {
+	h.Lock()
+	defer h.Unlock()
+	h.expireTime = 0
+}
+
+// Valid returns true if the lease is of the current term, not expired and the
+// partition applied up to the index of the grant.
+func (h *ReadLeaseHolder) Valid(p Partition) bool {
+	h.RLock()
+	defer h.RUnlock()
+	_, term := p.LeaderTerm()
+	return h.term == term && time.Now().UnixNano() < h.expireTime && p.AppliedIndex() >= h.index
+}
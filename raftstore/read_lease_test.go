@@ -0,0 +1,73 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package raftstore
+
+import (
+	"testing"
+	"time"
+)
+
+// a partition of the given term applied up to the given index
+type leaseTestPartition struct {
+	Partition
+	term    uint64
+	applied uint64
+}
+
+func (p *leaseTestPartition) LeaderTerm() (uint64, uint64) {
+	return 1, p.term
+}
+
+func (p *leaseTestPartition) AppliedIndex() uint64 {
+	return p.applied
+}
+
+func TestReadLease(t *testing.T) {
+	leader := &leaseTestPartition{term: 3, applied: 100}
+	lease := GrantReadLease(leader, 10)
+	if lease.Term != 3 || lease.Index != 100 || lease.Seconds != 10 {
+		t.Fatalf("lease %+v", lease)
+	}
+
+	follower := &leaseTestPartition{term: 3, applied: 99}
+	h := new(ReadLeaseHolder)
+	if h.Valid(follower) {
+		t.Fatalf("valid before a grant")
+	}
+	h.Set(lease, time.Now().UnixNano())
+	// the follower serves the reads once it applied the writes acknowledged at the grant
+	if h.Valid(follower) {
+		t.Fatalf("valid behind the index of the grant")
+	}
+	follower.applied = 100
+	if !h.Valid(follower) {
+		t.Fatalf("not valid at the index of the grant")
+	}
+	// a new term, its leader may have acknowledged writes not applied yet
+	follower.term = 4
+	if h.Valid(follower) {
+		t.Fatalf("valid in another term")
+	}
+	follower.term = 3
+	h.Reset()
+	if h.Valid(follower) {
+		t.Fatalf("valid once reset")
+	}
+	// counted from the request of the lease by the clock of the follower
+	h.Set(lease, time.Now().Add(-10*time.Second).UnixNano())
+	if h.Valid(follower) {
+		t.Fatalf("valid once expired")
+	}
+}
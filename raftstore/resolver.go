@@ -15,10 +15,11 @@
 package raftstore
 
 import (
-	"fmt"
 	"github.com/juju/errors"
 	"github.com/tiglabs/containerfs/util/log"
 	"github.com/tiglabs/raft"
+	"net"
+	"strconv"
 	"strings"
 	"sync"
 )
@@ -99,8 +100,8 @@ func (r *nodeResolver) AddNodeWithPort(nodeId uint64, addr string, heartbeat int
 	}
 	if len(strings.TrimSpace(addr)) != 0 {
 		r.nodeMap.Store(nodeId, &nodeAddress{
-			Heartbeat: fmt.Sprintf("%s:%d", addr, heartbeat),
-			Replicate: fmt.Sprintf("%s:%d", addr, replicate),
+			Heartbeat: net.JoinHostPort(addr, strconv.Itoa(heartbeat)),
+			Replicate: net.JoinHostPort(addr, strconv.Itoa(replicate)),
 		})
 	}
 }
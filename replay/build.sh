@@ -0,0 +1,3 @@
+#!/usr/bin/env bash
+export GOPATH=/home/guowl/cbfs
+go build -o cfs-replay
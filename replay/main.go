@@ -0,0 +1,102 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+//
+// Usage: ./cfs-replay -master 10.196.31.173:80,10.196.31.141:80 -vol test -i audit.log -speed 2
+//
+// Replays the ops of the audit or slow log of a client, recorded with auditLog
+// of its config, against the vol of a test cluster through the sdk, so a
+// regression seen in production can be reproduced in staging.
+//
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/tiglabs/containerfs/sdk/meta"
+	"github.com/tiglabs/containerfs/util/auth"
+	"github.com/tiglabs/containerfs/util/log"
+	"github.com/tiglabs/containerfs/util/pool"
+)
+
+const (
+	LoggerDir    = "replay"
+	LoggerPrefix = "replay"
+)
+
+var (
+	masterAddr = flag.String("master", "", "addresses of master server of the test cluster, separated by comma")
+	volName    = flag.String("vol", "", "vol the ops are replayed on")
+	token      = flag.String("token", "", "access token of the vol, required if it has tokens")
+	input      = flag.String("i", "", "audit or slow log to replay")
+	dir        = flag.String("dir", "replay", "dir under the root of the vol the ops are replayed in")
+	speed      = flag.Float64("speed", 1, "speed relative to the capture, 0 replays as fast as possible")
+	workers    = flag.Int("workers", 16, "ops replayed in parallel, the ops of an inode are replayed in order")
+	logDir     = flag.String("logdir", "/var/log/containerfs", "path for log file storage")
+	logLevel   = flag.String("loglvl", "warn", "level of logging")
+)
+
+func main() {
+	flag.Parse()
+	if *masterAddr == "" || *volName == "" || *input == "" {
+		fmt.Println("master, vol and i are required")
+		os.Exit(1)
+	}
+	if *speed < 0 || *workers <= 0 {
+		fmt.Println("speed must not be negative and workers must be positive")
+		os.Exit(1)
+	}
+	if _, err := log.InitLog(path.Join(*logDir, LoggerDir), LoggerPrefix, parseLogLevel(*logLevel)); err != nil {
+		fmt.Println("init log failed: ", err)
+		os.Exit(1)
+	}
+	defer log.LogFlush()
+	session := meta.NewSessionID()
+	pool.SetDialHook(auth.ConnectHook(*volName, *token, session))
+	f, err := os.Open(*input)
+	if err != nil {
+		fmt.Println("open input failed: ", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	r, err := newReplayer(*volName, *masterAddr, session, *dir)
+	if err != nil {
+		fmt.Println("init replay failed: ", err)
+		os.Exit(1)
+	}
+	if err = r.replay(f, *speed, *workers); err != nil {
+		fmt.Println("replay failed: ", err)
+	}
+	r.close()
+	r.report(os.Stdout)
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+func parseLogLevel(level string) log.Level {
+	switch level {
+	case "debug":
+		return log.DebugLevel
+	case "info":
+		return log.InfoLevel
+	case "error":
+		return log.ErrorLevel
+	}
+	return log.WarnLevel
+}
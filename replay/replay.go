@@ -0,0 +1,406 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/sdk/data/stream"
+	"github.com/tiglabs/containerfs/sdk/meta"
+	"github.com/tiglabs/containerfs/util/audit"
+	"github.com/tiglabs/containerfs/util/log"
+	"github.com/tiglabs/containerfs/util/pool"
+)
+
+const (
+	DefaultFileMode = 0644
+	DefaultDirMode  = os.ModeDir | 0755
+	FillBlockSize   = 1024 * 1024
+)
+
+var zeros = make([]byte, FillBlockSize)
+
+type opStats struct {
+	count    uint64
+	errors   uint64
+	latency  time.Duration //sum of the replayed
+	captured time.Duration //sum of the captured
+	max      time.Duration
+}
+
+// replayer maps the inodes of the captured cluster to the ones of the vol, an
+// inode seen first by an op other than its create or lookup is a placeholder
+// named by its captured inode in the replay dir, a file placeholder is filled
+// with zeros up to the end of a read.
+type replayer struct {
+	mw       *meta.MetaWrapper
+	ec       *stream.ExtentClient
+	root     uint64
+	inodes   map[uint64]uint64
+	readers  map[uint64]*stream.StreamReader
+	writable map[uint64]bool
+	stats    map[string]*opStats
+	maxLag   time.Duration
+	sync.Mutex
+}
+
+func newReplayer(volName, masterAddr, session, dir string) (r *replayer, err error) {
+	r = &replayer{
+		inodes:   make(map[uint64]uint64),
+		readers:  make(map[uint64]*stream.StreamReader),
+		writable: make(map[uint64]bool),
+		stats:    make(map[string]*opStats),
+	}
+	if r.mw, err = meta.NewMetaWrapperWithConns(volName, masterAddr, session, pool.NewConnPool()); err != nil {
+		return
+	}
+	r.mw.SetCaller(0, 0)
+	if r.ec, err = stream.NewExtentClient(volName, masterAddr, r.mw.AppendExtentKey, r.mw.GetExtents); err != nil {
+		return
+	}
+	if r.root, err = r.lookupOrCreate(proto.RootIno, dir, DefaultDirMode); err != nil {
+		return
+	}
+	r.inodes[proto.RootIno] = r.root
+	return
+}
+
+func (r *replayer) lookupOrCreate(parent uint64, name string, mode os.FileMode) (ino uint64, err error) {
+	info, err := r.mw.Create_ll(parent, name, proto.Mode(mode), nil)
+	if err == syscall.EEXIST {
+		// left by a previous replay
+		ino, _, err = r.mw.Lookup_ll(parent, name)
+		return
+	}
+	if err != nil {
+		return
+	}
+	return info.Inode, nil
+}
+
+/*the inode of the vol for the captured one, a placeholder is created if it is not mapped*/
+func (r *replayer) resolve(captured uint64, dir bool) (ino uint64, err error) {
+	r.Lock()
+	ino, ok := r.inodes[captured]
+	r.Unlock()
+	if ok {
+		return
+	}
+	mode := os.FileMode(DefaultFileMode)
+	if dir {
+		mode = DefaultDirMode
+	}
+	if ino, err = r.lookupOrCreate(r.root, "ino_"+strconv.FormatUint(captured, 10), mode); err != nil {
+		return
+	}
+	r.mapInode(captured, ino)
+	return
+}
+
+func (r *replayer) mapInode(captured, ino uint64) {
+	if captured == 0 {
+		return
+	}
+	r.Lock()
+	r.inodes[captured] = ino
+	r.Unlock()
+}
+
+/*open the file for write once, it is closed at the end of the replay*/
+func (r *replayer) openForWrite(ino uint64) (err error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.writable[ino] {
+		return
+	}
+	info, err := r.mw.InodeGet_ll(ino)
+	if err != nil {
+		return
+	}
+	r.ec.OpenForWrite(ino, info.Size)
+	r.writable[ino] = true
+	return
+}
+
+func (r *replayer) getReader(ino uint64) (reader *stream.StreamReader, err error) {
+	r.Lock()
+	defer r.Unlock()
+	if reader = r.readers[ino]; reader != nil {
+		return
+	}
+	if reader, err = r.ec.OpenForRead(ino); err != nil {
+		return
+	}
+	r.readers[ino] = reader
+	return
+}
+
+/*write zeros up to end so that the read of a placeholder gets data, not timed*/
+func (r *replayer) fill(ino uint64, end uint64) (err error) {
+	if err = r.openForWrite(ino); err != nil {
+		return
+	}
+	for size := r.ec.GetWriteSize(ino); size < end; size = r.ec.GetWriteSize(ino) {
+		n := end - size
+		if n > FillBlockSize {
+			n = FillBlockSize
+		}
+		if _, err = r.ec.Write(ino, int(size), zeros[:n]); err != nil {
+			return
+		}
+	}
+	return r.ec.Flush(ino)
+}
+
+// replay runs the entries at their captured pace divided by speed, at most
+// workers at a time. An entry starts once the entries before it naming one of
+// its inodes are done, so a write of a file follows its create in another dir
+// and the ops of an inode keep their order.
+func (r *replayer) replay(in io.Reader, speed float64, workers int) (err error) {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		last = make(map[uint64]chan struct{}) //the done of the last entry naming the inode
+		sem  = make(chan struct{}, workers)
+	)
+	reader := audit.NewReader(in)
+	var base int64
+	start := time.Now()
+	for {
+		e, readErr := reader.Next()
+		if readErr != nil {
+			if readErr != io.EOF {
+				err = readErr
+			}
+			break
+		}
+		if base == 0 {
+			base = e.Time
+		}
+		if speed > 0 {
+			due := start.Add(time.Duration(float64(e.Time-base) / speed))
+			if wait := time.Until(due); wait > 0 {
+				time.Sleep(wait)
+			} else if -wait > r.maxLag {
+				r.maxLag = -wait
+			}
+		}
+		inodes := entryInodes(e)
+		deps := make([]chan struct{}, 0, len(inodes))
+		done := make(chan struct{})
+		mu.Lock()
+		for _, ino := range inodes {
+			if dep, ok := last[ino]; ok {
+				deps = append(deps, dep)
+			}
+			last[ino] = done
+		}
+		mu.Unlock()
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(e *audit.Entry, deps []chan struct{}, done chan struct{}) {
+			defer wg.Done()
+			for _, dep := range deps {
+				<-dep
+			}
+			r.run(e)
+			close(done)
+			<-sem
+			mu.Lock()
+			for _, ino := range entryInodes(e) {
+				if last[ino] == done {
+					delete(last, ino)
+				}
+			}
+			mu.Unlock()
+		}(e, deps, done)
+	}
+	wg.Wait()
+	return
+}
+
+/*the captured inodes an entry depends on or creates*/
+func entryInodes(e *audit.Entry) []uint64 {
+	if e.NewIno == 0 || e.NewIno == e.Ino {
+		return []uint64{e.Ino}
+	}
+	return []uint64{e.Ino, e.NewIno}
+}
+
+func (r *replayer) run(e *audit.Entry) {
+	var (
+		ino    uint64
+		dst    uint64
+		info   *proto.InodeInfo
+		reader *stream.StreamReader
+		err    error
+	)
+	start := time.Now()
+	switch e.Op {
+	case audit.OpLookup:
+		if ino, err = r.resolve(e.Ino, true); err == nil {
+			start = time.Now()
+			if dst, _, err = r.mw.Lookup_ll(ino, e.Name); err == nil {
+				r.mapInode(e.NewIno, dst)
+			}
+		}
+	case audit.OpReadDir:
+		if ino, err = r.resolve(e.Ino, true); err == nil {
+			start = time.Now()
+			_, err = r.mw.ReadDir_ll(ino)
+		}
+	case audit.OpCreate, audit.OpMkdir:
+		mode := os.FileMode(DefaultFileMode)
+		if e.Op == audit.OpMkdir {
+			mode = DefaultDirMode
+		}
+		if ino, err = r.resolve(e.Ino, true); err == nil {
+			start = time.Now()
+			if dst, err = r.lookupOrCreate(ino, e.Name, mode); err == nil {
+				r.mapInode(e.NewIno, dst)
+			}
+		}
+	case audit.OpRemove:
+		if ino, err = r.resolve(e.Ino, true); err == nil {
+			start = time.Now()
+			if info, err = r.mw.Delete_ll(ino, e.Name); err == nil && info != nil && info.Nlink == 0 {
+				r.mw.Evict(info.Inode)
+			}
+		}
+	case audit.OpRename:
+		if ino, err = r.resolve(e.Ino, true); err == nil {
+			if dst, err = r.resolve(e.NewIno, true); err == nil {
+				start = time.Now()
+				err = r.mw.Rename_ll(ino, e.Name, dst, e.NewName)
+			}
+		}
+	case audit.OpLink:
+		if ino, err = r.resolve(e.Ino, true); err == nil {
+			if dst, err = r.resolve(e.NewIno, false); err == nil {
+				start = time.Now()
+				_, err = r.mw.Link(ino, e.Name, dst)
+			}
+		}
+	case audit.OpOpen:
+		if ino, err = r.resolve(e.Ino, false); err == nil {
+			start = time.Now()
+			if err = r.mw.Open_ll(ino); err == nil {
+				r.mw.Release_ll(ino)
+			}
+		}
+	case audit.OpRead:
+		if ino, err = r.resolve(e.Ino, false); err == nil {
+			if err = r.fill(ino, uint64(e.Offset)+uint64(e.Size)); err == nil {
+				if reader, err = r.getReader(ino); err == nil {
+					data := make([]byte, e.Size)
+					start = time.Now()
+					if _, err = r.ec.Read(reader, ino, data, int(e.Offset), e.Size); err == io.EOF {
+						err = nil
+					}
+				}
+			}
+		}
+	case audit.OpWrite:
+		if ino, err = r.resolve(e.Ino, false); err == nil {
+			if err = r.openForWrite(ino); err == nil {
+				data := zeros
+				if e.Size > len(zeros) {
+					data = make([]byte, e.Size)
+				}
+				start = time.Now()
+				_, err = r.ec.Write(ino, int(e.Offset), data[:e.Size])
+			}
+		}
+	case audit.OpFsync:
+		if ino, err = r.resolve(e.Ino, false); err == nil {
+			if err = r.openForWrite(ino); err == nil {
+				start = time.Now()
+				err = r.ec.Sync(ino)
+			}
+		}
+	case audit.OpTruncate:
+		if ino, err = r.resolve(e.Ino, false); err == nil {
+			start = time.Now()
+			if err = r.ec.Flush(ino); err == nil {
+				if err = r.mw.Truncate(ino); err == nil {
+					r.ec.SetWriteSize(ino, 0)
+				}
+			}
+		}
+	default:
+		err = fmt.Errorf("unknown op")
+	}
+	elapsed := time.Since(start)
+	if err != nil {
+		log.LogWarnf("action[run] op(%v) ino(%v) name(%v) err(%v)", e.Op, e.Ino, e.Name, err)
+	}
+	r.record(e, elapsed, err)
+}
+
+func (r *replayer) record(e *audit.Entry, elapsed time.Duration, err error) {
+	r.Lock()
+	defer r.Unlock()
+	s, ok := r.stats[e.Op]
+	if !ok {
+		s = new(opStats)
+		r.stats[e.Op] = s
+	}
+	s.count++
+	if err != nil {
+		s.errors++
+	}
+	s.latency += elapsed
+	s.captured += time.Duration(e.Latency) * time.Microsecond
+	if elapsed > s.max {
+		s.max = elapsed
+	}
+}
+
+func (r *replayer) close() {
+	r.Lock()
+	defer r.Unlock()
+	for ino := range r.writable {
+		if err := r.ec.CloseForWrite(ino); err != nil {
+			log.LogWarnf("action[close] ino(%v) err(%v)", ino, err)
+		}
+	}
+	r.mw.Close()
+}
+
+/*the ops with their avg latency of the replay against the captured one*/
+func (r *replayer) report(w io.Writer) {
+	r.Lock()
+	defer r.Unlock()
+	ops := make([]string, 0, len(r.stats))
+	for op := range r.stats {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	fmt.Fprintf(w, "%-10s %10s %8s %14s %14s %14s\n", "OP", "COUNT", "ERRORS", "AVG", "CAPTURED_AVG", "MAX")
+	for _, op := range ops {
+		s := r.stats[op]
+		fmt.Fprintf(w, "%-10s %10d %8d %14v %14v %14v\n", op, s.count, s.errors,
+			s.latency/time.Duration(s.count), s.captured/time.Duration(s.count), s.max)
+	}
+	fmt.Fprintf(w, "max lag behind the schedule: %v\n", r.maxLag)
+}
@@ -109,7 +109,7 @@ func (client *BlobClient) Write(data []byte) (key string, err error) {
 			return "", syscall.ENOMEM
 		}
 		var (
-			conn *net.TCPConn
+			conn net.Conn
 		)
 		request := NewBlobWritePacket(dp, writeData)
 		if conn, err = client.conns.Get(dp.Hosts[0]); err != nil {
@@ -148,7 +148,7 @@ func (client *BlobClient) Write(data []byte) (key string, err error) {
 func (client *BlobClient) readDataFromHost(request *proto.Packet, target string, expectCrc uint32) (data []byte, err error) {
 
 	var (
-		conn *net.TCPConn
+		conn net.Conn
 	)
 	if conn, err = client.conns.Get(target); err != nil {
 		err = errors.Annotatef(err, "ReadRequest(%v) Get connect from host(%v)-", request.GetUniqueLogId(), target)
@@ -218,7 +218,7 @@ func (client *BlobClient) Delete(key string) (err error) {
 	}
 	request := NewBlobDeletePacket(dp, fileID, objID)
 	var (
-		conn *net.TCPConn
+		conn net.Conn
 	)
 	if conn, err = client.conns.Get(dp.Hosts[0]); err != nil {
 		err = errors.Annotatef(err, "DeleteRequest(%v) Get connect from host(%v)-", key, dp.Hosts[0])
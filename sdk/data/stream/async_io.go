@@ -0,0 +1,237 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package stream
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+const (
+	IORead uint8 = iota
+	IOWrite
+)
+
+const (
+	DefaultIOQueueDepth   = 128
+	DefaultIOQueueWorkers = 16
+)
+
+var (
+	ErrIOQueueFull   = errors.New("io queue is full")
+	ErrIOQueueClosed = errors.New("io queue is closed")
+	ErrInvalidIOOp   = errors.New("invalid io op")
+)
+
+// IORequest is an asynchronous read or write of an inode. A read fills Iovs
+// from Offset in order, a write writes Iovs from Offset in order. Result and
+// Err are valid once the request is returned by IOQueue.Poll.
+// A StreamReader is not safe for concurrent use, reads in flight at the same
+// time should not share it.
+type IORequest struct {
+	Op       uint8
+	Inode    uint64
+	Stream   *StreamReader // reader of the inode, required by IORead
+	Offset   int
+	Iovs     [][]byte
+	UserData interface{}
+
+	Result int
+	Err    error
+}
+
+// IOQueue executes the submitted requests by a fixed number of workers, so
+// an application can keep Depth requests outstanding without a goroutine per
+// request. The completed requests are collected by Poll.
+type IOQueue struct {
+	depth     int64
+	inflight  int64
+	requestC  chan *IORequest
+	completeC chan *IORequest
+	stopC     chan bool
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+	do        func(req *IORequest)
+}
+
+// NewIOQueue create a queue holding at most depth outstanding requests
+// executed by workers goroutines, non positive values mean the defaults.
+func (client *ExtentClient) NewIOQueue(depth, workers int) *IOQueue {
+	return newIOQueue(depth, workers, client.doIORequest)
+}
+
+func newIOQueue(depth, workers int, do func(req *IORequest)) (q *IOQueue) {
+	if depth <= 0 {
+		depth = DefaultIOQueueDepth
+	}
+	if workers <= 0 {
+		workers = DefaultIOQueueWorkers
+	}
+	if workers > depth {
+		workers = depth
+	}
+	q = &IOQueue{
+		depth:     int64(depth),
+		requestC:  make(chan *IORequest, depth),
+		completeC: make(chan *IORequest, depth),
+		stopC:     make(chan bool),
+		do:        do,
+	}
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.worker()
+	}
+	return
+}
+
+func (q *IOQueue) worker() {
+	defer q.wg.Done()
+	for {
+		select {
+		case req := <-q.requestC:
+			q.do(req)
+			q.completeC <- req
+		case <-q.stopC:
+			return
+		}
+	}
+}
+
+// Submit queue the requests without waiting for them, it returns the number
+// of requests queued, which is less than len(reqs) with ErrIOQueueFull if
+// the queue cannot hold all of them.
+func (q *IOQueue) Submit(reqs ...*IORequest) (submitted int, err error) {
+	select {
+	case <-q.stopC:
+		return 0, ErrIOQueueClosed
+	default:
+	}
+	for _, req := range reqs {
+		if atomic.AddInt64(&q.inflight, 1) > q.depth {
+			atomic.AddInt64(&q.inflight, -1)
+			return submitted, ErrIOQueueFull
+		}
+		req.Result, req.Err = 0, nil
+		q.requestC <- req
+		submitted++
+	}
+	return
+}
+
+// Poll return at least min and at most max completed requests, it waits at
+// most timeout for min requests, a negative timeout waits forever.
+func (q *IOQueue) Poll(min, max int, timeout time.Duration) (reqs []*IORequest) {
+	if max <= 0 {
+		return
+	}
+	if min > max {
+		min = max
+	}
+	reqs = make([]*IORequest, 0, max)
+	var timeoutC <-chan time.Time
+	if timeout >= 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutC = timer.C
+	}
+	for len(reqs) < min {
+		select {
+		case req := <-q.completeC:
+			reqs = append(reqs, q.complete(req))
+		case <-timeoutC:
+			return
+		case <-q.stopC:
+			return
+		}
+	}
+	for len(reqs) < max {
+		select {
+		case req := <-q.completeC:
+			reqs = append(reqs, q.complete(req))
+		default:
+			return
+		}
+	}
+	return
+}
+
+func (q *IOQueue) complete(req *IORequest) *IORequest {
+	atomic.AddInt64(&q.inflight, -1)
+	return req
+}
+
+// Inflight return the number of requests submitted but not polled yet.
+func (q *IOQueue) Inflight() int {
+	return int(atomic.LoadInt64(&q.inflight))
+}
+
+// Close stop the workers, requests not executed yet are dropped.
+func (q *IOQueue) Close() {
+	q.closeOnce.Do(func() {
+		close(q.stopC)
+	})
+	q.wg.Wait()
+}
+
+func (client *ExtentClient) doIORequest(req *IORequest) {
+	switch req.Op {
+	case IORead:
+		req.Result, req.Err = client.Readv(req.Stream, req.Inode, req.Iovs, req.Offset)
+	case IOWrite:
+		req.Result, req.Err = client.Writev(req.Inode, req.Offset, req.Iovs)
+	default:
+		req.Err = ErrInvalidIOOp
+	}
+}
+
+// Writev write the buffers of iovs to the inode from offset in order like
+// pwritev, it stops at the first failed or short write.
+func (client *ExtentClient) Writev(inode uint64, offset int, iovs [][]byte) (write int, err error) {
+	for _, iov := range iovs {
+		if len(iov) == 0 {
+			continue
+		}
+		var n int
+		n, err = client.Write(inode, offset+write, iov)
+		write += n
+		if err != nil || n < len(iov) {
+			return
+		}
+	}
+	return
+}
+
+// Readv read the inode from offset into the buffers of iovs in order like
+// preadv, it stops at the first failed or short read.
+func (client *ExtentClient) Readv(stream *StreamReader, inode uint64, iovs [][]byte, offset int) (read int, err error) {
+	if stream == nil {
+		return 0, errors.Annotatef(ErrInvalidIOOp, "inode(%v) read without stream", inode)
+	}
+	for _, iov := range iovs {
+		if len(iov) == 0 {
+			continue
+		}
+		var n int
+		n, err = client.Read(stream, inode, iov, offset+read, len(iov))
+		read += n
+		if err != nil || n < len(iov) {
+			return
+		}
+	}
+	return
+}
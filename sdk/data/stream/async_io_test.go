@@ -0,0 +1,73 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package stream
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIOQueue_SubmitPoll(t *testing.T) {
+	release := make(chan struct{})
+	q := newIOQueue(4, 2, func(req *IORequest) {
+		<-release
+		for _, iov := range req.Iovs {
+			req.Result += len(iov)
+		}
+	})
+	defer q.Close()
+
+	reqs := make([]*IORequest, 0)
+	for i := 0; i < 5; i++ {
+		reqs = append(reqs, &IORequest{Op: IOWrite, Offset: i, Iovs: [][]byte{make([]byte, i), make([]byte, 1)}, UserData: i})
+	}
+	submitted, err := q.Submit(reqs...)
+	if submitted != 4 || err != ErrIOQueueFull {
+		t.Fatalf("submit 5 requests to queue of depth 4: submitted(%v) err(%v)", submitted, err)
+	}
+	if done := q.Poll(1, 4, 10*time.Millisecond); len(done) != 0 {
+		t.Fatalf("poll before completion: got %v requests", len(done))
+	}
+	close(release)
+	done := q.Poll(4, 4, time.Second)
+	if len(done) != 4 {
+		t.Fatalf("poll after completion: got %v requests", len(done))
+	}
+	for _, req := range done {
+		if i := req.UserData.(int); req.Result != i+1 || req.Err != nil {
+			t.Fatalf("request(%v) result(%v) err(%v)", i, req.Result, req.Err)
+		}
+	}
+	if q.Inflight() != 0 {
+		t.Fatalf("inflight(%v) after all polled", q.Inflight())
+	}
+	if submitted, err = q.Submit(reqs[4]); submitted != 1 || err != nil {
+		t.Fatalf("submit after polled: submitted(%v) err(%v)", submitted, err)
+	}
+	if done = q.Poll(1, 1, -1); len(done) != 1 || done[0].Result != 5 {
+		t.Fatalf("poll without timeout: %v", done)
+	}
+}
+
+func TestIOQueue_Closed(t *testing.T) {
+	q := newIOQueue(0, 0, func(req *IORequest) {})
+	q.Close()
+	if _, err := q.Submit(&IORequest{}); err != ErrIOQueueClosed {
+		t.Fatalf("submit to closed queue: err(%v)", err)
+	}
+	if done := q.Poll(1, 1, -1); len(done) != 0 {
+		t.Fatalf("poll closed queue: %v", done)
+	}
+}
@@ -15,26 +15,40 @@
 package stream
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"sync"
+	"syscall"
 
 	"github.com/juju/errors"
 	"github.com/tiglabs/containerfs/proto"
 	"github.com/tiglabs/containerfs/sdk/data/wrapper"
 	"github.com/tiglabs/containerfs/util/log"
+	"github.com/tiglabs/containerfs/util/pool"
+	"github.com/tiglabs/containerfs/util/trace"
 	"github.com/tiglabs/containerfs/util/ump"
 	"runtime"
 	"sync/atomic"
+	"time"
 )
 
 type AppendExtentKeyFunc func(inode uint64, key proto.ExtentKey) error
 type GetExtentsFunc func(inode uint64) ([]proto.ExtentKey, error)
 
 var (
-	gDataWrapper     *wrapper.Wrapper
-	writeRequestPool *sync.Pool
-	flushRequestPool *sync.Pool
-	closeRequestPool *sync.Pool
+	writeRequestPool = &sync.Pool{New: func() interface{} {
+		return &WriteRequest{}
+	}}
+	flushRequestPool = &sync.Pool{New: func() interface{} {
+		return &FlushRequest{}
+	}}
+	syncRequestPool = &sync.Pool{New: func() interface{} {
+		return &SyncRequest{}
+	}}
+	closeRequestPool = &sync.Pool{New: func() interface{} {
+		return &CloseRequest{}
+	}}
 )
 
 type ExtentClient struct {
@@ -44,31 +58,80 @@ type ExtentClient struct {
 	writerLock      sync.RWMutex
 	appendExtentKey AppendExtentKeyFunc
 	getExtents      GetExtentsFunc
+	readAhead       *readAheadCache
+	writeBack       *writeBackCache
+	writeBackLock   sync.RWMutex
+	dataWrapper     *wrapper.Wrapper
+	conns           *pool.ConnectPool // the connections to the data nodes of the reads
+	followerRead    uint32
 }
 
 func NewExtentClient(volname, master string, appendExtentKey AppendExtentKeyFunc, getExtents GetExtentsFunc) (client *ExtentClient, err error) {
+	return NewExtentClientWithConns(volname, master, ReadConnectPool, appendExtentKey, getExtents)
+}
+
+// NewExtentClientWithConns is NewExtentClient reading through conns, the
+// writes dial their connections like the ones of conns. The clients of
+// several vols may share conns.
+func NewExtentClientWithConns(volname, master string, conns *pool.ConnectPool, appendExtentKey AppendExtentKeyFunc, getExtents GetExtentsFunc) (client *ExtentClient, err error) {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	client = new(ExtentClient)
-	gDataWrapper, err = wrapper.NewDataPartitionWrapper(volname, master)
+	client.dataWrapper, err = wrapper.NewDataPartitionWrapper(volname, master)
 	if err != nil {
 		return nil, fmt.Errorf("init dp Wrapper failed (%v)", err.Error())
 	}
+	client.conns = conns
 	client.writers = make(map[uint64]*StreamWriter)
 	client.appendExtentKey = appendExtentKey
 	client.referCnt = make(map[uint64]uint64)
 	client.getExtents = getExtents
-	writeRequestPool = &sync.Pool{New: func() interface{} {
-		return &WriteRequest{}
-	}}
-	flushRequestPool = &sync.Pool{New: func() interface{} {
-		return &FlushRequest{}
-	}}
-	closeRequestPool = &sync.Pool{New: func() interface{} {
-		return &CloseRequest{}
-	}}
+	client.readAhead = newReadAheadCache(DefaultReadAheadBlocks)
 	return
 }
 
+// SetFollowerRead sets if the followers of a data partition are read without
+// checking that their watermark of the extent covers the range.
+func (client *ExtentClient) SetFollowerRead(enable bool) {
+	if enable {
+		atomic.StoreUint32(&client.followerRead, 1)
+	} else {
+		atomic.StoreUint32(&client.followerRead, 0)
+	}
+}
+
+func (client *ExtentClient) isFollowerRead() bool {
+	return atomic.LoadUint32(&client.followerRead) != 0
+}
+
+// SetZeroCopyRead asks the data nodes to send the full blocks of the stream reads
+// with sendfile, the blocks are not verified by the data nodes but by the client.
+func (client *ExtentClient) SetZeroCopyRead(enable bool) {
+	if enable {
+		atomic.StoreUint32(&zeroCopyRead, 1)
+	} else {
+		atomic.StoreUint32(&zeroCopyRead, 0)
+	}
+}
+
+// SetZone sets the zone of the client, the reads of a data partition whose leader
+// is in another zone go to a replica in the zone if it has the range. Empty reads
+// the leader only.
+func (client *ExtentClient) SetZone(zone string) {
+	localZone.Store(zone)
+}
+
+// ReleasingPartitions returns the ids of the data partitions released by the
+// shrink of the vol, the files are to be migrated off them.
+func (client *ExtentClient) ReleasingPartitions() map[uint32]bool {
+	return client.dataWrapper.ReleasingPartitions()
+}
+
+// ReportMigrated tells the master a migration pass started at start moved all
+// the files off the releasing partitions.
+func (client *ExtentClient) ReportMigrated(start int64) error {
+	return client.dataWrapper.ReportMigrated(start)
+}
+
 func (client *ExtentClient) getStreamWriter(inode uint64) (stream *StreamWriter) {
 	client.writerLock.RLock()
 	stream = client.writers[inode]
@@ -89,13 +152,74 @@ func (client *ExtentClient) getStreamWriterForRead(inode uint64) (stream *Stream
 }
 
 func (client *ExtentClient) Write(inode uint64, offset int, data []byte) (write int, err error) {
+	return client.WriteContext(context.Background(), inode, offset, data)
+}
+
+// WriteContext is Write with the packets of the data traced as children of the
+// span of ctx, the data taken by the write back cache is written untraced.
+func (client *ExtentClient) WriteContext(ctx context.Context, inode uint64, offset int, data []byte) (write int, err error) {
 	stream := client.getStreamWriter(inode)
 	if stream == nil {
 		prefix := fmt.Sprintf("inodewrite %v_%v_%v", inode, offset, len(data))
 		return 0, fmt.Errorf("Prefix(%v) cannot init write stream", prefix)
 	}
+	if client.readAhead.enabled() {
+		client.readAhead.drop(inode, 0, 0)
+	}
+	if wb := client.getWriteBack(); wb.enabled() {
+		if err = wb.put(inode, offset, data); err != nil {
+			prefix := fmt.Sprintf("inodewrite %v_%v_%v", inode, offset, len(data))
+			return 0, errors.Annotatef(err, prefix)
+		}
+		return len(data), nil
+	}
+	return client.writeStream(stream, inode, offset, data, trace.FromContext(ctx))
+}
+
+// WriteDirect writes the data of the inode bypassing the write back cache, it
+// returns once the data is on the data nodes.
+func (client *ExtentClient) WriteDirect(inode uint64, offset int, data []byte) (write int, err error) {
+	return client.WriteDirectContext(context.Background(), inode, offset, data)
+}
 
+// WriteDirectContext is WriteDirect with the packets of the data traced as
+// children of the span of ctx.
+func (client *ExtentClient) WriteDirectContext(ctx context.Context, inode uint64, offset int, data []byte) (write int, err error) {
+	stream := client.getStreamWriter(inode)
+	if stream == nil {
+		prefix := fmt.Sprintf("inodewrite %v_%v_%v", inode, offset, len(data))
+		return 0, fmt.Errorf("Prefix(%v) cannot init write stream", prefix)
+	}
+	if client.readAhead.enabled() {
+		client.readAhead.drop(inode, 0, 0)
+	}
+	// the dirty data of the write back cache goes before
+	if err = client.writeBackBarrier(inode); err != nil {
+		return
+	}
+	if write, err = client.writeStream(stream, inode, offset, data, trace.FromContext(ctx)); err != nil {
+		return
+	}
+	err = client.Flush(inode)
+	return
+}
+
+/*the write of the flushers of the write back cache*/
+func (client *ExtentClient) write(inode uint64, offset int, data []byte) (err error) {
+	stream := client.getStreamWriter(inode)
+	if stream == nil {
+		return fmt.Errorf("inodewrite %v_%v_%v cannot init write stream", inode, offset, len(data))
+	}
+	write, err := client.writeStream(stream, inode, offset, data, trace.SpanContext{})
+	if err == nil && write != len(data) {
+		err = fmt.Errorf("inodewrite %v_%v_%v short write %v", inode, offset, len(data), write)
+	}
+	return
+}
+
+func (client *ExtentClient) writeStream(stream *StreamWriter, inode uint64, offset int, data []byte, sc trace.SpanContext) (write int, err error) {
 	request := writeRequestPool.Get().(*WriteRequest)
+	request.trace = sc
 	request.data = data
 	request.kernelOffset = offset
 	request.size = len(data)
@@ -109,14 +233,14 @@ func (client *ExtentClient) Write(inode uint64, offset int, data []byte) (write
 		prefix := fmt.Sprintf("inodewrite %v_%v_%v", inode, offset, len(data))
 		err = errors.Annotatef(err, prefix)
 		log.LogError(errors.ErrorStack(err))
-		ump.Alarm(gDataWrapper.UmpWarningKey(), err.Error())
+		ump.Alarm(client.dataWrapper.UmpWarningKey(), err.Error())
 	}
 	writeRequestPool.Put(request)
 	return
 }
 
 func (client *ExtentClient) OpenForRead(inode uint64) (stream *StreamReader, err error) {
-	return NewStreamReader(inode, client.getExtents)
+	return NewStreamReader(client, inode)
 }
 
 func (client *ExtentClient) OpenForWrite(inode, start uint64) {
@@ -141,7 +265,7 @@ func (client *ExtentClient) OpenForWrite(inode, start uint64) {
 	client.writerLock.Lock()
 	_, ok = client.writers[inode]
 	if !ok {
-		writer := NewStreamWriter(inode, start, client.appendExtentKey)
+		writer := NewStreamWriter(client, inode, start)
 		client.writers[inode] = writer
 	}
 	client.writerLock.Unlock()
@@ -155,7 +279,13 @@ func (client *ExtentClient) GetWriteSize(inode uint64) uint64 {
 	if !ok {
 		return 0
 	}
-	return writer.getHasWriteSize()
+	size := writer.getHasWriteSize()
+	if wb := client.getWriteBack(); wb.enabled() {
+		if dirtySize := wb.dirtySize(inode); dirtySize > size {
+			size = dirtySize
+		}
+	}
+	return size
 }
 
 func (client *ExtentClient) SetWriteSize(inode, size uint64) {
@@ -178,15 +308,133 @@ func (client *ExtentClient) Flush(inode uint64) (err error) {
 	if stream == nil {
 		return nil
 	}
+	wbErr := client.writeBackBarrier(inode)
 	request := flushRequestPool.Get().(*FlushRequest)
 	request.done = make(chan struct{}, 1)
 	stream.requestCh <- request
 	<-request.done
 	err = request.err
 	flushRequestPool.Put(request)
+	if wbErr != nil {
+		return wbErr
+	}
 	return err
 }
 
+/*wait for the dirty data of the inode in the write back cache to reach the stream writer*/
+func (client *ExtentClient) writeBackBarrier(inode uint64) (err error) {
+	if wb := client.getWriteBack(); wb.enabled() {
+		err = wb.barrier(inode)
+	}
+	return
+}
+
+// Sync flushes the written data of the inode and synchronizes it to disk on
+// all the replicas, the data is durable when it returns without error.
+func (client *ExtentClient) Sync(inode uint64) (err error) {
+	stream := client.getStreamWriterForRead(inode)
+	if stream == nil {
+		return nil
+	}
+	wbErr := client.writeBackBarrier(inode)
+	request := syncRequestPool.Get().(*SyncRequest)
+	request.done = make(chan struct{}, 1)
+	stream.requestCh <- request
+	<-request.done
+	err = request.err
+	syncRequestPool.Put(request)
+	if wbErr != nil {
+		return wbErr
+	}
+	return err
+}
+
+// Preallocate makes the extents created for the writes of the inode up to end
+// preallocate their disk space on the replicas. It returns EOPNOTSUPP if the
+// inode is not open for write.
+func (client *ExtentClient) Preallocate(inode, end uint64) error {
+	stream := client.getStreamWriterForRead(inode)
+	if stream == nil {
+		return syscall.EOPNOTSUPP
+	}
+	for {
+		old := atomic.LoadUint64(&stream.preallocEnd)
+		if end <= old || atomic.CompareAndSwapUint64(&stream.preallocEnd, old, end) {
+			return nil
+		}
+	}
+}
+
+// PunchHole zeroes the range of the file and releases its space on all the
+// replicas of the extents it covers, the data written is to be flushed first.
+// It returns EOPNOTSUPP at an extent shared by other files, the extents of
+// the range before it are punched.
+func (client *ExtentClient) PunchHole(inode uint64, offset, size int) (err error) {
+	keys, err := client.getExtents(inode)
+	if err != nil {
+		return
+	}
+	if client.readAhead.enabled() {
+		client.readAhead.drop(inode, offset, size)
+	}
+	end := offset + size
+	fileOffset := 0
+	for _, key := range keys {
+		keyEnd := fileOffset + int(key.Size)
+		start := offset
+		if start < fileOffset {
+			start = fileOffset
+		}
+		stop := end
+		if stop > keyEnd {
+			stop = keyEnd
+		}
+		if start < stop {
+			if err = client.punchExtent(key, int64(start-fileOffset), int64(stop-start)); err == syscall.EOPNOTSUPP {
+				log.LogWarnf("PunchHole inode(%v) offset(%v) size(%v): extent(%v) shared or on a legacy data node", inode, offset, size, key)
+				return
+			} else if err != nil {
+				return errors.Annotatef(err, "PunchHole inode(%v) offset(%v) size(%v)", inode, offset, size)
+			}
+		}
+		if fileOffset = keyEnd; fileOffset >= end {
+			break
+		}
+	}
+	return
+}
+
+func (client *ExtentClient) punchExtent(key proto.ExtentKey, offset, size int64) (err error) {
+	dp, err := client.dataWrapper.GetDataPartition(key.PartitionId)
+	if err != nil {
+		return
+	}
+	connect, err := client.conns.Dial(dp.Hosts[0], time.Second)
+	if err != nil {
+		return errors.Annotatef(err, " get connect from datapartionHosts(%v)", dp.Hosts[0])
+	}
+	defer connect.Close()
+	// a legacy data node can't punch, the range is left
+	if !proto.PeerSupports(connect.RemoteAddr().String(), proto.ConnCapPunchHole) {
+		return syscall.EOPNOTSUPP
+	}
+	p := NewPunchHolePacket(dp, key.ExtentId, offset, size)
+	if err = p.WriteToConn(connect); err != nil {
+		return errors.Annotatef(err, "send PunchHole(%v) to datapartionHosts(%v)", p.GetUniqueLogId(), dp.Hosts[0])
+	}
+	if err = p.ReadFromConn(connect, proto.ReadDeadlineTime*2); err != nil {
+		return errors.Annotatef(err, "receive PunchHole(%v) failed datapartionHosts(%v)", p.GetUniqueLogId(), dp.Hosts[0])
+	}
+	if p.GetErrCode() == proto.ErrCodeExtentShared {
+		return syscall.EOPNOTSUPP
+	}
+	if p.ResultCode != proto.OpOk {
+		err = fmt.Errorf("receive PunchHole(%v) failed datapartionHosts(%v) result(%v)",
+			p.GetUniqueLogId(), dp.Hosts[0], string(p.Data[:p.Size]))
+	}
+	return
+}
+
 func (client *ExtentClient) CloseForWrite(inode uint64) (err error) {
 	client.referLock.Lock()
 	refercnt, ok := client.referCnt[inode]
@@ -209,6 +457,7 @@ func (client *ExtentClient) CloseForWrite(inode uint64) (err error) {
 		client.deleteRefercnt(inode)
 		return
 	}
+	wbErr := client.writeBackBarrier(inode)
 	atomic.StoreInt32(&streamWriter.hasClosed, HasClosed)
 	request := closeRequestPool.Get().(*CloseRequest)
 	request.done = make(chan struct{}, 1)
@@ -227,22 +476,35 @@ func (client *ExtentClient) CloseForWrite(inode uint64) (err error) {
 	client.writerLock.Unlock()
 	atomic.StoreInt32(&streamWriter.hasClosed, HasClosed)
 
-	return
+	return wbErr
 }
 
 func (client *ExtentClient) Read(stream *StreamReader, inode uint64, data []byte, offset int, size int) (read int, err error) {
+	return client.read(stream, inode, data, offset, size, false)
+}
+
+// ReadDirect reads the data of the inode from the data nodes, bypassing the
+// read ahead cache.
+func (client *ExtentClient) ReadDirect(stream *StreamReader, inode uint64, data []byte, offset int, size int) (read int, err error) {
+	return client.read(stream, inode, data, offset, size, true)
+}
+
+func (client *ExtentClient) read(stream *StreamReader, inode uint64, data []byte, offset int, size int, direct bool) (read int, err error) {
 	if size == 0 {
 		return
 	}
 
 	defer func() {
 		if err != nil {
-			ump.Alarm(gDataWrapper.UmpWarningKey(), err.Error())
+			ump.Alarm(client.dataWrapper.UmpWarningKey(), err.Error())
 		}
 	}()
 
 	wstream := client.getStreamWriterForRead(inode)
 	if wstream != nil {
+		if wb := client.getWriteBack(); wb.enabled() {
+			wb.flush(inode)
+		}
 		request := flushRequestPool.Get().(*FlushRequest)
 		request.done = make(chan struct{}, 1)
 		wstream.requestCh <- request
@@ -253,7 +515,17 @@ func (client *ExtentClient) Read(stream *StreamReader, inode uint64, data []byte
 			return 0, err
 		}
 	}
+	ra := client.readAhead
+	if direct {
+		return stream.read(data, offset, size)
+	}
+	if ra.enabled() && ra.read(inode, data, offset, size) {
+		return size, nil
+	}
 	read, err = stream.read(data, offset, size)
+	if ra.enabled() && (err == nil || err == io.EOF) {
+		client.readAheadOf(inode, offset+read, int(stream.fileSize))
+	}
 
 	return
 }
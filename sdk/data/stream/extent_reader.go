@@ -15,6 +15,7 @@
 package stream
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/juju/errors"
 	"github.com/tiglabs/containerfs/proto"
@@ -35,10 +36,26 @@ const (
 	NoCloseConnect    = false
 )
 
+const (
+	AgainRetry       = 8 //reads of a replica throttling them before the next replica is read
+	AgainBackoffBase = 10 * time.Millisecond
+	AgainBackoffMax  = time.Second
+)
+
+var (
+	AgainErr = errors.New("data node busy, try again")
+)
+
 var (
 	ReadConnectPool = pool.NewConnPool()
+	zeroCopyRead    uint32
 )
 
+//the watermark of an extent replied by a data node
+type extentWatermark struct {
+	Size uint64 `json:"size"`
+}
+
 type ExtentReader struct {
 	inode            uint64
 	startInodeOffset uint64
@@ -46,14 +63,21 @@ type ExtentReader struct {
 	dp               *wrapper.DataPartition
 	key              proto.ExtentKey
 	readerIndex      uint32
+	client           *ExtentClient
+	nearWatermark    atomic.Value // *nearWatermark
 }
 
-func NewExtentReader(inode uint64, inInodeOffset int, key proto.ExtentKey) (reader *ExtentReader, err error) {
+func NewExtentReader(client *ExtentClient, inode uint64, inInodeOffset int, key proto.ExtentKey) (reader *ExtentReader, err error) {
 	reader = new(ExtentReader)
-	reader.dp, err = gDataWrapper.GetDataPartition(key.PartitionId)
+	reader.client = client
+	reader.dp, err = client.dataWrapper.GetDataPartition(key.PartitionId)
 	if err != nil {
 		return
 	}
+	if reader.dp.ArchiveStatus != "" {
+		client.dataWrapper.RehydrateDataPartition(reader.dp)
+		return nil, fmt.Errorf("DataPartition[%v] %v, read it again after the rehydration", key.PartitionId, reader.dp.ArchiveStatus)
+	}
 	reader.inode = inode
 	reader.key = key
 	reader.startInodeOffset = uint64(inInodeOffset)
@@ -61,13 +85,13 @@ func NewExtentReader(inode uint64, inInodeOffset int, key proto.ExtentKey) (read
 	rand.Seed(time.Now().UnixNano())
 	hasFindLocalReplica := false
 	for index, host := range reader.dp.Hosts {
-		if strings.Split(host, ":")[0] == wrapper.LocalIP {
+		if util.GetHost(host) == wrapper.LocalIP {
 			reader.readerIndex = uint32(index)
 			hasFindLocalReplica = true
 			break
 		}
 	}
-	if !hasFindLocalReplica {
+	if !hasFindLocalReplica && reader.dp.ReplicaNum > 0 {
 		reader.readerIndex = uint32(rand.Intn(int(reader.dp.ReplicaNum)))
 	}
 	return reader, nil
@@ -82,28 +106,41 @@ func (reader *ExtentReader) read(data []byte, offset, size, kerneloffset, kernel
 	return
 }
 
+// read from the replica of the reader index, the local one or a random one, and
+// fail over to the next replica. A follower is read only if its watermark of the
+// extent covers the range, unless the vol allows the follower read
 func (reader *ExtentReader) readDataFromDataPartition(offset, size int, data []byte, kerneloffset, kernelsize int) (err error) {
 	var host string
-	if _, host, err = reader.streamReadDataFromHost(offset, size, data, kerneloffset, kernelsize); err != nil {
-		if reader.isUseCloseConnectErr(err) {
-			reader.forceDestoryAllConnect(host)
-		}
-		log.LogWarnf(err.Error())
-		goto forLoop
+	if reader.readFromNearReplica(offset, size, data, kerneloffset, kernelsize) {
+		return
 	}
-	return
-forLoop:
 	mesg := ""
+	again := 0
 	for i := 0; i < len(reader.dp.Hosts); i++ {
-		_, host, err = reader.streamReadDataFromHost(offset, size, data, kerneloffset, kernelsize)
+		index := reader.getReaderIndex()
+		host = reader.dp.Hosts[index]
+		err = nil
+		if index != 0 && !reader.client.isFollowerRead() {
+			err = reader.checkWatermark(host, offset+size)
+		}
+		if err == nil {
+			// the retries are read with copy, the data node verifies the blocks and quarantines a corrupt one
+			_, host, err = reader.streamReadDataFromHost(index, offset, size, data, kerneloffset, kernelsize, isZeroCopyRead() && i == 0)
+		}
 		if err == nil {
 			return
 		} else if reader.isUseCloseConnectErr(err) {
 			reader.forceDestoryAllConnect(host)
+		} else if strings.Contains(err.Error(), AgainErr.Error()) && again < AgainRetry {
+			// the replica throttled the read, it is read again after a backoff
+			time.Sleep(againBackoff(again))
+			again++
 			i--
+		} else {
+			atomic.CompareAndSwapUint32(&reader.readerIndex, uint32(index), uint32((index+1)%len(reader.dp.Hosts)))
 		}
 		log.LogWarn(err.Error())
-		mesg += fmt.Sprintf(" (index(%v) err(%v))", i, err.Error())
+		mesg += fmt.Sprintf(" (index(%v) err(%v))", index, err.Error())
 	}
 	log.LogWarn(mesg)
 	err = fmt.Errorf(mesg)
@@ -111,27 +148,138 @@ forLoop:
 	return
 }
 
+/*the exponential backoff with jitter of the retry of a request throttled by a data node*/
+func againBackoff(retry int) time.Duration {
+	backoff := AgainBackoffMax
+	if retry < 16 && AgainBackoffBase<<uint(retry) < AgainBackoffMax {
+		backoff = AgainBackoffBase << uint(retry)
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+func (reader *ExtentReader) getReaderIndex() int {
+	index := atomic.LoadUint32(&reader.readerIndex)
+	if index >= uint32(len(reader.dp.Hosts)) {
+		atomic.StoreUint32(&reader.readerIndex, 0)
+		index = 0
+	}
+	return int(index)
+}
+
+// read from a replica in the zone of the client if the leader is in another zone,
+// the replica is put on hold and the leader is read if it fails or is slow
+func (reader *ExtentReader) readFromNearReplica(offset, size int, data []byte, kerneloffset, kernelsize int) (ok bool) {
+	index := nearReplicaIndex(reader.dp, getLocalZone(), hostHealths)
+	if index < 0 {
+		return
+	}
+	host := reader.dp.Hosts[index]
+	start := time.Now()
+	err := reader.checkNearWatermark(host, offset+size)
+	if err == nil {
+		_, host, err = reader.streamReadDataFromHost(index, offset, size, data, kerneloffset, kernelsize, isZeroCopyRead())
+	}
+	if err != nil {
+		if reader.isUseCloseConnectErr(err) {
+			reader.forceDestoryAllConnect(host)
+		}
+		// a watermark behind the range is a lagging replica, not a sick one
+		if !strings.Contains(err.Error(), "not cover end") {
+			hostHealths.markFailed(host)
+		}
+		log.LogWarnf("action[readFromNearReplica] %v read from near replica(%v) failed, read the leader(%v): %v",
+			reader.toString(), host, reader.dp.Hosts[0], err)
+		return
+	}
+	if elapsed := time.Since(start); elapsed > SlowReadThreshold {
+		hostHealths.markFailed(host)
+		log.LogWarnf("action[readFromNearReplica] %v near replica(%v) slow(%v), read the leader until %v later",
+			reader.toString(), host, elapsed, UnhealthyHostDuration)
+	}
+	return true
+}
+
+/*check the watermark of the extent on host covers the end of the range*/
+/*check the watermark of the near replica, got again only if the range passes the one got last*/
+func (reader *ExtentReader) checkNearWatermark(host string, end int) (err error) {
+	if last, ok := reader.nearWatermark.Load().(*nearWatermark); ok && last.host == host && last.size >= uint64(end) {
+		return nil
+	}
+	var size uint64
+	if size, err = reader.getWatermark(host); err != nil {
+		return
+	}
+	reader.nearWatermark.Store(&nearWatermark{host: host, size: size})
+	if size < uint64(end) {
+		return fmt.Errorf("%vcheckWatermark host(%v) watermark(%v) not cover end(%v)", reader.toString(),
+			host, size, end)
+	}
+	return
+}
+
+func (reader *ExtentReader) checkWatermark(host string, end int) (err error) {
+	var size uint64
+	if size, err = reader.getWatermark(host); err != nil {
+		return
+	}
+	if size < uint64(end) {
+		return fmt.Errorf("%vcheckWatermark host(%v) watermark(%v) not cover end(%v)", reader.toString(),
+			host, size, end)
+	}
+	return
+}
+
+func (reader *ExtentReader) getWatermark(host string) (size uint64, err error) {
+	var connect net.Conn
+	request := NewGetWatermarkPacket(&reader.key)
+	if connect, err = reader.client.conns.Get(host); err != nil {
+		return 0, errors.Annotatef(err, reader.toString()+"checkWatermark dp(%v) cannot get connect from host(%v) request(%v)",
+			reader.key.PartitionId, host, request.GetUniqueLogId())
+	}
+	defer func() {
+		reader.client.conns.Put(connect, err != nil)
+	}()
+	if err = request.WriteToConn(connect); err != nil {
+		return 0, errors.Annotatef(err, reader.toString()+"checkWatermark host(%v) error request(%v)",
+			host, request.GetUniqueLogId())
+	}
+	if err = request.ReadFromConn(connect, proto.ReadDeadlineTime); err != nil {
+		return 0, errors.Annotatef(err, reader.toString()+"checkWatermark host(%v) error request(%v)",
+			host, request.GetUniqueLogId())
+	}
+	if request.ResultCode != proto.OpOk {
+		return 0, fmt.Errorf("%vcheckWatermark host(%v) request(%v) result(%v)", reader.toString(),
+			host, request.GetUniqueLogId(), string(request.Data[:request.Size]))
+	}
+	watermark := new(extentWatermark)
+	if err = json.Unmarshal(request.Data[:request.Size], watermark); err != nil {
+		return 0, errors.Annotatef(err, reader.toString()+"checkWatermark host(%v) request(%v) unmarshal",
+			host, request.GetUniqueLogId())
+	}
+	return watermark.Size, nil
+}
+
 func (reader *ExtentReader) isUseCloseConnectErr(err error) bool {
 	return strings.Contains(err.Error(), "use of closed network connection")
 }
 
 func (reader *ExtentReader) forceDestoryAllConnect(host string) {
-	ReadConnectPool.ReleaseAllConnect(host)
+	reader.client.conns.ReleaseAllConnect(host)
 }
 
-func (reader *ExtentReader) streamReadDataFromHost(offset, expectReadSize int, data []byte, kerneloffset,
-	kernelsize int) (actualReadSize int, host string, err error) {
+// a zero copy read asks the data node to send the full blocks from the file, their
+// crcs are checked here only
+func (reader *ExtentReader) streamReadDataFromHost(index, offset, expectReadSize int, data []byte, kerneloffset,
+	kernelsize int, zeroCopy bool) (actualReadSize int, host string, err error) {
 	request := NewStreamReadPacket(&reader.key, offset, expectReadSize)
-	var connect *net.TCPConn
-	index := atomic.LoadUint32(&reader.readerIndex)
-	if index >= uint32(reader.dp.ReplicaNum) {
-		index = 0
-		atomic.StoreUint32(&reader.readerIndex, 0)
+	if zeroCopy {
+		request.Arg = []byte(proto.ArgZeroCopy)
+		request.Arglen = uint32(len(request.Arg))
 	}
+	var connect net.Conn
 	host = reader.dp.Hosts[index]
-	connect, err = ReadConnectPool.Get(host)
+	connect, err = reader.client.conns.Get(host)
 	if err != nil {
-		atomic.AddUint32(&reader.readerIndex, 1)
 		return 0, host, errors.Annotatef(err, reader.toString()+
 			"streamReadDataFromHost dp(%v) cannot get  connect from host(%v) request(%v) ",
 			reader.key.PartitionId, host, request.GetUniqueLogId())
@@ -139,13 +287,9 @@ func (reader *ExtentReader) streamReadDataFromHost(offset, expectReadSize int, d
 	}
 	defer func() {
 		if err != nil {
-			ReadConnectPool.Put(connect, ForceCloseConnect)
-			if reader.isUseCloseConnectErr(err) {
-				return
-			}
-			atomic.AddUint32(&reader.readerIndex, 1)
+			reader.client.conns.Put(connect, ForceCloseConnect)
 		} else {
-			ReadConnectPool.Put(connect, NoCloseConnect)
+			reader.client.conns.Put(connect, NoCloseConnect)
 		}
 	}()
 
@@ -182,6 +326,10 @@ func (reader *ExtentReader) streamReadDataFromHost(offset, expectReadSize int, d
 }
 
 func (reader *ExtentReader) checkStreamReply(request *Packet, reply *Packet, kerneloffset, kernelsize int) (err error) {
+	if reply.ResultCode == proto.OpAgain {
+		return errors.Annotatef(AgainErr, "%vrequest(%v) reply(%v)", reader.toString(),
+			request.GetUniqueLogId(), reply.GetUniqueLogId())
+	}
 	if reply.ResultCode != proto.OpOk {
 		return errors.Annotatef(fmt.Errorf("reply status code(%v) is not ok,request (%v) "+
 			"but reply (%v) ", reply.ResultCode, request.GetUniqueLogId(), reply.GetUniqueLogId()),
@@ -215,6 +363,10 @@ func (reader *ExtentReader) updateKey(key proto.ExtentKey) (update bool) {
 	return true
 }
 
+func isZeroCopyRead() bool {
+	return atomic.LoadUint32(&zeroCopyRead) != 0
+}
+
 func (reader *ExtentReader) toString() (m string) {
 	return fmt.Sprintf("inode (%v) extentKey(%v) start(%v) end(%v)", reader.inode,
 		reader.key.Marshal(), reader.startInodeOffset, reader.endInodeOffset)
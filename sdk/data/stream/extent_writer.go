@@ -26,6 +26,7 @@ import (
 	"github.com/tiglabs/containerfs/sdk/data/wrapper"
 	"github.com/tiglabs/containerfs/util"
 	"github.com/tiglabs/containerfs/util/log"
+	"github.com/tiglabs/containerfs/util/trace"
 	"time"
 )
 
@@ -53,10 +54,11 @@ type ExtentWriter struct {
 	currentPacket    *Packet
 	byteAck          uint64 //DataNode Has Ack Bytes
 	offset           int
-	connect          *net.TCPConn
+	connect          net.Conn
 	handleCh         chan bool //a Chan for signal recive goroutine recive packet from connect
 	recoverCnt       int       //if failed,then recover contine,this is recover count
 	forbidUpdate     int64
+	throttled        int32
 	requestLock      sync.Mutex
 	isflushIng       int32
 	flushSignleCh    chan bool
@@ -64,7 +66,7 @@ type ExtentWriter struct {
 	updateSizeLock   sync.Mutex
 }
 
-func NewExtentWriter(inode uint64, dp *wrapper.DataPartition, extentId uint64) (writer *ExtentWriter, err error) {
+func NewExtentWriter(client *ExtentClient, inode uint64, dp *wrapper.DataPartition, extentId uint64) (writer *ExtentWriter, err error) {
 	if extentId <= 0 {
 		return nil, fmt.Errorf("inode(%v),dp(%v),unavalid extentId(%v)", inode, dp.PartitionID, extentId)
 	}
@@ -75,13 +77,7 @@ func NewExtentWriter(inode uint64, dp *wrapper.DataPartition, extentId uint64) (
 	writer.dp = dp
 	writer.inode = inode
 	writer.flushSignleCh = make(chan bool, 1)
-	var connect *net.TCPConn
-	conn, err := net.DialTimeout("tcp", dp.Hosts[0], time.Second)
-	if err == nil {
-		connect, _ = conn.(*net.TCPConn)
-		connect.SetKeepAlive(true)
-		connect.SetNoDelay(true)
-	}
+	connect, err := client.conns.Dial(dp.Hosts[0], time.Second)
 	if err != nil {
 		return
 	}
@@ -113,7 +109,7 @@ func (writer *ExtentWriter) flushWait() {
 }
 
 //user call write func
-func (writer *ExtentWriter) write(data []byte, kernelOffset, size int) (total int, err error) {
+func (writer *ExtentWriter) write(data []byte, kernelOffset, size int, sc trace.SpanContext) (total int, err error) {
 	var canWrite int
 	defer func() {
 		if err != nil {
@@ -129,6 +125,7 @@ func (writer *ExtentWriter) write(data []byte, kernelOffset, size int) (total in
 	for total < size {
 		if writer.currentPacket == nil {
 			writer.currentPacket = NewWritePacket(writer.dp, writer.extentId, writer.offset, kernelOffset)
+			writer.currentPacket.trace = sc
 		}
 		canWrite = writer.currentPacket.fill(data[total:size], size-total) //fill this packet
 		if writer.IsFullCurrentPacket() || canWrite == 0 {
@@ -154,8 +151,13 @@ func (writer *ExtentWriter) sendCurrPacket() (err error) {
 	if writer.currentPacket.getPacketLength() == 0 {
 		return
 	}
-	writer.pushRequestToQueue(writer.currentPacket)
 	packet := writer.currentPacket
+	packet.span = trace.StartChild(packet.trace, "datanode.write", trace.SpanKindClient)
+	packet.SetTrace(packet.span.Context())
+	packet.span.SetAttribute("partition", packet.PartitionID)
+	packet.span.SetAttribute("extent", packet.FileID)
+	packet.span.SetAttribute("size", packet.getPacketLength())
+	writer.pushRequestToQueue(packet)
 	writer.currentPacket = nil
 	orgOffset := writer.offset
 	writer.offset += packet.getPacketLength()
@@ -281,6 +283,15 @@ func (writer *ExtentWriter) close() (err error) {
 }
 
 func (writer *ExtentWriter) processReply(e *list.Element, request, reply *Packet) (err error) {
+	defer func() {
+		request.span.SetError(err)
+		request.span.End()
+	}()
+	if reply.ResultCode == proto.OpAgain {
+		atomic.StoreInt32(&writer.throttled, 1)
+		return errors.Annotatef(AgainErr, "writer(%v) request(%v) reply(%v)", writer.toString(),
+			request.GetUniqueLogId(), reply.GetUniqueLogId())
+	}
 	if reply.ResultCode != proto.OpOk {
 		return errors.Annotatef(fmt.Errorf("reply status code(%v) is not ok,request (%v) "+
 			"but reply (%v) ", reply.ResultCode, request.GetUniqueLogId(), reply.GetUniqueLogId()),
@@ -373,6 +384,10 @@ func (writer *ExtentWriter) receive() {
 	}
 }
 
+func (writer *ExtentWriter) isThrottled() bool {
+	return atomic.LoadInt32(&writer.throttled) != 0
+}
+
 func (writer *ExtentWriter) addByteAck(size uint64) {
 	atomic.AddUint64(&writer.byteAck, size)
 }
@@ -385,11 +400,11 @@ func (writer *ExtentWriter) getByteAck() uint64 {
 	return atomic.LoadUint64(&writer.byteAck)
 }
 
-func (writer *ExtentWriter) getConnect() *net.TCPConn {
+func (writer *ExtentWriter) getConnect() net.Conn {
 	return writer.connect
 }
 
-func (writer *ExtentWriter) setConnect(connect *net.TCPConn) {
+func (writer *ExtentWriter) setConnect(connect net.Conn) {
 	writer.connect = connect
 }
 
@@ -19,6 +19,7 @@ import (
 	"github.com/tiglabs/containerfs/proto"
 	"github.com/tiglabs/containerfs/sdk/data/wrapper"
 	"github.com/tiglabs/containerfs/util"
+	"github.com/tiglabs/containerfs/util/trace"
 	"hash/crc32"
 	"io"
 	"net"
@@ -31,6 +32,8 @@ type Packet struct {
 	kernelOffset int
 	orgSize      uint32
 	orgData      []byte
+	trace        trace.SpanContext //of the op the packet is written for
+	span         *trace.Span
 }
 
 func NewWritePacket(dp *wrapper.DataPartition, extentId uint64, offset int, kernelOffset int) (p *Packet) {
@@ -82,7 +85,20 @@ func NewStreamReadPacket(key *proto.ExtentKey, offset, size int) (p *Packet) {
 	return
 }
 
-func NewCreateExtentPacket(dp *wrapper.DataPartition, inodeId uint64) (p *Packet) {
+func NewGetWatermarkPacket(key *proto.ExtentKey) (p *Packet) {
+	p = new(Packet)
+	p.FileID = key.ExtentId
+	p.PartitionID = key.PartitionId
+	p.Magic = proto.ProtoMagic
+	p.Opcode = proto.OpGetWatermark
+	p.StoreMode = proto.ExtentStoreMode
+	p.ReqID = proto.GetReqID()
+	p.Nodes = 0
+
+	return
+}
+
+func NewCreateExtentPacket(dp *wrapper.DataPartition, inodeId uint64, prealloc int64) (p *Packet) {
 	p = new(Packet)
 	p.PartitionID = dp.PartitionID
 	p.Magic = proto.ProtoMagic
@@ -96,6 +112,10 @@ func NewCreateExtentPacket(dp *wrapper.DataPartition, inodeId uint64) (p *Packet
 
 	p.Data = make([]byte, 8)
 	binary.BigEndian.PutUint64(p.Data, inodeId)
+	if prealloc > 0 {
+		p.Data = append(p.Data, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(p.Data[8:16], uint64(prealloc))
+	}
 	p.Size = uint32(len(p.Data))
 
 	return p
@@ -115,6 +135,38 @@ func NewDeleteExtentPacket(dp *wrapper.DataPartition, extentId uint64) (p *Packe
 	return p
 }
 
+func NewSyncExtentPacket(dp *wrapper.DataPartition, extentId uint64) (p *Packet) {
+	p = new(Packet)
+	p.Magic = proto.ProtoMagic
+	p.Opcode = proto.OpSyncExtent
+	p.StoreMode = proto.ExtentStoreMode
+	p.PartitionID = dp.PartitionID
+	p.FileID = extentId
+	p.ReqID = proto.GetReqID()
+	p.Nodes = uint8(len(dp.Hosts) - 1)
+	p.Arg = ([]byte)(dp.GetAllAddrs())
+	p.Arglen = uint32(len(p.Arg))
+	return p
+}
+
+func NewPunchHolePacket(dp *wrapper.DataPartition, extentId uint64, offset, size int64) (p *Packet) {
+	p = new(Packet)
+	p.Magic = proto.ProtoMagic
+	p.Opcode = proto.OpPunchHole
+	p.StoreMode = proto.ExtentStoreMode
+	p.PartitionID = dp.PartitionID
+	p.FileID = extentId
+	p.Offset = offset
+	p.ReqID = proto.GetReqID()
+	p.Nodes = uint8(len(dp.Hosts) - 1)
+	p.Arg = ([]byte)(dp.GetAllAddrs())
+	p.Arglen = uint32(len(p.Arg))
+	p.Data = make([]byte, 8)
+	binary.BigEndian.PutUint64(p.Data, uint64(size))
+	p.Size = uint32(len(p.Data))
+	return p
+}
+
 func NewReply(reqId int64, partition uint32, extentId uint64) (p *Packet) {
 	p = new(Packet)
 	p.ReqID = reqId
@@ -198,6 +250,9 @@ func (p *Packet) ReadFromConnStream(c net.Conn, deadlineTime time.Duration) (err
 	if err = p.UnmarshalHeader(header); err != nil {
 		return
 	}
+	if err = p.ReadTraceFromConn(c); err != nil {
+		return
+	}
 
 	if p.Arglen > 0 {
 		if err = ReadFull(c, &p.Arg, int(p.Arglen)); err != nil {
@@ -0,0 +1,323 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package stream
+
+import (
+	"container/list"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	ReadAheadBlockSize     = 1 << 20
+	ReadAheadWindowBlocks  = 4 //blocks read ahead of a sequential read
+	ReadAheadBlockExpire   = 30 * time.Second
+	ReadAheadWorkers       = 4
+	DefaultReadAheadBlocks = 64
+)
+
+// The hints of posix_fadvise, an application tells how it is going to read
+// a file so that the client caches the data ahead of the access.
+const (
+	AdviceNormal = iota
+	AdviceSequential
+	AdviceRandom
+	AdviceWillNeed
+	AdviceDontNeed
+)
+
+type blockKey struct {
+	inode uint64
+	index int
+}
+
+// a cached block is shorter than ReadAheadBlockSize if it is the last one of
+// the file, the file size is the one seen when the block was read
+type cacheBlock struct {
+	key    blockKey
+	data   []byte
+	expire time.Time
+	elem   *list.Element
+}
+
+// readAheadCache keeps the blocks prefetched by the hints of the applications
+// and by the read ahead of the sequential files, the least recently used
+// blocks are evicted once capacity blocks are cached. A block is dropped by
+// a write of its inode through this client and expires after
+// ReadAheadBlockExpire for the writes of the other clients.
+type readAheadCache struct {
+	capacity   int
+	blocks     map[blockKey]*cacheBlock
+	lru        *list.List
+	pending    map[blockKey]bool
+	sequential map[uint64]bool
+	workerC    chan struct{}
+	sync.Mutex
+}
+
+func newReadAheadCache(capacity int) *readAheadCache {
+	return &readAheadCache{
+		capacity:   capacity,
+		blocks:     make(map[blockKey]*cacheBlock),
+		lru:        list.New(),
+		pending:    make(map[blockKey]bool),
+		sequential: make(map[uint64]bool),
+		workerC:    make(chan struct{}, ReadAheadWorkers),
+	}
+}
+
+func (ra *readAheadCache) enabled() bool {
+	return ra != nil && ra.capacity > 0
+}
+
+/*copy the range from the cached blocks, ok is false unless the whole range is cached, the end of file is always read from the dataNodes*/
+func (ra *readAheadCache) read(inode uint64, data []byte, offset, size int) (ok bool) {
+	ra.Lock()
+	defer ra.Unlock()
+	now := time.Now()
+	blocks := make([]*cacheBlock, 0, size/ReadAheadBlockSize+2)
+	for pos := offset; pos < offset+size; pos = (pos/ReadAheadBlockSize + 1) * ReadAheadBlockSize {
+		b, found := ra.blocks[blockKey{inode, pos / ReadAheadBlockSize}]
+		if !found || now.After(b.expire) {
+			return false
+		}
+		end := (pos/ReadAheadBlockSize)*ReadAheadBlockSize + len(b.data)
+		if end < offset+size && len(b.data) < ReadAheadBlockSize {
+			return false
+		}
+		blocks = append(blocks, b)
+	}
+	read := 0
+	for _, b := range blocks {
+		inBlock := (offset + read) % ReadAheadBlockSize
+		read += copy(data[read:size], b.data[inBlock:])
+		ra.lru.MoveToFront(b.elem)
+	}
+	return true
+}
+
+/*the indexes of the blocks of the range which are neither cached nor being fetched, they are marked pending*/
+func (ra *readAheadCache) reserve(inode uint64, offset, size int) (indexes []int) {
+	ra.Lock()
+	defer ra.Unlock()
+	now := time.Now()
+	last := (offset + size - 1) / ReadAheadBlockSize
+	for index := offset / ReadAheadBlockSize; index <= last && len(indexes) < ra.capacity; index++ {
+		key := blockKey{inode, index}
+		if b, found := ra.blocks[key]; (found && now.Before(b.expire)) || ra.pending[key] {
+			continue
+		}
+		ra.pending[key] = true
+		indexes = append(indexes, index)
+	}
+	return
+}
+
+func (ra *readAheadCache) put(inode uint64, index int, data []byte) {
+	ra.Lock()
+	defer ra.Unlock()
+	key := blockKey{inode, index}
+	if !ra.pending[key] {
+		// dropped by a write or a hint while being fetched
+		return
+	}
+	delete(ra.pending, key)
+	if b, found := ra.blocks[key]; found {
+		ra.remove(b)
+	}
+	b := &cacheBlock{key: key, data: data, expire: time.Now().Add(ReadAheadBlockExpire)}
+	b.elem = ra.lru.PushFront(b)
+	ra.blocks[key] = b
+	for ra.lru.Len() > ra.capacity {
+		ra.remove(ra.lru.Back().Value.(*cacheBlock))
+	}
+}
+
+func (ra *readAheadCache) cancel(inode uint64, indexes []int) {
+	ra.Lock()
+	defer ra.Unlock()
+	for _, index := range indexes {
+		delete(ra.pending, blockKey{inode, index})
+	}
+}
+
+/*the caller must hold the lock of ra*/
+func (ra *readAheadCache) remove(b *cacheBlock) {
+	ra.lru.Remove(b.elem)
+	delete(ra.blocks, b.key)
+}
+
+/*drop the blocks overlapping the range of the inode, a non positive size drops up to the end of file*/
+func (ra *readAheadCache) drop(inode uint64, offset, size int) {
+	ra.Lock()
+	defer ra.Unlock()
+	first := offset / ReadAheadBlockSize
+	last := -1
+	if size > 0 {
+		last = (offset + size - 1) / ReadAheadBlockSize
+	}
+	inRange := func(key blockKey) bool {
+		return key.inode == inode && key.index >= first && (last < 0 || key.index <= last)
+	}
+	for key, b := range ra.blocks {
+		if inRange(key) {
+			ra.remove(b)
+		}
+	}
+	for key := range ra.pending {
+		if inRange(key) {
+			delete(ra.pending, key)
+		}
+	}
+}
+
+func (ra *readAheadCache) setSequential(inode uint64, sequential bool) {
+	ra.Lock()
+	defer ra.Unlock()
+	if sequential {
+		ra.sequential[inode] = true
+	} else {
+		delete(ra.sequential, inode)
+	}
+}
+
+func (ra *readAheadCache) isSequential(inode uint64) bool {
+	ra.Lock()
+	defer ra.Unlock()
+	return ra.sequential[inode]
+}
+
+// SetReadAheadCache sets the number of blocks of ReadAheadBlockSize kept by
+// the read ahead cache, zero disables the cache and the prefetch hints.
+func (client *ExtentClient) SetReadAheadCache(blocks int) {
+	if blocks <= 0 {
+		client.readAhead = nil
+		return
+	}
+	client.readAhead = newReadAheadCache(blocks)
+}
+
+// Advise applies a posix_fadvise hint to the range of the inode, a non
+// positive size means up to the end of file. The hints are advisory, they
+// are ignored if the read ahead cache is disabled.
+func (client *ExtentClient) Advise(inode uint64, advice int, offset, size int) (err error) {
+	ra := client.readAhead
+	if !ra.enabled() {
+		return
+	}
+	switch advice {
+	case AdviceNormal, AdviceRandom:
+		ra.setSequential(inode, false)
+	case AdviceSequential:
+		ra.setSequential(inode, true)
+	case AdviceWillNeed:
+		err = client.Prefetch(inode, offset, size)
+	case AdviceDontNeed:
+		ra.drop(inode, offset, size)
+	default:
+		err = errors.Errorf("unknown advice(%v)", advice)
+	}
+	return
+}
+
+// Prefetch reads the range of the inode into the read ahead cache in the
+// background, a non positive size means up to the end of file. At most the
+// capacity of the cache is prefetched, the reads of the range which find its
+// blocks cached are served without any request to the dataNodes.
+func (client *ExtentClient) Prefetch(inode uint64, offset, size int) (err error) {
+	ra := client.readAhead
+	if !ra.enabled() || offset < 0 {
+		return
+	}
+	var stream *StreamReader
+	if stream, err = client.OpenForRead(inode); err != nil {
+		return
+	}
+	if fileSize := int(stream.fileSize); size <= 0 || offset+size > fileSize {
+		size = fileSize - offset
+	}
+	if size <= 0 {
+		return
+	}
+	if indexes := ra.reserve(inode, offset, size); len(indexes) != 0 {
+		client.prefetch(stream, inode, indexes)
+	}
+	return
+}
+
+/*fetch the reserved blocks in the background by the stream, which is not shared with any other reads*/
+func (client *ExtentClient) prefetch(stream *StreamReader, inode uint64, indexes []int) {
+	ra := client.readAhead
+	go func() {
+		ra.workerC <- struct{}{}
+		defer func() {
+			<-ra.workerC
+		}()
+		// the writes before the flush are read, a write after it drops the
+		// pending blocks so that no stale block is cached
+		if err := client.Flush(inode); err != nil {
+			log.LogWarnf("prefetch: ino(%v) flush err(%v)", inode, err)
+			ra.cancel(inode, indexes)
+			return
+		}
+		for i, index := range indexes {
+			data := make([]byte, ReadAheadBlockSize)
+			read, err := stream.read(data, index*ReadAheadBlockSize, ReadAheadBlockSize)
+			if err != nil && err != io.EOF {
+				log.LogWarnf("prefetch: ino(%v) block(%v) err(%v)", inode, index, err)
+				ra.cancel(inode, indexes[i:])
+				return
+			}
+			if read == 0 {
+				ra.cancel(inode, indexes[i:])
+				return
+			}
+			ra.put(inode, index, data[:read])
+			if read < ReadAheadBlockSize {
+				ra.cancel(inode, indexes[i+1:])
+				return
+			}
+		}
+	}()
+}
+
+/*read ahead of a read of a sequential file up to the file size known by the reader*/
+func (client *ExtentClient) readAheadOf(inode uint64, end, fileSize int) {
+	ra := client.readAhead
+	if !ra.isSequential(inode) {
+		return
+	}
+	size := ReadAheadWindowBlocks * ReadAheadBlockSize
+	if end+size > fileSize {
+		size = fileSize - end
+	}
+	if size <= 0 {
+		return
+	}
+	indexes := ra.reserve(inode, end, size)
+	if len(indexes) == 0 {
+		return
+	}
+	stream, err := client.OpenForRead(inode)
+	if err != nil {
+		ra.cancel(inode, indexes)
+		return
+	}
+	client.prefetch(stream, inode, indexes)
+}
@@ -0,0 +1,87 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package stream
+
+import (
+	"bytes"
+	"testing"
+)
+
+func putBlock(ra *readAheadCache, inode uint64, index int, data []byte) {
+	ra.reserve(inode, index*ReadAheadBlockSize, 1)
+	ra.put(inode, index, data)
+}
+
+func TestReadAheadCache_Read(t *testing.T) {
+	ra := newReadAheadCache(4)
+	full := bytes.Repeat([]byte{1}, ReadAheadBlockSize)
+	last := bytes.Repeat([]byte{2}, 100)
+	putBlock(ra, 1, 0, full)
+	putBlock(ra, 1, 1, last)
+
+	data := make([]byte, 200)
+	if !ra.read(1, data, ReadAheadBlockSize-100, 200) {
+		t.Fatalf("read across the cached blocks missed")
+	}
+	if !bytes.Equal(data[:100], full[:100]) || !bytes.Equal(data[100:], last[:100]) {
+		t.Fatalf("read across the cached blocks got wrong data")
+	}
+	if ra.read(1, data, ReadAheadBlockSize+50, 100) {
+		t.Fatalf("read beyond the last cached block hit")
+	}
+	if ra.read(2, data, 0, 100) {
+		t.Fatalf("read of another inode hit")
+	}
+	if indexes := ra.reserve(1, 0, 3*ReadAheadBlockSize); len(indexes) != 1 || indexes[0] != 2 {
+		t.Fatalf("reserve with blocks 0,1 cached: %v", indexes)
+	}
+	if indexes := ra.reserve(1, 2*ReadAheadBlockSize, 1); len(indexes) != 0 {
+		t.Fatalf("reserve of a pending block: %v", indexes)
+	}
+}
+
+func TestReadAheadCache_Drop(t *testing.T) {
+	ra := newReadAheadCache(4)
+	block := make([]byte, ReadAheadBlockSize)
+	for index := 0; index < 3; index++ {
+		putBlock(ra, 1, index, block)
+	}
+	indexes := ra.reserve(1, 3*ReadAheadBlockSize, 1)
+	ra.drop(1, ReadAheadBlockSize, 0)
+	ra.put(1, indexes[0], block)
+	if !ra.read(1, block, 0, 10) {
+		t.Fatalf("block before the dropped range missed")
+	}
+	for index := 1; index < 4; index++ {
+		if ra.read(1, block, index*ReadAheadBlockSize, 10) {
+			t.Fatalf("dropped block(%v) hit", index)
+		}
+	}
+}
+
+func TestReadAheadCache_Evict(t *testing.T) {
+	ra := newReadAheadCache(2)
+	block := make([]byte, ReadAheadBlockSize)
+	putBlock(ra, 1, 0, block)
+	putBlock(ra, 1, 1, block)
+	ra.read(1, block, 0, 10)
+	putBlock(ra, 1, 2, block)
+	if !ra.read(1, block, 0, 10) || ra.read(1, block, ReadAheadBlockSize, 10) {
+		t.Fatalf("the least recently used block is not evicted")
+	}
+	if len(ra.blocks) != 2 || ra.lru.Len() != 2 {
+		t.Fatalf("cache of capacity 2 holds %v blocks", len(ra.blocks))
+	}
+}
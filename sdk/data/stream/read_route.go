@@ -0,0 +1,100 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package stream
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/sdk/data/wrapper"
+)
+
+const (
+	SlowReadThreshold     = 200 * time.Millisecond //a near read slower than it puts the replica on hold
+	UnhealthyHostDuration = 30 * time.Second
+)
+
+var (
+	localZone   atomic.Value // string
+	hostHealths = newHostHealth(UnhealthyHostDuration)
+)
+
+func getLocalZone() string {
+	zone, _ := localZone.Load().(string)
+	return zone
+}
+
+// the watermark of the extent last got from a near replica, the later reads
+// under it need no new round trip
+type nearWatermark struct {
+	host string
+	size uint64
+}
+
+// the replicas which failed or were slow to read recently, they are not
+// preferred for the reads until the hold expires
+type hostHealth struct {
+	hold      time.Duration
+	unhealthy map[string]time.Time
+	sync.RWMutex
+}
+
+func newHostHealth(hold time.Duration) *hostHealth {
+	return &hostHealth{hold: hold, unhealthy: make(map[string]time.Time)}
+}
+
+func (h *hostHealth) markFailed(host string) {
+	h.Lock()
+	h.unhealthy[host] = time.Now().Add(h.hold)
+	h.Unlock()
+}
+
+func (h *hostHealth) markHealthy(host string) {
+	h.Lock()
+	delete(h.unhealthy, host)
+	h.Unlock()
+}
+
+func (h *hostHealth) isHealthy(host string) bool {
+	h.RLock()
+	until, ok := h.unhealthy[host]
+	h.RUnlock()
+	if !ok {
+		return true
+	}
+	if time.Now().Before(until) {
+		return false
+	}
+	h.markHealthy(host)
+	return true
+}
+
+/*the index of a healthy follower in zone, -1 if the leader is in zone or there is none*/
+func nearReplicaIndex(dp *wrapper.DataPartition, zone string, health *hostHealth) int {
+	if zone == "" || dp.PartitionType != proto.ExtentPartition || len(dp.Zones) != len(dp.Hosts) {
+		return -1
+	}
+	if dp.Zones[0] == zone {
+		return -1
+	}
+	for index := 1; index < len(dp.Hosts); index++ {
+		if dp.Zones[index] == zone && health.isHealthy(dp.Hosts[index]) {
+			return index
+		}
+	}
+	return -1
+}
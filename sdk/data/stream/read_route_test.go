@@ -0,0 +1,65 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package stream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/sdk/data/wrapper"
+)
+
+func TestNearReplicaIndex(t *testing.T) {
+	health := newHostHealth(time.Hour)
+	dp := &wrapper.DataPartition{
+		PartitionType: proto.ExtentPartition,
+		Hosts:         []string{"a:1", "b:1", "c:1"},
+		Zones:         []string{"z1", "z2", "z2"},
+	}
+	if index := nearReplicaIndex(dp, "z1", health); index != -1 {
+		t.Fatalf("leader in the zone of the client: %v", index)
+	}
+	if index := nearReplicaIndex(dp, "z2", health); index != 1 {
+		t.Fatalf("first follower in the zone: %v", index)
+	}
+	health.markFailed("b:1")
+	if index := nearReplicaIndex(dp, "z2", health); index != 2 {
+		t.Fatalf("follower on hold not skipped: %v", index)
+	}
+	health.markFailed("c:1")
+	if index := nearReplicaIndex(dp, "z2", health); index != -1 {
+		t.Fatalf("all followers in the zone on hold: %v", index)
+	}
+	if index := nearReplicaIndex(dp, "", health); index != -1 {
+		t.Fatalf("client without zone: %v", index)
+	}
+	dp.Zones = nil
+	if index := nearReplicaIndex(dp, "z2", health); index != -1 {
+		t.Fatalf("partition without zones: %v", index)
+	}
+}
+
+func TestHostHealth_Expire(t *testing.T) {
+	health := newHostHealth(10 * time.Millisecond)
+	health.markFailed("a:1")
+	if health.isHealthy("a:1") {
+		t.Fatalf("host healthy right after the failure")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if !health.isHealthy("a:1") {
+		t.Fatalf("host still on hold after the hold expired")
+	}
+}
@@ -41,12 +41,14 @@ type StreamReader struct {
 	getExtents GetExtentsFunc
 	extents    *proto.StreamKey
 	fileSize   uint64
+	client     *ExtentClient
 }
 
-func NewStreamReader(inode uint64, getExtents GetExtentsFunc) (stream *StreamReader, err error) {
+func NewStreamReader(client *ExtentClient, inode uint64) (stream *StreamReader, err error) {
 	stream = new(StreamReader)
 	stream.inode = inode
-	stream.getExtents = getExtents
+	stream.client = client
+	stream.getExtents = client.getExtents
 	stream.extents = proto.NewStreamKey(inode)
 	stream.extents.Extents, err = stream.getExtents(inode)
 	if err != nil {
@@ -55,7 +57,7 @@ func NewStreamReader(inode uint64, getExtents GetExtentsFunc) (stream *StreamRea
 	var offset int
 	var reader *ExtentReader
 	for _, key := range stream.extents.Extents {
-		if reader, err = NewExtentReader(inode, offset, key); err != nil {
+		if reader, err = NewExtentReader(stream.client, inode, offset, key); err != nil {
 			return nil, errors.Annotatef(err, "NewStreamReader inode(%v) "+
 				"key(%v) dp not found error", inode, key)
 		}
@@ -115,7 +117,7 @@ func (stream *StreamReader) updateLocalReader(newStreamKey *proto.StreamKey) (er
 			newOffSet += int(key.Size)
 			continue
 		} else if index > oldReaderCnt-1 {
-			if r, err = NewExtentReader(stream.inode, newOffSet, key); err != nil {
+			if r, err = NewExtentReader(stream.client, stream.inode, newOffSet, key); err != nil {
 				return errors.Annotatef(err, "NewStreamReader inode(%v) key(%v) "+
 					"dp not found error", stream.inode, key)
 			}
@@ -22,7 +22,9 @@ import (
 	"github.com/juju/errors"
 	"github.com/tiglabs/containerfs/proto"
 	"github.com/tiglabs/containerfs/sdk/data/wrapper"
+	"github.com/tiglabs/containerfs/util"
 	"github.com/tiglabs/containerfs/util/log"
+	"github.com/tiglabs/containerfs/util/trace"
 	"net"
 	"strings"
 	"sync/atomic"
@@ -42,6 +44,7 @@ type WriteRequest struct {
 	kernelOffset int
 	cutSize      int
 	done         chan struct{}
+	trace        trace.SpanContext
 }
 
 type FlushRequest struct {
@@ -49,6 +52,11 @@ type FlushRequest struct {
 	done chan struct{}
 }
 
+type SyncRequest struct {
+	err  error
+	done chan struct{}
+}
+
 type CloseRequest struct {
 	err  error
 	done chan struct{}
@@ -68,17 +76,23 @@ type StreamWriter struct {
 	hasWriteSize            uint64
 	hasClosed               int32
 	hasUpdateToMetaNodeSize uint64
+	unsyncedExtents         map[string]proto.ExtentKey //extents updated to metanode but not synchronized to disk
+	preallocEnd             uint64                     //the file offset the extents created are preallocated up to
+	againCnt                int                        //recoveries of the writes throttled in a row, for the backoff
+	client                  *ExtentClient
 }
 
-func NewStreamWriter(inode, start uint64, appendExtentKey AppendExtentKeyFunc) (stream *StreamWriter) {
+func NewStreamWriter(client *ExtentClient, inode, start uint64) (stream *StreamWriter) {
 	stream = new(StreamWriter)
-	stream.appendExtentKey = appendExtentKey
+	stream.client = client
+	stream.appendExtentKey = client.appendExtentKey
 	stream.Inode = inode
 	stream.setHasWriteSize(start)
 	stream.requestCh = make(chan interface{}, 1000)
 	stream.exitCh = make(chan bool, 10)
 	stream.excludePartition = make([]uint32, 0)
 	stream.hasUpdateKey = make(map[string]int, 0)
+	stream.unsyncedExtents = make(map[string]proto.ExtentKey, 0)
 	go stream.server()
 
 	return
@@ -157,12 +171,18 @@ func (stream *StreamWriter) handleRequest(request interface{}) {
 				request.cutSize = cutSize
 			}
 		}
-		request.canWrite, request.err = stream.write(request.data, request.kernelOffset, request.size)
+		request.canWrite, request.err = stream.write(request.data, request.kernelOffset, request.size, request.trace)
 		stream.addHasWriteSize(request.canWrite)
 		request.done <- struct{}{}
 	case *FlushRequest:
 		request.err = stream.flushCurrExtentWriter()
 		request.done <- struct{}{}
+	case *SyncRequest:
+		request.err = stream.flushCurrExtentWriter()
+		if request.err == nil {
+			request.err = stream.syncExtents()
+		}
+		request.done <- struct{}{}
 	case *CloseRequest:
 		request.err = stream.flushCurrExtentWriter()
 		if request.err == nil {
@@ -174,7 +194,7 @@ func (stream *StreamWriter) handleRequest(request interface{}) {
 	}
 }
 
-func (stream *StreamWriter) write(data []byte, offset, size int) (total int, err error) {
+func (stream *StreamWriter) write(data []byte, offset, size int, sc trace.SpanContext) (total int, err error) {
 	var (
 		write int
 	)
@@ -198,7 +218,7 @@ func (stream *StreamWriter) write(data []byte, offset, size int) (total int, err
 			}
 			continue
 		}
-		write, err = stream.currentWriter.write(data[total:size], offset, size-total)
+		write, err = stream.currentWriter.write(data[total:size], offset, size-total, sc)
 		if err == nil {
 			write = size - total
 			total += write
@@ -305,6 +325,11 @@ func (stream *StreamWriter) updateToMetaNode() (err error) {
 			stream.exit()
 			return
 		}
+		if err == syscall.EFBIG {
+			// the file reached the max file size of the vol, a retry is refused again
+			log.LogErrorf("stream(%v) extent(%v) refused: file too large", stream.toString(), ek.Size)
+			return
+		}
 		if err != nil {
 			err = errors.Annotatef(err, "update extent(%v) to MetaNode Failed", ek.Size)
 			log.LogErrorf("stream(%v) err(%v)", stream.toString(), err.Error())
@@ -312,6 +337,7 @@ func (stream *StreamWriter) updateToMetaNode() (err error) {
 		}
 		stream.addHasUpdateToMetaNodeSize(int(ek.Size) - lastUpdateSize)
 		stream.hasUpdateKey[updateKey] = int(ek.Size)
+		stream.unsyncedExtents[updateKey] = ek
 		return
 	}
 
@@ -322,7 +348,10 @@ func (stream *StreamWriter) writeRecoverPackets(writer *ExtentWriter, retryPacke
 	for _, p := range retryPackets {
 		log.LogInfof("recover packet (%v) kernelOffset(%v) to extent(%v)",
 			p.GetUniqueLogId(), p.kernelOffset, writer.toString())
-		_, err = writer.write(p.Data, p.kernelOffset, int(p.Size))
+		// the span of the packet lost ends, the packet written again gets one of the trace
+		p.span.SetAttribute("recovered", true)
+		p.span.End()
+		_, err = writer.write(p.Data, p.kernelOffset, int(p.Size), p.trace)
 		if err != nil {
 			err = errors.Annotatef(err, "pkg(%v) RecoverExtent write failed", p.GetUniqueLogId())
 			log.LogErrorf("stream(%v) err(%v)", stream.toStringWithWriter(writer), err.Error())
@@ -334,6 +363,13 @@ func (stream *StreamWriter) writeRecoverPackets(writer *ExtentWriter, retryPacke
 }
 
 func (stream *StreamWriter) recoverExtent() (err error) {
+	if stream.currentWriter.isThrottled() {
+		// the data node throttled the writes, back off before writing to a new extent
+		time.Sleep(againBackoff(stream.againCnt))
+		stream.againCnt++
+	} else {
+		stream.againCnt = 0
+	}
 	stream.excludePartition = append(stream.excludePartition, stream.currentWriter.dp.PartitionID) //exclude current PartionId
 	stream.currentWriter.notifyExit()
 	retryPackets := stream.currentWriter.getNeedRetrySendPackets() //get need retry recover packets
@@ -372,7 +408,7 @@ func (stream *StreamWriter) allocateNewExtentWriter() (writer *ExtentWriter, err
 	)
 	err = fmt.Errorf("cannot alloct new extent after maxrery")
 	for i := 0; i < MaxSelectDataPartionForWrite; i++ {
-		if dp, err = gDataWrapper.GetWriteDataPartition(stream.excludePartition); err != nil {
+		if dp, err = stream.client.dataWrapper.GetWriteDataPartition(stream.excludePartition); err != nil {
 			log.LogWarn(fmt.Sprintf("stream (%v) ActionAllocNewExtentWriter "+
 				"failed on getWriteDataPartion,error(%v) execludeDataPartion(%v)", stream.toString(), err.Error(), stream.excludePartition))
 			continue
@@ -382,7 +418,7 @@ func (stream *StreamWriter) allocateNewExtentWriter() (writer *ExtentWriter, err
 				"create Extent,error(%v) execludeDataPartion(%v)", stream.toString(), err.Error(), stream.excludePartition))
 			continue
 		}
-		if writer, err = NewExtentWriter(stream.Inode, dp, extentId); err != nil {
+		if writer, err = NewExtentWriter(stream.client, stream.Inode, dp, extentId); err != nil {
 			log.LogWarn(fmt.Sprintf("stream (%v) ActionAllocNewExtentWriter "+
 				"NewExtentWriter(%v),error(%v) execludeDataPartion(%v)", stream.toString(), extentId, err.Error(), stream.excludePartition))
 			continue
@@ -402,18 +438,15 @@ func (stream *StreamWriter) allocateNewExtentWriter() (writer *ExtentWriter, err
 
 func (stream *StreamWriter) createExtent(dp *wrapper.DataPartition) (extentId uint64, err error) {
 	var (
-		connect *net.TCPConn
+		connect net.Conn
 	)
-	conn, err := net.DialTimeout("tcp", dp.Hosts[0], time.Second)
+	connect, err = stream.client.conns.Dial(dp.Hosts[0], time.Second)
 	if err != nil {
 		err = errors.Annotatef(err, " get connect from datapartionHosts(%v)", dp.Hosts[0])
 		return 0, err
 	}
-	connect, _ = conn.(*net.TCPConn)
-	connect.SetKeepAlive(true)
-	connect.SetNoDelay(true)
 	defer connect.Close()
-	p := NewCreateExtentPacket(dp, stream.Inode)
+	p := NewCreateExtentPacket(dp, stream.Inode, stream.preallocSize())
 	if err = p.WriteToConn(connect); err != nil {
 		err = errors.Annotatef(err, "send CreateExtent(%v) to datapartionHosts(%v)", p.GetUniqueLogId(), dp.Hosts[0])
 		return
@@ -437,6 +470,61 @@ func (stream *StreamWriter) createExtent(dp *wrapper.DataPartition) (extentId ui
 	return extentId, nil
 }
 
+/*the bytes to preallocate for a new extent, up to the end fallocated or the size of an extent*/
+func (stream *StreamWriter) preallocSize() (size int64) {
+	end := atomic.LoadUint64(&stream.preallocEnd)
+	written := stream.getHasWriteSize()
+	if end <= written {
+		return 0
+	}
+	if size = int64(end - written); size > util.ExtentSize {
+		size = util.ExtentSize
+	}
+	return
+}
+
+//sync the flushed extents to disk on all the replicas of their data partitions
+func (stream *StreamWriter) syncExtents() (err error) {
+	for key, ek := range stream.unsyncedExtents {
+		var dp *wrapper.DataPartition
+		if dp, err = stream.client.dataWrapper.GetDataPartition(ek.PartitionId); err != nil {
+			return errors.Annotatef(err, "SyncExtent(%v) inode(%v)", ek.String(), stream.Inode)
+		}
+		if err = stream.syncExtent(dp, ek.ExtentId); err != nil {
+			return errors.Annotatef(err, "SyncExtent(%v) inode(%v)", ek.String(), stream.Inode)
+		}
+		delete(stream.unsyncedExtents, key)
+	}
+	return
+}
+
+func (stream *StreamWriter) syncExtent(dp *wrapper.DataPartition, extentId uint64) (err error) {
+	var (
+		connect net.Conn
+	)
+	connect, err = stream.client.conns.Dial(dp.Hosts[0], time.Second)
+	if err != nil {
+		err = errors.Annotatef(err, " get connect from datapartionHosts(%v)", dp.Hosts[0])
+		return
+	}
+	defer connect.Close()
+	p := NewSyncExtentPacket(dp, extentId)
+	if err = p.WriteToConn(connect); err != nil {
+		err = errors.Annotatef(err, "send SyncExtent(%v) to datapartionHosts(%v)", p.GetUniqueLogId(), dp.Hosts[0])
+		return
+	}
+	if err = p.ReadFromConn(connect, proto.ReadDeadlineTime*2); err != nil {
+		err = errors.Annotatef(err, "receive SyncExtent(%v) failed datapartionHosts(%v)", p.GetUniqueLogId(), dp.Hosts[0])
+		return
+	}
+	if p.ResultCode != proto.OpOk {
+		err = fmt.Errorf("receive SyncExtent(%v) failed datapartionHosts(%v) result(%v)",
+			p.GetUniqueLogId(), dp.Hosts[0], string(p.Data[:p.Size]))
+		return
+	}
+	return
+}
+
 func (stream *StreamWriter) exit() {
 	select {
 	case stream.exitCh <- true:
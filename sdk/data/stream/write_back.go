@@ -0,0 +1,299 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package stream
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	WriteBackChunkSize       = 1 << 20 //dirty bytes of a file flushed at once
+	WriteBackExpire          = time.Second
+	DefaultWriteBackFlushers = 4
+)
+
+type WriteBackFunc func(inode uint64, offset int, data []byte) error
+
+type dirtyRange struct {
+	offset int
+	data   []byte
+}
+
+// the dirty data of a file, the ranges are kept in the order of the writes so
+// that an overwrite is flushed after the data it overwrites
+type writeBackFile struct {
+	inode      uint64
+	ranges     []*dirtyRange
+	dirty      int
+	size       int
+	dirtySince time.Time
+	queued     bool
+	err        error //the first error of the flushes, reported by the next barrier
+	flushLock  sync.Mutex
+}
+
+// writeBackCache copies the writes into memory and returns at once, the
+// background flushers coalesce the small sequential writes of a file into
+// chunks of WriteBackChunkSize before they go to the stream writer. The
+// flushers start once a file has a chunk dirty, its dirty data is older than
+// WriteBackExpire or half of maxDirty is dirty, and the writes block while
+// maxDirty is dirty. The flush, fsync and close of a file are barriers which
+// wait for the flush of its dirty data and return the errors of the flushes.
+type writeBackCache struct {
+	maxDirty int
+	dirty    int
+	files    map[uint64]*writeBackFile
+	flushC   chan *writeBackFile
+	write    WriteBackFunc
+	cond     *sync.Cond
+	stopC    chan struct{}
+	stopped  bool
+	sync.Mutex
+}
+
+func newWriteBackCache(maxDirty, flushers int, write WriteBackFunc) (wb *writeBackCache) {
+	if flushers <= 0 {
+		flushers = DefaultWriteBackFlushers
+	}
+	wb = &writeBackCache{
+		maxDirty: maxDirty,
+		files:    make(map[uint64]*writeBackFile),
+		flushC:   make(chan *writeBackFile, 1024),
+		write:    write,
+		stopC:    make(chan struct{}),
+	}
+	wb.cond = sync.NewCond(&wb.Mutex)
+	for i := 0; i < flushers; i++ {
+		go wb.flusher()
+	}
+	go wb.expire()
+	return
+}
+
+func (wb *writeBackCache) enabled() bool {
+	return wb != nil && wb.maxDirty > 0
+}
+
+/*copy the data into the dirty ranges of the inode, block while the cache is full*/
+func (wb *writeBackCache) put(inode uint64, offset int, data []byte) (err error) {
+	wb.Lock()
+	for !wb.stopped && wb.dirty > 0 && wb.dirty+len(data) > wb.maxDirty {
+		wb.queueAll()
+		wb.cond.Wait()
+	}
+	if wb.stopped {
+		wb.Unlock()
+		// the cache is replaced, the write goes to the stream writer directly
+		return wb.write(inode, offset, data)
+	}
+	defer wb.Unlock()
+	f, ok := wb.files[inode]
+	if !ok {
+		f = &writeBackFile{inode: inode}
+		wb.files[inode] = f
+	}
+	if f.err != nil {
+		return f.err
+	}
+	if f.dirty == 0 {
+		f.dirtySince = time.Now()
+	}
+	if n := len(f.ranges); n > 0 && f.ranges[n-1].offset+len(f.ranges[n-1].data) == offset &&
+		len(f.ranges[n-1].data)+len(data) <= WriteBackChunkSize {
+		f.ranges[n-1].data = append(f.ranges[n-1].data, data...)
+	} else {
+		f.ranges = append(f.ranges, &dirtyRange{offset: offset, data: append([]byte(nil), data...)})
+	}
+	f.dirty += len(data)
+	wb.dirty += len(data)
+	if end := offset + len(data); end > f.size {
+		f.size = end
+	}
+	if f.dirty >= WriteBackChunkSize {
+		wb.queue(f)
+	}
+	if wb.dirty >= wb.maxDirty/2 {
+		wb.queueAll()
+	}
+	return
+}
+
+/*the caller must hold the lock of wb*/
+func (wb *writeBackCache) queue(f *writeBackFile) {
+	if f.queued || f.dirty == 0 {
+		return
+	}
+	select {
+	case wb.flushC <- f:
+		f.queued = true
+	default:
+		// the flushers are busy, the file is queued again by the next write or check
+	}
+}
+
+/*the caller must hold the lock of wb*/
+func (wb *writeBackCache) queueAll() {
+	for _, f := range wb.files {
+		wb.queue(f)
+	}
+}
+
+func (wb *writeBackCache) flusher() {
+	for {
+		select {
+		case <-wb.stopC:
+			return
+		case f := <-wb.flushC:
+			wb.Lock()
+			f.queued = false
+			wb.Unlock()
+			wb.flushFile(f)
+		}
+	}
+}
+
+func (wb *writeBackCache) expire() {
+	ticker := time.NewTicker(WriteBackExpire / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-wb.stopC:
+			return
+		case <-ticker.C:
+		}
+		wb.Lock()
+		now := time.Now()
+		for _, f := range wb.files {
+			if f.dirty > 0 && now.Sub(f.dirtySince) >= WriteBackExpire {
+				wb.queue(f)
+			}
+		}
+		wb.Unlock()
+	}
+}
+
+/*write the dirty ranges of the file to the stream writer in order, the flushes of a file are serialized by its flushLock*/
+func (wb *writeBackCache) flushFile(f *writeBackFile) {
+	f.flushLock.Lock()
+	defer f.flushLock.Unlock()
+	wb.Lock()
+	ranges := f.ranges
+	f.ranges = nil
+	failed := f.err != nil
+	wb.Unlock()
+	var err error
+	flushed := 0
+	for _, r := range ranges {
+		// the ranges after a failed one are dropped, the error is reported by the barrier
+		if !failed && err == nil {
+			if err = wb.write(f.inode, r.offset, r.data); err != nil {
+				log.LogErrorf("writeBack: inode(%v) offset(%v) size(%v) err(%v)", f.inode, r.offset, len(r.data), err)
+			}
+		}
+		flushed += len(r.data)
+	}
+	wb.Lock()
+	if err != nil && f.err == nil {
+		f.err = err
+	}
+	f.dirty -= flushed
+	wb.dirty -= flushed
+	if f.dirty > 0 {
+		f.dirtySince = time.Now()
+	}
+	wb.cond.Broadcast()
+	wb.Unlock()
+}
+
+/*flush the dirty data of the inode and wait for it, the errors are kept for the barrier*/
+func (wb *writeBackCache) flush(inode uint64) {
+	wb.Lock()
+	f, ok := wb.files[inode]
+	wb.Unlock()
+	if ok {
+		wb.flushFile(f)
+	}
+}
+
+/*flush the dirty data of the inode and return the first error of its flushes since the last barrier*/
+func (wb *writeBackCache) barrier(inode uint64) (err error) {
+	wb.Lock()
+	f, ok := wb.files[inode]
+	wb.Unlock()
+	if !ok {
+		return
+	}
+	wb.flushFile(f)
+	wb.Lock()
+	defer wb.Unlock()
+	err = f.err
+	f.err = nil
+	if f.dirty == 0 && len(f.ranges) == 0 {
+		delete(wb.files, inode)
+	}
+	return
+}
+
+/*flush the dirty data of all the files and stop the flushers, the errors of the flushes are only logged*/
+func (wb *writeBackCache) stop() {
+	wb.Lock()
+	wb.stopped = true
+	files := make([]*writeBackFile, 0, len(wb.files))
+	for _, f := range wb.files {
+		files = append(files, f)
+	}
+	wb.Unlock()
+	for _, f := range files {
+		wb.flushFile(f)
+	}
+	close(wb.stopC)
+}
+
+/*the end of the dirty data of the inode, zero if it has none*/
+func (wb *writeBackCache) dirtySize(inode uint64) uint64 {
+	wb.Lock()
+	defer wb.Unlock()
+	if f, ok := wb.files[inode]; ok {
+		return uint64(f.size)
+	}
+	return 0
+}
+
+// SetWriteBack sets the dirty bytes kept by the write back cache and the
+// number of its flushers, zero disables the cache and the writes go to the
+// stream writer directly. The cache replaced is flushed and its flushers
+// are stopped, so it is also set to zero once the mount is closed.
+func (client *ExtentClient) SetWriteBack(maxDirty, flushers int) {
+	var wb *writeBackCache
+	if maxDirty > 0 {
+		wb = newWriteBackCache(maxDirty, flushers, client.write)
+	}
+	client.writeBackLock.Lock()
+	old := client.writeBack
+	client.writeBack = wb
+	client.writeBackLock.Unlock()
+	if old != nil {
+		old.stop()
+	}
+}
+
+func (client *ExtentClient) getWriteBack() *writeBackCache {
+	client.writeBackLock.RLock()
+	defer client.writeBackLock.RUnlock()
+	return client.writeBack
+}
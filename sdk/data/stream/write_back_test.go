@@ -0,0 +1,138 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeFile struct {
+	data   []byte
+	writes int
+	err    error
+	sync.Mutex
+}
+
+func (f *fakeFile) write(inode uint64, offset int, data []byte) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	f.writes++
+	if end := offset + len(data); end > len(f.data) {
+		f.data = append(f.data, make([]byte, end-len(f.data))...)
+	}
+	copy(f.data[offset:], data)
+	return nil
+}
+
+func TestWriteBackCache_Coalesce(t *testing.T) {
+	f := &fakeFile{}
+	wb := newWriteBackCache(16*WriteBackChunkSize, 2, f.write)
+	expect := make([]byte, 0)
+	for i := 0; i < 1000; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 4096)
+		if err := wb.put(1, len(expect), data); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+		expect = append(expect, data...)
+	}
+	// an overwrite is flushed after the data it overwrites
+	if err := wb.put(1, 100, []byte("overwrite")); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	copy(expect[100:], "overwrite")
+	if size := wb.dirtySize(1); size != uint64(len(expect)) {
+		t.Fatalf("dirty size %v, expect %v", size, len(expect))
+	}
+	if err := wb.barrier(1); err != nil {
+		t.Fatalf("barrier: %v", err)
+	}
+	if !bytes.Equal(f.data, expect) {
+		t.Fatalf("flushed data differs")
+	}
+	if f.writes > 100 {
+		t.Fatalf("small writes not coalesced: %v writes", f.writes)
+	}
+	if size := wb.dirtySize(1); size != 0 {
+		t.Fatalf("dirty size %v after barrier", size)
+	}
+}
+
+func TestWriteBackCache_Error(t *testing.T) {
+	f := &fakeFile{err: errors.New("write failed")}
+	wb := newWriteBackCache(16*WriteBackChunkSize, 2, f.write)
+	if err := wb.put(1, 0, []byte("data")); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if err := wb.barrier(1); err == nil {
+		t.Fatalf("barrier missed the error of the flush")
+	}
+	if err := wb.barrier(1); err != nil {
+		t.Fatalf("error reported twice: %v", err)
+	}
+}
+
+func TestWriteBackCache_DirtyLimit(t *testing.T) {
+	f := &fakeFile{}
+	f.Lock()
+	wb := newWriteBackCache(2*WriteBackChunkSize, 2, f.write)
+	data := make([]byte, WriteBackChunkSize)
+	wb.put(1, 0, data)
+	wb.put(2, 0, data)
+	done := make(chan struct{})
+	go func() {
+		wb.put(3, 0, data)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatalf("put beyond the dirty limit did not block")
+	case <-time.After(100 * time.Millisecond):
+	}
+	f.Unlock()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("put blocked after the flush")
+	}
+}
+
+func TestWriteBackCache_Stop(t *testing.T) {
+	f := &fakeFile{}
+	wb := newWriteBackCache(16*WriteBackChunkSize, 2, f.write)
+	data := bytes.Repeat([]byte{1}, 4096)
+	if err := wb.put(1, 0, data); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	wb.stop()
+	select {
+	case <-wb.stopC:
+	default:
+		t.Fatalf("flushers not stopped")
+	}
+	if !bytes.Equal(f.data, data) {
+		t.Fatalf("dirty data not flushed by the stop")
+	}
+	// the writes to the stopped cache go through
+	if err := wb.put(1, 4096, data); err != nil || len(f.data) != 8192 {
+		t.Fatalf("put to the stopped cache: err %v size %v", err, len(f.data))
+	}
+}
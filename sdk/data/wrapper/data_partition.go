@@ -12,7 +12,13 @@ type DataPartition struct {
 	ReplicaNum    uint8
 	PartitionType string
 	Hosts         []string
+	ClientHosts   []string
+	Zones         []string
+	Epoch         uint64
+	ArchiveStatus string //not empty if the partition is archived, it is read after the rehydration
+	Releasing     bool   //read only and deleted once the files are migrated off, set by the shrink of vol
 	Metrics       *DataPartitionMetrics
+	rehydrateTime int64
 }
 
 type DataPartitionMetrics struct {
@@ -49,7 +55,7 @@ func (dp *DataPartition) String() string {
 }
 
 func (dp *DataPartition) GetAllAddrs() (m string) {
-	return strings.Join(dp.Hosts[1:], proto.AddrSplit) + proto.AddrSplit
+	return string(proto.ArgWithEpoch(strings.Join(dp.Hosts[1:], proto.AddrSplit)+proto.AddrSplit, dp.Epoch))
 }
 
 func isExcluded(partitionId uint32, excludes []uint32) bool {
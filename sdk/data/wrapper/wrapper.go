@@ -19,8 +19,10 @@ import (
 	"fmt"
 	"math/rand"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tiglabs/containerfs/proto"
@@ -31,8 +33,11 @@ import (
 const (
 	DataPartitionViewUrl        = "/client/dataPartitions"
 	GetClusterInfoURL           = "/admin/getIp"
+	RehydrateDataPartitionUrl   = "/dataPartition/rehydrate"
+	ReportMigratedUrl           = "/client/migrated"
 	ActionGetDataPartitionView  = "ActionGetDataPartitionView"
 	MinWritableDataPartitionNum = 10
+	RehydrateIntervalSeconds    = 60
 )
 
 var (
@@ -83,6 +88,7 @@ func (w *Wrapper) GetClusterName() string {
 }
 func (w *Wrapper) updateClusterInfo() error {
 	masterHelper := util.NewMasterHelper()
+	defer masterHelper.Stop()
 	for _, ip := range w.masters {
 		masterHelper.AddNode(ip)
 	}
@@ -147,7 +153,7 @@ func (w *Wrapper) updateDataPartition() error {
 	for _, dp := range partitions {
 		if dp.Status == proto.ReadWrite {
 			rwPartitionGroups = append(rwPartitionGroups, dp)
-			if strings.Split(dp.Hosts[0], ":")[0] == LocalIP {
+			if util.GetHost(dp.Hosts[0]) == LocalIP {
 				localLeaderPartitionGroups = append(localLeaderPartitionGroups, dp)
 			}
 		}
@@ -162,6 +168,10 @@ func (w *Wrapper) replaceOrInsertPartition(dp *DataPartition) {
 	var (
 		oldstatus int8
 	)
+	// Talk to the data nodes via the client facing addresses when advertised.
+	if len(dp.ClientHosts) == len(dp.Hosts) {
+		dp.Hosts = dp.ClientHosts
+	}
 	w.Lock()
 	old, ok := w.partitions[dp.PartitionID]
 	if ok {
@@ -169,6 +179,11 @@ func (w *Wrapper) replaceOrInsertPartition(dp *DataPartition) {
 		old.Status = dp.Status
 		old.ReplicaNum = dp.ReplicaNum
 		old.Hosts = dp.Hosts
+		old.ClientHosts = dp.ClientHosts
+		old.Zones = dp.Zones
+		old.Epoch = dp.Epoch
+		old.ArchiveStatus = dp.ArchiveStatus
+		old.Releasing = dp.Releasing
 	} else {
 		dp.Metrics = NewDataPartitionMetrics()
 		w.partitions[dp.PartitionID] = dp
@@ -244,6 +259,51 @@ func (w *Wrapper) GetDataPartition(partitionID uint32) (*DataPartition, error) {
 	return dp, nil
 }
 
+// ask the master to rehydrate the archived partition, at most once in RehydrateIntervalSeconds
+// for a partition, the partition is read again once the view shows it is active
+func (w *Wrapper) RehydrateDataPartition(dp *DataPartition) {
+	now := time.Now().Unix()
+	last := atomic.LoadInt64(&dp.rehydrateTime)
+	if now-last < RehydrateIntervalSeconds || !atomic.CompareAndSwapInt64(&dp.rehydrateTime, last, now) {
+		return
+	}
+	paras := make(map[string]string, 0)
+	paras["id"] = strconv.FormatUint(uint64(dp.PartitionID), 10)
+	paras["name"] = w.volName
+	if _, err := MasterHelper.Request(http.MethodPost, RehydrateDataPartitionUrl, paras, nil); err != nil {
+		log.LogWarnf("RehydrateDataPartition: dp(%v) err(%v)", dp.PartitionID, err)
+		return
+	}
+	log.LogInfof("RehydrateDataPartition: dp(%v) status(%v) rehydration requested", dp.PartitionID, dp.ArchiveStatus)
+}
+
+/*the ids of the partitions released by the shrink of the vol*/
+func (w *Wrapper) ReleasingPartitions() (ids map[uint32]bool) {
+	ids = make(map[uint32]bool)
+	w.RLock()
+	defer w.RUnlock()
+	for id, dp := range w.partitions {
+		if dp.Releasing {
+			ids[id] = true
+		}
+	}
+	return
+}
+
+// tell the master a migration pass started at start moved all the files off the
+// releasing partitions, the partitions marked before are deleted then
+func (w *Wrapper) ReportMigrated(start int64) (err error) {
+	paras := make(map[string]string, 0)
+	paras["name"] = w.volName
+	paras["start"] = strconv.FormatInt(start, 10)
+	if _, err = MasterHelper.Request(http.MethodPost, ReportMigratedUrl, paras, nil); err != nil {
+		log.LogWarnf("ReportMigrated: start(%v) err(%v)", start, err)
+		return
+	}
+	log.LogInfof("ReportMigrated: start(%v) reported", start)
+	return
+}
+
 func (w *Wrapper) UmpWarningKey() string {
 	return fmt.Sprintf("%s_client_warning", w.clusterName)
 }
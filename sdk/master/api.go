@@ -0,0 +1,208 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+)
+
+const (
+	GetClusterURL           = "/admin/getCluster"
+	CreateVolURL            = "/admin/createVol"
+	DeleteVolURL            = "/vol/delete"
+	GetVolStatURL           = "/client/volStat"
+	SetVolQuotaURL          = "/vol/setQuota"
+	SetVolImmutableURL      = "/vol/setImmutable"
+	GetDataPartitionsURL    = "/client/dataPartitions"
+	GetDataPartitionURL     = "/dataPartition/get"
+	CreateDataPartitionURL  = "/dataPartition/create"
+	DataPartitionOfflineURL = "/dataPartition/offline"
+	GetDataNodeURL          = "/dataNode/get"
+	DataNodeOfflineURL      = "/dataNode/offline"
+	DecommissionDataNodeURL = "/dataNode/decommission"
+	GetDecommissionURL      = "/dataNode/getDecommission"
+	CancelDecommissionURL   = "/dataNode/cancelDecommission"
+	GetMetaNodeURL          = "/metaNode/get"
+	MetaNodeOfflineURL      = "/metaNode/offline"
+	CreateTokenURL          = "/token/create"
+	RevokeTokenURL          = "/token/revoke"
+	RotateTokenURL          = "/token/rotate"
+	ListTokensURL           = "/token/list"
+)
+
+func (c *Client) GetCluster(ctx context.Context) (view *ClusterView, err error) {
+	view = &ClusterView{}
+	if err = c.request(ctx, GetClusterURL, url.Values{}, view); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// CreateVol creates a vol of partitionType with replicas copies of its data,
+// replication is "raft" for the raft replicated extent partitions or empty.
+func (c *Client) CreateVol(ctx context.Context, name, partitionType string, replicas int, replication string) (err error) {
+	params := url.Values{"name": {name}, "type": {partitionType}, "replicas": {strconv.Itoa(replicas)}}
+	if replication != "" {
+		params.Set("replication", replication)
+	}
+	return c.request(ctx, CreateVolURL, params, nil)
+}
+
+// DeleteVol marks the vol deleted, its partitions are removed by the master.
+func (c *Client) DeleteVol(ctx context.Context, name string) (err error) {
+	return c.request(ctx, DeleteVolURL, url.Values{"name": {name}}, nil)
+}
+
+func (c *Client) GetVolStat(ctx context.Context, name string) (stat *VolStat, err error) {
+	stat = &VolStat{}
+	if err = c.request(ctx, GetVolStatURL, url.Values{"name": {name}}, stat); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// SetVolQuota sets the GB the vol may hold, 0 means no quota.
+func (c *Client) SetVolQuota(ctx context.Context, name string, quotaGB uint64) (err error) {
+	return c.request(ctx, SetVolQuotaURL, url.Values{"name": {name}, "capacity": {strconv.FormatUint(quotaGB, 10)}}, nil)
+}
+
+func (c *Client) SetVolImmutable(ctx context.Context, name string, immutable bool) (err error) {
+	return c.request(ctx, SetVolImmutableURL, url.Values{"name": {name}, "enable": {strconv.FormatBool(immutable)}}, nil)
+}
+
+// GetDataPartitions returns the data partitions of the vol as its clients see them.
+func (c *Client) GetDataPartitions(ctx context.Context, name string) (dps []*DataPartitionView, err error) {
+	view := &struct {
+		DataPartitions []*DataPartitionView
+	}{}
+	if err = c.request(ctx, GetDataPartitionsURL, url.Values{"name": {name}}, view); err != nil {
+		return
+	}
+	return view.DataPartitions, nil
+}
+
+func (c *Client) GetDataPartition(ctx context.Context, id uint64) (dp *DataPartitionInfo, err error) {
+	dp = &DataPartitionInfo{}
+	if err = c.request(ctx, GetDataPartitionURL, url.Values{"id": {strconv.FormatUint(id, 10)}}, dp); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// CreateDataPartitions adds count data partitions of partitionType to the vol.
+func (c *Client) CreateDataPartitions(ctx context.Context, name, partitionType string, count int) (err error) {
+	params := url.Values{"name": {name}, "type": {partitionType}, "count": {strconv.Itoa(count)}}
+	return c.request(ctx, CreateDataPartitionURL, params, nil)
+}
+
+// DataPartitionOffline moves the replica of the partition off the data node.
+func (c *Client) DataPartitionOffline(ctx context.Context, name string, id uint64, addr string) (err error) {
+	params := url.Values{"name": {name}, "id": {strconv.FormatUint(id, 10)}, "addr": {addr}}
+	return c.request(ctx, DataPartitionOfflineURL, params, nil)
+}
+
+// PlanDataPartitionOffline returns the move DataPartitionOffline would do.
+func (c *Client) PlanDataPartitionOffline(ctx context.Context, name string, id uint64, addr string) (plan *MigrationPlan, err error) {
+	params := url.Values{"name": {name}, "id": {strconv.FormatUint(id, 10)}, "addr": {addr}, "dryRun": {"true"}}
+	plan = &MigrationPlan{}
+	if err = c.request(ctx, DataPartitionOfflineURL, params, plan); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (c *Client) GetDataNode(ctx context.Context, addr string) (node *DataNodeInfo, err error) {
+	node = &DataNodeInfo{}
+	if err = c.request(ctx, GetDataNodeURL, url.Values{"addr": {addr}}, node); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// DataNodeOffline removes the data node, all its replicas are moved at once.
+func (c *Client) DataNodeOffline(ctx context.Context, addr string) (err error) {
+	return c.request(ctx, DataNodeOfflineURL, url.Values{"addr": {addr}}, nil)
+}
+
+// DecommissionDataNode drains the data node with maxMigrations moves at a time
+// and removes it once it is empty, see GetDecommission for the progress.
+func (c *Client) DecommissionDataNode(ctx context.Context, addr string, maxMigrations int) (err error) {
+	return c.request(ctx, DecommissionDataNodeURL, url.Values{"addr": {addr}, "count": {strconv.Itoa(maxMigrations)}}, nil)
+}
+
+// PlanDecommission returns the moves DecommissionDataNode would do.
+func (c *Client) PlanDecommission(ctx context.Context, addr string, maxMigrations int) (plan *MigrationPlan, err error) {
+	params := url.Values{"addr": {addr}, "count": {strconv.Itoa(maxMigrations)}, "dryRun": {"true"}}
+	plan = &MigrationPlan{}
+	if err = c.request(ctx, DecommissionDataNodeURL, params, plan); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (c *Client) GetDecommission(ctx context.Context, addr string) (view *DecommissionView, err error) {
+	view = &DecommissionView{}
+	if err = c.request(ctx, GetDecommissionURL, url.Values{"addr": {addr}}, view); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (c *Client) CancelDecommission(ctx context.Context, addr string) (err error) {
+	return c.request(ctx, CancelDecommissionURL, url.Values{"addr": {addr}}, nil)
+}
+
+func (c *Client) GetMetaNode(ctx context.Context, addr string) (node *MetaNodeInfo, err error) {
+	node = &MetaNodeInfo{}
+	if err = c.request(ctx, GetMetaNodeURL, url.Values{"addr": {addr}}, node); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// MetaNodeOffline removes the meta node, its meta partitions are moved.
+func (c *Client) MetaNodeOffline(ctx context.Context, addr string) (err error) {
+	return c.request(ctx, MetaNodeOfflineURL, url.Values{"addr": {addr}}, nil)
+}
+
+// CreateToken creates a token of the vol, tokenType is proto.TokenReadOnly or
+// proto.TokenReadWrite.
+func (c *Client) CreateToken(ctx context.Context, name, tokenType string) (token *Token, err error) {
+	token = &Token{}
+	if err = c.request(ctx, CreateTokenURL, url.Values{"name": {name}, "type": {tokenType}}, token); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (c *Client) RevokeToken(ctx context.Context, name, value string) (err error) {
+	return c.request(ctx, RevokeTokenURL, url.Values{"name": {name}, "token": {value}}, nil)
+}
+
+// RotateToken replaces the token with a new one of the same type.
+func (c *Client) RotateToken(ctx context.Context, name, value string) (token *Token, err error) {
+	token = &Token{}
+	if err = c.request(ctx, RotateTokenURL, url.Values{"name": {name}, "token": {value}}, token); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (c *Client) ListTokens(ctx context.Context, name string) (tokens []*Token, err error) {
+	err = c.request(ctx, ListTokensURL, url.Values{"name": {name}}, &tokens)
+	return
+}
@@ -0,0 +1,189 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package master is a client of the admin API of the masters, for the tools
+// and the automation managing a cluster. The requests follow the leader and
+// are retried on the other masters while they fail to connect or the masters
+// have no leader, the errors of the API are returned as *APIError.
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tiglabs/containerfs/util"
+)
+
+const (
+	DefaultTimeout       = 10 * time.Second
+	DefaultRetries       = 3
+	DefaultRetryInterval = time.Second
+	MaxRedirects         = 3 //leader changes followed by a request
+)
+
+// APIError is a request refused by the leader, it is never retried.
+type APIError struct {
+	Path   string
+	Status int
+	Msg    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("master %v: status %v: %v", e.Path, e.Status, e.Msg)
+}
+
+// IsNotFound tells whether err is a request refused because the vol, the node
+// or the partition does not exist.
+func IsNotFound(err error) bool {
+	e, ok := err.(*APIError)
+	return ok && strings.Contains(e.Msg, "not found") && !strings.Contains(e.Msg, "parameter")
+}
+
+// Client sends the admin requests to the masters, it is safe for concurrent
+// use. The fields are read by each request, set them before using the client.
+type Client struct {
+	Timeout       time.Duration //of each attempt
+	Retries       int           //rounds over all the masters after the first one
+	RetryInterval time.Duration //between the rounds
+
+	masters []string
+	leader  string
+	http    *http.Client
+	sync.RWMutex
+}
+
+// NewClient returns a client of the masters, https is used if
+// util.SetMasterTLSConfig was called before.
+func NewClient(masters []string) *Client {
+	c := &Client{
+		Timeout:       DefaultTimeout,
+		Retries:       DefaultRetries,
+		RetryInterval: DefaultRetryInterval,
+		masters:       append([]string{}, masters...),
+		http:          util.NewMasterClient(0),
+	}
+	if len(masters) > 0 {
+		c.leader = masters[0]
+	}
+	return c
+}
+
+func (c *Client) Leader() string {
+	c.RLock()
+	defer c.RUnlock()
+	return c.leader
+}
+
+func (c *Client) setLeader(addr string) {
+	c.Lock()
+	defer c.Unlock()
+	c.leader = addr
+	for _, m := range c.masters {
+		if m == addr {
+			return
+		}
+	}
+	c.masters = append(c.masters, addr)
+}
+
+/*the masters to try, the leader first*/
+func (c *Client) targets() (addrs []string) {
+	c.RLock()
+	defer c.RUnlock()
+	addrs = make([]string, 0, len(c.masters))
+	if c.leader != "" {
+		addrs = append(addrs, c.leader)
+	}
+	for _, m := range c.masters {
+		if m != c.leader {
+			addrs = append(addrs, m)
+		}
+	}
+	return
+}
+
+// request sends path with params to the leader and decodes the json response
+// into result, the response is discarded if result is nil.
+func (c *Client) request(ctx context.Context, path string, params url.Values, result interface{}) (err error) {
+	var body []byte
+	for round := 0; round <= c.Retries; round++ {
+		if round > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(c.RetryInterval):
+			}
+		}
+		for _, addr := range c.targets() {
+			if body, err = c.send(ctx, addr, path, params, 0); err == nil {
+				if result == nil {
+					return
+				}
+				if err = json.Unmarshal(body, result); err != nil {
+					return fmt.Errorf("master %v: decode response: %v", path, err)
+				}
+				return
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if _, ok := err.(*APIError); ok {
+				return
+			}
+		}
+	}
+	return
+}
+
+func (c *Client) send(ctx context.Context, addr, path string, params url.Values, redirects int) (body []byte, err error) {
+	attemptCtx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, util.MasterURL(addr, path)+"?"+params.Encode(), nil)
+	if err != nil {
+		return
+	}
+	resp, err := c.http.Do(req.WithContext(attemptCtx))
+	if err != nil {
+		return
+	}
+	body, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return
+	}
+	msg := strings.TrimSpace(string(body))
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		c.setLeader(addr)
+		return
+	case resp.StatusCode == http.StatusForbidden:
+		// a follower answers with the address of the leader, empty if it has none
+		if msg == "" || redirects >= MaxRedirects {
+			return nil, fmt.Errorf("master %v: %v has no leader", path, addr)
+		}
+		c.setLeader(msg)
+		return c.send(ctx, msg, path, params, redirects+1)
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return nil, fmt.Errorf("master %v: %v status %v: %v", path, addr, resp.StatusCode, msg)
+	default:
+		return nil, &APIError{Path: path, Status: resp.StatusCode, Msg: msg}
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestClient(masters ...string) *Client {
+	c := NewClient(masters)
+	c.Retries = 1
+	c.RetryInterval = time.Millisecond
+	return c
+}
+
+func TestClient_FollowLeader(t *testing.T) {
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != GetVolStatURL || r.FormValue("name") != "vol1" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"Name":"vol1","TotalSize":100,"UsedSize":10}`)
+	}))
+	defer leader.Close()
+	leaderAddr := strings.TrimPrefix(leader.URL, "http://")
+	follower := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, leaderAddr, http.StatusForbidden)
+	}))
+	defer follower.Close()
+
+	c := newTestClient(strings.TrimPrefix(follower.URL, "http://"))
+	stat, err := c.GetVolStat(context.Background(), "vol1")
+	if err != nil {
+		t.Fatalf("get vol stat: %v", err)
+	}
+	if stat.Name != "vol1" || stat.TotalSize != 100 || stat.UsedSize != 10 {
+		t.Fatalf("unexpected stat %+v", stat)
+	}
+	if c.Leader() != leaderAddr {
+		t.Fatalf("leader %v, expect %v", c.Leader(), leaderAddr)
+	}
+}
+
+func TestClient_RetryOtherMaster(t *testing.T) {
+	var calls int32
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		http.Error(w, "no leader", http.StatusInternalServerError)
+	}))
+	defer down.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"VolName":"vol1","Value":"abc","Type":"rw"}]`)
+	}))
+	defer up.Close()
+
+	c := newTestClient(strings.TrimPrefix(down.URL, "http://"), strings.TrimPrefix(up.URL, "http://"))
+	tokens, err := c.ListTokens(context.Background(), "vol1")
+	if err != nil {
+		t.Fatalf("list tokens: %v", err)
+	}
+	if len(tokens) != 1 || tokens[0].Value != "abc" {
+		t.Fatalf("unexpected tokens %v", tokens)
+	}
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Fatalf("the down master called %v times", calls)
+	}
+}
+
+func TestClient_APIError(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		http.Error(w, "type[getDataNode] Because [data node not found]", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	c := newTestClient(strings.TrimPrefix(server.URL, "http://"))
+	_, err := c.GetDataNode(context.Background(), "127.0.0.1:6000")
+	if _, ok := err.(*APIError); !ok || !IsNotFound(err) {
+		t.Fatalf("unexpected err %v", err)
+	}
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Fatalf("an api error retried, %v calls", calls)
+	}
+}
+
+func TestClient_Context(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no leader", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	c := newTestClient(strings.TrimPrefix(server.URL, "http://"))
+	c.Retries = 100
+	c.RetryInterval = time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := c.DeleteVol(ctx, "vol1"); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected err %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("the retries ignored the context")
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"time"
+)
+
+// The views returned by the masters, only the fields of use to the clients of
+// the admin API are decoded.
+
+type NodeView struct {
+	ID     uint64
+	Addr   string
+	Status bool
+}
+
+type ClusterView struct {
+	Name               string
+	LeaderAddr         string
+	CompactStatus      bool
+	Applied            uint64
+	MaxDataPartitionID uint64
+	MaxMetaNodeID      uint64
+	MaxMetaPartitionID uint64
+	Vols               []string
+	MetaNodes          []NodeView
+	DataNodes          []NodeView
+}
+
+type DataNodeInfo struct {
+	ID                 uint64
+	Addr               string
+	ClientAddr         string
+	ReplicaAddr        string
+	Rack               string
+	Zone               string
+	Total              uint64 `json:"TotalWeight"`
+	Used               uint64 `json:"UsedWeight"`
+	Available          uint64
+	ReportTime         time.Time
+	DataPartitionCount uint32
+	Draining           bool
+	BadDisks           []string
+}
+
+type MetaNodeInfo struct {
+	ID                 uint64
+	Addr               string
+	IsActive           bool
+	Rack               string
+	Zone               string
+	MemClass           string
+	Total              uint64 `json:"TotalWeight"`
+	Used               uint64 `json:"UsedWeight"`
+	ReportTime         time.Time
+	MetaPartitionCount int
+}
+
+type DataReplicaInfo struct {
+	Addr       string
+	ReportTime int64
+	FileCount  uint32
+	Status     int8
+	Total      uint64 `json:"TotalSize"`
+	Used       uint64 `json:"UsedSize"`
+	Sealed     bool
+}
+
+type DataPartitionInfo struct {
+	PartitionID      uint64
+	ReplicaNum       uint8
+	Status           int8
+	PartitionType    string
+	PersistenceHosts []string
+	WarmHosts        []string
+	Replicas         []*DataReplicaInfo
+	Epoch            uint64
+	VolName          string
+	ArchiveStatus    string
+	Sealed           bool
+	Releasing        bool
+	Replication      string
+}
+
+// DataPartitionView is a data partition as the clients of the vol see it.
+type DataPartitionView struct {
+	PartitionID   uint64
+	Status        int8
+	ReplicaNum    uint8
+	PartitionType string
+	Hosts         []string
+	Epoch         uint64
+	ArchiveStatus string
+	Degraded      bool
+	Releasing     bool
+}
+
+type VolStat struct {
+	Name               string
+	TotalSize          uint64
+	UsedSize           uint64
+	Quota              uint64
+	MaxFileSize        uint64
+	MaxFiles           uint64
+	Files              uint64
+	DegradedWrite      string
+	DegradedPartitions int
+}
+
+type Token struct {
+	VolName    string
+	Value      string
+	Type       string
+	CreateTime int64
+}
+
+type Migration struct {
+	PartitionID uint64
+	VolName     string
+	Source      string
+	SourceDisk  string
+	Target      string
+	Status      string
+	StartTime   int64
+	EndTime     int64
+	Msg         string
+}
+
+type DecommissionView struct {
+	Addr          string
+	MaxMigrations int
+	StartTime     int64
+	Total         int
+	Remaining     int
+	Migrations    []*Migration
+	History       []*Migration
+}
+
+// PlannedMigration is a replica move of a dry run, Target is empty if the
+// replica is only removed or no data node can take it, Msg tells which.
+type PlannedMigration struct {
+	PartitionID uint64
+	VolName     string
+	Source      string
+	SourceDisk  string
+	Target      string
+	Bytes       uint64
+	Msg         string
+}
+
+type MigrationPlan struct {
+	Migrations       []*PlannedMigration
+	TotalBytes       uint64
+	MaxMigrations    int
+	EstimatedSeconds int64
+}
@@ -15,6 +15,8 @@
 package meta
 
 import (
+	"context"
+	"fmt"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -29,22 +31,59 @@ import (
 
 const (
 	BatchIgetRespBuf = 1000
+	ReadDirLimit     = 1000 //dentries of a page of readdir
 )
 
+// Statfs returns the quota of the vol as the total size if it is set, or
+// the capacity of its data partitions otherwise.
 func (mw *MetaWrapper) Statfs() (total, used uint64) {
 	total = atomic.LoadUint64(&mw.totalSize)
 	used = atomic.LoadUint64(&mw.usedSize)
+	if quota := atomic.LoadUint64(&mw.quota); quota != 0 {
+		total = quota
+	}
+	if used > total {
+		used = total
+	}
 	return
 }
 
 func (mw *MetaWrapper) Open_ll(inode uint64) error {
+	return mw.OpenContext_ll(context.Background(), inode, 0)
+}
+
+// OpenContext_ll is Open_ll with the open made for the caller of ctx, the meta
+// node checks its access to the inode for the flags of the open.
+func (mw *MetaWrapper) OpenContext_ll(ctx context.Context, inode uint64, flag uint32) error {
 	mp := mw.getPartitionByInode(inode)
 	if mp == nil {
 		log.LogErrorf("Open_ll: No such partition, ino(%v)", inode)
 		return syscall.ENOENT
 	}
 
-	status, err := mw.open(mp, inode)
+	// the inode is leased by the renews from now on, the lease is not lost
+	// by a renew crossing the open
+	mw.leases.add(mp.PartitionID, inode)
+	status, err := mw.open(ctx, mp, inode, flag)
+	if err != nil || status != statusOK {
+		mw.leases.remove(mp.PartitionID, inode)
+		return statusToErrno(status)
+	}
+	atomic.AddInt64(&mw.openFiles, 1)
+	return nil
+}
+
+// Release_ll releases a handle opened by Open_ll.
+func (mw *MetaWrapper) Release_ll(inode uint64) error {
+	atomic.AddInt64(&mw.openFiles, -1)
+	mp := mw.getPartitionByInode(inode)
+	if mp == nil {
+		log.LogErrorf("Release_ll: No such partition, ino(%v)", inode)
+		return syscall.ENOENT
+	}
+	mw.leases.remove(mp.PartitionID, inode)
+
+	status, err := mw.release(mp, inode)
 	if err != nil || status != statusOK {
 		return statusToErrno(status)
 	}
@@ -52,6 +91,12 @@ func (mw *MetaWrapper) Open_ll(inode uint64) error {
 }
 
 func (mw *MetaWrapper) Create_ll(parentID uint64, name string, mode uint32, target []byte) (*proto.InodeInfo, error) {
+	return mw.CreateContext_ll(context.Background(), parentID, name, mode, 0, 0, target)
+}
+
+// CreateContext_ll is Create_ll with the requests traced as children of the
+// span of ctx and made for its caller, the inode is owned by uid and gid.
+func (mw *MetaWrapper) CreateContext_ll(ctx context.Context, parentID uint64, name string, mode, uid, gid uint32, target []byte) (*proto.InodeInfo, error) {
 	var (
 		status       int
 		err          error
@@ -60,6 +105,9 @@ func (mw *MetaWrapper) Create_ll(parentID uint64, name string, mode uint32, targ
 		rwPartitions []*MetaPartition
 	)
 
+	if len(target) > proto.MaxSymlinkTargetSize {
+		return nil, syscall.ENAMETOOLONG
+	}
 	parentMP := mw.getPartitionByInode(parentID)
 	if parentMP == nil {
 		log.LogErrorf("Create_ll: No parent partition, parentID(%v)", parentID)
@@ -70,27 +118,33 @@ func (mw *MetaWrapper) Create_ll(parentID uint64, name string, mode uint32, targ
 
 	mp = mw.getLatestPartition()
 	if mp != nil {
-		status, info, err = mw.icreate(mp, mode, target)
+		status, info, err = mw.icreate(ctx, mp, parentID, mode, uid, gid, target)
 		if err == nil {
 			if status == statusOK {
 				goto create_dentry
 			} else if status == statusFull {
 				mw.UpdateMetaPartitions()
+			} else if status == statusTooManyFiles {
+				return nil, statusToErrno(status)
 			}
 		}
 	}
 
 	rwPartitions = mw.getRWPartitions()
 	for _, mp = range rwPartitions {
-		status, info, err = mw.icreate(mp, mode, target)
+		status, info, err = mw.icreate(ctx, mp, parentID, mode, uid, gid, target)
 		if err == nil && status == statusOK {
 			goto create_dentry
 		}
+		if err == nil && status == statusTooManyFiles {
+			// the file count is of the vol, the other partitions refuse too
+			return nil, statusToErrno(status)
+		}
 	}
 	return nil, syscall.ENOMEM
 
 create_dentry:
-	status, err = mw.dcreate(parentMP, parentID, name, info.Inode, mode)
+	status, err = mw.dcreate(ctx, parentMP, parentID, name, info.Inode, mode)
 	if err != nil || status != statusOK {
 		if status == statusExist {
 			return nil, syscall.EEXIST
@@ -104,13 +158,19 @@ create_dentry:
 }
 
 func (mw *MetaWrapper) Lookup_ll(parentID uint64, name string) (inode uint64, mode uint32, err error) {
+	return mw.LookupContext_ll(context.Background(), parentID, name)
+}
+
+// LookupContext_ll is Lookup_ll with the request traced as a child of the span
+// of ctx.
+func (mw *MetaWrapper) LookupContext_ll(ctx context.Context, parentID uint64, name string) (inode uint64, mode uint32, err error) {
 	parentMP := mw.getPartitionByInode(parentID)
 	if parentMP == nil {
 		log.LogErrorf("Lookup_ll: No parent partition, parentID(%v) name(%v)", parentID, name)
 		return 0, 0, syscall.ENOENT
 	}
 
-	status, inode, mode, err := mw.lookup(parentMP, parentID, name)
+	status, inode, mode, err := mw.lookup(ctx, parentMP, parentID, name)
 	if err != nil || status != statusOK {
 		return 0, 0, statusToErrno(status)
 	}
@@ -157,13 +217,29 @@ func (mw *MetaWrapper) BatchInodeGet(inodes []uint64) []*proto.InodeInfo {
 }
 
 func (mw *MetaWrapper) Delete_ll(parentID uint64, name string) (*proto.InodeInfo, error) {
+	return mw.DeleteContext_ll(context.Background(), parentID, name)
+}
+
+// DeleteContext_ll is Delete_ll with the requests traced as children of the
+// span of ctx and made for its caller.
+func (mw *MetaWrapper) DeleteContext_ll(ctx context.Context, parentID uint64, name string) (*proto.InodeInfo, error) {
+	return mw.delete(ctx, parentID, name, 0)
+}
+
+// DeleteIf_ll is Delete_ll if the dentry is still of the inode ino, it fails
+// with ENOENT if the name was removed or now refers to another inode.
+func (mw *MetaWrapper) DeleteIf_ll(parentID uint64, name string, ino uint64) (*proto.InodeInfo, error) {
+	return mw.delete(context.Background(), parentID, name, ino)
+}
+
+func (mw *MetaWrapper) delete(ctx context.Context, parentID uint64, name string, ino uint64) (*proto.InodeInfo, error) {
 	parentMP := mw.getPartitionByInode(parentID)
 	if parentMP == nil {
 		log.LogErrorf("Delete_ll: No parent partition, parentID(%v) name(%v)", parentID, name)
 		return nil, syscall.ENOENT
 	}
 
-	status, inode, err := mw.ddelete(parentMP, parentID, name)
+	status, inode, err := mw.ddelete(ctx, parentMP, parentID, name, ino)
 	if err != nil || status != statusOK {
 		return nil, statusToErrno(status)
 	}
@@ -183,6 +259,13 @@ func (mw *MetaWrapper) Delete_ll(parentID uint64, name string) (*proto.InodeInfo
 }
 
 func (mw *MetaWrapper) Rename_ll(srcParentID uint64, srcName string, dstParentID uint64, dstName string) (err error) {
+	return mw.RenameContext_ll(context.Background(), srcParentID, srcName, dstParentID, dstName)
+}
+
+// RenameContext_ll is Rename_ll with the requests traced as children of the
+// span of ctx and made for its caller, the rollback of a failed rename is
+// made for the caller set by SetCaller.
+func (mw *MetaWrapper) RenameContext_ll(ctx context.Context, srcParentID uint64, srcName string, dstParentID uint64, dstName string) (err error) {
 	var oldInode uint64
 
 	srcParentMP := mw.getPartitionByInode(srcParentID)
@@ -195,18 +278,21 @@ func (mw *MetaWrapper) Rename_ll(srcParentID uint64, srcName string, dstParentID
 	}
 
 	// look up for the ino
-	status, inode, mode, err := mw.lookup(srcParentMP, srcParentID, srcName)
+	status, inode, mode, err := mw.lookup(ctx, srcParentMP, srcParentID, srcName)
 	if err != nil || status != statusOK {
 		return statusToErrno(status)
 	}
+	if srcParentMP.PartitionID != dstParentMP.PartitionID && supportsTx(srcParentMP, dstParentMP) {
+		return mw.renameTx(ctx, srcParentMP, srcParentID, srcName, dstParentMP, dstParentID, dstName, inode, mode)
+	}
 	// create dentry in dst parent
-	status, err = mw.dcreate(dstParentMP, dstParentID, dstName, inode, mode)
+	status, err = mw.dcreate(ctx, dstParentMP, dstParentID, dstName, inode, mode)
 	if err != nil {
 		return syscall.EAGAIN
 	}
 
 	if status == statusExist {
-		status, oldInode, err = mw.dupdate(dstParentMP, dstParentID, dstName, inode)
+		status, oldInode, err = mw.dupdate(ctx, dstParentMP, dstParentID, dstName, inode)
 		if err != nil {
 			return syscall.EAGAIN
 		}
@@ -217,12 +303,12 @@ func (mw *MetaWrapper) Rename_ll(srcParentID uint64, srcName string, dstParentID
 	}
 
 	// delete dentry from src parent
-	status, _, err = mw.ddelete(srcParentMP, srcParentID, srcName)
+	status, _, err = mw.ddelete(ctx, srcParentMP, srcParentID, srcName, 0)
 	if err != nil || status != statusOK {
 		if oldInode == 0 {
-			mw.ddelete(dstParentMP, dstParentID, dstName)
+			mw.ddelete(context.Background(), dstParentMP, dstParentID, dstName, 0)
 		} else {
-			mw.dupdate(dstParentMP, dstParentID, dstName, oldInode)
+			mw.dupdate(context.Background(), dstParentMP, dstParentID, dstName, oldInode)
 		}
 		return statusToErrno(status)
 	}
@@ -237,17 +323,184 @@ func (mw *MetaWrapper) Rename_ll(srcParentID uint64, srcName string, dstParentID
 	return nil
 }
 
+// supportsTx tells if the meta nodes of the partitions negotiated the
+// transactions, the rename between the partitions of legacy meta nodes is the
+// one of before the transactions, not atomic.
+func supportsTx(mps ...*MetaPartition) bool {
+	for _, mp := range mps {
+		for _, addr := range mp.Members {
+			if !proto.PeerSupports(addr, proto.ConnCapMetaTx) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// renameTx renames between the dirs of two partitions in a transaction, the
+// partition of the destination decides it at its commit and unlinks the
+// inode it replaces. The meta nodes resolve the parts left behind if the
+// client fails in between.
+func (mw *MetaWrapper) renameTx(ctx context.Context, srcParentMP *MetaPartition, srcParentID uint64, srcName string,
+	dstParentMP *MetaPartition, dstParentID uint64, dstName string, inode uint64, mode uint32) error {
+	for i := 0; i < RenameTxRetry; i++ {
+		// the destination replaced meanwhile fails the prepare
+		var replaced uint64
+		var replacedMP *MetaPartition
+		status, dstInode, _, err := mw.lookup(ctx, dstParentMP, dstParentID, dstName)
+		if err != nil {
+			return syscall.EAGAIN
+		}
+		if status == statusOK {
+			if replacedMP = mw.getPartitionByInode(dstInode); replacedMP == nil {
+				log.LogErrorf("renameTx: No inode partition, parentID(%v) name(%v) ino(%v)", dstParentID, dstName, dstInode)
+				return syscall.ENOENT
+			}
+			replaced = dstInode
+		} else if status != statusNoent {
+			return statusToErrno(status)
+		}
+		if err = mw.renameTxOnce(ctx, srcParentMP, srcParentID, srcName, dstParentMP, dstParentID, dstName,
+			inode, mode, replaced, replacedMP); err != syscall.EEXIST {
+			return err
+		}
+		log.LogWarnf("renameTx: parentID(%v) name(%v) replaced meanwhile, try again", dstParentID, dstName)
+	}
+	return syscall.EAGAIN
+}
+
+func (mw *MetaWrapper) renameTxOnce(ctx context.Context, srcParentMP *MetaPartition, srcParentID uint64, srcName string,
+	dstParentMP *MetaPartition, dstParentID uint64, dstName string, inode uint64, mode uint32,
+	replaced uint64, replacedMP *MetaPartition) error {
+	txID := fmt.Sprintf("%v-%v", mw.sessionID, atomic.AddUint64(&mw.txSeq, 1))
+	req := &proto.TxPrepareRequest{
+		TxID:         txID,
+		Inode:        inode,
+		Mode:         mode,
+		Primary:      dstParentMP.PartitionID,
+		PrimaryAddrs: dstParentMP.Members,
+		Timeout:      RenameTxTimeout,
+	}
+
+	dstReq := *req
+	dstReq.Op, dstReq.ParentID, dstReq.Name = proto.TxCreateDentry, dstParentID, dstName
+	if replaced != 0 {
+		dstReq.Replaced, dstReq.ReplacedPartition, dstReq.ReplacedAddrs = replaced, replacedMP.PartitionID, replacedMP.Members
+	}
+	status, _, err := mw.txPrepare(ctx, dstParentMP, &dstReq)
+	if err != nil {
+		return syscall.EAGAIN
+	}
+	if status == statusExist {
+		return syscall.EEXIST
+	}
+	if status != statusOK {
+		return statusToErrno(status)
+	}
+
+	srcReq := *req
+	srcReq.Op, srcReq.ParentID, srcReq.Name = proto.TxDeleteDentry, srcParentID, srcName
+	status, _, err = mw.txPrepare(ctx, srcParentMP, &srcReq)
+	if err != nil || status != statusOK {
+		mw.txAbort(dstParentMP, txID)
+		if err != nil {
+			return syscall.EAGAIN
+		}
+		return statusToErrno(status)
+	}
+
+	// the rename is done once the primary committed
+	status, err = mw.txCommit(dstParentMP, txID)
+	if err != nil {
+		var committed bool
+		if committed, err = mw.txCommitted(dstParentMP, txID); err != nil {
+			// left to the meta nodes to resolve either way
+			log.LogErrorf("renameTx: tx(%v) not resolved: %v", txID, err)
+			return syscall.EIO
+		}
+		if !committed {
+			mw.txAbort(srcParentMP, txID)
+			return syscall.EIO
+		}
+		status = statusOK
+	}
+	if status != statusOK {
+		mw.txAbort(srcParentMP, txID)
+		return statusToErrno(status)
+	}
+	mw.txCommit(srcParentMP, txID)
+	return nil
+}
+
+// txCommitted asks the primary partition for the decision of a transaction
+// whose commit is not answered, and aborts it if the commit did not reach it.
+func (mw *MetaWrapper) txCommitted(mp *MetaPartition, txID string) (committed bool, err error) {
+	for i := 0; i < RenameTxRetry; i++ {
+		var txStatus uint8
+		if txStatus, err = mw.txStatus(mp, txID); err != nil {
+			continue
+		}
+		switch txStatus {
+		case proto.TxStatusCommitted:
+			return true, nil
+		case proto.TxStatusAborted:
+			return false, nil
+		case proto.TxStatusPrepared:
+			// a committed transaction is not aborted, its status is asked again
+			if status, e := mw.txAbort(mp, txID); e == nil && status == statusOK {
+				return false, nil
+			}
+		default:
+			err = fmt.Errorf("tx(%v) unknown to mp(%v)", txID, mp)
+			return
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("tx(%v) of mp(%v) neither committed nor aborted", txID, mp)
+	}
+	return
+}
+
 func (mw *MetaWrapper) ReadDir_ll(parentID uint64) ([]proto.Dentry, error) {
 	parentMP := mw.getPartitionByInode(parentID)
 	if parentMP == nil {
 		return nil, syscall.ENOENT
 	}
 
-	status, children, err := mw.readdir(parentMP, parentID)
+	var children []proto.Dentry
+	marker := ""
+	for {
+		status, page, next, err := mw.readdir(context.Background(), parentMP, parentID, marker, ReadDirLimit)
+		if err != nil || status != statusOK {
+			return nil, statusToErrno(status)
+		}
+		children = append(children, page...)
+		if next == "" {
+			return children, nil
+		}
+		marker = next
+	}
+}
+
+// ReadDirLimit_ll returns at most limit dentries of the dir after the
+// marker, and the marker of the next page or an empty one after the last.
+func (mw *MetaWrapper) ReadDirLimit_ll(parentID uint64, marker string, limit uint64) ([]proto.Dentry, string, error) {
+	return mw.ReadDirLimitContext_ll(context.Background(), parentID, marker, limit)
+}
+
+// ReadDirLimitContext_ll is ReadDirLimit_ll with the request traced as a child
+// of the span of ctx and made for its caller.
+func (mw *MetaWrapper) ReadDirLimitContext_ll(ctx context.Context, parentID uint64, marker string, limit uint64) ([]proto.Dentry, string, error) {
+	parentMP := mw.getPartitionByInode(parentID)
+	if parentMP == nil {
+		return nil, "", syscall.ENOENT
+	}
+
+	status, children, next, err := mw.readdir(ctx, parentMP, parentID, marker, limit)
 	if err != nil || status != statusOK {
-		return nil, statusToErrno(status)
+		return nil, "", statusToErrno(status)
 	}
-	return children, nil
+	return children, next, nil
 }
 
 // Used as a callback by stream sdk
@@ -279,14 +532,58 @@ func (mw *MetaWrapper) GetExtents(inode uint64) ([]proto.ExtentKey, error) {
 	return extents, nil
 }
 
+// ReplaceExtentKeys replaces the extent keys of the inode with newExtents if
+// they are still oldExtents, EAGAIN if they changed. The keys replaced are not
+// deleted.
+func (mw *MetaWrapper) ReplaceExtentKeys(inode uint64, oldExtents, newExtents []proto.ExtentKey) error {
+	mp := mw.getPartitionByInode(inode)
+	if mp == nil {
+		return syscall.ENOENT
+	}
+
+	status, err := mw.replaceExtentKeys(mp, inode, oldExtents, newExtents)
+	if err != nil || status != statusOK {
+		log.LogErrorf("ReplaceExtentKeys: inode(%v) err(%v) status(%v)", inode, err, status)
+		return statusToErrno(status)
+	}
+	return nil
+}
+
+// ListOrphans returns the regular inodes of the vol whose last link is deleted
+// while they are still open.
+func (mw *MetaWrapper) ListOrphans() (inodes []uint64, err error) {
+	mw.RLock()
+	partitions := make([]*MetaPartition, 0, len(mw.partitions))
+	for _, mp := range mw.partitions {
+		partitions = append(partitions, mp)
+	}
+	mw.RUnlock()
+
+	for _, mp := range partitions {
+		status, inos, e := mw.listOrphans(mp)
+		if e != nil || status != statusOK {
+			log.LogErrorf("ListOrphans: mp(%v) err(%v) status(%v)", mp, e, status)
+			return nil, statusToErrno(status)
+		}
+		inodes = append(inodes, inos...)
+	}
+	return
+}
+
 func (mw *MetaWrapper) Truncate(inode uint64) error {
+	return mw.TruncateContext(context.Background(), inode)
+}
+
+// TruncateContext is Truncate with the request traced as a child of the span
+// of ctx and made for its caller.
+func (mw *MetaWrapper) TruncateContext(ctx context.Context, inode uint64) error {
 	mp := mw.getPartitionByInode(inode)
 	if mp == nil {
 		log.LogErrorf("Truncate: No inode partition, ino(%v)", inode)
 		return syscall.ENOENT
 	}
 
-	status, err := mw.truncate(mp, inode)
+	status, err := mw.truncate(ctx, mp, inode)
 	if err != nil || status != statusOK {
 		return statusToErrno(status)
 	}
@@ -295,6 +592,12 @@ func (mw *MetaWrapper) Truncate(inode uint64) error {
 }
 
 func (mw *MetaWrapper) Link(parentID uint64, name string, ino uint64) (*proto.InodeInfo, error) {
+	return mw.LinkContext(context.Background(), parentID, name, ino)
+}
+
+// LinkContext is Link with the requests traced as children of the span of ctx
+// and made for its caller.
+func (mw *MetaWrapper) LinkContext(ctx context.Context, parentID uint64, name string, ino uint64) (*proto.InodeInfo, error) {
 	parentMP := mw.getPartitionByInode(parentID)
 	if parentMP == nil {
 		log.LogErrorf("Link: No parent partition, parentID(%v)", parentID)
@@ -314,14 +617,17 @@ func (mw *MetaWrapper) Link(parentID uint64, name string, ino uint64) (*proto.In
 	}
 
 	// create new dentry and refer to the inode
-	status, err = mw.dcreate(parentMP, parentID, name, ino, info.Mode)
+	status, err = mw.dcreate(ctx, parentMP, parentID, name, ino, info.Mode)
 	if err != nil || status != statusOK {
+		// the link taken by the dentry not created is dropped
+		mw.idelete(mp, ino)
 		if status == statusExist {
 			return nil, syscall.EEXIST
-		} else {
-			mw.idelete(mp, ino)
-			return nil, syscall.EAGAIN
 		}
+		if status == statusAccess {
+			return nil, syscall.EACCES
+		}
+		return nil, syscall.EAGAIN
 	}
 	return info, nil
 }
@@ -342,13 +648,19 @@ func (mw *MetaWrapper) Evict(inode uint64) error {
 }
 
 func (mw *MetaWrapper) Setattr(inode uint64, valid, mode, uid, gid uint32) error {
+	return mw.SetattrContext(context.Background(), inode, valid, mode, uid, gid)
+}
+
+// SetattrContext is Setattr with the request traced as a child of the span of
+// ctx and made for its caller.
+func (mw *MetaWrapper) SetattrContext(ctx context.Context, inode uint64, valid, mode, uid, gid uint32) error {
 	mp := mw.getPartitionByInode(inode)
 	if mp == nil {
 		log.LogErrorf("Setattr: No such partition, ino(%v)", inode)
 		return syscall.EINVAL
 	}
 
-	status, err := mw.setattr(mp, inode, valid, mode, uid, gid)
+	status, err := mw.setattr(ctx, mp, inode, valid, mode, uid, gid)
 	if err != nil || status != statusOK {
 		log.LogErrorf("Setattr: ino(%v) err(%v) status(%v)", inode, err, status)
 		return statusToErrno(status)
@@ -356,3 +668,98 @@ func (mw *MetaWrapper) Setattr(inode uint64, valid, mode, uid, gid uint32) error
 
 	return nil
 }
+
+// the not exist of an xattr op is the xattr, the inode of a node of the
+// fuse is not removed while the kernel references it
+func xattrStatusToErrno(status int) error {
+	if status == statusNoent {
+		return syscall.ENODATA
+	}
+	return statusToErrno(status)
+}
+
+func (mw *MetaWrapper) SetXAttr(inode uint64, name string, value []byte, flags uint32) error {
+	return mw.SetXAttrContext(context.Background(), inode, name, value, flags)
+}
+
+// SetXAttrContext is SetXAttr with the request traced as a child of the span
+// of ctx and made for its caller.
+func (mw *MetaWrapper) SetXAttrContext(ctx context.Context, inode uint64, name string, value []byte, flags uint32) error {
+	if len(name) > proto.MaxXAttrNameSize {
+		return syscall.ERANGE
+	}
+	if len(value) > proto.MaxXAttrValueSize {
+		return syscall.E2BIG
+	}
+	mp := mw.getPartitionByInode(inode)
+	if mp == nil {
+		log.LogErrorf("SetXAttr: No such partition, ino(%v)", inode)
+		return syscall.EINVAL
+	}
+
+	status, err := mw.setxattr(ctx, mp, inode, name, value, flags)
+	if err != nil || status != statusOK {
+		log.LogDebugf("SetXAttr: ino(%v) name(%v) err(%v) status(%v)", inode, name, err, status)
+		if status == statusInval {
+			// the names of the inode would exceed the list size
+			return syscall.ENOSPC
+		}
+		return xattrStatusToErrno(status)
+	}
+	return nil
+}
+
+func (mw *MetaWrapper) GetXAttr(inode uint64, name string) ([]byte, error) {
+	return mw.GetXAttrContext(context.Background(), inode, name)
+}
+
+// GetXAttrContext is GetXAttr made for the caller of ctx.
+func (mw *MetaWrapper) GetXAttrContext(ctx context.Context, inode uint64, name string) ([]byte, error) {
+	mp := mw.getPartitionByInode(inode)
+	if mp == nil {
+		log.LogErrorf("GetXAttr: No such partition, ino(%v)", inode)
+		return nil, syscall.EINVAL
+	}
+
+	status, value, err := mw.getxattr(ctx, mp, inode, name)
+	if err != nil || status != statusOK {
+		return nil, xattrStatusToErrno(status)
+	}
+	return value, nil
+}
+
+func (mw *MetaWrapper) ListXAttr(inode uint64) ([]string, error) {
+	mp := mw.getPartitionByInode(inode)
+	if mp == nil {
+		log.LogErrorf("ListXAttr: No such partition, ino(%v)", inode)
+		return nil, syscall.EINVAL
+	}
+
+	status, names, err := mw.listxattr(mp, inode)
+	if err != nil || status != statusOK {
+		log.LogErrorf("ListXAttr: ino(%v) err(%v) status(%v)", inode, err, status)
+		return nil, statusToErrno(status)
+	}
+	return names, nil
+}
+
+func (mw *MetaWrapper) RemoveXAttr(inode uint64, name string) error {
+	return mw.RemoveXAttrContext(context.Background(), inode, name)
+}
+
+// RemoveXAttrContext is RemoveXAttr with the request traced as a child of the
+// span of ctx and made for its caller.
+func (mw *MetaWrapper) RemoveXAttrContext(ctx context.Context, inode uint64, name string) error {
+	mp := mw.getPartitionByInode(inode)
+	if mp == nil {
+		log.LogErrorf("RemoveXAttr: No such partition, ino(%v)", inode)
+		return syscall.EINVAL
+	}
+
+	status, err := mw.removexattr(ctx, mp, inode, name)
+	if err != nil || status != statusOK {
+		log.LogDebugf("RemoveXAttr: ino(%v) name(%v) err(%v) status(%v)", inode, name, err, status)
+		return xattrStatusToErrno(status)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package meta
+
+import (
+	"context"
+	"path"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+type callerKey struct{}
+
+type dirPathsKey struct{}
+
+// NewCallerContext returns ctx carrying the user the requests are made for,
+// the meta nodes of a vol with the permission checks check the ops for it.
+func NewCallerContext(ctx context.Context, uid, gid uint32) context.Context {
+	return context.WithValue(ctx, callerKey{}, &proto.Caller{Uid: uid, Gid: gid})
+}
+
+// SetCaller makes the requests whose ctx carries no caller, and the ones of
+// the calls without a ctx, made for uid and gid. The meta nodes of a vol with
+// the permission checks refuse the requests without a caller. It is called
+// before any request.
+func (mw *MetaWrapper) SetCaller(uid, gid uint32) {
+	mw.caller = &proto.Caller{Uid: uid, Gid: gid}
+}
+
+// callerOf returns the caller carried by ctx, the one set by SetCaller if it
+// carries none.
+func (mw *MetaWrapper) callerOf(ctx context.Context) *proto.Caller {
+	if ctx != nil {
+		if caller, ok := ctx.Value(callerKey{}).(*proto.Caller); ok {
+			return caller
+		}
+	}
+	return mw.caller
+}
+
+// NewDirPathContext returns ctx carrying path as the path of the dir ino, the
+// dentry ops of the dir tell the meta nodes the path of the dentry for their
+// audit.
+func NewDirPathContext(ctx context.Context, ino uint64, path string) context.Context {
+	paths := make(map[uint64]string)
+	if parent, ok := ctx.Value(dirPathsKey{}).(map[uint64]string); ok {
+		for dir, p := range parent {
+			paths[dir] = p
+		}
+	}
+	paths[ino] = path
+	return context.WithValue(ctx, dirPathsKey{}, paths)
+}
+
+// pathOf returns the path of the dentry name of the dir parentID, empty if ctx
+// carries no path of the dir.
+func pathOf(ctx context.Context, parentID uint64, name string) string {
+	if ctx == nil {
+		return ""
+	}
+	dir, ok := ctx.Value(dirPathsKey{}).(map[uint64]string)[parentID]
+	if !ok {
+		return ""
+	}
+	return path.Join(dir, name)
+}
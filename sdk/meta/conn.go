@@ -23,6 +23,7 @@ import (
 
 	"github.com/tiglabs/containerfs/proto"
 	"github.com/tiglabs/containerfs/util/log"
+	"github.com/tiglabs/containerfs/util/trace"
 )
 
 const (
@@ -32,7 +33,7 @@ const (
 )
 
 type MetaConn struct {
-	conn *net.TCPConn
+	conn net.Conn
 	id   uint64 //PartitionID
 	addr string //MetaNode addr
 }
@@ -72,7 +73,19 @@ func (mw *MetaWrapper) sendToMetaPartition(mp *MetaPartition, req *proto.Packet)
 		op    string
 	)
 
+	if mw.isEvicted() {
+		return nil, ErrClientEvicted
+	}
+
 	op = req.GetOpMsg()
+	// the retries are in the span of the request
+	span := trace.StartChild(req.Trace, "meta."+op, trace.SpanKindClient)
+	req.SetTrace(span.Context())
+	span.SetAttribute("partition", mp.PartitionID)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
 	addr = mp.LeaderAddr
 	if addr == "" {
 		goto retry
@@ -86,7 +99,10 @@ func (mw *MetaWrapper) sendToMetaPartition(mp *MetaPartition, req *proto.Packet)
 	if err == nil && !resp.ShallRetry() {
 		goto out
 	}
-	log.LogWarnf("sendToMetaPartition: leader failed mp(%v) mc(%v) err(%v) op(%v) result(%v)", mp, mc, err, op, resp.GetResultMesg())
+	if err == nil && resp.GetErrCode().Category() == proto.ErrCategoryMisrouted {
+		mw.triggerRefresh()
+	}
+	log.LogWarnf("sendToMetaPartition: leader failed mp(%v) mc(%v) err(%v) op(%v) result(%v) code(%v)", mp, mc, err, op, resp.GetResultMesg(), resp.GetErrCode())
 
 retry:
 	start = time.Now()
@@ -0,0 +1,324 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package meta
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	// shorter than the cache leases on the meta nodes, the changes of the
+	// other clients are seen by the client in the interval
+	RenewLeasesInterval = time.Second
+	// the meta nodes drop the leases of a session not renewed for it, the
+	// changes of the inodes are no more queued for the session
+	RenewLeasesTimeout = 10 * time.Second
+)
+
+// leaseTable is the inodes the session caches the pages and the attrs of,
+// with the handles opened of them, and the inodes and the dirs it caches the
+// attrs and the dentries of for the ttl. The leader of a meta partition keeps
+// the leases in memory only, the leases of the opens are renewed with all the
+// inodes of the partition, the ones of the reads are granted by the reads
+// themselves, and the renew returns the inodes changed by the other clients.
+// The partitions are renewed apart, the lock is not held across a renew.
+type leaseTable struct {
+	partitions map[uint64]map[uint64]int  // handles of the leased inodes by partition
+	renewing   map[uint64]bool            // partitions with a renew in flight
+	crossed    map[uint64]map[uint64]bool // inodes opened while a renew of their partition was in flight
+	renewed    map[uint64]time.Time       // last renew succeeded by partition
+	invalidate func(inodes []uint64)
+	sync.Mutex
+
+	ttl       time.Duration
+	timed     map[uint64]map[uint64]time.Time // end of the leases of the reads by partition
+	timedLock sync.Mutex
+}
+
+// EnableLeases leases the caches of the files opened afterwards and the
+// attrs and the dentries read afterwards for the ttl, invalidate is called
+// with the inodes changed by the other clients. It is called before any
+// open.
+func (mw *MetaWrapper) EnableLeases(ttl time.Duration, invalidate func(inodes []uint64)) {
+	if ttl > proto.MaxCacheLeaseSeconds*time.Second {
+		ttl = proto.MaxCacheLeaseSeconds * time.Second
+	}
+	mw.leases = &leaseTable{
+		partitions: make(map[uint64]map[uint64]int),
+		renewing:   make(map[uint64]bool),
+		crossed:    make(map[uint64]map[uint64]bool),
+		renewed:    make(map[uint64]time.Time),
+		invalidate: invalidate,
+		ttl:        ttl,
+		timed:      make(map[uint64]map[uint64]time.Time),
+	}
+	go mw.renewLeases()
+}
+
+/*the seconds of lease asked by the reads, 0 without the leases*/
+func (t *leaseTable) seconds() int64 {
+	if t == nil {
+		return 0
+	}
+	return int64(t.ttl / time.Second)
+}
+
+/*record the lease of a read before sending it, the meta node keeps it longer than the session*/
+func (t *leaseTable) grant(partitionID uint64, inodes ...uint64) {
+	if t.seconds() <= 0 {
+		return
+	}
+	end := time.Now().Add(t.ttl)
+	t.timedLock.Lock()
+	defer t.timedLock.Unlock()
+	if t.timed[partitionID] == nil {
+		t.timed[partitionID] = make(map[uint64]time.Time)
+	}
+	for _, ino := range inodes {
+		t.timed[partitionID][ino] = end
+	}
+}
+
+/*the inodes of the partition read with an unexpired lease, the expired ones are dropped*/
+func (t *leaseTable) timedInodes(partitionID uint64) (inodes []uint64) {
+	now := time.Now()
+	t.timedLock.Lock()
+	defer t.timedLock.Unlock()
+	for ino, end := range t.timed[partitionID] {
+		if end.Before(now) {
+			delete(t.timed[partitionID], ino)
+			continue
+		}
+		inodes = append(inodes, ino)
+	}
+	if len(t.timed[partitionID]) == 0 {
+		delete(t.timed, partitionID)
+	}
+	return
+}
+
+func (t *leaseTable) add(partitionID, inode uint64) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	if t.partitions[partitionID] == nil {
+		t.partitions[partitionID] = make(map[uint64]int)
+	}
+	t.partitions[partitionID][inode]++
+	if t.renewing[partitionID] {
+		// the renew in flight may drop the lease of the open on the meta node
+		if t.crossed[partitionID] == nil {
+			t.crossed[partitionID] = make(map[uint64]bool)
+		}
+		t.crossed[partitionID][inode] = true
+	}
+}
+
+func (t *leaseTable) remove(partitionID, inode uint64) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	inodes := t.partitions[partitionID]
+	if inodes[inode]--; inodes[inode] > 0 {
+		return
+	}
+	delete(inodes, inode)
+	if len(inodes) == 0 {
+		delete(t.partitions, partitionID)
+	}
+}
+
+func (mw *MetaWrapper) renewLeases() {
+	t := time.NewTicker(RenewLeasesInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			// a partition slow to renew does not hold the renews of the others
+			go mw.RenewLeases()
+		case <-mw.evictC:
+			return
+		case <-mw.closeC:
+			return
+		}
+	}
+}
+
+// RenewLeases renews the leases of the session on every meta partition it
+// has leased inodes of, and invalidates the caches of the inodes changed by
+// the other clients. The partitions with a renew in flight are skipped.
+func (mw *MetaWrapper) RenewLeases() {
+	t := mw.leases
+	if t == nil {
+		return
+	}
+	partitions := make(map[uint64]bool)
+	t.timedLock.Lock()
+	for id := range t.timed {
+		partitions[id] = true
+	}
+	t.timedLock.Unlock()
+	t.Lock()
+	for id := range t.partitions {
+		partitions[id] = true
+	}
+	for id := range t.crossed {
+		partitions[id] = true
+	}
+	for id := range t.renewed {
+		if !partitions[id] && !t.renewing[id] {
+			delete(t.renewed, id)
+		}
+	}
+	t.Unlock()
+	var wg sync.WaitGroup
+	for id := range partitions {
+		wg.Add(1)
+		go func(id uint64) {
+			defer wg.Done()
+			if invalidated := mw.renewPartitionLeases(id); len(invalidated) != 0 {
+				t.invalidate(invalidated)
+			}
+		}(id)
+	}
+	wg.Wait()
+}
+
+/*start a renew of the partition, the inodes opened and the ones crossing the last renew, expired if the renews failed for the timeout*/
+func (t *leaseTable) beginRenew(partitionID uint64) (inodes, crossed []uint64, expired, ok bool) {
+	t.Lock()
+	defer t.Unlock()
+	if t.renewing[partitionID] {
+		return
+	}
+	t.renewing[partitionID] = true
+	inodes = make([]uint64, 0, len(t.partitions[partitionID]))
+	for ino := range t.partitions[partitionID] {
+		inodes = append(inodes, ino)
+	}
+	for ino := range t.crossed[partitionID] {
+		crossed = append(crossed, ino)
+	}
+	delete(t.crossed, partitionID)
+	now := time.Now()
+	if last, renewed := t.renewed[partitionID]; !renewed {
+		// the timeout runs from the first renew
+		t.renewed[partitionID] = now
+	} else {
+		expired = now.Sub(last) > RenewLeasesTimeout
+	}
+	return inodes, crossed, expired, true
+}
+
+/*end the renew of the partition, the crossed inodes of a renew failed are renewed by the next one*/
+func (t *leaseTable) endRenew(partitionID uint64, crossed []uint64, succeeded bool) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.renewing, partitionID)
+	if succeeded {
+		t.renewed[partitionID] = time.Now()
+		return
+	}
+	if len(crossed) == 0 {
+		return
+	}
+	if t.crossed[partitionID] == nil {
+		t.crossed[partitionID] = make(map[uint64]bool)
+	}
+	for _, ino := range crossed {
+		t.crossed[partitionID][ino] = true
+	}
+}
+
+/*a renew crossing an open may drop the lease of the open on the meta node, the open is renewed by the next renew and its caches invalidated after it, since changes may have been missed in between*/
+func (mw *MetaWrapper) renewPartitionLeases(partitionID uint64) (invalidated []uint64) {
+	t := mw.leases
+	inodes, crossed, expired, ok := t.beginRenew(partitionID)
+	if !ok {
+		return
+	}
+	succeeded := false
+	defer func() { t.endRenew(partitionID, crossed, succeeded) }()
+	// the leases of the reads are not renewed, they are polled for the changes
+	timed := t.timedInodes(partitionID)
+	if len(inodes) == 0 && len(timed) == 0 {
+		succeeded = true
+		return crossed
+	}
+	mp := mw.getPartitionByID(partitionID)
+	if mp == nil {
+		return
+	}
+	status, invalidated, reset, err := mw.renewleases(mp, inodes)
+	if err != nil || status != statusOK {
+		log.LogWarnf("RenewLeases: mp(%v) err(%v) status(%v) expired(%v)", mp, err, status, expired)
+		if expired {
+			// the meta node dropped the leases, the caches are no more served
+			return append(inodes, timed...)
+		}
+		return nil
+	}
+	succeeded = true
+	if reset || expired {
+		// the changes of the inodes may have been missed
+		log.LogWarnf("RenewLeases: mp(%v) reset(%v) expired(%v), inodes(%v) timed(%v)", mp, reset, expired, len(inodes), len(timed))
+		return append(inodes, timed...)
+	}
+	return append(invalidated, crossed...)
+}
+
+func (mw *MetaWrapper) renewleases(mp *MetaPartition, inodes []uint64) (status int, invalidated []uint64, reset bool, err error) {
+	req := &proto.RenewLeasesRequest{
+		VolName:     mw.volname,
+		PartitionID: mp.PartitionID,
+		SessionID:   mw.sessionID,
+		Inodes:      inodes,
+	}
+
+	packet := proto.NewPacket()
+	packet.Opcode = proto.OpMetaRenewLeases
+	err = packet.MarshalData(req)
+	if err != nil {
+		log.LogErrorf("renewleases: err(%v)", err)
+		return
+	}
+
+	packet, err = mw.sendToMetaPartition(mp, packet)
+	if err != nil {
+		log.LogErrorf("renewleases: mp(%v) inodes(%v) err(%v)", mp, len(inodes), err)
+		return
+	}
+
+	status = parseStatus(packet.ResultCode)
+	if status != statusOK {
+		log.LogErrorf("renewleases: mp(%v) inodes(%v) result(%v)", mp, len(inodes), packet.GetResultMesg())
+		return
+	}
+
+	resp := new(proto.RenewLeasesResponse)
+	if err = packet.UnmarshalData(resp); err != nil {
+		log.LogErrorf("renewleases: mp(%v) err(%v) PacketData(%v)", mp, err, string(packet.Data))
+		return
+	}
+	return statusOK, resp.Invalidated, resp.Reset, nil
+}
@@ -0,0 +1,344 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package meta
+
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/log"
+	"github.com/tiglabs/containerfs/util/ump"
+)
+
+const (
+	// shorter than the lease of the locks on the meta nodes
+	RenewLocksInterval = time.Second * 5
+	// renews of a partition sent again at once when a lock crossed them
+	RenewLocksRetry = 3
+)
+
+// lockTable is the locks held by the session, the leader of a meta
+// partition keeps them in memory only, they are renewed with all the locks
+// of the partition so that a new leader gets them back. The requests are
+// sent without the lock of lockTable, a renew crossing a lock request of its
+// partition, which it may have undone on the meta node, is sent again.
+type lockTable struct {
+	partitions map[uint64][]proto.InodeLock
+	renewed    map[uint64]bool   // the partitions which had locks at the last renew
+	sending    map[uint64]int    // the lock requests of the partition in flight
+	sent       map[uint64]uint64 // the lock requests of the partition sent so far
+	sync.Mutex
+}
+
+func newLockTable() *lockTable {
+	return &lockTable{
+		partitions: make(map[uint64][]proto.InodeLock),
+		renewed:    make(map[uint64]bool),
+		sending:    make(map[uint64]int),
+		sent:       make(map[uint64]uint64),
+	}
+}
+
+func (t *lockTable) startSend(partitionID uint64) {
+	t.Lock()
+	t.sending[partitionID]++
+	t.sent[partitionID]++
+	t.Unlock()
+}
+
+/*the caller must hold the lock of lockTable*/
+func (t *lockTable) endSend(partitionID uint64) {
+	if t.sending[partitionID]--; t.sending[partitionID] <= 0 {
+		delete(t.sending, partitionID)
+	}
+}
+
+/*apply the lock or the unlock to the locks of its owner as the meta node does, the caller must hold the lock of lockTable*/
+func (t *lockTable) record(partitionID, inode uint64, lock *proto.FileLock) {
+	locks := t.partitions[partitionID]
+	kept := make([]proto.InodeLock, 0, len(locks)+1)
+	for _, l := range locks {
+		h := l.Lock
+		if l.Inode != inode || h.Owner != lock.Owner || h.Flock != lock.Flock || h.End < lock.Start || lock.End < h.Start {
+			kept = append(kept, l)
+			continue
+		}
+		if h.Start < lock.Start {
+			left := l
+			left.Lock.End = lock.Start - 1
+			kept = append(kept, left)
+		}
+		if lock.End < h.End {
+			right := l
+			right.Lock.Start = lock.End + 1
+			kept = append(kept, right)
+		}
+	}
+	if lock.Type != proto.LockUnlock {
+		kept = append(kept, proto.InodeLock{Inode: inode, Lock: *lock})
+	}
+	if len(kept) == 0 {
+		delete(t.partitions, partitionID)
+		return
+	}
+	t.partitions[partitionID] = kept
+}
+
+// SetLock takes or releases, with a lock of type LockUnlock, a lock of the
+// session on the inode. It returns EAGAIN if another owner holds a
+// conflicting lock, or if the partition restores the locks after a leader
+// change.
+func (mw *MetaWrapper) SetLock(inode uint64, lock proto.FileLock) error {
+	mp := mw.getPartitionByInode(inode)
+	if mp == nil {
+		log.LogErrorf("SetLock: No such partition, ino(%v)", inode)
+		return syscall.EINVAL
+	}
+	t := mw.locks
+	t.startSend(mp.PartitionID)
+	status, err := mw.setlock(mp, inode, &lock)
+	t.Lock()
+	defer t.Unlock()
+	t.endSend(mp.PartitionID)
+	if err != nil || status != statusOK {
+		if status == statusExist {
+			return syscall.EAGAIN
+		}
+		log.LogErrorf("SetLock: ino(%v) lock(%v) err(%v) status(%v)", inode, lock, err, status)
+		if lock.Type == proto.LockUnlock {
+			// the lock is dropped by the meta node at the next renew
+			t.record(mp.PartitionID, inode, &lock)
+		}
+		return statusToErrno(status)
+	}
+	t.record(mp.PartitionID, inode, &lock)
+	return nil
+}
+
+// GetLock returns a lock of another owner conflicting with the lock, of type
+// LockUnlock if there is none.
+func (mw *MetaWrapper) GetLock(inode uint64, lock proto.FileLock) (proto.FileLock, error) {
+	mp := mw.getPartitionByInode(inode)
+	if mp == nil {
+		log.LogErrorf("GetLock: No such partition, ino(%v)", inode)
+		return lock, syscall.EINVAL
+	}
+	status, conflict, err := mw.getlock(mp, inode, &lock)
+	if err != nil || status != statusOK {
+		log.LogErrorf("GetLock: ino(%v) lock(%v) err(%v) status(%v)", inode, lock, err, status)
+		return lock, statusToErrno(status)
+	}
+	return conflict, nil
+}
+
+func (mw *MetaWrapper) renewLocks() {
+	t := time.NewTicker(RenewLocksInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			mw.RenewLocks()
+		case <-mw.evictC:
+			return
+		case <-mw.closeC:
+			return
+		}
+	}
+}
+
+// RenewLocks renews the lease of the locks of the session on every meta
+// partition in parallel, and drops the locks another session took meanwhile.
+func (mw *MetaWrapper) RenewLocks() {
+	t := mw.locks
+	t.Lock()
+	ids := make([]uint64, 0, len(t.partitions)+len(t.renewed))
+	for id := range t.partitions {
+		ids = append(ids, id)
+	}
+	for id := range t.renewed {
+		if _, ok := t.partitions[id]; !ok {
+			// the last renew after the partition has no lock of the session
+			ids = append(ids, id)
+		}
+	}
+	t.Unlock()
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		mp := mw.getPartitionByID(id)
+		if mp == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(mp *MetaPartition) {
+			defer wg.Done()
+			mw.renewPartitionLocks(mp)
+		}(mp)
+	}
+	wg.Wait()
+}
+
+func (mw *MetaWrapper) renewPartitionLocks(mp *MetaPartition) {
+	t := mw.locks
+	id := mp.PartitionID
+	for i := 0; i < RenewLocksRetry; i++ {
+		t.Lock()
+		locks := append([]proto.InodeLock{}, t.partitions[id]...)
+		crossed := t.sending[id] != 0
+		sent := t.sent[id]
+		t.Unlock()
+
+		status, lost, err := mw.renewlocks(mp, locks)
+		if err != nil || status != statusOK {
+			log.LogWarnf("RenewLocks: mp(%v) err(%v) status(%v)", mp, err, status)
+			return
+		}
+
+		t.Lock()
+		if crossed || t.sent[id] != sent {
+			// the meta node got the locks of the renew, not the lock requests meanwhile
+			t.Unlock()
+			log.LogDebugf("RenewLocks: mp(%v) crossed a lock request, renew again", mp)
+			continue
+		}
+		for _, l := range lost {
+			log.LogErrorf("RenewLocks: mp(%v) ino(%v) lock(%v) taken by another client after a leader change", mp, l.Inode, l.Lock)
+			unlock := l.Lock
+			unlock.Type = proto.LockUnlock
+			t.record(id, l.Inode, &unlock)
+		}
+		if _, ok := t.partitions[id]; ok {
+			t.renewed[id] = true
+		} else {
+			delete(t.renewed, id)
+		}
+		t.Unlock()
+		return
+	}
+	log.LogWarnf("RenewLocks: mp(%v) crossed lock requests %v times, renewed at the next interval", mp, RenewLocksRetry)
+}
+
+func (mw *MetaWrapper) setlock(mp *MetaPartition, inode uint64, lock *proto.FileLock) (status int, err error) {
+	req := &proto.SetLockRequest{
+		VolName:     mw.volname,
+		PartitionID: mp.PartitionID,
+		Inode:       inode,
+		SessionID:   mw.sessionID,
+		Lock:        *lock,
+	}
+
+	packet := proto.NewPacket()
+	packet.Opcode = proto.OpMetaSetLock
+	err = packet.MarshalData(req)
+	if err != nil {
+		log.LogErrorf("setlock: err(%v)", err)
+		return
+	}
+
+	umpKey := mw.umpKey(packet.GetOpMsg())
+	tpObject := ump.BeforeTP(umpKey)
+	defer ump.AfterTP(tpObject, err)
+
+	packet, err = mw.sendToMetaPartition(mp, packet)
+	if err != nil {
+		log.LogErrorf("setlock: mp(%v) req(%v) err(%v)", mp, *req, err)
+		return
+	}
+
+	status = parseStatus(packet.ResultCode)
+	if status != statusOK {
+		log.LogDebugf("setlock: mp(%v) req(%v) result(%v)", mp, *req, packet.GetResultMesg())
+		return
+	}
+	return statusOK, nil
+}
+
+func (mw *MetaWrapper) getlock(mp *MetaPartition, inode uint64, lock *proto.FileLock) (status int, conflict proto.FileLock, err error) {
+	req := &proto.GetLockRequest{
+		VolName:     mw.volname,
+		PartitionID: mp.PartitionID,
+		Inode:       inode,
+		SessionID:   mw.sessionID,
+		Lock:        *lock,
+	}
+
+	packet := proto.NewPacket()
+	packet.Opcode = proto.OpMetaGetLock
+	err = packet.MarshalData(req)
+	if err != nil {
+		log.LogErrorf("getlock: err(%v)", err)
+		return
+	}
+
+	umpKey := mw.umpKey(packet.GetOpMsg())
+	tpObject := ump.BeforeTP(umpKey)
+	defer ump.AfterTP(tpObject, err)
+
+	packet, err = mw.sendToMetaPartition(mp, packet)
+	if err != nil {
+		log.LogErrorf("getlock: mp(%v) req(%v) err(%v)", mp, *req, err)
+		return
+	}
+
+	status = parseStatus(packet.ResultCode)
+	if status != statusOK {
+		log.LogErrorf("getlock: mp(%v) req(%v) result(%v)", mp, *req, packet.GetResultMesg())
+		return
+	}
+
+	resp := new(proto.GetLockResponse)
+	if err = packet.UnmarshalData(resp); err != nil {
+		log.LogErrorf("getlock: mp(%v) req(%v) err(%v) PacketData(%v)", mp, *req, err, string(packet.Data))
+		return
+	}
+	return statusOK, resp.Lock, nil
+}
+
+func (mw *MetaWrapper) renewlocks(mp *MetaPartition, locks []proto.InodeLock) (status int, lost []proto.InodeLock, err error) {
+	req := &proto.RenewLocksRequest{
+		VolName:     mw.volname,
+		PartitionID: mp.PartitionID,
+		SessionID:   mw.sessionID,
+		Locks:       locks,
+	}
+
+	packet := proto.NewPacket()
+	packet.Opcode = proto.OpMetaRenewLocks
+	err = packet.MarshalData(req)
+	if err != nil {
+		log.LogErrorf("renewlocks: err(%v)", err)
+		return
+	}
+
+	packet, err = mw.sendToMetaPartition(mp, packet)
+	if err != nil {
+		log.LogErrorf("renewlocks: mp(%v) locks(%v) err(%v)", mp, len(locks), err)
+		return
+	}
+
+	status = parseStatus(packet.ResultCode)
+	if status != statusOK {
+		log.LogErrorf("renewlocks: mp(%v) locks(%v) result(%v)", mp, len(locks), packet.GetResultMesg())
+		return
+	}
+
+	resp := new(proto.RenewLocksResponse)
+	if err = packet.UnmarshalData(resp); err != nil {
+		log.LogErrorf("renewlocks: mp(%v) err(%v) PacketData(%v)", mp, err, string(packet.Data))
+		return
+	}
+	return statusOK, resp.Lost, nil
+}
@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -35,6 +36,13 @@ const (
 	GetClusterInfoURL    = "/admin/getIp"
 
 	RefreshMetaPartitionsInterval = time.Minute * 5
+
+	// Seconds a rename between two meta partitions may take before the
+	// meta nodes resolve it.
+	RenameTxTimeout = 10
+	// Tries of a rename between two meta partitions whose destination
+	// changes, or whose commit is not answered.
+	RenameTxRetry = 3
 )
 
 const (
@@ -46,6 +54,12 @@ const (
 	statusAgain
 	statusError
 	statusInval
+	statusTooManyOpen
+	statusTooManyFiles
+	statusFileTooLarge
+	statusReadOnly
+	statusAccess
+	statusNotSupp
 )
 
 type MetaWrapper struct {
@@ -67,9 +81,66 @@ type MetaWrapper struct {
 
 	totalSize uint64
 	usedSize  uint64
+
+	// Capacity of the vol set by master, zero means no quota.
+	quota uint64
+
+	// Non zero if the vol is an immutable dataset.
+	immutable uint32
+
+	// Non zero if close of a file must durably flush its written data.
+	syncOnClose uint32
+
+	// Non zero if the data may be read from the followers when the leader
+	// of a data partition is unreachable.
+	followerRead uint32
+
+	// Non zero if the nodes refuse the mutations and the writes of the vol.
+	readOnly uint32
+
+	// Non zero if the meta nodes check the ops of the vol for their callers.
+	permission uint32
+
+	// Bytes of a single file of the vol, 0 means no limit.
+	maxFileSize uint64
+
+	// Session reported to master, closing evictC means the client
+	// is evicted by master.
+	sessionID string
+	evictC    chan struct{}
+	evictOnce sync.Once
+
+	// Closing closeC stops the refresh and the session report.
+	closeC    chan struct{}
+	closeOnce sync.Once
+
+	// A misrouted reply of a meta node triggers a refresh of the partitions.
+	refreshC chan struct{}
+
+	// Handles opened by this client and not released yet.
+	openFiles int64
+
+	// Advisory locks held by the session.
+	locks *lockTable
+
+	// Inodes cached by the session with a lease, nil if not leased.
+	leases *leaseTable
+
+	// Sequence of the rename transactions of the session.
+	txSeq uint64
+
+	// Caller of the requests whose ctx carries none, nil if not set.
+	caller *proto.Caller
 }
 
 func NewMetaWrapper(volname, masterHosts string) (*MetaWrapper, error) {
+	return NewMetaWrapperWithConns(volname, masterHosts, NewSessionID(), pool.NewConnPool())
+}
+
+// NewMetaWrapperWithConns is NewMetaWrapper reporting session and sending the
+// requests to the meta nodes through conns, which may be shared by the wrappers
+// of several vols. The nodes fence session on the conns presenting it.
+func NewMetaWrapperWithConns(volname, masterHosts, session string, conns *pool.ConnectPool) (*MetaWrapper, error) {
 	mw := new(MetaWrapper)
 	mw.volname = volname
 	master := strings.Split(masterHosts, HostsSeparator)
@@ -77,22 +148,87 @@ func NewMetaWrapper(volname, masterHosts string) (*MetaWrapper, error) {
 	for _, ip := range master {
 		mw.master.AddNode(ip)
 	}
-	mw.conns = pool.NewConnPool()
+	mw.conns = conns
 	mw.partitions = make(map[uint64]*MetaPartition)
 	mw.ranges = btree.New(32)
+	mw.sessionID = session
+	mw.evictC = make(chan struct{})
+	mw.closeC = make(chan struct{})
+	mw.refreshC = make(chan struct{}, 1)
+	mw.locks = newLockTable()
+	if err := mw.ReportSession(); err == ErrClientEvicted {
+		return nil, err
+	}
 	mw.UpdateClusterInfo()
 	mw.UpdateVolStatInfo()
 	if err := mw.UpdateMetaPartitions(); err != nil {
 		return nil, err
 	}
 	go mw.refresh()
+	go mw.reportSession()
+	go mw.renewLocks()
 	return mw, nil
 }
 
+// Close stops the background refresh and session report of the wrapper,
+// a closed wrapper must not be used any more.
+func (mw *MetaWrapper) Close() {
+	mw.closeOnce.Do(func() {
+		close(mw.closeC)
+		mw.master.Stop()
+	})
+}
+
 func (mw *MetaWrapper) Cluster() string {
 	return mw.cluster
 }
 
+// Immutable returns if the vol is advertised as an immutable dataset, whose
+// metadata and data never change and can be cached indefinitely.
+func (mw *MetaWrapper) Immutable() bool {
+	return atomic.LoadUint32(&mw.immutable) != 0
+}
+
+// SyncOnClose returns if the vol asks the close of a file to be a durable
+// flush of its written data, otherwise the data is synchronized lazily.
+func (mw *MetaWrapper) SyncOnClose() bool {
+	return atomic.LoadUint32(&mw.syncOnClose) != 0
+}
+
+// FollowerRead returns if the vol allows the reads from the followers of a
+// data partition whose leader is unreachable.
+func (mw *MetaWrapper) FollowerRead() bool {
+	return atomic.LoadUint32(&mw.followerRead) != 0
+}
+
+// ReadOnly returns if the vol is set read only, the meta nodes and the data
+// nodes refuse its mutations and writes.
+func (mw *MetaWrapper) ReadOnly() bool {
+	return atomic.LoadUint32(&mw.readOnly) != 0
+}
+
+// Permission returns if the meta nodes check the owners and the modes of the
+// inodes of the vol for the callers of the requests.
+func (mw *MetaWrapper) Permission() bool {
+	return atomic.LoadUint32(&mw.permission) != 0
+}
+
+// MaxFileSize returns the bytes a single file of the vol may grow to, 0
+// means no limit.
+func (mw *MetaWrapper) MaxFileSize() uint64 {
+	return atomic.LoadUint64(&mw.maxFileSize)
+}
+
+// SessionID returns the session of this client reported to master.
+func (mw *MetaWrapper) SessionID() string {
+	return mw.sessionID
+}
+
+// OpenFiles returns the number of handles opened and not released yet.
+func (mw *MetaWrapper) OpenFiles() int64 {
+	return atomic.LoadInt64(&mw.openFiles)
+}
+
 func (mw *MetaWrapper) umpKey(act string) string {
 	return fmt.Sprintf("%s_sdk_meta_%s", mw.cluster, act)
 }
@@ -112,6 +248,16 @@ func parseStatus(result uint8) (status int) {
 		status = statusAgain
 	case proto.OpArgMismatchErr:
 		status = statusInval
+	case proto.OpTooManyOpenErr:
+		status = statusTooManyOpen
+	case proto.OpTooManyFilesErr:
+		status = statusTooManyFiles
+	case proto.OpFileTooLargeErr:
+		status = statusFileTooLarge
+	case proto.OpReadOnlyErr:
+		status = statusReadOnly
+	case proto.OpAccessErr:
+		status = statusAccess
 	default:
 		status = statusError
 	}
@@ -133,6 +279,18 @@ func statusToErrno(status int) error {
 		return syscall.EAGAIN
 	case statusInval:
 		return syscall.EINVAL
+	case statusTooManyOpen:
+		return syscall.EMFILE
+	case statusTooManyFiles:
+		return syscall.EDQUOT
+	case statusFileTooLarge:
+		return syscall.EFBIG
+	case statusReadOnly:
+		return syscall.EROFS
+	case statusAccess:
+		return syscall.EACCES
+	case statusNotSupp:
+		return syscall.EOPNOTSUPP
 	case statusError:
 		return syscall.EPERM
 	default:
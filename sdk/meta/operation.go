@@ -15,6 +15,7 @@
 package meta
 
 import (
+	"context"
 	"fmt"
 	"sync"
 
@@ -22,17 +23,22 @@ import (
 
 	"github.com/tiglabs/containerfs/proto"
 	"github.com/tiglabs/containerfs/util/log"
+	"github.com/tiglabs/containerfs/util/trace"
 	"github.com/tiglabs/containerfs/util/ump"
 )
 
 // API implementations
 //
 
-func (mw *MetaWrapper) open(mp *MetaPartition, inode uint64) (status int, err error) {
+func (mw *MetaWrapper) open(ctx context.Context, mp *MetaPartition, inode uint64, flag uint32) (status int, err error) {
 	req := &proto.OpenRequest{
 		VolName:     mw.volname,
 		PartitionID: mp.PartitionID,
 		Inode:       inode,
+		SessionID:   mw.sessionID,
+		Lease:       mw.leases != nil,
+		Flag:        flag,
+		Caller:      mw.callerOf(ctx),
 	}
 
 	packet := proto.NewPacket()
@@ -60,15 +66,53 @@ func (mw *MetaWrapper) open(mp *MetaPartition, inode uint64) (status int, err er
 	return
 }
 
-func (mw *MetaWrapper) icreate(mp *MetaPartition, mode uint32, target []byte) (status int, info *proto.InodeInfo, err error) {
+func (mw *MetaWrapper) release(mp *MetaPartition, inode uint64) (status int, err error) {
+	req := &proto.ReleaseOpenRequest{
+		VolName:     mw.volname,
+		PartitionID: mp.PartitionID,
+		Inode:       inode,
+		SessionID:   mw.sessionID,
+	}
+
+	packet := proto.NewPacket()
+	packet.Opcode = proto.OpMetaReleaseOpen
+	err = packet.MarshalData(req)
+	if err != nil {
+		log.LogErrorf("release: err(%v)", err)
+		return
+	}
+
+	umpKey := mw.umpKey(packet.GetOpMsg())
+	tpObject := ump.BeforeTP(umpKey)
+	defer ump.AfterTP(tpObject, err)
+
+	packet, err = mw.sendToMetaPartition(mp, packet)
+	if err != nil {
+		log.LogErrorf("release: mp(%v) req(%v) err(%v)", mp, *req, err)
+		return
+	}
+
+	status = parseStatus(packet.ResultCode)
+	if status != statusOK {
+		log.LogErrorf("release: mp(%v) req(%v) result(%v)", mp, *req, packet.GetResultMesg())
+	}
+	return
+}
+
+func (mw *MetaWrapper) icreate(ctx context.Context, mp *MetaPartition, parentID uint64, mode, uid, gid uint32, target []byte) (status int, info *proto.InodeInfo, err error) {
 	req := &proto.CreateInodeRequest{
 		VolName:     mw.volname,
 		PartitionID: mp.PartitionID,
 		Mode:        mode,
 		Target:      target,
+		Uid:         uid,
+		Gid:         gid,
+		Caller:      mw.callerOf(ctx),
+		ParentID:    parentID,
 	}
 
 	packet := proto.NewPacket()
+	packet.SetTrace(trace.FromContext(ctx))
 	packet.Opcode = proto.OpMetaCreateInode
 	err = packet.MarshalData(req)
 	if err != nil {
@@ -190,7 +234,7 @@ func (mw *MetaWrapper) ievict(mp *MetaPartition, inode uint64) (status int, err
 	return statusOK, nil
 }
 
-func (mw *MetaWrapper) dcreate(mp *MetaPartition, parentID uint64, name string, inode uint64, mode uint32) (status int, err error) {
+func (mw *MetaWrapper) dcreate(ctx context.Context, mp *MetaPartition, parentID uint64, name string, inode uint64, mode uint32) (status int, err error) {
 	req := &proto.CreateDentryRequest{
 		VolName:     mw.volname,
 		PartitionID: mp.PartitionID,
@@ -198,9 +242,12 @@ func (mw *MetaWrapper) dcreate(mp *MetaPartition, parentID uint64, name string,
 		Inode:       inode,
 		Name:        name,
 		Mode:        mode,
+		Caller:      mw.callerOf(ctx),
+		Path:        pathOf(ctx, parentID, name),
 	}
 
 	packet := proto.NewPacket()
+	packet.SetTrace(trace.FromContext(ctx))
 	packet.Opcode = proto.OpMetaCreateDentry
 	err = packet.MarshalData(req)
 	if err != nil {
@@ -228,16 +275,19 @@ func (mw *MetaWrapper) dcreate(mp *MetaPartition, parentID uint64, name string,
 	return
 }
 
-func (mw *MetaWrapper) dupdate(mp *MetaPartition, parentID uint64, name string, newInode uint64) (status int, oldInode uint64, err error) {
+func (mw *MetaWrapper) dupdate(ctx context.Context, mp *MetaPartition, parentID uint64, name string, newInode uint64) (status int, oldInode uint64, err error) {
 	req := &proto.UpdateDentryRequest{
 		VolName:     mw.volname,
 		PartitionID: mp.PartitionID,
 		ParentID:    parentID,
 		Name:        name,
 		Inode:       newInode,
+		Caller:      mw.callerOf(ctx),
+		Path:        pathOf(ctx, parentID, name),
 	}
 
 	packet := proto.NewPacket()
+	packet.SetTrace(trace.FromContext(ctx))
 	packet.Opcode = proto.OpMetaUpdateDentry
 	err = packet.MarshalData(req)
 	if err != nil {
@@ -273,15 +323,20 @@ func (mw *MetaWrapper) dupdate(mp *MetaPartition, parentID uint64, name string,
 	return statusOK, resp.Inode, nil
 }
 
-func (mw *MetaWrapper) ddelete(mp *MetaPartition, parentID uint64, name string) (status int, inode uint64, err error) {
+/*the dentry is deleted only if it is of ino, whatever its inode if ino is 0*/
+func (mw *MetaWrapper) ddelete(ctx context.Context, mp *MetaPartition, parentID uint64, name string, ino uint64) (status int, inode uint64, err error) {
 	req := &proto.DeleteDentryRequest{
 		VolName:     mw.volname,
 		PartitionID: mp.PartitionID,
 		ParentID:    parentID,
 		Name:        name,
+		Caller:      mw.callerOf(ctx),
+		Inode:       ino,
+		Path:        pathOf(ctx, parentID, name),
 	}
 
 	packet := proto.NewPacket()
+	packet.SetTrace(trace.FromContext(ctx))
 	packet.Opcode = proto.OpMetaDeleteDentry
 	err = packet.MarshalData(req)
 	if err != nil {
@@ -317,14 +372,19 @@ func (mw *MetaWrapper) ddelete(mp *MetaPartition, parentID uint64, name string)
 	return statusOK, resp.Inode, nil
 }
 
-func (mw *MetaWrapper) lookup(mp *MetaPartition, parentID uint64, name string) (status int, inode uint64, mode uint32, err error) {
+func (mw *MetaWrapper) lookup(ctx context.Context, mp *MetaPartition, parentID uint64, name string) (status int, inode uint64, mode uint32, err error) {
 	req := &proto.LookupRequest{
-		VolName:     mw.volname,
-		PartitionID: mp.PartitionID,
-		ParentID:    parentID,
-		Name:        name,
-	}
+		VolName:      mw.volname,
+		PartitionID:  mp.PartitionID,
+		ParentID:     parentID,
+		Name:         name,
+		SessionID:    mw.sessionID,
+		LeaseSeconds: mw.leases.seconds(),
+		Caller:       mw.callerOf(ctx),
+	}
+	mw.leases.grant(mp.PartitionID, parentID)
 	packet := proto.NewPacket()
+	packet.SetTrace(trace.FromContext(ctx))
 	packet.Opcode = proto.OpMetaLookup
 	err = packet.MarshalData(req)
 	if err != nil {
@@ -366,10 +426,13 @@ func (mw *MetaWrapper) lookup(mp *MetaPartition, parentID uint64, name string) (
 
 func (mw *MetaWrapper) iget(mp *MetaPartition, inode uint64) (status int, info *proto.InodeInfo, err error) {
 	req := &proto.InodeGetRequest{
-		VolName:     mw.volname,
-		PartitionID: mp.PartitionID,
-		Inode:       inode,
+		VolName:      mw.volname,
+		PartitionID:  mp.PartitionID,
+		Inode:        inode,
+		SessionID:    mw.sessionID,
+		LeaseSeconds: mw.leases.seconds(),
 	}
+	mw.leases.grant(mp.PartitionID, inode)
 
 	packet := proto.NewPacket()
 	packet.Opcode = proto.OpMetaInodeGet
@@ -410,10 +473,13 @@ func (mw *MetaWrapper) batchIget(wg *sync.WaitGroup, mp *MetaPartition, inodes [
 		err error
 	)
 	req := &proto.BatchInodeGetRequest{
-		VolName:     mw.volname,
-		PartitionID: mp.PartitionID,
-		Inodes:      inodes,
+		VolName:      mw.volname,
+		PartitionID:  mp.PartitionID,
+		Inodes:       inodes,
+		SessionID:    mw.sessionID,
+		LeaseSeconds: mw.leases.seconds(),
 	}
+	mw.leases.grant(mp.PartitionID, inodes...)
 
 	packet := proto.NewPacket()
 	packet.Opcode = proto.OpMetaBatchInodeGet
@@ -455,14 +521,21 @@ func (mw *MetaWrapper) batchIget(wg *sync.WaitGroup, mp *MetaPartition, inodes [
 	}
 }
 
-func (mw *MetaWrapper) readdir(mp *MetaPartition, parentID uint64) (status int, children []proto.Dentry, err error) {
+func (mw *MetaWrapper) readdir(ctx context.Context, mp *MetaPartition, parentID uint64, marker string, limit uint64) (status int, children []proto.Dentry, next string, err error) {
 	req := &proto.ReadDirRequest{
-		VolName:     mw.volname,
-		PartitionID: mp.PartitionID,
-		ParentID:    parentID,
+		VolName:      mw.volname,
+		PartitionID:  mp.PartitionID,
+		ParentID:     parentID,
+		Marker:       marker,
+		Limit:        limit,
+		SessionID:    mw.sessionID,
+		LeaseSeconds: mw.leases.seconds(),
+		Caller:       mw.callerOf(ctx),
 	}
+	mw.leases.grant(mp.PartitionID, parentID)
 
 	packet := proto.NewPacket()
+	packet.SetTrace(trace.FromContext(ctx))
 	packet.Opcode = proto.OpMetaReadDir
 	err = packet.MarshalData(req)
 	if err != nil {
@@ -493,8 +566,8 @@ func (mw *MetaWrapper) readdir(mp *MetaPartition, parentID uint64) (status int,
 		log.LogErrorf("readdir: mp(%v) err(%v) PacketData(%v)", mp, err, string(packet.Data))
 		return
 	}
-	log.LogDebugf("readdir: mp(%v) req(%v) dentries(%v)", mp, *req, resp.Children)
-	return statusOK, resp.Children, nil
+	log.LogDebugf("readdir: mp(%v) req(%v) dentries(%v) next(%v)", mp, *req, len(resp.Children), resp.Next)
+	return statusOK, resp.Children, resp.Next, nil
 }
 
 func (mw *MetaWrapper) appendExtentKey(mp *MetaPartition, inode uint64, extent proto.ExtentKey) (status int, err error) {
@@ -503,6 +576,8 @@ func (mw *MetaWrapper) appendExtentKey(mp *MetaPartition, inode uint64, extent p
 		PartitionID: mp.PartitionID,
 		Inode:       inode,
 		Extent:      extent,
+		SessionID:   mw.sessionID,
+		Caller:      mw.caller,
 	}
 
 	packet := proto.NewPacket()
@@ -530,11 +605,80 @@ func (mw *MetaWrapper) appendExtentKey(mp *MetaPartition, inode uint64, extent p
 	return status, nil
 }
 
+func (mw *MetaWrapper) replaceExtentKeys(mp *MetaPartition, inode uint64, oldExtents, newExtents []proto.ExtentKey) (status int, err error) {
+	req := &proto.ReplaceExtentKeysRequest{
+		VolName:     mw.volname,
+		PartitionID: mp.PartitionID,
+		Inode:       inode,
+		OldExtents:  oldExtents,
+		NewExtents:  newExtents,
+	}
+
+	packet := proto.NewPacket()
+	packet.Opcode = proto.OpMetaExtentsReplace
+	err = packet.MarshalData(req)
+	if err != nil {
+		log.LogErrorf("replaceExtentKeys: err(%v)", err)
+		return
+	}
+
+	umpKey := mw.umpKey(packet.GetOpMsg())
+	tpObject := ump.BeforeTP(umpKey)
+	defer ump.AfterTP(tpObject, err)
+
+	packet, err = mw.sendToMetaPartition(mp, packet)
+	if err != nil {
+		log.LogErrorf("replaceExtentKeys: mp(%v) ino(%v) err(%v)", mp, inode, err)
+		return
+	}
+
+	status = parseStatus(packet.ResultCode)
+	if status != statusOK {
+		log.LogErrorf("replaceExtentKeys: mp(%v) ino(%v) result(%v)", mp, inode, packet.GetResultMesg())
+	}
+	return status, nil
+}
+
+func (mw *MetaWrapper) listOrphans(mp *MetaPartition) (status int, inodes []uint64, err error) {
+	req := &proto.ListOrphansRequest{
+		VolName:     mw.volname,
+		PartitionID: mp.PartitionID,
+	}
+
+	packet := proto.NewPacket()
+	packet.Opcode = proto.OpMetaListOrphans
+	err = packet.MarshalData(req)
+	if err != nil {
+		log.LogErrorf("listOrphans: err(%v)", err)
+		return
+	}
+
+	packet, err = mw.sendToMetaPartition(mp, packet)
+	if err != nil {
+		log.LogErrorf("listOrphans: mp(%v) err(%v)", mp, err)
+		return
+	}
+
+	status = parseStatus(packet.ResultCode)
+	if status != statusOK {
+		log.LogErrorf("listOrphans: mp(%v) result(%v)", mp, packet.GetResultMesg())
+		return
+	}
+
+	resp := new(proto.ListOrphansResponse)
+	if err = packet.UnmarshalData(resp); err != nil {
+		log.LogErrorf("listOrphans: mp(%v) err(%v) PacketData(%v)", mp, err, string(packet.Data))
+		return
+	}
+	return statusOK, resp.Inodes, nil
+}
+
 func (mw *MetaWrapper) getExtents(mp *MetaPartition, inode uint64) (status int, extents []proto.ExtentKey, err error) {
 	req := &proto.GetExtentsRequest{
 		VolName:     mw.volname,
 		PartitionID: mp.PartitionID,
 		Inode:       inode,
+		Caller:      mw.caller,
 	}
 
 	packet := proto.NewPacket()
@@ -571,16 +715,19 @@ func (mw *MetaWrapper) getExtents(mp *MetaPartition, inode uint64) (status int,
 	return statusOK, resp.Extents, nil
 }
 
-func (mw *MetaWrapper) truncate(mp *MetaPartition, inode uint64) (status int, err error) {
+func (mw *MetaWrapper) truncate(ctx context.Context, mp *MetaPartition, inode uint64) (status int, err error) {
 	req := &proto.TruncateRequest{
 		VolName:     mw.volname,
 		PartitionID: mp.PartitionID,
 		Inode:       inode,
 		FileOffset:  0,
 		Size:        0,
+		SessionID:   mw.sessionID,
+		Caller:      mw.callerOf(ctx),
 	}
 
 	packet := proto.NewPacket()
+	packet.SetTrace(trace.FromContext(ctx))
 	packet.Opcode = proto.OpMetaTruncate
 	err = packet.MarshalData(req)
 	if err != nil {
@@ -658,7 +805,7 @@ func (mw *MetaWrapper) ilink(mp *MetaPartition, inode uint64) (status int, info
 	return statusOK, resp.Info, nil
 }
 
-func (mw *MetaWrapper) setattr(mp *MetaPartition, inode uint64, valid, mode, uid, gid uint32) (status int, err error) {
+func (mw *MetaWrapper) setattr(ctx context.Context, mp *MetaPartition, inode uint64, valid, mode, uid, gid uint32) (status int, err error) {
 	req := &proto.SetattrRequest{
 		VolName:     mw.volname,
 		PartitionID: mp.PartitionID,
@@ -667,9 +814,12 @@ func (mw *MetaWrapper) setattr(mp *MetaPartition, inode uint64, valid, mode, uid
 		Mode:        mode,
 		Uid:         uid,
 		Gid:         gid,
+		SessionID:   mw.sessionID,
+		Caller:      mw.callerOf(ctx),
 	}
 
 	packet := proto.NewPacket()
+	packet.SetTrace(trace.FromContext(ctx))
 	packet.Opcode = proto.OpMetaSetattr
 	err = packet.MarshalData(req)
 	if err != nil {
@@ -698,3 +848,291 @@ func (mw *MetaWrapper) setattr(mp *MetaPartition, inode uint64, valid, mode, uid
 	log.LogDebugf("setattr exit: mp(%v) req(%v)", mp, *req)
 	return statusOK, nil
 }
+
+func (mw *MetaWrapper) setxattr(ctx context.Context, mp *MetaPartition, inode uint64, name string, value []byte, flags uint32) (status int, err error) {
+	req := &proto.SetXAttrRequest{
+		VolName:     mw.volname,
+		PartitionID: mp.PartitionID,
+		Inode:       inode,
+		Name:        name,
+		Value:       value,
+		Flags:       flags,
+		Caller:      mw.callerOf(ctx),
+	}
+
+	packet := proto.NewPacket()
+	packet.SetTrace(trace.FromContext(ctx))
+	packet.Opcode = proto.OpMetaSetXAttr
+	err = packet.MarshalData(req)
+	if err != nil {
+		log.LogErrorf("setxattr: err(%v)", err)
+		return
+	}
+
+	umpKey := mw.umpKey(packet.GetOpMsg())
+	tpObject := ump.BeforeTP(umpKey)
+	defer ump.AfterTP(tpObject, err)
+
+	packet, err = mw.sendToMetaPartition(mp, packet)
+	if err != nil {
+		log.LogErrorf("setxattr: mp(%v) ino(%v) name(%v) err(%v)", mp, inode, name, err)
+		return
+	}
+
+	status = parseStatus(packet.ResultCode)
+	if packet.GetErrCode() == proto.ErrCodeUnknownOp {
+		// a meta node of a release or a format without the xattrs
+		status = statusNotSupp
+	}
+	if status != statusOK {
+		log.LogDebugf("setxattr: mp(%v) ino(%v) name(%v) result(%v)", mp, inode, name, packet.GetResultMesg())
+		return
+	}
+	return statusOK, nil
+}
+
+func (mw *MetaWrapper) getxattr(ctx context.Context, mp *MetaPartition, inode uint64, name string) (status int, value []byte, err error) {
+	req := &proto.GetXAttrRequest{
+		VolName:     mw.volname,
+		PartitionID: mp.PartitionID,
+		Inode:       inode,
+		Name:        name,
+		Caller:      mw.callerOf(ctx),
+	}
+
+	packet := proto.NewPacket()
+	packet.Opcode = proto.OpMetaGetXAttr
+	err = packet.MarshalData(req)
+	if err != nil {
+		log.LogErrorf("getxattr: err(%v)", err)
+		return
+	}
+
+	umpKey := mw.umpKey(packet.GetOpMsg())
+	tpObject := ump.BeforeTP(umpKey)
+	defer ump.AfterTP(tpObject, err)
+
+	packet, err = mw.sendToMetaPartition(mp, packet)
+	if err != nil {
+		log.LogErrorf("getxattr: mp(%v) req(%v) err(%v)", mp, *req, err)
+		return
+	}
+
+	status = parseStatus(packet.ResultCode)
+	if status != statusOK {
+		// a missing xattr is the common result of getxattr
+		log.LogDebugf("getxattr: mp(%v) req(%v) result(%v)", mp, *req, packet.GetResultMesg())
+		return
+	}
+
+	resp := new(proto.GetXAttrResponse)
+	if err = packet.UnmarshalData(resp); err != nil {
+		log.LogErrorf("getxattr: mp(%v) req(%v) err(%v) PacketData(%v)", mp, *req, err, string(packet.Data))
+		return
+	}
+	return statusOK, resp.Value, nil
+}
+
+func (mw *MetaWrapper) listxattr(mp *MetaPartition, inode uint64) (status int, names []string, err error) {
+	req := &proto.ListXAttrRequest{
+		VolName:     mw.volname,
+		PartitionID: mp.PartitionID,
+		Inode:       inode,
+	}
+
+	packet := proto.NewPacket()
+	packet.Opcode = proto.OpMetaListXAttr
+	err = packet.MarshalData(req)
+	if err != nil {
+		log.LogErrorf("listxattr: err(%v)", err)
+		return
+	}
+
+	umpKey := mw.umpKey(packet.GetOpMsg())
+	tpObject := ump.BeforeTP(umpKey)
+	defer ump.AfterTP(tpObject, err)
+
+	packet, err = mw.sendToMetaPartition(mp, packet)
+	if err != nil {
+		log.LogErrorf("listxattr: mp(%v) req(%v) err(%v)", mp, *req, err)
+		return
+	}
+
+	status = parseStatus(packet.ResultCode)
+	if status != statusOK {
+		log.LogErrorf("listxattr: mp(%v) req(%v) result(%v)", mp, *req, packet.GetResultMesg())
+		return
+	}
+
+	resp := new(proto.ListXAttrResponse)
+	if err = packet.UnmarshalData(resp); err != nil {
+		log.LogErrorf("listxattr: mp(%v) req(%v) err(%v) PacketData(%v)", mp, *req, err, string(packet.Data))
+		return
+	}
+	return statusOK, resp.Names, nil
+}
+
+func (mw *MetaWrapper) removexattr(ctx context.Context, mp *MetaPartition, inode uint64, name string) (status int, err error) {
+	req := &proto.RemoveXAttrRequest{
+		VolName:     mw.volname,
+		PartitionID: mp.PartitionID,
+		Inode:       inode,
+		Name:        name,
+		Caller:      mw.callerOf(ctx),
+	}
+
+	packet := proto.NewPacket()
+	packet.SetTrace(trace.FromContext(ctx))
+	packet.Opcode = proto.OpMetaRemoveXAttr
+	err = packet.MarshalData(req)
+	if err != nil {
+		log.LogErrorf("removexattr: err(%v)", err)
+		return
+	}
+
+	umpKey := mw.umpKey(packet.GetOpMsg())
+	tpObject := ump.BeforeTP(umpKey)
+	defer ump.AfterTP(tpObject, err)
+
+	packet, err = mw.sendToMetaPartition(mp, packet)
+	if err != nil {
+		log.LogErrorf("removexattr: mp(%v) req(%v) err(%v)", mp, *req, err)
+		return
+	}
+
+	status = parseStatus(packet.ResultCode)
+	if status != statusOK {
+		log.LogDebugf("removexattr: mp(%v) req(%v) result(%v)", mp, *req, packet.GetResultMesg())
+		return
+	}
+	return statusOK, nil
+}
+
+func (mw *MetaWrapper) txPrepare(ctx context.Context, mp *MetaPartition, req *proto.TxPrepareRequest) (status int, oldInode uint64, err error) {
+	req.VolName = mw.volname
+	req.PartitionID = mp.PartitionID
+	req.Caller = mw.callerOf(ctx)
+	req.Path = pathOf(ctx, req.ParentID, req.Name)
+
+	packet := proto.NewPacket()
+	packet.SetTrace(trace.FromContext(ctx))
+	packet.Opcode = proto.OpMetaTxPrepare
+	err = packet.MarshalData(req)
+	if err != nil {
+		log.LogErrorf("txPrepare: err(%v)", err)
+		return
+	}
+
+	log.LogDebugf("txPrepare enter: mp(%v) req(%v)", mp, string(packet.Data))
+
+	umpKey := mw.umpKey(packet.GetOpMsg())
+	tpObject := ump.BeforeTP(umpKey)
+	defer ump.AfterTP(tpObject, err)
+
+	packet, err = mw.sendToMetaPartition(mp, packet)
+	if err != nil {
+		log.LogErrorf("txPrepare: mp(%v) req(%v) err(%v)", mp, *req, err)
+		return
+	}
+
+	status = parseStatus(packet.ResultCode)
+	if status != statusOK {
+		log.LogErrorf("txPrepare: mp(%v) req(%v) result(%v)", mp, *req, packet.GetResultMesg())
+		return
+	}
+
+	resp := new(proto.TxPrepareResponse)
+	err = packet.UnmarshalData(resp)
+	if err != nil {
+		log.LogErrorf("txPrepare: mp(%v) err(%v) PacketData(%v)", mp, err, string(packet.Data))
+		return
+	}
+	log.LogDebugf("txPrepare exit: mp(%v) req(%v) oldIno(%v)", mp, *req, resp.OldInode)
+	return statusOK, resp.OldInode, nil
+}
+
+func (mw *MetaWrapper) txCommit(mp *MetaPartition, txID string) (status int, err error) {
+	return mw.txEnd(mp, proto.OpMetaTxCommit, txID)
+}
+
+func (mw *MetaWrapper) txAbort(mp *MetaPartition, txID string) (status int, err error) {
+	return mw.txEnd(mp, proto.OpMetaTxAbort, txID)
+}
+
+func (mw *MetaWrapper) txStatus(mp *MetaPartition, txID string) (txStatus uint8, err error) {
+	req := &proto.TxRequest{
+		VolName:     mw.volname,
+		PartitionID: mp.PartitionID,
+		TxID:        txID,
+	}
+
+	packet := proto.NewPacket()
+	packet.Opcode = proto.OpMetaTxStatus
+	err = packet.MarshalData(req)
+	if err != nil {
+		log.LogErrorf("txStatus: err(%v)", err)
+		return
+	}
+
+	log.LogDebugf("txStatus enter: mp(%v) req(%v)", mp, string(packet.Data))
+
+	umpKey := mw.umpKey(packet.GetOpMsg())
+	tpObject := ump.BeforeTP(umpKey)
+	defer ump.AfterTP(tpObject, err)
+
+	packet, err = mw.sendToMetaPartition(mp, packet)
+	if err != nil {
+		log.LogErrorf("txStatus: mp(%v) req(%v) err(%v)", mp, *req, err)
+		return
+	}
+	if packet.ResultCode != proto.OpOk {
+		err = fmt.Errorf("txStatus: mp(%v) req(%v) result(%v)", mp, *req, packet.GetResultMesg())
+		log.LogErrorf("%v", err)
+		return
+	}
+
+	resp := new(proto.TxStatusResponse)
+	err = packet.UnmarshalData(resp)
+	if err != nil {
+		log.LogErrorf("txStatus: mp(%v) err(%v) PacketData(%v)", mp, err, string(packet.Data))
+		return
+	}
+	log.LogDebugf("txStatus exit: mp(%v) req(%v) status(%v)", mp, *req, resp.Status)
+	return resp.Status, nil
+}
+
+func (mw *MetaWrapper) txEnd(mp *MetaPartition, opcode uint8, txID string) (status int, err error) {
+	req := &proto.TxRequest{
+		VolName:     mw.volname,
+		PartitionID: mp.PartitionID,
+		TxID:        txID,
+	}
+
+	packet := proto.NewPacket()
+	packet.Opcode = opcode
+	op := packet.GetOpMsg()
+	err = packet.MarshalData(req)
+	if err != nil {
+		log.LogErrorf("%v: err(%v)", op, err)
+		return
+	}
+
+	log.LogDebugf("%v enter: mp(%v) req(%v)", op, mp, string(packet.Data))
+
+	umpKey := mw.umpKey(op)
+	tpObject := ump.BeforeTP(umpKey)
+	defer ump.AfterTP(tpObject, err)
+
+	packet, err = mw.sendToMetaPartition(mp, packet)
+	if err != nil {
+		log.LogErrorf("%v: mp(%v) req(%v) err(%v)", op, mp, *req, err)
+		return
+	}
+
+	status = parseStatus(packet.ResultCode)
+	if status != statusOK {
+		log.LogErrorf("%v: mp(%v) req(%v) result(%v)", op, mp, *req, packet.GetResultMesg())
+	}
+	log.LogDebugf("%v exit: mp(%v) req(%v) result(%v)", op, mp, *req, packet.GetResultMesg())
+	return
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package meta
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	ClientSessionURL            = "/client/session"
+	ReportClientSessionInterval = time.Second * 30
+)
+
+var (
+	ErrClientEvicted = errors.New("client is evicted by master")
+)
+
+type ClientSessionView struct {
+	ID              string
+	Evicted         bool
+	FenceExpireTime int64
+}
+
+// NewSessionID returns a new session of a client, a process sharing its
+// connections among the vols it mounts reports the same session for all.
+func NewSessionID() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%v_%v_%v", hostname, os.Getpid(), time.Now().UnixNano())
+}
+
+// ReportSession keeps the session of this client alive on master, and marks
+// the client evicted if master asks so.
+func (mw *MetaWrapper) ReportSession() error {
+	params := make(map[string]string)
+	params["name"] = mw.volname
+	params["id"] = mw.sessionID
+	body, err := mw.master.Request(http.MethodPost, ClientSessionURL, params, nil)
+	if err != nil {
+		log.LogWarnf("ReportSession request: err(%v)", err)
+		return err
+	}
+
+	view := new(ClientSessionView)
+	if err = json.Unmarshal(body, view); err != nil {
+		log.LogWarnf("ReportSession unmarshal: err(%v) body(%v)", err, string(body))
+		return err
+	}
+	if view.Evicted {
+		mw.evictOnce.Do(func() {
+			log.LogErrorf("ReportSession: session(%v) evicted by master, fenced until(%v)",
+				mw.sessionID, time.Unix(view.FenceExpireTime, 0))
+			close(mw.evictC)
+		})
+		return ErrClientEvicted
+	}
+	return nil
+}
+
+// Evicted returns a channel which is closed once the client is evicted by
+// master, the client should unmount then.
+func (mw *MetaWrapper) Evicted() <-chan struct{} {
+	return mw.evictC
+}
+
+func (mw *MetaWrapper) isEvicted() bool {
+	select {
+	case <-mw.evictC:
+		return true
+	default:
+	}
+	return false
+}
+
+func (mw *MetaWrapper) reportSession() {
+	t := time.NewTicker(ReportClientSessionInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			mw.ReportSession()
+		case <-mw.evictC:
+			return
+		case <-mw.closeC:
+			return
+		}
+	}
+}
@@ -35,6 +35,12 @@ var (
 
 type VolumeView struct {
 	VolName        string
+	Immutable      bool
+	SyncOnClose    bool
+	FollowerRead   bool
+	ReadOnly       bool
+	Permission     bool
+	MaxFileSize    uint64
 	MetaPartitions []*MetaPartition
 }
 
@@ -46,6 +52,7 @@ type VolStatInfo struct {
 	Name      string
 	TotalSize uint64
 	UsedSize  uint64
+	Quota     uint64
 }
 
 // VolName view managements
@@ -101,6 +108,7 @@ func (mw *MetaWrapper) UpdateVolStatInfo() error {
 	log.LogInfof("UpdateVolStatInfo: info(%v)", *info)
 	atomic.StoreUint64(&mw.totalSize, info.TotalSize)
 	atomic.StoreUint64(&mw.usedSize, info.UsedSize)
+	atomic.StoreUint64(&mw.quota, info.Quota)
 	return nil
 }
 
@@ -114,16 +122,55 @@ func (mw *MetaWrapper) UpdateMetaPartitions() error {
 		mw.replaceOrInsertPartition(mp)
 		log.LogInfof("UpdateMetaPartition: mp(%v)", mp)
 	}
+	if nv.Immutable {
+		atomic.StoreUint32(&mw.immutable, 1)
+	} else {
+		atomic.StoreUint32(&mw.immutable, 0)
+	}
+	if nv.SyncOnClose {
+		atomic.StoreUint32(&mw.syncOnClose, 1)
+	} else {
+		atomic.StoreUint32(&mw.syncOnClose, 0)
+	}
+	if nv.FollowerRead {
+		atomic.StoreUint32(&mw.followerRead, 1)
+	} else {
+		atomic.StoreUint32(&mw.followerRead, 0)
+	}
+	if nv.ReadOnly {
+		atomic.StoreUint32(&mw.readOnly, 1)
+	} else {
+		atomic.StoreUint32(&mw.readOnly, 0)
+	}
+	if nv.Permission {
+		atomic.StoreUint32(&mw.permission, 1)
+	} else {
+		atomic.StoreUint32(&mw.permission, 0)
+	}
+	atomic.StoreUint64(&mw.maxFileSize, nv.MaxFileSize)
 	return nil
 }
 
+/*refresh the partitions in the background, the triggers during a refresh are merged*/
+func (mw *MetaWrapper) triggerRefresh() {
+	select {
+	case mw.refreshC <- struct{}{}:
+	default:
+	}
+}
+
 func (mw *MetaWrapper) refresh() {
 	t := time.NewTicker(RefreshMetaPartitionsInterval)
+	defer t.Stop()
 	for {
 		select {
 		case <-t.C:
 			mw.UpdateMetaPartitions()
 			mw.UpdateVolStatInfo()
+		case <-mw.refreshC:
+			mw.UpdateMetaPartitions()
+		case <-mw.closeC:
+			return
 		}
 	}
 }
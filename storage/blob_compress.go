@@ -0,0 +1,123 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+	"github.com/tiglabs/containerfs/proto"
+)
+
+// Codecs of the blob objects, kept in the top bits of the size of the object
+// header. The object header of a compressed object has the stored size, the
+// data starts with the raw size followed by the compressed bytes. An object the
+// codec doesn't make smaller is stored raw. The codec of an encrypted object
+// has CodecEncrypted set, it is compressed before encrypted.
+const (
+	CodecNone uint8 = iota
+	CodecLZ4
+	CodecZstd
+)
+
+const (
+	CodecEncrypted uint8 = 1 << 3
+)
+
+const (
+	ObjectCodecShift   = 28
+	MaxObjectSize      = 1<<ObjectCodecShift - 1
+	compressHeaderSize = 4
+)
+
+var (
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+func init() {
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+	// the indexes of version 1 have no codec, the top bits of their sizes are 0
+	RegisterMigration(&Migration{Kind: FormatIndex, From: 1, Upgrade: func(dataDir string) error {
+		return nil
+	}})
+}
+
+// ParseCodec returns the codec of a compression of the vols.
+func ParseCodec(compression string) (codec uint8, err error) {
+	switch compression {
+	case proto.CompressionNone:
+		return CodecNone, nil
+	case proto.CompressionLZ4:
+		return CodecLZ4, nil
+	case proto.CompressionZstd:
+		return CodecZstd, nil
+	}
+	return CodecNone, fmt.Errorf("unknown compression %v", compression)
+}
+
+/*the stored bytes of the object compressed by codec, nil if it isn't smaller*/
+func compressObject(codec uint8, data []byte) (stored []byte) {
+	switch codec {
+	case CodecLZ4:
+		buf := make([]byte, compressHeaderSize+lz4.CompressBlockBound(len(data)))
+		n, err := lz4.CompressBlock(data, buf[compressHeaderSize:], nil)
+		if err != nil || n == 0 {
+			return nil
+		}
+		stored = buf[:compressHeaderSize+n]
+	case CodecZstd:
+		stored = zstdEncoder.EncodeAll(data, make([]byte, compressHeaderSize, compressHeaderSize+len(data)))
+	default:
+		return nil
+	}
+	if len(stored) >= len(data) {
+		return nil
+	}
+	binary.BigEndian.PutUint32(stored[:compressHeaderSize], uint32(len(data)))
+	return
+}
+
+/*the raw bytes of an object compressed by codec*/
+func decompressObject(codec uint8, stored []byte) (data []byte, err error) {
+	if codec == CodecNone {
+		return stored, nil
+	}
+	if len(stored) < compressHeaderSize {
+		return nil, ErrCorruptObject
+	}
+	size := int(binary.BigEndian.Uint32(stored[:compressHeaderSize]))
+	if size > MaxObjectSize {
+		return nil, ErrCorruptObject
+	}
+	switch codec {
+	case CodecLZ4:
+		data = make([]byte, size)
+		var n int
+		if n, err = lz4.UncompressBlock(stored[compressHeaderSize:], data); err == nil && n != size {
+			err = ErrCorruptObject
+		}
+	case CodecZstd:
+		if data, err = zstdDecoder.DecodeAll(stored[compressHeaderSize:], make([]byte, 0, size)); err == nil && len(data) != size {
+			err = ErrCorruptObject
+		}
+	default:
+		err = fmt.Errorf("unknown codec %v", codec)
+	}
+	return
+}
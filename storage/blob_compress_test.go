@@ -0,0 +1,56 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestObject_Codec(t *testing.T) {
+	buf := make([]byte, ObjectHeaderSize)
+	for _, o := range []*Object{
+		{Oid: 1, Offset: 10, Size: 100, Crc: 7, Codec: CodecNone},
+		{Oid: 2, Offset: 20, Size: MaxObjectSize, Crc: 8, Codec: CodecZstd},
+		{Oid: 3, Offset: 30, Size: MarkDeleteObject, Crc: 9},
+	} {
+		o.Marshal(buf)
+		got := new(Object)
+		got.Unmarshal(buf)
+		if *got != *o {
+			t.Fatalf("object act[%+v] exp[%+v]", got, o)
+		}
+	}
+}
+
+func TestObject_Compress(t *testing.T) {
+	data := bytes.Repeat([]byte("containerfs blob object "), 1024)
+	for _, codec := range []uint8{CodecLZ4, CodecZstd} {
+		stored := compressObject(codec, data)
+		if stored == nil || len(stored) >= len(data) {
+			t.Fatalf("codec %v not compressed", codec)
+		}
+		raw, err := decompressObject(codec, stored)
+		if err != nil || !bytes.Equal(raw, data) {
+			t.Fatalf("codec %v decode err[%v]", codec, err)
+		}
+		if _, err = decompressObject(codec, stored[:len(stored)/2]); err == nil {
+			t.Fatalf("codec %v decoded truncated object", codec)
+		}
+	}
+	if stored := compressObject(CodecLZ4, []byte{1, 2, 3}); stored != nil {
+		t.Fatalf("object not smaller is compressed")
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"encoding/binary"
 	"hash/crc32"
 	"os"
+	"path"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -58,7 +59,22 @@ func (c *BlobFile) applyDelObjects(objects []uint64) (err error) {
 	return
 }
 
+// allocatedSize returns the disk space of the blob file and its index.
+func (c *BlobFile) allocatedSize() (size int64) {
+	c.commitLock.RLock()
+	defer c.commitLock.RUnlock()
+	for _, file := range []*os.File{c.file, c.tree.idxFile} {
+		if info, err := file.Stat(); err == nil {
+			size += AllocatedSize(info)
+		}
+	}
+	return
+}
+
 func (c *BlobFile) loadTree(name string) (maxOid uint64, err error) {
+	if err = recoverCompaction(name); err != nil {
+		return
+	}
 	if c.file, err = os.OpenFile(name, BlobFileOpenOpt, 0666); err != nil {
 		return
 	}
@@ -156,8 +172,11 @@ func (c *BlobFile) doCompact() (err error) {
 	if err = c.copyValidData(tree, newDatFile); err != nil {
 		return err
 	}
+	if err = newDatFile.Sync(); err != nil {
+		return err
+	}
 
-	return nil
+	return newIdxFile.Sync()
 }
 
 func (c *BlobFile) copyValidData(dstNm *ObjectTree, dstDatFile *os.File) (err error) {
@@ -219,27 +238,36 @@ func (c *BlobFile) copyValidData(dstNm *ObjectTree, dstDatFile *os.File) (err er
 	return err
 }
 
+// The rename of the new index to .commitIndex is the commit point of a
+// compaction, the data and the index are replaced after it and a compaction
+// found committed at loading is rolled forward, the one not committed is
+// dropped. A reader never sees the new data with the old index or the other
+// way around, even if the node crashed in the middle of the commit.
 func (c *BlobFile) doCommit() (err error) {
 	name := c.file.Name()
 	c.tree.idxFile.Close()
 	c.file.Close()
 
 	err = catchupDeleteIndex(name+".idx", name+".tmpIndex")
+	if err == nil {
+		err = os.Rename(name+".tmpIndex", name+".commitIndex")
+	}
+	if err == nil {
+		err = syncDir(path.Dir(name))
+	}
 	if err != nil {
-		return
+		log.LogErrorf("doCommit: %v compaction dropped: %v", name, err)
 	}
 
-	err = os.Rename(name+".tmpData", name)
-	if err != nil {
-		return
+	// the old files are reopened if the compaction is dropped
+	maxOid, loadErr := c.loadTree(name)
+	if loadErr != nil {
+		return loadErr
 	}
-	err = os.Rename(name+".tmpIndex", name+".idx")
 	if err != nil {
 		return
 	}
-
-	maxOid, err := c.loadTree(name)
-	if err == nil && maxOid > c.loadLastOid() {
+	if maxOid > c.loadLastOid() {
 		log.LogWarn("doCommit: maxOid = ", maxOid, "lastOid = ", c.loadLastOid())
 		c.storeLastOid(maxOid)
 	}
@@ -307,5 +335,43 @@ func catchupDeleteIndex(oldIdxName, newIdxName string) error {
 		return err
 	}
 
-	return nil
+	return newIdxFile.Sync()
+}
+
+/*finish the compaction of the blob file committed before a crash or drop the one not committed*/
+func recoverCompaction(name string) (err error) {
+	if _, err = os.Stat(name + ".commitIndex"); err != nil {
+		if !os.IsNotExist(err) {
+			return
+		}
+		os.Remove(name + ".tmpData")
+		os.Remove(name + ".tmpIndex")
+		return nil
+	}
+	if _, err = os.Stat(name + ".tmpData"); err == nil {
+		if err = os.Rename(name+".tmpData", name); err != nil {
+			return
+		}
+		// the new data is on the disk before the new index replaces the old one
+		if err = syncDir(path.Dir(name)); err != nil {
+			return
+		}
+	} else if !os.IsNotExist(err) {
+		return
+	}
+	if err = os.Rename(name+".commitIndex", name+".idx"); err != nil {
+		return
+	}
+	log.LogInfof("recoverCompaction: compaction of %v committed", name)
+	return syncDir(path.Dir(name))
+}
+
+func syncDir(dir string) (err error) {
+	var fp *os.File
+	if fp, err = os.Open(dir); err != nil {
+		return
+	}
+	err = fp.Sync()
+	fp.Close()
+	return
 }
@@ -0,0 +1,147 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func writeTestObject(t *testing.T, c *BlobFile, oid uint64, data []byte) {
+	fi, err := c.file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.file.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.tree.set(oid, uint64(fi.Size()), uint32(len(data)), crc32.ChecksumIEEE(data), CodecNone); err != nil {
+		t.Fatal(err)
+	}
+	c.storeLastOid(oid)
+}
+
+func checkTestObject(t *testing.T, c *BlobFile, oid uint64, data []byte) {
+	o, ok := c.tree.get(oid)
+	if !ok {
+		t.Fatalf("object %v not found", oid)
+	}
+	buf := make([]byte, o.Size)
+	if _, err := c.file.ReadAt(buf, int64(o.Offset)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) || o.Crc != crc32.ChecksumIEEE(data) {
+		t.Fatalf("object %v data mismatch", oid)
+	}
+}
+
+func TestBlobFile_Compact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, err := NewBlobFile(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects := make(map[uint64][]byte)
+	for oid := uint64(1); oid <= 100; oid++ {
+		objects[oid] = bytes.Repeat([]byte{byte(oid)}, 1024)
+		writeTestObject(t, c, oid, objects[oid])
+	}
+	deleted := make([]uint64, 0)
+	for oid := uint64(1); oid <= 100; oid += 2 {
+		deleted = append(deleted, oid)
+	}
+	if err = c.applyDelObjects(deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.doCompact(); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.doCommit(); err != nil {
+		t.Fatal(err)
+	}
+	fi, _ := c.file.Stat()
+	if fi.Size() != 50*1024 {
+		t.Fatalf("compacted size act[%v] exp[%v]", fi.Size(), 50*1024)
+	}
+	for oid, data := range objects {
+		if oid%2 == 1 {
+			if _, ok := c.tree.get(oid); ok {
+				t.Fatalf("deleted object %v found", oid)
+			}
+			continue
+		}
+		checkTestObject(t, c, oid, data)
+	}
+
+	// a compaction not committed is dropped at loading
+	if err = c.doCompact(); err != nil {
+		t.Fatal(err)
+	}
+	c.file.Close()
+	c.tree.idxFile.Close()
+	if c, err = NewBlobFile(dir, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(c.file.Name() + ".tmpData"); !os.IsNotExist(err) {
+		t.Fatalf("uncommitted compaction kept: %v", err)
+	}
+	checkTestObject(t, c, 2, objects[2])
+}
+
+func TestBlobFile_RecoverCommitted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, err := NewBlobFile(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("live object")
+	writeTestObject(t, c, 1, []byte("dead object"))
+	writeTestObject(t, c, 2, data)
+	c.applyDelObjects([]uint64{1})
+	if err = c.doCompact(); err != nil {
+		t.Fatal(err)
+	}
+	name := c.file.Name()
+	c.file.Close()
+	c.tree.idxFile.Close()
+
+	// crash after the commit point, before the data and the index are replaced
+	if err = os.Rename(name+".tmpIndex", name+".commitIndex"); err != nil {
+		t.Fatal(err)
+	}
+	if c, err = NewBlobFile(dir, 1); err != nil {
+		t.Fatal(err)
+	}
+	fi, _ := c.file.Stat()
+	if fi.Size() != int64(len(data)) {
+		t.Fatalf("rolled forward size act[%v] exp[%v]", fi.Size(), len(data))
+	}
+	checkTestObject(t, c, 2, data)
+	if _, ok := c.tree.get(1); ok {
+		t.Fatalf("deleted object found")
+	}
+}
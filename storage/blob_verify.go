@@ -6,6 +6,8 @@ import (
 	"io"
 	"os"
 	"path"
+
+	"github.com/tiglabs/containerfs/proto"
 )
 
 type ObjectInfo struct {
@@ -54,12 +56,15 @@ func (s *BlobStore) VerfiyObjects(chunkid int, needVerify bool) (blobFileInfo *B
 	blobFileInfo.FileBytes = cc.tree.fileBytes
 	blobFileInfo.DeleteBytes = cc.tree.deleteBytes
 	blobFileInfo.DeletePercent = float64(blobFileInfo.DeleteBytes) / float64(blobFileInfo.FileBytes)
-	WalkIndexFileAndVerify(indexfp, datafp, blobFileInfo)
+	WalkIndexFileAndVerify(indexfp, datafp, blobFileInfo, func(objectId uint64, codec uint8, stored []byte) ([]byte, error) {
+		return s.DecodeObject(uint32(chunkid), objectId, codec, stored)
+	})
 
 	return
 }
 
-func WalkIndexFileAndVerify(indexfp *os.File, datafp *os.File, blobFileInfo *BlobFileInfo) (err error) {
+func WalkIndexFileAndVerify(indexfp *os.File, datafp *os.File, blobFileInfo *BlobFileInfo,
+	decode func(objectId uint64, codec uint8, stored []byte) ([]byte, error)) (err error) {
 	var (
 		readOff int64
 		count   int
@@ -90,7 +95,12 @@ func WalkIndexFileAndVerify(indexfp *os.File, datafp *os.File, blobFileInfo *Blo
 				oi.ErrorMesg = fmt.Sprintf("oi read datafile err %v", err.Error())
 				return
 			}
-			crc := crc32.ChecksumIEEE(data)
+			raw, decodeErr := decode(ni.Oid, ni.Codec, data)
+			if decodeErr != nil {
+				oi.ErrorMesg = fmt.Sprintf("oi decode codec[%v] err %v", ni.Codec, decodeErr.Error())
+				continue
+			}
+			crc := crc32.ChecksumIEEE(raw)
 			if crc != ni.Crc {
 				oi.ErrorMesg = fmt.Sprintf("expectCrc[%v] actualCrc[%v]", ni.Crc, crc)
 			} else {
@@ -108,3 +118,129 @@ func WalkIndexFileAndVerify(indexfp *os.File, datafp *os.File, blobFileInfo *Blo
 
 	return err
 }
+
+// VerifyBlobFiles validates the tail records of every blob file index. Records which
+// point beyond the end of blob data file are cut from the index file into quarantine
+// directory and the blob file is reloaded, so blob repair will fetch them from other replicas.
+func (s *BlobStore) VerifyBlobFiles() (ranges []*proto.QuarantinedRange, err error) {
+	ranges = make([]*proto.QuarantinedRange, 0)
+	for blobfileId := 1; blobfileId <= BlobFileFileCount; blobfileId++ {
+		var qr *proto.QuarantinedRange
+		if qr, err = s.verifyBlobFileTail(blobfileId); err != nil {
+			return
+		}
+		if qr == nil {
+			continue
+		}
+		s.quarantineMux.Lock()
+		s.quarantined[blobfileId] = qr
+		s.quarantineMux.Unlock()
+		ranges = append(ranges, qr)
+	}
+	return
+}
+
+func (s *BlobStore) verifyBlobFileTail(blobfileId int) (qr *proto.QuarantinedRange, err error) {
+	var (
+		dataInfo os.FileInfo
+		idxInfo  os.FileInfo
+		readOff  int64
+		validOff int64
+		badOid   uint64
+		maxOid   uint64
+	)
+	c, ok := s.blobfiles[blobfileId]
+	if !ok {
+		return nil, ErrorFileNotFound
+	}
+	if dataInfo, err = c.file.Stat(); err != nil {
+		return
+	}
+	if idxInfo, err = c.tree.idxFile.Stat(); err != nil {
+		return
+	}
+	dataSize := uint64(dataInfo.Size())
+	validOff = idxInfo.Size() - idxInfo.Size()%ObjectHeaderSize
+	if maxOid, err = LoopIndexFile(c.tree.idxFile, func(oid, offset uint64, size, crc uint32) error {
+		if badOid == 0 && size != MarkDeleteObject && offset+uint64(size) > dataSize {
+			badOid = oid
+			validOff = readOff
+		}
+		readOff += ObjectHeaderSize
+		return nil
+	}); err != nil {
+		return
+	}
+	if validOff == idxInfo.Size() {
+		return
+	}
+	if err = s.quarantineIndexTail(blobfileId, validOff); err != nil {
+		return
+	}
+	qr = &proto.QuarantinedRange{
+		FileId: uint64(blobfileId),
+		Start:  s.blobfiles[blobfileId].loadLastOid() + 1,
+		End:    maxOid,
+		Reason: fmt.Sprintf("index tail offset(%v) exceed blob file size(%v)", validOff, dataSize),
+	}
+	if badOid != 0 {
+		qr.Start = badOid
+	}
+	if qr.End < qr.Start {
+		qr.End = qr.Start
+	}
+	return
+}
+
+func (s *BlobStore) quarantineIndexTail(blobfileId int, validOff int64) (err error) {
+	var (
+		dst *os.File
+		c   *BlobFile
+	)
+	quarantineDir := path.Join(s.dataDir, QuarantineDirName)
+	if err = CheckAndCreateSubdir(quarantineDir); err != nil {
+		return
+	}
+	idxFile := s.blobfiles[blobfileId].tree.idxFile
+	dstName := path.Join(quarantineDir, fmt.Sprintf("%v.idx_%v", blobfileId, validOff))
+	if dst, err = os.OpenFile(dstName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666); err != nil {
+		return
+	}
+	defer dst.Close()
+	if _, err = io.Copy(dst, io.NewSectionReader(idxFile, validOff, 1<<62)); err != nil {
+		return
+	}
+	if err = dst.Sync(); err != nil {
+		return
+	}
+	if err = idxFile.Truncate(validOff); err != nil {
+		return
+	}
+	if err = idxFile.Sync(); err != nil {
+		return
+	}
+
+	// Reload blob file with the truncated index.
+	s.blobfiles[blobfileId].file.Close()
+	idxFile.Close()
+	if c, err = NewBlobFile(s.dataDir, blobfileId); err != nil {
+		return
+	}
+	s.blobfiles[blobfileId] = c
+	return
+}
+
+// GetQuarantined returns quarantined object ranges which have not been repaired yet.
+func (s *BlobStore) GetQuarantined() (ranges []*proto.QuarantinedRange) {
+	ranges = make([]*proto.QuarantinedRange, 0)
+	s.quarantineMux.Lock()
+	defer s.quarantineMux.Unlock()
+	for blobfileId, qr := range s.quarantined {
+		if c, ok := s.blobfiles[blobfileId]; !ok || c.loadLastOid() >= qr.End {
+			delete(s.quarantined, blobfileId)
+			continue
+		}
+		ranges = append(ranges, qr)
+	}
+	return
+}
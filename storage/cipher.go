@@ -0,0 +1,230 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	CipherKeySize      = 32 //AES-256
+	CipherNonceSize    = 12
+	CipherTagSize      = 16
+	CipherRecordSize   = CipherNonceSize + CipherTagSize
+	CipherOverhead     = CipherRecordSize
+	EncryptionFileName = "ENCRYPTION"
+	ExtentCipherSuffix = ".gcm"
+)
+
+// The data of an encrypted store is encrypted with AES-GCM by the key of its vol,
+// which the data node gets from the master in the heartbeats and never writes to
+// disk. ENCRYPTION of the store dir has the id of the key, the store refuses the
+// reads and the writes until it is given the key of the id. A block of an extent
+// is encrypted as a whole with a random nonce each time it is written, the nonce
+// and the tag of the blocks are in the .gcm file of the extent, and the block crcs
+// in the extent header are the ones of the plain data so the replicas stay
+// comparable. A blob object is stored with its nonce in front and its tag behind.
+
+// DataCipher is the key of the vol of an encrypted store.
+type DataCipher struct {
+	KeyId string
+	aead  cipher.AEAD
+}
+
+func NewDataCipher(keyId string, key []byte) (c *DataCipher, err error) {
+	if len(key) != CipherKeySize {
+		return nil, fmt.Errorf("key %v of size %v, expect %v", keyId, len(key), CipherKeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+	c = &DataCipher{KeyId: keyId}
+	if c.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	return
+}
+
+/*the additional data binding an encrypted unit to its place, so it can't be moved to another*/
+func cipherAD(fileId, unit uint64) []byte {
+	ad := make([]byte, 16)
+	binary.BigEndian.PutUint64(ad[:8], fileId)
+	binary.BigEndian.PutUint64(ad[8:], unit)
+	return ad
+}
+
+/*encrypt the block in place, return the nonce and the tag of it*/
+func (c *DataCipher) sealBlock(block, ad []byte) (record []byte, err error) {
+	record = make([]byte, CipherRecordSize)
+	if _, err = io.ReadFull(rand.Reader, record[:CipherNonceSize]); err != nil {
+		return
+	}
+	sealed := c.aead.Seal(nil, record[:CipherNonceSize], block, ad)
+	copy(block, sealed[:len(block)])
+	copy(record[CipherNonceSize:], sealed[len(block):])
+	return
+}
+
+/*decrypt the block in place with its nonce and tag*/
+func (c *DataCipher) openBlock(block, record, ad []byte) (err error) {
+	sealed := make([]byte, len(block)+CipherTagSize)
+	copy(sealed, block)
+	copy(sealed[len(block):], record[CipherNonceSize:])
+	if _, err = c.aead.Open(block[:0], record[:CipherNonceSize], sealed, ad); err != nil {
+		return ErrorBlockCrcMismatch
+	}
+	return
+}
+
+/*the object encrypted with its nonce in front*/
+func (c *DataCipher) sealObject(data, ad []byte) (sealed []byte, err error) {
+	sealed = make([]byte, CipherNonceSize, CipherNonceSize+len(data)+CipherTagSize)
+	if _, err = io.ReadFull(rand.Reader, sealed); err != nil {
+		return
+	}
+	return c.aead.Seal(sealed, sealed[:CipherNonceSize], data, ad), nil
+}
+
+func (c *DataCipher) openObject(sealed, ad []byte) (data []byte, err error) {
+	if len(sealed) < CipherOverhead {
+		return nil, ErrCorruptObject
+	}
+	if data, err = c.aead.Open(nil, sealed[:CipherNonceSize], sealed[CipherNonceSize:], ad); err != nil {
+		return nil, ErrCorruptObject
+	}
+	return
+}
+
+// storeCipher is the encryption of a store shared by its files.
+type storeCipher struct {
+	dataDir string
+	keyId   atomic.Value //string, empty if the store is not encrypted
+	cipher  atomic.Value //*DataCipher, nil until the data node got the key
+}
+
+func loadStoreCipher(dataDir string) (sc *storeCipher, err error) {
+	sc = &storeCipher{dataDir: dataDir}
+	sc.keyId.Store("")
+	data, err := ioutil.ReadFile(path.Join(dataDir, EncryptionFileName))
+	if os.IsNotExist(err) {
+		return sc, nil
+	}
+	if err != nil {
+		return
+	}
+	sc.keyId.Store(strings.TrimSpace(string(data)))
+	return
+}
+
+func (sc *storeCipher) getKeyId() string {
+	return sc.keyId.Load().(string)
+}
+
+func (sc *storeCipher) encrypted() bool {
+	return sc.getKeyId() != ""
+}
+
+/*the key of an encrypted store, nil if the store is not encrypted*/
+func (sc *storeCipher) get() (c *DataCipher, err error) {
+	if !sc.encrypted() {
+		return
+	}
+	var ok bool
+	if c, ok = sc.cipher.Load().(*DataCipher); !ok || c == nil {
+		return nil, ErrKeyUnavailable
+	}
+	return
+}
+
+/*encrypt the store by the key of keyId, the store must be empty*/
+func (sc *storeCipher) enable(keyId string) (err error) {
+	if keyId == "" || keyId == sc.getKeyId() {
+		return
+	}
+	if sc.encrypted() {
+		return fmt.Errorf("store %v encrypted by key %v", sc.dataDir, sc.getKeyId())
+	}
+	name := path.Join(sc.dataDir, EncryptionFileName)
+	if err = ioutil.WriteFile(name+".tmp", []byte(keyId), 0666); err != nil {
+		return
+	}
+	if err = os.Rename(name+".tmp", name); err != nil {
+		return
+	}
+	sc.keyId.Store(keyId)
+	return
+}
+
+func (sc *storeCipher) set(c *DataCipher) (err error) {
+	if c.KeyId != sc.getKeyId() {
+		return fmt.Errorf("store %v encrypted by key %v, not %v", sc.dataDir, sc.getKeyId(), c.KeyId)
+	}
+	sc.cipher.Store(c)
+	return
+}
+
+// EnableEncryption encrypts the extents of the store by the key of keyId, the
+// store must have no extents.
+func (s *ExtentStore) EnableEncryption(keyId string) (err error) {
+	s.extentInfoMux.RLock()
+	extents := len(s.extentInfoMap)
+	s.extentInfoMux.RUnlock()
+	if extents != 0 && keyId != s.crypt.getKeyId() {
+		return fmt.Errorf("store %v has %v extents", s.dataDir, extents)
+	}
+	return s.crypt.enable(keyId)
+}
+
+// SetCipher gives the key to the encrypted store.
+func (s *ExtentStore) SetCipher(c *DataCipher) error {
+	return s.crypt.set(c)
+}
+
+// EncryptionKeyId returns the id of the key of the store, empty if the store is not encrypted.
+func (s *ExtentStore) EncryptionKeyId() string {
+	return s.crypt.getKeyId()
+}
+
+// EnableEncryption encrypts the objects of the store by the key of keyId, the
+// store must have no objects.
+func (s *BlobStore) EnableEncryption(keyId string) (err error) {
+	for _, c := range s.blobfiles {
+		if c.loadLastOid() != 0 && keyId != s.crypt.getKeyId() {
+			return fmt.Errorf("store %v has objects", s.dataDir)
+		}
+	}
+	return s.crypt.enable(keyId)
+}
+
+// SetCipher gives the key to the encrypted store.
+func (s *BlobStore) SetCipher(c *DataCipher) error {
+	return s.crypt.set(c)
+}
+
+// EncryptionKeyId returns the id of the key of the store, empty if the store is not encrypted.
+func (s *BlobStore) EncryptionKeyId() string {
+	return s.crypt.getKeyId()
+}
@@ -0,0 +1,179 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"hash/crc32"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/tiglabs/containerfs/util"
+)
+
+func newTestCipher(t *testing.T, dir string) *storeCipher {
+	sc, err := loadStoreCipher(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sc.enable("key1"); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewDataCipher("key1", bytes.Repeat([]byte{7}, CipherKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sc.set(c); err != nil {
+		t.Fatal(err)
+	}
+	return sc
+}
+
+func TestFsExtent_Encrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cipher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sc := newTestCipher(t, dir)
+	name := path.Join(dir, "1025")
+	extent := newExtentInCore(name, 1025, sc, SyncIO)
+	if err = extent.InitToFS(1, false); err != nil {
+		t.Fatal(err)
+	}
+	plain := make([]byte, 0)
+	for i := 0; i < 20; i++ {
+		data := make([]byte, rand.Intn(util.BlockSize)+1)
+		rand.Read(data)
+		if err = extent.Write(data, int64(len(plain)), int64(len(data)), crc32.ChecksumIEEE(data)); err != nil {
+			t.Fatal(err)
+		}
+		plain = append(plain, data...)
+	}
+	extent.Flush()
+	extent.Close()
+
+	onDisk, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(onDisk, plain[:64]) {
+		t.Fatalf("plain data on disk")
+	}
+	extent = newExtentInCore(name, 1025, sc, SyncIO)
+	if err = extent.RestoreFromFS(); err != nil {
+		t.Fatal(err)
+	}
+	defer extent.Close()
+	if extent.Size() != int64(len(plain)) {
+		t.Fatalf("size %v, expect %v", extent.Size(), len(plain))
+	}
+	data := make([]byte, util.BlockSize)
+	for offset := int64(0); offset < int64(len(plain)); offset += util.BlockSize {
+		size := int64(len(plain)) - offset
+		if size > util.BlockSize {
+			size = util.BlockSize
+		}
+		if _, err = extent.Read(data, offset, size); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data[:size], plain[offset:offset+size]) {
+			t.Fatalf("data mismatch at %v", offset)
+		}
+	}
+	if corrupt, err := extent.VerifyBlocks(0, int64(len(plain))); err != nil || len(corrupt) != 0 {
+		t.Fatalf("verify blocks %v %v", corrupt, err)
+	}
+	// the tail block is sealed again for the truncated size
+	plain = plain[:len(plain)-util.BlockSize/2]
+	if err = extent.Truncate(int64(len(plain))); err != nil {
+		t.Fatal(err)
+	}
+	if corrupt, err := extent.VerifyBlocks(0, int64(len(plain))); err != nil || len(corrupt) != 0 {
+		t.Fatalf("verify blocks after truncate %v %v", corrupt, err)
+	}
+	tail := int64(len(plain)) - 100
+	if _, err = extent.Read(data, tail, 100); err != nil || !bytes.Equal(data[:100], plain[tail:]) {
+		t.Fatalf("read tail after truncate: %v", err)
+	}
+
+	// a changed byte of the data fails the authentication of its block
+	file, err := os.OpenFile(name, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	file.WriteAt([]byte{onDisk[util.BlockHeaderSize+10] + 1}, util.BlockHeaderSize+10)
+	if _, err = extent.Read(data, 0, 100); err != ErrorBlockCrcMismatch {
+		t.Fatalf("read of tampered block: %v", err)
+	}
+	if _, err = extent.Read(data, util.BlockSize, 100); err != nil {
+		t.Fatalf("read of next block: %v", err)
+	}
+}
+
+func TestFsExtent_EncryptedKeyUnavailable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cipher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	newTestCipher(t, dir)
+	sc, err := loadStoreCipher(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sc.encrypted() || sc.getKeyId() != "key1" {
+		t.Fatalf("key id %v not loaded", sc.getKeyId())
+	}
+	extent := newExtentInCore(path.Join(dir, "1025"), 1025, sc, SyncIO)
+	if err = extent.InitToFS(1, false); err != nil {
+		t.Fatal(err)
+	}
+	defer extent.Close()
+	data := []byte("data")
+	if err = extent.Write(data, 0, int64(len(data)), crc32.ChecksumIEEE(data)); err != ErrKeyUnavailable {
+		t.Fatalf("write without key: %v", err)
+	}
+	c, _ := NewDataCipher("key2", bytes.Repeat([]byte{7}, CipherKeySize))
+	if err = sc.set(c); err == nil {
+		t.Fatalf("key of another id accepted")
+	}
+}
+
+func TestDataCipher_Object(t *testing.T) {
+	c, err := NewDataCipher("key1", bytes.Repeat([]byte{7}, CipherKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("object data")
+	sealed, err := c.sealObject(data, cipherAD(1, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sealed) != len(data)+CipherOverhead {
+		t.Fatalf("sealed size %v", len(sealed))
+	}
+	opened, err := c.openObject(sealed, cipherAD(1, 2))
+	if err != nil || !bytes.Equal(opened, data) {
+		t.Fatalf("open %v %v", opened, err)
+	}
+	if _, err = c.openObject(sealed, cipherAD(1, 3)); err != ErrCorruptObject {
+		t.Fatalf("object opened at another oid: %v", err)
+	}
+}
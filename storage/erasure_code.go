@@ -0,0 +1,329 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+const (
+	DefaultECDataShards   = proto.ECDataShards
+	DefaultECParityShards = proto.ECParityShards
+	MaxECTotalShards      = 256
+)
+
+// arithmetic of GF(2^8) with the polynomial x^8+x^4+x^3+x^2+1
+const gfPolynomial = 0x11d
+
+var (
+	gfExp      [512]byte
+	gfLog      [256]byte
+	gfMulTable [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= gfPolynomial
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMulTable[a][b] = gfExp[int(gfLog[a])+int(gfLog[b])]
+		}
+	}
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// dst ^= c * src
+func gfMulAdd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	table := &gfMulTable[c]
+	for i, b := range src {
+		dst[i] ^= table[b]
+	}
+}
+
+// ErasureCode is a systematic Reed-Solomon code, the data shards are kept as
+// they are and the parity shards are computed by a Cauchy matrix, so any
+// dataShards of the dataShards+parityShards shards rebuild the others.
+type ErasureCode struct {
+	dataShards   int
+	parityShards int
+	parity       [][]byte // parityShards x dataShards coding matrix
+}
+
+func NewErasureCode(dataShards, parityShards int) (ec *ErasureCode, err error) {
+	if dataShards <= 0 || parityShards <= 0 || dataShards+parityShards > MaxECTotalShards {
+		err = ErrECInvalidShardNum
+		return
+	}
+	ec = &ErasureCode{
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		parity:       make([][]byte, parityShards),
+	}
+	for i := 0; i < parityShards; i++ {
+		ec.parity[i] = make([]byte, dataShards)
+		for j := 0; j < dataShards; j++ {
+			ec.parity[i][j] = gfInv(byte(dataShards+i) ^ byte(j))
+		}
+	}
+	return
+}
+
+func (ec *ErasureCode) DataShards() int {
+	return ec.dataShards
+}
+
+func (ec *ErasureCode) ParityShards() int {
+	return ec.parityShards
+}
+
+func (ec *ErasureCode) TotalShards() int {
+	return ec.dataShards + ec.parityShards
+}
+
+// the row of shard index in the coding matrix of the whole code
+func (ec *ErasureCode) row(index int) (row []byte) {
+	if index >= ec.dataShards {
+		return ec.parity[index-ec.dataShards]
+	}
+	row = make([]byte, ec.dataShards)
+	row[index] = 1
+	return
+}
+
+// shardSize return the size of the present shards, they must be of the same
+// size, nil or empty shards are treated as missing.
+func (ec *ErasureCode) shardSize(shards [][]byte) (size int, err error) {
+	if len(shards) != ec.TotalShards() {
+		return 0, ErrECInvalidShardNum
+	}
+	for _, shard := range shards {
+		if len(shard) == 0 {
+			continue
+		}
+		if size == 0 {
+			size = len(shard)
+		} else if size != len(shard) {
+			return 0, ErrECShardSize
+		}
+	}
+	if size == 0 {
+		err = ErrECShardSize
+	}
+	return
+}
+
+// Split cut data into dataShards equal shards padded by zero and allocate
+// the parity shards, the parity shards are filled by Encode.
+func (ec *ErasureCode) Split(data []byte) (shards [][]byte, err error) {
+	if len(data) == 0 {
+		return nil, ErrECShortData
+	}
+	size := (len(data) + ec.dataShards - 1) / ec.dataShards
+	buf := make([]byte, size*ec.TotalShards())
+	copy(buf, data)
+	shards = make([][]byte, ec.TotalShards())
+	for i := range shards {
+		shards[i] = buf[i*size : (i+1)*size]
+	}
+	return
+}
+
+// Encode compute the parity shards from the data shards.
+func (ec *ErasureCode) Encode(shards [][]byte) (err error) {
+	if len(shards) != ec.TotalShards() {
+		return ErrECInvalidShardNum
+	}
+	size := len(shards[0])
+	if size == 0 {
+		return ErrECShardSize
+	}
+	for i := 1; i < ec.dataShards; i++ {
+		if len(shards[i]) != size {
+			return ErrECShardSize
+		}
+	}
+	for i := 0; i < ec.parityShards; i++ {
+		index := ec.dataShards + i
+		if len(shards[index]) != size {
+			shards[index] = make([]byte, size)
+		} else {
+			for j := range shards[index] {
+				shards[index][j] = 0
+			}
+		}
+		for j := 0; j < ec.dataShards; j++ {
+			gfMulAdd(shards[index], shards[j], ec.parity[i][j])
+		}
+	}
+	return
+}
+
+// Verify check the parity shards match the data shards, all shards must be
+// present.
+func (ec *ErasureCode) Verify(shards [][]byte) (ok bool, err error) {
+	var size int
+	if size, err = ec.shardSize(shards); err != nil {
+		return
+	}
+	parity := make([]byte, size)
+	for i := 0; i < ec.parityShards; i++ {
+		for j := range parity {
+			parity[j] = 0
+		}
+		for j := 0; j < ec.dataShards; j++ {
+			if len(shards[j]) == 0 {
+				return false, ErrECTooFewShards
+			}
+			gfMulAdd(parity, shards[j], ec.parity[i][j])
+		}
+		if !bytes.Equal(parity, shards[ec.dataShards+i]) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Reconstruct rebuild the missing shards, nil or empty ones, in place. At
+// least dataShards shards must be present.
+func (ec *ErasureCode) Reconstruct(shards [][]byte) (err error) {
+	var size int
+	if size, err = ec.shardSize(shards); err != nil {
+		return
+	}
+	present := make([]int, 0, ec.dataShards)
+	dataMissing := false
+	for i, shard := range shards {
+		if len(shard) != 0 {
+			if len(present) < ec.dataShards {
+				present = append(present, i)
+			}
+		} else if i < ec.dataShards {
+			dataMissing = true
+		}
+	}
+	if len(present) < ec.dataShards {
+		return ErrECTooFewShards
+	}
+	if dataMissing {
+		matrix := make([][]byte, ec.dataShards)
+		for i, index := range present {
+			matrix[i] = append([]byte(nil), ec.row(index)...)
+		}
+		var decode [][]byte
+		if decode, err = invertMatrix(matrix); err != nil {
+			return
+		}
+		for i := 0; i < ec.dataShards; i++ {
+			if len(shards[i]) != 0 {
+				continue
+			}
+			shard := make([]byte, size)
+			for j, index := range present {
+				gfMulAdd(shard, shards[index], decode[i][j])
+			}
+			shards[i] = shard
+		}
+	}
+	for i := 0; i < ec.parityShards; i++ {
+		index := ec.dataShards + i
+		if len(shards[index]) != 0 {
+			continue
+		}
+		shard := make([]byte, size)
+		for j := 0; j < ec.dataShards; j++ {
+			gfMulAdd(shard, shards[j], ec.parity[i][j])
+		}
+		shards[index] = shard
+	}
+	return
+}
+
+// Join concatenate the data shards into the first size bytes of data.
+func (ec *ErasureCode) Join(shards [][]byte, size int) (data []byte, err error) {
+	if len(shards) < ec.dataShards {
+		return nil, ErrECTooFewShards
+	}
+	data = make([]byte, 0, size)
+	for i := 0; i < ec.dataShards && len(data) < size; i++ {
+		if len(shards[i]) == 0 {
+			return nil, ErrECTooFewShards
+		}
+		shard := shards[i]
+		if left := size - len(data); len(shard) > left {
+			shard = shard[:left]
+		}
+		data = append(data, shard...)
+	}
+	if len(data) < size {
+		return nil, ErrECShortData
+	}
+	return
+}
+
+// invertMatrix invert the square matrix by Gauss-Jordan elimination, the
+// matrix is modified.
+func invertMatrix(matrix [][]byte) (inverse [][]byte, err error) {
+	n := len(matrix)
+	inverse = make([][]byte, n)
+	for i := range inverse {
+		inverse[i] = make([]byte, n)
+		inverse[i][i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && matrix[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, ErrECTooFewShards
+		}
+		matrix[col], matrix[pivot] = matrix[pivot], matrix[col]
+		inverse[col], inverse[pivot] = inverse[pivot], inverse[col]
+		if c := matrix[col][col]; c != 1 {
+			scale := gfInv(c)
+			for j := 0; j < n; j++ {
+				matrix[col][j] = gfMulTable[scale][matrix[col][j]]
+				inverse[col][j] = gfMulTable[scale][inverse[col][j]]
+			}
+		}
+		for row := 0; row < n; row++ {
+			if row == col || matrix[row][col] == 0 {
+				continue
+			}
+			c := matrix[row][col]
+			gfMulAdd(matrix[row], matrix[col], c)
+			gfMulAdd(inverse[row], inverse[col], c)
+		}
+	}
+	return
+}
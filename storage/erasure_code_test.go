@@ -0,0 +1,100 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestErasureCode_Reconstruct(t *testing.T) {
+	ec, err := NewErasureCode(DefaultECDataShards, DefaultECParityShards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 64*1024+13)
+	rand.Read(data)
+	shards, err := ec.Split(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ec.Encode(shards); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := ec.Verify(shards); err != nil || !ok {
+		t.Fatalf("verify encoded shards: ok(%v) err(%v)", ok, err)
+	}
+
+	// lose every combination of parityShards shards
+	total := ec.TotalShards()
+	for i := 0; i < total; i++ {
+		for j := i + 1; j < total; j++ {
+			lost := make([][]byte, total)
+			copy(lost, shards)
+			lost[i], lost[j] = nil, nil
+			if err = ec.Reconstruct(lost); err != nil {
+				t.Fatalf("reconstruct without shard(%v,%v): %v", i, j, err)
+			}
+			for k := range shards {
+				if !bytes.Equal(lost[k], shards[k]) {
+					t.Fatalf("reconstruct without shard(%v,%v): shard(%v) mismatch", i, j, k)
+				}
+			}
+			joined, err := ec.Join(lost, len(data))
+			if err != nil || !bytes.Equal(joined, data) {
+				t.Fatalf("join without shard(%v,%v): err(%v)", i, j, err)
+			}
+		}
+	}
+}
+
+func TestErasureCode_TooFewShards(t *testing.T) {
+	ec, err := NewErasureCode(DefaultECDataShards, DefaultECParityShards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards, err := ec.Split([]byte("erasure code of data partition"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ec.Encode(shards); err != nil {
+		t.Fatal(err)
+	}
+	shards[0], shards[2], shards[5] = nil, nil, nil
+	if err = ec.Reconstruct(shards); err != ErrECTooFewShards {
+		t.Fatalf("reconstruct with %v lost shards: err(%v)", 3, err)
+	}
+}
+
+func TestErasureCode_VerifyCorrupted(t *testing.T) {
+	ec, err := NewErasureCode(DefaultECDataShards, DefaultECParityShards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 4096)
+	rand.Read(data)
+	shards, err := ec.Split(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ec.Encode(shards); err != nil {
+		t.Fatal(err)
+	}
+	shards[1][100] ^= 0xff
+	if ok, err := ec.Verify(shards); err != nil || ok {
+		t.Fatalf("verify corrupted shards: ok(%v) err(%v)", ok, err)
+	}
+}
@@ -36,6 +36,17 @@ var (
 	ErrorCommit            = errors.New("commit error")
 	ErrObjectSmaller       = errors.New("object smaller error")
 	ErrPkgCrcMismatch      = errors.New("pkg crc is not equal pkg data")
+	ErrorBlockCrcMismatch  = errors.New("block crc is not equal block data")
+	ErrCorruptObject       = errors.New("compressed object is corrupt")
+	ErrKeyUnavailable      = errors.New("key of encrypted store unavailable")
+	ErrorExtentShared      = errors.New("extent shared by other files")
+	ErrorZeroCopyUnsupport = errors.New("range can not be sent without copy")
+	ErrorExtentTiered      = errors.New("extent data in the cold tier")
+	ErrorNoColdTier        = errors.New("no cold tier")
+	ErrECInvalidShardNum   = errors.New("invalid erasure code shard number")
+	ErrECShardSize         = errors.New("erasure code shards size mismatch")
+	ErrECTooFewShards      = errors.New("too few erasure code shards to reconstruct")
+	ErrECShortData         = errors.New("not enough data to split")
 )
 
 func NewParamMismatchErr(msg string) (err error) {
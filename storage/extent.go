@@ -47,8 +47,12 @@ type FileInfo struct {
 	Crc         uint32    `json:"crc"`
 	Deleted     bool      `json:"deleted"`
 	ModTime     time.Time `json:"modTime"`
+	Refs        uint32    `json:"refs"`
 	Source      string    `json:"src"`
 	MemberIndex int
+	allocated   int64 //disk space of the extent counted in the used size of the store
+	hole        int64 //disk space beyond the data of the extent counted in the hole size of the store
+	readTime    int64 //unix time of the last read, for the cold tier
 }
 
 func (ei *FileInfo) FromExtent(extent Extent) {
@@ -112,6 +116,45 @@ type Extent interface {
 	// HeaderChecksum returns crc checksum value of extent header data
 	// include inode data and block crc.
 	HeaderChecksum() (crc uint32)
+
+	// VerifyBlocks checks the data blocks covering the range against the crcs
+	// stored in extent header and returns the numbers of the blocks mismatching them.
+	VerifyBlocks(offset, size int64) (corrupt []int64, err error)
+
+	// Truncate shrinks extent data to the specified size.
+	Truncate(size int64) error
+
+	// PunchHole zeroes the data in the range and releases its disk space, the
+	// range beyond the data is ignored.
+	PunchHole(offset, size int64) error
+
+	// Preallocate allocates the disk space of the data up to size without
+	// changing the size of the extent.
+	Preallocate(size int64) error
+
+	// BlockCrcs returns the block crcs stored in extent header from the block
+	// of offset to the end of data.
+	BlockCrcs(offset int64) (crcs []uint32)
+
+	// AllocatedSize returns the disk space of the extent file, the punched
+	// holes excluded.
+	AllocatedSize() (size int64, err error)
+
+	// SendFile sends a full block of data to conn from the file without copying
+	// it through the user space, head is called with the block crc before.
+	SendFile(conn syscall.Conn, offset, size int64, head func(crc uint32) error) (err error)
+
+	// ReleaseData punches the data of the extent moved to the cold tier, the
+	// header is kept. ErrorAgain is returned if the extent was modified after
+	// modTime, the data is read by ReadFrom until RestoreData.
+	ReleaseData(modTime time.Time) error
+
+	// ReadFrom reads the data of a released extent from src, which holds the
+	// data without header, and verifies it against the block crcs.
+	ReadFrom(src io.ReaderAt, data []byte, offset, size int64) (crc uint32, err error)
+
+	// RestoreData writes back the data of a released extent read from src.
+	RestoreData(src io.Reader) error
 }
 
 // FSExtent is an implementation of Extent for local regular extent file data management.
@@ -127,12 +170,22 @@ type fsExtent struct {
 	dataSize   int64
 	closeC     chan bool
 	closed     bool
+	crypt      *storeCipher //the encryption of the store, nil if not encrypted
+	cryptFile  *os.File     //the nonces and tags of the blocks of an encrypted extent
+	io         ExtentIO     //of the data and the block crcs
+	released   bool         //the data is punched and kept in the cold tier
 }
 
 // NewExtentInCore create and returns a new extent instance.
 func NewExtentInCore(name string, extentId uint64) Extent {
+	return newExtentInCore(name, extentId, nil, SyncIO)
+}
+
+func newExtentInCore(name string, extentId uint64, crypt *storeCipher, extentIO ExtentIO) Extent {
 	e := new(fsExtent)
 	e.extentId = extentId
+	e.crypt = crypt
+	e.io = extentIO
 	e.filePath = name
 	e.header = make([]byte, util.BlockHeaderSize)
 	e.closeC = make(chan bool)
@@ -146,6 +199,11 @@ func (e *fsExtent) Close() (err error) {
 	if err = e.file.Close(); err != nil {
 		return
 	}
+	if e.cryptFile != nil {
+		if err = e.cryptFile.Close(); err != nil {
+			return
+		}
+	}
 	close(e.closeC)
 	e.closed = true
 	return
@@ -181,12 +239,15 @@ func (e *fsExtent) InitToFS(ino uint64, overwrite bool) (err error) {
 			os.Remove(e.filePath)
 		}
 	}()
-	//e.tryKeepSize(int(e.file.Fd()), 0, util.ExtentFileSizeLimit)
-	if err = e.file.Truncate(util.BlockHeaderSize); err != nil {
+	if err = e.openCryptFile(); err != nil {
+		return
+	}
+	//e.io.Fallocate(e.file, FALLOC_FL_KEEP_SIZE, 0, util.ExtentFileSizeLimit)
+	if err = e.io.Truncate(e.file, util.BlockHeaderSize); err != nil {
 		return
 	}
 	binary.BigEndian.PutUint64(e.header[:8], ino)
-	if _, err = e.file.WriteAt(e.header[:8], 0); err != nil {
+	if _, err = e.io.WriteAt(e.file, e.header[:8], 0); err != nil {
 		return
 	}
 	emptyCrc := crc32.ChecksumIEEE(make([]byte, util.BlockSize))
@@ -195,7 +256,7 @@ func (e *fsExtent) InitToFS(ino uint64, overwrite bool) (err error) {
 			return
 		}
 	}
-	if err = e.file.Sync(); err != nil {
+	if err = e.io.Fsync(e.file); err != nil {
 		return
 	}
 
@@ -207,6 +268,7 @@ func (e *fsExtent) InitToFS(ino uint64, overwrite bool) (err error) {
 	}
 	e.modifyTime = fileInfo.ModTime()
 	e.dataSize = 0
+	e.released = false
 	// go e.pendingCollapseFile()
 	return
 }
@@ -221,6 +283,9 @@ func (e *fsExtent) RestoreFromFS() (err error) {
 		}
 		return err
 	}
+	if err = e.openCryptFile(); err != nil {
+		return
+	}
 	var (
 		info os.FileInfo
 	)
@@ -232,7 +297,7 @@ func (e *fsExtent) RestoreFromFS() (err error) {
 		err = BrokenExtentFileErr
 		return
 	}
-	if _, err = e.file.ReadAt(e.header, 0); err != nil {
+	if _, err = e.io.ReadAt(e.file, e.header, 0); err != nil {
 		err = fmt.Errorf("read file %v offset %v: %v", e.file.Name(), 0, err)
 		return
 	}
@@ -246,7 +311,7 @@ func (e *fsExtent) MarkDelete() (err error) {
 	e.lock.RLock()
 	defer e.lock.RUnlock()
 	e.header[util.MarkDeleteIndex] = util.MarkDelete
-	if _, err = e.file.WriteAt(e.header, 0); err != nil {
+	if _, err = e.io.WriteAt(e.file, e.header, 0); err != nil {
 		return
 	}
 	e.modifyTime = time.Now()
@@ -268,6 +333,18 @@ func (e *fsExtent) Size() (size int64) {
 	return
 }
 
+// AllocatedSize returns the disk space of the extent file, the punched
+// holes excluded.
+func (e *fsExtent) AllocatedSize() (size int64, err error) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	var info os.FileInfo
+	if info, err = e.file.Stat(); err != nil {
+		return
+	}
+	return AllocatedSize(info), nil
+}
+
 // ModTime returns the time when this extent was last modified.
 func (e *fsExtent) ModTime() time.Time {
 	e.lock.RLock()
@@ -280,13 +357,19 @@ func (e *fsExtent) Write(data []byte, offset, size int64, crc uint32) (err error
 	if err = e.checkOffsetAndSize(offset, size); err != nil {
 		return
 	}
+	if e.isEncrypted() {
+		return e.writeEncrypted(data, offset, size)
+	}
 	var (
 		writeSize int
 	)
 	e.lock.RLock()
 	defer e.lock.RUnlock()
+	if e.released {
+		return ErrorExtentTiered
+	}
 
-	if writeSize, err = e.file.WriteAt(data[:size], int64(offset+util.BlockHeaderSize)); err != nil {
+	if writeSize, err = e.io.WriteAt(e.file, data[:size], int64(offset+util.BlockHeaderSize)); err != nil {
 		return
 	}
 	blockNo := offset / util.BlockSize
@@ -312,7 +395,7 @@ func (e *fsExtent) Write(data []byte, offset, size int64, crc uint32) (err error
 		if remainCheckByteCnt <= 0 {
 			break
 		}
-		readN, readErr := e.file.ReadAt(blockBuffer, int64(blockNo*util.BlockSize+util.BlockHeaderSize))
+		readN, readErr := e.io.ReadAt(e.file, blockBuffer, int64(blockNo*util.BlockSize+util.BlockHeaderSize))
 		if readErr != nil && readErr != io.EOF {
 			err = readErr
 			return
@@ -333,17 +416,40 @@ func (e *fsExtent) Write(data []byte, offset, size int64, crc uint32) (err error
 	return
 }
 
-// Read data from extent.
+// Read data from extent, the blocks covering the data are verified against
+// the block crc stored in extent header.
 func (e *fsExtent) Read(data []byte, offset, size int64) (crc uint32, err error) {
 	if err = e.checkOffsetAndSize(offset, size); err != nil {
 		return
 	}
 	e.lock.RLock()
-	defer e.lock.RUnlock()
+	crc, err = e.readAndVerify(data, offset, size)
+	e.lock.RUnlock()
+	if err != ErrorBlockCrcMismatch {
+		return
+	}
+	// a write in flight updates the block crc after the data, check again
+	// with the writes excluded
+	e.lock.Lock()
+	crc, err = e.readAndVerify(data, offset, size)
+	e.lock.Unlock()
+	return
+}
+
+func (e *fsExtent) readAndVerify(data []byte, offset, size int64) (crc uint32, err error) {
+	if e.released {
+		return 0, ErrorExtentTiered
+	}
+	if e.isEncrypted() {
+		return e.readDecrypted(data, offset, size)
+	}
 	var (
 		readN int
 	)
-	if readN, err = e.file.ReadAt(data[:size], offset+util.BlockHeaderSize); err != nil {
+	if readN, err = e.io.ReadAt(e.file, data[:size], offset+util.BlockHeaderSize); err != nil {
+		return
+	}
+	if err = e.verifyBlocks(data[:readN], offset); err != nil {
 		return
 	}
 	if offset%util.BlockSize == 0 && readN == util.BlockSize {
@@ -355,11 +461,47 @@ func (e *fsExtent) Read(data []byte, offset, size int64) (crc uint32, err error)
 	return
 }
 
+// verifyBlocks checks the blocks covering the data read at offset, the part of
+// a block out of the data is read from the file again.
+func (e *fsExtent) verifyBlocks(data []byte, offset int64) (err error) {
+	var (
+		blockBuffer []byte
+		poolErr     error
+	)
+	end := offset + int64(len(data))
+	for blockNo := offset / util.BlockSize; blockNo*util.BlockSize < end; blockNo++ {
+		blockStart := blockNo * util.BlockSize
+		blockEnd := int64(math.Min(float64(blockStart+util.BlockSize), float64(e.dataSize)))
+		if blockEnd <= blockStart {
+			break
+		}
+		var block []byte
+		if blockStart >= offset && blockEnd <= end {
+			block = data[blockStart-offset : blockEnd-offset]
+		} else {
+			if blockBuffer == nil {
+				if blockBuffer, poolErr = buf.Buffers.Get(util.BlockSize); poolErr != nil {
+					blockBuffer = make([]byte, util.BlockSize)
+				}
+				defer buf.Buffers.Put(blockBuffer)
+			}
+			block = blockBuffer[:blockEnd-blockStart]
+			if _, err = e.io.ReadAt(e.file, block, blockStart+util.BlockHeaderSize); err != nil {
+				return
+			}
+		}
+		if crc32.ChecksumIEEE(block) != e.getBlockCrc(int(blockNo)) {
+			return ErrorBlockCrcMismatch
+		}
+	}
+	return
+}
+
 func (e *fsExtent) updateBlockCrc(blockNo int, crc uint32) (err error) {
 	startIdx := util.BlockHeaderCrcIndex + blockNo*util.PerBlockCrcSize
 	endIdx := startIdx + util.PerBlockCrcSize
 	binary.BigEndian.PutUint32(e.header[startIdx:endIdx], crc)
-	if _, err = e.file.WriteAt(e.header[startIdx:endIdx], int64(startIdx)); err != nil {
+	if _, err = e.io.WriteAt(e.file, e.header[startIdx:endIdx], int64(startIdx)); err != nil {
 		return
 	}
 	e.modifyTime = time.Now()
@@ -373,6 +515,16 @@ func (e *fsExtent) getBlockCrc(blockNo int) (crc uint32) {
 	return
 }
 
+func (e *fsExtent) BlockCrcs(offset int64) (crcs []uint32) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	crcs = make([]uint32, 0)
+	for blockNo := offset / util.BlockSize; blockNo*util.BlockSize < e.dataSize && blockNo < util.BlockCount; blockNo++ {
+		crcs = append(crcs, e.getBlockCrc(int(blockNo)))
+	}
+	return
+}
+
 func (e *fsExtent) checkOffsetAndSize(offset, size int64) error {
 	if offset+size > util.BlockSize*util.BlockCount {
 		return NewParamMismatchErr(fmt.Sprintf("offset=%v size=%v", offset, size))
@@ -389,7 +541,12 @@ func (e *fsExtent) checkOffsetAndSize(offset, size int64) error {
 
 // Flush synchronize data to disk immediately.
 func (e *fsExtent) Flush() (err error) {
-	err = e.file.Sync()
+	if err = e.io.Fsync(e.file); err != nil {
+		return
+	}
+	if e.cryptFile != nil {
+		err = e.io.Fsync(e.cryptFile)
+	}
 	return
 }
 
@@ -402,6 +559,165 @@ func (e *fsExtent) HeaderChecksum() (crc uint32) {
 	return
 }
 
+// VerifyBlocks checks the data blocks covering the range against the crcs
+// stored in extent header and returns the numbers of the blocks mismatching them,
+// the blocks of an encrypted extent failing the authentication mismatch too.
+func (e *fsExtent) VerifyBlocks(offset, size int64) (corrupt []int64, err error) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	end := int64(math.Min(float64(offset+size), float64(e.dataSize)))
+	if end > util.ExtentSize {
+		end = util.ExtentSize
+	}
+	if e.released || offset < 0 || offset >= end {
+		return
+	}
+	var c *DataCipher
+	if e.isEncrypted() {
+		if c, err = e.crypt.get(); err != nil {
+			return
+		}
+	}
+	block := make([]byte, util.BlockSize)
+	for blockNo := offset / util.BlockSize; blockNo*util.BlockSize < end; blockNo++ {
+		if c != nil {
+			_, err = e.readPlainBlock(c, blockNo)
+		} else {
+			err = e.verifyBlock(block, blockNo)
+		}
+		if err == ErrorBlockCrcMismatch {
+			corrupt = append(corrupt, blockNo)
+			err = nil
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+/*check the data of the block against its crc, the caller must hold the lock of e*/
+func (e *fsExtent) verifyBlock(block []byte, blockNo int64) (err error) {
+	blockStart := blockNo * util.BlockSize
+	blockEnd := int64(math.Min(float64(blockStart+util.BlockSize), float64(e.dataSize)))
+	block = block[:blockEnd-blockStart]
+	if _, err = e.io.ReadAt(e.file, block, blockStart+util.BlockHeaderSize); err != nil {
+		return
+	}
+	if crc32.ChecksumIEEE(block) != e.getBlockCrc(int(blockNo)) {
+		return ErrorBlockCrcMismatch
+	}
+	return
+}
+
+// Truncate shrinks extent data to the specified size.
+func (e *fsExtent) Truncate(size int64) (err error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if size >= e.dataSize {
+		return
+	}
+	if e.released {
+		return ErrorExtentTiered
+	}
+	if e.isEncrypted() {
+		if err = e.truncateEncrypted(size); err != nil {
+			return
+		}
+	}
+	if err = e.io.Truncate(e.file, size+util.BlockHeaderSize); err != nil {
+		return
+	}
+	if err = e.io.Fsync(e.file); err != nil {
+		return
+	}
+	e.dataSize = size
+	e.modifyTime = time.Now()
+	return
+}
+
+// PunchHole zeroes the data in the range and releases the file blocks fully
+// covered by it, the block crcs of the range are updated to the zeroed data.
+// The data of an encrypted extent is zeroed without releasing the space.
+func (e *fsExtent) PunchHole(offset, size int64) (err error) {
+	if offset < 0 || size <= 0 {
+		return NewParamMismatchErr(fmt.Sprintf("offset=%v size=%v", offset, size))
+	}
+	if e.isEncrypted() {
+		return e.zeroEncrypted(offset, size)
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.released {
+		return ErrorExtentTiered
+	}
+	end := int64(math.Min(float64(offset+size), float64(e.dataSize)))
+	if offset >= end {
+		return
+	}
+	if err = e.io.Fallocate(e.file, FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE, offset+util.BlockHeaderSize, end-offset); err != nil {
+		// the file system can't punch holes, the range is zeroed in place
+		if err = e.writeZero(offset, end); err != nil {
+			return
+		}
+	}
+	zero := make([]byte, util.BlockSize)
+	for blockNo := offset / util.BlockSize; blockNo*util.BlockSize < end; blockNo++ {
+		blockStart := blockNo * util.BlockSize
+		blockEnd := int64(math.Min(float64(blockStart+util.BlockSize), float64(e.dataSize)))
+		block := zero[:blockEnd-blockStart]
+		if blockStart < offset || blockEnd > end {
+			block = make([]byte, blockEnd-blockStart)
+			if _, err = e.io.ReadAt(e.file, block, blockStart+util.BlockHeaderSize); err != nil {
+				return
+			}
+		}
+		if err = e.updateBlockCrc(int(blockNo), crc32.ChecksumIEEE(block)); err != nil {
+			return
+		}
+	}
+	e.modifyTime = time.Now()
+	return
+}
+
+// Preallocate reserves the blocks of the data up to size, they are counted in
+// the used space and released by the collapse if left unwritten.
+func (e *fsExtent) Preallocate(size int64) (err error) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	if size <= e.dataSize {
+		return
+	}
+	if e.released {
+		return ErrorExtentTiered
+	}
+	return e.io.Fallocate(e.file, FALLOC_FL_KEEP_SIZE, e.dataSize+util.BlockHeaderSize, size-e.dataSize)
+}
+
+/*the caller must hold the lock of the extent*/
+func (e *fsExtent) writeZero(offset, end int64) (err error) {
+	zero := make([]byte, util.BlockSize)
+	for off := offset; off < end; off += util.BlockSize {
+		size := int64(math.Min(float64(util.BlockSize), float64(end-off)))
+		if _, err = e.io.WriteAt(e.file, zero[:size], off+util.BlockHeaderSize); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (e *fsExtent) zeroEncrypted(offset, size int64) (err error) {
+	end := int64(math.Min(float64(offset+size), float64(e.Size())))
+	zero := make([]byte, util.BlockSize)
+	for off := offset; off < end; off += util.BlockSize {
+		size := int64(math.Min(float64(util.BlockSize), float64(end-off)))
+		if err = e.writeEncrypted(zero, off, size); err != nil {
+			return
+		}
+	}
+	return
+}
+
 func (e *fsExtent) pendingCollapseFile() {
 	timer := time.NewTimer(5 * time.Second)
 	for {
@@ -440,6 +756,6 @@ func (e *fsExtent) collapseFile() (err error) {
 	if info.Size()%int64(statFs.Bsize) != 0 {
 		blockNum += 1
 	}
-	err = e.tryPunchHole(int(e.file.Fd()), blockNum*int64(statFs.Bsize), util.ExtentFileSizeLimit)
+	err = e.io.Fallocate(e.file, FALLOC_FL_PUNCH_HOLE, blockNum*int64(statFs.Bsize), util.ExtentFileSizeLimit)
 	return
 }
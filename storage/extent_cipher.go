@@ -0,0 +1,171 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	"github.com/tiglabs/containerfs/util"
+)
+
+// The data of an encrypted extent has the size and the offsets of the plain
+// data, each block is sealed alone and its nonce and tag are at blockNo*CipherRecordSize
+// of the .gcm file. A write decrypts the blocks it touches, merges the data and seals
+// them again with new nonces. A crash between the data and the record of a block
+// loses the block, it fails the authentication on read like a block mismatching its
+// crc and is quarantined and fetched from the other replicas by the extent repair.
+
+func (e *fsExtent) isEncrypted() bool {
+	return e.crypt != nil && e.crypt.encrypted()
+}
+
+func (e *fsExtent) openCryptFile() (err error) {
+	if !e.isEncrypted() || e.cryptFile != nil {
+		return
+	}
+	e.cryptFile, err = os.OpenFile(e.filePath+ExtentCipherSuffix, os.O_CREATE|os.O_RDWR, 0666)
+	return
+}
+
+func (e *fsExtent) readBlockRecord(blockNo int64) (record []byte, err error) {
+	record = make([]byte, CipherRecordSize)
+	if _, err = e.io.ReadAt(e.cryptFile, record, blockNo*CipherRecordSize); err == io.EOF {
+		err = ErrorBlockCrcMismatch
+	}
+	return
+}
+
+/*the plain data of the block, the caller must hold the lock of e*/
+func (e *fsExtent) readPlainBlock(c *DataCipher, blockNo int64) (block []byte, err error) {
+	blockStart := blockNo * util.BlockSize
+	blockEnd := int64(math.Min(float64(blockStart+util.BlockSize), float64(e.dataSize)))
+	if blockEnd <= blockStart {
+		return
+	}
+	block = make([]byte, blockEnd-blockStart)
+	if _, err = e.io.ReadAt(e.file, block, blockStart+util.BlockHeaderSize); err != nil {
+		return
+	}
+	var record []byte
+	if record, err = e.readBlockRecord(blockNo); err != nil {
+		return
+	}
+	if err = c.openBlock(block, record, cipherAD(e.extentId, uint64(blockNo))); err != nil {
+		return
+	}
+	if crc32.ChecksumIEEE(block) != e.getBlockCrc(int(blockNo)) {
+		err = ErrorBlockCrcMismatch
+	}
+	return
+}
+
+/*seal the plain data of the block and write it with its record and crc, the caller must hold the lock of e*/
+func (e *fsExtent) writePlainBlock(c *DataCipher, blockNo int64, block []byte) (err error) {
+	crc := crc32.ChecksumIEEE(block)
+	var record []byte
+	if record, err = c.sealBlock(block, cipherAD(e.extentId, uint64(blockNo))); err != nil {
+		return
+	}
+	if _, err = e.io.WriteAt(e.file, block, blockNo*util.BlockSize+util.BlockHeaderSize); err != nil {
+		return
+	}
+	if _, err = e.io.WriteAt(e.cryptFile, record, blockNo*CipherRecordSize); err != nil {
+		return
+	}
+	return e.updateBlockCrc(int(blockNo), crc)
+}
+
+func (e *fsExtent) writeEncrypted(data []byte, offset, size int64) (err error) {
+	var c *DataCipher
+	if c, err = e.crypt.get(); err != nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	end := offset + size
+	newSize := int64(math.Max(float64(e.dataSize), float64(end)))
+	// the blocks skipped by a write beyond the end are sealed as zero
+	start := int64(math.Min(float64(offset), float64(e.dataSize)))
+	for blockNo := start / util.BlockSize; blockNo*util.BlockSize < end; blockNo++ {
+		blockStart := blockNo * util.BlockSize
+		blockEnd := int64(math.Min(float64(blockStart+util.BlockSize), float64(newSize)))
+		var old []byte
+		if old, err = e.readPlainBlock(c, blockNo); err != nil {
+			return
+		}
+		block := make([]byte, blockEnd-blockStart)
+		copy(block, old)
+		if offset < blockEnd && end > blockStart {
+			from := int64(math.Max(float64(offset), float64(blockStart)))
+			to := int64(math.Min(float64(end), float64(blockEnd)))
+			copy(block[from-blockStart:to-blockStart], data[from-offset:to-offset])
+		}
+		if err = e.writePlainBlock(c, blockNo, block); err != nil {
+			return
+		}
+	}
+	e.dataSize = newSize
+	e.modifyTime = time.Now()
+	return
+}
+
+/*read the plain data like readAndVerify, the caller must hold the lock of e*/
+func (e *fsExtent) readDecrypted(data []byte, offset, size int64) (crc uint32, err error) {
+	var c *DataCipher
+	if c, err = e.crypt.get(); err != nil {
+		return
+	}
+	if offset+size > e.dataSize {
+		return 0, io.EOF
+	}
+	end := offset + size
+	for blockNo := offset / util.BlockSize; blockNo*util.BlockSize < end; blockNo++ {
+		blockStart := blockNo * util.BlockSize
+		var block []byte
+		if block, err = e.readPlainBlock(c, blockNo); err != nil {
+			return
+		}
+		from := int64(math.Max(float64(offset), float64(blockStart)))
+		to := int64(math.Min(float64(end), float64(blockStart+int64(len(block)))))
+		copy(data[from-offset:to-offset], block[from-blockStart:to-blockStart])
+	}
+	if offset%util.BlockSize == 0 && size == util.BlockSize {
+		crc = e.getBlockCrc(int(offset / util.BlockSize))
+		return
+	}
+	crc = crc32.ChecksumIEEE(data)
+	return
+}
+
+/*seal the tail block again for its new size before the truncate, the caller must hold the lock of e*/
+func (e *fsExtent) truncateEncrypted(size int64) (err error) {
+	if size%util.BlockSize == 0 {
+		return
+	}
+	var c *DataCipher
+	if c, err = e.crypt.get(); err != nil {
+		return
+	}
+	blockNo := size / util.BlockSize
+	var block []byte
+	if block, err = e.readPlainBlock(c, blockNo); err != nil {
+		return
+	}
+	return e.writePlainBlock(c, blockNo, block[:size-blockNo*util.BlockSize])
+}
@@ -14,12 +14,33 @@
 
 package storage
 
-func (e *fsExtent) tryKeepSize(fd int, off int64, len int64) (err error) {
-	// Do nothing
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+func fallocate(f *os.File, mode uint32, off int64, len int64) (err error) {
+	// the blocks are neither kept nor collapsed, a hole is not punched
+	if mode == FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE {
+		return syscall.ENOTSUP
+	}
 	return
 }
 
-func (e *fsExtent) tryPunchHole(fd int, off int64, len int64) (err error) {
-	// Do nothing
-	return
+// AllocatedSize returns the bytes actually allocated on disk for the file.
+func AllocatedSize(info os.FileInfo) int64 {
+	return info.Size()
+}
+
+func accessTime(info os.FileInfo) time.Time {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(stat.Atimespec.Sec, stat.Atimespec.Nsec)
+	}
+	return info.ModTime()
+}
+
+// SendFile is not supported, the blocks are read and copied.
+func (e *fsExtent) SendFile(conn syscall.Conn, offset, size int64, head func(crc uint32) error) (err error) {
+	return ErrorZeroCopyUnsupport
 }
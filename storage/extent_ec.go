@@ -0,0 +1,253 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util"
+)
+
+const (
+	ECStoreDirName     = "ec"
+	ECSizeFileName     = "EC_SIZE"
+	ECSizeRecordSize   = 24 //extent id, inode and size
+	ECStripeUnit       = util.BlockSize
+	ECSizeFileOpt      = os.O_CREATE | os.O_RDWR | os.O_APPEND
+	ecDecodedStripeNil = -1
+)
+
+// An extent of an erasure coded partition is cut into stripes of a unit on each
+// data shard, the last one padded by zero, and each stripe gets a unit on each
+// parity shard. The shard of a host is the units of the stripes at its index, a
+// unit is a block of the shard so the block crcs of the shard cover its units.
+
+/*the size of a shard of the extent of size, a unit per stripe*/
+func ECShardSize(size int64, dataShards int) int64 {
+	stripe := int64(dataShards) * ECStripeUnit
+	return (size + stripe - 1) / stripe * ECStripeUnit
+}
+
+// EncodeExtent encodes the size bytes of an extent got by read into its shards,
+// the units of each stripe are given to write with their offset in the shards.
+func (ec *ErasureCode) EncodeExtent(size int64, read func(offset int64, data []byte) error,
+	write func(shard int, offset int64, data []byte) error) (err error) {
+	stripeSize := int64(ec.dataShards) * ECStripeUnit
+	stripe := make([]byte, stripeSize)
+	for offset := int64(0); offset < size; offset += stripeSize {
+		n := util.Min(int(size-offset), int(stripeSize))
+		if err = read(offset, stripe[:n]); err != nil {
+			return
+		}
+		for i := n; i < len(stripe); i++ {
+			stripe[i] = 0
+		}
+		shards := make([][]byte, ec.TotalShards())
+		for i := 0; i < ec.dataShards; i++ {
+			shards[i] = stripe[int64(i)*ECStripeUnit : int64(i+1)*ECStripeUnit]
+		}
+		if err = ec.Encode(shards); err != nil {
+			return
+		}
+		shardOffset := offset / stripeSize * ECStripeUnit
+		for i, unit := range shards {
+			if err = write(i, shardOffset, unit); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// ReadExtent reads data at offset of an extent of size from its shards by read.
+// The stripes whose data shards fail to read are decoded from the other shards.
+func (ec *ErasureCode) ReadExtent(size, offset int64, data []byte,
+	read func(shard int, offset int64, data []byte) error) (err error) {
+	if offset < 0 || offset+int64(len(data)) > size {
+		return NewParamMismatchErr(fmt.Sprintf("offset=%v size=%v extent size=%v", offset, len(data), size))
+	}
+	stripeSize := int64(ec.dataShards) * ECStripeUnit
+	decodedStripe := int64(ecDecodedStripeNil)
+	var decoded [][]byte
+	for done := 0; done < len(data); {
+		pos := offset + int64(done)
+		stripeNo, inStripe := pos/stripeSize, pos%stripeSize
+		shard, inUnit := int(inStripe/ECStripeUnit), inStripe%ECStripeUnit
+		n := util.Min(len(data)-done, int(ECStripeUnit-inUnit))
+		unitOffset := stripeNo * ECStripeUnit
+		if decodedStripe != stripeNo {
+			if read(shard, unitOffset+inUnit, data[done:done+n]) == nil {
+				done += n
+				continue
+			}
+			if decoded, err = ec.decodeStripe(unitOffset, shard, read); err != nil {
+				return
+			}
+			decodedStripe = stripeNo
+		}
+		copy(data[done:done+n], decoded[shard][inUnit:])
+		done += n
+	}
+	return
+}
+
+// RebuildShard decodes each stripe of the shard of an extent of size from the
+// other shards got by read, and gives the units to write.
+func (ec *ErasureCode) RebuildShard(size int64, shard int, read func(shard int, offset int64, data []byte) error,
+	write func(offset int64, data []byte) error) (err error) {
+	shardSize := ECShardSize(size, ec.dataShards)
+	for offset := int64(0); offset < shardSize; offset += ECStripeUnit {
+		var shards [][]byte
+		if shards, err = ec.decodeStripe(offset, shard, read); err != nil {
+			return
+		}
+		if err = write(offset, shards[shard]); err != nil {
+			return
+		}
+	}
+	return
+}
+
+/*the units of the stripe at offset of the shards, decoded from the shards but failed*/
+func (ec *ErasureCode) decodeStripe(offset int64, failed int, read func(shard int, offset int64, data []byte) error) (shards [][]byte, err error) {
+	shards = make([][]byte, ec.TotalShards())
+	present := 0
+	for i := 0; i < ec.TotalShards() && present < ec.dataShards; i++ {
+		if i == failed {
+			continue
+		}
+		unit := make([]byte, ECStripeUnit)
+		if read(i, offset, unit) != nil {
+			continue
+		}
+		shards[i] = unit
+		present++
+	}
+	if present < ec.dataShards {
+		return nil, ErrECTooFewShards
+	}
+	err = ec.Reconstruct(shards)
+	return
+}
+
+// ECStore keeps the shards a node holds of the extents of an erasure coded
+// partition, the shard of an extent is the extent of the same id in the store.
+// The inode and the size of the data of each extent are appended to EC_SIZE
+// when its shard is created, the record appended last wins.
+type ECStore struct {
+	*ExtentStore
+	extents map[uint64]*proto.ECExtent
+	sizeFp  *os.File
+	sizeMux sync.RWMutex
+}
+
+func NewECStore(dataDir string, storeSize int, extentIO ExtentIO) (s *ECStore, err error) {
+	s = &ECStore{extents: make(map[uint64]*proto.ECExtent)}
+	if s.ExtentStore, err = NewExtentStoreWithIO(dataDir, storeSize, extentIO); err != nil {
+		return nil, err
+	}
+	var data []byte
+	sizeFilePath := path.Join(dataDir, ECSizeFileName)
+	if data, err = ioutil.ReadFile(sizeFilePath); err != nil && !os.IsNotExist(err) {
+		s.ExtentStore.Close()
+		return nil, fmt.Errorf("NewECStore [%v] err[%v]", dataDir, err)
+	}
+	for off := 0; off+ECSizeRecordSize <= len(data); off += ECSizeRecordSize {
+		extent := &proto.ECExtent{
+			ExtentId: binary.BigEndian.Uint64(data[off : off+8]),
+			Inode:    binary.BigEndian.Uint64(data[off+8 : off+16]),
+			Size:     int64(binary.BigEndian.Uint64(data[off+16 : off+ECSizeRecordSize])),
+		}
+		s.extents[extent.ExtentId] = extent
+	}
+	if s.sizeFp, err = os.OpenFile(sizeFilePath, ECSizeFileOpt, 0666); err != nil {
+		s.ExtentStore.Close()
+		return nil, err
+	}
+	return
+}
+
+// CreateShard creates the shard of the extent of size, a shard created before
+// is written over.
+func (s *ECStore) CreateShard(extentId, inode uint64, size int64) (err error) {
+	if err = s.Create(extentId, inode, true); err != nil {
+		return
+	}
+	record := make([]byte, ECSizeRecordSize)
+	binary.BigEndian.PutUint64(record[0:8], extentId)
+	binary.BigEndian.PutUint64(record[8:16], inode)
+	binary.BigEndian.PutUint64(record[16:ECSizeRecordSize], uint64(size))
+	s.sizeMux.Lock()
+	defer s.sizeMux.Unlock()
+	if _, err = s.sizeFp.Write(record); err != nil {
+		return
+	}
+	if err = s.sizeFp.Sync(); err != nil {
+		return
+	}
+	s.extents[extentId] = &proto.ECExtent{ExtentId: extentId, Inode: inode, Size: size}
+	return
+}
+
+/*the extent of the shard held by the store, nil once it is deleted*/
+func (s *ECStore) ECExtent(extentId uint64) (extent *proto.ECExtent) {
+	s.sizeMux.RLock()
+	extent = s.extents[extentId]
+	s.sizeMux.RUnlock()
+	if extent == nil || !s.IsExistExtent(extentId) {
+		return nil
+	}
+	if info, err := s.GetWatermark(extentId, false); err != nil || info.Deleted {
+		return nil
+	}
+	return &proto.ECExtent{ExtentId: extent.ExtentId, Inode: extent.Inode, Size: extent.Size, Refs: s.Refs(extentId)}
+}
+
+/*the extents whose shards are held by the store whole, by extent id*/
+func (s *ECStore) ECExtents() (extents []*proto.ECExtent) {
+	s.sizeMux.RLock()
+	ids := make([]uint64, 0, len(s.extents))
+	for id := range s.extents {
+		ids = append(ids, id)
+	}
+	s.sizeMux.RUnlock()
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	extents = make([]*proto.ECExtent, 0, len(ids))
+	for _, id := range ids {
+		extent := s.ECExtent(id)
+		if extent == nil {
+			continue
+		}
+		if info, err := s.GetWatermark(id, false); err != nil || int64(info.Size) < ECShardSize(extent.Size, proto.ECDataShards) {
+			continue
+		}
+		extents = append(extents, extent)
+	}
+	return
+}
+
+func (s *ECStore) Close() {
+	s.ExtentStore.Close()
+	s.sizeMux.Lock()
+	s.sizeFp.Close()
+	s.sizeMux.Unlock()
+}
@@ -0,0 +1,164 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+/*the shards of data encoded in memory*/
+func encodeTestExtent(t *testing.T, ec *ErasureCode, data []byte) (shards [][]byte) {
+	size := int64(len(data))
+	shards = make([][]byte, ec.TotalShards())
+	for i := range shards {
+		shards[i] = make([]byte, ECShardSize(size, ec.DataShards()))
+	}
+	err := ec.EncodeExtent(size, func(offset int64, buf []byte) error {
+		copy(buf, data[offset:])
+		return nil
+	}, func(shard int, offset int64, unit []byte) error {
+		copy(shards[shard][offset:], unit)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+/*the read of the shards, the failed ones return an error*/
+func readTestShards(shards [][]byte, failed ...int) func(shard int, offset int64, data []byte) error {
+	return func(shard int, offset int64, data []byte) error {
+		for _, f := range failed {
+			if f == shard {
+				return errors.New("shard unavailable")
+			}
+		}
+		copy(data, shards[shard][offset:])
+		return nil
+	}
+}
+
+func TestErasureCode_ReadExtent(t *testing.T) {
+	ec, err := NewErasureCode(DefaultECDataShards, DefaultECParityShards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 2*DefaultECDataShards*ECStripeUnit+1000)
+	rand.Read(data)
+	shards := encodeTestExtent(t, ec, data)
+	size := int64(len(data))
+	cases := []struct {
+		offset, size int64
+		failed       []int
+	}{
+		{0, size, nil},
+		{ECStripeUnit - 10, 20, nil},
+		{0, size, []int{0, 5}},
+		{3*ECStripeUnit + 7, 2 * ECStripeUnit, []int{1, 3}},
+		{size - 100, 100, []int{0, 1}},
+	}
+	for _, c := range cases {
+		buf := make([]byte, c.size)
+		if err = ec.ReadExtent(size, c.offset, buf, readTestShards(shards, c.failed...)); err != nil {
+			t.Fatalf("read offset(%v) size(%v) failed(%v): %v", c.offset, c.size, c.failed, err)
+		}
+		if !bytes.Equal(buf, data[c.offset:c.offset+c.size]) {
+			t.Fatalf("read offset(%v) size(%v) failed(%v): data mismatch", c.offset, c.size, c.failed)
+		}
+	}
+	buf := make([]byte, size)
+	if err = ec.ReadExtent(size, 0, buf, readTestShards(shards, 0, 1, 2)); err != ErrECTooFewShards {
+		t.Fatalf("read with three failed shards: err(%v) want(%v)", err, ErrECTooFewShards)
+	}
+	if err = ec.ReadExtent(size, 1, buf, readTestShards(shards)); err == nil {
+		t.Fatalf("read beyond the extent succeeded")
+	}
+}
+
+func TestErasureCode_RebuildShard(t *testing.T) {
+	ec, err := NewErasureCode(DefaultECDataShards, DefaultECParityShards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, DefaultECDataShards*ECStripeUnit+ECStripeUnit/2)
+	rand.Read(data)
+	shards := encodeTestExtent(t, ec, data)
+	for _, lost := range []int{1, DefaultECDataShards} {
+		rebuilt := make([]byte, len(shards[lost]))
+		err = ec.RebuildShard(int64(len(data)), lost, readTestShards(shards, lost), func(offset int64, unit []byte) error {
+			copy(rebuilt[offset:], unit)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("rebuild shard(%v): %v", lost, err)
+		}
+		if !bytes.Equal(rebuilt, shards[lost]) {
+			t.Fatalf("rebuild shard(%v): data mismatch", lost)
+		}
+	}
+}
+
+func TestECStore_Reopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewECStore(dir, 0, SyncIO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unit := make([]byte, ECStripeUnit)
+	rand.Read(unit)
+	if err = store.CreateShard(1025, 7, ECStripeUnit); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Write(1025, 0, ECStripeUnit, unit, crc32.ChecksumIEEE(unit)); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.CreateShard(1026, 8, 3*ECStripeUnit); err != nil {
+		t.Fatal(err)
+	}
+	if extents := store.ECExtents(); len(extents) != 1 || extents[0].ExtentId != 1025 {
+		t.Fatalf("extents with whole shards: %v", extents)
+	}
+	store.Close()
+
+	if store, err = NewECStore(dir, 0, SyncIO); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	extent := store.ECExtent(1025)
+	if extent == nil || extent.Inode != 7 || extent.Size != ECStripeUnit {
+		t.Fatalf("reopened extent: %v", extent)
+	}
+	buf := make([]byte, ECStripeUnit)
+	if _, err = store.Read(1025, 0, ECStripeUnit, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, unit) {
+		t.Fatalf("reopened shard: data mismatch")
+	}
+	if extent = store.ECExtent(1026); extent == nil || extent.Size != 3*ECStripeUnit {
+		t.Fatalf("reopened partial extent: %v", extent)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	IOBackendSync    = "sync"
+	IOBackendIOUring = "iouring"
+
+	DefaultIOUringEntries = 256
+
+	FALLOC_FL_KEEP_SIZE  = 1
+	FALLOC_FL_PUNCH_HOLE = 2
+)
+
+var (
+	ErrIOUringUnsupported = errors.New("io_uring not supported by the build, it needs the iouring tag on linux")
+	ErrIOClosed           = errors.New("extent io closed")
+)
+
+// ExtentIO does the reads and the writes of the headers, the data and the block
+// crcs of the extents, their fsync, truncate and fallocate, it is shared by the
+// extent stores of a disk.
+type ExtentIO interface {
+	// ReadAt reads len(b) bytes of the file from off, it returns io.EOF if the
+	// file ends before like os.File.
+	ReadAt(f *os.File, b []byte, off int64) (n int, err error)
+
+	// WriteAt writes b to the file from off.
+	WriteAt(f *os.File, b []byte, off int64) (n int, err error)
+
+	// Fsync synchronizes the file to the disk.
+	Fsync(f *os.File) error
+
+	// Fallocate allocates or, with FALLOC_FL_PUNCH_HOLE, releases the blocks
+	// of the file in the range of size from off.
+	Fallocate(f *os.File, mode uint32, off, size int64) error
+
+	// Truncate changes the size of the file.
+	Truncate(f *os.File, size int64) error
+
+	// Close releases the backend, the IO in flight is finished before.
+	Close() error
+}
+
+// NewExtentIO returns the extent io of backend, the io_uring backend submits
+// the IO of the disk in batches through a ring of entries.
+func NewExtentIO(backend string, entries int) (ExtentIO, error) {
+	switch backend {
+	case "", IOBackendSync:
+		return SyncIO, nil
+	case IOBackendIOUring:
+		if entries <= 0 {
+			entries = DefaultIOUringEntries
+		}
+		return newIOUring(entries)
+	}
+	return nil, fmt.Errorf("unknown io backend %v", backend)
+}
+
+// SyncIO does the IO by the syscalls of os.File in the goroutine of the caller.
+var SyncIO ExtentIO = syncIO{}
+
+type syncIO struct{}
+
+func (syncIO) ReadAt(f *os.File, b []byte, off int64) (int, error) {
+	return f.ReadAt(b, off)
+}
+
+func (syncIO) WriteAt(f *os.File, b []byte, off int64) (int, error) {
+	return f.WriteAt(b, off)
+}
+
+func (syncIO) Fsync(f *os.File) error {
+	return f.Sync()
+}
+
+func (syncIO) Fallocate(f *os.File, mode uint32, off, size int64) error {
+	return fallocate(f, mode, off, size)
+}
+
+func (syncIO) Truncate(f *os.File, size int64) error {
+	return f.Truncate(size)
+}
+
+func (syncIO) Close() error {
+	return nil
+}
@@ -0,0 +1,420 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// +build iouring
+
+package storage
+
+import (
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	sysIOUringSetup = 425
+	sysIOUringEnter = 426
+
+	ioringOpNop       = 0
+	ioringOpFsync     = 3
+	ioringOpFallocate = 17
+	ioringOpRead      = 22
+	ioringOpWrite     = 23
+
+	ioringOffSqRing = 0
+	ioringOffCqRing = 0x8000000
+	ioringOffSqes   = 0x10000000
+
+	ioringFeatSingleMmap = 1
+	ioringEnterGetEvents = 1
+
+	ioUringSqeSize  = 64
+	ioUringCqeSize  = 16
+	ioUringMaxBatch = 32
+	ioUringStopData = ^uint64(0) //user data of the nop stopping the reaper
+)
+
+type ioSqringOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type ioCqringOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type ioUringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFd uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  ioSqringOffsets
+	cqOff                                                                  ioCqringOffsets
+}
+
+type ioUringSqe struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	opFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	pad         [2]uint64
+}
+
+type ioUringCqe struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// an IO waiting for its completion, buf is kept referenced until then, the
+// mode and the size are of a fallocate
+type ioUringRequest struct {
+	opcode uint8
+	fd     int32
+	buf    []byte
+	off    int64
+	mode   uint32
+	size   int64
+	res    int32
+	done   chan struct{}
+}
+
+// ioUring submits the IO of a disk through an io_uring. The submitter takes the
+// requests queued while the ring was entered and submits them by one
+// io_uring_enter, the reaper waits for the completions and wakes the callers.
+type ioUring struct {
+	fd       int
+	sqRing   []byte
+	cqRing   []byte
+	sqes     []byte
+	sqTail   *uint32
+	sqMask   uint32
+	sqArray  unsafe.Pointer
+	cqHead   *uint32
+	cqTail   *uint32
+	cqMask   uint32
+	cqes     unsafe.Pointer
+	maxBatch int
+
+	reqC     chan *ioUringRequest
+	slots    chan struct{} //the requests in flight are limited to the completion entries
+	inflight map[uint64]*ioUringRequest
+	nextId   uint64
+	lock     sync.Mutex
+	closeMux sync.RWMutex
+	closed   bool
+	closeC   chan struct{}
+	stoppedC chan struct{}
+}
+
+func newIOUring(entries int) (ExtentIO, error) {
+	params := &ioUringParams{}
+	fd, _, errno := syscall.Syscall(sysIOUringSetup, uintptr(entries), uintptr(unsafe.Pointer(params)), 0)
+	if errno != 0 {
+		return nil, os.NewSyscallError("io_uring_setup", errno)
+	}
+	r := &ioUring{fd: int(fd)}
+	if err := r.mmap(params); err != nil {
+		r.unmap()
+		syscall.Close(r.fd)
+		return nil, err
+	}
+	r.maxBatch = ioUringMaxBatch
+	if int(params.sqEntries) < r.maxBatch {
+		r.maxBatch = int(params.sqEntries)
+	}
+	r.reqC = make(chan *ioUringRequest, params.sqEntries)
+	r.slots = make(chan struct{}, params.cqEntries)
+	r.inflight = make(map[uint64]*ioUringRequest)
+	r.closeC = make(chan struct{})
+	r.stoppedC = make(chan struct{})
+	go r.submit()
+	go r.reap()
+	return r, nil
+}
+
+func (r *ioUring) mmap(params *ioUringParams) (err error) {
+	sqSize := int(params.sqOff.array + params.sqEntries*4)
+	cqSize := int(params.cqOff.cqes + params.cqEntries*ioUringCqeSize)
+	singleMmap := params.features&ioringFeatSingleMmap != 0
+	if singleMmap && cqSize > sqSize {
+		sqSize = cqSize
+	}
+	prot := syscall.PROT_READ | syscall.PROT_WRITE
+	flags := syscall.MAP_SHARED | syscall.MAP_POPULATE
+	if r.sqRing, err = syscall.Mmap(r.fd, ioringOffSqRing, sqSize, prot, flags); err != nil {
+		return os.NewSyscallError("mmap", err)
+	}
+	r.cqRing = r.sqRing
+	if !singleMmap {
+		if r.cqRing, err = syscall.Mmap(r.fd, ioringOffCqRing, cqSize, prot, flags); err != nil {
+			r.cqRing = nil
+			return os.NewSyscallError("mmap", err)
+		}
+	}
+	if r.sqes, err = syscall.Mmap(r.fd, ioringOffSqes, int(params.sqEntries)*ioUringSqeSize, prot, flags); err != nil {
+		r.sqes = nil
+		return os.NewSyscallError("mmap", err)
+	}
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.tail]))
+	r.sqMask = *(*uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.ringMask]))
+	r.sqArray = unsafe.Pointer(&r.sqRing[params.sqOff.array])
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[params.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[params.cqOff.tail]))
+	r.cqMask = *(*uint32)(unsafe.Pointer(&r.cqRing[params.cqOff.ringMask]))
+	r.cqes = unsafe.Pointer(&r.cqRing[params.cqOff.cqes])
+	return
+}
+
+func (r *ioUring) unmap() {
+	if r.sqes != nil {
+		syscall.Munmap(r.sqes)
+	}
+	if r.cqRing != nil && &r.cqRing[0] != &r.sqRing[0] {
+		syscall.Munmap(r.cqRing)
+	}
+	if r.sqRing != nil {
+		syscall.Munmap(r.sqRing)
+	}
+}
+
+func (r *ioUring) ReadAt(f *os.File, b []byte, off int64) (n int, err error) {
+	// a read returns less at the end of the file
+	for n < len(b) {
+		var m int
+		if m, err = r.do(f, &ioUringRequest{opcode: ioringOpRead, buf: b[n:], off: off + int64(n)}); err != nil {
+			return
+		}
+		if m == 0 {
+			return n, io.EOF
+		}
+		n += m
+	}
+	return
+}
+
+func (r *ioUring) WriteAt(f *os.File, b []byte, off int64) (n int, err error) {
+	for n < len(b) {
+		var m int
+		if m, err = r.do(f, &ioUringRequest{opcode: ioringOpWrite, buf: b[n:], off: off + int64(n)}); err != nil {
+			return
+		}
+		if m == 0 {
+			return n, io.ErrShortWrite
+		}
+		n += m
+	}
+	return
+}
+
+func (r *ioUring) Fsync(f *os.File) (err error) {
+	_, err = r.do(f, &ioUringRequest{opcode: ioringOpFsync})
+	return
+}
+
+func (r *ioUring) Fallocate(f *os.File, mode uint32, off, size int64) (err error) {
+	_, err = r.do(f, &ioUringRequest{opcode: ioringOpFallocate, off: off, mode: mode, size: size})
+	return
+}
+
+// Truncate is done by the syscall, the ring has no op of it.
+func (r *ioUring) Truncate(f *os.File, size int64) error {
+	r.closeMux.RLock()
+	defer r.closeMux.RUnlock()
+	if r.closed {
+		return ErrIOClosed
+	}
+	return f.Truncate(size)
+}
+
+func (r *ioUring) do(f *os.File, req *ioUringRequest) (n int, err error) {
+	req.fd, req.done = int32(f.Fd()), make(chan struct{})
+	r.closeMux.RLock()
+	if r.closed {
+		r.closeMux.RUnlock()
+		return 0, ErrIOClosed
+	}
+	r.slots <- struct{}{}
+	r.reqC <- req
+	r.closeMux.RUnlock()
+	<-req.done
+	// the file must not be closed by its finalizer while the kernel uses its fd
+	runtime.KeepAlive(f)
+	if req.res < 0 {
+		return 0, &os.PathError{Op: ioUringOpName(req.opcode), Path: f.Name(), Err: syscall.Errno(-req.res)}
+	}
+	return int(req.res), nil
+}
+
+func ioUringOpName(opcode uint8) string {
+	switch opcode {
+	case ioringOpRead:
+		return "read"
+	case ioringOpWrite:
+		return "write"
+	case ioringOpFsync:
+		return "fsync"
+	case ioringOpFallocate:
+		return "fallocate"
+	}
+	return "nop"
+}
+
+func (r *ioUring) submit() {
+	batch := make([]*ioUringRequest, 0, r.maxBatch)
+	for {
+		batch = batch[:0]
+		select {
+		case req := <-r.reqC:
+			batch = append(batch, req)
+		case <-r.closeC:
+			// no more requests are queued once the ring is closed, the ones
+			// queued before are submitted before the stop
+			for len(r.reqC) > 0 {
+				for len(batch) < r.maxBatch && len(r.reqC) > 0 {
+					batch = append(batch, <-r.reqC)
+				}
+				r.enter(batch, 0)
+				batch = batch[:0]
+			}
+			r.enter(batch, ioUringStopData)
+			return
+		}
+	drain:
+		for len(batch) < r.maxBatch {
+			select {
+			case req := <-r.reqC:
+				batch = append(batch, req)
+			default:
+				break drain
+			}
+		}
+		r.enter(batch, 0)
+	}
+}
+
+// enter puts the requests into the submission ring and submits them, a nop of
+// stopData is put after them unless it is 0.
+func (r *ioUring) enter(batch []*ioUringRequest, stopData uint64) {
+	tail := atomic.LoadUint32(r.sqTail)
+	count := uint32(0)
+	for _, req := range batch {
+		r.lock.Lock()
+		r.nextId++
+		id := r.nextId
+		r.inflight[id] = req
+		r.lock.Unlock()
+		sqe := r.sqe(tail + count)
+		*sqe = ioUringSqe{opcode: req.opcode, fd: req.fd, off: uint64(req.off), userData: id}
+		if len(req.buf) != 0 {
+			sqe.addr = uint64(uintptr(unsafe.Pointer(&req.buf[0])))
+			sqe.len = uint32(len(req.buf))
+		}
+		if req.opcode == ioringOpFallocate {
+			// the length of the range is in the addr and the mode in the len
+			sqe.addr, sqe.len = uint64(req.size), req.mode
+		}
+		count++
+	}
+	if stopData != 0 {
+		*r.sqe(tail + count) = ioUringSqe{opcode: ioringOpNop, userData: stopData}
+		count++
+	}
+	atomic.StoreUint32(r.sqTail, tail+count)
+	for submitted := uint32(0); submitted < count; {
+		ret, _, errno := syscall.Syscall6(sysIOUringEnter, uintptr(r.fd), uintptr(count-submitted), 0, 0, 0, 0)
+		switch errno {
+		case 0:
+			submitted += uint32(ret)
+		case syscall.EINTR, syscall.EAGAIN, syscall.EBUSY:
+			// the completions are reaped meanwhile
+			time.Sleep(time.Millisecond)
+		default:
+			log.LogErrorf("action[ioUring.enter] submit %v entries: %v", count-submitted, errno)
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func (r *ioUring) sqe(index uint32) *ioUringSqe {
+	index &= r.sqMask
+	*(*uint32)(unsafe.Pointer(uintptr(r.sqArray) + uintptr(index)*4)) = index
+	return (*ioUringSqe)(unsafe.Pointer(&r.sqes[uintptr(index)*ioUringSqeSize]))
+}
+
+func (r *ioUring) reap() {
+	defer close(r.stoppedC)
+	stopped := false
+	for {
+		head := atomic.LoadUint32(r.cqHead)
+		tail := atomic.LoadUint32(r.cqTail)
+		for ; head != tail; head++ {
+			cqe := (*ioUringCqe)(unsafe.Pointer(uintptr(r.cqes) + uintptr(head&r.cqMask)*ioUringCqeSize))
+			if cqe.userData == ioUringStopData {
+				stopped = true
+				continue
+			}
+			r.lock.Lock()
+			req := r.inflight[cqe.userData]
+			delete(r.inflight, cqe.userData)
+			r.lock.Unlock()
+			if req == nil {
+				continue
+			}
+			req.res = cqe.res
+			close(req.done)
+			<-r.slots
+		}
+		atomic.StoreUint32(r.cqHead, head)
+		r.lock.Lock()
+		idle := len(r.inflight) == 0
+		r.lock.Unlock()
+		if stopped && idle {
+			return
+		}
+		_, _, errno := syscall.Syscall6(sysIOUringEnter, uintptr(r.fd), 0, 1, ioringEnterGetEvents, 0, 0)
+		if errno != 0 && errno != syscall.EINTR {
+			log.LogErrorf("action[ioUring.reap] wait completions: %v", errno)
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func (r *ioUring) Close() error {
+	r.closeMux.Lock()
+	if r.closed {
+		r.closeMux.Unlock()
+		return nil
+	}
+	r.closed = true
+	r.closeMux.Unlock()
+	close(r.closeC)
+	<-r.stoppedC
+	r.unmap()
+	return syscall.Close(r.fd)
+}
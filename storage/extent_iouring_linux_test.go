@@ -0,0 +1,125 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// +build iouring
+
+package storage
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+	"unsafe"
+)
+
+func newTestIOUring(t *testing.T) ExtentIO {
+	if unsafe.Sizeof(ioUringSqe{}) != ioUringSqeSize || unsafe.Sizeof(ioUringCqe{}) != ioUringCqeSize ||
+		unsafe.Sizeof(ioUringParams{}) != 120 {
+		t.Fatalf("io_uring struct sizes mismatch the kernel")
+	}
+	r, err := NewExtentIO(IOBackendIOUring, 8)
+	if err != nil {
+		t.Skipf("io_uring not available: %v", err)
+	}
+	return r
+}
+
+func TestIOUring_ReadWrite(t *testing.T) {
+	r := newTestIOUring(t)
+	defer r.Close()
+	name := "/tmp/extent_iouring_rw"
+	defer os.Remove(name)
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	data := make([]byte, 64*1024)
+	rand.Read(data)
+	// more writers than the entries of the ring
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			chunk := data[i*4096 : (i+1)*4096]
+			if n, err := r.WriteAt(f, chunk, int64(i*4096)); err != nil || n != len(chunk) {
+				t.Errorf("write chunk[%v] n[%v] err[%v]", i, n, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err = r.Fsync(f); err != nil {
+		t.Fatalf("fsync: %v", err)
+	}
+	readBuf := make([]byte, len(data))
+	if n, err := r.ReadAt(f, readBuf, 0); err != nil || n != len(data) || !bytes.Equal(readBuf, data) {
+		t.Fatalf("read n[%v] err[%v] exp[%v] data mismatch", n, err, len(data))
+	}
+	if n, err := r.ReadAt(f, readBuf, int64(len(data)-100)); err != io.EOF || n != 100 {
+		t.Fatalf("read over the end n[%v] err[%v] exp[100 %v]", n, err, io.EOF)
+	}
+}
+
+func TestIOUring_FallocateTruncate(t *testing.T) {
+	r := newTestIOUring(t)
+	defer r.Close()
+	name := "/tmp/extent_iouring_falloc"
+	defer os.Remove(name)
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	data := bytes.Repeat([]byte{'a'}, 3*4096)
+	if _, err = r.WriteAt(f, data, 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err = r.Fallocate(f, FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE, 4096, 4096); err != nil {
+		t.Skipf("punch hole not supported: %v", err)
+	}
+	readBuf := make([]byte, len(data))
+	if _, err = r.ReadAt(f, readBuf, 0); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	copy(data[4096:], make([]byte, 4096))
+	if !bytes.Equal(readBuf, data) {
+		t.Fatalf("data mismatch after the punch")
+	}
+	if err = r.Fallocate(f, FALLOC_FL_KEEP_SIZE, int64(len(data)), 4096); err != nil {
+		t.Fatalf("keep size: %v", err)
+	}
+	if err = r.Truncate(f, 4096); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	if info, err := f.Stat(); err != nil || info.Size() != 4096 {
+		t.Fatalf("size after the truncate %v err[%v]", info.Size(), err)
+	}
+}
+
+func TestIOUring_Close(t *testing.T) {
+	r := newTestIOUring(t)
+	if err := r.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if _, err := r.ReadAt(os.Stdin, make([]byte, 1), 0); err != ErrIOClosed {
+		t.Fatalf("read of closed err[%v] exp[%v]", err, ErrIOClosed)
+	}
+	if err := r.Truncate(os.Stdin, 0); err != ErrIOClosed {
+		t.Fatalf("truncate of closed err[%v] exp[%v]", err, ErrIOClosed)
+	}
+}
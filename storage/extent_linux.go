@@ -15,20 +15,29 @@
 package storage
 
 import (
+	"os"
 	"syscall"
+	"time"
 )
 
-const (
-	FALLOC_FL_KEEP_SIZE  = 1
-	FALLOC_FL_PUNCH_HOLE = 2
-)
+// fallocate allocates the blocks of the range by mode, with
+// FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE it releases them keeping the size of
+// the file, the partial blocks at its ends are zeroed.
+func fallocate(f *os.File, mode uint32, off int64, len int64) (err error) {
+	return syscall.Fallocate(int(f.Fd()), mode, off, len)
+}
 
-func (e *fsExtent) tryKeepSize(fd int, off int64, len int64) (err error) {
-	err = syscall.Fallocate(fd, FALLOC_FL_KEEP_SIZE, off, len)
-	return
+// AllocatedSize returns the bytes actually allocated on disk for the file.
+func AllocatedSize(info os.FileInfo) int64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Blocks * 512
+	}
+	return info.Size()
 }
 
-func (e *fsExtent) tryPunchHole(fd int, off int64, len int64) (err error) {
-	err = syscall.Fallocate(fd, FALLOC_FL_PUNCH_HOLE, off, len)
-	return
+func accessTime(info os.FileInfo) time.Time {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(stat.Atim.Sec, stat.Atim.Nsec)
+	}
+	return info.ModTime()
 }
@@ -0,0 +1,190 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	ExtRefFileName       = "EXTENT_REF"
+	ExtRefRecordSize     = 12   //extent id and its references
+	ExtRefCompactRecords = 4096 //records appended beyond twice the shared extents before EXTENT_REF is rewritten
+	ExtRefFileOpt        = os.O_CREATE | os.O_RDWR | os.O_APPEND
+)
+
+// The references of the extents shared by several files, like the clones and
+// the snapshots, are kept in EXTENT_REF next to EXTENT_META rather than in the
+// extent header, so the extents written before keep their layout. An extent
+// missing from the file has a single reference, a mark delete drops one and
+// only the drop of the last one deletes the extent and reclaims its space.
+//
+// Each change of the references appends a record to the file, the last record
+// of an extent wins and a record of at most one reference drops it. The file is
+// rewritten with the shared extents only once the records outgrow them. The
+// references are changed under refMux and written under extentInfoMux too, so
+// the readers of the extent infos holding extentInfoMux see them consistent.
+
+func (s *ExtentStore) loadExtentRefs() (err error) {
+	var data []byte
+	name := path.Join(s.dataDir, ExtRefFileName)
+	if data, err = ioutil.ReadFile(name); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	s.extentInfoMux.Lock()
+	for off := 0; off+ExtRefRecordSize <= len(data); off += ExtRefRecordSize {
+		extentId := binary.BigEndian.Uint64(data[off : off+8])
+		refs := binary.BigEndian.Uint32(data[off+8 : off+ExtRefRecordSize])
+		if refs <= 1 {
+			refs = 1
+		}
+		if extentInfo, ok := s.extentInfoMap[extentId]; ok {
+			extentInfo.Refs = refs
+		}
+	}
+	s.extentInfoMux.Unlock()
+	s.refMux.Lock()
+	defer s.refMux.Unlock()
+	// a record torn by a crash or the records of the deleted extents are dropped
+	return s.compactExtentRefs()
+}
+
+/*rewrite EXTENT_REF with the extents having more than one reference, the caller must hold refMux*/
+func (s *ExtentStore) compactExtentRefs() (err error) {
+	data := make([]byte, 0)
+	record := make([]byte, ExtRefRecordSize)
+	s.extentInfoMux.RLock()
+	for extentId, extentInfo := range s.extentInfoMap {
+		if extentInfo.Refs <= 1 {
+			continue
+		}
+		binary.BigEndian.PutUint64(record[:8], extentId)
+		binary.BigEndian.PutUint32(record[8:], extentInfo.Refs)
+		data = append(data, record...)
+	}
+	s.extentInfoMux.RUnlock()
+	name := path.Join(s.dataDir, ExtRefFileName)
+	tmpName := name + ".tmp"
+	var fp *os.File
+	if fp, err = os.OpenFile(tmpName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666); err != nil {
+		return
+	}
+	if _, err = fp.Write(data); err == nil {
+		err = fp.Sync()
+	}
+	fp.Close()
+	if err != nil {
+		os.Remove(tmpName)
+		return
+	}
+	if err = os.Rename(tmpName, name); err != nil {
+		return
+	}
+	if err = syncDir(s.dataDir); err != nil {
+		return
+	}
+	if s.refFp != nil {
+		s.refFp.Close()
+	}
+	if s.refFp, err = os.OpenFile(name, ExtRefFileOpt, 0666); err != nil {
+		return
+	}
+	s.refRecords = len(data) / ExtRefRecordSize
+	s.refShared = s.refRecords
+	return
+}
+
+/*append the references of the extent to EXTENT_REF and set them, the caller must hold refMux*/
+func (s *ExtentStore) putExtentRefs(extentId uint64, extentInfo *FileInfo, refs uint32) (err error) {
+	record := make([]byte, ExtRefRecordSize)
+	binary.BigEndian.PutUint64(record[:8], extentId)
+	binary.BigEndian.PutUint32(record[8:], refs)
+	if _, err = s.refFp.Write(record); err == nil {
+		err = s.refFp.Sync()
+	}
+	if err != nil {
+		return
+	}
+	s.refRecords++
+	if extentInfo != nil {
+		s.extentInfoMux.Lock()
+		extentInfo.Refs = refs
+		s.extentInfoMux.Unlock()
+	}
+	if s.refRecords > 2*s.refShared+ExtRefCompactRecords {
+		if cerr := s.compactExtentRefs(); cerr != nil {
+			log.LogWarnf("action[putExtentRefs] dir(%v) compact %v: %v", s.dataDir, ExtRefFileName, cerr)
+		}
+	}
+	return
+}
+
+// AddRef adds a reference of another file sharing the extent.
+func (s *ExtentStore) AddRef(extentId uint64) (refs uint32, err error) {
+	s.refMux.Lock()
+	defer s.refMux.Unlock()
+	s.extentInfoMux.RLock()
+	extentInfo, has := s.extentInfoMap[extentId]
+	s.extentInfoMux.RUnlock()
+	if !has {
+		err = fmt.Errorf("extent %v not exist", extentId)
+		return
+	}
+	if extentInfo.Deleted {
+		err = ErrorHasDelete
+		return
+	}
+	if err = s.putExtentRefs(extentId, extentInfo, extentInfo.Refs+1); err != nil {
+		return
+	}
+	return extentInfo.Refs, nil
+}
+
+// Refs returns the references of the extent, 0 if it doesn't exist.
+func (s *ExtentStore) Refs(extentId uint64) (refs uint32) {
+	s.extentInfoMux.RLock()
+	defer s.extentInfoMux.RUnlock()
+	if extentInfo, has := s.extentInfoMap[extentId]; has {
+		refs = extentInfo.Refs
+	}
+	return
+}
+
+// SetRefs sets the references of the extent to the ones of the leader, a
+// leader not reporting references has a single one of each extent.
+func (s *ExtentStore) SetRefs(extentId uint64, refs uint32) (err error) {
+	if refs == 0 {
+		refs = 1
+	}
+	s.refMux.Lock()
+	defer s.refMux.Unlock()
+	s.extentInfoMux.RLock()
+	extentInfo, has := s.extentInfoMap[extentId]
+	s.extentInfoMux.RUnlock()
+	if !has {
+		err = fmt.Errorf("extent %v not exist", extentId)
+		return
+	}
+	if extentInfo.Refs == refs {
+		return
+	}
+	return s.putExtentRefs(extentId, extentInfo, refs)
+}
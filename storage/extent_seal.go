@@ -0,0 +1,191 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+const (
+	ExtSealFileName   = "EXTENT_SEAL"
+	ExtSealRecordSize = 20 //extent id, size and header crc
+)
+
+// The extents of a sealed store don't change but by a delete. The seal flushes
+// the extents and keeps the size and the crc of the header, which holds the crc
+// of each block, of every extent in EXTENT_SEAL. The headers are verified
+// against the file without reading the data, and the replicas of a sealed
+// partition are the same if their files have the same crc.
+
+type sealRecord struct {
+	size uint64
+	crc  uint32
+}
+
+func (s *ExtentStore) loadExtentSeal() (err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(path.Join(s.dataDir, ExtSealFileName)); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	sealed := make(map[uint64]*sealRecord)
+	for off := 0; off+ExtSealRecordSize <= len(data); off += ExtSealRecordSize {
+		extentId := binary.BigEndian.Uint64(data[off : off+8])
+		sealed[extentId] = &sealRecord{
+			size: binary.BigEndian.Uint64(data[off+8 : off+16]),
+			crc:  binary.BigEndian.Uint32(data[off+16 : off+ExtSealRecordSize]),
+		}
+	}
+	s.sealMux.Lock()
+	s.sealed = sealed
+	s.sealCrc = crc32.ChecksumIEEE(data)
+	s.sealMux.Unlock()
+	return
+}
+
+// Seal flushes the extents and records them in EXTENT_SEAL, the caller must
+// refuse the writes before. A sealed store is sealed again after its extents
+// are repaired.
+func (s *ExtentStore) Seal() (err error) {
+	extents, err := s.GetAllWatermark(nil)
+	if err != nil {
+		return
+	}
+	sort.Slice(extents, func(i, j int) bool {
+		return extents[i].FileId < extents[j].FileId
+	})
+	data := make([]byte, 0, len(extents)*ExtSealRecordSize)
+	record := make([]byte, ExtSealRecordSize)
+	for _, extentInfo := range extents {
+		if extentInfo.Deleted || extentInfo.FileId <= BlobFileFileCount {
+			continue
+		}
+		extentId := uint64(extentInfo.FileId)
+		if err = s.Sync(extentId); err != nil {
+			return fmt.Errorf("sync extent %v: %v", extentId, err)
+		}
+		if extentInfo, err = s.GetWatermark(extentId, true); err != nil {
+			return
+		}
+		binary.BigEndian.PutUint64(record[:8], extentId)
+		binary.BigEndian.PutUint64(record[8:16], extentInfo.Size)
+		binary.BigEndian.PutUint32(record[16:], extentInfo.Crc)
+		data = append(data, record...)
+	}
+	name := path.Join(s.dataDir, ExtSealFileName)
+	tmpName := name + ".tmp"
+	var fp *os.File
+	if fp, err = os.OpenFile(tmpName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666); err != nil {
+		return
+	}
+	if _, err = fp.Write(data); err == nil {
+		err = fp.Sync()
+	}
+	fp.Close()
+	if err != nil {
+		os.Remove(tmpName)
+		return
+	}
+	if err = os.Rename(tmpName, name); err != nil {
+		return
+	}
+	return s.loadExtentSeal()
+}
+
+// Unseal removes EXTENT_SEAL, the extents can be written again.
+func (s *ExtentStore) Unseal() (err error) {
+	if err = os.Remove(path.Join(s.dataDir, ExtSealFileName)); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	s.sealMux.Lock()
+	s.sealed = nil
+	s.sealCrc = 0
+	s.sealMux.Unlock()
+	return nil
+}
+
+// Manifest returns the digests of the extents not deleted, of the seal if the
+// store is sealed, else read from the headers of the extents now.
+func (s *ExtentStore) Manifest() (digests []*proto.ExtentDigest, sealed bool, err error) {
+	s.sealMux.RLock()
+	records := s.sealed
+	s.sealMux.RUnlock()
+	sealed = records != nil
+	extents, err := s.GetAllWatermark(nil)
+	if err != nil {
+		return
+	}
+	digests = make([]*proto.ExtentDigest, 0, len(extents))
+	for _, extentInfo := range extents {
+		if extentInfo.Deleted || extentInfo.FileId <= BlobFileFileCount {
+			continue
+		}
+		extentId := uint64(extentInfo.FileId)
+		if record, ok := records[extentId]; ok {
+			digests = append(digests, &proto.ExtentDigest{ExtentId: extentId, Size: record.size, Crc: record.crc})
+			continue
+		}
+		if extentInfo, err = s.GetWatermark(extentId, true); err != nil {
+			return
+		}
+		digests = append(digests, &proto.ExtentDigest{ExtentId: extentId, Size: extentInfo.Size, Crc: extentInfo.Crc})
+	}
+	return
+}
+
+func (s *ExtentStore) IsSealed() bool {
+	s.sealMux.RLock()
+	defer s.sealMux.RUnlock()
+	return s.sealed != nil
+}
+
+// SealCrc returns the crc of EXTENT_SEAL, 0 if the store is not sealed.
+func (s *ExtentStore) SealCrc() uint32 {
+	s.sealMux.RLock()
+	defer s.sealMux.RUnlock()
+	return s.sealCrc
+}
+
+// VerifySeal returns the extents of the seal whose size or header changed, the
+// extents deleted since the seal are not.
+func (s *ExtentStore) VerifySeal() (extents []uint64) {
+	s.sealMux.RLock()
+	sealed := s.sealed
+	s.sealMux.RUnlock()
+	extents = make([]uint64, 0)
+	for extentId, record := range sealed {
+		extentInfo, err := s.GetWatermark(extentId, true)
+		if err != nil || extentInfo.Deleted {
+			continue
+		}
+		if extentInfo.Size != record.size || extentInfo.Crc != record.crc {
+			extents = append(extents, extentId)
+		}
+	}
+	sort.Slice(extents, func(i, j int) bool {
+		return extents[i] < extents[j]
+	})
+	return
+}
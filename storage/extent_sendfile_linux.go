@@ -0,0 +1,89 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"io"
+	"syscall"
+
+	"github.com/tiglabs/containerfs/util"
+)
+
+// SendFile sends the block at offset with sendfile, only the full blocks of the
+// extents not encrypted are sent as their crcs are in the header, the others
+// get ErrorZeroCopyUnsupport before head is called. The data is not verified,
+// the receiver checks it against the crc, and a write in flight may change the
+// block after its crc is taken.
+func (e *fsExtent) SendFile(conn syscall.Conn, offset, size int64, head func(crc uint32) error) (err error) {
+	if e.isEncrypted() || offset%util.BlockSize != 0 || size != util.BlockSize {
+		return ErrorZeroCopyUnsupport
+	}
+	if err = e.checkOffsetAndSize(offset, size); err != nil {
+		return
+	}
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	if offset+size > e.dataSize || e.released {
+		return ErrorZeroCopyUnsupport
+	}
+	if err = head(e.getBlockCrc(int(offset / util.BlockSize))); err != nil {
+		return
+	}
+	return sendFile(conn, e.file, offset+util.BlockHeaderSize, size)
+}
+
+// sendFile copies size bytes of src at offset to dst in the kernel, it waits
+// for dst to be writable through the poller and keeps the deadline of dst.
+func sendFile(dst, src syscall.Conn, offset, size int64) (err error) {
+	dstConn, err := dst.SyscallConn()
+	if err != nil {
+		return
+	}
+	srcConn, err := src.SyscallConn()
+	if err != nil {
+		return
+	}
+	var sendErr error
+	ctrlErr := srcConn.Control(func(srcFd uintptr) {
+		err = dstConn.Write(func(dstFd uintptr) bool {
+			for size > 0 {
+				n, serr := syscall.Sendfile(int(dstFd), int(srcFd), &offset, int(size))
+				if n > 0 {
+					size -= int64(n)
+				}
+				switch {
+				case serr == syscall.EAGAIN:
+					return false
+				case serr == syscall.EINTR:
+					continue
+				case serr != nil:
+					sendErr = serr
+					return true
+				case n == 0:
+					sendErr = io.ErrUnexpectedEOF
+					return true
+				}
+			}
+			return true
+		})
+	})
+	if err == nil {
+		err = sendErr
+	}
+	if err == nil {
+		err = ctrlErr
+	}
+	return
+}
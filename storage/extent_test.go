@@ -19,8 +19,12 @@ import (
 	"encoding/binary"
 	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"math/rand"
+	"net"
 	"os"
+	"path"
+	"strconv"
 	"testing"
 	"time"
 
@@ -105,3 +109,727 @@ func TestFsExtent_Validate(t *testing.T) {
 	}
 
 }
+
+func TestFsExtent_ReadCorruptBlock(t *testing.T) {
+	var err error
+	defer os.Remove("/tmp/extent_2")
+	extent := NewExtentInCore("/tmp/extent_2", 2)
+	if err = extent.InitToFS(2, true); err != nil {
+		panic(err)
+	}
+	defer extent.Close()
+	data := make([]byte, util.BlockSize)
+	for blockNo := 0; blockNo < 2; blockNo++ {
+		rand.Read(data)
+		if err = extent.Write(data, int64(blockNo*util.BlockSize), int64(len(data)), crc32.ChecksumIEEE(data)); err != nil {
+			panic(err)
+		}
+	}
+	var file *os.File
+	if file, err = os.OpenFile("/tmp/extent_2", os.O_RDWR, 0666); err != nil {
+		panic(err)
+	}
+	defer file.Close()
+	readBuff := make([]byte, 100)
+	if _, err = file.ReadAt(readBuff[:1], int64(util.BlockHeaderSize+util.BlockSize+10)); err != nil {
+		panic(err)
+	}
+	readBuff[0] ^= 0xff
+	if _, err = file.WriteAt(readBuff[:1], int64(util.BlockHeaderSize+util.BlockSize+10)); err != nil {
+		panic(err)
+	}
+	if _, err = extent.Read(readBuff, 10, int64(len(readBuff))); err != nil {
+		t.Fatalf("read intact block: %v", err)
+	}
+	if _, err = extent.Read(readBuff, int64(util.BlockSize+50), int64(len(readBuff))); err != ErrorBlockCrcMismatch {
+		t.Fatalf("read corrupt block err[%v] exp[%v]", err, ErrorBlockCrcMismatch)
+	}
+	if _, err = extent.Read(readBuff, int64(util.BlockSize-50), int64(len(readBuff))); err != ErrorBlockCrcMismatch {
+		t.Fatalf("read across corrupt block err[%v] exp[%v]", err, ErrorBlockCrcMismatch)
+	}
+}
+
+func TestFsExtent_PunchHole(t *testing.T) {
+	var err error
+	defer os.Remove("/tmp/extent_3")
+	extent := NewExtentInCore("/tmp/extent_3", 3)
+	if err = extent.InitToFS(3, true); err != nil {
+		panic(err)
+	}
+	defer extent.Close()
+	data := make([]byte, 3*util.BlockSize)
+	rand.Read(data)
+	for blockNo := 0; blockNo < 3; blockNo++ {
+		block := data[blockNo*util.BlockSize : (blockNo+1)*util.BlockSize]
+		if err = extent.Write(block, int64(blockNo*util.BlockSize), int64(len(block)), crc32.ChecksumIEEE(block)); err != nil {
+			panic(err)
+		}
+	}
+	offset, size := 100, 2*util.BlockSize
+	if err = extent.PunchHole(int64(offset), int64(size)); err != nil {
+		t.Fatalf("punch hole: %v", err)
+	}
+	if extent.Size() != int64(len(data)) {
+		t.Fatalf("size act[%v] exp[%v]", extent.Size(), len(data))
+	}
+	copy(data[offset:offset+size], make([]byte, size))
+	readBuff := make([]byte, util.BlockSize)
+	for blockNo := 0; blockNo < 3; blockNo++ {
+		if _, err = extent.Read(readBuff, int64(blockNo*util.BlockSize), int64(len(readBuff))); err != nil {
+			t.Fatalf("read block[%v] of punched extent: %v", blockNo, err)
+		}
+		if !bytes.Equal(readBuff, data[blockNo*util.BlockSize:(blockNo+1)*util.BlockSize]) {
+			t.Fatalf("data of block[%v] of punched extent mismatch", blockNo)
+		}
+	}
+}
+
+func TestFsExtent_SendFile(t *testing.T) {
+	var err error
+	defer os.Remove("/tmp/extent_4")
+	extent := NewExtentInCore("/tmp/extent_4", 4)
+	if err = extent.InitToFS(4, true); err != nil {
+		panic(err)
+	}
+	defer extent.Close()
+	data := make([]byte, util.BlockSize+100)
+	rand.Read(data)
+	if err = extent.Write(data[:util.BlockSize], 0, util.BlockSize, crc32.ChecksumIEEE(data[:util.BlockSize])); err != nil {
+		panic(err)
+	}
+	if err = extent.Write(data[util.BlockSize:], util.BlockSize, 100, crc32.ChecksumIEEE(data[util.BlockSize:])); err != nil {
+		panic(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer conn.Close()
+		block := make([]byte, util.BlockSize)
+		if _, err = io.ReadFull(conn, block); err != nil {
+			block = nil
+		}
+		received <- block
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	head := func(crc uint32) error {
+		if crc != crc32.ChecksumIEEE(data[:util.BlockSize]) {
+			t.Fatalf("crc of block act[%v] exp[%v]", crc, crc32.ChecksumIEEE(data[:util.BlockSize]))
+		}
+		return nil
+	}
+	// the partial block and the range out of the block need the copy
+	if err = extent.SendFile(conn.(*net.TCPConn), util.BlockSize, 100, head); err != ErrorZeroCopyUnsupport {
+		t.Fatalf("send partial block: %v", err)
+	}
+	if err = extent.SendFile(conn.(*net.TCPConn), 100, util.BlockSize, head); err != ErrorZeroCopyUnsupport {
+		t.Fatalf("send unaligned block: %v", err)
+	}
+	if err = extent.SendFile(conn.(*net.TCPConn), 0, util.BlockSize, head); err != nil {
+		t.Fatalf("send block: %v", err)
+	}
+	if block := <-received; !bytes.Equal(block, data[:util.BlockSize]) {
+		t.Fatalf("data of block sent mismatch")
+	}
+}
+
+func TestExtentStore_Refs(t *testing.T) {
+	dataDir := "/tmp/extent_store_refs"
+	os.RemoveAll(dataDir)
+	defer os.RemoveAll(dataDir)
+	store, err := NewExtentStore(dataDir, util.ExtentSize)
+	if err != nil {
+		panic(err)
+	}
+	extentId := store.NextExtentId()
+	if err = store.Create(extentId, 1, false); err != nil {
+		panic(err)
+	}
+	if refs, err := store.AddRef(extentId); err != nil || refs != 2 {
+		t.Fatalf("add ref refs[%v] err[%v] exp[2]", refs, err)
+	}
+	store.Close()
+	if store, err = NewExtentStore(dataDir, util.ExtentSize); err != nil {
+		panic(err)
+	}
+	defer store.Close()
+	if refs := store.Refs(extentId); refs != 2 {
+		t.Fatalf("reloaded refs act[%v] exp[2]", refs)
+	}
+	if err = store.MarkDelete(extentId); err != nil {
+		panic(err)
+	}
+	if !store.IsExistExtent(extentId) || store.Refs(extentId) != 1 {
+		t.Fatalf("extent deleted with refs act[%v] exp[1]", store.Refs(extentId))
+	}
+	if err = store.MarkDelete(extentId); err != nil {
+		panic(err)
+	}
+	if store.IsExistExtent(extentId) {
+		t.Fatalf("extent not deleted by the last reference")
+	}
+}
+
+func TestExtentStore_RefsAppended(t *testing.T) {
+	dataDir := "/tmp/extent_store_refs_appended"
+	os.RemoveAll(dataDir)
+	defer os.RemoveAll(dataDir)
+	store, err := NewExtentStore(dataDir, util.ExtentSize)
+	if err != nil {
+		panic(err)
+	}
+	shared, single := store.NextExtentId(), store.NextExtentId()
+	for _, extentId := range []uint64{shared, single} {
+		if err = store.Create(extentId, 1, false); err != nil {
+			panic(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if _, err = store.AddRef(shared); err != nil {
+			panic(err)
+		}
+	}
+	if _, err = store.AddRef(single); err != nil {
+		panic(err)
+	}
+	if err = store.MarkDelete(single); err != nil {
+		panic(err)
+	}
+	info, err := os.Stat(path.Join(dataDir, ExtRefFileName))
+	if err != nil {
+		panic(err)
+	}
+	if info.Size() != 5*ExtRefRecordSize {
+		t.Fatalf("refs file size act[%v] exp[%v]", info.Size(), 5*ExtRefRecordSize)
+	}
+	store.Close()
+	if store, err = NewExtentStore(dataDir, util.ExtentSize); err != nil {
+		panic(err)
+	}
+	defer store.Close()
+	if store.Refs(shared) != 4 || store.Refs(single) != 1 {
+		t.Fatalf("reloaded refs act[%v %v] exp[4 1]", store.Refs(shared), store.Refs(single))
+	}
+	if info, err = os.Stat(path.Join(dataDir, ExtRefFileName)); err != nil || info.Size() != ExtRefRecordSize {
+		t.Fatalf("refs file not compacted at the load: %v %v", info, err)
+	}
+}
+
+func TestExtentStore_PunchHoleShared(t *testing.T) {
+	dataDir := "/tmp/extent_store_punch"
+	os.RemoveAll(dataDir)
+	defer os.RemoveAll(dataDir)
+	store, err := NewExtentStore(dataDir, util.ExtentSize)
+	if err != nil {
+		panic(err)
+	}
+	defer store.Close()
+	extentId := store.NextExtentId()
+	if err = store.Create(extentId, 1, false); err != nil {
+		panic(err)
+	}
+	data := make([]byte, util.BlockSize)
+	rand.Read(data)
+	if err = store.Write(extentId, 0, int64(len(data)), data, crc32.ChecksumIEEE(data)); err != nil {
+		panic(err)
+	}
+	if _, err = store.AddRef(extentId); err != nil {
+		panic(err)
+	}
+	if err = store.PunchHole(extentId, 0, int64(len(data))); err != ErrorExtentShared {
+		t.Fatalf("punch shared extent err[%v] exp[%v]", err, ErrorExtentShared)
+	}
+	if err = store.MarkDelete(extentId); err != nil {
+		panic(err)
+	}
+	if err = store.PunchHole(extentId, 0, int64(len(data))); err != nil {
+		t.Fatalf("punch extent: %v", err)
+	}
+}
+
+func TestExtentStore_UsedSize(t *testing.T) {
+	dataDir := "/tmp/extent_store_used"
+	os.RemoveAll(dataDir)
+	defer os.RemoveAll(dataDir)
+	store, err := NewExtentStore(dataDir, util.ExtentSize)
+	if err != nil {
+		panic(err)
+	}
+	defer store.Close()
+	extentId := store.NextExtentId()
+	if err = store.Create(extentId, 1, false); err != nil {
+		panic(err)
+	}
+	data := make([]byte, util.BlockSize)
+	for blockNo := 0; blockNo < 3; blockNo++ {
+		rand.Read(data)
+		if err = store.Write(extentId, int64(blockNo*util.BlockSize), int64(len(data)), data, crc32.ChecksumIEEE(data)); err != nil {
+			panic(err)
+		}
+	}
+	written := store.UsedSize()
+	if written < 3*util.BlockSize {
+		t.Fatalf("used size of written extent act[%v] exp[>=%v]", written, 3*util.BlockSize)
+	}
+	if drift, err := store.ReconcileUsedSize(); err != nil || drift != 0 {
+		t.Fatalf("drift of written extent act[%v] err[%v] exp[0]", drift, err)
+	}
+	if err = store.PunchHole(extentId, 0, util.BlockSize); err != nil {
+		panic(err)
+	}
+	if drift, err := store.ReconcileUsedSize(); err != nil || drift != 0 {
+		t.Fatalf("drift of punched extent act[%v] err[%v] exp[0]", drift, err)
+	}
+	punched := store.UsedSize()
+	if err = store.MarkDelete(extentId); err != nil {
+		panic(err)
+	}
+	if used := store.UsedSize(); used != punched {
+		t.Fatalf("used size of deleted extent act[%v] exp[%v]", used, punched)
+	}
+	if err = store.FlushDelete(); err != nil {
+		panic(err)
+	}
+	if used := store.UsedSize(); used != 0 {
+		t.Fatalf("used size of flushed extent act[%v] exp[0]", used)
+	}
+}
+
+func TestExtentStore_ReclaimableSize(t *testing.T) {
+	dataDir := "/tmp/extent_store_reclaimable"
+	os.RemoveAll(dataDir)
+	defer os.RemoveAll(dataDir)
+	store, err := NewExtentStore(dataDir, util.ExtentSize)
+	if err != nil {
+		panic(err)
+	}
+	defer store.Close()
+	extentId := store.NextExtentId()
+	if err = store.Create(extentId, 1, false); err != nil {
+		panic(err)
+	}
+	data := make([]byte, util.BlockSize)
+	rand.Read(data)
+	if err = store.Write(extentId, 0, int64(len(data)), data, crc32.ChecksumIEEE(data)); err != nil {
+		panic(err)
+	}
+	if err = store.Preallocate(extentId, 4*util.BlockSize); err != nil {
+		panic(err)
+	}
+	preallocated := store.ReclaimableSize()
+	if preallocated < 2*util.BlockSize {
+		t.Fatalf("reclaimable of preallocated extent act[%v] exp[>=%v]", preallocated, 2*util.BlockSize)
+	}
+	// the kept size is the one a scan of the files counts
+	if _, err = store.ReconcileUsedSize(); err != nil {
+		panic(err)
+	}
+	if reclaimable := store.ReclaimableSize(); reclaimable != preallocated {
+		t.Fatalf("reclaimable after reconcile act[%v] exp[%v]", reclaimable, preallocated)
+	}
+	used := store.UsedSize()
+	if err = store.MarkDelete(extentId); err != nil {
+		panic(err)
+	}
+	if reclaimable := store.ReclaimableSize(); reclaimable != used {
+		t.Fatalf("reclaimable of deleted extent act[%v] exp[%v]", reclaimable, used)
+	}
+	if err = store.FlushDelete(); err != nil {
+		panic(err)
+	}
+	if reclaimable := store.ReclaimableSize(); reclaimable != 0 {
+		t.Fatalf("reclaimable of flushed extent act[%v] exp[0]", reclaimable)
+	}
+}
+
+func TestExtentStore_ReadQuarantined(t *testing.T) {
+	dataDir := "/tmp/extent_store_quarantined"
+	os.RemoveAll(dataDir)
+	defer os.RemoveAll(dataDir)
+	store, err := NewExtentStore(dataDir, util.ExtentSize)
+	if err != nil {
+		panic(err)
+	}
+	defer store.Close()
+	extentId := store.NextExtentId()
+	if err = store.Create(extentId, 1, false); err != nil {
+		panic(err)
+	}
+	data := make([]byte, util.BlockSize)
+	for blockNo := 0; blockNo < 3; blockNo++ {
+		rand.Read(data)
+		if err = store.Write(extentId, int64(blockNo*util.BlockSize), int64(len(data)), data, crc32.ChecksumIEEE(data)); err != nil {
+			panic(err)
+		}
+	}
+	crcs, err := store.BlockCrcs(extentId, util.BlockSize)
+	if err != nil || len(crcs) != 2 {
+		t.Fatalf("block crcs len[%v] err[%v] exp[2]", len(crcs), err)
+	}
+	extent, err := store.getExtent(extentId)
+	if err != nil {
+		panic(err)
+	}
+	if err = store.quarantineExtent(extent, util.BlockSize); err != nil {
+		panic(err)
+	}
+	if remain, _ := store.BlockCrcs(extentId, 0); len(remain) != 1 {
+		t.Fatalf("block crcs after quarantine len[%v] exp[1]", len(remain))
+	}
+	for i, crc := range crcs {
+		n, err := store.ReadQuarantined(extentId, util.BlockSize, int64((i+1)*util.BlockSize), data)
+		if err != nil || n != len(data) || crc32.ChecksumIEEE(data) != crc {
+			t.Fatalf("quarantined block[%v] n[%v] err[%v] crc mismatch", i+1, n, err)
+		}
+	}
+	if _, err = store.ReadQuarantined(extentId, 2*util.BlockSize, 2*util.BlockSize, data); err != ErrorFileNotFound {
+		t.Fatalf("read not quarantined err[%v] exp[%v]", err, ErrorFileNotFound)
+	}
+}
+
+func TestExtentStore_VerifyExtents(t *testing.T) {
+	dataDir := "/tmp/extent_store_verify"
+	os.RemoveAll(dataDir)
+	defer os.RemoveAll(dataDir)
+	store, err := NewExtentStore(dataDir, util.ExtentSize)
+	if err != nil {
+		panic(err)
+	}
+	defer store.Close()
+	extentId := store.NextExtentId()
+	if err = store.Create(extentId, 1, false); err != nil {
+		panic(err)
+	}
+	blocks := make([][]byte, 4)
+	for blockNo := range blocks {
+		blocks[blockNo] = make([]byte, util.BlockSize)
+		rand.Read(blocks[blockNo])
+		if err = store.Write(extentId, int64(blockNo*util.BlockSize), util.BlockSize, blocks[blockNo], crc32.ChecksumIEEE(blocks[blockNo])); err != nil {
+			panic(err)
+		}
+	}
+	file, err := os.OpenFile(path.Join(dataDir, strconv.FormatUint(extentId, 10)), os.O_RDWR, 0666)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+	// a block in the middle and the last block are corrupt
+	for _, blockNo := range []int{1, 3} {
+		if _, err = file.WriteAt([]byte{^blocks[blockNo][10]}, int64(util.BlockHeaderSize+blockNo*util.BlockSize+10)); err != nil {
+			panic(err)
+		}
+	}
+	ranges, err := store.VerifyExtents()
+	if err != nil || len(ranges) != 1 {
+		t.Fatalf("verify ranges[%v] err[%v] exp[1]", len(ranges), err)
+	}
+	info, err := store.GetWatermark(extentId, false)
+	if err != nil || info.Size != 3*util.BlockSize {
+		t.Fatalf("size after verify [%v] err[%v] exp[%v]", info.Size, err, 3*util.BlockSize)
+	}
+	// only the tail is verified on load, the block in the middle is found by the scrub
+	corrupt := store.GetCorruptBlocks()
+	if len(corrupt) != 0 {
+		t.Fatalf("corrupt blocks after verify %v exp none", corrupt)
+	}
+	if err = store.ScrubExtent(extentId, func(n int) {}); err != ErrorBlockCrcMismatch {
+		t.Fatalf("scrub err[%v] exp[%v]", err, ErrorBlockCrcMismatch)
+	}
+	corrupt = store.GetCorruptBlocks()
+	if len(corrupt) != 1 || corrupt[0].Start != util.BlockSize || corrupt[0].End != 2*util.BlockSize {
+		t.Fatalf("corrupt blocks %v exp block 1", corrupt)
+	}
+	data := make([]byte, util.BlockSize)
+	if _, err = store.Read(extentId, 2*util.BlockSize, util.BlockSize, data); err != nil || !bytes.Equal(data, blocks[2]) {
+		t.Fatalf("read block after the corrupt one: %v", err)
+	}
+
+	if err = store.RepairBlock(extentId, util.BlockSize, blocks[2], crc32.ChecksumIEEE(blocks[1])); err != ErrorBlockCrcMismatch {
+		t.Fatalf("repair with other data err[%v] exp[%v]", err, ErrorBlockCrcMismatch)
+	}
+	if err = store.RepairBlock(extentId, util.BlockSize, blocks[1], crc32.ChecksumIEEE(blocks[1])); err != nil {
+		t.Fatalf("repair block: %v", err)
+	}
+	if _, err = store.Read(extentId, util.BlockSize, util.BlockSize, data); err != nil || !bytes.Equal(data, blocks[1]) {
+		t.Fatalf("read repaired block: %v", err)
+	}
+	if corrupt = store.GetCorruptBlocks(); len(corrupt) != 0 {
+		t.Fatalf("corrupt blocks after repair %v", corrupt)
+	}
+	if quarantined := store.GetQuarantined(); len(quarantined) != 1 || quarantined[0].Start != 3*util.BlockSize {
+		t.Fatalf("quarantined after repair %v exp the tail", quarantined)
+	}
+}
+
+func TestExtentStore_ReadCorruptBlock(t *testing.T) {
+	dataDir := "/tmp/extent_store_read_corrupt"
+	os.RemoveAll(dataDir)
+	defer os.RemoveAll(dataDir)
+	store, err := NewExtentStore(dataDir, util.ExtentSize)
+	if err != nil {
+		panic(err)
+	}
+	defer store.Close()
+	extentId := store.NextExtentId()
+	if err = store.Create(extentId, 1, false); err != nil {
+		panic(err)
+	}
+	blocks := make([][]byte, 3)
+	for blockNo := range blocks {
+		blocks[blockNo] = make([]byte, util.BlockSize)
+		rand.Read(blocks[blockNo])
+		if err = store.Write(extentId, int64(blockNo*util.BlockSize), util.BlockSize, blocks[blockNo], crc32.ChecksumIEEE(blocks[blockNo])); err != nil {
+			panic(err)
+		}
+	}
+	file, err := os.OpenFile(path.Join(dataDir, strconv.FormatUint(extentId, 10)), os.O_RDWR, 0666)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+	if _, err = file.WriteAt([]byte{^blocks[1][10]}, int64(util.BlockHeaderSize+util.BlockSize+10)); err != nil {
+		panic(err)
+	}
+	data := make([]byte, util.BlockSize)
+	if _, err = store.Read(extentId, util.BlockSize, util.BlockSize, data); err != ErrorBlockCrcMismatch {
+		t.Fatalf("read corrupt block err[%v] exp[%v]", err, ErrorBlockCrcMismatch)
+	}
+	// only the corrupt block is marked, the extent keeps its size
+	info, err := store.GetWatermark(extentId, false)
+	if err != nil || info.Size != 3*util.BlockSize {
+		t.Fatalf("size after corrupt read [%v] err[%v] exp[%v]", info.Size, err, 3*util.BlockSize)
+	}
+	corrupt := store.GetCorruptBlocks()
+	if len(corrupt) != 1 || corrupt[0].Start != util.BlockSize || corrupt[0].End != 2*util.BlockSize {
+		t.Fatalf("corrupt blocks %v exp block 1", corrupt)
+	}
+	if _, err = store.Read(extentId, 2*util.BlockSize, util.BlockSize, data); err != nil || !bytes.Equal(data, blocks[2]) {
+		t.Fatalf("read block after the corrupt one: %v", err)
+	}
+	scrubbed := 0
+	if err = store.ScrubExtent(extentId, func(n int) { scrubbed += n }); err != ErrorBlockCrcMismatch || scrubbed != 3*util.BlockSize {
+		t.Fatalf("scrub err[%v] scrubbed[%v] exp[%v] [%v]", err, scrubbed, ErrorBlockCrcMismatch, 3*util.BlockSize)
+	}
+	if quarantined := store.GetQuarantined(); len(quarantined) != 1 {
+		t.Fatalf("quarantined after scrub %v exp block 1", quarantined)
+	}
+	if err = store.RepairBlock(extentId, util.BlockSize, blocks[1], crc32.ChecksumIEEE(blocks[1])); err != nil {
+		t.Fatalf("repair block: %v", err)
+	}
+	if err = store.ScrubExtent(extentId, func(n int) {}); err != nil {
+		t.Fatalf("scrub after repair: %v", err)
+	}
+}
+
+// memTier is the view of a replica of a tier shared by the replicas
+type memTier struct {
+	objects map[string][]byte
+	refs    map[string]map[string]bool
+	replica string
+}
+
+func newMemTier() *memTier {
+	return &memTier{objects: make(map[string][]byte), refs: make(map[string]map[string]bool), replica: "a"}
+}
+
+func (m *memTier) of(replica string) *memTier {
+	return &memTier{objects: m.objects, refs: m.refs, replica: replica}
+}
+
+func (m *memTier) Put(key string, data io.Reader, size int64) (err error) {
+	object := make([]byte, size)
+	if _, err = io.ReadFull(data, object); err != nil {
+		return
+	}
+	m.objects[key] = object
+	return
+}
+
+func (m *memTier) Exist(key string, size int64) bool {
+	object, ok := m.objects[key]
+	return ok && int64(len(object)) == size
+}
+
+func (m *memTier) ReadAt(key string, data []byte, offset int64) (n int, err error) {
+	object, ok := m.objects[key]
+	if !ok {
+		return 0, ErrorObjNotFound
+	}
+	if n = copy(data, object[offset:]); n < len(data) {
+		err = io.EOF
+	}
+	return
+}
+
+func (m *memTier) Get(key string) (io.ReadCloser, error) {
+	object, ok := m.objects[key]
+	if !ok {
+		return nil, ErrorObjNotFound
+	}
+	return ioutil.NopCloser(bytes.NewReader(object)), nil
+}
+
+func (m *memTier) Ref(key string) error {
+	if m.refs[key] == nil {
+		m.refs[key] = make(map[string]bool)
+	}
+	m.refs[key][m.replica] = true
+	return nil
+}
+
+func (m *memTier) Unref(key string) error {
+	delete(m.refs[key], m.replica)
+	if len(m.refs[key]) == 0 {
+		delete(m.refs, key)
+		delete(m.objects, key)
+	}
+	return nil
+}
+
+func TestExtentStore_ColdTier(t *testing.T) {
+	dataDir := "/tmp/extent_store_tier"
+	os.RemoveAll(dataDir)
+	defer os.RemoveAll(dataDir)
+	store, err := NewExtentStore(dataDir, util.ExtentSize)
+	if err != nil {
+		panic(err)
+	}
+	tier := newMemTier()
+	store.SetColdTier(tier, false)
+	extentId := store.NextExtentId()
+	if err = store.Create(extentId, 1, false); err != nil {
+		panic(err)
+	}
+	data := make([]byte, 3*util.BlockSize-100)
+	rand.Read(data)
+	for offset := 0; offset < len(data); offset += util.BlockSize {
+		block := data[offset:]
+		if len(block) > util.BlockSize {
+			block = block[:util.BlockSize]
+		}
+		if err = store.Write(extentId, int64(offset), int64(len(block)), block, crc32.ChecksumIEEE(block)); err != nil {
+			panic(err)
+		}
+	}
+	if extents := store.ColdExtents(time.Now().Add(time.Second)); len(extents) != 1 || extents[0] != extentId {
+		t.Fatalf("cold extents act[%v] exp[%v]", extents, extentId)
+	}
+	written := store.UsedSize()
+	if err = store.TierExtent(extentId); err != nil {
+		t.Fatalf("tier extent: %v", err)
+	}
+	if !store.IsTiered(extentId) || len(tier.objects) != 1 {
+		t.Fatalf("tiered[%v] objects[%v] exp[true 1]", store.IsTiered(extentId), len(tier.objects))
+	}
+	if used := store.UsedSize(); used >= written-2*util.BlockSize {
+		t.Fatalf("used size of tiered extent act[%v] exp[<%v]", used, written-2*util.BlockSize)
+	}
+	store.Close()
+	if store, err = NewExtentStore(dataDir, util.ExtentSize); err != nil {
+		panic(err)
+	}
+	defer store.Close()
+	store.SetColdTier(tier, false)
+	if !store.IsTiered(extentId) {
+		t.Fatalf("reloaded extent not tiered")
+	}
+	read := make([]byte, util.BlockSize)
+	for _, r := range [][2]int64{{0, util.BlockSize}, {100, 1000}, {util.BlockSize - 10, 20}, {2 * util.BlockSize, util.BlockSize - 100}} {
+		if _, err = store.Read(extentId, r[0], r[1], read); err != nil {
+			t.Fatalf("read tiered offset[%v] size[%v]: %v", r[0], r[1], err)
+		}
+		if !bytes.Equal(read[:r[1]], data[r[0]:r[0]+r[1]]) {
+			t.Fatalf("read tiered offset[%v] size[%v] data mismatch", r[0], r[1])
+		}
+	}
+	// a write recalls the data first
+	block := data[:util.BlockSize]
+	if err = store.Write(extentId, 0, int64(len(block)), block, crc32.ChecksumIEEE(block)); err != nil {
+		t.Fatalf("write tiered: %v", err)
+	}
+	if store.IsTiered(extentId) {
+		t.Fatalf("written extent still tiered")
+	}
+	if _, err = store.Read(extentId, 2*util.BlockSize, util.BlockSize-100, read); err != nil || !bytes.Equal(read[:util.BlockSize-100], data[2*util.BlockSize:]) {
+		t.Fatalf("read recalled err[%v] or data mismatch", err)
+	}
+	if err = store.TierExtent(extentId); err != nil {
+		panic(err)
+	}
+	if err = store.MarkDelete(extentId); err != nil {
+		panic(err)
+	}
+	if err = store.FlushDelete(); err != nil {
+		panic(err)
+	}
+	if store.IsTiered(extentId) || len(tier.objects) != 0 {
+		t.Fatalf("flushed extent tiered[%v] objects[%v] exp[false 0]", store.IsTiered(extentId), len(tier.objects))
+	}
+}
+
+func TestExtentStore_ColdTierReplicas(t *testing.T) {
+	tier := newMemTier()
+	data := make([]byte, 2*util.BlockSize)
+	rand.Read(data)
+	var (
+		stores   []*ExtentStore
+		extentId uint64
+	)
+	for _, replica := range []string{"a", "b"} {
+		dataDir := "/tmp/extent_store_tier_" + replica
+		os.RemoveAll(dataDir)
+		defer os.RemoveAll(dataDir)
+		store, err := NewExtentStore(dataDir, util.ExtentSize)
+		if err != nil {
+			panic(err)
+		}
+		defer store.Close()
+		store.SetColdTier(tier.of(replica), false)
+		extentId = store.NextExtentId()
+		if err = store.Create(extentId, 1, false); err != nil {
+			panic(err)
+		}
+		for offset := 0; offset < len(data); offset += util.BlockSize {
+			block := data[offset : offset+util.BlockSize]
+			if err = store.Write(extentId, int64(offset), int64(len(block)), block, crc32.ChecksumIEEE(block)); err != nil {
+				panic(err)
+			}
+		}
+		if err = store.TierExtent(extentId); err != nil {
+			t.Fatalf("tier extent of replica %v: %v", replica, err)
+		}
+		stores = append(stores, store)
+	}
+	if len(tier.objects) != 1 || len(tier.refs) != 1 {
+		t.Fatalf("objects[%v] refs[%v] of the replicas exp[1 1]", len(tier.objects), len(tier.refs))
+	}
+	// the object is kept while a replica holds it
+	if err := stores[0].RecallExtent(extentId); err != nil {
+		t.Fatalf("recall: %v", err)
+	}
+	if len(tier.objects) != 1 {
+		t.Fatalf("object of a replica still tiered deleted")
+	}
+	read := make([]byte, util.BlockSize)
+	if _, err := stores[1].Read(extentId, util.BlockSize, util.BlockSize, read); err != nil || !bytes.Equal(read, data[util.BlockSize:]) {
+		t.Fatalf("read tiered err[%v] or data mismatch", err)
+	}
+	if err := stores[1].RecallExtent(extentId); err != nil {
+		t.Fatalf("recall: %v", err)
+	}
+	if len(tier.objects) != 0 || len(tier.refs) != 0 {
+		t.Fatalf("objects[%v] refs[%v] after the last recall exp[0 0]", len(tier.objects), len(tier.refs))
+	}
+}
@@ -0,0 +1,538 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tiglabs/containerfs/util"
+	"github.com/tiglabs/containerfs/util/buf"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	ExtTierFileName   = "EXTENT_TIER"
+	ExtTierRecordSize = 20 //extent id, size and header crc
+)
+
+// The data of an extent not read for a while can be moved to a cold tier, an
+// S3-compatible bucket usually. The data is put as one object and punched from
+// the extent file, the header stays so the size and the crc of the extent don't
+// change and the blocks read from the tier are verified like the local ones.
+// The tiered extents are kept in EXTENT_TIER with the size and the header crc
+// naming their object, the replicas with the same data share it and each one
+// holds a reference to it. A write recalls the data of the extent first, the
+// reference is dropped once the extent is recalled, overwritten or deleted and
+// the object is deleted with the last one. The extents of an encrypted store
+// are not tiered.
+
+// ColdTier keeps the data of the tiered extents of a store.
+type ColdTier interface {
+	Put(key string, data io.Reader, size int64) error
+	Exist(key string, size int64) bool
+	ReadAt(key string, data []byte, offset int64) (n int, err error)
+	Get(key string) (io.ReadCloser, error)
+
+	// Ref records the reference of the replica of the store to the object,
+	// it is taken before the object is put so the one of another replica
+	// dropped meanwhile keeps it.
+	Ref(key string) error
+
+	// Unref drops the reference of the replica of the store, the object is
+	// deleted with the last one.
+	Unref(key string) error
+}
+
+/*serializes the moves of an extent to and from the cold tier, the ones of the other extents go on*/
+type tierOpLock struct {
+	sync.Mutex
+	waiters int
+}
+
+type tierRecord struct {
+	size uint64
+	crc  uint32
+}
+
+func (r *tierRecord) key(extentId uint64) string {
+	return fmt.Sprintf("%v_%v_%08x", extentId, r.size, r.crc)
+}
+
+type tierReader struct {
+	tier ColdTier
+	key  string
+}
+
+func (r *tierReader) ReadAt(data []byte, offset int64) (n int, err error) {
+	return r.tier.ReadAt(r.key, data, offset)
+}
+
+func (s *ExtentStore) loadExtentTier() (err error) {
+	var data []byte
+	s.tiered = make(map[uint64]*tierRecord)
+	s.recalling = make(map[uint64]bool)
+	s.tierOps = make(map[uint64]*tierOpLock)
+	if data, err = ioutil.ReadFile(path.Join(s.dataDir, ExtTierFileName)); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	for off := 0; off+ExtTierRecordSize <= len(data); off += ExtTierRecordSize {
+		extentId := binary.BigEndian.Uint64(data[off : off+8])
+		s.tiered[extentId] = &tierRecord{
+			size: binary.BigEndian.Uint64(data[off+8 : off+16]),
+			crc:  binary.BigEndian.Uint32(data[off+16 : off+ExtTierRecordSize]),
+		}
+		// the data released before a crash may be left in the file
+		s.extentInfoMux.RLock()
+		extentInfo, has := s.extentInfoMap[extentId]
+		s.extentInfoMux.RUnlock()
+		if !has {
+			continue
+		}
+		extent, loadErr := s.getExtent(extentId)
+		if loadErr != nil {
+			continue
+		}
+		if err = extent.ReleaseData(extent.ModTime()); err != nil {
+			return fmt.Errorf("release extent %v: %v", extentId, err)
+		}
+		s.updateUsedSize(extentInfo, extent)
+	}
+	return
+}
+
+/*lock the tier ops of the extent, the returned func unlocks them*/
+func (s *ExtentStore) lockTierOp(extentId uint64) (unlock func()) {
+	s.tierMux.Lock()
+	l := s.tierOps[extentId]
+	if l == nil {
+		l = new(tierOpLock)
+		s.tierOps[extentId] = l
+	}
+	l.waiters++
+	s.tierMux.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		s.tierMux.Lock()
+		if l.waiters--; l.waiters == 0 {
+			delete(s.tierOps, extentId)
+		}
+		s.tierMux.Unlock()
+	}
+}
+
+/*drop the reference of the store to the object of the extent no longer tiered*/
+func (s *ExtentStore) unrefTiered(tier ColdTier, extentId uint64, record *tierRecord) {
+	if tier == nil {
+		return
+	}
+	if err := tier.Unref(record.key(extentId)); err != nil {
+		log.LogWarnf("action[unrefTiered] store(%v) extent(%v) object(%v) kept: %v",
+			s.dataDir, extentId, record.key(extentId), err)
+	}
+}
+
+/*rewrite EXTENT_TIER with the tiered extents, the caller must hold tierMux*/
+func (s *ExtentStore) persistExtentTier() (err error) {
+	data := make([]byte, 0, len(s.tiered)*ExtTierRecordSize)
+	record := make([]byte, ExtTierRecordSize)
+	for extentId, r := range s.tiered {
+		binary.BigEndian.PutUint64(record[:8], extentId)
+		binary.BigEndian.PutUint64(record[8:16], r.size)
+		binary.BigEndian.PutUint32(record[16:], r.crc)
+		data = append(data, record...)
+	}
+	name := path.Join(s.dataDir, ExtTierFileName)
+	tmpName := name + ".tmp"
+	var fp *os.File
+	if fp, err = os.OpenFile(tmpName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666); err != nil {
+		return
+	}
+	if _, err = fp.Write(data); err == nil {
+		err = fp.Sync()
+	}
+	fp.Close()
+	if err != nil {
+		os.Remove(tmpName)
+		return
+	}
+	return os.Rename(tmpName, name)
+}
+
+// SetColdTier sets the tier the extents are moved to, the data of a tiered
+// extent read is recalled to the local disk if recall is true.
+func (s *ExtentStore) SetColdTier(tier ColdTier, recall bool) {
+	s.tierMux.Lock()
+	s.coldTier = tier
+	s.recallOnRead = recall
+	s.tierMux.Unlock()
+}
+
+func (s *ExtentStore) IsTiered(extentId uint64) bool {
+	s.tierMux.RLock()
+	defer s.tierMux.RUnlock()
+	_, ok := s.tiered[extentId]
+	return ok
+}
+
+// TieredSize returns the count and the bytes of the extents in the cold tier.
+func (s *ExtentStore) TieredSize() (count int, size uint64) {
+	s.tierMux.RLock()
+	defer s.tierMux.RUnlock()
+	for _, r := range s.tiered {
+		size += r.size
+	}
+	return len(s.tiered), size
+}
+
+// ColdExtents returns the extents neither written nor read since before, the
+// oldest first. The reads before the store was loaded are known by the access
+// time of the files, which a file system mounted with noatime doesn't keep.
+func (s *ExtentStore) ColdExtents(before time.Time) (extents []uint64) {
+	extentInfoSlice, _ := s.GetAllWatermark(func(info *FileInfo) bool {
+		return !info.Deleted && info.Size > 0 && info.FileId > BlobFileFileCount && info.ModTime.Before(before) &&
+			atomic.LoadInt64(&info.readTime) < before.Unix()
+	})
+	sort.Slice(extentInfoSlice, func(i, j int) bool {
+		return atomic.LoadInt64(&extentInfoSlice[i].readTime) < atomic.LoadInt64(&extentInfoSlice[j].readTime)
+	})
+	extents = make([]uint64, 0, len(extentInfoSlice))
+	for _, extentInfo := range extentInfoSlice {
+		if extentId := uint64(extentInfo.FileId); !s.IsTiered(extentId) {
+			extents = append(extents, extentId)
+		}
+	}
+	return
+}
+
+// TierExtent puts the data of the extent to the cold tier and releases its
+// disk space, ErrorAgain is returned if the extent is written meanwhile.
+func (s *ExtentStore) TierExtent(extentId uint64) (err error) {
+	defer s.lockTierOp(extentId)()
+	s.tierMux.RLock()
+	tier := s.coldTier
+	_, tiered := s.tiered[extentId]
+	s.tierMux.RUnlock()
+	if tier == nil {
+		return ErrorNoColdTier
+	}
+	if tiered {
+		return
+	}
+	if s.EncryptionKeyId() != "" {
+		return fmt.Errorf("extent %v of encrypted store not tiered", extentId)
+	}
+	s.extentInfoMux.RLock()
+	extentInfo, has := s.extentInfoMap[extentId]
+	s.extentInfoMux.RUnlock()
+	if !has {
+		return fmt.Errorf("extent %v not exist", extentId)
+	}
+	extent, err := s.getExtent(extentId)
+	if err != nil {
+		return
+	}
+	if extent.IsMarkDelete() {
+		return ErrorHasDelete
+	}
+	if err = extent.Flush(); err != nil {
+		return
+	}
+	modTime := extent.ModTime()
+	record := &tierRecord{size: uint64(extent.Size()), crc: extent.HeaderChecksum()}
+	key := record.key(extentId)
+	if err = tier.Ref(key); err != nil {
+		return fmt.Errorf("ref extent %v in cold tier: %v", extentId, err)
+	}
+	defer func() {
+		if err != nil {
+			s.unrefTiered(tier, extentId, record)
+		}
+	}()
+	if !tier.Exist(key, int64(record.size)) {
+		var fp *os.File
+		if fp, err = os.Open(path.Join(s.dataDir, fmt.Sprint(extentId))); err != nil {
+			return
+		}
+		err = tier.Put(key, io.NewSectionReader(fp, util.BlockHeaderSize, int64(record.size)), int64(record.size))
+		fp.Close()
+		if err != nil {
+			return fmt.Errorf("put extent %v to cold tier: %v", extentId, err)
+		}
+	}
+	s.tierMux.Lock()
+	s.tiered[extentId] = record
+	if err = s.persistExtentTier(); err != nil {
+		delete(s.tiered, extentId)
+		s.tierMux.Unlock()
+		return
+	}
+	s.tierMux.Unlock()
+	if err = extent.ReleaseData(modTime); err != nil {
+		s.tierMux.Lock()
+		delete(s.tiered, extentId)
+		s.persistExtentTier()
+		s.tierMux.Unlock()
+		return
+	}
+	s.updateUsedSize(extentInfo, extent)
+	return
+}
+
+// RecallExtent writes the data of the tiered extent back to the local disk and
+// drops the reference to its object, the other replicas may still hold theirs.
+func (s *ExtentStore) RecallExtent(extentId uint64) (err error) {
+	defer s.lockTierOp(extentId)()
+	s.tierMux.RLock()
+	tier := s.coldTier
+	record, tiered := s.tiered[extentId]
+	s.tierMux.RUnlock()
+	if !tiered {
+		return
+	}
+	if tier == nil {
+		return ErrorNoColdTier
+	}
+	extent, err := s.getExtent(extentId)
+	if err != nil {
+		return
+	}
+	var data io.ReadCloser
+	if data, err = tier.Get(record.key(extentId)); err != nil {
+		return fmt.Errorf("get extent %v from cold tier: %v", extentId, err)
+	}
+	err = extent.RestoreData(data)
+	data.Close()
+	if err != nil {
+		return fmt.Errorf("restore extent %v: %v", extentId, err)
+	}
+	s.tierMux.Lock()
+	delete(s.tiered, extentId)
+	err = s.persistExtentTier()
+	s.tierMux.Unlock()
+	s.extentInfoMux.RLock()
+	extentInfo, has := s.extentInfoMap[extentId]
+	s.extentInfoMux.RUnlock()
+	if has {
+		s.updateUsedSize(extentInfo, extent)
+	}
+	// the record is dropped first, a crash before leaves the object only
+	if err == nil {
+		s.unrefTiered(tier, extentId, record)
+	}
+	return
+}
+
+// RecallExtents recalls the data of all the tiered extents.
+func (s *ExtentStore) RecallExtents() (err error) {
+	s.tierMux.RLock()
+	extents := make([]uint64, 0, len(s.tiered))
+	for extentId := range s.tiered {
+		extents = append(extents, extentId)
+	}
+	s.tierMux.RUnlock()
+	for _, extentId := range extents {
+		if !s.IsExistExtent(extentId) {
+			continue
+		}
+		if err = s.RecallExtent(extentId); err != nil {
+			return
+		}
+	}
+	return
+}
+
+/*read the range of the released extent from the cold tier, the extent is recalled in background if set*/
+func (s *ExtentStore) readTiered(extent Extent, offset, size int64, nbuf []byte) (crc uint32, err error) {
+	extentId := extent.ID()
+	s.tierMux.Lock()
+	tier := s.coldTier
+	record, tiered := s.tiered[extentId]
+	recall := s.recallOnRead && !s.recalling[extentId]
+	if recall {
+		s.recalling[extentId] = true
+	}
+	s.tierMux.Unlock()
+	if !tiered {
+		return 0, ErrorExtentTiered
+	}
+	if tier == nil {
+		return 0, ErrorNoColdTier
+	}
+	if recall {
+		go func() {
+			s.RecallExtent(extentId)
+			s.tierMux.Lock()
+			delete(s.recalling, extentId)
+			s.tierMux.Unlock()
+		}()
+	}
+	return extent.ReadFrom(&tierReader{tier: tier, key: record.key(extentId)}, nbuf, offset, size)
+}
+
+/*drop the reference to the object of the extent flushed from the disk, the caller has to retry if err*/
+func (s *ExtentStore) deleteTiered(extentId uint64) (err error) {
+	defer s.lockTierOp(extentId)()
+	s.tierMux.RLock()
+	tier := s.coldTier
+	record, tiered := s.tiered[extentId]
+	s.tierMux.RUnlock()
+	if !tiered {
+		return
+	}
+	if tier != nil {
+		if err = tier.Unref(record.key(extentId)); err != nil {
+			return
+		}
+	}
+	s.tierMux.Lock()
+	defer s.tierMux.Unlock()
+	delete(s.tiered, extentId)
+	return s.persistExtentTier()
+}
+
+/*drop the record of the overwritten extent and its reference to the object*/
+func (s *ExtentStore) dropTiered(extentId uint64) (err error) {
+	defer s.lockTierOp(extentId)()
+	s.tierMux.Lock()
+	tier := s.coldTier
+	record, tiered := s.tiered[extentId]
+	if !tiered {
+		s.tierMux.Unlock()
+		return
+	}
+	delete(s.tiered, extentId)
+	err = s.persistExtentTier()
+	s.tierMux.Unlock()
+	if err == nil {
+		s.unrefTiered(tier, extentId, record)
+	}
+	return
+}
+
+// ReleaseData punches the data of the extent moved to the cold tier, the
+// header is kept. ErrorAgain is returned if the extent was modified after
+// modTime, the data is read by ReadFrom until RestoreData.
+func (e *fsExtent) ReleaseData(modTime time.Time) (err error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.released {
+		return
+	}
+	if !e.modifyTime.Equal(modTime) {
+		return ErrorAgain
+	}
+	if e.dataSize > 0 {
+		if err = e.io.Fallocate(e.file, FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE, util.BlockHeaderSize, e.dataSize); err != nil {
+			return
+		}
+	}
+	// the stable and cold extents are found by the modify time
+	if err = os.Chtimes(e.filePath, time.Now(), e.modifyTime); err != nil {
+		return
+	}
+	e.released = true
+	return
+}
+
+// ReadFrom reads the data of a released extent from src, which holds the
+// data without header, and verifies it against the block crcs.
+func (e *fsExtent) ReadFrom(src io.ReaderAt, data []byte, offset, size int64) (crc uint32, err error) {
+	if err = e.checkOffsetAndSize(offset, size); err != nil {
+		return
+	}
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	if offset+size > e.dataSize {
+		return 0, io.EOF
+	}
+	// the blocks covering the range are read whole to be verified
+	blockStart := offset / util.BlockSize * util.BlockSize
+	blockEnd := (offset+size-1)/util.BlockSize*util.BlockSize + util.BlockSize
+	if blockEnd > e.dataSize {
+		blockEnd = e.dataSize
+	}
+	blocks := buf.Buffers.Alloc(int(blockEnd - blockStart))
+	defer buf.Buffers.Free(blocks)
+	var n int
+	if n, err = src.ReadAt(blocks, blockStart); n < len(blocks) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	err = nil
+	for off := int64(0); off < int64(len(blocks)); off += util.BlockSize {
+		end := off + util.BlockSize
+		if end > int64(len(blocks)) {
+			end = int64(len(blocks))
+		}
+		if crc32.ChecksumIEEE(blocks[off:end]) != e.getBlockCrc(int((blockStart+off)/util.BlockSize)) {
+			return 0, ErrorBlockCrcMismatch
+		}
+	}
+	copy(data[:size], blocks[offset-blockStart:])
+	if offset%util.BlockSize == 0 && size == util.BlockSize {
+		return e.getBlockCrc(int(offset / util.BlockSize)), nil
+	}
+	return crc32.ChecksumIEEE(data[:size]), nil
+}
+
+// RestoreData writes back the data of a released extent read from src.
+func (e *fsExtent) RestoreData(src io.Reader) (err error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if !e.released {
+		return
+	}
+	block := buf.Buffers.Alloc(util.BlockSize)
+	defer buf.Buffers.Free(block)
+	for offset := int64(0); offset < e.dataSize; offset += util.BlockSize {
+		size := e.dataSize - offset
+		if size > util.BlockSize {
+			size = util.BlockSize
+		}
+		if _, err = io.ReadFull(src, block[:size]); err != nil {
+			return
+		}
+		if crc32.ChecksumIEEE(block[:size]) != e.getBlockCrc(int(offset/util.BlockSize)) {
+			return ErrorBlockCrcMismatch
+		}
+		if _, err = e.io.WriteAt(e.file, block[:size], offset+util.BlockHeaderSize); err != nil {
+			return
+		}
+	}
+	if err = e.io.Fsync(e.file); err != nil {
+		return
+	}
+	if err = os.Chtimes(e.filePath, time.Now(), e.modifyTime); err != nil {
+		return
+	}
+	e.released = false
+	return
+}
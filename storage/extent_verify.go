@@ -0,0 +1,261 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+// VerifyExtents checks the tail of every extent of this store against its
+// stored block crc, the headers were read when the extents were loaded. The
+// corrupt blocks at the end of an extent are the writes torn by a crash, they
+// are verified backward from the last block until one matches its crc. The
+// tail from the first of them is moved into quarantine directory and the extent
+// is shrunk to the verified size, so the normal extent repair will fetch the
+// quarantined range from other replicas. The blocks before the tail are read by
+// the scrub of the disk, which marks the corrupt ones for RepairBlock.
+func (s *ExtentStore) VerifyExtents() (ranges []*proto.QuarantinedRange, err error) {
+	var (
+		extentInfoSlice []*FileInfo
+		extent          Extent
+		corrupt         []int64
+	)
+	ranges = make([]*proto.QuarantinedRange, 0)
+	if extentInfoSlice, err = s.GetAllWatermark(nil); err != nil {
+		return
+	}
+	for _, extentInfo := range extentInfoSlice {
+		if extentInfo.Deleted || extentInfo.Size == 0 {
+			continue
+		}
+		extentId := uint64(extentInfo.FileId)
+		if extent, err = s.getExtent(extentId); err != nil {
+			return
+		}
+		size := extent.Size()
+		validSize := size
+		for validSize > 0 {
+			lastBlock := (validSize - 1) / util.BlockSize * util.BlockSize
+			if corrupt, err = extent.VerifyBlocks(lastBlock, validSize-lastBlock); err != nil {
+				return
+			}
+			if len(corrupt) == 0 {
+				break
+			}
+			validSize = lastBlock
+		}
+		if validSize == size {
+			continue
+		}
+		qr := &proto.QuarantinedRange{
+			FileId: extentId,
+			Start:  uint64(validSize),
+			End:    uint64(size),
+			Reason: fmt.Sprintf("extent size(%v) mismatch with block crc", size),
+		}
+		if err = s.quarantineExtent(extent, validSize); err != nil {
+			return
+		}
+		extentInfo.FromExtent(extent)
+		s.updateUsedSize(extentInfo, extent)
+		s.quarantineMux.Lock()
+		s.quarantined[extentId] = qr
+		s.quarantineMux.Unlock()
+		ranges = append(ranges, qr)
+	}
+	return
+}
+
+/*mark the block of the extent mismatching its crc until it is repaired*/
+func (s *ExtentStore) markCorruptBlock(extent Extent, blockNo int64, reason string) (qr *proto.QuarantinedRange) {
+	extentId := extent.ID()
+	end := (blockNo + 1) * util.BlockSize
+	if size := extent.Size(); end > size {
+		end = size
+	}
+	qr = &proto.QuarantinedRange{
+		FileId: extentId,
+		Start:  uint64(blockNo * util.BlockSize),
+		End:    uint64(end),
+		Reason: reason,
+	}
+	s.quarantineMux.Lock()
+	defer s.quarantineMux.Unlock()
+	blocks, ok := s.corruptBlocks[extentId]
+	if !ok {
+		blocks = make(map[int64]*proto.QuarantinedRange)
+		s.corruptBlocks[extentId] = blocks
+	}
+	blocks[blockNo] = qr
+	return
+}
+
+// GetCorruptBlocks returns the blocks of the extents mismatching their crc
+// which have not been repaired yet, one range each.
+func (s *ExtentStore) GetCorruptBlocks() (ranges []*proto.QuarantinedRange) {
+	ranges = make([]*proto.QuarantinedRange, 0)
+	s.quarantineMux.RLock()
+	defer s.quarantineMux.RUnlock()
+	for _, blocks := range s.corruptBlocks {
+		for _, qr := range blocks {
+			ranges = append(ranges, qr)
+		}
+	}
+	return
+}
+
+// RepairBlock writes in place the data of a corrupt block fetched from another
+// replica, the data must match crc and cover the block up to the extent size.
+func (s *ExtentStore) RepairBlock(extentId uint64, offset int64, data []byte, crc uint32) (err error) {
+	if offset%util.BlockSize != 0 {
+		return NewParamMismatchErr(fmt.Sprintf("offset=%v", offset))
+	}
+	blockNo := offset / util.BlockSize
+	s.quarantineMux.RLock()
+	qr, ok := s.corruptBlocks[extentId][blockNo]
+	s.quarantineMux.RUnlock()
+	if !ok {
+		return
+	}
+	if int64(len(data)) != int64(qr.End-qr.Start) || crc32.ChecksumIEEE(data) != crc {
+		return ErrorBlockCrcMismatch
+	}
+	if err = s.Write(extentId, offset, int64(len(data)), data, crc); err != nil {
+		return
+	}
+	s.quarantineMux.Lock()
+	if blocks, ok := s.corruptBlocks[extentId]; ok {
+		delete(blocks, blockNo)
+		if len(blocks) == 0 {
+			delete(s.corruptBlocks, extentId)
+		}
+	}
+	s.quarantineMux.Unlock()
+	return
+}
+
+func (s *ExtentStore) quarantineExtent(extent Extent, validSize int64) (err error) {
+	var (
+		src *os.File
+		dst *os.File
+	)
+	quarantineDir := path.Join(s.dataDir, QuarantineDirName)
+	if err = CheckAndCreateSubdir(quarantineDir); err != nil {
+		return
+	}
+	extentName := strconv.FormatUint(extent.ID(), 10)
+	if src, err = os.Open(path.Join(s.dataDir, extentName)); err != nil {
+		return
+	}
+	defer src.Close()
+	dstName := path.Join(quarantineDir, fmt.Sprintf("%v_%v", extentName, validSize))
+	if dst, err = os.OpenFile(dstName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666); err != nil {
+		return
+	}
+	defer dst.Close()
+	if _, err = src.Seek(validSize+util.BlockHeaderSize, io.SeekStart); err != nil {
+		return
+	}
+	if _, err = io.Copy(dst, src); err != nil {
+		return
+	}
+	if err = dst.Sync(); err != nil {
+		return
+	}
+	return extent.Truncate(validSize)
+}
+
+// markCorruptRead marks the blocks of the range read at offset mismatching
+// their crc, the extent keeps its size and the other blocks stay readable. The
+// blocks are fetched from other replicas by the next extent repair.
+func (s *ExtentStore) markCorruptRead(extent Extent, offset, size int64) {
+	corrupt, err := extent.VerifyBlocks(offset, size)
+	if err != nil {
+		log.LogErrorf("action[markCorruptRead] extent(%v) offset(%v) size(%v) err(%v).", extent.ID(), offset, size, err)
+		return
+	}
+	for _, blockNo := range corrupt {
+		s.markCorruptBlock(extent, blockNo, fmt.Sprintf("block crc mismatch on read at offset(%v)", offset))
+	}
+}
+
+// BlockCrcs returns the crcs of the blocks of the extent from the block of offset.
+func (s *ExtentStore) BlockCrcs(extentId uint64, offset int64) (crcs []uint32, err error) {
+	var extent Extent
+	if extent, err = s.getExtent(extentId); err != nil {
+		return
+	}
+	return extent.BlockCrcs(offset), nil
+}
+
+// ReadQuarantined reads the data at offset of the extent from the tail
+// quarantined when the extent was shrunk to validSize, so the repair takes
+// the blocks of the tail still matching the other replicas from the local disk.
+// The tail of an encrypted extent is sealed, ErrorFileNotFound is returned for it
+// like for an extent never quarantined at validSize.
+func (s *ExtentStore) ReadQuarantined(extentId uint64, validSize, offset int64, data []byte) (n int, err error) {
+	if s.crypt != nil && s.crypt.encrypted() || offset < validSize {
+		return 0, ErrorFileNotFound
+	}
+	name := path.Join(s.dataDir, QuarantineDirName, fmt.Sprintf("%v_%v", extentId, validSize))
+	var file *os.File
+	if file, err = os.Open(name); err != nil {
+		if os.IsNotExist(err) {
+			err = ErrorFileNotFound
+		}
+		return
+	}
+	defer file.Close()
+	if n, err = file.ReadAt(data, offset-validSize); err == io.EOF {
+		err = nil
+	}
+	return
+}
+
+// GetQuarantined returns quarantined ranges which have not been repaired yet.
+func (s *ExtentStore) GetQuarantined() (ranges []*proto.QuarantinedRange) {
+	ranges = make([]*proto.QuarantinedRange, 0)
+	s.quarantineMux.Lock()
+	defer s.quarantineMux.Unlock()
+	for extentId, qr := range s.quarantined {
+		s.extentInfoMux.RLock()
+		extentInfo, has := s.extentInfoMap[extentId]
+		s.extentInfoMux.RUnlock()
+		if !has || extentInfo.Size >= qr.End {
+			delete(s.quarantined, extentId)
+			continue
+		}
+		ranges = append(ranges, qr)
+	}
+	for extentId, blocks := range s.corruptBlocks {
+		if !s.IsExistExtent(extentId) {
+			delete(s.corruptBlocks, extentId)
+			continue
+		}
+		for _, qr := range blocks {
+			ranges = append(ranges, qr)
+		}
+	}
+	return
+}
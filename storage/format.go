@@ -0,0 +1,225 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	FormatFileName   = "FORMAT"
+	FormatRecordSize = 8 //format kind and its version
+)
+
+// The kinds of the files a data partition keeps on disk.
+type FormatKind uint32
+
+const (
+	FormatExtent FormatKind = iota + 1 //extent files and EXTENT_META
+	FormatBlob                         //blob files
+	FormatIndex                        //needle indexes of the blob files
+)
+
+func (k FormatKind) String() string {
+	switch k {
+	case FormatExtent:
+		return "extent"
+	case FormatBlob:
+		return "blob"
+	case FormatIndex:
+		return "index"
+	}
+	return fmt.Sprintf("FormatKind(%d)", uint32(k))
+}
+
+// LegacyFormatVersion is the version of the files written before FORMAT existed.
+const LegacyFormatVersion = 1
+
+// the versions written by this build, a store refuses to load a newer one
+var currentFormatVersions = map[FormatKind]uint32{
+	FormatExtent: 1,
+	FormatBlob:   1,
+	FormatIndex:  2,
+}
+
+// The versions of the files of a partition are kept in FORMAT of the partition
+// dir shared by the extent store and the blob store, neither the extent header
+// nor the index record has room for one. A kind missing from the file is at
+// LegacyFormatVersion if the store has files of the kind, at the current version
+// otherwise. A store upgrades its kinds at loading by the registered migrations,
+// one version at a time, and persists the version after each of them, so an
+// upgrade interrupted by a crash restarts from the last finished step. The
+// migrations are done before the store is loaded, a store only ever serves the
+// files of the current versions, whose version is then the one of the dir.
+
+// Migration upgrades the files of Kind in the partition dir from version From to From+1.
+// Upgrade may find the files it upgraded already if the node crashed before the
+// version was persisted.
+type Migration struct {
+	Kind    FormatKind
+	From    uint32
+	Upgrade func(dataDir string) error
+}
+
+var (
+	migrations   = make(map[FormatKind][]*Migration)
+	migrationMux sync.Mutex
+	formatMux    sync.Mutex
+)
+
+// RegisterMigration adds the upgrade of a format, usually in the init of the file changing it.
+func RegisterMigration(m *Migration) {
+	migrationMux.Lock()
+	defer migrationMux.Unlock()
+	for _, registered := range migrations[m.Kind] {
+		if registered.From == m.From {
+			panic(fmt.Sprintf("migration of %v from version %v registered twice", m.Kind, m.From))
+		}
+	}
+	migrations[m.Kind] = append(migrations[m.Kind], m)
+	sort.Slice(migrations[m.Kind], func(i, j int) bool {
+		return migrations[m.Kind][i].From < migrations[m.Kind][j].From
+	})
+}
+
+func getMigration(kind FormatKind, from uint32) *Migration {
+	migrationMux.Lock()
+	defer migrationMux.Unlock()
+	for _, m := range migrations[kind] {
+		if m.From == from {
+			return m
+		}
+	}
+	return nil
+}
+
+// LoadFormatVersions returns the versions recorded in FORMAT of the partition dir.
+func LoadFormatVersions(dataDir string) (versions map[FormatKind]uint32, err error) {
+	formatMux.Lock()
+	defer formatMux.Unlock()
+	return loadFormatVersions(dataDir)
+}
+
+func loadFormatVersions(dataDir string) (versions map[FormatKind]uint32, err error) {
+	var data []byte
+	versions = make(map[FormatKind]uint32)
+	if data, err = ioutil.ReadFile(path.Join(dataDir, FormatFileName)); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	for off := 0; off+FormatRecordSize <= len(data); off += FormatRecordSize {
+		kind := FormatKind(binary.BigEndian.Uint32(data[off : off+4]))
+		versions[kind] = binary.BigEndian.Uint32(data[off+4 : off+FormatRecordSize])
+	}
+	return
+}
+
+/*rewrite FORMAT with version of kind, the other kinds of the file are kept*/
+func persistFormatVersion(dataDir string, kind FormatKind, version uint32) (err error) {
+	formatMux.Lock()
+	defer formatMux.Unlock()
+	var versions map[FormatKind]uint32
+	if versions, err = loadFormatVersions(dataDir); err != nil {
+		return
+	}
+	versions[kind] = version
+	kinds := make([]int, 0, len(versions))
+	for k := range versions {
+		kinds = append(kinds, int(k))
+	}
+	sort.Ints(kinds)
+	data := make([]byte, 0, len(kinds)*FormatRecordSize)
+	record := make([]byte, FormatRecordSize)
+	for _, k := range kinds {
+		binary.BigEndian.PutUint32(record[:4], uint32(k))
+		binary.BigEndian.PutUint32(record[4:], versions[FormatKind(k)])
+		data = append(data, record...)
+	}
+	name := path.Join(dataDir, FormatFileName)
+	tmpName := name + ".tmp"
+	var fp *os.File
+	if fp, err = os.OpenFile(tmpName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666); err != nil {
+		return
+	}
+	if _, err = fp.Write(data); err == nil {
+		err = fp.Sync()
+	}
+	fp.Close()
+	if err != nil {
+		os.Remove(tmpName)
+		return
+	}
+	return os.Rename(tmpName, name)
+}
+
+// initFormat brings the kinds of a store to the current versions before it is
+// loaded, legacy tells if the store has files of the kind written before FORMAT
+// existed. A failed migration fails the loading and is retried by the next one.
+func initFormat(dataDir string, legacy bool, kinds ...FormatKind) (err error) {
+	var versions map[FormatKind]uint32
+	if versions, err = LoadFormatVersions(dataDir); err != nil {
+		return
+	}
+	for _, kind := range kinds {
+		version, ok := versions[kind]
+		if !ok {
+			version = currentFormatVersions[kind]
+			if legacy {
+				version = LegacyFormatVersion
+			}
+			if err = persistFormatVersion(dataDir, kind, version); err != nil {
+				return
+			}
+		}
+		if version > currentFormatVersions[kind] {
+			err = fmt.Errorf("%v format version %v of %v is newer than %v", kind, version, dataDir,
+				currentFormatVersions[kind])
+			return
+		}
+		for ; version < currentFormatVersions[kind]; version++ {
+			m := getMigration(kind, version)
+			if m == nil {
+				err = fmt.Errorf("no migration of %v format from version %v", kind, version)
+				return
+			}
+			if err = upgradeFormat(dataDir, m); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+/*run a migration and persist the version it upgrades to*/
+func upgradeFormat(dataDir string, m *Migration) (err error) {
+	if err = m.Upgrade(dataDir); err != nil {
+		return fmt.Errorf("upgrade %v format of %v from version %v: %v", m.Kind, dataDir, m.From, err)
+	}
+	if err = persistFormatVersion(dataDir, m.Kind, m.From+1); err != nil {
+		return
+	}
+	log.LogInfof("action[upgradeFormat] %v format of %v upgraded to version %v", m.Kind, dataDir, m.From+1)
+	return
+}
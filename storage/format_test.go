@@ -0,0 +1,100 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFormat_Init(t *testing.T) {
+	dir, err := ioutil.TempDir("", "format")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = initFormat(dir, false, FormatExtent); err != nil {
+		t.Fatal(err)
+	}
+	if err = initFormat(dir, true, FormatBlob, FormatIndex); err != nil {
+		t.Fatal(err)
+	}
+	versions, err := LoadFormatVersions(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kind := range []FormatKind{FormatExtent, FormatBlob, FormatIndex} {
+		if versions[kind] != currentFormatVersions[kind] {
+			t.Fatalf("%v version act[%v] exp[%v]", kind, versions[kind], currentFormatVersions[kind])
+		}
+	}
+
+	if err = persistFormatVersion(dir, FormatIndex, currentFormatVersions[FormatIndex]+1); err != nil {
+		t.Fatal(err)
+	}
+	if err = initFormat(dir, true, FormatBlob, FormatIndex); err == nil {
+		t.Fatalf("newer index format loaded")
+	}
+}
+
+func TestFormat_Migrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "format")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	const kind = FormatKind(100)
+	currentFormatVersions[kind] = 3
+	defer delete(currentFormatVersions, kind)
+	defer delete(migrations, kind)
+
+	upgraded := make([]uint32, 0)
+	fail := errors.New("fail")
+	failAt := uint32(2)
+	upgrade := func(from uint32) func(string) error {
+		return func(string) error {
+			if from == failAt {
+				return fail
+			}
+			upgraded = append(upgraded, from)
+			return nil
+		}
+	}
+	RegisterMigration(&Migration{Kind: kind, From: 2, Upgrade: upgrade(2)})
+	RegisterMigration(&Migration{Kind: kind, From: 1, Upgrade: upgrade(1)})
+
+	// the store is not loaded until all its migrations are done
+	if err = initFormat(dir, true, kind); err == nil {
+		t.Fatalf("loaded with a failed migration")
+	}
+	if len(upgraded) != 1 || upgraded[0] != 1 {
+		t.Fatalf("upgraded[%v]", upgraded)
+	}
+	versions, _ := LoadFormatVersions(dir)
+	if versions[kind] != 2 {
+		t.Fatalf("failed migration persisted version[%v]", versions[kind])
+	}
+
+	failAt = 0
+	if err = initFormat(dir, true, kind); err != nil {
+		t.Fatal(err)
+	}
+	versions, _ = LoadFormatVersions(dir)
+	if versions[kind] != 3 || len(upgraded) != 2 || upgraded[1] != 2 {
+		t.Fatalf("version[%v] upgraded[%v]", versions[kind], upgraded)
+	}
+}
@@ -35,8 +35,9 @@ const (
 type Object struct {
 	Oid    uint64
 	Offset uint64
-	Size   uint32
-	Crc    uint32
+	Size   uint32 //bytes stored in the blob file
+	Crc    uint32 //crc of the raw bytes
+	Codec  uint8
 }
 
 func (o Object) Less(than btree.Item) bool {
@@ -47,7 +48,11 @@ func (o Object) Less(than btree.Item) bool {
 func (o *Object) Marshal(out []byte) {
 	binary.BigEndian.PutUint64(out[0:8], o.Oid)
 	binary.BigEndian.PutUint64(out[8:16], o.Offset)
-	binary.BigEndian.PutUint32(out[16:20], o.Size)
+	size := o.Size
+	if size != MarkDeleteObject {
+		size |= uint32(o.Codec) << ObjectCodecShift
+	}
+	binary.BigEndian.PutUint32(out[16:20], size)
 	binary.BigEndian.PutUint32(out[20:ObjectHeaderSize], o.Crc)
 }
 
@@ -55,6 +60,11 @@ func (o *Object) Unmarshal(in []byte) {
 	o.Oid = binary.BigEndian.Uint64(in[0:8])
 	o.Offset = binary.BigEndian.Uint64(in[8:16])
 	o.Size = binary.BigEndian.Uint32(in[16:20])
+	o.Codec = CodecNone
+	if o.Size != MarkDeleteObject {
+		o.Codec = uint8(o.Size >> ObjectCodecShift)
+		o.Size &= MaxObjectSize
+	}
 	o.Crc = binary.BigEndian.Uint32(in[20:ObjectHeaderSize])
 	return
 }
@@ -89,8 +99,8 @@ func NewObjectTree(f *os.File) *ObjectTree {
 // guarantee there is no write and delete operations on this needle map
 func (tree *ObjectTree) Load() (maxOid uint64, err error) {
 	f := tree.idxFile
-	maxOid, err = LoopIndexFile(f, func(oid, offset uint64, size, crc uint32) error {
-		o := Object{Oid: oid, Offset: offset, Size: size, Crc: crc}
+	maxOid, err = loopIndexObjects(f, func(o Object) error {
+		oid, size := o.Oid, o.Size
 		if oid > 0 && size != MarkDeleteObject {
 			tree.idxLock.Lock()
 			found := tree.tree.ReplaceOrInsert(o)
@@ -121,6 +131,12 @@ func (o *Object) Check(offset uint64, size, crc uint32) bool {
 }
 
 func LoopIndexFile(f *os.File, fn func(oid, offset uint64, size, crc uint32) error) (maxOid uint64, err error) {
+	return loopIndexObjects(f, func(o Object) error {
+		return fn(o.Oid, o.Offset, o.Size, o.Crc)
+	})
+}
+
+func loopIndexObjects(f *os.File, fn func(o Object) error) (maxOid uint64, err error) {
 	var (
 		readOff int64
 		count   int
@@ -138,7 +154,7 @@ func LoopIndexFile(f *os.File, fn func(oid, offset uint64, size, crc uint32) err
 			if maxOid < o.Oid {
 				maxOid = o.Oid
 			}
-			if e := fn(o.Oid, o.Offset, o.Size, o.Crc); e != nil {
+			if e := fn(*o); e != nil {
 				return maxOid, e
 			}
 		}
@@ -155,12 +171,13 @@ func LoopIndexFile(f *os.File, fn func(oid, offset uint64, size, crc uint32) err
 	return maxOid, err
 }
 
-func (tree *ObjectTree) set(oid, offset uint64, size, crc uint32) (oldOff uint64, oldSize uint32, err error) {
+func (tree *ObjectTree) set(oid, offset uint64, size, crc uint32, codec uint8) (oldOff uint64, oldSize uint32, err error) {
 	o := &Object{
 		Oid:    oid,
 		Offset: offset,
 		Size:   size,
 		Crc:    crc,
+		Codec:  codec,
 	}
 
 	tree.idxLock.Lock()
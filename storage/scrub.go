@@ -0,0 +1,120 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"hash/crc32"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util"
+	"github.com/tiglabs/containerfs/util/buf"
+)
+
+// ScrubExtent reads the whole extent block by block, the blocks mismatching
+// their crc are marked by Read and the scrub goes on with the next block,
+// ErrorBlockCrcMismatch is returned once the extent is read. A tiered extent is not read. The wait is called with the bytes of each block before it is read,
+// so the caller can limit the bandwidth.
+func (s *ExtentStore) ScrubExtent(extentId uint64, wait func(n int)) (err error) {
+	var (
+		extent  Extent
+		data    []byte
+		corrupt bool
+	)
+	if s.IsTiered(extentId) {
+		return
+	}
+	if extent, err = s.getExtent(extentId); err != nil {
+		return
+	}
+	if data, err = buf.Buffers.Get(util.BlockSize); err != nil {
+		data = make([]byte, util.BlockSize)
+	}
+	defer buf.Buffers.Put(data)
+	size := extent.Size()
+	for offset := int64(0); offset < size; offset += util.BlockSize {
+		readSize := size - offset
+		if readSize > util.BlockSize {
+			readSize = util.BlockSize
+		}
+		wait(int(readSize))
+		if _, err = s.read(extentId, offset, readSize, data, false); err == ErrorBlockCrcMismatch {
+			corrupt = true
+		} else if err != nil {
+			return
+		}
+	}
+	if corrupt {
+		err = ErrorBlockCrcMismatch
+	}
+	return
+}
+
+// ScrubBlobFile verifies every object of the blob file against its crc. The
+// corrupt objects are returned one range each, they are not quarantined since
+// blob repair only fetches the objects after the last one. The wait is called
+// with the bytes of each object before it is read.
+func (s *BlobStore) ScrubBlobFile(blobfileId int, wait func(n int)) (ranges []*proto.QuarantinedRange, err error) {
+	ranges = make([]*proto.QuarantinedRange, 0)
+	c, ok := s.blobfiles[blobfileId]
+	if !ok {
+		return nil, ErrorFileNotFound
+	}
+	var (
+		data []byte
+		crc  uint32
+	)
+	lastOid := c.loadLastOid()
+	for oid := uint64(1); oid <= lastOid; oid++ {
+		o, exist := c.tree.get(oid)
+		if !exist || o.Size == MarkDeleteObject {
+			continue
+		}
+		if int(o.Size) > len(data) {
+			data = make([]byte, o.Size)
+		}
+		wait(int(o.Size))
+		if crc, err = s.ReadStored(uint32(blobfileId), int64(oid), int64(o.Size), data); err != nil {
+			if err == ErrorObjNotFound || err == ErrorParamMismatch {
+				// deleted or compacted since got
+				err = nil
+				continue
+			}
+			return
+		}
+		raw, decodeErr := s.DecodeObject(uint32(blobfileId), oid, o.Codec, data[:o.Size])
+		if decodeErr == ErrKeyUnavailable {
+			return ranges, decodeErr
+		}
+		if decodeErr != nil {
+			ranges = append(ranges, &proto.QuarantinedRange{
+				FileId: uint64(blobfileId),
+				Start:  oid,
+				End:    oid,
+				Reason: fmt.Sprintf("object of codec(%v) not decoded: %v", o.Codec, decodeErr),
+			})
+			continue
+		}
+		if actual := crc32.ChecksumIEEE(raw); actual != crc {
+			ranges = append(ranges, &proto.QuarantinedRange{
+				FileId: uint64(blobfileId),
+				Start:  oid,
+				End:    oid,
+				Reason: fmt.Sprintf("object crc(%v) mismatch with data crc(%v)", crc, actual),
+			})
+		}
+	}
+	return
+}
@@ -20,7 +20,10 @@ import (
 
 	"fmt"
 	"io/ioutil"
+	"path"
 	"strconv"
+	"sync"
+	"sync/atomic"
 
 	"github.com/juju/errors"
 	"github.com/tiglabs/containerfs/proto"
@@ -48,6 +51,14 @@ type BlobStore struct {
 	unavailBlobFileCh chan int
 	storeSize         int
 	blobfileSize      int
+	quarantined       map[int]*proto.QuarantinedRange
+	quarantineMux     sync.Mutex
+	compactedBytes    uint64
+	codec             uint32 //codec of the objects written, set by the compression of vol
+	rawBytes          uint64 //bytes of the objects written since loaded
+	storedBytes       uint64 //bytes stored of the objects written since loaded
+	crypt             *storeCipher
+	usedSize          int64 //disk space of the blob files and their indexes, kept up by the writes
 }
 
 func NewBlobStore(dataDir string, storeSize int) (s *BlobStore, err error) {
@@ -56,10 +67,20 @@ func NewBlobStore(dataDir string, storeSize int) (s *BlobStore, err error) {
 	if err = CheckAndCreateSubdir(dataDir); err != nil {
 		return nil, fmt.Errorf("NewBlobStore [%v] err[%v]", dataDir, err)
 	}
+	// the index of the first blob file tells if the blob files were written before
+	_, statErr := os.Stat(path.Join(dataDir, "1.idx"))
+	if err = initFormat(dataDir, statErr == nil, FormatBlob, FormatIndex); err != nil {
+		return nil, fmt.Errorf("NewBlobStore [%v] err[%v]", dataDir, err)
+	}
 	s.blobfiles = make(map[int]*BlobFile)
+	s.quarantined = make(map[int]*proto.QuarantinedRange)
+	if s.crypt, err = loadStoreCipher(dataDir); err != nil {
+		return nil, fmt.Errorf("NewBlobStore [%v] err[%v]", dataDir, err)
+	}
 	if err = s.initBlobFileFile(); err != nil {
 		return nil, fmt.Errorf("NewBlobStore [%v] err[%v]", dataDir, err)
 	}
+	s.ReconcileUsedSize()
 
 	s.availBlobFileCh = make(chan int, BlobFileFileCount+1)
 	s.unavailBlobFileCh = make(chan int, BlobFileFileCount+1)
@@ -82,9 +103,47 @@ func (s *BlobStore) DeleteStore() {
 	os.RemoveAll(s.dataDir)
 }
 
+// UseSize returns the disk space of the blob files and their indexes.
 func (s *BlobStore) UseSize() (size int64) {
-	// TODO: implement this
-	return 0
+	return atomic.LoadInt64(&s.usedSize)
+}
+
+// ReconcileUsedSize recounts the used size from the blob files and returns the
+// drift of the kept one, which counts the bytes appended instead of the blocks.
+func (s *BlobStore) ReconcileUsedSize() (drift int64) {
+	var size int64
+	for _, c := range s.blobfiles {
+		size += c.allocatedSize()
+	}
+	return size - atomic.SwapInt64(&s.usedSize, size)
+}
+
+// ReclaimableSize returns the bytes of dead objects which will be released by compaction.
+func (s *BlobStore) ReclaimableSize() (size int64) {
+	for _, c := range s.blobfiles {
+		size += int64(atomic.LoadUint64(&c.tree.deleteBytes))
+	}
+	return
+}
+
+// CompactedSize returns the bytes of dead objects released by compaction since the store was loaded.
+func (s *BlobStore) CompactedSize() uint64 {
+	return atomic.LoadUint64(&s.compactedBytes)
+}
+
+// SetCodec sets the codec compressing the objects written from now, the objects
+// written before are read with their own codec.
+func (s *BlobStore) SetCodec(codec uint8) {
+	atomic.StoreUint32(&s.codec, uint32(codec))
+}
+
+func (s *BlobStore) Codec() uint8 {
+	return uint8(atomic.LoadUint32(&s.codec))
+}
+
+// CompressedSize returns the raw and the stored bytes of the objects written since the store was loaded.
+func (s *BlobStore) CompressedSize() (raw, stored uint64) {
+	return atomic.LoadUint64(&s.rawBytes), atomic.LoadUint64(&s.storedBytes)
 }
 
 func (s *BlobStore) initBlobFileFile() (err error) {
@@ -125,6 +184,7 @@ func (s *BlobStore) WriteDeleteDentry(objectId uint64, blobfileId int, crc uint3
 	}
 	o := &Object{Oid: objectId, Size: MarkDeleteObject, Offset: uint64(fi.Size()), Crc: crc}
 	if err = c.tree.appendToIdxFile(o); err == nil {
+		atomic.AddInt64(&s.usedSize, ObjectHeaderSize)
 		if c.loadLastOid() < objectId {
 			c.storeLastOid(objectId)
 		}
@@ -133,7 +193,43 @@ func (s *BlobStore) WriteDeleteDentry(objectId uint64, blobfileId int, crc uint3
 	return
 }
 
+// Write compresses the object by the codec of the store and encrypts it if the
+// store is encrypted, crc is the one of the raw data.
 func (s *BlobStore) Write(fileId uint32, objectId uint64, size int64, data []byte, crc uint32) (err error) {
+	var c *DataCipher
+	if c, err = s.crypt.get(); err != nil {
+		return
+	}
+	maxSize := int64(MaxObjectSize)
+	if c != nil {
+		maxSize -= CipherOverhead
+	}
+	if size > maxSize {
+		return NewParamMismatchErr(fmt.Sprintf("object size %v exceeds %v", size, maxSize))
+	}
+	codec := s.Codec()
+	stored := data[:size]
+	storedCodec := CodecNone
+	if codec != CodecNone {
+		if compressed := compressObject(codec, stored); compressed != nil {
+			stored = compressed
+			storedCodec = codec
+		}
+	}
+	if c != nil {
+		if stored, err = c.sealObject(stored, cipherAD(uint64(fileId), objectId)); err != nil {
+			return
+		}
+		storedCodec |= CodecEncrypted
+	}
+	atomic.AddUint64(&s.rawBytes, uint64(size))
+	atomic.AddUint64(&s.storedBytes, uint64(len(stored)))
+	return s.WriteStored(fileId, objectId, int64(len(stored)), stored, storedCodec, crc)
+}
+
+// WriteStored writes the bytes of an object as stored by codec, like the ones
+// read by ReadStored of another replica.
+func (s *BlobStore) WriteStored(fileId uint32, objectId uint64, size int64, data []byte, codec uint8, crc uint32) (err error) {
 	var (
 		fi os.FileInfo
 	)
@@ -163,8 +259,10 @@ func (s *BlobStore) Write(fileId uint32, objectId uint64, size int64, data []byt
 	if _, err = c.file.WriteAt(data[:size], newOffset); err != nil {
 		return
 	}
+	atomic.AddInt64(&s.usedSize, size)
 
-	if _, _, err = c.tree.set(objectId, uint64(newOffset), uint32(size), crc); err == nil {
+	if _, _, err = c.tree.set(objectId, uint64(newOffset), uint32(size), crc, codec); err == nil {
+		atomic.AddInt64(&s.usedSize, ObjectHeaderSize)
 		if c.loadLastOid() < objectId {
 			c.storeLastOid(objectId)
 		}
@@ -172,7 +270,49 @@ func (s *BlobStore) Write(fileId uint32, objectId uint64, size int64, data []byt
 	return
 }
 
+// Read returns the raw bytes of the object, size is the raw size.
 func (s *BlobStore) Read(fileId uint32, offset, size int64, nbuf []byte) (crc uint32, err error) {
+	var (
+		stored []byte
+		data   []byte
+	)
+	o, e := s.GetObject(fileId, uint64(offset))
+	if e != nil || o.Codec == CodecNone {
+		return s.ReadStored(fileId, offset, size, nbuf)
+	}
+	stored = make([]byte, o.Size)
+	if crc, err = s.ReadStored(fileId, offset, int64(o.Size), stored); err != nil {
+		return
+	}
+	if data, err = s.DecodeObject(fileId, o.Oid, o.Codec, stored); err != nil {
+		return
+	}
+	if int64(len(data)) != size {
+		return 0, ErrorParamMismatch
+	}
+	copy(nbuf[:size], data)
+	return
+}
+
+// DecodeObject returns the raw bytes of the object stored by codec.
+func (s *BlobStore) DecodeObject(fileId uint32, objectId uint64, codec uint8, stored []byte) (data []byte, err error) {
+	if codec&CodecEncrypted != 0 {
+		var c *DataCipher
+		if c, err = s.crypt.get(); err != nil {
+			return
+		}
+		if c == nil {
+			return nil, ErrKeyUnavailable
+		}
+		if stored, err = c.openObject(stored, cipherAD(uint64(fileId), objectId)); err != nil {
+			return
+		}
+	}
+	return decompressObject(codec&^CodecEncrypted, stored)
+}
+
+// ReadStored returns the bytes of the object as stored in the blob file, size is the stored size.
+func (s *BlobStore) ReadStored(fileId uint32, offset, size int64, nbuf []byte) (crc uint32, err error) {
 	blobfileId := int(fileId)
 	objectId := uint64(offset)
 	c, ok := s.blobfiles[blobfileId]
@@ -424,6 +564,7 @@ func (s *BlobStore) DoCompactWork(blobfileID int) (err error, released uint64) {
 	if err != nil {
 		return err, 0
 	}
+	atomic.AddUint64(&s.compactedBytes, released)
 
 	return nil, released
 }
@@ -450,6 +591,10 @@ func (s *BlobStore) doCompactAndCommit(blobfileID int) (err error, released uint
 	}
 	defer cc.compactLock.Unlock()
 
+	usedBeforeCompact := cc.allocatedSize()
+	defer func() {
+		atomic.AddInt64(&s.usedSize, cc.allocatedSize()-usedBeforeCompact)
+	}()
 	sizeBeforeCompact := cc.tree.FileBytes()
 	if err = cc.doCompact(); err != nil {
 		return err, 0
@@ -25,6 +25,7 @@ import (
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"syscall"
 
 	"path"
 	"regexp"
@@ -44,6 +45,7 @@ const (
 	ExtMetaDeleteIdxOffset = 8
 	ExtMetaDeleteIdxSize   = 8
 	ExtMetaFileSize        = ExtMetaBaseIdSize + ExtMetaDeleteIdxSize
+	QuarantineDirName      = "quarantine"
 )
 
 var (
@@ -63,7 +65,7 @@ var (
 	GetEmptyExtentFilter = func() ExtentFilter {
 		now := time.Now()
 		return func(info *FileInfo) bool {
-			return now.Unix()-info.ModTime.Unix() > 30*60 && !info.Deleted && info.Size == 0
+			return now.Unix()-info.ModTime.Unix() > 30*60 && !info.Deleted && info.Size == 0 && info.Refs <= 1
 		}
 	}
 )
@@ -80,17 +82,52 @@ type ExtentStore struct {
 	deleteFp      *os.File
 	closeC        chan bool
 	closed        bool
+	quarantined   map[uint64]*proto.QuarantinedRange
+	corruptBlocks map[uint64]map[int64]*proto.QuarantinedRange //blocks mismatching their crc, by extent and block number
+	quarantineMux sync.RWMutex
+	refMux        sync.Mutex
+	refFp         *os.File
+	refRecords    int
+	refShared     int
+	sealed        map[uint64]*sealRecord //nil if the store is not sealed
+	sealCrc       uint32
+	sealMux       sync.RWMutex
+	crypt         *storeCipher
+	usedSize      int64 //disk space of the extent files, kept up by the changes of the extents
+	holeSize      int64 //disk space beyond the data of the extents, released by punching holes
+	deletingSize  int64 //disk space of the extents marked deleted which are not flushed yet
+	io            ExtentIO
+	coldTier      ColdTier
+	recallOnRead  bool
+	tiered        map[uint64]*tierRecord
+	recalling     map[uint64]bool
+	tierOps       map[uint64]*tierOpLock
+	tierMux       sync.RWMutex
 }
 
 func NewExtentStore(dataDir string, storeSize int) (s *ExtentStore, err error) {
+	return NewExtentStoreWithIO(dataDir, storeSize, SyncIO)
+}
+
+// NewExtentStoreWithIO returns the extent store whose extents do the IO by
+// extentIO, usually the one of the disk of dataDir.
+func NewExtentStoreWithIO(dataDir string, storeSize int, extentIO ExtentIO) (s *ExtentStore, err error) {
 	s = new(ExtentStore)
 	s.dataDir = dataDir
+	s.io = extentIO
 	if err = CheckAndCreateSubdir(dataDir); err != nil {
 		return nil, fmt.Errorf("NewExtentStore [%v] err[%v]", dataDir, err)
 	}
+	if s.crypt, err = loadStoreCipher(s.dataDir); err != nil {
+		return nil, fmt.Errorf("NewExtentStore [%v] err[%v]", dataDir, err)
+	}
 
 	// Load EXTENT_META
 	metaFilePath := path.Join(s.dataDir, ExtMetaFileName)
+	_, statErr := os.Stat(metaFilePath)
+	if err = initFormat(s.dataDir, statErr == nil, FormatExtent); err != nil {
+		return nil, fmt.Errorf("NewExtentStore [%v] err[%v]", dataDir, err)
+	}
 	if s.metaFp, err = os.OpenFile(metaFilePath, ExtMetaFileOpt, 0666); err != nil {
 		return
 	}
@@ -104,11 +141,26 @@ func NewExtentStore(dataDir string, storeSize int) (s *ExtentStore, err error) {
 		return
 	}
 	s.extentInfoMap = make(map[uint64]*FileInfo, 40)
+	s.quarantined = make(map[uint64]*proto.QuarantinedRange)
+	s.corruptBlocks = make(map[uint64]map[int64]*proto.QuarantinedRange)
 	s.cache = NewExtentCache(40)
 	if err = s.initBaseFileId(); err != nil {
 		err = fmt.Errorf("init base field ID: %v", err)
 		return
 	}
+	if err = s.loadExtentRefs(); err != nil {
+		err = fmt.Errorf("load extent refs: %v", err)
+		return
+	}
+	if err = s.loadExtentSeal(); err != nil {
+		err = fmt.Errorf("load extent seal: %v", err)
+		return
+	}
+	if err = s.loadExtentTier(); err != nil {
+		err = fmt.Errorf("load extent tier: %v", err)
+		return
+	}
+	atomic.StoreInt64(&s.deletingSize, s.countDeleting())
 	s.storeSize = storeSize
 	s.closeC = make(chan bool, 1)
 	s.closed = false
@@ -159,19 +211,34 @@ func (s *ExtentStore) Create(extentId uint64, inode uint64, overwrite bool) (err
 			return
 		}
 		extent.InitToFS(extentId, true)
+		s.dropTiered(extentId)
 	} else {
-		extent = NewExtentInCore(name, extentId)
+		extent = newExtentInCore(name, extentId, s.crypt, s.io)
 		if err = extent.InitToFS(inode, false); err != nil {
 			return
 		}
 	}
 	s.cache.Put(extent)
 
-	extInfo := &FileInfo{}
+	extInfo := &FileInfo{Refs: 1, readTime: time.Now().Unix()}
 	extInfo.FromExtent(extent)
 	s.extentInfoMux.Lock()
+	oldInfo := s.extentInfoMap[extentId]
+	var oldRefs uint32
+	if oldInfo != nil {
+		extInfo.allocated = atomic.LoadInt64(&oldInfo.allocated)
+		extInfo.hole = atomic.LoadInt64(&oldInfo.hole)
+		oldRefs = oldInfo.Refs
+	}
 	s.extentInfoMap[extentId] = extInfo
 	s.extentInfoMux.Unlock()
+	s.updateUsedSize(extInfo, extent)
+	if oldRefs > 1 {
+		// the overwritten extent starts with a single reference
+		s.refMux.Lock()
+		s.putExtentRefs(extentId, nil, 1)
+		s.refMux.Unlock()
+	}
 
 	s.UpdateBaseExtentId(extentId)
 	return
@@ -201,6 +268,16 @@ func (s *ExtentStore) getExtent(extentId uint64) (e Extent, err error) {
 	return
 }
 
+/*the extent to be written, its data is recalled from the cold tier first*/
+func (s *ExtentStore) getWritableExtent(extentId uint64) (e Extent, err error) {
+	if s.IsTiered(extentId) {
+		if err = s.RecallExtent(extentId); err != nil {
+			return
+		}
+	}
+	return s.getExtent(extentId)
+}
+
 func (s *ExtentStore) IsExistExtent(extentId uint64) (exist bool) {
 	s.extentInfoMux.RLock()
 	defer s.extentInfoMux.RUnlock()
@@ -208,9 +285,18 @@ func (s *ExtentStore) IsExistExtent(extentId uint64) (exist bool) {
 	return
 }
 
+/*the extent is marked deleted and its file is not removed by the flush of the deletes yet*/
+func (s *ExtentStore) IsMarkDeleted(extentId uint64) bool {
+	if s.IsExistExtent(extentId) {
+		return false
+	}
+	_, err := os.Stat(path.Join(s.dataDir, strconv.Itoa(int(extentId))))
+	return err == nil
+}
+
 func (s *ExtentStore) loadExtentFromDisk(extentId uint64) (e Extent, err error) {
 	name := path.Join(s.dataDir, strconv.Itoa(int(extentId)))
-	e = NewExtentInCore(name, extentId)
+	e = newExtentInCore(name, extentId, s.crypt, s.io)
 	if err = e.RestoreFromFS(); err != nil {
 		err = fmt.Errorf("restore from file system: %v", err)
 		return
@@ -248,8 +334,9 @@ func (s *ExtentStore) initBaseFileId() (err error) {
 		if extent, loadErr = s.getExtent(extentId); loadErr != nil {
 			continue
 		}
-		extentInfo = &FileInfo{}
+		extentInfo = &FileInfo{Refs: 1, readTime: accessTime(f).Unix()}
 		extentInfo.FromExtent(extent)
+		s.updateUsedSize(extentInfo, extent)
 		s.extentInfoMux.Lock()
 		s.extentInfoMap[extentId] = extentInfo
 		s.extentInfoMux.Unlock()
@@ -273,7 +360,7 @@ func (s *ExtentStore) Write(extentId uint64, offset, size int64, data []byte, cr
 		err = fmt.Errorf("extent %v not exist", extentId)
 		return
 	}
-	extent, err := s.getExtent(extentId)
+	extent, err := s.getWritableExtent(extentId)
 	if err != nil {
 		return err
 	}
@@ -287,6 +374,79 @@ func (s *ExtentStore) Write(extentId uint64, offset, size int64, data []byte, cr
 		return
 	}
 	extentInfo.FromExtent(extent)
+	s.updateUsedSize(extentInfo, extent)
+	return
+}
+
+// PunchHole zeroes the range of the extent and releases its disk space, an
+// extent shared by other files is not changed.
+func (s *ExtentStore) PunchHole(extentId uint64, offset, size int64) (err error) {
+	s.refMux.Lock()
+	defer s.refMux.Unlock()
+	s.extentInfoMux.RLock()
+	extentInfo, has := s.extentInfoMap[extentId]
+	s.extentInfoMux.RUnlock()
+	if !has {
+		err = fmt.Errorf("extent %v not exist", extentId)
+		return
+	}
+	if extentInfo.Refs > 1 {
+		return ErrorExtentShared
+	}
+	extent, err := s.getWritableExtent(extentId)
+	if err != nil {
+		return err
+	}
+	if extent.IsMarkDelete() {
+		return ErrorHasDelete
+	}
+	if err = extent.PunchHole(offset, size); err != nil {
+		return
+	}
+	extentInfo.FromExtent(extent)
+	s.updateUsedSize(extentInfo, extent)
+	return
+}
+
+// Preallocate allocates the disk space of the extent up to size beyond its
+// data, the space left unwritten is released by the punching of the holes.
+func (s *ExtentStore) Preallocate(extentId uint64, size int64) (err error) {
+	if size <= 0 || size > util.ExtentSize {
+		return NewParamMismatchErr(fmt.Sprintf("preallocate size=%v", size))
+	}
+	extent, err := s.getWritableExtent(extentId)
+	if err != nil {
+		return err
+	}
+	if err = extent.Preallocate(size); err != nil {
+		return
+	}
+	s.extentInfoMux.RLock()
+	extentInfo, has := s.extentInfoMap[extentId]
+	s.extentInfoMux.RUnlock()
+	if has {
+		s.updateUsedSize(extentInfo, extent)
+	}
+	return
+}
+
+// updateUsedSize counts the change of the disk space of the extent in the used
+// size of the store, the extent is recounted by the next reconcile if its file
+// can't be stat.
+func (s *ExtentStore) updateUsedSize(extentInfo *FileInfo, extent Extent) {
+	allocated, err := extent.AllocatedSize()
+	if err != nil {
+		return
+	}
+	atomic.AddInt64(&s.usedSize, allocated-atomic.SwapInt64(&extentInfo.allocated, allocated))
+	hole := holeSize(allocated, extentInfo)
+	atomic.AddInt64(&s.holeSize, hole-atomic.SwapInt64(&extentInfo.hole, hole))
+}
+
+func holeSize(allocated int64, extentInfo *FileInfo) (hole int64) {
+	if hole = allocated - int64(extentInfo.Size) - util.BlockHeaderSize; hole < 0 {
+		hole = 0
+	}
 	return
 }
 
@@ -305,6 +465,11 @@ func (s *ExtentStore) checkOffsetAndSize(offset, size int64) error {
 }
 
 func (s *ExtentStore) Read(extentId uint64, offset, size int64, nbuf []byte) (crc uint32, err error) {
+	return s.read(extentId, offset, size, nbuf, true)
+}
+
+/*the read time of the extent is kept if touch, the scrub doesn't make an extent warm*/
+func (s *ExtentStore) read(extentId uint64, offset, size int64, nbuf []byte, touch bool) (crc uint32, err error) {
 	var extent Extent
 	if extent, err = s.getExtent(extentId); err != nil {
 		return
@@ -316,23 +481,72 @@ func (s *ExtentStore) Read(extentId uint64, offset, size int64, nbuf []byte) (cr
 		err = ErrorHasDelete
 		return
 	}
+	if touch {
+		s.extentInfoMux.RLock()
+		if extentInfo, has := s.extentInfoMap[extentId]; has {
+			atomic.StoreInt64(&extentInfo.readTime, time.Now().Unix())
+		}
+		s.extentInfoMux.RUnlock()
+	}
 	crc, err = extent.Read(nbuf, offset, size)
+	if err == ErrorExtentTiered {
+		// the block mismatching is in the cold tier, nothing to quarantine
+		return s.readTiered(extent, offset, size, nbuf)
+	}
+	if err == ErrorBlockCrcMismatch {
+		s.markCorruptRead(extent, offset, size)
+	}
 	return
 }
 
+// SendFile sends a full block of the extent to conn without copying it through
+// the user space, head writes the header of the reply with the crc of the block.
+// ErrorZeroCopyUnsupport is returned before head for the ranges to be read.
+func (s *ExtentStore) SendFile(extentId uint64, offset, size int64, conn syscall.Conn, head func(crc uint32) error) (err error) {
+	var extent Extent
+	if extent, err = s.getExtent(extentId); err != nil {
+		return
+	}
+	if err = s.checkOffsetAndSize(offset, size); err != nil {
+		return
+	}
+	if extent.IsMarkDelete() {
+		err = ErrorHasDelete
+		return
+	}
+	return extent.SendFile(conn, offset, size, head)
+}
+
+// MarkDelete drops a reference of the extent, the extent is marked deleted
+// when no file references it any more.
 func (s *ExtentStore) MarkDelete(extentId uint64) (err error) {
+	return s.markDelete(extentId, false)
+}
+
+// ForceMarkDelete marks the extent deleted whatever its references, for the
+// repair following a delete of the leader.
+func (s *ExtentStore) ForceMarkDelete(extentId uint64) (err error) {
+	return s.markDelete(extentId, true)
+}
+
+func (s *ExtentStore) markDelete(extentId uint64, force bool) (err error) {
 	var (
 		extent     Extent
 		extentInfo *FileInfo
 		has        bool
 	)
 
+	s.refMux.Lock()
+	defer s.refMux.Unlock()
 	s.extentInfoMux.RLock()
 	extentInfo, has = s.extentInfoMap[extentId]
 	s.extentInfoMux.RUnlock()
 	if !has {
 		return
 	}
+	if extentInfo.Refs > 1 && !force {
+		return s.putExtentRefs(extentId, extentInfo, extentInfo.Refs-1)
+	}
 
 	if extent, err = s.getExtent(extentId); err != nil {
 		return nil
@@ -347,12 +561,17 @@ func (s *ExtentStore) MarkDelete(extentId uint64) (err error) {
 	s.extentInfoMux.Lock()
 	delete(s.extentInfoMap, extentId)
 	s.extentInfoMux.Unlock()
+	atomic.AddInt64(&s.holeSize, -atomic.SwapInt64(&extentInfo.hole, 0))
+	if extentInfo.Refs > 1 {
+		s.putExtentRefs(extentId, nil, 0)
+	}
 
 	buf := make([]byte, 8)
 	binary.BigEndian.PutUint64(buf, extentId)
 	if _, err = s.deleteFp.Write(buf); err != nil {
 		return
 	}
+	atomic.AddInt64(&s.deletingSize, atomic.LoadInt64(&extentInfo.allocated))
 
 	return
 }
@@ -389,6 +608,7 @@ func (s *ExtentStore) FlushDelete() (err error) {
 		readN     int
 		extentId  uint64
 		opErr     error
+		tierErr   error
 	)
 	// Load delete index offset from EXTENT_META
 	delIdxOffBytes := make([]byte, ExtMetaDeleteIdxSize)
@@ -418,16 +638,28 @@ func (s *ExtentStore) FlushDelete() (err error) {
 			err = nil
 			break
 		}
-		delIdxOff += 8
 		_, err = s.getExtent(extentId)
 		if err != nil {
+			delIdxOff += 8
 			continue
 		}
+		if tierErr = s.deleteTiered(extentId); tierErr != nil {
+			// the delete of the extent is flushed again with its object
+			tierErr = fmt.Errorf("delete extent %v from cold tier: %v", extentId, tierErr)
+			break
+		}
+		delIdxOff += 8
 		s.cache.Del(extentId)
 		extentFilePath := path.Join(s.dataDir, strconv.FormatUint(extentId, 10))
+		info, statErr := os.Stat(extentFilePath)
 		if opErr = os.Remove(extentFilePath); opErr != nil {
 			continue
 		}
+		os.Remove(extentFilePath + ExtentCipherSuffix)
+		if statErr == nil {
+			atomic.AddInt64(&s.usedSize, -AllocatedSize(info))
+			atomic.AddInt64(&s.deletingSize, -AllocatedSize(info))
+		}
 	}
 
 	// Store offset of EXTENT_DELETE into EXTENT_META
@@ -436,7 +668,7 @@ func (s *ExtentStore) FlushDelete() (err error) {
 		return
 	}
 
-	return
+	return tierErr
 }
 
 func (s *ExtentStore) Sync(extentId uint64) (err error) {
@@ -467,6 +699,10 @@ func (s *ExtentStore) Close() {
 	s.deleteFp.Sync()
 	s.deleteFp.Close()
 
+	s.refMux.Lock()
+	s.refFp.Close()
+	s.refMux.Unlock()
+
 	s.closed = true
 }
 
@@ -493,19 +729,15 @@ func (s *ExtentStore) GetWatermark(extentId uint64, reload bool) (extentInfo *Fi
 
 func (s *ExtentStore) GetAllWatermark(filter ExtentFilter) (extents []*FileInfo, err error) {
 	extents = make([]*FileInfo, 0)
-	extentInfoSlice := make([]*FileInfo, 0, len(s.extentInfoMap))
+	// the filters are applied under the lock, the references are written under it
 	s.extentInfoMux.RLock()
-	for _, extentId := range s.extentInfoMap {
-		extentInfoSlice = append(extentInfoSlice, extentId)
-	}
-	s.extentInfoMux.RUnlock()
-
-	for _, extentInfo := range extentInfoSlice {
+	for _, extentInfo := range s.extentInfoMap {
 		if filter != nil && !filter(extentInfo) {
 			continue
 		}
 		extents = append(extents, extentInfo)
 	}
+	s.extentInfoMux.RUnlock()
 	return
 }
 
@@ -524,16 +756,80 @@ func (s *ExtentStore) parseExtentId(filename string) (extentId uint64, isExtent
 	return
 }
 
+// UsedSize returns the disk space of the extent files, including the ones
+// marked deleted which are not flushed yet.
 func (s *ExtentStore) UsedSize() (size int64) {
-	if fInfoArray, err := ioutil.ReadDir(s.dataDir); err == nil {
-		for _, fInfo := range fInfoArray {
-			if fInfo.IsDir() {
-				continue
-			}
-			if _, isExtent := s.parseExtentId(fInfo.Name()); !isExtent {
-				continue
+	return atomic.LoadInt64(&s.usedSize)
+}
+
+// ReconcileUsedSize recounts the used size from the extent files and returns
+// the drift of the kept one, it scans the store so it is done rarely.
+func (s *ExtentStore) ReconcileUsedSize() (drift int64, err error) {
+	var (
+		files []os.FileInfo
+		size  int64
+	)
+	if files, err = ioutil.ReadDir(s.dataDir); err != nil {
+		return
+	}
+	allocated := make(map[uint64]int64, len(files))
+	for _, fInfo := range files {
+		if fInfo.IsDir() {
+			continue
+		}
+		extentId, isExtent := s.parseExtentId(fInfo.Name())
+		if !isExtent {
+			continue
+		}
+		allocated[extentId] = AllocatedSize(fInfo)
+		size += allocated[extentId]
+	}
+	// the changes of the extents during the scan may be missed until the next reconcile
+	var holes int64
+	s.extentInfoMux.RLock()
+	for extentId, extentInfo := range s.extentInfoMap {
+		atomic.StoreInt64(&extentInfo.allocated, allocated[extentId])
+		hole := holeSize(allocated[extentId], extentInfo)
+		atomic.StoreInt64(&extentInfo.hole, hole)
+		holes += hole
+	}
+	s.extentInfoMux.RUnlock()
+	atomic.StoreInt64(&s.holeSize, holes)
+	atomic.StoreInt64(&s.deletingSize, s.countDeleting())
+	drift = size - atomic.SwapInt64(&s.usedSize, size)
+	return
+}
+
+// ReclaimableSize returns the bytes which will be released by the next delete flush
+// and by punching holes beyond the data of extents, kept up by the changes of
+// the extents like the used size.
+func (s *ExtentStore) ReclaimableSize() (size int64) {
+	return atomic.LoadInt64(&s.holeSize) + atomic.LoadInt64(&s.deletingSize)
+}
+
+// countDeleting scans the delete index for the disk space of the extents marked
+// deleted which are not flushed yet, on load and on the reconcile.
+func (s *ExtentStore) countDeleting() (size int64) {
+	var (
+		delIdxOff uint64
+		stat      os.FileInfo
+		err       error
+	)
+	delIdxOffBytes := make([]byte, ExtMetaDeleteIdxSize)
+	if _, err = s.metaFp.ReadAt(delIdxOffBytes, ExtMetaDeleteIdxOffset); err == nil {
+		delIdxOff = binary.BigEndian.Uint64(delIdxOffBytes)
+	}
+	if stat, err = s.deleteFp.Stat(); err != nil {
+		return
+	}
+	if stat.Size() > int64(delIdxOff) {
+		readBuf := make([]byte, stat.Size()-int64(delIdxOff))
+		readN, _ := s.deleteFp.ReadAt(readBuf, int64(delIdxOff))
+		for off := 0; off+8 <= readN; off += 8 {
+			extentId := binary.BigEndian.Uint64(readBuf[off : off+8])
+			if info, statErr := os.Stat(path.Join(s.dataDir, strconv.FormatUint(extentId, 10))); statErr == nil {
+				size += AllocatedSize(info)
 			}
-			size += fInfo.Size()
 		}
 	}
 	return
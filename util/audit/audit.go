@@ -0,0 +1,167 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package audit records the file system ops of a client as JSON lines, one
+// entry per op, all of them or only the ones slower than a threshold as a slow
+// log. The entries are replayed against another cluster by cfs-replay to
+// reproduce the op mix. An entry names the inodes of the client cluster, the
+// replay maps them to the inodes it creates. The namespace mutations served by
+// the meta nodes are recorded by MetaLogger for the audit of the vols.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	OpLookup    = "lookup"
+	OpReadDir   = "readdir"
+	OpCreate    = "create"
+	OpMkdir     = "mkdir"
+	OpRemove    = "remove"
+	OpRename    = "rename"
+	OpLink      = "link"
+	OpOpen      = "open"
+	OpRead      = "read"
+	OpWrite     = "write"
+	OpFsync     = "fsync"
+	OpTruncate  = "truncate"
+	OpFallocate = "fallocate"
+)
+
+const (
+	DefaultMaxSize = 1024 * 1024 * 1024 // bytes of the file, the entries over it are dropped
+	FlushInterval  = time.Second
+)
+
+// Entry is an op of the client, Ino is the inode of the op or the parent of a
+// dentry op, NewIno is the inode created or linked or the destination dir of a
+// rename.
+type Entry struct {
+	Time    int64  //unix nanoseconds the op started
+	Op      string //one of the Op consts
+	Ino     uint64
+	Name    string `json:",omitempty"`
+	NewIno  uint64 `json:",omitempty"`
+	NewName string `json:",omitempty"`
+	Offset  int64  `json:",omitempty"`
+	Size    int    `json:",omitempty"`
+	Latency int64  //microseconds the op took
+}
+
+// Logger appends the entries to a file, the writes are buffered and flushed
+// every second so the ops do not wait for the disk.
+type Logger struct {
+	file    *os.File
+	w       *bufio.Writer
+	slow    time.Duration
+	maxSize int64
+	size    int64
+	dropped uint64
+	stopC   chan struct{}
+	sync.Mutex
+}
+
+// NewLogger appends the ops taking at least slow to file, zero logs all of them.
+func NewLogger(file string, slow time.Duration, maxSize int64) (l *Logger, err error) {
+	l = &Logger{slow: slow, maxSize: maxSize, stopC: make(chan struct{})}
+	if l.file, err = os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return nil, err
+	}
+	if info, err := l.file.Stat(); err == nil {
+		l.size = info.Size()
+	}
+	l.w = bufio.NewWriter(l.file)
+	go l.flushScheduler()
+	return
+}
+
+func (l *Logger) flushScheduler() {
+	ticker := time.NewTicker(FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.Lock()
+			l.w.Flush()
+			l.Unlock()
+		case <-l.stopC:
+			return
+		}
+	}
+}
+
+// Log records the op started at start, it does nothing on a nil Logger.
+func (l *Logger) Log(start time.Time, e *Entry) {
+	if l == nil {
+		return
+	}
+	latency := time.Since(start)
+	if latency < l.slow {
+		return
+	}
+	e.Time = start.UnixNano()
+	e.Latency = int64(latency / time.Microsecond)
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+	l.Lock()
+	defer l.Unlock()
+	if l.maxSize > 0 && l.size+int64(len(data)) > l.maxSize {
+		l.dropped++
+		return
+	}
+	l.size += int64(len(data))
+	l.w.Write(data)
+}
+
+// Dropped returns the entries dropped since the file is full.
+func (l *Logger) Dropped() uint64 {
+	l.Lock()
+	defer l.Unlock()
+	return l.dropped
+}
+
+func (l *Logger) Close() (err error) {
+	close(l.stopC)
+	l.Lock()
+	defer l.Unlock()
+	l.w.Flush()
+	return l.file.Close()
+}
+
+// Reader reads the entries of an audit or slow log in order.
+type Reader struct {
+	dec *json.Decoder
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{dec: json.NewDecoder(r)}
+}
+
+// Next returns the next entry, io.EOF at the end.
+func (r *Reader) Next() (e *Entry, err error) {
+	e = new(Entry)
+	if err = r.dec.Decode(e); err != nil {
+		return nil, err
+	}
+	return
+}
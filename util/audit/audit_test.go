@@ -0,0 +1,86 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package audit
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLogger_Replay(t *testing.T) {
+	f, err := ioutil.TempFile("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	l, err := NewLogger(f.Name(), 0, DefaultMaxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	l.Log(start, &Entry{Op: OpCreate, Ino: 1, Name: "a", NewIno: 10})
+	l.Log(start.Add(-time.Millisecond), &Entry{Op: OpWrite, Ino: 10, Offset: 4096, Size: 100})
+	if err = l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	in, err := os.Open(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	r := NewReader(in)
+	e, err := r.Next()
+	if err != nil || e.Op != OpCreate || e.Ino != 1 || e.Name != "a" || e.NewIno != 10 || e.Time != start.UnixNano() {
+		t.Fatalf("first entry %+v err %v", e, err)
+	}
+	if e, err = r.Next(); err != nil || e.Op != OpWrite || e.Offset != 4096 || e.Size != 100 {
+		t.Fatalf("second entry %+v err %v", e, err)
+	}
+	if _, err = r.Next(); err != io.EOF {
+		t.Fatalf("end of log err %v", err)
+	}
+}
+
+func TestLogger_SlowAndFull(t *testing.T) {
+	f, err := ioutil.TempFile("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	l, err := NewLogger(f.Name(), time.Hour, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// faster than the threshold
+	l.Log(time.Now(), &Entry{Op: OpRead, Ino: 2})
+	if l.Dropped() != 0 {
+		t.Fatalf("a fast op counted as dropped")
+	}
+	// slow enough, but the file is full
+	l.Log(time.Now().Add(-2*time.Hour), &Entry{Op: OpRead, Ino: 2})
+	if l.Dropped() != 1 {
+		t.Fatalf("dropped %v, expect 1", l.Dropped())
+	}
+	l.Close()
+	if data, _ := ioutil.ReadFile(f.Name()); len(data) != 0 {
+		t.Fatalf("entries written: %q", data)
+	}
+}
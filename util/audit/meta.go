@@ -0,0 +1,232 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMetaMaxSize = 1024 * 1024 * 1024 // bytes of the file before it is rotated
+	DefaultMetaBackups = 10                 // rotated files kept
+	SinkBatchEntries   = 1000
+	SinkQueueEntries   = 100000
+	SinkTimeout        = 10 * time.Second
+	rotatedTimeFormat  = "20060102150405.000000000"
+)
+
+// MetaEntry is a namespace mutation served by a meta node, the file of a
+// dentry op is named by its parent inode and its name, and by the path the
+// client asked for if it tells it as the meta node does not know the paths.
+type MetaEntry struct {
+	Time      int64 //unix nanoseconds the op was served
+	Vol       string
+	Client    string //ip of the client
+	Proxy     string `json:",omitempty"` //ip of the meta node that proxied the op to the leader
+	Op        string //the op of the packet
+	Partition uint64
+	Parent    uint64 `json:",omitempty"`
+	Name      string `json:",omitempty"`
+	Path      string `json:",omitempty"`
+	Inode     uint64 `json:",omitempty"` //created, deleted or changed, the new inode of an updated dentry
+	Mode      uint32 `json:",omitempty"`
+	Uid       uint32 `json:",omitempty"`
+	Gid       uint32 `json:",omitempty"`
+	Valid     uint32 `json:",omitempty"` //attrs changed by a setattr
+	TxID      string `json:",omitempty"`
+	TxOp      string `json:",omitempty"` //the dentry op of a part of a rename transaction
+	Result    string
+}
+
+// MetaLogger appends the entries to a file rotated by size, and posts them to
+// an HTTP sink in batches of JSON lines if it is set. The file is complete, the
+// sink gets the entries best effort and drops them while it is unreachable.
+type MetaLogger struct {
+	file    string
+	fp      *os.File
+	w       *bufio.Writer
+	maxSize int64
+	backups int
+	size    int64
+	sink    string
+	queue   chan []byte
+	dropped uint64
+	client  *http.Client
+	stopC   chan struct{}
+	wg      sync.WaitGroup
+	sync.Mutex
+}
+
+// NewMetaLogger appends the entries to file, it is rotated once over maxSize
+// and the backups newest of the rotated files are kept. An empty sink posts
+// the entries nowhere.
+func NewMetaLogger(file string, maxSize int64, backups int, sink string) (l *MetaLogger, err error) {
+	l = &MetaLogger{file: file, maxSize: maxSize, backups: backups, sink: sink, stopC: make(chan struct{})}
+	if l.fp, err = os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return nil, err
+	}
+	if info, err := l.fp.Stat(); err == nil {
+		l.size = info.Size()
+	}
+	l.w = bufio.NewWriter(l.fp)
+	l.wg.Add(1)
+	go l.flushScheduler()
+	if sink != "" {
+		l.queue = make(chan []byte, SinkQueueEntries)
+		l.client = &http.Client{Timeout: SinkTimeout}
+		l.wg.Add(1)
+		go l.sinkScheduler()
+	}
+	return
+}
+
+func (l *MetaLogger) flushScheduler() {
+	defer l.wg.Done()
+	ticker := time.NewTicker(FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.Lock()
+			l.w.Flush()
+			l.Unlock()
+		case <-l.stopC:
+			return
+		}
+	}
+}
+
+// Log records the entry served now, it does nothing on a nil MetaLogger.
+func (l *MetaLogger) Log(e *MetaEntry) {
+	if l == nil {
+		return
+	}
+	e.Time = time.Now().UnixNano()
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+	l.Lock()
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(data)) > l.maxSize {
+		l.rotate()
+	}
+	l.size += int64(len(data))
+	l.w.Write(data)
+	l.Unlock()
+	if l.queue != nil {
+		select {
+		case l.queue <- data:
+		default:
+			l.Lock()
+			l.dropped++
+			l.Unlock()
+		}
+	}
+}
+
+/*the caller must hold the lock, the entries go on to the current file if the rotation fails*/
+func (l *MetaLogger) rotate() {
+	l.w.Flush()
+	rotated := l.file + "." + time.Now().Format(rotatedTimeFormat)
+	if err := os.Rename(l.file, rotated); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	fp, err := os.OpenFile(l.file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		// the open file is the rotated one now, the next rotation creates the file
+		return
+	}
+	l.fp.Close()
+	l.fp = fp
+	l.w.Reset(fp)
+	l.size = 0
+	if l.backups <= 0 {
+		return
+	}
+	files, _ := filepath.Glob(l.file + ".*")
+	sort.Strings(files)
+	for len(files) > l.backups {
+		os.Remove(files[0])
+		files = files[1:]
+	}
+}
+
+func (l *MetaLogger) sinkScheduler() {
+	defer l.wg.Done()
+	ticker := time.NewTicker(FlushInterval)
+	defer ticker.Stop()
+	batch := make([][]byte, 0, SinkBatchEntries)
+	for {
+		select {
+		case data := <-l.queue:
+			if batch = append(batch, data); len(batch) < SinkBatchEntries {
+				continue
+			}
+		case <-ticker.C:
+		case <-l.stopC:
+			for len(l.queue) != 0 {
+				batch = append(batch, <-l.queue)
+			}
+			l.post(batch)
+			return
+		}
+		l.post(batch)
+		batch = batch[:0]
+	}
+}
+
+func (l *MetaLogger) post(batch [][]byte) {
+	if len(batch) == 0 {
+		return
+	}
+	resp, err := l.client.Post(l.sink, "application/x-ndjson", bytes.NewReader(bytes.Join(batch, nil)))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			err = fmt.Errorf("status %v", resp.StatusCode)
+		}
+	}
+	if err != nil {
+		l.Lock()
+		l.dropped += uint64(len(batch))
+		l.Unlock()
+	}
+}
+
+// Dropped returns the entries the sink did not get.
+func (l *MetaLogger) Dropped() uint64 {
+	l.Lock()
+	defer l.Unlock()
+	return l.dropped
+}
+
+func (l *MetaLogger) Close() (err error) {
+	close(l.stopC)
+	l.wg.Wait()
+	l.Lock()
+	defer l.Unlock()
+	l.w.Flush()
+	return l.fp.Close()
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestMetaLogger_Rotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "audit.log")
+	l, err := NewMetaLogger(file, 200, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		l.Log(&MetaEntry{Vol: "vol", Client: "10.0.0.1", Op: "OpMetaCreateDentry", Partition: 1, Parent: 1, Name: "a", Result: "Ok"})
+	}
+	if err = l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	rotated, _ := filepath.Glob(file + ".*")
+	if len(rotated) != 2 {
+		t.Fatalf("rotated files %v, expect 2", rotated)
+	}
+	for _, f := range append(rotated, file) {
+		info, err := os.Stat(f)
+		if err != nil || info.Size() > 200 || info.Size() == 0 {
+			t.Fatalf("file %v info %v err %v", f, info, err)
+		}
+	}
+	fp, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		e := &MetaEntry{}
+		if err = json.Unmarshal(scanner.Bytes(), e); err != nil || e.Vol != "vol" || e.Name != "a" || e.Time == 0 {
+			t.Fatalf("entry %+v err %v", e, err)
+		}
+	}
+}
+
+func TestMetaLogger_Sink(t *testing.T) {
+	var (
+		entries []*MetaEntry
+		mu      sync.Mutex
+	)
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			e := &MetaEntry{}
+			json.Unmarshal(scanner.Bytes(), e)
+			mu.Lock()
+			entries = append(entries, e)
+			mu.Unlock()
+		}
+	}))
+	defer sink.Close()
+	f, err := ioutil.TempFile("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	l, err := NewMetaLogger(f.Name(), DefaultMetaMaxSize, DefaultMetaBackups, sink.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Log(&MetaEntry{Vol: "vol", Op: "OpMetaDeleteDentry", Parent: 1, Name: "a", Inode: 2, Result: "Ok"})
+	l.Log(&MetaEntry{Vol: "vol", Op: "OpMetaSetattr", Inode: 2, Mode: 0600, Valid: 1, Result: "Ok"})
+	l.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(entries) != 2 || entries[0].Op != "OpMetaDeleteDentry" || entries[1].Mode != 0600 {
+		t.Fatalf("sink got %v entries", len(entries))
+	}
+	if l.Dropped() != 0 {
+		t.Fatalf("dropped %v", l.Dropped())
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+const (
+	AuthKey = "authKey" //config key of the key shared by the nodes of the cluster
+	Token   = "token"   //config key of the token the client presents for its vol
+)
+
+const (
+	AuthConnTimeoutSeconds = 5
+)
+
+type Access uint8
+
+const (
+	AccessRead Access = iota
+	AccessWrite
+	AccessInternal //master commands and the requests between the nodes
+)
+
+var (
+	ErrNotPermitted     = errors.New("access not permitted")
+	ErrTokensNotArrived = errors.New("vol tokens not received from master")
+)
+
+type connAuth struct {
+	volName  string
+	digest   string
+	internal bool
+}
+
+// Checker keeps the authentication of the connections to a node and checks
+// their requests against the vol tokens sent by the master in the heartbeats.
+// A connection without authentication is allowed to the vols without tokens,
+// the checks are disabled if the node has no auth key or the checker is nil.
+type Checker struct {
+	key     string
+	arrived bool
+	tokens  map[string]map[string]string //vol -> token digest -> token type
+	conns   sync.Map                     //net.Conn -> *connAuth
+	sync.RWMutex
+}
+
+func NewChecker(key string) *Checker {
+	return &Checker{key: key, tokens: make(map[string]map[string]string)}
+}
+
+func (c *Checker) Enabled() bool {
+	return c != nil && c.key != ""
+}
+
+// Update replaces the tokens of all the vols, a token missing from volTokens
+// is revoked and refused by the next check of the connections presenting it
+func (c *Checker) Update(volTokens map[string][]*proto.TokenDigest) {
+	if !c.Enabled() {
+		return
+	}
+	tokens := make(map[string]map[string]string, len(volTokens))
+	for name, digests := range volTokens {
+		tokens[name] = make(map[string]string, len(digests))
+		for _, d := range digests {
+			tokens[name][d.Digest] = d.Type
+		}
+	}
+	c.Lock()
+	c.tokens = tokens
+	c.arrived = true
+	c.Unlock()
+}
+
+// Authenticate records the auth of an OpAuthConn request for the connection, the
+// connection presenting only the client session is checked as unauthenticated
+func (c *Checker) Authenticate(conn net.Conn, req *proto.AuthConnRequest) (err error) {
+	if !c.Enabled() || req.Token == "" {
+		return
+	}
+	if req.VolName == "" {
+		if subtle.ConstantTimeCompare([]byte(req.Token), []byte(c.key)) != 1 {
+			return fmt.Errorf("%v: invalid auth key", ErrNotPermitted)
+		}
+		c.conns.Store(conn, &connAuth{internal: true})
+		return
+	}
+	digest := proto.TokenDigestOf(req.Token)
+	if _, err = c.tokenType(req.VolName, digest); err != nil {
+		return
+	}
+	c.conns.Store(conn, &connAuth{volName: req.VolName, digest: digest})
+	return
+}
+
+// Check returns an error if the connection is not allowed the access to the vol
+func (c *Checker) Check(conn net.Conn, volName string, access Access) (err error) {
+	if !c.Enabled() {
+		return
+	}
+	var ca *connAuth
+	if value, ok := c.conns.Load(conn); ok {
+		ca = value.(*connAuth)
+	}
+	if ca != nil && ca.internal {
+		return
+	}
+	if access == AccessInternal {
+		return fmt.Errorf("%v: not authenticated as a node of the cluster", ErrNotPermitted)
+	}
+	if ca == nil {
+		c.RLock()
+		defer c.RUnlock()
+		if !c.arrived {
+			return ErrTokensNotArrived
+		}
+		if len(c.tokens[volName]) != 0 {
+			return fmt.Errorf("%v: vol[%v] requires a token", ErrNotPermitted, volName)
+		}
+		return
+	}
+	if ca.volName != volName {
+		return fmt.Errorf("%v: token of vol[%v] presented for vol[%v]", ErrNotPermitted, ca.volName, volName)
+	}
+	var tokenType string
+	if tokenType, err = c.tokenType(volName, ca.digest); err != nil {
+		return
+	}
+	if access == AccessWrite && tokenType != proto.TokenReadWrite {
+		return fmt.Errorf("%v: read only token of vol[%v]", ErrNotPermitted, volName)
+	}
+	return
+}
+
+func (c *Checker) tokenType(volName, digest string) (tokenType string, err error) {
+	c.RLock()
+	defer c.RUnlock()
+	if !c.arrived {
+		return "", ErrTokensNotArrived
+	}
+	tokenType, ok := c.tokens[volName][digest]
+	if !ok {
+		return "", fmt.Errorf("%v: invalid or revoked token of vol[%v]", ErrNotPermitted, volName)
+	}
+	return
+}
+
+// Internal returns if the connection is authenticated with the auth key of the
+// cluster, as a node of it
+func (c *Checker) Internal(conn net.Conn) bool {
+	if !c.Enabled() {
+		return false
+	}
+	value, ok := c.conns.Load(conn)
+	return ok && value.(*connAuth).internal
+}
+
+// Release forgets the auth of the connection once it is closed
+func (c *Checker) Release(conn net.Conn) {
+	if !c.Enabled() {
+		return
+	}
+	c.conns.Delete(conn)
+}
+
+// ConnectHook returns the dial hook presenting the token of the vol, or the auth
+// key of the cluster if volName is empty, and the client session if any in the
+// first packet of the connections. Only the session is presented without token,
+// and nothing to the legacy nodes which don't take it.
+func ConnectHook(volName, token, session string) func(conn net.Conn) error {
+	return func(conn net.Conn) (err error) {
+		if token == "" && (session == "" || !proto.PeerSupports(conn.RemoteAddr().String(), proto.ConnCapSession)) {
+			return
+		}
+		var p *proto.Packet
+		if p, err = proto.NewAuthConnPacket(volName, token, session); err != nil {
+			return
+		}
+		if err = p.WriteToConn(conn); err != nil {
+			return
+		}
+		if err = p.ReadFromConn(conn, AuthConnTimeoutSeconds); err != nil {
+			return
+		}
+		conn.SetDeadline(time.Time{})
+		if p.ResultCode != proto.OpOk {
+			return fmt.Errorf("auth of conn to %v: %v", conn.RemoteAddr(), string(p.Data[:p.Size]))
+		}
+		return
+	}
+}
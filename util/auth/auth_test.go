@@ -0,0 +1,209 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package auth
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+const (
+	testKey     = "cluster-key"
+	testRWToken = "rw-token"
+	testROToken = "ro-token"
+)
+
+func testTokens(tokens ...string) map[string][]*proto.TokenDigest {
+	digests := make([]*proto.TokenDigest, 0)
+	for _, token := range tokens {
+		tokenType := proto.TokenReadOnly
+		if token == testRWToken {
+			tokenType = proto.TokenReadWrite
+		}
+		digests = append(digests, &proto.TokenDigest{Digest: proto.TokenDigestOf(token), Type: tokenType})
+	}
+	return map[string][]*proto.TokenDigest{"ltptest": digests, "open": {}}
+}
+
+func newTestConn(t *testing.T) net.Conn {
+	c1, c2 := net.Pipe()
+	c2.Close()
+	return c1
+}
+
+func TestChecker_Check(t *testing.T) {
+	cases := []struct {
+		name    string
+		req     *proto.AuthConnRequest //nil for a conn without authentication
+		authErr bool
+		volName string
+		access  Access
+		checkOk bool
+	}{
+		{"rw token reads", &proto.AuthConnRequest{VolName: "ltptest", Token: testRWToken}, false, "ltptest", AccessRead, true},
+		{"rw token writes", &proto.AuthConnRequest{VolName: "ltptest", Token: testRWToken}, false, "ltptest", AccessWrite, true},
+		{"ro token reads", &proto.AuthConnRequest{VolName: "ltptest", Token: testROToken}, false, "ltptest", AccessRead, true},
+		{"ro token writes", &proto.AuthConnRequest{VolName: "ltptest", Token: testROToken}, false, "ltptest", AccessWrite, false},
+		{"token of another vol", &proto.AuthConnRequest{VolName: "ltptest", Token: testRWToken}, false, "open", AccessRead, false},
+		{"token not internal", &proto.AuthConnRequest{VolName: "ltptest", Token: testRWToken}, false, "ltptest", AccessInternal, false},
+		{"invalid token", &proto.AuthConnRequest{VolName: "ltptest", Token: "forged"}, true, "ltptest", AccessRead, false},
+		{"auth key", &proto.AuthConnRequest{Token: testKey}, false, "ltptest", AccessInternal, true},
+		{"auth key writes", &proto.AuthConnRequest{Token: testKey}, false, "ltptest", AccessWrite, true},
+		{"invalid auth key", &proto.AuthConnRequest{Token: "forged"}, true, "ltptest", AccessInternal, false},
+		{"no auth to a vol with tokens", nil, false, "ltptest", AccessRead, false},
+		{"no auth to a vol without tokens", nil, false, "open", AccessWrite, true},
+		{"no auth internal", nil, false, "open", AccessInternal, false},
+		{"empty request", &proto.AuthConnRequest{}, false, "open", AccessRead, true},
+		{"session only to a vol without tokens", &proto.AuthConnRequest{VolName: "open", Session: "session-1"}, false, "open", AccessWrite, true},
+		{"session only to a vol with tokens", &proto.AuthConnRequest{VolName: "ltptest", Session: "session-1"}, false, "ltptest", AccessRead, false},
+	}
+	c := NewChecker(testKey)
+	c.Update(testTokens(testRWToken, testROToken))
+	for _, tc := range cases {
+		conn := newTestConn(t)
+		if tc.req != nil {
+			if err := c.Authenticate(conn, tc.req); (err != nil) != tc.authErr {
+				t.Fatalf("%v: authenticate err(%v)", tc.name, err)
+			}
+		}
+		if err := c.Check(conn, tc.volName, tc.access); (err == nil) != tc.checkOk {
+			t.Fatalf("%v: check err(%v)", tc.name, err)
+		}
+		c.Release(conn)
+	}
+}
+
+func TestChecker_Revoke(t *testing.T) {
+	c := NewChecker(testKey)
+	conn := newTestConn(t)
+	req := &proto.AuthConnRequest{VolName: "ltptest", Token: testROToken}
+	if err := c.Authenticate(conn, req); err != ErrTokensNotArrived {
+		t.Fatalf("authenticate before the tokens arrived: err(%v)", err)
+	}
+	if err := c.Check(conn, "open", AccessRead); err != ErrTokensNotArrived {
+		t.Fatalf("check before the tokens arrived: err(%v)", err)
+	}
+	c.Update(testTokens(testRWToken, testROToken))
+	if err := c.Authenticate(conn, req); err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	if err := c.Check(conn, "ltptest", AccessRead); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	// the token revoked or expired on the master is missing from the next heartbeat
+	c.Update(testTokens(testRWToken))
+	if err := c.Check(conn, "ltptest", AccessRead); err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Fatalf("check of a revoked token: err(%v)", err)
+	}
+	if err := c.Authenticate(newTestConn(t), req); err == nil {
+		t.Fatalf("authenticate with a revoked token succeeded")
+	}
+}
+
+func TestChecker_Internal(t *testing.T) {
+	c := NewChecker(testKey)
+	c.Update(testTokens(testRWToken))
+	node, client, anonymous := newTestConn(t), newTestConn(t), newTestConn(t)
+	if err := c.Authenticate(node, &proto.AuthConnRequest{Token: testKey}); err != nil {
+		t.Fatalf("authenticate node: %v", err)
+	}
+	if err := c.Authenticate(client, &proto.AuthConnRequest{VolName: "ltptest", Token: testRWToken}); err != nil {
+		t.Fatalf("authenticate client: %v", err)
+	}
+	if !c.Internal(node) || c.Internal(client) || c.Internal(anonymous) {
+		t.Fatalf("internal node(%v) client(%v) anonymous(%v)", c.Internal(node), c.Internal(client), c.Internal(anonymous))
+	}
+	// the node bypasses the tokens of every vol, also once they are all revoked
+	c.Update(nil)
+	if err := c.Check(node, "ltptest", AccessWrite); err != nil {
+		t.Fatalf("check of the node: %v", err)
+	}
+	c.Release(node)
+	if c.Internal(node) {
+		t.Fatalf("released conn still internal")
+	}
+
+	var disabled *Checker
+	if disabled.Enabled() || disabled.Internal(node) || disabled.Check(anonymous, "ltptest", AccessInternal) != nil {
+		t.Fatalf("nil checker not disabled")
+	}
+	noKey := NewChecker("")
+	if err := noKey.Authenticate(client, &proto.AuthConnRequest{VolName: "ltptest", Token: "forged"}); err != nil {
+		t.Fatalf("checker without key authenticated: %v", err)
+	}
+	if err := noKey.Check(anonymous, "ltptest", AccessWrite); err != nil {
+		t.Fatalf("checker without key checked: %v", err)
+	}
+}
+
+/*serve the OpAuthConn of the hook on conn by c, the request the hook sent is given to reqC*/
+func serveTestAuth(c *Checker, conn net.Conn, reqC chan *proto.AuthConnRequest) {
+	defer conn.Close()
+	p := new(proto.Packet)
+	if err := p.ReadFromConn(conn, AuthConnTimeoutSeconds); err != nil {
+		close(reqC)
+		return
+	}
+	req := &proto.AuthConnRequest{}
+	err := p.UnmarshalData(req)
+	if err == nil {
+		err = c.Authenticate(conn, req)
+	}
+	reqC <- req
+	if err != nil {
+		p.PackErrorWithBody(proto.OpNotPermErr, []byte(err.Error()))
+	} else {
+		p.PackOkReply()
+	}
+	p.WriteToConn(conn)
+}
+
+func TestConnectHook(t *testing.T) {
+	c := NewChecker(testKey)
+	c.Update(testTokens(testRWToken))
+	cases := []struct {
+		name, volName, token, session string
+		sent, ok                      bool
+	}{
+		{"vol token", "ltptest", testRWToken, "", true, true},
+		{"token with session", "ltptest", testRWToken, "session-1", true, true},
+		{"auth key", "", testKey, "", true, true},
+		{"revoked token", "ltptest", testROToken, "", true, false},
+		{"session only", "open", "", "session-1", true, true},
+		{"nothing to present", "open", "", "", false, true},
+	}
+	for _, tc := range cases {
+		client, server := net.Pipe()
+		reqC := make(chan *proto.AuthConnRequest, 1)
+		if tc.sent {
+			go serveTestAuth(c, server, reqC)
+		}
+		err := ConnectHook(tc.volName, tc.token, tc.session)(client)
+		if (err == nil) != tc.ok {
+			t.Fatalf("%v: hook err(%v)", tc.name, err)
+		}
+		if tc.sent {
+			req, ok := <-reqC
+			if !ok || req.VolName != tc.volName || req.Token != tc.token || req.Session != tc.session {
+				t.Fatalf("%v: request sent %+v", tc.name, req)
+			}
+		}
+		client.Close()
+		server.Close()
+	}
+}
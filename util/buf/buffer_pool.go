@@ -16,59 +16,149 @@ package buf
 
 import (
 	"fmt"
-	"github.com/tiglabs/containerfs/util"
+	"math/bits"
 	"sync"
+	"sync/atomic"
+
+	"github.com/tiglabs/containerfs/util"
+)
+
+const (
+	MinPooledSize        = 64
+	PoolTiers            = 21 //the tiers are the powers of two from 64B to 64MB
+	MaxPooledSize        = MinPooledSize << (PoolTiers - 1)
+	DefaultMaxPooledSize = 16 * util.MB
 )
 
 var (
 	Buffers = NewBufferPool()
 )
 
+type bufferTier struct {
+	size   int
+	pool   sync.Pool
+	gets   uint64
+	misses uint64
+}
+
+// the buffers of the packets, a buffer is taken from the tier of the smallest
+// power of two holding the size and returned to it by its capacity, the sizes
+// over maxPooledSize are allocated and left to the gc
 type BufferPool struct {
-	pools [3]*sync.Pool
+	tiers         [PoolTiers]*bufferTier
+	maxPooledSize int64
+	unpooled      uint64
+}
+
+type TierStats struct {
+	Size   int
+	Gets   uint64
+	Misses uint64 //gets the tier had no free buffer for
+}
+
+type PoolStats struct {
+	MaxPooledSize int
+	Unpooled      uint64 //allocations over MaxPooledSize
+	Tiers         []TierStats
 }
 
 func NewBufferPool() (bufferP *BufferPool) {
-	bufferP = &BufferPool{}
-	bufferP.pools[0] = &sync.Pool{New: func() interface{} {
-		return make([]byte, util.PacketHeaderSize)
-	}}
-	bufferP.pools[1] = &sync.Pool{New: func() interface{} {
-		return make([]byte, util.BlockSize)
-	}}
-	bufferP.pools[2] = &sync.Pool{New: func() interface{} {
-		return make([]byte, util.ReadBlockSize)
-	}}
+	bufferP = &BufferPool{maxPooledSize: DefaultMaxPooledSize}
+	for i := range bufferP.tiers {
+		t := &bufferTier{size: MinPooledSize << uint(i)}
+		t.pool.New = func() interface{} {
+			atomic.AddUint64(&t.misses, 1)
+			return make([]byte, t.size)
+		}
+		bufferP.tiers[i] = t
+	}
 
 	return bufferP
 }
 
-func (bufferP *BufferPool) Get(size int) (data []byte, err error) {
-	if size == util.PacketHeaderSize {
-		return bufferP.pools[0].Get().([]byte), nil
-	} else if size == util.BlockSize {
-		return bufferP.pools[1].Get().([]byte), nil
-	} else if size == util.ReadBlockSize {
-		return bufferP.pools[2].Get().([]byte), nil
+func tierOf(size int) int {
+	if size <= MinPooledSize {
+		return 0
 	}
-	return nil, fmt.Errorf("can only support 45 or 65536 bytes")
+	return bits.Len(uint(size-1)) - bits.Len(uint(MinPooledSize-1))
 }
 
-func (bufferP *BufferPool) Put(data []byte) {
-	if data == nil {
+func (bufferP *BufferPool) MaxPooledSize() int {
+	return int(atomic.LoadInt64(&bufferP.maxPooledSize))
+}
+
+// the buffers over the new size already pooled are dropped by the gc
+func (bufferP *BufferPool) SetMaxPooledSize(size int) (err error) {
+	if size < MinPooledSize || size > MaxPooledSize {
+		return fmt.Errorf("max pooled size(%v) out of [%v, %v]", size, MinPooledSize, MaxPooledSize)
+	}
+	atomic.StoreInt64(&bufferP.maxPooledSize, int64(size))
+	return
+}
+
+// a buffer of len size, the content is not zeroed
+func (bufferP *BufferPool) Alloc(size int) (data []byte) {
+	if size > bufferP.MaxPooledSize() {
+		atomic.AddUint64(&bufferP.unpooled, 1)
+		return make([]byte, size)
+	}
+	t := bufferP.tiers[tierOf(size)]
+	atomic.AddUint64(&t.gets, 1)
+	data = t.pool.Get().([]byte)
+	return data[:size]
+}
+
+// return a buffer of Alloc, the caller must not use it afterwards
+func (bufferP *BufferPool) Free(data []byte) {
+	size := cap(data)
+	if size < MinPooledSize || size > bufferP.MaxPooledSize() {
 		return
 	}
-	size := len(data)
-	if size != util.BlockSize && size != util.PacketHeaderSize && size != util.ReadBlockSize {
+	t := bufferP.tiers[tierOf(size)]
+	if t.size != size {
 		return
 	}
-	if size == util.PacketHeaderSize {
-		bufferP.pools[0].Put(data)
-	} else if size == util.BlockSize {
-		bufferP.pools[1].Put(data)
-	} else if size == util.ReadBlockSize {
-		bufferP.pools[2].Put(data)
+	t.pool.Put(data[:size])
+}
+
+func (bufferP *BufferPool) Get(size int) (data []byte, err error) {
+	if size > bufferP.MaxPooledSize() {
+		return nil, fmt.Errorf("size(%v) over the max pooled size(%v)", size, bufferP.MaxPooledSize())
+	}
+	return bufferP.Alloc(size), nil
+}
+
+func (bufferP *BufferPool) Put(data []byte) {
+	if data == nil {
+		return
 	}
+	bufferP.Free(data)
+
+	return
+}
 
+// the stats of the tiers used so far
+func (bufferP *BufferPool) Stats() (stats *PoolStats) {
+	stats = &PoolStats{MaxPooledSize: bufferP.MaxPooledSize(), Unpooled: atomic.LoadUint64(&bufferP.unpooled),
+		Tiers: make([]TierStats, 0)}
+	for _, t := range bufferP.tiers {
+		gets := atomic.LoadUint64(&t.gets)
+		if gets == 0 {
+			continue
+		}
+		stats.Tiers = append(stats.Tiers, TierStats{Size: t.size, Gets: gets, Misses: atomic.LoadUint64(&t.misses)})
+	}
 	return
 }
+
+// the share of the gets served by a free buffer
+func (s *TierStats) HitRate() float64 {
+	if s.Gets == 0 {
+		return 0
+	}
+	hits := s.Gets - s.Misses
+	if s.Misses > s.Gets {
+		hits = 0
+	}
+	return float64(hits) / float64(s.Gets)
+}
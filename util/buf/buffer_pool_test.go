@@ -17,36 +17,91 @@ package buf
 import (
 	"encoding/binary"
 	"fmt"
-	"github.com/tiglabs/containerfs/storage"
-	"github.com/tiglabs/containerfs/util/pool"
+	"github.com/tiglabs/containerfs/util"
 	"hash/crc32"
 	"math/rand"
 	"testing"
 )
 
 func TestBufferPool_Get(t *testing.T) {
-	cp := pool.NewBufferPool()
+	cp := NewBufferPool()
 	for i := 0; i < 1024; i++ {
-		buffer, err := cp.Get(storage.BlockSize + 1)
+		buffer, err := cp.Get(util.BlockSize)
 		if err != nil {
 			t.Fatal(err)
 		}
-		if len(buffer) != storage.BlockSize {
+		if len(buffer) != util.BlockSize {
 			t.FailNow()
 		}
-		buffer[i%storage.BlockSize] = uint8(rand.Intn(255))
-		crc := crc32.ChecksumIEEE(buffer[:storage.BlockSize-4])
-		binary.BigEndian.PutUint32(buffer[storage.BlockSize-4:storage.BlockSize], crc)
+		buffer[i%util.BlockSize] = uint8(rand.Intn(255))
+		crc := crc32.ChecksumIEEE(buffer[:util.BlockSize-4])
+		binary.BigEndian.PutUint32(buffer[util.BlockSize-4:util.BlockSize], crc)
 		cp.Put(buffer)
 	}
 	for i := 0; i < 1024; i++ {
-		buffer, _ := cp.Get(storage.BlockSize)
-		actualCrc := crc32.ChecksumIEEE(buffer[:storage.BlockSize-4])
-		expectCrc := binary.BigEndian.Uint32(buffer[storage.BlockSize-4 : storage.BlockSize])
+		buffer, _ := cp.Get(util.BlockSize)
+		actualCrc := crc32.ChecksumIEEE(buffer[:util.BlockSize-4])
+		expectCrc := binary.BigEndian.Uint32(buffer[util.BlockSize-4 : util.BlockSize])
 		fmt.Printf("i[%v] actualCrc[%v] expect[%v]\n", i, actualCrc, expectCrc)
 		if actualCrc != expectCrc {
 			fmt.Printf("i[%v] actualCrc[%v] expect[%v]\n", i, actualCrc, expectCrc)
 			t.FailNow()
 		}
+		cp.Put(buffer)
+	}
+}
+
+func TestBufferPool_Tiers(t *testing.T) {
+	cp := NewBufferPool()
+	for _, size := range []int{0, 1, 45, 64, 65, util.BlockSize, util.BlockSize + 1, 15 * util.MB} {
+		buffer := cp.Alloc(size)
+		if len(buffer) != size {
+			t.Fatalf("size[%v] len[%v]", size, len(buffer))
+		}
+		if c := cap(buffer); c != MinPooledSize<<uint(tierOf(size)) || c < size || c >= 2*size && c != MinPooledSize {
+			t.Fatalf("size[%v] cap[%v] not the tier", size, c)
+		}
+		cp.Free(buffer)
+	}
+	if buffer := cp.Alloc(DefaultMaxPooledSize + 1); cap(buffer) != DefaultMaxPooledSize+1 {
+		t.Fatalf("cap[%v] pooled over the max", cap(buffer))
+	}
+	stats := cp.Stats()
+	if stats.Unpooled != 1 {
+		t.Fatalf("unpooled[%v]", stats.Unpooled)
+	}
+	var gets uint64
+	for _, s := range stats.Tiers {
+		gets += s.Gets
+		if s.Misses > s.Gets {
+			t.Fatalf("tier[%v] gets[%v] misses[%v]", s.Size, s.Gets, s.Misses)
+		}
+	}
+	if gets != 8 {
+		t.Fatalf("gets[%v]", gets)
+	}
+}
+
+func TestBufferPool_SetMaxPooledSize(t *testing.T) {
+	cp := NewBufferPool()
+	if err := cp.SetMaxPooledSize(MinPooledSize - 1); err == nil {
+		t.Fatal("max pooled size under the min tier accepted")
+	}
+	if err := cp.SetMaxPooledSize(MaxPooledSize + 1); err == nil {
+		t.Fatal("max pooled size over the max tier accepted")
+	}
+	if err := cp.SetMaxPooledSize(util.BlockSize); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cp.Get(util.BlockSize + 1); err == nil {
+		t.Fatal("get over the max pooled size")
+	}
+	if buffer := cp.Alloc(util.BlockSize + 1); len(buffer) != util.BlockSize+1 || cap(buffer) != util.BlockSize+1 {
+		t.Fatalf("len[%v] cap[%v]", len(buffer), cap(buffer))
+	}
+	// a buffer of another capacity is not pooled
+	cp.Free(make([]byte, 100))
+	if buffer := cp.Alloc(100); cap(buffer) != 128 {
+		t.Fatalf("cap[%v]", cap(buffer))
 	}
 }
@@ -0,0 +1,95 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package util
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// ClientFences is the set of client sessions evicted by the master, requests
+// on a connection of a fenced session are refused by the node until the fence
+// expired. The session of a connection is the one presented by its auth
+// packet, the other clients of the same host are not fenced with it.
+// The fences are kept by the node itself, so a master failover does not
+// lift them before their expire time.
+type ClientFences struct {
+	sync.RWMutex
+	fences   map[string]int64
+	sessions sync.Map //net.Conn -> session
+}
+
+func NewClientFences() *ClientFences {
+	return &ClientFences{fences: make(map[string]int64)}
+}
+
+// Fence refuse the session until expireTime, a later expire time of the same
+// session extends the fence.
+func (f *ClientFences) Fence(session string, expireTime int64) {
+	if session == "" {
+		return
+	}
+	f.Lock()
+	defer f.Unlock()
+	if expireTime > f.fences[session] {
+		f.fences[session] = expireTime
+	}
+}
+
+// SetSession records the client session the connection is of.
+func (f *ClientFences) SetSession(conn net.Conn, session string) {
+	if session != "" {
+		f.sessions.Store(conn, session)
+	}
+}
+
+// Session returns the session of the connection, empty if it presented none.
+func (f *ClientFences) Session(conn net.Conn) string {
+	if value, ok := f.sessions.Load(conn); ok {
+		return value.(string)
+	}
+	return ""
+}
+
+// Release forgets the session of the connection once it is closed.
+func (f *ClientFences) Release(conn net.Conn) {
+	f.sessions.Delete(conn)
+}
+
+// IsFenced tells if the session of the connection is fenced, a connection
+// without session is never.
+func (f *ClientFences) IsFenced(conn net.Conn) bool {
+	value, ok := f.sessions.Load(conn)
+	if !ok {
+		return false
+	}
+	session := value.(string)
+	f.RLock()
+	expireTime, ok := f.fences[session]
+	f.RUnlock()
+	if !ok {
+		return false
+	}
+	if time.Now().Unix() < expireTime {
+		return true
+	}
+	f.Lock()
+	if f.fences[session] == expireTime {
+		delete(f.fences, session)
+	}
+	f.Unlock()
+	return false
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// config keys of TLS, the same for all the roles and the client
+const (
+	CertFile = "certFile"
+	KeyFile  = "keyFile"
+	CaFile   = "caFile"
+)
+
+// Returns the TLS config of the services of the process, nil if certFile is not set.
+// The peers have to present a certificate signed by caFile when verifyPeer is true
+// and caFile is set
+func (c *Config) ServerTLSConfig(verifyPeer bool) (cfg *tls.Config, err error) {
+	certFile, keyFile, caFile := c.GetString(CertFile), c.GetString(KeyFile), c.GetString(CaFile)
+	if certFile == "" {
+		return
+	}
+	cfg = &tls.Config{MinVersion: tls.VersionTLS12}
+	var cert tls.Certificate
+	if cert, err = tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		return nil, fmt.Errorf("load %v %v: %v", certFile, keyFile, err)
+	}
+	cfg.Certificates = []tls.Certificate{cert}
+	if verifyPeer && caFile != "" {
+		if cfg.ClientCAs, err = loadCertPool(caFile); err != nil {
+			return nil, err
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return
+}
+
+// Returns the TLS config of the connections the process makes, nil if neither certFile
+// nor caFile is set. The servers are verified with caFile, or the system roots if it is
+// not set, and the certificate of certFile is presented to the servers requiring one
+func (c *Config) ClientTLSConfig() (cfg *tls.Config, err error) {
+	certFile, keyFile, caFile := c.GetString(CertFile), c.GetString(KeyFile), c.GetString(CaFile)
+	if certFile == "" && caFile == "" {
+		return
+	}
+	cfg = &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		if cfg.RootCAs, err = loadCertPool(caFile); err != nil {
+			return nil, err
+		}
+	}
+	if certFile != "" {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			return nil, fmt.Errorf("load %v %v: %v", certFile, keyFile, err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return
+}
+
+func loadCertPool(caFile string) (pool *x509.CertPool, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(caFile); err != nil {
+		return
+	}
+	pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate in %v", caFile)
+	}
+	return
+}
@@ -0,0 +1,128 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package gctuner tunes GOGC of a server to its memory budget. With the
+// default GOGC a large live heap doubles before it is collected, and a small
+// one is collected too often. The tuner lets the heap grow up to a share of
+// the budget, so the collections are rare while there is room and frequent
+// only when the live heap comes close to the budget. An optional ballast
+// raises the heap the collector paces on without using physical memory.
+package gctuner
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	DefaultGCPercent   = 100
+	MinGCPercent       = 25
+	MaxGCPercent       = 1000
+	DefaultHeapPercent = 70 // share of the budget the heap grows to before a collection
+	DefaultTunePeriod  = 5 * time.Second
+)
+
+type Tuner struct {
+	budget    uint64
+	ballast   []byte
+	gcPercent int32
+	stopC     chan struct{}
+}
+
+// New create a tuner of the memory budget in bytes, a zero budget leaves GOGC
+// untouched. The ballast in bytes is allocated at once and never touched, so
+// it takes virtual memory only.
+func New(budget, ballast uint64) (t *Tuner) {
+	t = &Tuner{
+		budget:    budget,
+		gcPercent: DefaultGCPercent,
+		stopC:     make(chan struct{}),
+	}
+	if ballast > 0 {
+		t.ballast = make([]byte, ballast)
+	}
+	return
+}
+
+func (t *Tuner) Start() {
+	if t.budget == 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(DefaultTunePeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-t.stopC:
+				return
+			case <-ticker.C:
+				t.tune()
+			}
+		}
+	}()
+}
+
+func (t *Tuner) Stop() {
+	close(t.stopC)
+	debug.SetGCPercent(DefaultGCPercent)
+}
+
+// GCPercent returns the GOGC set by the tuner.
+func (t *Tuner) GCPercent() int {
+	return int(atomic.LoadInt32(&t.gcPercent))
+}
+
+func (t *Tuner) tune() {
+	stats := &runtime.MemStats{}
+	runtime.ReadMemStats(stats)
+	old := t.GCPercent()
+	// the heap goal is live*(1+GOGC/100), the live heap of the last
+	// collection is derived from it
+	live := stats.NextGC * 100 / uint64(100+old)
+	percent := gcPercent(t.budget, live, uint64(len(t.ballast)))
+	if percent == old {
+		return
+	}
+	debug.SetGCPercent(percent)
+	atomic.StoreInt32(&t.gcPercent, int32(percent))
+	log.LogInfof("action[gcTune] budget(%v) live(%v) ballast(%v) GOGC from %v to %v",
+		t.budget, live, len(t.ballast), old, percent)
+}
+
+// gcPercent returns the GOGC making the heap goal the share of the budget, the
+// ballast is part of the live heap but not of the budget.
+func gcPercent(budget, live, ballast uint64) int {
+	if live < ballast {
+		live = ballast
+	}
+	if live == 0 {
+		live = 1
+	}
+	goal := budget*DefaultHeapPercent/100 + ballast
+	if goal <= live {
+		return MinGCPercent
+	}
+	percent := (goal - live) * 100 / live
+	if percent < MinGCPercent {
+		return MinGCPercent
+	}
+	if percent > MaxGCPercent {
+		return MaxGCPercent
+	}
+	return int(percent)
+}
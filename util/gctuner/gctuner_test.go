@@ -0,0 +1,41 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package gctuner
+
+import (
+	"testing"
+
+	"github.com/tiglabs/containerfs/util"
+)
+
+func TestGCPercent(t *testing.T) {
+	cases := []struct {
+		budget, live, ballast uint64
+		expect                int
+	}{
+		{10 * util.GB, 1 * util.GB, 0, 600},
+		{10 * util.GB, 5 * util.GB, 0, 40},
+		{10 * util.GB, 8 * util.GB, 0, MinGCPercent},
+		{10 * util.GB, 100 * util.MB, 0, MaxGCPercent},
+		{10 * util.GB, 3 * util.GB, 2 * util.GB, 200},
+		{10 * util.GB, 0, 2 * util.GB, 350},
+	}
+	for _, c := range cases {
+		if percent := gcPercent(c.budget, c.live, c.ballast); percent != c.expect {
+			t.Fatalf("budget(%v) live(%v) ballast(%v) GOGC(%v) expect(%v)",
+				c.budget, c.live, c.ballast, percent, c.expect)
+		}
+	}
+}
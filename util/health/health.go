@@ -0,0 +1,95 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package health serves the liveness and the readiness of a node on the prof
+// port for the probes of Kubernetes and the load balancers: /healthz fails
+// when the node should be restarted, /readyz while it should get no requests.
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+const (
+	HealthzPath = "/healthz"
+	ReadyzPath  = "/readyz"
+)
+
+// Check is the result of one check of the node, a failed check with Warn is
+// reported without failing the probe.
+type Check struct {
+	Name string
+	OK   bool
+	Warn bool   `json:",omitempty"`
+	Msg  string `json:",omitempty"`
+}
+
+// Status is the body of the probes, OK is false if a check without Warn failed.
+type Status struct {
+	Role   string
+	OK     bool
+	Checks []*Check
+}
+
+// Checker returns the checks of a probe.
+type Checker func() []*Check
+
+// NewCheck returns the check name with the message formatted.
+func NewCheck(name string, ok bool, format string, a ...interface{}) *Check {
+	return &Check{Name: name, OK: ok, Msg: fmt.Sprintf(format, a...)}
+}
+
+// NewWarnCheck returns the check name which only warns if it failed.
+func NewWarnCheck(name string, ok bool, format string, a ...interface{}) *Check {
+	c := NewCheck(name, ok, format, a...)
+	c.Warn = true
+	return c
+}
+
+// NewStatus runs the checks of role.
+func NewStatus(role string, checker Checker) (s *Status) {
+	s = &Status{Role: role, OK: true, Checks: checker()}
+	for _, c := range s.Checks {
+		if !c.OK && !c.Warn {
+			s.OK = false
+		}
+	}
+	return
+}
+
+// Handler serves the status of the checks, 503 if it is not OK.
+func Handler(role string, checker Checker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := NewStatus(role, checker)
+		data, err := json.Marshal(s)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !s.OK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(data)
+	}
+}
+
+// Register serves the probes of role on the default mux.
+func Register(role string, healthz, readyz Checker) {
+	http.HandleFunc(HealthzPath, Handler(role, healthz))
+	http.HandleFunc(ReadyzPath, Handler(role, readyz))
+}
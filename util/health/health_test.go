@@ -0,0 +1,52 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	ready := false
+	handler := Handler("datanode", func() []*Check {
+		return []*Check{
+			NewCheck("disks", true, "%v of %v disks available", 2, 2),
+			NewCheck("partitions", ready, "loaded"),
+			NewWarnCheck("master", false, "no heartbeat"),
+		}
+	})
+	for _, ready = range []bool{false, true} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, ReadyzPath, nil))
+		expect := http.StatusServiceUnavailable
+		if ready {
+			expect = http.StatusOK
+		}
+		if w.Code != expect {
+			t.Fatalf("ready(%v) status code %v, expect %v", ready, w.Code, expect)
+		}
+		s := new(Status)
+		if err := json.Unmarshal(w.Body.Bytes(), s); err != nil {
+			t.Fatal(err)
+		}
+		if s.Role != "datanode" || s.OK != ready || len(s.Checks) != 3 || !s.Checks[2].Warn ||
+			s.Checks[0].Msg != "2 of 2 disks available" {
+			t.Fatalf("ready(%v) status %+v", ready, s)
+		}
+	}
+}
@@ -14,20 +14,47 @@
 
 package util
 
-import "net"
+import (
+	"fmt"
+	"net"
+	"strings"
+)
 
+// GetLocalIP return the first non loopback IPv4 address of this host,
+// if the host has none, the first global unicast IPv6 address is returned.
 func GetLocalIP() (localIP string, err error) {
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
 		return
 	}
+	var ip6 string
 	for _, addr := range addrs {
 		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
 			if ipnet.IP.To4() != nil {
 				localIP = ipnet.IP.String()
 				return
 			}
+			if ip6 == "" && ipnet.IP.IsGlobalUnicast() {
+				ip6 = ipnet.IP.String()
+			}
 		}
 	}
+	localIP = ip6
 	return
 }
+
+// GetHost return the host part of addr, which may be "ip:port",
+// "[ipv6]:port" or a bare ip.
+func GetHost(addr string) string {
+	addr = strings.TrimSpace(addr)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
+
+// JoinHostPort combine host and port into an address, IPv6 host is
+// enclosed in square brackets.
+func JoinHostPort(host string, port interface{}) string {
+	return net.JoinHostPort(strings.Trim(host, "[]"), fmt.Sprint(port))
+}
@@ -24,7 +24,9 @@ import (
 	"path"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -45,6 +47,7 @@ const (
 	FileOpt              = os.O_RDWR | os.O_CREATE | os.O_APPEND
 	WriterBufferInitSize = 4 * 1024 * 1024
 	WriterBufferLenLimit = 4 * 1024 * 1024
+	WriterBufferMaxLen   = 64 * 1024 * 1024 // the logs are dropped over it while the file blocks
 )
 
 var levelPrefixes = []string{
@@ -57,6 +60,16 @@ var levelPrefixes = []string{
 	"[WRITE]",
 }
 
+var levelNames = []string{
+	"debug",
+	"info",
+	"warn",
+	"error",
+	"fatal",
+	"read",
+	"write",
+}
+
 type flusher interface {
 	Flush()
 }
@@ -68,6 +81,8 @@ type asyncWriter struct {
 	flushC   chan bool
 	closed   bool
 	mu       sync.Mutex
+	ring     *ringBuffer
+	flushMu  sync.Mutex
 }
 
 func (writer *asyncWriter) flushScheduler() {
@@ -91,6 +106,12 @@ func (writer *asyncWriter) flushScheduler() {
 
 func (writer *asyncWriter) Write(p []byte) (n int, err error) {
 	writer.mu.Lock()
+	if writer.buffer.Len()+len(p) > WriterBufferMaxLen {
+		writer.mu.Unlock()
+		atomic.AddUint64(&droppedBytes, uint64(len(p)))
+		setDegraded("log file write blocked")
+		return len(p), nil
+	}
 	writer.buffer.Write(p)
 	writer.mu.Unlock()
 	if writer.buffer.Len() > WriterBufferLenLimit {
@@ -119,6 +140,8 @@ func (writer *asyncWriter) Flush() {
 }
 
 func (writer *asyncWriter) flushToFile() {
+	writer.flushMu.Lock()
+	defer writer.flushMu.Unlock()
 	writer.mu.Lock()
 	flushLength := writer.buffer.Len()
 	if writer.flushTmp == nil || cap(writer.flushTmp) < flushLength {
@@ -127,7 +150,25 @@ func (writer *asyncWriter) flushToFile() {
 	copy(writer.flushTmp, writer.buffer.Bytes())
 	writer.buffer.Reset()
 	writer.mu.Unlock()
-	writer.file.Write(writer.flushTmp[:flushLength])
+	data := writer.flushTmp[:flushLength]
+	if IsDegraded() {
+		writer.ring.write(data)
+		return
+	}
+	// the logs kept while degraded go first
+	if len(writer.ring.data) != 0 {
+		if n, err := writer.file.Write(writer.ring.data); err != nil {
+			writer.ring.data = writer.ring.data[:copy(writer.ring.data, writer.ring.data[n:])]
+			writer.ring.write(data)
+			setDegraded(err.Error())
+			return
+		}
+		writer.ring.reset()
+	}
+	if n, err := writer.file.Write(data); err != nil {
+		writer.ring.write(data[n:])
+		setDegraded(err.Error())
+	}
 }
 
 func newAsyncWriter(out *os.File) *asyncWriter {
@@ -135,6 +176,7 @@ func newAsyncWriter(out *os.File) *asyncWriter {
 		file:   out,
 		buffer: bytes.NewBuffer(make([]byte, 0, WriterBufferInitSize)),
 		flushC: make(chan bool, 1000),
+		ring:   newRingBuffer(RingBufferSize),
 	}
 	go w.flushScheduler()
 	return w
@@ -176,7 +218,7 @@ type Log struct {
 	infoLogger   *closableLogger
 	readLogger   *closableLogger
 	updateLogger *closableLogger
-	level        Level
+	levels       atomic.Value // *levelConfig
 	msgC         chan string
 	startTime    time.Time
 }
@@ -211,6 +253,7 @@ func InitLog(dir, module string, level Level) (*Log, error) {
 	}
 	l.startTime = time.Now()
 	go l.checkLogRotation(dir, module)
+	go l.checkLogSpace()
 
 	gLog = l
 	return l, nil
@@ -218,6 +261,10 @@ func InitLog(dir, module string, level Level) (*Log, error) {
 
 func (l *Log) initLog(logDir, module string, level Level) error {
 	logOpt := log.LstdFlags | log.Lmicroseconds
+	if IsJSON() {
+		// the time is a field of the json line
+		logOpt = 0
+	}
 
 	getNewLog := func(logFileName string) (newLogger *closableLogger, err error) {
 		var (
@@ -237,7 +284,7 @@ func (l *Log) initLog(logDir, module string, level Level) error {
 			return err
 		}
 	}
-	l.level = level
+	l.levels.Store(&levelConfig{level: level})
 	return nil
 }
 
@@ -257,6 +304,67 @@ func (l *Log) SetPrefix(s, level string) string {
 	return level + " " + file + ":" + strconv.Itoa(line) + ": " + s
 }
 
+// caller is the call site of a log line.
+type caller struct {
+	file       string
+	line       int
+	suppressed uint64 // lines of the call site dropped by the sampling since the last one logged
+}
+
+/*the call site of the log function, and whether its module logs at level, the caller of the log function is 2 frames up*/
+func (l *Log) check(level Level) (c caller, ok bool) {
+	cfg := l.levels.Load().(*levelConfig)
+	// the call site is only looked up for the filtered lines if a module has its own level
+	if len(cfg.modules) == 0 && level&cfg.level != cfg.level {
+		return
+	}
+	_, c.file, c.line, _ = runtime.Caller(2)
+	moduleLevel := cfg.level
+	if len(cfg.modules) != 0 {
+		if m, found := cfg.modules[moduleOf(c.file)]; found {
+			moduleLevel = m
+		}
+	}
+	if level&moduleLevel != moduleLevel {
+		return
+	}
+	if level == WarnLevel || level == ErrorLevel {
+		ok, c.suppressed = sample(c.file, c.line)
+		return
+	}
+	return c, true
+}
+
+func (l *Log) output(logger *closableLogger, level int, c caller, s string) {
+	file := shortFile(c.file) + ":" + strconv.Itoa(c.line)
+	if IsJSON() {
+		logger.Output(2, jsonLine(time.Now(), levelNames[level], moduleOf(c.file), file, s, c.suppressed))
+		return
+	}
+	if c.suppressed != 0 {
+		s = strings.TrimSuffix(s, "\n") + " [" + strconv.FormatUint(c.suppressed, 10) + " similar lines suppressed]"
+	}
+	logger.Output(2, levelPrefixes[level]+" "+file+": "+s)
+}
+
+/*the base name of the source file*/
+func shortFile(file string) string {
+	if i := strings.LastIndexByte(file, '/'); i >= 0 {
+		return file[i+1:]
+	}
+	return file
+}
+
+/*the module of a source file is the dir it is in, the name of its package*/
+func moduleOf(file string) string {
+	i := strings.LastIndexByte(file, '/')
+	if i < 0 {
+		return ""
+	}
+	dir := file[:i]
+	return dir[strings.LastIndexByte(dir, '/')+1:]
+}
+
 func (l *Log) Flush() {
 	loggers := []*closableLogger{
 		l.debugLogger,
@@ -277,108 +385,99 @@ func LogWarn(v ...interface{}) {
 	if gLog == nil {
 		return
 	}
-	if WarnLevel&gLog.level != gLog.level {
+	c, ok := gLog.check(WarnLevel)
+	if !ok {
 		return
 	}
-	s := fmt.Sprintln(v...)
-	s = gLog.SetPrefix(s, levelPrefixes[2])
-	gLog.warnLogger.Output(2, s)
+	gLog.output(gLog.warnLogger, 2, c, fmt.Sprintln(v...))
 }
 
 func LogWarnf(format string, v ...interface{}) {
 	if gLog == nil {
 		return
 	}
-	if WarnLevel&gLog.level != gLog.level {
+	c, ok := gLog.check(WarnLevel)
+	if !ok {
 		return
 	}
-	s := fmt.Sprintf(format, v...)
-	s = gLog.SetPrefix(s, levelPrefixes[2])
-	gLog.warnLogger.Output(2, s)
+	gLog.output(gLog.warnLogger, 2, c, fmt.Sprintf(format, v...))
 }
 
 func LogInfo(v ...interface{}) {
 	if gLog == nil {
 		return
 	}
-	if InfoLevel&gLog.level != gLog.level {
+	c, ok := gLog.check(InfoLevel)
+	if !ok {
 		return
 	}
-	s := fmt.Sprintln(v...)
-	s = gLog.SetPrefix(s, levelPrefixes[1])
-	gLog.infoLogger.Output(2, s)
+	gLog.output(gLog.infoLogger, 1, c, fmt.Sprintln(v...))
 }
 
 func LogInfof(format string, v ...interface{}) {
 	if gLog == nil {
 		return
 	}
-	if InfoLevel&gLog.level != gLog.level {
+	c, ok := gLog.check(InfoLevel)
+	if !ok {
 		return
 	}
-	s := fmt.Sprintf(format, v...)
-	s = gLog.SetPrefix(s, levelPrefixes[1])
-	gLog.infoLogger.Output(2, s)
+	gLog.output(gLog.infoLogger, 1, c, fmt.Sprintf(format, v...))
 }
 
 func LogError(v ...interface{}) {
 	if gLog == nil {
 		return
 	}
-	if ErrorLevel&gLog.level != gLog.level {
+	c, ok := gLog.check(ErrorLevel)
+	if !ok {
 		return
 	}
-	s := fmt.Sprintln(v...)
-	s = gLog.SetPrefix(s, levelPrefixes[3])
-	gLog.errorLogger.Output(2, s)
+	gLog.output(gLog.errorLogger, 3, c, fmt.Sprintln(v...))
 }
 
 func LogErrorf(format string, v ...interface{}) {
 	if gLog == nil {
 		return
 	}
-	if ErrorLevel&gLog.level != gLog.level {
+	c, ok := gLog.check(ErrorLevel)
+	if !ok {
 		return
 	}
-	s := fmt.Sprintf(format, v...)
-	s = gLog.SetPrefix(s, levelPrefixes[3])
-	gLog.errorLogger.Print(s)
+	gLog.output(gLog.errorLogger, 3, c, fmt.Sprintf(format, v...))
 }
 
 func LogDebug(v ...interface{}) {
 	if gLog == nil {
 		return
 	}
-	if DebugLevel&gLog.level != gLog.level {
+	c, ok := gLog.check(DebugLevel)
+	if !ok {
 		return
 	}
-	s := fmt.Sprintln(v...)
-	s = gLog.SetPrefix(s, levelPrefixes[0])
-	gLog.debugLogger.Print(s)
+	gLog.output(gLog.debugLogger, 0, c, fmt.Sprintln(v...))
 }
 
 func LogDebugf(format string, v ...interface{}) {
 	if gLog == nil {
 		return
 	}
-	if DebugLevel&gLog.level != gLog.level {
+	c, ok := gLog.check(DebugLevel)
+	if !ok {
 		return
 	}
-	s := fmt.Sprintf(format, v...)
-	s = gLog.SetPrefix(s, levelPrefixes[0])
-	gLog.debugLogger.Output(2, s)
+	gLog.output(gLog.debugLogger, 0, c, fmt.Sprintf(format, v...))
 }
 
 func LogFatal(v ...interface{}) {
 	if gLog == nil {
 		return
 	}
-	if FatalLevel&gLog.level != gLog.level {
+	c, ok := gLog.check(FatalLevel)
+	if !ok {
 		return
 	}
-	s := fmt.Sprintln(v...)
-	s = gLog.SetPrefix(s, levelPrefixes[4])
-	gLog.errorLogger.Output(2, s)
+	gLog.output(gLog.errorLogger, 4, c, fmt.Sprintln(v...))
 	os.Exit(1)
 }
 
@@ -386,12 +485,11 @@ func LogFatalf(format string, v ...interface{}) {
 	if gLog == nil {
 		return
 	}
-	if FatalLevel&gLog.level != gLog.level {
+	c, ok := gLog.check(FatalLevel)
+	if !ok {
 		return
 	}
-	s := fmt.Sprintf(format, v...)
-	s = gLog.SetPrefix(s, levelPrefixes[4])
-	gLog.errorLogger.Output(2, s)
+	gLog.output(gLog.errorLogger, 4, c, fmt.Sprintf(format, v...))
 	os.Exit(1)
 }
 
@@ -399,48 +497,44 @@ func LogRead(v ...interface{}) {
 	if gLog == nil {
 		return
 	}
-	if ReadLevel&gLog.level != gLog.level {
+	c, ok := gLog.check(ReadLevel)
+	if !ok {
 		return
 	}
-	s := fmt.Sprintln(v...)
-	s = gLog.SetPrefix(s, levelPrefixes[5])
-	gLog.readLogger.Output(2, s)
+	gLog.output(gLog.readLogger, 5, c, fmt.Sprintln(v...))
 }
 
 func LogReadf(format string, v ...interface{}) {
 	if gLog == nil {
 		return
 	}
-	if ReadLevel&gLog.level != gLog.level {
+	c, ok := gLog.check(ReadLevel)
+	if !ok {
 		return
 	}
-	s := fmt.Sprintf(format, v...)
-	s = gLog.SetPrefix(s, levelPrefixes[5])
-	gLog.readLogger.Output(2, s)
+	gLog.output(gLog.readLogger, 5, c, fmt.Sprintf(format, v...))
 }
 
 func LogWrite(v ...interface{}) {
 	if gLog == nil {
 		return
 	}
-	if UpdateLevel&gLog.level != gLog.level {
+	c, ok := gLog.check(UpdateLevel)
+	if !ok {
 		return
 	}
-	s := fmt.Sprintln(v...)
-	s = gLog.SetPrefix(s, levelPrefixes[6])
-	gLog.updateLogger.Output(2, s)
+	gLog.output(gLog.updateLogger, 6, c, fmt.Sprintln(v...))
 }
 
 func LogWritef(format string, v ...interface{}) {
 	if gLog == nil {
 		return
 	}
-	if UpdateLevel&gLog.level != gLog.level {
+	c, ok := gLog.check(UpdateLevel)
+	if !ok {
 		return
 	}
-	s := fmt.Sprintf(format, v...)
-	s = gLog.SetPrefix(s, levelPrefixes[6])
-	gLog.updateLogger.Output(2, s)
+	gLog.output(gLog.updateLogger, 6, c, fmt.Sprintf(format, v...))
 }
 
 func LogFlush() {
@@ -0,0 +1,211 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	LevelPath      = "/logLevel"
+	JSONTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+var (
+	jsonFormat int32
+	levelMu    sync.Mutex
+)
+
+// levelConfig is replaced as a whole on a change, the log functions read it
+// without a lock.
+type levelConfig struct {
+	level   Level
+	modules map[string]Level
+}
+
+// LevelView is the log level and the levels of the modules set apart from it.
+type LevelView struct {
+	Level   string
+	Modules map[string]string
+}
+
+type jsonEntry struct {
+	Time       string
+	Level      string
+	Module     string
+	File       string
+	Msg        string
+	Suppressed uint64 `json:",omitempty"`
+}
+
+// IsJSON returns true if the log lines are written as json objects.
+func IsJSON() bool {
+	return atomic.LoadInt32(&jsonFormat) != 0
+}
+
+// SetJSON writes the log lines as json objects with the time, the level, the
+// module, the call site and the message instead of the text lines.
+func SetJSON(enabled bool) {
+	logOpt := log.LstdFlags | log.Lmicroseconds
+	if enabled {
+		atomic.StoreInt32(&jsonFormat, 1)
+		logOpt = 0
+	} else {
+		atomic.StoreInt32(&jsonFormat, 0)
+	}
+	if gLog == nil {
+		return
+	}
+	for _, logger := range []*closableLogger{gLog.debugLogger, gLog.infoLogger, gLog.warnLogger,
+		gLog.errorLogger, gLog.readLogger, gLog.updateLogger} {
+		logger.SetFlags(logOpt)
+	}
+}
+
+func jsonLine(t time.Time, level, module, file, msg string, suppressed uint64) string {
+	data, err := json.Marshal(&jsonEntry{
+		Time:       t.Format(JSONTimeFormat),
+		Level:      level,
+		Module:     module,
+		File:       file,
+		Msg:        strings.TrimSuffix(msg, "\n"),
+		Suppressed: suppressed,
+	})
+	if err != nil {
+		return msg
+	}
+	return string(data)
+}
+
+// ParseLevel returns the level of its name, debug, info, warn or error.
+func ParseLevel(name string) (level Level, err error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		level = DebugLevel
+	case "info":
+		level = InfoLevel
+	case "warn":
+		level = WarnLevel
+	case "error":
+		level = ErrorLevel
+	default:
+		err = fmt.Errorf("unknown log level %v", name)
+	}
+	return
+}
+
+func levelName(level Level) string {
+	switch level {
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warn"
+	case ErrorLevel:
+		return "error"
+	case FatalLevel:
+		return "fatal"
+	}
+	return fmt.Sprintf("%v", uint8(level))
+}
+
+/*apply f to a copy of the level config*/
+func updateLevels(f func(cfg *levelConfig)) {
+	if gLog == nil {
+		return
+	}
+	levelMu.Lock()
+	defer levelMu.Unlock()
+	old := gLog.levels.Load().(*levelConfig)
+	cfg := &levelConfig{level: old.level, modules: make(map[string]Level, len(old.modules))}
+	for module, level := range old.modules {
+		cfg.modules[module] = level
+	}
+	f(cfg)
+	gLog.levels.Store(cfg)
+}
+
+// SetLevel changes the level of the modules without a level of their own.
+func SetLevel(level Level) {
+	updateLevels(func(cfg *levelConfig) {
+		cfg.level = level
+	})
+}
+
+// SetModuleLevel changes the level of the lines logged by the source files of
+// module, the dir of the files, apart from the level of the others.
+func SetModuleLevel(module string, level Level) {
+	updateLevels(func(cfg *levelConfig) {
+		cfg.modules[module] = level
+	})
+}
+
+// ResetModuleLevel logs module at the level of the others again.
+func ResetModuleLevel(module string) {
+	updateLevels(func(cfg *levelConfig) {
+		delete(cfg.modules, module)
+	})
+}
+
+func GetLevels() (view *LevelView) {
+	view = &LevelView{Modules: make(map[string]string)}
+	if gLog == nil {
+		return
+	}
+	cfg := gLog.levels.Load().(*levelConfig)
+	view.Level = levelName(cfg.level)
+	for module, level := range cfg.modules {
+		view.Modules[module] = levelName(level)
+	}
+	return
+}
+
+// LevelHandle shows the log levels, sets the level with level, or the level
+// of a module with module and level, an empty level resets the module.
+func LevelHandle(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	module := r.FormValue("module")
+	name := r.FormValue("level")
+	if module != "" && name == "" {
+		ResetModuleLevel(module)
+	} else if name != "" {
+		level, err := ParseLevel(name)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if module == "" {
+			SetLevel(level)
+		} else {
+			SetModuleLevel(module, level)
+		}
+	}
+	data, err := json.Marshal(GetLevels())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write(data)
+}
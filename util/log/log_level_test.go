@@ -0,0 +1,100 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"strings"
+	"testing"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (b *bufferCloser) Close() error {
+	return nil
+}
+
+func newTestLog(level Level) (l *Log, out *bufferCloser) {
+	out = new(bufferCloser)
+	logger := newCloseableLogger(out, "", 0)
+	l = &Log{debugLogger: logger, infoLogger: logger, warnLogger: logger, errorLogger: logger,
+		readLogger: logger, updateLogger: logger}
+	l.levels.Store(&levelConfig{level: level})
+	return
+}
+
+func TestModuleOf(t *testing.T) {
+	for file, expect := range map[string]string{
+		"/go/src/github.com/tiglabs/containerfs/datanode/partition.go": "datanode",
+		"sdk/data/stream/stream_writer.go":                             "stream",
+		"log.go":                                                       "",
+	} {
+		if m := moduleOf(file); m != expect {
+			t.Fatalf("module of %v is %v, expect %v", file, m, expect)
+		}
+	}
+}
+
+func TestLog_ModuleLevel(t *testing.T) {
+	l, out := newTestLog(WarnLevel)
+	gLog = l
+	defer func() { gLog = nil }()
+	SetJSON(true)
+	defer SetJSON(false)
+	LogDebugf("filtered %v", 1)
+	SetModuleLevel("log", DebugLevel)
+	LogDebugf("logged %v", 2)
+	ResetModuleLevel("log")
+	LogDebugf("filtered %v", 3)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("lines %q, expect 1", lines)
+	}
+	entry := new(jsonEntry)
+	if err := json.Unmarshal([]byte(lines[0]), entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Level != "debug" || entry.Module != "log" || entry.Msg != "logged 2" ||
+		!strings.HasPrefix(entry.File, "log_level_test.go:") {
+		t.Fatalf("entry %+v", entry)
+	}
+	if view := GetLevels(); view.Level != "warn" || len(view.Modules) != 0 {
+		t.Fatalf("levels %+v", view)
+	}
+}
+
+func TestLog_Sample(t *testing.T) {
+	l, out := newTestLog(ErrorLevel)
+	gLog = l
+	defer func() { gLog = nil }()
+	l.errorLogger.SetFlags(log.LstdFlags)
+	dropped := SampledLines()
+	n := DefaultSampleLines + 10*SampleThereafter
+	for i := 0; i < n; i++ {
+		LogErrorf("repair extent %v", i)
+	}
+	// the loop may cross a window, which logs the first lines again
+	logged := strings.Count(out.String(), "\n")
+	if logged < DefaultSampleLines+10 || logged > 2*(DefaultSampleLines+10) {
+		t.Fatalf("logged %v lines, expect %v", logged, DefaultSampleLines+10)
+	}
+	if d := SampledLines() - dropped; d != uint64(n-logged) {
+		t.Fatalf("sampled %v lines, expect %v", d, n-logged)
+	}
+}
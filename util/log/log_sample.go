@@ -0,0 +1,82 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package log
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultSampleLines = 100 // warn and error lines of a call site logged in a window before the sampling
+	SampleThereafter   = 100 // one of the lines over it is logged
+	SampleWindow       = time.Second
+)
+
+var (
+	sampleLines    int64 = DefaultSampleLines
+	sampledLines   uint64
+	sampleCounters sync.Map // sampleSite -> *sampleCounter
+)
+
+type sampleSite struct {
+	file string
+	line int
+}
+
+type sampleCounter struct {
+	window     int64
+	count      uint64
+	suppressed uint64
+}
+
+// SetSampleLines sets the warn and error lines of a call site logged in a
+// second before only one in SampleThereafter is logged, negative disables it.
+func SetSampleLines(lines int64) {
+	atomic.StoreInt64(&sampleLines, lines)
+}
+
+// SampledLines returns the lines dropped by the sampling since the start.
+func SampledLines() uint64 {
+	return atomic.LoadUint64(&sampledLines)
+}
+
+/*whether the line of the call site is logged, and the lines of the call site dropped before it*/
+func sample(file string, line int) (ok bool, suppressed uint64) {
+	first := atomic.LoadInt64(&sampleLines)
+	if first < 0 {
+		return true, 0
+	}
+	key := sampleSite{file: file, line: line}
+	v, found := sampleCounters.Load(key)
+	if !found {
+		v, _ = sampleCounters.LoadOrStore(key, &sampleCounter{})
+	}
+	c := v.(*sampleCounter)
+	window := time.Now().UnixNano() / int64(SampleWindow)
+	if w := atomic.LoadInt64(&c.window); w != window && atomic.CompareAndSwapInt64(&c.window, w, window) {
+		atomic.StoreUint64(&c.count, 0)
+		suppressed = atomic.SwapUint64(&c.suppressed, 0)
+	}
+	n := atomic.AddUint64(&c.count, 1)
+	if n <= uint64(first) || (n-uint64(first))%SampleThereafter == 0 {
+		return true, suppressed
+	}
+	// the count of the last window goes with the next line logged
+	atomic.AddUint64(&c.suppressed, suppressed+1)
+	atomic.AddUint64(&sampledLines, 1)
+	return false, 0
+}
@@ -0,0 +1,172 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultLogMinFreeSpace = 512 * 1024 * 1024 // bytes kept free on the disk of the log dir
+	LogSpaceCheckInterval  = 10 * time.Second
+	RingBufferSize         = 1024 * 1024 // bytes of each log file kept in memory while degraded
+)
+
+var (
+	minFreeSpace uint64 = DefaultLogMinFreeSpace
+	degraded     int32
+	droppedBytes uint64
+)
+
+// IsDegraded returns true if the log dir is short of space or failed a write,
+// the logs are kept in the memory and written once the space is back.
+func IsDegraded() bool {
+	return atomic.LoadInt32(&degraded) != 0
+}
+
+// DroppedBytes returns the bytes of the log lost since the start, the oldest of
+// the memory kept while degraded are dropped first.
+func DroppedBytes() uint64 {
+	return atomic.LoadUint64(&droppedBytes)
+}
+
+func setDegraded(reason string) {
+	if atomic.CompareAndSwapInt32(&degraded, 0, 1) {
+		// the log itself can't be written, the alert goes to the stderr
+		fmt.Fprintf(os.Stderr, "%v logging degraded, logs kept in memory: %v\n",
+			time.Now().Format("2006/01/02 15:04:05"), reason)
+	}
+}
+
+// ringBuffer keeps the last size bytes written, the oldest whole lines are
+// dropped once it is full.
+type ringBuffer struct {
+	data []byte
+	size int
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{size: size}
+}
+
+func (r *ringBuffer) write(p []byte) {
+	if len(p) > r.size {
+		atomic.AddUint64(&droppedBytes, uint64(len(r.data)+len(p)-r.size))
+		r.data = append(r.data[:0], p[len(p)-r.size:]...)
+		return
+	}
+	if over := len(r.data) + len(p) - r.size; over > 0 {
+		if i := bytes.IndexByte(r.data[over:], '\n'); i >= 0 {
+			over += i + 1
+		}
+		if over > len(r.data) {
+			over = len(r.data)
+		}
+		atomic.AddUint64(&droppedBytes, uint64(over))
+		r.data = r.data[:copy(r.data, r.data[over:])]
+	}
+	r.data = append(r.data, p...)
+}
+
+func (r *ringBuffer) reset() {
+	r.data = r.data[:0]
+}
+
+func freeSpace(dir string) (free uint64, err error) {
+	fs := syscall.Statfs_t{}
+	if err = syscall.Statfs(dir, &fs); err != nil {
+		return
+	}
+	return fs.Bavail * uint64(fs.Bsize), nil
+}
+
+/*the rotated log files of module in dir, the oldest first*/
+func rotatedLogFiles(dir, module string) (files []string, err error) {
+	var infos []os.FileInfo
+	if infos, err = ioutil.ReadDir(dir); err != nil {
+		return
+	}
+	dates := make(map[string]time.Time)
+	for _, info := range infos {
+		name := info.Name()
+		i := strings.LastIndex(name, ".")
+		if info.IsDir() || i < 0 || !strings.HasPrefix(name, module+"_") {
+			continue
+		}
+		date, err := time.Parse(FileNameDateFormat, name[i+1:])
+		if err != nil {
+			continue
+		}
+		dates[name] = date
+		files = append(files, name)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if !dates[files[i]].Equal(dates[files[j]]) {
+			return dates[files[i]].Before(dates[files[j]])
+		}
+		return files[i] < files[j]
+	})
+	return
+}
+
+// checkLogSpace removes the oldest rotated log files while the free space of
+// the log dir is under the min, and degrades the logging if that is not enough.
+// The logging is restored once the space is back.
+func (l *Log) checkLogSpace() {
+	for {
+		time.Sleep(LogSpaceCheckInterval)
+		free, err := freeSpace(l.dir)
+		if err != nil {
+			continue
+		}
+		if free < minFreeSpace {
+			free = l.purgeLogFiles(free)
+		}
+		if free < minFreeSpace {
+			setDegraded(fmt.Sprintf("free space %v of log dir %v under %v", free, l.dir, minFreeSpace))
+		} else if atomic.CompareAndSwapInt32(&degraded, 1, 0) {
+			l.Flush()
+			LogWarnf("action[checkLogSpace] logging restored, free space(%v) dropped bytes(%v).", free, DroppedBytes())
+		}
+	}
+}
+
+/*remove the oldest rotated log files until the free space is over the min, return the free space*/
+func (l *Log) purgeLogFiles(free uint64) uint64 {
+	files, err := rotatedLogFiles(l.dir, l.module)
+	if err != nil {
+		return free
+	}
+	for _, name := range files {
+		if err = os.Remove(path.Join(l.dir, name)); err != nil {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "%v log dir %v short of space, removed %v\n",
+			time.Now().Format("2006/01/02 15:04:05"), l.dir, name)
+		if free, err = freeSpace(l.dir); err != nil || free >= minFreeSpace {
+			break
+		}
+	}
+	return free
+}
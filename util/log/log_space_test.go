@@ -0,0 +1,92 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package log
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRingBuffer_Write(t *testing.T) {
+	dropped := DroppedBytes()
+	r := newRingBuffer(10)
+	r.write([]byte("abc\n"))
+	r.write([]byte("def\n"))
+	if string(r.data) != "abc\ndef\n" {
+		t.Fatalf("ring buffer not full: %q", r.data)
+	}
+	// the oldest whole line is dropped
+	r.write([]byte("gh\n"))
+	if string(r.data) != "def\ngh\n" {
+		t.Fatalf("ring buffer full: %q", r.data)
+	}
+	if d := DroppedBytes() - dropped; d != 4 {
+		t.Fatalf("dropped %v bytes, expect 4", d)
+	}
+	r.write([]byte("0123456789ab"))
+	if string(r.data) != "23456789ab" {
+		t.Fatalf("write larger than the ring buffer: %q", r.data)
+	}
+}
+
+func TestRotatedLogFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log_space")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"m_info.log", "m_info.log.2018-01-02", "m_warn.log.2018-01-01",
+		"m_error.log.2018-01-02", "other_info.log.2018-01-01", "m_info.log.tmp"} {
+		if err = ioutil.WriteFile(path.Join(dir, name), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := rotatedLogFiles(dir, "m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"m_warn.log.2018-01-01", "m_error.log.2018-01-02", "m_info.log.2018-01-02"}
+	if !reflect.DeepEqual(files, expect) {
+		t.Fatalf("rotated files %v, expect %v", files, expect)
+	}
+}
+
+func TestAsyncWriter_Degraded(t *testing.T) {
+	f, err := ioutil.TempFile("", "log_space")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	w := &asyncWriter{file: f, buffer: new(bytes.Buffer), ring: newRingBuffer(RingBufferSize)}
+	atomic.StoreInt32(&degraded, 1)
+	w.Write([]byte("kept\n"))
+	w.flushToFile()
+	atomic.StoreInt32(&degraded, 0)
+	w.Write([]byte("new\n"))
+	w.flushToFile()
+	f.Close()
+	data, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "kept\nnew\n" {
+		t.Fatalf("file after degraded: %q", data)
+	}
+}
@@ -16,6 +16,7 @@ package util
 
 import (
 	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/tiglabs/containerfs/util/log"
@@ -31,29 +32,85 @@ var (
 	ErrNoValidMaster = errors.New("no valid master")
 )
 
+var masterTLSConfig *tls.Config
+
+// SetMasterTLSConfig makes the requests to the masters use https verified with cfg, http if cfg is nil
+func SetMasterTLSConfig(cfg *tls.Config) {
+	masterTLSConfig = cfg
+}
+
+// MasterURL returns the url of path on the master of addr
+func MasterURL(addr, path string) string {
+	if masterTLSConfig != nil {
+		return fmt.Sprintf("https://%s%s", addr, path)
+	}
+	return fmt.Sprintf("http://%s%s", addr, path)
+}
+
+// NewMasterClient returns a client of the masters with the timeout
+func NewMasterClient(timeout time.Duration) *http.Client {
+	client := &http.Client{Timeout: timeout}
+	if masterTLSConfig != nil {
+		client.Transport = &http.Transport{TLSClientConfig: masterTLSConfig}
+	}
+	return client
+}
+
 type MasterHelper interface {
 	AddNode(address string)
 	Nodes() []string
 	Leader() string
 	Request(method, path string, param map[string]string, body []byte) (data []byte, err error)
+	ReadRequest(method, path string, param map[string]string, body []byte) (data []byte, err error)
+	Stop()
 }
 
 type masterHelper struct {
 	masters   []string
 	leaderIdx int
+	readIdx   int // the master the last read only query was sent to
 	skipMarks *Set
+	domains   []string            // configured SRV records and DNS names
+	resolved  map[string][]string // domain -> master addresses it resolved to
+	stopC     chan struct{}       // closed to stop the periodic resolve of the domains
 	sync.RWMutex
 }
 
+// the resolver of the domains, swapped by the tests
+var resolveMasterAddr = ResolveMasterAddr
+
 func (helper *masterHelper) AddNode(address string) {
 	helper.Lock()
 	defer helper.Unlock()
-	helper.updateMaster(address)
+	if !IsDomainAddr(address) {
+		helper.updateMaster(address)
+		return
+	}
+	helper.domains = append(helper.domains, address)
+	helper.applyResolved(resolveDomains([]string{address}))
+	if helper.stopC == nil {
+		helper.stopC = make(chan struct{})
+		go helper.resolveScheduler(MasterResolveInterval, helper.stopC)
+	}
+}
+
+// Stop stops the periodic resolve of the domains once the node or the client
+// owning the helper stops, the next domain added starts it again.
+func (helper *masterHelper) Stop() {
+	helper.Lock()
+	defer helper.Unlock()
+	if helper.stopC != nil {
+		close(helper.stopC)
+		helper.stopC = nil
+	}
 }
 
 func (helper *masterHelper) Leader() string {
 	helper.RLock()
 	defer helper.RUnlock()
+	if len(helper.masters) == 0 {
+		return ""
+	}
 	return helper.masters[helper.leaderIdx]
 }
 
@@ -62,9 +119,124 @@ func (helper *masterHelper) Request(method, path string, param map[string]string
 	defer helper.Unlock()
 	respData, err = helper.request(method, path, param, reqData)
 	helper.skipMarks.RemoveAll()
+	if err == ErrNoValidMaster && len(helper.domains) > 0 {
+		// masters may have been replaced, resolve the domains again and retry.
+		helper.applyResolved(resolveDomains(helper.domains))
+		respData, err = helper.request(method, path, param, reqData)
+		helper.skipMarks.RemoveAll()
+	}
 	return
 }
 
+// ReadRequest sends a read only query to the masters in turn, it goes to the
+// leader by Request if the master fails it, a follower without read lease refuses it.
+func (helper *masterHelper) ReadRequest(method, path string, param map[string]string, reqData []byte) (respData []byte, err error) {
+	var addr string
+	helper.Lock()
+	if len(helper.masters) > 1 {
+		helper.readIdx = (helper.readIdx + 1) % len(helper.masters)
+		addr = helper.masters[helper.readIdx]
+	}
+	helper.Unlock()
+	if addr != "" {
+		var resp *http.Response
+		if resp, err = helper.httpRequest(method, MasterURL(addr, path), param, reqData); err == nil {
+			respData, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err == nil && resp.StatusCode == http.StatusOK {
+				return
+			}
+		}
+	}
+	return helper.Request(method, path, param, reqData)
+}
+
+func (helper *masterHelper) resolveScheduler(interval time.Duration, stopC chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopC:
+			return
+		case <-ticker.C:
+		}
+		helper.RLock()
+		domains := make([]string, len(helper.domains))
+		copy(domains, helper.domains)
+		helper.RUnlock()
+		resolved := resolveDomains(domains)
+		helper.Lock()
+		helper.applyResolved(resolved)
+		helper.Unlock()
+	}
+}
+
+func resolveDomains(domains []string) (resolved map[string][]string) {
+	resolved = make(map[string][]string)
+	for _, domain := range domains {
+		addrs, err := resolveMasterAddr(domain)
+		if err != nil || len(addrs) == 0 {
+			log.LogWarnf("action[resolveDomains] resolve master(%v) err(%v).", domain, err)
+			continue
+		}
+		resolved[domain] = addrs
+	}
+	return
+}
+
+// applyResolved replace the addresses previously resolved from the domains
+// with the new ones, the caller must hold the lock.
+func (helper *masterHelper) applyResolved(resolved map[string][]string) {
+	if len(resolved) == 0 {
+		return
+	}
+	var leader string
+	if len(helper.masters) > 0 {
+		leader = helper.masters[helper.leaderIdx]
+	}
+	stale := make(map[string]bool)
+	for domain, addrs := range resolved {
+		for _, addr := range helper.resolved[domain] {
+			stale[addr] = true
+		}
+		for _, addr := range addrs {
+			delete(stale, addr)
+		}
+		helper.resolved[domain] = addrs
+	}
+	masters := make([]string, 0, len(helper.masters))
+	for _, addr := range helper.masters {
+		if !stale[addr] {
+			masters = append(masters, addr)
+		}
+	}
+	for _, addrs := range resolved {
+		for _, addr := range addrs {
+			if !contains(masters, addr) {
+				masters = append(masters, addr)
+			}
+		}
+	}
+	helper.masters = masters
+	helper.leaderIdx = 0
+	for i, addr := range masters {
+		if addr == leader {
+			helper.leaderIdx = i
+			break
+		}
+	}
+	log.LogInfof("action[applyResolved] masters(%v) leader(%v).", helper.masters, helper.masters[helper.leaderIdx])
+}
+
+func contains(addrs []string, addr string) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
 func (helper *masterHelper) request(method, path string, param map[string]string, reqData []byte) (repsData []byte, err error) {
 	for i := 0; i < len(helper.masters); i++ {
 		var index int
@@ -81,7 +253,7 @@ func (helper *masterHelper) request(method, path string, param map[string]string
 		}
 		helper.skipMarks.Add(mark)
 		var resp *http.Response
-		resp, err = helper.httpRequest(method, fmt.Sprintf("http://%s%s", masterAddr, path), param, reqData)
+		resp, err = helper.httpRequest(method, MasterURL(masterAddr, path), param, reqData)
 		if err != nil {
 			continue
 		}
@@ -121,9 +293,8 @@ func (helper *masterHelper) Nodes() []string {
 }
 
 func (helper *masterHelper) httpRequest(method, url string, param map[string]string, reqData []byte) (resp *http.Response, err error) {
-	client := &http.Client{}
+	client := NewMasterClient(time.Second * 3)
 	reader := bytes.NewReader(reqData)
-	client.Timeout = time.Second * 3
 	var req *http.Request
 	fullUrl := helper.mergeRequestUrl(url, param)
 	log.LogDebugf("action[httpRequest] method[%v] url[%v] reqBodyLen[%v].", method, fullUrl, len(reqData))
@@ -179,5 +350,6 @@ func NewMasterHelper() MasterHelper {
 	return &masterHelper{
 		masters:   make([]string, 0),
 		skipMarks: NewSet(),
+		resolved:  make(map[string][]string),
 	}
 }
@@ -0,0 +1,106 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package util
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a resolver of the domains to the addresses set by the tests
+type testResolver struct {
+	addrs map[string][]string
+	sync.Mutex
+}
+
+func (r *testResolver) set(domain string, addrs ...string) {
+	r.Lock()
+	defer r.Unlock()
+	r.addrs[domain] = addrs
+}
+
+func (r *testResolver) resolve(domain string) ([]string, error) {
+	r.Lock()
+	defer r.Unlock()
+	return r.addrs[domain], nil
+}
+
+func waitTestMasters(t *testing.T, helper MasterHelper, expect []string) {
+	for i := 0; i < 100 && !reflect.DeepEqual(helper.Nodes(), expect); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if nodes := helper.Nodes(); !reflect.DeepEqual(nodes, expect) {
+		t.Fatalf("masters %v expect %v", nodes, expect)
+	}
+}
+
+func TestMasterHelper_Resolve(t *testing.T) {
+	r := &testResolver{addrs: make(map[string][]string)}
+	resolveMasterAddr = r.resolve
+	defer func() { resolveMasterAddr = ResolveMasterAddr }()
+	r.set("master.test:17010", "10.0.0.1:17010", "10.0.0.2:17010")
+
+	helper := NewMasterHelper().(*masterHelper)
+	helper.AddNode("10.0.0.9:17010")
+	helper.AddNode("master.test:17010")
+	waitTestMasters(t, helper, []string{"10.0.0.9:17010", "10.0.0.1:17010", "10.0.0.2:17010"})
+	if helper.stopC == nil {
+		t.Fatalf("resolve not scheduled")
+	}
+	helper.Stop()
+	if helper.stopC != nil {
+		t.Fatalf("resolve not stopped")
+	}
+
+	stopC := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		helper.resolveScheduler(10*time.Millisecond, stopC)
+		close(done)
+	}()
+	// a master replaced, the address kept as the leader
+	helper.Lock()
+	helper.leaderIdx = 2
+	helper.Unlock()
+	r.set("master.test:17010", "10.0.0.2:17010", "10.0.0.3:17010")
+	waitTestMasters(t, helper, []string{"10.0.0.9:17010", "10.0.0.2:17010", "10.0.0.3:17010"})
+	if leader := helper.Leader(); leader != "10.0.0.2:17010" {
+		t.Fatalf("leader %v after the resolve", leader)
+	}
+	// nothing resolved, the addresses are kept
+	r.set("master.test:17010")
+	time.Sleep(50 * time.Millisecond)
+	waitTestMasters(t, helper, []string{"10.0.0.9:17010", "10.0.0.2:17010", "10.0.0.3:17010"})
+
+	close(stopC)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("resolve not stopped by the stop channel")
+	}
+	r.set("master.test:17010", "10.0.0.4:17010")
+	time.Sleep(50 * time.Millisecond)
+	waitTestMasters(t, helper, []string{"10.0.0.9:17010", "10.0.0.2:17010", "10.0.0.3:17010"})
+
+	// a domain added after the stop schedules the resolve again
+	r.set("other.test:17010", "10.0.1.1:17010")
+	helper.AddNode("other.test:17010")
+	if helper.stopC == nil {
+		t.Fatalf("resolve not scheduled again")
+	}
+	helper.Stop()
+}
@@ -0,0 +1,80 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package util
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	SrvAddrPrefix         = "srv://"
+	DnsAddrPrefix         = "dns://"
+	MasterResolveInterval = time.Minute
+)
+
+// IsDomainAddr return true if the master address is a SRV record or a
+// DNS name which need to be resolved to the master instances.
+func IsDomainAddr(addr string) bool {
+	if strings.HasPrefix(addr, SrvAddrPrefix) || strings.HasPrefix(addr, DnsAddrPrefix) {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	return net.ParseIP(host) == nil
+}
+
+// ResolveMasterAddr expand a configured master address into the addresses
+// of the master instances. "srv://_master._tcp.example.com" is looked up as
+// a SRV record, "dns://master.example.com:port" or "master.example.com:port"
+// is resolved to all of its A and AAAA records, other addresses are
+// returned as is.
+func ResolveMasterAddr(addr string) (addrs []string, err error) {
+	addr = strings.TrimSpace(addr)
+	if strings.HasPrefix(addr, SrvAddrPrefix) {
+		var records []*net.SRV
+		if _, records, err = net.LookupSRV("", "", strings.TrimPrefix(addr, SrvAddrPrefix)); err != nil {
+			return
+		}
+		for _, r := range records {
+			addrs = append(addrs, JoinHostPort(strings.TrimSuffix(r.Target, "."), r.Port))
+		}
+		return
+	}
+	if !IsDomainAddr(addr) {
+		return []string{addr}, nil
+	}
+	var (
+		host, port string
+		ips        []string
+	)
+	if host, port, err = net.SplitHostPort(strings.TrimPrefix(addr, DnsAddrPrefix)); err != nil {
+		return
+	}
+	if ips, err = net.LookupHost(host); err != nil {
+		return
+	}
+	for _, ip := range ips {
+		addrs = append(addrs, JoinHostPort(ip, port))
+	}
+	if len(addrs) == 0 {
+		err = fmt.Errorf("master address(%v) resolve to nothing", addr)
+	}
+	return
+}
@@ -0,0 +1,259 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package metrics exposes the metrics of a server in the Prometheus text
+// format. The metrics are collected at scrape time by the collectors
+// registered by the server, so no state is kept here except histograms.
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tiglabs/containerfs/util/log"
+	"github.com/tiglabs/containerfs/util/trace"
+)
+
+const (
+	Namespace   = "cfs"
+	MetricsPath = "/metrics"
+	ContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// latency buckets in seconds
+var DefaultLatencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// Histogram counts the observations into buckets of upper bounds, it is safe
+// for concurrent use.
+type Histogram struct {
+	buckets []float64
+	counts  []uint64 // the last one counts the observations above all buckets
+	count   uint64
+	sumBits uint64
+}
+
+// NewHistogram create a histogram of the buckets, which are sorted in place.
+func NewHistogram(buckets []float64) *Histogram {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)+1),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	for {
+		old := atomic.LoadUint64(&h.sumBits)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sumBits, old, sum) {
+			return
+		}
+	}
+}
+
+// Snapshot return the cumulative counts of the buckets, the sum and the
+// number of the observations.
+func (h *Histogram) Snapshot() (buckets []float64, cumulative []uint64, sum float64, count uint64) {
+	buckets = h.buckets
+	cumulative = make([]uint64, len(h.buckets))
+	var total uint64
+	for i := range h.buckets {
+		total += atomic.LoadUint64(&h.counts[i])
+		cumulative[i] = total
+	}
+	count = total + atomic.LoadUint64(&h.counts[len(h.buckets)])
+	sum = math.Float64frombits(atomic.LoadUint64(&h.sumBits))
+	return
+}
+
+type family struct {
+	name    string
+	help    string
+	typ     string
+	samples *bytes.Buffer
+}
+
+// Writer groups the samples into metric families in the order they are
+// first written, the labels are pairs of name and value.
+type Writer struct {
+	families []*family
+	index    map[string]*family
+}
+
+func NewWriter() *Writer {
+	return &Writer{index: make(map[string]*family)}
+}
+
+func (w *Writer) family(name, help, typ string) *family {
+	name = Namespace + "_" + name
+	f, ok := w.index[name]
+	if !ok {
+		f = &family{name: name, help: help, typ: typ, samples: new(bytes.Buffer)}
+		w.index[name] = f
+		w.families = append(w.families, f)
+	}
+	return f
+}
+
+func (w *Writer) Counter(name, help string, value float64, labels ...string) {
+	f := w.family(name, help, typeCounter)
+	writeSample(f.samples, f.name, labels, "", value)
+}
+
+func (w *Writer) Gauge(name, help string, value float64, labels ...string) {
+	f := w.family(name, help, typeGauge)
+	writeSample(f.samples, f.name, labels, "", value)
+}
+
+func (w *Writer) Histogram(name, help string, h *Histogram, labels ...string) {
+	f := w.family(name, help, typeHistogram)
+	buckets, cumulative, sum, count := h.Snapshot()
+	for i, bound := range buckets {
+		writeSample(f.samples, f.name+"_bucket", labels,
+			strconv.FormatFloat(bound, 'g', -1, 64), float64(cumulative[i]))
+	}
+	writeSample(f.samples, f.name+"_bucket", labels, "+Inf", float64(count))
+	writeSample(f.samples, f.name+"_sum", labels, "", sum)
+	writeSample(f.samples, f.name+"_count", labels, "", float64(count))
+}
+
+// WriteTo write the families in the Prometheus text format.
+func (w *Writer) WriteTo(out io.Writer) (n int64, err error) {
+	buf := new(bytes.Buffer)
+	for _, f := range w.families {
+		buf.WriteString("# HELP " + f.name + " " + escape(f.help, false) + "\n")
+		buf.WriteString("# TYPE " + f.name + " " + f.typ + "\n")
+		f.samples.WriteTo(buf)
+	}
+	return buf.WriteTo(out)
+}
+
+func writeSample(buf *bytes.Buffer, name string, labels []string, le string, value float64) {
+	buf.WriteString(name)
+	if len(labels) > 1 || le != "" {
+		buf.WriteByte('{')
+		sep := ""
+		for i := 0; i+1 < len(labels); i += 2 {
+			buf.WriteString(sep + labels[i] + `="` + escape(labels[i+1], true) + `"`)
+			sep = ","
+		}
+		if le != "" {
+			buf.WriteString(sep + `le="` + le + `"`)
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(formatValue(value))
+	buf.WriteByte('\n')
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escape(s string, quote bool) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	if quote {
+		s = strings.Replace(s, `"`, `\"`, -1)
+	}
+	return s
+}
+
+// Collector writes the current metrics of a subsystem.
+type Collector func(w *Writer)
+
+// Registry serves the metrics of its collectors on MetricsPath along with the
+// runtime metrics of the process.
+type Registry struct {
+	role       string
+	collectors []Collector
+	sync.RWMutex
+}
+
+func NewRegistry(role string) (r *Registry) {
+	r = &Registry{role: role}
+	r.Register(r.collectRuntime)
+	return
+}
+
+func (r *Registry) Register(c Collector) {
+	r.Lock()
+	defer r.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+func (r *Registry) Write(out io.Writer) (err error) {
+	w := NewWriter()
+	r.RLock()
+	for _, c := range r.collectors {
+		c(w)
+	}
+	r.RUnlock()
+	_, err = w.WriteTo(out)
+	return
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	r.Write(w)
+}
+
+func (r *Registry) collectRuntime(w *Writer) {
+	stats := &runtime.MemStats{}
+	runtime.ReadMemStats(stats)
+	w.Gauge("up", "Whether the server is up.", 1, "role", r.role)
+	w.Gauge("go_goroutines", "Number of goroutines.", float64(runtime.NumGoroutine()), "role", r.role)
+	w.Gauge("go_memstats_sys_bytes", "Bytes of memory obtained from the OS.", float64(stats.Sys), "role", r.role)
+	w.Gauge("go_memstats_heap_alloc_bytes", "Bytes of allocated heap objects.", float64(stats.HeapAlloc), "role", r.role)
+	w.Counter("go_gc_total", "Number of completed GC cycles.", float64(stats.NumGC), "role", r.role)
+	w.Gauge("log_degraded", "Whether the logs are kept in memory for lack of space of the log dir.", Bool(log.IsDegraded()), "role", r.role)
+	w.Counter("log_dropped_bytes_total", "Bytes of the log lost.", float64(log.DroppedBytes()), "role", r.role)
+	w.Counter("log_sampled_lines_total", "Warn and error lines dropped by the log sampling.", float64(log.SampledLines()), "role", r.role)
+	w.Counter("trace_dropped_spans_total", "Spans not exported for a full queue or a failed export.", float64(trace.Dropped()), "role", r.role)
+}
+
+// Bool convert b into the value of a gauge.
+func Bool(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
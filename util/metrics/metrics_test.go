@@ -0,0 +1,89 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestHistogram_Snapshot(t *testing.T) {
+	h := NewHistogram([]float64{1, 0.1, 0.01})
+	for _, v := range []float64{0.005, 0.01, 0.05, 0.5, 2} {
+		h.Observe(v)
+	}
+	buckets, cumulative, sum, count := h.Snapshot()
+	if buckets[0] != 0.01 || buckets[2] != 1 {
+		t.Fatalf("buckets not sorted: %v", buckets)
+	}
+	expect := []uint64{2, 3, 4}
+	for i := range expect {
+		if cumulative[i] != expect[i] {
+			t.Fatalf("bucket(%v) count(%v) expect(%v)", buckets[i], cumulative[i], expect[i])
+		}
+	}
+	if count != 5 || sum < 2.564 || sum > 2.566 {
+		t.Fatalf("count(%v) sum(%v)", count, sum)
+	}
+}
+
+func TestWriter_WriteTo(t *testing.T) {
+	w := NewWriter()
+	w.Gauge("disk_used_bytes", "Used bytes of disk.", 100, "path", "/data0")
+	w.Counter("partition_writes_total", "Writes of partition.", 7, "partition", "1", "vol", `a"b`)
+	w.Gauge("disk_used_bytes", "Used bytes of disk.", 200, "path", "/data1")
+	h := NewHistogram([]float64{0.1})
+	h.Observe(0.05)
+	w.Histogram("partition_write_seconds", "Write latency.", h, "partition", "1")
+
+	buf := new(bytes.Buffer)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	expect := `# HELP cfs_disk_used_bytes Used bytes of disk.
+# TYPE cfs_disk_used_bytes gauge
+cfs_disk_used_bytes{path="/data0"} 100
+cfs_disk_used_bytes{path="/data1"} 200
+# HELP cfs_partition_writes_total Writes of partition.
+# TYPE cfs_partition_writes_total counter
+cfs_partition_writes_total{partition="1",vol="a\"b"} 7
+# HELP cfs_partition_write_seconds Write latency.
+# TYPE cfs_partition_write_seconds histogram
+cfs_partition_write_seconds_bucket{partition="1",le="0.1"} 1
+cfs_partition_write_seconds_bucket{partition="1",le="+Inf"} 1
+cfs_partition_write_seconds_sum{partition="1"} 0.05
+cfs_partition_write_seconds_count{partition="1"} 1
+`
+	if buf.String() != expect {
+		t.Fatalf("unexpected output:\n%v", buf.String())
+	}
+}
+
+func TestRegistry_Write(t *testing.T) {
+	r := NewRegistry("datanode")
+	r.Register(func(w *Writer) {
+		w.Gauge("raft_leader", "Whether the node is the raft leader.", Bool(true))
+	})
+	buf := new(bytes.Buffer)
+	if err := r.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{`cfs_up{role="datanode"} 1`, "cfs_raft_leader 1"} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Fatalf("missing %v in:\n%v", line, buf.String())
+		}
+	}
+}
@@ -30,7 +30,7 @@ import (
 )
 
 type ConnectObject struct {
-	conn *net.TCPConn
+	conn net.Conn
 }
 
 type Pool struct {
@@ -38,25 +38,36 @@ type Pool struct {
 	mincap int
 	maxcap int
 	target string
+	hook   func(conn net.Conn) error
 }
 
 func NewPool(min, max int, target string) (p *Pool) {
+	return newPool(min, max, target, nil)
+}
+
+func newPool(min, max int, target string, hook func(conn net.Conn) error) (p *Pool) {
 	p = new(Pool)
 	p.mincap = min
 	p.maxcap = max
 	p.target = target
+	p.hook = hook
 	p.pool = make(chan *ConnectObject, max)
 	p.initAllConnect()
 	return p
 }
 
+/*the pools without their own hook run the one set by SetDialHook*/
+func (p *Pool) dial() (net.Conn, error) {
+	if p.hook == nil {
+		return Dial(p.target, 0)
+	}
+	return DialWithHook(p.target, 0, p.hook)
+}
+
 func (p *Pool) initAllConnect() {
 	for i := 0; i < p.mincap; i++ {
-		c, err := net.Dial("tcp", p.target)
+		conn, err := p.dial()
 		if err == nil {
-			conn := c.(*net.TCPConn)
-			conn.SetKeepAlive(true)
-			conn.SetNoDelay(true)
 			obj := &ConnectObject{conn: conn}
 			p.putconnect(obj)
 		}
@@ -92,20 +103,12 @@ func (p *Pool) AutoRelease() {
 	}
 }
 
-func (p *Pool) Get() (c *net.TCPConn, err error) {
+func (p *Pool) Get() (c net.Conn, err error) {
 	obj := p.getconnect()
 	if obj != nil {
 		return obj.conn, nil
 	}
-	var connect net.Conn
-	connect, err = net.Dial("tcp", p.target)
-	if err == nil {
-		conn := connect.(*net.TCPConn)
-		conn.SetKeepAlive(true)
-		conn.SetNoDelay(true)
-		c = conn
-	}
-	return
+	return p.dial()
 }
 
 type ConnectPool struct {
@@ -114,20 +117,56 @@ type ConnectPool struct {
 	mincap  int
 	maxcap  int
 	timeout int64
+	hook    func(conn net.Conn) error
 }
 
 func NewConnPool() (connectPool *ConnectPool) {
-	connectPool = &ConnectPool{pools: make(map[string]*Pool), mincap: 5, maxcap: 50, timeout: int64(time.Second * 20)}
+	return NewConnPoolWithHook(nil)
+}
+
+// NewConnPoolWithHook returns a pool whose connections run hook instead of
+// the one set by SetDialHook, like the connections authenticated for a vol.
+func NewConnPoolWithHook(hook func(conn net.Conn) error) (connectPool *ConnectPool) {
+	connectPool = &ConnectPool{pools: make(map[string]*Pool), mincap: 5, maxcap: 50, timeout: int64(time.Second * 20), hook: hook}
 	go connectPool.autoRelease()
 
 	return connectPool
 }
 
-func (connectPool *ConnectPool) Get(targetAddr string) (c *net.TCPConn, err error) {
+var sharedPools = struct {
+	pools map[string]*ConnectPool
+	sync.Mutex
+}{pools: make(map[string]*ConnectPool)}
+
+// SharedConnPool returns the pool of the process for key, created with hook
+// by the first caller. The clients of several vols in one process share the
+// connections to the nodes through it, the key tells the connections apart
+// whose hook differ, like the ones authenticated with the token of a vol.
+func SharedConnPool(key string, hook func(conn net.Conn) error) *ConnectPool {
+	sharedPools.Lock()
+	defer sharedPools.Unlock()
+	connectPool, ok := sharedPools.pools[key]
+	if !ok {
+		connectPool = NewConnPoolWithHook(hook)
+		sharedPools.pools[key] = connectPool
+	}
+	return connectPool
+}
+
+// Dial connects to target like the connections of the pool, the connection
+// is not taken from nor put back to the pool.
+func (connectPool *ConnectPool) Dial(target string, timeout time.Duration) (net.Conn, error) {
+	if connectPool.hook == nil {
+		return Dial(target, timeout)
+	}
+	return DialWithHook(target, timeout, connectPool.hook)
+}
+
+func (connectPool *ConnectPool) Get(targetAddr string) (c net.Conn, err error) {
 	connectPool.Lock()
 	pool, ok := connectPool.pools[targetAddr]
 	if !ok {
-		pool = NewPool(connectPool.mincap, connectPool.maxcap, targetAddr)
+		pool = newPool(connectPool.mincap, connectPool.maxcap, targetAddr, connectPool.hook)
 		connectPool.pools[targetAddr] = pool
 	}
 	connectPool.Unlock()
@@ -135,7 +174,7 @@ func (connectPool *ConnectPool) Get(targetAddr string) (c *net.TCPConn, err erro
 	return pool.Get()
 }
 
-func (connectPool *ConnectPool) Put(c *net.TCPConn, forceClose bool) {
+func (connectPool *ConnectPool) Put(c net.Conn, forceClose bool) {
 	if c == nil {
 		return
 	}
@@ -157,7 +196,7 @@ func (connectPool *ConnectPool) Put(c *net.TCPConn, forceClose bool) {
 	return
 }
 
-func (connectPool *ConnectPool) CheckErrorForPutConnect(c *net.TCPConn, target string, err error) {
+func (connectPool *ConnectPool) CheckErrorForPutConnect(c net.Conn, target string, err error) {
 	if c == nil {
 		return
 	}
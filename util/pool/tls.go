@@ -0,0 +1,102 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package pool
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+var (
+	clientTLSConfig *tls.Config
+	dialHook        func(conn net.Conn) error
+)
+
+// SetTLSConfig makes the connections of the pools and Dial use TLS with cfg,
+// they are plain TCP if cfg is nil
+func SetTLSConfig(cfg *tls.Config) {
+	clientTLSConfig = cfg
+}
+
+// SetDialHook makes Dial run hook on the connections before returning them,
+// the connection is closed if hook fails
+func SetDialHook(hook func(conn net.Conn) error) {
+	dialHook = hook
+}
+
+// Dial connects to target with keepalive and no delay, over TLS if it is set.
+// The certificate of target is verified against its host, no timeout if timeout is 0.
+// The protocol is negotiated with target before the dial hook runs.
+func Dial(target string, timeout time.Duration) (conn net.Conn, err error) {
+	return DialWithHook(target, timeout, dialHook)
+}
+
+// DialWithHook is Dial running hook instead of the one set by SetDialHook,
+// none if hook is nil.
+func DialWithHook(target string, timeout time.Duration, hook func(conn net.Conn) error) (conn net.Conn, err error) {
+	if conn, err = dial(target, timeout); err != nil {
+		return
+	}
+	if err = proto.NegotiateConn(conn); err != nil {
+		// the legacy datanodes close the conn after the error reply and the
+		// legacy metanodes don't answer, the conn is replaced by one without
+		conn.Close()
+		if conn, err = dial(target, timeout); err != nil {
+			return
+		}
+	}
+	if hook != nil {
+		if err = hook(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return
+}
+
+func dial(target string, timeout time.Duration) (conn net.Conn, err error) {
+	if conn, err = net.DialTimeout("tcp", target, timeout); err != nil {
+		return
+	}
+	setTCPOptions(conn)
+	if clientTLSConfig != nil {
+		cfg := clientTLSConfig.Clone()
+		if cfg.ServerName, _, err = net.SplitHostPort(target); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tls.Client(conn, cfg)
+	}
+	return
+}
+
+// ServerConn sets the options of the accepted connection, and wraps it with TLS if cfg is not nil
+func ServerConn(conn net.Conn, cfg *tls.Config) net.Conn {
+	setTCPOptions(conn)
+	if cfg == nil {
+		return conn
+	}
+	return tls.Server(conn, cfg)
+}
+
+func setTCPOptions(conn net.Conn) {
+	if c, ok := conn.(*net.TCPConn); ok {
+		c.SetKeepAlive(true)
+		c.SetNoDelay(true)
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package qos limits the IOPS and the bandwidth of the requests of each vol and
+// of each client session of a vol by token buckets, the limits are of the node
+// serving the requests only.
+package qos
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+const (
+	MaxWaitTime = time.Second      //a request waiting longer for its tokens is refused
+	IdleTime    = 10 * time.Minute //the buckets unused for it are dropped
+)
+
+var (
+	ErrThrottled = errors.New("qos throttled")
+)
+
+// Limit is the IOPS and the bytes per second allowed, 0 means no limit.
+type Limit struct {
+	IOPS      int64
+	Bandwidth int64
+}
+
+func (l Limit) IsUnlimited() bool {
+	return l.IOPS <= 0 && l.Bandwidth <= 0
+}
+
+// TokenBucket refills rate tokens per second up to a burst of one second, a
+// reservation may take the bucket below zero and waits for the refill.
+type TokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+	sync.Mutex
+}
+
+func NewTokenBucket(rate int64, now time.Time) *TokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &TokenBucket{rate: float64(rate), tokens: float64(rate), last: now}
+}
+
+// Reserve takes n tokens, it returns how long the caller waits until they are refilled.
+func (b *TokenBucket) Reserve(n float64, now time.Time) (wait time.Duration) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+		b.last = now
+	}
+	b.tokens -= n
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	return
+}
+
+// Refund gives back the tokens of a request refused after their reservation.
+func (b *TokenBucket) Refund(n float64) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	b.tokens += n
+	b.Unlock()
+}
+
+type limiter struct {
+	iops      *TokenBucket
+	bandwidth *TokenBucket
+	lastUse   int64 //unix nano of the last reservation, accessed atomically
+}
+
+func newLimiter(limit Limit, now time.Time) *limiter {
+	return &limiter{iops: NewTokenBucket(limit.IOPS, now), bandwidth: NewTokenBucket(limit.Bandwidth, now),
+		lastUse: now.UnixNano()}
+}
+
+func (l *limiter) reserve(bytes int, now time.Time) (wait time.Duration) {
+	if l == nil {
+		return
+	}
+	atomic.StoreInt64(&l.lastUse, now.UnixNano())
+	wait = l.iops.Reserve(1, now)
+	if w := l.bandwidth.Reserve(float64(bytes), now); w > wait {
+		wait = w
+	}
+	return
+}
+
+func (l *limiter) refund(bytes int) {
+	if l == nil {
+		return
+	}
+	l.iops.Refund(1)
+	l.bandwidth.Refund(float64(bytes))
+}
+
+// Qos limits the requests of each vol and of each client session of a vol. A
+// session keeps its bucket across its connections, so a client can't get a
+// new burst by reconnecting, and the sessions of a host are limited apart.
+// The buckets unused for IdleTime are dropped.
+type Qos struct {
+	VolLimit    Limit
+	VolLimits   map[string]Limit //vols overriding VolLimit
+	ClientLimit Limit
+	vols        sync.Map //vol name to *limiter
+	clients     sync.Map //clientKey to *limiter
+	throttled   uint64
+	refused     uint64
+	lastPrune   int64
+}
+
+type clientKey struct {
+	volName string
+	client  string
+}
+
+func New(volLimit, clientLimit Limit, volLimits map[string]Limit) *Qos {
+	if volLimits == nil {
+		volLimits = make(map[string]Limit)
+	}
+	return &Qos{VolLimit: volLimit, VolLimits: volLimits, ClientLimit: clientLimit, lastPrune: time.Now().UnixNano()}
+}
+
+func (q *Qos) getVolLimiter(volName string, now time.Time) *limiter {
+	if l, ok := q.vols.Load(volName); ok {
+		return l.(*limiter)
+	}
+	limit, ok := q.VolLimits[volName]
+	if !ok {
+		limit = q.VolLimit
+	}
+	if limit.IsUnlimited() {
+		return nil
+	}
+	l, _ := q.vols.LoadOrStore(volName, newLimiter(limit, now))
+	return l.(*limiter)
+}
+
+func (q *Qos) getClientLimiter(volName, client string, now time.Time) *limiter {
+	if q.ClientLimit.IsUnlimited() {
+		return nil
+	}
+	key := clientKey{volName: volName, client: client}
+	if l, ok := q.clients.Load(key); ok {
+		return l.(*limiter)
+	}
+	l, _ := q.clients.LoadOrStore(key, newLimiter(q.ClientLimit, now))
+	return l.(*limiter)
+}
+
+// Wait blocks until the request of bytes is allowed for the client and the
+// vol, the request is refused if it would wait more than MaxWaitTime. The
+// client is its session, or its address if it has none.
+func (q *Qos) Wait(volName, client string, bytes int) (err error) {
+	if q == nil {
+		return
+	}
+	now := time.Now()
+	q.prune(now)
+	clientLimiter := q.getClientLimiter(volName, client, now)
+	volLimiter := q.getVolLimiter(volName, now)
+	if clientLimiter == nil && volLimiter == nil {
+		return
+	}
+	wait := clientLimiter.reserve(bytes, now)
+	if w := volLimiter.reserve(bytes, now); w > wait {
+		wait = w
+	}
+	if wait > MaxWaitTime {
+		clientLimiter.refund(bytes)
+		volLimiter.refund(bytes)
+		atomic.AddUint64(&q.refused, 1)
+		return errors.Annotatef(ErrThrottled, "vol(%v) client(%v) wait(%v)", volName, client, wait)
+	}
+	if wait > 0 {
+		atomic.AddUint64(&q.throttled, 1)
+		time.Sleep(wait)
+	}
+	return
+}
+
+/*drop the buckets idle for IdleTime, at most once every IdleTime*/
+func (q *Qos) prune(now time.Time) {
+	last := atomic.LoadInt64(&q.lastPrune)
+	if now.UnixNano()-last < int64(IdleTime) || !atomic.CompareAndSwapInt64(&q.lastPrune, last, now.UnixNano()) {
+		return
+	}
+	idle := func(buckets *sync.Map) {
+		buckets.Range(func(key, value interface{}) bool {
+			if now.UnixNano()-atomic.LoadInt64(&value.(*limiter).lastUse) >= int64(IdleTime) {
+				buckets.Delete(key)
+			}
+			return true
+		})
+	}
+	idle(&q.vols)
+	idle(&q.clients)
+}
+
+func (q *Qos) Throttled() uint64 {
+	return atomic.LoadUint64(&q.throttled)
+}
+
+func (q *Qos) Refused() uint64 {
+	return atomic.LoadUint64(&q.refused)
+}
@@ -0,0 +1,109 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package qos
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := NewTokenBucket(100, now)
+	if wait := b.Reserve(100, now); wait != 0 {
+		t.Fatalf("burst of one second waits %v", wait)
+	}
+	if wait := b.Reserve(50, now); wait != 500*time.Millisecond {
+		t.Fatalf("reservation below zero waits %v, expect 500ms", wait)
+	}
+	if wait := b.Reserve(50, now.Add(time.Second)); wait != 0 {
+		t.Fatalf("refilled bucket waits %v", wait)
+	}
+	if wait := b.Reserve(150, now.Add(10*time.Second)); wait != 500*time.Millisecond {
+		t.Fatalf("refill beyond the burst, wait %v, expect 500ms", wait)
+	}
+	b.Refund(50)
+	if wait := b.Reserve(0, now.Add(10*time.Second)); wait != 0 {
+		t.Fatalf("refunded bucket waits %v", wait)
+	}
+	if NewTokenBucket(0, now).Reserve(1<<30, now) != 0 {
+		t.Fatalf("unlimited bucket waits")
+	}
+}
+
+func TestQos_ClientSessions(t *testing.T) {
+	q := New(Limit{}, Limit{IOPS: 2}, nil)
+	for i := 0; i < 2; i++ {
+		if err := q.Wait("vol", "session1", 0); err != nil {
+			t.Fatalf("request %v within the burst: %v", i, err)
+		}
+	}
+	start := time.Now()
+	if err := q.Wait("vol", "session1", 0); err != nil {
+		t.Fatalf("throttled request: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || q.Throttled() != 1 {
+		t.Fatalf("throttled request waited %v, throttled %v", elapsed, q.Throttled())
+	}
+	// the other sessions and the other vols of the session have their own buckets
+	for _, c := range [][2]string{{"vol", "session2"}, {"vol2", "session1"}} {
+		start = time.Now()
+		if err := q.Wait(c[0], c[1], 0); err != nil || time.Since(start) > 100*time.Millisecond {
+			t.Fatalf("vol(%v) client(%v) waited %v: %v", c[0], c[1], time.Since(start), err)
+		}
+	}
+}
+
+func TestQos_Refused(t *testing.T) {
+	q := New(Limit{Bandwidth: 1000}, Limit{}, map[string]Limit{"big": {}})
+	if err := q.Wait("vol", "session", 1000); err != nil {
+		t.Fatalf("request within the burst: %v", err)
+	}
+	err := q.Wait("vol", "session", 2000)
+	if err == nil || !strings.Contains(err.Error(), ErrThrottled.Error()) || q.Refused() != 1 {
+		t.Fatalf("request waiting beyond %v: err %v refused %v", MaxWaitTime, err, q.Refused())
+	}
+	// the tokens of the refused request are refunded
+	if err = q.Wait("vol", "session", 1); err != nil {
+		t.Fatalf("request after the refused one: %v", err)
+	}
+	if err = q.Wait("big", "session", 1<<30); err != nil {
+		t.Fatalf("request of a vol overriding the limit: %v", err)
+	}
+}
+
+func TestQos_Prune(t *testing.T) {
+	q := New(Limit{IOPS: 10}, Limit{IOPS: 10}, nil)
+	if err := q.Wait("vol", "session", 0); err != nil {
+		t.Fatal(err)
+	}
+	count := func(buckets *sync.Map) (n int) {
+		buckets.Range(func(key, value interface{}) bool {
+			n++
+			return true
+		})
+		return
+	}
+	q.prune(time.Now())
+	if count(&q.vols) != 1 || count(&q.clients) != 1 {
+		t.Fatalf("buckets pruned before the idle time")
+	}
+	q.prune(time.Now().Add(IdleTime))
+	if count(&q.vols) != 0 || count(&q.clients) != 0 {
+		t.Fatalf("idle buckets not pruned, vols %v clients %v", count(&q.vols), count(&q.clients))
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package rpc
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Codec encodes the messages of the services in the protobuf wire format. A
+// message is a struct whose fields have the number of their field in
+// packet.proto in a protobuf tag, `protobuf:"3"`; the fields are uint32,
+// uint64, int64, bool, string, []byte, a message or a slice of them, as
+// proto3 does the repeated scalars are packed and the zero values omitted.
+// The messages with their own Marshal and Unmarshal, like Packet, use them.
+type Codec struct{}
+
+type wireMarshaler interface {
+	Marshal() ([]byte, error)
+}
+
+type wireUnmarshaler interface {
+	Unmarshal(data []byte) error
+}
+
+func (Codec) Marshal(v interface{}) ([]byte, error) {
+	if m, ok := v.(wireMarshaler); ok {
+		return m.Marshal()
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("rpc: marshal %T, not a pointer to a message", v)
+	}
+	return appendMessage(nil, rv.Elem())
+}
+
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	if m, ok := v.(wireUnmarshaler); ok {
+		return m.Unmarshal(data)
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("rpc: unmarshal %T, not a pointer to a message", v)
+	}
+	rv.Elem().Set(reflect.Zero(rv.Elem().Type()))
+	return readMessage(data, rv.Elem())
+}
+
+// the name of the codec of gRPC, the messages are the ones of protobuf
+func (Codec) String() string {
+	return "proto"
+}
+
+type wireField struct {
+	number int
+	index  int
+}
+
+var wireFields sync.Map // reflect.Type to []wireField
+
+func fieldsOf(t reflect.Type) []wireField {
+	if fields, ok := wireFields.Load(t); ok {
+		return fields.([]wireField)
+	}
+	var fields []wireField
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("protobuf")
+		if tag == "" {
+			continue
+		}
+		number, err := strconv.Atoi(strings.Split(tag, ",")[0])
+		if err != nil {
+			panic(fmt.Sprintf("rpc: protobuf tag %q of %v.%v", tag, t, t.Field(i).Name))
+		}
+		fields = append(fields, wireField{number: number, index: i})
+	}
+	wireFields.Store(t, fields)
+	return fields
+}
+
+func appendMessage(data []byte, v reflect.Value) (_ []byte, err error) {
+	for _, f := range fieldsOf(v.Type()) {
+		if data, err = appendField(data, f.number, v.Field(f.index)); err != nil {
+			return
+		}
+	}
+	return data, nil
+}
+
+func appendField(data []byte, number int, v reflect.Value) (_ []byte, err error) {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			data = appendVarint(data, number, 1)
+		}
+	case reflect.Uint8, reflect.Uint32, reflect.Uint64:
+		data = appendVarint(data, number, v.Uint())
+	case reflect.Int32, reflect.Int64:
+		data = appendVarint(data, number, uint64(v.Int()))
+	case reflect.String:
+		data = appendBytes(data, number, []byte(v.String()))
+	case reflect.Ptr:
+		if v.IsNil() {
+			return data, nil
+		}
+		return appendField(data, number, v.Elem())
+	case reflect.Struct:
+		var msg []byte
+		if msg, err = appendMessage(nil, v); err != nil {
+			return
+		}
+		data = appendUvarint(data, uint64(number)<<3|wireBytes)
+		data = appendUvarint(data, uint64(len(msg)))
+		data = append(data, msg...)
+	case reflect.Slice:
+		elem := v.Type().Elem()
+		switch elem.Kind() {
+		case reflect.Uint8:
+			data = appendBytes(data, number, v.Bytes())
+		case reflect.Uint32, reflect.Uint64, reflect.Int64:
+			if v.Len() == 0 {
+				return data, nil
+			}
+			var packed []byte
+			for i := 0; i < v.Len(); i++ {
+				if elem.Kind() == reflect.Int64 {
+					packed = appendUvarint(packed, uint64(v.Index(i).Int()))
+				} else {
+					packed = appendUvarint(packed, v.Index(i).Uint())
+				}
+			}
+			data = appendBytes(data, number, packed)
+		default:
+			// the repeated strings and messages, each element in a field of its own
+			for i := 0; i < v.Len(); i++ {
+				e := v.Index(i)
+				if e.Kind() == reflect.String {
+					data = appendUvarint(data, uint64(number)<<3|wireBytes)
+					data = appendUvarint(data, uint64(e.Len()))
+					data = append(data, e.String()...)
+					continue
+				}
+				if e.Kind() == reflect.Ptr {
+					if e.IsNil() {
+						e = reflect.New(elem.Elem())
+					}
+					e = e.Elem()
+				}
+				if data, err = appendField(data, number, e); err != nil {
+					return
+				}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("rpc: field %v of kind %v unsupported", number, v.Kind())
+	}
+	return data, nil
+}
+
+func readMessage(data []byte, v reflect.Value) (err error) {
+	fields := fieldsOf(v.Type())
+	for len(data) > 0 {
+		var key, n uint64
+		var b []byte
+		if key, data, err = readUvarint(data); err != nil {
+			return
+		}
+		number, wire := int(key>>3), key&0x7
+		switch wire {
+		case wireVarint:
+			if n, data, err = readUvarint(data); err != nil {
+				return
+			}
+		case wireBytes:
+			if n, data, err = readUvarint(data); err != nil {
+				return
+			}
+			if uint64(len(data)) < n {
+				return ErrTruncated
+			}
+			b, data = data[:n], data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return ErrTruncated
+			}
+			data = data[8:]
+			continue
+		case wireFixed32:
+			if len(data) < 4 {
+				return ErrTruncated
+			}
+			data = data[4:]
+			continue
+		default:
+			return ErrWireType
+		}
+		for _, f := range fields {
+			if f.number == number {
+				if err = readField(v.Field(f.index), wire, n, b); err != nil {
+					return
+				}
+				break
+			}
+		}
+	}
+	return
+}
+
+func readField(v reflect.Value, wire, n uint64, b []byte) (err error) {
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(n != 0)
+	case reflect.Uint8, reflect.Uint32, reflect.Uint64:
+		v.SetUint(n)
+	case reflect.Int32, reflect.Int64:
+		v.SetInt(int64(n))
+	case reflect.String:
+		v.SetString(string(b))
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return readField(v.Elem(), wire, n, b)
+	case reflect.Struct:
+		return readMessage(b, v)
+	case reflect.Slice:
+		elem := v.Type().Elem()
+		switch elem.Kind() {
+		case reflect.Uint8:
+			v.SetBytes(append([]byte(nil), b...))
+		case reflect.Uint32, reflect.Uint64, reflect.Int64:
+			if wire == wireVarint {
+				// a repeated scalar not packed by the sender
+				v.Set(reflect.Append(v, reflect.ValueOf(n).Convert(elem)))
+				return
+			}
+			for len(b) > 0 {
+				if n, b, err = readUvarint(b); err != nil {
+					return
+				}
+				v.Set(reflect.Append(v, reflect.ValueOf(n).Convert(elem)))
+			}
+		default:
+			e := reflect.New(elem).Elem()
+			if err = readField(e, wire, n, b); err != nil {
+				return
+			}
+			v.Set(reflect.Append(v, e))
+		}
+	default:
+		return fmt.Errorf("rpc: field of kind %v unsupported", v.Kind())
+	}
+	return
+}
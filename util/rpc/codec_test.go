@@ -0,0 +1,109 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+func TestCodec_RoundTrip(t *testing.T) {
+	c := Codec{}
+	for _, m := range []interface{}{
+		&LookupRequest{VolName: "ltptest", PartitionID: 3, ParentID: proto.RootIno, Name: "a",
+			LeaseSeconds: -1, Caller: &Caller{Uid: 1000}},
+		&BatchInodeGetRequest{VolName: "ltptest", Inodes: []uint64{1, 1 << 40, 300}},
+		&ReadDirReply{Children: []*Dentry{{Name: "a", Inode: 2}, {Name: "b", Inode: 3, Type: 1}}, Next: "c"},
+		&CreateExtentRequest{PartitionID: 7, Hosts: []string{"10.0.0.1:17310", "10.0.0.2:17310"}, Epoch: 2, Inode: 9},
+		&WriteRequest{PartitionID: 7, Hosts: []string{"10.0.0.1:17310"}, Offset: 4096, Data: []byte("hello")},
+		&CreateMetaPartitionRequest{VolName: "ltptest", End: 1<<64 - 1, Members: []*Peer{{ID: 1, Addr: "a"}, {ID: 2}}},
+		&Packet{Opcode: uint32(proto.OpWrite), Data: []byte("x")},
+	} {
+		data, err := c.Marshal(m)
+		if err != nil {
+			t.Fatalf("marshal %T: %v", m, err)
+		}
+		got := reflect.New(reflect.TypeOf(m).Elem()).Interface()
+		if err = c.Unmarshal(data, got); err != nil {
+			t.Fatalf("unmarshal %T: %v", m, err)
+		}
+		if !reflect.DeepEqual(m, got) {
+			t.Fatalf("have %+v, want %+v", got, m)
+		}
+	}
+	if _, err := c.Marshal(LookupRequest{}); err == nil {
+		t.Fatalf("marshal of a message not a pointer")
+	}
+}
+
+func TestCodec_Wire(t *testing.T) {
+	c := Codec{}
+	// the zero values omitted, the repeated scalars packed
+	data, err := c.Marshal(&BatchInodeGetRequest{Inodes: []uint64{1, 300}})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	want := []byte{3<<3 | wireBytes, 3, 1, 0xAC, 0x02}
+	if !bytes.Equal(data, want) {
+		t.Fatalf("have %x, want %x", data, want)
+	}
+	if data, _ = c.Marshal(&Empty{}); len(data) != 0 {
+		t.Fatalf("empty message of %x", data)
+	}
+	// the repeated scalars unpacked by an older peer and the unknown fields
+	got := new(BatchInodeGetRequest)
+	data = []byte{3<<3 | wireVarint, 1, 15<<3 | wireBytes, 1, 'x', 3<<3 | wireVarint, 0xAC, 0x02}
+	if err = c.Unmarshal(data, got); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(got.Inodes, []uint64{1, 300}) {
+		t.Fatalf("inodes %v", got.Inodes)
+	}
+	if err = c.Unmarshal(want[:len(want)-1], got); err != ErrTruncated {
+		t.Fatalf("truncated message: have %v, want %v", err, ErrTruncated)
+	}
+}
+
+func TestMessages_Json(t *testing.T) {
+	// the typed messages are the json bodies of the packets of the meta ops
+	req := &LookupRequest{VolName: "ltptest", PartitionID: 3, ParentID: 1, Name: "a"}
+	data, err := json.Marshal(req)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	pr := new(proto.LookupRequest)
+	if err = json.Unmarshal(data, pr); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if pr.VolName != req.VolName || pr.PartitionID != req.PartitionID || pr.ParentID != req.ParentID || pr.Name != req.Name {
+		t.Fatalf("have %+v, want %+v", pr, req)
+	}
+	mtime := time.Unix(1500000000, 0)
+	if data, err = json.Marshal(&proto.InodeGetResponse{Info: &proto.InodeInfo{Inode: 2, Nlink: 1, ModifyTime: mtime}}); err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	reply := new(InodeReply)
+	if err = json.Unmarshal(data, reply); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if reply.Info == nil || reply.Info.Inode != 2 || reply.Info.Nlink != 1 || reply.Info.ModifyTime != mtime.Unix() {
+		t.Fatalf("info %+v", reply.Info)
+	}
+}
@@ -0,0 +1,319 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package rpc
+
+import (
+	"encoding/json"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+// The messages of the typed RPCs in packet.proto. The json names are the ones
+// of the bodies of the packets in the proto package, a request is marshaled
+// into the data of the packet of its op and the reply unmarshaled from the
+// data of the packet replied.
+
+type Empty struct{}
+
+type Caller struct {
+	Uid uint32 `protobuf:"1" json:"uid"`
+	Gid uint32 `protobuf:"2" json:"gid"`
+}
+
+// InodeInfo has the times in unix seconds.
+type InodeInfo struct {
+	Inode      uint64 `protobuf:"1" json:"ino"`
+	Mode       uint32 `protobuf:"2" json:"mode"`
+	Nlink      uint32 `protobuf:"3" json:"nlink"`
+	Size       uint64 `protobuf:"4" json:"sz"`
+	Uid        uint32 `protobuf:"5" json:"uid"`
+	Gid        uint32 `protobuf:"6" json:"gid"`
+	Generation uint64 `protobuf:"7" json:"gen"`
+	ModifyTime int64  `protobuf:"8" json:"-"`
+	CreateTime int64  `protobuf:"9" json:"-"`
+	AccessTime int64  `protobuf:"10" json:"-"`
+	Target     []byte `protobuf:"11" json:"tgt"`
+}
+
+func (info *InodeInfo) UnmarshalJSON(data []byte) (err error) {
+	pi := new(proto.InodeInfo)
+	if err = json.Unmarshal(data, pi); err != nil {
+		return
+	}
+	*info = InodeInfo{
+		Inode:      pi.Inode,
+		Mode:       pi.Mode,
+		Nlink:      pi.Nlink,
+		Size:       pi.Size,
+		Uid:        pi.Uid,
+		Gid:        pi.Gid,
+		Generation: pi.Generation,
+		ModifyTime: pi.ModifyTime.Unix(),
+		CreateTime: pi.CreateTime.Unix(),
+		AccessTime: pi.AccessTime.Unix(),
+		Target:     pi.Target,
+	}
+	return
+}
+
+type Dentry struct {
+	Name  string `protobuf:"1" json:"name"`
+	Inode uint64 `protobuf:"2" json:"ino"`
+	Type  uint32 `protobuf:"3" json:"type"`
+}
+
+type ExtentKey struct {
+	PartitionId uint32 `protobuf:"1" json:"PartitionId"`
+	ExtentId    uint64 `protobuf:"2" json:"ExtentId"`
+	Size        uint32 `protobuf:"3" json:"Size"`
+	Crc         uint32 `protobuf:"4" json:"Crc"`
+}
+
+// the meta ops
+
+type CreateInodeRequest struct {
+	VolName     string  `protobuf:"1" json:"vol"`
+	PartitionID uint64  `protobuf:"2" json:"pid"`
+	Mode        uint32  `protobuf:"3" json:"mode"`
+	Target      []byte  `protobuf:"4" json:"tgt"`
+	Uid         uint32  `protobuf:"5" json:"uid,omitempty"`
+	Gid         uint32  `protobuf:"6" json:"gid,omitempty"`
+	Caller      *Caller `protobuf:"7" json:"caller,omitempty"`
+}
+
+type InodeRequest struct {
+	VolName     string `protobuf:"1" json:"vol"`
+	PartitionID uint64 `protobuf:"2" json:"pid"`
+	Inode       uint64 `protobuf:"3" json:"ino"`
+}
+
+type InodeReply struct {
+	Info *InodeInfo `protobuf:"1" json:"info"`
+}
+
+type InodeGetRequest struct {
+	VolName      string `protobuf:"1" json:"vol"`
+	PartitionID  uint64 `protobuf:"2" json:"pid"`
+	Inode        uint64 `protobuf:"3" json:"ino"`
+	SessionID    string `protobuf:"4" json:"sid,omitempty"`
+	LeaseSeconds int64  `protobuf:"5" json:"lsec,omitempty"`
+}
+
+type BatchInodeGetRequest struct {
+	VolName      string   `protobuf:"1" json:"vol"`
+	PartitionID  uint64   `protobuf:"2" json:"pid"`
+	Inodes       []uint64 `protobuf:"3" json:"inos"`
+	SessionID    string   `protobuf:"4" json:"sid,omitempty"`
+	LeaseSeconds int64    `protobuf:"5" json:"lsec,omitempty"`
+}
+
+type BatchInodeGetReply struct {
+	Infos []*InodeInfo `protobuf:"1" json:"infos"`
+}
+
+type CreateDentryRequest struct {
+	VolName     string  `protobuf:"1" json:"vol"`
+	PartitionID uint64  `protobuf:"2" json:"pid"`
+	ParentID    uint64  `protobuf:"3" json:"pino"`
+	Inode       uint64  `protobuf:"4" json:"ino"`
+	Name        string  `protobuf:"5" json:"name"`
+	Mode        uint32  `protobuf:"6" json:"mode"`
+	Caller      *Caller `protobuf:"7" json:"caller,omitempty"`
+}
+
+type DeleteDentryRequest struct {
+	VolName     string  `protobuf:"1" json:"vol"`
+	PartitionID uint64  `protobuf:"2" json:"pid"`
+	ParentID    uint64  `protobuf:"3" json:"pino"`
+	Name        string  `protobuf:"4" json:"name"`
+	Caller      *Caller `protobuf:"5" json:"caller,omitempty"`
+	InodeUid    uint32  `protobuf:"6" json:"iuid,omitempty"`
+}
+
+type UpdateDentryRequest struct {
+	VolName     string  `protobuf:"1" json:"vol"`
+	PartitionID uint64  `protobuf:"2" json:"pid"`
+	ParentID    uint64  `protobuf:"3" json:"pino"`
+	Name        string  `protobuf:"4" json:"name"`
+	Inode       uint64  `protobuf:"5" json:"ino"`
+	Caller      *Caller `protobuf:"6" json:"caller,omitempty"`
+	OldInodeUid uint32  `protobuf:"7" json:"ouid,omitempty"`
+}
+
+// DentryReply is the inode the dentry held before the op.
+type DentryReply struct {
+	Inode uint64 `protobuf:"1" json:"ino"`
+}
+
+type LookupRequest struct {
+	VolName      string  `protobuf:"1" json:"vol"`
+	PartitionID  uint64  `protobuf:"2" json:"pid"`
+	ParentID     uint64  `protobuf:"3" json:"pino"`
+	Name         string  `protobuf:"4" json:"name"`
+	SessionID    string  `protobuf:"5" json:"sid,omitempty"`
+	LeaseSeconds int64   `protobuf:"6" json:"lsec,omitempty"`
+	Caller       *Caller `protobuf:"7" json:"caller,omitempty"`
+}
+
+type LookupReply struct {
+	Inode uint64 `protobuf:"1" json:"ino"`
+	Mode  uint32 `protobuf:"2" json:"mode"`
+}
+
+type ReadDirRequest struct {
+	VolName      string  `protobuf:"1" json:"vol"`
+	PartitionID  uint64  `protobuf:"2" json:"pid"`
+	ParentID     uint64  `protobuf:"3" json:"pino"`
+	Marker       string  `protobuf:"4" json:"marker,omitempty"`
+	Limit        uint64  `protobuf:"5" json:"limit,omitempty"`
+	SessionID    string  `protobuf:"6" json:"sid,omitempty"`
+	LeaseSeconds int64   `protobuf:"7" json:"lsec,omitempty"`
+	Caller       *Caller `protobuf:"8" json:"caller,omitempty"`
+}
+
+type ReadDirReply struct {
+	Children []*Dentry `protobuf:"1" json:"children"`
+	Next     string    `protobuf:"2" json:"next,omitempty"`
+}
+
+type ExtentsListReply struct {
+	Extents []*ExtentKey `protobuf:"1" json:"eks"`
+}
+
+type ExtentsAddRequest struct {
+	VolName     string     `protobuf:"1" json:"vol"`
+	PartitionID uint64     `protobuf:"2" json:"pid"`
+	Inode       uint64     `protobuf:"3" json:"ino"`
+	Extent      *ExtentKey `protobuf:"4" json:"ek"`
+	SessionID   string     `protobuf:"5" json:"sid,omitempty"`
+}
+
+type TruncateRequest struct {
+	VolName     string  `protobuf:"1" json:"vol"`
+	PartitionID uint64  `protobuf:"2" json:"pid"`
+	Inode       uint64  `protobuf:"3" json:"ino"`
+	SessionID   string  `protobuf:"4" json:"sid,omitempty"`
+	Caller      *Caller `protobuf:"5" json:"caller,omitempty"`
+}
+
+// TruncateReply is the extent keys dropped from the inode.
+type TruncateReply struct {
+	Extents []*ExtentKey `protobuf:"1" json:"ek"`
+}
+
+type SetAttrRequest struct {
+	VolName     string  `protobuf:"1" json:"vol"`
+	PartitionID uint64  `protobuf:"2" json:"pid"`
+	Inode       uint64  `protobuf:"3" json:"ino"`
+	Mode        uint32  `protobuf:"4" json:"mode"`
+	Uid         uint32  `protobuf:"5" json:"uid"`
+	Gid         uint32  `protobuf:"6" json:"gid"`
+	Valid       uint32  `protobuf:"7" json:"valid"`
+	SessionID   string  `protobuf:"8" json:"sid,omitempty"`
+	Caller      *Caller `protobuf:"9" json:"caller,omitempty"`
+}
+
+// the data ops, Hosts are the replicas of the partition, the leader first,
+// and Epoch its membership epoch
+
+type CreateExtentRequest struct {
+	PartitionID uint32   `protobuf:"1"`
+	Hosts       []string `protobuf:"2"`
+	Epoch       uint64   `protobuf:"3"`
+	Inode       uint64   `protobuf:"4"`
+	Prealloc    int64    `protobuf:"5"` //bytes to preallocate for the extent
+}
+
+type CreateExtentReply struct {
+	ExtentID uint64 `protobuf:"1"`
+}
+
+type WriteRequest struct {
+	PartitionID uint32   `protobuf:"1"`
+	Hosts       []string `protobuf:"2"`
+	Epoch       uint64   `protobuf:"3"`
+	ExtentID    uint64   `protobuf:"4"`
+	Offset      int64    `protobuf:"5"`
+	Data        []byte   `protobuf:"6"`
+}
+
+type MarkDeleteRequest struct {
+	PartitionID uint32   `protobuf:"1"`
+	Hosts       []string `protobuf:"2"`
+	Epoch       uint64   `protobuf:"3"`
+	ExtentID    uint64   `protobuf:"4"`
+}
+
+type ExtentRequest struct {
+	PartitionID uint32 `protobuf:"1"`
+	ExtentID    uint64 `protobuf:"2"`
+	Offset      int64  `protobuf:"3"`
+	Size        uint32 `protobuf:"4"`
+}
+
+// ReadReply is a piece of the range read, at Offset of the extent.
+type ReadReply struct {
+	Offset int64  `protobuf:"1"`
+	Data   []byte `protobuf:"2"`
+	Crc    uint32 `protobuf:"3"`
+}
+
+type WatermarkReply struct {
+	Size uint64 `protobuf:"1" json:"size"`
+}
+
+// the admin tasks, replied once the node took them, their results are
+// reported to the master
+
+type Peer struct {
+	ID   uint64 `protobuf:"1" json:"id"`
+	Addr string `protobuf:"2" json:"addr"`
+}
+
+type CreateDataPartitionRequest struct {
+	TaskID        string `protobuf:"1" json:"-"`
+	PartitionType string `protobuf:"2" json:"PartitionType"`
+	PartitionId   uint64 `protobuf:"3" json:"PartitionId"`
+	PartitionSize int64  `protobuf:"4" json:"PartitionSize"`
+	VolumeId      string `protobuf:"5" json:"VolumeId"`
+	Epoch         uint64 `protobuf:"6" json:"Epoch"`
+}
+
+type DeleteDataPartitionRequest struct {
+	TaskID            string `protobuf:"1" json:"-"`
+	DataPartitionType string `protobuf:"2" json:"DataPartitionType"`
+	PartitionId       uint64 `protobuf:"3" json:"PartitionId"`
+	PartitionSize     int64  `protobuf:"4" json:"PartitionSize"`
+}
+
+type CreateMetaPartitionRequest struct {
+	TaskID      string  `protobuf:"1" json:"-"`
+	MetaId      string  `protobuf:"2" json:"MetaId"`
+	VolName     string  `protobuf:"3" json:"VolName"`
+	Start       uint64  `protobuf:"4" json:"Start"`
+	End         uint64  `protobuf:"5" json:"End"`
+	PartitionID uint64  `protobuf:"6" json:"PartitionID"`
+	Members     []*Peer `protobuf:"7" json:"Members"`
+}
+
+type DeleteMetaPartitionRequest struct {
+	TaskID      string `protobuf:"1" json:"-"`
+	PartitionID uint64 `protobuf:"2" json:"PartitionID"`
+}
+
+type AdminReply struct {
+	ResultCode uint32 `protobuf:"1"`
+	Message    string `protobuf:"2"`
+}
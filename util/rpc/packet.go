@@ -0,0 +1,237 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package rpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+var (
+	ErrTruncated = errors.New("protobuf message truncated")
+	ErrWireType  = errors.New("protobuf wire type unsupported")
+)
+
+// the numbers of the fields of Packet in packet.proto
+const (
+	fieldStoreMode   = 1
+	fieldOpcode      = 2
+	fieldResultCode  = 3
+	fieldNodes       = 4
+	fieldCrc         = 5
+	fieldPartitionID = 6
+	fieldFileID      = 7
+	fieldOffset      = 8
+	fieldReqID       = 9
+	fieldArg         = 10
+	fieldData        = 11
+)
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// Packet is the message of the gRPC services, the fields of proto.Packet
+// without the magic and the sizes. It is encoded in the protobuf wire format
+// by itself, so the clients generate theirs from packet.proto.
+type Packet struct {
+	StoreMode   uint32
+	Opcode      uint32
+	ResultCode  uint32
+	Nodes       uint32
+	Crc         uint32
+	PartitionID uint32
+	FileID      uint64
+	Offset      int64
+	ReqID       int64
+	Arg         []byte
+	Data        []byte
+}
+
+func FromPacket(p *proto.Packet) *Packet {
+	m := &Packet{
+		StoreMode:   uint32(p.StoreMode),
+		Opcode:      uint32(p.Opcode),
+		ResultCode:  uint32(p.ResultCode),
+		Nodes:       uint32(p.Nodes),
+		Crc:         p.Crc,
+		PartitionID: p.PartitionID,
+		FileID:      p.FileID,
+		Offset:      p.Offset,
+		ReqID:       p.ReqID,
+	}
+	if p.Arglen > 0 {
+		m.Arg = p.Arg[:p.Arglen]
+	}
+	if p.Size > 0 && len(p.Data) >= int(p.Size) {
+		m.Data = p.Data[:p.Size]
+	}
+	return m
+}
+
+func (m *Packet) ToPacket() (p *proto.Packet, err error) {
+	if m.StoreMode > 0xFF || m.Opcode > 0xFF || m.ResultCode > 0xFF || m.Nodes > 0xFF {
+		return nil, fmt.Errorf("packet field out of range: storeMode(%v) opcode(%v) resultCode(%v) nodes(%v)",
+			m.StoreMode, m.Opcode, m.ResultCode, m.Nodes)
+	}
+	p = proto.NewPacket()
+	p.StoreMode = uint8(m.StoreMode)
+	p.Opcode = uint8(m.Opcode)
+	p.ResultCode = uint8(m.ResultCode)
+	p.Nodes = uint8(m.Nodes)
+	p.Crc = m.Crc
+	p.PartitionID = m.PartitionID
+	p.FileID = m.FileID
+	p.Offset = m.Offset
+	p.ReqID = m.ReqID
+	p.Arg = m.Arg
+	p.Arglen = uint32(len(m.Arg))
+	p.Data = m.Data
+	p.Size = uint32(len(m.Data))
+	return
+}
+
+func (m *Packet) Reset() {
+	*m = Packet{}
+}
+
+func (m *Packet) String() string {
+	return fmt.Sprintf("Packet{opcode(%v) partitionID(%v) fileID(%v) offset(%v) reqID(%v) resultCode(%v) arg(%v) data(%v)}",
+		m.Opcode, m.PartitionID, m.FileID, m.Offset, m.ReqID, m.ResultCode, len(m.Arg), len(m.Data))
+}
+
+func (*Packet) ProtoMessage() {}
+
+// Marshal encodes the message in the protobuf wire format, the fields of the
+// zero value are omitted as proto3 does.
+func (m *Packet) Marshal() (data []byte, err error) {
+	data = make([]byte, 0, 11*binary.MaxVarintLen64+len(m.Arg)+len(m.Data))
+	data = appendVarint(data, fieldStoreMode, uint64(m.StoreMode))
+	data = appendVarint(data, fieldOpcode, uint64(m.Opcode))
+	data = appendVarint(data, fieldResultCode, uint64(m.ResultCode))
+	data = appendVarint(data, fieldNodes, uint64(m.Nodes))
+	data = appendVarint(data, fieldCrc, uint64(m.Crc))
+	data = appendVarint(data, fieldPartitionID, uint64(m.PartitionID))
+	data = appendVarint(data, fieldFileID, m.FileID)
+	data = appendVarint(data, fieldOffset, uint64(m.Offset))
+	data = appendVarint(data, fieldReqID, uint64(m.ReqID))
+	data = appendBytes(data, fieldArg, m.Arg)
+	data = appendBytes(data, fieldData, m.Data)
+	return
+}
+
+// Unmarshal decodes the message from the protobuf wire format, the unknown
+// fields are skipped.
+func (m *Packet) Unmarshal(data []byte) (err error) {
+	m.Reset()
+	for len(data) > 0 {
+		var key, v uint64
+		var b []byte
+		if key, data, err = readUvarint(data); err != nil {
+			return
+		}
+		field, wire := key>>3, key&0x7
+		switch wire {
+		case wireVarint:
+			if v, data, err = readUvarint(data); err != nil {
+				return
+			}
+		case wireBytes:
+			if v, data, err = readUvarint(data); err != nil {
+				return
+			}
+			if uint64(len(data)) < v {
+				return ErrTruncated
+			}
+			b, data = data[:v], data[v:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return ErrTruncated
+			}
+			data = data[8:]
+			continue
+		case wireFixed32:
+			if len(data) < 4 {
+				return ErrTruncated
+			}
+			data = data[4:]
+			continue
+		default:
+			return ErrWireType
+		}
+		switch field {
+		case fieldStoreMode:
+			m.StoreMode = uint32(v)
+		case fieldOpcode:
+			m.Opcode = uint32(v)
+		case fieldResultCode:
+			m.ResultCode = uint32(v)
+		case fieldNodes:
+			m.Nodes = uint32(v)
+		case fieldCrc:
+			m.Crc = uint32(v)
+		case fieldPartitionID:
+			m.PartitionID = uint32(v)
+		case fieldFileID:
+			m.FileID = v
+		case fieldOffset:
+			m.Offset = int64(v)
+		case fieldReqID:
+			m.ReqID = int64(v)
+		case fieldArg:
+			m.Arg = append([]byte(nil), b...)
+		case fieldData:
+			m.Data = append([]byte(nil), b...)
+		}
+	}
+	return
+}
+
+func appendUvarint(data []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(data, buf[:n]...)
+}
+
+func appendVarint(data []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return data
+	}
+	data = appendUvarint(data, uint64(field)<<3|wireVarint)
+	return appendUvarint(data, v)
+}
+
+func appendBytes(data []byte, field int, b []byte) []byte {
+	if len(b) == 0 {
+		return data
+	}
+	data = appendUvarint(data, uint64(field)<<3|wireBytes)
+	data = appendUvarint(data, uint64(len(b)))
+	return append(data, b...)
+}
+
+func readUvarint(data []byte) (v uint64, rest []byte, err error) {
+	v, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, data, ErrTruncated
+	}
+	return v, data[n:], nil
+}
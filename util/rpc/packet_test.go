@@ -0,0 +1,67 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package rpc
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+func TestPacket_MarshalRoundTrip(t *testing.T) {
+	m := &Packet{StoreMode: 1, Opcode: uint32(proto.OpWrite), Nodes: 2, Crc: 0xFFFFFFFF, PartitionID: 7,
+		FileID: 1 << 40, Offset: -1, ReqID: 1234567, Arg: []byte("10.0.0.2:17310/"), Data: []byte("hello")}
+	data, err := m.Marshal()
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	got := new(Packet)
+	if err = got.Unmarshal(data); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(m, got) {
+		t.Fatalf("have %v, want %v", got, m)
+	}
+	if _, err = (&Packet{Opcode: 0x100}).ToPacket(); err == nil {
+		t.Fatalf("opcode out of range converted")
+	}
+}
+
+func TestPacket_Wire(t *testing.T) {
+	// the fields of the zero value are omitted, the others are in the order of their numbers
+	m := &Packet{Opcode: uint32(proto.OpRead), Offset: 300, Data: []byte{0xAB}}
+	want := []byte{2<<3 | wireVarint, byte(proto.OpRead), 8<<3 | wireVarint, 0xAC, 0x02, 11<<3 | wireBytes, 1, 0xAB}
+	data, err := m.Marshal()
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if !bytes.Equal(data, want) {
+		t.Fatalf("have %x, want %x", data, want)
+	}
+	// the unknown fields of a newer peer are skipped
+	data = append([]byte{15<<3 | wireBytes, 2, 'x', 'y', 14<<3 | wireFixed32, 1, 2, 3, 4}, data...)
+	got := new(Packet)
+	if err = got.Unmarshal(data); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(m, got) {
+		t.Fatalf("have %v, want %v", got, m)
+	}
+	if err = got.Unmarshal(want[:len(want)-1]); err != ErrTruncated {
+		t.Fatalf("truncated message: have %v, want %v", err, ErrTruncated)
+	}
+}
@@ -0,0 +1,604 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/log"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// names of the services in packet.proto
+const (
+	MetaService  = "containerfs.MetaService"
+	DataService  = "containerfs.DataService"
+	AdminService = "containerfs.AdminService"
+)
+
+// metadata of a Call authenticating to a node requiring tokens, and of the
+// client session the node fences
+const (
+	MetadataVol     = "cfs-vol"
+	MetadataToken   = "cfs-token"
+	MetadataSession = "cfs-session"
+)
+
+var (
+	ErrListenerClosed = errors.New("grpc listener closed")
+	ErrSessionClosed  = errors.New("grpc session closed")
+)
+
+// a gRPC connection starts with the client preface of HTTP/2, a connection of the
+// packet protocol with the magic of a packet.
+var http2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+// ServeConnFunc serves the packets of a connection of the packet protocol until
+// it is closed.
+type ServeConnFunc func(conn net.Conn)
+
+// Server serves the gRPC services of a node on the port of the packet protocol,
+// the protocol of a connection is negotiated by its first bytes. The calls go
+// through a pipe to the serve loop of the packet protocol, so they are
+// authenticated, checked and replicated as the packets of a connection: the
+// calls of a gRPC connection with the same metadata share a session, one pipe
+// authenticated once, as the packets of a connection share its auth, qos and
+// fence.
+type Server struct {
+	serve    ServeConnFunc
+	server   *grpc.Server
+	listener *connListener
+	sessions map[string]*session
+	sync.Mutex
+}
+
+type packetHandler interface {
+	call(ctx context.Context, service string, req *Packet) (*Packet, error)
+	stream(service string, stream grpc.ServerStream) error
+	invoke(ctx context.Context, m *method, req interface{}) (interface{}, error)
+	read(m *method, stream grpc.ServerStream) error
+}
+
+func NewServer(serve ServeConnFunc, services ...string) (s *Server) {
+	s = &Server{
+		serve:    serve,
+		server:   grpc.NewServer(grpc.CustomCodec(Codec{})),
+		listener: newConnListener(),
+		sessions: make(map[string]*session),
+	}
+	for _, name := range services {
+		s.server.RegisterService(serviceDesc(name), s)
+	}
+	go s.server.Serve(s.listener)
+	return
+}
+
+func (s *Server) Stop() {
+	s.server.Stop()
+	s.listener.Close()
+	s.closeSessions(func(sess *session) bool { return true })
+}
+
+// ServeConn serves the connection accepted by gRPC if it starts with the preface
+// of HTTP/2, by the packet protocol otherwise.
+func (s *Server) ServeConn(conn net.Conn) {
+	bc := &bufferedConn{Conn: conn, r: bufio.NewReaderSize(conn, len(http2Preface))}
+	if head, err := bc.r.Peek(1); err == nil && head[0] == http2Preface[0] {
+		// a packet header is longer than the preface
+		if head, err = bc.r.Peek(len(http2Preface)); err == nil && bytes.Equal(head, http2Preface) {
+			gc := &grpcConn{bufferedConn: bc, server: s}
+			if err = s.listener.put(gc); err != nil {
+				conn.Close()
+			}
+			return
+		}
+	}
+	s.serve(bc)
+}
+
+func serviceDesc(service string) *grpc.ServiceDesc {
+	desc := &grpc.ServiceDesc{
+		ServiceName: service,
+		HandlerType: (*packetHandler)(nil),
+		Methods: []grpc.MethodDesc{
+			{
+				MethodName: "Call",
+				Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+					req := new(Packet)
+					if err := dec(req); err != nil {
+						return nil, err
+					}
+					return srv.(packetHandler).call(ctx, service, req)
+				},
+			},
+		},
+		Streams: []grpc.StreamDesc{
+			{
+				StreamName: "Stream",
+				Handler: func(srv interface{}, stream grpc.ServerStream) error {
+					return srv.(packetHandler).stream(service, stream)
+				},
+				ServerStreams: true,
+				ClientStreams: true,
+			},
+		},
+		Metadata: "packet.proto",
+	}
+	methods := methodsOf(service)
+	for i := range methods {
+		m := &methods[i]
+		desc.Methods = append(desc.Methods, grpc.MethodDesc{
+			MethodName: m.name,
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := m.newRequest()
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				return srv.(packetHandler).invoke(ctx, m, req)
+			},
+		})
+	}
+	if service == DataService {
+		desc.Streams = append(desc.Streams, grpc.StreamDesc{
+			StreamName: readMethod.name,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				return srv.(packetHandler).read(&readMethod, stream)
+			},
+			ServerStreams: true,
+		})
+	}
+	return desc
+}
+
+/*the ops the service takes, the others are refused before reaching the node*/
+func allowed(service string, opcode uint8) bool {
+	switch service {
+	case MetaService:
+		return opcode >= proto.OpMetaCreateInode && opcode < proto.OpCreateMetaPartition ||
+			opcode == proto.OpAuthConn || opcode == proto.OpNegotiate || opcode == proto.OpPing
+	case DataService:
+		return opcode > proto.OpInitResultCode && opcode < proto.OpMetaCreateInode || opcode == proto.OpPing
+	case AdminService:
+		return opcode >= proto.OpCreateMetaPartition && opcode < proto.OpIntraGroupNetErr
+	}
+	return false
+}
+
+func (s *Server) toPacket(service string, req *Packet) (p *proto.Packet, err error) {
+	if p, err = req.ToPacket(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if !allowed(service, p.Opcode) {
+		return nil, status.Errorf(codes.InvalidArgument, "op(%v) not served by %v", p.GetOpMsg(), service)
+	}
+	return
+}
+
+/*a connection to the serve loop of the packet protocol, with the address of the peer of the call*/
+func (s *Server) open(ctx context.Context) net.Conn {
+	local, remote := net.Pipe()
+	go s.serve(&pipeConn{Conn: remote, remote: peerAddr(ctx)})
+	return &pipeConn{Conn: local, remote: pipeAddr("grpc")}
+}
+
+func peerAddr(ctx context.Context) net.Addr {
+	if pr, ok := peer.FromContext(ctx); ok && pr.Addr != nil {
+		return pr.Addr
+	}
+	return pipeAddr("grpc")
+}
+
+/*the vol, the token and the client session in the metadata of a call*/
+func authOf(ctx context.Context) (vol, token, session string) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return
+	}
+	if len(md[MetadataVol]) > 0 && len(md[MetadataToken]) > 0 {
+		vol, token = md[MetadataVol][0], md[MetadataToken][0]
+	}
+	if len(md[MetadataSession]) > 0 {
+		session = md[MetadataSession][0]
+	}
+	return
+}
+
+/*the session of the gRPC connection and the metadata of the call, opened and authenticated if none*/
+func (s *Server) session(ctx context.Context) (sess *session, err error) {
+	addr := peerAddr(ctx)
+	vol, token, fence := authOf(ctx)
+	key := strings.Join([]string{addr.String(), vol, token, fence}, "\x00")
+	s.Lock()
+	sess = s.sessions[key]
+	s.Unlock()
+	if sess != nil {
+		return
+	}
+	conn := s.open(ctx)
+	if vol != "" || fence != "" {
+		var ap, ar *proto.Packet
+		if ap, err = proto.NewAuthConnPacket(vol, token, fence); err != nil {
+			conn.Close()
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if ar, err = roundTrip(conn, ap); err != nil {
+			conn.Close()
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+		if ar.ResultCode != proto.OpOk {
+			conn.Close()
+			return nil, status.Errorf(codes.PermissionDenied, "auth conn: %v", string(ar.Data))
+		}
+	}
+	s.Lock()
+	defer s.Unlock()
+	if other := s.sessions[key]; other != nil {
+		// opened by a concurrent call
+		conn.Close()
+		return other, nil
+	}
+	sess = newSession(key, addr.String(), conn, s.dropSession)
+	s.sessions[key] = sess
+	return
+}
+
+func (s *Server) dropSession(sess *session) {
+	s.Lock()
+	defer s.Unlock()
+	if s.sessions[sess.key] == sess {
+		delete(s.sessions, sess.key)
+	}
+}
+
+func (s *Server) closeSessions(match func(sess *session) bool) {
+	var closed []*session
+	s.Lock()
+	for key, sess := range s.sessions {
+		if match(sess) {
+			closed = append(closed, sess)
+			delete(s.sessions, key)
+		}
+	}
+	s.Unlock()
+	// a session failed drops itself, so out of the lock
+	for _, sess := range closed {
+		sess.fail(ErrSessionClosed)
+	}
+}
+
+/*serve a packet on the session of the call, the replies come on the waiter*/
+func (s *Server) send(ctx context.Context, p *proto.Packet) (sess *session, w *waiter, err error) {
+	if sess, err = s.session(ctx); err != nil {
+		return
+	}
+	if w, err = sess.send(p); err != nil {
+		err = status.Error(codes.Unavailable, err.Error())
+	}
+	return
+}
+
+/*serve the packet on the session of the call, the first reply is returned*/
+func (s *Server) call(ctx context.Context, service string, req *Packet) (reply *Packet, err error) {
+	var p *proto.Packet
+	if p, err = s.toPacket(service, req); err != nil {
+		return
+	}
+	if p.Opcode == proto.OpAuthConn || p.Opcode == proto.OpNegotiate {
+		// the session is shared, a call authenticates with its metadata
+		return nil, status.Errorf(codes.InvalidArgument, "op(%v) of a call, only of a stream", p.GetOpMsg())
+	}
+	var rp *proto.Packet
+	if rp, err = s.roundTrip(ctx, p); err != nil {
+		return
+	}
+	return FromPacket(rp), nil
+}
+
+/*serve the packet of a typed request on the session of the call*/
+func (s *Server) invoke(ctx context.Context, m *method, req interface{}) (reply interface{}, err error) {
+	var p, rp *proto.Packet
+	if p, err = m.toPacket(req); err != nil {
+		return
+	}
+	if rp, err = s.roundTrip(ctx, p); err != nil {
+		return
+	}
+	return m.fromPacket(rp)
+}
+
+func (s *Server) roundTrip(ctx context.Context, p *proto.Packet) (reply *proto.Packet, err error) {
+	sess, w, err := s.send(ctx, p)
+	if err != nil {
+		return
+	}
+	defer sess.cancel(w)
+	select {
+	case reply = <-w.replies:
+		if reply == nil {
+			err = status.Error(codes.Unavailable, w.err.Error())
+		}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return
+}
+
+/*stream the blocks of a stream read back*/
+func (s *Server) read(m *method, stream grpc.ServerStream) (err error) {
+	ctx := stream.Context()
+	req := m.newRequest().(*ExtentRequest)
+	if err = stream.RecvMsg(req); err != nil {
+		return
+	}
+	var p *proto.Packet
+	if p, err = m.toPacket(req); err != nil {
+		return
+	}
+	sess, w, err := s.send(ctx, p)
+	if err != nil {
+		return
+	}
+	defer sess.cancel(w)
+	offset := req.Offset
+	for {
+		var reply *proto.Packet
+		select {
+		case reply = <-w.replies:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if reply == nil {
+			if w.err == errWaiterDone {
+				return nil
+			}
+			return status.Error(codes.Unavailable, w.err.Error())
+		}
+		if reply.ResultCode != proto.OpOk {
+			return replyError(reply)
+		}
+		if err = stream.SendMsg(&ReadReply{Offset: offset, Data: reply.Data[:reply.Size], Crc: reply.Crc}); err != nil {
+			return
+		}
+		offset += int64(reply.Size)
+	}
+}
+
+func roundTrip(conn net.Conn, p *proto.Packet) (reply *proto.Packet, err error) {
+	if err = p.WriteToConn(conn); err != nil {
+		return
+	}
+	reply = proto.NewPacket()
+	err = reply.ReadFromConn(conn, proto.NoReadDeadlineTime)
+	return
+}
+
+// relay the packets of the stream to a connection and its replies back. Once the
+// client closed its side the stream ends with the replies of the packets sent.
+func (s *Server) stream(service string, stream grpc.ServerStream) (err error) {
+	ctx := stream.Context()
+	conn := s.open(ctx)
+	defer conn.Close()
+	pending := newInflight()
+	errC := make(chan error, 2)
+	go func() {
+		for {
+			reply := proto.NewPacket()
+			if err := reply.ReadFromConn(conn, proto.NoReadDeadlineTime); err != nil {
+				errC <- status.Error(codes.Unavailable, err.Error())
+				return
+			}
+			if err := stream.SendMsg(FromPacket(reply)); err != nil {
+				errC <- err
+				return
+			}
+			pending.done(reply)
+		}
+	}()
+	go func() {
+		for {
+			req := new(Packet)
+			if err := stream.RecvMsg(req); err != nil {
+				if err != io.EOF {
+					errC <- err
+				}
+				pending.close()
+				return
+			}
+			p, err := s.toPacket(service, req)
+			if err != nil {
+				errC <- err
+				return
+			}
+			pending.add(p)
+			if err = p.WriteToConn(conn); err != nil {
+				errC <- status.Error(codes.Unavailable, err.Error())
+				return
+			}
+		}
+	}()
+	select {
+	case err = <-errC:
+	case <-pending.drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		log.LogDebugf("action[rpc.stream] service(%v) err(%v)", service, err)
+	}
+	return
+}
+
+// the packets of a stream waiting for their replies, a stream read gets
+// replies up to its size
+type inflight struct {
+	reqs    map[int64]int64
+	closed  bool
+	drained chan struct{}
+	sync.Mutex
+}
+
+func newInflight() *inflight {
+	return &inflight{reqs: make(map[int64]int64), drained: make(chan struct{})}
+}
+
+func (f *inflight) add(p *proto.Packet) {
+	f.Lock()
+	defer f.Unlock()
+	if p.Opcode == proto.OpStreamRead {
+		f.reqs[p.ReqID] = int64(p.Size)
+	} else {
+		f.reqs[p.ReqID] = 0
+	}
+}
+
+func (f *inflight) done(reply *proto.Packet) {
+	f.Lock()
+	defer f.Unlock()
+	remain, ok := f.reqs[reply.ReqID]
+	if !ok {
+		return
+	}
+	remain -= int64(reply.Size)
+	if reply.Opcode != proto.OpStreamRead || reply.ResultCode != proto.OpOk || remain <= 0 {
+		delete(f.reqs, reply.ReqID)
+	} else {
+		f.reqs[reply.ReqID] = remain
+	}
+	f.checkDrained()
+}
+
+func (f *inflight) close() {
+	f.Lock()
+	defer f.Unlock()
+	f.closed = true
+	f.checkDrained()
+}
+
+/*the caller must hold the lock of inflight*/
+func (f *inflight) checkDrained() {
+	if f.closed && len(f.reqs) == 0 {
+		select {
+		case <-f.drained:
+		default:
+			close(f.drained)
+		}
+	}
+}
+
+// the accepted connections of gRPC
+type connListener struct {
+	conns  chan net.Conn
+	closeC chan struct{}
+	once   sync.Once
+}
+
+func newConnListener() *connListener {
+	return &connListener{conns: make(chan net.Conn), closeC: make(chan struct{})}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closeC:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() {
+		close(l.closeC)
+	})
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return pipeAddr("grpc")
+}
+
+func (l *connListener) put(conn net.Conn) error {
+	select {
+	case l.conns <- conn:
+		return nil
+	case <-l.closeC:
+		return ErrListenerClosed
+	}
+}
+
+// a connection accepted by gRPC, its sessions are closed with it
+type grpcConn struct {
+	*bufferedConn
+	server *Server
+	once   sync.Once
+}
+
+func (c *grpcConn) Close() (err error) {
+	err = c.bufferedConn.Close()
+	c.once.Do(func() {
+		addr := c.RemoteAddr().String()
+		c.server.closeSessions(func(sess *session) bool { return sess.addr == addr })
+	})
+	return
+}
+
+// a connection with the bytes peeked for the negotiation read first
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+type pipeConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// an empty write of a pipe waits for a read of the peer, as the one of the arg of
+// a packet without any
+func (c *pipeConn) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	return c.Conn.Write(b)
+}
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string {
+	return "pipe"
+}
+
+func (a pipeAddr) String() string {
+	return string(a)
+}
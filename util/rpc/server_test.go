@@ -0,0 +1,271 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package rpc
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// testNode serves the packets of a connection as a node, the token of the
+// vols is secret
+type testNode struct {
+	conns int32
+}
+
+func (n *testNode) serve(conn net.Conn) {
+	atomic.AddInt32(&n.conns, 1)
+	defer conn.Close()
+	for {
+		p := proto.NewPacket()
+		if err := p.ReadFromConn(conn, proto.NoReadDeadlineTime); err != nil {
+			return
+		}
+		switch p.Opcode {
+		case proto.OpAuthConn:
+			req := new(proto.AuthConnRequest)
+			if p.UnmarshalData(req); req.Token != "secret" {
+				p.PackErrorWithBody(proto.OpAccessErr, []byte("token mismatch"))
+			} else {
+				p.PackOkReply()
+			}
+		case proto.OpMetaLookup:
+			req := new(proto.LookupRequest)
+			p.UnmarshalData(req)
+			if req.Name == "missing" {
+				p.PackErrorWithBody(proto.OpNotExistErr, []byte("no dentry"))
+			} else {
+				data, _ := json.Marshal(&proto.LookupResponse{Inode: req.ParentID + 1, Mode: 0644})
+				p.PackOkWithBody(data)
+			}
+		case proto.OpStreamRead:
+			for remain := p.Size; remain > 0; {
+				size := uint32(util.Min(int(remain), util.ReadBlockSize))
+				p.Data, p.Size, p.ResultCode = make([]byte, size), size, proto.OpOk
+				if err := p.WriteToConn(conn); err != nil {
+					return
+				}
+				remain -= size
+			}
+			continue
+		default:
+			p.PackOkReply()
+		}
+		if err := p.WriteToConn(conn); err != nil {
+			return
+		}
+	}
+}
+
+func startServer(t *testing.T) (s *Server, node *testNode, ln net.Listener) {
+	node = new(testNode)
+	s = NewServer(node.serve, MetaService, DataService)
+	var err error
+	if ln, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.ServeConn(conn)
+		}
+	}()
+	return s, node, ln
+}
+
+func dial(t *testing.T, addr string) *grpc.ClientConn {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cc, err := grpc.DialContext(ctx, addr, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithCodec(Codec{}))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	return cc
+}
+
+func TestServer_ServeConn(t *testing.T) {
+	s, node, ln := startServer(t)
+	defer ln.Close()
+	defer s.Stop()
+	addr := ln.Addr().String()
+	// a connection of the packet protocol goes to the serve loop
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	p := proto.NewPacket()
+	p.Opcode = proto.OpPing
+	p.ReqID = proto.GetReqID()
+	if err = p.WriteToConn(conn); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	reply := proto.NewPacket()
+	if err = reply.ReadFromConn(conn, 5); err != nil || reply.ResultCode != proto.OpOk || reply.ReqID != p.ReqID {
+		t.Fatalf("reply %v, err(%v)", reply, err)
+	}
+	// and one of gRPC to the services on the same port
+	cc := dial(t, addr)
+	defer cc.Close()
+	rp := new(Packet)
+	if err = cc.Invoke(context.Background(), "/"+MetaService+"/Call", FromPacket(p), rp); err != nil || rp.ResultCode != uint32(proto.OpOk) {
+		t.Fatalf("call: reply %v, err(%v)", rp, err)
+	}
+	if conns := atomic.LoadInt32(&node.conns); conns != 2 {
+		t.Fatalf("%v conns served, want 2", conns)
+	}
+}
+
+func TestServer_Call(t *testing.T) {
+	s, node, ln := startServer(t)
+	defer ln.Close()
+	defer s.Stop()
+	addr := ln.Addr().String()
+	cc := dial(t, addr)
+	defer cc.Close()
+	ctx := metadata.AppendToOutgoingContext(context.Background(), MetadataVol, "ltptest", MetadataToken, "secret")
+	// the calls of the connection with the same metadata share a session
+	for i := 0; i < 3; i++ {
+		reply := new(LookupReply)
+		if err := cc.Invoke(ctx, "/"+MetaService+"/Lookup", &LookupRequest{VolName: "ltptest", ParentID: 1, Name: "a"}, reply); err != nil {
+			t.Fatalf("lookup: %v", err)
+		}
+		if reply.Inode != 2 || reply.Mode != 0644 {
+			t.Fatalf("lookup reply %+v", reply)
+		}
+	}
+	err := cc.Invoke(ctx, "/"+MetaService+"/Lookup", &LookupRequest{ParentID: 1, Name: "missing"}, new(LookupReply))
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("lookup of a missing dentry: %v", err)
+	}
+	if conns := atomic.LoadInt32(&node.conns); conns != 1 {
+		t.Fatalf("%v conns served, want 1", conns)
+	}
+	// a call authenticates with its metadata only
+	auth, _ := proto.NewAuthConnPacket("ltptest", "secret", "")
+	if err = cc.Invoke(ctx, "/"+MetaService+"/Call", FromPacket(auth), new(Packet)); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("auth conn of a call: %v", err)
+	}
+	bad := metadata.AppendToOutgoingContext(context.Background(), MetadataVol, "ltptest", MetadataToken, "guess")
+	if err = cc.Invoke(bad, "/"+MetaService+"/Lookup", &LookupRequest{ParentID: 1, Name: "a"}, new(LookupReply)); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("lookup with a bad token: %v", err)
+	}
+	if conns := atomic.LoadInt32(&node.conns); conns != 2 {
+		t.Fatalf("%v conns served, want 2", conns)
+	}
+	// the ops of another service are refused
+	write := proto.NewPacket()
+	write.Opcode = proto.OpWrite
+	if err = cc.Invoke(ctx, "/"+MetaService+"/Call", FromPacket(write), new(Packet)); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("write of the meta service: %v", err)
+	}
+}
+
+func TestServer_Read(t *testing.T) {
+	s, _, ln := startServer(t)
+	defer ln.Close()
+	defer s.Stop()
+	addr := ln.Addr().String()
+	cc := dial(t, addr)
+	defer cc.Close()
+	desc := &grpc.StreamDesc{StreamName: "Read", ServerStreams: true}
+	stream, err := cc.NewStream(context.Background(), desc, "/"+DataService+"/Read")
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	req := &ExtentRequest{PartitionID: 1, ExtentID: 2, Offset: 100, Size: util.ReadBlockSize*2 + 1}
+	if err = stream.SendMsg(req); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if err = stream.CloseSend(); err != nil {
+		t.Fatalf("close send: %v", err)
+	}
+	offset := req.Offset
+	for {
+		reply := new(ReadReply)
+		if err = stream.RecvMsg(reply); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("recv: %v", err)
+		}
+		if reply.Offset != offset {
+			t.Fatalf("block at %v, want %v", reply.Offset, offset)
+		}
+		offset += int64(len(reply.Data))
+	}
+	if offset != req.Offset+int64(req.Size) {
+		t.Fatalf("read up to %v, want %v", offset, req.Offset+int64(req.Size))
+	}
+}
+
+func TestServer_Stream(t *testing.T) {
+	s, node, ln := startServer(t)
+	defer ln.Close()
+	defer s.Stop()
+	addr := ln.Addr().String()
+	cc := dial(t, addr)
+	defer cc.Close()
+	desc := &grpc.StreamDesc{StreamName: "Stream", ServerStreams: true, ClientStreams: true}
+	stream, err := cc.NewStream(context.Background(), desc, "/"+MetaService+"/Stream")
+	if err != nil {
+		t.Fatalf("stream: %v", err)
+	}
+	// a stream is a connection of its own, authenticated by its first packet
+	auth, _ := proto.NewAuthConnPacket("ltptest", "secret", "")
+	lookup := proto.NewPacket()
+	lookup.Opcode = proto.OpMetaLookup
+	lookup.ReqID = proto.GetReqID()
+	lookup.MarshalData(&proto.LookupRequest{ParentID: 1, Name: "a"})
+	for _, p := range []*proto.Packet{auth, lookup} {
+		if err = stream.SendMsg(FromPacket(p)); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+	if err = stream.CloseSend(); err != nil {
+		t.Fatalf("close send: %v", err)
+	}
+	var replies []*Packet
+	for {
+		reply := new(Packet)
+		if err = stream.RecvMsg(reply); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("recv: %v", err)
+		}
+		replies = append(replies, reply)
+	}
+	if len(replies) != 2 || replies[0].ReqID != auth.ReqID || replies[1].ReqID != lookup.ReqID ||
+		replies[1].ResultCode != uint32(proto.OpOk) {
+		t.Fatalf("replies %v", replies)
+	}
+	if conns := atomic.LoadInt32(&node.conns); conns != 1 {
+		t.Fatalf("%v conns served, want 1", conns)
+	}
+}
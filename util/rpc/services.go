@@ -0,0 +1,275 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package rpc
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"strings"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// method is a typed RPC of a service, served by the packet of an op.
+type method struct {
+	name       string
+	opcode     uint8
+	newRequest func() interface{}
+	// the packet of the request, the body of a meta op or an admin task is the
+	// request marshaled if nil
+	packet func(req interface{}) (*proto.Packet, error)
+	// the reply of the packet replied ok, the body unmarshaled if nil
+	reply    func(p *proto.Packet) (interface{}, error)
+	newReply func() interface{}
+}
+
+func empty() interface{} { return new(Empty) }
+
+var metaMethods = []method{
+	{name: "CreateInode", opcode: proto.OpMetaCreateInode,
+		newRequest: func() interface{} { return new(CreateInodeRequest) }, newReply: func() interface{} { return new(InodeReply) }},
+	{name: "LinkInode", opcode: proto.OpMetaLinkInode,
+		newRequest: func() interface{} { return new(InodeRequest) }, newReply: func() interface{} { return new(InodeReply) }},
+	{name: "UnlinkInode", opcode: proto.OpMetaDeleteInode,
+		newRequest: func() interface{} { return new(InodeRequest) }, newReply: func() interface{} { return new(InodeReply) }},
+	{name: "EvictInode", opcode: proto.OpMetaEvictInode,
+		newRequest: func() interface{} { return new(InodeRequest) }, newReply: empty},
+	{name: "InodeGet", opcode: proto.OpMetaInodeGet,
+		newRequest: func() interface{} { return new(InodeGetRequest) }, newReply: func() interface{} { return new(InodeReply) }},
+	{name: "BatchInodeGet", opcode: proto.OpMetaBatchInodeGet,
+		newRequest: func() interface{} { return new(BatchInodeGetRequest) }, newReply: func() interface{} { return new(BatchInodeGetReply) }},
+	{name: "CreateDentry", opcode: proto.OpMetaCreateDentry,
+		newRequest: func() interface{} { return new(CreateDentryRequest) }, newReply: empty},
+	{name: "DeleteDentry", opcode: proto.OpMetaDeleteDentry,
+		newRequest: func() interface{} { return new(DeleteDentryRequest) }, newReply: func() interface{} { return new(DentryReply) }},
+	{name: "UpdateDentry", opcode: proto.OpMetaUpdateDentry,
+		newRequest: func() interface{} { return new(UpdateDentryRequest) }, newReply: func() interface{} { return new(DentryReply) }},
+	{name: "Lookup", opcode: proto.OpMetaLookup,
+		newRequest: func() interface{} { return new(LookupRequest) }, newReply: func() interface{} { return new(LookupReply) }},
+	{name: "ReadDir", opcode: proto.OpMetaReadDir,
+		newRequest: func() interface{} { return new(ReadDirRequest) }, newReply: func() interface{} { return new(ReadDirReply) }},
+	{name: "ExtentsList", opcode: proto.OpMetaExtentsList,
+		newRequest: func() interface{} { return new(InodeRequest) }, newReply: func() interface{} { return new(ExtentsListReply) }},
+	{name: "ExtentsAdd", opcode: proto.OpMetaExtentsAdd,
+		newRequest: func() interface{} { return new(ExtentsAddRequest) }, newReply: empty},
+	{name: "Truncate", opcode: proto.OpMetaTruncate,
+		newRequest: func() interface{} { return new(TruncateRequest) }, newReply: func() interface{} { return new(TruncateReply) }},
+	{name: "SetAttr", opcode: proto.OpMetaSetattr,
+		newRequest: func() interface{} { return new(SetAttrRequest) }, newReply: empty},
+}
+
+var dataMethods = []method{
+	{name: "CreateExtent", opcode: proto.OpCreateFile,
+		newRequest: func() interface{} { return new(CreateExtentRequest) },
+		packet: func(req interface{}) (p *proto.Packet, err error) {
+			r := req.(*CreateExtentRequest)
+			if p, err = chainPacket(proto.OpCreateFile, r.PartitionID, r.Hosts, r.Epoch); err != nil {
+				return
+			}
+			p.Data = make([]byte, 8, 16)
+			binary.BigEndian.PutUint64(p.Data, r.Inode)
+			if r.Prealloc > 0 {
+				p.Data = p.Data[:16]
+				binary.BigEndian.PutUint64(p.Data[8:], uint64(r.Prealloc))
+			}
+			p.Size = uint32(len(p.Data))
+			return
+		},
+		reply: func(p *proto.Packet) (interface{}, error) {
+			return &CreateExtentReply{ExtentID: p.FileID}, nil
+		}},
+	{name: "Write", opcode: proto.OpWrite,
+		newRequest: func() interface{} { return new(WriteRequest) },
+		packet: func(req interface{}) (p *proto.Packet, err error) {
+			r := req.(*WriteRequest)
+			if len(r.Data) == 0 || len(r.Data) > util.BlockSize {
+				return nil, status.Errorf(codes.InvalidArgument, "write of %v bytes, 1 to %v", len(r.Data), util.BlockSize)
+			}
+			if p, err = chainPacket(proto.OpWrite, r.PartitionID, r.Hosts, r.Epoch); err != nil {
+				return
+			}
+			p.FileID, p.Offset = r.ExtentID, r.Offset
+			p.Data, p.Size = r.Data, uint32(len(r.Data))
+			p.Crc = crc32.ChecksumIEEE(r.Data)
+			return
+		},
+		newReply: empty},
+	{name: "MarkDelete", opcode: proto.OpMarkDelete,
+		newRequest: func() interface{} { return new(MarkDeleteRequest) },
+		packet: func(req interface{}) (p *proto.Packet, err error) {
+			r := req.(*MarkDeleteRequest)
+			if p, err = chainPacket(proto.OpMarkDelete, r.PartitionID, r.Hosts, r.Epoch); err == nil {
+				p.FileID = r.ExtentID
+			}
+			return
+		},
+		newReply: empty},
+	{name: "GetWatermark", opcode: proto.OpGetWatermark,
+		newRequest: func() interface{} { return new(ExtentRequest) },
+		packet: func(req interface{}) (*proto.Packet, error) {
+			return extentPacket(proto.OpGetWatermark, req.(*ExtentRequest)), nil
+		},
+		newReply: func() interface{} { return new(WatermarkReply) }},
+}
+
+// readMethod is the server streaming Read of DataService, a stream read of the
+// range replied in blocks.
+var readMethod = method{name: "Read", opcode: proto.OpStreamRead,
+	newRequest: func() interface{} { return new(ExtentRequest) },
+	packet: func(req interface{}) (p *proto.Packet, err error) {
+		r := req.(*ExtentRequest)
+		if r.Size == 0 || r.Size > util.ExtentSize {
+			return nil, status.Errorf(codes.InvalidArgument, "read of %v bytes, 1 to %v", r.Size, util.ExtentSize)
+		}
+		p = extentPacket(proto.OpStreamRead, r)
+		p.Size = r.Size
+		return
+	}}
+
+var adminMethods = []method{
+	{name: "CreateDataPartition", opcode: proto.OpCreateDataPartition,
+		newRequest: func() interface{} { return new(CreateDataPartitionRequest) }, reply: adminReply},
+	{name: "DeleteDataPartition", opcode: proto.OpDeleteDataPartition,
+		newRequest: func() interface{} { return new(DeleteDataPartitionRequest) }, reply: adminReply},
+	{name: "CreateMetaPartition", opcode: proto.OpCreateMetaPartition,
+		newRequest: func() interface{} { return new(CreateMetaPartitionRequest) }, reply: adminReply},
+	{name: "DeleteMetaPartition", opcode: proto.OpDeleteMetaPartition,
+		newRequest: func() interface{} { return new(DeleteMetaPartitionRequest) }, reply: adminReply},
+}
+
+func methodsOf(service string) []method {
+	switch service {
+	case MetaService:
+		return metaMethods
+	case DataService:
+		return dataMethods
+	case AdminService:
+		return adminMethods
+	}
+	return nil
+}
+
+/*the packet of a typed request*/
+func (m *method) toPacket(req interface{}) (p *proto.Packet, err error) {
+	if m.packet != nil {
+		return m.packet(req)
+	}
+	p = proto.NewPacket()
+	p.Opcode = m.opcode
+	p.ReqID = proto.GetReqID()
+	body := req
+	if m.opcode >= proto.OpCreateMetaPartition {
+		body = &proto.AdminTask{ID: taskID(req), OpCode: m.opcode, Request: req}
+	}
+	if err = p.MarshalData(body); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return
+}
+
+/*the typed reply of a packet, the error of a packet failed*/
+func (m *method) fromPacket(p *proto.Packet) (reply interface{}, err error) {
+	if p.ResultCode != proto.OpOk {
+		return nil, replyError(p)
+	}
+	if m.reply != nil {
+		return m.reply(p)
+	}
+	reply = m.newReply()
+	if _, ok := reply.(*Empty); ok || p.Size == 0 {
+		return
+	}
+	if err = json.Unmarshal(p.Data[:p.Size], reply); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return
+}
+
+func adminReply(p *proto.Packet) (interface{}, error) {
+	reply := &AdminReply{ResultCode: uint32(p.ResultCode)}
+	if p.Size > 0 {
+		reply.Message = string(p.Data[:p.Size])
+	}
+	return reply, nil
+}
+
+func taskID(req interface{}) string {
+	switch r := req.(type) {
+	case *CreateDataPartitionRequest:
+		return r.TaskID
+	case *DeleteDataPartitionRequest:
+		return r.TaskID
+	case *CreateMetaPartitionRequest:
+		return r.TaskID
+	case *DeleteMetaPartitionRequest:
+		return r.TaskID
+	}
+	return ""
+}
+
+/*a packet of the replication chain of the hosts of a partition*/
+func chainPacket(opcode uint8, partitionID uint32, hosts []string, epoch uint64) (p *proto.Packet, err error) {
+	if len(hosts) < 1 || len(hosts) > 0xFF {
+		return nil, status.Errorf(codes.InvalidArgument, "%v hosts of partition(%v)", len(hosts), partitionID)
+	}
+	p = proto.NewPacket()
+	p.Opcode = opcode
+	p.StoreMode = proto.ExtentStoreMode
+	p.PartitionID = partitionID
+	p.ReqID = proto.GetReqID()
+	p.Nodes = uint8(len(hosts) - 1)
+	p.Arg = proto.ArgWithEpoch(strings.Join(hosts[1:], proto.AddrSplit)+proto.AddrSplit, epoch)
+	p.Arglen = uint32(len(p.Arg))
+	return
+}
+
+func extentPacket(opcode uint8, r *ExtentRequest) (p *proto.Packet) {
+	p = proto.NewPacket()
+	p.Opcode = opcode
+	p.StoreMode = proto.ExtentStoreMode
+	p.PartitionID = r.PartitionID
+	p.FileID = r.ExtentID
+	p.Offset = r.Offset
+	p.ReqID = proto.GetReqID()
+	return
+}
+
+/*the status of gRPC of a packet failed, its body has the error code*/
+func replyError(p *proto.Packet) error {
+	msg := p.GetResultMesg()
+	if p.Size > 0 && len(p.Data) >= int(p.Size) {
+		msg = string(p.Data[:p.Size])
+	}
+	code := codes.Internal
+	switch p.ResultCode {
+	case proto.OpNotExistErr:
+		code = codes.NotFound
+	case proto.OpExistErr:
+		code = codes.AlreadyExists
+	case proto.OpNotPermErr, proto.OpAccessErr:
+		code = codes.PermissionDenied
+	case proto.OpArgMismatchErr:
+		code = codes.InvalidArgument
+	case proto.OpReadOnlyErr:
+		code = codes.FailedPrecondition
+	case proto.OpAgain, proto.OpIntraGroupNetErr:
+		code = codes.Unavailable
+	}
+	return status.Error(code, msg)
+}
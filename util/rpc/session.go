@@ -0,0 +1,164 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package rpc
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+var errWaiterDone = errors.New("replies done")
+
+// session is a connection to the serve loop of the packet protocol shared by
+// the calls of a gRPC connection with the same metadata. The packets of the
+// calls are written in turn with the request ids of the session, so the calls
+// of different clients don't collide, and the replies are dispatched back by
+// them with the ids of the calls.
+type session struct {
+	key     string
+	addr    string
+	conn    net.Conn
+	drop    func(sess *session)
+	seq     int64
+	waiters map[int64]*waiter
+	err     error
+	wLock   sync.Mutex
+	sync.Mutex
+}
+
+// waiter is a packet sent waiting for its replies, the replies of a stream
+// read up to its size, the replies are closed once received or the session
+// failed.
+type waiter struct {
+	seq     int64
+	reqID   int64
+	stream  bool
+	remain  int64
+	replies chan *proto.Packet
+	err     error
+}
+
+func newSession(key, addr string, conn net.Conn, drop func(sess *session)) (sess *session) {
+	sess = &session{
+		key:     key,
+		addr:    addr,
+		conn:    conn,
+		drop:    drop,
+		waiters: make(map[int64]*waiter),
+	}
+	go sess.receive()
+	return
+}
+
+func (sess *session) send(p *proto.Packet) (w *waiter, err error) {
+	sess.Lock()
+	if sess.err != nil {
+		err = sess.err
+		sess.Unlock()
+		return
+	}
+	sess.seq++
+	w = &waiter{seq: sess.seq, reqID: p.ReqID}
+	if p.Opcode == proto.OpStreamRead {
+		w.stream, w.remain = true, int64(p.Size)
+		w.replies = make(chan *proto.Packet, int(p.Size)/util.ReadBlockSize+2)
+	} else {
+		w.replies = make(chan *proto.Packet, 1)
+	}
+	p.ReqID = w.seq
+	sess.waiters[w.seq] = w
+	sess.Unlock()
+
+	sess.wLock.Lock()
+	err = p.WriteToConn(sess.conn)
+	sess.wLock.Unlock()
+	if err != nil {
+		sess.fail(err)
+		return nil, err
+	}
+	return
+}
+
+/*a call done or canceled, the replies left are dropped*/
+func (sess *session) cancel(w *waiter) {
+	sess.Lock()
+	defer sess.Unlock()
+	if sess.waiters[w.seq] == w {
+		delete(sess.waiters, w.seq)
+	}
+}
+
+func (sess *session) receive() {
+	for {
+		reply := proto.NewPacket()
+		if err := reply.ReadFromConn(sess.conn, proto.NoReadDeadlineTime); err != nil {
+			sess.fail(err)
+			return
+		}
+		sess.dispatch(reply)
+	}
+}
+
+func (sess *session) dispatch(reply *proto.Packet) {
+	sess.Lock()
+	defer sess.Unlock()
+	w := sess.waiters[reply.ReqID]
+	if w == nil {
+		return
+	}
+	reply.ReqID = w.reqID
+	done := true
+	if w.stream && reply.ResultCode == proto.OpOk {
+		w.remain -= int64(reply.Size)
+		done = w.remain <= 0
+	}
+	select {
+	case w.replies <- reply:
+	default:
+		log.LogWarnf("action[rpc.dispatch] session(%v) reply of req(%v) dropped, more than the ones of its size",
+			sess.addr, w.reqID)
+		done = true
+	}
+	if done {
+		delete(sess.waiters, w.seq)
+		if w.stream {
+			w.err = errWaiterDone
+			close(w.replies)
+		}
+	}
+}
+
+/*close the session, its waiters get the error*/
+func (sess *session) fail(err error) {
+	sess.Lock()
+	if sess.err != nil {
+		sess.Unlock()
+		return
+	}
+	sess.err = err
+	for seq, w := range sess.waiters {
+		w.err = err
+		close(w.replies)
+		delete(sess.waiters, seq)
+	}
+	sess.Unlock()
+	sess.conn.Close()
+	sess.drop(sess)
+}
@@ -0,0 +1,139 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package rpc
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util"
+)
+
+func testPacket(opcode uint8, reqID int64, body string) *proto.Packet {
+	p := proto.NewPacket()
+	p.Opcode = opcode
+	p.ReqID = reqID
+	p.Data = []byte(body)
+	p.Size = uint32(len(p.Data))
+	return p
+}
+
+func readPacket(t *testing.T, conn net.Conn) *proto.Packet {
+	p := proto.NewPacket()
+	if err := p.ReadFromConn(conn, 5); err != nil {
+		t.Fatalf("read packet: %v", err)
+	}
+	return p
+}
+
+func waitReply(t *testing.T, w *waiter) *proto.Packet {
+	select {
+	case reply := <-w.replies:
+		return reply
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no reply of req(%v)", w.reqID)
+	}
+	return nil
+}
+
+func TestSession_Dispatch(t *testing.T) {
+	local, pipe := net.Pipe()
+	remote := &pipeConn{Conn: pipe, remote: pipeAddr("grpc")}
+	defer remote.Close()
+	dropped := make(chan *session, 1)
+	sess := newSession("key", "addr", &pipeConn{Conn: local, remote: pipeAddr("node")}, func(sess *session) { dropped <- sess })
+
+	// the calls of two clients with the same request id
+	go func() {
+		first, second := readPacket(t, remote), readPacket(t, remote)
+		if first.ReqID == second.ReqID {
+			t.Errorf("packets of the session with the same req(%v)", first.ReqID)
+		}
+		// replied out of order
+		second.PackOkWithBody(second.Data)
+		second.WriteToConn(remote)
+		first.PackOkWithBody(first.Data)
+		first.WriteToConn(remote)
+	}()
+	w1, err := sess.send(testPacket(proto.OpMetaLookup, 7, "a"))
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	w2, err := sess.send(testPacket(proto.OpMetaLookup, 7, "b"))
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	for w, body := range map[*waiter]string{w1: "a", w2: "b"} {
+		reply := waitReply(t, w)
+		if reply == nil || reply.ReqID != 7 || string(reply.Data[:reply.Size]) != body {
+			t.Fatalf("reply %v of %v", reply, body)
+		}
+		sess.cancel(w)
+	}
+
+	// the replies of a stream read up to its size
+	go func() {
+		req := readPacket(t, remote)
+		for remain := req.Size; remain > 0; {
+			size := uint32(util.Min(int(remain), util.ReadBlockSize))
+			req.Data = make([]byte, size)
+			req.Size = size
+			req.ResultCode = proto.OpOk
+			req.WriteToConn(remote)
+			remain -= size
+		}
+	}()
+	read := testPacket(proto.OpStreamRead, 8, "")
+	read.Data, read.Size = nil, util.ReadBlockSize*2+1
+	w, err := sess.send(read)
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	var size uint32
+	for reply := waitReply(t, w); reply != nil; reply = waitReply(t, w) {
+		if reply.ReqID != 8 {
+			t.Fatalf("reply of req(%v), want 8", reply.ReqID)
+		}
+		size += reply.Size
+	}
+	if size != read.Size || w.err != errWaiterDone {
+		t.Fatalf("read %v of %v, err(%v)", size, read.Size, w.err)
+	}
+
+	// the waiters fail with the connection
+	go func() {
+		readPacket(t, remote)
+		remote.Close()
+	}()
+	if w, err = sess.send(testPacket(proto.OpMetaLookup, 9, "c")); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if reply := waitReply(t, w); reply != nil || w.err == nil {
+		t.Fatalf("reply %v of a session closed, err(%v)", reply, w.err)
+	}
+	select {
+	case d := <-dropped:
+		if d != sess {
+			t.Fatalf("dropped another session")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("session failed not dropped")
+	}
+	if _, err = sess.send(testPacket(proto.OpMetaLookup, 10, "d")); err == nil {
+		t.Fatalf("send on a session failed")
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package slowop reports the requests served slower than the threshold of
+// their op: they are logged with the context of the request, counted by op
+// and posted as alerts to a webhook if one is set.
+package slowop
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	DefaultThreshold = time.Second
+	AlertInterval    = time.Minute //an op is alerted at most once in it, the alert counts the slow ops since the previous one
+	AlertQueue       = 1000
+	AlertTimeout     = 10 * time.Second
+)
+
+// Alert is posted as JSON to the webhook.
+type Alert struct {
+	Time        int64 //unix seconds
+	Role        string
+	Host        string
+	Op          string
+	LatencyMs   int64
+	ThresholdMs int64
+	Count       uint64 //slow ops of the op since the previous alert, this one included
+	Request     string //the context of the request
+}
+
+type opStats struct {
+	count     uint64
+	unalerted uint64
+	lastAlert int64 //unix nanoseconds
+}
+
+// Detector checks the latency of the requests against the thresholds, a nil
+// Detector detects nothing.
+type Detector struct {
+	role       string
+	host       atomic.Value //string
+	threshold  time.Duration
+	thresholds map[string]time.Duration
+	webhook    string
+	ops        sync.Map //op -> *opStats
+	queue      chan *Alert
+	client     *http.Client
+	dropped    uint64
+	stopC      chan struct{}
+	wg         sync.WaitGroup
+}
+
+// NewDetector reports the requests of role on host taking at least threshold,
+// or the threshold of their op in thresholds. A non positive threshold
+// disables the ops without one of their own, an empty webhook posts no alert.
+func NewDetector(role, host string, threshold time.Duration, thresholds map[string]time.Duration, webhook string) (d *Detector) {
+	d = &Detector{
+		role:       role,
+		threshold:  threshold,
+		thresholds: thresholds,
+		webhook:    webhook,
+		stopC:      make(chan struct{}),
+	}
+	d.host.Store(host)
+	if d.thresholds == nil {
+		d.thresholds = make(map[string]time.Duration)
+	}
+	if webhook != "" {
+		d.queue = make(chan *Alert, AlertQueue)
+		d.client = &http.Client{Timeout: AlertTimeout}
+		d.wg.Add(1)
+		go d.alertScheduler()
+	}
+	return
+}
+
+// SetHost sets the host of the alerts, for a node learning its address after the start.
+func (d *Detector) SetHost(host string) {
+	if d == nil {
+		return
+	}
+	d.host.Store(host)
+}
+
+// ParseThresholds parses the "OP:MS" thresholds of the config, e.g.
+// "OpMetaLookup:50", the op is named as by GetOpMsg of its packet.
+func ParseThresholds(values []interface{}) (thresholds map[string]time.Duration, err error) {
+	thresholds = make(map[string]time.Duration)
+	for _, v := range values {
+		value, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("bad slow op threshold %v", v)
+		}
+		arr := strings.Split(value, ":")
+		if len(arr) != 2 || arr[0] == "" {
+			return nil, fmt.Errorf("bad slow op threshold %v", value)
+		}
+		ms, err := strconv.ParseInt(arr[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad slow op threshold %v", value)
+		}
+		thresholds[arr[0]] = time.Duration(ms) * time.Millisecond
+	}
+	return
+}
+
+// Threshold returns the threshold of op, not positive if its slow ops are not reported.
+func (d *Detector) Threshold(op string) time.Duration {
+	if t, ok := d.thresholds[op]; ok {
+		return t
+	}
+	return d.threshold
+}
+
+// Check reports the request of op if it took at least the threshold of op,
+// request returns the context of the request and is called only then.
+func (d *Detector) Check(op string, latency time.Duration, request func() string) (slow bool) {
+	if d == nil {
+		return
+	}
+	threshold := d.Threshold(op)
+	if threshold <= 0 || latency < threshold {
+		return
+	}
+	v, ok := d.ops.Load(op)
+	if !ok {
+		v, _ = d.ops.LoadOrStore(op, &opStats{})
+	}
+	stats := v.(*opStats)
+	atomic.AddUint64(&stats.count, 1)
+	unalerted := atomic.AddUint64(&stats.unalerted, 1)
+	ctx := request()
+	log.LogWarnf("action[slowOp] op(%v) latency(%v) threshold(%v) %v", op, latency, threshold, ctx)
+	if d.queue == nil {
+		return true
+	}
+	now := time.Now()
+	last := atomic.LoadInt64(&stats.lastAlert)
+	if now.UnixNano()-last < int64(AlertInterval) || !atomic.CompareAndSwapInt64(&stats.lastAlert, last, now.UnixNano()) {
+		return true
+	}
+	atomic.AddUint64(&stats.unalerted, ^(unalerted - 1))
+	alert := &Alert{
+		Time:        now.Unix(),
+		Role:        d.role,
+		Host:        d.host.Load().(string),
+		Op:          op,
+		LatencyMs:   int64(latency / time.Millisecond),
+		ThresholdMs: int64(threshold / time.Millisecond),
+		Count:       unalerted,
+		Request:     ctx,
+	}
+	select {
+	case d.queue <- alert:
+	default:
+		atomic.AddUint64(&d.dropped, 1)
+	}
+	return true
+}
+
+// Range calls f with the slow ops of each op since the start.
+func (d *Detector) Range(f func(op string, count uint64)) {
+	if d == nil {
+		return
+	}
+	d.ops.Range(func(op, v interface{}) bool {
+		f(op.(string), atomic.LoadUint64(&v.(*opStats).count))
+		return true
+	})
+}
+
+// Dropped returns the alerts the webhook did not get.
+func (d *Detector) Dropped() uint64 {
+	if d == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&d.dropped)
+}
+
+func (d *Detector) alertScheduler() {
+	defer d.wg.Done()
+	for {
+		select {
+		case alert := <-d.queue:
+			d.post(alert)
+		case <-d.stopC:
+			for len(d.queue) != 0 {
+				d.post(<-d.queue)
+			}
+			return
+		}
+	}
+}
+
+func (d *Detector) post(alert *Alert) {
+	data, err := json.Marshal(alert)
+	if err != nil {
+		return
+	}
+	resp, err := d.client.Post(d.webhook, "application/json", bytes.NewReader(data))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			err = fmt.Errorf("status %v", resp.StatusCode)
+		}
+	}
+	if err != nil {
+		atomic.AddUint64(&d.dropped, 1)
+		log.LogWarnf("action[slowOp] post alert of op(%v) to webhook(%v): %v", alert.Op, d.webhook, err)
+	}
+}
+
+// Close posts the alerts queued and stops.
+func (d *Detector) Close() {
+	if d == nil || d.queue == nil {
+		return
+	}
+	close(d.stopC)
+	d.wg.Wait()
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package slowop
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseThresholds(t *testing.T) {
+	thresholds, err := ParseThresholds([]interface{}{"OpMetaLookup:50", "Write:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thresholds["OpMetaLookup"] != 50*time.Millisecond || thresholds["Write"] != 0 {
+		t.Fatalf("thresholds %v", thresholds)
+	}
+	for _, bad := range []interface{}{"OpMetaLookup", ":50", "Write:ms", 50} {
+		if _, err = ParseThresholds([]interface{}{bad}); err == nil {
+			t.Fatalf("threshold %v parsed", bad)
+		}
+	}
+}
+
+func TestDetector_Check(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		alerts []*Alert
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		alert := new(Alert)
+		if err := json.Unmarshal(data, alert); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		alerts = append(alerts, alert)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	var nilDetector *Detector
+	if nilDetector.Check("Write", time.Hour, nil) {
+		t.Fatal("nil detector detected a slow op")
+	}
+	d := NewDetector("datanode", "127.0.0.1", 100*time.Millisecond,
+		map[string]time.Duration{"Read": 0, "Write": 10 * time.Millisecond}, server.URL)
+	called := 0
+	request := func() string {
+		called++
+		return "id[1_2_3]"
+	}
+	if d.Check("OpCreateFile", 50*time.Millisecond, request) || d.Check("Read", time.Hour, request) || called != 0 {
+		t.Fatalf("fast or disabled op detected, context called %v times", called)
+	}
+	for i := 0; i < 3; i++ {
+		if !d.Check("Write", 20*time.Millisecond, request) {
+			t.Fatal("slow write not detected")
+		}
+	}
+	d.Check("OpCreateFile", time.Second, request)
+	d.Close()
+
+	counts := make(map[string]uint64)
+	d.Range(func(op string, count uint64) {
+		counts[op] = count
+	})
+	if counts["Write"] != 3 || counts["OpCreateFile"] != 1 || called != 4 {
+		t.Fatalf("counts %v, context called %v times", counts, called)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(alerts) != 2 {
+		t.Fatalf("%v alerts posted, expect one of each op", len(alerts))
+	}
+	a := alerts[0]
+	if a.Op != "Write" || a.Role != "datanode" || a.Count != 1 || a.ThresholdMs != 10 || a.LatencyMs != 20 || a.Request != "id[1_2_3]" {
+		t.Fatalf("alert %+v", a)
+	}
+	if d.Dropped() != 0 {
+		t.Fatalf("%v alerts dropped", d.Dropped())
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package trace
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ExportBatchSpans = 512
+	ExportQueueSpans = 10000
+	ExportInterval   = 5 * time.Second
+	ExportTimeout    = 10 * time.Second
+	ScopeName        = "github.com/tiglabs/containerfs"
+)
+
+var droppedSpans uint64
+
+// Dropped returns the spans not exported since the start, the spans are
+// dropped instead of slowing the ops while the collector can't keep up.
+func Dropped() uint64 {
+	return atomic.LoadUint64(&droppedSpans)
+}
+
+// exporter posts the spans in batches of the OTLP/HTTP json encoding.
+type exporter struct {
+	service  string
+	endpoint string
+	queue    chan *Span
+	client   *http.Client
+	stopC    chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newExporter(service, endpoint string) (e *exporter) {
+	e = &exporter{
+		service:  service,
+		endpoint: endpoint,
+		queue:    make(chan *Span, ExportQueueSpans),
+		client:   &http.Client{Timeout: ExportTimeout},
+		stopC:    make(chan struct{}),
+	}
+	e.wg.Add(1)
+	go e.scheduler()
+	return
+}
+
+func (e *exporter) export(s *Span) {
+	select {
+	case e.queue <- s:
+	default:
+		atomic.AddUint64(&droppedSpans, 1)
+	}
+}
+
+func (e *exporter) scheduler() {
+	defer e.wg.Done()
+	ticker := time.NewTicker(ExportInterval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, ExportBatchSpans)
+	for {
+		select {
+		case s := <-e.queue:
+			if batch = append(batch, s); len(batch) < ExportBatchSpans {
+				continue
+			}
+		case <-ticker.C:
+		case <-e.stopC:
+			for len(e.queue) != 0 {
+				batch = append(batch, <-e.queue)
+			}
+			e.post(batch)
+			return
+		}
+		e.post(batch)
+		batch = batch[:0]
+	}
+}
+
+func (e *exporter) close() {
+	close(e.stopC)
+	e.wg.Wait()
+}
+
+type otlpRequest struct {
+	ResourceSpans []*otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []*otlpScopeSpan `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []*otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpan struct {
+	Scope otlpScope   `json:"scope"`
+	Spans []*otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string           `json:"traceId"`
+	SpanID            string           `json:"spanId"`
+	ParentSpanID      string           `json:"parentSpanId,omitempty"`
+	Name              string           `json:"name"`
+	Kind              int              `json:"kind"`
+	StartTimeUnixNano string           `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string           `json:"endTimeUnixNano"`
+	Attributes        []*otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus      `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+const otlpStatusError = 2
+
+func newOTLPAttribute(key string, value interface{}) *otlpAttribute {
+	a := &otlpAttribute{Key: key}
+	// the 64 bit integers are strings in the json encoding of OTLP
+	switch v := value.(type) {
+	case string:
+		a.Value = map[string]interface{}{"stringValue": v}
+	case bool:
+		a.Value = map[string]interface{}{"boolValue": v}
+	case int:
+		a.Value = map[string]interface{}{"intValue": strconv.FormatInt(int64(v), 10)}
+	case int64:
+		a.Value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case uint32:
+		a.Value = map[string]interface{}{"intValue": strconv.FormatUint(uint64(v), 10)}
+	case uint64:
+		a.Value = map[string]interface{}{"intValue": strconv.FormatUint(v, 10)}
+	case float64:
+		a.Value = map[string]interface{}{"doubleValue": v}
+	default:
+		a.Value = map[string]interface{}{"stringValue": fmt.Sprintf("%v", v)}
+	}
+	return a
+}
+
+func toOTLPSpan(s *Span) (o *otlpSpan) {
+	s.Lock()
+	defer s.Unlock()
+	o = &otlpSpan{
+		TraceID:           hex.EncodeToString(s.ctx.TraceID[:]),
+		SpanID:            hex.EncodeToString(s.ctx.SpanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parent != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	for _, a := range s.attrs {
+		o.Attributes = append(o.Attributes, newOTLPAttribute(a.Key, a.Value))
+	}
+	if s.err != "" {
+		o.Status = &otlpStatus{Code: otlpStatusError, Message: s.err}
+	}
+	return
+}
+
+func (e *exporter) marshal(batch []*Span) ([]byte, error) {
+	scope := &otlpScopeSpan{Scope: otlpScope{Name: ScopeName}, Spans: make([]*otlpSpan, 0, len(batch))}
+	for _, s := range batch {
+		scope.Spans = append(scope.Spans, toOTLPSpan(s))
+	}
+	return json.Marshal(&otlpRequest{ResourceSpans: []*otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []*otlpAttribute{newOTLPAttribute("service.name", e.service)}},
+		ScopeSpans: []*otlpScopeSpan{scope},
+	}}})
+}
+
+func (e *exporter) post(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+	data, err := e.marshal(batch)
+	if err == nil {
+		var resp *http.Response
+		if resp, err = e.client.Post(e.endpoint, "application/json", bytes.NewReader(data)); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				err = fmt.Errorf("status %v", resp.StatusCode)
+			}
+		}
+	}
+	if err != nil {
+		atomic.AddUint64(&droppedSpans, uint64(len(batch)))
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package trace records the spans of the requests across the client, the meta
+// nodes and the data nodes and exports them to an OpenTelemetry collector by
+// OTLP over HTTP. The client starts the traces, the nodes only record the spans
+// of the packets carrying the context of a sampled span.
+package trace
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SpanContextSize      = 25 // bytes of a span context on the wire: trace id, span id and flags
+	FlagSampled     byte = 0x01
+)
+
+// the span kinds of OTLP
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+	SpanKindClient   = 3
+)
+
+// SpanContext identifies a span across the processes, as the traceparent of
+// the W3C trace context.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+func (sc SpanContext) IsSampled() bool {
+	return sc.Flags&FlagSampled != 0
+}
+
+// String returns the traceparent of the span context.
+func (sc SpanContext) String() string {
+	return fmt.Sprintf("00-%x-%x-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+// ParseTraceParent parses the traceparent of the W3C trace context.
+func ParseTraceParent(s string) (sc SpanContext, err error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, fmt.Errorf("bad traceparent %v", s)
+	}
+	var flags []byte
+	if _, err = hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return
+	}
+	if _, err = hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return
+	}
+	if flags, err = hex.DecodeString(parts[3]); err != nil {
+		return
+	}
+	sc.Flags = flags[0]
+	if !sc.IsValid() {
+		err = fmt.Errorf("bad traceparent %v", s)
+	}
+	return
+}
+
+// Marshal writes the span context to the first SpanContextSize bytes of out.
+func (sc SpanContext) Marshal(out []byte) {
+	copy(out[0:16], sc.TraceID[:])
+	copy(out[16:24], sc.SpanID[:])
+	out[24] = sc.Flags
+}
+
+func UnmarshalSpanContext(in []byte) (sc SpanContext) {
+	copy(sc.TraceID[:], in[0:16])
+	copy(sc.SpanID[:], in[16:24])
+	sc.Flags = in[24]
+	return
+}
+
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Span is an op timed in a trace, the methods of a nil Span do nothing so the
+// callers don't check whether the op is traced.
+type Span struct {
+	ctx    SpanContext
+	parent [8]byte
+	name   string
+	kind   int
+	start  time.Time
+	end    time.Time
+	attrs  []Attribute
+	err    string
+	ended  int32
+	tracer *Tracer
+	sync.Mutex
+}
+
+// Tracer starts the spans of the process and exports them once ended.
+type Tracer struct {
+	service  string
+	ratio    float64
+	exporter *exporter
+	rand     *rand.Rand
+	randMu   sync.Mutex
+}
+
+var gTracer atomic.Value // *Tracer
+
+/*the tracer set by Init, nil if tracing is disabled*/
+func getTracer() *Tracer {
+	t, _ := gTracer.Load().(*Tracer)
+	return t
+}
+
+// Init exports the spans of service to the OTLP/HTTP endpoint of a collector,
+// e.g. http://127.0.0.1:4318/v1/traces, and samples ratio of the traces started
+// by the process. An empty endpoint disables tracing.
+func Init(service, endpoint string, ratio float64) {
+	if endpoint == "" {
+		return
+	}
+	var seed [8]byte
+	if _, err := crand.Read(seed[:]); err != nil {
+		binary.BigEndian.PutUint64(seed[:], uint64(time.Now().UnixNano()))
+	}
+	t := &Tracer{
+		service:  service,
+		ratio:    ratio,
+		exporter: newExporter(service, endpoint),
+		rand:     rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(seed[:])))),
+	}
+	if old := getTracer(); old != nil {
+		old.exporter.close()
+	}
+	gTracer.Store(t)
+}
+
+// Close exports the spans ended and stops the tracing.
+func Close() {
+	if t := getTracer(); t != nil {
+		gTracer.Store((*Tracer)(nil))
+		t.exporter.close()
+	}
+}
+
+func (t *Tracer) newIDs(traceID *[16]byte, spanID *[8]byte) {
+	t.randMu.Lock()
+	defer t.randMu.Unlock()
+	if traceID != nil {
+		for *traceID == [16]byte{} {
+			binary.BigEndian.PutUint64(traceID[0:8], t.rand.Uint64())
+			binary.BigEndian.PutUint64(traceID[8:16], t.rand.Uint64())
+		}
+	}
+	for *spanID == [8]byte{} {
+		binary.BigEndian.PutUint64(spanID[:], t.rand.Uint64())
+	}
+}
+
+func (t *Tracer) sampled() bool {
+	t.randMu.Lock()
+	defer t.randMu.Unlock()
+	return t.rand.Float64() < t.ratio
+}
+
+// StartRoot starts the span of a new trace, it returns nil if tracing is
+// disabled or the trace is not sampled.
+func StartRoot(name string, kind int) *Span {
+	t := getTracer()
+	if t == nil || !t.sampled() {
+		return nil
+	}
+	s := &Span{name: name, kind: kind, start: time.Now(), tracer: t}
+	s.ctx.Flags = FlagSampled
+	t.newIDs(&s.ctx.TraceID, &s.ctx.SpanID)
+	return s
+}
+
+// StartChild starts a span of the trace of parent, it returns nil if tracing is
+// disabled or parent is not a sampled span.
+func StartChild(parent SpanContext, name string, kind int) *Span {
+	if !parent.IsValid() || !parent.IsSampled() {
+		return nil
+	}
+	t := getTracer()
+	if t == nil {
+		return nil
+	}
+	s := &Span{name: name, kind: kind, start: time.Now(), tracer: t, parent: parent.SpanID}
+	s.ctx.TraceID = parent.TraceID
+	s.ctx.Flags = parent.Flags
+	t.newIDs(nil, &s.ctx.SpanID)
+	return s
+}
+
+// Context returns the span context passed on to the children of the span, the
+// zero SpanContext for a nil span.
+func (s *Span) Context() (sc SpanContext) {
+	if s == nil {
+		return
+	}
+	return s.ctx
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	s.attrs = append(s.attrs, Attribute{Key: key, Value: value})
+	s.Unlock()
+}
+
+// SetError marks the span failed with err, a nil err does nothing.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.Lock()
+	s.err = err.Error()
+	s.Unlock()
+}
+
+// End ends the span and queues it for the export, only the first End counts.
+func (s *Span) End() {
+	if s == nil || !atomic.CompareAndSwapInt32(&s.ended, 0, 1) {
+		return
+	}
+	s.Lock()
+	s.end = time.Now()
+	s.Unlock()
+	s.tracer.exporter.export(s)
+}
+
+type spanKey struct{}
+
+// NewContext returns ctx carrying the span, or ctx itself for a nil span.
+func NewContext(ctx context.Context, s *Span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, s.ctx)
+}
+
+// FromContext returns the span context carried by ctx, the zero SpanContext if
+// it carries none.
+func FromContext(ctx context.Context) (sc SpanContext) {
+	if ctx == nil {
+		return
+	}
+	sc, _ = ctx.Value(spanKey{}).(SpanContext)
+	return
+}
@@ -0,0 +1,111 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestSpanContext_TraceParent(t *testing.T) {
+	s := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceParent(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sc.IsValid() || !sc.IsSampled() || sc.String() != s {
+		t.Fatalf("span context %v of %v", sc, s)
+	}
+	out := make([]byte, SpanContextSize)
+	sc.Marshal(out)
+	if UnmarshalSpanContext(out) != sc {
+		t.Fatalf("span context %v after marshal", UnmarshalSpanContext(out))
+	}
+	for _, bad := range []string{"", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01", "00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01"} {
+		if _, err = ParseTraceParent(bad); err == nil {
+			t.Fatalf("traceparent %q parsed", bad)
+		}
+	}
+}
+
+func TestTracer_Export(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		reqs []*otlpRequest
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		req := new(otlpRequest)
+		if err := json.Unmarshal(data, req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		reqs = append(reqs, req)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	if StartRoot("untraced", SpanKindInternal) != nil {
+		t.Fatal("span started without tracer")
+	}
+	Init("client", server.URL, 1)
+	root := StartRoot("fs.write", SpanKindInternal)
+	ctx := NewContext(context.Background(), root)
+	child := StartChild(FromContext(ctx), "datanode.write", SpanKindClient)
+	child.SetAttribute("partition", uint32(12))
+	child.SetError(errors.New("timeout"))
+	child.End()
+	root.End()
+	root.End()
+	if StartChild(SpanContext{TraceID: root.Context().TraceID, SpanID: root.Context().SpanID}, "unsampled", SpanKindServer) != nil {
+		t.Fatal("child of an unsampled span started")
+	}
+	Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	spans := make(map[string]*otlpSpan)
+	for _, req := range reqs {
+		for _, rs := range req.ResourceSpans {
+			if rs.Resource.Attributes[0].Value["stringValue"] != "client" {
+				t.Fatalf("resource %+v", rs.Resource.Attributes[0])
+			}
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					spans[s.Name] = s
+				}
+			}
+		}
+	}
+	if len(spans) != 2 {
+		t.Fatalf("exported %v spans, expect 2", len(spans))
+	}
+	r, c := spans["fs.write"], spans["datanode.write"]
+	if r == nil || c == nil || c.TraceID != r.TraceID || c.ParentSpanID != r.SpanID || r.ParentSpanID != "" {
+		t.Fatalf("spans root %+v child %+v", r, c)
+	}
+	if c.Status == nil || c.Status.Code != otlpStatusError || c.Kind != SpanKindClient ||
+		len(c.Attributes) != 1 || c.Attributes[0].Value["intValue"] != "12" {
+		t.Fatalf("child %+v", c)
+	}
+}
@@ -14,7 +14,11 @@
 
 package util
 
-import "regexp"
+import (
+	"net"
+	"regexp"
+	"strings"
+)
 
 const (
 	_  = iota
@@ -63,7 +67,25 @@ func Max(a, b int) int {
 func IP(val interface{}) bool {
 	ip4Pattern := `((25[0-5]|2[0-4]\d|[01]?\d\d?)\.){3}(25[0-5]|2[0-4]\d|[01]?\d\d?)`
 	ip4 := regexpCompile(ip4Pattern)
-	return isMatch(ip4, val)
+	if isMatch(ip4, val) {
+		return true
+	}
+	return isIP6(val)
+}
+
+func isIP6(val interface{}) bool {
+	var s string
+	switch v := val.(type) {
+	case []rune:
+		s = string(v)
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	default:
+		return false
+	}
+	return strings.Contains(s, ":") && net.ParseIP(s) != nil
 }
 
 func regexpCompile(str string) *regexp.Regexp {